@@ -2,7 +2,9 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"io"
+	"os"
 
 	"github.com/sirupsen/logrus"
 	"github.com/vorteil/vorteil/pkg/provisioners/registry"
@@ -11,6 +13,7 @@ import (
 	"github.com/vorteil/vorteil/pkg/ext4"
 	"github.com/vorteil/vorteil/pkg/ova"
 	"github.com/vorteil/vorteil/pkg/provisioners"
+	"github.com/vorteil/vorteil/pkg/provisioners/ipxe"
 	"github.com/vorteil/vorteil/pkg/provisioners/nutanix"
 	"github.com/vorteil/vorteil/pkg/provisioners/vcenter"
 	"github.com/vorteil/vorteil/pkg/xfs"
@@ -22,18 +25,13 @@ import (
 	"github.com/vorteil/vorteil/pkg/vio"
 )
 
-var logger elog.View
-
 func init() {
-	log := &elog.CLI{}
-	logrus.SetFormatter(log)
+	logrus.SetFormatter(&elog.CLI{})
 	logrus.SetLevel(logrus.TraceLevel)
-	logger = log
 }
 
-// cli.SetError() wrapper
+// cli.SetError() wrapper. The error is logged by cli.HandleErrors.
 func setError(err error, statusCode int) {
-	logger.Errorf(err.Error())
 	cli.SetError(err, statusCode)
 }
 
@@ -41,9 +39,6 @@ func main() {
 
 	defer cli.HandleErrors()
 
-	// Init FOSS COMMANDS
-	cli.InitializeCommands()
-
 	// OVA Image Format Added
 	ovaBuilder := func(w io.WriteSeeker, b *vimg.Builder, cfg *vcfg.VCFG) (io.WriteSeeker, error) {
 		return ova.NewWriter(w, b, cfg)
@@ -52,9 +47,19 @@ func main() {
 	vdisk.RegisterNewDiskFormat(ova.ImageFormatOVA, ".ova", 0x200000, 1500, ovaBuilder)
 
 	newExt4 := func(log elog.Logger, tree vio.FileTree, args interface{}) (vimg.FSCompiler, error) {
+		uuid, err := vdisk.FilesystemUUID(args)
+		if err != nil {
+			return nil, err
+		}
+		label, err := vdisk.FilesystemLabel(args, ext4.MaxLabelLength)
+		if err != nil {
+			return nil, err
+		}
 		return ext4.NewCompiler(&ext4.CompilerArgs{
 			Logger:   log,
 			FileTree: tree,
+			UUID:     uuid,
+			Label:    label,
 		}), nil
 	}
 
@@ -65,9 +70,29 @@ func main() {
 	}
 
 	newXFS := func(log elog.Logger, tree vio.FileTree, args interface{}) (vimg.FSCompiler, error) {
+		uuid, err := vdisk.FilesystemUUID(args)
+		if err != nil {
+			return nil, err
+		}
+		label, err := vdisk.FilesystemLabel(args, xfs.MaxLabelLength)
+		if err != nil {
+			return nil, err
+		}
+		var settings vcfg.XFSSettings
+		var quotas []xfs.Quota
+		if cfg, ok := args.(*vcfg.VCFG); ok && cfg != nil {
+			settings = cfg.System.XFS
+			quotas = xfsQuotas(cfg.Quotas)
+		}
 		return xfs.NewCompiler(&xfs.CompilerArgs{
-			Logger:   log,
-			FileTree: tree,
+			Logger:             log,
+			FileTree:           tree,
+			UUID:               uuid,
+			Label:              label,
+			BlockSize:          int64(settings.BlockSize),
+			InodeSize:          int64(settings.InodeSize),
+			DirectoryBlockSize: int64(settings.DirectoryBlockSize),
+			Quotas:             quotas,
 		}), nil
 	}
 
@@ -77,6 +102,18 @@ func main() {
 		return
 	}
 
+	err = vdisk.RegisterFilesystemGrower("ext4", ext4.Grow)
+	if err != nil {
+		setError(err, 1)
+		return
+	}
+
+	err = vdisk.RegisterFilesystemGrower("xfs", xfs.Grow)
+	if err != nil {
+		setError(err, 2)
+		return
+	}
+
 	// Nutanix
 	nutanixFn := func(log elog.View, data []byte) (provisioners.Provisioner, error) {
 		var cfg nutanix.Config
@@ -113,10 +150,59 @@ func main() {
 
 	cli.AddNewProvisionerCmd(vcenter.ProvisionersNewVCenterCmd)
 
-	err = cli.RootCommand.Execute()
+	// iPXE
+	ipxeFn := func(log elog.View, data []byte) (provisioners.Provisioner, error) {
+		var cfg ipxe.Config
+		err := json.Unmarshal(data, &cfg)
+		if err != nil {
+			return nil, err
+		}
+		return ipxe.NewProvisioner(log, &cfg)
+	}
+
+	err = registry.RegisterProvisioner(ipxe.ProvisionerType, ipxeFn)
+	if err != nil {
+		setError(err, 4)
+		return
+	}
+
+	cli.AddNewProvisionerCmd(ipxe.ProvisionersNewIPXECmd)
+
+	err = cli.Execute(os.Args[1:])
 	if err != nil {
+		var exitErr *cli.ExitError
+		if errors.As(err, &exitErr) {
+			setError(exitErr.Err, exitErr.Code)
+			return
+		}
 		setError(err, 5)
 		return
 	}
 
 }
+
+// xfsQuotas converts the quotas declared in a VCFG to their XFS equivalents.
+func xfsQuotas(quotas []vcfg.Quota) []xfs.Quota {
+
+	types := map[vcfg.QuotaType]xfs.QuotaType{
+		vcfg.UserQuota:    xfs.UserQuota,
+		vcfg.GroupQuota:   xfs.GroupQuota,
+		vcfg.ProjectQuota: xfs.ProjectQuota,
+	}
+
+	var x []xfs.Quota
+	for _, q := range quotas {
+		x = append(x, xfs.Quota{
+			Type:       types[q.Type],
+			ID:         q.ID,
+			Path:       q.Path,
+			Space:      int64(q.Space),
+			SoftSpace:  int64(q.SoftSpace),
+			Inodes:     int64(q.Inodes),
+			SoftInodes: int64(q.SoftInodes),
+		})
+	}
+
+	return x
+
+}
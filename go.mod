@@ -12,6 +12,7 @@ require (
 	github.com/aws/aws-sdk-go v1.31.6
 	github.com/beeker1121/goque v2.1.0+incompatible
 	github.com/cavaliercoder/grab v2.0.0+incompatible
+	github.com/cespare/xxhash/v2 v2.1.2
 	github.com/containerd/containerd v1.5.9
 	github.com/containers/image v3.0.2+incompatible
 	github.com/davidminor/uint128 v0.0.0-20141227063632-5745f1bf8041
@@ -50,7 +51,7 @@ require (
 	golang.org/x/crypto v0.0.0-20210322153248-0c34fe9e7dc2
 	golang.org/x/oauth2 v0.0.0-20200107190931-bf48bf16ab8d
 	golang.org/x/sync v0.0.0-20210220032951-036812b2e83c
-	golang.org/x/sys v0.0.0-20211216021012-1d35b9e2eb4e // indirect
+	golang.org/x/sys v0.0.0-20211216021012-1d35b9e2eb4e
 	google.golang.org/api v0.25.0
 	google.golang.org/grpc v1.40.0 // indirect
 	gopkg.in/natefinch/npipe.v2 v2.0.0-20160621034901-c1b8fa8bdcce // indirect
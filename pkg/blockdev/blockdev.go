@@ -0,0 +1,233 @@
+package blockdev
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"unsafe"
+)
+
+const (
+	// SectorSize is the alignment of every write to the device. Direct I/O
+	// requires offsets, lengths and memory to all be aligned to the device's
+	// logical block size, which is never larger than this.
+	SectorSize = 4096
+
+	bufferSize = 0x400000
+)
+
+// IsDevice returns true if path is a block device, rather than a file that
+// can be created or overwritten.
+func IsDevice(path string) bool {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+	return fi.Mode()&os.ModeDevice != 0 && fi.Mode()&os.ModeCharDevice == 0
+}
+
+// alignedBuffer returns a buffer of size bytes whose memory is aligned to
+// SectorSize, as direct I/O requires.
+func alignedBuffer(size int) []byte {
+	buf := make([]byte, size+SectorSize)
+	offset := int(uintptr(unsafe.Pointer(&buf[0])) & (SectorSize - 1))
+	if offset != 0 {
+		offset = SectorSize - offset
+	}
+	return buf[offset : offset+size]
+}
+
+// Device is a block device a disk image is being written to. Writes bypass
+// the page cache where the platform allows it, so that what was written can be
+// read back from the device itself by Verify. Because of that, writes are
+// buffered and only ever reach the device in whole sectors.
+type Device struct {
+	f       *os.File
+	path    string
+	flag    int
+	size    int64
+	buf     []byte
+	n       int
+	written int64
+	hasher  hash.Hash
+	closed  bool
+}
+
+// Open opens the block device at path for writing a disk image to it from the
+// beginning.
+func Open(path string) (*Device, error) {
+
+	if !IsDevice(path) {
+		return nil, fmt.Errorf("'%s' is not a block device", path)
+	}
+
+	return open(path, directFlag)
+
+}
+
+func open(path string, flag int) (*Device, error) {
+
+	f, err := os.OpenFile(path, os.O_WRONLY|flag, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	_, err = f.Seek(0, io.SeekStart)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return &Device{
+		f:      f,
+		path:   path,
+		flag:   flag,
+		size:   size,
+		buf:    alignedBuffer(bufferSize),
+		hasher: sha256.New(),
+	}, nil
+
+}
+
+// Size returns the size of the device in bytes.
+func (d *Device) Size() int64 {
+	return d.size
+}
+
+// Written returns the number of bytes of the image written so far.
+func (d *Device) Written() int64 {
+	return d.written
+}
+
+func (d *Device) flush() error {
+
+	if d.n == 0 {
+		return nil
+	}
+
+	// the end of the image is padded with zeroes to a whole sector
+	n := (d.n + SectorSize - 1) / SectorSize * SectorSize
+	for i := d.n; i < n; i++ {
+		d.buf[i] = 0
+	}
+
+	_, err := d.f.Write(d.buf[:n])
+	if err != nil {
+		return err
+	}
+
+	d.n = 0
+	return nil
+
+}
+
+// Write implements io.Writer.
+func (d *Device) Write(p []byte) (int, error) {
+
+	if d.written+int64(len(p)) > d.size {
+		return 0, fmt.Errorf("image is larger than the device '%s' (%d bytes)", d.path, d.size)
+	}
+
+	var n int
+	for len(p) > 0 {
+		k := copy(d.buf[d.n:], p)
+		_, _ = d.hasher.Write(p[:k])
+		d.n += k
+		d.written += int64(k)
+		n += k
+		p = p[k:]
+
+		if d.n == len(d.buf) {
+			err := d.flush()
+			if err != nil {
+				return n, err
+			}
+		}
+	}
+
+	return n, nil
+
+}
+
+// Close writes anything still buffered, and waits for it to reach the device.
+func (d *Device) Close() error {
+
+	if d.closed {
+		return nil
+	}
+	d.closed = true
+
+	err := d.flush()
+	if err != nil {
+		d.f.Close()
+		return err
+	}
+
+	err = d.f.Sync()
+	if err != nil {
+		d.f.Close()
+		return err
+	}
+
+	return d.f.Close()
+
+}
+
+// Verify reads back everything that was written to the device after it has
+// been closed, and returns an error if it doesn't match.
+func (d *Device) Verify() error {
+
+	if !d.closed {
+		return errors.New("device must be closed before it can be verified")
+	}
+
+	f, err := os.OpenFile(d.path, os.O_RDONLY|d.flag, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	hasher := sha256.New()
+	buf := alignedBuffer(bufferSize)
+	remaining := d.written
+
+	for remaining > 0 {
+		n := int64(len(buf))
+		if remaining < n {
+			n = (remaining + SectorSize - 1) / SectorSize * SectorSize
+		}
+
+		_, err = io.ReadFull(f, buf[:n])
+		if err != nil {
+			return err
+		}
+
+		if remaining < n {
+			n = remaining
+		}
+		_, _ = hasher.Write(buf[:n])
+		remaining -= n
+	}
+
+	if !bytes.Equal(hasher.Sum(nil), d.hasher.Sum(nil)) {
+		return fmt.Errorf("verification failed: data read back from '%s' doesn't match the image written to it", d.path)
+	}
+
+	return nil
+
+}
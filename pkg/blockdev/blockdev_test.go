@@ -0,0 +1,109 @@
+package blockdev
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+	"unsafe"
+)
+
+func TestDevice(t *testing.T) {
+
+	f, err := ioutil.TempFile("", "blockdev")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	// stale data on the device beyond the end of the image is left alone
+	stale := bytes.Repeat([]byte{0xFF}, 4*SectorSize)
+	_, err = f.Write(stale)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	if IsDevice(f.Name()) {
+		t.Errorf("regular file mistaken for a block device")
+	}
+
+	_, err = Open(f.Name())
+	if err == nil {
+		t.Errorf("opened a regular file as a block device")
+	}
+
+	d, err := open(f.Name(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if d.Size() != int64(len(stale)) {
+		t.Errorf("bad device size %d", d.Size())
+	}
+
+	image := bytes.Repeat([]byte("vorteil"), SectorSize/7+1)
+	_, err = d.Write(image[:100])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = d.Write(image[100:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = d.Write(make([]byte, 3*SectorSize))
+	if err == nil {
+		t.Errorf("wrote beyond the end of the device")
+	}
+
+	err = d.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = d.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := make([]byte, 2*SectorSize)
+	copy(expect, image)
+	expect = append(expect, stale[2*SectorSize:]...)
+	if !bytes.Equal(data, expect) {
+		t.Errorf("device has the wrong contents")
+	}
+
+	// corrupt the image on the device
+	data[10]++
+	err = ioutil.WriteFile(f.Name(), data, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = d.Verify()
+	if err == nil {
+		t.Errorf("corrupted device passed verification")
+	}
+
+}
+
+func TestAlignedBuffer(t *testing.T) {
+	for i := 0; i < 8; i++ {
+		buf := alignedBuffer(SectorSize * (i + 1))
+		if uintptr(unsafe.Pointer(&buf[0]))%SectorSize != 0 || len(buf) != SectorSize*(i+1) {
+			t.Errorf("buffer isn't aligned")
+		}
+	}
+}
@@ -0,0 +1,13 @@
+// +build linux
+
+package blockdev
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import "syscall"
+
+// directFlag bypasses the page cache.
+const directFlag = syscall.O_DIRECT
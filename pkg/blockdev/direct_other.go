@@ -0,0 +1,12 @@
+// +build !linux
+
+package blockdev
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+// directFlag is only supported on linux, so elsewhere writes go through the
+// page cache and are flushed to the device when it is closed.
+const directFlag = 0
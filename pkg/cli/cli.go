@@ -7,6 +7,7 @@ package cli
 
 import (
 	"fmt"
+	"sync"
 
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
@@ -14,32 +15,6 @@ import (
 	"github.com/vorteil/vorteil/pkg/elog"
 )
 
-var log elog.View
-
-var (
-	flagJSON             bool
-	flagVerbose          bool
-	flagDebug            bool
-	flagDefault          bool
-	flagCompressionLevel uint
-	flagForce            bool
-	flagExcludeDefault   bool
-	flagFormat           string
-	flagOutput           string
-	flagPlatform         string
-	flagSaveDisk         string
-	flagName             string
-	flagKey              string
-	flagGUI              bool
-	flagOS               bool
-	flagRecord           string
-	flagShell            bool
-	flagTouched          bool
-
-	pushOrganisation string
-	pushBucket       string
-)
-
 const (
 	platformQEMU        = "qemu"
 	platformVirtualBox  = "virtualbox"
@@ -48,25 +23,58 @@ const (
 	platformVMware      = "vmware"
 )
 
-func InitializeCommands() {
+// newRootCmd builds the vorteil command and the whole tree of commands
+// beneath it, with every flag bound to the context.
+func (c *commandContext) newRootCmd() *cobra.Command {
+
+	cmd := &cobra.Command{
+		Use:   "vorteil",
+		Short: "Vorteil's command-line interface",
+		Long: `Vorteil's command-line interface provides a complete set of tools for developers
+to create, test, optimize, and build Vorteil apps.`,
+	}
 
-	// Here we attack VCFG modification flags to relevant commands. Because of
-	// the order Go runs init functions this is the safest place to do this.
-	addModifyFlags(buildCmd.Flags())
-	addModifyFlags(runCmd.Flags())
-	addModifyFlags(provisionCmd.Flags())
-	addModifyFlags(unpackCmd.Flags())
-	addModifyFlags(packCmd.Flags())
+	versionCmd := c.newVersionCmd()
+	imagesCmd := c.newImagesCmd()
+	buildCmd := c.newBuildCmd()
+	decompileCmd := c.newDecompileCmd()
+	provisionCmd := c.newProvisionCmd()
+	packagesCmd := c.newPackagesCmd()
+	packCmd := c.newPackCmd()
+	unpackCmd := c.newUnpackCmd()
+	projectsCmd := c.newProjectsCmd()
+	newProjectCmd := c.newProjectsNewCmd()
+	convertContainerCmd := c.newConvertContainerCmd()
+	importSharedObjectsCmd := c.newImportSharedObjectsCmd()
+	provisionersCmd := c.newProvisionersCmd()
+	provisionersNewCmd := c.newProvisionersNewCmd()
+	runCmd := c.newRunCmd()
+	execCmd := c.newExecCmd()
+	logsCmd := c.newLogsCmd()
+	deployCmd := c.newDeployCmd()
+	repositoriesCmd := c.newRepositoriesCmd()
+	keysCmd := c.newKeysCmd()
+	firecrackerCmd := c.newFirecrackerCmd()
+
+	// Here we attach VCFG modification flags to relevant commands.
+	c.addModifyFlags(buildCmd.Flags())
+	c.addModifyFlags(runCmd.Flags())
+	c.addModifyFlags(execCmd.Flags())
+	c.addModifyFlags(provisionCmd.Flags())
+	c.addModifyFlags(deployCmd.Flags())
+	c.addModifyFlags(unpackCmd.Flags())
+	c.addModifyFlags(packCmd.Flags())
 	// setup logging across all commands
-	RootCommand.PersistentFlags().BoolVarP(&flagVerbose, "verbose", "v", false, "enable verbose output")
-	RootCommand.PersistentFlags().BoolVarP(&flagDebug, "debug", "d", false, "enable debug output")
-	RootCommand.PersistentFlags().BoolVarP(&flagJSON, "json", "j", false, "enable json output")
+	cmd.PersistentFlags().BoolVarP(&c.flagVerbose, "verbose", "v", false, "enable verbose output")
+	cmd.PersistentFlags().BoolVarP(&c.flagDebug, "debug", "d", false, "enable debug output")
+	cmd.PersistentFlags().BoolVar(&c.flagTrace, "trace", false, "enable trace output, including the metadata written into disk images")
+	cmd.PersistentFlags().BoolVarP(&c.flagJSON, "json", "j", false, "enable json output")
 
-	RootCommand.PersistentPreRunE = func(cmd *cobra.Command, args []string) error {
+	cmd.PersistentPreRunE = func(cmd *cobra.Command, args []string) error {
 
 		logger := &elog.CLI{}
 
-		if flagJSON {
+		if c.flagJSON {
 			logger.DisableTTY = true
 			logrus.SetFormatter(&logrus.JSONFormatter{})
 		} else {
@@ -75,84 +83,115 @@ func InitializeCommands() {
 
 		logrus.SetLevel(logrus.TraceLevel)
 
-		if flagDebug {
+		if c.flagTrace {
+			logger.IsTrace = true
 			logger.IsDebug = true
 			logger.IsVerbose = true
-		} else if flagVerbose {
+		} else if c.flagDebug {
+			logger.IsDebug = true
+			logger.IsVerbose = true
+		} else if c.flagVerbose {
 			logger.IsVerbose = true
 		}
 
-		log = logger
+		c.log = logger
 
 		return nil
 	}
 
 	// Here we define some hidden top-level shortcuts.
-	RootCommand.AddCommand(commandShortcut(versionCmd))
-	RootCommand.AddCommand(commandShortcut(buildCmd))
-	RootCommand.AddCommand(commandShortcut(decompileCmd))
-	RootCommand.AddCommand(commandShortcut(provisionCmd))
-	RootCommand.AddCommand(commandShortcut(packCmd))
-	RootCommand.AddCommand(commandShortcut(unpackCmd))
-	RootCommand.AddCommand(commandShortcut(convertContainerCmd))
-	RootCommand.AddCommand(commandShortcut(importSharedObjectsCmd))
+	cmd.AddCommand(commandShortcut(versionCmd))
+	cmd.AddCommand(commandShortcut(buildCmd))
+	cmd.AddCommand(commandShortcut(decompileCmd))
+	cmd.AddCommand(commandShortcut(provisionCmd))
+	cmd.AddCommand(commandShortcut(packCmd))
+	cmd.AddCommand(commandShortcut(unpackCmd))
+	cmd.AddCommand(commandShortcut(convertContainerCmd))
+	cmd.AddCommand(commandShortcut(importSharedObjectsCmd))
 
 	// Here is the visible command structure definition.
-	RootCommand.AddCommand(imagesCmd)
-	RootCommand.AddCommand(packagesCmd)
-	RootCommand.AddCommand(projectsCmd)
-	RootCommand.AddCommand(provisionersCmd)
-	RootCommand.AddCommand(runCmd)
-
-	RootCommand.AddCommand(repositoriesCmd)
-	// RootCommand.AddCommand(initFirecrackerCmd)
-
-	repositoriesCmd.AddCommand(pushCmd)
+	cmd.AddCommand(imagesCmd)
+	cmd.AddCommand(packagesCmd)
+	cmd.AddCommand(projectsCmd)
+	cmd.AddCommand(provisionersCmd)
+	cmd.AddCommand(runCmd)
+	cmd.AddCommand(execCmd)
+	cmd.AddCommand(logsCmd)
+	cmd.AddCommand(deployCmd)
+
+	cmd.AddCommand(repositoriesCmd)
+	cmd.AddCommand(firecrackerCmd)
+
+	repositoriesCmd.AddCommand(c.newPushCmd())
 	repositoriesCmd.AddCommand(keysCmd)
+	repositoriesCmd.AddCommand(c.newMirrorCmd())
 
-	keysCmd.AddCommand(defaultKeyCmd)
-	keysCmd.AddCommand(createKeyCmd)
-	keysCmd.AddCommand(deleteKeyCmd)
-	keysCmd.AddCommand(listKeysCmd)
+	keysCmd.AddCommand(c.newDefaultKeyCmd())
+	keysCmd.AddCommand(c.newCreateKeyCmd())
+	keysCmd.AddCommand(c.newDeleteKeyCmd())
+	keysCmd.AddCommand(c.newListKeysCmd())
 
-	addImagesCmd()
+	imagesCmd.AddCommand(buildCmd)
+	imagesCmd.AddCommand(decompileCmd)
+	imagesCmd.AddCommand(provisionCmd)
+	imagesCmd.AddCommand(c.newCatCmd())
+	imagesCmd.AddCommand(c.newCpCmd())
+	imagesCmd.AddCommand(c.newDuCmd())
+	imagesCmd.AddCommand(c.newFormatCmd())
+	imagesCmd.AddCommand(c.newFsCmd())
+	imagesCmd.AddCommand(c.newFsimgCmd())
+	imagesCmd.AddCommand(c.newGptCmd())
+	imagesCmd.AddCommand(c.newLsCmd())
+	imagesCmd.AddCommand(c.newMd5Cmd())
+	imagesCmd.AddCommand(c.newResizeCmd())
+	imagesCmd.AddCommand(c.newStatCmd())
+	imagesCmd.AddCommand(c.newTreeCmd())
+	imagesCmd.AddCommand(c.newVerifyCmd())
+	imagesCmd.AddCommand(c.newAssertCmd())
+
+	firecrackerCmd.AddCommand(c.newFirecrackerListCmd())
+	firecrackerCmd.AddCommand(c.newFirecrackerFetchCmd())
+	firecrackerCmd.AddCommand(c.newFirecrackerVerifyCmd())
+	firecrackerCmd.AddCommand(c.newFirecrackerPruneCmd())
 
 	packagesCmd.AddCommand(packCmd)
 	packagesCmd.AddCommand(unpackCmd)
 
 	projectsCmd.AddCommand(newProjectCmd)
-	addModifyFlags(newProjectCmd.Flags())
+	c.addModifyFlags(newProjectCmd.Flags())
 
 	projectsCmd.AddCommand(convertContainerCmd)
 	projectsCmd.AddCommand(importSharedObjectsCmd)
 
 	provisionersCmd.AddCommand(provisionersNewCmd)
 
-	provisionersNewCmd.AddCommand(provisionersNewAmazonEC2Cmd)
-	provisionersNewCmd.AddCommand(provisionersNewAzureCmd)
-	provisionersNewCmd.AddCommand(provisionersNewGoogleCmd)
-}
+	provisionersNewCmd.AddCommand(c.newProvisionersNewAmazonEC2Cmd())
+	provisionersNewCmd.AddCommand(c.newProvisionersNewAzureCmd())
+	provisionersNewCmd.AddCommand(c.newProvisionersNewGoogleCmd())
+
+	provisionerCmdsLock.Lock()
+	defer provisionerCmdsLock.Unlock()
+	for _, x := range provisionerCmds {
+		provisionersNewCmd.AddCommand(x)
+	}
+
+	return cmd
 
-// AddNewProvisionerCmd - Append a command to the `vorteil provisioners new` command
-func AddNewProvisionerCmd(newCmd *cobra.Command) {
-	provisionersNewCmd.AddCommand(newCmd)
 }
 
-func addImagesCmd() {
-	imagesCmd.AddCommand(buildCmd)
-	imagesCmd.AddCommand(decompileCmd)
-	imagesCmd.AddCommand(provisionCmd)
-	imagesCmd.AddCommand(catCmd)
-	imagesCmd.AddCommand(cpCmd)
-	imagesCmd.AddCommand(duCmd)
-	imagesCmd.AddCommand(formatCmd)
-	imagesCmd.AddCommand(fsCmd)
-	imagesCmd.AddCommand(fsimgCmd)
-	imagesCmd.AddCommand(gptCmd)
-	imagesCmd.AddCommand(lsCmd)
-	imagesCmd.AddCommand(md5Cmd)
-	imagesCmd.AddCommand(statCmd)
-	imagesCmd.AddCommand(treeCmd)
+// provisionerCmds are the commands added with AddNewProvisionerCmd.
+var (
+	provisionerCmds     []*cobra.Command
+	provisionerCmdsLock sync.Mutex
+)
+
+// AddNewProvisionerCmd - Append a command to the `vorteil provisioners new`
+// command of every command tree built after it is called. Unlike the rest of
+// the tree the command is shared, so it shouldn't keep state between runs.
+func AddNewProvisionerCmd(newCmd *cobra.Command) {
+	provisionerCmdsLock.Lock()
+	defer provisionerCmdsLock.Unlock()
+	provisionerCmds = append(provisionerCmds, newCmd)
 }
 
 func commandShortcut(cmd *cobra.Command) *cobra.Command {
@@ -162,51 +201,48 @@ func commandShortcut(cmd *cobra.Command) *cobra.Command {
 	return &c
 }
 
-var RootCommand = &cobra.Command{
-	Use:   "vorteil",
-	Short: "Vorteil's command-line interface",
-	Long: `Vorteil's command-line interface provides a complete set of tools for developers
-to create, test, optimize, and build Vorteil apps.`,
-}
-
-var versionCmd = &cobra.Command{
-	Use:   "version",
-	Short: "View CLI version information",
-	Long:  "View CLI version information",
-	Args:  cobra.NoArgs,
-	PreRunE: func(cmd *cobra.Command, args []string) error {
-
-		format, err := cmd.Flags().GetString("format")
-		if err != nil {
-			panic(err)
-		}
-
-		switch format {
-		case "json", "", "plain":
-			return nil
-		default:
-			return fmt.Errorf("invalid format '%s'", format)
-		}
-	},
-	Run: func(cmd *cobra.Command, args []string) {
-
-		format, err := cmd.Flags().GetString("format")
-		if err != nil {
-			panic(err)
-		}
+func (c *commandContext) newVersionCmd() *cobra.Command {
+
+	cmd := &cobra.Command{
+		Use:   "version",
+		Short: "View CLI version information",
+		Long:  "View CLI version information",
+		Args:  cobra.NoArgs,
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+
+			format, err := cmd.Flags().GetString("format")
+			if err != nil {
+				panic(err)
+			}
+
+			switch format {
+			case "json", "", "plain":
+				return nil
+			default:
+				return fmt.Errorf("invalid format '%s'", format)
+			}
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+
+			format, err := cmd.Flags().GetString("format")
+			if err != nil {
+				panic(err)
+			}
+
+			switch format {
+			case "json":
+				fmt.Printf("{\n\t\"version\": \"%s\",\n\t\"ref\": \"%s\",\n\t\"released\": \"%s\"\n}\n",
+					release, commit, date)
+			default:
+				fmt.Printf("Version: %s\nRef: %s\nReleased: %s\n", release, commit, date)
+			}
+
+		},
+	}
 
-		switch format {
-		case "json":
-			fmt.Printf("{\n\t\"version\": \"%s\",\n\t\"ref\": \"%s\",\n\t\"released\": \"%s\"\n}\n",
-				release, commit, date)
-		default:
-			fmt.Printf("Version: %s\nRef: %s\nReleased: %s\n", release, commit, date)
-		}
+	f := cmd.Flags()
+	f.String("format", "", "specify output format (json, plain)")
 
-	},
-}
+	return cmd
 
-func init() {
-	f := versionCmd.Flags()
-	f.String("format", "", "specify output format (json, plain)")
 }
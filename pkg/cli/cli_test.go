@@ -11,6 +11,7 @@ import (
 
 func TestHandleFileInjections(t *testing.T) {
 
+	c := newCommandContext(nil)
 	b := vpkg.NewBuilder()
 
 	var testFileNotExists, testDirNotExists string
@@ -28,24 +29,24 @@ func TestHandleFileInjections(t *testing.T) {
 	}
 	defer os.RemoveAll(dir)
 
-	filesMap[f.Name()] = []string{"/test1"}
-	filesMap[dir] = []string{"/test2"}
+	c.filesMap[f.Name()] = []string{"/test1"}
+	c.filesMap[dir] = []string{"/test2"}
 
-	err = handleFileInjections(b)
+	err = c.handleFileInjections(b)
 	if err != nil {
 		t.Fatal(err.Error())
 	}
 
-	delete(filesMap, f.Name())
-	delete(filesMap, dir)
+	delete(c.filesMap, f.Name())
+	delete(c.filesMap, dir)
 
 	testFileNotExists = filepath.Join(f.Name(), "test")
 	testDirNotExists = filepath.Join(dir, "test")
 
-	filesMap[testFileNotExists] = []string{"/test3"}
-	filesMap[testDirNotExists] = []string{"/test4"}
+	c.filesMap[testFileNotExists] = []string{"/test3"}
+	c.filesMap[testDirNotExists] = []string{"/test4"}
 
-	err = handleFileInjections(b)
+	err = c.handleFileInjections(b)
 	if err == nil {
 		t.Fatal("expected failure; source file/dir do not exist")
 	}
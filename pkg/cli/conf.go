@@ -12,7 +12,8 @@ import (
 
 	"github.com/mitchellh/go-homedir"
 	"github.com/sisatech/toml"
-	"github.com/vorteil/vorteil/pkg/vimg"
+	"github.com/vorteil/vorteil/pkg/sdk"
+	"github.com/vorteil/vorteil/pkg/vdisk"
 	"github.com/vorteil/vorteil/pkg/vkern"
 )
 
@@ -22,14 +23,17 @@ type vorteildConf struct {
 		DropPath           string   `toml:"drop-path"`
 		RemoteRepositories []string `toml:"remote-repositories"`
 	} `toml:"kernel-sources"`
+	OSFiles []string `toml:"os-files"`
+	Policy  string   `toml:"policy"`
 }
 
-var ksrc vkern.Manager
-
 type vorteilConfig struct {
 	kernels string
 	watch   string
 	sources []string
+	osFiles []string
+	policy  string
+	cache   string
 }
 
 // loadVorteilConfig : Load vorteil config from ~/.vorteild path.
@@ -45,6 +49,7 @@ func loadVorteilConfig() (vorteilConfig, error) {
 
 	vorteild := filepath.Join(home, ".vorteil")
 	conf := filepath.Join(vorteild, "conf.toml")
+	vCfg.cache = filepath.Join(vorteild, "cache")
 
 	confData, err := ioutil.ReadFile(conf)
 	if err != nil {
@@ -60,6 +65,8 @@ func loadVorteilConfig() (vorteilConfig, error) {
 		vCfg.kernels = vconf.KernelSources.Directory
 		vCfg.watch = vconf.KernelSources.DropPath
 		vCfg.sources = vconf.KernelSources.RemoteRepositories
+		vCfg.osFiles = vconf.OSFiles
+		vCfg.policy = vconf.Policy
 	}
 
 	return vCfg, nil
@@ -77,7 +84,7 @@ func mkDirAllSlice(perm os.FileMode, dirs ...string) error {
 	return nil
 }
 
-func initKernels() error {
+func (c *commandContext) initKernels() error {
 	vCfg, err := loadVorteilConfig()
 	if err != nil {
 		return err
@@ -88,18 +95,22 @@ func initKernels() error {
 		return err
 	}
 
-	ksrc, err = vkern.CLI(vkern.CLIArgs{
+	c.confOSFiles = vCfg.osFiles
+	c.confPolicy = vCfg.policy
+
+	c.ksrc, err = sdk.UseKernels(vkern.CLIArgs{
 		Directory:          vCfg.kernels,
 		DropPath:           vCfg.watch,
 		RemoteRepositories: vCfg.sources,
-	}, log)
+	}, c.log)
 	if err != nil {
 		return err
 	}
 
-	vkern.Global = ksrc
-	vimg.GetKernel = ksrc.Get
-	vimg.GetLatestKernel = vkern.ConstructGetLastestKernelsFunc(&ksrc)
+	c.fsCache, err = vdisk.NewFilesystemCache(filepath.Join(vCfg.cache, "fs"))
+	if err != nil {
+		return err
+	}
 
 	return nil
 
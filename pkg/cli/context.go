@@ -0,0 +1,249 @@
+package cli
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/beeker1121/goque"
+
+	"github.com/vorteil/vorteil/pkg/elog"
+	"github.com/vorteil/vorteil/pkg/vcfg"
+	"github.com/vorteil/vorteil/pkg/vdisk"
+	"github.com/vorteil/vorteil/pkg/vkern"
+)
+
+// commandContext holds everything a single invocation of the CLI sets up and
+// modifies: the values of its flags, the VCFG they build up, its logger and
+// the configuration it loads. Commands are built as closures over a context,
+// so that separate invocations in the same process don't share any of it.
+type commandContext struct {
+	log elog.View
+
+	flagJSON                bool
+	flagVerbose             bool
+	flagDebug               bool
+	flagTrace               bool
+	flagDefault             bool
+	flagCompressionLevel    uint
+	flagHashAlgorithm       string
+	flagForce               bool
+	flagExcludeDefault      bool
+	flagFormat              string
+	flagFormatOptions       []string
+	flagOutput              string
+	flagPlatform            string
+	flagSaveDisk            string
+	flagEphemeral           bool
+	flagExportOnly          string
+	flagName                string
+	flagKey                 string
+	flagGUI                 bool
+	flagOS                  bool
+	flagRecord              string
+	flagKernelArgsExtra     string
+	flagHyperVSwitch        string
+	flagFirecrackerRootless bool
+	flagStrictPorts         bool
+	flagSkipPreflight       bool
+	flagDNS                 []string
+	flagAddHosts            []string
+	flagProgram             string
+	flagShell               bool
+	flagTouched             bool
+	flagBaseline            string
+	flagUpdateBaseline      bool
+	flagAllow               []string
+	flagIcon                string
+	flagVCFG                []string
+	flagInfoDate            string
+	flagInfoURL             string
+	flagSystemFilesystem    string
+	flagSystemOutputMode    string
+	flagSysctl              []string
+	flagVMDiskSize          string
+	flagVMInodes            string
+	flagVMRAM               string
+	flagOSFiles             []string
+	flagNoCache             bool
+	flagChecksums           bool
+	flagManifest            bool
+	flagMeasurements        bool
+	flagPolicy              string
+	flagMaxImageSize        string
+	flagMaxPackageSize      string
+	flagReportTop           int
+	flagTZData              bool
+	flagTemplateValues      []string
+	flagReproducible        bool
+	flagSeed                int64
+	flagSecureBootKey       string
+	flagSecureBootCert      string
+	flagMirrorDestKey       string
+
+	pushOrganisation string
+	pushBucket       string
+
+	provisionName            string
+	provisionDescription     string
+	provisionForce           bool
+	provisionReadyWhenUsable bool
+	provisionPassPhrase      string
+	provisionRetries         int
+	provisionRetryDelay      time.Duration
+	provisionLaunch          string
+	provisionNoPipeline      bool
+
+	provisionersNewPassphrase string
+
+	// Google Cloud Platform
+	provisionersNewGoogleBucket  string
+	provisionersNewGoogleKeyFile string
+	provisionersNewGoogleZone    string
+
+	// Amazon Web Services
+	provisionersNewAmazonKey     string
+	provisionersNewAmazonRegion  string
+	provisionersNewAmazonBucket  string
+	provisionersNewAmazonSecret  string
+	provisionersNewAmazonProfile string
+
+	// Azure
+	provisionersNewAzureContainer          string
+	provisionersNewAzureKeyFile            string
+	provisionersNewAzureLocation           string
+	provisionersNewAzureResourceGroup      string
+	provisionersNewAzureStorageAccountKey  string
+	provisionersNewAzureStorageAccountName string
+
+	// numbersMode determines which format sizes are printed in.
+	numbersMode int
+
+	// overrideVCFG is built up by the VCFG modification flags, and merged
+	// over the VCFG of the app a command is run on.
+	overrideVCFG vcfg.VCFG
+
+	// a key can have multiple destinations
+	// key = src, vals = dst
+	filesMap map[string][]string
+
+	// The number of each repeatable flag to create, which depends on the
+	// indexes the arguments use.
+	maxRedirectFlags int
+	maxNetworkFlags  int
+	maxProgramFlags  int
+	maxNFSFlags      int
+	maxSMBFlags      int
+	maxSyncFlags     int
+	maxLoggingFlags  int
+	maxDiskFlags     int
+	maxPartFlags     int
+	maxNodeFlags     int
+
+	modifyFlags
+
+	ksrc vkern.Manager
+
+	// confOSFiles are extra files to add to the Vorteil OS partition of every
+	// disk built, from the 'os-files' list in the vorteil config.
+	confOSFiles []string
+
+	// confPolicy is the path of a policy every app built must follow, from the
+	// 'policy' setting in the vorteil config.
+	confPolicy string
+
+	// fsCache holds file-systems compiled by previous builds.
+	fsCache *vdisk.FilesystemCache
+
+	// serialOutput is where the serial output of a running virtual machine is
+	// printed.
+	serialOutput io.Writer
+
+	ips *goque.Queue
+
+	// The error a command failed with, and the status the process should
+	// exit with because of it.
+	errorStatusCode    int
+	errorStatusMessage error
+}
+
+// newCommandContext returns a context for running the CLI with args, which
+// are needed up front to know how many of each repeatable flag to create.
+func newCommandContext(args []string) *commandContext {
+
+	c := &commandContext{
+		filesMap:     make(map[string][]string),
+		serialOutput: os.Stdout,
+	}
+
+	c.tallyRepeatableFlags(args)
+	c.initModifyFlags()
+
+	return c
+
+}
+
+// setError records the error a command failed with, and the status the
+// process should exit with.
+func (c *commandContext) setError(err error, code int) {
+	c.errorStatusCode = code
+	c.errorStatusMessage = err
+}
+
+// ExitError is returned by Execute when a command fails.
+type ExitError struct {
+	Code int
+	Err  error
+}
+
+// Error returns the message of the error the command failed with.
+func (e *ExitError) Error() string {
+	if e.Err == nil {
+		return fmt.Sprintf("exit status %d", e.Code)
+	}
+	return e.Err.Error()
+}
+
+// Unwrap returns the error the command failed with.
+func (e *ExitError) Unwrap() error {
+	return e.Err
+}
+
+// Execute runs the vorteil command with args, which don't include the name of
+// the program. Each call builds its own tree of commands and flags, so it can
+// be called more than once from the same process without the flags or VCFG
+// modifications of one call leaking into the next. If a command fails, the
+// error returned is an *ExitError with the status the process should exit
+// with.
+func Execute(args []string) error {
+
+	if args == nil {
+		args = []string{}
+	}
+
+	c := newCommandContext(args)
+
+	cmd := c.newRootCmd()
+	cmd.SetArgs(args)
+
+	err := cmd.Execute()
+	if err != nil {
+		return err
+	}
+
+	if c.errorStatusCode != 0 || c.errorStatusMessage != nil {
+		return &ExitError{
+			Code: c.errorStatusCode,
+			Err:  c.errorStatusMessage,
+		}
+	}
+
+	return nil
+
+}
@@ -0,0 +1,37 @@
+package cli
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCommandContextsAreIndependent(t *testing.T) {
+
+	a := newCommandContext([]string{"build", "--network[2].ip=dhcp"})
+	b := newCommandContext(nil)
+
+	assert.Equal(t, 3, a.maxNetworkFlags)
+	assert.Equal(t, 0, b.maxNetworkFlags)
+
+	f := a.infoNameFlag
+	f.Value = "app"
+
+	err := a.infoNameFlagValidator(f)
+	assert.NoError(t, err)
+	assert.Equal(t, "app", a.overrideVCFG.Info.Name)
+	assert.Equal(t, "", b.overrideVCFG.Info.Name)
+	assert.Equal(t, "", b.infoNameFlag.Value)
+
+}
+
+func TestExecute(t *testing.T) {
+
+	err := Execute([]string{"version", "--format", "invalid"})
+	assert.Error(t, err)
+
+	// the flag from the last call mustn't carry over
+	err = Execute([]string{"version"})
+	assert.NoError(t, err)
+
+}
@@ -10,18 +10,13 @@ import (
 	"github.com/vorteil/vorteil/pkg/vconvert"
 )
 
-func init() {
-	f := convertContainerCmd.Flags()
-	f.StringP("user", "u", "", "container registry user")
-	f.StringP("password", "p", "", "container registry password")
-	f.StringP("config", "c", "", "container registry configuration list")
-}
+func (c *commandContext) newConvertContainerCmd() *cobra.Command {
 
-var convertContainerCmd = &cobra.Command{
-	Use:   "convert-container REPO:APP DESTFOLDER",
-	Args:  cobra.ExactValidArgs(2),
-	Short: "Convert containers into vorteil.io virtual machines",
-	Long: `Convert containers into vorteil.io project folders. This command can convert
+	cmd := &cobra.Command{
+		Use:   "convert-container REPO:APP DESTFOLDER",
+		Args:  cobra.ExactValidArgs(2),
+		Short: "Convert containers into vorteil.io virtual machines",
+		Long: `Convert containers into vorteil.io project folders. This command can convert
 containers from a remote repository as well as from local container runtimes.
 At the moment docker and containerd are supported.
 
@@ -42,22 +37,31 @@ repositories:
   myrepo:
    url: https://myurl
 `,
-	Run: func(cmd *cobra.Command, args []string) {
-		// in case of an error we pass empty user/pwd/config in
-		user, _ := cmd.Flags().GetString("user")
-		pwd, _ := cmd.Flags().GetString("password")
-		config, _ := cmd.Flags().GetString("config")
-
-		cc, err := vconvert.NewContainerConverter(args[0], config, log)
-		if err != nil {
-			SetError(err, 1)
-			return
-		}
-
-		err = cc.ConvertToProject(args[1], user, pwd)
-		if err != nil {
-			SetError(err, 2)
-			return
-		}
-	},
+		Run: func(cmd *cobra.Command, args []string) {
+			// in case of an error we pass empty user/pwd/config in
+			user, _ := cmd.Flags().GetString("user")
+			pwd, _ := cmd.Flags().GetString("password")
+			config, _ := cmd.Flags().GetString("config")
+
+			cc, err := vconvert.NewContainerConverter(args[0], config, c.log)
+			if err != nil {
+				c.setError(err, 1)
+				return
+			}
+
+			err = cc.ConvertToProject(args[1], user, pwd)
+			if err != nil {
+				c.setError(err, 2)
+				return
+			}
+		},
+	}
+
+	f := cmd.Flags()
+	f.StringP("user", "u", "", "container registry user")
+	f.StringP("password", "p", "", "container registry password")
+	f.StringP("config", "c", "", "container registry configuration list")
+
+	return cmd
+
 }
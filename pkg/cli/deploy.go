@@ -0,0 +1,100 @@
+package cli
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/vorteil/vorteil/pkg/vproj"
+)
+
+func (c *commandContext) newDeployCmd() *cobra.Command {
+
+	cmd := &cobra.Command{
+		Use:   "deploy [PROJECT[:TARGET]]",
+		Short: "Build and provision a project target",
+		Long: `Build a project target and provision it to the destination declared by the
+target in the project file. This is equivalent to running 'vorteil provision'
+with the target's provisioner.
+
+Targets declare their destination with the 'provisioner' field, a path to a
+file created with the 'vorteil provisioners new' command. The optional
+'image-name' field is a template used to name the provisioned image, e.g.:
+
+	[[target]]
+	  name = "prod"
+	  vcfgs = ["default.vcfg", "prod.vcfg"]
+	  provisioner = "provisioners/aws"
+	  image-name = "{{.Name}}-{{.Version}}-{{.Date}}"
+
+The fields available to the template are Project, Target, Name, Version,
+Timestamp and Date. The '--name' flag takes precedence over the template.
+
+Example Command:
+ - Deploying the 'prod' target of the project in the current directory:
+ $ vorteil deploy .:prod`,
+		Args: cobra.RangeArgs(0, 1),
+		Run: func(cmd *cobra.Command, args []string) {
+
+			src := "."
+			if len(args) >= 1 {
+				src = args[0]
+			}
+
+			path, target := vproj.Split(src)
+			proj, err := vproj.LoadProject(path)
+			if err != nil {
+				if os.IsNotExist(err) {
+					err = fmt.Errorf("failed to resolve PROJECT '%s'", src)
+				}
+				c.setError(err, 1)
+				return
+			}
+
+			tgt, err := proj.Target(target)
+			if err != nil {
+				c.setError(err, 2)
+				return
+			}
+
+			provisionFile, err := tgt.ProvisionerPath()
+			if err != nil {
+				c.setError(err, 3)
+				return
+			}
+
+			if c.provisionName == "" {
+				cfg, err := tgt.VCFG()
+				if err != nil {
+					c.setError(err, 4)
+					return
+				}
+
+				c.provisionName, err = tgt.RenderImageName(cfg)
+				if err != nil {
+					c.setError(err, 5)
+					return
+				}
+			}
+
+			c.provisionBuildable(src, provisionFile)
+		},
+	}
+
+	f := cmd.Flags()
+	f.StringVarP(&c.flagKey, "key", "k", "", "vrepo authentication key")
+
+	f.StringVarP(&c.provisionName, "name", "n", "", "Name of the resulting image on the remote platform, overriding the target's image-name template.")
+	f.StringVarP(&c.provisionDescription, "description", "D", "", "Description for the resulting image, if supported by the platform.")
+	f.BoolVarP(&c.provisionForce, "force", "f", false, "Force an overwrite if an existing image conflicts with the new.")
+	f.BoolVarP(&c.provisionReadyWhenUsable, "ready-when-usable", "r", false, "Return successfully as soon as the operation is complete, regardless of whether or not the platform is still processing the image.")
+	f.StringVarP(&c.provisionPassPhrase, "passphrase", "s", "", "Passphrase used to decrypt encrypted provisioner data.")
+
+	return cmd
+
+}
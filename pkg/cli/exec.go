@@ -0,0 +1,261 @@
+package cli
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/vorteil/vorteil/pkg/vcfg"
+	"github.com/vorteil/vorteil/pkg/vio"
+	"github.com/vorteil/vorteil/pkg/vpkg"
+)
+
+func (c *commandContext) newExecCmd() *cobra.Command {
+
+	cmd := &cobra.Command{
+		Use:   "exec [flags] -- BINARY [ARGS...]",
+		Short: "Run a single binary as a one-shot virtual machine",
+		Long: `The exec command wraps a single binary in a transient package, runs it in a
+virtual machine, streams its output, and exits with the exit status the
+program reported, much like running a tool from a scratch container.
+
+The binary is placed in the root of the file-system and run with ARGS. Any
+other files it needs, including the shared objects of dynamically linked
+binaries, can be added with --files, and the VM can be configured with the
+same VCFG flags and files accepted by 'vorteil run'.`,
+		Example: `  vorteil exec -- ./tool --arg value
+  vorteil exec --files ./data@/ -- ./tool /data/input.json`,
+		Args: cobra.MinimumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+
+			pkgBuilder, err := execPackageBuilder(args[0], args[1:])
+			if err != nil {
+				c.setError(err, 1)
+				return
+			}
+			defer pkgBuilder.Close()
+
+			err = c.modifyPackageBuilder(pkgBuilder)
+			if err != nil {
+				c.setError(err, 2)
+				return
+			}
+
+			pkgReader, err := vpkg.ReaderFromBuilder(pkgBuilder)
+			if err != nil {
+				c.setError(err, 3)
+				return
+			}
+			defer pkgReader.Close()
+
+			pkgReader, err = vpkg.PeekVCFG(pkgReader)
+			if err != nil {
+				c.setError(err, 4)
+				return
+			}
+
+			cfg, err := vcfg.LoadFile(pkgReader.VCFG())
+			if err != nil {
+				c.setError(err, 5)
+				return
+			}
+
+			pkgReader, err = c.overrideRunNetwork(pkgReader, cfg)
+			if err != nil {
+				c.setError(err, 5)
+				return
+			}
+
+			err = c.initKernels()
+			if err != nil {
+				c.setError(err, 6)
+				return
+			}
+
+			status := new(exitStatusWriter)
+			c.serialOutput = io.MultiWriter(os.Stdout, status)
+			defer func() {
+				c.serialOutput = os.Stdout
+			}()
+
+			name := strings.TrimSuffix(filepath.Base(args[0]), filepath.Ext(args[0]))
+			disk := &diskSource{pkg: pkgReader}
+
+			fn, err := c.platformRunner(c.flagPlatform)
+			if err != nil {
+				c.setError(err, 7)
+				return
+			}
+
+			err = fn(disk, cfg, name, "")
+			if err != nil {
+				c.setError(err, 8)
+				return
+			}
+
+			if code := status.Code(); code != 0 {
+				c.setError(nil, code)
+			}
+
+		},
+	}
+
+	f := cmd.Flags()
+	f.StringVar(&c.flagPlatform, "platform", defaultVirtualizer(), "run a virtual machine with appropriate hypervisor (qemu, firecracker, virtualbox, hyper-v)")
+	f.BoolVar(&c.flagShell, "shell", false, "add a busybox shell environment to the image")
+	f.BoolVar(&c.flagNoCache, "no-cache", false, "don't reuse or cache the compiled file-system")
+	f.StringSliceVar(&c.flagOSFiles, "os-files", nil, "<src>[@<dst>]   add files from the host filesystem to a folder in the Vorteil OS partition (dst defaults to '/')")
+	f.BoolVar(&c.flagTZData, "tzdata", false, "add the host's time-zone database and C.UTF-8 locale to the app, with the local time zone set by system.timezone")
+	f.StringArrayVar(&c.flagTemplateValues, "template-value", nil, "set a value for the app's templates, as name=value")
+	f.StringVar(&c.flagPolicy, "policy", "", "check the app against the rules in this policy file before building it")
+	f.StringVar(&c.flagKernelArgsExtra, "kernel-args-extra", "", "extra kernel arguments to boot with, for virtualizers that boot the kernel directly (firecracker)")
+	f.StringVar(&c.flagHyperVSwitch, "hyperv-switch", "", "attach hyper-v virtual machines to this virtual switch instead of forwarding their ports to localhost through NAT")
+	f.BoolVar(&c.flagFirecrackerRootless, "firecracker-rootless", false, "network firecracker virtual machines with slirp4netns, forwarding their ports to localhost, so they can run without root")
+	f.BoolVar(&c.flagStrictPorts, "strict-ports", false, "fail if a port the virtual machine forwards is in use on the host, instead of forwarding a random free port")
+	f.BoolVar(&c.flagSkipPreflight, "skip-preflight", false, "don't check the host's free memory, disk space and hypervisor support before starting the virtual machine")
+	f.StringSliceVar(&c.flagDNS, "dns", nil, "name servers to use for this run instead of the app's own")
+	f.StringArrayVar(&c.flagAddHosts, "add-host", nil, "NAME:IP   add an entry to the app's /etc/hosts for this run")
+	f.SetInterspersed(false)
+
+	return cmd
+
+}
+
+// execPackageBuilder creates a package builder containing nothing but the
+// binary, configured to run it with args.
+func execPackageBuilder(binary string, args []string) (vpkg.Builder, error) {
+
+	fi, err := os.Stat(binary)
+	if err != nil {
+		return nil, err
+	}
+
+	if !fi.Mode().IsRegular() {
+		return nil, fmt.Errorf("'%s' is not a regular file", binary)
+	}
+
+	f, err := vio.LazyOpen(binary)
+	if err != nil {
+		return nil, err
+	}
+
+	path := "/" + filepath.Base(binary)
+
+	b := vpkg.NewBuilder()
+
+	err = b.AddToFS(path, f)
+	if err != nil {
+		b.Close()
+		return nil, err
+	}
+
+	cfg := &vcfg.VCFG{
+		Programs: []vcfg.Program{{
+			Binary: path,
+			Args:   quoteArgs(args),
+		}},
+	}
+
+	vf, err := cfg.File()
+	if err != nil {
+		b.Close()
+		return nil, err
+	}
+
+	err = b.SetVCFG(vf)
+	if err != nil {
+		b.Close()
+		return nil, err
+	}
+
+	return b, nil
+
+}
+
+// quoteArgs joins args into a single program args string, quoting any that
+// would otherwise be split or unquoted.
+func quoteArgs(args []string) string {
+
+	var quoted []string
+
+	for _, arg := range args {
+		if arg == "" || strings.ContainsAny(arg, " \t\n\"'\\") {
+			arg = strconv.Quote(arg)
+		}
+		quoted = append(quoted, arg)
+	}
+
+	return strings.Join(quoted, " ")
+
+}
+
+// exitStatusPattern matches the line the kernel prints on the serial console
+// when a program exits.
+var exitStatusPattern = regexp.MustCompile(`(?i)\bexit(?:ed)?(?: with)? (?:code|status)[: ]+(-?\d+)`)
+
+// exitStatusWriter scans serial output for program exit status lines,
+// remembering the last status it sees.
+type exitStatusWriter struct {
+	line   []byte
+	code   int
+	exited bool
+}
+
+func (w *exitStatusWriter) Write(p []byte) (int, error) {
+
+	w.line = append(w.line, p...)
+
+	for {
+		i := bytes.IndexByte(w.line, '\n')
+		if i < 0 {
+			break
+		}
+		w.scan(w.line[:i])
+		w.line = w.line[i+1:]
+	}
+
+	return len(p), nil
+
+}
+
+func (w *exitStatusWriter) scan(line []byte) {
+
+	m := exitStatusPattern.FindSubmatch(line)
+	if m == nil {
+		return
+	}
+
+	code, err := strconv.Atoi(string(m[1]))
+	if err != nil {
+		return
+	}
+
+	w.code = code
+	w.exited = true
+
+}
+
+// Code returns the exit status the CLI should exit with: the last status
+// reported by a program, truncated to the range a process can exit with.
+func (w *exitStatusWriter) Code() int {
+
+	w.scan(w.line)
+
+	if !w.exited {
+		return 0
+	}
+
+	return w.code & 0xFF
+
+}
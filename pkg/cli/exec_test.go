@@ -0,0 +1,124 @@
+package cli
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vorteil/vorteil/pkg/vio"
+	"github.com/vorteil/vorteil/pkg/virtualizers"
+)
+
+func TestQuoteArgs(t *testing.T) {
+	assert.Equal(t, "", quoteArgs(nil))
+	assert.Equal(t, "--arg value", quoteArgs([]string{"--arg", "value"}))
+	assert.Equal(t, `"two words" "" "say \"hi\""`, quoteArgs([]string{"two words", "", `say "hi"`}))
+}
+
+func TestExitStatusWriter(t *testing.T) {
+
+	w := new(exitStatusWriter)
+	assert.Equal(t, 0, w.Code())
+
+	_, _ = w.Write([]byte("hello\n[    1.234] program exited with st"))
+	_, _ = w.Write([]byte("atus 3\nbye\n"))
+	assert.Equal(t, 3, w.Code())
+
+	w = new(exitStatusWriter)
+	_, _ = w.Write([]byte("exit code: 257"))
+	assert.Equal(t, 1, w.Code())
+
+}
+
+func TestCheckKernelArgsExtra(t *testing.T) {
+
+	c := newCommandContext(nil)
+
+	c.flagKernelArgsExtra = ""
+	assert.NoError(t, c.checkKernelArgsExtra(platformQEMU))
+
+	c.flagKernelArgsExtra = "loglevel=9"
+	defer func() {
+		c.flagKernelArgsExtra = ""
+	}()
+
+	assert.NoError(t, c.checkKernelArgsExtra(platformFirecracker))
+	assert.Error(t, c.checkKernelArgsExtra(platformQEMU))
+
+	_, err := c.platformRunner(platformVirtualBox)
+	assert.Error(t, err)
+
+}
+
+func TestFormatPortRemaps(t *testing.T) {
+
+	lines := formatPortRemaps([]virtualizers.PortRemap{
+		{NIC: 0, Protocol: "http", Requested: "80", Actual: "40123"},
+		{NIC: 1, Protocol: "udp", Requested: "5353", Actual: "40124"},
+	})
+
+	assert.Equal(t, []string{
+		" • nic0  http  80 → 40123",
+		" • nic1  udp   5353 → 40124",
+	}, lines)
+
+}
+
+func TestParseAddHosts(t *testing.T) {
+
+	entries, err := parseAddHosts([]string{"api.staging:10.0.0.5", "v6.staging:fd00::1"})
+	assert.NoError(t, err)
+	assert.Len(t, entries, 2)
+	assert.Equal(t, "api.staging", entries[0].name)
+	assert.Equal(t, "10.0.0.5", entries[0].ip.String())
+	assert.Equal(t, "fd00::1", entries[1].ip.String())
+
+	for _, bad := range []string{"api.staging", ":10.0.0.5", "api staging:10.0.0.5", "api.staging:nowhere"} {
+		_, err = parseAddHosts([]string{bad})
+		assert.Error(t, err, bad)
+	}
+
+}
+
+func TestAddRunHosts(t *testing.T) {
+
+	entries, err := parseAddHosts([]string{"api.staging:10.0.0.5"})
+	assert.NoError(t, err)
+
+	tree := vio.NewFileTree()
+	defer tree.Close()
+
+	assert.NoError(t, addRunHosts(tree, entries))
+	assert.Equal(t, "127.0.0.1\tlocalhost\n::1\tlocalhost\n10.0.0.5\tapi.staging\n", readTreeFile(t, tree, "./etc/hosts"))
+
+	existing := "10.0.0.1 db"
+	assert.NoError(t, tree.Map("etc/hosts", vio.CustomFile(vio.CustomFileArgs{
+		Name:       "hosts",
+		Size:       len(existing),
+		ModTime:    time.Now(),
+		ReadCloser: ioutil.NopCloser(strings.NewReader(existing)),
+	})))
+
+	assert.NoError(t, addRunHosts(tree, entries))
+	assert.Equal(t, "10.0.0.1 db\n10.0.0.5\tapi.staging\n", readTreeFile(t, tree, "./etc/hosts"))
+
+}
+
+func readTreeFile(t *testing.T, tree vio.FileTree, path string) string {
+
+	var data []byte
+	err := tree.Walk(func(p string, f vio.File) error {
+		if p == path {
+			var err error
+			data, err = ioutil.ReadAll(f)
+			return err
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+
+	return string(data)
+
+}
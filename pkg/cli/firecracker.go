@@ -0,0 +1,205 @@
+package cli
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+
+	"github.com/mitchellh/go-homedir"
+	"github.com/spf13/cobra"
+	"github.com/vorteil/vorteil/pkg/virtualizers/firecracker"
+)
+
+// firecrackerPath returns the directory the vmlinux binaries firecracker boots
+// are stored in.
+func firecrackerPath() (string, error) {
+
+	home, err := homedir.Dir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(home, ".vorteil", "firecracker-vm"), nil
+
+}
+
+func (c *commandContext) newFirecrackerCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "firecracker",
+		Short: "Manage the vmlinux binaries firecracker boots",
+		Long: `Manage the vmlinux binaries firecracker boots. Firecracker can't boot a disk
+image's bootloader, so a vmlinux binary for each kernel version that is run is
+downloaded and kept until it is pruned.`,
+	}
+}
+
+func (c *commandContext) newFirecrackerListCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "list",
+		Short: "List the vmlinux binaries that have been downloaded",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+
+			dir, err := firecrackerPath()
+			if err != nil {
+				c.setError(err, 1)
+				return
+			}
+
+			list, err := firecracker.ListVMLinux(dir)
+			if err != nil {
+				c.setError(err, 2)
+				return
+			}
+
+			if c.flagJSON {
+				data, err := json.MarshalIndent(list, "", "  ")
+				if err != nil {
+					c.setError(err, 3)
+					return
+				}
+				fmt.Println(string(data))
+				return
+			}
+
+			if len(list) == 0 {
+				c.log.Printf("No vmlinux binaries in %s", dir)
+				return
+			}
+
+			table := [][]string{{"", "", ""}, {"KERNEL", "SIZE", "DOWNLOADED"}}
+			for _, v := range list {
+				kernel := v.Kernel.String()
+				if kernel == "" {
+					kernel = v.Name
+				}
+				table = append(table, []string{kernel, c.printableSize(int(v.Size)), v.ModTime.Format("2006-01-02 15:04")})
+			}
+
+			PlainTable(table)
+
+		},
+	}
+}
+
+func (c *commandContext) newFirecrackerFetchCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "fetch KERNEL...",
+		Short: "Download the vmlinux binaries for kernel versions",
+		Long: `Download the vmlinux binaries for kernel versions, so that firecracker can run
+apps built with them without downloading them first, e.g. before going offline.
+Binaries that have already been downloaded are left alone.`,
+		Example: "vorteil firecracker fetch 20.9.1",
+		Args:    cobra.MinimumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+
+			dir, err := firecrackerPath()
+			if err != nil {
+				c.setError(err, 1)
+				return
+			}
+
+			for _, kernel := range args {
+				path, err := firecracker.FetchVMLinux(context.Background(), dir, kernel, c.log)
+				if err != nil {
+					c.setError(err, 2)
+					return
+				}
+				c.log.Printf("%s", path)
+			}
+
+		},
+	}
+}
+
+func (c *commandContext) newFirecrackerVerifyCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "verify",
+		Short: "Check the vmlinux binaries against their published SHA256 sums",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+
+			dir, err := firecrackerPath()
+			if err != nil {
+				c.setError(err, 1)
+				return
+			}
+
+			list, err := firecracker.ListVMLinux(dir)
+			if err != nil {
+				c.setError(err, 2)
+				return
+			}
+
+			var failed int
+			for _, v := range list {
+				ok, err := firecracker.VerifyVMLinux(context.Background(), v)
+				if err != nil {
+					c.log.Errorf("%v", err)
+					failed++
+				} else if ok {
+					c.log.Printf("%s: OK", v.Name)
+				} else {
+					c.log.Warnf("%s: no published checksum to verify against", v.Name)
+				}
+			}
+
+			if failed > 0 {
+				c.setError(fmt.Errorf("%d of %d vmlinux binaries failed verification", failed, len(list)), 3)
+				return
+			}
+
+		},
+	}
+}
+
+func (c *commandContext) newFirecrackerPruneCmd() *cobra.Command {
+
+	var keep int
+
+	cmd := &cobra.Command{
+		Use:   "prune",
+		Short: "Delete the vmlinux binaries of older kernels",
+		Long: `Delete the vmlinux binaries of all but the newest kernels, as well as any
+downloads that were interrupted. Deleted binaries are downloaded again the next
+time an app built with their kernel is run.`,
+		Args: cobra.NoArgs,
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			if keep < 0 {
+				return errors.New("--keep can't be negative")
+			}
+			return nil
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+
+			dir, err := firecrackerPath()
+			if err != nil {
+				c.setError(err, 1)
+				return
+			}
+
+			pruned, err := firecracker.PruneVMLinux(dir, keep)
+			for _, v := range pruned {
+				c.log.Printf("deleted %s", v.Name)
+			}
+			if err != nil {
+				c.setError(err, 2)
+				return
+			}
+
+		},
+	}
+
+	f := cmd.Flags()
+	f.IntVar(&keep, "keep", 1, "number of the newest kernels to keep the vmlinux binaries of")
+
+	return cmd
+
+}
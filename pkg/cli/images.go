@@ -7,6 +7,7 @@ package cli
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"os"
@@ -15,27 +16,35 @@ import (
 	"time"
 
 	"github.com/spf13/cobra"
+	"github.com/vorteil/vorteil/pkg/blockdev"
 	"github.com/vorteil/vorteil/pkg/ext"
 	"github.com/vorteil/vorteil/pkg/imagetools"
+	"github.com/vorteil/vorteil/pkg/vcfg"
 	"github.com/vorteil/vorteil/pkg/vdecompiler"
 	"github.com/vorteil/vorteil/pkg/vdisk"
+	"github.com/vorteil/vorteil/pkg/vimg"
+	"github.com/vorteil/vorteil/pkg/vio"
 	"github.com/vorteil/vorteil/pkg/vpkg"
 )
 
-var imagesCmd = &cobra.Command{
-	Use:   "images",
-	Short: "Commands for creating and interacting with virtual disk images",
-	Long: `The ultimate purpose of any Vorteil app is to become a virtual machine. These
+func (c *commandContext) newImagesCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "images",
+		Short: "Commands for creating and interacting with virtual disk images",
+		Long: `The ultimate purpose of any Vorteil app is to become a virtual machine. These
 commands are responsible for creating the virtual disk images that are an
 important step along the way. These commands also include helper and utility
 functions that operate on existing Vorteil virtual disk images.`,
-	Aliases: []string{"disks"},
+		Aliases: []string{"disks"},
+	}
 }
 
-var buildCmd = &cobra.Command{
-	Use:   "build [BUILDABLE]",
-	Short: "Create a virtual disk image",
-	Long: `Create a virtual disk image for a Vorteil app.
+func (c *commandContext) newBuildCmd() *cobra.Command {
+
+	cmd := &cobra.Command{
+		Use:   "build [BUILDABLE]",
+		Short: "Create a virtual disk image",
+		Long: `Create a virtual disk image for a Vorteil app.
 
 BUILDABLE refers to anything that can be resolved into a usable source for
 building a Vorteil disk vdecompiler. This can include Vorteil project directories and
@@ -48,707 +57,1411 @@ and optional tag as forward-slash separated strings. If BUILDABLE is not
 provided it will be substituted with ".", i.e. the current directory, which
 must be a valid Vorteil project.
 
+BUILDABLE can also be an existing raw disk image, in which case package and
+file-system compilation are skipped and the image is rewrapped as-is in the
+requested format, e.g. to convert a decompiled or third-party disk to vmdk.
+
+BUILDABLE can also be a package in an S3 bucket ("s3://bucket/key"), a
+project in a git repository ("git+https://host/repo.git#tag"), a container
+image to convert into a project ("oci://nginx:latest"), or an app in a
+repository that requires authentication ("vrepo://host/org/bucket/app").
+
+Additional disks declared in the app's vcfg are built in the same format and
+written alongside the image, with the disk's name inserted before the file
+extension, e.g. "app-data.vmdk" for a disk named "data".
+
 Supported disk formats include:
 
-	xva, raw, vmdk, stream-optimized-vmdk, vhd, vhd-dynamic
+	xva, raw, vmdk, stream-optimized-vmdk, vhd, vhd-dynamic, vhdx, qcow2, gcp, azure, iso, ebs
+
+The raw format is written as a sparse file wherever the destination allows it,
+so empty space takes up no room on the host.
+The gcp format is a gzip-compressed tarball containing the disk as disk.raw,
+ready to be uploaded to a Google Cloud Storage bucket and imported as an image.
+The azure format is a fixed VHD padded to a whole number of MiB, ready to be
+uploaded as a page blob and used with 'az image create'.
+The ebs format is a stream of the image's non-empty 512 KiB blocks, each with
+its SHA256 checksum, ready to be written to an EBS snapshot with the EBS
+direct APIs instead of being imported through a helper instance.
+The iso format is a hybrid image that boots when burned to a CD or written
+directly to a USB drive.
+
+If the output is "-" the image is written to stdout instead of a file, so it
+can be piped straight into another tool. Only formats that can be written
+without seeking are supported (raw, vmdk-stream-optimized, gcp and ebs),
+additional disks are skipped, and log messages are written to stderr.
+
+If the output is a block device, e.g. "/dev/sdb", the image is written directly
+to it in the raw format, for flashing an app onto a physical disk or SD card.
+Everything on the device is destroyed, so you are asked to confirm first
+unless '-f' is given. Writes bypass the page cache where possible, and
+everything written is read back from the device afterwards to verify it.
+Additional disks are skipped.
+
+With '--checksums' the SHA256 checksums of each 64 MiB region of the image are
+written to a manifest alongside it, e.g. "app.vmdk.sha256.json", which
+'vorteil images verify' can use to check that a copy of the image wasn't
+corrupted in transit.
+
+With '--manifest' a build manifest is written alongside the image, e.g.
+"app.vmdk.manifest.json", so that the image can be traced back to what it was
+built from. It records digests of the BUILDABLE and the final vcfg, the
+kernel, the number of files in the app, the digest and size of each disk
+written, and the version of the CLI that built them.
+
+With '--max-image-size' the build fails if the image file ends up larger than
+the limit, and with '--max-package-size' it fails before anything is built if
+the app's files add up to more than the limit. Either way the largest files
+and directories in the app are listed, so that size regressions are caught
+before they make uploads slow. An image over its limit is deleted.
+
+With '--report-top N' the N largest files and directories in the app are
+listed before it is built, whatever its size, to help find things that
+shouldn't be there, like test fixtures and caches.
+
+Files can be rendered from Go templates as the app is built, by declaring
+them in its vcfg with a source and a path in its file-system:
+
+	[[templates]]
+	  source = "/etc/app.conf.tmpl"
+	  path = "/etc/app.conf"
+	  values = { level = "info" }
+
+Templates can use {{ .Values.level }}, which '--template-value level=debug'
+overrides, and the environment the app is built in as {{ .Env.NAME }}.
+
+With '--policy' the app is checked against the rules in a policy file before
+it is built, and the build fails listing every rule the app breaks. A policy
+can also be set for every build with 'policy' in the vorteil config. Policies
+are written in TOML, and each rule is optional:
+
+	forbid-privileges = ["root"]    # programs can't run with these privileges
+	require-dns = true              # at least one dns server must be configured
+	forbid-paths = ["**.pem"]       # no file may match these glob patterns
+	require-paths = ["/etc/hosts"]  # these files must be in the app
+
+Some formats accept additional settings with '--format-option key=value':
+
+	qcow2: compress=none|zlib|zstd, backing=PATH
+	vhd-dynamic: parent=PATH
+
+With 'backing' the qcow2 format only contains the clusters that differ from
+the image at PATH, usually a previous build, and qemu reads the rest from it.
+This keeps iterative builds tiny. The backing image can be a raw or qcow2
+image, and is recorded relative to the new image, so keep them together and
+don't change the backing image while images refer to it.
+
+With 'parent' the vhd-dynamic format writes a differencing VHD containing only
+the blocks that differ from the parent VHD at PATH, so that updates to a fleet
+sharing a common base image stay small. The parent must be a fixed or dynamic
+VHD of exactly the same size as the image, so give the app a fixed disk size,
+and it must not be changed once children have been built against it. The
+child expects to find the parent at the same path relative to itself, e.g.
+alongside it, and additional disks are built as ordinary dynamic VHDs.
 `,
-	Aliases: []string{"new", "create", "make"},
-	Args:    cobra.MaximumNArgs(1),
-	Run: func(cmd *cobra.Command, args []string) {
-
-		buildablePath := "."
-		if len(args) >= 1 {
-			buildablePath = args[0]
-		}
-
-		format, err := parseImageFormat(flagFormat)
-		if err != nil {
-			SetError(err, 1)
-			return
-		}
-		suffix := format.Suffix()
-
-		_, base := filepath.Split(strings.TrimSuffix(filepath.ToSlash(buildablePath), "/"))
-		outputPath := filepath.Join(".", strings.TrimSuffix(base, vpkg.Suffix)+suffix)
-		if flagOutput != "" {
-			outputPath = flagOutput
-			if !strings.HasSuffix(outputPath, suffix) {
-				log.Warnf("file name does not end with '%s' file extension", suffix)
-			}
-		}
-
-		err = checkValidNewFileOutput(outputPath, flagForce, "output", "-f")
-		if err != nil {
-			SetError(err, 2)
-			return
-		}
-
-		pkgBuilder, err := getPackageBuilder("BUILDABLE", buildablePath)
-		if err != nil {
-			SetError(err, 3)
-			return
-		}
-		defer pkgBuilder.Close()
-
-		err = modifyPackageBuilder(pkgBuilder)
-		if err != nil {
-			SetError(err, 4)
-			return
-		}
-
-		pkgReader, err := vpkg.ReaderFromBuilder(pkgBuilder)
-		if err != nil {
-			SetError(err, 5)
-			return
-		}
-		defer pkgReader.Close()
-
-		err = initKernels()
-		if err != nil {
-			SetError(err, 6)
-			return
-		}
-
-		f, err := os.Create(outputPath)
-		if err != nil {
-			SetError(err, 7)
-			return
-		}
-		defer f.Close()
-
-		err = vdisk.Build(context.Background(), f, &vdisk.BuildArgs{
-			WithVCFGDefaults: true,
-			PackageReader:    pkgReader,
-			Format:           format,
-			KernelOptions: vdisk.KernelOptions{
-				Shell: flagShell,
-			},
-			Logger: log,
-		})
-		if err != nil {
-			SetError(err, 8)
-			return
-		}
-
-		err = f.Close()
-		if err != nil {
-			SetError(err, 9)
-			return
-		}
-
-		err = pkgReader.Close()
-		if err != nil {
-			SetError(err, 10)
-			return
-		}
-
-		// TODO: progress tracking
-		log.Printf("created image: %s", outputPath)
-
-	},
+		Aliases: []string{"new", "create", "make"},
+		Args:    cobra.MaximumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+
+			buildablePath := "."
+			if len(args) >= 1 {
+				buildablePath = args[0]
+			}
+
+			format, err := parseImageFormat(c.flagFormat)
+			if err != nil {
+				c.setError(err, 1)
+				return
+			}
+
+			device := blockdev.IsDevice(c.flagOutput)
+			if device {
+				if cmd.Flags().Changed("format") && format != vdisk.RAWFormat {
+					c.setError(fmt.Errorf("the %s format can't be written to a block device: only raw images can", format), 1)
+					return
+				}
+				format = vdisk.RAWFormat
+			}
+			suffix := format.Suffix()
+
+			formatOptions, err := vdisk.ParseFormatOptions(c.flagFormatOptions)
+			if err != nil {
+				c.setError(err, 1)
+				return
+			}
+
+			maxImageSize, err := parseSizeBudget("max-image-size", c.flagMaxImageSize)
+			if err != nil {
+				c.setError(err, 1)
+				return
+			}
+
+			maxPackageSize, err := parseSizeBudget("max-package-size", c.flagMaxPackageSize)
+			if err != nil {
+				c.setError(err, 1)
+				return
+			}
+
+			image, err := getRawImage(buildablePath)
+			if err != nil {
+				c.setError(err, 3)
+				return
+			}
+			if image != nil {
+				defer image.Close()
+			}
+
+			stream := c.flagOutput == "-"
+			if stream {
+				if !format.Streamable() {
+					c.setError(fmt.Errorf("the %s format can't be written to stdout: it must be written to a file", format), 1)
+					return
+				}
+				c.streamLogsToStderr()
+			}
+
+			_, base := filepath.Split(strings.TrimSuffix(filepath.ToSlash(buildablePath), "/"))
+			if image != nil {
+				base = strings.TrimSuffix(base, filepath.Ext(base))
+			}
+			outputPath := filepath.Join(".", strings.TrimSuffix(base, vpkg.Suffix)+suffix)
+			if c.flagOutput != "" {
+				outputPath = c.flagOutput
+				if !stream && !device && !strings.HasSuffix(outputPath, suffix) {
+					c.log.Warnf("file name does not end with '%s' file extension", suffix)
+				}
+			}
+
+			if image != nil && isSameFile(outputPath, image.Name()) {
+				c.setError(fmt.Errorf("output '%s' is the same file as BUILDABLE", outputPath), 2)
+				return
+			}
+
+			if !stream && !device {
+				err = checkValidNewFileOutput(outputPath, c.flagForce, "output", "-f")
+				if err != nil {
+					c.setError(err, 2)
+					return
+				}
+			}
+
+			if device && (c.flagChecksums || c.flagManifest || c.flagMeasurements) {
+				c.setError(errors.New("checksums, manifests and measurements can't be written when the image is written to a block device"), 1)
+				return
+			}
+
+			if (stream || device) && maxImageSize != 0 {
+				c.setError(errors.New("--max-image-size can only be checked when the image is written to a file"), 1)
+				return
+			}
+
+			if image != nil && maxPackageSize != 0 {
+				c.setError(errors.New("--max-package-size can't be checked when BUILDABLE is a disk image"), 1)
+				return
+			}
+
+			if c.flagReportTop < 0 {
+				c.setError(fmt.Errorf("invalid value for --report-top: %d", c.flagReportTop), 1)
+				return
+			}
+
+			if image != nil && c.flagReportTop != 0 {
+				c.setError(errors.New("--report-top can't be used when BUILDABLE is a disk image"), 1)
+				return
+			}
+
+			checksumsPath := outputPath + vdisk.ChecksumsSuffix
+			if c.flagChecksums {
+				if stream {
+					c.setError(errors.New("checksums can't be written when the image is written to stdout"), 1)
+					return
+				}
+
+				err = checkValidNewFileOutput(checksumsPath, c.flagForce, "checksums", "-f")
+				if err != nil {
+					c.setError(err, 2)
+					return
+				}
+			}
+
+			manifestPath := outputPath + vdisk.ManifestSuffix
+			if c.flagManifest {
+				if stream {
+					c.setError(errors.New("a manifest can't be written when the image is written to stdout"), 1)
+					return
+				}
+
+				err = checkValidNewFileOutput(manifestPath, c.flagForce, "manifest", "-f")
+				if err != nil {
+					c.setError(err, 2)
+					return
+				}
+			}
+
+			measurementsPath := outputPath + vdisk.MeasurementsSuffix
+			if c.flagMeasurements {
+				if stream {
+					c.setError(errors.New("measurements can't be written when the image is written to stdout"), 1)
+					return
+				}
+
+				if image != nil {
+					c.setError(errors.New("--measurements can't be used when BUILDABLE is a disk image"), 1)
+					return
+				}
+
+				err = checkValidNewFileOutput(measurementsPath, c.flagForce, "measurements", "-f")
+				if err != nil {
+					c.setError(err, 2)
+					return
+				}
+			}
+
+			repro, err := c.reproducible()
+			if err != nil {
+				c.setError(err, 1)
+				return
+			}
+
+			signer, err := c.secureBootSigner()
+			if err != nil {
+				c.setError(err, 1)
+				return
+			}
+
+			buildArgs := &vdisk.BuildArgs{
+				WithVCFGDefaults: true,
+				Format:           format,
+				FormatOptions:    formatOptions,
+				KernelOptions: vdisk.KernelOptions{
+					Shell: c.flagShell,
+				},
+				Logger:       c.log,
+				Reproducible: repro,
+				Signer:       signer,
+			}
+
+			if c.flagChecksums {
+				buildArgs.Checksums = new(vdisk.Checksums)
+			}
+
+			if c.flagMeasurements {
+				buildArgs.Measurements = new(vimg.Measurements)
+			}
+
+			if c.flagManifest {
+				digest, err := projectDigest(buildablePath)
+				if err != nil {
+					c.setError(err, 3)
+					return
+				}
+
+				built := time.Now().UTC()
+				if repro != nil {
+					built = repro.Time.UTC()
+				}
+
+				buildArgs.Manifest = &vdisk.Manifest{
+					Tool: vdisk.ManifestTool{
+						Name:    "vorteil",
+						Version: release,
+						Ref:     commit,
+					},
+					Built: built,
+					Inputs: vdisk.ManifestInputs{
+						Source:        buildablePath,
+						ProjectDigest: digest,
+					},
+				}
+			}
+
+			var pkgReader vpkg.Reader
+			if image != nil {
+				buildArgs.Image = image
+			} else {
+				pkgBuilder, err := c.getPackageBuilder("BUILDABLE", buildablePath)
+				if err != nil {
+					c.setError(err, 3)
+					return
+				}
+				defer pkgBuilder.Close()
+
+				err = c.modifyPackageBuilder(pkgBuilder)
+				if err != nil {
+					c.setError(err, 4)
+					return
+				}
+
+				pkgReader, err = vpkg.ReaderFromBuilder(pkgBuilder)
+				if err != nil {
+					c.setError(err, 5)
+					return
+				}
+				defer pkgReader.Close()
+
+				if maxPackageSize != 0 || c.flagReportTop != 0 {
+					report, err := vio.DiskUsage(pkgReader.FS(), c.flagReportTop)
+					if err != nil {
+						c.setError(err, 5)
+						return
+					}
+
+					if c.flagReportTop != 0 {
+						c.log.Printf("app files add up to %s\n%s", c.printableSize(int(report.Total)), c.formatUsageReport(report))
+					}
+
+					err = c.checkSizeBudget("package", report.Total, maxPackageSize, "max-package-size", pkgReader.FS())
+					if err != nil {
+						c.setError(err, 5)
+						return
+					}
+				}
+
+				err = c.initKernels()
+				if err != nil {
+					c.setError(err, 6)
+					return
+				}
+
+				buildArgs.PackageReader = pkgReader
+				buildArgs.FilesystemCache = c.filesystemCache()
+				buildArgs.ZoneInfo = c.zoneInfo()
+
+				buildArgs.TemplateData, err = c.templateData()
+				if err != nil {
+					c.setError(err, 6)
+					return
+				}
+
+				buildArgs.OSFiles, err = c.osFileTree()
+				if err != nil {
+					c.setError(err, 6)
+					return
+				}
+				if buildArgs.OSFiles != nil {
+					defer buildArgs.OSFiles.Close()
+				}
+
+				buildArgs.Policy, err = c.loadPolicy()
+				if err != nil {
+					c.setError(err, 6)
+					return
+				}
+			}
+
+			if stream {
+				// additional disks have nowhere to go, so they're skipped
+				w, err := vdisk.StreamWriter(os.Stdout)
+				if err != nil {
+					c.setError(err, 7)
+					return
+				}
+
+				err = vdisk.Build(context.Background(), w, buildArgs)
+				if err != nil {
+					c.setError(err, 8)
+					return
+				}
+
+				return
+			}
+
+			if device {
+				if !c.flagForce {
+					err = confirmDeviceWrite(outputPath)
+					if err != nil {
+						c.setError(err, 2)
+						return
+					}
+				}
+
+				// additional disks have nowhere to go, so they're skipped
+				err = c.buildToDevice(outputPath, buildArgs)
+				if err != nil {
+					c.setError(err, 8)
+					return
+				}
+
+				c.log.Printf("wrote image to device: %s", outputPath)
+				return
+			}
+
+			f, err := os.Create(outputPath)
+			if err != nil {
+				c.setError(err, 7)
+				return
+			}
+			defer f.Close()
+
+			disks := &diskFiles{main: outputPath}
+			defer disks.Close()
+			buildArgs.DiskWriter = disks.create
+
+			err = vdisk.Build(context.Background(), f, buildArgs)
+			if err != nil {
+				c.setError(err, 8)
+				return
+			}
+
+			err = f.Close()
+			if err != nil {
+				c.setError(err, 9)
+				return
+			}
+
+			err = disks.Close()
+			if err != nil {
+				c.setError(err, 9)
+				return
+			}
+
+			if maxImageSize != 0 {
+				info, err := os.Stat(outputPath)
+				if err != nil {
+					c.setError(err, 9)
+					return
+				}
+
+				var tree vio.FileTree
+				if pkgReader != nil {
+					tree = pkgReader.FS()
+				}
+
+				err = c.checkSizeBudget("image", info.Size(), maxImageSize, "max-image-size", tree)
+				if err != nil {
+					os.Remove(outputPath)
+					disks.remove()
+					c.setError(err, 9)
+					return
+				}
+			}
+
+			if c.flagChecksums {
+				err = writeManifest(checksumsPath, buildArgs.Checksums)
+				if err != nil {
+					c.setError(err, 9)
+					return
+				}
+			}
+
+			if c.flagManifest {
+				err = writeBuildManifest(manifestPath, buildArgs.Manifest, outputPath, disks, format)
+				if err != nil {
+					c.setError(err, 9)
+					return
+				}
+			}
+
+			if c.flagMeasurements {
+				err = writeManifest(measurementsPath, buildArgs.Measurements)
+				if err != nil {
+					c.setError(err, 9)
+					return
+				}
+			}
+
+			if pkgReader != nil {
+				err = pkgReader.Close()
+				if err != nil {
+					c.setError(err, 10)
+					return
+				}
+			}
+
+			// TODO: progress tracking
+			c.log.Printf("created image: %s", outputPath)
+			for _, path := range disks.paths() {
+				c.log.Printf("created disk: %s", path)
+			}
+			if c.flagChecksums {
+				c.log.Printf("created checksums: %s", checksumsPath)
+			}
+			if c.flagManifest {
+				c.log.Printf("created manifest: %s", manifestPath)
+			}
+			if c.flagMeasurements {
+				c.log.Printf("created measurements: %s", measurementsPath)
+			}
+
+		},
+	}
+
+	f := cmd.Flags()
+	f.BoolVarP(&c.flagForce, "force", "f", false, "force overwrite of existing files")
+	f.StringVarP(&c.flagOutput, "output", "o", "", "path to put image file, '-' for stdout, or a block device to write the image to")
+	f.StringVarP(&c.flagKey, "key", "k", "", "vrepo authentication key")
+	f.StringVar(&c.flagFormat, "format", "vmdk", "disk image format")
+	f.StringArrayVar(&c.flagFormatOptions, "format-option", nil, "format specific option of the form 'key=value', e.g. 'compress=zstd' for qcow2 images")
+	f.BoolVar(&c.flagShell, "shell", false, "add a busybox shell environment to the image")
+	f.BoolVar(&c.flagNoCache, "no-cache", false, "don't reuse or cache the compiled file-system")
+	f.BoolVar(&c.flagChecksums, "checksums", false, "write a manifest of the image's SHA256 checksums alongside it")
+	f.BoolVar(&c.flagManifest, "manifest", false, "write a manifest describing the build's inputs and outputs alongside the image")
+	f.BoolVar(&c.flagMeasurements, "measurements", false, "write the TPM PCR measurements the image is expected to produce when it boots alongside it")
+	f.StringVar(&c.flagPolicy, "policy", "", "check the app against the rules in this policy file before building it")
+	f.StringVar(&c.flagSecureBootKey, "secure-boot-key", "", "sign the image's EFI binaries for secure boot with this private key (needs sbsign)")
+	f.StringVar(&c.flagSecureBootCert, "secure-boot-cert", "", "certificate for the key given by --secure-boot-key")
+	f.StringVar(&c.flagMaxImageSize, "max-image-size", "", "fail the build if the image file is larger than this, e.g. '2GiB'")
+	f.StringVar(&c.flagMaxPackageSize, "max-package-size", "", "fail the build if the app's files add up to more than this, e.g. '500MiB'")
+	f.IntVar(&c.flagReportTop, "report-top", 0, "list the N largest files and directories in the app before building it")
+	f.StringSliceVar(&c.flagOSFiles, "os-files", nil, "<src>[@<dst>]   add files from the host filesystem to a folder in the Vorteil OS partition (dst defaults to '/')")
+	f.BoolVar(&c.flagTZData, "tzdata", false, "add the host's time-zone database and C.UTF-8 locale to the app, with the local time zone set by system.timezone")
+	f.StringArrayVar(&c.flagTemplateValues, "template-value", nil, "set a value for the app's templates, as name=value")
+	f.BoolVar(&c.flagReproducible, "reproducible", false, "build a bit-identical image every time, with timestamps taken from SOURCE_DATE_EPOCH")
+	f.Int64Var(&c.flagSeed, "seed", 0, "seed the GUIDs and UUIDs of a --reproducible build")
+
+	return cmd
+
 }
 
-func init() {
-	f := buildCmd.Flags()
-	f.BoolVarP(&flagForce, "force", "f", false, "force overwrite of existing files")
-	f.StringVarP(&flagOutput, "output", "o", "", "path to put image file")
-	f.StringVarP(&flagKey, "key", "k", "", "vrepo authentication key")
-	f.StringVar(&flagFormat, "format", "vmdk", "disk image format")
-	f.BoolVar(&flagShell, "shell", false, "add a busybox shell environment to the image")
+func (c *commandContext) newDecompileCmd() *cobra.Command {
+
+	cmd := &cobra.Command{
+		Use:   "decompile IMAGE OUTPUT",
+		Short: "Create a usable project directory from a Vorteil disk vdecompiler.",
+		Args:  cobra.ExactArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+
+			srcPath := args[0]
+			outPath := args[1]
+			decompileSpinner := c.log.NewProgress("Decompiling Disk", "", 0)
+			defer decompileSpinner.Finish(true)
+			if err := c.runDecompile(srcPath, outPath, c.flagTouched); err != nil {
+				c.setError(err, 1)
+			}
+			decompileSpinner.Finish(true)
+			c.log.Printf("Decompile Completed")
+		},
+	}
+
+	f := cmd.Flags()
+	f.BoolVarP(&c.flagTouched, "touched", "t", false, "Only extract files that have been 'touched'.")
+
+	return cmd
+
 }
 
-var decompileCmd = &cobra.Command{
-	Use:   "decompile IMAGE OUTPUT",
-	Short: "Create a usable project directory from a Vorteil disk vdecompiler.",
-	Args:  cobra.ExactArgs(2),
-	Run: func(cmd *cobra.Command, args []string) {
-
-		srcPath := args[0]
-		outPath := args[1]
-		decompileSpinner := log.NewProgress("Decompiling Disk", "", 0)
-		defer decompileSpinner.Finish(true)
-		if err := runDecompile(srcPath, outPath, flagTouched); err != nil {
-			SetError(err, 1)
-		}
-		decompileSpinner.Finish(true)
-		log.Printf("Decompile Completed")
-	},
+func (c *commandContext) newCatCmd() *cobra.Command {
+
+	cmd := &cobra.Command{
+		Use:   "cat IMAGE FILEPATH...",
+		Short: "Concatenate files and print on the standard output.",
+		Args:  cobra.MinimumNArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			img := args[0]
+
+			// Create Vorteil Image Object From Image
+			vImageIO, err := vdecompiler.Open(img)
+			if err != nil {
+				c.setError(err, 1)
+				return
+			}
+			defer vImageIO.Close()
+
+			for i := 1; i < len(args); i++ {
+				fpath := args[i]
+
+				// Get Reader
+				rdr, err := imagetools.CatImageFile(vImageIO, fpath, c.flagOS)
+				if err != nil {
+					c.setError(err, 2)
+					return
+				}
+
+				// Copy Contents
+				_, err = io.Copy(os.Stdout, rdr)
+				if err != nil {
+					c.setError(err, 3)
+					return
+				}
+
+			}
+		},
+	}
+
+	f := cmd.Flags()
+	f.BoolVarP(&c.flagOS, "vpartition", "p", false, "Read files from the Vorteil OS partition instead of the file-system partition.")
+
+	return cmd
+
 }
 
-func init() {
-	f := decompileCmd.Flags()
-	f.BoolVarP(&flagTouched, "touched", "t", false, "Only extract files that have been 'touched'.")
+func (c *commandContext) newCpCmd() *cobra.Command {
+
+	cmd := &cobra.Command{
+		Use:   "cp IMAGE SRC_FILEPATH DEST_FILEPATH",
+		Short: "Copy files and directories from an image to your system.",
+		Args:  cobra.ExactArgs(3),
+		Run: func(cmd *cobra.Command, args []string) {
+
+			img := args[0]
+
+			iio, err := vdecompiler.Open(img)
+			if err != nil {
+				c.setError(err, 1)
+				return
+			}
+			defer iio.Close()
+
+			dest := args[2]
+			fpath := args[1]
+
+			err = imagetools.CopyImageFile(iio, fpath, dest, c.flagOS)
+			if err != nil {
+				panic(err)
+			}
+		},
+	}
+
+	f := cmd.Flags()
+	f.BoolVarP(&c.flagOS, "vpartition", "p", false, "Read files from the Vorteil OS partition instead of the file-system partition.")
+
+	return cmd
+
 }
 
-var catCmd = &cobra.Command{
-	Use:   "cat IMAGE FILEPATH...",
-	Short: "Concatenate files and print on the standard output.",
-	Args:  cobra.MinimumNArgs(2),
-	Run: func(cmd *cobra.Command, args []string) {
-		img := args[0]
+func (c *commandContext) newDuCmd() *cobra.Command {
+
+	cmd := &cobra.Command{
+		Use:   "du IMAGE [FILEPATH]",
+		Short: "Calculate file space usage.",
+		Args:  cobra.RangeArgs(1, 2),
+		Run: func(cmd *cobra.Command, args []string) {
+			err := c.setNumbersMode(cmd)
+			if err != nil {
+				c.setError(err, 1)
+				return
+			}
+			img := args[0]
 
-		// Create Vorteil Image Object From Image
-		vImageIO, err := vdecompiler.Open(img)
-		if err != nil {
-			SetError(err, 1)
-			return
-		}
-		defer vImageIO.Close()
+			iio, err := vdecompiler.Open(img)
+			if err != nil {
+				c.setError(err, 2)
+				return
+			}
+			defer iio.Close()
 
-		for i := 1; i < len(args); i++ {
-			fpath := args[i]
+			all, err := cmd.Flags().GetBool("all")
+			if err != nil {
+				c.setError(err, 3)
+				return
+			}
 
-			// Get Reader
-			rdr, err := imagetools.CatImageFile(vImageIO, fpath, flagOS)
+			free, err := cmd.Flags().GetBool("free")
 			if err != nil {
-				SetError(err, 2)
+				c.setError(err, 4)
 				return
 			}
 
-			// Copy Contents
-			_, err = io.Copy(os.Stdout, rdr)
+			maxDepth, err := cmd.Flags().GetInt("max-depth")
 			if err != nil {
-				SetError(err, 3)
+				c.setError(err, 5)
 				return
 			}
 
-		}
-	},
-}
+			table := [][]string{{"", ""}}
 
-func init() {
-	f := catCmd.Flags()
-	f.BoolVarP(&flagOS, "vpartition", "p", false, "Read files from the Vorteil OS partition instead of the file-system partition.")
-}
+			var fpath string = "/"
+			if len(args) > 1 {
+				fpath = args[1]
+			}
 
-var cpCmd = &cobra.Command{
-	Use:   "cp IMAGE SRC_FILEPATH DEST_FILEPATH",
-	Short: "Copy files and directories from an image to your system.",
-	Args:  cobra.ExactArgs(3),
-	Run: func(cmd *cobra.Command, args []string) {
-
-		img := args[0]
-
-		iio, err := vdecompiler.Open(img)
-		if err != nil {
-			SetError(err, 1)
-			return
-		}
-		defer iio.Close()
-
-		dest := args[2]
-		fpath := args[1]
-
-		err = imagetools.CopyImageFile(iio, fpath, dest, flagOS)
-		if err != nil {
-			panic(err)
-		}
-	},
-}
+			duOut, err := imagetools.DUImageFile(iio, fpath, free, maxDepth, all)
+			if err != nil {
+				c.setError(err, 6)
+				return
+			}
 
-func init() {
-	f := cpCmd.Flags()
-	f.BoolVarP(&flagOS, "vpartition", "p", false, "Read files from the Vorteil OS partition instead of the file-system partition.")
-}
+			for i := range duOut.ImageFiles {
+				table = append(table, []string{duOut.ImageFiles[i].FilePath, fmt.Sprintf("%s", c.printableSize(duOut.ImageFiles[i].FileSize))})
+			}
 
-var duCmd = &cobra.Command{
-	Use:   "du IMAGE [FILEPATH]",
-	Short: "Calculate file space usage.",
-	Args:  cobra.RangeArgs(1, 2),
-	Run: func(cmd *cobra.Command, args []string) {
-		err := SetNumberModeFlagCMD(cmd)
-		if err != nil {
-			SetError(err, 1)
-			return
-		}
-		img := args[0]
-
-		iio, err := vdecompiler.Open(img)
-		if err != nil {
-			SetError(err, 2)
-			return
-		}
-		defer iio.Close()
-
-		all, err := cmd.Flags().GetBool("all")
-		if err != nil {
-			SetError(err, 3)
-			return
-		}
-
-		free, err := cmd.Flags().GetBool("free")
-		if err != nil {
-			SetError(err, 4)
-			return
-		}
-
-		maxDepth, err := cmd.Flags().GetInt("max-depth")
-		if err != nil {
-			SetError(err, 5)
-			return
-		}
-
-		table := [][]string{{"", ""}}
-
-		var fpath string = "/"
-		if len(args) > 1 {
-			fpath = args[1]
-		}
-
-		duOut, err := imagetools.DUImageFile(iio, fpath, free, maxDepth, all)
-		if err != nil {
-			SetError(err, 6)
-			return
-		}
-
-		for i := range duOut.ImageFiles {
-			table = append(table, []string{duOut.ImageFiles[i].FilePath, fmt.Sprintf("%s", PrintableSize(duOut.ImageFiles[i].FileSize))})
-		}
-
-		PlainTable(table)
-		if free {
-			log.Printf("Free space: %s", PrintableSize(duOut.FreeSpace))
-		}
-	},
-}
+			PlainTable(table)
+			if free {
+				c.log.Printf("Free space: %s", c.printableSize(duOut.FreeSpace))
+			}
+		},
+	}
 
-func init() {
-	f := duCmd.Flags()
+	f := cmd.Flags()
 	f.BoolP("all", "a", false, "Write counts for all files, not just directories.")
 	f.BoolP("free", "f", false, "Add a free-space estimation at the end.")
 	f.IntP("max-depth", "l", -1, "Print the total only if the file is within a certain depth.")
 	f.StringP("numbers", "n", "short", "Number printing format")
-}
 
-var formatCmd = &cobra.Command{
-	Use:   "format IMAGE",
-	Short: "Image file format information.",
-	Args:  cobra.ExactArgs(1),
-	Run: func(cmd *cobra.Command, args []string) {
-		img := args[0]
-
-		iio, err := vdecompiler.Open(img)
-		if err != nil {
-			SetError(err, 1)
-			return
-		}
-		defer iio.Close()
-
-		format, err := iio.ImageFormat()
-		if err != nil {
-			SetError(err, 2)
-			return
-		}
-
-		log.Printf("Image file format: %s", format)
-	},
-}
+	return cmd
 
-var fsCmd = &cobra.Command{
-	Use:   "fs IMAGE",
-	Short: "Summarize the information in the main file-system's metadata.",
-	Args:  cobra.ExactArgs(1),
-	Run: func(cmd *cobra.Command, args []string) {
-		err := SetNumberModeFlagCMD(cmd)
-		if err != nil {
-			SetError(err, 2)
-			return
-		}
-		iio, err := vdecompiler.Open(args[0])
-		if err != nil {
-			SetError(err, 2)
-			return
-		}
-		defer iio.Close()
-
-		fsReport, err := imagetools.FSImageFile(iio)
-		if err != nil {
-			SetError(err, 3)
-			return
-		}
-
-		log.Printf("First LBA:        \t%s", PrintableSize(fsReport.FirstLBA))
-		log.Printf("Last LBA:         \t%s", PrintableSize(fsReport.LastLBA))
-		log.Printf("Type:             \t%s", fsReport.Type)
-		log.Printf("Block size:       \t%s", PrintableSize(fsReport.BlockSize))
-		log.Printf("Blocks allocated: \t%s / %s", PrintableSize(fsReport.BlocksAllocated), PrintableSize(fsReport.BlocksAvaliable))
-		log.Printf("Inodes allocated: \t%s / %s", PrintableSize(fsReport.InodesAllocated), PrintableSize(fsReport.InodesAvaliable))
-
-		log.Printf("Block groups:     \t%s", PrintableSize(fsReport.BlockGroups))
-		log.Printf("  Max blocks each:\t%s", PrintableSize(fsReport.MaxBlock))
-		log.Printf("  Max inodes each:\t%s", PrintableSize(fsReport.MaxInodes))
-
-		// TODO: log.Printf("Expansion ceiling: %s")
-		log.Printf("Last mount time:  \t%s", fsReport.LastMountTime)
-		log.Printf("Last written time:\t%s", fsReport.LastWriteTime)
-
-		// TODO: files
-		// TODO: dirs
-		// TODO: free space
-	},
 }
 
-func init() {
-	f := fsCmd.Flags()
-	f.StringP("numbers", "n", "short", "Number printing format")
-}
+func (c *commandContext) newFormatCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "format IMAGE",
+		Short: "Image file format information.",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			img := args[0]
 
-var fsimgCmd = &cobra.Command{
-	Use:   "fsimg IMAGE DEST",
-	Short: "Copy the image's file-system partition.",
-	Args:  cobra.ExactArgs(2),
-	Run: func(cmd *cobra.Command, args []string) {
-		img := args[0]
-		dst := args[1]
-
-		iio, err := vdecompiler.Open(img)
-		if err != nil {
-			SetError(err, 1)
-			return
-		}
-		defer iio.Close()
-
-		if err := imagetools.FSIMGImage(iio, dst); err != nil {
-			SetError(err, 2)
-
-		}
-	},
-}
+			iio, err := vdecompiler.Open(img)
+			if err != nil {
+				c.setError(err, 1)
+				return
+			}
+			defer iio.Close()
 
-var gptCmd = &cobra.Command{
-	Use:   "gpt IMAGE",
-	Short: "Summarize the information in the GUID Partition Table.",
-	Args:  cobra.ExactArgs(1),
-	Run: func(cmd *cobra.Command, args []string) {
-		err := SetNumberModeFlagCMD(cmd)
-		if err != nil {
-			SetError(err, 1)
-			return
-		}
-		img := args[0]
-
-		iio, err := vdecompiler.Open(img)
-		if err != nil {
-			SetError(err, 2)
-			return
-		}
-		defer iio.Close()
-
-		gptOut, err := imagetools.ImageGPT(iio)
-		if err != nil {
-			SetError(err, 3)
-			return
-		}
-
-		log.Printf("GPT Header LBA:   \t%s", PrintableSize(gptOut.HeaderLBA))
-		log.Printf("Backup LBA:       \t%s", PrintableSize(gptOut.BackupLBA))
-		log.Printf("First usable LBA: \t%s", PrintableSize(gptOut.FirstUsableLBA))
-		log.Printf("Last usable LBA:  \t%s", PrintableSize(gptOut.LastUsableLBA))
-		log.Printf("First entries LBA:\t%s", PrintableSize(gptOut.FirstEntriesLBA))
-		log.Printf("Entries:")
-		for i, entry := range gptOut.Entries {
-			log.Printf("  %d: %s", i, entry.Name)
-			log.Printf("     First LBA:\t%s", PrintableSize(int(entry.FirstLBA)))
-			log.Printf("     Last LBA: \t%s", PrintableSize(int(entry.LastLBA)))
-		}
-	},
-}
+			format, err := iio.ImageFormat()
+			if err != nil {
+				c.setError(err, 2)
+				return
+			}
 
-func init() {
-	f := gptCmd.Flags()
-	f.StringP("numbers", "n", "short", "Number printing format")
+			c.log.Printf("Image file format: %s", format)
+		},
+	}
 }
 
-var lsCmd = &cobra.Command{
-	Use:   "ls IMAGE [FILEPATH]",
-	Short: "List directory contents.",
-	Args:  cobra.RangeArgs(1, 2),
-	Run: func(cmd *cobra.Command, args []string) {
-		err := SetNumberModeFlagCMD(cmd)
-		if err != nil {
-			SetError(err, 1)
-			return
-		}
-		var reiterating bool
+func (c *commandContext) newFsCmd() *cobra.Command {
+
+	cmd := &cobra.Command{
+		Use:   "fs IMAGE",
+		Short: "Summarize the information in the main file-system's metadata.",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			err := c.setNumbersMode(cmd)
+			if err != nil {
+				c.setError(err, 2)
+				return
+			}
+			iio, err := vdecompiler.Open(args[0])
+			if err != nil {
+				c.setError(err, 2)
+				return
+			}
+			defer iio.Close()
+
+			fsReport, err := imagetools.FSImageFile(iio)
+			if err != nil {
+				c.setError(err, 3)
+				return
+			}
 
-		all, err := cmd.Flags().GetBool("all")
-		if err != nil {
-			panic(err)
-		}
+			c.log.Printf("First LBA:        \t%s", c.printableSize(fsReport.FirstLBA))
+			c.log.Printf("Last LBA:         \t%s", c.printableSize(fsReport.LastLBA))
+			c.log.Printf("Type:             \t%s", fsReport.Type)
+			c.log.Printf("Block size:       \t%s", c.printableSize(fsReport.BlockSize))
+			c.log.Printf("Blocks allocated: \t%s / %s", c.printableSize(fsReport.BlocksAllocated), c.printableSize(fsReport.BlocksAvaliable))
+			c.log.Printf("Inodes allocated: \t%s / %s", c.printableSize(fsReport.InodesAllocated), c.printableSize(fsReport.InodesAvaliable))
 
-		almostAll, err := cmd.Flags().GetBool("almost-all")
-		if err != nil {
-			panic(err)
-		}
+			c.log.Printf("Block groups:     \t%s", c.printableSize(fsReport.BlockGroups))
+			c.log.Printf("  Max blocks each:\t%s", c.printableSize(fsReport.MaxBlock))
+			c.log.Printf("  Max inodes each:\t%s", c.printableSize(fsReport.MaxInodes))
 
-		long, err := cmd.Flags().GetBool("long")
-		if err != nil {
-			panic(err)
-		}
+			// TODO: log.Printf("Expansion ceiling: %s")
+			c.log.Printf("Last mount time:  \t%s", fsReport.LastMountTime)
+			c.log.Printf("Last written time:\t%s", fsReport.LastWriteTime)
 
-		recursive, err := cmd.Flags().GetBool("recursive")
-		if err != nil {
-			panic(err)
-		}
+			// TODO: files
+			// TODO: dirs
+			// TODO: free space
+		},
+	}
 
-		img := args[0]
+	f := cmd.Flags()
+	f.StringP("numbers", "n", "short", "Number printing format")
 
-		iio, err := vdecompiler.Open(img)
-		if err != nil {
-			SetError(err, 2)
-			return
-		}
-		defer iio.Close()
+	return cmd
 
-		var fpaths []string
-		var inos []int
-		var inodes []*ext.Inode
-		var table [][]string
-		var entries []*vdecompiler.DirectoryEntry
+}
 
-		var fpath string = "/"
-		if len(args) > 1 {
-			fpath = args[1]
-		}
+func (c *commandContext) newFsimgCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "fsimg IMAGE DEST",
+		Short: "Copy the image's file-system partition.",
+		Args:  cobra.ExactArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			img := args[0]
+			dst := args[1]
 
-		if flagOS {
-			if fpath != "/" && fpath != "" && fpath != "." {
-				SetError(fmt.Errorf("bad FILE_PATH for vorteil partition: %s", fpath), 3)
+			iio, err := vdecompiler.Open(img)
+			if err != nil {
+				c.setError(err, 1)
 				return
 			}
+			defer iio.Close()
 
-			kfiles, err := iio.KernelFiles()
+			if err := imagetools.FSIMGImage(iio, dst); err != nil {
+				c.setError(err, 2)
+
+			}
+		},
+	}
+}
+
+func (c *commandContext) newGptCmd() *cobra.Command {
+
+	cmd := &cobra.Command{
+		Use:   "gpt IMAGE",
+		Short: "Summarize the information in the GUID Partition Table.",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			err := c.setNumbersMode(cmd)
 			if err != nil {
-				SetError(err, 4)
+				c.setError(err, 1)
 				return
 			}
+			img := args[0]
 
-			if long {
-				var table [][]string
-				table = [][]string{{"", "", "", "", "", "", ""}}
-				for _, kf := range kfiles {
-					table = append(table, []string{"----------", "?", "-", "-", "-", fmt.Sprintf("%s", PrintableSize(kf.Size)), kf.Name})
-				}
-				PlainTable(table)
-			} else {
-				for _, kf := range kfiles {
-					log.Printf("%s", kf.Name)
-				}
+			iio, err := vdecompiler.Open(img)
+			if err != nil {
+				c.setError(err, 2)
+				return
 			}
-			return
-		}
-
-		ino, err := iio.ResolvePathToInodeNo(fpath)
-		if err != nil {
-			SetError(err, 5)
-			return
-		}
+			defer iio.Close()
 
-	inoEntry:
-		inode, err := iio.ResolveInode(ino)
-		if err != nil {
-			SetError(err, 6)
-			return
-		}
+			gptOut, err := imagetools.ImageGPT(iio)
+			if err != nil {
+				c.setError(err, 3)
+				return
+			}
 
-	inodeEntry:
-		if !vdecompiler.InodeIsDirectory(inode) {
-			if reiterating {
-				goto skip
+			c.log.Printf("GPT Header LBA:   \t%s", c.printableSize(gptOut.HeaderLBA))
+			c.log.Printf("Backup LBA:       \t%s", c.printableSize(gptOut.BackupLBA))
+			c.log.Printf("First usable LBA: \t%s", c.printableSize(gptOut.FirstUsableLBA))
+			c.log.Printf("Last usable LBA:  \t%s", c.printableSize(gptOut.LastUsableLBA))
+			c.log.Printf("First entries LBA:\t%s", c.printableSize(gptOut.FirstEntriesLBA))
+			c.log.Printf("Entries:")
+			for i, entry := range gptOut.Entries {
+				c.log.Printf("  %d: %s", i, entry.Name)
+				c.log.Printf("     First LBA:\t%s", c.printableSize(int(entry.FirstLBA)))
+				c.log.Printf("     Last LBA: \t%s", c.printableSize(int(entry.LastLBA)))
 			}
+		},
+	}
+
+	f := cmd.Flags()
+	f.StringP("numbers", "n", "short", "Number printing format")
 
-			// TODO: log.Info info about files
-			return
-		}
+	return cmd
 
-		if reiterating {
-			log.Infof("")
-		}
+}
 
-		entries, err = iio.Readdir(inode)
-		if err != nil {
-			SetError(err, 7)
-			return
-		}
+func (c *commandContext) newLsCmd() *cobra.Command {
 
-		if recursive {
-			log.Printf("%s:", fpath)
-		}
+	cmd := &cobra.Command{
+		Use:   "ls IMAGE [FILEPATH]",
+		Short: "List directory contents.",
+		Args:  cobra.RangeArgs(1, 2),
+		Run: func(cmd *cobra.Command, args []string) {
+			err := c.setNumbersMode(cmd)
+			if err != nil {
+				c.setError(err, 1)
+				return
+			}
+			var reiterating bool
 
-		if long {
-			table = [][]string{{"", "", "", "", "", "", ""}}
-		}
+			all, err := cmd.Flags().GetBool("all")
+			if err != nil {
+				panic(err)
+			}
 
-		for _, entry := range entries {
-			if !(all || almostAll) && strings.HasPrefix(entry.Name, ".") {
-				continue
+			almostAll, err := cmd.Flags().GetBool("almost-all")
+			if err != nil {
+				panic(err)
 			}
-			if almostAll && (entry.Name == "." || entry.Name == "..") {
-				continue
+
+			long, err := cmd.Flags().GetBool("long")
+			if err != nil {
+				panic(err)
 			}
 
-			if recursive && !(entry.Name == "." || entry.Name == "..") {
-				fpaths = append(fpaths, filepath.ToSlash(filepath.Join(fpath, entry.Name)))
+			recursive, err := cmd.Flags().GetBool("recursive")
+			if err != nil {
+				panic(err)
 			}
 
-			if long {
-				child, err := iio.ResolveInode(entry.Inode)
+			img := args[0]
+
+			iio, err := vdecompiler.Open(img)
+			if err != nil {
+				c.setError(err, 2)
+				return
+			}
+			defer iio.Close()
+
+			var fpaths []string
+			var inos []int
+			var inodes []*ext.Inode
+			var table [][]string
+			var entries []*vdecompiler.DirectoryEntry
+
+			var fpath string = "/"
+			if len(args) > 1 {
+				fpath = args[1]
+			}
+
+			if c.flagOS {
+				if fpath != "/" && fpath != "" && fpath != "." {
+					c.setError(fmt.Errorf("bad FILE_PATH for vorteil partition: %s", fpath), 3)
+					return
+				}
+
+				kfiles, err := iio.KernelFiles()
 				if err != nil {
-					SetError(err, 8)
+					c.setError(err, 4)
 					return
 				}
-				links := "?"
 
-				var uid, gid string
-				uid = fmt.Sprintf("%d", child.UID)
-				gid = fmt.Sprintf("%d", child.GID)
+				if long {
+					var table [][]string
+					table = [][]string{{"", "", "", "", "", "", ""}}
+					for _, kf := range kfiles {
+						table = append(table, []string{"----------", "?", "-", "-", "-", fmt.Sprintf("%s", c.printableSize(kf.Size)), kf.Name})
+					}
+					PlainTable(table)
+				} else {
+					for _, kf := range kfiles {
+						c.log.Printf("%s", kf.Name)
+					}
+				}
+				return
+			}
+
+			ino, err := iio.ResolvePathToInodeNo(fpath)
+			if err != nil {
+				c.setError(err, 5)
+				return
+			}
+
+		inoEntry:
+			inode, err := iio.ResolveInode(ino)
+			if err != nil {
+				c.setError(err, 6)
+				return
+			}
+
+		inodeEntry:
+			if !vdecompiler.InodeIsDirectory(inode) {
+				if reiterating {
+					goto skip
+				}
+
+				// TODO: log.Info info about files
+				return
+			}
+
+			if reiterating {
+				c.log.Infof("")
+			}
+
+			entries, err = iio.Readdir(inode)
+			if err != nil {
+				c.setError(err, 7)
+				return
+			}
+
+			if recursive {
+				c.log.Printf("%s:", fpath)
+			}
 
-				ts := fmt.Sprintf("%s", time.Unix(int64(child.ModificationTime), 0))
-				size := fmt.Sprintf("%s", PrintableSize(vdecompiler.InodeSize(inode)))
+			if long {
+				table = [][]string{{"", "", "", "", "", "", ""}}
+			}
 
-				table = append(table, []string{vdecompiler.InodePermissionsString(child), links, uid, gid, ts, size, entry.Name})
+			for _, entry := range entries {
+				if !(all || almostAll) && strings.HasPrefix(entry.Name, ".") {
+					continue
+				}
+				if almostAll && (entry.Name == "." || entry.Name == "..") {
+					continue
+				}
 
 				if recursive && !(entry.Name == "." || entry.Name == "..") {
-					inodes = append(inodes, child)
+					fpaths = append(fpaths, filepath.ToSlash(filepath.Join(fpath, entry.Name)))
 				}
-			} else {
 
-				if recursive {
-					log.Printf("  %s", entry.Name)
-					if !(entry.Name == "." || entry.Name == "..") {
-						inos = append(inos, entry.Inode)
+				if long {
+					child, err := iio.ResolveInode(entry.Inode)
+					if err != nil {
+						c.setError(err, 8)
+						return
+					}
+					links := "?"
+
+					var uid, gid string
+					uid = fmt.Sprintf("%d", child.UID)
+					gid = fmt.Sprintf("%d", child.GID)
+
+					ts := fmt.Sprintf("%s", time.Unix(int64(child.ModificationTime), 0))
+					size := fmt.Sprintf("%s", c.printableSize(int(vdecompiler.InodeSize(inode))))
+
+					table = append(table, []string{vdecompiler.InodePermissionsString(child), links, uid, gid, ts, size, entry.Name})
+
+					if recursive && !(entry.Name == "." || entry.Name == "..") {
+						inodes = append(inodes, child)
 					}
 				} else {
-					log.Printf("%s", entry.Name)
+
+					if recursive {
+						c.log.Printf("  %s", entry.Name)
+						if !(entry.Name == "." || entry.Name == "..") {
+							inos = append(inos, entry.Inode)
+						}
+					} else {
+						c.log.Printf("%s", entry.Name)
+					}
 				}
+
 			}
 
-		}
+			if long {
+				PlainTable(table)
+			}
 
-		if long {
-			PlainTable(table)
-		}
-
-	skip:
-		if recursive {
-			reiterating = true
-			if len(fpaths) > 0 {
-				fpath = fpaths[0]
-				fpaths = fpaths[1:]
-			}
-			if len(inos) > 0 {
-				ino = inos[0]
-				inos = inos[1:]
-				goto inoEntry
-			}
-			if len(inodes) > 0 {
-				inode = inodes[0]
-				inodes = inodes[1:]
-				goto inodeEntry
-			}
-		}
-	},
-}
+		skip:
+			if recursive {
+				reiterating = true
+				if len(fpaths) > 0 {
+					fpath = fpaths[0]
+					fpaths = fpaths[1:]
+				}
+				if len(inos) > 0 {
+					ino = inos[0]
+					inos = inos[1:]
+					goto inoEntry
+				}
+				if len(inodes) > 0 {
+					inode = inodes[0]
+					inodes = inodes[1:]
+					goto inodeEntry
+				}
+			}
+		},
+	}
 
-func init() {
-	f := lsCmd.Flags()
-	f.BoolVarP(&flagOS, "vpartition", "p", false, "Read files from the Vorteil OS partition instead of the file-system partition.")
+	f := cmd.Flags()
+	f.BoolVarP(&c.flagOS, "vpartition", "p", false, "Read files from the Vorteil OS partition instead of the file-system partition.")
 	f.BoolP("all", "a", false, "Do not ignore entries starting with \".\".")
 	f.BoolP("almost-all", "A", false, "Do not list implied \".\" and \"..\".")
 	f.BoolP("long", "l", false, "Use a long listing format.")
 	f.BoolP("recursive", "R", false, "List subdirectories recursively.")
 	f.StringP("numbers", "n", "short", "Number printing format")
-}
 
-var md5Cmd = &cobra.Command{
-	Use:   "md5 IMAGE FILEPATH",
-	Short: "Compute MD5 checksum for a file on an vdecompiler.",
-	Args:  cobra.ExactArgs(2),
-	Run: func(cmd *cobra.Command, args []string) {
-		img := args[0]
-
-		fpath := args[1]
-		imageFileMD5, err := imagetools.MDSumImageFile(img, fpath, flagOS)
-		if err != nil {
-			SetError(err, 1)
-			return
-		}
-
-		log.Printf("%s", imageFileMD5)
-	},
+	return cmd
+
 }
 
-func init() {
-	f := md5Cmd.Flags()
-	f.BoolVarP(&flagOS, "vpartition", "p", false, "Read files from the Vorteil OS partition instead of the file-system partition.")
+func (c *commandContext) newMd5Cmd() *cobra.Command {
+
+	cmd := &cobra.Command{
+		Use:   "md5 IMAGE FILEPATH",
+		Short: "Compute MD5 checksum for a file on an vdecompiler.",
+		Args:  cobra.ExactArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			img := args[0]
+
+			fpath := args[1]
+			imageFileMD5, err := imagetools.MDSumImageFile(img, fpath, c.flagOS)
+			if err != nil {
+				c.setError(err, 1)
+				return
+			}
+
+			c.log.Printf("%s", imageFileMD5)
+		},
+	}
+
+	f := cmd.Flags()
+	f.BoolVarP(&c.flagOS, "vpartition", "p", false, "Read files from the Vorteil OS partition instead of the file-system partition.")
 	f.StringP("numbers", "n", "short", "Number printing format")
+
+	return cmd
+
 }
 
-var statCmd = &cobra.Command{
-	Use:   "stat IMAGE [FILEPATH]",
-	Short: "Print detailed metadata relating to the file at FILE_PATH.",
-	Args:  cobra.RangeArgs(1, 2),
-	Run: func(cmd *cobra.Command, args []string) {
-		err := SetNumberModeFlagCMD(cmd)
-		if err != nil {
-			SetError(err, 2)
-			return
-		}
-		img := args[0]
-
-		var fpath string = "/"
-		if len(args) > 1 {
-			fpath = args[1]
-		}
-
-		fileStat, err := imagetools.StatImageFile(img, fpath, flagOS)
-		if err != nil {
-			SetError(err, 2)
-			return
-		}
-
-		log.Printf("File: %s", fileStat.FileName)
-		log.Printf("Size: %s", PrintableSize(fileStat.Size))
-		log.Printf("Inode: %d", fileStat.Inode)
-		log.Printf("Permissions: %s", fileStat.Permissions)
-		log.Printf("Uid: %d (%s)", fileStat.UID, fileStat.User)
-		log.Printf("Gid: %d (%s)", fileStat.GID, fileStat.Group)
-		log.Printf("Access: %s", fileStat.Access)
-		log.Printf("Modify: %s", fileStat.Modify)
-		log.Printf("Create: %s", fileStat.Create)
-	},
+func (c *commandContext) newResizeCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "resize IMAGE SIZE",
+		Short: "Grow a raw disk image and its file-system.",
+		Long: `Grow a raw disk image to SIZE, expanding its partition table and growing the
+ext4 or xfs file-system on its root partition to fill the new space, so that
+an app gets more free space without being rebuilt. Prefix SIZE with '+' to
+grow the image by that much instead.`,
+		Example: `  vorteil images resize disk.raw 4GiB
+  vorteil images resize disk.raw +512MiB`,
+		Args: cobra.ExactArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			img := args[0]
+
+			fi, err := os.Stat(img)
+			if err != nil {
+				c.setError(err, 1)
+				return
+			}
+
+			relative := strings.HasPrefix(args[1], "+")
+			size, err := vcfg.ParseBytes(strings.TrimPrefix(args[1], "+"))
+			if err != nil {
+				c.setError(fmt.Errorf("invalid size '%s': %v", args[1], err), 2)
+				return
+			}
+
+			if relative {
+				size += vcfg.Bytes(fi.Size())
+			}
+
+			err = vdisk.ResizeRawImage(img, int64(size))
+			if err != nil {
+				c.setError(err, 3)
+				return
+			}
+
+			c.log.Printf("Resized %s to %s", img, size)
+		},
+	}
 }
 
-func init() {
-	f := statCmd.Flags()
-	f.BoolVarP(&flagOS, "vpartition", "p", false, "Read files from the Vorteil OS partition instead of the file-system partition.")
+func (c *commandContext) newStatCmd() *cobra.Command {
+
+	cmd := &cobra.Command{
+		Use:   "stat IMAGE [FILEPATH]",
+		Short: "Print detailed metadata relating to the file at FILE_PATH.",
+		Args:  cobra.RangeArgs(1, 2),
+		Run: func(cmd *cobra.Command, args []string) {
+			err := c.setNumbersMode(cmd)
+			if err != nil {
+				c.setError(err, 2)
+				return
+			}
+			img := args[0]
+
+			var fpath string = "/"
+			if len(args) > 1 {
+				fpath = args[1]
+			}
+
+			fileStat, err := imagetools.StatImageFile(img, fpath, c.flagOS)
+			if err != nil {
+				c.setError(err, 2)
+				return
+			}
+
+			c.log.Printf("File: %s", fileStat.FileName)
+			c.log.Printf("Size: %s", c.printableSize(fileStat.Size))
+			c.log.Printf("Inode: %d", fileStat.Inode)
+			c.log.Printf("Permissions: %s", fileStat.Permissions)
+			c.log.Printf("Uid: %d (%s)", fileStat.UID, fileStat.User)
+			c.log.Printf("Gid: %d (%s)", fileStat.GID, fileStat.Group)
+			c.log.Printf("Access: %s", fileStat.Access)
+			c.log.Printf("Modify: %s", fileStat.Modify)
+			c.log.Printf("Create: %s", fileStat.Create)
+		},
+	}
+
+	f := cmd.Flags()
+	f.BoolVarP(&c.flagOS, "vpartition", "p", false, "Read files from the Vorteil OS partition instead of the file-system partition.")
 	f.StringP("numbers", "n", "short", "Number printing format")
+
+	return cmd
+
+}
+
+func (c *commandContext) newTreeCmd() *cobra.Command {
+
+	cmd := &cobra.Command{
+		Use:   "tree IMAGE [FILEPATH]",
+		Short: "List contents of directories in a tree-like format.",
+		Args:  cobra.RangeArgs(1, 2),
+		Run: func(cmd *cobra.Command, args []string) {
+			img := args[0]
+
+			var fpath string = "/"
+			if len(args) > 1 {
+				fpath = args[1]
+			}
+
+			treeResults, err := imagetools.TreeImageFile(img, fpath, c.flagOS)
+			if err != nil {
+				c.setError(err, 1)
+				return
+			}
+
+			c.log.Printf(treeResults.String())
+
+		},
+	}
+
+	f := cmd.Flags()
+	f.BoolVarP(&c.flagOS, "vpartition", "p", false, "Read files from the Vorteil OS partition instead of the file-system partition.")
+
+	return cmd
+
 }
 
-var treeCmd = &cobra.Command{
-	Use:   "tree IMAGE [FILEPATH]",
-	Short: "List contents of directories in a tree-like format.",
-	Args:  cobra.RangeArgs(1, 2),
-	Run: func(cmd *cobra.Command, args []string) {
-		img := args[0]
+func (c *commandContext) newVerifyCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "verify IMAGE [CHECKSUMS]",
+		Short: "Check an image against its checksums manifest.",
+		Long: `Check an image against the checksums manifest written alongside it by
+'vorteil images build --checksums', to make sure it wasn't corrupted in
+transit. CHECKSUMS defaults to the image's path with ".sha256.json" appended.
+Any regions of the image that don't match are listed.`,
+		Args: cobra.RangeArgs(1, 2),
+		Run: func(cmd *cobra.Command, args []string) {
+			img := args[0]
+
+			checksumsPath := img + vdisk.ChecksumsSuffix
+			if len(args) > 1 {
+				checksumsPath = args[1]
+			}
+
+			cf, err := os.Open(checksumsPath)
+			if err != nil {
+				c.setError(err, 1)
+				return
+			}
+			defer cf.Close()
+
+			sums, err := vdisk.LoadChecksums(cf)
+			if err != nil {
+				c.setError(fmt.Errorf("failed to load checksums '%s': %w", checksumsPath, err), 2)
+				return
+			}
+
+			f, err := os.Open(img)
+			if err != nil {
+				c.setError(err, 3)
+				return
+			}
+			defer f.Close()
+
+			fi, err := f.Stat()
+			if err != nil {
+				c.setError(err, 4)
+				return
+			}
 
-		var fpath string = "/"
-		if len(args) > 1 {
-			fpath = args[1]
-		}
+			mismatches, err := sums.Verify(f, fi.Size())
+			if err != nil {
+				c.setError(err, 5)
+				return
+			}
 
-		treeResults, err := imagetools.TreeImageFile(img, fpath, flagOS)
-		if err != nil {
-			SetError(err, 1)
-			return
-		}
+			for _, m := range mismatches {
+				c.log.Errorf("region %d (bytes %d to %d) doesn't match its checksum", m.Region, m.Offset, m.Offset+m.Size)
+			}
 
-		log.Printf(treeResults.String())
+			if len(mismatches) > 0 {
+				c.setError(fmt.Errorf("%d of %d regions of '%s' are corrupt", len(mismatches), len(sums.Regions), img), 6)
+				return
+			}
 
-	},
+			c.log.Printf("%s matches its checksums", img)
+		},
+	}
 }
 
-func init() {
-	f := treeCmd.Flags()
-	f.BoolVarP(&flagOS, "vpartition", "p", false, "Read files from the Vorteil OS partition instead of the file-system partition.")
+func (c *commandContext) newAssertCmd() *cobra.Command {
+
+	cmd := &cobra.Command{
+		Use:   "assert IMAGE",
+		Short: "Check an image's contents against a baseline.",
+		Long: `Check the files in an image's root file-system and the config it was built with
+against a baseline, to catch content that changed by accident, e.g. in a
+release pipeline. Every difference is listed, and the command fails if any of
+them aren't allowed by the baseline's allow patterns or the '--allow' flags.
+
+Patterns are matched against file paths, which start with '/', and config
+settings like "program.0.args" or "info.version". A pattern also allows
+everything under what it matches, so "/var/cache" allows any change inside
+that directory and "info" allows any change to the info section.
+
+With '--update' the baseline is (re)written from the image instead, keeping
+its allow patterns and adding any given with '--allow'.`,
+		Example: `  vorteil images assert app.raw --baseline app.baseline.json --update --allow info.date
+  vorteil images assert app.raw --baseline app.baseline.json`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			img := args[0]
+
+			var baseline *vdisk.Baseline
+
+			bf, err := os.Open(c.flagBaseline)
+			if err == nil {
+				baseline, err = vdisk.LoadBaseline(bf)
+				bf.Close()
+				if err != nil {
+					c.setError(fmt.Errorf("failed to load baseline '%s': %w", c.flagBaseline, err), 1)
+					return
+				}
+			} else if !c.flagUpdateBaseline || !os.IsNotExist(err) {
+				c.setError(err, 1)
+				return
+			}
+
+			iio, err := vdecompiler.Open(img)
+			if err != nil {
+				c.setError(err, 2)
+				return
+			}
+			defer iio.Close()
+
+			actual, err := imagetools.ImageBaseline(iio)
+			if err != nil {
+				c.setError(fmt.Errorf("failed to read '%s': %w", img, err), 3)
+				return
+			}
+
+			if c.flagUpdateBaseline {
+				if baseline != nil {
+					actual.Allow = baseline.Allow
+				}
+				actual.Allow = append(actual.Allow, c.flagAllow...)
+
+				err = vdisk.ValidateBaselinePatterns(c.flagAllow)
+				if err != nil {
+					c.setError(err, 4)
+					return
+				}
+
+				err = writeManifest(c.flagBaseline, actual)
+				if err != nil {
+					c.setError(err, 4)
+					return
+				}
+
+				c.log.Printf("wrote baseline: %s", c.flagBaseline)
+				return
+			}
+
+			diffs, err := baseline.Compare(actual, c.flagAllow)
+			if err != nil {
+				c.setError(err, 5)
+				return
+			}
+
+			var unexpected int
+			for _, d := range diffs {
+				if d.Allowed {
+					c.log.Infof("%s (allowed)", d.String())
+					continue
+				}
+				c.log.Errorf("%s", d.String())
+				unexpected++
+			}
+
+			if unexpected > 0 {
+				c.setError(fmt.Errorf("%d unexpected changes in '%s'", unexpected, img), 6)
+				return
+			}
+
+			c.log.Printf("%s matches baseline %s", img, c.flagBaseline)
+		},
+	}
+
+	f := cmd.Flags()
+	f.StringVar(&c.flagBaseline, "baseline", "", "path of the baseline to check the image against")
+	f.BoolVar(&c.flagUpdateBaseline, "update", false, "write the baseline from the image instead of checking it")
+	f.StringArrayVar(&c.flagAllow, "allow", nil, "pattern for files or config settings that are allowed to change")
+	cmd.MarkFlagRequired("baseline")
+
+	return cmd
+
 }
@@ -0,0 +1,82 @@
+package cli
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+func (c *commandContext) newLogsCmd() *cobra.Command {
+
+	cmd := &cobra.Command{
+		Use:   "logs NAME",
+		Short: "Print the serial output of an app's last run",
+		Long: `Print the serial output of the last virtual machine started for an app with
+'vorteil run' or 'vorteil exec'. NAME is the name the app was run under, which
+is the base name of the RUNNABLE (or of the binary, for exec).
+
+If the app was run with system.tag-output the output of a single program can be
+selected with '--program', given the program's index in the VCFG or 'system'
+for the output of the kernel and init.`,
+		Example: `  vorteil run ./myapp --system.tag-output
+  vorteil logs myapp --program 1`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+
+			path, err := serialLogPath(args[0])
+			if err != nil {
+				c.setError(err, 1)
+				return
+			}
+
+			f, err := os.Open(path)
+			if os.IsNotExist(err) {
+				c.setError(fmt.Errorf("no logs for '%s': it hasn't been run", args[0]), 2)
+				return
+			} else if err != nil {
+				c.setError(err, 2)
+				return
+			}
+			defer f.Close()
+
+			var w io.Writer = os.Stdout
+
+			filter, err := programFilter(w, c.flagProgram)
+			if err != nil {
+				c.setError(err, 3)
+				return
+			}
+			if filter != nil {
+				w = filter
+			}
+
+			_, err = io.Copy(w, f)
+			if err != nil {
+				c.setError(err, 4)
+				return
+			}
+
+			if filter != nil {
+				err = filter.Flush()
+				if err != nil {
+					c.setError(err, 4)
+					return
+				}
+			}
+
+		},
+	}
+
+	f := cmd.Flags()
+	f.StringVar(&c.flagProgram, "program", "", "only print the output of the program at this index in the VCFG, or 'system' for everything else")
+
+	return cmd
+
+}
@@ -16,6 +16,7 @@ import (
 	"runtime"
 	"strings"
 
+	"github.com/sirupsen/logrus"
 	"github.com/sisatech/tablewriter"
 	"github.com/spf13/cobra"
 	"github.com/spf13/pflag"
@@ -33,16 +34,28 @@ var (
 	date    = "Thu, 01 Jan 1970 00:00:00 +0000"
 )
 
-// Each command executed may have a error message and status code
+// Commands added with AddNewProvisionerCmd may have a error message and
+// status code
 var errorStatusCode int
 var errorStatusMessage error
 
-// SetError sets the global variables for when the process exits to display accordingly
+// SetError sets the global variables for when the process exits to display
+// accordingly. It's for commands added with AddNewProvisionerCmd, which don't
+// run in a context of their own; HandleErrors reports it.
 func SetError(err error, code int) {
 	errorStatusCode = code
 	errorStatusMessage = err
 }
 
+// streamLogsToStderr moves log messages and progress bars off stdout, for
+// commands that write their output there.
+func (c *commandContext) streamLogsToStderr() {
+	logrus.SetOutput(os.Stderr)
+	if cli, ok := c.log.(*elog.CLI); ok {
+		cli.Output = os.Stderr
+	}
+}
+
 func isEmptyDir(path string) bool {
 
 	fis, err := ioutil.ReadDir(path)
@@ -70,6 +83,23 @@ func checkValidNewDirOutput(path string, force bool, dest, flag string) error {
 	return nil
 }
 
+// isSameFile returns true if both paths exist and refer to the same file.
+func isSameFile(a, b string) bool {
+
+	fa, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+
+	fb, err := os.Stat(b)
+	if err != nil {
+		return false
+	}
+
+	return os.SameFile(fa, fb)
+
+}
+
 func checkValidNewFileOutput(path string, force bool, dest, flag string) error {
 	if !isNotExist(path) {
 		if force {
@@ -103,9 +133,13 @@ type sourceType string
 
 const (
 	sourceURL     sourceType = "URL"
-	sourceFile               = "File"
-	sourceDir                = "Dir"
-	sourceINVALID            = "INVALID"
+	sourceFile    sourceType = "File"
+	sourceDir     sourceType = "Dir"
+	sourceVRepo   sourceType = "VRepo"
+	sourceOCI     sourceType = "OCI"
+	sourceGit     sourceType = "Git"
+	sourceS3      sourceType = "S3"
+	sourceINVALID sourceType = "INVALID"
 )
 
 // readSourcePath fetches src, target or returns an error
@@ -142,34 +176,24 @@ func readSourcePath(src string) (string, string, error) {
 	return src, target, err
 }
 
+// getSourceType returns the kind of source src is, as decided by the first
+// registered source resolver that matches it.
 func getSourceType(src string) (sourceType, error) {
-	var err error
-	var fi os.FileInfo
-
-	// Check if Source is a URL
-	if _, err := url.ParseRequestURI(src); err == nil {
-		if u, uErr := url.Parse(src); uErr == nil && u.Scheme != "" && u.Host != "" && u.Path != "" {
-			return sourceURL, nil
-		}
-	}
 
-	src, target, err := readSourcePath(src)
+	r, err := resolveSource(src)
 	if err != nil {
 		return sourceINVALID, err
 	}
-
-	// Check if Source is a file or dir
-	fi, err = os.Stat(src)
-	if !os.IsNotExist(err) && (fi != nil && !fi.IsDir()) {
-		if target != "" {
-			return sourceINVALID, errors.New("Targetable runs are unable to be used on packages")
-		}
-		return sourceFile, nil
-	} else if !os.IsNotExist(err) && (fi != nil && fi.IsDir()) {
-		return sourceDir, nil
+	if r != nil {
+		return r.name, nil
 	}
 
 	// Source is unknown and thus is invalid
+	path, _, err := readSourcePath(src)
+	if err == nil {
+		_, err = os.Stat(path)
+	}
+
 	return sourceINVALID, err
 }
 
@@ -197,20 +221,27 @@ func checkIfNewVRepo(src string) (string, error) {
 	return resp.Header.Get("Vorteil-Repository"), nil
 }
 
-func getReaderURL(src string) (vpkg.Reader, error) {
+func (c *commandContext) getReaderURL(src string) (vpkg.Reader, error) {
 
 	newVrepo, err := checkIfNewVRepo(src)
 	if err != nil {
 		return nil, err
 	}
+
+	return c.downloadPackage(src, newVrepo == "True")
+}
+
+// downloadPackage loads the package at src, authenticating with the
+// repository it's in if auth is set.
+func (c *commandContext) downloadPackage(src string, auth bool) (vpkg.Reader, error) {
 	client := &http.Client{}
 
 	req, err := http.NewRequest("GET", src, nil)
 	if err != nil {
 		return nil, err
 	}
-	if newVrepo == "True" {
-		token, err := checkAuthentication()
+	if auth {
+		token, err := c.checkAuthentication()
 		if err != nil {
 			return nil, err
 		}
@@ -233,10 +264,10 @@ func getReaderURL(src string) (vpkg.Reader, error) {
 
 	var p elog.Progress
 	if resp.ContentLength == -1 {
-		p = log.NewProgress("Downloading package", "", 0)
+		p = c.log.NewProgress("Downloading package", "", 0)
 		defer p.Finish(true)
 	} else {
-		p = log.NewProgress("Downloading package", "KiB", resp.ContentLength)
+		p = c.log.NewProgress("Downloading package", "KiB", resp.ContentLength)
 	}
 
 	pkgr, err := vpkg.Load(p.ProxyReader(resp.Body))
@@ -249,19 +280,6 @@ func getReaderURL(src string) (vpkg.Reader, error) {
 	return pkgr, nil
 }
 
-func getBuilderURL(argName, src string) (vpkg.Builder, error) {
-	pkgr, err := getReaderURL(src)
-	if err != nil {
-		return nil, err
-	}
-	pkgb, err := vpkg.NewBuilderFromReader(pkgr)
-	if err != nil {
-		pkgr.Close()
-		return nil, err
-	}
-	return pkgb, nil
-}
-
 func getReaderFile(src string) (vpkg.Reader, error) {
 	f, err := os.Open(src)
 	if err != nil {
@@ -278,19 +296,6 @@ func getReaderFile(src string) (vpkg.Reader, error) {
 	}
 	return pkgr, nil
 }
-func getBuilderFile(argName, src string) (vpkg.Builder, error) {
-
-	pkgr, err := getReaderFile(src)
-	if err != nil {
-		return nil, err
-	}
-	pkgb, err := vpkg.NewBuilderFromReader(pkgr)
-	if err != nil {
-		pkgr.Close()
-		return nil, err
-	}
-	return pkgb, err
-}
 
 func getBuilderDir(argName, src string) (vpkg.Builder, error) {
 	var ptgt *vproj.Target
@@ -312,80 +317,106 @@ func getBuilderDir(argName, src string) (vpkg.Builder, error) {
 	return pkgb, err
 }
 
-func getPackageReader(argName, src string) (vpkg.Reader, error) {
-	var err error
-	var pkgR vpkg.Reader
-	sType, err := getSourceType(src)
+func (c *commandContext) getPackageReader(argName, src string) (vpkg.Reader, error) {
+	r, err := resolveSource(src)
 	if err != nil {
 		return nil, err
 	}
 
-	switch sType {
-	case sourceURL:
-		pkgR, err = getReaderURL(src)
-	case sourceFile:
-		pkgR, err = getReaderFile(src)
-	case sourceINVALID:
-		fallthrough
-	default:
-		err = fmt.Errorf("failed to resolve %s '%s'", argName, src)
+	if r == nil || r.reader == nil {
+		return nil, fmt.Errorf("failed to resolve %s '%s'", argName, src)
 	}
 
-	return pkgR, err
+	return r.reader(c, argName, src)
 }
-func getPackageBuilder(argName, src string) (vpkg.Builder, error) {
-	var err error
-	var pkgB vpkg.Builder
-	sType, err := getSourceType(src)
+
+func (c *commandContext) getPackageBuilder(argName, src string) (vpkg.Builder, error) {
+	r, err := resolveSource(src)
 	if err != nil {
 		return nil, err
 	}
 
-	switch sType {
-	case sourceURL:
-		pkgB, err = getBuilderURL(argName, src)
-	case sourceFile:
-		pkgB, err = getBuilderFile(argName, src)
-	case sourceDir:
-		pkgB, err = getBuilderDir(argName, src)
-	case sourceINVALID:
-		fallthrough
-	default:
-		err = fmt.Errorf("failed to resolve %s '%s'", argName, src)
+	switch {
+	case r == nil:
+		return nil, fmt.Errorf("failed to resolve %s '%s'", argName, src)
+	case r.builder != nil:
+		return r.builder(c, argName, src)
 	}
 
-	return pkgB, err
+	pkgr, err := r.reader(c, argName, src)
+	if err != nil {
+		return nil, err
+	}
+	pkgb, err := vpkg.NewBuilderFromReader(pkgr)
+	if err != nil {
+		pkgr.Close()
+		return nil, err
+	}
+	return pkgb, nil
+}
+
+// getRawImage opens src as a raw disk image if it is one. It returns a nil
+// image without an error if src should be resolved as some other kind of
+// BUILDABLE instead.
+func getRawImage(src string) (*vdisk.RawImage, error) {
+
+	sType, err := getSourceType(src)
+	if err != nil || sType != sourceFile {
+		return nil, nil
+	}
+
+	img, err := vdisk.OpenRawImage(src)
+	if errors.Is(err, vdisk.ErrNotRawImage) {
+		return nil, nil
+	}
 
-	// TODO: check for vrepo strings
+	return img, err
 
 }
 
-var (
-	flagIcon             string
-	flagVCFG             []string
-	flagInfoDate         string
-	flagInfoURL          string
-	flagSystemFilesystem string
-	flagSystemOutputMode string
-	flagSysctl           []string
-	flagVMDiskSize       string
-	flagVMInodes         string
-	flagVMRAM            string
-	overrideVCFG         vcfg.VCFG
-)
+// rawImageVCFG returns the configuration to use when running a raw disk image,
+// which is made up entirely of VCFG files and values passed in as flags.
+func (c *commandContext) rawImageVCFG() (*vcfg.VCFG, error) {
+
+	err := c.vcfgFlags.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := new(vcfg.VCFG)
+	for _, path := range c.flagVCFG {
+		f, err := vio.Open(path)
+		if err != nil {
+			return nil, err
+		}
+
+		x, err := vcfg.LoadFile(f)
+		if err != nil {
+			return nil, err
+		}
+
+		cfg, err = vcfg.Merge(cfg, x)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return vcfg.Merge(cfg, &c.overrideVCFG)
 
-func addModifyFlags(f *pflag.FlagSet) {
-	vcfgFlags.AddTo(f)
+}
+
+func (c *commandContext) addModifyFlags(f *pflag.FlagSet) {
+	c.vcfgFlags.AddTo(f)
 }
 
 // mergeFlagVCFGFiles : Merge values from from VCFG files stored in 'flagVCFG', and then merge vcfg flag values with overrideVCFG
-func mergeVCFGFlagValues(b *vpkg.Builder) error {
+func (c *commandContext) mergeVCFGFlagValues(b *vpkg.Builder) error {
 	var err error
 	var f vio.File
 	var cfg *vcfg.VCFG
 
 	// Iterate over vcfg paths stored in flagVCFG, read vcfg files and merge into b
-	for _, path := range flagVCFG {
+	for _, path := range c.flagVCFG {
 		f, err = vio.Open(path)
 		if err != nil {
 			return err
@@ -403,64 +434,68 @@ func mergeVCFGFlagValues(b *vpkg.Builder) error {
 	}
 
 	// Merge overrideVCFG object containing flag values into b
-	err = (*b).MergeVCFG(&overrideVCFG)
+	err = (*b).MergeVCFG(&c.overrideVCFG)
 	return err
 }
 
-func modifyPackageBuilder(b vpkg.Builder) error {
+func (c *commandContext) modifyPackageBuilder(b vpkg.Builder) error {
 	var err error
 	var f vio.File
 
-	err = vcfgFlags.Validate()
+	err = c.vcfgFlags.Validate()
 	if err != nil {
 		return err
 	}
 
-	if flagIcon != "" {
-		f, err = vio.LazyOpen(flagIcon)
+	if c.flagIcon != "" {
+		f, err = vio.LazyOpen(c.flagIcon)
 		if err != nil {
 			return err
 		}
 		b.SetIcon(f)
 	}
 
-	err = mergeVCFGFlagValues(&b)
+	err = c.mergeVCFGFlagValues(&b)
 	if err != nil {
 		return err
 	}
 
-	err = handleFileInjections(b)
+	err = c.handleFileInjections(b)
 	return err
 }
 
-// NumbersMode determines which numbers format a PrintableSize should render to.
-var NumbersMode int
+// Formats a size can be printed in, chosen with the --numbers flag.
+const (
+	numbersShort = iota
+	numbersDecimal
+	numbersHex
+)
 
-// SetNumbersMode parses s and sets NumbersMode accordingly.
-func SetNumbersMode(s string) error {
+// parseNumbersMode parses s as a format to print sizes in.
+func parseNumbersMode(s string) (int, error) {
 	s = strings.ToLower(s)
 	s = strings.TrimSpace(s)
 	switch s {
 	case "", "short":
-		NumbersMode = 0
+		return numbersShort, nil
 	case "dec", "decimal":
-		NumbersMode = 1
+		return numbersDecimal, nil
 	case "hex", "hexadecimal":
-		NumbersMode = 2
+		return numbersHex, nil
 	default:
-		return fmt.Errorf("numbers mode must be one of 'dec', 'hex', or 'short'")
+		return 0, fmt.Errorf("numbers mode must be one of 'dec', 'hex', or 'short'")
 	}
-	return nil
 }
 
-// SetNumberModeFlagCMD : Will SetNumberMode to the value of the cmd flag 'numbers'
-func SetNumberModeFlagCMD(cmd *cobra.Command) error {
+// setNumbersMode sets the format sizes are printed in to the value of the
+// cmd flag 'numbers'.
+func (c *commandContext) setNumbersMode(cmd *cobra.Command) error {
 	numbers, err := cmd.Flags().GetString("numbers")
 	if err != nil {
 		return err
 	}
 
-	err = SetNumbersMode(numbers)
+	c.numbersMode, err = parseNumbersMode(numbers)
 	if err != nil {
 		return fmt.Errorf("couldn't parse value of --numbers: %v", err)
 	}
@@ -468,14 +503,10 @@ func SetNumberModeFlagCMD(cmd *cobra.Command) error {
 	return nil
 }
 
-// PrintableSize is a wrapper around int to alter its string formatting behaviour.
-type PrintableSize int
-
-// String returns a string representation of the PrintableSize, formatted according to the global NumbersMode.
-func (c PrintableSize) String() string {
-	switch NumbersMode {
-	case 0:
-		x := int(c)
+// printableSize formats x according to the context's numbers mode.
+func (c *commandContext) printableSize(x int) string {
+	switch c.numbersMode {
+	case numbersShort:
 		if x == 0 {
 			return "0"
 		}
@@ -492,12 +523,12 @@ func (c PrintableSize) String() string {
 			}
 		}
 		return fmt.Sprintf("%d%s", x, suffixes[units])
-	case 1:
-		return fmt.Sprintf("%d", int(c))
-	case 2:
-		return fmt.Sprintf("%#x", int(c))
+	case numbersDecimal:
+		return fmt.Sprintf("%d", x)
+	case numbersHex:
+		return fmt.Sprintf("%#x", x)
 	default:
-		panic("invalid NumbersMode")
+		panic("invalid numbers mode")
 	}
 }
 
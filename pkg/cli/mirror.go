@@ -0,0 +1,433 @@
+package cli
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/vorteil/vorteil/pkg/vpkg"
+)
+
+func (c *commandContext) newMirrorCmd() *cobra.Command {
+
+	cmd := &cobra.Command{
+		Use:   "mirror SRC DST",
+		Short: "Copy packages between repositories or to a local directory",
+		Long: `Copy packages from one repository to another, or to a local directory for
+sites without access to a repository.
+
+SRC is the URL of an app in a repository, a package file, or a local directory
+of packages, such as one created by an earlier mirror. DST is either a local
+directory or a bucket in a repository, given as the repository URL followed
+by the organisation and bucket, e.g. https://repo.example.com/org/bucket.
+Packages keep their app names, and are checked to be valid packages before
+they are copied.
+
+Downloads that are interrupted are resumed from where they left off the next
+time the same command is run. Packages that already exist in a destination
+directory are skipped unless '--force' is given.
+
+The source repository is authenticated with '--key' and the destination
+repository with '--dest-key', both of which default to the default key.`,
+		Example: ` - Mirroring an app to a local directory:
+ vorteil repositories mirror https://repo.example.com/org/bucket/app ./mirror
+
+ - Uploading everything in a local mirror to another repository:
+ vorteil repositories mirror ./mirror https://offline.example.com/org/bucket`,
+		Args: cobra.ExactArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+
+			err := c.mirrorPackages(args[0], args[1])
+			if err != nil {
+				c.setError(err, 1)
+				return
+			}
+
+		},
+	}
+
+	f := cmd.Flags()
+	f.StringVarP(&c.flagKey, "key", "k", "", "vrepo authentication key file name for the source repository")
+	f.StringVar(&c.flagMirrorDestKey, "dest-key", "", "vrepo authentication key file name for the destination repository")
+	f.BoolVar(&c.flagForce, "force", false, "copy packages that already exist in the destination directory")
+
+	return cmd
+
+}
+
+// mirrorSource is a package to be mirrored, either from a repository or from
+// the local file-system.
+type mirrorSource struct {
+	name string
+	url  string
+	path string
+}
+
+// mirrorSources resolves SRC into the packages it refers to.
+func mirrorSources(src string) ([]mirrorSource, error) {
+
+	sType, err := getSourceType(src)
+	if err != nil {
+		return nil, err
+	}
+
+	switch sType {
+	case sourceURL:
+		u, err := url.Parse(src)
+		if err != nil {
+			return nil, err
+		}
+		return []mirrorSource{{name: path.Base(u.Path), url: src}}, nil
+	case sourceFile:
+		name := strings.TrimSuffix(filepath.Base(src), vpkg.Suffix)
+		return []mirrorSource{{name: name, path: src}}, nil
+	case sourceDir:
+	default:
+		return nil, fmt.Errorf("failed to resolve SRC '%s'", src)
+	}
+
+	fis, err := ioutil.ReadDir(src)
+	if err != nil {
+		return nil, err
+	}
+
+	var sources []mirrorSource
+	for _, fi := range fis {
+		if fi.IsDir() || !strings.HasSuffix(fi.Name(), vpkg.Suffix) {
+			continue
+		}
+
+		sources = append(sources, mirrorSource{
+			name: strings.TrimSuffix(fi.Name(), vpkg.Suffix),
+			path: filepath.Join(src, fi.Name()),
+		})
+	}
+
+	if len(sources) == 0 {
+		return nil, fmt.Errorf("no packages found in '%s'", src)
+	}
+
+	return sources, nil
+
+}
+
+// mirrorDestination splits a repository bucket URL into the repository URL,
+// organisation and bucket. It returns an empty repository URL if dst isn't a
+// URL, in which case it should be treated as a local directory.
+func mirrorDestination(dst string) (repo, org, bucket string, err error) {
+
+	sType, _ := getSourceType(dst)
+	if sType != sourceURL {
+		return "", "", "", nil
+	}
+
+	u, err := url.Parse(dst)
+	if err != nil {
+		return "", "", "", err
+	}
+
+	elems := strings.Split(strings.Trim(u.Path, "/"), "/")
+	if len(elems) < 2 {
+		return "", "", "", fmt.Errorf("invalid DST '%s': must include the organisation and bucket", dst)
+	}
+
+	org = elems[len(elems)-2]
+	bucket = elems[len(elems)-1]
+	u.Path = "/" + strings.Join(elems[:len(elems)-2], "/")
+
+	return strings.TrimSuffix(u.String(), "/"), org, bucket, nil
+
+}
+
+// mirrorPackages copies every package in src to dst.
+func (c *commandContext) mirrorPackages(src, dst string) error {
+
+	sources, err := mirrorSources(src)
+	if err != nil {
+		return err
+	}
+
+	repo, org, bucket, err := mirrorDestination(dst)
+	if err != nil {
+		return err
+	}
+
+	var destToken string
+	if repo != "" {
+		destToken, err = keyToken(c.flagMirrorDestKey)
+		if err != nil {
+			return err
+		}
+	} else {
+		err = os.MkdirAll(dst, 0777)
+		if err != nil {
+			return err
+		}
+	}
+
+	var srcToken string
+	if first := sources[0]; first.url != "" {
+		if isVrepo, _ := checkIfNewVRepo(first.url); isVrepo == "True" {
+			srcToken, err = c.checkAuthentication()
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, src := range sources {
+
+		if repo == "" {
+			err = c.mirrorToDirectory(src, dst, srcToken)
+		} else {
+			err = c.mirrorToRepository(src, repo, []string{org, bucket, src.name}, srcToken, destToken)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to mirror '%s': %w", src.name, err)
+		}
+
+	}
+
+	return nil
+
+}
+
+// mirrorToDirectory copies src into the directory dir.
+func (c *commandContext) mirrorToDirectory(src mirrorSource, dir, token string) error {
+
+	dst := filepath.Join(dir, src.name+vpkg.Suffix)
+	if _, err := os.Stat(dst); err == nil && !c.flagForce {
+		c.log.Printf("Skipping '%s': already mirrored", src.name)
+		return nil
+	}
+
+	if src.url != "" {
+		err := c.downloadResumable(src.url, dst, token)
+		if err != nil {
+			return err
+		}
+		return checkPackageFile(dst)
+	}
+
+	err := checkPackageFile(src.path)
+	if err != nil {
+		return err
+	}
+
+	return copyFileAtomic(src.path, dst)
+
+}
+
+// mirrorToRepository uploads src to the app repoPath in the repository at
+// repo. Packages from another repository are staged in a temporary file that
+// is kept until the upload succeeds, so that an interrupted download can be
+// resumed.
+func (c *commandContext) mirrorToRepository(src mirrorSource, repo string, repoPath []string, srcToken, destToken string) error {
+
+	pkgPath := src.path
+
+	if src.url != "" {
+		digest := sha256.Sum256([]byte(src.url))
+		pkgPath = filepath.Join(os.TempDir(), "vorteil-mirror-"+hex.EncodeToString(digest[:8])+vpkg.Suffix)
+
+		if _, err := os.Stat(pkgPath); err != nil {
+			err = c.downloadResumable(src.url, pkgPath, srcToken)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	err := checkPackageFile(pkgPath)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(pkgPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	err = c.uploadPackage(repo, repoPath, destToken, f)
+	if err != nil {
+		return err
+	}
+
+	if src.url != "" {
+		f.Close()
+		return os.Remove(pkgPath)
+	}
+
+	return nil
+
+}
+
+// keyToken returns the token in the named key file, or in the default key
+// file if name is empty.
+func keyToken(name string) (string, error) {
+
+	pathCheck, err := checkKeysFolder()
+	if err != nil {
+		return "", err
+	}
+
+	if name == "" {
+		name = "default"
+	}
+
+	return checkAuthFile(filepath.Join(pathCheck, name))
+
+}
+
+// checkPackageFile returns an error if the file at path isn't a valid
+// package.
+func checkPackageFile(path string) error {
+
+	pkgr, err := getReaderFile(path)
+	if err != nil {
+		return err
+	}
+
+	return pkgr.Close()
+
+}
+
+// copyFileAtomic copies src to dst by way of a temporary file, so that dst is
+// never left partially written.
+func copyFileAtomic(src, dst string) error {
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := ioutil.TempFile(filepath.Dir(dst), filepath.Base(dst)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(out.Name())
+	defer out.Close()
+
+	_, err = io.Copy(out, in)
+	if err != nil {
+		return err
+	}
+
+	err = out.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(out.Name(), dst)
+
+}
+
+// downloadResumable downloads src to dst. The download is written to dst with
+// ".part" appended until it has finished, and if that file already exists the
+// download picks up where it left off, as long as the server supports range
+// requests.
+func (c *commandContext) downloadResumable(src, dst, token string) error {
+
+	part := dst + ".part"
+
+	f, err := os.OpenFile(part, os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	offset, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("GET", src, nil)
+	if err != nil {
+		return err
+	}
+
+	if token != "" {
+		req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", token))
+	}
+
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		c.log.Infof("Resuming download of '%s' from %d bytes", src, offset)
+	case http.StatusOK:
+		// the server doesn't support range requests, so start again
+		err = f.Truncate(0)
+		if err != nil {
+			return err
+		}
+
+		_, err = f.Seek(0, io.SeekStart)
+		if err != nil {
+			return err
+		}
+	case http.StatusRequestedRangeNotSatisfiable:
+		if offset == 0 {
+			return errors.New(resp.Status)
+		}
+		// an earlier attempt downloaded everything
+		err = f.Close()
+		if err != nil {
+			return err
+		}
+		return os.Rename(part, dst)
+	default:
+		return errors.New(resp.Status)
+	}
+
+	var total int64
+	units := ""
+	if resp.ContentLength != -1 {
+		total = resp.ContentLength
+		units = "KiB"
+	}
+
+	p := c.log.NewProgress(fmt.Sprintf("Downloading %s", filepath.Base(dst)), units, total)
+
+	_, err = io.Copy(f, p.ProxyReader(resp.Body))
+	if err != nil {
+		p.Finish(false)
+		return err
+	}
+
+	err = f.Close()
+	if err != nil {
+		p.Finish(false)
+		return err
+	}
+
+	p.Finish(true)
+
+	return os.Rename(part, dst)
+
+}
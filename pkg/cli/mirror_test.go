@@ -0,0 +1,69 @@
+package cli
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vorteil/vorteil/pkg/elog"
+)
+
+func TestMirrorDestination(t *testing.T) {
+
+	repo, org, bucket, err := mirrorDestination("https://repo.example.com/org/bucket")
+	assert.NoError(t, err)
+	assert.Equal(t, "https://repo.example.com", repo)
+	assert.Equal(t, "org", org)
+	assert.Equal(t, "bucket", bucket)
+
+	_, _, _, err = mirrorDestination("https://repo.example.com/org")
+	assert.Error(t, err)
+
+	repo, _, _, err = mirrorDestination("./mirror")
+	assert.NoError(t, err)
+	assert.Equal(t, "", repo)
+
+}
+
+func TestDownloadResumable(t *testing.T) {
+
+	c := newCommandContext(nil)
+	c.log = &elog.CLI{}
+
+	data := bytes.Repeat([]byte("vorteil"), 0x1000)
+	var ranges []string
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ranges = append(ranges, r.Header.Get("Range"))
+		http.ServeContent(w, r, "app", time.Time{}, bytes.NewReader(data))
+	}))
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "mirror")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	dst := filepath.Join(dir, "app.vorteil")
+
+	// an earlier attempt that was interrupted part way through
+	err = ioutil.WriteFile(dst+".part", data[:0x100], 0644)
+	assert.NoError(t, err)
+
+	err = c.downloadResumable(srv.URL+"/org/bucket/app", dst, "")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"bytes=256-"}, ranges)
+
+	downloaded, err := ioutil.ReadFile(dst)
+	assert.NoError(t, err)
+	assert.Equal(t, data, downloaded)
+
+	_, err = os.Stat(dst + ".part")
+	assert.True(t, os.IsNotExist(err))
+
+}
@@ -13,10 +13,11 @@ import (
 	"github.com/vorteil/vorteil/pkg/vproj"
 )
 
-var projectsCmd = &cobra.Command{
-	Use:   "projects",
-	Short: "Helper commands for working with Vorteil projects",
-	Long: `Vorteil projects are a useful way of working with Vorteil during the development
+func (c *commandContext) newProjectsCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "projects",
+		Short: "Helper commands for working with Vorteil projects",
+		Long: `Vorteil projects are a useful way of working with Vorteil during the development
 or testing of an application. They organize the files and information needed to
 produce Vorteil images, and provide makefile-like functionality where multiple
 different configurations can be managed. A Vorteil project is any directory
@@ -77,7 +78,7 @@ project if it is a path to a directory containing a '.vorteilproject' file.
 Without any further information, the first target within the project file will
 be used, but alternate targets can be used by appending '::<target>' to the
 path.`,
-	Example: `  Turn an existing directory into a project, based on binary 'helloworld':
+		Example: `  Turn an existing directory into a project, based on binary 'helloworld':
 
 	$ %s new helloworld
 
@@ -90,76 +91,83 @@ Using a project as the source argument for packaging:
 	$ %s pack .::prod
 
 `,
+	}
 }
 
-var newProjectCmd = &cobra.Command{
-	Use:   "new [PROJECT]",
-	Short: "New creates a default.vcfg and a .vorteilproject at a certain directory",
-	Args:  cobra.ExactArgs(1),
-	Run: func(cmd *cobra.Command, args []string) {
-		var err error
-		var projectPath string
-		if len(args) != 0 {
-			err = vcfgFlags.Validate()
-			if err != nil {
-				SetError(err, 1)
-				return
-			}
-			projectPath, err = filepath.Abs(args[0])
-			if err != nil {
-				SetError(err, 2)
-				return
+func (c *commandContext) newProjectsNewCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "new [PROJECT]",
+		Short: "New creates a default.vcfg and a .vorteilproject at a certain directory",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			var err error
+			var projectPath string
+			if len(args) != 0 {
+				err = c.vcfgFlags.Validate()
+				if err != nil {
+					c.setError(err, 1)
+					return
+				}
+				projectPath, err = filepath.Abs(args[0])
+				if err != nil {
+					c.setError(err, 2)
+					return
+				}
+				// make sure directory is created
+				err = os.MkdirAll(projectPath, os.ModePerm)
+				if err != nil {
+					c.setError(err, 3)
+					return
+				}
+
+				err = vproj.NewProject(projectPath, &c.overrideVCFG, c.log)
+				if err != nil {
+					c.setError(err, 4)
+					return
+				}
 			}
-			// make sure directory is created
-			err = os.MkdirAll(projectPath, os.ModePerm)
-			if err != nil {
-				SetError(err, 3)
-				return
+		},
+	}
+}
+
+func (c *commandContext) newImportSharedObjectsCmd() *cobra.Command {
+
+	cmd := &cobra.Command{
+		Use:   "import-shared-objects [PROJECT]",
+		Short: "Import shared objects required by the binary targeted within the project.",
+		Args:  cobra.MaximumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			var projectPath string = "."
+			var err error
+
+			// Get Project Path
+			if len(args) != 0 {
+				projectPath, err = filepath.Abs(args[0])
+				if err != nil {
+					c.setError(err, 1)
+					return
+				}
 			}
 
-			err = vproj.NewProject(projectPath, &overrideVCFG, log)
+			// Create Import Operation
+			importOperation, err := vproj.NewImportSharedObject(projectPath, c.flagExcludeDefault, c.log)
+
 			if err != nil {
-				SetError(err, 4)
+				c.setError(err, 2)
 				return
 			}
-		}
-	},
-}
 
-var importSharedObjectsCmd = &cobra.Command{
-	Use:   "import-shared-objects [PROJECT]",
-	Short: "Import shared objects required by the binary targeted within the project.",
-	Args:  cobra.MaximumNArgs(1),
-	Run: func(cmd *cobra.Command, args []string) {
-		var projectPath string = "."
-		var err error
-
-		// Get Project Path
-		if len(args) != 0 {
-			projectPath, err = filepath.Abs(args[0])
-			if err != nil {
-				SetError(err, 1)
+			// Start Import Operation
+			if err = importOperation.Start(); err != nil {
+				c.setError(err, 3)
 				return
 			}
-		}
-
-		// Create Import Operation
-		importOperation, err := vproj.NewImportSharedObject(projectPath, flagExcludeDefault, log)
-
-		if err != nil {
-			SetError(err, 2)
-			return
-		}
-
-		// Start Import Operation
-		if err = importOperation.Start(); err != nil {
-			SetError(err, 3)
-			return
-		}
-	},
-}
+		},
+	}
+
+	f := cmd.Flags()
+	f.BoolVarP(&c.flagExcludeDefault, "no-defaults", "e", false, "exclude default shared objects")
+
+	return cmd
 
-func init() {
-	f := importSharedObjectsCmd.Flags()
-	f.BoolVarP(&flagExcludeDefault, "no-defaults", "e", false, "exclude default shared objects")
 }
@@ -23,15 +23,18 @@ import (
 	"github.com/vorteil/vorteil/pkg/provisioners/azure"
 	"github.com/vorteil/vorteil/pkg/provisioners/google"
 	"github.com/vorteil/vorteil/pkg/provisioners/registry"
+	"github.com/vorteil/vorteil/pkg/vcfg"
 	"github.com/vorteil/vorteil/pkg/vdisk"
 	"github.com/vorteil/vorteil/pkg/vio"
 	"github.com/vorteil/vorteil/pkg/vpkg"
 )
 
-var provisionCmd = &cobra.Command{
-	Use:   "provision BUILDABLE PROVISIONER",
-	Short: "Provision a vorteil buildable",
-	Long: `Provision a vorteil buildable to a supported provisioner online.
+func (c *commandContext) newProvisionCmd() *cobra.Command {
+
+	cmd := &cobra.Command{
+		Use:   "provision BUILDABLE PROVISIONER",
+		Short: "Provision a vorteil buildable",
+		Long: `Provision a vorteil buildable to a supported provisioner online.
 
 Example Command:
  - Provisioning python3 package to an aws provisioner:
@@ -41,387 +44,574 @@ PROVISIONER is a file that has been created with the 'vorteil provisioners new'
 It tells vorteil where to provision your BUILDABLE to.
 
 If your PROVISIONER was created with a passphrase you can input this passphrase with the
-'--passphrase' flag when using the 'provision' command.`,
-	Args: cobra.ExactArgs(2),
-	Run: func(cmd *cobra.Command, args []string) {
-		var provisionFile string
-		provisionFile = args[1]
-
-		// Load the provided provisioner file
-		if _, err := os.Stat(provisionFile); err != nil {
-			SetError(fmt.Errorf("Could not read PROVISIONER '%s' , error: %v", provisionFile, err), 1)
-			return
-		}
+'--passphrase' flag when using the 'provision' command.
+
+Images are tagged with a token derived from the digest of the disk, so running the same
+command again after a failure picks up where it left off: an identical image that already
+exists is left alone, and one that failed to provision is replaced without needing '--force'.
+Failed uploads and platform operations are retried according to '--retries' and '--retry-delay'.
+
+Amazon, Google and Azure provisioners can also launch an instance from the new image
+with '--launch MACHINE_TYPE', e.g. '--launch t3.micro'.
+
+Provisioners that upload images as a single stream, such as Google, upload the image while
+it is still being built, which makes provisioning large images much faster. Images built
+this way aren't tagged with a token, because the digest isn't known until the upload has
+finished. Use '--no-pipeline' to build the whole image first.`,
+		Args: cobra.ExactArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			c.provisionBuildable(args[0], args[1])
+		},
+	}
 
-		b, err := ioutil.ReadFile(provisionFile)
-		if err != nil {
-			SetError(fmt.Errorf("Could not read PROVISIONER '%s' , error: %v", provisionFile, err), 2)
-			return
-		}
+	f := cmd.Flags()
+	f.StringVarP(&c.flagKey, "key", "k", "", "vrepo authentication key")
+	f.StringSliceVar(&c.flagOSFiles, "os-files", nil, "<src>[@<dst>]   add files from the host filesystem to a folder in the Vorteil OS partition (dst defaults to '/')")
+	f.BoolVar(&c.flagTZData, "tzdata", false, "add the host's time-zone database and C.UTF-8 locale to the app, with the local time zone set by system.timezone")
+	f.StringArrayVar(&c.flagTemplateValues, "template-value", nil, "set a value for the app's templates, as name=value")
+	f.StringVar(&c.flagPolicy, "policy", "", "check the app against the rules in this policy file before building it")
+	f.StringVar(&c.flagSecureBootKey, "secure-boot-key", "", "sign the image's EFI binaries for secure boot with this private key (needs sbsign)")
+	f.StringVar(&c.flagSecureBootCert, "secure-boot-cert", "", "certificate for the key given by --secure-boot-key")
+
+	f.StringVarP(&c.provisionName, "name", "n", "", "Name of the resulting image on the remote platform.")
+	f.StringVarP(&c.provisionDescription, "description", "D", "", "Description for the resulting image, if supported by the platform.")
+	f.BoolVarP(&c.provisionForce, "force", "f", false, "Force an overwrite if an existing image conflicts with the new.")
+	f.BoolVarP(&c.provisionReadyWhenUsable, "ready-when-usable", "r", false, "Return successfully as soon as the operation is complete, regardless of whether or not the platform is still processing the image.")
+	f.StringVarP(&c.provisionPassPhrase, "passphrase", "s", "", "Passphrase used to decrypt encrypted provisioner data.")
+	f.IntVar(&c.provisionRetries, "retries", provisioners.DefaultRetryPolicy.Attempts-1, "Number of times to retry a failed upload or platform operation.")
+	f.DurationVar(&c.provisionRetryDelay, "retry-delay", provisioners.DefaultRetryPolicy.Delay, "Delay before the first retry, doubling for each retry after that.")
+	f.StringVar(&c.provisionLaunch, "launch", "", "Launch an instance of this machine type (e.g. t3.micro) from the image once it has been created, with the ports in the VCFG opened, and print its IP address.")
+	f.BoolVar(&c.provisionNoPipeline, "no-pipeline", false, "Finish building the image before uploading it, even if the provisioner can upload it while it's being built.")
+
+	return cmd
 
-		data, err := provisioners.Decrypt(b, provisionPassPhrase)
-		if err != nil {
-			SetError(err, 3)
-			return
-		}
+}
 
-		ptype, err := provisioners.ProvisionerType(data)
-		if err != nil {
-			SetError(err, 4)
-			return
-		}
+// provisionBuildable builds the buildable at buildablePath and provisions it
+// using the provisioner file at provisionFile. Failures are reported using
+// SetError.
+func (c *commandContext) provisionBuildable(buildablePath, provisionFile string) {
 
-		prov, err := registry.NewProvisioner(ptype, log, data)
-		if err != nil {
-			SetError(err, 5)
-			return
-		}
+	// Load the provided provisioner file
+	if _, err := os.Stat(provisionFile); err != nil {
+		c.setError(fmt.Errorf("Could not read PROVISIONER '%s' , error: %v", provisionFile, err), 1)
+		return
+	}
 
-		buildablePath := "."
-		if len(args) >= 1 {
-			buildablePath = args[0]
-		}
+	b, err := ioutil.ReadFile(provisionFile)
+	if err != nil {
+		c.setError(fmt.Errorf("Could not read PROVISIONER '%s' , error: %v", provisionFile, err), 2)
+		return
+	}
 
-		pkgBuilder, err := getPackageBuilder("BUILDABLE", buildablePath)
-		if err != nil {
-			SetError(err, 9)
+	data, err := provisioners.Decrypt(b, c.provisionPassPhrase)
+	if err != nil {
+		c.setError(err, 3)
+		return
+	}
 
-			return
-		}
+	ptype, err := provisioners.ProvisionerType(data)
+	if err != nil {
+		c.setError(err, 4)
+		return
+	}
 
-		err = modifyPackageBuilder(pkgBuilder)
-		if err != nil {
-			SetError(err, 10)
-			return
-		}
+	prov, err := registry.NewProvisioner(ptype, c.log, data)
+	if err != nil {
+		c.setError(err, 5)
+		return
+	}
+
+	launcher, ok := prov.(provisioners.Launcher)
+	if c.provisionLaunch != "" && !ok {
+		c.setError(fmt.Errorf("the %s provisioner doesn't support launching instances", prov.Type()), 6)
+		return
+	}
+
+	pkgBuilder, err := c.getPackageBuilder("BUILDABLE", buildablePath)
+	if err != nil {
+		c.setError(err, 9)
+
+		return
+	}
+
+	err = c.modifyPackageBuilder(pkgBuilder)
+	if err != nil {
+		c.setError(err, 10)
+		return
+	}
+
+	pkgReader, err := vpkg.ReaderFromBuilder(pkgBuilder)
+	if err != nil {
+		c.setError(err, 11)
+		return
+	}
+	defer pkgReader.Close()
 
-		pkgReader, err := vpkg.ReaderFromBuilder(pkgBuilder)
+	pkgReader, err = vpkg.PeekVCFG(pkgReader)
+	if err != nil {
+		c.setError(err, 12)
+		return
+	}
+
+	err = c.initKernels()
+	if err != nil {
+		c.setError(err, 13)
+		return
+	}
+
+	osFiles, err := c.osFileTree()
+	if err != nil {
+		c.setError(err, 14)
+		return
+	}
+	if osFiles != nil {
+		defer osFiles.Close()
+	}
+
+	pol, err := c.loadPolicy()
+	if err != nil {
+		c.setError(err, 14)
+		return
+	}
+
+	signer, err := c.secureBootSigner()
+	if err != nil {
+		c.setError(err, 14)
+		return
+	}
+
+	var ports []provisioners.Port
+	if c.provisionLaunch != "" {
+		cfg, err := vcfg.LoadFile(pkgReader.VCFG())
 		if err != nil {
-			SetError(err, 11)
+			c.setError(err, 7)
 			return
 		}
-		defer pkgReader.Close()
 
-		pkgReader, err = vpkg.PeekVCFG(pkgReader)
+		ports, err = provisioners.Ports(cfg)
 		if err != nil {
-			SetError(err, 12)
+			c.setError(err, 8)
 			return
 		}
+	}
 
-		err = initKernels()
-		if err != nil {
-			SetError(err, 13)
+	templateData, err := c.templateData()
+	if err != nil {
+		c.setError(err, 8)
+		return
+	}
+
+	f, err := ioutil.TempFile(os.TempDir(), "vorteil.disk")
+	if err != nil {
+		c.setError(err, 14)
+		return
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	buildArgs := &vdisk.BuildArgs{
+		WithVCFGDefaults: true,
+		PackageReader:    pkgReader,
+		Format:           prov.DiskFormat(),
+		SizeAlign:        int64(prov.SizeAlign()),
+		KernelOptions: vdisk.KernelOptions{
+			Shell: c.flagShell,
+		},
+		Logger:       c.log,
+		OSFiles:      osFiles,
+		Policy:       pol,
+		ZoneInfo:     c.zoneInfo(),
+		TemplateData: templateData,
+		Signer:       signer,
+	}
+
+	if c.provisionName == "" {
+		c.provisionName = generateProvisionUUID()
+		c.log.Infof("--name flag what not set using generated uuid '%s'", c.provisionName)
+	}
+
+	ctx, cancel := c.interruptContext()
+	defer cancel()
+
+	provisionArgs := &provisioners.ProvisionArgs{
+		Context:         ctx,
+		Name:            c.provisionName,
+		Description:     c.provisionDescription,
+		Force:           c.provisionForce,
+		ReadyWhenUsable: c.provisionReadyWhenUsable,
+		Retry: &provisioners.RetryPolicy{
+			Attempts: c.provisionRetries + 1,
+			Delay:    c.provisionRetryDelay,
+			MaxDelay: provisioners.DefaultRetryPolicy.MaxDelay,
+		},
+	}
+
+	if c.canPipelineProvision(prov) {
+		buildErr, err := buildAndProvision(ctx, f, prov, buildArgs, provisionArgs)
+		if buildErr != nil {
+			c.setError(buildErr, 15)
 			return
 		}
-
-		f, err := ioutil.TempFile(os.TempDir(), "vorteil.disk")
 		if err != nil {
-			SetError(err, 14)
+			c.setError(err, 19)
 			return
 		}
-		defer os.Remove(f.Name())
-		defer f.Close()
-
-		err = vdisk.Build(context.Background(), f, &vdisk.BuildArgs{
-			WithVCFGDefaults: true,
-			PackageReader:    pkgReader,
-			Format:           prov.DiskFormat(),
-			SizeAlign:        int64(prov.SizeAlign()),
-			KernelOptions: vdisk.KernelOptions{
-				Shell: flagShell,
-			},
-			Logger: log,
-		})
+	} else {
+		err = vdisk.Build(ctx, f, buildArgs)
 		if err != nil {
-			SetError(err, 15)
+			c.setError(err, 15)
 			return
 		}
 
 		err = f.Close()
 		if err != nil {
-			SetError(err, 16)
+			c.setError(err, 16)
 			return
 		}
 
 		err = pkgReader.Close()
 		if err != nil {
-			SetError(err, 17)
+			c.setError(err, 17)
+			return
+		}
+
+		provisionArgs.Token, err = imageToken(f.Name())
+		if err != nil {
+			c.setError(err, 18)
 			return
 		}
 
-		image, err := vio.LazyOpen(f.Name())
+		provisionArgs.Image, err = vio.LazyOpen(f.Name())
 		if err != nil {
-			SetError(err, 18)
+			c.setError(err, 18)
 			return
 		}
 
-		if provisionName == "" {
-			provisionName = generateProvisionUUID()
-			log.Infof("--name flag what not set using generated uuid '%s'", provisionName)
+		provisionArgs.OpenImage = func() (vio.File, error) {
+			return vio.LazyOpen(f.Name())
 		}
 
-		ctx := context.TODO()
-		err = prov.Provision(&provisioners.ProvisionArgs{
-			Context:         ctx,
-			Image:           image,
-			Name:            provisionName,
-			Description:     provisionDescription,
-			Force:           provisionForce,
-			ReadyWhenUsable: provisionReadyWhenUsable,
-		})
+		err = prov.Provision(provisionArgs)
 		if err != nil {
-			SetError(err, 19)
+			c.setError(err, 19)
 			return
 		}
+	}
 
-		fmt.Printf("Finished creating image.\n")
-	},
-}
+	fmt.Printf("Finished creating image.\n")
 
-func generateProvisionUUID() string {
-	pName := strings.ReplaceAll(uuid.New().String(), "-", "")
+	if c.provisionLaunch == "" {
+		return
+	}
 
-	// Replace first character with v if its a number
-	if _, err := strconv.Atoi(pName[:1]); err == nil {
-		pName = "v" + pName[1:]
+	instance, err := launcher.Launch(&provisioners.LaunchArgs{
+		Name:        c.provisionName,
+		MachineType: c.provisionLaunch,
+		Ports:       ports,
+		Context:     ctx,
+	})
+	if err != nil {
+		c.setError(err, 20)
+		return
 	}
 
-	return pName
+	fmt.Printf("Launched instance %s: %s\n", instance.ID, instance.IP)
 }
 
-var (
-	provisionName            string
-	provisionDescription     string
-	provisionForce           bool
-	provisionReadyWhenUsable bool
-	provisionPassPhrase      string
-)
+// canPipelineProvision returns true if prov can upload images while they're
+// still being built, unless pipelining has been turned off.
+func (c *commandContext) canPipelineProvision(prov provisioners.Provisioner) bool {
+
+	if c.provisionNoPipeline {
+		return false
+	}
 
-func init() {
-	f := provisionCmd.Flags()
-	f.StringVarP(&flagKey, "key", "k", "", "vrepo authentication key")
+	streamer, ok := prov.(provisioners.Streamer)
+	if !ok || !streamer.Streams() {
+		return false
+	}
 
-	f.StringVarP(&provisionName, "name", "n", "", "Name of the resulting image on the remote platform.")
-	f.StringVarP(&provisionDescription, "description", "D", "", "Description for the resulting image, if supported by the platform.")
-	f.BoolVarP(&provisionForce, "force", "f", false, "Force an overwrite if an existing image conflicts with the new.")
-	f.BoolVarP(&provisionReadyWhenUsable, "ready-when-usable", "r", false, "Return successfully as soon as the operation is complete, regardless of whether or not the platform is still processing the image.")
-	f.StringVarP(&provisionPassPhrase, "passphrase", "s", "", "Passphrase used to decrypt encrypted provisioner data.")
-}
+	format := prov.DiskFormat()
+	return format.Streamable()
 
-var provisionersCmd = &cobra.Command{
-	Use:     "provisioners",
-	Short:   "Helper commands for working with Vorteil provisioners",
-	Long:    ``,
-	Example: ``,
 }
 
-var provisionersNewCmd = &cobra.Command{
-	Use:   "new",
-	Short: "Add a new provisioner.",
-}
+// buildAndProvision builds the image to f and provisions it at the same time,
+// streaming each part of the image to the provisioner as soon as it has been
+// written. The image has no idempotency token, because its digest isn't known
+// until it has been uploaded. If provisioning fails the build is cancelled.
+func buildAndProvision(ctx context.Context, f *os.File, prov provisioners.Provisioner, buildArgs *vdisk.BuildArgs, args *provisioners.ProvisionArgs) (buildErr, provisionErr error) {
 
-var (
-	provisionersNewPassphrase string
-
-	// Google Cloud Platform
-	provisionersNewGoogleBucket  string
-	provisionersNewGoogleKeyFile string
-
-	// Amazon Web Services
-	provisionersNewAmazonKey    string
-	provisionersNewAmazonRegion string
-	provisionersNewAmazonBucket string
-	provisionersNewAmazonSecret string
-
-	// Azure
-	provisionersNewAzureContainer          string
-	provisionersNewAzureKeyFile            string
-	provisionersNewAzureLocation           string
-	provisionersNewAzureResourceGroup      string
-	provisionersNewAzureStorageAccountKey  string
-	provisionersNewAzureStorageAccountName string
-)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
-var provisionersNewAmazonEC2Cmd = &cobra.Command{
-	Use:   "amazon-ec2 <OUTPUT_FILE>",
-	Short: "Add a new AWS (Amazon Web Services) Provisioner.",
-	Args:  cobra.ExactArgs(1),
-	Run: func(cmd *cobra.Command, args []string) {
+	pipe := vdisk.NewImagePipe(f)
+	built := make(chan error, 1)
 
-		f, err := os.OpenFile(args[0], os.O_RDWR|os.O_CREATE, 0644)
-		if err != nil {
-			SetError(err, 1)
-			return
-		}
-		defer f.Close()
-
-		p, err := amazon.NewProvisioner(log, &amazon.Config{
-			Key:    provisionersNewAmazonKey,
-			Secret: provisionersNewAmazonSecret,
-			Region: provisionersNewAmazonRegion,
-			Bucket: provisionersNewAmazonBucket,
-		})
-		if err != nil {
-			SetError(err, 2)
-			return
+	go func() {
+		w, err := vdisk.StreamWriter(pipe)
+		if err == nil {
+			err = vdisk.Build(ctx, w, buildArgs)
 		}
+		built <- err
+		pipe.CloseWithError(err)
+	}()
 
-		data, err := p.Marshal()
-		if err != nil {
-			SetError(err, 3)
-			return
-		}
+	args.Image, _ = pipe.Open()
+	args.OpenImage = pipe.Open
+	args.Context = ctx
 
-		out := provisioners.Encrypt(data, provisionersNewPassphrase)
-		_, err = io.Copy(f, bytes.NewReader(out))
-		if err != nil {
-			SetError(err, 4)
-			return
-		}
+	provisionErr = prov.Provision(args)
+	if provisionErr == nil {
+		return <-built, nil
+	}
 
-	},
-}
+	select {
+	case buildErr = <-built:
+		// the build finished first, and may be why provisioning failed
+	default:
+		cancel()
+		<-built
+	}
+
+	return buildErr, provisionErr
 
-func init() {
-	f := provisionersNewAmazonEC2Cmd.Flags()
-	f.StringVarP(&provisionersNewAmazonKey, "key", "k", "", "Access key ID")
-	provisionersNewAmazonEC2Cmd.MarkFlagRequired("key")
-	f.StringVarP(&provisionersNewAmazonSecret, "secret", "s", "", "Secret access key")
-	provisionersNewAmazonEC2Cmd.MarkFlagRequired("secret")
-	f.StringVarP(&provisionersNewAmazonRegion, "region", "r", "ap-southeast-2", "AWS region")
-	f.StringVarP(&provisionersNewAmazonBucket, "bucket", "b", "", "AWS bucket")
-	provisionersNewAmazonEC2Cmd.MarkFlagRequired("bucket")
-	f.StringVarP(&provisionersNewPassphrase, "passphrase", "p", "", "Passphrase for encrypting exported provisioner data.")
 }
 
-var provisionersNewAzureCmd = &cobra.Command{
-	Use:   "azure <OUTPUT_FILE>",
-	Short: "Add a new Microsoft Azure Provisioner.",
-	Args:  cobra.ExactArgs(1),
-	Run: func(cmd *cobra.Command, args []string) {
+// imageToken returns the idempotency token for the disk image at path.
+func imageToken(path string) (string, error) {
 
-		f, err := os.OpenFile(args[0], os.O_RDWR|os.O_CREATE, 0644)
-		if err != nil {
-			SetError(err, 1)
-			return
-		}
-		defer f.Close()
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
 
-		path := provisionersNewAzureKeyFile
-		_, err = os.Stat(path)
-		if err != nil {
-			SetError(err, 2)
-			return
-		}
+	return provisioners.Token(f)
 
-		b, err := ioutil.ReadFile(path)
-		if err != nil {
-			SetError(err, 3)
-			return
-		}
-
-		p, err := azure.NewProvisioner(log, &azure.Config{
-			Key:                base64.StdEncoding.EncodeToString(b),
-			Container:          provisionersNewAzureContainer,
-			Location:           provisionersNewAzureLocation,
-			ResourceGroup:      provisionersNewAzureResourceGroup,
-			StorageAccountKey:  provisionersNewAzureStorageAccountKey,
-			StorageAccountName: provisionersNewAzureStorageAccountName,
-		})
-		if err != nil {
-			SetError(err, 4)
-			return
-		}
+}
 
-		data, err := p.Marshal()
-		if err != nil {
-			SetError(err, 5)
-			return
-		}
+func generateProvisionUUID() string {
+	pName := strings.ReplaceAll(uuid.New().String(), "-", "")
 
-		out := provisioners.Encrypt(data, provisionersNewPassphrase)
-		_, err = io.Copy(f, bytes.NewReader(out))
-		if err != nil {
-			SetError(err, 6)
-			return
-		}
+	// Replace first character with v if its a number
+	if _, err := strconv.Atoi(pName[:1]); err == nil {
+		pName = "v" + pName[1:]
+	}
 
-	},
+	return pName
 }
 
-func init() {
-	f := provisionersNewAzureCmd.Flags()
-	f.StringVarP(&provisionersNewAzureKeyFile, "key-file", "k", "", "Azure 'Service Principal' credentials file")
-	provisionersNewAzureCmd.MarkFlagRequired("key-file")
-	f.StringVarP(&provisionersNewAzureContainer, "container", "c", "", "Azure container name")
-	provisionersNewAzureCmd.MarkFlagRequired("container")
-	f.StringVarP(&provisionersNewAzureResourceGroup, "resource-group", "r", "", "Azure resource group name")
-	provisionersNewAzureCmd.MarkFlagRequired("resource-group")
-	f.StringVarP(&provisionersNewAzureLocation, "location", "l", "", "Azure location")
-	provisionersNewAzureCmd.MarkFlagRequired("location")
-	f.StringVarP(&provisionersNewAzureStorageAccountKey, "storage-account-key", "s", "", "Azure storage account key")
-	provisionersNewAzureCmd.MarkFlagRequired("storage-account-key")
-	f.StringVarP(&provisionersNewAzureStorageAccountName, "storage-account-name", "n", "", "Azure storage account name")
-	provisionersNewAzureCmd.MarkFlagRequired("storage-account-name")
-	f.StringVarP(&provisionersNewPassphrase, "passphrase", "p", "", "Passphrase for encrypting exported provisioner data.")
+func (c *commandContext) newProvisionersCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:     "provisioners",
+		Short:   "Helper commands for working with Vorteil provisioners",
+		Long:    ``,
+		Example: ``,
+	}
+}
 
+func (c *commandContext) newProvisionersNewCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "new",
+		Short: "Add a new provisioner.",
+	}
 }
 
-var provisionersNewGoogleCmd = &cobra.Command{
-	Use:   "google <OUTPUT_FILE>",
-	Short: "Add a new Google Cloud (Compute Engine) Provisioner.",
-	Args:  cobra.ExactArgs(1), // Single arg, points to output file
-	Run: func(cmd *cobra.Command, args []string) {
+func (c *commandContext) newProvisionersNewAmazonEC2Cmd() *cobra.Command {
+
+	cmd := &cobra.Command{
+		Use:   "amazon-ec2 <OUTPUT_FILE>",
+		Short: "Add a new AWS (Amazon Web Services) Provisioner.",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+
+			f, err := os.OpenFile(args[0], os.O_RDWR|os.O_CREATE, 0644)
+			if err != nil {
+				c.setError(err, 1)
+				return
+			}
+			defer f.Close()
+
+			p, err := amazon.NewProvisioner(c.log, &amazon.Config{
+				Key:     c.provisionersNewAmazonKey,
+				Secret:  c.provisionersNewAmazonSecret,
+				Region:  c.provisionersNewAmazonRegion,
+				Bucket:  c.provisionersNewAmazonBucket,
+				Profile: c.provisionersNewAmazonProfile,
+			})
+			if err != nil {
+				c.setError(err, 2)
+				return
+			}
+
+			data, err := p.Marshal()
+			if err != nil {
+				c.setError(err, 3)
+				return
+			}
+
+			out := provisioners.Encrypt(data, c.provisionersNewPassphrase)
+			_, err = io.Copy(f, bytes.NewReader(out))
+			if err != nil {
+				c.setError(err, 4)
+				return
+			}
+
+		},
+	}
 
-		f, err := os.OpenFile(args[0], os.O_RDWR|os.O_CREATE, 0644)
-		if err != nil {
-			SetError(err, 1)
-			return
-		}
-		defer f.Close()
+	f := cmd.Flags()
+	f.StringVarP(&c.provisionersNewAmazonKey, "key", "k", "", "Access key ID (if omitted, the default AWS credential chain is used)")
+	f.StringVarP(&c.provisionersNewAmazonSecret, "secret", "s", "", "Secret access key")
+	f.StringVar(&c.provisionersNewAmazonProfile, "profile", "", "AWS shared config profile to use with the default credential chain")
+	f.StringVarP(&c.provisionersNewAmazonRegion, "region", "r", "ap-southeast-2", "AWS region")
+	f.StringVarP(&c.provisionersNewAmazonBucket, "bucket", "b", "", "AWS bucket")
+	cmd.MarkFlagRequired("bucket")
+	f.StringVarP(&c.provisionersNewPassphrase, "passphrase", "p", "", "Passphrase for encrypting exported provisioner data.")
 
-		path := provisionersNewGoogleKeyFile
-		_, err = os.Stat(path)
-		if err != nil {
-			SetError(err, 2)
-			return
-		}
+	return cmd
 
-		b, err := ioutil.ReadFile(path)
-		if err != nil {
-			SetError(err, 3)
-			return
-		}
+}
 
-		p, err := google.NewProvisioner(log, &google.Config{
-			Bucket: provisionersNewGoogleBucket,
-			Key:    base64.StdEncoding.EncodeToString(b),
-		})
-		if err != nil {
-			SetError(err, 4)
-			return
-		}
+func (c *commandContext) newProvisionersNewAzureCmd() *cobra.Command {
+
+	cmd := &cobra.Command{
+		Use:   "azure <OUTPUT_FILE>",
+		Short: "Add a new Microsoft Azure Provisioner.",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+
+			f, err := os.OpenFile(args[0], os.O_RDWR|os.O_CREATE, 0644)
+			if err != nil {
+				c.setError(err, 1)
+				return
+			}
+			defer f.Close()
+
+			path := c.provisionersNewAzureKeyFile
+			_, err = os.Stat(path)
+			if err != nil {
+				c.setError(err, 2)
+				return
+			}
+
+			b, err := ioutil.ReadFile(path)
+			if err != nil {
+				c.setError(err, 3)
+				return
+			}
+
+			p, err := azure.NewProvisioner(c.log, &azure.Config{
+				Key:                base64.StdEncoding.EncodeToString(b),
+				Container:          c.provisionersNewAzureContainer,
+				Location:           c.provisionersNewAzureLocation,
+				ResourceGroup:      c.provisionersNewAzureResourceGroup,
+				StorageAccountKey:  c.provisionersNewAzureStorageAccountKey,
+				StorageAccountName: c.provisionersNewAzureStorageAccountName,
+			})
+			if err != nil {
+				c.setError(err, 4)
+				return
+			}
+
+			data, err := p.Marshal()
+			if err != nil {
+				c.setError(err, 5)
+				return
+			}
+
+			out := provisioners.Encrypt(data, c.provisionersNewPassphrase)
+			_, err = io.Copy(f, bytes.NewReader(out))
+			if err != nil {
+				c.setError(err, 6)
+				return
+			}
+
+		},
+	}
 
-		data, err := p.Marshal()
-		if err != nil {
-			SetError(err, 5)
-			return
-		}
+	f := cmd.Flags()
+	f.StringVarP(&c.provisionersNewAzureKeyFile, "key-file", "k", "", "Azure 'Service Principal' credentials file")
+	cmd.MarkFlagRequired("key-file")
+	f.StringVarP(&c.provisionersNewAzureContainer, "container", "c", "", "Azure container name")
+	cmd.MarkFlagRequired("container")
+	f.StringVarP(&c.provisionersNewAzureResourceGroup, "resource-group", "r", "", "Azure resource group name")
+	cmd.MarkFlagRequired("resource-group")
+	f.StringVarP(&c.provisionersNewAzureLocation, "location", "l", "", "Azure location")
+	cmd.MarkFlagRequired("location")
+	f.StringVarP(&c.provisionersNewAzureStorageAccountKey, "storage-account-key", "s", "", "Azure storage account key")
+	cmd.MarkFlagRequired("storage-account-key")
+	f.StringVarP(&c.provisionersNewAzureStorageAccountName, "storage-account-name", "n", "", "Azure storage account name")
+	cmd.MarkFlagRequired("storage-account-name")
+	f.StringVarP(&c.provisionersNewPassphrase, "passphrase", "p", "", "Passphrase for encrypting exported provisioner data.")
+
+	return cmd
 
-		out := provisioners.Encrypt(data, provisionersNewPassphrase)
-		_, err = io.Copy(f, bytes.NewReader(out))
-		if err != nil {
-			SetError(err, 6)
-			return
-		}
-	},
 }
 
-func init() {
-	f := provisionersNewGoogleCmd.Flags()
-	f.StringVarP(&provisionersNewPassphrase, "passphrase", "p", "", "Passphrase for encrypting exported provisioner data.")
-	f.StringVarP(&provisionersNewGoogleBucket, "bucket", "b", "", "Name of an existing Google Cloud Storage bucket, for which the provided service account credentials have adequate permissions for object creation/deletion.")
-	provisionersNewGoogleCmd.MarkFlagRequired("bucket")
-	f.StringVarP(&provisionersNewGoogleKeyFile, "credentials", "f", "", "Path of an existing JSON-formatted Google Cloud Platform service account credentials file.")
-	provisionersNewGoogleCmd.MarkFlagRequired("credentials")
+func (c *commandContext) newProvisionersNewGoogleCmd() *cobra.Command {
+
+	cmd := &cobra.Command{
+		Use:   "google <OUTPUT_FILE>",
+		Short: "Add a new Google Cloud (Compute Engine) Provisioner.",
+		Args:  cobra.ExactArgs(1), // Single arg, points to output file
+		Run: func(cmd *cobra.Command, args []string) {
+
+			f, err := os.OpenFile(args[0], os.O_RDWR|os.O_CREATE, 0644)
+			if err != nil {
+				c.setError(err, 1)
+				return
+			}
+			defer f.Close()
+
+			path := c.provisionersNewGoogleKeyFile
+			_, err = os.Stat(path)
+			if err != nil {
+				c.setError(err, 2)
+				return
+			}
+
+			b, err := ioutil.ReadFile(path)
+			if err != nil {
+				c.setError(err, 3)
+				return
+			}
+
+			p, err := google.NewProvisioner(c.log, &google.Config{
+				Bucket: c.provisionersNewGoogleBucket,
+				Key:    base64.StdEncoding.EncodeToString(b),
+				Zone:   c.provisionersNewGoogleZone,
+			})
+			if err != nil {
+				c.setError(err, 4)
+				return
+			}
+
+			data, err := p.Marshal()
+			if err != nil {
+				c.setError(err, 5)
+				return
+			}
+
+			out := provisioners.Encrypt(data, c.provisionersNewPassphrase)
+			_, err = io.Copy(f, bytes.NewReader(out))
+			if err != nil {
+				c.setError(err, 6)
+				return
+			}
+		},
+	}
+
+	f := cmd.Flags()
+	f.StringVarP(&c.provisionersNewPassphrase, "passphrase", "p", "", "Passphrase for encrypting exported provisioner data.")
+	f.StringVarP(&c.provisionersNewGoogleBucket, "bucket", "b", "", "Name of an existing Google Cloud Storage bucket, for which the provided service account credentials have adequate permissions for object creation/deletion.")
+	cmd.MarkFlagRequired("bucket")
+	f.StringVarP(&c.provisionersNewGoogleKeyFile, "credentials", "f", "", "Path of an existing JSON-formatted Google Cloud Platform service account credentials file.")
+	cmd.MarkFlagRequired("credentials")
+	f.StringVarP(&c.provisionersNewGoogleZone, "zone", "z", "", "Zone to launch instances in when provisioning with '--launch' (default \"us-central1-a\").")
+
+	return cmd
+
 }
@@ -20,14 +20,18 @@ import (
 	"github.com/vorteil/vorteil/pkg/vpkg"
 )
 
-var repositoriesCmd = &cobra.Command{
-	Use:   "repositories",
-	Short: "Interact with vorteil repositories",
+func (c *commandContext) newRepositoriesCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "repositories",
+		Short: "Interact with vorteil repositories",
+	}
 }
 
-var keysCmd = &cobra.Command{
-	Use:   "keys",
-	Short: "Create, List and Delete keys for authentication with Vorteil Repositories",
+func (c *commandContext) newKeysCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "keys",
+		Short: "Create, List and Delete keys for authentication with Vorteil Repositories",
+	}
 }
 
 func checkKeysFolder() (string, error) {
@@ -42,409 +46,423 @@ func checkKeysFolder() (string, error) {
 	return pathCheck, nil
 }
 
-var defaultKeyCmd = &cobra.Command{
-	Use:   "default KEY_NAME",
-	Short: "View the keys that are equal to the default or change the default repository key by providing KEY_NAME",
-	PreRunE: func(cmd *cobra.Command, args []string) error {
-		usr, err := os.UserHomeDir()
-		if err != nil {
-			return err
-		}
-		pathCheck := filepath.Join(usr, ".vorteil", "repository-keys")
-		_, err = os.Stat(pathCheck)
-		if err != nil {
-			err = os.MkdirAll(pathCheck, os.ModePerm)
+func (c *commandContext) newDefaultKeyCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "default KEY_NAME",
+		Short: "View the keys that are equal to the default or change the default repository key by providing KEY_NAME",
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			usr, err := os.UserHomeDir()
 			if err != nil {
 				return err
 			}
-		}
-		return nil
-	},
-	Run: func(cmd *cobra.Command, args []string) {
-
-		pathCheck, err := checkKeysFolder()
-		if err != nil {
-			SetError(err, 1)
-			return
-		}
+			pathCheck := filepath.Join(usr, ".vorteil", "repository-keys")
+			_, err = os.Stat(pathCheck)
+			if err != nil {
+				err = os.MkdirAll(pathCheck, os.ModePerm)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		Run: func(cmd *cobra.Command, args []string) {
 
-		if len(args) > 0 {
-			// Set default to args
-			key := args[0]
-			f, err := os.Open(filepath.Join(pathCheck, key))
+			pathCheck, err := checkKeysFolder()
 			if err != nil {
-				SetError(fmt.Errorf("%s does not exist as a key stored", key), 3)
+				c.setError(err, 1)
 				return
 			}
-			defer f.Close()
-			data, err := ioutil.ReadAll(f)
-			if err != nil {
-				SetError(fmt.Errorf("unable to read from key file"), 4)
+
+			if len(args) > 0 {
+				// Set default to args
+				key := args[0]
+				f, err := os.Open(filepath.Join(pathCheck, key))
+				if err != nil {
+					c.setError(fmt.Errorf("%s does not exist as a key stored", key), 3)
+					return
+				}
+				defer f.Close()
+				data, err := ioutil.ReadAll(f)
+				if err != nil {
+					c.setError(fmt.Errorf("unable to read from key file"), 4)
+					return
+				}
+
+				defaultF, err := os.OpenFile(filepath.Join(pathCheck, "default"), os.O_RDWR|os.O_CREATE, 0644)
+				if err != nil {
+					c.setError(fmt.Errorf("unable to open default key: %s", err.Error()), 5)
+					return
+				}
+
+				defer defaultF.Close()
+				err = ioutil.WriteFile(filepath.Join(pathCheck, "default"), data, os.ModePerm)
+				if err != nil {
+					c.setError(err, 6)
+					return
+				}
+
+				// Finished doing what we wanted
 				return
 			}
 
-			defaultF, err := os.OpenFile(filepath.Join(pathCheck, "default"), os.O_RDWR|os.O_CREATE, 0644)
+			// Open default
+			f, err := os.Open(filepath.Join(pathCheck, "default"))
 			if err != nil {
-				SetError(fmt.Errorf("unable to open default key: %s", err.Error()), 5)
+				c.setError(errors.New("default key has not been set"), 6)
 				return
 			}
+			defer f.Close()
 
-			defer defaultF.Close()
-			err = ioutil.WriteFile(filepath.Join(pathCheck, "default"), data, os.ModePerm)
+			h := md5.New()
+			if _, err := io.Copy(h, f); err != nil {
+				c.setError(err, 7)
+				return
+			}
+
+			fis, err := ioutil.ReadDir(pathCheck)
 			if err != nil {
-				SetError(err, 6)
+				c.setError(err, 8)
 				return
 			}
 
-			// Finished doing what we wanted
-			return
-		}
+			for _, fi := range fis {
 
-		// Open default
-		f, err := os.Open(filepath.Join(pathCheck, "default"))
-		if err != nil {
-			SetError(errors.New("default key has not been set"), 6)
-			return
-		}
-		defer f.Close()
+				if fi.Name() != "default" {
+					f2, err := os.Open(filepath.Join(pathCheck, fi.Name()))
+					if err != nil {
+						c.setError(err, 9)
+						return
+					}
+					h2 := md5.New()
+					if _, err := io.Copy(h2, f2); err != nil {
+						c.setError(err, 6)
+						return
+					}
+					if bytes.Equal(h.Sum(nil), h2.Sum(nil)) {
+						fmt.Println(fi.Name())
+					}
+					f2.Close()
+				}
 
-		h := md5.New()
-		if _, err := io.Copy(h, f); err != nil {
-			SetError(err, 7)
-			return
-		}
+			}
+		},
+	}
+}
 
-		fis, err := ioutil.ReadDir(pathCheck)
-		if err != nil {
-			SetError(err, 8)
-			return
-		}
+func (c *commandContext) newCreateKeyCmd() *cobra.Command {
 
-		for _, fi := range fis {
+	cmd := &cobra.Command{
+		Use:   "create NAME TOKEN",
+		Short: "Creates a file containing the access token to be referenced using name",
+		Args:  cobra.MaximumNArgs(2),
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) < 2 {
+				return errors.New("must provide a NAME and TOKEN")
+			}
+			usr, err := os.UserHomeDir()
+			if err != nil {
+				return err
+			}
+			pathCheck := filepath.Join(usr, ".vorteil", "repository-keys")
+			_, err = os.Stat(pathCheck)
+			if err != nil {
+				err = os.MkdirAll(pathCheck, os.ModePerm)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			name := args[0]
+			if name == "default" {
+				c.setError(errors.New("default is a reserved word and can't be a name"), 1)
+				return
+			}
+			key := args[1]
 
-			if fi.Name() != "default" {
-				f2, err := os.Open(filepath.Join(pathCheck, fi.Name()))
+			pathCheck, err := checkKeysFolder()
+			if err != nil {
+				c.setError(err, 2)
+				return
+			}
+
+			// Check if file exists
+			// if stat returns no error return error saying you need to provide the force flag
+			fi, err := os.Stat(filepath.Join(pathCheck, name))
+			if err == nil && !c.flagForce {
+				c.setError(errors.New("key file already exists provide --force to overwrite"), 2)
+				return
+			}
+
+			if c.flagForce && fi != nil {
+
+				// open old file
+				f2, err := os.Open(filepath.Join(pathCheck, name))
 				if err != nil {
-					SetError(err, 9)
+					c.setError(err, 4)
 					return
 				}
-				h2 := md5.New()
-				if _, err := io.Copy(h2, f2); err != nil {
-					SetError(err, 6)
+				defer f2.Close()
+
+				odata, err := ioutil.ReadAll(f2)
+				if err != nil {
+					c.setError(err, 5)
 					return
 				}
-				if bytes.Equal(h.Sum(nil), h2.Sum(nil)) {
-					fmt.Println(fi.Name())
+
+				// check if []byte(key) is equal to default
+				f, err := os.Open(filepath.Join(pathCheck, "default"))
+				if err == nil {
+					defer f.Close()
+					data, err := ioutil.ReadAll(f)
+					if err != nil {
+						c.setError(err, 6)
+						return
+					}
+					if string(data) == string(odata) {
+						// Write default to be the same
+						err = ioutil.WriteFile(filepath.Join(pathCheck, "default"), []byte(key), os.ModePerm)
+						if err != nil {
+							c.setError(err, 7)
+							return
+						}
+					}
 				}
-				f2.Close()
 			}
 
-		}
-	},
-}
-
-var createKeyCmd = &cobra.Command{
-	Use:   "create NAME TOKEN",
-	Short: "Creates a file containing the access token to be referenced using name",
-	Args:  cobra.MaximumNArgs(2),
-	PreRunE: func(cmd *cobra.Command, args []string) error {
-		if len(args) < 2 {
-			return errors.New("must provide a NAME and TOKEN")
-		}
-		usr, err := os.UserHomeDir()
-		if err != nil {
-			return err
-		}
-		pathCheck := filepath.Join(usr, ".vorteil", "repository-keys")
-		_, err = os.Stat(pathCheck)
-		if err != nil {
-			err = os.MkdirAll(pathCheck, os.ModePerm)
+			// Write key to a file under that keys directory
+			err = ioutil.WriteFile(filepath.Join(pathCheck, name), []byte(key), os.ModePerm)
 			if err != nil {
-				return err
+				c.setError(err, 8)
+				return
 			}
-		}
-		return nil
-	},
-	Run: func(cmd *cobra.Command, args []string) {
-		name := args[0]
-		if name == "default" {
-			SetError(errors.New("default is a reserved word and can't be a name"), 1)
-			return
-		}
-		key := args[1]
 
-		pathCheck, err := checkKeysFolder()
-		if err != nil {
-			SetError(err, 2)
-			return
-		}
+			// Check if default and write another file called default under repository-keys
+			if c.flagDefault {
+				err = ioutil.WriteFile(filepath.Join(pathCheck, "default"), []byte(key), os.ModePerm)
+				if err != nil {
+					c.setError(err, 9)
+					return
+				}
+			}
+		},
+	}
 
-		// Check if file exists
-		// if stat returns no error return error saying you need to provide the force flag
-		fi, err := os.Stat(filepath.Join(pathCheck, name))
-		if err == nil && !flagForce {
-			SetError(errors.New("key file already exists provide --force to overwrite"), 2)
-			return
-		}
+	f := cmd.Flags()
+	f.BoolVar(&c.flagDefault, "default", false, "save this key to use as default")
+	f.BoolVar(&c.flagForce, "force", false, "force overwrite of key file")
 
-		if flagForce && fi != nil {
+	return cmd
 
-			// open old file
-			f2, err := os.Open(filepath.Join(pathCheck, name))
+}
+
+func (c *commandContext) newListKeysCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "list",
+		Short: "List all keys currently stored",
+		Args:  cobra.MaximumNArgs(0),
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			usr, err := os.UserHomeDir()
 			if err != nil {
-				SetError(err, 4)
+				return err
+			}
+			pathCheck := filepath.Join(usr, ".vorteil", "repository-keys")
+			_, err = os.Stat(pathCheck)
+			if err != nil {
+				err = os.MkdirAll(pathCheck, os.ModePerm)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			pathCheck, err := checkKeysFolder()
+			if err != nil {
+				c.setError(err, 2)
 				return
 			}
-			defer f2.Close()
 
-			odata, err := ioutil.ReadAll(f2)
+			fis, err := ioutil.ReadDir(pathCheck)
 			if err != nil {
-				SetError(err, 5)
+				c.setError(err, 2)
 				return
 			}
 
-			// check if []byte(key) is equal to default
-			f, err := os.Open(filepath.Join(pathCheck, "default"))
+			var data []byte
+
+			// Open default key to check which one is also the same as default
+			defaultKey, err := os.Open(filepath.Join(pathCheck, "default"))
 			if err == nil {
-				defer f.Close()
-				data, err := ioutil.ReadAll(f)
+				defer defaultKey.Close()
+				data, err = ioutil.ReadAll(defaultKey)
 				if err != nil {
-					SetError(err, 6)
+					c.setError(err, 3)
 					return
 				}
-				if string(data) == string(odata) {
-					// Write default to be the same
-					err = ioutil.WriteFile(filepath.Join(pathCheck, "default"), []byte(key), os.ModePerm)
-					if err != nil {
-						SetError(err, 7)
-						return
+			}
+
+			for _, fi := range fis {
+				if fi.Name() != "default" {
+					if len(data) > 0 {
+						f, err := os.Open(filepath.Join(pathCheck, fi.Name()))
+						if err != nil {
+							c.setError(err, 4)
+							return
+						}
+						defer f.Close()
+						keyD, err := ioutil.ReadAll(f)
+						if err != nil {
+							c.setError(err, 5)
+							return
+						}
+						if string(data) == string(keyD) {
+							fmt.Printf("%s [default]\n", fi.Name())
+							continue
+						}
 					}
+					fmt.Println(fi.Name())
 				}
 			}
-		}
-
-		// Write key to a file under that keys directory
-		err = ioutil.WriteFile(filepath.Join(pathCheck, name), []byte(key), os.ModePerm)
-		if err != nil {
-			SetError(err, 8)
-			return
-		}
+		},
+	}
+}
 
-		// Check if default and write another file called default under repository-keys
-		if flagDefault {
-			err = ioutil.WriteFile(filepath.Join(pathCheck, "default"), []byte(key), os.ModePerm)
+func (c *commandContext) newDeleteKeyCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "delete NAME",
+		Short: "Delete a key currently stored",
+		Args:  cobra.MaximumNArgs(1),
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) != 1 {
+				return errors.New("Must provide the name of the key you want to delete")
+			}
+			usr, err := os.UserHomeDir()
 			if err != nil {
-				SetError(err, 9)
+				return err
+			}
+			pathCheck := filepath.Join(usr, ".vorteil", "repository-keys")
+			_, err = os.Stat(pathCheck)
+			if err != nil {
+				err = os.MkdirAll(pathCheck, os.ModePerm)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			name := args[0]
+			if name == "default" {
+				c.setError(errors.New("default is a reserved word and can't be used to delete a key"), 1)
 				return
 			}
-		}
-	},
-}
-
-func init() {
-	f := createKeyCmd.Flags()
-	f.BoolVar(&flagDefault, "default", false, "save this key to use as default")
-	f.BoolVar(&flagForce, "force", false, "force overwrite of key file")
-}
+			pathCheck, err := checkKeysFolder()
+			if err != nil {
+				c.setError(err, 2)
+				return
+			}
+			path := filepath.Join(pathCheck, name)
+			dpath := filepath.Join(pathCheck, "default")
 
-var listKeysCmd = &cobra.Command{
-	Use:   "list",
-	Short: "List all keys currently stored",
-	Args:  cobra.MaximumNArgs(0),
-	PreRunE: func(cmd *cobra.Command, args []string) error {
-		usr, err := os.UserHomeDir()
-		if err != nil {
-			return err
-		}
-		pathCheck := filepath.Join(usr, ".vorteil", "repository-keys")
-		_, err = os.Stat(pathCheck)
-		if err != nil {
-			err = os.MkdirAll(pathCheck, os.ModePerm)
+			// before removing we should check if default is the same and delete that
+			f1, err := ioutil.ReadFile(path)
 			if err != nil {
-				return err
+				c.setError(fmt.Errorf("%s keyfile does not exist", name), 2)
+				return
 			}
-		}
-		return nil
-	},
-	Run: func(cmd *cobra.Command, args []string) {
-		pathCheck, err := checkKeysFolder()
-		if err != nil {
-			SetError(err, 2)
-			return
-		}
 
-		fis, err := ioutil.ReadDir(pathCheck)
-		if err != nil {
-			SetError(err, 2)
-			return
-		}
+			f2, err := ioutil.ReadFile(dpath)
+			if err != nil {
+				if !errors.Is(err, os.ErrNotExist) {
+					c.setError(err, 3)
+					return
+				}
+			}
 
-		var data []byte
+			// If same bytes remove default aswell
+			if bytes.Equal(f1, f2) {
+				err = os.Remove(dpath)
+				if err != nil {
+					c.setError(err, 4)
+					return
+				}
+			}
 
-		// Open default key to check which one is also the same as default
-		defaultKey, err := os.Open(filepath.Join(pathCheck, "default"))
-		if err == nil {
-			defer defaultKey.Close()
-			data, err = ioutil.ReadAll(defaultKey)
+			// Else just remove the keyfile
+			err = os.Remove(filepath.Join(pathCheck, name))
 			if err != nil {
-				SetError(err, 3)
+				c.setError(err, 5)
 				return
 			}
-		}
 
-		for _, fi := range fis {
-			if fi.Name() != "default" {
-				if len(data) > 0 {
-					f, err := os.Open(filepath.Join(pathCheck, fi.Name()))
-					if err != nil {
-						SetError(err, 4)
-						return
-					}
-					defer f.Close()
-					keyD, err := ioutil.ReadAll(f)
-					if err != nil {
-						SetError(err, 5)
-						return
-					}
-					if string(data) == string(keyD) {
-						fmt.Printf("%s [default]\n", fi.Name())
-						continue
-					}
-				}
-				fmt.Println(fi.Name())
-			}
-		}
-	},
+		},
+	}
 }
 
-var deleteKeyCmd = &cobra.Command{
-	Use:   "delete NAME",
-	Short: "Delete a key currently stored",
-	Args:  cobra.MaximumNArgs(1),
-	PreRunE: func(cmd *cobra.Command, args []string) error {
-		if len(args) != 1 {
-			return errors.New("Must provide the name of the key you want to delete")
-		}
-		usr, err := os.UserHomeDir()
-		if err != nil {
-			return err
-		}
-		pathCheck := filepath.Join(usr, ".vorteil", "repository-keys")
-		_, err = os.Stat(pathCheck)
-		if err != nil {
-			err = os.MkdirAll(pathCheck, os.ModePerm)
-			if err != nil {
-				return err
+func (c *commandContext) newPushCmd() *cobra.Command {
+
+	cmd := &cobra.Command{
+		Use:   "push REPOSITORY ORG/BUCKET/APP SOURCE",
+		Short: "Push to a repository",
+		Long:  `The push command is a function for quickly pushing an application to the repository.`,
+		Args:  cobra.MaximumNArgs(3),
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) < 3 {
+				return errors.New("must provide three arguments <REPOSITORY ORG/BUCKET/APP SOURCE>")
 			}
-		}
-		return nil
-	},
-	Run: func(cmd *cobra.Command, args []string) {
-		name := args[0]
-		if name == "default" {
-			SetError(errors.New("default is a reserved word and can't be used to delete a key"), 1)
-			return
-		}
-		pathCheck, err := checkKeysFolder()
-		if err != nil {
-			SetError(err, 2)
-			return
-		}
-		path := filepath.Join(pathCheck, name)
-		dpath := filepath.Join(pathCheck, "default")
+			words := strings.Split(args[1], "/")
+			if len(words) < 3 {
+				return fmt.Errorf("invalid format for <org/bucket/app> argument")
+			}
+			return nil
+		},
+		Run: func(cmd *cobra.Command, args []string) {
 
-		// before removing we should check if default is the same and delete that
-		f1, err := ioutil.ReadFile(path)
-		if err != nil {
-			SetError(fmt.Errorf("%s keyfile does not exist", name), 2)
-			return
-		}
+			urlPath := args[0]
+			repoPath := strings.Split(args[1], "/")
+			buildablePath := args[2]
 
-		f2, err := ioutil.ReadFile(dpath)
-		if err != nil {
-			if !errors.Is(err, os.ErrNotExist) {
-				SetError(err, 3)
+			pkgBuilder, err := c.getPackageBuilder("BUILDABLE", buildablePath)
+			if err != nil {
+				c.setError(err, 2)
 				return
 			}
-		}
+			defer pkgBuilder.Close()
 
-		// If same bytes remove default aswell
-		if bytes.Equal(f1, f2) {
-			err = os.Remove(dpath)
+			err = c.modifyPackageBuilder(pkgBuilder)
 			if err != nil {
-				SetError(err, 4)
+				c.setError(err, 3)
 				return
 			}
-		}
-
-		// Else just remove the keyfile
-		err = os.Remove(filepath.Join(pathCheck, name))
-		if err != nil {
-			SetError(err, 5)
-			return
-		}
-
-	},
-}
-
-var pushCmd = &cobra.Command{
-	Use:   "push REPOSITORY ORG/BUCKET/APP SOURCE",
-	Short: "Push to a repository",
-	Long:  `The push command is a function for quickly pushing an application to the repository.`,
-	Args:  cobra.MaximumNArgs(3),
-	PreRunE: func(cmd *cobra.Command, args []string) error {
-		if len(args) < 3 {
-			return errors.New("must provide three arguments <REPOSITORY ORG/BUCKET/APP SOURCE>")
-		}
-		words := strings.Split(args[1], "/")
-		if len(words) < 3 {
-			return fmt.Errorf("invalid format for <org/bucket/app> argument")
-		}
-		return nil
-	},
-	Run: func(cmd *cobra.Command, args []string) {
 
-		urlPath := args[0]
-		repoPath := strings.Split(args[1], "/")
-		buildablePath := args[2]
-
-		pkgBuilder, err := getPackageBuilder("BUILDABLE", buildablePath)
-		if err != nil {
-			SetError(err, 2)
-			return
-		}
-		defer pkgBuilder.Close()
+			err = c.pushPackage(pkgBuilder, urlPath, repoPath)
+			if err != nil {
+				c.setError(err, 5)
+				return
+			}
 
-		err = modifyPackageBuilder(pkgBuilder)
-		if err != nil {
-			SetError(err, 3)
 			return
-		}
+		},
+	}
 
-		err = pushPackage(pkgBuilder, urlPath, repoPath)
-		if err != nil {
-			SetError(err, 5)
-			return
-		}
+	f := cmd.Flags()
+	f.StringVarP(&c.flagKey, "key", "k", "", "vrepo authentication key file name")
 
-		return
-	},
-}
+	return cmd
 
-func init() {
-	f := pushCmd.Flags()
-	f.StringVarP(&flagKey, "key", "k", "", "vrepo authentication key file name")
 }
 
 // checkAuthentication checks to see if the flag has provided a name if not
 // checks to see if default exists if that doesnt exist
 // errors out saying you need to provide authentication
-func checkAuthentication() (string, error) {
+func (c *commandContext) checkAuthentication() (string, error) {
 	pathCheck, err := checkKeysFolder()
 	if err != nil {
 		return "", err
 	}
-	token, err := checkDefaultAndProvided(pathCheck)
+	token, err := c.checkDefaultAndProvided(pathCheck)
 	if err != nil {
 		return "", err
 	}
@@ -453,15 +471,15 @@ func checkAuthentication() (string, error) {
 }
 
 // checkDefaultAndProvided checks both files for authentication
-func checkDefaultAndProvided(pathCheck string) (string, error) {
+func (c *commandContext) checkDefaultAndProvided(pathCheck string) (string, error) {
 	var token string
 	var path string
 	var err error
-	if flagKey != "" {
-		path = filepath.Join(pathCheck, flagKey)
+	if c.flagKey != "" {
+		path = filepath.Join(pathCheck, c.flagKey)
 		token, err = checkAuthFile(path)
 		if err != nil {
-			return "", fmt.Errorf("unable to locate '%s' keyfile", flagKey)
+			return "", fmt.Errorf("unable to locate '%s' keyfile", c.flagKey)
 		}
 	} else {
 		path = filepath.Join(pathCheck, "default")
@@ -492,8 +510,8 @@ func checkAuthFile(path string) (string, error) {
 }
 
 // preparePackage for upload
-func preparePackage(builder vpkg.Builder) (*os.File, error) {
-	spinner := log.NewProgress("Preparing Package", "", 0)
+func (c *commandContext) preparePackage(builder vpkg.Builder) (*os.File, error) {
+	spinner := c.log.NewProgress("Preparing Package", "", 0)
 	defer spinner.Finish(true)
 	file, err := ioutil.TempFile(os.TempDir(), "vpkg-")
 	if err != nil {
@@ -526,7 +544,7 @@ func generateRequest(url string, repo []string, r io.ReadCloser, token string) (
 }
 
 // uploadPackage sends the request to upload package
-func uploadPackage(url string, repo []string, token string, file *os.File) error {
+func (c *commandContext) uploadPackage(url string, repo []string, token string, file *os.File) error {
 	client := &http.Client{}
 
 	stats, err := file.Stat()
@@ -534,7 +552,7 @@ func uploadPackage(url string, repo []string, token string, file *os.File) error
 		return err
 	}
 
-	p := log.NewProgress("Uploading Package", "KiB", stats.Size())
+	p := c.log.NewProgress("Uploading Package", "KiB", stats.Size())
 	r := p.ProxyReader(file)
 	defer p.Finish(true)
 
@@ -569,10 +587,10 @@ func uploadPackage(url string, repo []string, token string, file *os.File) error
 }
 
 // pushPackage takes builder, url and repo array of strings which is org/bucket/app
-func pushPackage(builder vpkg.Builder, url string, repo []string) error {
+func (c *commandContext) pushPackage(builder vpkg.Builder, url string, repo []string) error {
 
 	// check authentication before doing things
-	token, err := checkAuthentication()
+	token, err := c.checkAuthentication()
 	if err != nil {
 		return err
 	}
@@ -581,13 +599,13 @@ func pushPackage(builder vpkg.Builder, url string, repo []string) error {
 		return fmt.Errorf("target repo '%s' is not a Vorteil Repository", url)
 	}
 
-	file, err := preparePackage(builder)
+	file, err := c.preparePackage(builder)
 	if err != nil {
 		return err
 	}
 	defer os.Remove(file.Name())
 
-	err = uploadPackage(url, repo, token, file)
+	err = c.uploadPackage(url, repo, token, file)
 	if err != nil {
 		return err
 	}
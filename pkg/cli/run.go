@@ -7,8 +7,11 @@ package cli
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"net/url"
 	"os"
 	"os/exec"
@@ -16,181 +19,353 @@ import (
 	"path/filepath"
 	"strings"
 	"syscall"
+	"text/tabwriter"
 	"time"
 
 	isatty "github.com/mattn/go-isatty"
-	"github.com/mitchellh/go-homedir"
 	"github.com/spf13/cobra"
 	"github.com/thanhpk/randstr"
 	"github.com/vorteil/vorteil/pkg/imagetools"
 	"github.com/vorteil/vorteil/pkg/vcfg"
 	"github.com/vorteil/vorteil/pkg/vdecompiler"
 	"github.com/vorteil/vorteil/pkg/virtualizers"
+	logger "github.com/vorteil/vorteil/pkg/virtualizers/logging"
 	"github.com/vorteil/vorteil/pkg/virtualizers/util"
 	"github.com/vorteil/vorteil/pkg/vpkg"
 )
 
-var runCmd = &cobra.Command{
-	Use:   "run [RUNNABLE]",
-	Short: "Quick-launch a virtual machine",
-	Long: `The run command is a convenience function for quickly getting a Vorteil machine
+func (c *commandContext) newRunCmd() *cobra.Command {
+
+	cmd := &cobra.Command{
+		Use:   "run [RUNNABLE]",
+		Short: "Quick-launch a virtual machine",
+		Long: `The run command is a convenience function for quickly getting a Vorteil machine
 up and running. It attempts to emulate the behaviour of running the binary
 natively as best as possible, which includes making it superficially appear as
 though the virtual machine is a child process of the CLI by handling interrupts
-and cleaning up the instance when it's done.`,
-	Args: cobra.MaximumNArgs(1),
-	Run: func(cmd *cobra.Command, args []string) {
-		var err error
-
-		if flagSaveDisk != "" {
-			flagSaveDisk, err = filepath.Abs(flagSaveDisk)
+and cleaning up the instance when it's done.
+
+RUNNABLE can be anything accepted as a BUILDABLE by 'vorteil images build',
+including an existing raw disk image, which is run as-is without compiling
+anything. Only VCFG flags and files are used to configure the virtual machine
+in that case.
+
+Virtualizers that boot the kernel directly, such as firecracker, can be given
+extra kernel arguments with '--kernel-args-extra', e.g. '--kernel-args-extra
+"loglevel=9"', which are appended to the image's own without rebuilding it.
+
+The app's name servers can be replaced for a single run with '--dns', and
+extra entries added to its /etc/hosts with '--add-host NAME:IP', which makes it
+easy to point an app at staging endpoints without changing its VCFG.
+
+The serial output of apps with several programs can be narrowed down to one of
+them with '--program', given the program's index in the VCFG or 'system' for
+the output of the kernel and init. It turns on system.tag-output, which tags
+each line with the program that wrote it. The full serial output of the last
+run of each app is saved, and can be printed again with 'vorteil logs'.
+
+Every run boots from a scratch copy of the disk, so the RUNNABLE itself is
+never modified. With '--ephemeral' the scratch directory holding that copy, its
+additional disks and the hypervisor's files is deleted as soon as the virtual
+machine is torn down, and anything that would keep the disk's state around,
+like '--save-disk', is refused, so repeated runs always start from the exact
+built state.
+
+With '--export-only DIR' the virtual machine is prepared for the selected
+platform but never started. Instead, its disks and the files the hypervisor
+needs to run it are written to DIR. That means a qemu launch script, a VMware
+.vmx file, a VirtualBox .vbox file or a firecracker configuration file, which
+can be hand-tuned and launched with the hypervisor's own tooling.`,
+		Args: cobra.MaximumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			var err error
+
+			err = c.checkKernelArgsExtra(c.flagPlatform)
 			if err != nil {
-				SetError(fmt.Errorf("save-disk could not format path, error: %v", err), 12)
+				c.setError(err, 16)
 				return
 			}
 
-			_, err = os.Stat(flagSaveDisk)
-			if err == nil {
-				SetError(fmt.Errorf("save-disk points to file '%s' that already exists", flagSaveDisk), 13)
-				return
-			}
+			if c.flagExportOnly != "" {
+				if c.flagPlatform == platformHyperV {
+					c.setError(errors.New("--export-only isn't supported by hyper-v"), 12)
+					return
+				}
 
-			sdParent := filepath.Dir(flagSaveDisk)
-			stat, err := os.Stat(sdParent)
-			if os.IsNotExist(err) {
-				SetError(fmt.Errorf("save-disk path parent '%s' does not exist", sdParent), 14)
-				return
+				c.flagExportOnly, err = filepath.Abs(c.flagExportOnly)
+				if err != nil {
+					c.setError(fmt.Errorf("export-only could not format path, error: %v", err), 12)
+					return
+				}
 			}
 
-			if !stat.IsDir() {
-				SetError(errors.New("save-disk path parent is not directory"), 15)
+			if c.flagEphemeral && c.flagSaveDisk != "" {
+				c.setError(errors.New("--save-disk can't be used with --ephemeral, which discards the disk when the run ends"), 12)
 				return
 			}
 
-		}
-
-		buildablePath := "."
-		if len(args) >= 1 {
-			buildablePath = args[0]
-		}
-
-		pkgBuilder, err := getPackageBuilder("BUILDABLE", buildablePath)
-		if err != nil {
-			SetError(err, 2)
-			return
-		}
-		defer pkgBuilder.Close()
-
-		err = modifyPackageBuilder(pkgBuilder)
-		if err != nil {
-			SetError(err, 3)
-			return
-		}
+			if c.flagSaveDisk != "" {
+				c.flagSaveDisk, err = filepath.Abs(c.flagSaveDisk)
+				if err != nil {
+					c.setError(fmt.Errorf("save-disk could not format path, error: %v", err), 12)
+					return
+				}
 
-		pkgReader, err := vpkg.ReaderFromBuilder(pkgBuilder)
-		if err != nil {
-			SetError(err, 4)
-			return
-		}
-		defer pkgReader.Close()
+				_, err = os.Stat(c.flagSaveDisk)
+				if err == nil {
+					c.setError(fmt.Errorf("save-disk points to file '%s' that already exists", c.flagSaveDisk), 13)
+					return
+				}
 
-		pkgReader, err = vpkg.PeekVCFG(pkgReader)
-		if err != nil {
-			SetError(err, 5)
-			return
-		}
+				sdParent := filepath.Dir(c.flagSaveDisk)
+				stat, err := os.Stat(sdParent)
+				if os.IsNotExist(err) {
+					c.setError(fmt.Errorf("save-disk path parent '%s' does not exist", sdParent), 14)
+					return
+				}
 
-		cfgf := pkgReader.VCFG()
-		cfg, err := vcfg.LoadFile(cfgf)
-		if err != nil {
-			SetError(err, 6)
-			return
-		}
-		err = initKernels()
-		if err != nil {
-			SetError(err, 7)
-			return
-		}
+				if !stat.IsDir() {
+					c.setError(errors.New("save-disk path parent is not directory"), 15)
+					return
+				}
 
-		src, _, err := readSourcePath(buildablePath)
-		if err != nil {
-			SetError(err, 20)
-			return
-		}
+			}
 
-		// Fetch name of the app from path
-		var name string
-		_, err = os.Stat(src)
-		if err != nil {
-			// If stat errors assume its a url
-			u, errParse := url.Parse(buildablePath)
-			if errParse == nil {
-				// Check if its a url i can handle otherwise default to vorteil-vm
-				if u.Hostname() == "apps.vorteil.io" {
-					name = u.Path
-					name = strings.ReplaceAll(name, "/file/", "")
-					name = strings.ReplaceAll(name, "/", "-")
-				} else {
-					name = "vorteil-vm"
+			programIndex := logger.SystemOutput
+			if c.flagProgram != "" {
+				programIndex, err = parseProgramFlag(c.flagProgram)
+				if err != nil {
+					c.setError(err, 17)
+					return
 				}
-			} else {
-				SetError(err, 1)
-				return
 			}
-		} else {
-			name = strings.ReplaceAll(filepath.Base(buildablePath), ".vorteil", "")
-		}
 
-		switch flagPlatform {
-		case platformQEMU:
-			err = runQEMU(pkgReader, cfg, name, flagSaveDisk)
-			if err != nil {
-				SetError(err, 8)
-				return
+			buildablePath := "."
+			if len(args) >= 1 {
+				buildablePath = args[0]
 			}
-		case platformVMware:
-			err = runVMware(pkgReader, cfg, name, flagSaveDisk)
+
+			image, err := getRawImage(buildablePath)
 			if err != nil {
-				SetError(err, 13)
+				c.setError(err, 2)
 				return
 			}
-		case platformVirtualBox:
-			err = runVirtualBox(pkgReader, cfg, name, flagSaveDisk)
-			if err != nil {
-				SetError(err, 9)
-				return
+
+			disk := new(diskSource)
+			var cfg *vcfg.VCFG
+
+			if image != nil {
+				defer image.Close()
+				disk.image = image
+
+				if c.hasRunNetworkOverrides() {
+					c.setError(errors.New("--dns and --add-host can't be used to run a raw disk image"), 3)
+					return
+				}
+
+				cfg, err = c.rawImageVCFG()
+				if err != nil {
+					c.setError(err, 3)
+					return
+				}
+			} else {
+				pkgBuilder, err := c.getPackageBuilder("BUILDABLE", buildablePath)
+				if err != nil {
+					c.setError(err, 2)
+					return
+				}
+				defer pkgBuilder.Close()
+
+				if c.flagProgram != "" {
+					c.overrideVCFG.System.TagOutput = true
+				}
+
+				err = c.modifyPackageBuilder(pkgBuilder)
+				if err != nil {
+					c.setError(err, 3)
+					return
+				}
+
+				pkgReader, err := vpkg.ReaderFromBuilder(pkgBuilder)
+				if err != nil {
+					c.setError(err, 4)
+					return
+				}
+				defer pkgReader.Close()
+
+				pkgReader, err = vpkg.PeekVCFG(pkgReader)
+				if err != nil {
+					c.setError(err, 5)
+					return
+				}
+
+				cfgf := pkgReader.VCFG()
+				cfg, err = vcfg.LoadFile(cfgf)
+				if err != nil {
+					c.setError(err, 6)
+					return
+				}
+
+				if programIndex >= len(cfg.Programs) {
+					c.setError(fmt.Errorf("invalid --program '%s': the app only has %d programs", c.flagProgram, len(cfg.Programs)), 6)
+					return
+				}
+
+				pkgReader, err = c.overrideRunNetwork(pkgReader, cfg)
+				if err != nil {
+					c.setError(err, 6)
+					return
+				}
+
+				err = c.initKernels()
+				if err != nil {
+					c.setError(err, 7)
+					return
+				}
+
+				disk.pkg = pkgReader
 			}
-		case platformHyperV:
-			err = runHyperV(pkgReader, cfg, name, flagSaveDisk)
+
+			src, _, err := readSourcePath(buildablePath)
 			if err != nil {
-				SetError(err, 10)
+				c.setError(err, 20)
 				return
 			}
-		case platformFirecracker:
-			err = runFirecracker(pkgReader, cfg, name, flagSaveDisk)
+
+			// Fetch name of the app from path
+			var name string
+			_, err = os.Stat(src)
 			if err != nil {
-				SetError(err, 11)
-				return
-			}
-		default:
-			if flagPlatform == "not installed" {
-				SetError((fmt.Errorf("no virtualizers are currently installed")), 12)
+				// If stat errors assume its a url
+				u, errParse := url.Parse(buildablePath)
+				if errParse == nil {
+					// Check if its a url i can handle otherwise default to vorteil-vm
+					if u.Hostname() == "apps.vorteil.io" {
+						name = u.Path
+						name = strings.ReplaceAll(name, "/file/", "")
+						name = strings.ReplaceAll(name, "/", "-")
+					} else {
+						name = "vorteil-vm"
+					}
+				} else {
+					c.setError(err, 1)
+					return
+				}
 			} else {
-				SetError((fmt.Errorf("platform '%s' not supported", flagPlatform)), 12)
+				name = strings.ReplaceAll(filepath.Base(buildablePath), ".vorteil", "")
+				if image != nil {
+					name = strings.TrimSuffix(name, filepath.Ext(name))
+				}
 			}
-		}
 
-	},
+			switch c.flagPlatform {
+			case platformQEMU:
+				err = c.runQEMU(disk, cfg, name, c.flagSaveDisk)
+				if err != nil {
+					c.setError(err, 8)
+					return
+				}
+			case platformVMware:
+				err = c.runVMware(disk, cfg, name, c.flagSaveDisk)
+				if err != nil {
+					c.setError(err, 13)
+					return
+				}
+			case platformVirtualBox:
+				err = c.runVirtualBox(disk, cfg, name, c.flagSaveDisk)
+				if err != nil {
+					c.setError(err, 9)
+					return
+				}
+			case platformHyperV:
+				err = c.runHyperV(disk, cfg, name, c.flagSaveDisk)
+				if err != nil {
+					c.setError(err, 10)
+					return
+				}
+			case platformFirecracker:
+				err = c.runFirecracker(disk, cfg, name, c.flagSaveDisk)
+				if err != nil {
+					c.setError(err, 11)
+					return
+				}
+			default:
+				if c.flagPlatform == "not installed" {
+					c.setError((fmt.Errorf("no virtualizers are currently installed")), 12)
+				} else {
+					c.setError((fmt.Errorf("platform '%s' not supported", c.flagPlatform)), 12)
+				}
+			}
+
+		},
+	}
+
+	f := cmd.Flags()
+	f.StringVar(&c.flagPlatform, "platform", defaultVirtualizer(), "run a virtual machine with appropriate hypervisor (qemu, firecracker, virtualbox, hyper-v)")
+	f.StringVar(&c.flagSaveDisk, "save-disk", "", "copy's a vorteil disk after a run operation to the given path")
+	f.StringVar(&c.flagExportOnly, "export-only", "", "write the virtual machine's disks and hypervisor files to this directory instead of starting it")
+	f.BoolVar(&c.flagEphemeral, "ephemeral", false, "delete the run's scratch disk and hypervisor files when the virtual machine is torn down")
+	f.StringVarP(&c.flagKey, "key", "k", "", "vrepo authentication key")
+	f.BoolVar(&c.flagGUI, "gui", false, "when running virtual machine show gui of hypervisor")
+	f.BoolVar(&c.flagShell, "shell", false, "add a busybox shell environment to the image")
+	f.StringVar(&c.flagRecord, "record", "", "extract touched files to this path after running")
+	f.BoolVar(&c.flagNoCache, "no-cache", false, "don't reuse or cache the compiled file-system")
+	f.StringSliceVar(&c.flagOSFiles, "os-files", nil, "<src>[@<dst>]   add files from the host filesystem to a folder in the Vorteil OS partition (dst defaults to '/')")
+	f.BoolVar(&c.flagTZData, "tzdata", false, "add the host's time-zone database and C.UTF-8 locale to the app, with the local time zone set by system.timezone")
+	f.StringArrayVar(&c.flagTemplateValues, "template-value", nil, "set a value for the app's templates, as name=value")
+	f.StringVar(&c.flagPolicy, "policy", "", "check the app against the rules in this policy file before building it")
+	f.StringVar(&c.flagKernelArgsExtra, "kernel-args-extra", "", "extra kernel arguments to boot with, for virtualizers that boot the kernel directly (firecracker)")
+	f.StringVar(&c.flagHyperVSwitch, "hyperv-switch", "", "attach hyper-v virtual machines to this virtual switch instead of forwarding their ports to localhost through NAT")
+	f.BoolVar(&c.flagFirecrackerRootless, "firecracker-rootless", false, "network firecracker virtual machines with slirp4netns, forwarding their ports to localhost, so they can run without root")
+	f.BoolVar(&c.flagStrictPorts, "strict-ports", false, "fail if a port the virtual machine forwards is in use on the host, instead of forwarding a random free port")
+	f.BoolVar(&c.flagSkipPreflight, "skip-preflight", false, "don't check the host's free memory, disk space and hypervisor support before starting the virtual machine")
+	f.StringSliceVar(&c.flagDNS, "dns", nil, "name servers to use for this run instead of the app's own")
+	f.StringArrayVar(&c.flagAddHosts, "add-host", nil, "NAME:IP   add an entry to the app's /etc/hosts for this run")
+	f.StringVar(&c.flagProgram, "program", "", "only show the serial output of the program at this index in the VCFG, or 'system' for everything else")
+
+	return cmd
+
 }
 
-func init() {
-	f := runCmd.Flags()
-	f.StringVar(&flagPlatform, "platform", defaultVirtualizer(), "run a virtual machine with appropriate hypervisor (qemu, firecracker, virtualbox, hyper-v)")
-	f.StringVar(&flagSaveDisk, "save-disk", "", "copy's a vorteil disk after a run operation to the given path")
-	f.StringVarP(&flagKey, "key", "k", "", "vrepo authentication key")
-	f.BoolVar(&flagGUI, "gui", false, "when running virtual machine show gui of hypervisor")
-	f.BoolVar(&flagShell, "shell", false, "add a busybox shell environment to the image")
-	f.StringVar(&flagRecord, "record", "", "extract touched files to this path after running")
+// checkKernelArgsExtra returns an error if '--kernel-args-extra' was given
+// for a platform that boots through the image's bootloader, which would
+// ignore it.
+func (c *commandContext) checkKernelArgsExtra(platform string) error {
+
+	if c.flagKernelArgsExtra != "" && platform != platformFirecracker {
+		return fmt.Errorf("--kernel-args-extra is only supported by virtualizers that boot the kernel directly, not '%s'", platform)
+	}
+
+	return nil
+
+}
+
+// platformRunner returns the function that builds and runs a disk on the
+// named platform.
+func (c *commandContext) platformRunner(platform string) (func(src *diskSource, cfg *vcfg.VCFG, name, diskOutput string) error, error) {
+
+	err := c.checkKernelArgsExtra(platform)
+	if err != nil {
+		return nil, err
+	}
+
+	switch platform {
+	case platformQEMU:
+		return c.runQEMU, nil
+	case platformVMware:
+		return c.runVMware, nil
+	case platformVirtualBox:
+		return c.runVirtualBox, nil
+	case platformHyperV:
+		return c.runHyperV, nil
+	case platformFirecracker:
+		return c.runFirecracker, nil
+	case "not installed":
+		return nil, fmt.Errorf("no virtualizers are currently installed")
+	default:
+		return nil, fmt.Errorf("platform '%s' not supported", platform)
+	}
+
 }
 
 func defaultVirtualizer() string {
@@ -214,7 +389,7 @@ func defaultVirtualizer() string {
 	return defaultP
 }
 
-func runDecompile(diskpath string, outpath string, skipUnTouched bool) error {
+func (c *commandContext) runDecompile(diskpath string, outpath string, skipUnTouched bool) error {
 	iio, err := vdecompiler.Open(diskpath)
 	if err != nil {
 		return err
@@ -230,37 +405,76 @@ func runDecompile(diskpath string, outpath string, skipUnTouched bool) error {
 	for _, dFile := range report.ImageFiles {
 		switch dFile.Result {
 		case imagetools.CopiedMkDir:
-			log.Debugf("Creating Dir > %s", dFile.Path)
+			c.log.Debugf("Creating Dir > %s", dFile.Path)
 		case imagetools.CopiedRegularFile:
-			log.Debugf("Copied File  > %s", dFile.Path)
+			c.log.Debugf("Copied File  > %s", dFile.Path)
 		case imagetools.CopiedSymlink:
-			log.Debugf("Created Symlink > %s", dFile.Path)
+			c.log.Debugf("Created Symlink > %s", dFile.Path)
 		case imagetools.SkippedAbnormalFile:
-			log.Debugf("Skipped Abnormal > %s", dFile.Path)
+			c.log.Debugf("Skipped Abnormal > %s", dFile.Path)
 		case imagetools.SkippedNotTouched:
-			log.Debugf("Skipped Untouched File > %s", dFile.Path)
+			c.log.Debugf("Skipped Untouched File > %s", dFile.Path)
 		}
 	}
 
 	return nil
 }
-func run(virt virtualizers.Virtualizer, diskpath string, cfg *vcfg.VCFG, name string) error {
+func (c *commandContext) run(virt virtualizers.Virtualizer, diskpath string, disks []string, cfg *vcfg.VCFG, name string) error {
+
+	fcPath, err := firecrackerPath()
+	if err != nil {
+		return err
+	}
+
+	// cancelled on interrupt, so a VM that is still being created never starts
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	args := &virtualizers.PrepareArgs{
+		Name:        fmt.Sprintf("%s-%s", name, randstr.Hex(4)),
+		PName:       virt.Type(),
+		Context:     ctx,
+		Start:       true,
+		Config:      cfg,
+		FCPath:      fcPath,
+		ImagePath:   diskpath,
+		Disks:       disks,
+		Logger:      c.log,
+		KernelArgs:  c.flagKernelArgsExtra,
+		StrictPorts: c.flagStrictPorts,
+	}
+
+	if !c.flagSkipPreflight {
+		err = virtualizers.Preflight(virt.Type(), args)
+		if err != nil {
+			return fmt.Errorf("%w (use --skip-preflight to try anyway)", err)
+		}
+	}
+
+	if c.flagExportOnly != "" {
+		return c.exportVM(virt, args)
+	}
+
+	vo := virt.Prepare(args)
 
-	// Gather home directory for firecracker storage path
-	home, err := homedir.Dir()
+	out := c.serialOutput
+
+	filter, err := programFilter(out, c.flagProgram)
 	if err != nil {
 		return err
 	}
+	if filter != nil {
+		defer filter.Flush()
+		out = filter
+	}
 
-	vo := virt.Prepare(&virtualizers.PrepareArgs{
-		Name:      fmt.Sprintf("%s-%s", name, randstr.Hex(4)),
-		PName:     virt.Type(),
-		Start:     true,
-		Config:    cfg,
-		FCPath:    filepath.Join(home, ".vorteil", "firecracker-vm"),
-		ImagePath: diskpath,
-		Logger:    log,
-	})
+	serialLog, err := createSerialLog(name)
+	if err != nil {
+		c.log.Warnf("Serial output won't be saved: %v", err)
+	} else {
+		defer serialLog.Close()
+		out = io.MultiWriter(serialLog, out)
+	}
 
 	serial := virt.Serial()
 	serialSubscription := serial.Subscribe()
@@ -276,15 +490,19 @@ func run(virt virtualizers.Virtualizer, diskpath string, cfg *vcfg.VCFG, name st
 	defer func() {
 		virt.Close(true)
 
-		if flagRecord != "" {
-			decompileSpinner := log.NewProgress("Decompiling Disk", "", 0)
+		if c.flagEphemeral {
+			defer c.discardScratch(diskpath)
+		}
+
+		if c.flagRecord != "" {
+			decompileSpinner := c.log.NewProgress("Decompiling Disk", "", 0)
 			defer decompileSpinner.Finish(true)
-			if err := runDecompile(diskpath, flagRecord, true); err != nil {
-				SetError(err, 1)
+			if err := c.runDecompile(diskpath, c.flagRecord, true); err != nil {
+				c.setError(err, 1)
 				return
 			}
 			decompileSpinner.Finish(true)
-			log.Printf("Decompile Completed")
+			c.log.Printf("Decompile Completed")
 		}
 	}()
 
@@ -309,15 +527,26 @@ func run(virt virtualizers.Virtualizer, diskpath string, cfg *vcfg.VCFG, name st
 
 			// Check prepare error from vm operation
 			if prepareError != nil {
+				if finished && errors.Is(prepareError, context.Canceled) {
+					return nil
+				}
 				return prepareError
 			}
 			if virt.State() == virtualizers.Alive && !routesChecked {
 				routesChecked = true
-				lines := gatherNetworkDetails(util.ConvertToVM(virt.Details()).(*virtualizers.VirtualMachine))
+				machine := util.ConvertToVM(virt.Details()).(*virtualizers.VirtualMachine)
+				lines := gatherNetworkDetails(machine)
 				if len(lines) > 0 {
-					log.Warnf("Network settings")
+					c.log.Warnf("Network settings")
 					for _, line := range lines {
-						log.Warnf(line)
+						c.log.Warnf(line)
+					}
+				}
+				remaps := virtualizers.RemappedPorts(machine.Networks)
+				if len(remaps) > 0 {
+					c.log.Warnf("Ports in use on the host were remapped (use --strict-ports to fail instead)")
+					for _, line := range formatPortRemaps(remaps) {
+						c.log.Warnf(line)
 					}
 				}
 			}
@@ -339,19 +568,24 @@ func run(virt virtualizers.Virtualizer, diskpath string, cfg *vcfg.VCFG, name st
 			if !more {
 				return nil
 			}
-			fmt.Print(string(msg))
+			_, _ = out.Write(msg)
 		case <-signalChannel:
 			if finished {
 				return nil
 			}
+			finished = true
+			if virt.State() != virtualizers.Alive {
+				// abort the VM's creation, or stop it once it has started
+				cancel()
+				continue
+			}
 			// Close virtual machine without forcing to handle stopping the virtual machine gracefully
 			go func() {
 				err = virt.Stop()
 				if err != nil {
-					log.Errorf(err.Error())
+					c.log.Errorf(err.Error())
 				}
 			}()
-			finished = true
 
 		case <-chBool:
 			return nil
@@ -360,6 +594,60 @@ func run(virt virtualizers.Virtualizer, diskpath string, cfg *vcfg.VCFG, name st
 
 }
 
+// exportVM prepares the VM described by args without starting it, and writes
+// the files its hypervisor needs to run it to the '--export-only' directory.
+func (c *commandContext) exportVM(virt virtualizers.Virtualizer, args *virtualizers.PrepareArgs) error {
+
+	exporter, ok := virt.(virtualizers.Exporter)
+	if !ok {
+		return fmt.Errorf("%s virtual machines can't be exported", virt.Type())
+	}
+
+	err := os.MkdirAll(c.flagExportOnly, 0755)
+	if err != nil {
+		return err
+	}
+
+	args.Start = false
+	vo := virt.Prepare(args)
+	defer virt.Close(true)
+
+	err = <-vo.Error
+	if err != nil {
+		return err
+	}
+
+	paths, err := exporter.Export(c.flagExportOnly)
+	if err != nil {
+		return err
+	}
+
+	for _, path := range paths {
+		c.log.Printf("%s", path)
+	}
+
+	return nil
+
+}
+
+// discardScratch deletes the directory an ephemeral run's disk was built in,
+// along with everything else in it: the additional disks and whatever files the
+// hypervisor left behind. Each runner builds the disk in a directory of its
+// own, so nothing else is in there.
+func (c *commandContext) discardScratch(diskpath string) {
+
+	dir := filepath.Dir(diskpath)
+
+	err := os.RemoveAll(dir)
+	if err != nil {
+		c.log.Warnf("Failed to discard the ephemeral disk in '%s': %v", dir, err)
+		return
+	}
+
+	c.log.Debugf("Discarded the ephemeral disk in '%s'", dir)
+
+}
+
 func fetchPorts(lines []string, portmap virtualizers.RouteMap, networkType string) []string {
 	actual := portmap.Address[strings.LastIndex(portmap.Address, ":")+1:]
 	if actual != portmap.Port && actual != "" {
@@ -406,6 +694,21 @@ func gatherNetworkDetails(machine *virtualizers.VirtualMachine) []string {
 	return lines
 }
 
+// formatPortRemaps returns an aligned line for each remapped port, showing
+// the port that was requested and the host port it was forwarded from instead.
+func formatPortRemaps(remaps []virtualizers.PortRemap) []string {
+
+	buf := new(bytes.Buffer)
+	w := tabwriter.NewWriter(buf, 0, 0, 2, ' ', 0)
+	for _, r := range remaps {
+		fmt.Fprintf(w, " • nic%d\t%s\t%s → %s\n", r.NIC, r.Protocol, r.Requested, r.Actual)
+	}
+	_ = w.Flush()
+
+	return strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+
+}
+
 func raw(start bool) error {
 	r := "raw"
 	if !start {
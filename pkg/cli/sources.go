@@ -0,0 +1,313 @@
+package cli
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/vorteil/vorteil/pkg/elog"
+	"github.com/vorteil/vorteil/pkg/vconvert"
+	"github.com/vorteil/vorteil/pkg/vpkg"
+)
+
+// sourceResolver resolves one kind of BUILDABLE or PACKABLE into a package.
+type sourceResolver struct {
+
+	// match reports whether src is this kind of source. It returns an error
+	// if src is this kind of source but can't be used as one.
+	match func(src string) (bool, error)
+
+	// reader loads src as a package. It's nil for sources that have to be
+	// built before they're a package, like project directories.
+	reader func(c *commandContext, argName, src string) (vpkg.Reader, error)
+
+	// builder returns a builder for the package src resolves to. If it's
+	// nil the builder is made from the package reader loads.
+	builder func(c *commandContext, argName, src string) (vpkg.Builder, error)
+}
+
+type registeredSourceResolver struct {
+	name sourceType
+	*sourceResolver
+}
+
+var registeredSourceResolvers []registeredSourceResolver
+
+// registerSourceResolver registers a sourceResolver with a given name.
+// Resolvers are tried in the order they're registered, so resolvers for
+// sources that look like URLs must be registered before the URL resolver.
+func registerSourceResolver(name sourceType, r *sourceResolver) error {
+
+	for _, x := range registeredSourceResolvers {
+		if x.name == name {
+			return fmt.Errorf("refusing to register source resolver '%s': already registered", name)
+		}
+	}
+
+	registeredSourceResolvers = append(registeredSourceResolvers, registeredSourceResolver{
+		name:           name,
+		sourceResolver: r,
+	})
+
+	return nil
+
+}
+
+// resolveSource returns the first registered resolver that matches src, or
+// nil if none do.
+func resolveSource(src string) (*registeredSourceResolver, error) {
+
+	for i := range registeredSourceResolvers {
+		r := &registeredSourceResolvers[i]
+		ok, err := r.match(src)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			return r, nil
+		}
+	}
+
+	return nil, nil
+
+}
+
+func init() {
+
+	for _, x := range []struct {
+		name sourceType
+		r    *sourceResolver
+	}{
+		{sourceS3, &sourceResolver{
+			match:  matchScheme("s3://"),
+			reader: (*commandContext).getReaderS3,
+		}},
+		{sourceGit, &sourceResolver{
+			match:   matchScheme("git+"),
+			builder: (*commandContext).getBuilderGit,
+		}},
+		{sourceOCI, &sourceResolver{
+			match:   matchScheme("oci://"),
+			builder: (*commandContext).getBuilderOCI,
+		}},
+		{sourceVRepo, &sourceResolver{
+			match: matchScheme("vrepo://"),
+			reader: func(c *commandContext, argName, src string) (vpkg.Reader, error) {
+				return c.downloadPackage("https://"+strings.TrimPrefix(src, "vrepo://"), true)
+			},
+		}},
+		{sourceURL, &sourceResolver{
+			match: matchURL,
+			reader: func(c *commandContext, argName, src string) (vpkg.Reader, error) {
+				return c.getReaderURL(src)
+			},
+		}},
+		{sourceFile, &sourceResolver{
+			match: matchFile,
+			reader: func(c *commandContext, argName, src string) (vpkg.Reader, error) {
+				return getReaderFile(src)
+			},
+		}},
+		{sourceDir, &sourceResolver{
+			match: matchDir,
+			builder: func(c *commandContext, argName, src string) (vpkg.Builder, error) {
+				return getBuilderDir(argName, src)
+			},
+		}},
+	} {
+		err := registerSourceResolver(x.name, x.r)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+}
+
+func matchScheme(prefix string) func(src string) (bool, error) {
+	return func(src string) (bool, error) {
+		return strings.HasPrefix(src, prefix), nil
+	}
+}
+
+func matchURL(src string) (bool, error) {
+	if _, err := url.ParseRequestURI(src); err == nil {
+		if u, uErr := url.Parse(src); uErr == nil && u.Scheme != "" && u.Host != "" && u.Path != "" {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func matchFile(src string) (bool, error) {
+	src, target, err := readSourcePath(src)
+	if err != nil {
+		return false, err
+	}
+
+	fi, err := os.Stat(src)
+	if err != nil || fi.IsDir() {
+		return false, nil
+	}
+
+	if target != "" {
+		return false, errors.New("Targetable runs are unable to be used on packages")
+	}
+
+	return true, nil
+}
+
+func matchDir(src string) (bool, error) {
+	src, _, err := readSourcePath(src)
+	if err != nil {
+		return false, err
+	}
+
+	fi, err := os.Stat(src)
+	return err == nil && fi.IsDir(), nil
+}
+
+// tempBuilder is a builder for a project that was fetched into a temporary
+// directory, which is removed when the builder is closed.
+type tempBuilder struct {
+	vpkg.Builder
+	dir string
+}
+
+func (b *tempBuilder) Close() error {
+	err := b.Builder.Close()
+	_ = os.RemoveAll(b.dir)
+	return err
+}
+
+// newTempBuilder returns a builder for the project in dir, which it takes
+// ownership of.
+func newTempBuilder(argName, dir string) (vpkg.Builder, error) {
+	pkgb, err := getBuilderDir(argName, dir)
+	if err != nil {
+		_ = os.RemoveAll(dir)
+		return nil, err
+	}
+
+	return &tempBuilder{Builder: pkgb, dir: dir}, nil
+}
+
+// getBuilderGit clones a project from a git repository. The repository's URL
+// follows 'git+', and a branch or tag to clone can follow a '#'.
+func (c *commandContext) getBuilderGit(argName, src string) (vpkg.Builder, error) {
+	repo := strings.TrimPrefix(src, "git+")
+
+	var ref string
+	if i := strings.LastIndex(repo, "#"); i >= 0 {
+		repo, ref = repo[:i], repo[i+1:]
+	}
+
+	dir, err := ioutil.TempDir("", "vorteil-git")
+	if err != nil {
+		return nil, err
+	}
+
+	args := []string{"clone", "--depth", "1"}
+	if ref != "" {
+		args = append(args, "--branch", ref)
+	}
+	args = append(args, "--", repo, dir)
+
+	c.log.Infof("Cloning %s", repo)
+	out, err := exec.Command("git", args...).CombinedOutput()
+	if err != nil {
+		_ = os.RemoveAll(dir)
+		return nil, fmt.Errorf("failed to clone %s '%s': %v: %s", argName, src, err, bytes.TrimSpace(out))
+	}
+
+	return newTempBuilder(argName, dir)
+}
+
+// getBuilderOCI converts a container image into a project, the same way the
+// convert-container command does.
+func (c *commandContext) getBuilderOCI(argName, src string) (vpkg.Builder, error) {
+	cc, err := vconvert.NewContainerConverter(strings.TrimPrefix(src, "oci://"), "", c.log)
+	if err != nil {
+		return nil, err
+	}
+
+	dir, err := ioutil.TempDir("", "vorteil-oci")
+	if err != nil {
+		return nil, err
+	}
+
+	err = cc.ConvertToProject(dir, "", "")
+	if err != nil {
+		_ = os.RemoveAll(dir)
+		return nil, err
+	}
+
+	return newTempBuilder(argName, dir)
+}
+
+// getReaderS3 loads a package from an S3 bucket, using the default AWS
+// credentials. If no region is configured the bucket's own region is used.
+func (c *commandContext) getReaderS3(argName, src string) (vpkg.Reader, error) {
+	u, err := url.Parse(src)
+	if err != nil {
+		return nil, err
+	}
+
+	bucket, key := u.Host, strings.TrimPrefix(u.Path, "/")
+	if bucket == "" || key == "" {
+		return nil, fmt.Errorf("failed to resolve %s '%s': must include the bucket and key", argName, src)
+	}
+
+	sess, err := session.NewSessionWithOptions(session.Options{
+		SharedConfigState: session.SharedConfigEnable,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not create aws session: %v", err)
+	}
+
+	if aws.StringValue(sess.Config.Region) == "" {
+		region, err := s3manager.GetBucketRegion(aws.BackgroundContext(), sess, bucket, "us-east-1")
+		if err != nil {
+			return nil, err
+		}
+		sess = sess.Copy(&aws.Config{Region: aws.String(region)})
+	}
+
+	obj, err := s3.New(sess).GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var p elog.Progress
+	if obj.ContentLength == nil {
+		p = c.log.NewProgress("Downloading package", "", 0)
+		defer p.Finish(true)
+	} else {
+		p = c.log.NewProgress("Downloading package", "KiB", *obj.ContentLength)
+	}
+
+	pkgr, err := vpkg.Load(p.ProxyReader(obj.Body))
+	if err != nil {
+		obj.Body.Close()
+		p.Finish(false)
+		return nil, err
+	}
+
+	return pkgr, nil
+}
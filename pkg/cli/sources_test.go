@@ -0,0 +1,52 @@
+package cli
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetSourceType(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "sources")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	pkg := filepath.Join(dir, "app.vorteil")
+	err = ioutil.WriteFile(pkg, nil, 0644)
+	assert.NoError(t, err)
+
+	for src, expected := range map[string]sourceType{
+		"s3://bucket/app.vorteil":                  sourceS3,
+		"git+https://example.com/app.git#v1":       sourceGit,
+		"oci://nginx:latest":                       sourceOCI,
+		"vrepo://repo.example.com/org/bucket/app":  sourceVRepo,
+		"https://apps.vorteil.io/file/vorteil/app": sourceURL,
+		pkg: sourceFile,
+		dir: sourceDir,
+	} {
+		sType, err := getSourceType(src)
+		assert.NoError(t, err, src)
+		assert.Equal(t, expected, sType, src)
+	}
+
+	sType, err := getSourceType(filepath.Join(dir, "missing"))
+	assert.Error(t, err)
+	assert.Equal(t, sourceINVALID, sType)
+
+	_, err = getSourceType(pkg + ":target")
+	assert.Error(t, err)
+
+}
+
+func TestRegisterSourceResolver(t *testing.T) {
+
+	err := registerSourceResolver(sourceFile, &sourceResolver{
+		match: matchScheme("file://"),
+	})
+	assert.Error(t, err)
+
+}
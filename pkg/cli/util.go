@@ -6,11 +6,34 @@ package cli
  */
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
+	isatty "github.com/mattn/go-isatty"
+	"github.com/mitchellh/go-homedir"
+	"github.com/sirupsen/logrus"
+	"github.com/vorteil/vorteil/pkg/blockdev"
+	"github.com/vorteil/vorteil/pkg/policy"
+	"github.com/vorteil/vorteil/pkg/vcfg"
+	"github.com/vorteil/vorteil/pkg/vdisk"
+	"github.com/vorteil/vorteil/pkg/vimg"
 	"github.com/vorteil/vorteil/pkg/vio"
+	logger "github.com/vorteil/vorteil/pkg/virtualizers/logging"
 	"github.com/vorteil/vorteil/pkg/vpkg"
 )
 
@@ -18,9 +41,7 @@ func HandleErrors() {
 	if errorStatusMessage != nil {
 		// Pretty sure this only happens when invalid flags.
 		// Which the error gets printed before this
-		if log != nil {
-			log.Errorf(errorStatusMessage.Error())
-		}
+		logrus.Errorf(errorStatusMessage.Error())
 	}
 	if errorStatusCode != 0 {
 		os.Exit(errorStatusCode)
@@ -57,8 +78,8 @@ func handleFile(src string, dst string, builder vpkg.Builder) error {
 	return nil
 }
 
-func handleFileInjections(builder vpkg.Builder) error {
-	for src, v := range filesMap {
+func (c *commandContext) handleFileInjections(builder vpkg.Builder) error {
+	for src, v := range c.filesMap {
 		for _, dst := range v {
 			stat, err := os.Stat(src)
 			if err != nil {
@@ -81,3 +102,657 @@ func handleFileInjections(builder vpkg.Builder) error {
 
 	return nil
 }
+
+// filesystemCache returns the cache of compiled file-systems that builds
+// should use, or nil if --no-cache was set.
+func (c *commandContext) filesystemCache() *vdisk.FilesystemCache {
+	if c.flagNoCache {
+		return nil
+	}
+	return c.fsCache
+}
+
+// zoneInfo returns the host directory to add the time-zone database from, or
+// an empty string if --tzdata wasn't given.
+func (c *commandContext) zoneInfo() string {
+	if !c.flagTZData {
+		return ""
+	}
+	return vdisk.DefaultZoneInfo
+}
+
+// templateData returns the data to render the app's templates with: the
+// values given with --template-value, and the environment.
+func (c *commandContext) templateData() (*vdisk.TemplateData, error) {
+
+	data := &vdisk.TemplateData{
+		Values: make(map[string]string),
+		Env:    make(map[string]string),
+	}
+
+	for _, s := range c.flagTemplateValues {
+		kv := strings.SplitN(s, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("invalid --template-value '%s': should be name=value", s)
+		}
+		data.Values[kv[0]] = kv[1]
+	}
+
+	for _, s := range os.Environ() {
+		kv := strings.SplitN(s, "=", 2)
+		if len(kv) == 2 {
+			data.Env[kv[0]] = kv[1]
+		}
+	}
+
+	return data, nil
+
+}
+
+// interruptContext returns a context that is cancelled if the process is
+// interrupted, so that uploads and other long operations are abandoned
+// instead of the process being killed part way through them.
+func (c *commandContext) interruptContext() (context.Context, context.CancelFunc) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		select {
+		case <-ch:
+			c.log.Warnf("Interrupted, cancelling")
+			cancel()
+		case <-ctx.Done():
+		}
+		signal.Stop(ch)
+	}()
+
+	return ctx, cancel
+
+}
+
+// secureBootSigner returns a signer for the key and certificate given by the
+// --secure-boot-key and --secure-boot-cert flags, or nil if neither was given.
+func (c *commandContext) secureBootSigner() (vimg.Signer, error) {
+
+	if c.flagSecureBootKey == "" && c.flagSecureBootCert == "" {
+		return nil, nil
+	}
+
+	if c.flagSecureBootKey == "" || c.flagSecureBootCert == "" {
+		return nil, errors.New("--secure-boot-key and --secure-boot-cert have to be used together")
+	}
+
+	for _, path := range []string{c.flagSecureBootKey, c.flagSecureBootCert} {
+		_, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &vimg.SBSign{
+		Key:  c.flagSecureBootKey,
+		Cert: c.flagSecureBootCert,
+	}, nil
+
+}
+
+// reproducible returns the settings for a reproducible build, or nil if the
+// build doesn't have to be reproducible. Timestamps come from the
+// SOURCE_DATE_EPOCH environment variable, or the Unix epoch if it isn't set.
+func (c *commandContext) reproducible() (*vdisk.Reproducible, error) {
+
+	if !c.flagReproducible {
+		if c.flagSeed != 0 {
+			return nil, errors.New("--seed can only be used with --reproducible")
+		}
+		return nil, nil
+	}
+
+	t := time.Unix(0, 0)
+	if s := os.Getenv("SOURCE_DATE_EPOCH"); s != "" {
+		secs, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid SOURCE_DATE_EPOCH: '%s'", s)
+		}
+		t = time.Unix(secs, 0)
+	}
+
+	return &vdisk.Reproducible{
+		Seed: c.flagSeed,
+		Time: t,
+	}, nil
+
+}
+
+// sizeReportEntries is how many of the largest files and directories are
+// listed when an app is over its size budget.
+const sizeReportEntries = 10
+
+// parseSizeBudget parses the value of a size budget flag. It returns zero if
+// the flag wasn't given, meaning there's no limit.
+func parseSizeBudget(flag, value string) (vcfg.Bytes, error) {
+
+	limit, err := vcfg.ParseBytes(value)
+	if err != nil || limit < 0 {
+		return 0, fmt.Errorf("invalid value for --%s: '%s'", flag, value)
+	}
+
+	return limit, nil
+
+}
+
+// checkSizeBudget returns an error if size is over limit, listing the largest
+// files and directories in tree, if there is one, so that it's clear where the
+// space went. A limit of zero means there is no limit.
+func (c *commandContext) checkSizeBudget(what string, size int64, limit vcfg.Bytes, flag string, tree vio.FileTree) error {
+
+	if limit == 0 || size <= int64(limit) {
+		return nil
+	}
+
+	msg := fmt.Sprintf("%s is %s, over the %s limit set with --%s", what, c.printableSize(int(size)), c.printableSize(int(limit)), flag)
+
+	if tree != nil {
+		report, err := vio.DiskUsage(tree, sizeReportEntries)
+		if err != nil {
+			return err
+		}
+		msg += "\n" + c.formatUsageReport(report)
+	}
+
+	return errors.New(msg)
+
+}
+
+// formatUsageReport lists the largest files and directories in report.
+func (c *commandContext) formatUsageReport(report *vio.UsageReport) string {
+
+	b := new(strings.Builder)
+
+	fmt.Fprintf(b, "largest files:")
+	for _, u := range report.Files {
+		fmt.Fprintf(b, "\n\t%s\t%s", c.printableSize(int(u.Size)), u.Path)
+	}
+
+	fmt.Fprintf(b, "\nlargest directories:")
+	for _, u := range report.Dirs {
+		fmt.Fprintf(b, "\n\t%s\t%s", c.printableSize(int(u.Size)), u.Path)
+	}
+
+	return b.String()
+
+}
+
+// loadPolicy loads the policy given with --policy, or the one from the
+// 'policy' setting in the vorteil config. It returns nil if there is neither.
+func (c *commandContext) loadPolicy() (*policy.Policy, error) {
+
+	path := c.flagPolicy
+	if path == "" {
+		path = c.confPolicy
+	}
+
+	if path == "" {
+		return nil, nil
+	}
+
+	return policy.LoadFilepath(path)
+
+}
+
+// osFileTree builds the tree of extra files to add to the Vorteil OS
+// partition, from the 'os-files' list in the vorteil config followed by the
+// --os-files flag. Each entry has the same '<src>[@<dst>]' form as --files. It
+// returns nil if there are no extra files.
+func (c *commandContext) osFileTree() (vio.FileTree, error) {
+
+	entries := append(append([]string{}, c.confOSFiles...), c.flagOSFiles...)
+	if len(entries) == 0 {
+		return nil, nil
+	}
+
+	tree := vio.NewFileTree()
+
+	for _, entry := range entries {
+		x := strings.SplitN(entry, "@", 2)
+		var src = x[0]
+		var dst = "/"
+		if len(x) > 1 {
+			dst = x[1]
+		}
+
+		stat, err := os.Stat(src)
+		if err != nil {
+			tree.Close()
+			return nil, err
+		}
+
+		path := strings.TrimPrefix(filepath.ToSlash(filepath.Join(dst, stat.Name())), "/")
+
+		if stat.IsDir() {
+			var sub vio.FileTree
+			sub, err = vio.FileTreeFromDirectory(src)
+			if err == nil {
+				err = tree.MapSubTree(path, sub)
+			}
+		} else {
+			var f vio.File
+			f, err = vio.LazyOpen(src)
+			if err == nil {
+				err = tree.Map(path, f)
+			}
+		}
+		if err != nil {
+			tree.Close()
+			return nil, err
+		}
+	}
+
+	return tree, nil
+}
+
+// writeManifest writes one of the manifests stored alongside an image, such as
+// its checksums or its build manifest, to path.
+func writeManifest(path string, m interface{ Write(io.Writer) error }) error {
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	err = m.Write(f)
+	if err != nil {
+		return err
+	}
+
+	return f.Close()
+
+}
+
+// writeBuildManifest records the main disk at path and each of the additional
+// disks in the manifest, and writes it to manifestPath.
+func writeBuildManifest(manifestPath string, m *vdisk.Manifest, path string, disks *diskFiles, format vdisk.Format) error {
+
+	err := m.AddOutput(path, "", format)
+	if err != nil {
+		return err
+	}
+
+	for i, name := range disks.names {
+		err = m.AddOutput(disks.files[i].Name(), name, format)
+		if err != nil {
+			return err
+		}
+	}
+
+	return writeManifest(manifestPath, m)
+
+}
+
+// projectDigest returns a SHA256 digest of the contents of a BUILDABLE for a
+// build manifest. Package files and images are hashed as they are, and
+// project directories are hashed file by file, including the paths of each
+// file. BUILDABLEs in a repository have no digest.
+func projectDigest(src string) (string, error) {
+
+	sType, err := getSourceType(src)
+	if err != nil {
+		return "", err
+	}
+
+	hasher := sha256.New()
+
+	switch sType {
+	case sourceFile:
+		f, err := os.Open(src)
+		if err != nil {
+			return "", err
+		}
+		defer f.Close()
+
+		_, err = io.Copy(hasher, f)
+		if err != nil {
+			return "", err
+		}
+	case sourceDir:
+		dir, _, err := readSourcePath(src)
+		if err != nil {
+			return "", err
+		}
+
+		err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+
+			rel, err := filepath.Rel(dir, path)
+			if err != nil {
+				return err
+			}
+
+			fmt.Fprintf(hasher, "%q %v %d\n", filepath.ToSlash(rel), info.Mode(), info.Size())
+
+			switch {
+			case info.Mode()&os.ModeSymlink != 0:
+				target, err := os.Readlink(path)
+				if err != nil {
+					return err
+				}
+				fmt.Fprintf(hasher, "%q\n", target)
+			case info.Mode().IsRegular():
+				f, err := os.Open(path)
+				if err != nil {
+					return err
+				}
+				defer f.Close()
+
+				_, err = io.Copy(hasher, f)
+				if err != nil {
+					return err
+				}
+			}
+
+			return nil
+		})
+		if err != nil {
+			return "", err
+		}
+	default:
+		return "", nil
+	}
+
+	return vdisk.ChecksumAlgorithm + ":" + hex.EncodeToString(hasher.Sum(nil)), nil
+
+}
+
+// confirmDeviceWrite asks the user to confirm that everything on the block
+// device at path can be destroyed.
+func confirmDeviceWrite(path string) error {
+
+	if !isatty.IsTerminal(os.Stdin.Fd()) && !isatty.IsCygwinTerminal(os.Stdin.Fd()) {
+		return fmt.Errorf("refusing to overwrite block device '%s' without confirmation: use '-f' to write to it anyway", path)
+	}
+
+	description := path
+	f, err := os.Open(path)
+	if err == nil {
+		size, err := f.Seek(0, io.SeekEnd)
+		if err == nil {
+			description = fmt.Sprintf("%s (%s)", path, vcfg.Bytes(size))
+		}
+		f.Close()
+	}
+
+	fmt.Fprintf(os.Stderr, "All data on %s will be destroyed. Type 'yes' to continue: ", description)
+
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return err
+	}
+
+	if strings.TrimSpace(answer) != "yes" {
+		return errors.New("aborted: block device left untouched")
+	}
+
+	return nil
+
+}
+
+// buildToDevice builds a raw image directly onto the block device at path,
+// then reads it back to verify it.
+func (c *commandContext) buildToDevice(path string, args *vdisk.BuildArgs) error {
+
+	d, err := blockdev.Open(path)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	w, err := vdisk.StreamWriter(d)
+	if err != nil {
+		return err
+	}
+
+	err = vdisk.Build(context.Background(), w, args)
+	if err != nil {
+		return err
+	}
+
+	err = d.Close()
+	if err != nil {
+		return err
+	}
+
+	p := c.log.NewProgress(fmt.Sprintf("Verifying %s", path), "", 0)
+	err = d.Verify()
+	p.Finish(err == nil)
+	if err != nil {
+		return err
+	}
+
+	return nil
+
+}
+
+// hostEntry is a line added to the app's /etc/hosts by '--add-host'.
+type hostEntry struct {
+	name string
+	ip   net.IP
+}
+
+// parseAddHosts parses the values given to '--add-host', each of the form
+// NAME:IP. IPv6 addresses contain colons, so the name ends at the first one.
+func parseAddHosts(values []string) ([]hostEntry, error) {
+
+	var entries []hostEntry
+
+	for _, v := range values {
+		k := strings.Index(v, ":")
+		if k < 0 {
+			return nil, fmt.Errorf("invalid --add-host '%s': should be NAME:IP", v)
+		}
+
+		name, addr := v[:k], v[k+1:]
+		if name == "" || strings.ContainsAny(name, " \t#") {
+			return nil, fmt.Errorf("invalid --add-host '%s': bad host name '%s'", v, name)
+		}
+
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid --add-host '%s': bad IP address '%s'", v, addr)
+		}
+
+		entries = append(entries, hostEntry{name: name, ip: ip})
+	}
+
+	return entries, nil
+
+}
+
+// extendHosts returns the contents of a hosts file with entries appended to
+// existing, which may be empty if the app doesn't have one of its own.
+func extendHosts(existing []byte, entries []hostEntry) []byte {
+
+	buf := new(bytes.Buffer)
+
+	if len(existing) == 0 {
+		buf.WriteString("127.0.0.1\tlocalhost\n::1\tlocalhost\n")
+	} else {
+		buf.Write(existing)
+		if existing[len(existing)-1] != '\n' {
+			buf.WriteString("\n")
+		}
+	}
+
+	for _, e := range entries {
+		fmt.Fprintf(buf, "%s\t%s\n", e.ip, e.name)
+	}
+
+	return buf.Bytes()
+
+}
+
+// hasRunNetworkOverrides returns true if '--dns' or '--add-host' was given.
+func (c *commandContext) hasRunNetworkOverrides() bool {
+	return len(c.flagDNS) > 0 || len(c.flagAddHosts) > 0
+}
+
+// overrideRunNetwork applies '--dns' and '--add-host' to cfg and to the
+// package a run boots, without changing the package or project it came from.
+// The name servers replace the app's own, and the hosts are added to its
+// /etc/hosts.
+func (c *commandContext) overrideRunNetwork(pkg vpkg.Reader, cfg *vcfg.VCFG) (vpkg.Reader, error) {
+
+	entries, err := parseAddHosts(c.flagAddHosts)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, s := range c.flagDNS {
+		if net.ParseIP(s) == nil {
+			return nil, fmt.Errorf("invalid --dns '%s': should be an IP address", s)
+		}
+	}
+
+	if len(c.flagDNS) > 0 {
+		cfg.System.DNS = c.flagDNS
+
+		f, err := cfg.File()
+		if err != nil {
+			return nil, err
+		}
+
+		pkg, err = vpkg.ReplaceVCFG(pkg, f)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(entries) > 0 {
+		err = addRunHosts(pkg.FS(), entries)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return pkg, nil
+
+}
+
+// addRunHosts replaces /etc/hosts in tree with a copy that includes entries.
+func addRunHosts(tree vio.FileTree, entries []hostEntry) error {
+
+	const path = "./etc/hosts"
+
+	var existing []byte
+	modTime := time.Unix(0, 0)
+
+	err := tree.Walk(func(p string, f vio.File) error {
+		if p != "." && f.IsDir() && !strings.HasPrefix(path, p+"/") {
+			return vio.ErrSkip
+		}
+
+		if p != path {
+			return nil
+		}
+
+		if f.IsDir() || f.IsSymlink() {
+			return errors.New("can't add to the app's /etc/hosts, it isn't a regular file")
+		}
+
+		data, err := ioutil.ReadAll(f)
+		if err != nil {
+			return err
+		}
+		existing = data
+		modTime = f.ModTime()
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	data := extendHosts(existing, entries)
+
+	return tree.Map(path, vio.CustomFile(vio.CustomFileArgs{
+		Name:       "hosts",
+		Size:       len(data),
+		ModTime:    modTime,
+		ReadCloser: ioutil.NopCloser(bytes.NewReader(data)),
+	}))
+
+}
+
+// parseProgramFlag returns the program selected by '--program', which is
+// either the index of a program in the VCFG or "system" for output that
+// doesn't come from any program.
+func parseProgramFlag(value string) (int, error) {
+
+	if value == "system" {
+		return logger.SystemOutput, nil
+	}
+
+	index, err := strconv.Atoi(value)
+	if err != nil || index < 0 {
+		return 0, fmt.Errorf("invalid --program '%s': should be the index of a program in the VCFG, or 'system'", value)
+	}
+
+	return index, nil
+
+}
+
+// programFilter returns a filter that only writes the output of the program
+// selected by '--program' to w, or nil if the flag wasn't given.
+func programFilter(w io.Writer, value string) (*logger.ProgramFilter, error) {
+
+	if value == "" {
+		return nil, nil
+	}
+
+	index, err := parseProgramFlag(value)
+	if err != nil {
+		return nil, err
+	}
+
+	return logger.NewProgramFilter(w, index), nil
+
+}
+
+// serialLogPath returns the path the serial output of the last run of the
+// named app is saved to.
+func serialLogPath(name string) (string, error) {
+
+	if name == "" || name != filepath.Base(name) || name == "." || name == ".." {
+		return "", fmt.Errorf("invalid app name '%s'", name)
+	}
+
+	home, err := homedir.Dir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(home, ".vorteil", "logs", name+".log"), nil
+
+}
+
+// createSerialLog creates or truncates the serial log of the named app.
+func createSerialLog(name string) (*os.File, error) {
+
+	path, err := serialLogPath(name)
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	return os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+
+}
@@ -13,19 +13,13 @@ import (
 	"strconv"
 	"strings"
 
+	"github.com/google/uuid"
 	"github.com/mattn/go-shellwords"
 	"github.com/vorteil/vorteil/pkg/flag"
 	"github.com/vorteil/vorteil/pkg/vcfg"
 )
 
-var (
-	hideFlags        = false
-	maxRedirectFlags int
-	maxNetworkFlags  int
-	maxProgramFlags  int
-	maxNFSFlags      int
-	maxLoggingFlags  int
-)
+var hideFlags = false
 
 func init() {
 	// fixes a flag parsing issue
@@ -38,18 +32,25 @@ func init() {
 			}
 		}
 	}
+}
 
-	args, err := shellwords.Parse(strings.Join(os.Args, " "))
+// tallyRepeatableFlags finds the highest index given to each of the
+// repeatable flags in args, like the 1 in '--network[1].ip', so that enough of
+// them are created.
+func (c *commandContext) tallyRepeatableFlags(args []string) {
+
+	args, err := shellwords.Parse(strings.Join(args, " "))
 	if err != nil {
 		// panic(err)
 	}
 
 	for _, arg := range args {
-		setFlagArgArray(arg)
+		c.setFlagArgArray(arg)
 	}
+
 }
 
-func setFlagArgArray(arg string) {
+func (c *commandContext) setFlagArgArray(arg string) {
 	if !strings.HasPrefix(arg, "--") {
 		return
 	}
@@ -59,15 +60,25 @@ func setFlagArgArray(arg string) {
 		elems[1] = strings.Split(elems[1], "]")[0]
 		switch elems[0] {
 		case "--network":
-			tallyRepeatableFlag(&maxNetworkFlags, elems[1])
+			tallyRepeatableFlag(&c.maxNetworkFlags, elems[1])
 		case "--program":
-			tallyRepeatableFlag(&maxProgramFlags, elems[1])
+			tallyRepeatableFlag(&c.maxProgramFlags, elems[1])
 		case "--nfs":
-			tallyRepeatableFlag(&maxNFSFlags, elems[1])
+			tallyRepeatableFlag(&c.maxNFSFlags, elems[1])
+		case "--smb":
+			tallyRepeatableFlag(&c.maxSMBFlags, elems[1])
+		case "--sync":
+			tallyRepeatableFlag(&c.maxSyncFlags, elems[1])
 		case "--logging":
-			tallyRepeatableFlag(&maxLoggingFlags, elems[1])
+			tallyRepeatableFlag(&c.maxLoggingFlags, elems[1])
 		case "--redirect":
-			tallyRepeatableFlag(&maxRedirectFlags, elems[1])
+			tallyRepeatableFlag(&c.maxRedirectFlags, elems[1])
+		case "--disk":
+			tallyRepeatableFlag(&c.maxDiskFlags, elems[1])
+		case "--partition":
+			tallyRepeatableFlag(&c.maxPartFlags, elems[1])
+		case "--node":
+			tallyRepeatableFlag(&c.maxNodeFlags, elems[1])
 		}
 	}
 }
@@ -79,87 +90,78 @@ func tallyRepeatableFlag(v *int, s string) {
 }
 
 // --sysctl
-var sysctlFlag = flag.NewStringSliceFlag("sysctl", "add a sysctl key/value tuple", hideFlags, sysctlFlagValidator)
-var sysctlFlagValidator = func(f flag.StringSliceFlag) error {
+func (c *commandContext) sysctlFlagValidator(f flag.StringSliceFlag) error {
 	for _, s := range f.Value {
 		x := strings.Split(s, "=")
 		if len(x) < 2 {
-			log.Warnf("invalid sysctl tuple '%s'", s)
+			c.log.Warnf("invalid sysctl tuple '%s'", s)
 		}
-		if overrideVCFG.Sysctl == nil {
-			overrideVCFG.Sysctl = make(map[string]string)
+		if c.overrideVCFG.Sysctl == nil {
+			c.overrideVCFG.Sysctl = make(map[string]string)
 		}
-		overrideVCFG.Sysctl[x[0]] = x[1]
+		c.overrideVCFG.Sysctl[x[0]] = x[1]
 	}
 	return nil
 }
 
 // --info.author
-var infoAuthorFlag = flag.NewStringFlag("info.author", "name the author of the app", hideFlags, infoAuthorFlagValidator)
-var infoAuthorFlagValidator = func(f flag.StringFlag) error {
-	overrideVCFG.Info.Author = f.Value
+func (c *commandContext) infoAuthorFlagValidator(f flag.StringFlag) error {
+	c.overrideVCFG.Info.Author = f.Value
 	return nil
 }
 
 // --info.date
-var infoDateFlag = flag.NewStringFlag("info.date", "date of app's release (YYYY-MM-DD)", hideFlags, infoDateFlagValidator)
-var infoDateFlagValidator = func(f flag.StringFlag) error {
+func (c *commandContext) infoDateFlagValidator(f flag.StringFlag) error {
 	var err error
 	if f.Value == "" {
 		return nil
 	}
-	overrideVCFG.Info.Date, err = vcfg.TimestampFromString(f.Value)
+	c.overrideVCFG.Info.Date, err = vcfg.TimestampFromString(f.Value)
 	return err
 }
 
 // --info.description
-var infoDescriptionFlag = flag.NewStringFlag("info.description", "provide a description for the app", hideFlags, infoDescriptionFlagValidator)
-var infoDescriptionFlagValidator = func(f flag.StringFlag) error {
-	overrideVCFG.Info.Description = f.Value
+func (c *commandContext) infoDescriptionFlagValidator(f flag.StringFlag) error {
+	c.overrideVCFG.Info.Description = f.Value
 	return nil
 }
 
 // --info.name
-var infoNameFlag = flag.NewStringFlag("info.name", "name of the app", hideFlags, infoNameFlagValidator)
-var infoNameFlagValidator = func(f flag.StringFlag) error {
-	overrideVCFG.Info.Name = f.Value
+func (c *commandContext) infoNameFlagValidator(f flag.StringFlag) error {
+	c.overrideVCFG.Info.Name = f.Value
 	return nil
 }
 
 // --info.summary
-var infoSummaryFlag = flag.NewStringFlag("info.summary", "provide a short summary for the app", hideFlags, infoSummaryFlagValidator)
-var infoSummaryFlagValidator = func(f flag.StringFlag) error {
-	overrideVCFG.Info.Summary = f.Value
+func (c *commandContext) infoSummaryFlagValidator(f flag.StringFlag) error {
+	c.overrideVCFG.Info.Summary = f.Value
 	return nil
 }
 
 // --info.url
-var infoURLFlag = flag.NewStringFlag("info.url", "URL for more information about the app", hideFlags, infoURLFlagValidator)
-var infoURLFlagValidator = func(f flag.StringFlag) error {
+func (c *commandContext) infoURLFlagValidator(f flag.StringFlag) error {
 	var err error
-	overrideVCFG.Info.URL, err = vcfg.URLFromString(f.Value)
+	c.overrideVCFG.Info.URL, err = vcfg.URLFromString(f.Value)
 	return err
 }
 
 // --info.version
-var infoVersionFlag = flag.NewStringFlag("info.version", "identify the app's version", hideFlags, infoVersionFlagValidator)
-var infoVersionFlagValidator = func(f flag.StringFlag) error {
-	overrideVCFG.Info.Version = f.Value
+func (c *commandContext) infoVersionFlagValidator(f flag.StringFlag) error {
+	c.overrideVCFG.Info.Version = f.Value
 	return nil
 }
 
 // --logging.config
-var loggingConfigFlag = flag.NewNStringSliceFlag("logging[<<N>>].config", "configure app's logging config", &maxLoggingFlags, hideFlags, loggingConfigFlagValidator)
-var loggingConfigFlagValidator = func(f flag.NStringSliceFlag) error {
+func (c *commandContext) loggingConfigFlagValidator(f flag.NStringSliceFlag) error {
 	for i := 0; i < *f.Total; i++ {
 		if len(f.Value[i]) == 0 {
 			continue
 		}
 		s := f.Value[i]
-		for len(overrideVCFG.Logging) < i+1 {
-			overrideVCFG.Logging = append(overrideVCFG.Logging, vcfg.Logging{})
+		for len(c.overrideVCFG.Logging) < i+1 {
+			c.overrideVCFG.Logging = append(c.overrideVCFG.Logging, vcfg.Logging{})
 		}
-		logging := &overrideVCFG.Logging[i]
+		logging := &c.overrideVCFG.Logging[i]
 		if logging.Config == nil {
 			logging.Config = make([]string, 0)
 		}
@@ -169,120 +171,428 @@ var loggingConfigFlagValidator = func(f flag.NStringSliceFlag) error {
 }
 
 // --logging.type
-var loggingTypeFlag = flag.NewNStringFlag("logging[<<N>>].type", "configure app's logging type", &maxLoggingFlags, hideFlags, loggingTypeFlagValidator)
-var loggingTypeFlagValidator = func(f flag.NStringFlag) error {
+func (c *commandContext) loggingTypeFlagValidator(f flag.NStringFlag) error {
 	for i := 0; i < *f.Total; i++ {
 		if f.Value[i] == "" {
 			continue
 		}
 		s := f.Value[i]
-		for len(overrideVCFG.Logging) < i+1 {
-			overrideVCFG.Logging = append(overrideVCFG.Logging, vcfg.Logging{})
+		for len(c.overrideVCFG.Logging) < i+1 {
+			c.overrideVCFG.Logging = append(c.overrideVCFG.Logging, vcfg.Logging{})
 		}
-		logging := &overrideVCFG.Logging[i]
+		logging := &c.overrideVCFG.Logging[i]
 		logging.Type = s
 	}
 	return nil
 }
 
-var initRequiredNFS = func(f flag.NStringFlag, fn func(nfs *vcfg.NFSSettings, s string)) error {
-	return initFromNStringFlag(f, func(i int, s string) {
-		for len(overrideVCFG.NFS) < i+1 {
-			overrideVCFG.NFS = append(overrideVCFG.NFS, vcfg.NFSSettings{})
+func (c *commandContext) initRequiredLogging(f flag.NStringFlag, fn func(logging *vcfg.Logging, s string)) error {
+	return c.initFromNStringFlag(f, func(i int, s string) {
+		for len(c.overrideVCFG.Logging) < i+1 {
+			c.overrideVCFG.Logging = append(c.overrideVCFG.Logging, vcfg.Logging{})
 		}
-		fn(&overrideVCFG.NFS[i], s)
+		fn(&c.overrideVCFG.Logging[i], s)
+	})
+}
+
+// --logging.driver
+func (c *commandContext) loggingDriverFlagValidator(f flag.NStringFlag) error {
+	return c.initRequiredLogging(f, func(logging *vcfg.Logging, s string) { logging.Driver = s })
+}
+
+// --logging.address
+func (c *commandContext) loggingAddressFlagValidator(f flag.NStringFlag) error {
+	return c.initRequiredLogging(f, func(logging *vcfg.Logging, s string) { logging.Address = s })
+}
+
+// --logging.path
+func (c *commandContext) loggingPathFlagValidator(f flag.NStringFlag) error {
+	return c.initRequiredLogging(f, func(logging *vcfg.Logging, s string) { logging.Path = s })
+}
+
+// --logging.tag
+func (c *commandContext) loggingTagFlagValidator(f flag.NStringFlag) error {
+	return c.initRequiredLogging(f, func(logging *vcfg.Logging, s string) { logging.Tag = s })
+}
+
+func (c *commandContext) initRequiredNFS(f flag.NStringFlag, fn func(nfs *vcfg.NFSSettings, s string)) error {
+	return c.initFromNStringFlag(f, func(i int, s string) {
+		for len(c.overrideVCFG.NFS) < i+1 {
+			c.overrideVCFG.NFS = append(c.overrideVCFG.NFS, vcfg.NFSSettings{})
+		}
+		fn(&c.overrideVCFG.NFS[i], s)
 	})
 }
 
 // --nfs.mount
-var nfsMountFlag = flag.NewNStringFlag("nfs[<<N>>].mount", "configure app's nfs mounts", &maxNFSFlags, hideFlags, nfsMountFlagValidator)
-var nfsMountFlagValidator = func(f flag.NStringFlag) error {
-	return initRequiredNFS(f, func(nfs *vcfg.NFSSettings, s string) { nfs.MountPoint = s })
+func (c *commandContext) nfsMountFlagValidator(f flag.NStringFlag) error {
+	return c.initRequiredNFS(f, func(nfs *vcfg.NFSSettings, s string) { nfs.MountPoint = s })
 }
 
 // --nfs.options
-var nfsOptionsFlag = flag.NewNStringFlag("nfs[<<N>>].options", "configure app's nfs options", &maxNFSFlags, hideFlags, nfsOptionsFlagValidator)
-var nfsOptionsFlagValidator = func(f flag.NStringFlag) error {
-	return initRequiredNFS(f, func(nfs *vcfg.NFSSettings, s string) { nfs.Arguments = s })
+func (c *commandContext) nfsOptionsFlagValidator(f flag.NStringFlag) error {
+	return c.initRequiredNFS(f, func(nfs *vcfg.NFSSettings, s string) { nfs.Arguments = s })
 }
 
 // --nfs.server
-var nfsServerFlag = flag.NewNStringFlag("nfs[<<N>>].server", "configure app's nfs servers", &maxNFSFlags, hideFlags, nfsServerFlagValidator)
-var nfsServerFlagValidator = func(f flag.NStringFlag) error {
-	return initRequiredNFS(f, func(nfs *vcfg.NFSSettings, s string) { nfs.Server = s })
+func (c *commandContext) nfsServerFlagValidator(f flag.NStringFlag) error {
+	return c.initRequiredNFS(f, func(nfs *vcfg.NFSSettings, s string) { nfs.Server = s })
+}
+
+// --nfs.version
+func (c *commandContext) nfsVersionFlagValidator(f flag.NStringFlag) error {
+	return c.initRequiredNFS(f, func(nfs *vcfg.NFSSettings, s string) { nfs.Version = s })
+}
+
+// --nfs.transport
+func (c *commandContext) nfsTransportFlagValidator(f flag.NStringFlag) error {
+	return c.initRequiredNFS(f, func(nfs *vcfg.NFSSettings, s string) { nfs.Transport = s })
+}
+
+// --nfs.timeout
+func (c *commandContext) nfsTimeoutFlagValidator(f flag.NStringFlag) error {
+	var err error
+	c.initRequiredNFS(f, func(nfs *vcfg.NFSSettings, s string) {
+		var e error
+		nfs.Timeout, e = vcfg.DurationFromString(s)
+		if e != nil && err == nil {
+			err = fmt.Errorf("invalid nfs timeout '%s': %v", s, e)
+		}
+	})
+	return err
+}
+
+func (c *commandContext) initRequiredSMB(f flag.NStringFlag, fn func(smb *vcfg.SMBSettings, s string)) error {
+	return c.initFromNStringFlag(f, func(i int, s string) {
+		for len(c.overrideVCFG.SMB) < i+1 {
+			c.overrideVCFG.SMB = append(c.overrideVCFG.SMB, vcfg.SMBSettings{})
+		}
+		fn(&c.overrideVCFG.SMB[i], s)
+	})
+}
+
+// --smb.mount
+func (c *commandContext) smbMountFlagValidator(f flag.NStringFlag) error {
+	return c.initRequiredSMB(f, func(smb *vcfg.SMBSettings, s string) { smb.MountPoint = s })
+}
+
+// --smb.server
+func (c *commandContext) smbServerFlagValidator(f flag.NStringFlag) error {
+	return c.initRequiredSMB(f, func(smb *vcfg.SMBSettings, s string) { smb.Server = s })
+}
+
+// --smb.options
+func (c *commandContext) smbOptionsFlagValidator(f flag.NStringFlag) error {
+	return c.initRequiredSMB(f, func(smb *vcfg.SMBSettings, s string) { smb.Arguments = s })
+}
+
+// --smb.username
+func (c *commandContext) smbUsernameFlagValidator(f flag.NStringFlag) error {
+	return c.initRequiredSMB(f, func(smb *vcfg.SMBSettings, s string) { smb.Username = s })
+}
+
+// --smb.password
+func (c *commandContext) smbPasswordFlagValidator(f flag.NStringFlag) error {
+	return c.initRequiredSMB(f, func(smb *vcfg.SMBSettings, s string) { smb.Password = s })
+}
+
+// --smb.domain
+func (c *commandContext) smbDomainFlagValidator(f flag.NStringFlag) error {
+	return c.initRequiredSMB(f, func(smb *vcfg.SMBSettings, s string) { smb.Domain = s })
+}
+
+// --smb.version
+func (c *commandContext) smbVersionFlagValidator(f flag.NStringFlag) error {
+	return c.initRequiredSMB(f, func(smb *vcfg.SMBSettings, s string) { smb.Version = s })
+}
+
+func (c *commandContext) initRequiredSync(f flag.NStringFlag, fn func(sync *vcfg.ObjectSync, s string)) error {
+	return c.initFromNStringFlag(f, func(i int, s string) {
+		for len(c.overrideVCFG.Sync) < i+1 {
+			c.overrideVCFG.Sync = append(c.overrideVCFG.Sync, vcfg.ObjectSync{})
+		}
+		fn(&c.overrideVCFG.Sync[i], s)
+	})
+}
+
+// --sync.source
+func (c *commandContext) syncSourceFlagValidator(f flag.NStringFlag) error {
+	return c.initRequiredSync(f, func(sync *vcfg.ObjectSync, s string) { sync.Source = s })
+}
+
+// --sync.path
+func (c *commandContext) syncPathFlagValidator(f flag.NStringFlag) error {
+	return c.initRequiredSync(f, func(sync *vcfg.ObjectSync, s string) { sync.Path = s })
+}
+
+// --sync.endpoint
+func (c *commandContext) syncEndpointFlagValidator(f flag.NStringFlag) error {
+	return c.initRequiredSync(f, func(sync *vcfg.ObjectSync, s string) { sync.Endpoint = s })
+}
+
+// --sync.region
+func (c *commandContext) syncRegionFlagValidator(f flag.NStringFlag) error {
+	return c.initRequiredSync(f, func(sync *vcfg.ObjectSync, s string) { sync.Region = s })
+}
+
+// --sync.credentials
+func (c *commandContext) syncCredentialsFlagValidator(f flag.NStringFlag) error {
+	return c.initRequiredSync(f, func(sync *vcfg.ObjectSync, s string) { sync.Credentials = s })
+}
+
+// --sync.sync-back
+func (c *commandContext) syncSyncBackFlagValidator(f flag.NBoolFlag) error {
+	for i := 0; i < *f.Total; i++ {
+		if !f.Value[i] {
+			continue
+		}
+		for len(c.overrideVCFG.Sync) < i+1 {
+			c.overrideVCFG.Sync = append(c.overrideVCFG.Sync, vcfg.ObjectSync{})
+		}
+		c.overrideVCFG.Sync[i].SyncBack = true
+	}
+	return nil
+}
+
+func (c *commandContext) initRequiredDisks(f flag.NStringFlag, fn func(disk *vcfg.Disk, s string) error) error {
+	for i := 0; i < *f.Total; i++ {
+		s := f.Value[i]
+		if s == "" {
+			continue
+		}
+		for len(c.overrideVCFG.Disks) < i+1 {
+			c.overrideVCFG.Disks = append(c.overrideVCFG.Disks, vcfg.Disk{})
+		}
+		err := fn(&c.overrideVCFG.Disks[i], s)
+		if err != nil {
+			return fmt.Errorf("--disk[%d]: %v", i, err)
+		}
+	}
+	return nil
+}
+
+// --disk.name
+func (c *commandContext) diskNameFlagValidator(f flag.NStringFlag) error {
+	return c.initRequiredDisks(f, func(disk *vcfg.Disk, s string) error {
+		disk.Name = s
+		return nil
+	})
+}
+
+// --disk.mount
+func (c *commandContext) diskMountFlagValidator(f flag.NStringFlag) error {
+	return c.initRequiredDisks(f, func(disk *vcfg.Disk, s string) error {
+		disk.MountPoint = s
+		return nil
+	})
+}
+
+// --disk.size
+func (c *commandContext) diskSizeFlagValidator(f flag.NStringFlag) error {
+	return c.initRequiredDisks(f, func(disk *vcfg.Disk, s string) error {
+		var err error
+		disk.Size, err = vcfg.ParseBytes(s)
+		return err
+	})
+}
+
+// --disk.filesystem
+func (c *commandContext) diskFilesystemFlagValidator(f flag.NStringFlag) error {
+	return c.initRequiredDisks(f, func(disk *vcfg.Disk, s string) error {
+		disk.Filesystem = vcfg.Filesystem(s)
+		return nil
+	})
+}
+
+func (c *commandContext) initRequiredPartitions(f flag.NStringFlag, fn func(p *vcfg.Partition, s string) error) error {
+	for i := 0; i < *f.Total; i++ {
+		s := f.Value[i]
+		if s == "" {
+			continue
+		}
+		for len(c.overrideVCFG.Partitions) < i+1 {
+			c.overrideVCFG.Partitions = append(c.overrideVCFG.Partitions, vcfg.Partition{})
+		}
+		err := fn(&c.overrideVCFG.Partitions[i], s)
+		if err != nil {
+			return fmt.Errorf("--partition[%d]: %v", i, err)
+		}
+	}
+	return nil
+}
+
+// --partition.name
+func (c *commandContext) partitionNameFlagValidator(f flag.NStringFlag) error {
+	return c.initRequiredPartitions(f, func(p *vcfg.Partition, s string) error {
+		p.Name = s
+		return nil
+	})
+}
+
+// --partition.mount
+func (c *commandContext) partitionMountFlagValidator(f flag.NStringFlag) error {
+	return c.initRequiredPartitions(f, func(p *vcfg.Partition, s string) error {
+		p.MountPoint = s
+		return nil
+	})
 }
 
-func initRequiredNetworks(l, i int) {
+// --partition.size
+func (c *commandContext) partitionSizeFlagValidator(f flag.NStringFlag) error {
+	return c.initRequiredPartitions(f, func(p *vcfg.Partition, s string) error {
+		var err error
+		p.Size, err = vcfg.ParseBytes(s)
+		return err
+	})
+}
+
+// --partition.filesystem
+func (c *commandContext) partitionFilesystemFlagValidator(f flag.NStringFlag) error {
+	return c.initRequiredPartitions(f, func(p *vcfg.Partition, s string) error {
+		p.Filesystem = vcfg.Filesystem(s)
+		return nil
+	})
+}
+
+// --partition.flags
+func (c *commandContext) partitionFlagsFlagValidator(f flag.NStringSliceFlag) error {
+	for i := 0; i < *f.Total; i++ {
+		if len(f.Value[i]) == 0 {
+			continue
+		}
+		for len(c.overrideVCFG.Partitions) < i+1 {
+			c.overrideVCFG.Partitions = append(c.overrideVCFG.Partitions, vcfg.Partition{})
+		}
+		p := &c.overrideVCFG.Partitions[i]
+		p.Flags = append(p.Flags, f.Value[i]...)
+	}
+	return nil
+}
+
+func (c *commandContext) initRequiredNodes(f flag.NStringFlag, fn func(n *vcfg.Node, s string) error) error {
+	for i := 0; i < *f.Total; i++ {
+		s := f.Value[i]
+		if s == "" {
+			continue
+		}
+		for len(c.overrideVCFG.Nodes) < i+1 {
+			c.overrideVCFG.Nodes = append(c.overrideVCFG.Nodes, vcfg.Node{})
+		}
+		err := fn(&c.overrideVCFG.Nodes[i], s)
+		if err != nil {
+			return fmt.Errorf("--node[%d]: %v", i, err)
+		}
+	}
+	return nil
+}
+
+func parseDeviceNumber(s string) (uint32, error) {
+	x, err := strconv.ParseUint(s, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid device number '%s'", s)
+	}
+	return uint32(x), nil
+}
+
+// --node.path
+func (c *commandContext) nodePathFlagValidator(f flag.NStringFlag) error {
+	return c.initRequiredNodes(f, func(n *vcfg.Node, s string) error {
+		n.Path = s
+		return nil
+	})
+}
+
+// --node.type
+func (c *commandContext) nodeTypeFlagValidator(f flag.NStringFlag) error {
+	return c.initRequiredNodes(f, func(n *vcfg.Node, s string) error {
+		n.Type = vcfg.NodeType(s)
+		return nil
+	})
+}
+
+// --node.major
+func (c *commandContext) nodeMajorFlagValidator(f flag.NStringFlag) error {
+	return c.initRequiredNodes(f, func(n *vcfg.Node, s string) error {
+		var err error
+		n.Major, err = parseDeviceNumber(s)
+		return err
+	})
+}
+
+// --node.minor
+func (c *commandContext) nodeMinorFlagValidator(f flag.NStringFlag) error {
+	return c.initRequiredNodes(f, func(n *vcfg.Node, s string) error {
+		var err error
+		n.Minor, err = parseDeviceNumber(s)
+		return err
+	})
+}
+
+func (c *commandContext) initRequiredNetworks(l, i int) {
 	if l == 0 {
 		return
 	}
-	for len(overrideVCFG.Networks) < i+1 {
-		overrideVCFG.Networks = append(overrideVCFG.Networks, vcfg.NetworkInterface{IP: "dhcp"})
+	for len(c.overrideVCFG.Networks) < i+1 {
+		c.overrideVCFG.Networks = append(c.overrideVCFG.Networks, vcfg.NetworkInterface{IP: "dhcp"})
 	}
 }
 
-var initRequiredNetworksFromString = func(f flag.NStringFlag, fn func(nic *vcfg.NetworkInterface, s string)) error {
-	return initFromNStringFlag(f, func(i int, s string) {
-		initRequiredNetworks(len(f.Value), i)
-		fn(&overrideVCFG.Networks[i], s)
+func (c *commandContext) initRequiredNetworksFromString(f flag.NStringFlag, fn func(nic *vcfg.NetworkInterface, s string)) error {
+	return c.initFromNStringFlag(f, func(i int, s string) {
+		c.initRequiredNetworks(len(f.Value), i)
+		fn(&c.overrideVCFG.Networks[i], s)
 	})
 }
 
 // --network.tcpdump
-var networkTCPDumpFlag = flag.NewNBoolFlag("network[<<N>>].tcpdump", "configure this network to run with tcpdump", &maxNetworkFlags, hideFlags, networkTCPDumpFlagValidator)
-var networkTCPDumpFlagValidator = func(f flag.NBoolFlag) error {
+func (c *commandContext) networkTCPDumpFlagValidator(f flag.NBoolFlag) error {
 	for i := 0; i < *f.Total; i++ {
-		initRequiredNetworks(len(f.Value), i)
+		c.initRequiredNetworks(len(f.Value), i)
 		val := f.Value[i]
-		overrideVCFG.Networks[i].TCPDUMP = val
+		c.overrideVCFG.Networks[i].TCPDUMP = val
 	}
 	return nil
 }
 
 // --network.gateway
-var networkGatewayFlag = flag.NewNStringFlag("network[<<N>>].gateway", "configure app's network gateway", &maxNetworkFlags, hideFlags, networkGatewayFlagValidator)
-var networkGatewayFlagValidator = func(f flag.NStringFlag) error {
-	return initRequiredNetworksFromString(f, func(nic *vcfg.NetworkInterface, s string) { nic.Gateway = s })
+func (c *commandContext) networkGatewayFlagValidator(f flag.NStringFlag) error {
+	return c.initRequiredNetworksFromString(f, func(nic *vcfg.NetworkInterface, s string) { nic.Gateway = s })
 }
 
-var networkFlagValidator = func(f flag.NStringSliceFlag, fn func(nic *vcfg.NetworkInterface, s interface{})) error {
+func (c *commandContext) networkFlagValidator(f flag.NStringSliceFlag, fn func(nic *vcfg.NetworkInterface, s interface{})) error {
 	for i := 0; i < *f.Total; i++ {
 		// Skip empty values from unassigned flags
 		if f.Value[i] == nil {
 			continue
 		}
 
-		initRequiredNetworks(len(f.Value[i]), i)
+		c.initRequiredNetworks(len(f.Value[i]), i)
 		s := f.Value[i]
-		nic := &overrideVCFG.Networks[i]
+		nic := &c.overrideVCFG.Networks[i]
 		fn(nic, s)
 	}
 	return nil
 }
 
 // --network.http
-var networkHTTPFlag = flag.NewNStringSliceFlag("network[<<N>>].http", "expose http port", &maxNetworkFlags, hideFlags, networkHTTPFlagValidator)
-var networkHTTPFlagValidator = func(f flag.NStringSliceFlag) error {
-	return networkFlagValidator(f, func(nic *vcfg.NetworkInterface, s interface{}) { nic.HTTP = s.([]string) })
+func (c *commandContext) networkHTTPFlagValidator(f flag.NStringSliceFlag) error {
+	return c.networkFlagValidator(f, func(nic *vcfg.NetworkInterface, s interface{}) { nic.HTTP = s.([]string) })
 }
 
 // --network.https
-var networkHTTPSFlag = flag.NewNStringSliceFlag("network[<<N>>].https", "expose https port", &maxNetworkFlags, hideFlags, networkHTTPSFlagValidator)
-var networkHTTPSFlagValidator = func(f flag.NStringSliceFlag) error {
-	return networkFlagValidator(f, func(nic *vcfg.NetworkInterface, s interface{}) { nic.HTTPS = s.([]string) })
+func (c *commandContext) networkHTTPSFlagValidator(f flag.NStringSliceFlag) error {
+	return c.networkFlagValidator(f, func(nic *vcfg.NetworkInterface, s interface{}) { nic.HTTPS = s.([]string) })
 }
 
 // --network.ip
-var networkIPFlag = flag.NewNStringFlag("network[<<N>>].ip", "configure app's network IP address", &maxNetworkFlags, hideFlags, networkIPFlagValidator)
-var networkIPFlagValidator = func(f flag.NStringFlag) error {
-	return initRequiredNetworksFromString(f, func(nic *vcfg.NetworkInterface, s string) { nic.IP = s })
+func (c *commandContext) networkIPFlagValidator(f flag.NStringFlag) error {
+	return c.initRequiredNetworksFromString(f, func(nic *vcfg.NetworkInterface, s string) { nic.IP = s })
 }
 
 // --network.mtu
-var networkMTUFlag = flag.NewNStringFlag("network[<<N>>].mtu", "configure app's network interface MTU", &maxNetworkFlags, hideFlags, networkMTUFlagValidator)
-var networkMTUFlagValidator = func(f flag.NStringFlag) error {
+func (c *commandContext) networkMTUFlagValidator(f flag.NStringFlag) error {
 	for i := 0; i < *f.Total; i++ {
-		initRequiredNetworks(len(f.Value), i)
+		c.initRequiredNetworks(len(f.Value), i)
 		s := f.Value[i]
 		if s == "" {
 			continue
@@ -291,93 +601,189 @@ var networkMTUFlagValidator = func(f flag.NStringFlag) error {
 		if err != nil {
 			return err
 		}
-		nic := &overrideVCFG.Networks[i]
+		nic := &c.overrideVCFG.Networks[i]
 		nic.MTU = uint(x)
 	}
 	return nil
 }
 
 // --network.mask
-var networkMaskFlag = flag.NewNStringFlag("network[<<N>>].mask", "configure app's subnet mask", &maxNetworkFlags, hideFlags, networkMaskFlagValidator)
-var networkMaskFlagValidator = func(f flag.NStringFlag) error {
-	return initRequiredNetworksFromString(f, func(nic *vcfg.NetworkInterface, s string) { nic.Mask = s })
+func (c *commandContext) networkMaskFlagValidator(f flag.NStringFlag) error {
+	return c.initRequiredNetworksFromString(f, func(nic *vcfg.NetworkInterface, s string) { nic.Mask = s })
 }
 
 // --network.tcp
-var networkTCPFlag = flag.NewNStringSliceFlag("network[<<N>>].tcp", "expose tcp port", &maxNetworkFlags, hideFlags, networkTCPFlagValidator)
-var networkTCPFlagValidator = func(f flag.NStringSliceFlag) error {
-	return networkFlagValidator(f, func(nic *vcfg.NetworkInterface, s interface{}) { nic.TCP = s.([]string) })
+func (c *commandContext) networkTCPFlagValidator(f flag.NStringSliceFlag) error {
+	return c.networkFlagValidator(f, func(nic *vcfg.NetworkInterface, s interface{}) { nic.TCP = s.([]string) })
 }
 
 // --network.udp
-var networkUDPFlag = flag.NewNStringSliceFlag("network[<<N>>].udp", "expose udp port", &maxNetworkFlags, hideFlags, networkUDPFlagValidator)
-var networkUDPFlagValidator = func(f flag.NStringSliceFlag) error {
-	return networkFlagValidator(f, func(nic *vcfg.NetworkInterface, s interface{}) { nic.UDP = s.([]string) })
+func (c *commandContext) networkUDPFlagValidator(f flag.NStringSliceFlag) error {
+	return c.networkFlagValidator(f, func(nic *vcfg.NetworkInterface, s interface{}) { nic.UDP = s.([]string) })
 }
 
 // --system.kernel-args
-var systemKernelArgsFlag = flag.NewStringFlag("system.kernel-args", "linux kernel args to append", hideFlags, systemKernelArgsFlagValidator)
-var systemKernelArgsFlagValidator = func(f flag.StringFlag) error {
-	overrideVCFG.System.KernelArgs = f.Value
+func (c *commandContext) systemKernelArgsFlagValidator(f flag.StringFlag) error {
+	c.overrideVCFG.System.KernelArgs = f.Value
 	return nil
 }
 
 // --system.dns
-var systemDNSFlag = flag.NewStringSliceFlag("system.dns", "set the DNS server list for the system", hideFlags, systemDNSFlagValidator)
-var systemDNSFlagValidator = func(f flag.StringSliceFlag) error {
-	overrideVCFG.System.DNS = f.Value
+func (c *commandContext) systemDNSFlagValidator(f flag.StringSliceFlag) error {
+	c.overrideVCFG.System.DNS = f.Value
 	return nil
 }
 
 // --system.hostname
-var systemHostnameFlag = flag.NewStringFlag("system.hostname", "set the hostname for the system", hideFlags, systemHostnameFlagValidator)
-var systemHostnameFlagValidator = func(f flag.StringFlag) error {
-	overrideVCFG.System.Hostname = f.Value
+func (c *commandContext) systemHostnameFlagValidator(f flag.StringFlag) error {
+	c.overrideVCFG.System.Hostname = f.Value
 	return nil
 }
 
 // --system.filesystem
-var systemFilesystemFlag = flag.NewStringFlag("system.filesystem", "set the filesystem format", hideFlags, systemFilesystemFlagValidator)
-var systemFilesystemFlagValidator = func(f flag.StringFlag) error {
-	overrideVCFG.System.Filesystem = vcfg.Filesystem(f.Value)
+func (c *commandContext) systemFilesystemFlagValidator(f flag.StringFlag) error {
+	c.overrideVCFG.System.Filesystem = vcfg.Filesystem(f.Value)
+	return nil
+}
+
+// --system.overlay-filesystem
+func (c *commandContext) systemOverlayFilesystemFlagValidator(f flag.StringFlag) error {
+	c.overrideVCFG.System.OverlayFilesystem = vcfg.Filesystem(f.Value)
 	return nil
 }
 
 // --system.max-fds
-var systemMaxFDsFlag = flag.NewUintFlag("system.max-fds", "maximum file descriptors available to app", hideFlags, systemMaxFDsFlagValidator)
-var systemMaxFDsFlagValidator = func(f flag.UintFlag) error {
-	overrideVCFG.System.MaxFDs = f.Value
+func (c *commandContext) systemMaxFDsFlagValidator(f flag.UintFlag) error {
+	c.overrideVCFG.System.MaxFDs = f.Value
 	return nil
 }
 
 // --system.output-mode
-var systemOutputModeFlag = flag.NewStringFlag("system.output-mode", "specify vm output behaviour mode", hideFlags, systemOutputModeFlagValidator)
-var systemOutputModeFlagValidator = func(f flag.StringFlag) error {
-	overrideVCFG.System.StdoutMode = vcfg.StdoutModeFromString(f.Value)
+func (c *commandContext) systemOutputModeFlagValidator(f flag.StringFlag) error {
+	c.overrideVCFG.System.StdoutMode = vcfg.StdoutModeFromString(f.Value)
 	return nil
 }
 
 // --system.user
-var systemUserFlag = flag.NewStringFlag("system.user", "name of the non-root user (default: vorteil)", hideFlags, systemUserFlagValidator)
-var systemUserFlagValidator = func(f flag.StringFlag) error {
-	overrideVCFG.System.User = f.Value
+func (c *commandContext) systemUserFlagValidator(f flag.StringFlag) error {
+	c.overrideVCFG.System.User = f.Value
 	return nil
 }
 
 // --system.terminate-wait
-var systemTerminateWaitFlag = flag.NewUintFlag("system.terminate-wait", "how many milliseconds to wait for program termination (default: 3000)", hideFlags, systemTerminateWaitFlagValidator)
-var systemTerminateWaitFlagValidator = func(f flag.UintFlag) error {
-	overrideVCFG.System.TerminateWait = f.Value
+func (c *commandContext) systemTerminateWaitFlagValidator(f flag.UintFlag) error {
+	c.overrideVCFG.System.TerminateWait = f.Value
+	return nil
+}
+
+// --system.disk-guid
+func (c *commandContext) systemDiskGUIDFlagValidator(f flag.StringFlag) error {
+	return overwriteUUIDFieldFromString(f, &c.overrideVCFG.System.DiskGUID)
+}
+
+// --system.os-partition-guid
+func (c *commandContext) systemOSPartitionGUIDFlagValidator(f flag.StringFlag) error {
+	return overwriteUUIDFieldFromString(f, &c.overrideVCFG.System.OSPartitionGUID)
+}
+
+// --system.root-partition-guid
+func (c *commandContext) systemRootPartitionGUIDFlagValidator(f flag.StringFlag) error {
+	return overwriteUUIDFieldFromString(f, &c.overrideVCFG.System.RootPartitionGUID)
+}
+
+// --system.filesystem-uuid
+func (c *commandContext) systemFilesystemUUIDFlagValidator(f flag.StringFlag) error {
+	return overwriteUUIDFieldFromString(f, &c.overrideVCFG.System.FilesystemUUID)
+}
+
+// --system.fs-label
+func (c *commandContext) systemFilesystemLabelFlagValidator(f flag.StringFlag) error {
+	c.overrideVCFG.System.FilesystemLabel = f.Value
+	return nil
+}
+
+// --system.expand-fs
+func (c *commandContext) systemExpandFilesystemFlagValidator(f flag.BoolFlag) error {
+	c.overrideVCFG.System.ExpandFilesystem = f.Value
+	return nil
+}
+
+// --system.verity
+func (c *commandContext) systemVerityFlagValidator(f flag.BoolFlag) error {
+	c.overrideVCFG.System.Verity = f.Value
+	return nil
+}
+
+// --system.tag-output
+func (c *commandContext) systemTagOutputFlagValidator(f flag.BoolFlag) error {
+	c.overrideVCFG.System.TagOutput = f.Value
+	return nil
+}
+
+// --system.preserve-ownership
+func (c *commandContext) systemPreserveOwnershipFlagValidator(f flag.BoolFlag) error {
+	c.overrideVCFG.System.PreserveOwnership = f.Value
+	return nil
+}
+
+// --system.overlay-size
+func (c *commandContext) systemOverlaySizeFlagValidator(f flag.StringFlag) error {
+	return overwriteSizeFieldFromString(f, &c.overrideVCFG.System.OverlaySize)
+}
+
+// --system.boot-mode
+func (c *commandContext) systemBootModeFlagValidator(f flag.StringFlag) error {
+	c.overrideVCFG.System.BootMode = vcfg.BootMode(f.Value)
+	return nil
+}
+
+// --system.timezone
+func (c *commandContext) systemTimezoneFlagValidator(f flag.StringFlag) error {
+	c.overrideVCFG.System.Timezone = f.Value
+	return nil
+}
+
+// --system.xfs.block-size
+func (c *commandContext) systemXFSBlockSizeFlagValidator(f flag.StringFlag) error {
+	return overwriteSizeFieldFromString(f, &c.overrideVCFG.System.XFS.BlockSize)
+}
+
+// --system.xfs.inode-size
+func (c *commandContext) systemXFSInodeSizeFlagValidator(f flag.StringFlag) error {
+	return overwriteSizeFieldFromString(f, &c.overrideVCFG.System.XFS.InodeSize)
+}
+
+// --system.xfs.dir-block-size
+func (c *commandContext) systemXFSDirBlockSizeFlagValidator(f flag.StringFlag) error {
+	return overwriteSizeFieldFromString(f, &c.overrideVCFG.System.XFS.DirectoryBlockSize)
+}
+
+// --system.encryption.passphrase
+func (c *commandContext) systemEncryptionPassphraseFlagValidator(f flag.StringFlag) error {
+	c.overrideVCFG.System.Encryption.Passphrase = f.Value
+	return nil
+}
+
+// --system.encryption.key-file
+func (c *commandContext) systemEncryptionKeyFileFlagValidator(f flag.StringFlag) error {
+	c.overrideVCFG.System.Encryption.KeyFile = f.Value
 	return nil
 }
 
-// a key can have multiple destinations
-// key = src, vals = dst
-var filesMap = make(map[string][]string)
+func overwriteUUIDFieldFromString(f flag.StringFlag, field *string) error {
+	if f.Value == "" {
+		return nil
+	}
+	_, err := uuid.Parse(f.Value)
+	if err != nil {
+		return fmt.Errorf("--%s=%s: %v", f.Key, f.Value, err)
+	}
+	*field = f.Value
+	return nil
+}
 
 // --files
-var filesFlag = flag.NewStringSliceFlag("files", "<src>[@<dst>]   add files from the host filesystem to an existing folder in the virtual machine filesystem (dst defaults to '/')", hideFlags, filesFlagValidator)
-var filesFlagValidator = func(f flag.StringSliceFlag) error {
+func (c *commandContext) filesFlagValidator(f flag.StringSliceFlag) error {
 	for _, v := range f.Value {
 		// value should have no more than 2 elements when split by '@'
 		x := strings.SplitN(v, "@", 2)
@@ -386,18 +792,17 @@ var filesFlagValidator = func(f flag.StringSliceFlag) error {
 		if len(x) > 1 {
 			dst = x[1]
 		}
-		if _, ok := filesMap[src]; !ok {
-			filesMap[src] = make([]string, 0)
+		if _, ok := c.filesMap[src]; !ok {
+			c.filesMap[src] = make([]string, 0)
 		}
-		filesMap[src] = append(filesMap[src], dst)
+		c.filesMap[src] = append(c.filesMap[src], dst)
 	}
 	return nil
 }
 
 // --vm.cpus
-var vmCPUsFlag = flag.NewUintFlag("vm.cpus", "number of cpus to allocate to app", hideFlags, vmCPUsFlagValidator)
-var vmCPUsFlagValidator = func(f flag.UintFlag) error {
-	overrideVCFG.VM.CPUs = f.Value
+func (c *commandContext) vmCPUsFlagValidator(f flag.UintFlag) error {
+	c.overrideVCFG.VM.CPUs = f.Value
 	return nil
 }
 
@@ -411,34 +816,35 @@ func overwriteSizeFieldFromString(f flag.StringFlag, field *vcfg.Bytes) error {
 }
 
 // --vm.disk-size
-var vmDiskSizeFlag = flag.NewStringFlag("vm.disk-size", "disk image capacity to allocate to app", hideFlags, vmDiskSizeFlagValidator)
-var vmDiskSizeFlagValidator = func(f flag.StringFlag) error {
-	return overwriteSizeFieldFromString(f, &overrideVCFG.VM.DiskSize)
+func (c *commandContext) vmDiskSizeFlagValidator(f flag.StringFlag) error {
+	return overwriteSizeFieldFromString(f, &c.overrideVCFG.VM.DiskSize)
+}
+
+// --vm.swap-size
+func (c *commandContext) vmSwapSizeFlagValidator(f flag.StringFlag) error {
+	return overwriteSizeFieldFromString(f, &c.overrideVCFG.VM.SwapSize)
 }
 
 // --vm.inodes
-var vmInodesFlag = flag.NewUintFlag("vm.inodes", "number of inodes to build on disk image", hideFlags, vmInodesFlagValidator)
-var vmInodesFlagValidator = func(f flag.UintFlag) error {
-	overrideVCFG.VM.Inodes = vcfg.InodesQuota(f.Value)
+func (c *commandContext) vmInodesFlagValidator(f flag.UintFlag) error {
+	c.overrideVCFG.VM.Inodes = vcfg.InodesQuota(f.Value)
 	return nil
 }
 
 // --vm.kernel
-var vmKernelFlag = flag.NewStringFlag("vm.kernel", "kernel to build app on", hideFlags, vmKernelFlagValidator)
-var vmKernelFlagValidator = func(f flag.StringFlag) error {
+func (c *commandContext) vmKernelFlagValidator(f flag.StringFlag) error {
 	if f.Value != "" {
-		overrideVCFG.VM.Kernel = f.Value
+		c.overrideVCFG.VM.Kernel = f.Value
 	}
 	return nil
 }
 
 // --vm.ram
-var vmRAMFlag = flag.NewStringFlag("vm.ram", "memory to allocate to app", hideFlags, vmRAMFlagValidator)
-var vmRAMFlagValidator = func(f flag.StringFlag) error {
-	return overwriteSizeFieldFromString(f, &overrideVCFG.VM.RAM)
+func (c *commandContext) vmRAMFlagValidator(f flag.StringFlag) error {
+	return overwriteSizeFieldFromString(f, &c.overrideVCFG.VM.RAM)
 }
 
-var initFromNStringFlag = func(f flag.NStringFlag, fn func(i int, s string)) error {
+func (c *commandContext) initFromNStringFlag(f flag.NStringFlag, fn func(i int, s string)) error {
 	for i := 0; i < *f.Total; i++ {
 		s := f.Value[i]
 		if s == "" {
@@ -449,117 +855,343 @@ var initFromNStringFlag = func(f flag.NStringFlag, fn func(i int, s string)) err
 	return nil
 }
 
-var initRequiredProgramsFromString = func(f flag.NStringFlag, fn func(prog *vcfg.Program, s string)) error {
-	return initFromNStringFlag(f, func(i int, s string) {
-		for len(overrideVCFG.Programs) < i+1 {
-			overrideVCFG.Programs = append(overrideVCFG.Programs, vcfg.Program{})
+func (c *commandContext) initRequiredProgramsFromString(f flag.NStringFlag, fn func(prog *vcfg.Program, s string)) error {
+	return c.initFromNStringFlag(f, func(i int, s string) {
+		for len(c.overrideVCFG.Programs) < i+1 {
+			c.overrideVCFG.Programs = append(c.overrideVCFG.Programs, vcfg.Program{})
 		}
-		fn(&overrideVCFG.Programs[i], s)
+		fn(&c.overrideVCFG.Programs[i], s)
 	})
 }
 
-var initRequiredProgramsFromBool = func(f flag.NBoolFlag, fn func(prog *vcfg.Program, s bool)) error {
+func (c *commandContext) initRequiredProgramsFromBool(f flag.NBoolFlag, fn func(prog *vcfg.Program, s bool)) error {
 	for i := 0; i < *f.Total; i++ {
-		for len(overrideVCFG.Programs) < i+1 {
-			overrideVCFG.Programs = append(overrideVCFG.Programs, vcfg.Program{})
+		for len(c.overrideVCFG.Programs) < i+1 {
+			c.overrideVCFG.Programs = append(c.overrideVCFG.Programs, vcfg.Program{})
 		}
-		fn(&overrideVCFG.Programs[i], f.Value[i])
+		fn(&c.overrideVCFG.Programs[i], f.Value[i])
 	}
 	return nil
 }
 
-var initRequiredProgramsFromStringSlice = func(f flag.NStringSliceFlag, fn func(prog *vcfg.Program, s []string)) error {
+func (c *commandContext) initRequiredProgramsFromStringSlice(f flag.NStringSliceFlag, fn func(prog *vcfg.Program, s []string)) error {
 	for i := 0; i < *f.Total; i++ {
 		s := f.Value[i]
 		if s == nil {
 			continue
 		}
-		for len(overrideVCFG.Programs) < i+1 {
-			overrideVCFG.Programs = append(overrideVCFG.Programs, vcfg.Program{})
+		for len(c.overrideVCFG.Programs) < i+1 {
+			c.overrideVCFG.Programs = append(c.overrideVCFG.Programs, vcfg.Program{})
 		}
-		fn(&overrideVCFG.Programs[i], s)
+		fn(&c.overrideVCFG.Programs[i], s)
 	}
 	return nil
 }
 
 // --program.binary
-var programBinaryFlag = flag.NewNStringFlag("program[<<N>>].binary", "configure a program binary", &maxProgramFlags, hideFlags, programBinaryFlagValidator)
-var programBinaryFlagValidator = func(f flag.NStringFlag) error {
-	return initRequiredProgramsFromString(f, func(prog *vcfg.Program, s string) { prog.Binary = s })
+func (c *commandContext) programBinaryFlagValidator(f flag.NStringFlag) error {
+	return c.initRequiredProgramsFromString(f, func(prog *vcfg.Program, s string) { prog.Binary = s })
 }
 
 // --program.privileges
-var programPrivilegesFlag = flag.NewNStringFlag("program[<<N>>].privilege", "configure program privileges (root, superuser, user)", &maxProgramFlags, hideFlags, programPrivilegesFlagValidator)
-var programPrivilegesFlagValidator = func(f flag.NStringFlag) error {
-	return initRequiredProgramsFromString(f, func(prog *vcfg.Program, s string) { prog.Privilege = vcfg.Privilege(s) })
+func (c *commandContext) programPrivilegesFlagValidator(f flag.NStringFlag) error {
+	return c.initRequiredProgramsFromString(f, func(prog *vcfg.Program, s string) { prog.Privilege = vcfg.Privilege(s) })
 }
 
 // --program.env
-var programEnvFlag = flag.NewNStringSliceFlag("program[<<N>>].env", "configure the environment variables of a program", &maxProgramFlags, hideFlags, programEnvFlagValidator)
-var programEnvFlagValidator = func(f flag.NStringSliceFlag) error {
-	return initRequiredProgramsFromStringSlice(f, func(prog *vcfg.Program, s []string) { prog.Env = s })
+func (c *commandContext) programEnvFlagValidator(f flag.NStringSliceFlag) error {
+	return c.initRequiredProgramsFromStringSlice(f, func(prog *vcfg.Program, s []string) { prog.Env = s })
 }
 
 // --program.cwd
-var programCWDFlag = flag.NewNStringFlag("program[<<N>>].cwd", "configure the working directory of a program", &maxProgramFlags, hideFlags, programCWDFlagValidator)
-var programCWDFlagValidator = func(f flag.NStringFlag) error {
-	return initRequiredProgramsFromString(f, func(prog *vcfg.Program, s string) { prog.Cwd = s })
+func (c *commandContext) programCWDFlagValidator(f flag.NStringFlag) error {
+	return c.initRequiredProgramsFromString(f, func(prog *vcfg.Program, s string) { prog.Cwd = s })
 }
 
 // --program.terminate
-var programTerminateFlag = flag.NewNStringFlag("program[<<N>>].terminate", "configure the signal to send program on termination (default: SIGTERM)", &maxProgramFlags, hideFlags, programTerminateFlagValidator)
-var programTerminateFlagValidator = func(f flag.NStringFlag) error {
-	return initRequiredProgramsFromString(f, func(prog *vcfg.Program, s string) { prog.Terminate = vcfg.TerminateSignal(s) })
+func (c *commandContext) programTerminateFlagValidator(f flag.NStringFlag) error {
+	return c.initRequiredProgramsFromString(f, func(prog *vcfg.Program, s string) { prog.Terminate = vcfg.TerminateSignal(s) })
 }
 
 // --program.logfiles
-var programLogFilesFlag = flag.NewNStringSliceFlag("program[<<N>>].logfiles", "gure the logfiles of a program", &maxProgramFlags, hideFlags, programLogFilesFlagValidator)
-var programLogFilesFlagValidator = func(f flag.NStringSliceFlag) error {
-	return initRequiredProgramsFromStringSlice(f, func(prog *vcfg.Program, s []string) { prog.LogFiles = s })
+func (c *commandContext) programLogFilesFlagValidator(f flag.NStringSliceFlag) error {
+	return c.initRequiredProgramsFromStringSlice(f, func(prog *vcfg.Program, s []string) { prog.LogFiles = s })
 }
 
 // --program.bootstrap
-var programBootstrapFlag = flag.NewNStringSliceFlag("program[<<N>>].bootstrap", "configure the bootstrap parameters of a program", &maxProgramFlags, hideFlags, programBootstrapFlagValidator)
-var programBootstrapFlagValidator = func(f flag.NStringSliceFlag) error {
-	return initRequiredProgramsFromStringSlice(f, func(prog *vcfg.Program, s []string) { prog.Bootstrap = s })
+func (c *commandContext) programBootstrapFlagValidator(f flag.NStringSliceFlag) error {
+	for i := 0; i < *f.Total; i++ {
+		for _, step := range f.Value[i] {
+			err := vcfg.ValidateBootstrap(step)
+			if err != nil {
+				return fmt.Errorf("--program[%d].bootstrap: %v", i, err)
+			}
+		}
+	}
+	return c.initRequiredProgramsFromStringSlice(f, func(prog *vcfg.Program, s []string) { prog.Bootstrap = s })
 }
 
 // --program.stdout
-var programStdoutFlag = flag.NewNStringFlag("program[<<N>>].stdout", "configure programs stdout", &maxProgramFlags, hideFlags, programStdoutFlagValidator)
-var programStdoutFlagValidator = func(f flag.NStringFlag) error {
-	return initRequiredProgramsFromString(f, func(prog *vcfg.Program, s string) { prog.Stdout = s })
+func (c *commandContext) programStdoutFlagValidator(f flag.NStringFlag) error {
+	return c.initRequiredProgramsFromString(f, func(prog *vcfg.Program, s string) { prog.Stdout = s })
 }
 
 // --program.stderr
-var programStderrFlag = flag.NewNStringFlag("program[<<N>>].stderr", "configure programs stderr", &maxProgramFlags, hideFlags, programStderrFlagValidator)
-var programStderrFlagValidator = func(f flag.NStringFlag) error {
-	return initRequiredProgramsFromString(f, func(prog *vcfg.Program, s string) { prog.Stderr = s })
+func (c *commandContext) programStderrFlagValidator(f flag.NStringFlag) error {
+	return c.initRequiredProgramsFromString(f, func(prog *vcfg.Program, s string) { prog.Stderr = s })
 }
 
 // --program.strace
-var programStraceFlag = flag.NewNBoolFlag("program[<<N>>].strace", "configure the program to run with strace", &maxProgramFlags, hideFlags, programStraceFlagValidator)
-var programStraceFlagValidator = func(f flag.NBoolFlag) error {
-	return initRequiredProgramsFromBool(f, func(prog *vcfg.Program, s bool) { prog.Strace = s })
+func (c *commandContext) programStraceFlagValidator(f flag.NBoolFlag) error {
+	return c.initRequiredProgramsFromBool(f, func(prog *vcfg.Program, s bool) { prog.Strace = s })
 }
 
 // --program.args
-var programArgsFlag = flag.NewNStringFlag("program[<<N>>].args", "configure programs args", &maxProgramFlags, hideFlags, programArgsFlagValidator)
-var programArgsFlagValidator = func(f flag.NStringFlag) error {
-	return initRequiredProgramsFromString(f, func(prog *vcfg.Program, s string) { prog.Args = s })
-}
-
-var vcfgFlags = flag.FlagsList{
-	&vmCPUsFlag, &vmDiskSizeFlag, &vmInodesFlag, &vmKernelFlag, &vmRAMFlag,
-	&filesFlag, &infoAuthorFlag, &infoDateFlag, &infoDescriptionFlag,
-	&infoNameFlag, &infoSummaryFlag, &infoURLFlag, &infoVersionFlag,
-	&networkIPFlag, &networkMaskFlag, &networkGatewayFlag, &networkUDPFlag,
-	&networkTCPFlag, &networkHTTPFlag, &networkHTTPSFlag, &networkMTUFlag,
-	&networkTCPDumpFlag, &loggingConfigFlag, &loggingTypeFlag, &nfsMountFlag,
-	&nfsServerFlag, &nfsOptionsFlag, &systemKernelArgsFlag, &systemDNSFlag,
-	&systemHostnameFlag, &systemFilesystemFlag, &systemMaxFDsFlag,
-	&systemOutputModeFlag, &systemUserFlag, &programBinaryFlag,
-	&programPrivilegesFlag, &programArgsFlag, &programStdoutFlag,
-	&programStderrFlag, &programLogFilesFlag, &programBootstrapFlag,
-	&programEnvFlag, &programCWDFlag, &programStraceFlag, &sysctlFlag,
-	&programTerminateFlag, &systemTerminateWaitFlag,
+func (c *commandContext) programArgsFlagValidator(f flag.NStringFlag) error {
+	return c.initRequiredProgramsFromString(f, func(prog *vcfg.Program, s string) { prog.Args = s })
+}
+
+// modifyFlags are the flags that modify the VCFG of the app a command is run
+// on. They hold the values they're given, so each context has its own.
+type modifyFlags struct {
+	sysctlFlag                     flag.StringSliceFlag
+	infoAuthorFlag                 flag.StringFlag
+	infoDateFlag                   flag.StringFlag
+	infoDescriptionFlag            flag.StringFlag
+	infoNameFlag                   flag.StringFlag
+	infoSummaryFlag                flag.StringFlag
+	infoURLFlag                    flag.StringFlag
+	infoVersionFlag                flag.StringFlag
+	loggingConfigFlag              flag.NStringSliceFlag
+	loggingTypeFlag                flag.NStringFlag
+	loggingDriverFlag              flag.NStringFlag
+	loggingAddressFlag             flag.NStringFlag
+	loggingPathFlag                flag.NStringFlag
+	loggingTagFlag                 flag.NStringFlag
+	nfsMountFlag                   flag.NStringFlag
+	nfsOptionsFlag                 flag.NStringFlag
+	nfsServerFlag                  flag.NStringFlag
+	nfsVersionFlag                 flag.NStringFlag
+	nfsTransportFlag               flag.NStringFlag
+	nfsTimeoutFlag                 flag.NStringFlag
+	smbMountFlag                   flag.NStringFlag
+	smbServerFlag                  flag.NStringFlag
+	smbOptionsFlag                 flag.NStringFlag
+	smbUsernameFlag                flag.NStringFlag
+	smbPasswordFlag                flag.NStringFlag
+	smbDomainFlag                  flag.NStringFlag
+	smbVersionFlag                 flag.NStringFlag
+	syncSourceFlag                 flag.NStringFlag
+	syncPathFlag                   flag.NStringFlag
+	syncEndpointFlag               flag.NStringFlag
+	syncRegionFlag                 flag.NStringFlag
+	syncCredentialsFlag            flag.NStringFlag
+	syncSyncBackFlag               flag.NBoolFlag
+	diskNameFlag                   flag.NStringFlag
+	diskMountFlag                  flag.NStringFlag
+	diskSizeFlag                   flag.NStringFlag
+	diskFilesystemFlag             flag.NStringFlag
+	partitionNameFlag              flag.NStringFlag
+	partitionMountFlag             flag.NStringFlag
+	partitionSizeFlag              flag.NStringFlag
+	partitionFilesystemFlag        flag.NStringFlag
+	partitionFlagsFlag             flag.NStringSliceFlag
+	nodePathFlag                   flag.NStringFlag
+	nodeTypeFlag                   flag.NStringFlag
+	nodeMajorFlag                  flag.NStringFlag
+	nodeMinorFlag                  flag.NStringFlag
+	networkTCPDumpFlag             flag.NBoolFlag
+	networkGatewayFlag             flag.NStringFlag
+	networkHTTPFlag                flag.NStringSliceFlag
+	networkHTTPSFlag               flag.NStringSliceFlag
+	networkIPFlag                  flag.NStringFlag
+	networkMTUFlag                 flag.NStringFlag
+	networkMaskFlag                flag.NStringFlag
+	networkTCPFlag                 flag.NStringSliceFlag
+	networkUDPFlag                 flag.NStringSliceFlag
+	systemKernelArgsFlag           flag.StringFlag
+	systemDNSFlag                  flag.StringSliceFlag
+	systemHostnameFlag             flag.StringFlag
+	systemFilesystemFlag           flag.StringFlag
+	systemOverlayFilesystemFlag    flag.StringFlag
+	systemMaxFDsFlag               flag.UintFlag
+	systemOutputModeFlag           flag.StringFlag
+	systemUserFlag                 flag.StringFlag
+	systemTerminateWaitFlag        flag.UintFlag
+	systemDiskGUIDFlag             flag.StringFlag
+	systemOSPartitionGUIDFlag      flag.StringFlag
+	systemRootPartitionGUIDFlag    flag.StringFlag
+	systemFilesystemUUIDFlag       flag.StringFlag
+	systemFilesystemLabelFlag      flag.StringFlag
+	systemExpandFilesystemFlag     flag.BoolFlag
+	systemVerityFlag               flag.BoolFlag
+	systemTagOutputFlag            flag.BoolFlag
+	systemPreserveOwnershipFlag    flag.BoolFlag
+	systemOverlaySizeFlag          flag.StringFlag
+	systemBootModeFlag             flag.StringFlag
+	systemTimezoneFlag             flag.StringFlag
+	systemXFSBlockSizeFlag         flag.StringFlag
+	systemXFSInodeSizeFlag         flag.StringFlag
+	systemXFSDirBlockSizeFlag      flag.StringFlag
+	systemEncryptionPassphraseFlag flag.StringFlag
+	systemEncryptionKeyFileFlag    flag.StringFlag
+	filesFlag                      flag.StringSliceFlag
+	vmCPUsFlag                     flag.UintFlag
+	vmDiskSizeFlag                 flag.StringFlag
+	vmSwapSizeFlag                 flag.StringFlag
+	vmInodesFlag                   flag.UintFlag
+	vmKernelFlag                   flag.StringFlag
+	vmRAMFlag                      flag.StringFlag
+	programBinaryFlag              flag.NStringFlag
+	programPrivilegesFlag          flag.NStringFlag
+	programEnvFlag                 flag.NStringSliceFlag
+	programCWDFlag                 flag.NStringFlag
+	programTerminateFlag           flag.NStringFlag
+	programLogFilesFlag            flag.NStringSliceFlag
+	programBootstrapFlag           flag.NStringSliceFlag
+	programStdoutFlag              flag.NStringFlag
+	programStderrFlag              flag.NStringFlag
+	programStraceFlag              flag.NBoolFlag
+	programArgsFlag                flag.NStringFlag
+
+	vcfgFlags flag.FlagsList
+}
+
+// initModifyFlags creates the context's modifyFlags. The repeatable flags
+// must already be tallied, because it determines how many are created.
+func (c *commandContext) initModifyFlags() {
+
+	c.sysctlFlag = flag.NewStringSliceFlag("sysctl", "add a sysctl key/value tuple", hideFlags, c.sysctlFlagValidator)
+	c.infoAuthorFlag = flag.NewStringFlag("info.author", "name the author of the app", hideFlags, c.infoAuthorFlagValidator)
+	c.infoDateFlag = flag.NewStringFlag("info.date", "date of app's release (YYYY-MM-DD)", hideFlags, c.infoDateFlagValidator)
+	c.infoDescriptionFlag = flag.NewStringFlag("info.description", "provide a description for the app", hideFlags, c.infoDescriptionFlagValidator)
+	c.infoNameFlag = flag.NewStringFlag("info.name", "name of the app", hideFlags, c.infoNameFlagValidator)
+	c.infoSummaryFlag = flag.NewStringFlag("info.summary", "provide a short summary for the app", hideFlags, c.infoSummaryFlagValidator)
+	c.infoURLFlag = flag.NewStringFlag("info.url", "URL for more information about the app", hideFlags, c.infoURLFlagValidator)
+	c.infoVersionFlag = flag.NewStringFlag("info.version", "identify the app's version", hideFlags, c.infoVersionFlagValidator)
+	c.loggingConfigFlag = flag.NewNStringSliceFlag("logging[<<N>>].config", "configure app's logging config", &c.maxLoggingFlags, hideFlags, c.loggingConfigFlagValidator)
+	c.loggingTypeFlag = flag.NewNStringFlag("logging[<<N>>].type", "configure app's logging type", &c.maxLoggingFlags, hideFlags, c.loggingTypeFlagValidator)
+	c.loggingDriverFlag = flag.NewNStringFlag("logging[<<N>>].driver", "ship app's logs using a logging driver (syslog, fluentd, file)", &c.maxLoggingFlags, hideFlags, c.loggingDriverFlagValidator)
+	c.loggingAddressFlag = flag.NewNStringFlag("logging[<<N>>].address", "configure the address a syslog or fluentd logging driver ships logs to", &c.maxLoggingFlags, hideFlags, c.loggingAddressFlagValidator)
+	c.loggingPathFlag = flag.NewNStringFlag("logging[<<N>>].path", "configure the file a file logging driver writes logs to", &c.maxLoggingFlags, hideFlags, c.loggingPathFlagValidator)
+	c.loggingTagFlag = flag.NewNStringFlag("logging[<<N>>].tag", "configure the tag a logging driver attaches to logs", &c.maxLoggingFlags, hideFlags, c.loggingTagFlagValidator)
+	c.nfsMountFlag = flag.NewNStringFlag("nfs[<<N>>].mount", "configure app's nfs mounts", &c.maxNFSFlags, hideFlags, c.nfsMountFlagValidator)
+	c.nfsOptionsFlag = flag.NewNStringFlag("nfs[<<N>>].options", "configure app's nfs options", &c.maxNFSFlags, hideFlags, c.nfsOptionsFlagValidator)
+	c.nfsServerFlag = flag.NewNStringFlag("nfs[<<N>>].server", "configure app's nfs servers", &c.maxNFSFlags, hideFlags, c.nfsServerFlagValidator)
+	c.nfsVersionFlag = flag.NewNStringFlag("nfs[<<N>>].version", "set the NFS protocol version of an nfs mount ('3', '4', '4.1', or '4.2')", &c.maxNFSFlags, hideFlags, c.nfsVersionFlagValidator)
+	c.nfsTransportFlag = flag.NewNStringFlag("nfs[<<N>>].transport", "set the transport of an nfs mount ('tcp', 'udp', or 'rdma')", &c.maxNFSFlags, hideFlags, c.nfsTransportFlagValidator)
+	c.nfsTimeoutFlag = flag.NewNStringFlag("nfs[<<N>>].timeout", "set how long an nfs mount waits for a response before retrying a request", &c.maxNFSFlags, hideFlags, c.nfsTimeoutFlagValidator)
+	c.smbMountFlag = flag.NewNStringFlag("smb[<<N>>].mount", "configure app's smb mounts", &c.maxSMBFlags, hideFlags, c.smbMountFlagValidator)
+	c.smbServerFlag = flag.NewNStringFlag("smb[<<N>>].server", "configure the share an smb mount uses, e.g. //host/share", &c.maxSMBFlags, hideFlags, c.smbServerFlagValidator)
+	c.smbOptionsFlag = flag.NewNStringFlag("smb[<<N>>].options", "configure app's smb options", &c.maxSMBFlags, hideFlags, c.smbOptionsFlagValidator)
+	c.smbUsernameFlag = flag.NewNStringFlag("smb[<<N>>].username", "set the user an smb mount authenticates as", &c.maxSMBFlags, hideFlags, c.smbUsernameFlagValidator)
+	c.smbPasswordFlag = flag.NewNStringFlag("smb[<<N>>].password", "set the password an smb mount authenticates with", &c.maxSMBFlags, hideFlags, c.smbPasswordFlagValidator)
+	c.smbDomainFlag = flag.NewNStringFlag("smb[<<N>>].domain", "set the domain of an smb mount's user", &c.maxSMBFlags, hideFlags, c.smbDomainFlagValidator)
+	c.smbVersionFlag = flag.NewNStringFlag("smb[<<N>>].version", "set the SMB protocol version of an smb mount, e.g. '3.0'", &c.maxSMBFlags, hideFlags, c.smbVersionFlagValidator)
+	c.syncSourceFlag = flag.NewNStringFlag("sync[<<N>>].source", "copy the objects under this s3:// or gs:// prefix into the VM at boot", &c.maxSyncFlags, hideFlags, c.syncSourceFlagValidator)
+	c.syncPathFlag = flag.NewNStringFlag("sync[<<N>>].path", "set the directory a sync copies objects into", &c.maxSyncFlags, hideFlags, c.syncPathFlagValidator)
+	c.syncEndpointFlag = flag.NewNStringFlag("sync[<<N>>].endpoint", "use an S3-compatible service at this URL for a sync", &c.maxSyncFlags, hideFlags, c.syncEndpointFlagValidator)
+	c.syncRegionFlag = flag.NewNStringFlag("sync[<<N>>].region", "set the region of an s3 sync's bucket", &c.maxSyncFlags, hideFlags, c.syncRegionFlagValidator)
+	c.syncCredentialsFlag = flag.NewNStringFlag("sync[<<N>>].credentials", "read a sync's credentials from this file in the VM instead of using the instance's", &c.maxSyncFlags, hideFlags, c.syncCredentialsFlagValidator)
+	c.syncSyncBackFlag = flag.NewNBoolFlag("sync[<<N>>].sync-back", "copy a sync's directory back to its source when the VM shuts down", &c.maxSyncFlags, hideFlags, c.syncSyncBackFlagValidator)
+	c.diskNameFlag = flag.NewNStringFlag("disk[<<N>>].name", "name an additional data disk, which is written alongside the main disk", &c.maxDiskFlags, hideFlags, c.diskNameFlagValidator)
+	c.diskMountFlag = flag.NewNStringFlag("disk[<<N>>].mount", "configure where an additional data disk is mounted", &c.maxDiskFlags, hideFlags, c.diskMountFlagValidator)
+	c.diskSizeFlag = flag.NewNStringFlag("disk[<<N>>].size", "configure the capacity of an additional data disk", &c.maxDiskFlags, hideFlags, c.diskSizeFlagValidator)
+	c.diskFilesystemFlag = flag.NewNStringFlag("disk[<<N>>].filesystem", "set the filesystem format of an additional data disk", &c.maxDiskFlags, hideFlags, c.diskFilesystemFlagValidator)
+	c.partitionNameFlag = flag.NewNStringFlag("partition[<<N>>].name", "name an extra partition, which is added to the main disk before the root file-system", &c.maxPartFlags, hideFlags, c.partitionNameFlagValidator)
+	c.partitionMountFlag = flag.NewNStringFlag("partition[<<N>>].mount", "configure where an extra partition is mounted", &c.maxPartFlags, hideFlags, c.partitionMountFlagValidator)
+	c.partitionSizeFlag = flag.NewNStringFlag("partition[<<N>>].size", "configure the size of an extra partition", &c.maxPartFlags, hideFlags, c.partitionSizeFlagValidator)
+	c.partitionFilesystemFlag = flag.NewNStringFlag("partition[<<N>>].filesystem", "set the filesystem format of an extra partition", &c.maxPartFlags, hideFlags, c.partitionFilesystemFlagValidator)
+	c.partitionFlagsFlag = flag.NewNStringSliceFlag("partition[<<N>>].flags", "set GPT attributes on an extra partition ('required', 'read-only', 'hidden', or 'no-automount')", &c.maxPartFlags, hideFlags, c.partitionFlagsFlagValidator)
+	c.nodePathFlag = flag.NewNStringFlag("node[<<N>>].path", "create a device node or named pipe at this path in the root file-system", &c.maxNodeFlags, hideFlags, c.nodePathFlagValidator)
+	c.nodeTypeFlag = flag.NewNStringFlag("node[<<N>>].type", "set the type of a node ('char', 'block', or 'fifo')", &c.maxNodeFlags, hideFlags, c.nodeTypeFlagValidator)
+	c.nodeMajorFlag = flag.NewNStringFlag("node[<<N>>].major", "set the major number of a device node", &c.maxNodeFlags, hideFlags, c.nodeMajorFlagValidator)
+	c.nodeMinorFlag = flag.NewNStringFlag("node[<<N>>].minor", "set the minor number of a device node", &c.maxNodeFlags, hideFlags, c.nodeMinorFlagValidator)
+	c.networkTCPDumpFlag = flag.NewNBoolFlag("network[<<N>>].tcpdump", "configure this network to run with tcpdump", &c.maxNetworkFlags, hideFlags, c.networkTCPDumpFlagValidator)
+	c.networkGatewayFlag = flag.NewNStringFlag("network[<<N>>].gateway", "configure app's network gateway", &c.maxNetworkFlags, hideFlags, c.networkGatewayFlagValidator)
+	c.networkHTTPFlag = flag.NewNStringSliceFlag("network[<<N>>].http", "expose http port", &c.maxNetworkFlags, hideFlags, c.networkHTTPFlagValidator)
+	c.networkHTTPSFlag = flag.NewNStringSliceFlag("network[<<N>>].https", "expose https port", &c.maxNetworkFlags, hideFlags, c.networkHTTPSFlagValidator)
+	c.networkIPFlag = flag.NewNStringFlag("network[<<N>>].ip", "configure app's network IP address", &c.maxNetworkFlags, hideFlags, c.networkIPFlagValidator)
+	c.networkMTUFlag = flag.NewNStringFlag("network[<<N>>].mtu", "configure app's network interface MTU", &c.maxNetworkFlags, hideFlags, c.networkMTUFlagValidator)
+	c.networkMaskFlag = flag.NewNStringFlag("network[<<N>>].mask", "configure app's subnet mask", &c.maxNetworkFlags, hideFlags, c.networkMaskFlagValidator)
+	c.networkTCPFlag = flag.NewNStringSliceFlag("network[<<N>>].tcp", "expose tcp port", &c.maxNetworkFlags, hideFlags, c.networkTCPFlagValidator)
+	c.networkUDPFlag = flag.NewNStringSliceFlag("network[<<N>>].udp", "expose udp port", &c.maxNetworkFlags, hideFlags, c.networkUDPFlagValidator)
+	c.systemKernelArgsFlag = flag.NewStringFlag("system.kernel-args", "linux kernel args to append", hideFlags, c.systemKernelArgsFlagValidator)
+	c.systemDNSFlag = flag.NewStringSliceFlag("system.dns", "set the DNS server list for the system", hideFlags, c.systemDNSFlagValidator)
+	c.systemHostnameFlag = flag.NewStringFlag("system.hostname", "set the hostname for the system", hideFlags, c.systemHostnameFlagValidator)
+	c.systemFilesystemFlag = flag.NewStringFlag("system.filesystem", "set the filesystem format", hideFlags, c.systemFilesystemFlagValidator)
+	c.systemOverlayFilesystemFlag = flag.NewStringFlag("system.overlay-filesystem", "set the filesystem format of the overlay partition", hideFlags, c.systemOverlayFilesystemFlagValidator)
+	c.systemMaxFDsFlag = flag.NewUintFlag("system.max-fds", "maximum file descriptors available to app", hideFlags, c.systemMaxFDsFlagValidator)
+	c.systemOutputModeFlag = flag.NewStringFlag("system.output-mode", "specify vm output behaviour mode", hideFlags, c.systemOutputModeFlagValidator)
+	c.systemUserFlag = flag.NewStringFlag("system.user", "name of the non-root user (default: vorteil)", hideFlags, c.systemUserFlagValidator)
+	c.systemTerminateWaitFlag = flag.NewUintFlag("system.terminate-wait", "how many milliseconds to wait for program termination (default: 3000)", hideFlags, c.systemTerminateWaitFlagValidator)
+	c.systemDiskGUIDFlag = flag.NewStringFlag("system.disk-guid", "set the GUID of the disk's partition table (default: random)", hideFlags, c.systemDiskGUIDFlagValidator)
+	c.systemOSPartitionGUIDFlag = flag.NewStringFlag("system.os-partition-guid", "set the unique GUID of the OS partition (default: random)", hideFlags, c.systemOSPartitionGUIDFlagValidator)
+	c.systemRootPartitionGUIDFlag = flag.NewStringFlag("system.root-partition-guid", "set the unique GUID of the root file-system partition", hideFlags, c.systemRootPartitionGUIDFlagValidator)
+	c.systemFilesystemUUIDFlag = flag.NewStringFlag("system.filesystem-uuid", "set the UUID of the root file-system", hideFlags, c.systemFilesystemUUIDFlagValidator)
+	c.systemFilesystemLabelFlag = flag.NewStringFlag("system.fs-label", "set the volume label of the root file-system", hideFlags, c.systemFilesystemLabelFlagValidator)
+	c.systemExpandFilesystemFlag = flag.NewBoolFlag("system.expand-fs", "grow the root file-system to fill the disk at boot if the disk has been made bigger", hideFlags, c.systemExpandFilesystemFlagValidator)
+	c.systemVerityFlag = flag.NewBoolFlag("system.verity", "add a dm-verity hash tree for the root file-system and mount it read-only", hideFlags, c.systemVerityFlagValidator)
+	c.systemTagOutputFlag = flag.NewBoolFlag("system.tag-output", "prefix each line of program output on the serial port with the index of the program that wrote it", hideFlags, c.systemTagOutputFlagValidator)
+	c.systemPreserveOwnershipFlag = flag.NewBoolFlag("system.preserve-ownership", "keep the owners and permissions files have on the host instead of giving everything to the default user", hideFlags, c.systemPreserveOwnershipFlagValidator)
+	c.systemOverlaySizeFlag = flag.NewStringFlag("system.overlay-size", "mount the root file-system read-only with a writable overlay partition of this size", hideFlags, c.systemOverlaySizeFlagValidator)
+	c.systemBootModeFlag = flag.NewStringFlag("system.boot-mode", "set the firmware the disk boots under ('bios', 'uefi', or 'hybrid')", hideFlags, c.systemBootModeFlagValidator)
+	c.systemTimezoneFlag = flag.NewStringFlag("system.timezone", "set the system's local time zone, e.g. 'Europe/Berlin' (needs the time-zone database added with --tzdata)", hideFlags, c.systemTimezoneFlagValidator)
+	c.systemXFSBlockSizeFlag = flag.NewStringFlag("system.xfs.block-size", "set the block size of an XFS root file-system (default: 4 KiB)", hideFlags, c.systemXFSBlockSizeFlagValidator)
+	c.systemXFSInodeSizeFlag = flag.NewStringFlag("system.xfs.inode-size", "set the inode size of an XFS root file-system (default: 512 B)", hideFlags, c.systemXFSInodeSizeFlagValidator)
+	c.systemXFSDirBlockSizeFlag = flag.NewStringFlag("system.xfs.dir-block-size", "set the directory block size of an XFS root file-system (default: the block size)", hideFlags, c.systemXFSDirBlockSizeFlagValidator)
+	c.systemEncryptionPassphraseFlag = flag.NewStringFlag("system.encryption.passphrase", "encrypt the root file-system partition with LUKS2 using this passphrase", hideFlags, c.systemEncryptionPassphraseFlagValidator)
+	c.systemEncryptionKeyFileFlag = flag.NewStringFlag("system.encryption.key-file", "encrypt the root file-system partition with LUKS2 using the contents of this file as the key", hideFlags, c.systemEncryptionKeyFileFlagValidator)
+	c.filesFlag = flag.NewStringSliceFlag("files", "<src>[@<dst>]   add files from the host filesystem to an existing folder in the virtual machine filesystem (dst defaults to '/')", hideFlags, c.filesFlagValidator)
+	c.vmCPUsFlag = flag.NewUintFlag("vm.cpus", "number of cpus to allocate to app", hideFlags, c.vmCPUsFlagValidator)
+	c.vmDiskSizeFlag = flag.NewStringFlag("vm.disk-size", "disk image capacity to allocate to app", hideFlags, c.vmDiskSizeFlagValidator)
+	c.vmSwapSizeFlag = flag.NewStringFlag("vm.swap-size", "size of a swap partition to add to the disk image", hideFlags, c.vmSwapSizeFlagValidator)
+	c.vmInodesFlag = flag.NewUintFlag("vm.inodes", "number of inodes to build on disk image", hideFlags, c.vmInodesFlagValidator)
+	c.vmKernelFlag = flag.NewStringFlag("vm.kernel", "kernel to build app on", hideFlags, c.vmKernelFlagValidator)
+	c.vmRAMFlag = flag.NewStringFlag("vm.ram", "memory to allocate to app", hideFlags, c.vmRAMFlagValidator)
+	c.programBinaryFlag = flag.NewNStringFlag("program[<<N>>].binary", "configure a program binary", &c.maxProgramFlags, hideFlags, c.programBinaryFlagValidator)
+	c.programPrivilegesFlag = flag.NewNStringFlag("program[<<N>>].privilege", "configure program privileges (root, superuser, user)", &c.maxProgramFlags, hideFlags, c.programPrivilegesFlagValidator)
+	c.programEnvFlag = flag.NewNStringSliceFlag("program[<<N>>].env", "configure the environment variables of a program", &c.maxProgramFlags, hideFlags, c.programEnvFlagValidator)
+	c.programCWDFlag = flag.NewNStringFlag("program[<<N>>].cwd", "configure the working directory of a program", &c.maxProgramFlags, hideFlags, c.programCWDFlagValidator)
+	c.programTerminateFlag = flag.NewNStringFlag("program[<<N>>].terminate", "configure the signal to send program on termination (default: SIGTERM)", &c.maxProgramFlags, hideFlags, c.programTerminateFlagValidator)
+	c.programLogFilesFlag = flag.NewNStringSliceFlag("program[<<N>>].logfiles", "gure the logfiles of a program", &c.maxProgramFlags, hideFlags, c.programLogFilesFlagValidator)
+	c.programBootstrapFlag = flag.NewNStringSliceFlag("program[<<N>>].bootstrap", "configure the bootstrap steps of a program, e.g. 'WAIT_TCP db:5432 30s', 'FETCH <url> <path>', or 'TEMPLATE <path>'", &c.maxProgramFlags, hideFlags, c.programBootstrapFlagValidator)
+	c.programStdoutFlag = flag.NewNStringFlag("program[<<N>>].stdout", "configure programs stdout", &c.maxProgramFlags, hideFlags, c.programStdoutFlagValidator)
+	c.programStderrFlag = flag.NewNStringFlag("program[<<N>>].stderr", "configure programs stderr", &c.maxProgramFlags, hideFlags, c.programStderrFlagValidator)
+	c.programStraceFlag = flag.NewNBoolFlag("program[<<N>>].strace", "configure the program to run with strace", &c.maxProgramFlags, hideFlags, c.programStraceFlagValidator)
+	c.programArgsFlag = flag.NewNStringFlag("program[<<N>>].args", "configure programs args", &c.maxProgramFlags, hideFlags, c.programArgsFlagValidator)
+	c.vcfgFlags = flag.FlagsList{
+		&c.vmCPUsFlag, &c.vmDiskSizeFlag, &c.vmInodesFlag, &c.vmKernelFlag, &c.vmRAMFlag,
+		&c.vmSwapSizeFlag,
+		&c.filesFlag, &c.infoAuthorFlag, &c.infoDateFlag, &c.infoDescriptionFlag,
+		&c.infoNameFlag, &c.infoSummaryFlag, &c.infoURLFlag, &c.infoVersionFlag,
+		&c.networkIPFlag, &c.networkMaskFlag, &c.networkGatewayFlag, &c.networkUDPFlag,
+		&c.networkTCPFlag, &c.networkHTTPFlag, &c.networkHTTPSFlag, &c.networkMTUFlag,
+		&c.networkTCPDumpFlag, &c.loggingConfigFlag, &c.loggingTypeFlag, &c.nfsMountFlag,
+		&c.nfsServerFlag, &c.nfsOptionsFlag, &c.nfsVersionFlag, &c.nfsTransportFlag,
+		&c.nfsTimeoutFlag, &c.smbMountFlag, &c.smbServerFlag, &c.smbOptionsFlag,
+		&c.smbUsernameFlag, &c.smbPasswordFlag, &c.smbDomainFlag, &c.smbVersionFlag,
+		&c.syncSourceFlag, &c.syncPathFlag, &c.syncEndpointFlag, &c.syncRegionFlag,
+		&c.syncCredentialsFlag, &c.syncSyncBackFlag,
+		&c.systemKernelArgsFlag, &c.systemDNSFlag,
+		&c.systemHostnameFlag, &c.systemFilesystemFlag, &c.systemMaxFDsFlag,
+		&c.systemOutputModeFlag, &c.systemUserFlag, &c.programBinaryFlag,
+		&c.programPrivilegesFlag, &c.programArgsFlag, &c.programStdoutFlag,
+		&c.programStderrFlag, &c.programLogFilesFlag, &c.programBootstrapFlag,
+		&c.programEnvFlag, &c.programCWDFlag, &c.programStraceFlag, &c.sysctlFlag,
+		&c.programTerminateFlag, &c.systemTerminateWaitFlag, &c.systemDiskGUIDFlag,
+		&c.systemOSPartitionGUIDFlag, &c.systemRootPartitionGUIDFlag,
+		&c.systemFilesystemUUIDFlag, &c.systemFilesystemLabelFlag,
+		&c.systemEncryptionPassphraseFlag, &c.systemEncryptionKeyFileFlag,
+		&c.systemExpandFilesystemFlag, &c.systemVerityFlag, &c.systemBootModeFlag,
+		&c.systemTimezoneFlag, &c.systemOverlaySizeFlag, &c.systemOverlayFilesystemFlag,
+		&c.systemTagOutputFlag, &c.systemPreserveOwnershipFlag,
+		&c.systemXFSBlockSizeFlag, &c.systemXFSInodeSizeFlag, &c.systemXFSDirBlockSizeFlag,
+		&c.loggingDriverFlag, &c.loggingAddressFlag, &c.loggingPathFlag, &c.loggingTagFlag,
+		&c.diskNameFlag, &c.diskMountFlag, &c.diskSizeFlag, &c.diskFilesystemFlag,
+		&c.partitionNameFlag, &c.partitionMountFlag, &c.partitionSizeFlag,
+		&c.partitionFilesystemFlag, &c.partitionFlagsFlag,
+		&c.nodePathFlag, &c.nodeTypeFlag, &c.nodeMajorFlag, &c.nodeMinorFlag,
+	}
+
 }
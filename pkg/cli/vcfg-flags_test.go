@@ -8,362 +8,387 @@ import (
 	"github.com/vorteil/vorteil/pkg/vcfg"
 )
 
-func testResetOverrideVCFG() {
-	overrideVCFG = vcfg.VCFG{}
-}
-
 func TestSetFlagArray(t *testing.T) {
 
-	testResetOverrideVCFG()
+	c := newCommandContext(nil)
+
+	c.setFlagArgArray("--network[3].blah")
+	assert.Equal(t, 4, c.maxNetworkFlags)
+
+	c.setFlagArgArray("--program[3].blah")
+	assert.Equal(t, 4, c.maxProgramFlags)
 
-	setFlagArgArray("--network[3].blah")
-	assert.Equal(t, 4, maxNetworkFlags)
+	c.setFlagArgArray("--logging[3].blah")
+	assert.Equal(t, 4, c.maxLoggingFlags)
 
-	setFlagArgArray("--program[3].blah")
-	assert.Equal(t, 4, maxProgramFlags)
+	c.setFlagArgArray("--nfs[3].blah")
+	assert.Equal(t, 4, c.maxNFSFlags)
 
-	setFlagArgArray("--logging[3].blah")
-	assert.Equal(t, 4, maxLoggingFlags)
+	c.setFlagArgArray("--smb[2].blah")
+	assert.Equal(t, 3, c.maxSMBFlags)
 
-	setFlagArgArray("--nfs[3].blah")
-	assert.Equal(t, 4, maxNFSFlags)
+	c.setFlagArgArray("--sync[0].blah")
+	assert.Equal(t, 1, c.maxSyncFlags)
 
-	setFlagArgArray("--redirect[3].blah")
-	assert.Equal(t, 4, maxRedirectFlags)
+	c.setFlagArgArray("--redirect[3].blah")
+	assert.Equal(t, 4, c.maxRedirectFlags)
+
+	c.setFlagArgArray("--disk[3].blah")
+	assert.Equal(t, 4, c.maxDiskFlags)
+
+	c.setFlagArgArray("--partition[3].blah")
+	assert.Equal(t, 4, c.maxPartFlags)
+
+	c.setFlagArgArray("--node[1].blah")
+	assert.Equal(t, 2, c.maxNodeFlags)
 
 }
 
 func TestVMCPUsFlag(t *testing.T) {
 
-	testResetOverrideVCFG()
+	c := newCommandContext(nil)
 
 	// set --vm.cpus=1
-	f := vmCPUsFlag
+	f := c.vmCPUsFlag
 	f.Value = 1
 
-	err := vmCPUsFlagValidator(f)
+	err := c.vmCPUsFlagValidator(f)
 	assert.NoError(t, err)
-	assert.Equal(t, uint(1), overrideVCFG.VM.CPUs)
+	assert.Equal(t, uint(1), c.overrideVCFG.VM.CPUs)
 
 }
 
 func TestVMDiskSizeFlag(t *testing.T) {
 
-	testResetOverrideVCFG()
+	c := newCommandContext(nil)
 
 	// set --vm.disk-size="10 MiB"
-	f := vmDiskSizeFlag
+	f := c.vmDiskSizeFlag
 	f.Value = "10 MiB"
 	nBytes := 10 * 1024 * 1024
 
-	err := vmDiskSizeFlagValidator(f)
+	err := c.vmDiskSizeFlagValidator(f)
+	assert.NoError(t, err)
+	assert.Equal(t, vcfg.Bytes(nBytes), c.overrideVCFG.VM.DiskSize)
+
+}
+
+func TestVMSwapSizeFlag(t *testing.T) {
+
+	c := newCommandContext(nil)
+
+	// set --vm.swap-size="64 MiB"
+	f := c.vmSwapSizeFlag
+	f.Value = "64 MiB"
+
+	err := c.vmSwapSizeFlagValidator(f)
 	assert.NoError(t, err)
-	assert.Equal(t, vcfg.Bytes(nBytes), overrideVCFG.VM.DiskSize)
+	assert.Equal(t, 64*vcfg.MiB, c.overrideVCFG.VM.SwapSize)
 
 }
 
 func TestVMInodesFlag(t *testing.T) {
 
-	testResetOverrideVCFG()
+	c := newCommandContext(nil)
 
 	// set --vm.inodes=1337
-	f := vmInodesFlag
+	f := c.vmInodesFlag
 	f.Value = 1337
 
-	err := vmInodesFlagValidator(f)
+	err := c.vmInodesFlagValidator(f)
 	assert.NoError(t, err)
-	assert.Equal(t, vcfg.InodesQuota(f.Value), overrideVCFG.VM.Inodes)
+	assert.Equal(t, vcfg.InodesQuota(f.Value), c.overrideVCFG.VM.Inodes)
 
 }
 
 func TestVMKernelFlag(t *testing.T) {
 
-	testResetOverrideVCFG()
+	c := newCommandContext(nil)
 
 	// set --vm.kernel="20.9.2"
-	f := vmKernelFlag
+	f := c.vmKernelFlag
 	f.Value = "20.9.2"
 
-	err := vmKernelFlagValidator(f)
+	err := c.vmKernelFlagValidator(f)
 	assert.NoError(t, err)
-	assert.Equal(t, f.Value, overrideVCFG.VM.Kernel)
+	assert.Equal(t, f.Value, c.overrideVCFG.VM.Kernel)
 
 }
 
 func TestVMRAMFlag(t *testing.T) {
 
-	testResetOverrideVCFG()
+	c := newCommandContext(nil)
 
 	// set --vm.ram="128 MiB"
-	f := vmRAMFlag
+	f := c.vmRAMFlag
 	f.Value = "128 MiB"
 	nBytes := 128 * 1024 * 1024
 
-	err := vmRAMFlagValidator(f)
+	err := c.vmRAMFlagValidator(f)
 	assert.NoError(t, err)
-	assert.Equal(t, vcfg.Bytes(nBytes), overrideVCFG.VM.RAM)
+	assert.Equal(t, vcfg.Bytes(nBytes), c.overrideVCFG.VM.RAM)
 
 }
 
 func TestFilesFlag(t *testing.T) {
 
-	testResetOverrideVCFG()
+	c := newCommandContext(nil)
 
 	// set --files="a@b" --files="a@c" --files="c@d"
-	f := filesFlag
+	f := c.filesFlag
 	f.Value = []string{"a@b", "a@c", "c@d"}
 
-	err := filesFlagValidator(f)
+	err := c.filesFlagValidator(f)
 	assert.NoError(t, err)
 
-	a, _ := filesMap["a"]
-	c, _ := filesMap["c"]
+	a, _ := c.filesMap["a"]
+	b, _ := c.filesMap["c"]
 
 	assert.Equal(t, a, []string{"b", "c"})
-	assert.Equal(t, c, []string{"d"})
+	assert.Equal(t, b, []string{"d"})
 
 }
 
 func TestInfoAuthorFlag(t *testing.T) {
 
-	testResetOverrideVCFG()
+	c := newCommandContext(nil)
 
 	// set --info.author="John Connor"
-	f := infoAuthorFlag
+	f := c.infoAuthorFlag
 	f.Value = "John Connor"
 
-	err := infoAuthorFlagValidator(f)
+	err := c.infoAuthorFlagValidator(f)
 	assert.NoError(t, err)
-	assert.Equal(t, f.Value, overrideVCFG.Info.Author)
+	assert.Equal(t, f.Value, c.overrideVCFG.Info.Author)
 
 }
 
 func TestInfoDateFlag(t *testing.T) {
 
-	testResetOverrideVCFG()
+	c := newCommandContext(nil)
 
 	// set --info.date="29-08-1997"
-	f := infoDateFlag
+	f := c.infoDateFlag
 	f.Value = "29-08-1997"
 
-	err := infoDateFlagValidator(f)
+	err := c.infoDateFlagValidator(f)
 	assert.NoError(t, err)
-	assert.Equal(t, f.Value, overrideVCFG.Info.Date.String())
+	assert.Equal(t, f.Value, c.overrideVCFG.Info.Date.String())
 
 }
 
 func TestInfoDescriptionFlag(t *testing.T) {
 
-	testResetOverrideVCFG()
+	c := newCommandContext(nil)
 
 	// set --info.description="Hasta la vista, baby."
-	f := infoDescriptionFlag
+	f := c.infoDescriptionFlag
 	f.Value = "Hasta la vista, baby."
 
-	err := infoDescriptionFlagValidator(f)
+	err := c.infoDescriptionFlagValidator(f)
 	assert.NoError(t, err)
-	assert.Equal(t, f.Value, overrideVCFG.Info.Description)
+	assert.Equal(t, f.Value, c.overrideVCFG.Info.Description)
 
 }
 
 func TestInfoNameFlag(t *testing.T) {
 
-	testResetOverrideVCFG()
+	c := newCommandContext(nil)
 
 	// set --info.name="Terminator 2"
-	f := infoNameFlag
+	f := c.infoNameFlag
 	f.Value = "Terminator 2"
 
-	err := infoNameFlagValidator(f)
+	err := c.infoNameFlagValidator(f)
 	assert.NoError(t, err)
-	assert.Equal(t, f.Value, overrideVCFG.Info.Name)
+	assert.Equal(t, f.Value, c.overrideVCFG.Info.Name)
 
 }
 
 func TestInfoSummaryFlag(t *testing.T) {
 
-	testResetOverrideVCFG()
+	c := newCommandContext(nil)
 
 	// set --info.summary="Judgment Day"
-	f := infoSummaryFlag
+	f := c.infoSummaryFlag
 	f.Value = "Judgment Day"
 
-	err := infoSummaryFlagValidator(f)
+	err := c.infoSummaryFlagValidator(f)
 	assert.NoError(t, err)
-	assert.Equal(t, f.Value, overrideVCFG.Info.Summary)
+	assert.Equal(t, f.Value, c.overrideVCFG.Info.Summary)
 
 }
 
 func TestInfoURLFlag(t *testing.T) {
 
-	testResetOverrideVCFG()
+	c := newCommandContext(nil)
 
 	// set --info.url="https://en.wikipedia.org/wiki/Terminator_2:_Judgment_Day"
-	f := infoURLFlag
+	f := c.infoURLFlag
 	f.Value = "https://en.wikipedia.org/wiki/Terminator_2:_Judgment_Day"
 
-	err := infoURLFlagValidator(f)
+	err := c.infoURLFlagValidator(f)
 	assert.NoError(t, err)
-	assert.Equal(t, vcfg.URL(f.Value), overrideVCFG.Info.URL)
+	assert.Equal(t, vcfg.URL(f.Value), c.overrideVCFG.Info.URL)
 
 }
 
 func TestInfoVersionFlag(t *testing.T) {
 
-	testResetOverrideVCFG()
+	c := newCommandContext(nil)
 
 	// set --info.version="T101"
-	f := infoVersionFlag
+	f := c.infoVersionFlag
 	f.Value = "T101"
 
-	err := infoVersionFlagValidator(f)
+	err := c.infoVersionFlagValidator(f)
 	assert.NoError(t, err)
-	assert.Equal(t, f.Value, overrideVCFG.Info.Version)
+	assert.Equal(t, f.Value, c.overrideVCFG.Info.Version)
 
 }
 
 func TestNetworksIPFlag(t *testing.T) {
 
-	testResetOverrideVCFG()
+	c := newCommandContext(nil)
 	var ip = "29.08.19.97"
 
 	// set --networks[3].ip="29.08.19.97"
-	f := networkIPFlag
+	f := c.networkIPFlag
 	nNICs := 3
 	f.Total = &nNICs
 	f.Value = []string{"", "", "29.08.19.97"}
 
-	err := networkIPFlagValidator(f)
+	err := c.networkIPFlagValidator(f)
 	assert.NoError(t, err)
-	assert.Equal(t, nNICs, len(overrideVCFG.Networks))
-	assert.Equal(t, ip, overrideVCFG.Networks[2].IP)
-	assert.Equal(t, "dhcp", overrideVCFG.Networks[1].IP)
-	assert.Equal(t, "dhcp", overrideVCFG.Networks[0].IP)
+	assert.Equal(t, nNICs, len(c.overrideVCFG.Networks))
+	assert.Equal(t, ip, c.overrideVCFG.Networks[2].IP)
+	assert.Equal(t, "dhcp", c.overrideVCFG.Networks[1].IP)
+	assert.Equal(t, "dhcp", c.overrideVCFG.Networks[0].IP)
 
 }
 
 func TestNetworkMaskFlag(t *testing.T) {
 
-	testResetOverrideVCFG()
+	c := newCommandContext(nil)
 	mask := "255.255.255.0"
 
 	// set --networks[2].mask="255.255.255.0"
-	f := networkMaskFlag
+	f := c.networkMaskFlag
 	nNICs := 2
 	f.Total = &nNICs
 	f.Value = []string{"", mask}
 
-	err := networkMaskFlagValidator(f)
+	err := c.networkMaskFlagValidator(f)
 	assert.NoError(t, err)
-	assert.Equal(t, nNICs, len(overrideVCFG.Networks))
-	assert.Equal(t, mask, overrideVCFG.Networks[1].Mask)
-	assert.Equal(t, "", overrideVCFG.Networks[0].Mask)
+	assert.Equal(t, nNICs, len(c.overrideVCFG.Networks))
+	assert.Equal(t, mask, c.overrideVCFG.Networks[1].Mask)
+	assert.Equal(t, "", c.overrideVCFG.Networks[0].Mask)
 
 }
 
 func TestNetworkGatewayFlag(t *testing.T) {
 
-	testResetOverrideVCFG()
+	c := newCommandContext(nil)
 	gateway := "192.168.0.1"
 
 	// set --networks[4].gateway="192.168.0.1"
-	f := networkMaskFlag
+	f := c.networkMaskFlag
 	nNICs := 4
 	f.Total = &nNICs
 	f.Value = []string{"", "", "", gateway}
 
-	err := networkGatewayFlagValidator(f)
+	err := c.networkGatewayFlagValidator(f)
 	assert.NoError(t, err)
-	assert.Equal(t, nNICs, len(overrideVCFG.Networks))
-	assert.Equal(t, gateway, overrideVCFG.Networks[3].Gateway)
-	assert.Equal(t, "", overrideVCFG.Networks[2].Gateway)
-	assert.Equal(t, "", overrideVCFG.Networks[1].Gateway)
-	assert.Equal(t, "", overrideVCFG.Networks[0].Gateway)
+	assert.Equal(t, nNICs, len(c.overrideVCFG.Networks))
+	assert.Equal(t, gateway, c.overrideVCFG.Networks[3].Gateway)
+	assert.Equal(t, "", c.overrideVCFG.Networks[2].Gateway)
+	assert.Equal(t, "", c.overrideVCFG.Networks[1].Gateway)
+	assert.Equal(t, "", c.overrideVCFG.Networks[0].Gateway)
 
 }
 
 func TestNetworkUDPFlag(t *testing.T) {
 
-	testResetOverrideVCFG()
+	c := newCommandContext(nil)
 
 	// set --networks[1].udp="80" --networks[2].udp="81" --networks[3].udp="82"
-	f := networkUDPFlag
+	f := c.networkUDPFlag
 	nNICs := 3
 	f.Total = &nNICs
 	f.Value = [][]string{[]string{"80"}, []string{"81"}, []string{"82"}}
 
-	err := networkUDPFlagValidator(f)
+	err := c.networkUDPFlagValidator(f)
 	assert.NoError(t, err)
-	assert.Equal(t, nNICs, len(overrideVCFG.Networks))
-	assert.Equal(t, f.Value[2], overrideVCFG.Networks[2].UDP)
-	assert.Equal(t, f.Value[1], overrideVCFG.Networks[1].UDP)
-	assert.Equal(t, f.Value[0], overrideVCFG.Networks[0].UDP)
+	assert.Equal(t, nNICs, len(c.overrideVCFG.Networks))
+	assert.Equal(t, f.Value[2], c.overrideVCFG.Networks[2].UDP)
+	assert.Equal(t, f.Value[1], c.overrideVCFG.Networks[1].UDP)
+	assert.Equal(t, f.Value[0], c.overrideVCFG.Networks[0].UDP)
 
 }
 
 func TestNetworkTCPFlag(t *testing.T) {
 
-	testResetOverrideVCFG()
+	c := newCommandContext(nil)
 
 	// set --networks[1].tcp="80" --networks[2].tcp="81" --networks[3].tcp="82"
-	f := networkTCPFlag
+	f := c.networkTCPFlag
 	nNICs := 3
 	f.Total = &nNICs
 	f.Value = [][]string{[]string{"80"}, []string{"81"}, []string{"82"}}
 
-	err := networkTCPFlagValidator(f)
+	err := c.networkTCPFlagValidator(f)
 	assert.NoError(t, err)
-	assert.Equal(t, nNICs, len(overrideVCFG.Networks))
-	assert.Equal(t, f.Value[2], overrideVCFG.Networks[2].TCP)
-	assert.Equal(t, f.Value[1], overrideVCFG.Networks[1].TCP)
-	assert.Equal(t, f.Value[0], overrideVCFG.Networks[0].TCP)
+	assert.Equal(t, nNICs, len(c.overrideVCFG.Networks))
+	assert.Equal(t, f.Value[2], c.overrideVCFG.Networks[2].TCP)
+	assert.Equal(t, f.Value[1], c.overrideVCFG.Networks[1].TCP)
+	assert.Equal(t, f.Value[0], c.overrideVCFG.Networks[0].TCP)
 
 }
 
 func TestNetworkHTTPFlag(t *testing.T) {
 
-	testResetOverrideVCFG()
+	c := newCommandContext(nil)
 
 	// set --networks[1].http="80" --networks[2].http="81" --networks[3].http="82"
-	f := networkHTTPFlag
+	f := c.networkHTTPFlag
 	nNICs := 3
 	f.Total = &nNICs
 	f.Value = [][]string{[]string{"80"}, []string{"81"}, []string{"82"}}
 
-	err := networkHTTPFlagValidator(f)
+	err := c.networkHTTPFlagValidator(f)
 	assert.NoError(t, err)
-	assert.Equal(t, nNICs, len(overrideVCFG.Networks))
-	assert.Equal(t, f.Value[2], overrideVCFG.Networks[2].HTTP)
-	assert.Equal(t, f.Value[1], overrideVCFG.Networks[1].HTTP)
-	assert.Equal(t, f.Value[0], overrideVCFG.Networks[0].HTTP)
+	assert.Equal(t, nNICs, len(c.overrideVCFG.Networks))
+	assert.Equal(t, f.Value[2], c.overrideVCFG.Networks[2].HTTP)
+	assert.Equal(t, f.Value[1], c.overrideVCFG.Networks[1].HTTP)
+	assert.Equal(t, f.Value[0], c.overrideVCFG.Networks[0].HTTP)
 
 }
 
 func TestNetworkHTTPSFlag(t *testing.T) {
 
-	testResetOverrideVCFG()
+	c := newCommandContext(nil)
 
 	// set --networks[1].https="80" --networks[2].https="81" --networks[3].https="82"
-	f := networkHTTPSFlag
+	f := c.networkHTTPSFlag
 	nNICs := 3
 	f.Total = &nNICs
 	f.Value = [][]string{[]string{"80"}, []string{"81"}, []string{"82"}}
 
-	err := networkHTTPSFlagValidator(f)
+	err := c.networkHTTPSFlagValidator(f)
 	assert.NoError(t, err)
-	assert.Equal(t, nNICs, len(overrideVCFG.Networks))
-	assert.Equal(t, f.Value[2], overrideVCFG.Networks[2].HTTPS)
-	assert.Equal(t, f.Value[1], overrideVCFG.Networks[1].HTTPS)
-	assert.Equal(t, f.Value[0], overrideVCFG.Networks[0].HTTPS)
+	assert.Equal(t, nNICs, len(c.overrideVCFG.Networks))
+	assert.Equal(t, f.Value[2], c.overrideVCFG.Networks[2].HTTPS)
+	assert.Equal(t, f.Value[1], c.overrideVCFG.Networks[1].HTTPS)
+	assert.Equal(t, f.Value[0], c.overrideVCFG.Networks[0].HTTPS)
 
 }
 
 func TestNetworkMTU(t *testing.T) {
 
-	testResetOverrideVCFG()
+	c := newCommandContext(nil)
 
 	// set --networks[2].mtu=64
-	f := networkMTUFlag
+	f := c.networkMTUFlag
 	nNICs := 2
 	f.Total = &nNICs
 	f.Value = []string{"", "64"}
@@ -371,448 +396,551 @@ func TestNetworkMTU(t *testing.T) {
 	mtu, err := strconv.Atoi(f.Value[1])
 	assert.NoError(t, err)
 
-	err = networkMTUFlagValidator(f)
+	err = c.networkMTUFlagValidator(f)
 	assert.NoError(t, err)
-	assert.Equal(t, nNICs, len(overrideVCFG.Networks))
-	assert.Equal(t, uint(mtu), overrideVCFG.Networks[1].MTU)
-	assert.Equal(t, uint(0), overrideVCFG.Networks[0].MTU)
+	assert.Equal(t, nNICs, len(c.overrideVCFG.Networks))
+	assert.Equal(t, uint(mtu), c.overrideVCFG.Networks[1].MTU)
+	assert.Equal(t, uint(0), c.overrideVCFG.Networks[0].MTU)
 
 }
 
 func TestNetworkTCPDumpFlag(t *testing.T) {
 
-	testResetOverrideVCFG()
+	c := newCommandContext(nil)
 
 	// set --networks[1].tcpdump=true
-	f := networkTCPDumpFlag
+	f := c.networkTCPDumpFlag
 	f.Value = []bool{true}
 	nNICs := 1
 	f.Total = &nNICs
 
-	err := networkTCPDumpFlagValidator(f)
+	err := c.networkTCPDumpFlagValidator(f)
 	assert.NoError(t, err)
-	assert.Equal(t, nNICs, len(overrideVCFG.Networks))
-	assert.Equal(t, f.Value[0], overrideVCFG.Networks[0].TCPDUMP)
+	assert.Equal(t, nNICs, len(c.overrideVCFG.Networks))
+	assert.Equal(t, f.Value[0], c.overrideVCFG.Networks[0].TCPDUMP)
 
 }
 
 func TestLoggingConfigFlag(t *testing.T) {
 
-	testResetOverrideVCFG()
+	c := newCommandContext(nil)
 
 	// set --logging[1].config="test"
-	f := loggingConfigFlag
+	f := c.loggingConfigFlag
 	f.Value = [][]string{[]string{"test"}}
 	nLog := 1
 	f.Total = &nLog
 
-	err := loggingConfigFlagValidator(f)
+	err := c.loggingConfigFlagValidator(f)
 	assert.NoError(t, err)
-	assert.Equal(t, nLog, len(overrideVCFG.Logging))
-	assert.Equal(t, f.Value[0], overrideVCFG.Logging[0].Config)
+	assert.Equal(t, nLog, len(c.overrideVCFG.Logging))
+	assert.Equal(t, f.Value[0], c.overrideVCFG.Logging[0].Config)
 
 }
 
 func TestLoggingTypeFlag(t *testing.T) {
 
-	testResetOverrideVCFG()
+	c := newCommandContext(nil)
 
 	// set --logging[1].type="test"
-	f := loggingTypeFlag
+	f := c.loggingTypeFlag
 	f.Value = []string{"", "", "test"}
 	nLog := 3
 	f.Total = &nLog
 
-	err := loggingTypeFlagValidator(f)
+	err := c.loggingTypeFlagValidator(f)
 	assert.NoError(t, err)
-	assert.Equal(t, nLog, len(overrideVCFG.Logging))
-	assert.Equal(t, f.Value[2], overrideVCFG.Logging[2].Type)
+	assert.Equal(t, nLog, len(c.overrideVCFG.Logging))
+	assert.Equal(t, f.Value[2], c.overrideVCFG.Logging[2].Type)
 
 }
 
 func TestNFSMountFlag(t *testing.T) {
 
-	testResetOverrideVCFG()
+	c := newCommandContext(nil)
 
 	// set --nfs[2].mount="test"
-	f := nfsMountFlag
+	f := c.nfsMountFlag
 	f.Value = []string{"test1", "test2"}
 	nNFS := 2
 	f.Total = &nNFS
 
-	err := nfsMountFlagValidator(f)
+	err := c.nfsMountFlagValidator(f)
 	assert.NoError(t, err)
-	assert.Equal(t, nNFS, len(overrideVCFG.NFS))
-	assert.Equal(t, f.Value[1], overrideVCFG.NFS[1].MountPoint)
-	assert.Equal(t, f.Value[0], overrideVCFG.NFS[0].MountPoint)
+	assert.Equal(t, nNFS, len(c.overrideVCFG.NFS))
+	assert.Equal(t, f.Value[1], c.overrideVCFG.NFS[1].MountPoint)
+	assert.Equal(t, f.Value[0], c.overrideVCFG.NFS[0].MountPoint)
 
 }
 
 func TestNFSServerFlag(t *testing.T) {
 
-	testResetOverrideVCFG()
+	c := newCommandContext(nil)
 
 	// set --nfs[2].server="test"
-	f := nfsServerFlag
+	f := c.nfsServerFlag
 	f.Value = []string{"test1", "test2"}
 	nNFS := 2
 	f.Total = &nNFS
 
-	err := nfsServerFlagValidator(f)
+	err := c.nfsServerFlagValidator(f)
 	assert.NoError(t, err)
-	assert.Equal(t, nNFS, len(overrideVCFG.NFS))
-	assert.Equal(t, f.Value[1], overrideVCFG.NFS[1].Server)
-	assert.Equal(t, f.Value[0], overrideVCFG.NFS[0].Server)
+	assert.Equal(t, nNFS, len(c.overrideVCFG.NFS))
+	assert.Equal(t, f.Value[1], c.overrideVCFG.NFS[1].Server)
+	assert.Equal(t, f.Value[0], c.overrideVCFG.NFS[0].Server)
 
 }
 
 func TestNFSOptionsFlag(t *testing.T) {
 
-	testResetOverrideVCFG()
+	c := newCommandContext(nil)
 
 	// set --nfs[2].options="test"
-	f := nfsOptionsFlag
+	f := c.nfsOptionsFlag
 	f.Value = []string{"test1", "test2"}
 	nNFS := 2
 	f.Total = &nNFS
 
-	err := nfsOptionsFlagValidator(f)
+	err := c.nfsOptionsFlagValidator(f)
 	assert.NoError(t, err)
-	assert.Equal(t, nNFS, len(overrideVCFG.NFS))
-	assert.Equal(t, f.Value[1], overrideVCFG.NFS[1].Arguments)
-	assert.Equal(t, f.Value[0], overrideVCFG.NFS[0].Arguments)
+	assert.Equal(t, nNFS, len(c.overrideVCFG.NFS))
+	assert.Equal(t, f.Value[1], c.overrideVCFG.NFS[1].Arguments)
+	assert.Equal(t, f.Value[0], c.overrideVCFG.NFS[0].Arguments)
 
 }
 
 func TestSystemKernelArgsFlag(t *testing.T) {
 
-	testResetOverrideVCFG()
+	c := newCommandContext(nil)
 
 	// set --system.kernel-args="loglevel=9"
-	f := systemKernelArgsFlag
+	f := c.systemKernelArgsFlag
 	f.Value = "loglevel=9"
 
-	err := systemKernelArgsFlagValidator(f)
+	err := c.systemKernelArgsFlagValidator(f)
 	assert.NoError(t, err)
-	assert.Equal(t, f.Value, overrideVCFG.System.KernelArgs)
+	assert.Equal(t, f.Value, c.overrideVCFG.System.KernelArgs)
 
 }
 
 func TestSystemDNSFlag(t *testing.T) {
 
-	testResetOverrideVCFG()
+	c := newCommandContext(nil)
 
 	// set --system.dns="1.1.1.1" --system.dns="8.8.8.8" --system.dns="8.8.4.4"
-	f := systemDNSFlag
+	f := c.systemDNSFlag
 	f.Value = []string{"1.1.1.1", "8.8.8.8", "8.8.4.4"}
 
-	err := systemDNSFlagValidator(f)
+	err := c.systemDNSFlagValidator(f)
 	assert.NoError(t, err)
-	assert.Equal(t, len(f.Value), len(overrideVCFG.System.DNS))
-	assert.Equal(t, f.Value[2], overrideVCFG.System.DNS[2])
-	assert.Equal(t, f.Value[1], overrideVCFG.System.DNS[1])
-	assert.Equal(t, f.Value[0], overrideVCFG.System.DNS[0])
+	assert.Equal(t, len(f.Value), len(c.overrideVCFG.System.DNS))
+	assert.Equal(t, f.Value[2], c.overrideVCFG.System.DNS[2])
+	assert.Equal(t, f.Value[1], c.overrideVCFG.System.DNS[1])
+	assert.Equal(t, f.Value[0], c.overrideVCFG.System.DNS[0])
 
 }
 
 func TestSystemHostnameFlag(t *testing.T) {
 
-	testResetOverrideVCFG()
+	c := newCommandContext(nil)
 
 	// set --system.hostname="skynet"
-	f := systemHostnameFlag
+	f := c.systemHostnameFlag
 	f.Value = "skynet"
 
-	err := systemHostnameFlagValidator(f)
+	err := c.systemHostnameFlagValidator(f)
 	assert.NoError(t, err)
-	assert.Equal(t, f.Value, overrideVCFG.System.Hostname)
+	assert.Equal(t, f.Value, c.overrideVCFG.System.Hostname)
+
+}
+
+func TestSystemOverlaySizeFlag(t *testing.T) {
+
+	c := newCommandContext(nil)
+
+	// set --system.overlay-size="+32 MiB"
+	f := c.systemOverlaySizeFlag
+	f.Value = "+32 MiB"
+
+	err := c.systemOverlaySizeFlagValidator(f)
+	assert.NoError(t, err)
+	assert.True(t, c.overrideVCFG.System.OverlaySize.IsDelta())
+
+}
+
+func TestSystemOverlayFilesystemFlag(t *testing.T) {
+
+	c := newCommandContext(nil)
+
+	// set --system.overlay-filesystem="xfs"
+	f := c.systemOverlayFilesystemFlag
+	f.Value = "xfs"
+
+	err := c.systemOverlayFilesystemFlagValidator(f)
+	assert.NoError(t, err)
+	assert.Equal(t, vcfg.XFS, c.overrideVCFG.System.OverlayFilesystem)
+
+}
+
+func TestSystemTimezoneFlag(t *testing.T) {
+
+	c := newCommandContext(nil)
+
+	// set --system.timezone="Europe/Berlin"
+	f := c.systemTimezoneFlag
+	f.Value = "Europe/Berlin"
+
+	err := c.systemTimezoneFlagValidator(f)
+	assert.NoError(t, err)
+	assert.Equal(t, f.Value, c.overrideVCFG.System.Timezone)
 
 }
 
 func TestSystemFSFlag(t *testing.T) {
 
-	testResetOverrideVCFG()
+	c := newCommandContext(nil)
 
 	// set --system.filesystem="ext2"
-	f := systemFilesystemFlag
+	f := c.systemFilesystemFlag
 	f.Value = "ext2"
 
-	err := systemFilesystemFlagValidator(f)
+	err := c.systemFilesystemFlagValidator(f)
 	assert.NoError(t, err)
-	assert.Equal(t, vcfg.Filesystem(f.Value), overrideVCFG.System.Filesystem)
+	assert.Equal(t, vcfg.Filesystem(f.Value), c.overrideVCFG.System.Filesystem)
 
 }
 
 func TestSystemMaxFDsFlag(t *testing.T) {
 
-	testResetOverrideVCFG()
+	c := newCommandContext(nil)
 
 	// set --system.maxfds="4096"
-	f := systemMaxFDsFlag
+	f := c.systemMaxFDsFlag
 	f.Value = 4096
 
-	err := systemMaxFDsFlagValidator(f)
+	err := c.systemMaxFDsFlagValidator(f)
 	assert.NoError(t, err)
-	assert.Equal(t, f.Value, overrideVCFG.System.MaxFDs)
+	assert.Equal(t, f.Value, c.overrideVCFG.System.MaxFDs)
 
 }
 
 func TestSystemTerminateWaitFlag(t *testing.T) {
 
-	testResetOverrideVCFG()
+	c := newCommandContext(nil)
 
 	// set --system.terminate-wait="1000"
-	f := systemTerminateWaitFlag
+	f := c.systemTerminateWaitFlag
 	f.Value = 1000
 
-	err := systemTerminateWaitFlagValidator(f)
+	err := c.systemTerminateWaitFlagValidator(f)
 	assert.NoError(t, err)
-	assert.Equal(t, f.Value, overrideVCFG.System.TerminateWait)
+	assert.Equal(t, f.Value, c.overrideVCFG.System.TerminateWait)
 
 }
 
 func TestSystemOutputModeFlag(t *testing.T) {
 
-	testResetOverrideVCFG()
+	c := newCommandContext(nil)
 
 	// set --system.output-mode="screen"
-	f := systemOutputModeFlag
+	f := c.systemOutputModeFlag
 	f.Value = "screen"
 
-	err := systemOutputModeFlagValidator(f)
+	err := c.systemOutputModeFlagValidator(f)
 	assert.NoError(t, err)
-	assert.Equal(t, vcfg.StdoutModeScreenOnly, overrideVCFG.System.StdoutMode)
+	assert.Equal(t, vcfg.StdoutModeScreenOnly, c.overrideVCFG.System.StdoutMode)
 
 	// set --system.output-mode="serial"
 	f.Value = "serial"
 
-	err = systemOutputModeFlagValidator(f)
+	err = c.systemOutputModeFlagValidator(f)
 	assert.NoError(t, err)
-	assert.Equal(t, vcfg.StdoutModeSerialOnly, overrideVCFG.System.StdoutMode)
+	assert.Equal(t, vcfg.StdoutModeSerialOnly, c.overrideVCFG.System.StdoutMode)
 
 	// set --system.output-mode="disabled"
 	f.Value = "disabled"
 
-	err = systemOutputModeFlagValidator(f)
+	err = c.systemOutputModeFlagValidator(f)
 	assert.NoError(t, err)
-	assert.Equal(t, vcfg.StdoutModeDisabled, overrideVCFG.System.StdoutMode)
+	assert.Equal(t, vcfg.StdoutModeDisabled, c.overrideVCFG.System.StdoutMode)
 
 }
 
 func TestSystemUserFlag(t *testing.T) {
 
-	testResetOverrideVCFG()
+	c := newCommandContext(nil)
 
 	// set --system.user="jconnor"
-	f := systemUserFlag
+	f := c.systemUserFlag
 	f.Value = "jconnor"
 
-	err := systemUserFlagValidator(f)
+	err := c.systemUserFlagValidator(f)
 	assert.NoError(t, err)
-	assert.Equal(t, f.Value, overrideVCFG.System.User)
+	assert.Equal(t, f.Value, c.overrideVCFG.System.User)
 
 }
 
 func TestProgramBinaryFlag(t *testing.T) {
 
-	testResetOverrideVCFG()
+	c := newCommandContext(nil)
 
 	// set --program[3].binary="test"
-	f := programBinaryFlag
+	f := c.programBinaryFlag
 	f.Value = []string{"", "", "test"}
 	nProgs := 3
 	f.Total = &nProgs
 
-	err := programBinaryFlagValidator(f)
+	err := c.programBinaryFlagValidator(f)
 	assert.NoError(t, err)
-	assert.Equal(t, nProgs, len(overrideVCFG.Programs))
-	assert.Equal(t, f.Value[2], overrideVCFG.Programs[2].Binary)
+	assert.Equal(t, nProgs, len(c.overrideVCFG.Programs))
+	assert.Equal(t, f.Value[2], c.overrideVCFG.Programs[2].Binary)
 
 }
 
 func TestProgramArgsFlag(t *testing.T) {
 
-	testResetOverrideVCFG()
+	c := newCommandContext(nil)
 
 	// set --program[1].args="test1" --program[2].args="test2" --program[3].args="test3"
-	f := programArgsFlag
+	f := c.programArgsFlag
 	f.Value = []string{"test1", "test2", "test3"}
 	nProgs := 3
 	f.Total = &nProgs
 
-	err := programArgsFlagValidator(f)
+	err := c.programArgsFlagValidator(f)
 	assert.NoError(t, err)
-	assert.Equal(t, nProgs, len(overrideVCFG.Programs))
-	assert.Equal(t, f.Value[2], overrideVCFG.Programs[2].Args)
-	assert.Equal(t, f.Value[1], overrideVCFG.Programs[1].Args)
-	assert.Equal(t, f.Value[0], overrideVCFG.Programs[0].Args)
+	assert.Equal(t, nProgs, len(c.overrideVCFG.Programs))
+	assert.Equal(t, f.Value[2], c.overrideVCFG.Programs[2].Args)
+	assert.Equal(t, f.Value[1], c.overrideVCFG.Programs[1].Args)
+	assert.Equal(t, f.Value[0], c.overrideVCFG.Programs[0].Args)
 
 }
 
 func TestProgramEnvFlag(t *testing.T) {
 
-	testResetOverrideVCFG()
+	c := newCommandContext(nil)
 
 	// set --program[2].env="A=B"
-	f := programEnvFlag
+	f := c.programEnvFlag
 	f.Value = [][]string{[]string{}, []string{"A=B"}}
 	nProgs := 2
 	f.Total = &nProgs
 
-	err := programEnvFlagValidator(f)
+	err := c.programEnvFlagValidator(f)
 	assert.NoError(t, err)
-	assert.Equal(t, nProgs, len(overrideVCFG.Programs))
-	assert.Equal(t, "A=B", overrideVCFG.Programs[1].Env[0])
+	assert.Equal(t, nProgs, len(c.overrideVCFG.Programs))
+	assert.Equal(t, "A=B", c.overrideVCFG.Programs[1].Env[0])
 
 }
 
 func TestProgramPrivilegesFlag(t *testing.T) {
 
-	testResetOverrideVCFG()
+	c := newCommandContext(nil)
 
 	// set --program[2].privileges="superuser" --program[1].privileges="root"
-	f := programPrivilegesFlag
+	f := c.programPrivilegesFlag
 	f.Value = []string{"root", "superuser"}
 	nProgs := 2
 	f.Total = &nProgs
 
-	err := programPrivilegesFlagValidator(f)
+	err := c.programPrivilegesFlagValidator(f)
 	assert.NoError(t, err)
-	assert.Equal(t, nProgs, len(overrideVCFG.Programs))
-	assert.Equal(t, vcfg.Privilege(f.Value[0]), overrideVCFG.Programs[0].Privilege)
-	assert.Equal(t, vcfg.Privilege(f.Value[1]), overrideVCFG.Programs[1].Privilege)
+	assert.Equal(t, nProgs, len(c.overrideVCFG.Programs))
+	assert.Equal(t, vcfg.Privilege(f.Value[0]), c.overrideVCFG.Programs[0].Privilege)
+	assert.Equal(t, vcfg.Privilege(f.Value[1]), c.overrideVCFG.Programs[1].Privilege)
 
 }
 
 func TestProgramStdoutFlag(t *testing.T) {
 
-	testResetOverrideVCFG()
+	c := newCommandContext(nil)
 
 	// set --program[2].stdout="test"
-	f := programStdoutFlag
+	f := c.programStdoutFlag
 	f.Value = []string{"", "test"}
 	nProgs := 2
 	f.Total = &nProgs
 
-	err := programStdoutFlagValidator(f)
+	err := c.programStdoutFlagValidator(f)
 	assert.NoError(t, err)
-	assert.Equal(t, nProgs, len(overrideVCFG.Programs))
-	assert.Equal(t, f.Value[1], overrideVCFG.Programs[1].Stdout)
+	assert.Equal(t, nProgs, len(c.overrideVCFG.Programs))
+	assert.Equal(t, f.Value[1], c.overrideVCFG.Programs[1].Stdout)
 
 }
 
 func TestProgramStderrFlag(t *testing.T) {
 
-	testResetOverrideVCFG()
+	c := newCommandContext(nil)
 
 	// set --program[2].stderr="test"
-	f := programStderrFlag
+	f := c.programStderrFlag
 	f.Value = []string{"", "test"}
 	nProgs := 2
 	f.Total = &nProgs
 
-	err := programStderrFlagValidator(f)
+	err := c.programStderrFlagValidator(f)
 	assert.NoError(t, err)
-	assert.Equal(t, nProgs, len(overrideVCFG.Programs))
-	assert.Equal(t, f.Value[1], overrideVCFG.Programs[1].Stderr)
+	assert.Equal(t, nProgs, len(c.overrideVCFG.Programs))
+	assert.Equal(t, f.Value[1], c.overrideVCFG.Programs[1].Stderr)
 
 }
 
 func TestProgramsCWDFlag(t *testing.T) {
 
-	testResetOverrideVCFG()
+	c := newCommandContext(nil)
 
 	// set --program[2].cwd="/test"
-	f := programCWDFlag
+	f := c.programCWDFlag
 	f.Value = []string{"", "/test"}
 	nProgs := 2
 	f.Total = &nProgs
 
-	err := programCWDFlagValidator(f)
+	err := c.programCWDFlagValidator(f)
 	assert.NoError(t, err)
-	assert.Equal(t, nProgs, len(overrideVCFG.Programs))
-	assert.Equal(t, f.Value[1], overrideVCFG.Programs[1].Cwd)
+	assert.Equal(t, nProgs, len(c.overrideVCFG.Programs))
+	assert.Equal(t, f.Value[1], c.overrideVCFG.Programs[1].Cwd)
 
 }
 
 func TestProgramsTerminateFlag(t *testing.T) {
 
-	testResetOverrideVCFG()
+	c := newCommandContext(nil)
 
 	// set --program[2].terminate="SIGTERM"
-	f := programTerminateFlag
+	f := c.programTerminateFlag
 	f.Value = []string{"", "SIGTERM"}
 	nProgs := 2
 	f.Total = &nProgs
 
-	err := programTerminateFlagValidator(f)
+	err := c.programTerminateFlagValidator(f)
 	assert.NoError(t, err)
-	assert.Equal(t, nProgs, len(overrideVCFG.Programs))
-	assert.Equal(t, f.Value[1], string(overrideVCFG.Programs[1].Terminate))
+	assert.Equal(t, nProgs, len(c.overrideVCFG.Programs))
+	assert.Equal(t, f.Value[1], string(c.overrideVCFG.Programs[1].Terminate))
 
 }
 
 func TestProgramsBootstrapFlag(t *testing.T) {
 
-	testResetOverrideVCFG()
+	c := newCommandContext(nil)
 
 	// set --program[2].bootstrap="SLEEP 3000" --program[2].bootstrap="WAIT_FILE test"
-	f := programBootstrapFlag
+	f := c.programBootstrapFlag
 	f.Value = [][]string{[]string{}, []string{"SLEEP 3000", "WAIT_FILE test"}}
 	nProgs := 2
 	f.Total = &nProgs
 
-	err := programBootstrapFlagValidator(f)
+	err := c.programBootstrapFlagValidator(f)
 	assert.NoError(t, err)
-	assert.Equal(t, nProgs, len(overrideVCFG.Programs))
-	assert.Equal(t, f.Value[1], overrideVCFG.Programs[1].Bootstrap)
+	assert.Equal(t, nProgs, len(c.overrideVCFG.Programs))
+	assert.Equal(t, f.Value[1], c.overrideVCFG.Programs[1].Bootstrap)
+
+}
+
+func TestProgramsBootstrapFlagValidation(t *testing.T) {
+
+	c := newCommandContext(nil)
+
+	// set --program[0].bootstrap="WAIT_TCP db:5432 30s" --program[0].bootstrap="TEMPLATE /etc/app.conf"
+	f := c.programBootstrapFlag
+	f.Value = [][]string{[]string{"WAIT_TCP db:5432 30s", "TEMPLATE /etc/app.conf"}}
+	nProgs := 1
+	f.Total = &nProgs
+
+	err := c.programBootstrapFlagValidator(f)
+	assert.NoError(t, err)
+	assert.Equal(t, f.Value[0], c.overrideVCFG.Programs[0].Bootstrap)
+
+	// set --program[0].bootstrap="FETCH ftp://example.com/x /x"
+	c = newCommandContext(nil)
+	f.Value = [][]string{[]string{"FETCH ftp://example.com/x /x"}}
+
+	err = c.programBootstrapFlagValidator(f)
+	assert.Error(t, err)
+	assert.Equal(t, 0, len(c.overrideVCFG.Programs))
 
 }
 
 func TestProgramsLogfilesFlag(t *testing.T) {
 
-	testResetOverrideVCFG()
+	c := newCommandContext(nil)
 
 	// set --program[2].logfiles="test"
-	f := programLogFilesFlag
+	f := c.programLogFilesFlag
 	f.Value = [][]string{[]string{}, []string{"test"}}
 	nProgs := 2
 	f.Total = &nProgs
 
-	err := programLogFilesFlagValidator(f)
+	err := c.programLogFilesFlagValidator(f)
 	assert.NoError(t, err)
-	assert.Equal(t, nProgs, len(overrideVCFG.Programs))
-	assert.Equal(t, f.Value[1], overrideVCFG.Programs[1].LogFiles)
+	assert.Equal(t, nProgs, len(c.overrideVCFG.Programs))
+	assert.Equal(t, f.Value[1], c.overrideVCFG.Programs[1].LogFiles)
 
 }
 
 func TestProgramsStraceFlag(t *testing.T) {
 
-	testResetOverrideVCFG()
+	c := newCommandContext(nil)
 
 	// set --program[2].strace=true
-	f := programStraceFlag
+	f := c.programStraceFlag
 	f.Value = []bool{false, true}
 	nProgs := 2
 	f.Total = &nProgs
 
-	err := programStraceFlagValidator(f)
+	err := c.programStraceFlagValidator(f)
 	assert.NoError(t, err)
-	assert.Equal(t, nProgs, len(overrideVCFG.Programs))
-	assert.Equal(t, f.Value[1], overrideVCFG.Programs[1].Strace)
+	assert.Equal(t, nProgs, len(c.overrideVCFG.Programs))
+	assert.Equal(t, f.Value[1], c.overrideVCFG.Programs[1].Strace)
 
 }
 
 func TestSysctlFlag(t *testing.T) {
 
-	testResetOverrideVCFG()
+	c := newCommandContext(nil)
 
 	// set --sysctl A=B
-	f := sysctlFlag
+	f := c.sysctlFlag
 	f.Value = []string{"A=B"}
 
-	err := sysctlFlagValidator(f)
+	err := c.sysctlFlagValidator(f)
+	assert.NoError(t, err)
+	assert.Equal(t, "B", c.overrideVCFG.Sysctl["A"])
+
+}
+
+func TestDiskFlags(t *testing.T) {
+
+	c := newCommandContext(nil)
+
+	// set --disk[1].name="data" --disk[1].size="64 MiB" --disk[1].filesystem="xfs"
+	nDisks := 2
+
+	name := c.diskNameFlag
+	name.Value = []string{"", "data"}
+	name.Total = &nDisks
+
+	err := c.diskNameFlagValidator(name)
 	assert.NoError(t, err)
-	assert.Equal(t, "B", overrideVCFG.Sysctl["A"])
+
+	size := c.diskSizeFlag
+	size.Value = []string{"", "64 MiB"}
+	size.Total = &nDisks
+
+	err = c.diskSizeFlagValidator(size)
+	assert.NoError(t, err)
+
+	fs := c.diskFilesystemFlag
+	fs.Value = []string{"", "xfs"}
+	fs.Total = &nDisks
+
+	err = c.diskFilesystemFlagValidator(fs)
+	assert.NoError(t, err)
+
+	assert.Equal(t, nDisks, len(c.overrideVCFG.Disks))
+	assert.Equal(t, vcfg.Disk{Name: "data", Size: 64 * vcfg.MiB, Filesystem: vcfg.XFS}, c.overrideVCFG.Disks[1])
+
+	size.Value = []string{"", "lots"}
+	err = c.diskSizeFlagValidator(size)
+	assert.Error(t, err)
 
 }
@@ -15,7 +15,6 @@ import (
 	"path/filepath"
 	"runtime"
 
-	"github.com/beeker1121/goque"
 	"github.com/thanhpk/randstr"
 	"github.com/vorteil/vorteil/pkg/ext"
 	"github.com/vorteil/vorteil/pkg/vcfg"
@@ -30,53 +29,202 @@ import (
 	"github.com/vorteil/vorteil/pkg/vpkg"
 )
 
-var ips *goque.Queue
+// diskSource is what the disk for a run is built from: either a package or a
+// pre-existing raw disk image.
+type diskSource struct {
+	pkg   vpkg.Reader
+	image *vdisk.RawImage
+}
+
+// buildDisk builds the disk for a run from src, in the given format.
+func (c *commandContext) buildDisk(ctx context.Context, src *diskSource, w io.WriteSeeker, format vdisk.Format, disks *diskFiles) error {
+
+	args := &vdisk.BuildArgs{
+		WithVCFGDefaults: true,
+		PackageReader:    src.pkg,
+		Format:           format,
+		KernelOptions: vdisk.KernelOptions{
+			Shell:  c.flagShell,
+			Record: c.flagRecord != "",
+		},
+		Logger:     c.log,
+		DiskWriter: disks.create,
+	}
+
+	if src.image != nil {
+		args.Image = src.image
+	} else {
+		osFiles, err := c.osFileTree()
+		if err != nil {
+			return err
+		}
+		if osFiles != nil {
+			defer osFiles.Close()
+		}
+		args.OSFiles = osFiles
+		args.FilesystemCache = c.filesystemCache()
+		args.ZoneInfo = c.zoneInfo()
+
+		args.TemplateData, err = c.templateData()
+		if err != nil {
+			return err
+		}
+
+		args.Policy, err = c.loadPolicy()
+		if err != nil {
+			return err
+		}
+	}
+
+	return vdisk.Build(ctx, w, args)
+
+}
+
+// Close closes whichever of the package or image the diskSource holds.
+func (src *diskSource) Close() error {
+	if src.image != nil {
+		return src.image.Close()
+	}
+	return src.pkg.Close()
+}
+
+// diskFiles creates and keeps track of the files that a build's additional
+// disks are written to, which sit alongside the main disk.
+type diskFiles struct {
+	main  string
+	names []string
+	files []*os.File
+}
+
+func (d *diskFiles) create(name string) (io.WriteSeeker, error) {
+
+	f, err := os.Create(vdisk.DiskPath(d.main, name))
+	if err != nil {
+		return nil, err
+	}
+
+	d.names = append(d.names, name)
+	d.files = append(d.files, f)
+
+	return f, nil
+
+}
+
+// paths returns the paths of the additional disks in the order they were
+// created, which is the order they should be attached to a VM.
+func (d *diskFiles) paths() []string {
+	var paths []string
+	for _, f := range d.files {
+		paths = append(paths, f.Name())
+	}
+	return paths
+}
+
+// Close closes every file, returning the first error encountered.
+func (d *diskFiles) Close() error {
+	var err error
+	for _, f := range d.files {
+		e := f.Close()
+		if e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// saveDisks moves each of the additional disks alongside the main disk's
+// diskOutput.
+func (c *commandContext) saveDisks(d *diskFiles, diskOutput string) {
+	for i, f := range d.files {
+		c.saveDisk(f.Name(), vdisk.DiskPath(diskOutput, d.names[i]))
+	}
+}
+
+// remove deletes every file.
+func (d *diskFiles) remove() {
+	for _, f := range d.files {
+		f.Close()
+		os.Remove(f.Name())
+	}
+}
 
 // saveDisk attempts to moves disk from sourceDisk to destDisk
-func saveDisk(sourceDisk, destDisk string) error {
-	p := log.NewProgress("Copying Disk to "+destDisk, "", 0)
+func (c *commandContext) saveDisk(sourceDisk, destDisk string) error {
+	p := c.log.NewProgress("Copying Disk to "+destDisk, "", 0)
 	err := os.Rename(sourceDisk, destDisk)
 	if err != nil {
-		log.Errorf("Failed to Copy Disk to '%s' error: %v\f", destDisk, err)
+		c.log.Errorf("Failed to Copy Disk to '%s' error: %v\f", destDisk, err)
 		p.Finish(false)
 		return err
 	}
 
 	p.Finish(true)
-	log.Printf("Copied Disk")
+	c.log.Printf("Copied Disk")
 	return nil
 }
 
-// buildFirecracker does the same thing as vdisk.Build but it returns me a calver of the kernel being used
-func buildFirecracker(ctx context.Context, w io.WriteSeeker, cfg *vcfg.VCFG, args *vdisk.BuildArgs) (string, error) {
+// buildFirecracker does the same thing as vdisk.Build but it returns me a calver of the kernel being used.
+// Unless rootless, the network interfaces are given addresses on vorteil-bridge.
+func (c *commandContext) buildFirecracker(ctx context.Context, w io.WriteSeeker, cfg *vcfg.VCFG, args *vdisk.BuildArgs, rootless bool) (string, error) {
 	var err error
-	for i := range cfg.Networks {
-		if ips == nil {
-			ips, err = iputil.NewIPStack()
+	if rootless {
+		firecracker.AssignRootlessAddresses(cfg)
+	} else {
+		for i := range cfg.Networks {
+			if c.ips == nil {
+				c.ips, err = iputil.NewIPStack()
+				if err != nil {
+					return "", err
+				}
+				defer c.ips.Close()
+
+			}
+			ip, err := c.ips.Dequeue()
 			if err != nil {
 				return "", err
 			}
-			defer ips.Close()
-
+			cfg.Networks[i].IP = ip.ToString()
+			cfg.Networks[i].Gateway = iputil.BridgeIP
+			cfg.Networks[i].Mask = "255.255.255.0"
 		}
-		ip, err := ips.Dequeue()
+	}
+	if args.ZoneInfo != "" {
+		err = vdisk.MapTimezoneData(cfg, args.ZoneInfo, args.PackageReader.FS())
 		if err != nil {
 			return "", err
 		}
-		cfg.Networks[i].IP = ip.ToString()
-		cfg.Networks[i].Gateway = iputil.BridgeIP
-		cfg.Networks[i].Mask = "255.255.255.0"
+	}
+	err = vdisk.ValidateTemplates(cfg)
+	if err != nil {
+		return "", err
+	}
+	err = vdisk.RenderTemplates(cfg, args.TemplateData, args.PackageReader.FS())
+	if err != nil {
+		return "", err
+	}
+	var fsCompiler vimg.FSCompiler = ext.NewCompiler(&ext.CompilerArgs{
+		FileTree: args.PackageReader.FS(),
+		Logger:   args.Logger,
+	})
+	if args.FilesystemCache != nil {
+		fsCompiler, err = args.FilesystemCache.Compiler(c.log, fsCompiler, "ext", args.PackageReader.FS(), cfg)
+		if err != nil {
+			return "", err
+		}
+	}
+	partitions, err := vdisk.ExtraPartitions(cfg, args)
+	if err != nil {
+		return "", err
 	}
 	vimgBuilder, err := vdisk.CreateBuilder(ctx, &vimg.BuilderArgs{
 		Kernel: vimg.KernelOptions{
 			Shell: args.KernelOptions.Shell,
 		},
-		FSCompiler: ext.NewCompiler(&ext.CompilerArgs{
-			FileTree: args.PackageReader.FS(),
-			Logger:   args.Logger,
-		}),
-		VCFG:   cfg,
-		Logger: log,
+		FSCompiler: fsCompiler,
+		VCFG:       cfg,
+		Logger:     c.log,
+		OSFiles:    args.OSFiles,
+		Partitions: partitions,
 	})
 	if err != nil {
 		return "", err
@@ -88,16 +236,22 @@ func buildFirecracker(ctx context.Context, w io.WriteSeeker, cfg *vcfg.VCFG, arg
 		return "", err
 	}
 
-	err = args.Format.Build(ctx, log, w, vimgBuilder, cfg)
+	err = args.Format.Build(ctx, c.log, w, vimgBuilder, cfg)
+	if err != nil {
+		return "", err
+	}
+
+	err = vdisk.BuildDisks(ctx, cfg, args)
 	if err != nil {
 		return "", err
 	}
+
 	return string(vimgBuilder.KernelUsed()), nil
 }
 
 // runVMware
 //	Saves resulting image to diskOutput if it's not an empty string
-func runVMware(pkgReader vpkg.Reader, cfg *vcfg.VCFG, name, diskOutput string) error {
+func (c *commandContext) runVMware(src *diskSource, cfg *vcfg.VCFG, name, diskOutput string) error {
 	if !vmware.Allocator.IsAvailable() {
 		return errors.New("vmware is not installed on your system")
 	}
@@ -123,23 +277,22 @@ func runVMware(pkgReader vpkg.Reader, cfg *vcfg.VCFG, name, diskOutput string) e
 		f.Close()
 		// Move disk to diskOutput
 		if diskOutput != "" {
-			saveDisk(f.Name(), diskOutput)
+			c.saveDisk(f.Name(), diskOutput)
 		}
 		os.Remove(f.Name())
 		os.Remove(parent)
 
 	}()
 
-	err = vdisk.Build(context.Background(), f, &vdisk.BuildArgs{
-		WithVCFGDefaults: true,
-		PackageReader:    pkgReader,
-		Format:           vmware.Allocator.DiskFormat(),
-		KernelOptions: vdisk.KernelOptions{
-			Shell:  flagShell,
-			Record: flagRecord != "",
-		},
-		Logger: log,
-	})
+	disks := &diskFiles{main: f.Name()}
+	defer func() {
+		if diskOutput != "" {
+			c.saveDisks(disks, diskOutput)
+		}
+		disks.remove()
+	}()
+
+	err = c.buildDisk(context.Background(), src, f, vmware.Allocator.DiskFormat(), disks)
 	if err != nil {
 		return err
 	}
@@ -149,7 +302,12 @@ func runVMware(pkgReader vpkg.Reader, cfg *vcfg.VCFG, name, diskOutput string) e
 		return err
 	}
 
-	err = pkgReader.Close()
+	err = disks.Close()
+	if err != nil {
+		return err
+	}
+
+	err = src.Close()
 	if err != nil {
 		return err
 	}
@@ -158,7 +316,7 @@ func runVMware(pkgReader vpkg.Reader, cfg *vcfg.VCFG, name, diskOutput string) e
 	virt := alloc.Alloc()
 
 	config := vmware.Config{
-		Headless:    !flagGUI,
+		Headless:    !c.flagGUI,
 		NetworkType: "nat",
 	}
 
@@ -167,17 +325,17 @@ func runVMware(pkgReader vpkg.Reader, cfg *vcfg.VCFG, name, diskOutput string) e
 		return err
 	}
 
-	err = vcfg.WithDefaults(cfg, log)
+	err = vcfg.WithDefaults(cfg, c.log)
 	if err != nil {
 		return err
 	}
 
-	return run(virt, f.Name(), cfg, name)
+	return c.run(virt, f.Name(), disks.paths(), cfg, name)
 }
 
 // runFirecracker needs a longer build process so we can pull the calver of the kernel used to build the disk
 //	Saves resulting image to diskOutput if it's not an empty string
-func runFirecracker(pkgReader vpkg.Reader, cfg *vcfg.VCFG, name, diskOutput string) error {
+func (c *commandContext) runFirecracker(src *diskSource, cfg *vcfg.VCFG, name, diskOutput string) error {
 	var err error
 	if runtime.GOOS != "linux" {
 		return errors.New("firecracker is only available on linux")
@@ -185,13 +343,21 @@ func runFirecracker(pkgReader vpkg.Reader, cfg *vcfg.VCFG, name, diskOutput stri
 	if !firecracker.Allocator.IsAvailable() {
 		return errors.New("firecracker is not installed on your system")
 	}
+	if src.image != nil {
+		return errors.New("firecracker boots the kernel directly, so it can't run raw disk images")
+	}
 
-	err = firecracker.FetchBridgeDevice()
-	if err != nil {
-		// Set bridge device to 10.26.10.1
-		err = firecracker.SetupBridge(log, iputil.BridgeIP)
+	if !c.flagFirecrackerRootless {
+		err = firecracker.FetchBridgeDevice()
 		if err != nil {
-			return err
+			// Set bridge device to 10.26.10.1
+			err = firecracker.SetupBridge(c.log, iputil.BridgeIP)
+			if err != nil {
+				if os.Geteuid() != 0 {
+					return fmt.Errorf("%v: setting up vorteil-bridge requires root, use --firecracker-rootless to run without it", err)
+				}
+				return err
+			}
 		}
 	}
 
@@ -215,28 +381,59 @@ func runFirecracker(pkgReader vpkg.Reader, cfg *vcfg.VCFG, name, diskOutput stri
 		f.Close()
 		// Move disk to diskOutput
 		if diskOutput != "" {
-			saveDisk(f.Name(), diskOutput)
+			c.saveDisk(f.Name(), diskOutput)
 		}
 		os.Remove(f.Name())
 		os.Remove(parent)
 
 	}()
 
-	err = vcfg.WithDefaults(cfg, log)
+	err = vcfg.WithDefaults(cfg, c.log)
+	if err != nil {
+		return err
+	}
+
+	err = vdisk.ValidateDisks(cfg, src.pkg)
 	if err != nil {
 		return err
 	}
 
-	kernelVer, err := buildFirecracker(context.Background(), f, cfg, &vdisk.BuildArgs{
+	disks := &diskFiles{main: f.Name()}
+	defer func() {
+		if diskOutput != "" {
+			c.saveDisks(disks, diskOutput)
+		}
+		disks.remove()
+	}()
+
+	osFiles, err := c.osFileTree()
+	if err != nil {
+		return err
+	}
+	if osFiles != nil {
+		defer osFiles.Close()
+	}
+
+	templateData, err := c.templateData()
+	if err != nil {
+		return err
+	}
+
+	kernelVer, err := c.buildFirecracker(context.Background(), f, cfg, &vdisk.BuildArgs{
 		WithVCFGDefaults: true,
-		PackageReader:    pkgReader,
+		PackageReader:    src.pkg,
 		Format:           firecracker.Allocator.DiskFormat(),
 		KernelOptions: vdisk.KernelOptions{
-			Shell:  flagShell,
-			Record: flagRecord != "",
+			Shell:  c.flagShell,
+			Record: c.flagRecord != "",
 		},
-		Logger: log,
-	})
+		Logger:          c.log,
+		DiskWriter:      disks.create,
+		OSFiles:         osFiles,
+		FilesystemCache: c.filesystemCache(),
+		ZoneInfo:        c.zoneInfo(),
+		TemplateData:    templateData,
+	}, c.flagFirecrackerRootless)
 	if err != nil {
 		return err
 	}
@@ -249,7 +446,12 @@ func runFirecracker(pkgReader vpkg.Reader, cfg *vcfg.VCFG, name, diskOutput stri
 		return err
 	}
 
-	err = pkgReader.Close()
+	err = disks.Close()
+	if err != nil {
+		return err
+	}
+
+	err = src.Close()
 	if err != nil {
 		return err
 	}
@@ -257,23 +459,25 @@ func runFirecracker(pkgReader vpkg.Reader, cfg *vcfg.VCFG, name, diskOutput stri
 	alloc := firecracker.Allocator
 	virt := alloc.Alloc()
 
-	if flagGUI {
-		log.Warnf("firecracker does not support displaying a gui")
+	if c.flagGUI {
+		c.log.Warnf("firecracker does not support displaying a gui")
 	}
 
-	config := firecracker.Config{}
+	config := firecracker.Config{
+		Rootless: c.flagFirecrackerRootless,
+	}
 
 	err = virt.Initialize(config.Marshal())
 	if err != nil {
 		return err
 	}
 
-	return run(virt, f.Name(), cfg, name)
+	return c.run(virt, f.Name(), disks.paths(), cfg, name)
 }
 
 // runHyperV
 //	Saves resulting image to diskOutput if it's not an empty string
-func runHyperV(pkgReader vpkg.Reader, cfg *vcfg.VCFG, name, diskOutput string) error {
+func (c *commandContext) runHyperV(src *diskSource, cfg *vcfg.VCFG, name, diskOutput string) error {
 	if runtime.GOOS != "windows" {
 		return errors.New("hyper-v is only available on windows system")
 	}
@@ -290,6 +494,16 @@ func runHyperV(pkgReader vpkg.Reader, cfg *vcfg.VCFG, name, diskOutput string) e
 		return err
 	}
 
+	// without a switch the vm's ports are forwarded to localhost through NAT,
+	// which needs static addresses baked into the disk
+	nat := c.flagHyperVSwitch == ""
+	if nat {
+		err = useHyperVNAT(src, cfg)
+		if err != nil {
+			return err
+		}
+	}
+
 	// need to create a tempfile rather than use the function to as hyper-v complains if the extension doesn't exist
 	f, err := os.Create(filepath.Join(parent, "disk.vhd"))
 	if err != nil {
@@ -300,23 +514,22 @@ func runHyperV(pkgReader vpkg.Reader, cfg *vcfg.VCFG, name, diskOutput string) e
 		f.Close()
 		// Move disk to diskOutput
 		if diskOutput != "" {
-			saveDisk(f.Name(), diskOutput)
+			c.saveDisk(f.Name(), diskOutput)
 		}
 		os.Remove(f.Name())
 		os.Remove(parent)
 
 	}()
 
-	err = vdisk.Build(context.Background(), f, &vdisk.BuildArgs{
-		WithVCFGDefaults: true,
-		PackageReader:    pkgReader,
-		Format:           hyperv.Allocator.DiskFormat(),
-		KernelOptions: vdisk.KernelOptions{
-			Shell:  flagShell,
-			Record: flagRecord != "",
-		},
-		Logger: log,
-	})
+	disks := &diskFiles{main: f.Name()}
+	defer func() {
+		if diskOutput != "" {
+			c.saveDisks(disks, diskOutput)
+		}
+		disks.remove()
+	}()
+
+	err = c.buildDisk(context.Background(), src, f, hyperv.Allocator.DiskFormat(), disks)
 	if err != nil {
 		return err
 	}
@@ -326,7 +539,12 @@ func runHyperV(pkgReader vpkg.Reader, cfg *vcfg.VCFG, name, diskOutput string) e
 		return err
 	}
 
-	err = pkgReader.Close()
+	err = disks.Close()
+	if err != nil {
+		return err
+	}
+
+	err = src.Close()
 	if err != nil {
 		return err
 	}
@@ -335,8 +553,9 @@ func runHyperV(pkgReader vpkg.Reader, cfg *vcfg.VCFG, name, diskOutput string) e
 	virt := alloc.Alloc()
 
 	config := hyperv.Config{
-		Headless:   !flagGUI,
-		SwitchName: "Default Switch",
+		Headless:   !c.flagGUI,
+		SwitchName: c.flagHyperVSwitch,
+		NAT:        nat,
 	}
 
 	err = virt.Initialize(config.Marshal())
@@ -344,17 +563,47 @@ func runHyperV(pkgReader vpkg.Reader, cfg *vcfg.VCFG, name, diskOutput string) e
 		return err
 	}
 
-	err = vcfg.WithDefaults(cfg, log)
+	err = vcfg.WithDefaults(cfg, c.log)
 	if err != nil {
 		return err
 	}
 
-	return run(virt, f.Name(), cfg, name)
+	return c.run(virt, f.Name(), disks.paths(), cfg, name)
+}
+
+// useHyperVNAT gives the package's network interfaces static addresses on
+// the hyper-v NAT network.
+func useHyperVNAT(src *diskSource, cfg *vcfg.VCFG) error {
+
+	if src.image != nil {
+		if len(cfg.Networks) > 0 {
+			return errors.New("disk images can't be given addresses on the hyper-v nat network, use --hyperv-switch to run them")
+		}
+		return nil
+	}
+
+	err := hyperv.AssignNATAddresses(cfg)
+	if err != nil {
+		return err
+	}
+
+	f, err := cfg.File()
+	if err != nil {
+		return err
+	}
+
+	src.pkg, err = vpkg.ReplaceVCFG(src.pkg, f)
+	if err != nil {
+		return err
+	}
+
+	return nil
+
 }
 
 // runVirtualBox
 //	Saves resulting image to diskOutput if it's not an empty string
-func runVirtualBox(pkgReader vpkg.Reader, cfg *vcfg.VCFG, name, diskOutput string) error {
+func (c *commandContext) runVirtualBox(src *diskSource, cfg *vcfg.VCFG, name, diskOutput string) error {
 	if !virtualbox.Allocator.IsAvailable() {
 		return errors.New("virtualbox not found installed on system")
 	}
@@ -378,23 +627,22 @@ func runVirtualBox(pkgReader vpkg.Reader, cfg *vcfg.VCFG, name, diskOutput strin
 		f.Close()
 		// Move disk to diskOutput
 		if diskOutput != "" {
-			saveDisk(f.Name(), diskOutput)
+			c.saveDisk(f.Name(), diskOutput)
 		}
 		os.Remove(f.Name())
 		os.Remove(parent)
 
 	}()
 
-	err = vdisk.Build(context.Background(), f, &vdisk.BuildArgs{
-		WithVCFGDefaults: true,
-		PackageReader:    pkgReader,
-		Format:           virtualbox.Allocator.DiskFormat(),
-		KernelOptions: vdisk.KernelOptions{
-			Shell:  flagShell,
-			Record: flagRecord != "",
-		},
-		Logger: log,
-	})
+	disks := &diskFiles{main: f.Name()}
+	defer func() {
+		if diskOutput != "" {
+			c.saveDisks(disks, diskOutput)
+		}
+		disks.remove()
+	}()
+
+	err = c.buildDisk(context.Background(), src, f, virtualbox.Allocator.DiskFormat(), disks)
 	if err != nil {
 		return err
 	}
@@ -404,7 +652,12 @@ func runVirtualBox(pkgReader vpkg.Reader, cfg *vcfg.VCFG, name, diskOutput strin
 		return err
 	}
 
-	err = pkgReader.Close()
+	err = disks.Close()
+	if err != nil {
+		return err
+	}
+
+	err = src.Close()
 	if err != nil {
 		return err
 	}
@@ -413,7 +666,7 @@ func runVirtualBox(pkgReader vpkg.Reader, cfg *vcfg.VCFG, name, diskOutput strin
 	virt := alloc.Alloc()
 
 	config := virtualbox.Config{
-		Headless:    !flagGUI,
+		Headless:    !c.flagGUI,
 		NetworkType: "nat",
 	}
 
@@ -422,17 +675,17 @@ func runVirtualBox(pkgReader vpkg.Reader, cfg *vcfg.VCFG, name, diskOutput strin
 		return err
 	}
 
-	err = vcfg.WithDefaults(cfg, log)
+	err = vcfg.WithDefaults(cfg, c.log)
 	if err != nil {
 		return err
 	}
 
-	return run(virt, f.Name(), cfg, name)
+	return c.run(virt, f.Name(), disks.paths(), cfg, name)
 }
 
 // runQEMU
 //	Saves resulting image to diskOutput if it's not an empty string
-func runQEMU(pkgReader vpkg.Reader, cfg *vcfg.VCFG, name string, diskOutput string) error {
+func (c *commandContext) runQEMU(src *diskSource, cfg *vcfg.VCFG, name string, diskOutput string) error {
 
 	if !qemu.Allocator.IsAvailable() {
 		return errors.New("qemu not installed on system")
@@ -455,23 +708,22 @@ func runQEMU(pkgReader vpkg.Reader, cfg *vcfg.VCFG, name string, diskOutput stri
 		f.Close()
 		// Move disk to diskOutput
 		if diskOutput != "" {
-			saveDisk(f.Name(), diskOutput)
+			c.saveDisk(f.Name(), diskOutput)
 		}
 		os.Remove(f.Name())
 		os.Remove(parent)
 
 	}()
 
-	err = vdisk.Build(context.Background(), f, &vdisk.BuildArgs{
-		WithVCFGDefaults: true,
-		PackageReader:    pkgReader,
-		Format:           qemu.Allocator.DiskFormat(),
-		KernelOptions: vdisk.KernelOptions{
-			Shell:  flagShell,
-			Record: flagRecord != "",
-		},
-		Logger: log,
-	})
+	disks := &diskFiles{main: f.Name()}
+	defer func() {
+		if diskOutput != "" {
+			c.saveDisks(disks, diskOutput)
+		}
+		disks.remove()
+	}()
+
+	err = c.buildDisk(context.Background(), src, f, qemu.Allocator.DiskFormat(), disks)
 	if err != nil {
 		return err
 	}
@@ -481,7 +733,12 @@ func runQEMU(pkgReader vpkg.Reader, cfg *vcfg.VCFG, name string, diskOutput stri
 		return err
 	}
 
-	err = pkgReader.Close()
+	err = disks.Close()
+	if err != nil {
+		return err
+	}
+
+	err = src.Close()
 	if err != nil {
 		return err
 	}
@@ -490,7 +747,7 @@ func runQEMU(pkgReader vpkg.Reader, cfg *vcfg.VCFG, name string, diskOutput stri
 	virt := alloc.Alloc()
 
 	config := qemu.Config{
-		Headless: !flagGUI,
+		Headless: !c.flagGUI,
 	}
 
 	err = virt.Initialize(config.Marshal())
@@ -498,10 +755,10 @@ func runQEMU(pkgReader vpkg.Reader, cfg *vcfg.VCFG, name string, diskOutput stri
 		return err
 	}
 
-	err = vcfg.WithDefaults(cfg, log)
+	err = vcfg.WithDefaults(cfg, c.log)
 	if err != nil {
 		return err
 	}
 
-	return run(virt, f.Name(), cfg, name)
+	return c.run(virt, f.Name(), disks.paths(), cfg, name)
 }
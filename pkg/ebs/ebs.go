@@ -0,0 +1,406 @@
+package ebs
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+)
+
+// The EBS block stream is a raw disk image laid out for the EBS direct APIs,
+// so that it can be turned into a snapshot with StartSnapshot,
+// PutSnapshotBlock and CompleteSnapshot instead of importing it through a
+// helper instance. The image is split into 512 KiB blocks, and only blocks
+// that aren't entirely zeroes are included, each one preceded by its index
+// and SHA256 checksum:
+//
+//	header  | magic "VEBSBLK\0", version, block size, volume size
+//	block   | index, SHA256 checksum, BlockSize bytes of data
+//	...
+//	trailer | EndIndex, LINEAR aggregate checksum, number of blocks
+//
+// All integers are little-endian. Blocks appear in order of their index, so
+// the aggregate checksum in the trailer is the SHA256 checksum of every block
+// checksum concatenated in the order they appear, which is what
+// CompleteSnapshot expects with the LINEAR aggregation method.
+
+const (
+	// BlockSize is the size of the blocks the EBS direct APIs work with.
+	BlockSize = 0x80000
+
+	// SizeAlignment is the multiple EBS requires the volume size to be.
+	SizeAlignment = 0x40000000
+
+	// ChecksumAlgorithm is the checksum algorithm the EBS direct APIs are
+	// told the checksums were computed with.
+	ChecksumAlgorithm = "SHA256"
+
+	// ChecksumAggregationMethod is how the checksum of the whole snapshot is
+	// computed from the block checksums.
+	ChecksumAggregationMethod = "LINEAR"
+
+	// EndIndex is the index of the trailer that follows the last block.
+	EndIndex = ^uint64(0)
+
+	version = 1
+)
+
+var magic = [8]byte{'V', 'E', 'B', 'S', 'B', 'L', 'K', 0}
+
+type header struct {
+	Magic      [8]byte
+	Version    uint32
+	BlockSize  uint32
+	VolumeSize uint64
+}
+
+type blockHeader struct {
+	Index    uint64
+	Checksum [sha256.Size]byte
+}
+
+type trailer struct {
+	Index    uint64
+	Checksum [sha256.Size]byte
+	Blocks   uint64
+}
+
+// Sizer is anything that knows the size of the raw disk image.
+type Sizer interface {
+	Size() int64
+}
+
+// Writer converts a raw disk image into an EBS block stream. Like the other
+// streaming formats it never seeks backwards, and the space it is told to
+// skip over is treated as zeroes.
+type Writer struct {
+	w         io.Writer
+	length    int64
+	cursor    int64
+	buf       []byte
+	dirty     bool
+	aggregate hash.Hash
+	blocks    uint64
+	closed    bool
+}
+
+// NewWriter returns a Writer that writes an EBS block stream for a raw disk
+// image of h.Size() bytes to w.
+func NewWriter(w io.Writer, h Sizer) (*Writer, error) {
+
+	length := h.Size()
+	if length <= 0 || length%SizeAlignment != 0 {
+		return nil, fmt.Errorf("ebs volume size must be a non-zero multiple of 1 GiB (got %d bytes)", length)
+	}
+
+	hdr := header{
+		Magic:      magic,
+		Version:    version,
+		BlockSize:  BlockSize,
+		VolumeSize: uint64(length),
+	}
+
+	err := binary.Write(w, binary.LittleEndian, &hdr)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Writer{
+		w:         w,
+		length:    length,
+		buf:       make([]byte, BlockSize),
+		aggregate: sha256.New(),
+	}, nil
+
+}
+
+// flush writes out the current block if it contains any data, and starts the
+// next one.
+func (w *Writer) flush() error {
+
+	index := uint64(w.cursor/BlockSize) - 1
+
+	if w.dirty && !isZeroes(w.buf) {
+		bh := blockHeader{
+			Index:    index,
+			Checksum: sha256.Sum256(w.buf),
+		}
+
+		err := binary.Write(w.w, binary.LittleEndian, &bh)
+		if err != nil {
+			return err
+		}
+
+		_, err = w.w.Write(w.buf)
+		if err != nil {
+			return err
+		}
+
+		_, _ = w.aggregate.Write(bh.Checksum[:])
+		w.blocks++
+	}
+
+	if w.dirty {
+		for i := range w.buf {
+			w.buf[i] = 0
+		}
+	}
+	w.dirty = false
+
+	return nil
+
+}
+
+// Write implements io.Writer.
+func (w *Writer) Write(p []byte) (int, error) {
+
+	if w.cursor+int64(len(p)) > w.length {
+		return 0, errors.New("ebs writer received more raw image data than was expected")
+	}
+
+	var n int
+	for len(p) > 0 {
+		off := w.cursor % BlockSize
+		k := copy(w.buf[off:], p)
+		w.dirty = true
+		w.cursor += int64(k)
+		n += k
+		p = p[k:]
+
+		if w.cursor%BlockSize == 0 {
+			err := w.flush()
+			if err != nil {
+				return n, err
+			}
+		}
+	}
+
+	return n, nil
+
+}
+
+// Seek implements io.Seeker. It can only seek forwards.
+func (w *Writer) Seek(offset int64, whence int) (int64, error) {
+
+	var abs int64
+	switch whence {
+	case io.SeekStart:
+		abs = offset
+	case io.SeekCurrent:
+		abs = w.cursor + offset
+	case io.SeekEnd:
+		abs = w.length + offset
+	default:
+		panic("bad seek whence")
+	}
+
+	if abs < w.cursor {
+		return w.cursor, errors.New("ebs writer cannot seek backwards")
+	}
+
+	if abs > w.length {
+		return w.cursor, errors.New("ebs writer cannot seek beyond the end of the disk")
+	}
+
+	// finish the current block, then skip whole blocks of zeroes
+	if w.cursor%BlockSize != 0 && abs >= w.cursor-w.cursor%BlockSize+BlockSize {
+		w.cursor += BlockSize - w.cursor%BlockSize
+		err := w.flush()
+		if err != nil {
+			return w.cursor, err
+		}
+	}
+
+	w.cursor = abs
+	return w.cursor, nil
+
+}
+
+// Close writes the last block and the trailer. Anything after the last data
+// written is zeroes, so it doesn't need to have been written.
+func (w *Writer) Close() error {
+
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+
+	if w.cursor%BlockSize != 0 {
+		w.cursor += BlockSize - w.cursor%BlockSize
+		err := w.flush()
+		if err != nil {
+			return err
+		}
+	}
+
+	t := trailer{
+		Index:  EndIndex,
+		Blocks: w.blocks,
+	}
+	copy(t.Checksum[:], w.aggregate.Sum(nil))
+
+	return binary.Write(w.w, binary.LittleEndian, &t)
+
+}
+
+func isZeroes(p []byte) bool {
+	return bytes.Count(p, []byte{0}) == len(p)
+}
+
+// Block is a block of an EBS block stream, ready to be passed to
+// PutSnapshotBlock.
+type Block struct {
+	Index    int64
+	Checksum string // base64 encoded, as PutSnapshotBlock expects
+	Data     []byte
+}
+
+// Reader reads an EBS block stream.
+type Reader struct {
+	r          io.Reader
+	volumeSize int64
+	blocks     int64
+	checksum   string
+	aggregate  hash.Hash
+	last       int64
+}
+
+// NewReader returns a Reader for the EBS block stream in r, having read its
+// header.
+func NewReader(r io.Reader) (*Reader, error) {
+
+	hdr := new(header)
+	err := binary.Read(r, binary.LittleEndian, hdr)
+	if err != nil {
+		return nil, err
+	}
+
+	if hdr.Magic != magic {
+		return nil, errors.New("not an ebs block stream")
+	}
+
+	if hdr.Version != version || hdr.BlockSize != BlockSize {
+		return nil, fmt.Errorf("unsupported ebs block stream (version %d, block size %d)", hdr.Version, hdr.BlockSize)
+	}
+
+	return &Reader{
+		r:          r,
+		volumeSize: int64(hdr.VolumeSize),
+		aggregate:  sha256.New(),
+		last:       -1,
+	}, nil
+
+}
+
+// VolumeSize returns the size of the disk in bytes. StartSnapshot takes it in
+// GiB.
+func (r *Reader) VolumeSize() int64 {
+	return r.volumeSize
+}
+
+// Next returns the next block, or io.EOF after the last one. The block's data
+// is read into data if it is big enough, so that a buffer can be reused
+// between calls. Each block's checksum is verified as it is read.
+func (r *Reader) Next(data []byte) (*Block, error) {
+
+	if r.checksum != "" {
+		return nil, io.EOF
+	}
+
+	var index uint64
+	err := binary.Read(r.r, binary.LittleEndian, &index)
+	if err != nil {
+		return nil, unexpectedEOF(err)
+	}
+
+	if index == EndIndex {
+		return nil, r.readTrailer()
+	}
+
+	if int64(index) <= r.last || int64(index) >= r.volumeSize/BlockSize {
+		return nil, fmt.Errorf("ebs block stream has an out of order block %d", index)
+	}
+	r.last = int64(index)
+
+	var checksum [sha256.Size]byte
+	_, err = io.ReadFull(r.r, checksum[:])
+	if err != nil {
+		return nil, unexpectedEOF(err)
+	}
+
+	if len(data) < BlockSize {
+		data = make([]byte, BlockSize)
+	}
+	data = data[:BlockSize]
+
+	_, err = io.ReadFull(r.r, data)
+	if err != nil {
+		return nil, unexpectedEOF(err)
+	}
+
+	if sha256.Sum256(data) != checksum {
+		return nil, fmt.Errorf("ebs block stream block %d doesn't match its checksum", index)
+	}
+
+	_, _ = r.aggregate.Write(checksum[:])
+	r.blocks++
+
+	return &Block{
+		Index:    int64(index),
+		Checksum: base64.StdEncoding.EncodeToString(checksum[:]),
+		Data:     data,
+	}, nil
+
+}
+
+func (r *Reader) readTrailer() error {
+
+	var t trailer
+	err := binary.Read(r.r, binary.LittleEndian, &t.Checksum)
+	if err != nil {
+		return unexpectedEOF(err)
+	}
+
+	err = binary.Read(r.r, binary.LittleEndian, &t.Blocks)
+	if err != nil {
+		return unexpectedEOF(err)
+	}
+
+	if int64(t.Blocks) != r.blocks || !bytes.Equal(t.Checksum[:], r.aggregate.Sum(nil)) {
+		return errors.New("ebs block stream doesn't match its aggregate checksum")
+	}
+
+	r.checksum = base64.StdEncoding.EncodeToString(t.Checksum[:])
+
+	return io.EOF
+
+}
+
+// Checksum returns the base64 encoded aggregate checksum of every block, as
+// CompleteSnapshot expects. It is only available once Next has returned
+// io.EOF.
+func (r *Reader) Checksum() string {
+	return r.checksum
+}
+
+// Blocks returns the number of blocks read so far, which is the
+// ChangedBlocksCount once Next has returned io.EOF.
+func (r *Reader) Blocks() int64 {
+	return r.blocks
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
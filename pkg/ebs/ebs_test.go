@@ -0,0 +1,169 @@
+package ebs
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"io"
+	"testing"
+)
+
+type testSizer int64
+
+func (s testSizer) Size() int64 {
+	return int64(s)
+}
+
+func TestWriter(t *testing.T) {
+
+	head := bytes.Repeat([]byte("vorteil"), 1000)
+	middle := []byte("straddles two blocks")
+	tail := []byte("end of disk")
+
+	buf := new(bytes.Buffer)
+	w, err := NewWriter(buf, testSizer(SizeAlignment))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = w.Write(head)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// block 1 is skipped entirely, and the middle ends up in blocks 3 and 4
+	_, err = w.Seek(4*BlockSize-5, io.SeekStart)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = w.Write(middle)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = w.Seek(-int64(len(tail)), io.SeekEnd)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = w.Write(tail)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = w.Write([]byte{1})
+	if err == nil {
+		t.Errorf("ebs writer accepted data beyond the end of the disk")
+	}
+
+	_, err = w.Seek(0, io.SeekStart)
+	if err == nil {
+		t.Errorf("ebs writer seeked backwards")
+	}
+
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the expected contents of each block that isn't empty
+	last := int64(SizeAlignment/BlockSize - 1)
+	expect := map[int64][]byte{
+		0:    make([]byte, BlockSize),
+		3:    make([]byte, BlockSize),
+		4:    make([]byte, BlockSize),
+		last: make([]byte, BlockSize),
+	}
+	copy(expect[0], head)
+	copy(expect[3][BlockSize-5:], middle)
+	copy(expect[4], middle[5:])
+	copy(expect[last][BlockSize-len(tail):], tail)
+
+	r, err := NewReader(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if r.VolumeSize() != SizeAlignment {
+		t.Errorf("bad volume size %d", r.VolumeSize())
+	}
+
+	aggregate := sha256.New()
+	var indices []int64
+	data := make([]byte, BlockSize)
+
+	for {
+		block, err := r.Next(data)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(block.Data, expect[block.Index]) {
+			t.Errorf("block %d has the wrong data", block.Index)
+		}
+
+		sum := sha256.Sum256(expect[block.Index])
+		if block.Checksum != base64.StdEncoding.EncodeToString(sum[:]) {
+			t.Errorf("block %d has the wrong checksum", block.Index)
+		}
+
+		aggregate.Write(sum[:])
+		indices = append(indices, block.Index)
+	}
+
+	if len(indices) != 4 || indices[0] != 0 || indices[1] != 3 || indices[2] != 4 {
+		t.Errorf("wrong blocks in the stream: %v", indices)
+	}
+
+	if r.Blocks() != 4 || r.Checksum() != base64.StdEncoding.EncodeToString(aggregate.Sum(nil)) {
+		t.Errorf("bad aggregate checksum")
+	}
+
+}
+
+func TestReaderCorruption(t *testing.T) {
+
+	buf := new(bytes.Buffer)
+	w, err := NewWriter(buf, testSizer(SizeAlignment))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = w.Write([]byte("vorteil"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stream := buf.Bytes()
+	stream[len(stream)-100]++ // in the data of the only block
+
+	r, err := NewReader(bytes.NewReader(stream))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = r.Next(nil)
+	if err == nil {
+		t.Errorf("corrupted block wasn't detected")
+	}
+
+	_, err = NewWriter(buf, testSizer(BlockSize))
+	if err == nil {
+		t.Errorf("ebs writer accepted a volume that isn't a whole number of GiB")
+	}
+
+}
@@ -26,6 +26,7 @@ import (
 // Logger is an interface that has the ability to hide debug/info
 type Logger interface {
 	Debugf(format string, x ...interface{})
+	Tracef(format string, x ...interface{})
 	Errorf(format string, x ...interface{})
 	Infof(format string, x ...interface{})
 	Printf(format string, x ...interface{})
@@ -60,6 +61,8 @@ type CLI struct {
 	DisableTTY         bool
 	IsDebug            bool
 	IsVerbose          bool
+	IsTrace            bool
+	Output             io.Writer // defaults to os.Stdout
 	lock               sync.Mutex
 	isTrackingProgress bool
 	bars               map[*mpb.Bar]bool
@@ -67,6 +70,13 @@ type CLI struct {
 	progressContainer  *mpb.Progress
 }
 
+func (log *CLI) output() io.Writer {
+	if log.Output == nil {
+		return os.Stdout
+	}
+	return log.Output
+}
+
 // Debugf is a wrapper function that executes logrus.Tracef if debug is enabled.
 func (log *CLI) Debugf(format string, x ...interface{}) {
 	if log.IsDebug {
@@ -74,6 +84,15 @@ func (log *CLI) Debugf(format string, x ...interface{}) {
 	}
 }
 
+// Tracef is a wrapper function that executes logrus.Tracef if trace is enabled.
+// It's for output too detailed even for debugging most problems, like the
+// metadata tables written into a disk image.
+func (log *CLI) Tracef(format string, x ...interface{}) {
+	if log.IsTrace {
+		logrus.Tracef(format, x...)
+	}
+}
+
 // Errorf is a wrapper function that executes logrus.Errorf
 func (log *CLI) Errorf(format string, x ...interface{}) {
 	logrus.Errorf(format, x...)
@@ -122,7 +141,7 @@ func (log *CLI) NewProgress(label string, units string, total int64) Progress {
 		log.isTrackingProgress = true
 		log.buffer = new(bytes.Buffer)
 		logrus.SetOutput(log.buffer)
-		log.progressContainer = mpb.New(mpb.WithWidth(80))
+		log.progressContainer = mpb.New(mpb.WithWidth(80), mpb.WithOutput(log.output()))
 		log.bars = make(map[*mpb.Bar]bool)
 	}
 
@@ -172,6 +191,22 @@ func (log *CLI) NewProgress(label string, units string, total int64) Progress {
 
 }
 
+// NewProgress creates a progress object from log if it is also a
+// ProgressReporter, so that code that is only given a Logger can still report
+// its progress. Otherwise the progress object returned doesn't display
+// anything.
+func NewProgress(log Logger, label string, units string, total int64) Progress {
+
+	if r, ok := log.(ProgressReporter); ok {
+		return r.NewProgress(label, units, total)
+	}
+
+	return &nilProgress{
+		total: total,
+	}
+
+}
+
 type nilProgress struct {
 	cursor int64
 	total  int64
@@ -271,8 +306,8 @@ func (pb *pb) Finish(success bool) {
 		pb.log.isTrackingProgress = false
 		pb.log.progressContainer.Wait()
 		pb.log.progressContainer = nil
-		logrus.SetOutput(os.Stdout)
-		_, _ = pb.log.buffer.WriteTo(os.Stdout)
+		logrus.SetOutput(pb.log.output())
+		_, _ = pb.log.buffer.WriteTo(pb.log.output())
 		pb.log.buffer = nil
 	}
 }
@@ -354,6 +389,54 @@ func (mws *mws) Write(p []byte) (n int, err error) {
 	return len(p), nil
 }
 
+type writerOnly struct {
+	io.Writer
+}
+
+// ReadFrom implements io.ReaderFrom. If the first write seeker implements
+// io.ReaderFrom and all others are Progress trackers, the data is read
+// directly into the first and the others are advanced by the number of bytes
+// copied. Otherwise the data is copied to all of them normally.
+func (mws *mws) ReadFrom(r io.Reader) (int64, error) {
+
+	rf, ok := mws.w[0].(io.ReaderFrom)
+	for _, w := range mws.w[1:] {
+		if _, isProgress := w.(Progress); !isProgress {
+			ok = false
+		}
+	}
+
+	if !ok {
+		return io.Copy(writerOnly{mws}, r)
+	}
+
+	n, err := rf.ReadFrom(r)
+	for _, w := range mws.w[1:] {
+		_, serr := w.Seek(n, io.SeekCurrent)
+		if err == nil {
+			err = serr
+		}
+	}
+
+	return n, err
+
+}
+
+// WriterAt returns the first write seeker as an io.WriterAt if it is one and
+// all others are Progress trackers, which follow the position of the first
+// and don't need to see writes made at other offsets.
+func (mws *mws) WriterAt() (io.WriterAt, bool) {
+
+	for _, w := range mws.w[1:] {
+		if _, isProgress := w.(Progress); !isProgress {
+			return nil, false
+		}
+	}
+
+	return vio.WriterAt(mws.w[0])
+
+}
+
 // Seek moves to the offset
 func (mws *mws) Seek(offset int64, whence int) (int64, error) {
 
@@ -0,0 +1,533 @@
+package erofs
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/vorteil/vorteil/pkg/elog"
+	"github.com/vorteil/vorteil/pkg/vio"
+)
+
+type node struct {
+	tree     *vio.TreeNode
+	parent   *node
+	children []*node
+	typ      uint8
+	nid      uint64
+	ino      uint32
+
+	// size is the inode's size: the size of a regular file, the length of
+	// a symlink's target, or the size of a directory's listing.
+	size int64
+
+	// inline is set if the data is stored right after the inode rather than
+	// in blocks of its own starting at block.
+	inline bool
+	block  uint32
+	blocks int64
+
+	// target is a symlink's target.
+	target string
+}
+
+// CompilerArgs organizes all inputs necessary to create a new Compiler.
+type CompilerArgs struct {
+	FileTree vio.FileTree
+	Logger   elog.Logger
+
+	// UUID is written to the superblock to identify the file-system.
+	UUID [16]byte
+
+	// Label is the volume name written to the superblock. It can be no more
+	// than MaxLabelLength bytes.
+	Label string
+}
+
+// Compiler builds a read-only EROFS file-system. Compilation happens in the
+// same stages as the other file-system compilers: NewCompiler, Commit,
+// Precompile, Compile. Nothing is compressed, so Commit can lay out the whole
+// file-system without reading the contents of any files, and Compile copies
+// them straight into their blocks.
+//
+// Every inode is stored in the metadata area after the superblock, with
+// directories and symlinks small enough to fit stored in the same block as
+// their inodes. Everything else is stored in whole blocks after the
+// metadata area, in the order the tree is walked.
+type Compiler struct {
+	log   elog.Logger
+	tree  vio.FileTree
+	uuid  [16]byte
+	label string
+
+	// timestamp is written to the superblock and every inode instead of the
+	// current time, if it is set.
+	timestamp time.Time
+
+	nodes      []*node
+	metaBlocks int64
+	blocks     int64
+	size       int64
+}
+
+// NewCompiler returns an initialized Compiler object. Its contents can be
+// modified with Mkdir and AddFile before calling Commit.
+func NewCompiler(args *CompilerArgs) *Compiler {
+	return &Compiler{
+		log:   args.Logger,
+		tree:  args.FileTree,
+		uuid:  args.UUID,
+		label: args.Label,
+	}
+}
+
+// Mkdir adds an empty directory to the file-system at 'path' if no file or
+// directory is already mapped there. It must be called before Commit.
+func (c *Compiler) Mkdir(path string) error {
+
+	_, base := filepath.Split(path)
+	err := c.tree.Map(path, vio.CustomFile(vio.CustomFileArgs{
+		Name:  base,
+		IsDir: true,
+	}))
+	if err != nil {
+		return err
+	}
+
+	return nil
+
+}
+
+// AddFile adds a file to the file-system at 'path'. It must be called before
+// Commit.
+func (c *Compiler) AddFile(path string, r io.ReadCloser, size int64, force bool) error {
+
+	_, base := filepath.Split(path)
+	err := c.tree.Map(path, vio.CustomFile(vio.CustomFileArgs{
+		Name:       base,
+		Size:       int(size),
+		ReadCloser: r,
+	}))
+	if err != nil {
+		return err
+	}
+
+	return nil
+
+}
+
+// IncreaseMinimumInodes does nothing, because an EROFS file-system can't be
+// written to, so there's no point in reserving inodes for later.
+func (c *Compiler) IncreaseMinimumInodes(inodes int64) {
+}
+
+// SetMinimumInodes does nothing, for the same reason as IncreaseMinimumInodes.
+func (c *Compiler) SetMinimumInodes(inodes int64) {
+}
+
+// SetMinimumInodesPer64MiB does nothing, for the same reason as
+// IncreaseMinimumInodes.
+func (c *Compiler) SetMinimumInodesPer64MiB(inodes int64) {
+}
+
+// IncreaseMinimumFreeSpace does nothing, because an EROFS file-system can't
+// be written to, so free space inside it would be wasted.
+func (c *Compiler) IncreaseMinimumFreeSpace(space int64) {
+}
+
+// Reproduce makes the Compiler write t to the superblock and every inode
+// instead of the current time. The seed is unused, because the UUID is only
+// ever the one given to NewCompiler.
+func (c *Compiler) Reproduce(seed int64, t time.Time) {
+	c.timestamp = t
+}
+
+// Commit reads the targets of symlinks and lays out the file-system, after
+// which MinimumSize returns its exact size. Any calls to functions that
+// change the contents of the file-system must be done before this function is
+// called.
+func (c *Compiler) Commit(ctx context.Context) error {
+
+	if c.timestamp.IsZero() {
+		c.timestamp = time.Now()
+	}
+
+	if len(c.label) > MaxLabelLength {
+		return fmt.Errorf("erofs volume label '%s' is longer than %d bytes", c.label, MaxLabelLength)
+	}
+
+	nodes := make(map[*vio.TreeNode]*node)
+	c.nodes = nil
+
+	err := c.tree.WalkNode(func(path string, n *vio.TreeNode) error {
+
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		x := &node{tree: n, typ: fileType(n.File)}
+		nodes[n] = x
+		c.nodes = append(c.nodes, x)
+		x.ino = uint32(len(c.nodes))
+
+		if n.Parent == nil || n.Parent == n {
+			x.parent = x
+		} else {
+			x.parent = nodes[n.Parent]
+			x.parent.children = append(x.parent.children, x)
+			if name := n.File.Name(); len(name) == 0 || len(name) > MaxNameLength {
+				return fmt.Errorf("invalid file name '%s'", name)
+			}
+		}
+
+		switch x.typ {
+		case typeRegular:
+			x.size = int64(n.File.Size())
+		case typeSymlink:
+			x.target = n.File.Symlink()
+			if !n.File.SymlinkIsCached() {
+				data, err := ioutil.ReadAll(n.File)
+				if err != nil {
+					return fmt.Errorf("failed to read '%s': %w", path, err)
+				}
+				x.target = string(data)
+			}
+			_ = n.File.Close()
+			x.size = int64(len(x.target))
+		}
+
+		return nil
+
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, x := range c.nodes {
+		if x.typ == typeDir {
+			sort.Slice(x.children, func(i, j int) bool {
+				return x.children[i].tree.File.Name() < x.children[j].tree.File.Name()
+			})
+			x.size = int64(len(c.listing(x)))
+		}
+	}
+
+	return c.layout()
+
+}
+
+// layout places every inode in the metadata area, followed by any data that
+// isn't stored with its inode. The root directory is walked first, so it
+// always gets the first inode, which keeps its number within the 16 bits the
+// superblock has room for.
+func (c *Compiler) layout() error {
+
+	var offset int64
+
+	for _, x := range c.nodes {
+
+		tail := int64(0)
+		if (x.typ == typeDir || x.typ == typeSymlink) && x.size <= maxInline {
+			x.inline = true
+			tail = x.size
+			if offset%BlockSize+inodeSize+tail > BlockSize {
+				offset = align(offset, BlockSize)
+			}
+		}
+
+		x.nid = uint64(offset / slotSize)
+		offset = align(offset+inodeSize+tail, slotSize)
+
+	}
+
+	c.metaBlocks = align(offset, BlockSize) / BlockSize
+	c.blocks = metaBlock + c.metaBlocks
+
+	for _, x := range c.nodes {
+
+		if x.inline || x.typ == typeRegular && x.size == 0 || x.typ != typeRegular && x.typ != typeDir && x.typ != typeSymlink {
+			continue
+		}
+
+		x.block = uint32(c.blocks)
+		x.blocks = align(x.size, BlockSize) / BlockSize
+		c.blocks += x.blocks
+
+		if c.blocks > math.MaxUint32 {
+			return errors.New("contents are too big for an erofs file-system")
+		}
+
+	}
+
+	return nil
+
+}
+
+// listing returns the contents of a directory, which is divided into blocks
+// that each start with the entries stored in them followed by their names.
+// Entries are sorted by name across every block, including the '.' and '..'
+// entries, so that names can be found with a binary search. Every block but
+// the last is padded out to the full block size.
+func (c *Compiler) listing(n *node) []byte {
+
+	type entry struct {
+		name string
+		node *node
+	}
+
+	entries := []entry{{".", n}, {"..", n.parent}}
+	for _, child := range n.children {
+		entries = append(entries, entry{child.tree.File.Name(), child})
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].name < entries[j].name
+	})
+
+	out := new(bytes.Buffer)
+
+	for len(entries) > 0 {
+
+		k, used := 0, 0
+		for ; k < len(entries) && used+direntSize+len(entries[k].name) <= BlockSize; k++ {
+			used += direntSize + len(entries[k].name)
+		}
+
+		if out.Len() > 0 {
+			out.Write(make([]byte, align(int64(out.Len()), BlockSize)-int64(out.Len())))
+		}
+
+		nameoff := k * direntSize
+		for _, e := range entries[:k] {
+			_ = binary.Write(out, binary.LittleEndian, &dirent{
+				NID:      e.node.nid,
+				NameOff:  uint16(nameoff),
+				FileType: e.node.typ,
+			})
+			nameoff += len(e.name)
+		}
+
+		for _, e := range entries[:k] {
+			out.WriteString(e.name)
+		}
+
+		entries = entries[k:]
+
+	}
+
+	return out.Bytes()
+
+}
+
+// MinimumSize returns the number of bytes needed to contain the file-system.
+// It can be called after a successful call to Commit.
+func (c *Compiler) MinimumSize() int64 {
+	return c.blocks * BlockSize
+}
+
+// Precompile locks in the size of the space the file-system is written to.
+// Anything after the file-system itself is left as a hole.
+func (c *Compiler) Precompile(ctx context.Context, size int64) error {
+
+	if size < c.MinimumSize() {
+		return errors.New("insufficient size to contain the erofs file-system")
+	}
+
+	c.size = size
+	return nil
+
+}
+
+// RegionIsHole reports whether a region of the space passed to Precompile is
+// entirely after the end of the file-system.
+func (c *Compiler) RegionIsHole(begin, size int64) bool {
+	return begin >= c.MinimumSize()
+}
+
+func (c *Compiler) superblock() *superblock {
+
+	super := &superblock{
+		Magic:         Magic,
+		BlockSizeBits: BlockLog,
+		RootNID:       uint16(c.nodes[0].nid),
+		Inodes:        uint64(len(c.nodes)),
+		BuildTime:     uint64(c.timestamp.Unix()),
+		BuildTimeNsec: uint32(c.timestamp.Nanosecond()),
+		Blocks:        uint32(c.blocks),
+		MetaBlockAddr: metaBlock,
+		UUID:          c.uuid,
+	}
+	copy(super.VolumeName[:], c.label)
+
+	return super
+
+}
+
+func (c *Compiler) inode(n *node) *inode {
+
+	own := n.tree.File.Ownership()
+	if own == nil {
+		own = &vio.DefaultOwnership
+	}
+
+	layout := uint16(layoutFlatPlain)
+	if n.inline {
+		layout = layoutFlatInline
+	}
+
+	x := &inode{
+		Format:    formatExtended | layout<<1,
+		Mode:      typeModes[n.typ] | uint16(own.Mode&vio.ModeMask),
+		Size:      uint64(n.size),
+		Union:     n.block,
+		Ino:       n.ino,
+		UID:       own.UID,
+		GID:       own.GID,
+		Mtime:     uint64(c.timestamp.Unix()),
+		MtimeNsec: uint32(c.timestamp.Nanosecond()),
+		Links:     uint32(n.tree.Links),
+	}
+
+	if n.typ == typeBlockDevice || n.typ == typeCharDevice {
+		major, minor := n.tree.File.Device()
+		x.Union = minor&0xff | major<<8 | (minor&^0xff)<<12
+	}
+
+	return x
+
+}
+
+// data returns the contents of a directory or symlink.
+func (c *Compiler) data(n *node) []byte {
+
+	if n.typ == typeDir {
+		return c.listing(n)
+	}
+
+	return []byte(n.target)
+
+}
+
+// writeMetadata writes every inode, along with the data stored with them.
+func (c *Compiler) writeMetadata(ctx context.Context, w io.Writer) error {
+
+	var offset int64
+
+	for _, x := range c.nodes {
+
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		buf := new(bytes.Buffer)
+		buf.Write(make([]byte, int64(x.nid)*slotSize-offset))
+		_ = binary.Write(buf, binary.LittleEndian, c.inode(x))
+		if x.inline {
+			buf.Write(c.data(x))
+		}
+
+		_, err := w.Write(buf.Bytes())
+		if err != nil {
+			return err
+		}
+
+		offset += int64(buf.Len())
+
+	}
+
+	_, err := io.CopyN(w, vio.Zeroes, c.metaBlocks*BlockSize-offset)
+	if err != nil {
+		return err
+	}
+
+	return nil
+
+}
+
+// writeData copies the contents of a regular file, directory or symlink into
+// its blocks.
+func (c *Compiler) writeData(w io.Writer, n *node) error {
+
+	if n.typ == typeRegular {
+		defer n.tree.File.Close()
+		_, err := io.CopyN(w, n.tree.File, n.size)
+		if err != nil {
+			return fmt.Errorf("failed to read '%s': %w", n.tree.Path(), err)
+		}
+	} else {
+		_, err := w.Write(c.data(n))
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err := io.CopyN(w, vio.Zeroes, n.blocks*BlockSize-n.size)
+	if err != nil {
+		return err
+	}
+
+	return nil
+
+}
+
+// Compile writes the file-system to w.
+func (c *Compiler) Compile(ctx context.Context, w io.WriteSeeker) error {
+
+	_, err := w.Write(make([]byte, SuperblockOffset))
+	if err != nil {
+		return err
+	}
+
+	err = c.superblock().write(w)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(make([]byte, metaBlock*BlockSize-SuperblockOffset-SuperblockSize))
+	if err != nil {
+		return err
+	}
+
+	err = c.writeMetadata(ctx, w)
+	if err != nil {
+		return err
+	}
+
+	for _, x := range c.nodes {
+
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+
+		if x.blocks > 0 {
+			err = c.writeData(w, x)
+			if err != nil {
+				return err
+			}
+		} else if x.typ == typeRegular {
+			_ = x.tree.File.Close()
+		}
+
+	}
+
+	_, err = w.Seek(c.size, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	return nil
+
+}
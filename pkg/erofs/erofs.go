@@ -0,0 +1,182 @@
+// Package erofs builds uncompressed EROFS file-systems: read-only
+// file-systems that Linux can mount directly. Unlike SquashFS, every file's
+// contents are stored in whole, contiguous blocks, so any part of a file can
+// be read with a single request to the disk and without decompressing
+// anything. That suits root file-systems for workloads that read files in
+// no particular order, like containers.
+package erofs
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"encoding/binary"
+	"io"
+	"os"
+
+	"github.com/vorteil/vorteil/pkg/vio"
+)
+
+const (
+	// Magic identifies an EROFS superblock.
+	Magic = 0xE0F5E1E2
+
+	// BlockLog is the base 2 logarithm of BlockSize.
+	BlockLog = 12
+
+	// BlockSize is the size of the blocks the file-system is divided into.
+	BlockSize = 1 << BlockLog
+
+	// SuperblockOffset is where the superblock is found in the first block.
+	SuperblockOffset = 1024
+
+	// SuperblockSize is the size of the superblock.
+	SuperblockSize = 128
+
+	// MaxLabelLength is the longest volume label an EROFS file-system can
+	// have.
+	MaxLabelLength = 16
+
+	// MaxNameLength is the longest name a file can have.
+	MaxNameLength = 255
+
+	// metaBlock is the first block of the metadata area, which holds every
+	// inode. Inodes are identified by their offset into it in slots.
+	metaBlock = 1
+
+	// slotSize is the unit inodes are addressed and aligned in.
+	slotSize = 32
+
+	// inodeSize is the size of an extended inode, which is the only kind
+	// this package writes, so that every inode has a timestamp and 32 bit
+	// owners.
+	inodeSize = 64
+
+	// direntSize is the size of a directory entry, not counting its name.
+	direntSize = 12
+
+	// maxInline is the most data that can be stored in the same block as
+	// the inode it belongs to.
+	maxInline = BlockSize - inodeSize
+)
+
+// inode data layouts
+const (
+	layoutFlatPlain  = 0
+	layoutFlatInline = 2
+)
+
+// i_format version of an extended inode
+const formatExtended = 1
+
+// file types recorded in directory entries
+const (
+	typeUnknown = iota
+	typeRegular
+	typeDir
+	typeCharDevice
+	typeBlockDevice
+	typeFIFO
+	typeSocket
+	typeSymlink
+)
+
+// file type bits of an inode's mode
+const (
+	modeFIFO        = 0x1000
+	modeCharDevice  = 0x2000
+	modeDir         = 0x4000
+	modeBlockDevice = 0x6000
+	modeRegular     = 0x8000
+	modeSymlink     = 0xA000
+)
+
+type superblock struct {
+	Magic             uint32
+	Checksum          uint32
+	FeatureCompat     uint32
+	BlockSizeBits     uint8
+	ExtSlots          uint8
+	RootNID           uint16
+	Inodes            uint64
+	BuildTime         uint64
+	BuildTimeNsec     uint32
+	Blocks            uint32
+	MetaBlockAddr     uint32
+	XattrBlockAddr    uint32
+	UUID              [16]byte
+	VolumeName        [16]byte
+	FeatureIncompat   uint32
+	ComprAlgs         uint16
+	ExtraDevices      uint16
+	DevtSlotOffset    uint16
+	DirBlockBits      uint8
+	XattrPrefixCount  uint8
+	XattrPrefixStart  uint32
+	PackedNID         uint64
+	XattrFilterReserv uint8
+	Reserved          [23]byte
+}
+
+func (s *superblock) write(w io.Writer) error {
+	return binary.Write(w, binary.LittleEndian, s)
+}
+
+type inode struct {
+	Format     uint16
+	XattrCount uint16
+	Mode       uint16
+	Reserved   uint16
+	Size       uint64
+	Union      uint32
+	Ino        uint32
+	UID        uint32
+	GID        uint32
+	Mtime      uint64
+	MtimeNsec  uint32
+	Links      uint32
+	Reserved2  [16]byte
+}
+
+type dirent struct {
+	NID      uint64
+	NameOff  uint16
+	FileType uint8
+	Reserved uint8
+}
+
+func align(x, y int64) int64 {
+	return (x + y - 1) / y * y
+}
+
+// fileType returns the type of f, as recorded in directory entries.
+func fileType(f vio.File) uint8 {
+
+	switch {
+	case f.IsDir():
+		return typeDir
+	case f.IsSymlink():
+		return typeSymlink
+	case f.Special() == os.ModeDevice:
+		return typeBlockDevice
+	case f.Special() == os.ModeDevice|os.ModeCharDevice:
+		return typeCharDevice
+	case f.Special() == os.ModeNamedPipe:
+		return typeFIFO
+	default:
+		return typeRegular
+	}
+
+}
+
+// typeModes are the file type bits of the mode of each type of inode.
+var typeModes = map[uint8]uint16{
+	typeRegular:     modeRegular,
+	typeDir:         modeDir,
+	typeCharDevice:  modeCharDevice,
+	typeBlockDevice: modeBlockDevice,
+	typeFIFO:        modeFIFO,
+	typeSymlink:     modeSymlink,
+}
@@ -0,0 +1,288 @@
+package erofs
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vorteil/vorteil/pkg/vio"
+)
+
+// image reads back the parts of a compiled file-system the tests need.
+type image []byte
+
+func (img image) inode(t *testing.T, nid uint64) *inode {
+
+	x := new(inode)
+	off := metaBlock*BlockSize + int64(nid)*slotSize
+	err := binary.Read(bytes.NewReader(img[off:]), binary.LittleEndian, x)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return x
+
+}
+
+func (img image) data(t *testing.T, nid uint64) []byte {
+
+	x := img.inode(t, nid)
+	if x.Format>>1 == layoutFlatInline {
+		off := metaBlock*BlockSize + int64(nid)*slotSize + inodeSize
+		if off/BlockSize != (off+int64(x.Size)-1)/BlockSize {
+			t.Errorf("inline data of inode %d crosses a block boundary", nid)
+		}
+		return img[off : off+int64(x.Size)]
+	}
+
+	off := int64(x.Union) * BlockSize
+	return img[off : off+int64(x.Size)]
+
+}
+
+// readdir returns the entries of a directory in the order they're stored.
+func (img image) readdir(t *testing.T, nid uint64) ([]string, map[string]dirent) {
+
+	data := img.data(t, nid)
+	var names []string
+	entries := make(map[string]dirent)
+
+	for len(data) > 0 {
+
+		block := data
+		if len(block) > BlockSize {
+			block = block[:BlockSize]
+		}
+		data = data[len(block):]
+
+		count := int(binary.LittleEndian.Uint16(block[8:])) / direntSize
+		des := make([]dirent, count)
+		err := binary.Read(bytes.NewReader(block), binary.LittleEndian, des)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i, de := range des {
+			end := len(block)
+			if i+1 < count {
+				end = int(des[i+1].NameOff)
+			}
+			name := strings.TrimRight(string(block[de.NameOff:end]), "\x00")
+			names = append(names, name)
+			entries[name] = de
+		}
+
+	}
+
+	return names, entries
+
+}
+
+func TestListing(t *testing.T) {
+
+	tree := vio.NewFileTree()
+	for i := 0; i < 500; i++ {
+		name := fmt.Sprintf("/dir/%04d", i)
+		err := tree.Map(name, vio.CustomFile(vio.CustomFileArgs{
+			Name:  name[5:],
+			IsDir: true,
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c := NewCompiler(&CompilerArgs{FileTree: tree})
+	err := c.Commit(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := c.nodes[1]
+	if dir.inline || dir.blocks != 2 {
+		t.Fatalf("502 entries should take two blocks: %+v", dir)
+	}
+
+	// each block has as many entries as fit in it
+	perBlock := BlockSize / (direntSize + 4)
+	if dir.size != BlockSize+int64((502-perBlock)*(direntSize+4)) {
+		t.Errorf("directory has the wrong size: %d", dir.size)
+	}
+
+	data := c.listing(dir)
+	if len(data) != int(dir.size) {
+		t.Errorf("listing is %d bytes, but the directory is %d", len(data), dir.size)
+	}
+
+	if binary.LittleEndian.Uint16(data[8:]) != uint16(perBlock*direntSize) {
+		t.Errorf("first block has the wrong number of entries")
+	}
+
+	// '.' and '..' sort before the digits
+	if string(data[perBlock*direntSize:perBlock*direntSize+3]) != "..." {
+		t.Errorf("first names should be '.' and '..': %q", data[perBlock*direntSize:perBlock*direntSize+8])
+	}
+
+}
+
+func TestCompile(t *testing.T) {
+
+	tree := vio.NewFileTree()
+	data := []byte(strings.Repeat("vorteil", BlockSize/2))
+	target := strings.Repeat("x/", BlockSize/2)
+
+	for path, args := range map[string]vio.CustomFileArgs{
+		"/a": {
+			Size:       len(data),
+			ReadCloser: ioutil.NopCloser(bytes.NewReader(data)),
+			Ownership:  &vio.Ownership{UID: 1, GID: 2, Mode: 0644},
+		},
+		"/b": {
+			ReadCloser: ioutil.NopCloser(bytes.NewReader(nil)),
+		},
+		"/c": {
+			IsSymlink: true,
+			Symlink:   "a",
+		},
+		"/d": {
+			IsSymlink: true,
+			Symlink:   target,
+		},
+	} {
+		args.Name = path[1:]
+		err := tree.Map(path, vio.CustomFile(args))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c := NewCompiler(&CompilerArgs{
+		FileTree: tree,
+		UUID:     [16]byte{1, 2, 3},
+		Label:    "root",
+	})
+	err := c.Mkdir("dev")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.Reproduce(0, time.Unix(1000, 0))
+
+	ctx := context.Background()
+	err = c.Commit(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	size := c.MinimumSize()
+	if size%BlockSize != 0 {
+		t.Errorf("minimum size %d isn't a whole number of blocks", size)
+	}
+
+	err = c.Precompile(ctx, size-BlockSize)
+	if err == nil {
+		t.Errorf("precompile accepted a size that's too small")
+	}
+
+	err = c.Precompile(ctx, size+BlockSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.RegionIsHole(0, BlockSize) || !c.RegionIsHole(size, BlockSize) {
+		t.Errorf("holes are in the wrong place")
+	}
+
+	f, err := ioutil.TempFile("", "erofs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	err = c.Compile(ctx, f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	raw, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	img := image(raw)
+
+	if int64(len(img)) != size {
+		t.Errorf("wrote %d bytes, but the file-system is %d", len(img), size)
+	}
+
+	super := new(superblock)
+	err = binary.Read(bytes.NewReader(img[SuperblockOffset:]), binary.LittleEndian, super)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if super.Magic != Magic || super.BlockSizeBits != BlockLog || super.MetaBlockAddr != metaBlock {
+		t.Errorf("superblock is wrong: %+v", super)
+	}
+
+	if super.Inodes != 6 || super.BuildTime != 1000 || int64(super.Blocks)*BlockSize != size {
+		t.Errorf("expected 6 inodes, the reproducible time and %d bytes: %+v", size, super)
+	}
+
+	if super.UUID != [16]byte{1, 2, 3} || string(bytes.TrimRight(super.VolumeName[:], "\x00")) != "root" {
+		t.Errorf("superblock has the wrong identifiers: %+v", super)
+	}
+
+	names, entries := img.readdir(t, uint64(super.RootNID))
+	if strings.Join(names, " ") != ". .. a b c d dev" {
+		t.Fatalf("root directory has the wrong entries: %v", names)
+	}
+
+	if entries[".."].NID != uint64(super.RootNID) || entries["dev"].FileType != typeDir || entries["c"].FileType != typeSymlink {
+		t.Errorf("root directory entries are wrong: %+v", entries)
+	}
+
+	a := img.inode(t, entries["a"].NID)
+	if a.Mode != modeRegular|0644 || a.UID != 1 || a.GID != 2 || a.Mtime != 1000 {
+		t.Errorf("file has the wrong inode: %+v", a)
+	}
+
+	if !bytes.Equal(img.data(t, entries["a"].NID), data) {
+		t.Errorf("file has the wrong contents")
+	}
+
+	if img.inode(t, entries["b"].NID).Size != 0 {
+		t.Errorf("empty file has a size")
+	}
+
+	c1 := img.inode(t, entries["c"].NID)
+	if c1.Format>>1 != layoutFlatInline || string(img.data(t, entries["c"].NID)) != "a" {
+		t.Errorf("short symlink should be stored with its inode: %+v", c1)
+	}
+
+	d := img.inode(t, entries["d"].NID)
+	if d.Format>>1 != layoutFlatPlain || string(img.data(t, entries["d"].NID)) != target {
+		t.Errorf("long symlink should be stored in its own block: %+v", d)
+	}
+
+}
+
+func TestLabelTooLong(t *testing.T) {
+
+	c := NewCompiler(&CompilerArgs{
+		FileTree: vio.NewFileTree(),
+		Label:    strings.Repeat("x", MaxLabelLength+1),
+	})
+
+	err := c.Commit(context.Background())
+	if err == nil {
+		t.Errorf("expected an error for a label that's too long")
+	}
+
+}
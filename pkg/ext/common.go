@@ -10,6 +10,7 @@ import (
 	"encoding/binary"
 	"errors"
 	"io"
+	"os"
 	"path"
 
 	"github.com/vorteil/vorteil/pkg/vio"
@@ -36,7 +37,10 @@ const (
 
 	RootDirInode = 2
 
+	InodeTypeFIFO               = 0x1000
+	InodeTypeCharDevice         = 0x2000
 	InodeTypeDirectory          = 0x4000
+	InodeTypeBlockDevice        = 0x6000
 	InodeTypeRegularFile        = 0x8000
 	InodeTypeSymlink            = 0xA000
 	InodeTypeMask               = 0xF000
@@ -49,6 +53,7 @@ const (
 	inodeSymlinkPermissions     = InodeTypeSymlink | DefaultInodePermissions
 
 	IncompatFiletype = 0x2
+	Incompat64Bit    = 0x80
 )
 
 // Superblock is the structure of a superblock as written to the disk.
@@ -79,7 +84,7 @@ type Superblock struct {
 	SuperUser           uint16
 	SuperGroup          uint16
 	_                   uint32
-	_                   uint16
+	InodeSize           uint16 // zero in revision 0 file-systems
 	_                   uint16
 	_                   uint32
 	RequiredFeatures    uint32
@@ -270,9 +275,45 @@ func calculateDirectoryBlocks(n *vio.TreeNode) (int64, int64) {
 const (
 	ftypeRegularFile = 0x1
 	ftypeDir         = 0x2
+	ftypeCharDevice  = 0x3
+	ftypeBlockDevice = 0x4
+	ftypeFIFO        = 0x5
 	ftypeSymlink     = 0x7
 )
 
+func fileType(f vio.File) uint8 {
+
+	switch {
+	case f.IsDir():
+		return ftypeDir
+	case f.IsSymlink():
+		return ftypeSymlink
+	case f.Special() == os.ModeNamedPipe:
+		return ftypeFIFO
+	case f.Special()&os.ModeCharDevice != 0:
+		return ftypeCharDevice
+	case f.Special() != 0:
+		return ftypeBlockDevice
+	default:
+		return ftypeRegularFile
+	}
+
+}
+
+// specialInodeType returns the inode type of a device node or named pipe.
+func specialInodeType(f vio.File) uint16 {
+
+	switch fileType(f) {
+	case ftypeFIFO:
+		return InodeTypeFIFO
+	case ftypeCharDevice:
+		return InodeTypeCharDevice
+	default:
+		return InodeTypeBlockDevice
+	}
+
+}
+
 type dirTuple struct {
 	name  string
 	inode uint32
@@ -286,14 +327,7 @@ func generateDirectoryData(node *nodeBlocks) (io.Reader, error) {
 	tuples = append(tuples, &dirTuple{name: "..", inode: uint32(node.node.Parent.NodeSequenceNumber), ftype: ftypeDir})
 
 	for _, child := range node.node.Children {
-		var ftype uint8
-		if child.File.IsDir() {
-			ftype = ftypeDir
-		} else if child.File.IsSymlink() {
-			ftype = ftypeSymlink
-		} else {
-			ftype = ftypeRegularFile
-		}
+		ftype := fileType(child.File)
 		tuples = append(tuples, &dirTuple{name: path.Base(child.File.Name()), inode: uint32(child.NodeSequenceNumber), ftype: ftype})
 	}
 
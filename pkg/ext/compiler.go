@@ -11,8 +11,10 @@ import (
 	"encoding/binary"
 	"errors"
 	"io"
+	"os"
 	"time"
 
+	"github.com/vorteil/vorteil/pkg/elog"
 	"github.com/vorteil/vorteil/pkg/vio"
 )
 
@@ -25,6 +27,10 @@ type compiler struct {
 
 	superblock Superblock
 	bgdt       []byte
+
+	// timestamp is written to the superblock instead of the current time,
+	// if it is set.
+	timestamp time.Time
 }
 
 func (c *compiler) calculateMinimumSize(ctx context.Context, minDataBlocks, minInodes, minInodesPer64 int64) (int64, error) {
@@ -119,7 +125,10 @@ retry:
 }
 
 func (c *compiler) initSuperblock() {
-	now := time.Now()
+	now := c.timestamp
+	if now.IsZero() {
+		now = time.Now()
+	}
 	c.superblock.LastMountTime = uint32(now.Unix())
 	c.superblock.LastWrittenTime = uint32(now.Unix())
 	c.superblock.MountsCheckInterval = 20
@@ -322,6 +331,24 @@ func (c *compiler) setInodePointers(ino int64, inode *Inode) {
 
 }
 
+// setInodeDevice stores the device number of a device node the same way
+// Linux does: in the first direct pointer if the old 8-bit format can hold it,
+// or in the second otherwise.
+func setInodeDevice(f vio.File, inode *Inode) {
+
+	if f.Special()&os.ModeDevice == 0 {
+		return
+	}
+
+	major, minor := f.Device()
+	if major < 256 && minor < 256 {
+		inode.DirectPointer[0] = major<<8 | minor
+	} else {
+		inode.DirectPointer[1] = minor&0xff | major<<8 | (minor&^0xff)<<12
+	}
+
+}
+
 func (c *compiler) writeInode(ino int64, w io.Writer) error {
 
 	inode := &Inode{}
@@ -343,6 +370,8 @@ func (c *compiler) writeInode(ino int64, w io.Writer) error {
 	} else if node.node.File.IsSymlink() {
 		inode.SizeLower = uint32(node.node.File.Size())
 		inode.Permissions = inodeSymlinkPermissions
+	} else if node.node.File.Special() != 0 {
+		inode.Permissions = specialInodeType(node.node.File) | DefaultInodePermissions
 	} else {
 		inode.SizeLower = uint32(node.node.File.Size())
 		inode.Permissions = inodeRegularFilePermissions
@@ -362,6 +391,7 @@ func (c *compiler) writeInode(ino int64, w io.Writer) error {
 	inode.GID = SuperGID
 	inode.Sectors = node.fs * (BlockSize / SectorSize)
 	c.setInodePointers(ino, inode)
+	setInodeDevice(node.node.File, inode)
 
 	err := binary.Write(w, binary.LittleEndian, inode)
 	if err != nil {
@@ -389,7 +419,7 @@ func (c *compiler) writeInodeTable(w io.WriteSeeker, g int64) error {
 	return nil
 }
 
-func (c *compiler) writeDataBlocks(ctx context.Context, w io.WriteSeeker, g int64) error {
+func (c *compiler) writeDataBlocks(ctx context.Context, w io.WriteSeeker, g int64, progress elog.Progress) error {
 
 	first := g*c.blocksPerGroup + c.overheadBlocksPerGroup
 	last := (g+1)*c.blocksPerGroup - 1
@@ -402,6 +432,8 @@ func (c *compiler) writeDataBlocks(ctx context.Context, w io.WriteSeeker, g int6
 		return err
 	}
 
+	rf, zeroCopy := w.(io.ReaderFrom)
+
 	for block := first; block <= last; block++ {
 
 		err := ctx.Err()
@@ -409,6 +441,18 @@ func (c *compiler) writeDataBlocks(ctx context.Context, w io.WriteSeeker, g int6
 			return err
 		}
 
+		if zeroCopy {
+			k, err := c.copyLocalBlocks(w, rf, last-block+1)
+			if err != nil {
+				return err
+			}
+			if k > 0 {
+				progress.Increment(k * BlockSize)
+				block += k - 1
+				continue
+			}
+		}
+
 		err = c.writeNextDataBlock(w, c.mapDBtoBlockAddr)
 		if err != nil {
 			if err == io.EOF {
@@ -416,6 +460,7 @@ func (c *compiler) writeDataBlocks(ctx context.Context, w io.WriteSeeker, g int6
 			}
 			return err
 		}
+		progress.Increment(BlockSize)
 	}
 
 	return nil
@@ -474,14 +519,15 @@ func (c *compiler) writeBlockGroupMetadata(w io.WriteSeeker, g int64) error {
 
 }
 
-func (c *compiler) writeBlockGroup(ctx context.Context, w io.WriteSeeker, g int64) error {
+func (c *compiler) writeBlockGroup(ctx context.Context, w io.WriteSeeker, g int64, inodeProgress, dataProgress elog.Progress) error {
 
 	err := c.writeBlockGroupMetadata(w, g)
 	if err != nil {
 		return err
 	}
+	inodeProgress.Increment(c.inodesPerGroup)
 
-	err = c.writeDataBlocks(ctx, w, g)
+	err = c.writeDataBlocks(ctx, w, g, dataProgress)
 	if err != nil {
 		return err
 	}
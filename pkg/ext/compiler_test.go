@@ -0,0 +1,116 @@
+package ext
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/vorteil/vorteil/pkg/elog"
+	"github.com/vorteil/vorteil/pkg/vio"
+)
+
+func compileTestDirectory(t *testing.T, dir string, w io.WriteSeeker) int64 {
+
+	tree, err := vio.FileTreeFromDirectory(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := NewCompiler(&CompilerArgs{
+		FileTree: tree,
+		Logger:   &elog.CLI{},
+	})
+
+	c.IncreaseMinimumFreeSpace(0x800000)
+
+	err = c.Commit(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = c.Precompile(context.Background(), c.MinimumSize())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.superblock.LastMountTime = 0
+	c.superblock.LastWrittenTime = 0
+	c.superblock.TimeLastCheck = 0
+
+	err = c.Compile(context.Background(), w)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return c.size
+
+}
+
+func TestZeroCopyCompile(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "ext")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// include a file large enough to need doubly indirect pointers
+	for i, size := range []int{0, 100, BlockSize, 5000, 200000, 5000000} {
+		data := bytes.Repeat([]byte{byte(i + 1)}, size)
+		err = ioutil.WriteFile(filepath.Join(dir, strings.Repeat("x", i+1)), data, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// an io.Writer that hides any io.ReaderFrom implementation
+	buf := new(bytes.Buffer)
+	w, err := vio.WriteSeeker(struct{ io.Writer }{buf})
+	if err != nil {
+		t.Fatal(err)
+	}
+	compileTestDirectory(t, dir, w)
+
+	f, err := ioutil.TempFile("", "ext")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	w, err = vio.WriteSeeker(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := compileTestDirectory(t, dir, w)
+
+	err = f.Truncate(size)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = f.Seek(0, io.SeekStart)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(data, buf.Bytes()) {
+		t.Errorf("file-system copied with io.ReaderFrom differs from the normal build")
+	}
+
+}
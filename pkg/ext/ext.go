@@ -9,6 +9,7 @@ import (
 	"context"
 	"io"
 	"path/filepath"
+	"time"
 
 	"github.com/vorteil/vorteil/pkg/elog"
 	"github.com/vorteil/vorteil/pkg/vio"
@@ -119,6 +120,13 @@ func (c *Compiler) IncreaseMinimumFreeSpace(space int64) {
 	c.minFreeSpace += space
 }
 
+// Reproduce makes the Compiler write t to the superblock instead of the
+// current time. The seed is unused, because an ext2 file-system built by the
+// Compiler has no random identifiers.
+func (c *Compiler) Reproduce(seed int64, t time.Time) {
+	c.timestamp = t
+}
+
 type nodeBlocks struct {
 	node    *vio.TreeNode
 	start   int64
@@ -135,10 +143,14 @@ func (c *Compiler) Commit(ctx context.Context) error {
 
 	var err error
 
-	c.filledDataBlocks, err = c.scanInodes(ctx, c.tree)
+	progress := elog.NewProgress(c.log, "Scanning file-system", "", int64(c.tree.NodeCount()))
+	defer progress.Finish(false)
+
+	c.filledDataBlocks, err = c.scanInodes(ctx, c.tree, progress)
 	if err != nil {
 		return err
 	}
+	progress.Finish(true)
 
 	minInodes := int64(len(c.inodeBlocks)) - 1
 	minInodes += c.minFreeInodes
@@ -220,15 +232,26 @@ func (c *Compiler) Compile(ctx context.Context, w io.WriteSeeker) error {
 
 	var err error
 
+	_, c.zeroCopy = w.(io.ReaderFrom)
+
+	inodeProgress := elog.NewProgress(c.log, "Writing inodes", "", c.groups*c.inodesPerGroup)
+	defer inodeProgress.Finish(false)
+
+	dataProgress := elog.NewProgress(c.log, "Writing file data", "KiB", c.filledDataBlocks*BlockSize)
+	defer dataProgress.Finish(false)
+
 	for g := int64(0); g < c.groups; g++ {
 
-		err = c.writeBlockGroup(ctx, w, g)
+		err = c.writeBlockGroup(ctx, w, g, inodeProgress, dataProgress)
 		if err != nil {
 			return err
 		}
 
 	}
 
+	inodeProgress.Finish(true)
+	dataProgress.Finish(true)
+
 	// seek to the end of the image
 	_, err = w.Seek(c.size, io.SeekStart)
 	if err != nil {
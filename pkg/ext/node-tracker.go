@@ -10,7 +10,9 @@ import (
 	"context"
 	"encoding/binary"
 	"io"
+	"os"
 
+	"github.com/vorteil/vorteil/pkg/elog"
 	"github.com/vorteil/vorteil/pkg/vio"
 )
 
@@ -21,9 +23,16 @@ type nodeTracker struct {
 	activeNodeBlock  int64
 	activeNodeBlocks int64
 	activeNodeStart  int64
+
+	// if zeroCopy is true, activeNodeLocal is set while the active node is a
+	// file on the local file-system that can be copied into the image with
+	// an io.ReaderFrom
+	zeroCopy        bool
+	activeNodeLocal *os.File
+	activeNodeSize  int64
 }
 
-func (c *nodeTracker) scanInodes(ctx context.Context, tree vio.FileTree) (int64, error) {
+func (c *nodeTracker) scanInodes(ctx context.Context, tree vio.FileTree, progress elog.Progress) (int64, error) {
 
 	var err error
 	var ino, minInodes, contentDelta, fsDelta, filledDataBlocks int64
@@ -53,6 +62,7 @@ func (c *nodeTracker) scanInodes(ctx context.Context, tree vio.FileTree) (int64,
 		c.inodeBlocks[ino].fs = uint32(fsDelta)
 		n.NodeSequenceNumber = ino
 		filledDataBlocks += fsDelta
+		progress.Increment(1)
 
 		return nil
 
@@ -107,6 +117,7 @@ func (c *nodeTracker) prepNextDataBlock() error {
 		c.activeNodeBlock = 0
 		c.activeNodeBlocks = int64(node.fs)
 		c.activeNodeStart = int64(node.start)
+		c.activeNodeLocal = nil
 
 		// generate dir data into args.objData
 		if node.node.File.IsDir() {
@@ -119,6 +130,10 @@ func (c *nodeTracker) prepNextDataBlock() error {
 
 		} else {
 			c.activeNodeReader = node.node.File
+			if c.zeroCopy && !node.node.File.IsSymlink() {
+				c.activeNodeLocal, _ = vio.LocalFile(node.node.File)
+				c.activeNodeSize = int64(node.node.File.Size())
+			}
 		}
 
 		if c.activeNodeBlocks == 0 {
@@ -204,3 +219,62 @@ func (c *nodeTracker) writeNextDataBlock(w io.Writer, mapDBtoBlockAddr func(int6
 	return nil
 
 }
+
+type writerOnly struct {
+	io.Writer
+}
+
+// copyLocalBlocks copies a run of up to max data blocks from the active node
+// using rf, which allows the kernel to skip copying the data through
+// userspace. It returns the number of blocks written, which is zero if the
+// active node isn't a local file or the next block isn't a data block.
+func (c *nodeTracker) copyLocalBlocks(w io.Writer, rf io.ReaderFrom, max int64) (int64, error) {
+
+	err := c.prepNextDataBlock()
+	if err == io.EOF {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	if c.activeNodeLocal == nil {
+		return 0, nil
+	}
+
+	var k int64
+	for k < max && c.activeNodeBlock+k < c.activeNodeBlocks && blockType(c.activeNodeBlock+k) == 0 {
+		k++
+	}
+
+	if k == 0 {
+		return 0, nil
+	}
+
+	offset, err := c.activeNodeLocal.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+
+	length := k * BlockSize
+	if remaining := c.activeNodeSize - offset; length > remaining {
+		length = remaining
+	}
+
+	n, err := rf.ReadFrom(io.LimitReader(c.activeNodeLocal, length))
+	if err != nil {
+		return 0, err
+	}
+	if n != length {
+		return 0, io.ErrUnexpectedEOF
+	}
+
+	_, err = io.CopyN(writerOnly{w}, vio.Zeroes, k*BlockSize-length)
+	if err != nil {
+		return 0, err
+	}
+
+	c.activeNodeBlock += k
+
+	return k, nil
+
+}
@@ -0,0 +1,206 @@
+package ext4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+)
+
+// Metadata checksums (RO_COMPAT_METADATA_CSUM) protect the superblock, group
+// descriptors, bitmaps, inodes, extent tree blocks and directory blocks with
+// crc32c, the same way mke2fs does by default. Checksums of anything that
+// belongs to an inode are seeded with the file-system's UUID, the inode number
+// and its generation, which is always zero here.
+
+const (
+	ROCompatMetadataCsum = 0x400 // RO_COMPAT_METADATA_CSUM
+	ChecksumTypeCRC32C   = 1
+)
+
+// offsets of checksum fields that are patched after a structure is encoded
+const (
+	sbChecksumOffset      = 0x3FC
+	bgdChecksumOffset     = 0x1E
+	inodeChecksumOffset   = 0x7C
+	inodeExtraIsizeOffset = 0x80
+	inodeChecksumHiOffset = 0x82
+)
+
+// DirentTailSize is the size of the fake directory entry at the end of every
+// directory block that holds its checksum.
+const DirentTailSize = 12
+
+// direntTailFileType marks a directory entry as a checksum tail.
+const direntTailFileType = 0xDE
+
+// dirBlockCapacity is the number of bytes in a directory block available to
+// real directory entries.
+const dirBlockCapacity = BlockSize - DirentTailSize
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// crc32c continues a crc32c over p without the pre- and post-inversion that
+// hash/crc32 applies, which is how the kernel chains ext4 checksums.
+func crc32c(crc uint32, p []byte) uint32 {
+	return ^crc32.Update(^crc, crc32cTable, p)
+}
+
+func le16(x uint16) []byte {
+	buf := make([]byte, 2)
+	binary.LittleEndian.PutUint16(buf, x)
+	return buf
+}
+
+func le32(x uint32) []byte {
+	buf := make([]byte, 4)
+	binary.LittleEndian.PutUint32(buf, x)
+	return buf
+}
+
+// checksumSeed returns the seed for every checksum in a file-system with the
+// given UUID, other than the superblock's own.
+func checksumSeed(uuid [16]byte) uint32 {
+	return crc32c(^uint32(0), uuid[:])
+}
+
+// inodeChecksumSeed returns the seed for the checksums of an inode and the
+// blocks that belong to it.
+func inodeChecksumSeed(seed uint32, ino int64) uint32 {
+	crc := crc32c(seed, le32(uint32(ino)))
+	return crc32c(crc, le32(0)) // generation
+}
+
+// superblockChecksum returns the checksum of an encoded superblock.
+func superblockChecksum(raw []byte) uint32 {
+	return crc32c(^uint32(0), raw[:sbChecksumOffset])
+}
+
+// descriptorChecksum returns the checksum of an encoded group descriptor,
+// which is either 32 or 64 bytes long.
+func descriptorChecksum(seed uint32, g int64, raw []byte) uint16 {
+	crc := crc32c(seed, le32(uint32(g)))
+	crc = crc32c(crc, raw[:bgdChecksumOffset])
+	crc = crc32c(crc, le16(0))
+	crc = crc32c(crc, raw[bgdChecksumOffset+2:])
+	return uint16(crc)
+}
+
+// bitmapChecksum returns the checksum of the first size bytes of a block or
+// inode bitmap. Group descriptors only have room for the lower half of it
+// unless the file-system has the 64bit feature.
+func bitmapChecksum(seed uint32, bitmap []byte, size int64) uint32 {
+	return crc32c(seed, bitmap[:size])
+}
+
+// inodeChecksum returns the checksum of an encoded inode. Inodes larger than
+// 128 bytes also store the upper half of it after their extra size, if it's
+// large enough to include it.
+func inodeChecksum(seed uint32, ino int64, raw []byte) uint32 {
+
+	crc := crc32c(inodeChecksumSeed(seed, ino), raw[:inodeChecksumOffset])
+	crc = crc32c(crc, le16(0))
+	crc = crc32c(crc, raw[inodeChecksumOffset+2:inodeExtraIsizeOffset])
+
+	if len(raw) > inodeExtraIsizeOffset {
+		offset := inodeChecksumHiOffset
+		crc = crc32c(crc, raw[inodeExtraIsizeOffset:offset])
+		if inodeHasChecksumHi(raw) {
+			crc = crc32c(crc, le16(0))
+			offset += 2
+		}
+		crc = crc32c(crc, raw[offset:])
+	}
+
+	return crc
+
+}
+
+func inodeHasChecksumHi(raw []byte) bool {
+	return len(raw) > inodeExtraIsizeOffset && binary.LittleEndian.Uint16(raw[inodeExtraIsizeOffset:]) >= 4
+}
+
+// setInodeChecksum sets the checksum of an encoded inode.
+func setInodeChecksum(seed uint32, ino int64, raw []byte) {
+
+	crc := inodeChecksum(seed, ino, raw)
+	binary.LittleEndian.PutUint16(raw[inodeChecksumOffset:], uint16(crc))
+	if inodeHasChecksumHi(raw) {
+		binary.LittleEndian.PutUint16(raw[inodeChecksumHiOffset:], uint16(crc>>16))
+	}
+
+}
+
+// checksumInode encodes an inode with its checksum set.
+func checksumInode(seed uint32, ino int64, inode *Inode) []byte {
+
+	buf := new(bytes.Buffer)
+	err := binary.Write(buf, binary.LittleEndian, inode)
+	if err != nil {
+		panic(err)
+	}
+
+	raw := buf.Bytes()
+	setInodeChecksum(seed, ino, raw)
+
+	return raw
+
+}
+
+// checksumExtentBlock sets the checksum in the tail of an extent tree block,
+// which follows the maximum number of entries its header allows.
+func checksumExtentBlock(seed uint32, ino int64, block []byte) {
+
+	max := int64(binary.LittleEndian.Uint16(block[4:]))
+	offset := 12 + 12*max
+	crc := crc32c(inodeChecksumSeed(seed, ino), block[:offset])
+	binary.LittleEndian.PutUint32(block[offset:], crc)
+
+}
+
+// checksumXattrBlock sets the checksum of an extended attribute block, which
+// is seeded with the block's address instead of an inode.
+func checksumXattrBlock(seed uint32, addr int64, block []byte) {
+
+	addrBytes := make([]byte, 8)
+	binary.LittleEndian.PutUint64(addrBytes, uint64(addr))
+
+	crc := crc32c(seed, addrBytes)
+	crc = crc32c(crc, block[:xattrChecksumOffset])
+	crc = crc32c(crc, le32(0))
+	crc = crc32c(crc, block[xattrChecksumOffset+4:])
+	binary.LittleEndian.PutUint32(block[xattrChecksumOffset:], crc)
+
+}
+
+// writeDirentTail writes the fake directory entry that ends a directory
+// block, with its checksum left blank.
+func writeDirentTail(buf *bytes.Buffer) {
+
+	tail := make([]byte, DirentTailSize)
+	binary.LittleEndian.PutUint16(tail[4:], DirentTailSize)
+	tail[7] = direntTailFileType
+	buf.Write(tail)
+
+}
+
+// checksumDirectoryBlock sets the checksum in a directory block's tail.
+func checksumDirectoryBlock(seed uint32, ino int64, block []byte) {
+	crc := crc32c(inodeChecksumSeed(seed, ino), block[:dirBlockCapacity])
+	binary.LittleEndian.PutUint32(block[dirBlockCapacity+8:], crc)
+}
+
+// checksumHashDirectoryRoot sets the checksum in the tail of the root block of
+// an indexed directory, which covers the block up to its last used entry.
+func checksumHashDirectoryRoot(seed uint32, ino int64, block []byte) {
+
+	const countOffset = 0x20
+	limit := int64(binary.LittleEndian.Uint16(block[countOffset:]))
+	count := int64(binary.LittleEndian.Uint16(block[countOffset+2:]))
+	tail := countOffset + limit*8
+
+	crc := crc32c(inodeChecksumSeed(seed, ino), block[:countOffset+count*8])
+	crc = crc32c(crc, block[tail:tail+4])
+	crc = crc32c(crc, le32(0))
+	binary.LittleEndian.PutUint32(block[tail+4:], crc)
+
+}
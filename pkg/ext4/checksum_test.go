@@ -0,0 +1,121 @@
+package ext4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"testing"
+
+	"github.com/vorteil/vorteil/pkg/vio"
+)
+
+func TestCrc32c(t *testing.T) {
+
+	data := []byte("123456789")
+
+	// the kernel's crc32c skips the final inversion
+	if crc32c(^uint32(0), data) != ^crc32.Checksum(data, crc32cTable) {
+		t.Errorf("crc32c doesn't match the standard crc32c")
+	}
+
+	if crc32c(crc32c(^uint32(0), data[:4]), data[4:]) != crc32c(^uint32(0), data) {
+		t.Errorf("chained crc32c doesn't match a single crc32c")
+	}
+
+}
+
+func TestDirectoryChecksums(t *testing.T) {
+
+	p := &vio.TreeNode{
+		File: vio.CustomFile(vio.CustomFileArgs{
+			IsDir: true,
+		}),
+		NodeSequenceNumber: 2,
+		Links:              2,
+	}
+	p.Parent = p
+
+	n := &node{
+		node:    p,
+		content: 1,
+		fs:      1,
+	}
+
+	seed := checksumSeed([16]byte{1, 2, 3, 4})
+
+	r, err := generateDirectoryData(n, seed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := new(bytes.Buffer)
+	_, err = buf.ReadFrom(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+
+	if len(data) != BlockSize {
+		t.Fatalf("expected a single directory block, got %d bytes", len(data))
+	}
+
+	tail := data[dirBlockCapacity:]
+	if binary.LittleEndian.Uint16(tail[4:]) != DirentTailSize || tail[7] != direntTailFileType {
+		t.Errorf("directory block doesn't end with a checksum tail: %v", tail)
+	}
+
+	expect := crc32c(inodeChecksumSeed(seed, 2), data[:dirBlockCapacity])
+	if binary.LittleEndian.Uint32(tail[8:]) != expect {
+		t.Errorf("directory block has the wrong checksum")
+	}
+
+	// '..' must stop short of the tail
+	if binary.LittleEndian.Uint16(data[16:]) != dirBlockCapacity-12 {
+		t.Errorf("last directory entry overlaps the checksum tail")
+	}
+
+}
+
+func TestSuperblockChecksum(t *testing.T) {
+
+	blocks := int64(BlocksPerGroup*2 - 100)
+	nodes := make([]node, 20)
+	nodes[RootDirInode].fs = 1
+	nodes[RootDirInode].node = &vio.TreeNode{
+		NodeSequenceNumber: RootDirInode,
+		File: vio.CustomFile(vio.CustomFileArgs{
+			IsDir: true,
+		}),
+	}
+	nodes[RootDirInode].node.Parent = nodes[RootDirInode].node
+
+	s := &super{uuid: [16]byte{1, 2, 3, 4}}
+	s.init(blocks, 100, &nodes)
+
+	sb := s.generateSuperblock(0)
+	if sb.FeatureROCompat&ROCompatMetadataCsum == 0 {
+		t.Fatalf("superblock doesn't have metadata checksums enabled")
+	}
+
+	buf := new(bytes.Buffer)
+	err := binary.Write(buf, binary.LittleEndian, sb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if sb.Checksum != superblockChecksum(buf.Bytes()) {
+		t.Errorf("superblock has the wrong checksum")
+	}
+
+	bgdt := s.generateBGDT()
+	for g := int64(0); g < s.totalGroups(); g++ {
+		raw := bgdt[g*DescriptorSize : (g+1)*DescriptorSize]
+		if binary.LittleEndian.Uint16(raw[bgdChecksumOffset:]) != descriptorChecksum(s.csumSeed, g, raw) {
+			t.Errorf("group descriptor %d has the wrong checksum", g)
+		}
+		if binary.LittleEndian.Uint16(raw[bgdBlockBitmapCsumOffset:]) != uint16(bitmapChecksum(s.csumSeed, s.blockBitmap(g), BlocksPerGroup/8)) {
+			t.Errorf("group descriptor %d has the wrong block bitmap checksum", g)
+		}
+	}
+
+}
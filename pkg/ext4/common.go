@@ -53,7 +53,32 @@ func calculateSymlinkBlocks(f vio.File) int64 {
 }
 
 func calculateRegularFileBlocks(f vio.File) int64 {
-	// NOTE: super small files cannot be stored in an inode right now because of limitations within the vio.FileTree logic when stream-building.
+	// NOTE: files stored in their inodes are picked out by inlineData before this is called.
 	// NOTE: we are not enforcing minimum file block pre-allocations on build because most files written during build are probably only for reading.
 	return calculateBlocksFromSize(int64(f.Size()))
 }
+
+// inlineData returns the contents of a regular file small enough to be stored
+// in its inode, or nil if it isn't stored there. Only files on the local
+// file-system are read this early, since reading a file from a stream before
+// the files ahead of it would skip over them.
+func inlineData(f vio.File) ([]byte, error) {
+
+	size := f.Size()
+	if size == 0 || size > InodeMaximumInlineBytes || !vio.IsLocalFile(f) {
+		return nil, nil
+	}
+
+	if _, ok := f.Xattrs()[inlineDataXattr]; ok {
+		return nil, nil
+	}
+
+	data := make([]byte, size)
+	_, err := io.ReadFull(f, data)
+	if err != nil {
+		return nil, err
+	}
+
+	return data, nil
+
+}
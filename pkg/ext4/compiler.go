@@ -4,6 +4,7 @@ import (
 	"context"
 	"io"
 	"path/filepath"
+	"time"
 
 	"github.com/vorteil/vorteil/pkg/elog"
 	"github.com/vorteil/vorteil/pkg/vio"
@@ -12,11 +13,46 @@ import (
 type CompilerArgs struct {
 	FileTree vio.FileTree
 	Logger   elog.Logger
+
+	// PrefetchReaders is the number of goroutines reading file contents
+	// ahead of the compiler. If zero, DefaultPrefetchReaders is used. Values
+	// greater than one are only safe if the files in FileTree can be read
+	// independently, which is not the case for trees loaded from archives.
+	PrefetchReaders int
+
+	// Workers is the number of goroutines rendering flex group metadata
+	// (bitmaps and inode tables) concurrently while data is being written.
+	// If zero, DefaultWorkers is used. If one, metadata is rendered serially
+	// as it is written.
+	Workers int
+
+	// MaxMemory caps the bytes buffered at once by the prefetch readers and
+	// the workers, which read ahead less and are fewer if they wouldn't fit
+	// under it. If zero, DefaultMaxMemory is used.
+	MaxMemory int64
+
+	// UUID is written to the superblock to identify the file-system.
+	UUID [16]byte
+
+	// Label is the volume name written to the superblock. It is truncated
+	// to MaxLabelLength bytes.
+	Label string
+
+	// Force64Bit enables the 64bit feature even if the file-system is small
+	// enough not to need it, so that it can be grown beyond 16 TiB later.
+	// File-systems larger than MaxBlocks32 blocks always have it.
+	Force64Bit bool
 }
 
+// MaxLabelLength is the longest volume label an ext4 file-system can have.
+const MaxLabelLength = 16
+
 type Compiler struct {
-	log  elog.Logger
-	tree vio.FileTree
+	log             elog.Logger
+	tree            vio.FileTree
+	prefetchReaders int
+	workers         int
+	maxMemory       int64
 
 	planner
 	super
@@ -25,9 +61,32 @@ type Compiler struct {
 }
 
 func NewCompiler(args *CompilerArgs) *Compiler {
+	readers := args.PrefetchReaders
+	if readers == 0 {
+		readers = DefaultPrefetchReaders
+	}
+
+	workers := args.Workers
+	if workers == 0 {
+		workers = DefaultWorkers
+	}
+
+	maxMemory := args.MaxMemory
+	if maxMemory == 0 {
+		maxMemory = DefaultMaxMemory
+	}
+
 	return &Compiler{
-		tree: args.FileTree,
-		log:  args.Logger,
+		tree:            args.FileTree,
+		log:             args.Logger,
+		prefetchReaders: readers,
+		workers:         workers,
+		maxMemory:       maxMemory,
+		super: super{
+			uuid:       args.UUID,
+			label:      args.Label,
+			force64Bit: args.Force64Bit,
+		},
 	}
 }
 
@@ -78,9 +137,25 @@ func (c *Compiler) IncreaseMinimumFreeSpace(space int64) {
 	c.minFreeSpace += space
 }
 
+// Reproduce makes the compiler write t to the superblock instead of the
+// current time. The seed is unused, because the UUID is only ever the one
+// given to NewCompiler.
+func (c *Compiler) Reproduce(seed int64, t time.Time) {
+	c.super.timestamp = t
+}
+
 func (c *Compiler) Commit(ctx context.Context) error {
 
-	return c.planner.commit(ctx, c.tree)
+	progress := elog.NewProgress(c.log, "Scanning file-system", "", int64(c.tree.NodeCount()))
+	defer progress.Finish(false)
+
+	err := c.planner.commit(ctx, c.tree, c.super.force64Bit, progress)
+	if err != nil {
+		return err
+	}
+
+	progress.Finish(true)
+	return nil
 
 }
 
@@ -107,6 +182,36 @@ func (c *Compiler) Compile(ctx context.Context, w io.WriteSeeker) error {
 
 	var err error
 
+	chunks, workers := budgetMemory(c.maxMemory, c.prefetchReaders, c.workers, BlockSize*c.flexOverheadBlocks())
+
+	_, zeroCopy := w.(io.ReaderFrom)
+	c.data.startPrefetching(ctx, c.prefetchReaders, chunks, zeroCopy)
+	defer c.data.stopPrefetching()
+
+	// metadata can only be written by the workers directly if they can
+	// write to the image at the same time as the data writer
+	wa, ok := vio.WriterAt(w)
+	if !ok || workers < 2 || c.totalFlexes() < 2 {
+		wa = nil
+	}
+
+	var renderer *metadataRenderer
+	if workers > 1 && c.totalFlexes() > 1 {
+		renderer = c.startRenderingMetadata(ctx, workers, wa)
+		defer renderer.stop()
+	}
+
+	inodesPerFlex := c.groupsPerFlex() * c.inodesPerGroup
+	inodeProgress := elog.NewProgress(c.log, "Writing inodes", "", c.totalFlexes()*inodesPerFlex)
+	defer inodeProgress.Finish(false)
+
+	var dataBlocks int64
+	for _, n := range c.data.nodes {
+		dataBlocks += int64(n.fs)
+	}
+	dataProgress := elog.NewProgress(c.log, "Writing file data", "KiB", dataBlocks*BlockSize)
+	defer dataProgress.Finish(false)
+
 	err = c.writeSuperblockAndBGDT(ctx, w, 0)
 	if err != nil {
 		return err
@@ -114,19 +219,30 @@ func (c *Compiler) Compile(ctx context.Context, w io.WriteSeeker) error {
 
 	for f := int64(0); f < c.totalFlexes(); f++ {
 
-		offset := BlockSize * BlocksPerGroup * c.groupsPerFlex() * f
-		if f == 0 {
-			offset += BlockSize * c.superOverheadBlocks()
-		}
-
-		_, err = w.Seek(offset, io.SeekStart)
-		if err != nil {
-			return err
-		}
-
-		err = c.writeFlexGroupMetaData(ctx, w, f)
-		if err != nil {
-			return err
+		offset := c.flexMetaDataOffset(f)
+
+		if wa != nil {
+			var n int64
+			n, err = renderer.collect(ctx, false)
+			if err != nil {
+				return err
+			}
+			inodeProgress.Increment(n * inodesPerFlex)
+		} else {
+			_, err = w.Seek(offset, io.SeekStart)
+			if err != nil {
+				return err
+			}
+
+			if renderer != nil {
+				err = renderer.write(ctx, w, f)
+			} else {
+				err = c.writeFlexGroupMetaData(ctx, w, f)
+			}
+			if err != nil {
+				return err
+			}
+			inodeProgress.Increment(inodesPerFlex)
 		}
 
 		offset += BlockSize * c.flexOverheadBlocks()
@@ -142,13 +258,25 @@ func (c *Compiler) Compile(ctx context.Context, w io.WriteSeeker) error {
 		}
 		b -= offset / BlockSize
 
-		err = c.writeDataBlocks(ctx, w, b, &c.super)
+		err = c.writeDataBlocks(ctx, elog.MultiWriteSeeker(w, dataProgress), b, &c.super)
 		if err != nil {
 			return err
 		}
 
 	}
 
+	if wa != nil {
+		var n int64
+		n, err = renderer.collect(ctx, true)
+		if err != nil {
+			return err
+		}
+		inodeProgress.Increment(n * inodesPerFlex)
+	}
+
+	inodeProgress.Finish(true)
+	dataProgress.Finish(true)
+
 	// seek to the end of the image
 	_, err = w.Seek(c.size, io.SeekStart)
 	if err != nil {
@@ -1,11 +1,17 @@
 package ext4
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/vorteil/vorteil/pkg/vio"
 )
@@ -111,3 +117,304 @@ func TestTinyFS(t *testing.T) {
 	}
 
 }
+
+func compileTestDirectory(t *testing.T, dir string, w io.WriteSeeker) int64 {
+
+	tree, err := vio.FileTreeFromDirectory(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := NewCompiler(&CompilerArgs{
+		FileTree: tree,
+	})
+
+	c.IncreaseMinimumFreeSpace(0x800000)
+
+	err = c.Commit(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = c.Precompile(context.Background(), c.MinimumSize())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.super.timestamp = time.Unix(0, 0)
+
+	err = c.Compile(context.Background(), w)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return c.size
+
+}
+
+func TestZeroCopyCompile(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "ext4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for i, size := range []int{0, 100, BlockSize, 5000, 200000} {
+		data := bytes.Repeat([]byte{byte(i + 1)}, size)
+		err = ioutil.WriteFile(filepath.Join(dir, strings.Repeat("x", i+1)), data, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// an io.Writer that hides any io.ReaderFrom implementation
+	buf := new(bytes.Buffer)
+	w, err := vio.WriteSeeker(struct{ io.Writer }{buf})
+	if err != nil {
+		t.Fatal(err)
+	}
+	compileTestDirectory(t, dir, w)
+
+	f, err := ioutil.TempFile("", "ext4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	w, err = vio.WriteSeeker(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := compileTestDirectory(t, dir, w)
+
+	err = f.Truncate(size)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = f.Seek(0, io.SeekStart)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(data, buf.Bytes()) {
+		t.Errorf("file-system copied with io.ReaderFrom differs from the normal build")
+	}
+
+}
+
+func TestParallelCompile(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "ext4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for i := 0; i < 64; i++ {
+		data := bytes.Repeat([]byte{byte(i + 1)}, i*1000)
+		err = ioutil.WriteFile(filepath.Join(dir, fmt.Sprintf("file%d", i)), data, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// if direct, the file-system is compiled into a file that the workers
+	// write metadata to directly
+	compile := func(workers int, direct bool) []byte {
+
+		tree, err := vio.FileTreeFromDirectory(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		c := NewCompiler(&CompilerArgs{
+			FileTree: tree,
+			Workers:  workers,
+		})
+
+		err = c.Commit(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// big enough for more than one flex group
+		err = c.Precompile(context.Background(), 3*BlocksPerGroup*BlockSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if c.totalFlexes() < 2 {
+			t.Fatalf("expected more than one flex group, got %d", c.totalFlexes())
+		}
+
+		c.super.timestamp = time.Unix(0, 0)
+
+		h := sha256.New()
+
+		if direct {
+			f, err := ioutil.TempFile("", "ext4")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.Remove(f.Name())
+			defer f.Close()
+
+			w, err := vio.WriteSeeker(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if _, ok := vio.WriterAt(w); !ok {
+				t.Fatalf("expected a file to be written at arbitrary offsets")
+			}
+
+			err = c.Compile(context.Background(), w)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = f.Truncate(c.size)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = io.Copy(h, io.NewSectionReader(f, 0, c.size))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			return h.Sum(nil)
+		}
+
+		w, err := vio.WriteSeeker(struct{ io.Writer }{h})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = c.Compile(context.Background(), w)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return h.Sum(nil)
+
+	}
+
+	serial := compile(1, false)
+
+	if !bytes.Equal(serial, compile(4, false)) {
+		t.Errorf("file-system compiled in parallel differs from the serial build")
+	}
+
+	if !bytes.Equal(serial, compile(4, true)) {
+		t.Errorf("file-system written in parallel differs from the serial build")
+	}
+
+}
+
+func TestBudgetMemory(t *testing.T) {
+
+	const flex = 32 * 0x100000
+
+	for _, x := range []struct {
+		max              int64
+		readers, workers int
+		chunks, expected int
+	}{
+		{DefaultMaxMemory, 1, 4, prefetchChunksPerFile, 4},
+		{DefaultMaxMemory, 1, 64, prefetchChunksPerFile, 7},
+		{DefaultMaxMemory, 4, 1, prefetchChunksPerFile, 1},
+		{32 * 0x100000, 4, 8, 4, 1},
+		{0, 2, 8, 1, 1},
+	} {
+		chunks, workers := budgetMemory(x.max, x.readers, x.workers, flex)
+		if chunks != x.chunks || workers != x.expected {
+			t.Errorf("budgetMemory(%d, %d, %d) = %d chunks, %d workers, expected %d chunks, %d workers",
+				x.max, x.readers, x.workers, chunks, workers, x.chunks, x.expected)
+		}
+	}
+
+}
+
+func TestInlineData(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "ext4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]int{
+		"empty":  0,
+		"tiny":   20,
+		"inline": InodeMaximumInlineBytes,
+		"large":  InodeMaximumInlineBytes + 1,
+	}
+
+	for name, size := range files {
+		err = ioutil.WriteFile(filepath.Join(dir, name), bytes.Repeat([]byte(name[:1]), size), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tree, err := vio.FileTreeFromDirectory(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := NewCompiler(&CompilerArgs{
+		FileTree: tree,
+	})
+
+	err = c.Commit(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := range c.inodeBlocks {
+		n := &c.inodeBlocks[i]
+		if n.node == nil || n.node.File.IsDir() {
+			continue
+		}
+
+		name := n.node.File.Name()
+		size := files[name]
+		inlined := size > 0 && size <= InodeMaximumInlineBytes
+
+		if (n.inline != nil) != inlined {
+			t.Errorf("'%s' inlined: %v, expected %v", name, n.inline != nil, inlined)
+			continue
+		}
+
+		if !inlined {
+			continue
+		}
+
+		if n.fs != 0 {
+			t.Errorf("'%s' is inline but uses %d blocks", name, n.fs)
+		}
+
+		inode := generateInode(n, &testContentMapper{})
+		if inode.Flags != Ext4InlineDataFL {
+			t.Errorf("'%s' has the wrong flags: %#x", name, inode.Flags)
+		}
+
+		if !bytes.Equal(inode.Block[:size], bytes.Repeat([]byte(name[:1]), size)) {
+			t.Errorf("'%s' has the wrong inline data", name)
+		}
+
+		if inode.ExtraIsize != InodeExtraSize || !bytes.Equal(inode.Xattrs[:4], le32(XattrMagic)) || string(inode.Xattrs[20:24]) != "data" {
+			t.Errorf("'%s' is missing its system.data attribute", name)
+		}
+	}
+
+}
@@ -4,7 +4,10 @@ import (
 	"bytes"
 	"context"
 	"io"
+	"os"
 	"sort"
+
+	"github.com/vorteil/vorteil/pkg/vio"
 )
 
 type offsetOrderedNodes []*node
@@ -24,11 +27,20 @@ func (x offsetOrderedNodes) Swap(i, j int) {
 }
 
 type data struct {
-	nodes  offsetOrderedNodes
-	idx    int64
-	reader io.Reader
-	block  int64
-	blocks int64
+	nodes    offsetOrderedNodes
+	idx      int64
+	reader   io.Reader
+	block    int64
+	blocks   int64
+	prefetch *prefetcher
+	csumSeed uint32
+
+	// if zeroCopy is true, local is set while the current node is a file
+	// on the local file-system that can be copied into the image with an
+	// io.ReaderFrom
+	zeroCopy bool
+	local    *os.File
+	size     int64
 }
 
 func (d *data) offsetOrderInodeBlocks(inodes *[]node) {
@@ -40,10 +52,30 @@ func (d *data) offsetOrderInodeBlocks(inodes *[]node) {
 	d.idx = -1
 }
 
-func (d *data) init(inodes *[]node) {
+func (d *data) init(inodes *[]node, csumSeed uint32) {
 
 	d.offsetOrderInodeBlocks(inodes)
+	d.csumSeed = csumSeed
+
+}
+
+func (d *data) startPrefetching(ctx context.Context, readers, chunks int, zeroCopy bool) {
+	d.zeroCopy = zeroCopy
+	d.prefetch = newPrefetcher(ctx, d.nodes, readers, chunks, zeroCopy)
+}
 
+func (d *data) stopPrefetching() {
+	if d.prefetch != nil {
+		d.prefetch.close()
+		d.prefetch = nil
+	}
+}
+
+func (d *data) prefetchReader(n *node) io.Reader {
+	if d.prefetch == nil {
+		return nil
+	}
+	return d.prefetch.reader(n)
 }
 
 func (d *data) getNextNode() *node {
@@ -52,7 +84,7 @@ func (d *data) getNextNode() *node {
 
 		if int64(len(d.nodes)) > d.idx && d.idx >= 0 {
 			old := d.nodes[d.idx]
-			if old.node != nil {
+			if old.node != nil && (d.prefetch == nil || !d.prefetch.handles(old)) {
 				_ = old.node.File.Close()
 			}
 		}
@@ -86,16 +118,23 @@ retry:
 
 		d.block = 0
 		d.blocks = int64(node.fs)
+		d.local = nil
 
 		// generate dir data into args.objData
 		if node.node.File.IsDir() {
 
 			var err error
-			d.reader, err = generateDirectoryData(node)
+			d.reader, err = generateDirectoryData(node, d.csumSeed)
 			if err != nil {
 				return err
 			}
 
+		} else if r := d.prefetchReader(node); r != nil {
+			d.reader = r
+		} else if f, ok := d.localFile(node); ok {
+			d.local = f
+			d.size = int64(node.node.File.Size())
+			d.reader = node.node.File
 		} else {
 			d.reader = node.node.File
 		}
@@ -105,12 +144,22 @@ retry:
 		}
 
 		// prepend an extent tree if necessary
-		if node.fs > node.content {
-			if node.fs-node.content > 1 {
+		if node.treeBlocks() > 0 {
+			if node.treeBlocks() > 1 {
 				panic("only handling 'small' extent trees")
 			}
 
-			d.reader = io.MultiReader(bytes.NewReader(extentsBlock(node, mapper)), d.reader)
+			block := extentsBlock(node, mapper)
+			checksumExtentBlock(d.csumSeed, node.node.NodeSequenceNumber, block)
+			d.reader = io.MultiReader(bytes.NewReader(block), d.reader)
+		}
+
+		// and the extended attributes before that
+		if len(node.xattrs) > 0 {
+			addr, _ := mapper.mapContent(node.start)
+			block := xattrBlock(node.xattrs)
+			checksumXattrBlock(d.csumSeed, addr, block)
+			d.reader = io.MultiReader(bytes.NewReader(block), d.reader)
 		}
 
 	}
@@ -119,41 +168,74 @@ retry:
 
 }
 
-func (d *data) writeBlock(w io.Writer) error {
+type writerOnly struct {
+	io.Writer
+}
 
-	// write next block
-	buffer := new(bytes.Buffer)
-	_, err := io.CopyN(buffer, d.reader, BlockSize)
-	if err != nil && err != io.EOF {
-		return err
+func (d *data) localFile(n *node) (*os.File, bool) {
+
+	if !d.zeroCopy || n.fs != n.content {
+		return nil, false
 	}
 
-	growToBlock(buffer)
+	return vio.LocalFile(n.node.File)
 
-	// pad and write
-	_, err = io.Copy(w, bytes.NewReader(buffer.Bytes()))
+}
+
+// copyLocalBlocks copies up to max blocks of the current node's contents
+// using rf, which allows the kernel to skip copying the data through
+// userspace. It returns the number of blocks written.
+func (d *data) copyLocalBlocks(w io.Writer, rf io.ReaderFrom, max int64) (int64, error) {
+
+	k := d.blocks - d.block
+	if k > max {
+		k = max
+	}
+
+	length := k * BlockSize
+	remaining := d.size - d.block*BlockSize
+	if length > remaining {
+		length = remaining
+	}
+
+	n, err := rf.ReadFrom(io.LimitReader(d.local, length))
 	if err != nil {
-		return err
+		return 0, err
+	}
+	if n != length {
+		return 0, io.ErrUnexpectedEOF
 	}
 
-	d.block++
+	_, err = io.CopyN(writerOnly{w}, vio.Zeroes, k*BlockSize-length)
+	if err != nil {
+		return 0, err
+	}
 
-	return nil
+	d.block += k
+
+	return k, nil
 
 }
 
-func (d *data) writeNextDataBlock(w io.Writer, mapper contentMapper) error {
+func (d *data) writeBlock(w io.Writer) error {
 
-	err := d.prepNextDataBlock(mapper)
-	if err != nil {
+	// write next block
+	buffer := new(bytes.Buffer)
+	_, err := io.CopyN(buffer, d.reader, BlockSize)
+	if err != nil && err != io.EOF {
 		return err
 	}
 
-	err = d.writeBlock(w)
+	growToBlock(buffer)
+
+	// pad and write
+	_, err = io.Copy(w, bytes.NewReader(buffer.Bytes()))
 	if err != nil {
 		return err
 	}
 
+	d.block++
+
 	return nil
 
 }
@@ -162,6 +244,8 @@ func (d *data) writeDataBlocks(ctx context.Context, w io.Writer, n int64, mapper
 
 	// TODO: support contents large enough to require extra metadata blocks
 
+	rf, zeroCopy := w.(io.ReaderFrom)
+
 	for i := int64(0); i < n; i++ {
 
 		err := ctx.Err()
@@ -169,7 +253,7 @@ func (d *data) writeDataBlocks(ctx context.Context, w io.Writer, n int64, mapper
 			return err
 		}
 
-		err = d.writeNextDataBlock(w, mapper)
+		err = d.prepNextDataBlock(mapper)
 		if err != nil {
 			if err == io.EOF {
 				break
@@ -177,6 +261,20 @@ func (d *data) writeDataBlocks(ctx context.Context, w io.Writer, n int64, mapper
 			return err
 		}
 
+		if zeroCopy && d.local != nil {
+			k, err := d.copyLocalBlocks(w, rf, n-i)
+			if err != nil {
+				return err
+			}
+			i += k - 1
+			continue
+		}
+
+		err = d.writeBlock(w)
+		if err != nil {
+			return err
+		}
+
 	}
 
 	return nil
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/binary"
 	"io"
+	"os"
 	"path"
 	"sort"
 	"strings"
@@ -19,9 +20,31 @@ const (
 const (
 	FTypeRegularFile = 0x1 // FTYPE_REGULAR_FILE
 	FTypeDir         = 0x2 // FTYPE_DIR
+	FTypeCharDevice  = 0x3 // FTYPE_CHRDEV
+	FTypeBlockDevice = 0x4 // FTYPE_BLKDEV
+	FTypeFIFO        = 0x5 // FTYPE_FIFO
 	FTypeSymlink     = 0x7 // FTYPE_SYMLINK
 )
 
+func fileType(f vio.File) uint8 {
+
+	switch {
+	case f.IsDir():
+		return FTypeDir
+	case f.IsSymlink():
+		return FTypeSymlink
+	case f.Special() == os.ModeNamedPipe:
+		return FTypeFIFO
+	case f.Special()&os.ModeCharDevice != 0:
+		return FTypeCharDevice
+	case f.Special() != 0:
+		return FTypeBlockDevice
+	default:
+		return FTypeRegularFile
+	}
+
+}
+
 func sliceStringForHashing(s string) (string, *[4]uint32) {
 
 	var pad, val uint32
@@ -158,7 +181,7 @@ func calculateLinearDirectorySize(n *vio.TreeNode) int64 {
 
 	var length, leftover int64
 	length = 24 // '.' + '..' entries
-	leftover = BlockSize - length
+	leftover = dirBlockCapacity - length
 
 	for i, child := range n.Children {
 
@@ -170,18 +193,18 @@ func calculateLinearDirectorySize(n *vio.TreeNode) int64 {
 		} else {
 			length += leftover
 			length += l
-			leftover = BlockSize - l
+			leftover = dirBlockCapacity - l
 		}
 
 		if leftover < 8 || i == len(n.Children)-1 {
 			length += leftover
-			leftover = BlockSize
+			leftover = dirBlockCapacity
 		}
 
 	}
 
-	length = align(length, BlockSize)
-	return length
+	// every block ends with a checksum tail
+	return divide(length, dirBlockCapacity) * BlockSize
 
 }
 
@@ -195,7 +218,7 @@ func addLinearDirectoryBlock(w io.Writer, tuples []*dirTuple) error {
 
 	buf := new(bytes.Buffer)
 	length := int64(0)
-	leftover := int64(BlockSize)
+	leftover := int64(dirBlockCapacity)
 	exceedsBlock := false
 
 	for i, child := range tuples {
@@ -212,7 +235,7 @@ func addLinearDirectoryBlock(w io.Writer, tuples []*dirTuple) error {
 		if leftover < 8 || i == len(tuples)-1 {
 			l += leftover
 			length += leftover
-			leftover = int64(BlockSize)
+			leftover = int64(dirBlockCapacity)
 			exceedsBlock = true
 		}
 
@@ -228,7 +251,7 @@ func addLinearDirectoryBlock(w io.Writer, tuples []*dirTuple) error {
 
 	}
 
-	growToBlock(buf)
+	writeDirentTail(buf)
 
 	_, err := io.Copy(w, bytes.NewReader(buf.Bytes()))
 	if err != nil {
@@ -246,14 +269,7 @@ func generateLinearDirectoryData(n *node) []byte {
 	tuples = append(tuples, &dirTuple{name: "..", inode: uint32(n.node.Parent.NodeSequenceNumber), ftype: FTypeDir})
 
 	for _, child := range n.node.Children {
-		var ftype uint8
-		if child.File.IsDir() {
-			ftype = FTypeDir
-		} else if child.File.IsSymlink() {
-			ftype = FTypeSymlink
-		} else {
-			ftype = FTypeRegularFile
-		}
+		ftype := fileType(child.File)
 		tuples = append(tuples, &dirTuple{name: path.Base(child.File.Name()), inode: uint32(child.NodeSequenceNumber), ftype: ftype})
 	}
 
@@ -264,7 +280,7 @@ func generateLinearDirectoryData(n *node) []byte {
 	for i, tuple := range tuples {
 		l := dentryMinLength(tuple.name)
 		size += l
-		if size > BlockSize {
+		if size > dirBlockCapacity {
 			err := addLinearDirectoryBlock(buf, tuples[begin:i])
 			if err != nil {
 				panic(err)
@@ -323,7 +339,7 @@ func calculateHashDirectorySize(n *vio.TreeNode) int64 {
 
 	for i := range entries {
 
-		if l+entries[i].length > BlockSize {
+		if l+entries[i].length > dirBlockCapacity {
 			blocks = append(blocks, entries[first:i])
 			first = i
 			l = entries[i].length
@@ -383,7 +399,9 @@ type HashDirectoryRoot struct {
 	Limit          uint16                  // 0x20
 	Count          uint16                  // 0x22
 	Block          uint32                  // 0x24
-	Entries        [507]HashDirectoryEntry // 0x28
+	Entries        [506]HashDirectoryEntry // 0x28
+	_              uint32                  // 0xFF8
+	Checksum       uint32                  // 0xFFC
 }
 
 func addBlockToBuffer(w io.Writer, block hashDirEntriesMetdata) error {
@@ -392,14 +410,7 @@ func addBlockToBuffer(w io.Writer, block hashDirEntriesMetdata) error {
 
 	for _, child := range block {
 
-		var ftype uint8
-		if child.node.File.IsDir() {
-			ftype = FTypeDir
-		} else if child.node.File.IsSymlink() {
-			ftype = FTypeSymlink
-		} else {
-			ftype = FTypeRegularFile
-		}
+		ftype := fileType(child.node.File)
 
 		tuples = append(tuples, &dirTuple{
 			name:  child.node.File.Name(),
@@ -437,7 +448,7 @@ func generateHashDirectoryData(node *node) []byte {
 
 	for i := range entries {
 
-		if l+entries[i].length > BlockSize {
+		if l+entries[i].length > dirBlockCapacity {
 			blocks = append(blocks, entries[first:i])
 			first = i
 			l = entries[i].length
@@ -468,7 +479,7 @@ func generateHashDirectoryData(node *node) []byte {
 		HashVersion:    DirentHashVersion,
 		InfoLength:     8,
 		IndirectLevels: 0, // TODO: support deeper trees
-		Limit:          507 + 1,
+		Limit:          506 + 1,
 		Count:          uint16(len(blocks)), // + 1,
 		Block:          1,
 	}
@@ -496,16 +507,26 @@ func generateHashDirectoryData(node *node) []byte {
 
 }
 
-func generateDirectoryData(node *node) (io.Reader, error) {
+func generateDirectoryData(node *node, seed uint32) (io.Reader, error) {
 
-	if node.fs == 0 {
+	if node.content == 0 {
 		return bytes.NewReader([]byte{}), nil
 	}
 
-	if node.fs == 1 {
-		return bytes.NewReader(generateLinearDirectoryData(node)), nil
+	ino := node.node.NodeSequenceNumber
+
+	if node.content == 1 {
+		data := generateLinearDirectoryData(node)
+		checksumDirectoryBlock(seed, ino, data)
+		return bytes.NewReader(data), nil
+	}
+
+	data := generateHashDirectoryData(node)
+	checksumHashDirectoryRoot(seed, ino, data[:BlockSize])
+	for off := BlockSize; off < len(data); off += BlockSize {
+		checksumDirectoryBlock(seed, ino, data[off:off+BlockSize])
 	}
 
-	return bytes.NewReader(generateHashDirectoryData(node)), nil
+	return bytes.NewReader(data), nil
 
 }
@@ -145,7 +145,7 @@ func TestLinearDir(t *testing.T) {
 		2, 0, 0, 0, 12, 0, 2, 2, '.', '.', 0, 0,
 		11, 0, 0, 0, 20, 0, 8, 2, 't', 'e', 's', 't', '_', 'd', 'i', 'r', 0, 0, 0, 0,
 		12, 0, 0, 0, 20, 0, 9, 1, 't', 'e', 's', 't', '_', 'f', 'i', 'l', 'e', 0, 0, 0,
-		13, 0, 0, 0, 0xC0, 0x0F, 12, 7, 't', 'e', 's', 't', '_', 's', 'y', 'm', 'l', 'i', 'n', 'k', 0, 0, 0, 0,
+		13, 0, 0, 0, 0xB4, 0x0F, 12, 7, 't', 'e', 's', 't', '_', 's', 'y', 'm', 'l', 'i', 'n', 'k', 0, 0, 0, 0,
 	}
 	if !bytes.HasPrefix(data, expect) {
 		t.Errorf("generated linear directory isn't like we expected --\n\texpect %v\n\t   got %v", expect, data)
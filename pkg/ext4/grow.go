@@ -0,0 +1,556 @@
+package ext4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// superblock field offsets patched in place by Grow, so that fields the
+// Superblock structure leaves blank survive
+const (
+	sbTotalInodesOffset         = 0x0
+	sbTotalBlocksOffset         = 0x4
+	sbUnallocatedBlocksOffset   = 0xC
+	sbUnallocatedInodesOffset   = 0x10
+	sbReservedGDTBlocksOffset   = 0xCE
+	sbTotalBlocksHiOffset       = 0x150
+	sbUnallocatedBlocksHiOffset = 0x158
+)
+
+const (
+	bgdFreeBlocksOffset        = 0xC
+	bgdBlockBitmapCsumOffset   = 0x18
+	bgdBlockBitmapCsumHiOffset = 0x38
+	inodeSectorsOffset         = 0x1C
+	inodeBlockOffset           = 0x28
+)
+
+const incompatRecover = 0x4 // INCOMPAT_RECOVER
+
+// ErrCannotGrow is returned by Grow if the file-system doesn't have enough
+// reserved group descriptor blocks left to grow to the requested size.
+var ErrCannotGrow = errors.New("file-system has too few reserved group descriptor blocks to grow that large")
+
+type grower struct {
+	rw        io.ReadWriteSeeker
+	sb        Superblock
+	raw       []byte
+	gdt       []groupDescriptor
+	descSize  int64
+	oldBlocks int64
+	newBlocks int64
+	oldGroups int64
+	newGroups int64
+
+	// csum is true if the file-system has metadata checksums, which have to
+	// be updated along with everything Grow changes
+	csum     bool
+	csumSeed uint32
+}
+
+// Grow grows an ext4 file-system built by this package in place, so that it
+// fills size bytes. The new space must already exist and be readable and
+// writable through rw, which must treat the start of the file-system as
+// offset zero. New block groups are added using the group descriptor blocks
+// reserved for growth, so a file-system can grow to roughly 1024 times the
+// size it was built at, but only beyond 16 TiB if it has the 64bit feature.
+//
+// Grow checks that the file-system can be grown before it writes anything, so
+// that an unsupported file-system is left valid at its original size.
+func Grow(rw io.ReadWriteSeeker, size int64) error {
+
+	g := &grower{rw: rw}
+
+	err := g.readSuperblock()
+	if err != nil {
+		return err
+	}
+
+	err = g.plan(size)
+	if err != nil {
+		return err
+	}
+
+	if g.newBlocks == g.oldBlocks {
+		return nil
+	}
+
+	err = g.readGDT()
+	if err != nil {
+		return err
+	}
+
+	err = g.checkLayout()
+	if err != nil {
+		return err
+	}
+
+	freeBlocks, err := g.extendLastGroup()
+	if err != nil {
+		return err
+	}
+
+	for grp := g.oldGroups; grp < g.newGroups; grp++ {
+		var free int64
+		free, err = g.addGroup(grp)
+		if err != nil {
+			return err
+		}
+		freeBlocks += free
+	}
+
+	err = g.writeGDT()
+	if err != nil {
+		return err
+	}
+
+	err = g.updateResizeInode()
+	if err != nil {
+		return err
+	}
+
+	return g.writeSuperblock(freeBlocks)
+
+}
+
+func (g *grower) readAt(p []byte, off int64) error {
+
+	_, err := g.rw.Seek(off, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.ReadFull(g.rw, p)
+	return err
+
+}
+
+func (g *grower) writeAt(p []byte, off int64) error {
+
+	_, err := g.rw.Seek(off, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(g.rw, bytes.NewReader(p))
+	return err
+
+}
+
+func (g *grower) readSuperblock() error {
+
+	g.raw = make([]byte, 1024)
+	err := g.readAt(g.raw, 1024)
+	if err != nil {
+		return err
+	}
+
+	err = binary.Read(bytes.NewReader(g.raw), binary.LittleEndian, &g.sb)
+	if err != nil {
+		return err
+	}
+
+	sb := &g.sb
+
+	if sb.Signature != Signature {
+		return errors.New("not an ext4 file-system")
+	}
+
+	if sb.LogBlockSize != 2 || sb.BlocksPerGroup != BlocksPerGroup {
+		return errors.New("unsupported ext4 block size")
+	}
+
+	if sb.FeatureIncompat&incompatRecover != 0 {
+		return errors.New("ext4 file-system needs journal recovery before it can be grown")
+	}
+
+	supported := uint32(IncompatFiletype | IncompatExtents | Incompat64Bit | IncompatFlexBG | IncompatInlineData)
+	if sb.FeatureIncompat&^supported != 0 || sb.FeatureIncompat&IncompatFlexBG == 0 {
+		return fmt.Errorf("unsupported ext4 incompatible features: %#x", sb.FeatureIncompat)
+	}
+
+	if sb.FeatureCompat&CompatResizeInode == 0 {
+		return errors.New("ext4 file-system has no resize inode")
+	}
+
+	g.descSize = DescriptorSize
+	if g.is64Bit() {
+		g.descSize = DescriptorSize64
+	}
+
+	if sb.DescSize != 0 && int64(sb.DescSize) != g.descSize {
+		return errors.New("unsupported ext4 group descriptor size")
+	}
+
+	if sb.InodeSize < 128 || BlockSize%int64(sb.InodeSize) != 0 {
+		return errors.New("unsupported ext4 inode size")
+	}
+
+	if sb.BackupBGs != [2]uint32{} {
+		return errors.New("ext4 file-systems with backup superblocks can't be grown")
+	}
+
+	if sb.FeatureROCompat&ROCompatMetadataCsum != 0 {
+		if sb.ChecksumType != ChecksumTypeCRC32C {
+			return errors.New("unsupported ext4 metadata checksums")
+		}
+		g.csum = true
+		g.csumSeed = checksumSeed(sb.UUID)
+	}
+
+	return nil
+
+}
+
+func (g *grower) is64Bit() bool {
+	return g.sb.FeatureIncompat&Incompat64Bit != 0
+}
+
+func (g *grower) descriptorsPerBlock() int64 {
+	return BlockSize / g.descSize
+}
+
+func (g *grower) groupsPerFlex() int64 {
+	return int64(1) << g.sb.LogGroupsPerFlex
+}
+
+func (g *grower) inodeBlocksPerGroup() int64 {
+	return divide(int64(g.sb.InodesPerGroup)*int64(g.sb.InodeSize), BlockSize)
+}
+
+func (g *grower) flexOverheadBlocks() int64 {
+	return g.groupsPerFlex() * (2 + g.inodeBlocksPerGroup())
+}
+
+func (g *grower) superOverheadBlocks() int64 {
+	return 1 + divide(g.oldGroups, g.descriptorsPerBlock()) + int64(g.sb.ReservedGDTBlocks)
+}
+
+func (g *grower) plan(size int64) error {
+
+	g.oldBlocks = int64(g.sb.TotalBlocks)
+	if g.is64Bit() {
+		g.oldBlocks |= int64(g.sb.TotalBlocksHi) << 32
+	}
+	g.oldGroups = divide(g.oldBlocks, BlocksPerGroup)
+
+	g.newBlocks = size / BlockSize
+	if g.newBlocks < g.oldBlocks {
+		return fmt.Errorf("ext4 file-system can't be shrunk from %d to %d blocks", g.oldBlocks, g.newBlocks)
+	}
+
+	if g.newBlocks > MaxBlocks32 && !g.is64Bit() {
+		g.newBlocks = MaxBlocks32
+	}
+
+	g.newGroups = divide(g.newBlocks, BlocksPerGroup)
+
+	// a new flex group's metadata lives at its start, so leave out a
+	// trailing group that's too small to hold it
+	last := g.newGroups - 1
+	if last >= g.oldGroups && last%g.groupsPerFlex() == 0 && g.newBlocks-last*BlocksPerGroup <= g.flexOverheadBlocks() {
+		g.newBlocks = last * BlocksPerGroup
+		g.newGroups = last
+	}
+
+	if g.newBlocks < g.oldBlocks {
+		g.newBlocks = g.oldBlocks
+		g.newGroups = g.oldGroups
+	}
+
+	if divide(g.newGroups, g.descriptorsPerBlock()) > divide(g.oldGroups, g.descriptorsPerBlock())+int64(g.sb.ReservedGDTBlocks) {
+		return ErrCannotGrow
+	}
+
+	if g.newGroups*int64(g.sb.InodesPerGroup) > math.MaxUint32 {
+		return ErrCannotGrow
+	}
+
+	return nil
+
+}
+
+func (g *grower) readGDT() error {
+
+	buf := make([]byte, g.oldGroups*g.descSize)
+	err := g.readAt(buf, BlockSize)
+	if err != nil {
+		return err
+	}
+
+	g.gdt = make([]groupDescriptor, g.oldGroups, g.newGroups)
+	for grp := range g.gdt {
+		g.gdt[grp], err = decodeGroupDescriptor(buf[int64(grp)*g.descSize:][:g.descSize])
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+
+}
+
+// groupMetadata returns the addresses of a group's bitmaps and inode table,
+// which are packed at the start of its flex group.
+func (g *grower) groupMetadata(grp int64) (blockBitmap, inodeBitmap, inodeTable int64) {
+
+	gpf := g.groupsPerFlex()
+	flex := grp / gpf
+	r := grp % gpf
+
+	base := flex * gpf * BlocksPerGroup
+	if flex == 0 {
+		base += g.superOverheadBlocks()
+	}
+
+	blockBitmap = base + r
+	inodeBitmap = base + gpf + r
+	inodeTable = base + 2*gpf + r*g.inodeBlocksPerGroup()
+
+	return
+
+}
+
+// checkLayout makes sure the existing groups are laid out the way this
+// package lays them out, which Grow relies on.
+func (g *grower) checkLayout() error {
+
+	for grp := range g.gdt {
+		bb, ib, it := g.groupMetadata(int64(grp))
+		desc := &g.gdt[grp]
+		if desc.blockBitmapAddr() != bb || desc.inodeBitmapAddr() != ib || desc.inodeTableAddr() != it {
+			return errors.New("unsupported ext4 flex group layout")
+		}
+	}
+
+	return nil
+
+}
+
+func setBits(bitmap []byte, begin, end int64, set bool) {
+	for i := begin; i < end; i++ {
+		if set {
+			bitmap[i/8] |= 1 << (i % 8)
+		} else {
+			bitmap[i/8] &^= 1 << (i % 8)
+		}
+	}
+}
+
+// extendLastGroup frees the blocks added to the end of the existing last
+// group, if it wasn't full.
+func (g *grower) extendLastGroup() (int64, error) {
+
+	grp := g.oldGroups - 1
+	first := grp * BlocksPerGroup
+	end := first + BlocksPerGroup
+	if end > g.newBlocks {
+		end = g.newBlocks
+	}
+
+	if end <= g.oldBlocks {
+		return 0, nil
+	}
+
+	desc := &g.gdt[grp]
+	bitmap := make([]byte, BlockSize)
+	err := g.readAt(bitmap, desc.blockBitmapAddr()*BlockSize)
+	if err != nil {
+		return 0, err
+	}
+
+	setBits(bitmap, g.oldBlocks-first, end-first, false)
+
+	err = g.writeAt(bitmap, desc.blockBitmapAddr()*BlockSize)
+	if err != nil {
+		return 0, err
+	}
+
+	free := end - g.oldBlocks
+	desc.FreeBlocks += uint16(free)
+	if g.csum {
+		desc.setBlockBitmapCsum(bitmapChecksum(g.csumSeed, bitmap, BlocksPerGroup/8))
+	}
+
+	return free, nil
+
+}
+
+// addGroup writes the bitmaps and an empty inode table for a new group, and
+// returns the number of free blocks in it.
+func (g *grower) addGroup(grp int64) (int64, error) {
+
+	bb, ib, it := g.groupMetadata(grp)
+	first := grp * BlocksPerGroup
+	end := first + BlocksPerGroup
+	if end > g.newBlocks {
+		end = g.newBlocks
+	}
+
+	blockBitmap := make([]byte, BlockSize)
+	setBits(blockBitmap, end-first, BlocksPerGroup, true)
+
+	used := int64(0)
+	if grp%g.groupsPerFlex() == 0 {
+		// the first group in a new flex group holds the whole flex group's
+		// metadata, including that of groups that don't exist yet
+		used = g.flexOverheadBlocks()
+		setBits(blockBitmap, 0, used, true)
+	}
+
+	inodeBitmap := bytes.Repeat([]byte{0xFF}, BlockSize)
+	setBits(inodeBitmap, 0, int64(g.sb.InodesPerGroup), false)
+
+	err := g.writeAt(blockBitmap, bb*BlockSize)
+	if err != nil {
+		return 0, err
+	}
+
+	err = g.writeAt(inodeBitmap, ib*BlockSize)
+	if err != nil {
+		return 0, err
+	}
+
+	err = g.writeAt(make([]byte, g.inodeBlocksPerGroup()*BlockSize), it*BlockSize)
+	if err != nil {
+		return 0, err
+	}
+
+	free := end - first - used
+	var desc groupDescriptor
+	desc.setAddrs(bb, ib, it)
+	desc.FreeBlocks = uint16(free)
+	desc.FreeInodes = uint16(g.sb.InodesPerGroup)
+
+	if g.csum {
+		desc.setBlockBitmapCsum(bitmapChecksum(g.csumSeed, blockBitmap, BlocksPerGroup/8))
+		desc.setInodeBitmapCsum(bitmapChecksum(g.csumSeed, inodeBitmap, int64(g.sb.InodesPerGroup)/8))
+	}
+
+	g.gdt = append(g.gdt, desc)
+
+	return free, nil
+
+}
+
+func (g *grower) writeGDT() error {
+
+	// the last existing descriptor may have changed, and only its free
+	// blocks count and checksums are patched in case the kernel has set
+	// other fields
+	last := g.oldGroups - 1
+	buf := make([]byte, g.descSize)
+	err := g.readAt(buf, BlockSize+last*g.descSize)
+	if err != nil {
+		return err
+	}
+
+	binary.LittleEndian.PutUint16(buf[bgdFreeBlocksOffset:], g.gdt[last].FreeBlocks)
+	if g.csum {
+		binary.LittleEndian.PutUint16(buf[bgdBlockBitmapCsumOffset:], g.gdt[last].BlockBitmapCsum)
+		if g.descSize > DescriptorSize {
+			binary.LittleEndian.PutUint16(buf[bgdBlockBitmapCsumHiOffset:], g.gdt[last].BlockBitmapCsumHi)
+		}
+		binary.LittleEndian.PutUint16(buf[bgdChecksumOffset:], descriptorChecksum(g.csumSeed, last, buf))
+	}
+
+	err = g.writeAt(buf, BlockSize+last*g.descSize)
+	if err != nil {
+		return err
+	}
+
+	out := new(bytes.Buffer)
+	for grp := g.oldGroups; grp < g.newGroups; grp++ {
+		raw := g.gdt[grp].encode(g.descSize)
+		if g.csum {
+			binary.LittleEndian.PutUint16(raw[bgdChecksumOffset:], descriptorChecksum(g.csumSeed, grp, raw))
+		}
+		out.Write(raw)
+	}
+
+	return g.writeAt(out.Bytes(), BlockSize+g.oldGroups*g.descSize)
+
+}
+
+// updateResizeInode removes the group descriptor blocks that are now in use
+// from the resize inode, which lists the blocks reserved for growth.
+func (g *grower) updateResizeInode() error {
+
+	oldGDTBlocks := divide(g.oldGroups, g.descriptorsPerBlock())
+	newGDTBlocks := divide(g.newGroups, g.descriptorsPerBlock())
+	if newGDTBlocks == oldGDTBlocks {
+		return nil
+	}
+
+	offset := g.gdt[0].inodeTableAddr()*BlockSize + (ResizeInode-1)*int64(g.sb.InodeSize)
+	inode := make([]byte, g.sb.InodeSize)
+	err := g.readAt(inode, offset)
+	if err != nil {
+		return err
+	}
+
+	dind := int64(binary.LittleEndian.Uint32(inode[inodeBlockOffset+13*4:]))
+	if dind == 0 {
+		return errors.New("ext4 resize inode has no reserved blocks")
+	}
+
+	block := make([]byte, BlockSize)
+	err = g.readAt(block, dind*BlockSize)
+	if err != nil {
+		return err
+	}
+
+	for i := oldGDTBlocks; i < newGDTBlocks && i < BlockSize/4; i++ {
+		binary.LittleEndian.PutUint32(block[i*4:], 0)
+	}
+
+	err = g.writeAt(block, dind*BlockSize)
+	if err != nil {
+		return err
+	}
+
+	sectors := binary.LittleEndian.Uint32(inode[inodeSectorsOffset:])
+	sectors -= uint32((newGDTBlocks - oldGDTBlocks) * SectorsPerBlock)
+	binary.LittleEndian.PutUint32(inode[inodeSectorsOffset:], sectors)
+
+	if g.csum {
+		setInodeChecksum(g.csumSeed, ResizeInode, inode)
+	}
+
+	return g.writeAt(inode, offset)
+
+}
+
+func (g *grower) writeSuperblock(freeBlocks int64) error {
+
+	addedInodes := uint32((g.newGroups - g.oldGroups) * int64(g.sb.InodesPerGroup))
+	usedGDTBlocks := divide(g.newGroups, g.descriptorsPerBlock()) - divide(g.oldGroups, g.descriptorsPerBlock())
+
+	unallocatedBlocks := int64(g.sb.UnallocatedBlocks)
+	if g.is64Bit() {
+		unallocatedBlocks |= int64(g.sb.UnallocatedBlocksHi) << 32
+	}
+	unallocatedBlocks += freeBlocks
+
+	binary.LittleEndian.PutUint32(g.raw[sbTotalInodesOffset:], g.sb.TotalInodes+addedInodes)
+	binary.LittleEndian.PutUint32(g.raw[sbTotalBlocksOffset:], uint32(g.newBlocks))
+	binary.LittleEndian.PutUint32(g.raw[sbUnallocatedBlocksOffset:], uint32(unallocatedBlocks))
+	binary.LittleEndian.PutUint32(g.raw[sbUnallocatedInodesOffset:], g.sb.UnallocatedInodes+addedInodes)
+	binary.LittleEndian.PutUint16(g.raw[sbReservedGDTBlocksOffset:], g.sb.ReservedGDTBlocks-uint16(usedGDTBlocks))
+
+	if g.is64Bit() {
+		binary.LittleEndian.PutUint32(g.raw[sbTotalBlocksHiOffset:], uint32(g.newBlocks>>32))
+		binary.LittleEndian.PutUint32(g.raw[sbUnallocatedBlocksHiOffset:], uint32(unallocatedBlocks>>32))
+	}
+
+	if g.csum {
+		binary.LittleEndian.PutUint32(g.raw[sbChecksumOffset:], superblockChecksum(g.raw))
+	}
+
+	return g.writeAt(g.raw, 1024)
+
+}
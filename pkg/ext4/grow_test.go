@@ -0,0 +1,127 @@
+package ext4
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/vorteil/vorteil/pkg/vio"
+)
+
+func TestGrow(t *testing.T) {
+
+	tree := vio.NewFileTree()
+
+	c := NewCompiler(&CompilerArgs{
+		FileTree: tree,
+	})
+
+	c.IncreaseMinimumFreeSpace(0x1000000)
+
+	ctx := context.Background()
+	err := c.Commit(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = c.Precompile(ctx, c.MinimumSize())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := ioutil.TempFile("", "ext4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	w, err := vio.WriteSeeker(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = c.Compile(ctx, w)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	groups := int64(5)
+	size := (groups-1)*BlocksPerGroup*BlockSize + 0x1000000
+
+	err = f.Truncate(size)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = Grow(f, size)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sb := new(Superblock)
+	err = binary.Read(io.NewSectionReader(f, 1024, 1024), binary.LittleEndian, sb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	raw := make([]byte, 1024)
+	_, err = f.ReadAt(raw, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if sb.Checksum != superblockChecksum(raw) {
+		t.Errorf("superblock checksum wasn't updated")
+	}
+
+	if int64(sb.TotalBlocks) != size/BlockSize {
+		t.Errorf("expected %d blocks, got %d", size/BlockSize, sb.TotalBlocks)
+	}
+
+	if int64(sb.TotalInodes) != groups*int64(sb.InodesPerGroup) {
+		t.Errorf("expected %d inodes, got %d", groups*int64(sb.InodesPerGroup), sb.TotalInodes)
+	}
+
+	gdt := make([]BlockGroupDescriptor, groups)
+	err = binary.Read(io.NewSectionReader(f, BlockSize, groups*DescriptorSize), binary.LittleEndian, gdt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rawGDT := make([]byte, groups*DescriptorSize)
+	_, err = f.ReadAt(rawGDT, BlockSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seed := checksumSeed(sb.UUID)
+	for g := int64(0); g < groups; g++ {
+		if gdt[g].Checksum != descriptorChecksum(seed, g, rawGDT[g*DescriptorSize:(g+1)*DescriptorSize]) {
+			t.Errorf("group descriptor %d has the wrong checksum", g)
+		}
+	}
+
+	var free, freeInodes int64
+	for _, desc := range gdt {
+		free += int64(desc.FreeBlocks)
+		freeInodes += int64(desc.FreeInodes)
+	}
+
+	if free != int64(sb.UnallocatedBlocks) {
+		t.Errorf("superblock has %d free blocks, groups have %d", sb.UnallocatedBlocks, free)
+	}
+
+	if freeInodes != int64(sb.UnallocatedInodes) {
+		t.Errorf("superblock has %d free inodes, groups have %d", sb.UnallocatedInodes, freeInodes)
+	}
+
+	err = Grow(f, size/2)
+	if err == nil {
+		t.Errorf("file-system was shrunk")
+	}
+
+}
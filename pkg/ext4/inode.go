@@ -5,16 +5,24 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"os"
 
 	"github.com/vorteil/vorteil/pkg/vio"
 )
 
 const (
 	InodeMaximumInlineBytes = 60
+
+	// InodeExtraSize is the size of the fields that follow the first 128
+	// bytes of an inode. The rest of the inode holds extended attributes.
+	InodeExtraSize = 32
 )
 
 const (
+	InodeTypeFIFO                      = 0x1000
+	InodeTypeCharDevice                = 0x2000
 	InodeTypeDirectory                 = 0x4000
+	InodeTypeBlockDevice               = 0x6000
 	InodeTypeRegularFile               = 0x8000
 	InodeTypeSymlink                   = 0xA000
 	InodeTypeMask                      = 0xF000
@@ -38,6 +46,23 @@ type node struct {
 	start   int64
 	content uint32
 	fs      uint32
+	xattrs  []xattr
+	inline  []byte // contents of a regular file stored in its inode
+}
+
+// xattrBlocks returns the number of blocks holding the node's extended
+// attributes, which come before anything else that belongs to it.
+func (n *node) xattrBlocks() uint32 {
+	if len(n.xattrs) > 0 {
+		return 1
+	}
+	return 0
+}
+
+// treeBlocks returns the number of extent tree blocks that come between the
+// node's extended attributes and its contents.
+func (n *node) treeBlocks() uint32 {
+	return n.fs - n.content - n.xattrBlocks()
 }
 
 type Inode struct {
@@ -59,10 +84,24 @@ type Inode struct {
 	SizeUpper        uint32   // 0x6C
 	FragAddr         uint32   // 0x70
 	OSStuff          [12]byte // 0x74
-} // 0x80
+	ExtraIsize       uint16   // 0x80
+	ChecksumHi       uint16   // 0x82
+	CtimeExtra       uint32   // 0x84
+	MtimeExtra       uint32   // 0x88
+	AtimeExtra       uint32   // 0x8C
+	Crtime           uint32   // 0x90
+	CrtimeExtra      uint32   // 0x94
+	VersionHi        uint32   // 0x98
+	ProjID           uint32   // 0x9C
+	Xattrs           [96]byte // 0xA0
+} // 0x100
 
 func iblockInline(n *node) []byte {
 
+	if n.inline != nil {
+		return n.inline
+	}
+
 	f := n.node.File
 	if f.IsSymlink() {
 		if f.SymlinkIsCached() {
@@ -75,6 +114,57 @@ func iblockInline(n *node) []byte {
 
 }
 
+// specialInodeType returns the inode type of a device node or named pipe.
+func specialInodeType(f vio.File) uint16 {
+
+	switch {
+	case f.Special() == os.ModeNamedPipe:
+		return InodeTypeFIFO
+	case f.Special()&os.ModeCharDevice != 0:
+		return InodeTypeCharDevice
+	default:
+		return InodeTypeBlockDevice
+	}
+
+}
+
+// iblockDevice encodes the device number of a device node the same way Linux
+// does: in the first word if the old 8-bit format can hold it, or in the
+// second word otherwise.
+func iblockDevice(n *node) []byte {
+
+	major, minor := n.node.File.Device()
+
+	var dev [2]uint32
+	if major < 256 && minor < 256 {
+		dev[0] = major<<8 | minor
+	} else {
+		dev[1] = minor&0xff | major<<8 | (minor&^0xff)<<12
+	}
+
+	buf := new(bytes.Buffer)
+	err := binary.Write(buf, binary.LittleEndian, dev)
+	if err != nil {
+		panic(err)
+	}
+
+	return buf.Bytes()
+
+}
+
+// setInodeOwnership replaces an inode's default owner and permissions. IDs
+// that don't fit in 16 bits have their upper halves in the OS-specific part of
+// the inode, the way Linux does it.
+func setInodeOwnership(inode *Inode, o *vio.Ownership) {
+
+	inode.Permissions = inode.Permissions&InodeTypeMask | uint16(o.Mode&vio.ModeMask)
+	inode.UID = uint16(o.UID)
+	inode.GID = uint16(o.GID)
+	binary.LittleEndian.PutUint16(inode.OSStuff[4:], uint16(o.UID>>16))
+	binary.LittleEndian.PutUint16(inode.OSStuff[6:], uint16(o.GID>>16))
+
+}
+
 type extent struct {
 	beginning int64
 	length    int64
@@ -123,6 +213,7 @@ func extentTree(extents []extent, max int64) *bytes.Buffer {
 		e := &Extent{
 			Block:   block,
 			Len:     uint16(extents[i].length),
+			StartHi: uint16(extents[i].beginning >> 32),
 			StartLo: uint32(extents[i].beginning),
 		}
 		block += uint32(extents[i].length)
@@ -161,6 +252,7 @@ func extentArray(n *node, mapper contentMapper) []extent {
 				beginning: addr,
 				length:    chunk,
 			})
+			addr += chunk
 			cursor += chunk
 			remainder -= chunk
 			delta -= chunk
@@ -220,10 +312,11 @@ func iblockExtentsRoot(n *node, mapper contentMapper) []byte {
 		panic(err)
 	}
 
-	addr, _ := mapper.mapContent(n.start)
+	addr, _ := mapper.mapContent(n.start + int64(n.xattrBlocks()))
 
 	idx := &ExtentIndex{
 		LeafLo: uint32(addr),
+		LeafHi: uint16(addr >> 32),
 	}
 	err = binary.Write(buf, binary.LittleEndian, idx)
 	if err != nil {
@@ -237,11 +330,15 @@ func iblockExtentsRoot(n *node, mapper contentMapper) []byte {
 func iblock(n *node, mapper contentMapper) []byte {
 
 	f := n.node.File
-	if n.fs == 0 && f.IsSymlink() && f.Size() < InodeMaximumInlineBytes {
+	if n.inline != nil || (n.content == 0 && f.IsSymlink() && f.Size() < InodeMaximumInlineBytes) {
 		return iblockInline(n)
 	}
 
-	if n.fs > n.content {
+	if f.Special() != 0 {
+		return iblockDevice(n)
+	}
+
+	if n.treeBlocks() > 0 {
 		// deep extent tree
 		return iblockExtentsRoot(n, mapper)
 	}
@@ -262,10 +359,12 @@ func generateInode(n *node, mapper contentMapper) *Inode {
 	inode.Permissions = InodeDefaultRegularFilePermissions
 	inode.UID = SuperUID
 	inode.SizeLower = uint32(f.Size())
+	inode.SizeUpper = uint32(int64(f.Size()) >> 32)
 	inode.GID = SuperGID
 	inode.Links = uint16(n.node.Links)
 	inode.Sectors = n.fs * SectorsPerBlock
 	inode.Flags = Ext4ExtentsFL
+	inode.ExtraIsize = InodeExtraSize
 
 	if f.IsSymlink() {
 		inode.Permissions = InodeDefaultSymlinkPermissions
@@ -276,6 +375,17 @@ func generateInode(n *node, mapper contentMapper) *Inode {
 		}
 	}
 
+	if n.inline != nil {
+		inode.Flags = Ext4InlineDataFL
+		copy(inode.Xattrs[:], inlineDataXattrs())
+	}
+
+	if f.Special() != 0 {
+		inode.Permissions = specialInodeType(f) | DefaultInodePermissions
+		inode.SizeLower = 0
+		inode.Flags &^= Ext4ExtentsFL
+	}
+
 	if f.IsDir() {
 		inode.Permissions = InodeDefaultDirectoryPermissions
 		inode.SizeLower = uint32(n.content * BlockSize)
@@ -284,8 +394,18 @@ func generateInode(n *node, mapper contentMapper) *Inode {
 		}
 	}
 
+	if o := f.Ownership(); o != nil {
+		setInodeOwnership(inode, o)
+	}
+
 	copy(inode.Block[:], iblock(n, mapper))
 
+	if len(n.xattrs) > 0 {
+		addr, _ := mapper.mapContent(n.start)
+		inode.FileACL = uint32(addr)
+		binary.LittleEndian.PutUint16(inode.OSStuff[2:], uint16(addr>>32))
+	}
+
 	return inode
 
 }
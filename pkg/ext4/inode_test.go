@@ -5,6 +5,7 @@ import (
 	"encoding/binary"
 	"io"
 	"io/ioutil"
+	"os"
 	"reflect"
 	"strings"
 	"testing"
@@ -124,6 +125,33 @@ func TestGenerateInodeEmptyFile(t *testing.T) {
 
 }
 
+func TestGenerateInodeOwnership(t *testing.T) {
+
+	n := &node{
+		node: &vio.TreeNode{
+			File: vio.CustomFile(vio.CustomFileArgs{
+				ReadCloser: ioutil.NopCloser(io.LimitReader(vio.Zeroes, 0)),
+				Ownership:  &vio.Ownership{UID: 0x10002, GID: 33, Mode: 04755},
+			}),
+			NodeSequenceNumber: 42,
+			Links:              1,
+		},
+	}
+
+	inode := generateInode(n, nil)
+
+	if inode.Permissions != InodeTypeRegularFile|04755 {
+		t.Errorf("inode has incorrect file permissions -- expect %x but got %x", InodeTypeRegularFile|04755, inode.Permissions)
+	}
+
+	uid := uint32(binary.LittleEndian.Uint16(inode.OSStuff[4:]))<<16 | uint32(inode.UID)
+	gid := uint32(binary.LittleEndian.Uint16(inode.OSStuff[6:]))<<16 | uint32(inode.GID)
+	if uid != 0x10002 || gid != 33 {
+		t.Errorf("inode has incorrect owner -- expect %d:%d but got %d:%d", 0x10002, 33, uid, gid)
+	}
+
+}
+
 func TestGenerateInodeSmallFile(t *testing.T) {
 
 	size := int64(38912) // 10 blocks
@@ -358,6 +386,58 @@ func TestGenerateInodeLargeSymlink(t *testing.T) {
 
 }
 
+func TestGenerateInodeDevice(t *testing.T) {
+
+	tests := []struct {
+		special      os.FileMode
+		major, minor uint32
+		permissions  uint16
+		dev          [2]uint32
+	}{
+		{os.ModeDevice | os.ModeCharDevice, 1, 3, InodeTypeCharDevice | DefaultInodePermissions, [2]uint32{0x103, 0}},
+		{os.ModeDevice, 259, 300, InodeTypeBlockDevice | DefaultInodePermissions, [2]uint32{0, 0x2c | 259<<8 | 0x100<<12}},
+		{os.ModeNamedPipe, 0, 0, InodeTypeFIFO | DefaultInodePermissions, [2]uint32{0, 0}},
+	}
+
+	for _, test := range tests {
+
+		n := &node{
+			node: &vio.TreeNode{
+				File: vio.CustomFile(vio.CustomFileArgs{
+					Special:    test.special,
+					Major:      test.major,
+					Minor:      test.minor,
+					ReadCloser: ioutil.NopCloser(strings.NewReader("")),
+				}),
+				NodeSequenceNumber: 42,
+				Links:              1,
+			},
+		}
+
+		inode := generateInode(n, &testContentMapper{})
+
+		if inode.Permissions != test.permissions {
+			t.Errorf("inode has incorrect file permissions -- expect %x but got %x", test.permissions, inode.Permissions)
+		}
+
+		if inode.Flags&Ext4ExtentsFL != 0 {
+			t.Errorf("device inode has Ext4ExtentsFL flag set")
+		}
+
+		var dev [2]uint32
+		err := binary.Read(bytes.NewReader(inode.Block[:]), binary.LittleEndian, &dev)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if dev != test.dev {
+			t.Errorf("inode has incorrect device number -- expect %x but got %x", test.dev, dev)
+		}
+
+	}
+
+}
+
 func TestGenerateInodeFlatDirectory(t *testing.T) {
 
 	blocks := int64(1)
@@ -4,7 +4,9 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"math"
 
+	"github.com/vorteil/vorteil/pkg/elog"
 	"github.com/vorteil/vorteil/pkg/vio"
 )
 
@@ -16,7 +18,7 @@ type planner struct {
 	minSize                                  int64
 }
 
-func calculateMinimumSize(ctx context.Context, minDataBlocks, minInodes, minInodesPer64 int64) (int64, error) {
+func calculateMinimumSize(ctx context.Context, minDataBlocks, minInodes, minInodesPer64 int64, force64Bit bool) (int64, error) {
 
 	var err error
 	var journalBlocks, contentBlocks, groups, groupsPerFlex int64
@@ -55,14 +57,16 @@ func calculateMinimumSize(ctx context.Context, minDataBlocks, minInodes, minInod
 
 		blocksPerInodeTable = divide(inodesPerGroup, InodesPerBlock)
 
+		is64Bit := force64Bit || groups*BlocksPerGroup > MaxBlocks32
+
 		groupDescriptors = groups
 		groupDescriptors *= 1024 // NOTE: default behaviour is to allow the file-system to grow up to 1024 times larger.
-		groupDescriptors = align(groupDescriptors, DescriptorsPerBlock)
-		if groupDescriptors > MaxGroupDescriptors {
-			groupDescriptors = MaxGroupDescriptors
+		groupDescriptors = align(groupDescriptors, descriptorsPerBlock(is64Bit))
+		if groupDescriptors > maxGroupDescriptors(is64Bit) {
+			groupDescriptors = maxGroupDescriptors(is64Bit)
 		}
 
-		blocksPerBGDT = divide(groupDescriptors, DescriptorsPerBlock)
+		blocksPerBGDT = divide(groupDescriptors, descriptorsPerBlock(is64Bit))
 
 		overheadBlocksPerFlex = (2 + blocksPerInodeTable) * groupsPerFlex
 		groupZeroOverhead = overheadBlocksPerFlex + blocksPerBGDT + 1
@@ -135,9 +139,9 @@ func calculateMinimumSize(ctx context.Context, minDataBlocks, minInodes, minInod
 
 }
 
-func (p *planner) commit(ctx context.Context, tree vio.FileTree) error {
+func (p *planner) commit(ctx context.Context, tree vio.FileTree, force64Bit bool, progress elog.Progress) error {
 
-	filledDataBlocks, nodeBlocks, err := scanInodes(ctx, tree)
+	filledDataBlocks, nodeBlocks, err := scanInodes(ctx, tree, progress)
 	if err != nil {
 		return err
 	}
@@ -153,7 +157,7 @@ func (p *planner) commit(ctx context.Context, tree vio.FileTree) error {
 	minDataBlocks := filledDataBlocks
 	minDataBlocks += divide(p.minFreeSpace, BlockSize)
 
-	p.minSize, err = calculateMinimumSize(ctx, minDataBlocks, minInodes, p.minInodesPer64)
+	p.minSize, err = calculateMinimumSize(ctx, minDataBlocks, minInodes, p.minInodesPer64, force64Bit)
 	if err != nil {
 		return err
 	}
@@ -162,7 +166,7 @@ func (p *planner) commit(ctx context.Context, tree vio.FileTree) error {
 
 }
 
-func scanInodes(ctx context.Context, tree vio.FileTree) (int64, []node, error) {
+func scanInodes(ctx context.Context, tree vio.FileTree, progress elog.Progress) (int64, []node, error) {
 
 	var err error
 	var ino, minInodes, filledDataBlocks, delta int64
@@ -178,20 +182,36 @@ func scanInodes(ctx context.Context, tree vio.FileTree) (int64, []node, error) {
 
 		ino++
 
+		var inline []byte
 		if n.File.IsSymlink() {
 			delta = calculateSymlinkBlocks(n.File)
 		} else if n.File.IsDir() {
 			delta = calculateDirectoryBlocks(n)
 		} else {
-			delta = calculateRegularFileBlocks(n.File)
+			inline, err = inlineData(n.File)
+			if err != nil {
+				return fmt.Errorf("%s: %v", path, err)
+			}
+			delta = 0
+			if inline == nil {
+				delta = calculateRegularFileBlocks(n.File)
+			}
+		}
+
+		xattrs, err := parseXattrs(n.File.Xattrs())
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
 		}
 
 		inodeBlocks[ino].start = filledDataBlocks
 		inodeBlocks[ino].node = n
 		inodeBlocks[ino].content = uint32(delta)
-		inodeBlocks[ino].fs = uint32(delta)
+		inodeBlocks[ino].xattrs = xattrs
+		inodeBlocks[ino].inline = inline
+		inodeBlocks[ino].fs = uint32(delta) + inodeBlocks[ino].xattrBlocks()
 		n.NodeSequenceNumber = ino
-		filledDataBlocks += delta
+		filledDataBlocks += int64(inodeBlocks[ino].fs)
+		progress.Increment(1)
 
 		return nil
 
@@ -219,11 +239,13 @@ func (c *Compiler) setPrecompileConstants(size, minDataBlocks, minInodes, minIno
 		minInodes = 10
 	}
 
+	is64Bit := c.super.use64Bit(blocks)
+
 	groupDescriptors := groups
 	groupDescriptors *= 1024 // NOTE: default behaviour is to allow the file-system to grow up to 1024 times larger.
-	groupDescriptors = align(groupDescriptors, DescriptorsPerBlock)
-	if groupDescriptors > MaxGroupDescriptors {
-		groupDescriptors = MaxGroupDescriptors
+	groupDescriptors = align(groupDescriptors, descriptorsPerBlock(is64Bit))
+	if groupDescriptors > maxGroupDescriptors(is64Bit) {
+		groupDescriptors = maxGroupDescriptors(is64Bit)
 	}
 
 	groupsPerFlex := int64(1)
@@ -246,8 +268,11 @@ func (c *Compiler) setPrecompileConstants(size, minDataBlocks, minInodes, minIno
 		return fmt.Errorf("file-system needs to be much larger to allow space for so many inodes")
 	}
 	inodesPerGroup = align(inodesPerGroup, InodesPerBlock)
+	if groups*inodesPerGroup > math.MaxUint32 {
+		return fmt.Errorf("file-system is too large for so many inodes per group")
+	}
 
-	superOverheadBlocks := 1 + divide(groupDescriptors, DescriptorsPerBlock)
+	superOverheadBlocks := 1 + divide(groupDescriptors, descriptorsPerBlock(is64Bit))
 	flexOverheadBlocks := (2 + divide(inodesPerGroup, InodesPerBlock)) * groupsPerFlex
 	if superOverheadBlocks+flexOverheadBlocks > BlocksPerGroup {
 		return errors.New("an unusual situation was encountered while calculating the layout of an ext4 file-system: you could try reducing the number of inodes or increasing the size of the image, or submit a bug report so we can improve this logic")
@@ -280,7 +305,7 @@ func (c *Compiler) setPrecompileConstants(size, minDataBlocks, minInodes, minIno
 
 	c.super.init(blocks, inodesPerGroup, &c.inodeBlocks)
 
-	c.data.init(c.super.inodes)
+	c.data.init(c.super.inodes, c.super.csumSeed)
 
 	return nil
 
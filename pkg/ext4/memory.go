@@ -0,0 +1,36 @@
+package ext4
+
+// DefaultMaxMemory is the most memory, in bytes, the compiler buffers at
+// once if CompilerArgs.MaxMemory is zero.
+const DefaultMaxMemory = 0x10000000 // 256 MiB
+
+// budgetMemory splits max bytes between the prefetch readers and the metadata
+// workers. Prefetching gets up to half of it, in chunks of every file the
+// readers read ahead, and each worker needs room for the metadata of a flex
+// group of flexSize bytes. It returns the number of chunks to read ahead of
+// each file and the number of workers to use, which is one (metadata rendered
+// as it is written, without buffering) if fewer than two fit. Neither is ever
+// less than one, so max is exceeded rather than stalling the compiler if it
+// is too small to make progress in.
+func budgetMemory(max int64, readers, workers int, flexSize int64) (int, int) {
+
+	chunks := int(max / 2 / (int64(readers) * prefetchChunkSize))
+	if chunks > prefetchChunksPerFile {
+		chunks = prefetchChunksPerFile
+	}
+	if chunks < 1 {
+		chunks = 1
+	}
+
+	max -= int64(readers*chunks) * prefetchChunkSize
+
+	if flexSize > 0 && int64(workers) > max/flexSize {
+		workers = int(max / flexSize)
+	}
+	if workers < 2 {
+		workers = 1
+	}
+
+	return chunks, workers
+
+}
@@ -0,0 +1,170 @@
+package ext4
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"runtime"
+	"sync"
+)
+
+// DefaultWorkers is the number of goroutines used to render flex group
+// metadata if CompilerArgs.Workers is zero.
+var DefaultWorkers = runtime.NumCPU()
+
+// renderedFlex is the metadata of a single flex group, rendered by a worker
+// and waiting to be merged into the image in order.
+type renderedFlex struct {
+	data []byte
+	err  error
+}
+
+// metadataRenderer renders the metadata of each flex group concurrently into
+// independent buffers so that the bitmaps and inode tables of a large
+// file-system can be generated on every core while the data blocks, which
+// must be read in order, are being written. At most 'workers' flex groups are
+// rendered or waiting to be written at any time, which bounds memory use.
+//
+// If the image can be written at arbitrary offsets, each worker writes the
+// metadata it rendered straight into place, so the data writer never waits
+// on it and only has to collect the results to check them for errors.
+type metadataRenderer struct {
+	results []chan renderedFlex
+	slots   chan struct{}
+	wa      io.WriterAt
+	next    int64 // the first flex group whose result hasn't been collected
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+}
+
+func (c *Compiler) startRenderingMetadata(ctx context.Context, workers int, wa io.WriterAt) *metadataRenderer {
+
+	ctx, cancel := context.WithCancel(ctx)
+
+	r := &metadataRenderer{
+		results: make([]chan renderedFlex, c.totalFlexes()),
+		slots:   make(chan struct{}, workers),
+		wa:      wa,
+		cancel:  cancel,
+	}
+
+	for i := range r.results {
+		r.results[i] = make(chan renderedFlex, 1)
+	}
+
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		for f := range r.results {
+			select {
+			case r.slots <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			r.wg.Add(1)
+			go func(f int) {
+				defer r.wg.Done()
+				result := c.renderFlexGroupMetaData(ctx, int64(f))
+				if r.wa != nil {
+					if result.err == nil {
+						_, result.err = r.wa.WriteAt(result.data, c.flexMetaDataOffset(int64(f)))
+					}
+					result.data = nil
+					<-r.slots
+				}
+				r.results[f] <- result
+			}(f)
+		}
+	}()
+
+	return r
+
+}
+
+func (c *Compiler) renderFlexGroupMetaData(ctx context.Context, flex int64) renderedFlex {
+
+	err := ctx.Err()
+	if err != nil {
+		return renderedFlex{err: err}
+	}
+
+	buf := new(bytes.Buffer)
+	buf.Grow(int(BlockSize * c.flexOverheadBlocks()))
+
+	err = c.super.writeFlexGroupMetaData(ctx, buf, flex)
+	if err != nil {
+		return renderedFlex{err: err}
+	}
+
+	return renderedFlex{data: buf.Bytes()}
+
+}
+
+// write waits for the metadata of the flex group to finish rendering, then
+// writes it to w and frees its slot for another flex group.
+func (r *metadataRenderer) write(ctx context.Context, w io.Writer, flex int64) error {
+
+	var result renderedFlex
+
+	select {
+	case result = <-r.results[flex]:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	<-r.slots
+
+	if result.err != nil {
+		return result.err
+	}
+
+	_, err := w.Write(result.data)
+	if err != nil {
+		return err
+	}
+
+	return nil
+
+}
+
+// collect checks the results of the flex groups whose metadata the workers
+// have written directly, in order, and returns how many it checked. If wait
+// is true it waits for all of them, otherwise it stops at the first that
+// hasn't finished.
+func (r *metadataRenderer) collect(ctx context.Context, wait bool) (int64, error) {
+
+	var n int64
+
+	for ; r.next < int64(len(r.results)); r.next++ {
+
+		var result renderedFlex
+
+		if wait {
+			select {
+			case result = <-r.results[r.next]:
+			case <-ctx.Done():
+				return n, ctx.Err()
+			}
+		} else {
+			select {
+			case result = <-r.results[r.next]:
+			default:
+				return n, nil
+			}
+		}
+
+		if result.err != nil {
+			return n, result.err
+		}
+		n++
+
+	}
+
+	return n, nil
+
+}
+
+func (r *metadataRenderer) stop() {
+	r.cancel()
+	r.wg.Wait()
+}
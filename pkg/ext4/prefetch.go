@@ -0,0 +1,160 @@
+package ext4
+
+import (
+	"context"
+	"io"
+	"sync"
+
+	"github.com/vorteil/vorteil/pkg/vio"
+)
+
+const (
+	DefaultPrefetchReaders = 1
+	prefetchChunkSize      = 0x100000 // 1 MiB
+	prefetchChunksPerFile  = 8
+)
+
+// prefetchedFile is the buffered contents of a single node, filled by a
+// prefetcher worker and drained by the data writer.
+type prefetchedFile struct {
+	chunks chan []byte
+	err    error
+	buf    []byte
+}
+
+func (f *prefetchedFile) Read(p []byte) (int, error) {
+
+	for len(f.buf) == 0 {
+		chunk, ok := <-f.chunks
+		if !ok {
+			if f.err != nil {
+				return 0, f.err
+			}
+			return 0, io.EOF
+		}
+		f.buf = chunk
+	}
+
+	n := copy(p, f.buf)
+	f.buf = f.buf[n:]
+	return n, nil
+
+}
+
+// prefetcher reads the contents of upcoming nodes ahead of the data writer
+// so that writes aren't stalled waiting on slow sources. Each reader handles
+// every nth node in offset order, which means a single reader consumes files
+// in exactly the same order the writer would have. More than one reader
+// should only be used if the files in the tree can be read independently of
+// one another (files loaded from an archive cannot).
+type prefetcher struct {
+	files  map[*node]*prefetchedFile
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func prefetchable(n *node) bool {
+	return n.node != nil && n.content > 0 && !n.node.File.IsDir()
+}
+
+// newPrefetcher starts prefetching the contents of nodes, reading up to
+// chunks chunks ahead of each. If skipLocal is true, files on the local
+// file-system are left alone so that they can be copied directly into the
+// image instead.
+func newPrefetcher(ctx context.Context, nodes offsetOrderedNodes, readers, chunks int, skipLocal bool) *prefetcher {
+
+	if readers < 1 {
+		readers = 1
+	}
+
+	if chunks < 1 {
+		chunks = 1
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	p := &prefetcher{
+		files:  make(map[*node]*prefetchedFile),
+		cancel: cancel,
+	}
+
+	var queue []*node
+	for _, n := range nodes {
+		if prefetchable(n) && !(skipLocal && vio.IsLocalFile(n.node.File)) {
+			queue = append(queue, n)
+			p.files[n] = &prefetchedFile{
+				chunks: make(chan []byte, chunks),
+			}
+		}
+	}
+
+	for i := 0; i < readers; i++ {
+		p.wg.Add(1)
+		go p.read(ctx, queue, i, readers)
+	}
+
+	return p
+
+}
+
+func (p *prefetcher) read(ctx context.Context, queue []*node, first, stride int) {
+
+	defer p.wg.Done()
+
+	for i := first; i < len(queue); i += stride {
+		if !p.fill(ctx, queue[i]) {
+			return
+		}
+	}
+
+}
+
+func (p *prefetcher) fill(ctx context.Context, n *node) bool {
+
+	f := p.files[n]
+	defer close(f.chunks)
+	defer n.node.File.Close()
+
+	for {
+		chunk := make([]byte, prefetchChunkSize)
+		k, err := io.ReadFull(n.node.File, chunk)
+		if k > 0 {
+			select {
+			case f.chunks <- chunk[:k]:
+			case <-ctx.Done():
+				f.err = ctx.Err()
+				return false
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return true
+		}
+		if err != nil {
+			f.err = err
+			return true
+		}
+	}
+
+}
+
+func (p *prefetcher) handles(n *node) bool {
+	_, ok := p.files[n]
+	return ok
+}
+
+// reader returns the prefetched contents for n, or nil if n isn't handled
+// by the prefetcher.
+func (p *prefetcher) reader(n *node) io.Reader {
+
+	f, ok := p.files[n]
+	if !ok {
+		return nil
+	}
+
+	return f
+
+}
+
+func (p *prefetcher) close() {
+	p.cancel()
+	p.wg.Wait()
+}
@@ -0,0 +1,67 @@
+package ext4
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"testing"
+
+	"github.com/vorteil/vorteil/pkg/vio"
+)
+
+func TestPrefetcher(t *testing.T) {
+
+	var nodes offsetOrderedNodes
+	var contents [][]byte
+
+	for i := 0; i < 16; i++ {
+		data := bytes.Repeat([]byte(fmt.Sprintf("%d", i)), prefetchChunkSize/4*(i+1))
+		contents = append(contents, data)
+		nodes = append(nodes, &node{
+			node: &vio.TreeNode{
+				File: vio.CustomFile(vio.CustomFileArgs{
+					Name:       fmt.Sprintf("%d", i),
+					Size:       len(data),
+					ReadCloser: ioutil.NopCloser(bytes.NewReader(data)),
+				}),
+			},
+			start:   int64(i),
+			content: uint32(divide(int64(len(data)), BlockSize)),
+			fs:      uint32(divide(int64(len(data)), BlockSize)),
+		})
+	}
+
+	for _, x := range []struct {
+		readers, chunks int
+	}{
+		{1, prefetchChunksPerFile},
+		{3, prefetchChunksPerFile},
+		{3, 1},
+	} {
+
+		for i, n := range nodes {
+			n.node.File = vio.CustomFile(vio.CustomFileArgs{
+				Name:       n.node.File.Name(),
+				Size:       len(contents[i]),
+				ReadCloser: ioutil.NopCloser(bytes.NewReader(contents[i])),
+			})
+		}
+
+		p := newPrefetcher(context.Background(), nodes, x.readers, x.chunks, false)
+
+		for i, n := range nodes {
+			data, err := ioutil.ReadAll(p.reader(n))
+			if err != nil {
+				t.Error(err)
+			}
+			if !bytes.Equal(data, contents[i]) {
+				t.Errorf("prefetcher with %d readers and %d chunks returned bad data for node %d", x.readers, x.chunks, i)
+			}
+		}
+
+		p.close()
+
+	}
+
+}
@@ -15,14 +15,14 @@ const (
 
 func (s *super) resizeData() []byte {
 
-	descriptorBlocks := divide(s.totalGroupDescriptors, DescriptorsPerBlock)
+	descriptorBlocks := divide(s.totalGroupDescriptors, s.descriptorsPerBlock())
 
 	buf := new(bytes.Buffer)
 
 	for i := int64(0); i < descriptorBlocks && i < BlockSize/4; i++ {
 		addr := 1 + i
 		x := addr
-		if int64(len(s.descriptors)-1)/DescriptorsPerBlock >= i {
+		if int64(len(s.descriptors)-1)/s.descriptorsPerBlock() >= i {
 			x = 0
 		}
 		err := binary.Write(buf, binary.LittleEndian, uint32(x))
@@ -66,6 +66,7 @@ func (s *super) generateResizeInode(n *node, mapper contentMapper) *Inode {
 	inode.UID = SuperUID
 	inode.GID = SuperGID
 	inode.Links = 1
+	inode.ExtraIsize = InodeExtraSize
 	inode.SizeLower = 0x40C000                                                    // size of the "hole" where the direct pointers and single indirect pointers cover.
 	inode.SizeUpper = 0x1                                                         // size of the total space coverable by the double indirect pointers.
 	inode.Sectors = uint32((s.reservedGDTBlocksPerTable() + 1) * SectorsPerBlock) // redo
@@ -5,6 +5,7 @@ import (
 	"context"
 	"encoding/binary"
 	"io"
+	"math"
 	"time"
 )
 
@@ -19,7 +20,7 @@ const (
 	BlockSize           = 0x1000
 	BlocksPerGroup      = BlockSize * 8
 	DescriptorSize      = 32
-	InodeSize           = 128
+	InodeSize           = 256
 	SectorsPerBlock     = BlockSize / SectorSize
 	DescriptorsPerBlock = BlockSize / DescriptorSize
 	InodesPerBlock      = BlockSize / InodeSize
@@ -30,6 +31,19 @@ const (
 	MaxGroupDescriptors = (BlocksPerGroup / 2) * DescriptorsPerBlock // NOTE: capped to 128 TiB because we're not using meta block groups (META_BG) this is half the documented limit, but bg 0 can't be 100% group descriptors so I've cut it in half for safety
 )
 
+// group descriptors are twice as big on file-systems with the 64bit feature
+const (
+	DescriptorSize64      = 64
+	DescriptorsPerBlock64 = BlockSize / DescriptorSize64
+	MaxGroupDescriptors64 = (BlocksPerGroup / 2) * DescriptorsPerBlock64
+)
+
+// MaxBlocks32 is the most blocks a file-system can have without the 64bit
+// feature (16 TiB). Larger file-systems get 64 byte group descriptors and the
+// upper halves of block numbers in the superblock, group descriptors and
+// extents.
+const MaxBlocks32 = math.MaxUint32
+
 const (
 	CompatDirPrealloc  = 0x1   // COMPAT_DIR_PREALLOC
 	CompatHasJournal   = 0x4   // COMPAT_HAS_JOURNAL
@@ -41,13 +55,15 @@ const (
 const (
 	IncompatFiletype   = 0x2    // INCOMPAT_FILETYPE
 	IncompatExtents    = 0x40   // INCOMPAT_EXTENTS
+	Incompat64Bit      = 0x80   // INCOMPAT_64BIT
 	IncompatFlexBG     = 0x200  // INCOMPAT_FLEX_BG
 	IncompatInlineData = 0x8000 // INCOMPAT_INLINE_DATA
 )
 
 const (
-	ROCompatSparseSuper = 0x1 // RO_COMPAT_SPARSE_SUPER
-	ROCompatLargeFile   = 0x2 // RO_COMPAT_LARGE_FILE
+	ROCompatSparseSuper = 0x1  // RO_COMPAT_SPARSE_SUPER
+	ROCompatLargeFile   = 0x2  // RO_COMPAT_LARGE_FILE
+	ROCompatExtraIsize  = 0x40 // RO_COMPAT_EXTRA_ISIZE
 )
 
 // Superblock is the structure of a superblock as written to the disk.
@@ -84,7 +100,7 @@ type Superblock struct {
 	FeatureIncompat     uint32 // 0x60
 	FeatureROCompat     uint32
 	UUID                [16]byte
-	_                   [16]byte
+	VolumeName          [16]byte
 	_                   [64]byte
 	_                   uint32
 	PreallocBlocks      uint8
@@ -102,11 +118,11 @@ type Superblock struct {
 	_                   uint32
 	_                   uint32
 	_                   [17]uint32
+	TotalBlocksHi       uint32 // 0x150
 	_                   uint32
-	_                   uint32
-	_                   uint32
-	_                   uint16
-	_                   uint16
+	UnallocatedBlocksHi uint32
+	MinExtraIsize       uint16
+	WantExtraIsize      uint16
 	Flags               uint32 // 0x160
 	_                   uint16
 	_                   uint16
@@ -151,7 +167,7 @@ type Superblock struct {
 	_                   uint16
 	_                   uint16
 	_                   [95]uint32
-	_                   uint32
+	Checksum            uint32 // 0x3FC
 }
 
 type layout struct {
@@ -159,6 +175,36 @@ type layout struct {
 	logGroupsPerFlex      int64
 	totalBlocks           int64
 	inodesPerGroup        int64
+	is64Bit               bool
+}
+
+// descriptorsPerBlock returns the number of group descriptors in a block of
+// the group descriptor table.
+func descriptorsPerBlock(is64Bit bool) int64 {
+	if is64Bit {
+		return DescriptorsPerBlock64
+	}
+	return DescriptorsPerBlock
+}
+
+// maxGroupDescriptors returns the most group descriptors that can be reserved
+// for growth.
+func maxGroupDescriptors(is64Bit bool) int64 {
+	if is64Bit {
+		return MaxGroupDescriptors64
+	}
+	return MaxGroupDescriptors
+}
+
+func (l *layout) descriptorSize() int64 {
+	if l.is64Bit {
+		return DescriptorSize64
+	}
+	return DescriptorSize
+}
+
+func (l *layout) descriptorsPerBlock() int64 {
+	return descriptorsPerBlock(l.is64Bit)
 }
 
 func (l *layout) groupsPerFlex() int64 {
@@ -178,7 +224,7 @@ func (l *layout) totalInodes() int64 {
 }
 
 func (l *layout) reservedGDTBlocksPerTable() int64 {
-	return divide(l.totalGroupDescriptors, DescriptorsPerBlock) - divide(l.totalGroups(), DescriptorsPerBlock)
+	return divide(l.totalGroupDescriptors, l.descriptorsPerBlock()) - divide(l.totalGroups(), l.descriptorsPerBlock())
 }
 
 func (l *layout) inodeBlocksPerGroup() int64 {
@@ -186,13 +232,24 @@ func (l *layout) inodeBlocksPerGroup() int64 {
 }
 
 func (l *layout) superOverheadBlocks() int64 {
-	return 1 + divide(l.totalGroupDescriptors, DescriptorsPerBlock)
+	return 1 + divide(l.totalGroupDescriptors, l.descriptorsPerBlock())
 }
 
 func (l *layout) flexOverheadBlocks() int64 {
 	return l.groupsPerFlex() * (2 + l.inodeBlocksPerGroup())
 }
 
+// flexMetaDataOffset returns the offset in bytes of the bitmaps and inode
+// tables of a flex group, which follow the superblock and group descriptor
+// table in the first.
+func (l *layout) flexMetaDataOffset(flex int64) int64 {
+	offset := BlockSize * BlocksPerGroup * l.groupsPerFlex() * flex
+	if flex == 0 {
+		offset += BlockSize * l.superOverheadBlocks()
+	}
+	return offset
+}
+
 type descriptor struct {
 	freeInodes  uint16
 	freeBlocks  uint16
@@ -204,21 +261,34 @@ type descriptors []descriptor
 type super struct {
 	layout
 	timestamp time.Time
+	uuid      [16]byte
+	label     string
+	csumSeed  uint32
+
+	// force64Bit enables the 64bit feature on file-systems small enough
+	// not to need it
+	force64Bit bool
 
 	descriptors      descriptors
 	blockUsageBitmap []uint64
 	inodes           *[]node
 }
 
-func totalGroupsAllowingForGrowth(g int64) int64 {
+func totalGroupsAllowingForGrowth(g int64, is64Bit bool) int64 {
 	g *= 1024
-	g = align(g, DescriptorsPerBlock)
-	if g > MaxGroupDescriptors {
-		g = MaxGroupDescriptors
+	g = align(g, descriptorsPerBlock(is64Bit))
+	if g > maxGroupDescriptors(is64Bit) {
+		g = maxGroupDescriptors(is64Bit)
 	}
 	return g
 }
 
+// use64Bit returns true if a file-system with the given number of blocks
+// needs the 64bit feature, or should have it anyway.
+func (s *super) use64Bit(totalBlocks int64) bool {
+	return s.force64Bit || totalBlocks > MaxBlocks32
+}
+
 func logGroupsPerFlex(totalGroups, inodeBlocksPerGroup, superOverheadBlocks int64) int64 {
 
 	var x int64
@@ -259,10 +329,14 @@ func (s *super) extentTreeBlocks(n *node) int64 {
 }
 
 func (s *super) init(totalBlocks, inodesPerGroup int64, nodes *[]node) {
-	s.timestamp = time.Now()
+	if s.timestamp.IsZero() {
+		s.timestamp = time.Now()
+	}
+	s.csumSeed = checksumSeed(s.uuid)
 	s.layout.inodesPerGroup = inodesPerGroup
 	s.layout.totalBlocks = totalBlocks
-	s.layout.totalGroupDescriptors = totalGroupsAllowingForGrowth(divide(totalBlocks, BlocksPerGroup))
+	s.layout.is64Bit = s.use64Bit(totalBlocks)
+	s.layout.totalGroupDescriptors = totalGroupsAllowingForGrowth(divide(totalBlocks, BlocksPerGroup), s.is64Bit)
 	s.layout.logGroupsPerFlex = logGroupsPerFlex(s.totalGroups(), s.inodeBlocksPerGroup(), s.superOverheadBlocks())
 
 	s.descriptors = make(descriptors, s.totalGroups())
@@ -371,6 +445,8 @@ func (s *super) generateSuperblock(g int64) *Superblock {
 		TotalInodes:         uint32(s.totalInodes()),
 		TotalBlocks:         uint32(s.totalBlocks),
 		UnallocatedBlocks:   uint32(s.totalFreeBlocks()),
+		TotalBlocksHi:       uint32(s.totalBlocks >> 32),
+		UnallocatedBlocksHi: uint32(s.totalFreeBlocks() >> 32),
 		UnallocatedInodes:   uint32(s.totalFreeInodes()),
 		LogBlockSize:        2,
 		LogClusterSize:      2,
@@ -392,28 +468,43 @@ func (s *super) generateSuperblock(g int64) *Superblock {
 		FirstIno:            11,
 		InodeSize:           InodeSize,
 		BlockGroupNumber:    uint16(g),
-		FeatureCompat:       CompatDirPrealloc | CompatHasJournal | CompatResizeInode | CompatDirIndex | CompatSparseSuper2,
+		FeatureCompat:       CompatDirPrealloc | CompatHasJournal | CompatExtAttr | CompatResizeInode | CompatDirIndex | CompatSparseSuper2,
 		FeatureIncompat:     IncompatFiletype | IncompatExtents | IncompatFlexBG | IncompatInlineData,
-		FeatureROCompat:     ROCompatSparseSuper | ROCompatLargeFile, // NOTE: the resize inode is "larger than 2 GiB"...
-		// TODO UUID
-		PreallocBlocks:    PreallocFileBlocks,
-		PreallocDirBlocks: PreallocDirBlocks,
-		ReservedGDTBlocks: uint16(s.reservedGDTBlocksPerTable()),
+		FeatureROCompat:     ROCompatSparseSuper | ROCompatLargeFile | ROCompatMetadataCsum | ROCompatExtraIsize, // NOTE: the resize inode is "larger than 2 GiB"...
+		UUID:                s.uuid,
+		PreallocBlocks:      PreallocFileBlocks,
+		PreallocDirBlocks:   PreallocDirBlocks,
+		ReservedGDTBlocks:   uint16(s.reservedGDTBlocksPerTable()),
 		// TODO JournalUUID
 		JournalInum: JournalInode,
 		// TODO HashSeed
 		DefHashVersion: DirentHashVersion,
 		// TODO JnlBackupType
-		DescSize: DescriptorSize,
-		// TODO DefaultMountOpts
+		DescSize:         uint16(s.descriptorSize()),
+		DefaultMountOpts: DefaultMountOptsXattrUser | DefaultMountOptsACL,
 		Flags:            0x2,
 		LogGroupsPerFlex: uint8(s.logGroupsPerFlex),
-		ChecksumType:     1,
+		ChecksumType:     ChecksumTypeCRC32C,
+		MinExtraIsize:    InodeExtraSize,
+		WantExtraIsize:   InodeExtraSize,
 		// TODO MountOptions
 		// BackupBGs intentionally left blank (no redundancy).
 
 	}
 
+	copy(sb.VolumeName[:], s.label)
+
+	if s.is64Bit {
+		sb.FeatureIncompat |= Incompat64Bit
+	}
+
+	buf := new(bytes.Buffer)
+	err := binary.Write(buf, binary.LittleEndian, sb)
+	if err != nil {
+		panic(err)
+	}
+	sb.Checksum = superblockChecksum(buf.Bytes())
+
 	return sb
 
 }
@@ -450,11 +541,110 @@ type BlockGroupDescriptor struct {
 	Directories     uint16 // 0x10
 	Flags           uint16 // 0x12
 	_               uint32 // 0x14
-	_, _            uint16 // 0x18
+	BlockBitmapCsum uint16 // 0x18
+	InodeBitmapCsum uint16 // 0x1A
 	UnusedInodes    uint16 // 0x1C
-	_               uint16 // 0x1E
+	Checksum        uint16 // 0x1E
 } // 0x20
 
+// BlockGroupDescriptorHi is the second half of a block group descriptor on a
+// file-system with the 64bit feature, which holds the upper halves of its
+// fields.
+type BlockGroupDescriptorHi struct {
+	BlockBitmapAddrHi uint32 // 0x20
+	InodeBitmapAddrHi uint32 // 0x24
+	InodeTableAddrHi  uint32 // 0x28
+	FreeBlocksHi      uint16 // 0x2C
+	FreeInodesHi      uint16 // 0x2E
+	DirectoriesHi     uint16 // 0x30
+	UnusedInodesHi    uint16 // 0x32
+	_                 uint32 // 0x34
+	BlockBitmapCsumHi uint16 // 0x38
+	InodeBitmapCsumHi uint16 // 0x3A
+	_                 uint32 // 0x3C
+} // 0x40
+
+// groupDescriptor is a block group descriptor of either size. Its upper
+// halves are only written to file-systems with the 64bit feature.
+type groupDescriptor struct {
+	BlockGroupDescriptor
+	BlockGroupDescriptorHi
+}
+
+func (d *groupDescriptor) setAddrs(blockBitmap, inodeBitmap, inodeTable int64) {
+	d.BlockBitmapAddr = uint32(blockBitmap)
+	d.BlockBitmapAddrHi = uint32(blockBitmap >> 32)
+	d.InodeBitmapAddr = uint32(inodeBitmap)
+	d.InodeBitmapAddrHi = uint32(inodeBitmap >> 32)
+	d.InodeTableAddr = uint32(inodeTable)
+	d.InodeTableAddrHi = uint32(inodeTable >> 32)
+}
+
+func (d *groupDescriptor) blockBitmapAddr() int64 {
+	return int64(d.BlockBitmapAddr) | int64(d.BlockBitmapAddrHi)<<32
+}
+
+func (d *groupDescriptor) inodeBitmapAddr() int64 {
+	return int64(d.InodeBitmapAddr) | int64(d.InodeBitmapAddrHi)<<32
+}
+
+func (d *groupDescriptor) inodeTableAddr() int64 {
+	return int64(d.InodeTableAddr) | int64(d.InodeTableAddrHi)<<32
+}
+
+func (d *groupDescriptor) setBlockBitmapCsum(crc uint32) {
+	d.BlockBitmapCsum = uint16(crc)
+	d.BlockBitmapCsumHi = uint16(crc >> 16)
+}
+
+func (d *groupDescriptor) setInodeBitmapCsum(crc uint32) {
+	d.InodeBitmapCsum = uint16(crc)
+	d.InodeBitmapCsumHi = uint16(crc >> 16)
+}
+
+// encode returns the descriptor as it's written to a file-system with group
+// descriptors of the given size.
+func (d *groupDescriptor) encode(size int64) []byte {
+
+	buf := new(bytes.Buffer)
+	err := binary.Write(buf, binary.LittleEndian, &d.BlockGroupDescriptor)
+	if err != nil {
+		panic(err)
+	}
+
+	if size > DescriptorSize {
+		err = binary.Write(buf, binary.LittleEndian, &d.BlockGroupDescriptorHi)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	return buf.Bytes()
+
+}
+
+// decodeGroupDescriptor reads a group descriptor of either size.
+func decodeGroupDescriptor(raw []byte) (groupDescriptor, error) {
+
+	var d groupDescriptor
+
+	r := bytes.NewReader(raw)
+	err := binary.Read(r, binary.LittleEndian, &d.BlockGroupDescriptor)
+	if err != nil {
+		return d, err
+	}
+
+	if len(raw) > DescriptorSize {
+		err = binary.Read(r, binary.LittleEndian, &d.BlockGroupDescriptorHi)
+		if err != nil {
+			return d, err
+		}
+	}
+
+	return d, nil
+
+}
+
 func (s *super) generateBGDT() []byte {
 
 	buf := new(bytes.Buffer)
@@ -463,7 +653,7 @@ func (s *super) generateBGDT() []byte {
 	inodeBlocksPerGroup := s.inodeBlocksPerGroup()
 	superOverheadBlocks := s.superOverheadBlocks()
 
-	var desc BlockGroupDescriptor
+	var desc groupDescriptor
 
 	for g := int64(0); g < groups; g++ {
 		flex := g / groupsPerFlex
@@ -472,17 +662,19 @@ func (s *super) generateBGDT() []byte {
 		if flex == 0 {
 			delta += superOverheadBlocks
 		}
-		desc.BlockBitmapAddr = uint32(flex*groupsPerFlex*BlocksPerGroup + delta + remainder)
-		desc.InodeBitmapAddr = desc.BlockBitmapAddr + uint32(groupsPerFlex)
-		desc.InodeTableAddr = uint32(flex*groupsPerFlex*BlocksPerGroup + delta + 2*groupsPerFlex + remainder*inodeBlocksPerGroup)
+		blockBitmap := flex*groupsPerFlex*BlocksPerGroup + delta + remainder
+		inodeBitmap := blockBitmap + groupsPerFlex
+		inodeTable := flex*groupsPerFlex*BlocksPerGroup + delta + 2*groupsPerFlex + remainder*inodeBlocksPerGroup
+		desc.setAddrs(blockBitmap, inodeBitmap, inodeTable)
 		desc.FreeBlocks = uint16(s.groupFreeBlocks(g))
 		desc.FreeInodes = uint16(s.groupFreeInodes(g))
 		desc.Directories = s.descriptors[g].directories
+		desc.setBlockBitmapCsum(bitmapChecksum(s.csumSeed, s.blockBitmap(g), BlocksPerGroup/8))
+		desc.setInodeBitmapCsum(bitmapChecksum(s.csumSeed, s.inodeBitmap(g), s.inodesPerGroup/8))
 
-		err := binary.Write(buf, binary.LittleEndian, &desc)
-		if err != nil {
-			panic(err)
-		}
+		raw := desc.encode(s.descriptorSize())
+		binary.LittleEndian.PutUint16(raw[bgdChecksumOffset:], descriptorChecksum(s.csumSeed, g, raw))
+		buf.Write(raw)
 	}
 
 	return buf.Bytes()
@@ -618,52 +810,45 @@ func (s *super) regionIsHole(begin, size int64) bool {
 
 }
 
-func (s *super) writeBlockBitmap(w io.Writer, g int64) error {
+// blockBitmap returns the block bitmap of group g. Groups past the end of the
+// file-system, which only exist to fill out the last flex group, are full.
+func (s *super) blockBitmap(g int64) []byte {
 
-	var err error
-	var slice []uint64
-	first := (BlocksPerGroup * g) / 64
-	l := int64(BlocksPerGroup) / 64
+	bitmap := bytes.Repeat([]byte{0xFF}, BlockSize)
 
 	if g >= s.totalGroups() {
-		goto end
+		return bitmap
 	}
 
-	slice = s.blockUsageBitmap[first:]
+	first := (BlocksPerGroup * g) / 64
+	l := int64(BlocksPerGroup) / 64
+
+	slice := s.blockUsageBitmap[first:]
 	if int64(len(slice)) > l {
 		slice = slice[:l]
 	}
 
-	err = binary.Write(w, binary.LittleEndian, slice)
-	if err != nil {
-		return err
+	for i, x := range slice {
+		binary.LittleEndian.PutUint64(bitmap[i*8:], x)
 	}
 
-end:
-	var free int
-	for _, x := range slice {
-		for bit := 0; bit < 64; bit++ {
-			if x&(x<<bit) == 0 {
-				free++
-			}
-		}
-	}
+	return bitmap
 
-	l = BlockSize - (int64(len(slice)) * 8)
-	for i := int64(0); i < l; i++ {
-		err = binary.Write(w, binary.LittleEndian, uint8(0xFF))
-		if err != nil {
-			return err
-		}
+}
+
+func (s *super) writeBlockBitmap(w io.Writer, g int64) error {
+
+	_, err := w.Write(s.blockBitmap(g))
+	if err != nil {
+		return err
 	}
 
 	return nil
 
 }
 
-func (s *super) writeInodeBitmap(w io.Writer, g int64) error {
-
-	var err error
+// inodeBitmap returns the inode bitmap of group g.
+func (s *super) inodeBitmap(g int64) []byte {
 
 	bitmap := bytes.Repeat([]byte{0xFF}, BlockSize)
 
@@ -676,7 +861,13 @@ func (s *super) writeInodeBitmap(w io.Writer, g int64) error {
 		}
 	}
 
-	err = binary.Write(w, binary.LittleEndian, bitmap)
+	return bitmap
+
+}
+
+func (s *super) writeInodeBitmap(w io.Writer, g int64) error {
+
+	_, err := w.Write(s.inodeBitmap(g))
 	if err != nil {
 		return err
 	}
@@ -706,7 +897,12 @@ func (s *super) writeInodeTable(w io.Writer, g int64) error {
 			inode = s.generateResizeInode(node, s)
 		}
 
-		err = binary.Write(w, binary.LittleEndian, inode)
+		if node == nil {
+			// unused inodes are left blank, which fsck accepts without a checksum
+			err = binary.Write(w, binary.LittleEndian, inode)
+		} else {
+			_, err = w.Write(checksumInode(s.csumSeed, ino, inode))
+		}
 		if err != nil {
 			return err
 		}
@@ -717,7 +913,7 @@ func (s *super) writeInodeTable(w io.Writer, g int64) error {
 
 }
 
-func (s *super) writeFlexGroupMetaData(ctx context.Context, w io.WriteSeeker, flex int64) error {
+func (s *super) writeFlexGroupMetaData(ctx context.Context, w io.Writer, flex int64) error {
 
 	var err error
 	begin := flex * s.groupsPerFlex()
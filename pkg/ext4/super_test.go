@@ -16,11 +16,21 @@ func TestSuperblockStruct(t *testing.T) {
 	// check that a couple of the fields are at the correct offsets
 	var offset int
 
+	offset = offsetOf(superblock, &superblock.VolumeName)
+	if offset != 0x78 {
+		t.Errorf("struct Superblock has been corrupted (a field is offset incorrectly)")
+	}
+
 	offset = offsetOf(superblock, &superblock.DefaultMountOpts)
 	if offset != 0x100 {
 		t.Errorf("struct Superblock has been corrupted (a field is offset incorrectly)")
 	}
 
+	offset = offsetOf(superblock, &superblock.TotalBlocksHi)
+	if offset != 0x150 {
+		t.Errorf("struct Superblock has been corrupted (a field is offset incorrectly)")
+	}
+
 	offset = offsetOf(superblock, &superblock.MountOptions)
 	if offset != 0x200 {
 		t.Errorf("struct Superblock has been corrupted (a field is offset incorrectly)")
@@ -48,6 +58,82 @@ func TestBlockGroupDescriptorStruct(t *testing.T) {
 
 }
 
+func TestGroupDescriptor64(t *testing.T) {
+
+	hi := &BlockGroupDescriptorHi{}
+	size := binary.Size(hi)
+	if size != DescriptorSize64-DescriptorSize {
+		t.Errorf("struct BlockGroupDescriptorHi is the wrong size -- expect %d but got %d", DescriptorSize64-DescriptorSize, size)
+	}
+
+	var desc groupDescriptor
+	desc.setAddrs(0x123456789, 0x12345678A, 0x12345678B)
+	desc.setBlockBitmapCsum(0xAABBCCDD)
+	desc.FreeBlocks = 100
+
+	raw := desc.encode(DescriptorSize64)
+	if len(raw) != DescriptorSize64 {
+		t.Fatalf("64 byte group descriptor encoded to %d bytes", len(raw))
+	}
+
+	x, err := decodeGroupDescriptor(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if x.blockBitmapAddr() != 0x123456789 || x.inodeBitmapAddr() != 0x12345678A || x.inodeTableAddr() != 0x12345678B {
+		t.Errorf("group descriptor addresses weren't preserved: %#x %#x %#x", x.blockBitmapAddr(), x.inodeBitmapAddr(), x.inodeTableAddr())
+	}
+
+	if x.BlockBitmapCsum != 0xCCDD || x.BlockBitmapCsumHi != 0xAABB || x.FreeBlocks != 100 {
+		t.Errorf("group descriptor fields weren't preserved: %+v", x)
+	}
+
+	if len(desc.encode(DescriptorSize)) != DescriptorSize {
+		t.Errorf("32 byte group descriptor has the wrong size")
+	}
+
+}
+
+func TestSuperLayout64Bit(t *testing.T) {
+
+	blocks := int64(BlocksPerGroup*12 - 100)
+	nodes := make([]node, 20)
+	nodes[RootDirInode].fs = 1
+	nodes[RootDirInode].node = &vio.TreeNode{
+		NodeSequenceNumber: RootDirInode,
+		File: vio.CustomFile(vio.CustomFileArgs{
+			IsDir: true,
+		}),
+	}
+	nodes[RootDirInode].node.Parent = nodes[RootDirInode].node
+
+	super := &super{force64Bit: true}
+	super.init(blocks, 100, &nodes)
+
+	sb := super.generateSuperblock(0)
+	if sb.FeatureIncompat&Incompat64Bit == 0 || sb.DescSize != DescriptorSize64 {
+		t.Errorf("superblock doesn't have the 64bit feature: %#x, %d", sb.FeatureIncompat, sb.DescSize)
+	}
+
+	if super.superOverheadBlocks() != 1+divide(super.totalGroupDescriptors, DescriptorsPerBlock64) {
+		t.Errorf("layout planned poorly -- group descriptor table is the wrong size")
+	}
+
+	bgdt := super.generateBGDT()
+	if int64(len(bgdt)) != super.totalGroups()*DescriptorSize64 {
+		t.Fatalf("expected %d bytes of group descriptors, got %d", super.totalGroups()*DescriptorSize64, len(bgdt))
+	}
+
+	for g := int64(0); g < super.totalGroups(); g++ {
+		raw := bgdt[g*DescriptorSize64 : (g+1)*DescriptorSize64]
+		if binary.LittleEndian.Uint16(raw[bgdChecksumOffset:]) != descriptorChecksum(super.csumSeed, g, raw) {
+			t.Errorf("group descriptor %d has the wrong checksum", g)
+		}
+	}
+
+}
+
 func TestSuperLayout(t *testing.T) {
 
 	blocks := int64(BlocksPerGroup*12 - 100)
@@ -92,7 +178,7 @@ func TestSuperLayout(t *testing.T) {
 			expectedFreeBlocks = super.totalBlocks - g*BlocksPerGroup
 		}
 		if g%super.groupsPerFlex() == 0 {
-			expectedFreeBlocks -= 24
+			expectedFreeBlocks -= super.groupsPerFlex() * (2 + super.inodeBlocksPerGroup())
 		}
 		if int64(super.descriptors[g].freeBlocks) != expectedFreeBlocks {
 			t.Errorf("layout planned poorly -- incorrect number of free blocks in group %d %d %d", g, expectedFreeBlocks, int64(super.descriptors[g].freeBlocks))
@@ -0,0 +1,331 @@
+package ext4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Extended attributes (and the POSIX ACLs and file capabilities stored in
+// them) are written to a block of their own for each inode that has any,
+// leaving the little room there is in the inode itself for the attribute that
+// marks inline data. The block comes before the inode's extent tree and
+// contents and is referenced by the inode's FileACL.
+
+const (
+	CompatExtAttr = 0x8 // COMPAT_EXT_ATTR
+
+	DefaultMountOptsXattrUser = 0x4 // EXT4_DEFM_XATTR_USER
+	DefaultMountOptsACL       = 0x8 // EXT4_DEFM_ACL
+)
+
+const (
+	XattrMagic           = 0xEA020000
+	xattrHeaderSize      = 0x20
+	xattrChecksumOffset  = 0x10
+	xattrEntryHeaderSize = 0x10
+	xattrMaxNameLength   = 255
+
+	// inlineDataXattr is the attribute that holds any inline data that
+	// doesn't fit in an inode's block map. It has to exist, even if it's
+	// empty, for the kernel to find an inode's inline data.
+	inlineDataXattr = "system.data"
+)
+
+// name indexes of the extended attribute namespaces
+const (
+	xattrIndexUser            = 1
+	xattrIndexPOSIXACLAccess  = 2
+	xattrIndexPOSIXACLDefault = 3
+	xattrIndexTrusted         = 4
+	xattrIndexSecurity        = 6
+	xattrIndexSystem          = 7
+)
+
+// xattrPrefixes map the start of an attribute's full name to the index of its
+// namespace, which replaces it on disk. The ACLs are matched by their whole
+// name, so they're checked before the rest of the system namespace.
+var xattrPrefixes = []struct {
+	prefix string
+	index  uint8
+}{
+	{"system.posix_acl_access", xattrIndexPOSIXACLAccess},
+	{"system.posix_acl_default", xattrIndexPOSIXACLDefault},
+	{"user.", xattrIndexUser},
+	{"trusted.", xattrIndexTrusted},
+	{"security.", xattrIndexSecurity},
+	{"system.", xattrIndexSystem},
+}
+
+type xattr struct {
+	index uint8
+	name  string
+	value []byte
+}
+
+// xattrHeader is the start of an extended attribute block.
+type xattrHeader struct {
+	Magic    uint32
+	RefCount uint32
+	Blocks   uint32
+	Hash     uint32
+	Checksum uint32
+	Reserved [3]uint32
+}
+
+// xattrEntry precedes each attribute's name, while its value is stored at the
+// end of the block.
+type xattrEntry struct {
+	NameLength  uint8
+	NameIndex   uint8
+	ValueOffset uint16
+	ValueInode  uint32
+	ValueSize   uint32
+	Hash        uint32
+}
+
+func xattrPad(x int) int {
+	return (x + 3) &^ 3
+}
+
+func (x *xattr) entrySize() int {
+	return xattrPad(xattrEntryHeaderSize + len(x.name))
+}
+
+// parseXattrs converts a file's extended attributes to the form they're
+// stored in, sorted the way the kernel expects to find them in a block.
+func parseXattrs(attrs map[string][]byte) ([]xattr, error) {
+
+	var list []xattr
+
+	for name, value := range attrs {
+
+		x, err := parseXattr(name, value)
+		if err != nil {
+			return nil, err
+		}
+
+		list = append(list, x)
+
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		a, b := list[i], list[j]
+		if a.index != b.index {
+			return a.index < b.index
+		}
+		if len(a.name) != len(b.name) {
+			return len(a.name) < len(b.name)
+		}
+		return a.name < b.name
+	})
+
+	// entries and the four byte terminator that follows them, then values
+	size := xattrHeaderSize + 4
+	for i := range list {
+		size += list[i].entrySize() + xattrPad(len(list[i].value))
+	}
+	if size > BlockSize {
+		return nil, fmt.Errorf("extended attributes need %d bytes but only %d fit in a block", size, BlockSize)
+	}
+
+	return list, nil
+
+}
+
+func parseXattr(name string, value []byte) (xattr, error) {
+
+	for _, p := range xattrPrefixes {
+
+		if !strings.HasPrefix(name, p.prefix) {
+			continue
+		}
+
+		x := xattr{
+			index: p.index,
+			name:  strings.TrimPrefix(name, p.prefix),
+			value: value,
+		}
+
+		isACL := x.index == xattrIndexPOSIXACLAccess || x.index == xattrIndexPOSIXACLDefault
+		if isACL && x.name != "" {
+			continue
+		}
+
+		if len(x.name) > xattrMaxNameLength {
+			return xattr{}, fmt.Errorf("extended attribute name '%s' is too long", name)
+		}
+
+		if isACL {
+			var err error
+			x.value, err = diskACL(value)
+			if err != nil {
+				return xattr{}, fmt.Errorf("bad extended attribute '%s': %v", name, err)
+			}
+		}
+
+		return x, nil
+
+	}
+
+	return xattr{}, fmt.Errorf("extended attribute '%s' isn't in a namespace ext4 supports", name)
+
+}
+
+// POSIX ACL entry tags
+const (
+	aclUserObj  = 0x01
+	aclUser     = 0x02
+	aclGroupObj = 0x04
+	aclGroup    = 0x08
+	aclMask     = 0x10
+	aclOther    = 0x20
+)
+
+const (
+	posixACLXattrVersion = 2
+	ext4ACLVersion       = 1
+)
+
+// diskACL converts an ACL from the format Linux passes through the xattr
+// system calls to the more compact one ext4 stores, which drops the unused ID
+// from entries that don't name a user or group.
+func diskACL(value []byte) ([]byte, error) {
+
+	if len(value) < 4 || (len(value)-4)%8 != 0 {
+		return nil, errors.New("invalid POSIX ACL size")
+	}
+
+	if binary.LittleEndian.Uint32(value) != posixACLXattrVersion {
+		return nil, errors.New("unsupported POSIX ACL version")
+	}
+
+	buf := new(bytes.Buffer)
+	buf.Write(le32(ext4ACLVersion))
+
+	for entry := value[4:]; len(entry) > 0; entry = entry[8:] {
+		tag := binary.LittleEndian.Uint16(entry)
+		switch tag {
+		case aclUserObj, aclGroupObj, aclMask, aclOther:
+			buf.Write(entry[:4])
+		case aclUser, aclGroup:
+			buf.Write(entry[:8])
+		default:
+			return nil, fmt.Errorf("invalid POSIX ACL tag %#x", tag)
+		}
+	}
+
+	return buf.Bytes(), nil
+
+}
+
+// xattrHash is the hash of a single attribute, which covers its name and the
+// words of its value padded with zeroes.
+func xattrHash(x *xattr) uint32 {
+
+	var hash uint32
+
+	for _, c := range []byte(x.name) {
+		hash = hash<<5 ^ hash>>27 ^ uint32(c)
+	}
+
+	value := make([]byte, xattrPad(len(x.value)))
+	copy(value, x.value)
+	for i := 0; i < len(value); i += 4 {
+		hash = hash<<16 ^ hash>>16 ^ binary.LittleEndian.Uint32(value[i:])
+	}
+
+	return hash
+
+}
+
+// xattrBlock encodes attrs as an extended attribute block with its checksum
+// left blank.
+func xattrBlock(attrs []xattr) []byte {
+
+	block := make([]byte, BlockSize)
+
+	var blockHash uint32
+	entries := new(bytes.Buffer)
+	end := BlockSize
+
+	for i := range attrs {
+		x := &attrs[i]
+
+		entry := &xattrEntry{
+			NameLength: uint8(len(x.name)),
+			NameIndex:  x.index,
+			ValueSize:  uint32(len(x.value)),
+			Hash:       xattrHash(x),
+		}
+
+		if len(x.value) > 0 {
+			end -= xattrPad(len(x.value))
+			copy(block[end:], x.value)
+			entry.ValueOffset = uint16(end)
+		}
+
+		blockHash = blockHash<<16 ^ blockHash>>16 ^ entry.Hash
+
+		err := binary.Write(entries, binary.LittleEndian, entry)
+		if err != nil {
+			panic(err)
+		}
+
+		entries.WriteString(x.name)
+		entries.Write(make([]byte, x.entrySize()-xattrEntryHeaderSize-len(x.name)))
+	}
+
+	hdr := &xattrHeader{
+		Magic:    XattrMagic,
+		RefCount: 1,
+		Blocks:   1,
+		Hash:     blockHash,
+	}
+
+	buf := new(bytes.Buffer)
+	err := binary.Write(buf, binary.LittleEndian, hdr)
+	if err != nil {
+		panic(err)
+	}
+
+	copy(block, buf.Bytes())
+	copy(block[xattrHeaderSize:], entries.Bytes())
+
+	return block
+
+}
+
+// inlineDataXattrs encodes the extended attributes stored in an inode with
+// inline data, which are just an empty inlineDataXattr, followed by the zeroes
+// that terminate the list.
+func inlineDataXattrs() []byte {
+
+	x, err := parseXattr(inlineDataXattr, nil)
+	if err != nil {
+		panic(err)
+	}
+
+	entry := &xattrEntry{
+		NameLength: uint8(len(x.name)),
+		NameIndex:  x.index,
+		Hash:       xattrHash(&x),
+	}
+
+	buf := new(bytes.Buffer)
+	buf.Write(le32(XattrMagic))
+
+	err = binary.Write(buf, binary.LittleEndian, entry)
+	if err != nil {
+		panic(err)
+	}
+
+	buf.WriteString(x.name)
+	buf.Write(make([]byte, x.entrySize()-xattrEntryHeaderSize-len(x.name)+4))
+
+	return buf.Bytes()
+
+}
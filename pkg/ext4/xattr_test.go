@@ -0,0 +1,196 @@
+package ext4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/vorteil/vorteil/pkg/vio"
+)
+
+// testACL is a POSIX ACL in the format of the xattr system calls, granting
+// read access to user 1000 on top of the usual owner, group and other entries.
+var testACL = []byte{
+	2, 0, 0, 0,
+	0x01, 0, 7, 0, 0xff, 0xff, 0xff, 0xff,
+	0x02, 0, 4, 0, 0xe8, 3, 0, 0,
+	0x04, 0, 5, 0, 0xff, 0xff, 0xff, 0xff,
+	0x10, 0, 5, 0, 0xff, 0xff, 0xff, 0xff,
+	0x20, 0, 0, 0, 0xff, 0xff, 0xff, 0xff,
+}
+
+func TestDiskACL(t *testing.T) {
+
+	acl, err := diskACL(testACL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := []byte{
+		1, 0, 0, 0,
+		0x01, 0, 7, 0,
+		0x02, 0, 4, 0, 0xe8, 3, 0, 0,
+		0x04, 0, 5, 0,
+		0x10, 0, 5, 0,
+		0x20, 0, 0, 0,
+	}
+
+	if !bytes.Equal(acl, expect) {
+		t.Errorf("ACL converted incorrectly -- expect %x but got %x", expect, acl)
+	}
+
+	_, err = diskACL(testACL[:len(testACL)-1])
+	if err == nil {
+		t.Errorf("truncated ACL was accepted")
+	}
+
+	_, err = diskACL([]byte{1, 0, 0, 0})
+	if err == nil {
+		t.Errorf("ACL with the wrong version was accepted")
+	}
+
+}
+
+func TestParseXattrs(t *testing.T) {
+
+	attrs, err := parseXattrs(map[string][]byte{
+		"user.long":                []byte("a"),
+		"security.capability":      []byte("b"),
+		"user.b":                   []byte("c"),
+		"user.a":                   []byte("d"),
+		"system.posix_acl_access":  testACL,
+		"system.posix_acl_accessx": []byte("e"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := []struct {
+		index uint8
+		name  string
+	}{
+		{xattrIndexUser, "a"},
+		{xattrIndexUser, "b"},
+		{xattrIndexUser, "long"},
+		{xattrIndexPOSIXACLAccess, ""},
+		{xattrIndexSecurity, "capability"},
+		{xattrIndexSystem, "posix_acl_accessx"},
+	}
+
+	if len(attrs) != len(expect) {
+		t.Fatalf("expected %d attributes but got %d", len(expect), len(attrs))
+	}
+
+	for i := range expect {
+		if attrs[i].index != expect[i].index || attrs[i].name != expect[i].name {
+			t.Errorf("attribute %d should be %d/%s but got %d/%s", i, expect[i].index, expect[i].name, attrs[i].index, attrs[i].name)
+		}
+	}
+
+	_, err = parseXattrs(map[string][]byte{"other.x": nil})
+	if err == nil {
+		t.Errorf("attribute in an unknown namespace was accepted")
+	}
+
+	_, err = parseXattrs(map[string][]byte{"user.x": make([]byte, BlockSize)})
+	if err == nil {
+		t.Errorf("attribute too large for a block was accepted")
+	}
+
+}
+
+func TestXattrBlock(t *testing.T) {
+
+	attrs, err := parseXattrs(map[string][]byte{
+		"trusted.x":  []byte("y"),
+		"user.empty": nil,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	block := xattrBlock(attrs)
+	if len(block) != BlockSize {
+		t.Fatalf("expected a single block, got %d bytes", len(block))
+	}
+
+	if binary.LittleEndian.Uint32(block) != XattrMagic {
+		t.Errorf("extended attribute block has the wrong magic number")
+	}
+
+	// user.empty comes first, and has no value
+	entry := block[xattrHeaderSize:]
+	if entry[0] != 5 || entry[1] != xattrIndexUser || string(entry[16:21]) != "empty" {
+		t.Errorf("first entry is wrong: %x", entry[:24])
+	}
+	if binary.LittleEndian.Uint16(entry[2:]) != 0 || binary.LittleEndian.Uint32(entry[8:]) != 0 {
+		t.Errorf("empty attribute has a value")
+	}
+
+	entry = entry[24:]
+	if entry[0] != 1 || entry[1] != xattrIndexTrusted || entry[16] != 'x' {
+		t.Errorf("second entry is wrong: %x", entry[:20])
+	}
+
+	offset := binary.LittleEndian.Uint16(entry[2:])
+	if offset != BlockSize-4 || block[offset] != 'y' {
+		t.Errorf("value stored at the wrong offset: %d", offset)
+	}
+
+	// 'x' rotated into the upper half of the hash, then the value 'y'
+	if hash := binary.LittleEndian.Uint32(entry[12:]); hash != 0x00780079 {
+		t.Errorf("entry has the wrong hash -- expect %#x but got %#x", 0x00780079, hash)
+	}
+
+	if !bytes.Equal(entry[20:24], []byte{0, 0, 0, 0}) {
+		t.Errorf("entries aren't terminated")
+	}
+
+	seed := checksumSeed([16]byte{1, 2, 3, 4})
+	checksumXattrBlock(seed, 100, block)
+	crc := binary.LittleEndian.Uint32(block[xattrChecksumOffset:])
+	checksumXattrBlock(seed, 101, block)
+	if crc == binary.LittleEndian.Uint32(block[xattrChecksumOffset:]) {
+		t.Errorf("extended attribute block checksum doesn't depend on its address")
+	}
+
+}
+
+func TestGenerateInodeXattrs(t *testing.T) {
+
+	attrs, err := parseXattrs(map[string][]byte{"user.x": []byte("y")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n := &node{
+		node: &vio.TreeNode{
+			File: vio.CustomFile(vio.CustomFileArgs{
+				Size: 5,
+			}),
+		},
+		start:   3,
+		content: 1,
+		fs:      2,
+		xattrs:  attrs,
+	}
+
+	mapper := &testContentMapper{}
+	inode := generateInode(n, mapper)
+
+	addr, _ := mapper.mapContent(3)
+	if int64(inode.FileACL) != addr {
+		t.Errorf("inode points to the wrong extended attribute block -- expect %d but got %d", addr, inode.FileACL)
+	}
+
+	if inode.Sectors != 2*SectorsPerBlock {
+		t.Errorf("inode doesn't count its extended attribute block")
+	}
+
+	extents := extentArray(n, mapper)
+	content, _ := mapper.mapContent(4)
+	if len(extents) != 1 || extents[0].beginning != content {
+		t.Errorf("file contents should follow the extended attribute block: %v", extents)
+	}
+
+}
@@ -0,0 +1,984 @@
+package f2fs
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"time"
+	"unicode/utf16"
+
+	"github.com/vorteil/vorteil/pkg/elog"
+	"github.com/vorteil/vorteil/pkg/vio"
+)
+
+type node struct {
+	tree     *vio.TreeNode
+	parent   *node
+	children []*node
+	typ      uint8
+	ino      uint32
+	size     int64
+	target   string
+
+	// logical is the number of blocks the inode addresses, including holes,
+	// and blocks is the number of them actually stored, starting at start.
+	logical int64
+	blocks  int64
+	start   int64
+
+	// directories
+	depth    uint32
+	dentries []*dentryBlock
+
+	// addr is the block the inode is stored in, and extra are the direct
+	// and indirect nodes holding the addresses of blocks the inode has no
+	// room for, in the order they are stored after it. directs are the
+	// direct nodes among them, in order of the blocks they address.
+	addr    int64
+	nids    [5]uint32
+	extra   []*indexNode
+	directs []*indexNode
+}
+
+// indexNode is a direct node, which holds data block addresses, or an
+// indirect node, which holds the IDs of other nodes.
+type indexNode struct {
+	nid    uint32
+	offset int64
+	addr   int64
+	direct bool
+	first  int64
+	nids   []uint32
+}
+
+// CompilerArgs organizes all inputs necessary to create a new Compiler.
+type CompilerArgs struct {
+	FileTree vio.FileTree
+	Logger   elog.Logger
+
+	// UUID is written to the superblock to identify the file-system.
+	UUID [16]byte
+
+	// Label is the volume name written to the superblock. It can be no more
+	// than MaxLabelLength UTF-16 code units.
+	Label string
+}
+
+// Compiler builds an F2FS file-system. Compilation happens in the same stages
+// as the other file-system compilers: NewCompiler, Commit, Precompile,
+// Compile.
+//
+// The contents of every file are written to the start of the main area, in
+// the order the tree is walked, followed by every node from the next
+// segment on. That leaves the rest of the main area free, with an empty
+// segment open for each type of log. The file-system is written as if it had
+// been cleanly unmounted, so Linux doesn't need to recover anything when it
+// first mounts it.
+type Compiler struct {
+	log   elog.Logger
+	tree  vio.FileTree
+	uuid  [16]byte
+	label string
+
+	// timestamp is written to every inode instead of the current time, if it
+	// is set.
+	timestamp time.Time
+
+	freeSpace int64
+
+	nodes      []*node
+	nextNID    uint32
+	dataBlocks int64
+	nodeBlocks int64
+
+	// The following variables are set by Precompile.
+	size int64
+	geometry
+}
+
+// NewCompiler returns an initialized Compiler object. Its contents can be
+// modified with Mkdir and AddFile before calling Commit.
+func NewCompiler(args *CompilerArgs) *Compiler {
+	return &Compiler{
+		log:   args.Logger,
+		tree:  args.FileTree,
+		uuid:  args.UUID,
+		label: args.Label,
+	}
+}
+
+// Mkdir adds an empty directory to the file-system at 'path' if no file or
+// directory is already mapped there. It must be called before Commit.
+func (c *Compiler) Mkdir(path string) error {
+
+	_, base := filepath.Split(path)
+	err := c.tree.Map(path, vio.CustomFile(vio.CustomFileArgs{
+		Name:  base,
+		IsDir: true,
+	}))
+	if err != nil {
+		return err
+	}
+
+	return nil
+
+}
+
+// AddFile adds a file to the file-system at 'path'. It must be called before
+// Commit.
+func (c *Compiler) AddFile(path string, r io.ReadCloser, size int64, force bool) error {
+
+	_, base := filepath.Split(path)
+	err := c.tree.Map(path, vio.CustomFile(vio.CustomFileArgs{
+		Name:       base,
+		Size:       int(size),
+		ReadCloser: r,
+	}))
+	if err != nil {
+		return err
+	}
+
+	return nil
+
+}
+
+// IncreaseMinimumInodes does nothing, because F2FS allocates inodes from the
+// same space as everything else, as they're needed.
+func (c *Compiler) IncreaseMinimumInodes(inodes int64) {
+}
+
+// SetMinimumInodes does nothing, for the same reason as IncreaseMinimumInodes.
+func (c *Compiler) SetMinimumInodes(inodes int64) {
+}
+
+// SetMinimumInodesPer64MiB does nothing, for the same reason as
+// IncreaseMinimumInodes.
+func (c *Compiler) SetMinimumInodesPer64MiB(inodes int64) {
+}
+
+// IncreaseMinimumFreeSpace increases the free space left in the main area
+// beyond what the file-system sets aside for cleaning. It must be called
+// before Commit.
+func (c *Compiler) IncreaseMinimumFreeSpace(space int64) {
+	c.freeSpace += space
+}
+
+// Reproduce makes the Compiler write t to every inode instead of the current
+// time. The seed is unused, because the UUID is only ever the one given to
+// NewCompiler.
+func (c *Compiler) Reproduce(seed int64, t time.Time) {
+	c.timestamp = t
+}
+
+// Commit reads the targets of symlinks, lays out every directory's hash table,
+// and places every block, after which MinimumSize returns the smallest size
+// the file-system can be. Any calls to functions that change the contents of
+// the file-system must be done before this function is called.
+func (c *Compiler) Commit(ctx context.Context) error {
+
+	if c.timestamp.IsZero() {
+		c.timestamp = time.Now()
+	}
+
+	if len(utf16.Encode([]rune(c.label))) > MaxLabelLength {
+		return fmt.Errorf("f2fs volume label '%s' is longer than %d characters", c.label, MaxLabelLength)
+	}
+
+	nodes := make(map[*vio.TreeNode]*node)
+	c.nodes = nil
+
+	err := c.tree.WalkNode(func(path string, n *vio.TreeNode) error {
+
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		x := &node{tree: n, typ: fileType(n.File)}
+		nodes[n] = x
+		c.nodes = append(c.nodes, x)
+		x.ino = rootIno + uint32(len(c.nodes)-1)
+
+		if n.Parent == nil || n.Parent == n {
+			x.parent = x
+		} else {
+			x.parent = nodes[n.Parent]
+			x.parent.children = append(x.parent.children, x)
+			if name := n.File.Name(); len(name) == 0 || len(name) > MaxNameLength {
+				return fmt.Errorf("invalid file name '%s'", name)
+			}
+		}
+
+		switch x.typ {
+		case typeRegular:
+			x.size = int64(n.File.Size())
+			x.blocks = divide(x.size, BlockSize)
+			x.logical = x.blocks
+		case typeSymlink:
+			x.target = n.File.Symlink()
+			if !n.File.SymlinkIsCached() {
+				data, err := ioutil.ReadAll(n.File)
+				if err != nil {
+					return fmt.Errorf("failed to read '%s': %w", path, err)
+				}
+				x.target = string(data)
+			}
+			_ = n.File.Close()
+			if len(x.target) == 0 || len(x.target) >= BlockSize {
+				return fmt.Errorf("invalid symlink target for '%s'", path)
+			}
+			x.size = int64(len(x.target))
+			x.blocks = 1
+			x.logical = 1
+		}
+
+		return nil
+
+	})
+	if err != nil {
+		return err
+	}
+
+	c.nextNID = rootIno + uint32(len(c.nodes))
+
+	for _, x := range c.nodes {
+
+		if x.typ == typeDir {
+			sort.Slice(x.children, func(i, j int) bool {
+				return x.children[i].tree.File.Name() < x.children[j].tree.File.Name()
+			})
+			err = layoutDir(x)
+			if err != nil {
+				return err
+			}
+		}
+
+		err = c.planNodes(x)
+		if err != nil {
+			return err
+		}
+
+	}
+
+	c.place()
+
+	return nil
+
+}
+
+// planNodes creates the direct and indirect nodes a file needs, and gives
+// each an offset that identifies where it sits in the file's tree of nodes.
+func (c *Compiler) planNodes(n *node) error {
+
+	rest := n.logical - addrsPerInode
+	first := int64(addrsPerInode)
+
+	add := func(offset int64, direct bool) *indexNode {
+		x := &indexNode{
+			nid:    c.nextNID,
+			offset: offset,
+			direct: direct,
+		}
+		c.nextNID++
+		n.extra = append(n.extra, x)
+		if direct {
+			x.first = first
+			first += addrsPerBlock
+			rest -= addrsPerBlock
+			n.directs = append(n.directs, x)
+		}
+		return x
+	}
+
+	for k := 0; k < 2 && rest > 0; k++ {
+		n.nids[k] = add(int64(1+k), true).nid
+	}
+
+	for k := 0; k < 2 && rest > 0; k++ {
+		ind := add(int64(3+k*(nidsPerBlock+1)), false)
+		n.nids[2+k] = ind.nid
+		for j := 0; j < nidsPerBlock && rest > 0; j++ {
+			ind.nids = append(ind.nids, add(ind.offset+1+int64(j), true).nid)
+		}
+	}
+
+	if rest > 0 {
+		dind := add(5+2*nidsPerBlock, false)
+		n.nids[4] = dind.nid
+		for k := 0; k < nidsPerBlock && rest > 0; k++ {
+			ind := add(int64(6+2*nidsPerBlock+k*(nidsPerBlock+1)), false)
+			dind.nids = append(dind.nids, ind.nid)
+			for j := 0; j < nidsPerBlock && rest > 0; j++ {
+				ind.nids = append(ind.nids, add(ind.offset+1+int64(j), true).nid)
+			}
+		}
+	}
+
+	if rest > 0 {
+		return fmt.Errorf("'%s' is too big for an f2fs file-system", n.tree.Path())
+	}
+
+	return nil
+
+}
+
+// place gives every data block and node block an address relative to the
+// start of the main area. Data comes first, and nodes start at the next
+// segment so that no segment holds both.
+func (c *Compiler) place() {
+
+	c.dataBlocks = 0
+	for _, x := range c.nodes {
+		x.start = c.dataBlocks
+		c.dataBlocks += x.blocks
+	}
+
+	start := align(c.dataBlocks, BlocksPerSegment)
+	c.nodeBlocks = 0
+	for _, x := range c.nodes {
+		x.addr = start + c.nodeBlocks
+		c.nodeBlocks++
+		for _, y := range x.extra {
+			y.addr = start + c.nodeBlocks
+			c.nodeBlocks++
+		}
+	}
+
+}
+
+func (c *Compiler) dataSegments() int64 {
+	return divide(c.dataBlocks, BlocksPerSegment)
+}
+
+func (c *Compiler) usedSegments() int64 {
+	return c.dataSegments() + divide(c.nodeBlocks, BlocksPerSegment)
+}
+
+// MinimumSize returns the smallest size the file-system can be. It can be
+// called after a successful call to Commit.
+func (c *Compiler) MinimumSize() int64 {
+
+	used := c.usedSegments()
+	free := divide(c.freeSpace, SegmentSize)
+
+	segments := int64(minSegments)
+	for {
+		size := (segments + 1) * SegmentSize
+		g, err := newGeometry(size)
+		if err == errTooSmall {
+			segments++
+			continue
+		} else if err != nil {
+			// Precompile will return the same error
+			return size
+		}
+
+		ok, short := g.fits(used, free, int64(c.nextNID))
+		if ok {
+			return size
+		}
+		segments += short
+	}
+
+}
+
+// Precompile lays out the file-system to fill size bytes, with the main area
+// taking everything the other areas don't need.
+func (c *Compiler) Precompile(ctx context.Context, size int64) error {
+
+	g, err := newGeometry(size)
+	if err != nil {
+		return err
+	}
+
+	ok, _ := g.fits(c.usedSegments(), divide(c.freeSpace, SegmentSize), int64(c.nextNID))
+	if !ok {
+		return errTooSmall
+	}
+
+	c.size = size
+	c.geometry = *g
+
+	return nil
+
+}
+
+// RegionIsHole reports whether a region of the space passed to Precompile is
+// entirely after the last node block.
+func (c *Compiler) RegionIsHole(begin, size int64) bool {
+	end := c.mainBlock + c.dataSegments()*BlocksPerSegment + c.nodeBlocks
+	return begin >= end*BlockSize
+}
+
+// dataAddr returns the absolute address of a block of a file, or zero if
+// it's a hole.
+func (c *Compiler) dataAddr(n *node, index int64) uint32 {
+
+	if n.typ != typeDir {
+		return uint32(c.mainBlock + n.start + index)
+	}
+
+	k := sort.Search(len(n.dentries), func(i int) bool {
+		return n.dentries[i].index >= index
+	})
+	if k == len(n.dentries) || n.dentries[k].index != index {
+		return 0
+	}
+
+	return uint32(c.mainBlock + n.start + int64(k))
+
+}
+
+// owner returns the ID of the node holding the address of a block of a file,
+// and its position there.
+func (n *node) owner(index int64) (uint32, uint16) {
+
+	if index < addrsPerInode {
+		return n.ino, uint16(index)
+	}
+
+	index -= addrsPerInode
+	return n.directs[index/addrsPerBlock].nid, uint16(index % addrsPerBlock)
+
+}
+
+// Compile writes the file-system to w.
+func (c *Compiler) Compile(ctx context.Context, w io.WriteSeeker) error {
+
+	for _, fn := range []func(io.WriteSeeker) error{
+		c.writeSuperblocks,
+		c.writeCheckpoints,
+		c.writeSIT,
+		c.writeNAT,
+		c.writeSSA,
+	} {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		err := fn(w)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := c.writeData(ctx, w)
+	if err != nil {
+		return err
+	}
+
+	err = c.writeNodes(ctx, w)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Seek(c.size, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	return nil
+
+}
+
+func seekBlock(w io.WriteSeeker, block int64) error {
+	_, err := w.Seek(block*BlockSize, io.SeekStart)
+	return err
+}
+
+func (c *Compiler) superblock() *superblock {
+
+	super := &superblock{
+		Magic:               Magic,
+		MajorVersion:        1,
+		MinorVersion:        15,
+		LogSectorSize:       9,
+		LogSectorsPerBlock:  3,
+		LogBlockSize:        12,
+		LogBlocksPerSegment: logBlocksPerSegment,
+		SegmentsPerSection:  1,
+		SectionsPerZone:     1,
+		BlockCount:          uint64(c.blockCount),
+		SectionCount:        uint32(c.mainSegments),
+		SegmentCount:        uint32(c.segmentCount),
+		SegmentCountCkpt:    checkpointSegments,
+		SegmentCountSIT:     uint32(c.sitSegments),
+		SegmentCountNAT:     uint32(c.natSegments),
+		SegmentCountSSA:     uint32(c.ssaSegments),
+		SegmentCountMain:    uint32(c.mainSegments),
+		Segment0BlockAddr:   BlocksPerSegment,
+		CPBlockAddr:         BlocksPerSegment,
+		SITBlockAddr:        uint32(c.sitBlock),
+		NATBlockAddr:        uint32(c.natBlock),
+		SSABlockAddr:        uint32(c.ssaBlock),
+		MainBlockAddr:       uint32(c.mainBlock),
+		RootIno:             rootIno,
+		NodeIno:             nodeIno,
+		MetaIno:             metaIno,
+		UUID:                c.uuid,
+	}
+
+	copy(super.VolumeName[:], utf16.Encode([]rune(c.label)))
+	copy(super.Version[:], "vorteil")
+	copy(super.InitVersion[:], "vorteil")
+
+	return super
+
+}
+
+// writeSuperblocks writes the superblock to the first two blocks.
+func (c *Compiler) writeSuperblocks(w io.WriteSeeker) error {
+
+	super := c.superblock()
+
+	for i := int64(0); i < 2; i++ {
+		_, err := w.Seek(i*BlockSize+SuperblockOffset, io.SeekStart)
+		if err != nil {
+			return err
+		}
+		err = super.write(w)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+
+}
+
+// curseg returns the segment left open for a type of log. They come right
+// after the segments in use.
+func (c *Compiler) curseg(typ int) int64 {
+	return c.usedSegments() + int64(typ)
+}
+
+func (c *Compiler) checkpoint(version uint64) *checkpoint {
+
+	used := c.usedSegments()
+
+	cp := &checkpoint{
+		Version:              version,
+		UserBlockCount:       uint64((c.mainSegments - c.overprovision) * BlocksPerSegment),
+		ValidBlockCount:      uint64(c.dataBlocks + c.nodeBlocks),
+		ReservedSegments:     uint32(c.reserved),
+		OverprovSegments:     uint32(c.overprovision),
+		FreeSegments:         uint32(c.mainSegments - used - cursegTypes),
+		Flags:                cpUmountFlag | cpCompactSumFlag,
+		PackTotalBlockCount:  checkpointPackBlocks,
+		PackStartSum:         1,
+		ValidNodeCount:       uint32(c.nodeBlocks),
+		ValidInodeCount:      uint32(len(c.nodes)),
+		NextFreeNID:          c.nextNID,
+		SITVersionBitmapSize: uint32(c.sitSegments / 2 * BlocksPerSegment / 8),
+		NATVersionBitmapSize: uint32(c.natSegments / 2 * BlocksPerSegment / 8),
+		ChecksumOffset:       checksumOffset,
+	}
+
+	for i := 0; i < 8; i++ {
+		cp.CurDataSegno[i] = 0xFFFFFFFF
+		cp.CurNodeSegno[i] = 0xFFFFFFFF
+	}
+
+	for i := 0; i < 3; i++ {
+		cp.CurDataSegno[i] = uint32(c.curseg(cursegHotData + i))
+		cp.CurNodeSegno[i] = uint32(c.curseg(cursegHotNode + i))
+	}
+
+	return cp
+
+}
+
+// checkpointPackBlocks is the number of blocks in a checkpoint pack: the
+// checkpoint, the compacted summaries of the open data segments, the
+// summaries of the three open node segments, and the checkpoint again.
+const checkpointPackBlocks = 6
+
+// writeCheckpoints writes both checkpoint packs. The second is the same as the
+// first, but older, so that Linux uses the first and overwrites the second
+// next time it writes a checkpoint. The open segments are empty, so their
+// summaries are too, as are the SIT and NAT journals.
+func (c *Compiler) writeCheckpoints(w io.WriteSeeker) error {
+
+	nodeSummary := make([]byte, BlockSize)
+	nodeSummary[BlockSize-5] = sumTypeNode
+
+	for pack, version := range []uint64{1, 0} {
+
+		err := seekBlock(w, int64(1+pack)*BlocksPerSegment)
+		if err != nil {
+			return err
+		}
+
+		cp := c.checkpoint(version).block()
+		blocks := [][]byte{cp, make([]byte, BlockSize), nodeSummary, nodeSummary, nodeSummary, cp}
+		for _, block := range blocks {
+			_, err = w.Write(block)
+			if err != nil {
+				return err
+			}
+		}
+
+	}
+
+	return nil
+
+}
+
+// writeSIT writes the first copy of the SIT, recording how many blocks of
+// each segment are in use, which ones, and which type of log each segment
+// belongs to.
+func (c *Compiler) writeSIT(w io.WriteSeeker) error {
+
+	err := seekBlock(w, c.sitBlock)
+	if err != nil {
+		return err
+	}
+
+	dataSegments := c.dataSegments()
+	used := c.usedSegments()
+	block := make([]byte, BlockSize)
+
+	for seg := int64(0); seg < c.mainSegments; seg++ {
+
+		var valid, typ int64
+
+		switch {
+		case seg < dataSegments:
+			valid = c.dataBlocks - seg*BlocksPerSegment
+			typ = cursegWarmData
+		case seg < used:
+			valid = c.nodeBlocks - (seg-dataSegments)*BlocksPerSegment
+			typ = cursegWarmNode
+		case seg < used+cursegTypes:
+			typ = seg - used
+		}
+
+		if valid > BlocksPerSegment {
+			valid = BlocksPerSegment
+		}
+
+		entry := block[seg%sitEntriesPerBlock*sitEntrySize:][:sitEntrySize]
+		entry[0] = byte(valid)
+		entry[1] = byte(valid>>8 | typ<<2)
+		for i := int64(0); i < valid; i++ {
+			entry[2+i/8] |= 0x80 >> (i % 8)
+		}
+
+		if (seg+1)%sitEntriesPerBlock == 0 || seg == c.mainSegments-1 {
+			_, err = w.Write(block)
+			if err != nil {
+				return err
+			}
+			block = make([]byte, BlockSize)
+		}
+
+	}
+
+	return nil
+
+}
+
+// writeNAT writes the first copy of the NAT blocks holding entries for every
+// node ID in use, which give the block each node is stored in. The node and
+// meta inodes don't exist, but they still get entries so that nothing else
+// is given their IDs.
+func (c *Compiler) writeNAT(w io.WriteSeeker) error {
+
+	type entry struct {
+		ino  uint32
+		addr uint32
+	}
+
+	entries := make([]entry, c.nextNID)
+	entries[nodeIno] = entry{nodeIno, 1}
+	entries[metaIno] = entry{metaIno, 1}
+
+	for _, x := range c.nodes {
+		entries[x.ino] = entry{x.ino, uint32(c.mainBlock + x.addr)}
+		for _, y := range x.extra {
+			entries[y.nid] = entry{x.ino, uint32(c.mainBlock + y.addr)}
+		}
+	}
+
+	for start := int64(0); start < int64(len(entries)); start += natEntriesPerBlock {
+
+		err := seekBlock(w, c.natAddr(start))
+		if err != nil {
+			return err
+		}
+
+		block := make([]byte, BlockSize)
+		for i := start; i < start+natEntriesPerBlock && i < int64(len(entries)); i++ {
+			e := block[(i-start)*natEntrySize:]
+			binary.LittleEndian.PutUint32(e[1:], entries[i].ino)
+			binary.LittleEndian.PutUint32(e[5:], entries[i].addr)
+		}
+
+		_, err = w.Write(block)
+		if err != nil {
+			return err
+		}
+
+	}
+
+	return nil
+
+}
+
+// writeSSA writes the summary of every segment in use, which records the
+// node that points to each block in it, so that the cleaner can move the
+// block and update the node.
+func (c *Compiler) writeSSA(w io.WriteSeeker) error {
+
+	err := seekBlock(w, c.ssaBlock)
+	if err != nil {
+		return err
+	}
+
+	block := make([]byte, BlockSize)
+	count := 0
+
+	flush := func(typ byte) error {
+		block[BlockSize-5] = typ
+		_, err := w.Write(block)
+		block = make([]byte, BlockSize)
+		count = 0
+		return err
+	}
+
+	add := func(nid uint32, offset uint16, typ byte) error {
+		e := block[count*summarySize:]
+		binary.LittleEndian.PutUint32(e, nid)
+		binary.LittleEndian.PutUint16(e[5:], offset)
+		count++
+		if count == BlocksPerSegment {
+			return flush(typ)
+		}
+		return nil
+	}
+
+	for _, x := range c.nodes {
+		for i := int64(0); i < x.logical; i++ {
+			if c.dataAddr(x, i) == 0 {
+				continue
+			}
+			nid, offset := x.owner(i)
+			err = add(nid, offset, sumTypeData)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if count > 0 {
+		err = flush(sumTypeData)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, x := range c.nodes {
+		err = add(x.ino, 0, sumTypeNode)
+		if err != nil {
+			return err
+		}
+		for _, y := range x.extra {
+			err = add(y.nid, 0, sumTypeNode)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if count > 0 {
+		err = flush(sumTypeNode)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+
+}
+
+// writeData writes the contents of every file, directory and symlink to the
+// start of the main area.
+func (c *Compiler) writeData(ctx context.Context, w io.WriteSeeker) error {
+
+	err := seekBlock(w, c.mainBlock)
+	if err != nil {
+		return err
+	}
+
+	for _, x := range c.nodes {
+
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+
+		switch x.typ {
+		case typeRegular:
+			err = c.writeFile(w, x)
+		case typeDir:
+			for _, b := range x.dentries {
+				_, err = w.Write(b.render())
+				if err != nil {
+					break
+				}
+			}
+		case typeSymlink:
+			block := make([]byte, BlockSize)
+			copy(block, x.target)
+			_, err = w.Write(block)
+		}
+		if err != nil {
+			return err
+		}
+
+	}
+
+	return nil
+
+}
+
+// writeFile copies the contents of a regular file into its blocks.
+func (c *Compiler) writeFile(w io.Writer, n *node) error {
+
+	defer n.tree.File.Close()
+
+	_, err := io.CopyN(w, n.tree.File, n.size)
+	if err != nil {
+		return fmt.Errorf("failed to read '%s': %w", n.tree.Path(), err)
+	}
+
+	_, err = io.CopyN(w, vio.Zeroes, n.blocks*BlockSize-n.size)
+	if err != nil {
+		return err
+	}
+
+	return nil
+
+}
+
+// writeNodes writes every inode, each followed by its direct and indirect
+// nodes, from the segment after the last data block.
+func (c *Compiler) writeNodes(ctx context.Context, w io.WriteSeeker) error {
+
+	err := seekBlock(w, c.mainBlock+c.dataSegments()*BlocksPerSegment)
+	if err != nil {
+		return err
+	}
+
+	buf := new(bytes.Buffer)
+
+	for _, x := range c.nodes {
+
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+
+		buf.Reset()
+		_ = binary.Write(buf, binary.LittleEndian, c.inode(x))
+		c.writeFooter(buf, x, x.ino, 0)
+
+		for _, y := range x.extra {
+			addrs := y.nids
+			if y.direct {
+				addrs = make([]uint32, 0, addrsPerBlock)
+				for i := y.first; i < y.first+addrsPerBlock && i < x.logical; i++ {
+					addrs = append(addrs, c.dataAddr(x, i))
+				}
+			}
+			_ = binary.Write(buf, binary.LittleEndian, addrs)
+			buf.Write(make([]byte, (addrsPerBlock-len(addrs))*4))
+			c.writeFooter(buf, x, y.nid, y.offset)
+		}
+
+		_, err = w.Write(buf.Bytes())
+		if err != nil {
+			return err
+		}
+
+	}
+
+	return nil
+
+}
+
+// writeFooter writes the footer of a node belonging to inode n, which records
+// which node it is and where it sits in the inode's tree of nodes. Nodes of
+// anything but directories are marked cold, as Linux would.
+func (c *Compiler) writeFooter(buf *bytes.Buffer, n *node, nid uint32, offset int64) {
+
+	flag := uint32(offset) << offsetShift
+	if n.typ != typeDir {
+		flag |= coldBit
+	}
+
+	_ = binary.Write(buf, binary.LittleEndian, &footer{
+		NID:               nid,
+		Ino:               n.ino,
+		Flag:              flag,
+		CheckpointVersion: 1,
+	})
+
+}
+
+func (c *Compiler) inode(n *node) *inode {
+
+	own := n.tree.File.Ownership()
+	if own == nil {
+		own = &vio.DefaultOwnership
+	}
+
+	t := uint64(c.timestamp.Unix())
+	nsec := uint32(c.timestamp.Nanosecond())
+
+	x := &inode{
+		Mode:         typeModes[n.typ] | uint16(own.Mode&vio.ModeMask),
+		UID:          own.UID,
+		GID:          own.GID,
+		Links:        uint32(n.tree.Links),
+		Size:         uint64(n.size),
+		Blocks:       uint64(1 + n.blocks + int64(len(n.extra))),
+		Atime:        t,
+		Ctime:        t,
+		Mtime:        t,
+		AtimeNsec:    nsec,
+		CtimeNsec:    nsec,
+		MtimeNsec:    nsec,
+		CurrentDepth: n.depth,
+		ParentIno:    n.parent.ino,
+		NIDs:         n.nids,
+	}
+
+	if n != n.parent {
+		name := n.tree.File.Name()
+		x.NameLen = uint32(len(name))
+		copy(x.Name[:], name)
+	}
+
+	for i := int64(0); i < addrsPerInode && i < n.logical; i++ {
+		x.Addrs[i] = c.dataAddr(n, i)
+	}
+
+	if n.typ == typeBlockDevice || n.typ == typeCharDevice {
+		major, minor := n.tree.File.Device()
+		if major < 256 && minor < 256 {
+			x.Addrs[0] = major<<8 | minor
+		} else {
+			x.Addrs[1] = minor&0xff | major<<8 | (minor&^0xff)<<12
+		}
+	}
+
+	return x
+
+}
@@ -0,0 +1,198 @@
+package f2fs
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+)
+
+// dentryBlock is one block of a directory's hash table.
+type dentryBlock struct {
+	index   int64
+	used    [dentrySlots]bool
+	entries []placedEntry
+}
+
+type placedEntry struct {
+	slot int
+	name string
+	node *node
+}
+
+// room returns the first slot of the first run of free slots that's long
+// enough for a name needing n slots, or dentrySlots if there isn't one.
+func (b *dentryBlock) room(n int) int {
+
+	for start := 0; start < dentrySlots; {
+		if b.used[start] {
+			start++
+			continue
+		}
+		end := start
+		for end < dentrySlots && !b.used[end] {
+			end++
+		}
+		if end-start >= n {
+			return start
+		}
+		start = end
+	}
+
+	return dentrySlots
+
+}
+
+func (b *dentryBlock) place(slot int, name string, n *node) {
+
+	for i := 0; i < nameSlots(name); i++ {
+		b.used[slot+i] = true
+	}
+
+	b.entries = append(b.entries, placedEntry{slot, name, n})
+
+}
+
+// render returns the contents of the block: a bitmap of used slots, an entry
+// in the first slot used by each name, and the names themselves.
+func (b *dentryBlock) render() []byte {
+
+	data := make([]byte, BlockSize)
+
+	for i, used := range b.used {
+		if used {
+			data[i/8] |= 1 << (i % 8)
+		}
+	}
+
+	for _, e := range b.entries {
+		off := dentryBitmapSize + dentryReserved + e.slot*dentrySize
+		binary.LittleEndian.PutUint32(data[off:], hashName(e.name))
+		binary.LittleEndian.PutUint32(data[off+4:], e.node.ino)
+		binary.LittleEndian.PutUint16(data[off+8:], uint16(len(e.name)))
+		data[off+10] = e.node.typ
+		copy(data[dentryNamesOffset+e.slot*dentrySlotLen:], e.name)
+	}
+
+	return data
+
+}
+
+func nameSlots(name string) int {
+	return int(divide(int64(len(name)), dentrySlotLen))
+}
+
+// dirBuckets returns the number of hash buckets at a level of a directory's
+// hash table.
+func dirBuckets(level int) int64 {
+
+	if level < maxDirHashDepth/2 {
+		return 1 << level
+	}
+
+	return 1 << (maxDirHashDepth/2 - 1)
+
+}
+
+// bucketBlocks returns the number of blocks in each bucket at a level of a
+// directory's hash table.
+func bucketBlocks(level int) int64 {
+
+	if level < maxDirHashDepth/2 {
+		return 2
+	}
+
+	return 4
+
+}
+
+// dirBlockIndex returns the first block of a bucket of a directory's hash
+// table.
+func dirBlockIndex(level int, bucket int64) int64 {
+
+	var index int64
+	for i := 0; i < level; i++ {
+		index += dirBuckets(i) * bucketBlocks(i)
+	}
+
+	return index + bucket*bucketBlocks(level)
+
+}
+
+// layoutDir places a directory's entries in its hash table the same way
+// Linux would if they were created in order: in the first block with room
+// for them in the bucket their hash picks at the lowest level that has room.
+// Only blocks that end up with entries in them are stored, the rest are
+// holes.
+func layoutDir(n *node) error {
+
+	blocks := make(map[int64]*dentryBlock)
+	get := func(index int64) *dentryBlock {
+		b, ok := blocks[index]
+		if !ok {
+			b = &dentryBlock{index: index}
+			blocks[index] = b
+		}
+		return b
+	}
+
+	root := get(0)
+	root.place(0, ".", n)
+	root.place(1, "..", n.parent)
+	n.depth = 1
+
+	for _, child := range n.children {
+
+		name := child.tree.File.Name()
+		slots := nameSlots(name)
+		hash := int64(hashName(name))
+		placed := false
+
+		for level := 0; !placed; level++ {
+
+			if level == maxDirHashDepth {
+				return fmt.Errorf("too many entries in directory '%s'", n.tree.Path())
+			}
+
+			first := dirBlockIndex(level, hash%dirBuckets(level))
+			for index := first; index < first+bucketBlocks(level) && !placed; index++ {
+				b := blocks[index]
+				slot := 0
+				if b != nil {
+					slot = b.room(slots)
+				}
+				if slot < dentrySlots {
+					get(index).place(slot, name, child)
+					placed = true
+				}
+			}
+
+			if placed && uint32(level+1) > n.depth {
+				n.depth = uint32(level + 1)
+			}
+
+		}
+
+	}
+
+	n.dentries = make([]*dentryBlock, 0, len(blocks))
+	for _, b := range blocks {
+		n.dentries = append(n.dentries, b)
+	}
+
+	sort.Slice(n.dentries, func(i, j int) bool {
+		return n.dentries[i].index < n.dentries[j].index
+	})
+
+	last := n.dentries[len(n.dentries)-1].index
+	n.logical = last + 1
+	n.size = n.logical * BlockSize
+	n.blocks = int64(len(n.dentries))
+
+	return nil
+
+}
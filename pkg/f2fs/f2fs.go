@@ -0,0 +1,407 @@
+// Package f2fs builds F2FS file-systems. F2FS is log-structured: it only ever
+// writes to the end of a few open segments, and cleans up behind itself,
+// which suits SD cards and eMMC, where rewriting blocks in place wears out
+// the flash unevenly.
+package f2fs
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"os"
+
+	"github.com/vorteil/vorteil/pkg/vio"
+)
+
+const (
+	// Magic identifies an F2FS superblock. It's also the seed of the
+	// checksums F2FS uses.
+	Magic = 0xF2F52010
+
+	// BlockSize is the size of the blocks the file-system is divided into.
+	BlockSize = 4096
+
+	// BlocksPerSegment is the number of blocks in a segment, which is the
+	// unit the file-system allocates and cleans space in.
+	BlocksPerSegment = 512
+
+	// SegmentSize is the size of a segment.
+	SegmentSize = BlockSize * BlocksPerSegment
+
+	// SuperblockOffset is where the superblock is found in each of the
+	// first two blocks.
+	SuperblockOffset = 1024
+
+	// MaxLabelLength is the longest volume label an F2FS file-system can
+	// have, in UTF-16 code units.
+	MaxLabelLength = 512
+
+	// MaxNameLength is the longest name a file can have.
+	MaxNameLength = 255
+
+	logBlocksPerSegment = 9
+
+	nodeIno = 1
+	metaIno = 2
+	rootIno = 3
+
+	// checkpointSegments is the number of segments holding checkpoint
+	// packs, of which there are always two.
+	checkpointSegments = 2
+
+	// checksumOffset is where a checkpoint's checksum is stored.
+	checksumOffset = BlockSize - 4
+
+	// checkpointSize is the size of a checkpoint block before the bitmaps
+	// that follow it.
+	checkpointSize = 192
+
+	// maxBitmapSize is the most room the SIT and NAT bitmaps can take up in
+	// a checkpoint block. Bigger file-systems would need more checkpoint
+	// blocks.
+	maxBitmapSize = checksumOffset - checkpointSize
+
+	sitEntrySize       = 74
+	sitEntriesPerBlock = BlockSize / sitEntrySize
+
+	natEntrySize       = 9
+	natEntriesPerBlock = BlockSize / natEntrySize
+
+	summarySize        = 7
+	summaryJournalSize = BlockSize - 5 - summarySize*BlocksPerSegment
+
+	addrsPerInode = 923
+	addrsPerBlock = 1018
+	nidsPerBlock  = 1018
+
+	// dentry block layout
+	dentrySlots       = 214
+	dentryBitmapSize  = (dentrySlots + 7) / 8
+	dentryReserved    = 3
+	dentrySize        = 11
+	dentrySlotLen     = 8
+	maxDirHashDepth   = 63
+	dentryNamesOffset = dentryBitmapSize + dentryReserved + dentrySlots*dentrySize
+)
+
+// current segment types, which are also the types recorded in the SIT
+const (
+	cursegHotData = iota
+	cursegWarmData
+	cursegColdData
+	cursegHotNode
+	cursegWarmNode
+	cursegColdNode
+	cursegTypes
+)
+
+// checkpoint flags
+const (
+	cpUmountFlag     = 0x1
+	cpCompactSumFlag = 0x4
+)
+
+// summary block types
+const (
+	sumTypeData = 0
+	sumTypeNode = 1
+)
+
+// node footer flag bits
+const (
+	coldBit     = 0x1
+	offsetShift = 3
+)
+
+// file types recorded in directory entries
+const (
+	typeUnknown = iota
+	typeRegular
+	typeDir
+	typeCharDevice
+	typeBlockDevice
+	typeFIFO
+	typeSocket
+	typeSymlink
+)
+
+// file type bits of an inode's mode
+const (
+	modeFIFO        = 0x1000
+	modeCharDevice  = 0x2000
+	modeDir         = 0x4000
+	modeBlockDevice = 0x6000
+	modeRegular     = 0x8000
+	modeSymlink     = 0xA000
+)
+
+type superblock struct {
+	Magic               uint32
+	MajorVersion        uint16
+	MinorVersion        uint16
+	LogSectorSize       uint32
+	LogSectorsPerBlock  uint32
+	LogBlockSize        uint32
+	LogBlocksPerSegment uint32
+	SegmentsPerSection  uint32
+	SectionsPerZone     uint32
+	ChecksumOffset      uint32
+	BlockCount          uint64
+	SectionCount        uint32
+	SegmentCount        uint32
+	SegmentCountCkpt    uint32
+	SegmentCountSIT     uint32
+	SegmentCountNAT     uint32
+	SegmentCountSSA     uint32
+	SegmentCountMain    uint32
+	Segment0BlockAddr   uint32
+	CPBlockAddr         uint32
+	SITBlockAddr        uint32
+	NATBlockAddr        uint32
+	SSABlockAddr        uint32
+	MainBlockAddr       uint32
+	RootIno             uint32
+	NodeIno             uint32
+	MetaIno             uint32
+	UUID                [16]byte
+	VolumeName          [MaxLabelLength]uint16
+	ExtensionCount      uint32
+	ExtensionList       [64][8]byte
+	CPPayload           uint32
+	Version             [256]byte
+	InitVersion         [256]byte
+	Feature             uint32
+	EncryptionLevel     uint8
+	EncryptPwSalt       [16]byte
+	Devices             [8]struct {
+		Path          [64]byte
+		TotalSegments uint32
+	}
+	QuotaInodes   [3]uint32
+	HotExtCount   uint8
+	Encoding      uint16
+	EncodingFlags uint16
+	StopReason    [32]byte
+	Errors        [16]byte
+	Reserved      [258]byte
+	Checksum      uint32
+}
+
+func (s *superblock) write(w io.Writer) error {
+	return binary.Write(w, binary.LittleEndian, s)
+}
+
+type checkpoint struct {
+	Version              uint64
+	UserBlockCount       uint64
+	ValidBlockCount      uint64
+	ReservedSegments     uint32
+	OverprovSegments     uint32
+	FreeSegments         uint32
+	CurNodeSegno         [8]uint32
+	CurNodeBlkoff        [8]uint16
+	CurDataSegno         [8]uint32
+	CurDataBlkoff        [8]uint16
+	Flags                uint32
+	PackTotalBlockCount  uint32
+	PackStartSum         uint32
+	ValidNodeCount       uint32
+	ValidInodeCount      uint32
+	NextFreeNID          uint32
+	SITVersionBitmapSize uint32
+	NATVersionBitmapSize uint32
+	ChecksumOffset       uint32
+	ElapsedTime          uint64
+	AllocType            [16]byte
+}
+
+// block returns a checkpoint block, with its checksum. The SIT and NAT
+// version bitmaps are all zeroes, because only the first copy of each SIT and
+// NAT block is ever written.
+func (cp *checkpoint) block() []byte {
+
+	buf := new(bytes.Buffer)
+	_ = binary.Write(buf, binary.LittleEndian, cp)
+	data := make([]byte, BlockSize)
+	copy(data, buf.Bytes())
+	binary.LittleEndian.PutUint32(data[checksumOffset:], checksum(data[:checksumOffset]))
+
+	return data
+
+}
+
+// checksum returns the CRC32 F2FS stores with checkpoints, which is seeded
+// with the superblock's magic number and isn't inverted at either end.
+func checksum(p []byte) uint32 {
+	return ^crc32.Update(^uint32(Magic), crc32.IEEETable, p)
+}
+
+type inode struct {
+	Mode         uint16
+	Advise       uint8
+	Inline       uint8
+	UID          uint32
+	GID          uint32
+	Links        uint32
+	Size         uint64
+	Blocks       uint64
+	Atime        uint64
+	Ctime        uint64
+	Mtime        uint64
+	AtimeNsec    uint32
+	CtimeNsec    uint32
+	MtimeNsec    uint32
+	Generation   uint32
+	CurrentDepth uint32
+	XattrNID     uint32
+	Flags        uint32
+	ParentIno    uint32
+	NameLen      uint32
+	Name         [MaxNameLength]byte
+	DirLevel     uint8
+	Extent       [3]uint32
+	Addrs        [addrsPerInode]uint32
+	NIDs         [5]uint32
+}
+
+type footer struct {
+	NID               uint32
+	Ino               uint32
+	Flag              uint32
+	CheckpointVersion uint64
+	NextBlockAddr     uint32
+}
+
+type dirent struct {
+	Hash     uint32
+	Ino      uint32
+	NameLen  uint16
+	FileType uint8
+}
+
+func align(x, y int64) int64 {
+	return (x + y - 1) / y * y
+}
+
+func divide(x, y int64) int64 {
+	return (x + y - 1) / y
+}
+
+// fileType returns the type of f, as recorded in directory entries.
+func fileType(f vio.File) uint8 {
+
+	switch {
+	case f.IsDir():
+		return typeDir
+	case f.IsSymlink():
+		return typeSymlink
+	case f.Special() == os.ModeDevice:
+		return typeBlockDevice
+	case f.Special() == os.ModeDevice|os.ModeCharDevice:
+		return typeCharDevice
+	case f.Special() == os.ModeNamedPipe:
+		return typeFIFO
+	default:
+		return typeRegular
+	}
+
+}
+
+// typeModes are the file type bits of the mode of each type of inode.
+var typeModes = map[uint8]uint16{
+	typeRegular:     modeRegular,
+	typeDir:         modeDir,
+	typeCharDevice:  modeCharDevice,
+	typeBlockDevice: modeBlockDevice,
+	typeFIFO:        modeFIFO,
+	typeSymlink:     modeSymlink,
+}
+
+// hashName returns the hash F2FS uses to find a name in a directory, which
+// is a TEA-based hash much like the one ext3 offers.
+func hashName(name string) uint32 {
+
+	if name == "." || name == ".." {
+		return 0
+	}
+
+	buf := [4]uint32{0x67452301, 0xefcdab89, 0x98badcfe, 0x10325476}
+	p := []byte(name)
+
+	for {
+		teaTransform(&buf, str2hashbuf(p))
+		if len(p) <= 16 {
+			break
+		}
+		p = p[16:]
+	}
+
+	return buf[0]
+
+}
+
+// str2hashbuf packs up to 16 bytes of msg into four words, padding them
+// with a pattern derived from the number of bytes left in the name.
+func str2hashbuf(msg []byte) [4]uint32 {
+
+	var out [4]uint32
+	k, num := 0, len(out)
+
+	pad := uint32(len(msg)) | uint32(len(msg))<<8
+	pad |= pad << 16
+	val := pad
+
+	n := len(msg)
+	if n > num*4 {
+		n = num * 4
+	}
+
+	for i := 0; i < n; i++ {
+		if i%4 == 0 {
+			val = pad
+		}
+		val = uint32(msg[i]) + val<<8
+		if i%4 == 3 {
+			out[k] = val
+			k++
+			val = pad
+			num--
+		}
+	}
+
+	if num--; num >= 0 {
+		out[k] = val
+		k++
+	}
+
+	for num--; num >= 0; num-- {
+		out[k] = pad
+		k++
+	}
+
+	return out
+
+}
+
+func teaTransform(buf *[4]uint32, in [4]uint32) {
+
+	var sum uint32
+	b0, b1 := buf[0], buf[1]
+	a, b, c, d := in[0], in[1], in[2], in[3]
+
+	for n := 0; n < 16; n++ {
+		sum += 0x9E3779B9
+		b0 += ((b1 << 4) + a) ^ (b1 + sum) ^ ((b1 >> 5) + b)
+		b1 += ((b0 << 4) + c) ^ (b0 + sum) ^ ((b0 >> 5) + d)
+	}
+
+	buf[0] += b0
+	buf[1] += b1
+
+}
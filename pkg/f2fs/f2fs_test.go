@@ -0,0 +1,418 @@
+package f2fs
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vorteil/vorteil/pkg/vio"
+)
+
+func TestStructureSizes(t *testing.T) {
+
+	for _, x := range []struct {
+		v    interface{}
+		size int
+	}{
+		{&superblock{}, BlockSize - SuperblockOffset},
+		{&checkpoint{}, checkpointSize},
+		{&inode{}, BlockSize - 24},
+		{&footer{}, 24},
+		{&dirent{}, dentrySize},
+	} {
+		if size := binary.Size(x.v); size != x.size {
+			t.Errorf("%T is %d bytes, expected %d", x.v, size, x.size)
+		}
+	}
+
+	if dentryNamesOffset+dentrySlots*dentrySlotLen != BlockSize {
+		t.Errorf("dentry block layout doesn't fill a block")
+	}
+
+}
+
+func TestHash(t *testing.T) {
+
+	if hashName(".") != 0 || hashName("..") != 0 {
+		t.Errorf("dot entries should hash to zero")
+	}
+
+	buf := str2hashbuf([]byte("abc"))
+	if buf != [4]uint32{0x03616263, 0x03030303, 0x03030303, 0x03030303} {
+		t.Errorf("short name packed wrong: %x", buf)
+	}
+
+	buf = str2hashbuf([]byte("abcdefgh"))
+	if buf != [4]uint32{0x61626364, 0x65666768, 0x08080808, 0x08080808} {
+		t.Errorf("name packed wrong: %x", buf)
+	}
+
+	// names longer than 16 bytes are hashed in chunks
+	if hashName(strings.Repeat("a", 17)) == hashName(strings.Repeat("a", 16)) {
+		t.Errorf("long names should hash differently")
+	}
+
+}
+
+func TestOverprovision(t *testing.T) {
+
+	reserved, ovp, ok := overprovision(50)
+	if !ok || reserved != 18 || ovp != 24 {
+		t.Errorf("expected 18 reserved and 24 overprovisioned segments, got %d and %d", reserved, ovp)
+	}
+
+	_, _, ok = overprovision(5)
+	if ok {
+		t.Errorf("5 segments shouldn't leave any room")
+	}
+
+}
+
+// image reads back the parts of a compiled file-system the tests need.
+type image struct {
+	t     *testing.T
+	data  []byte
+	super superblock
+	cp    checkpoint
+}
+
+func (img *image) block(addr uint32) []byte {
+	return img.data[int64(addr)*BlockSize:][:BlockSize]
+}
+
+func (img *image) node(nid uint32) []byte {
+
+	g := &geometry{natBlock: int64(img.super.NATBlockAddr)}
+	block := img.block(uint32(g.natAddr(int64(nid))))
+	entry := block[int64(nid)%natEntriesPerBlock*natEntrySize:]
+	addr := binary.LittleEndian.Uint32(entry[5:])
+	if addr == 0 {
+		img.t.Fatalf("node %d has no address", nid)
+	}
+
+	data := img.block(addr)
+	f := new(footer)
+	_ = binary.Read(bytes.NewReader(data[BlockSize-24:]), binary.LittleEndian, f)
+	if f.NID != nid {
+		img.t.Fatalf("node %d has the footer of node %d", nid, f.NID)
+	}
+
+	return data
+
+}
+
+func (img *image) inode(ino uint32) *inode {
+
+	x := new(inode)
+	_ = binary.Read(bytes.NewReader(img.node(ino)), binary.LittleEndian, x)
+	return x
+
+}
+
+// dataAddr returns the address of a block of a file, following its direct
+// and indirect nodes the same way Linux does.
+func (img *image) dataAddr(x *inode, index int64) uint32 {
+
+	if index < addrsPerInode {
+		return x.Addrs[index]
+	}
+
+	addrs := func(nid uint32) []uint32 {
+		a := make([]uint32, addrsPerBlock)
+		_ = binary.Read(bytes.NewReader(img.node(nid)), binary.LittleEndian, a)
+		return a
+	}
+
+	index -= addrsPerInode
+	if index < 2*addrsPerBlock {
+		return addrs(x.NIDs[index/addrsPerBlock])[index%addrsPerBlock]
+	}
+
+	index -= 2 * addrsPerBlock
+	ind := addrs(x.NIDs[2])
+	return addrs(ind[index/addrsPerBlock])[index%addrsPerBlock]
+
+}
+
+// lookup finds a name in a directory the same way Linux does.
+func (img *image) lookup(dir uint32, name string) (uint32, uint8) {
+
+	x := img.inode(dir)
+	hash := hashName(name)
+
+	for level := 0; level < int(x.CurrentDepth); level++ {
+		first := dirBlockIndex(level, int64(hash)%dirBuckets(level))
+		for index := first; index < first+bucketBlocks(level); index++ {
+			if index*BlockSize >= int64(x.Size) {
+				continue
+			}
+			addr := img.dataAddr(x, index)
+			if addr == 0 {
+				continue
+			}
+			block := img.block(addr)
+			for slot := 0; slot < dentrySlots; slot++ {
+				if block[slot/8]&(1<<(slot%8)) == 0 {
+					continue
+				}
+				de := new(dirent)
+				_ = binary.Read(bytes.NewReader(block[dentryBitmapSize+dentryReserved+slot*dentrySize:]), binary.LittleEndian, de)
+				if de.Hash != hash || int(de.NameLen) != len(name) {
+					continue
+				}
+				off := dentryNamesOffset + slot*dentrySlotLen
+				if string(block[off:off+len(name)]) == name {
+					return de.Ino, de.FileType
+				}
+			}
+		}
+	}
+
+	img.t.Fatalf("'%s' not found in directory %d", name, dir)
+	return 0, 0
+
+}
+
+func (img *image) read(ino uint32) []byte {
+
+	x := img.inode(ino)
+	var out []byte
+	for i := int64(0); i < divide(int64(x.Size), BlockSize); i++ {
+		out = append(out, img.block(img.dataAddr(x, i))...)
+	}
+
+	return out[:x.Size]
+
+}
+
+func TestLayoutDir(t *testing.T) {
+
+	tree := vio.NewFileTree()
+	for i := 0; i < 1000; i++ {
+		name := fmt.Sprintf("/dir/file-with-a-long-name-%04d", i)
+		err := tree.Map(name, vio.CustomFile(vio.CustomFileArgs{
+			Name:       name[5:],
+			ReadCloser: ioutil.NopCloser(bytes.NewReader(nil)),
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c := NewCompiler(&CompilerArgs{FileTree: tree})
+	err := c.Commit(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := c.nodes[1]
+	if dir.depth < 2 {
+		t.Errorf("1000 entries shouldn't fit in the first level")
+	}
+
+	count := 0
+	for _, b := range dir.dentries {
+		count += len(b.entries)
+		for _, e := range b.entries {
+			if e.name == "." || e.name == ".." {
+				if b.index != 0 || e.slot > 1 {
+					t.Errorf("dot entries should be at the start of the first block")
+				}
+			}
+		}
+	}
+
+	if count != 1002 {
+		t.Errorf("expected 1002 entries, found %d", count)
+	}
+
+	if dir.size != dir.logical*BlockSize || dir.blocks > dir.logical {
+		t.Errorf("directory has the wrong size: %d bytes, %d blocks", dir.size, dir.blocks)
+	}
+
+}
+
+func TestCompile(t *testing.T) {
+
+	tree := vio.NewFileTree()
+	data := []byte(strings.Repeat("vorteil", (addrsPerInode+10)*BlockSize/7))
+
+	for path, args := range map[string]vio.CustomFileArgs{
+		"/a": {
+			Size:       len(data),
+			ReadCloser: ioutil.NopCloser(bytes.NewReader(data)),
+			Ownership:  &vio.Ownership{UID: 1, GID: 2, Mode: 0644},
+		},
+		"/b": {
+			ReadCloser: ioutil.NopCloser(bytes.NewReader(nil)),
+		},
+		"/c": {
+			IsSymlink: true,
+			Symlink:   "a",
+		},
+	} {
+		args.Name = path[1:]
+		err := tree.Map(path, vio.CustomFile(args))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c := NewCompiler(&CompilerArgs{
+		FileTree: tree,
+		UUID:     [16]byte{1, 2, 3},
+		Label:    "root",
+	})
+	err := c.Mkdir("dev")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.Reproduce(0, time.Unix(1000, 0))
+
+	ctx := context.Background()
+	err = c.Commit(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	size := c.MinimumSize()
+	if size%SegmentSize != 0 {
+		t.Errorf("minimum size %d isn't a whole number of segments", size)
+	}
+
+	err = c.Precompile(ctx, size-SegmentSize)
+	if err == nil {
+		t.Errorf("precompile accepted a size that's too small")
+	}
+
+	err = c.Precompile(ctx, size+SegmentSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.RegionIsHole(0, BlockSize) || !c.RegionIsHole(size, BlockSize) {
+		t.Errorf("holes are in the wrong place")
+	}
+
+	f, err := ioutil.TempFile("", "f2fs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	err = c.Compile(ctx, f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_ = f.Truncate(size + SegmentSize)
+	raw, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	img := &image{t: t, data: raw}
+	_ = binary.Read(bytes.NewReader(raw[SuperblockOffset:]), binary.LittleEndian, &img.super)
+	s := &img.super
+
+	if s.Magic != Magic || !bytes.Equal(raw[SuperblockOffset:BlockSize], raw[BlockSize+SuperblockOffset:2*BlockSize]) {
+		t.Fatalf("superblocks are wrong")
+	}
+
+	// the areas must follow each other exactly
+	if s.SITBlockAddr != s.CPBlockAddr+s.SegmentCountCkpt*BlocksPerSegment ||
+		s.NATBlockAddr != s.SITBlockAddr+s.SegmentCountSIT*BlocksPerSegment ||
+		s.SSABlockAddr != s.NATBlockAddr+s.SegmentCountNAT*BlocksPerSegment ||
+		s.MainBlockAddr != s.SSABlockAddr+s.SegmentCountSSA*BlocksPerSegment ||
+		s.MainBlockAddr+s.SegmentCountMain*BlocksPerSegment != s.Segment0BlockAddr+s.SegmentCount*BlocksPerSegment {
+		t.Errorf("areas don't line up: %+v", s)
+	}
+
+	if s.UUID != [16]byte{1, 2, 3} || s.VolumeName[0] != 'r' || s.VolumeName[4] != 0 {
+		t.Errorf("superblock has the wrong identifiers")
+	}
+
+	cpBlock := img.block(s.CPBlockAddr)
+	if checksum(cpBlock[:checksumOffset]) != binary.LittleEndian.Uint32(cpBlock[checksumOffset:]) {
+		t.Errorf("checkpoint checksum is wrong")
+	}
+	_ = binary.Read(bytes.NewReader(cpBlock), binary.LittleEndian, &img.cp)
+
+	if !bytes.Equal(cpBlock, img.block(s.CPBlockAddr+img.cp.PackTotalBlockCount-1)) {
+		t.Errorf("checkpoint pack doesn't end with a copy of its checkpoint")
+	}
+
+	if img.cp.Version != 1 || binary.LittleEndian.Uint64(img.block(s.CPBlockAddr+BlocksPerSegment)) != 0 {
+		t.Errorf("the first checkpoint pack should be the newest")
+	}
+
+	// the SIT must agree with the checkpoint
+	var valid, nodes uint64
+	for seg := uint32(0); seg < s.SegmentCountMain; seg++ {
+		block := img.block(s.SITBlockAddr + seg/sitEntriesPerBlock)
+		vblocks := binary.LittleEndian.Uint16(block[seg%sitEntriesPerBlock*sitEntrySize:])
+		valid += uint64(vblocks & 0x3ff)
+		if vblocks>>10 >= cursegHotNode {
+			nodes += uint64(vblocks & 0x3ff)
+		}
+	}
+
+	if valid != img.cp.ValidBlockCount || nodes != uint64(img.cp.ValidNodeCount) {
+		t.Errorf("SIT counts %d blocks and %d nodes, checkpoint says %d and %d", valid, nodes, img.cp.ValidBlockCount, img.cp.ValidNodeCount)
+	}
+
+	if img.cp.ValidInodeCount != 5 || img.cp.ValidNodeCount != 6 {
+		t.Errorf("expected 5 inodes and a direct node: %+v", img.cp)
+	}
+
+	root := img.inode(s.RootIno)
+	if root.Mode&modeDir == 0 || root.Size != BlockSize || root.CurrentDepth != 1 {
+		t.Errorf("root inode is wrong: %+v", root)
+	}
+
+	ino, typ := img.lookup(s.RootIno, "a")
+	if typ != typeRegular {
+		t.Errorf("'a' should be a regular file")
+	}
+
+	a := img.inode(ino)
+	if a.Mode != modeRegular|0644 || a.UID != 1 || a.GID != 2 || a.Mtime != 1000 || a.Blocks != uint64(3+len(data)/BlockSize) {
+		t.Errorf("file has the wrong inode: %+v", a)
+	}
+
+	if !bytes.Equal(img.read(ino), data) {
+		t.Errorf("file has the wrong contents")
+	}
+
+	// the summary of the last block of the file points to its direct node
+	last := img.dataAddr(a, int64(len(data)/BlockSize))
+	seg := (last - s.MainBlockAddr) / BlocksPerSegment
+	sum := img.block(s.SSABlockAddr + seg)[(last-s.MainBlockAddr)%BlocksPerSegment*summarySize:]
+	if binary.LittleEndian.Uint32(sum) != a.NIDs[0] || binary.LittleEndian.Uint16(sum[5:]) != uint16(len(data)/BlockSize-addrsPerInode) {
+		t.Errorf("summary of the last block is wrong: %x", sum[:summarySize])
+	}
+
+	ino, typ = img.lookup(s.RootIno, "c")
+	if typ != typeSymlink || string(img.read(ino)) != "a" {
+		t.Errorf("symlink is wrong")
+	}
+
+	ino, _ = img.lookup(s.RootIno, "dev")
+	if dots, _ := img.lookup(ino, ".."); dots != s.RootIno {
+		t.Errorf("'..' should point to the root directory")
+	}
+
+	ino, _ = img.lookup(s.RootIno, "b")
+	if img.inode(ino).Size != 0 {
+		t.Errorf("empty file has a size")
+	}
+
+}
@@ -0,0 +1,165 @@
+package f2fs
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"errors"
+)
+
+// minSegments is the fewest segments Linux will mount a file-system with.
+const minSegments = 9
+
+// geometry is the layout of the areas of a file-system of a particular size.
+// The first segment holds the two copies of the superblock, and is followed
+// by the checkpoint, SIT, NAT and SSA areas, and then the main area, which
+// holds everything else.
+type geometry struct {
+	blockCount   int64
+	segmentCount int64
+
+	sitSegments  int64
+	natSegments  int64
+	ssaSegments  int64
+	mainSegments int64
+
+	// reserved is the number of main area segments set aside for cleaning,
+	// and overprovision is the number hidden from users, including them.
+	reserved      int64
+	overprovision int64
+
+	sitBlock  int64
+	natBlock  int64
+	ssaBlock  int64
+	mainBlock int64
+}
+
+// errTooSmall is returned by newGeometry if a file-system of the given size
+// wouldn't leave room for the segments the cleaner needs.
+var errTooSmall = errors.New("insufficient size to contain the f2fs file-system")
+
+// newGeometry lays out a file-system of size bytes the same way mkfs.f2fs
+// does: the SIT and NAT are sized so that every segment and every block
+// could be tracked, but the NAT is kept small enough for its bitmap to fit
+// in the checkpoint block alongside the SIT's.
+func newGeometry(size int64) (*geometry, error) {
+
+	g := &geometry{
+		blockCount:   size / BlockSize,
+		segmentCount: size/SegmentSize - 1,
+	}
+
+	if g.segmentCount < minSegments {
+		return nil, errTooSmall
+	}
+
+	sitBlocks := divide(g.segmentCount, sitEntriesPerBlock)
+	g.sitSegments = divide(sitBlocks, BlocksPerSegment) * 2
+
+	sitBitmap := g.sitSegments / 2 * BlocksPerSegment / 8
+	natBitmap := maxBitmapSize - sitBitmap
+	maxNATSegments := natBitmap * 8 / BlocksPerSegment
+	if maxNATSegments < 1 {
+		return nil, errors.New("too big for an f2fs file-system")
+	}
+
+	available := (g.segmentCount - checkpointSegments - g.sitSegments) * BlocksPerSegment
+	natSegments := divide(divide(available, natEntriesPerBlock), BlocksPerSegment)
+	if natSegments > maxNATSegments {
+		natSegments = maxNATSegments
+	}
+	g.natSegments = natSegments * 2
+
+	available = (g.segmentCount - checkpointSegments - g.sitSegments - g.natSegments) * BlocksPerSegment
+	g.ssaSegments = divide(available/BlocksPerSegment+1, BlocksPerSegment)
+
+	meta := checkpointSegments + g.sitSegments + g.natSegments + g.ssaSegments
+	if meta >= g.segmentCount {
+		return nil, errTooSmall
+	}
+	g.mainSegments = g.segmentCount - meta
+
+	g.sitBlock = BlocksPerSegment + checkpointSegments*BlocksPerSegment
+	g.natBlock = g.sitBlock + g.sitSegments*BlocksPerSegment
+	g.ssaBlock = g.natBlock + g.natSegments*BlocksPerSegment
+	g.mainBlock = g.ssaBlock + g.ssaSegments*BlocksPerSegment
+
+	var ok bool
+	g.reserved, g.overprovision, ok = overprovision(g.mainSegments)
+	if !ok || g.mainSegments-cursegTypes < g.reserved {
+		return nil, errTooSmall
+	}
+
+	return g, nil
+
+}
+
+// overprovision returns the number of segments to reserve for cleaning, and
+// the number of segments to hide from users including those, choosing the
+// overprovision ratio that leaves users the most space, the same way
+// mkfs.f2fs does.
+func overprovision(mainSegments int64) (reserved, overprovision int64, ok bool) {
+
+	// ratios are in hundredths of a percent
+	start, end, step := 1, 1000, 1
+	if mainSegments < 256 {
+		start, end, step = 1000, 9500, 500
+	}
+
+	var best, bestRatio float64
+	main := float64(mainSegments)
+
+	for x := start; x <= end; x += step {
+		ratio := float64(x) / 100
+		r := 2*(100/ratio+1) + cursegTypes
+		o := (main - r) * ratio / 100
+		space := main - r - o
+		if space > best {
+			best = space
+			bestRatio = ratio
+		}
+	}
+
+	if bestRatio == 0 {
+		return 0, 0, false
+	}
+
+	reserved = int64(2*(100/bestRatio+1) + cursegTypes)
+	overprovision = int64(float64(mainSegments-reserved)*bestRatio/100) + reserved
+
+	return reserved, overprovision, true
+
+}
+
+// natAddr returns the address of the first copy of the NAT block holding
+// entry nid. The two copies of each segment's worth of NAT blocks are next to
+// each other.
+func (g *geometry) natAddr(nid int64) int64 {
+	block := nid / natEntriesPerBlock
+	return g.natBlock + block/BlocksPerSegment*2*BlocksPerSegment + block%BlocksPerSegment
+}
+
+// maxNID returns the number of node IDs the NAT has room for.
+func (g *geometry) maxNID() int64 {
+	return g.natSegments / 2 * BlocksPerSegment * natEntriesPerBlock
+}
+
+// fits reports whether the main area has room for used segments, one empty
+// segment to log to for each type of data, free segments beyond those, and the
+// overprovisioned segments, and whether the NAT has room for every node.
+func (g *geometry) fits(used, free, nodes int64) (bool, int64) {
+
+	need := used + cursegTypes + g.overprovision + free
+	if need > g.mainSegments {
+		return false, need - g.mainSegments
+	}
+
+	if nodes >= g.maxNID() {
+		return false, 1
+	}
+
+	return true, 0
+
+}
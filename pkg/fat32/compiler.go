@@ -0,0 +1,743 @@
+package fat32
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	mrand "math/rand"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/vorteil/vorteil/pkg/elog"
+	"github.com/vorteil/vorteil/pkg/vio"
+)
+
+// maxDirEntries is the most entries a FAT directory can have, counting long
+// entries.
+const maxDirEntries = 65536
+
+// clusterSizes are the cluster sizes used for file-systems up to each size,
+// which are the same as Windows uses, except that small file-systems get
+// single sector clusters so that they have enough clusters to be FAT32.
+var clusterSizes = []struct {
+	limit int64
+	size  int64
+}{
+	{260 << 20, 512},
+	{8 << 30, 4 << 10},
+	{16 << 30, 8 << 10},
+	{32 << 30, 16 << 10},
+	{math.MaxInt64, 32 << 10},
+}
+
+// clusterSize returns the size of the clusters in a file-system of size bytes.
+func clusterSize(size int64) int64 {
+
+	for _, x := range clusterSizes {
+		if size <= x.limit {
+			return x.size
+		}
+	}
+
+	return clusterSizes[len(clusterSizes)-1].size
+
+}
+
+// layout returns the size of each FAT, and the number of clusters after them,
+// in a file-system of the given number of sectors.
+func layout(sectors, sectorsPerCluster int64) (fatSectors, clusters int64) {
+
+	for {
+		clusters = (sectors - ReservedSectors - numFATs*fatSectors) / sectorsPerCluster
+		if clusters < 0 {
+			return fatSectors, 0
+		}
+
+		need := ((clusters+RootCluster)*4 + SectorSize - 1) / SectorSize
+		if need <= fatSectors {
+			return fatSectors, clusters
+		}
+
+		fatSectors = need
+	}
+
+}
+
+type node struct {
+	tree     *vio.TreeNode
+	short    [11]byte
+	long     string
+	children []*node
+	size     int64
+	cluster  uint32
+	clusters uint32
+}
+
+// CompilerArgs organizes all inputs necessary to create a new Compiler.
+type CompilerArgs struct {
+	FileTree vio.FileTree
+	Logger   elog.Logger
+
+	// Label is the volume label, which can be no more than 11 characters.
+	// It is stored in upper-case.
+	Label string
+}
+
+// Compiler builds a FAT32 file-system. Compilation happens in the same stages
+// as the other file-system compilers: NewCompiler, Commit, Precompile,
+// Compile. FAT32 has no owners, permissions, symlinks or special files, so a
+// tree containing symlinks or special files can't be compiled, and the owners
+// and permissions of everything else are ignored.
+//
+// Files whose names aren't upper-case 8.3 names get long file names, with a
+// short alias like "LONGNA~1.TXT". Names that only differ by case are an
+// error, because FAT treats them as the same name.
+type Compiler struct {
+	log   elog.Logger
+	tree  vio.FileTree
+	label string
+
+	// timestamp is written to every directory entry instead of the current
+	// time, if it is set.
+	timestamp time.Time
+
+	volumeID      uint32
+	volumeIDSet   bool
+	hiddenSectors uint32
+	freeSpace     int64
+
+	volumeLabel [11]byte
+	nodes       []*node
+
+	// The following variables are set by Precompile.
+	size              int64
+	sectorsPerCluster int64
+	fatSectors        int64
+	dataFirst         int64
+	clusters          int64
+	usedClusters      int64
+}
+
+// NewCompiler returns an initialized Compiler object. Its contents can be
+// modified with Mkdir and AddFile before calling Commit.
+func NewCompiler(args *CompilerArgs) *Compiler {
+	return &Compiler{
+		log:   args.Logger,
+		tree:  args.FileTree,
+		label: args.Label,
+	}
+}
+
+// Mkdir adds an empty directory to the file-system at 'path' if no file or
+// directory is already mapped there. It must be called before Commit.
+func (c *Compiler) Mkdir(path string) error {
+
+	_, base := filepath.Split(path)
+	err := c.tree.Map(path, vio.CustomFile(vio.CustomFileArgs{
+		Name:  base,
+		IsDir: true,
+	}))
+	if err != nil {
+		return err
+	}
+
+	return nil
+
+}
+
+// AddFile adds a file to the file-system at 'path'. It must be called before
+// Commit.
+func (c *Compiler) AddFile(path string, r io.ReadCloser, size int64, force bool) error {
+
+	_, base := filepath.Split(path)
+	err := c.tree.Map(path, vio.CustomFile(vio.CustomFileArgs{
+		Name:       base,
+		Size:       int(size),
+		ReadCloser: r,
+	}))
+	if err != nil {
+		return err
+	}
+
+	return nil
+
+}
+
+// IncreaseMinimumInodes does nothing, because FAT has no inodes.
+func (c *Compiler) IncreaseMinimumInodes(inodes int64) {
+}
+
+// SetMinimumInodes does nothing, because FAT has no inodes.
+func (c *Compiler) SetMinimumInodes(inodes int64) {
+}
+
+// SetMinimumInodesPer64MiB does nothing, because FAT has no inodes.
+func (c *Compiler) SetMinimumInodesPer64MiB(inodes int64) {
+}
+
+// IncreaseMinimumFreeSpace increases the amount of free space MinimumSize
+// leaves room for.
+func (c *Compiler) IncreaseMinimumFreeSpace(space int64) {
+	c.freeSpace += space
+}
+
+// Reproduce makes the Compiler write t to every directory entry instead of
+// the current time, and derive the volume ID from seed, unless one was set
+// with SetVolumeID.
+func (c *Compiler) Reproduce(seed int64, t time.Time) {
+
+	c.timestamp = t
+
+	if !c.volumeIDSet {
+		c.volumeID = mrand.New(mrand.NewSource(seed)).Uint32()
+		c.volumeIDSet = true
+	}
+
+}
+
+// SetVolumeID sets the file-system's serial number, which is random unless
+// this is called before Compile.
+func (c *Compiler) SetVolumeID(id uint32) {
+	c.volumeID = id
+	c.volumeIDSet = true
+}
+
+// SetHiddenSectors records how many sectors come before the file-system on
+// its disk, which bootloaders that find the file-system through its boot
+// sector rely on. It must be called before Compile.
+func (c *Compiler) SetHiddenSectors(sectors uint32) {
+	c.hiddenSectors = sectors
+}
+
+// Commit checks that every file can be stored in the file-system, and gives
+// each a short name. Any calls to functions that change the contents of the
+// file-system must be done before this function is called.
+func (c *Compiler) Commit(ctx context.Context) error {
+
+	var err error
+
+	if c.timestamp.IsZero() {
+		c.timestamp = time.Now()
+	}
+
+	if !c.volumeIDSet {
+		err = binary.Read(rand.Reader, binary.LittleEndian, &c.volumeID)
+		if err != nil {
+			return err
+		}
+		c.volumeIDSet = true
+	}
+
+	if c.label != "" {
+		c.volumeLabel, err = VolumeLabel(c.label)
+		if err != nil {
+			return err
+		}
+	}
+
+	nodes := make(map[*vio.TreeNode]*node)
+	c.nodes = nil
+
+	err = c.tree.WalkNode(func(path string, n *vio.TreeNode) error {
+
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		x := &node{tree: n}
+		f := n.File
+
+		switch {
+		case f.IsDir():
+		case f.IsSymlink():
+			return fmt.Errorf("fat32 file-systems can't contain symlinks: '%s'", path)
+		case f.Special() != 0:
+			return fmt.Errorf("fat32 file-systems can't contain device nodes or named pipes: '%s'", path)
+		case int64(f.Size()) > MaxFileSize:
+			return fmt.Errorf("'%s' is too big for a fat32 file-system", path)
+		default:
+			x.size = int64(f.Size())
+		}
+
+		nodes[n] = x
+		c.nodes = append(c.nodes, x)
+		if n.Parent != nil && n.Parent != n {
+			parent := nodes[n.Parent]
+			parent.children = append(parent.children, x)
+		}
+
+		return nil
+
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, x := range c.nodes {
+		if x.tree.File.IsDir() {
+			err = c.nameChildren(x)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+
+}
+
+// nameChildren gives each file in dir its short name, and its long name if it
+// needs one, and works out how big dir is.
+func (c *Compiler) nameChildren(dir *node) error {
+
+	entries := 2 // "." and ".."
+	if dir == c.nodes[0] {
+		entries = 0
+		if c.label != "" {
+			entries++
+		}
+	}
+
+	used := make(map[[11]byte]bool)
+	names := make(map[string]string)
+
+	// names that are already short are reserved before any aliases are
+	// made, so that an alias can't take one
+	for _, x := range dir.children {
+
+		name := x.tree.File.Name()
+		if other, ok := names[strings.ToUpper(name)]; ok {
+			return fmt.Errorf("'%s' and '%s' in '%s' only differ by case, which fat32 doesn't allow", other, name, dir.tree.Path())
+		}
+		names[strings.ToUpper(name)] = name
+
+		short, ok := ShortName(name)
+		if ok {
+			x.short = short
+			used[short] = true
+		} else {
+			x.long = name
+		}
+
+	}
+
+	for _, x := range dir.children {
+
+		entries++
+		if x.long == "" {
+			continue
+		}
+
+		err := validateLongName(x.long)
+		if err != nil {
+			return err
+		}
+
+		x.short, err = shortAlias(x.long, used)
+		if err != nil {
+			return err
+		}
+		used[x.short] = true
+		entries += longEntries(x.long)
+
+	}
+
+	if entries > maxDirEntries {
+		return fmt.Errorf("directory '%s' has too many files for a fat32 file-system", dir.tree.Path())
+	}
+
+	dir.size = int64(entries * dirEntrySize)
+
+	return nil
+
+}
+
+// nodeClusters returns the number of clusters n takes up.
+func nodeClusters(n *node, size int64) int64 {
+
+	k := (n.size + size - 1) / size
+	if k == 0 && n.tree.File.IsDir() {
+		k = 1
+	}
+
+	return k
+
+}
+
+// clustersNeeded returns the number of clusters needed to hold the contents
+// of the file-system and its free space if each cluster is size bytes.
+func (c *Compiler) clustersNeeded(size int64) int64 {
+
+	n := (c.freeSpace + size - 1) / size
+	for _, x := range c.nodes {
+		n += nodeClusters(x, size)
+	}
+
+	return n
+
+}
+
+// MinimumSize returns the number of bytes needed to contain the file-system.
+// It can be called after a successful call to Commit.
+func (c *Compiler) MinimumSize() int64 {
+
+	var size int64
+
+	for i, x := range clusterSizes {
+
+		spc := x.size / SectorSize
+
+		n := c.clustersNeeded(x.size)
+		if n < MinClusters {
+			n = MinClusters
+		}
+
+		sectors := ReservedSectors + numFATs*(((n+RootCluster)*4+SectorSize-1)/SectorSize) + n*spc
+		for {
+			_, k := layout(sectors, spc)
+			if k >= n {
+				break
+			}
+			sectors += spc
+		}
+
+		size = sectors * SectorSize
+
+		// bigger clusters need smaller FATs, so the size might be small
+		// enough to get smaller clusters, which won't fit
+		if i > 0 && size <= clusterSizes[i-1].limit {
+			size = clusterSizes[i-1].limit + SectorSize
+		}
+
+		if size <= x.limit {
+			break
+		}
+
+	}
+
+	return size
+
+}
+
+// Precompile lays out the file-system to fill size bytes, picking a cluster
+// size to suit.
+func (c *Compiler) Precompile(ctx context.Context, size int64) error {
+
+	sectors := size / SectorSize
+	if sectors > math.MaxUint32 {
+		return errors.New("too large for a fat32 file-system")
+	}
+
+	cs := clusterSize(size)
+	c.sectorsPerCluster = cs / SectorSize
+	c.fatSectors, c.clusters = layout(sectors, c.sectorsPerCluster)
+	c.dataFirst = ReservedSectors + numFATs*c.fatSectors
+
+	if c.clusters < MinClusters || c.clusters < c.clustersNeeded(cs) {
+		return errors.New("insufficient size to contain the fat32 file-system")
+	}
+
+	if c.clusters > MaxClusters {
+		return errors.New("too large for a fat32 file-system")
+	}
+
+	next := uint32(RootCluster)
+	for _, x := range c.nodes {
+		k := uint32(nodeClusters(x, cs))
+		x.cluster, x.clusters = 0, k
+		if k > 0 {
+			x.cluster = next
+		}
+		next += k
+	}
+
+	c.usedClusters = int64(next - RootCluster)
+	c.size = size
+
+	return nil
+
+}
+
+func (c *Compiler) usedFATSectors() int64 {
+	return ((RootCluster+c.usedClusters)*4 + SectorSize - 1) / SectorSize
+}
+
+// RegionIsHole reports whether every byte of a region of the space passed to
+// Precompile is left empty.
+func (c *Compiler) RegionIsHole(begin, size int64) bool {
+
+	first := begin / SectorSize
+	last := (begin + size - 1) / SectorSize
+
+	used := [][2]int64{
+		{0, FSInfoSector},
+		{BackupSector, BackupSector + FSInfoSector},
+		{ReservedSectors, ReservedSectors + c.usedFATSectors() - 1},
+		{ReservedSectors + c.fatSectors, ReservedSectors + c.fatSectors + c.usedFATSectors() - 1},
+		{c.dataFirst, c.dataFirst + c.usedClusters*c.sectorsPerCluster - 1},
+	}
+
+	for _, x := range used {
+		if first <= x[1] && last >= x[0] {
+			return false
+		}
+	}
+
+	return true
+
+}
+
+func (c *Compiler) writeBootSectors(w io.WriteSeeker) error {
+
+	bs := bootSector{
+		Jump:           [3]byte{0xEB, 0x58, 0x90},
+		BytesPerSector: SectorSize,
+		SectorsPerClus: uint8(c.sectorsPerCluster),
+		ReservedSecs:   ReservedSectors,
+		NumFATs:        numFATs,
+		Media:          media,
+		SectorsPerTrk:  63,
+		Heads:          255,
+		HiddenSectors:  c.hiddenSectors,
+		TotalSectors:   uint32(c.size / SectorSize),
+		FATSize:        uint32(c.fatSectors),
+		RootCluster:    RootCluster,
+		FSInfoSector:   FSInfoSector,
+		BackupSector:   BackupSector,
+		DriveNumber:    0x80,
+		BootSignature:  0x29,
+		VolumeID:       c.volumeID,
+		VolumeLabel:    c.volumeLabel,
+		Signature:      [2]byte{0x55, 0xAA},
+	}
+
+	copy(bs.OEMName[:], "VORTEIL ")
+	copy(bs.FSType[:], "FAT32   ")
+	if c.label == "" {
+		copy(bs.VolumeLabel[:], "NO NAME    ")
+	}
+
+	info := fsInfo{
+		LeadSignature:   0x41615252,
+		StructSignature: 0x61417272,
+		FreeCount:       uint32(c.clusters - c.usedClusters),
+		NextFree:        uint32(RootCluster + c.usedClusters),
+		TrailSignature:  0xAA550000,
+	}
+
+	for _, sector := range []int64{0, BackupSector} {
+		_, err := w.Seek(sector*SectorSize, io.SeekStart)
+		if err != nil {
+			return err
+		}
+
+		err = binary.Write(w, binary.LittleEndian, &bs)
+		if err != nil {
+			return err
+		}
+
+		err = binary.Write(w, binary.LittleEndian, &info)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+
+}
+
+// fat returns the used part of the file allocation table.
+func (c *Compiler) fat() []uint32 {
+
+	fat := make([]uint32, RootCluster+c.usedClusters)
+	fat[0] = 0x0FFFFF00 | media
+	fat[1] = endOfChain
+
+	for _, x := range c.nodes {
+		if x.clusters == 0 {
+			continue
+		}
+		for i := x.cluster; i < x.cluster+x.clusters-1; i++ {
+			fat[i] = i + 1
+		}
+		fat[x.cluster+x.clusters-1] = endOfChain
+	}
+
+	return fat
+
+}
+
+func (c *Compiler) entry(name [11]byte, attr uint8, cluster uint32, size int64) dirEntry {
+
+	date, clock := timestamp(c.timestamp)
+
+	return dirEntry{
+		Name:        name,
+		Attr:        attr,
+		CreateTime:  clock,
+		CreateDate:  date,
+		AccessDate:  date,
+		FirstClusHi: uint16(cluster >> 16),
+		FirstClusLo: uint16(cluster),
+		WriteTime:   clock,
+		WriteDate:   date,
+		FileSize:    uint32(size),
+	}
+
+}
+
+// directory returns the entries of dir, padded to fill its clusters.
+func (c *Compiler) directory(dir, parent *node) ([]byte, error) {
+
+	buf := new(bytes.Buffer)
+	entries := make([]dirEntry, 0, 2)
+
+	if parent == nil {
+		if c.label != "" {
+			entries = append(entries, c.entry(c.volumeLabel, attrVolumeID, 0, 0))
+		}
+	} else {
+		// ".." is zero if it refers to the root
+		up := parent.cluster
+		if parent == c.nodes[0] {
+			up = 0
+		}
+		entries = append(entries, c.entry([11]byte{'.', ' ', ' ', ' ', ' ', ' ', ' ', ' ', ' ', ' ', ' '}, attrDirectory, dir.cluster, 0))
+		entries = append(entries, c.entry([11]byte{'.', '.', ' ', ' ', ' ', ' ', ' ', ' ', ' ', ' ', ' '}, attrDirectory, up, 0))
+	}
+
+	err := binary.Write(buf, binary.LittleEndian, entries)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, x := range dir.children {
+
+		if x.long != "" {
+			err = writeLongEntries(buf, x.long, x.short)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		e := c.entry(x.short, attrArchive, x.cluster, x.size)
+		if x.tree.File.IsDir() {
+			e = c.entry(x.short, attrDirectory, x.cluster, 0)
+		}
+
+		err = binary.Write(buf, binary.LittleEndian, &e)
+		if err != nil {
+			return nil, err
+		}
+
+	}
+
+	buf.Write(make([]byte, int64(dir.clusters)*c.sectorsPerCluster*SectorSize-int64(buf.Len())))
+
+	return buf.Bytes(), nil
+
+}
+
+// writeFile copies the contents of a regular file into its clusters.
+func (c *Compiler) writeFile(w io.Writer, n *node) error {
+
+	defer n.tree.File.Close()
+
+	_, err := io.CopyN(w, n.tree.File, n.size)
+	if err != nil {
+		return fmt.Errorf("failed to read '%s': %w", n.tree.Path(), err)
+	}
+
+	_, err = io.CopyN(w, vio.Zeroes, int64(n.clusters)*c.sectorsPerCluster*SectorSize-n.size)
+	if err != nil {
+		return err
+	}
+
+	return nil
+
+}
+
+// Compile writes the file-system to w. Directories and files are written
+// one after the other in the order the tree is walked, which is the order
+// their clusters were allocated in.
+func (c *Compiler) Compile(ctx context.Context, w io.WriteSeeker) error {
+
+	err := c.writeBootSectors(w)
+	if err != nil {
+		return err
+	}
+
+	fat := c.fat()
+
+	for i := int64(0); i < numFATs; i++ {
+		_, err = w.Seek((ReservedSectors+i*c.fatSectors)*SectorSize, io.SeekStart)
+		if err != nil {
+			return err
+		}
+
+		err = binary.Write(w, binary.LittleEndian, fat)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = w.Seek(c.dataFirst*SectorSize, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	nodes := make(map[*vio.TreeNode]*node)
+	for _, x := range c.nodes {
+		nodes[x.tree] = x
+	}
+
+	for _, x := range c.nodes {
+
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+
+		if !x.tree.File.IsDir() {
+			err = c.writeFile(w, x)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		var parent *node
+		if x != c.nodes[0] {
+			parent = nodes[x.tree.Parent]
+		}
+
+		data, err := c.directory(x, parent)
+		if err != nil {
+			return err
+		}
+
+		_, err = w.Write(data)
+		if err != nil {
+			return err
+		}
+
+	}
+
+	_, err = w.Seek(c.size, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	return nil
+
+}
@@ -0,0 +1,371 @@
+// Package fat32 builds FAT32 file-systems, like the ones UEFI firmware boots
+// from, and that almost every operating system can read and write.
+package fat32
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// Various FAT32 constants.
+const (
+	SectorSize      = 512
+	ReservedSectors = 32
+	FSInfoSector    = 1
+	BackupSector    = 6
+	RootCluster     = 2
+
+	// MinClusters is the fewest clusters a FAT32 file-system can have.
+	// Anything smaller is taken to be FAT16 by firmware and most operating
+	// systems, no matter what its boot sector says.
+	MinClusters = 65525
+
+	// MaxClusters is the most clusters a FAT32 file-system can have.
+	MaxClusters = 0x0FFFFFF5
+
+	// MaxFileSize is the largest file a FAT32 file-system can hold.
+	MaxFileSize = 0xFFFFFFFF
+
+	numFATs      = 2
+	endOfChain   = 0x0FFFFFFF
+	media        = 0xF8
+	dirEntrySize = 32
+
+	attrDirectory = 0x10
+	attrVolumeID  = 0x08
+	attrArchive   = 0x20
+	attrLongName  = 0x0F
+
+	lastLongEntry  = 0x40
+	longEntryChars = 13
+	maxLongName    = 255
+)
+
+// bootSector is the structure of a FAT32 boot sector as it appears on disk.
+type bootSector struct {
+	Jump           [3]byte
+	OEMName        [8]byte
+	BytesPerSector uint16
+	SectorsPerClus uint8
+	ReservedSecs   uint16
+	NumFATs        uint8
+	_              uint16 // root entries
+	_              uint16 // total sectors (16-bit)
+	Media          uint8
+	_              uint16 // FAT size (16-bit)
+	SectorsPerTrk  uint16
+	Heads          uint16
+	HiddenSectors  uint32
+	TotalSectors   uint32
+	FATSize        uint32
+	_              uint16 // ext flags
+	_              uint16 // version
+	RootCluster    uint32
+	FSInfoSector   uint16
+	BackupSector   uint16
+	_              [12]byte
+	DriveNumber    uint8
+	_              uint8
+	BootSignature  uint8
+	VolumeID       uint32
+	VolumeLabel    [11]byte
+	FSType         [8]byte
+	_              [420]byte
+	Signature      [2]byte
+}
+
+// fsInfo is the structure of a FAT32 FSInfo sector as it appears on disk.
+type fsInfo struct {
+	LeadSignature   uint32
+	_               [480]byte
+	StructSignature uint32
+	FreeCount       uint32
+	NextFree        uint32
+	_               [12]byte
+	TrailSignature  uint32
+}
+
+// dirEntry is the structure of a FAT directory entry as it appears on disk.
+type dirEntry struct {
+	Name        [11]byte
+	Attr        uint8
+	_           uint8 // reserved
+	_           uint8 // creation time (tenths)
+	CreateTime  uint16
+	CreateDate  uint16
+	AccessDate  uint16
+	FirstClusHi uint16
+	WriteTime   uint16
+	WriteDate   uint16
+	FirstClusLo uint16
+	FileSize    uint32
+}
+
+// longEntry is the structure of a VFAT long file name entry as it appears on
+// disk. A run of them comes before the directory entry whose name they hold,
+// last part first.
+type longEntry struct {
+	Order    uint8
+	Name1    [5]uint16
+	Attr     uint8
+	_        uint8 // type
+	Checksum uint8
+	Name2    [6]uint16
+	_        uint16 // first cluster
+	Name3    [2]uint16
+}
+
+// timestamp converts t into a FAT date and time, which can only hold the
+// years 1980 to 2107, to a resolution of two seconds.
+func timestamp(t time.Time) (date, clock uint16) {
+
+	t = t.UTC()
+
+	switch {
+	case t.Year() < 1980:
+		return 1<<5 | 1, 0
+	case t.Year() > 2107:
+		return 127<<9 | 12<<5 | 31, 23<<11 | 59<<5 | 29
+	}
+
+	date = uint16((t.Year()-1980)<<9 | int(t.Month())<<5 | t.Day())
+	clock = uint16(t.Hour()<<11 | t.Minute()<<5 | t.Second()/2)
+
+	return date, clock
+
+}
+
+func validShortChar(c rune) bool {
+	return c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("!#$%&'()-@^_`{}~", c)
+}
+
+// ShortName converts a file name into the padded form of a FAT 8.3 name, and
+// reports whether the name can be stored that way without losing anything,
+// which means it must already be upper-case.
+func ShortName(name string) ([11]byte, bool) {
+
+	var x [11]byte
+	for i := range x {
+		x[i] = ' '
+	}
+
+	base, ext := name, ""
+	if k := strings.LastIndex(base, "."); k >= 0 {
+		base, ext = base[:k], base[k+1:]
+	}
+
+	if base == "" || len(base) > 8 || len(ext) > 3 {
+		return x, false
+	}
+
+	for _, c := range base + ext {
+		if !validShortChar(c) {
+			return x, false
+		}
+	}
+
+	copy(x[:], base)
+	copy(x[8:], ext)
+
+	return x, true
+
+}
+
+// basisName returns the upper-case 8.3 name that a short alias for name is
+// derived from, before a numeric tail is added to make it unique.
+func basisName(name string) (base, ext string) {
+
+	upper := strings.TrimLeft(strings.ToUpper(name), ". ")
+
+	base = upper
+	if k := strings.LastIndex(upper, "."); k >= 0 {
+		base, ext = upper[:k], upper[k+1:]
+	}
+
+	clean := func(s string, n int) string {
+		var out []byte
+		for _, c := range s {
+			if len(out) == n {
+				break
+			}
+			if c == ' ' || c == '.' {
+				continue
+			}
+			if !validShortChar(c) {
+				c = '_'
+			}
+			out = append(out, byte(c))
+		}
+		return string(out)
+	}
+
+	base = clean(base, 8)
+	ext = clean(ext, 3)
+	if base == "" {
+		base = "_"
+	}
+
+	return base, ext
+
+}
+
+// shortAlias returns a unique 8.3 name for a file whose name needs a long
+// entry, in the same "BASENA~1.EXT" form Windows uses, or just the upper-case
+// name if that is a valid 8.3 name. Names already taken in the directory are
+// in used.
+func shortAlias(name string, used map[[11]byte]bool) ([11]byte, error) {
+
+	if x, ok := ShortName(strings.ToUpper(name)); ok && !used[x] {
+		return x, nil
+	}
+
+	base, ext := basisName(name)
+
+	for i := 1; i < 1000000; i++ {
+
+		tail := fmt.Sprintf("~%d", i)
+		b := base
+		if len(b)+len(tail) > 8 {
+			b = b[:8-len(tail)]
+		}
+
+		var x [11]byte
+		copy(x[:], fmt.Sprintf("%-8s%-3s", b+tail, ext))
+
+		if !used[x] {
+			return x, nil
+		}
+
+	}
+
+	return [11]byte{}, fmt.Errorf("too many files like '%s' in one directory", name)
+
+}
+
+// validateLongName returns an error if name can't be stored as a long file
+// name.
+func validateLongName(name string) error {
+
+	if name == "." || name == ".." {
+		return fmt.Errorf("invalid file name '%s'", name)
+	}
+
+	if strings.HasSuffix(name, ".") || strings.HasSuffix(name, " ") {
+		return fmt.Errorf("file name '%s' can't end with a period or space", name)
+	}
+
+	for _, c := range name {
+		if c < 0x20 || strings.ContainsRune(`"*/:<>?\|`, c) {
+			return fmt.Errorf("file name '%s' contains a character FAT doesn't allow: %q", name, c)
+		}
+	}
+
+	if len(utf16.Encode([]rune(name))) > maxLongName {
+		return fmt.Errorf("file name '%s' is longer than %d characters", name, maxLongName)
+	}
+
+	return nil
+
+}
+
+// longEntries returns the number of long entries needed to hold name.
+func longEntries(name string) int {
+	return (len(utf16.Encode([]rune(name))) + longEntryChars - 1) / longEntryChars
+}
+
+// checksum returns the checksum of a short name that each of its long entries
+// record.
+func checksum(short [11]byte) uint8 {
+
+	var sum uint8
+	for _, c := range short {
+		sum = (sum&1)<<7 + sum>>1 + c
+	}
+
+	return sum
+
+}
+
+// writeLongEntries writes the long entries for name, in the order they
+// appear on disk.
+func writeLongEntries(w io.Writer, name string, short [11]byte) error {
+
+	chars := utf16.Encode([]rune(name))
+	n := longEntries(name)
+
+	// the name is terminated by a zero, unless it fills its last entry,
+	// and then padded with 0xFFFF
+	padded := make([]uint16, n*longEntryChars)
+	for i := range padded {
+		padded[i] = 0xFFFF
+	}
+	copy(padded, chars)
+	if len(chars) < len(padded) {
+		padded[len(chars)] = 0
+	}
+
+	sum := checksum(short)
+
+	for i := n; i > 0; i-- {
+
+		part := padded[(i-1)*longEntryChars : i*longEntryChars]
+
+		e := longEntry{
+			Order:    uint8(i),
+			Attr:     attrLongName,
+			Checksum: sum,
+		}
+		if i == n {
+			e.Order |= lastLongEntry
+		}
+
+		copy(e.Name1[:], part[:5])
+		copy(e.Name2[:], part[5:11])
+		copy(e.Name3[:], part[11:])
+
+		err := binary.Write(w, binary.LittleEndian, &e)
+		if err != nil {
+			return err
+		}
+
+	}
+
+	return nil
+
+}
+
+// VolumeLabel converts a volume label into the padded, upper-case form it
+// takes in the boot sector and root directory, or returns an error if it
+// can't be represented that way.
+func VolumeLabel(label string) ([11]byte, error) {
+
+	var x [11]byte
+	for i := range x {
+		x[i] = ' '
+	}
+
+	upper := strings.ToUpper(label)
+	if len(upper) > len(x) {
+		return x, fmt.Errorf("volume label '%s' is longer than %d characters", label, len(x))
+	}
+
+	for _, c := range upper {
+		if c != ' ' && !validShortChar(c) {
+			return x, fmt.Errorf("volume label '%s' contains a character FAT doesn't allow: %q", label, c)
+		}
+	}
+
+	copy(x[:], upper)
+
+	return x, nil
+
+}
@@ -0,0 +1,286 @@
+package fat32
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vorteil/vorteil/pkg/vio"
+)
+
+func TestShortName(t *testing.T) {
+
+	for name, ok := range map[string]bool{
+		"BOOTX64.EFI":   true,
+		"README":        true,
+		"A.B":           true,
+		"readme.txt":    false,
+		"LONGNAME.TEXT": false,
+		"TOOLONGNAME":   false,
+		".BASHRC":       false,
+		"HAS SPACE":     false,
+	} {
+		_, x := ShortName(name)
+		if x != ok {
+			t.Errorf("ShortName(%q) should report %v", name, ok)
+		}
+	}
+
+	x, _ := ShortName("BOOTX64.EFI")
+	if string(x[:]) != "BOOTX64 EFI" {
+		t.Errorf("short name padded incorrectly: %q", x)
+	}
+
+}
+
+func TestShortAlias(t *testing.T) {
+
+	used := make(map[[11]byte]bool)
+
+	for _, x := range []struct {
+		name, alias string
+	}{
+		{"readme.txt", "README  TXT"},
+		{"ReadMe.txt", "README~1TXT"},
+		{"LongFileName.txt", "LONGFI~1TXT"},
+		{"longfilename.txt", "LONGFI~2TXT"},
+		{".bashrc", "BASHRC~1   "},
+		{"a b.tar.gz", "ABTAR~1 GZ "},
+		{"日本", "__~1       "},
+	} {
+		alias, err := shortAlias(x.name, used)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(alias[:]) != x.alias {
+			t.Errorf("alias of %q should be %q, got %q", x.name, x.alias, alias)
+		}
+		used[alias] = true
+	}
+
+}
+
+func TestLongEntries(t *testing.T) {
+
+	name := "fourteen-chars"
+	short, _ := ShortName("FOURTE~1")
+
+	buf := new(bytes.Buffer)
+	err := writeLongEntries(buf, name, short)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if buf.Len() != 2*dirEntrySize {
+		t.Fatalf("expected two long entries, got %d bytes", buf.Len())
+	}
+
+	entries := make([]longEntry, 2)
+	err = binary.Read(buf, binary.LittleEndian, entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if entries[0].Order != lastLongEntry|2 || entries[1].Order != 1 {
+		t.Errorf("long entries are out of order: %#x, %#x", entries[0].Order, entries[1].Order)
+	}
+
+	// the second part holds the last character, a terminator and padding
+	if entries[0].Name1[0] != 's' || entries[0].Name1[1] != 0 || entries[0].Name1[2] != 0xFFFF {
+		t.Errorf("last part of the name is wrong: %v", entries[0].Name1)
+	}
+
+	for _, e := range entries {
+		if e.Attr != attrLongName || e.Checksum != checksum(short) {
+			t.Errorf("long entry has the wrong attributes or checksum: %+v", e)
+		}
+	}
+
+}
+
+func TestMinimumSize(t *testing.T) {
+
+	ctx := context.Background()
+
+	c := NewCompiler(&CompilerArgs{FileTree: vio.NewFileTree()})
+	err := c.Commit(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	size := c.MinimumSize()
+
+	err = c.Precompile(ctx, size-SectorSize)
+	if err == nil {
+		t.Errorf("precompile accepted a size with too few clusters to be fat32")
+	}
+
+	err = c.Precompile(ctx, size)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.clusters != MinClusters || c.sectorsPerCluster != 1 {
+		t.Errorf("smallest file-system should have %d single sector clusters, got %d of %d", MinClusters, c.clusters, c.sectorsPerCluster)
+	}
+
+	// too big for single sector clusters
+	c.IncreaseMinimumFreeSpace(300 << 20)
+
+	size = c.MinimumSize()
+	if clusterSize(size) != 4<<10 {
+		t.Errorf("file-system of %d bytes should have 4 KiB clusters", size)
+	}
+
+	err = c.Precompile(ctx, size)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.clusters < c.clustersNeeded(4<<10) {
+		t.Errorf("file-system has %d clusters, but needs %d", c.clusters, c.clustersNeeded(4<<10))
+	}
+
+}
+
+func TestCompile(t *testing.T) {
+
+	tree := vio.NewFileTree()
+	data := []byte(strings.Repeat("vorteil", 100))
+
+	for _, path := range []string{"/EFI/BOOT/BOOTX64.EFI", "/data/Long File Name.txt"} {
+		err := tree.Map(path, vio.CustomFile(vio.CustomFileArgs{
+			Name:       path[strings.LastIndex(path, "/")+1:],
+			Size:       len(data),
+			ReadCloser: ioutil.NopCloser(bytes.NewReader(data)),
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx := context.Background()
+
+	c := NewCompiler(&CompilerArgs{FileTree: tree, Label: "data"})
+	c.Reproduce(0, time.Date(2000, 1, 1, 12, 0, 0, 0, time.UTC))
+	c.SetVolumeID(0x12345678)
+
+	err := c.Commit(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	size := c.MinimumSize()
+	err = c.Precompile(ctx, size)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.RegionIsHole(0, SectorSize) || !c.RegionIsHole(size-SectorSize, SectorSize) {
+		t.Errorf("holes are in the wrong place")
+	}
+
+	f, err := ioutil.TempFile("", "fat32")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	err = c.Compile(ctx, f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	img, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the empty space at the end is skipped, not written
+	if int64(len(img)) > size {
+		t.Errorf("wrote %d bytes, but the file-system is only %d", len(img), size)
+	}
+
+	bs := new(bootSector)
+	err = binary.Read(bytes.NewReader(img), binary.LittleEndian, bs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bs.Signature != [2]byte{0x55, 0xAA} || bs.VolumeID != 0x12345678 || string(bs.VolumeLabel[:]) != "DATA       " {
+		t.Errorf("boot sector is wrong: %+v", bs)
+	}
+
+	if !bytes.Equal(img[:SectorSize], img[BackupSector*SectorSize:(BackupSector+1)*SectorSize]) {
+		t.Errorf("backup boot sector doesn't match")
+	}
+
+	root := make([]dirEntry, 3)
+	err = binary.Read(bytes.NewReader(img[c.dataFirst*SectorSize:]), binary.LittleEndian, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if root[0].Attr != attrVolumeID || string(root[1].Name[:]) != "EFI        " || root[1].Attr != attrDirectory {
+		t.Errorf("root directory is wrong: %+v", root)
+	}
+
+	date, _ := timestamp(time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC))
+	if root[1].WriteDate != date {
+		t.Errorf("entry has the wrong date: %#x", root[1].WriteDate)
+	}
+
+	// the file has a long name, so its short entry comes after a long entry
+	var file *node
+	for _, x := range c.nodes {
+		if x.long == "Long File Name.txt" {
+			file = x
+		}
+	}
+
+	if file == nil || string(file.short[:]) != "LONGFI~1TXT" {
+		t.Fatalf("file with a long name has the wrong short name")
+	}
+
+	offset := (c.dataFirst + int64(file.cluster-RootCluster)*c.sectorsPerCluster) * SectorSize
+	if !bytes.Equal(img[offset:offset+int64(len(data))], data) {
+		t.Errorf("file contents are in the wrong place")
+	}
+
+	fat := img[ReservedSectors*SectorSize:]
+	if binary.LittleEndian.Uint32(fat[4*file.cluster:]) != file.cluster+1 || binary.LittleEndian.Uint32(fat[4*(file.cluster+file.clusters-1):]) != endOfChain {
+		t.Errorf("file's cluster chain is wrong")
+	}
+
+}
+
+func TestUnsupportedFiles(t *testing.T) {
+
+	for _, args := range []vio.CustomFileArgs{
+		{Name: "link", IsSymlink: true, Symlink: "target"},
+		{Name: "Same"},
+	} {
+		tree := vio.NewFileTree()
+		err := tree.Map("/same", vio.CustomFile(vio.CustomFileArgs{Name: "same"}))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = tree.Map("/"+args.Name, vio.CustomFile(args))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = NewCompiler(&CompilerArgs{FileTree: tree}).Commit(context.Background())
+		if err == nil {
+			t.Errorf("'%s' should not be allowed in a fat32 file-system", args.Name)
+		}
+	}
+
+}
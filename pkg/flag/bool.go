@@ -19,6 +19,14 @@ type BoolFlag struct {
 	Validate func(Value BoolFlag) error
 }
 
+// NewBoolFlag creates a new BoolFlag object
+func NewBoolFlag(key, usage string, hidden bool, validate func(BoolFlag) error) BoolFlag {
+	return BoolFlag{
+		Part:     NewFlagPart(key, usage, hidden),
+		Validate: validate,
+	}
+}
+
 // AddTo satisfies the Flag interface requirement
 func (f *BoolFlag) AddTo(flagSet *pflag.FlagSet) {
 	if f.short == "" {
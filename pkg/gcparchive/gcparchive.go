@@ -6,39 +6,53 @@ package gcparchive
  */
 
 import (
-	"bytes"
+	"archive/tar"
 	"errors"
 	"fmt"
-
-	// "compress/gzip"
-	"encoding/binary"
 	"io"
-	"strconv"
+	"time"
 
 	"github.com/klauspost/compress/gzip"
 	"github.com/vorteil/vorteil/pkg/vio"
 )
 
+const (
+	// DiskName is the name GCE requires for the raw disk within the archive.
+	DiskName = "disk.raw"
+
+	// SizeAlignment is the multiple GCE requires the raw disk size to be.
+	SizeAlignment = 0x40000000
+)
+
 type Sizer interface {
 	Size() int64
 }
 
+// Writer wraps a raw disk image as a gzip-compressed tarball suitable for
+// importing as a GCE image from a GCS bucket.
 type Writer struct {
 	gz     *gzip.Writer
+	tw     *tar.Writer
 	length int64
 	cursor int64
 }
 
 func NewWriter(w io.Writer, h Sizer) (*Writer, error) {
 
+	length := h.Size()
+	if length <= 0 || length%SizeAlignment != 0 {
+		return nil, fmt.Errorf("gcp archive disk size must be a non-zero multiple of 1 GiB (got %d bytes)", length)
+	}
+
 	gz, err := gzip.NewWriterLevel(w, gzip.BestSpeed)
 	if err != nil {
 		return nil, err
 	}
 
 	gw := &Writer{
-		length: h.Size(),
+		length: length,
 		gz:     gz,
+		tw:     tar.NewWriter(gz),
 	}
 
 	err = gw.writeHeader()
@@ -52,66 +66,17 @@ func NewWriter(w io.Writer, h Sizer) (*Writer, error) {
 }
 
 func (w *Writer) writeHeader() error {
-	header := new(gcpTarPosixHeader)
-	copy(header.Name[:], []byte("disk.raw")) // gcp requires the file is called disk.raw
-	octal := strconv.FormatUint(uint64(w.length), 8)
-
-	// header.Size field has len of 12 bytes
-	if len(octal) > 12 {
-		return fmt.Errorf("disk size is too large (must be <= 68719476735 bytes)")
-	}
-
-	copy(header.Size[:], []byte(octal))
-	header.Mode = [8]byte{0x30, 0x30, 0x30, 0x30, 0x36, 0x34, 0x34, 0x00}
-	copy(header.Mtime[:], []byte("00000000000"))
-	header.Typeflag = 0x30
-	header.Version = [2]byte{0x20, 0x00}
-
-	// Magic ...
-	magic := []byte("ustar")
-	byteMagic := make([]byte, len(magic)+1)
-	for i := 0; i < len(byteMagic); i++ {
-		if i == len(byteMagic)-1 {
-			byteMagic[i] = byte(0x20)
-		} else {
-			byteMagic[i] = magic[i]
-		}
-	}
-	copy(header.Magic[:], byteMagic)
-
-	// TODO user/group info
-
-	// Calculate Checksum ...
-	headerBytes := &bytes.Buffer{}
-	err := binary.Write(headerBytes, binary.LittleEndian, header)
-	if err != nil {
-		return err
-	}
-	bh := make([]byte, 512)
-	err = binary.Read(headerBytes, binary.LittleEndian, &bh)
-	if err != nil {
-		return err
-	}
-
-	var csVal uint32
-	csVal = 0
-	for i := 0; i < len(bh); i++ {
-		csVal += uint32(bh[i])
-	}
 
-	// Treat the 8 Checksum Field bytes as ASCII spaces (dec 32)
-	csVal += (8 * 32)
-	csOctal := "0" + strconv.FormatUint(uint64(csVal), 8)
-	csBytes := []byte(csOctal)
-	copy(header.Chksum[:], csBytes)
-	header.Chksum[len(header.Chksum)-1] = 0x20
-
-	err = binary.Write(w.gz, binary.LittleEndian, header)
-	if err != nil {
-		return err
-	}
-
-	return nil
+	// GCE expects an old GNU style tarball, which also allows sizes beyond the
+	// limit of the octal ustar size field.
+	return w.tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     DiskName,
+		Mode:     0644,
+		Size:     w.length,
+		ModTime:  time.Unix(0, 0),
+		Format:   tar.FormatGNU,
+	})
 
 }
 
@@ -143,17 +108,14 @@ func (w *Writer) Seek(offset int64, whence int) (int64, error) {
 
 func (w *Writer) Write(p []byte) (n int, err error) {
 
-	n, err = w.gz.Write(p)
-	w.cursor += int64(n)
-	if err != nil {
-		return
-	}
-
-	if w.cursor > w.length {
-		return n, errors.New("gcp archive received more raw image data than was expected")
+	if w.cursor+int64(len(p)) > w.length {
+		return 0, errors.New("gcp archive received more raw image data than was expected")
 	}
 
+	n, err = w.tw.Write(p)
+	w.cursor += int64(n)
 	return
+
 }
 
 func (w *Writer) writeFooter() error {
@@ -161,12 +123,8 @@ func (w *Writer) writeFooter() error {
 		return errors.New("gcp archive expected more raw image data than was received")
 	}
 
-	_, err := io.CopyN(w, vio.Zeroes, 15*512)
-	if err != nil {
-		return err
-	}
-
-	return nil
+	// pads the final block and writes the end-of-archive marker
+	return w.tw.Close()
 }
 
 func (w *Writer) Close() error {
@@ -184,24 +142,3 @@ func (w *Writer) Close() error {
 
 	return nil
 }
-
-type gcpTarPosixHeader struct {
-	Name       [100]byte // 0
-	Mode       [8]byte   // 100
-	UID        [8]byte   // 108
-	GID        [8]byte   // 116
-	Size       [12]byte  // 124
-	Mtime      [12]byte  // 136
-	Chksum     [8]byte   // 148
-	Typeflag   byte      // 156
-	Linkname   [100]byte // 157
-	Magic      [6]byte   // 257
-	Version    [2]byte   // 263
-	Uname      [32]byte  // 265
-	Gname      [32]byte  // 297
-	Devmajor   [8]byte   // 329
-	Devmintor  [8]byte   // 337
-	Prefix     [155]byte // 345
-	Endpadding [12]byte  // 500
-	// 512
-}
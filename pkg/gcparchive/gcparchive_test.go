@@ -0,0 +1,103 @@
+package gcparchive
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+type testSizer int64
+
+func (s testSizer) Size() int64 {
+	return int64(s)
+}
+
+func TestWriter(t *testing.T) {
+
+	head := bytes.Repeat([]byte("vorteil"), 1000)
+	tail := []byte("end of disk")
+
+	buf := new(bytes.Buffer)
+	w, err := NewWriter(buf, testSizer(SizeAlignment))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = w.Write(head)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = w.Seek(-int64(len(tail)), io.SeekEnd)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = w.Write(tail)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = w.Write([]byte{1})
+	if err == nil {
+		t.Errorf("gcp archive writer accepted data beyond the end of the disk")
+	}
+
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gz, err := gzip.NewReader(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tr := tar.NewReader(gz)
+	hdr, err := tr.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if hdr.Name != DiskName || hdr.Size != SizeAlignment || hdr.Typeflag != tar.TypeReg {
+		t.Fatalf("bad tar header: %+v", hdr)
+	}
+
+	data, err := ioutil.ReadAll(tr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.HasPrefix(data, head) || !bytes.HasSuffix(data, tail) {
+		t.Errorf("gcp archive disk contents differ from the raw image")
+	}
+
+	if bytes.Count(data[len(head):len(data)-len(tail)], []byte{0}) != len(data)-len(head)-len(tail) {
+		t.Errorf("gcp archive disk contains unexpected data between writes")
+	}
+
+	_, err = tr.Next()
+	if err != io.EOF {
+		t.Errorf("expected end of archive after disk.raw, got %v", err)
+	}
+
+}
+
+func TestWriterSize(t *testing.T) {
+
+	for _, size := range []int64{0, 0x100000, SizeAlignment + 512} {
+		_, err := NewWriter(ioutil.Discard, testSizer(size))
+		if err == nil {
+			t.Errorf("gcp archive writer accepted a disk size of %d bytes", size)
+		}
+	}
+
+}
@@ -0,0 +1,112 @@
+package imagetools
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"path"
+
+	"github.com/vorteil/vorteil/pkg/vdecompiler"
+	"github.com/vorteil/vorteil/pkg/vdisk"
+)
+
+// ImageBaseline records the contents of vorteilImage's root file-system and
+// its config as a baseline that later builds can be checked against. The
+// baseline has no allow patterns.
+func ImageBaseline(vorteilImage *vdecompiler.IO) (*vdisk.Baseline, error) {
+
+	cfg, err := vorteilImage.VCFG()
+	if err != nil {
+		return nil, err
+	}
+
+	settings, err := vdisk.FlattenVCFG(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	baseline := &vdisk.Baseline{
+		Files: make(map[string]string),
+		VCFG:  settings,
+	}
+
+	ino, err := vorteilImage.ResolvePathToInodeNo("/")
+	if err != nil {
+		return nil, err
+	}
+
+	err = baselineImageFileRecursive(vorteilImage, baseline.Files, ino, "/")
+	if err != nil {
+		return nil, err
+	}
+
+	return baseline, nil
+
+}
+
+func baselineImageFileRecursive(vorteilImage *vdecompiler.IO, files map[string]string, ino int, rpath string) error {
+
+	inode, err := vorteilImage.ResolveInode(ino)
+	if err != nil {
+		return err
+	}
+
+	if !vdecompiler.InodeIsDirectory(inode) {
+
+		if !vdecompiler.InodeIsRegularFile(inode) && !vdecompiler.InodeIsSymlink(inode) {
+			files[rpath] = "special"
+			return nil
+		}
+
+		rdr, err := vorteilImage.InodeReader(inode)
+		if err != nil {
+			return err
+		}
+		rdr = io.LimitReader(rdr, vdecompiler.InodeSize(inode))
+
+		if vdecompiler.InodeIsSymlink(inode) {
+			data, err := ioutil.ReadAll(rdr)
+			if err != nil {
+				return err
+			}
+			files[rpath] = "symlink:" + string(data)
+			return nil
+		}
+
+		hasher := sha256.New()
+		_, err = io.Copy(hasher, rdr)
+		if err != nil {
+			return err
+		}
+		files[rpath] = vdisk.ChecksumAlgorithm + ":" + hex.EncodeToString(hasher.Sum(nil))
+
+		return nil
+
+	}
+
+	files[rpath] = "dir"
+
+	entries, err := vorteilImage.Readdir(inode)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if entry.Name == "." || entry.Name == ".." {
+			continue
+		}
+		err = baselineImageFileRecursive(vorteilImage, files, entry.Inode, path.Join(rpath, entry.Name))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+
+}
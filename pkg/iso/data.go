@@ -0,0 +1,194 @@
+package iso
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+const (
+	// SectorSize is the logical block size of the ISO9660 file-system.
+	SectorSize = 2048
+
+	standardID = "CD001"
+
+	volumeDescriptorBootRecord = 0
+	volumeDescriptorPrimary    = 1
+	volumeDescriptorTerminator = 255
+
+	pvdSector          = 16
+	bootRecordSector   = 17
+	terminatorSector   = 18
+	bootCatalogSector  = 19
+	rootDirSector      = 20
+	lPathTableSector   = 21
+	mPathTableSector   = 22
+	diskSector         = 32
+	diskOffset         = diskSector * SectorSize
+	maxExtentSize      = 0xFFFFF800
+	diskFileIdentifier = "DISK.RAW;1"
+
+	dirFlagDirectory   = 0x02
+	dirFlagMultiExtent = 0x80
+
+	elToritoSystemID         = "EL TORITO SPECIFICATION"
+	elToritoPlatformX86      = 0
+	elToritoBootable         = 0x88
+	elToritoMediaHardDisk    = 4
+	elToritoProtectiveMBRFS  = 0xEE
+	elToritoValidationHeader = 1
+)
+
+// both16 encodes x in the "both-byte orders" format used throughout ISO9660.
+func both16(x uint16) [4]byte {
+	var b [4]byte
+	binary.LittleEndian.PutUint16(b[0:], x)
+	binary.BigEndian.PutUint16(b[2:], x)
+	return b
+}
+
+// both32 encodes x in the "both-byte orders" format used throughout ISO9660.
+func both32(x uint32) [8]byte {
+	var b [8]byte
+	binary.LittleEndian.PutUint32(b[0:], x)
+	binary.BigEndian.PutUint32(b[4:], x)
+	return b
+}
+
+// strA pads s with spaces to fill a fixed length character field.
+func strA(dst []byte, s string) {
+	for i := range dst {
+		dst[i] = ' '
+	}
+	copy(dst, s)
+}
+
+// volumeDate formats t as a 17 byte volume descriptor date.
+func volumeDate(t time.Time) [17]byte {
+	var d [17]byte
+	t = t.UTC()
+	copy(d[:], fmt.Sprintf("%04d%02d%02d%02d%02d%02d00", t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second()))
+	return d
+}
+
+// unsetVolumeDate is the 17 byte volume descriptor date for "not specified".
+func unsetVolumeDate() [17]byte {
+	var d [17]byte
+	copy(d[:], "0000000000000000")
+	return d
+}
+
+// recordDate formats t as a 7 byte directory record date.
+func recordDate(t time.Time) [7]byte {
+	t = t.UTC()
+	return [7]byte{
+		byte(t.Year() - 1900),
+		byte(t.Month()),
+		byte(t.Day()),
+		byte(t.Hour()),
+		byte(t.Minute()),
+		byte(t.Second()),
+		0,
+	}
+}
+
+type directoryRecordHeader struct { // 33 bytes
+	Length               uint8
+	ExtendedAttrLength   uint8
+	Extent               [8]byte
+	DataLength           [8]byte
+	RecordingDate        [7]byte
+	Flags                uint8
+	FileUnitSize         uint8
+	InterleaveGapSize    uint8
+	VolumeSequenceNumber [4]byte
+	IdentifierLength     uint8
+}
+
+type primaryVolumeDescriptor struct { // 2048 bytes
+	Type                    uint8
+	StandardID              [5]byte
+	Version                 uint8
+	_                       uint8
+	SystemID                [32]byte
+	VolumeID                [32]byte
+	_                       [8]byte
+	VolumeSpaceSize         [8]byte
+	_                       [32]byte
+	VolumeSetSize           [4]byte
+	VolumeSequenceNumber    [4]byte
+	LogicalBlockSize        [4]byte
+	PathTableSize           [8]byte
+	LPathTable              uint32
+	OptionalLPathTable      uint32
+	MPathTable              uint32
+	OptionalMPathTable      uint32
+	RootDirectory           directoryRecordHeader
+	RootDirectoryIdentifier uint8
+	VolumeSetID             [128]byte
+	PublisherID             [128]byte
+	DataPreparerID          [128]byte
+	ApplicationID           [128]byte
+	CopyrightFileID         [37]byte
+	AbstractFileID          [37]byte
+	BibliographicFileID     [37]byte
+	VolumeCreationDate      [17]byte
+	VolumeModificationDate  [17]byte
+	VolumeExpirationDate    [17]byte
+	VolumeEffectiveDate     [17]byte
+	FileStructureVersion    uint8
+	_                       uint8
+	ApplicationUse          [512]byte
+	_                       [653]byte
+}
+
+type bootRecordVolumeDescriptor struct { // 2048 bytes
+	Type              uint8
+	StandardID        [5]byte
+	Version           uint8
+	BootSystemID      [32]byte
+	BootID            [32]byte
+	BootCatalogSector uint32
+	_                 [1973]byte
+}
+
+type volumeDescriptorSetTerminator struct { // 2048 bytes
+	Type       uint8
+	StandardID [5]byte
+	Version    uint8
+	_          [2041]byte
+}
+
+type bootCatalogValidationEntry struct { // 32 bytes
+	HeaderID   uint8
+	PlatformID uint8
+	_          uint16
+	IDString   [24]byte
+	Checksum   uint16
+	Key        [2]byte
+}
+
+type bootCatalogDefaultEntry struct { // 32 bytes
+	BootIndicator uint8
+	MediaType     uint8
+	LoadSegment   uint16
+	SystemType    uint8
+	_             uint8
+	SectorCount   uint16
+	LoadRBA       uint32
+	_             [20]byte
+}
+
+type pathTableEntry struct { // 10 bytes, including the root identifier
+	IdentifierLength   uint8
+	ExtendedAttrLength uint8
+	Extent             uint32
+	ParentDirectory    uint16
+	Identifier         uint8
+	_                  uint8
+}
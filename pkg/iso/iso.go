@@ -0,0 +1,417 @@
+package iso
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"time"
+
+	"github.com/vorteil/vorteil/pkg/vimg"
+)
+
+const (
+	headSize = vimg.P0Offset // MBR and primary GPT of the raw disk
+
+	// tailSize is the space reserved after the raw disk for the relocated
+	// secondary GPT, rounded up to a whole ISO sector.
+	tailSize = (((1+vimg.GPTEntriesSectors)*vimg.SectorSize + SectorSize - 1) / SectorSize) * SectorSize
+
+	// shift is the distance in 512 byte sectors that the raw disk's
+	// partitions move when the disk is embedded in the ISO.
+	shift = diskOffset / vimg.SectorSize
+)
+
+// bootloaderLBAOffsets are the locations within the Vorteil bootloader of the
+// absolute LBAs it uses to find the OS partition.
+var bootloaderLBAOffsets = []int{0x20, 0x192}
+
+type Sizer interface {
+	Size() int64
+}
+
+// Writer produces a hybrid ISO9660 image from a raw Vorteil disk image. The
+// raw disk is stored on the ISO as DISK.RAW and referenced by an El Torito
+// boot catalog using hard disk emulation, so the ISO boots from CD. The
+// ISO's system area also receives a copy of the raw disk's MBR and GPT,
+// relocated to point at the embedded disk, so the same image boots when
+// written directly to a USB drive.
+type Writer struct {
+	w       io.WriteSeeker
+	length  int64
+	cursor  int64
+	head    []byte
+	created time.Time
+}
+
+// NewWriter returns a Writer that expects exactly h.Size() bytes of raw disk
+// image to be written to it.
+func NewWriter(w io.WriteSeeker, h Sizer) (*Writer, error) {
+
+	length := h.Size()
+	if length < headSize || length%SectorSize != 0 {
+		return nil, fmt.Errorf("iso disk size must be a multiple of %d bytes (got %d bytes)", SectorSize, length)
+	}
+
+	_, err := w.Seek(diskOffset, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Writer{
+		w:       w,
+		length:  length,
+		head:    make([]byte, headSize),
+		created: time.Now(),
+	}, nil
+
+}
+
+func (w *Writer) Write(p []byte) (n int, err error) {
+
+	if w.cursor+int64(len(p)) > w.length {
+		return 0, errors.New("iso writer received more raw image data than was expected")
+	}
+
+	if w.cursor < headSize {
+		copy(w.head[w.cursor:], p)
+	}
+
+	n, err = w.w.Write(p)
+	w.cursor += int64(n)
+	return
+
+}
+
+func (w *Writer) Seek(offset int64, whence int) (int64, error) {
+
+	var abs int64
+	switch whence {
+	case io.SeekStart:
+		abs = offset
+	case io.SeekCurrent:
+		abs = w.cursor + offset
+	case io.SeekEnd:
+		abs = w.length + offset
+	default:
+		panic("bad seek whence")
+	}
+
+	if abs < 0 || abs > w.length {
+		return w.cursor, fmt.Errorf("iso writer cannot seek to %d", abs)
+	}
+
+	_, err := w.w.Seek(diskOffset+abs, io.SeekStart)
+	if err != nil {
+		return w.cursor, err
+	}
+
+	w.cursor = abs
+	return w.cursor, nil
+
+}
+
+// Close writes the relocated partition tables and the ISO9660 structures
+// around the raw disk image.
+func (w *Writer) Close() error {
+
+	if w.cursor < w.length {
+		return errors.New("iso writer expected more raw image data than was received")
+	}
+
+	mbr, hdr, entries, err := w.relocate()
+	if err != nil {
+		return err
+	}
+
+	// secondary GPT, ending at the last sector of the image
+	lastLBA := (diskOffset+w.length+tailSize)/vimg.SectorSize - 1
+	_, err = w.w.Seek((lastLBA-vimg.GPTEntriesSectors)*vimg.SectorSize, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.w.Write(entries)
+	if err != nil {
+		return err
+	}
+
+	err = binary.Write(w.w, binary.LittleEndian, gptHeader(*hdr, uint64(lastLBA), 1, uint64(lastLBA-vimg.GPTEntriesSectors)))
+	if err != nil {
+		return err
+	}
+
+	// system area
+	_, err = w.w.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	err = binary.Write(w.w, binary.LittleEndian, mbr)
+	if err != nil {
+		return err
+	}
+
+	err = binary.Write(w.w, binary.LittleEndian, gptHeader(*hdr, vimg.PrimaryGPTHeaderLBA, uint64(lastLBA), vimg.PrimaryGPTEntriesLBA))
+	if err != nil {
+		return err
+	}
+
+	_, err = w.w.Write(entries)
+	if err != nil {
+		return err
+	}
+
+	return w.writeDescriptors()
+
+}
+
+// relocate returns the raw disk's MBR, primary GPT header and GPT entries,
+// modified to account for the disk's position within the ISO.
+func (w *Writer) relocate() (*vimg.ProtectiveMBR, *vimg.GPTHeader, []byte, error) {
+
+	if !bytes.Equal(w.head[:len(vimg.Bootloader)], vimg.Bootloader) {
+		return nil, nil, nil, errors.New("iso writer requires a disk with the Vorteil bootloader")
+	}
+
+	mbr := new(vimg.ProtectiveMBR)
+	_ = binary.Read(bytes.NewReader(w.head), binary.LittleEndian, mbr)
+
+	for _, offset := range bootloaderLBAOffsets {
+		lba := binary.LittleEndian.Uint32(mbr.Bootloader[offset:])
+		binary.LittleEndian.PutUint32(mbr.Bootloader[offset:], lba+shift)
+	}
+
+	sectors := (diskOffset + w.length + tailSize) / vimg.SectorSize
+	mbr.FirstLBA = vimg.PrimaryGPTHeaderLBA
+	mbr.TotalSectors = 0xFFFFFFFF
+	if sectors-1 < 0xFFFFFFFF {
+		mbr.TotalSectors = uint32(sectors - 1)
+	}
+
+	hdr := new(vimg.GPTHeader)
+	_ = binary.Read(bytes.NewReader(w.head[vimg.PrimaryGPTHeaderOffset:]), binary.LittleEndian, hdr)
+	if hdr.Signature != vimg.GPTSignature || hdr.NoOfParts*hdr.SizePartEntry > vimg.GPTEntriesSectors*vimg.SectorSize {
+		return nil, nil, nil, errors.New("iso writer requires a disk with a GPT")
+	}
+
+	entries := make([]byte, vimg.GPTEntriesSectors*vimg.SectorSize)
+	copy(entries, w.head[vimg.PrimaryGPTEntriesOffset:])
+
+	for i := uint32(0); i < hdr.NoOfParts; i++ {
+		e := entries[i*hdr.SizePartEntry:]
+		first := binary.LittleEndian.Uint64(e[32:])
+		last := binary.LittleEndian.Uint64(e[40:])
+		if first == 0 && last == 0 {
+			continue
+		}
+		binary.LittleEndian.PutUint64(e[32:], first+shift)
+		binary.LittleEndian.PutUint64(e[40:], last+shift)
+	}
+
+	hdr.CRCParts = crc32.ChecksumIEEE(entries[:hdr.NoOfParts*hdr.SizePartEntry])
+	hdr.FirstUsableLBA = vimg.P0FirstLBA
+	hdr.LastUsableLBA = uint64(sectors - 1 - vimg.GPTEntriesSectors - 1)
+
+	return mbr, hdr, entries, nil
+
+}
+
+// gptHeader returns a copy of hdr located at lba, with its checksum updated.
+func gptHeader(hdr vimg.GPTHeader, lba, backup, entries uint64) *vimg.GPTHeader {
+
+	hdr.CurrentLBA = lba
+	hdr.BackupLBA = backup
+	hdr.StartLBAParts = entries
+	hdr.CRC = 0
+
+	buf := new(bytes.Buffer)
+	_ = binary.Write(buf, binary.LittleEndian, &hdr)
+	hdr.CRC = crc32.ChecksumIEEE(buf.Bytes()[:hdr.HeaderSize])
+
+	return &hdr
+
+}
+
+// diskRecords returns the root directory records for the embedded disk. Files
+// larger than an ISO9660 extent are split across multiple extents.
+func (w *Writer) diskRecords() []byte {
+
+	buf := new(bytes.Buffer)
+	for offset := int64(0); offset < w.length; offset += maxExtentSize {
+		size := w.length - offset
+		var flags uint8
+		if size > maxExtentSize {
+			size = maxExtentSize
+			flags = dirFlagMultiExtent
+		}
+
+		writeRecord(buf, uint32(diskSector+offset/SectorSize), uint32(size), flags, diskFileIdentifier, w.created)
+	}
+
+	return buf.Bytes()
+
+}
+
+func writeRecord(buf *bytes.Buffer, extent, size uint32, flags uint8, id string, t time.Time) {
+
+	length := 33 + len(id)
+	length += length % 2
+
+	_ = binary.Write(buf, binary.LittleEndian, &directoryRecordHeader{
+		Length:               uint8(length),
+		Extent:               both32(extent),
+		DataLength:           both32(size),
+		RecordingDate:        recordDate(t),
+		Flags:                flags,
+		VolumeSequenceNumber: both16(1),
+		IdentifierLength:     uint8(len(id)),
+	})
+
+	buf.WriteString(id)
+	if len(id)%2 == 0 {
+		buf.WriteByte(0)
+	}
+
+}
+
+func (w *Writer) writeDescriptors() error {
+
+	root := new(bytes.Buffer)
+	writeRecord(root, rootDirSector, SectorSize, dirFlagDirectory, "\x00", w.created)
+	writeRecord(root, rootDirSector, SectorSize, dirFlagDirectory, "\x01", w.created)
+	root.Write(w.diskRecords())
+	if root.Len() > SectorSize {
+		return fmt.Errorf("iso disk size is too large (%d bytes)", w.length)
+	}
+
+	volumeSize := uint32((diskOffset + w.length + tailSize) / SectorSize)
+
+	pvd := &primaryVolumeDescriptor{
+		Type:                   volumeDescriptorPrimary,
+		Version:                1,
+		VolumeSpaceSize:        both32(volumeSize),
+		VolumeSetSize:          both16(1),
+		VolumeSequenceNumber:   both16(1),
+		LogicalBlockSize:       both16(SectorSize),
+		PathTableSize:          both32(uint32(binary.Size(pathTableEntry{}))),
+		LPathTable:             lPathTableSector,
+		MPathTable:             swap32(mPathTableSector),
+		VolumeCreationDate:     volumeDate(w.created),
+		VolumeModificationDate: volumeDate(w.created),
+		VolumeExpirationDate:   unsetVolumeDate(),
+		VolumeEffectiveDate:    unsetVolumeDate(),
+		FileStructureVersion:   1,
+	}
+	copy(pvd.StandardID[:], standardID)
+	strA(pvd.SystemID[:], "")
+	strA(pvd.VolumeID[:], "VORTEIL")
+	strA(pvd.VolumeSetID[:], "")
+	strA(pvd.PublisherID[:], "")
+	strA(pvd.DataPreparerID[:], "")
+	strA(pvd.ApplicationID[:], "VORTEIL")
+	strA(pvd.CopyrightFileID[:], "")
+	strA(pvd.AbstractFileID[:], "")
+	strA(pvd.BibliographicFileID[:], "")
+	// the PVD's copy of the root directory record is its first 34 bytes
+	_ = binary.Read(bytes.NewReader(root.Bytes()), binary.LittleEndian, &pvd.RootDirectory)
+
+	br := &bootRecordVolumeDescriptor{
+		Type:              volumeDescriptorBootRecord,
+		Version:           1,
+		BootCatalogSector: bootCatalogSector,
+	}
+	copy(br.StandardID[:], standardID)
+	copy(br.BootSystemID[:], elToritoSystemID)
+
+	term := &volumeDescriptorSetTerminator{
+		Type:    volumeDescriptorTerminator,
+		Version: 1,
+	}
+	copy(term.StandardID[:], standardID)
+
+	validation := &bootCatalogValidationEntry{
+		HeaderID:   elToritoValidationHeader,
+		PlatformID: elToritoPlatformX86,
+		Key:        [2]byte{0x55, 0xAA},
+	}
+	copy(validation.IDString[:], "VORTEIL")
+	validation.Checksum = catalogChecksum(validation)
+
+	entry := &bootCatalogDefaultEntry{
+		BootIndicator: elToritoBootable,
+		MediaType:     elToritoMediaHardDisk,
+		SystemType:    elToritoProtectiveMBRFS,
+		SectorCount:   1,
+		LoadRBA:       diskSector,
+	}
+
+	rootPath := &pathTableEntry{
+		IdentifierLength: 1,
+		Extent:           rootDirSector,
+		ParentDirectory:  1,
+	}
+
+	sectors := []struct {
+		sector int64
+		order  binary.ByteOrder
+		data   []interface{}
+	}{
+		{pvdSector, binary.LittleEndian, []interface{}{pvd}},
+		{bootRecordSector, binary.LittleEndian, []interface{}{br}},
+		{terminatorSector, binary.LittleEndian, []interface{}{term}},
+		{bootCatalogSector, binary.LittleEndian, []interface{}{validation, entry}},
+		{rootDirSector, binary.LittleEndian, []interface{}{root.Bytes()}},
+		{lPathTableSector, binary.LittleEndian, []interface{}{rootPath}},
+		{mPathTableSector, binary.BigEndian, []interface{}{rootPath}},
+	}
+
+	for _, s := range sectors {
+		_, err := w.w.Seek(s.sector*SectorSize, io.SeekStart)
+		if err != nil {
+			return err
+		}
+
+		for _, data := range s.data {
+			err = binary.Write(w.w, s.order, data)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+
+}
+
+// catalogChecksum returns the value that makes the 16-bit words of the
+// validation entry sum to zero.
+func catalogChecksum(v *bootCatalogValidationEntry) uint16 {
+
+	buf := new(bytes.Buffer)
+	_ = binary.Write(buf, binary.LittleEndian, v)
+
+	var sum uint16
+	data := buf.Bytes()
+	for i := 0; i < len(data); i += 2 {
+		sum += binary.LittleEndian.Uint16(data[i:])
+	}
+
+	return -sum
+
+}
+
+// swap32 returns x with its bytes reversed, for big-endian fields in
+// otherwise little-endian structures.
+func swap32(x uint32) uint32 {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], x)
+	return binary.LittleEndian.Uint32(b[:])
+}
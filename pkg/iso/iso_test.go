@@ -0,0 +1,248 @@
+package iso
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/vorteil/vorteil/pkg/vimg"
+)
+
+type testImage []byte
+
+func (img testImage) Size() int64 {
+	return int64(len(img))
+}
+
+// testDisk returns a raw disk with the Vorteil bootloader and a GPT
+// containing two partitions.
+func testDisk(t *testing.T, size int) testImage {
+
+	disk := make([]byte, size)
+	for i := vimg.P0Offset; i < size; i++ {
+		disk[i] = byte(i / vimg.SectorSize)
+	}
+
+	mbr := &vimg.ProtectiveMBR{
+		PartitionType: 0xEE,
+		FirstLBA:      1,
+		TotalSectors:  uint32(size/vimg.SectorSize - 1),
+		MagicNumber:   [2]byte{0x55, 0xAA},
+	}
+	copy(mbr.Bootloader[:], vimg.Bootloader)
+
+	entries := make([]byte, vimg.GPTEntriesSectors*vimg.SectorSize)
+	for i, lbas := range [][2]uint64{{34, 99}, {100, uint64(size/vimg.SectorSize) - 34}} {
+		e := &vimg.GPTEntry{FirstLBA: lbas[0], LastLBA: lbas[1]}
+		e.TypeGUID[0] = byte(i + 1)
+		buf := new(bytes.Buffer)
+		_ = binary.Write(buf, binary.LittleEndian, e)
+		copy(entries[i*vimg.GPTEntrySize:], buf.Bytes())
+	}
+
+	hdr := &vimg.GPTHeader{
+		Signature:     vimg.GPTSignature,
+		HeaderSize:    vimg.GPTHeaderSize,
+		NoOfParts:     vimg.MaximumGPTEntries,
+		SizePartEntry: vimg.GPTEntrySize,
+		CRCParts:      crc32.ChecksumIEEE(entries),
+	}
+
+	buf := new(bytes.Buffer)
+	_ = binary.Write(buf, binary.LittleEndian, mbr)
+	_ = binary.Write(buf, binary.LittleEndian, hdr)
+	buf.Write(entries)
+	copy(disk, buf.Bytes())
+
+	return disk
+
+}
+
+func readGPT(t *testing.T, f io.ReaderAt, lba int64) (*vimg.GPTHeader, []byte) {
+
+	data := make([]byte, vimg.SectorSize)
+	_, err := f.ReadAt(data, lba*vimg.SectorSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hdr := new(vimg.GPTHeader)
+	_ = binary.Read(bytes.NewReader(data), binary.LittleEndian, hdr)
+	if hdr.Signature != vimg.GPTSignature || hdr.CurrentLBA != uint64(lba) {
+		t.Fatalf("bad GPT header at LBA %d: %+v", lba, hdr)
+	}
+
+	crc := hdr.CRC
+	binary.LittleEndian.PutUint32(data[16:], 0)
+	if crc32.ChecksumIEEE(data[:hdr.HeaderSize]) != crc {
+		t.Errorf("bad GPT header checksum at LBA %d", lba)
+	}
+
+	entries := make([]byte, hdr.NoOfParts*hdr.SizePartEntry)
+	_, err = f.ReadAt(entries, int64(hdr.StartLBAParts)*vimg.SectorSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if crc32.ChecksumIEEE(entries) != hdr.CRCParts {
+		t.Errorf("bad GPT entries checksum for header at LBA %d", lba)
+	}
+
+	return hdr, entries
+
+}
+
+func TestWriter(t *testing.T) {
+
+	disk := testDisk(t, 0x200000)
+
+	f, err := ioutil.TempFile("", "iso")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	w, err := NewWriter(f, disk)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = io.CopyBuffer(w, bytes.NewReader(disk), make([]byte, 12345))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// primary volume descriptor
+	pvd := new(primaryVolumeDescriptor)
+	err = binary.Read(io.NewSectionReader(f, pvdSector*SectorSize, SectorSize), binary.LittleEndian, pvd)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(pvd.StandardID[:]) != standardID || pvd.Type != volumeDescriptorPrimary {
+		t.Fatalf("bad primary volume descriptor")
+	}
+
+	if int64(binary.LittleEndian.Uint32(pvd.VolumeSpaceSize[:]))*SectorSize != info.Size() {
+		t.Errorf("volume space size doesn't match the image size")
+	}
+
+	// boot catalog
+	br := new(bootRecordVolumeDescriptor)
+	err = binary.Read(io.NewSectionReader(f, bootRecordSector*SectorSize, SectorSize), binary.LittleEndian, br)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	catalog := make([]byte, 64)
+	_, err = f.ReadAt(catalog, int64(br.BootCatalogSector)*SectorSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var sum uint16
+	for i := 0; i < 32; i += 2 {
+		sum += binary.LittleEndian.Uint16(catalog[i:])
+	}
+	if sum != 0 || catalog[30] != 0x55 || catalog[31] != 0xAA {
+		t.Errorf("bad boot catalog validation entry")
+	}
+
+	if catalog[32] != elToritoBootable || catalog[33] != elToritoMediaHardDisk || binary.LittleEndian.Uint32(catalog[40:]) != diskSector {
+		t.Errorf("bad boot catalog default entry")
+	}
+
+	// root directory: ".", "..", then the disk
+	root := make([]byte, SectorSize)
+	_, err = f.ReadAt(root, int64(binary.LittleEndian.Uint32(pvd.RootDirectory.Extent[:]))*SectorSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	record := root[root[0]:]
+	record = record[record[0]:]
+	rec := new(directoryRecordHeader)
+	_ = binary.Read(bytes.NewReader(record), binary.LittleEndian, rec)
+	if id := string(record[33 : 33+rec.IdentifierLength]); id != diskFileIdentifier {
+		t.Fatalf("unexpected file in root directory: %s", id)
+	}
+
+	extent := int64(binary.LittleEndian.Uint32(rec.Extent[:]))
+	size := int64(binary.LittleEndian.Uint32(rec.DataLength[:]))
+	data := make([]byte, size)
+	_, err = f.ReadAt(data, extent*SectorSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(data, disk) {
+		t.Errorf("embedded disk contents differ from the raw image")
+	}
+
+	// relocated MBR and GPTs
+	mbr := new(vimg.ProtectiveMBR)
+	err = binary.Read(io.NewSectionReader(f, 0, vimg.SectorSize), binary.LittleEndian, mbr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, offset := range bootloaderLBAOffsets {
+		expect := binary.LittleEndian.Uint32(vimg.Bootloader[offset:]) + shift
+		if binary.LittleEndian.Uint32(mbr.Bootloader[offset:]) != expect {
+			t.Errorf("bootloader LBA at offset %#x was not relocated", offset)
+		}
+	}
+
+	lastLBA := info.Size()/vimg.SectorSize - 1
+	primary, entries := readGPT(t, f, 1)
+	backup, backupEntries := readGPT(t, f, lastLBA)
+	if primary.BackupLBA != uint64(lastLBA) || backup.BackupLBA != 1 || !bytes.Equal(entries, backupEntries) {
+		t.Errorf("primary and backup GPTs don't match")
+	}
+
+	e := new(vimg.GPTEntry)
+	_ = binary.Read(bytes.NewReader(entries[vimg.GPTEntrySize:]), binary.LittleEndian, e)
+	if e.FirstLBA != 100+shift {
+		t.Fatalf("partition was not relocated: %+v", e)
+	}
+
+	first := make([]byte, vimg.SectorSize)
+	_, err = f.ReadAt(first, int64(e.FirstLBA)*vimg.SectorSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(first, disk[100*vimg.SectorSize:101*vimg.SectorSize]) {
+		t.Errorf("relocated partition doesn't point at the embedded disk")
+	}
+
+}
+
+func TestWriterSize(t *testing.T) {
+
+	_, err := NewWriter(nil, make(testImage, 0x200000+512))
+	if err == nil {
+		t.Errorf("iso writer accepted a disk that isn't a whole number of sectors")
+	}
+
+}
@@ -0,0 +1,84 @@
+package luks
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+)
+
+// diffuse mixes every byte of buf into its neighbours one hash-sized block at
+// a time, as defined by the LUKS anti-forensic splitter.
+func diffuse(buf []byte) {
+
+	var iv [4]byte
+	for i := 0; i*sha256.Size < len(buf); i++ {
+		block := buf[i*sha256.Size:]
+		if len(block) > sha256.Size {
+			block = block[:sha256.Size]
+		}
+
+		binary.BigEndian.PutUint32(iv[:], uint32(i))
+		h := sha256.New()
+		h.Write(iv[:])
+		h.Write(block)
+		copy(block, h.Sum(nil))
+	}
+
+}
+
+// afSplit expands key into n stripes of random-looking data that can only be
+// merged back into the key if every stripe is intact, which makes destroying
+// a keyslot reliable even on storage that remaps sectors.
+func afSplit(rng io.Reader, key []byte, n int) ([]byte, error) {
+
+	out := make([]byte, len(key)*n)
+	buf := make([]byte, len(key))
+
+	_, err := io.ReadFull(rng, out[:len(key)*(n-1)])
+	if err != nil {
+		return nil, err
+	}
+
+	for i := 0; i < n-1; i++ {
+		stripe := out[i*len(key) : (i+1)*len(key)]
+		for j := range buf {
+			buf[j] ^= stripe[j]
+		}
+		diffuse(buf)
+	}
+
+	last := out[(n-1)*len(key):]
+	for j := range buf {
+		last[j] = buf[j] ^ key[j]
+	}
+
+	return out, nil
+
+}
+
+// afMerge reverses afSplit.
+func afMerge(data []byte, keySize, n int) []byte {
+
+	buf := make([]byte, keySize)
+
+	for i := 0; i < n-1; i++ {
+		stripe := data[i*keySize : (i+1)*keySize]
+		for j := range buf {
+			buf[j] ^= stripe[j]
+		}
+		diffuse(buf)
+	}
+
+	last := data[(n-1)*keySize:]
+	for j := range buf {
+		buf[j] ^= last[j]
+	}
+
+	return buf
+
+}
@@ -0,0 +1,161 @@
+package luks
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"strconv"
+)
+
+const (
+	// SectorSize is the encryption sector size of the data segment.
+	SectorSize = 512
+
+	// PayloadOffset is the offset of the encrypted data segment from the
+	// start of the LUKS device. Everything before it holds the two copies of
+	// the header and the keyslot area.
+	PayloadOffset = 0x100000
+
+	// KeySize is the size in bytes of the volume key. It is split in half
+	// by XTS, giving AES-256.
+	KeySize = 64
+
+	// Cipher is the dm-crypt cipher specification used for both the data
+	// segment and the keyslot area.
+	Cipher = "aes-xts-plain64"
+
+	headerSize       = 0x4000
+	binaryHdrSize    = 0x1000
+	jsonAreaSize     = headerSize - binaryHdrSize
+	checksumOffset   = 448
+	keyslotsOffset   = 2 * headerSize
+	keyslotsSize     = PayloadOffset - keyslotsOffset
+	stripes          = 4000
+	saltSize         = 32
+	digestIterations = 1000
+)
+
+var (
+	primaryMagic   = [6]byte{'L', 'U', 'K', 'S', 0xBA, 0xBE}
+	secondaryMagic = [6]byte{'S', 'K', 'U', 'L', 0xBA, 0xBE}
+)
+
+// binaryHeader is the fixed part of a LUKS2 header, which is followed by the
+// JSON metadata area. All fields are big-endian.
+type binaryHeader struct {
+	Magic       [6]byte
+	Version     uint16
+	HdrSize     uint64
+	SeqID       uint64
+	Label       [48]byte
+	ChecksumAlg [32]byte
+	Salt        [64]byte
+	UUID        [40]byte
+	Subsystem   [48]byte
+	HdrOffset   uint64
+	_           [184]byte
+	Checksum    [64]byte
+	_           [7 * 512]byte
+}
+
+type jsonAF struct {
+	Type    string `json:"type"`
+	Stripes int    `json:"stripes"`
+	Hash    string `json:"hash"`
+}
+
+type jsonArea struct {
+	Type       string `json:"type"`
+	Offset     string `json:"offset"`
+	Size       string `json:"size"`
+	Encryption string `json:"encryption"`
+	KeySize    int    `json:"key_size"`
+}
+
+type jsonKDF struct {
+	Type       string `json:"type"`
+	Hash       string `json:"hash"`
+	Iterations int    `json:"iterations"`
+	Salt       []byte `json:"salt"`
+}
+
+type jsonKeyslot struct {
+	Type    string   `json:"type"`
+	KeySize int      `json:"key_size"`
+	AF      jsonAF   `json:"af"`
+	Area    jsonArea `json:"area"`
+	KDF     jsonKDF  `json:"kdf"`
+}
+
+type jsonSegment struct {
+	Type       string `json:"type"`
+	Offset     string `json:"offset"`
+	Size       string `json:"size"`
+	IVTweak    string `json:"iv_tweak"`
+	Encryption string `json:"encryption"`
+	SectorSize int    `json:"sector_size"`
+}
+
+type jsonDigest struct {
+	Type       string   `json:"type"`
+	Keyslots   []string `json:"keyslots"`
+	Segments   []string `json:"segments"`
+	Hash       string   `json:"hash"`
+	Iterations int      `json:"iterations"`
+	Salt       []byte   `json:"salt"`
+	Digest     []byte   `json:"digest"`
+}
+
+type jsonConfig struct {
+	JSONSize     string `json:"json_size"`
+	KeyslotsSize string `json:"keyslots_size"`
+}
+
+type metadata struct {
+	Keyslots map[string]jsonKeyslot `json:"keyslots"`
+	Tokens   map[string]interface{} `json:"tokens"`
+	Segments map[string]jsonSegment `json:"segments"`
+	Digests  map[string]jsonDigest  `json:"digests"`
+	Config   jsonConfig             `json:"config"`
+}
+
+func u64(x int64) string {
+	return strconv.FormatInt(x, 10)
+}
+
+// marshalHeader returns one complete copy of the header, including its JSON
+// area and checksum.
+func marshalHeader(hdr *binaryHeader, md *metadata) ([]byte, error) {
+
+	data, err := json.Marshal(md)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) >= jsonAreaSize {
+		return nil, fmt.Errorf("luks metadata too large: %d bytes", len(data))
+	}
+
+	buf := new(bytes.Buffer)
+	err = binary.Write(buf, binary.BigEndian, hdr)
+	if err != nil {
+		return nil, err
+	}
+
+	buf.Write(data)
+	buf.Write(make([]byte, headerSize-buf.Len()))
+
+	out := buf.Bytes()
+	sum := sha256.Sum256(out)
+	copy(out[checksumOffset:], sum[:])
+
+	return out, nil
+
+}
@@ -0,0 +1,395 @@
+package luks
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"crypto/aes"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/google/uuid"
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/xts"
+)
+
+// DefaultIterations is the number of PBKDF2 iterations used to derive the
+// keyslot key from the passphrase if Options doesn't specify any.
+const DefaultIterations = 1000000
+
+// flushSize is how much encrypted data is buffered before being written.
+const flushSize = 0x100000
+
+// Options configures the LUKS2 device created by NewWriter.
+type Options struct {
+
+	// Key is the passphrase, or the contents of a key file, that unlocks
+	// the device.
+	Key []byte
+
+	// Iterations is the PBKDF2 iteration count for the keyslot. Higher
+	// values make brute-forcing the passphrase slower, but also unlocking.
+	Iterations int
+
+	// UUID identifies the device. A random one is generated if empty.
+	UUID string
+
+	// Label is an optional human-readable label for the device.
+	Label string
+}
+
+// Writer creates a LUKS2 encrypted device with a single passphrase keyslot,
+// encrypting everything written to it into the device's data segment using
+// aes-xts-plain64. Offsets passed to Seek are relative to the start of the
+// data segment, so the Writer can be given to a file-system compiler as though
+// it were the bare partition.
+//
+// Every sector of the data segment has to be written, because encrypted zeroes
+// are indistinguishable from any other data. Skipped regions are filled with
+// encrypted zeroes, so like the rest of the image building logic the Writer
+// never seeks backwards past the sector it is currently working on.
+type Writer struct {
+	w       io.WriteSeeker
+	cipher  *xts.Cipher
+	sectors int64
+	sector  int64
+	cursor  int64
+	buf     []byte
+	pending []byte
+	closed  bool
+}
+
+// NewWriter writes the LUKS2 headers and keyslot to w and returns a Writer for
+// the data segment. The size is the size of the whole device, including the
+// PayloadOffset bytes of metadata at the start.
+func NewWriter(w io.WriteSeeker, size int64, opts *Options) (*Writer, error) {
+
+	if size <= PayloadOffset || size%SectorSize != 0 {
+		return nil, fmt.Errorf("luks device size must be a multiple of %d bytes larger than %d bytes", SectorSize, PayloadOffset)
+	}
+
+	if len(opts.Key) == 0 {
+		return nil, errors.New("luks device requires a passphrase or key file")
+	}
+
+	volumeKey := make([]byte, KeySize)
+	_, err := io.ReadFull(rand.Reader, volumeKey)
+	if err != nil {
+		return nil, err
+	}
+
+	md, material, err := newMetadata(volumeKey, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	err = writeMetadata(w, md, material, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := xts.NewCipher(aes.NewCipher, volumeKey)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = w.Seek(PayloadOffset, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Writer{
+		w:       w,
+		cipher:  c,
+		sectors: (size - PayloadOffset) / SectorSize,
+		buf:     make([]byte, SectorSize),
+		pending: make([]byte, 0, flushSize),
+	}, nil
+
+}
+
+func newMetadata(volumeKey []byte, opts *Options) (*metadata, []byte, error) {
+
+	iterations := opts.Iterations
+	if iterations == 0 {
+		iterations = DefaultIterations
+	}
+
+	salt := make([]byte, saltSize)
+	_, err := io.ReadFull(rand.Reader, salt)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	digestSalt := make([]byte, saltSize)
+	_, err = io.ReadFull(rand.Reader, digestSalt)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	material, err := afSplit(rand.Reader, volumeKey, stripes)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// the keyslot area is encrypted with a key derived from the passphrase,
+	// with sector numbers starting from zero at the start of the area
+	kek := pbkdf2.Key(opts.Key, salt, iterations, KeySize, sha256.New)
+	c, err := xts.NewCipher(aes.NewCipher, kek)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for i := 0; i*SectorSize < len(material); i++ {
+		sector := material[i*SectorSize : (i+1)*SectorSize]
+		c.Encrypt(sector, sector, uint64(i))
+	}
+
+	areaSize := (int64(len(material)) + 0xFFF) &^ 0xFFF
+
+	md := &metadata{
+		Keyslots: map[string]jsonKeyslot{
+			"0": {
+				Type:    "luks2",
+				KeySize: KeySize,
+				AF: jsonAF{
+					Type:    "luks1",
+					Stripes: stripes,
+					Hash:    "sha256",
+				},
+				Area: jsonArea{
+					Type:       "raw",
+					Offset:     u64(keyslotsOffset),
+					Size:       u64(areaSize),
+					Encryption: Cipher,
+					KeySize:    KeySize,
+				},
+				KDF: jsonKDF{
+					Type:       "pbkdf2",
+					Hash:       "sha256",
+					Iterations: iterations,
+					Salt:       salt,
+				},
+			},
+		},
+		Tokens: map[string]interface{}{},
+		Segments: map[string]jsonSegment{
+			"0": {
+				Type:       "crypt",
+				Offset:     u64(PayloadOffset),
+				Size:       "dynamic",
+				IVTweak:    "0",
+				Encryption: Cipher,
+				SectorSize: SectorSize,
+			},
+		},
+		Digests: map[string]jsonDigest{
+			"0": {
+				Type:       "pbkdf2",
+				Keyslots:   []string{"0"},
+				Segments:   []string{"0"},
+				Hash:       "sha256",
+				Iterations: digestIterations,
+				Salt:       digestSalt,
+				Digest:     pbkdf2.Key(volumeKey, digestSalt, digestIterations, sha256.Size, sha256.New),
+			},
+		},
+		Config: jsonConfig{
+			JSONSize:     u64(jsonAreaSize),
+			KeyslotsSize: u64(keyslotsSize),
+		},
+	}
+
+	return md, material, nil
+
+}
+
+func writeMetadata(w io.WriteSeeker, md *metadata, material []byte, opts *Options) error {
+
+	id := opts.UUID
+	if id == "" {
+		u, err := uuid.NewRandom()
+		if err != nil {
+			return err
+		}
+		id = u.String()
+	}
+
+	_, err := w.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	for i, magic := range [][6]byte{primaryMagic, secondaryMagic} {
+		hdr := &binaryHeader{
+			Magic:     magic,
+			Version:   2,
+			HdrSize:   headerSize,
+			SeqID:     1,
+			HdrOffset: uint64(i * headerSize),
+		}
+		copy(hdr.Label[:], opts.Label)
+		copy(hdr.ChecksumAlg[:], "sha256")
+		copy(hdr.UUID[:], id)
+
+		_, err = io.ReadFull(rand.Reader, hdr.Salt[:])
+		if err != nil {
+			return err
+		}
+
+		data, err := marshalHeader(hdr, md)
+		if err != nil {
+			return err
+		}
+
+		_, err = w.Write(data)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = w.Write(material)
+	if err != nil {
+		return err
+	}
+
+	return nil
+
+}
+
+// encryptSector encrypts the buffered sector onto the pending output and moves
+// on to the next one.
+func (w *Writer) encryptSector() error {
+
+	k := len(w.pending)
+	w.pending = w.pending[:k+SectorSize]
+	w.cipher.Encrypt(w.pending[k:], w.buf, uint64(w.sector))
+
+	for i := range w.buf {
+		w.buf[i] = 0
+	}
+	w.sector++
+
+	if len(w.pending) == cap(w.pending) {
+		return w.flush()
+	}
+
+	return nil
+
+}
+
+func (w *Writer) flush() error {
+
+	_, err := w.w.Write(w.pending)
+	if err != nil {
+		return err
+	}
+
+	w.pending = w.pending[:0]
+	return nil
+
+}
+
+// advance encrypts every sector up to (but not including) sector.
+func (w *Writer) advance(sector int64) error {
+
+	if sector < w.sector {
+		return fmt.Errorf("luks writer cannot seek backwards from sector %d to %d", w.sector, sector)
+	}
+
+	if sector > w.sectors {
+		sector = w.sectors
+	}
+
+	for w.sector < sector {
+		err := w.encryptSector()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+
+}
+
+// Write implements io.Writer.
+func (w *Writer) Write(p []byte) (n int, err error) {
+
+	if w.closed {
+		return 0, errors.New("luks writer is closed")
+	}
+
+	for len(p) > 0 {
+
+		sector := w.cursor / SectorSize
+		if sector >= w.sectors {
+			return n, io.ErrShortWrite
+		}
+
+		err = w.advance(sector)
+		if err != nil {
+			return
+		}
+
+		k := copy(w.buf[w.cursor%SectorSize:], p)
+		w.cursor += int64(k)
+		n += k
+		p = p[k:]
+
+		if w.cursor%SectorSize == 0 {
+			err = w.encryptSector()
+			if err != nil {
+				return
+			}
+		}
+
+	}
+
+	return
+
+}
+
+// Seek implements io.Seeker.
+func (w *Writer) Seek(offset int64, whence int) (int64, error) {
+
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += w.cursor
+	case io.SeekEnd:
+		offset += w.sectors * SectorSize
+	default:
+		return 0, errors.New("invalid whence")
+	}
+
+	if offset < w.sector*SectorSize {
+		return 0, fmt.Errorf("luks writer cannot seek backwards to offset %d", offset)
+	}
+
+	w.cursor = offset
+	return w.cursor, nil
+
+}
+
+// Close encrypts the remainder of the data segment and flushes it to the
+// underlying writer, which is not closed.
+func (w *Writer) Close() error {
+
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+
+	err := w.advance(w.sectors)
+	if err != nil {
+		return err
+	}
+
+	return w.flush()
+
+}
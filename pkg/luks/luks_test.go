@@ -0,0 +1,165 @@
+package luks
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"testing"
+
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/xts"
+)
+
+// unlock parses the device the way cryptsetup would and returns the decrypted
+// data segment.
+func unlock(t *testing.T, f io.ReaderAt, size int64, key []byte) []byte {
+
+	raw := make([]byte, headerSize)
+	_, err := f.ReadAt(raw, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hdr := new(binaryHeader)
+	err = binary.Read(bytes.NewReader(raw), binary.BigEndian, hdr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if hdr.Magic != primaryMagic || hdr.Version != 2 || hdr.HdrSize != headerSize {
+		t.Fatalf("bad luks header: %+v", hdr)
+	}
+
+	sum := append([]byte(nil), raw[checksumOffset:checksumOffset+sha256.Size]...)
+	copy(raw[checksumOffset:checksumOffset+64], make([]byte, 64))
+	if expect := sha256.Sum256(raw); !bytes.Equal(sum, expect[:]) {
+		t.Fatalf("bad luks header checksum")
+	}
+
+	md := new(metadata)
+	err = json.Unmarshal(bytes.TrimRight(raw[binaryHdrSize:], "\x00"), md)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ks := md.Keyslots["0"]
+	offset, _ := strconv.ParseInt(ks.Area.Offset, 10, 64)
+	material := make([]byte, ks.KeySize*ks.AF.Stripes)
+	_, err = f.ReadAt(material, offset)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kek := pbkdf2.Key(key, ks.KDF.Salt, ks.KDF.Iterations, ks.Area.KeySize, sha256.New)
+	c, err := xts.NewCipher(aes.NewCipher, kek)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i*SectorSize < len(material); i++ {
+		sector := material[i*SectorSize : (i+1)*SectorSize]
+		c.Decrypt(sector, sector, uint64(i))
+	}
+
+	volumeKey := afMerge(material, ks.KeySize, ks.AF.Stripes)
+	d := md.Digests["0"]
+	if !bytes.Equal(pbkdf2.Key(volumeKey, d.Salt, d.Iterations, len(d.Digest), sha256.New), d.Digest) {
+		t.Fatalf("volume key digest mismatch")
+	}
+
+	seg := md.Segments["0"]
+	offset, _ = strconv.ParseInt(seg.Offset, 10, 64)
+	data := make([]byte, size-offset)
+	_, err = f.ReadAt(data, offset)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err = xts.NewCipher(aes.NewCipher, volumeKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i*SectorSize < len(data); i++ {
+		sector := data[i*SectorSize : (i+1)*SectorSize]
+		c.Decrypt(sector, sector, uint64(i))
+	}
+
+	return data
+
+}
+
+func TestWriter(t *testing.T) {
+
+	size := int64(PayloadOffset + 0x300000)
+	key := []byte("correct horse battery staple")
+
+	data := make([]byte, size-PayloadOffset)
+	copy(data[100:], bytes.Repeat([]byte{1}, 5000))
+	copy(data[0x100000+7:], []byte("vorteil"))
+	copy(data[0x200000:], bytes.Repeat([]byte{2}, 0x80000))
+
+	f, err := ioutil.TempFile("", "luks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	w, err := NewWriter(f, size, &Options{
+		Key:        key,
+		Iterations: 1000,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// write in odd-sized pieces, then seek over the empty space
+	_, err = io.CopyBuffer(struct{ io.Writer }{w}, bytes.NewReader(data[:0x100000+100]), make([]byte, 12345))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = w.Seek(0x200000, io.SeekStart)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = w.Write(data[0x200000:0x280000])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = w.Seek(0x100000, io.SeekStart)
+	if err == nil {
+		t.Errorf("luks writer accepted a backwards seek")
+	}
+
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if info.Size() != size {
+		t.Fatalf("luks device is %d bytes, expected %d", info.Size(), size)
+	}
+
+	if !bytes.Equal(unlock(t, f, size, key), data) {
+		t.Errorf("decrypted luks data segment differs from what was written")
+	}
+
+}
@@ -0,0 +1,207 @@
+package policy
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strings"
+
+	"github.com/gobwas/glob"
+	"github.com/sisatech/toml"
+	"github.com/vorteil/vorteil/pkg/vcfg"
+	"github.com/vorteil/vorteil/pkg/vio"
+)
+
+// A policy is a set of rules an organisation's images must follow, checked
+// against an app's VCFG and file tree before anything is built. It is written
+// in TOML, like the VCFG:
+//
+//	forbid-privileges = ["root"]
+//	require-dns = true
+//	forbid-paths = ["/etc/shadow", "**.pem"]
+//	require-paths = ["/etc/ssl/certs/ca-certificates.crt"]
+//
+// Every rule is optional, and rules that aren't set aren't checked.
+
+// Policy is a set of rules images must follow.
+type Policy struct {
+	// ForbidPrivileges lists privileges programs aren't allowed to run with.
+	// Programs without a privilege run as root.
+	ForbidPrivileges []vcfg.Privilege `toml:"forbid-privileges,omitempty"`
+
+	// RequireDNS requires at least one DNS server to be configured.
+	RequireDNS bool `toml:"require-dns,omitempty"`
+
+	// ForbidPaths lists glob patterns no file in the image may match, where
+	// '*' doesn't match '/' and '**' does.
+	ForbidPaths []string `toml:"forbid-paths,omitempty"`
+
+	// RequirePaths lists files that must be in the image.
+	RequirePaths []string `toml:"require-paths,omitempty"`
+
+	forbidden []glob.Glob
+}
+
+// Load parses a policy.
+func Load(data []byte) (*Policy, error) {
+
+	p := new(Policy)
+	err := toml.Unmarshal(data, p)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, pattern := range p.ForbidPaths {
+		g, err := glob.Compile(cleanPath(pattern), '/')
+		if err != nil {
+			return nil, fmt.Errorf("invalid forbidden path '%s': %v", pattern, err)
+		}
+		p.forbidden = append(p.forbidden, g)
+	}
+
+	for _, priv := range p.ForbidPrivileges {
+		switch priv {
+		case vcfg.RootPrivilege, vcfg.SuperuserPrivilege, vcfg.UserPrivilege:
+		default:
+			return nil, fmt.Errorf("invalid forbidden privilege '%s' (should be 'root', 'superuser', or 'user')", priv)
+		}
+	}
+
+	return p, nil
+
+}
+
+// LoadFilepath loads the policy at path.
+func LoadFilepath(path string) (*Policy, error) {
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	p, err := Load(data)
+	if err != nil {
+		return nil, fmt.Errorf("bad policy '%s': %v", path, err)
+	}
+
+	return p, nil
+
+}
+
+// Violations is the error returned when an app breaks a policy's rules, with
+// a description of each broken rule.
+type Violations []string
+
+// Error implements error.
+func (v Violations) Error() string {
+	return fmt.Sprintf("app violates policy:\n\t%s", strings.Join(v, "\n\t"))
+}
+
+// Check returns Violations listing every rule cfg and fs break, or nil if they
+// follow the policy.
+func (p *Policy) Check(cfg *vcfg.VCFG, fs vio.FileTree) error {
+
+	var v Violations
+
+	v = append(v, p.checkVCFG(cfg)...)
+
+	violations, err := p.checkFiles(fs)
+	if err != nil {
+		return err
+	}
+	v = append(v, violations...)
+
+	if len(v) > 0 {
+		return v
+	}
+
+	return nil
+
+}
+
+func (p *Policy) checkVCFG(cfg *vcfg.VCFG) []string {
+
+	var v []string
+
+	for i, prog := range cfg.Programs {
+		v = append(v, p.checkPrivilege(fmt.Sprintf("program %d (%s)", i, prog.Binary), prog.Privilege)...)
+	}
+
+	for i, hook := range cfg.System.FirstBoot {
+		v = append(v, p.checkPrivilege(fmt.Sprintf("first-boot hook %d (%s)", i, hook.Binary), hook.Privilege)...)
+	}
+
+	for i, hook := range cfg.System.OnShutdown {
+		v = append(v, p.checkPrivilege(fmt.Sprintf("on-shutdown hook %d (%s)", i, hook.Binary), hook.Privilege)...)
+	}
+
+	if p.RequireDNS && len(cfg.System.DNS) == 0 {
+		v = append(v, "no dns servers are configured")
+	}
+
+	return v
+
+}
+
+// checkPrivilege returns a violation if what runs with a forbidden privilege.
+func (p *Policy) checkPrivilege(what string, priv vcfg.Privilege) []string {
+
+	var v []string
+
+	if priv == "" {
+		priv = vcfg.RootPrivilege
+	}
+
+	for _, forbidden := range p.ForbidPrivileges {
+		if priv == forbidden {
+			v = append(v, fmt.Sprintf("%s runs with forbidden privilege '%s'", what, priv))
+		}
+	}
+
+	return v
+
+}
+
+func (p *Policy) checkFiles(fs vio.FileTree) ([]string, error) {
+
+	var v []string
+
+	if len(p.forbidden) == 0 && len(p.RequirePaths) == 0 {
+		return nil, nil
+	}
+
+	found := make(map[string]bool)
+
+	err := fs.Walk(func(path string, f vio.File) error {
+		path = cleanPath(path)
+		found[path] = true
+		for i, g := range p.forbidden {
+			if g.Match(path) {
+				v = append(v, fmt.Sprintf("file '%s' matches forbidden path '%s'", path, p.ForbidPaths[i]))
+				break
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, required := range p.RequirePaths {
+		if !found[cleanPath(required)] {
+			v = append(v, fmt.Sprintf("required file '%s' is missing", required))
+		}
+	}
+
+	return v, nil
+
+}
+
+func cleanPath(p string) string {
+	return path.Clean("/" + p)
+}
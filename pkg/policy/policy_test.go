@@ -0,0 +1,93 @@
+package policy
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/vorteil/vorteil/pkg/vcfg"
+	"github.com/vorteil/vorteil/pkg/vio"
+)
+
+func testTree(t *testing.T, paths ...string) vio.FileTree {
+
+	tree := vio.NewFileTree()
+	for _, path := range paths {
+		err := tree.Map(path, vio.CustomFile(vio.CustomFileArgs{
+			Name:       path,
+			ModTime:    time.Now(),
+			ReadCloser: ioutil.NopCloser(bytes.NewReader(nil)),
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return tree
+
+}
+
+func TestCheck(t *testing.T) {
+
+	p, err := Load([]byte(`
+forbid-privileges = ["root", "superuser"]
+require-dns = true
+forbid-paths = ["/etc/shadow", "**.pem"]
+require-paths = ["/etc/hosts", "app"]
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &vcfg.VCFG{
+		Programs: []vcfg.Program{
+			{Binary: "/app"},
+			{Binary: "/helper", Privilege: vcfg.UserPrivilege},
+		},
+		System: vcfg.SystemSettings{
+			FirstBoot: []vcfg.Hook{
+				{Binary: "/migrate", Privilege: vcfg.SuperuserPrivilege},
+			},
+			OnShutdown: []vcfg.Hook{
+				{Binary: "/cleanup", Privilege: vcfg.UserPrivilege},
+			},
+		},
+	}
+
+	tree := testTree(t, "app", "etc/shadow", "etc/ssl/key.pem")
+	defer tree.Close()
+
+	err = p.Check(cfg, tree)
+	v, ok := err.(Violations)
+	if !ok {
+		t.Fatalf("expected policy violations, got %v", err)
+	}
+
+	if len(v) != 6 {
+		t.Errorf("expected 6 violations, got %d: %v", len(v), v)
+	}
+
+	cfg.Programs[0].Privilege = vcfg.UserPrivilege
+	cfg.System.FirstBoot[0].Privilege = vcfg.UserPrivilege
+	cfg.System.DNS = []string{"8.8.8.8"}
+
+	tree = testTree(t, "app", "etc/hosts", "etc/ssl/key.crt")
+	defer tree.Close()
+
+	err = p.Check(cfg, tree)
+	if err != nil {
+		t.Errorf("unexpected policy violations: %v", err)
+	}
+
+	_, err = Load([]byte(`forbid-privileges = ["admin"]`))
+	if err == nil {
+		t.Errorf("policy accepted an invalid privilege")
+	}
+
+}
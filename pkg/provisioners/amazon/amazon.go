@@ -14,6 +14,7 @@ import (
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ec2"
@@ -24,6 +25,7 @@ import (
 	"github.com/vorteil/vorteil/pkg/provisioners"
 	"github.com/vorteil/vorteil/pkg/vcfg"
 	"github.com/vorteil/vorteil/pkg/vdisk"
+	"github.com/vorteil/vorteil/pkg/vio"
 )
 
 // ProvisionerType : Constant string value used to represent the provisioner type amazon
@@ -52,12 +54,17 @@ type Provisioner struct {
 	args        provisioners.ProvisionArgs
 }
 
-// Config contains configuration fields required by the Provisioner
+// Config contains configuration fields required by the Provisioner. If Key
+// and Secret are omitted, credentials are found using the default AWS
+// credential chain: environment variables, the shared credentials and config
+// files (using Profile, if set), then the ECS task role or EC2 instance
+// profile.
 type Config struct {
-	Key    string `json:"key"`    // AWS Access Key
-	Secret string `json:"secret"` // AWS Access Key Secret
-	Region string `json:"region"` // AWS Region
-	Bucket string `json:"bucket"` // AWS Bucket
+	Key     string `json:"key"`               // AWS Access Key
+	Secret  string `json:"secret"`            // AWS Access Key Secret
+	Region  string `json:"region"`            // AWS Region
+	Bucket  string `json:"bucket"`            // AWS Bucket
+	Profile string `json:"profile,omitempty"` // AWS shared config profile
 }
 
 type userData struct {
@@ -84,14 +91,18 @@ func NewProvisioner(log elog.View, cfg *Config) (*Provisioner, error) {
 // Validate ...
 func (p *Provisioner) Validate() error {
 	// Validate
-	if p.cfg.Key == "" {
+	if p.cfg.Key == "" && p.cfg.Secret != "" {
 		return errors.New("no defined access key")
 	}
 
-	if p.cfg.Secret == "" {
+	if p.cfg.Secret == "" && p.cfg.Key != "" {
 		return errors.New("no defined access secret")
 	}
 
+	if p.cfg.Key != "" && p.cfg.Profile != "" {
+		return errors.New("a profile cannot be used with a static access key")
+	}
+
 	if p.cfg.Region == "" {
 		return errors.New("no defined region")
 	}
@@ -101,14 +112,16 @@ func (p *Provisioner) Validate() error {
 	}
 
 	// attempt to connect and validate that the provided config is workable
-	sess, err := session.NewSession(&aws.Config{
-		Region:      aws.String(p.cfg.Region),
-		Credentials: credentials.NewStaticCredentials(p.cfg.Key, p.cfg.Secret, ""),
-	})
+	sess, err := p.newSession()
 	if err != nil {
 		return err
 	}
 
+	_, err = sess.Config.Credentials.Get()
+	if err != nil {
+		return fmt.Errorf("could not find aws credentials: %v", err)
+	}
+
 	region, err := s3manager.GetBucketRegion(context.Background(), sess, p.cfg.Bucket, p.cfg.Region)
 	if err != nil {
 		return fmt.Errorf("bucket '%s' does not exist", p.cfg.Bucket)
@@ -136,12 +149,31 @@ func (p *Provisioner) SizeAlign() vcfg.Bytes {
 	return vcfg.GiB
 }
 
+// newSession creates an aws session using the static credentials from the
+// config if they exist, or the default credential chain otherwise. The
+// default chain fetches instance profile credentials using IMDSv2 session
+// tokens, falling back to IMDSv1 where tokens are unavailable.
+func (p *Provisioner) newSession() (*session.Session, error) {
+
+	if p.cfg.Key != "" {
+		return session.NewSession(&aws.Config{
+			Region:      aws.String(p.cfg.Region),
+			Credentials: credentials.NewStaticCredentials(p.cfg.Key, p.cfg.Secret, ""),
+		})
+	}
+
+	return session.NewSessionWithOptions(session.Options{
+		Config: aws.Config{
+			Region: aws.String(p.cfg.Region),
+		},
+		Profile:           p.cfg.Profile,
+		SharedConfigState: session.SharedConfigEnable,
+	})
+}
+
 func (p *Provisioner) init() error {
 	var err error
-	p.awsSession, err = session.NewSession(&aws.Config{
-		Region:      aws.String(p.cfg.Region),
-		Credentials: credentials.NewStaticCredentials(p.cfg.Key, p.cfg.Secret, ""),
-	})
+	p.awsSession, err = p.newSession()
 	if err != nil {
 		return fmt.Errorf("could not create aws session: %v", err)
 	}
@@ -158,38 +190,59 @@ func (p *Provisioner) init() error {
 //	this function will block until aws reports the ami as usable.
 func (p *Provisioner) Provision(args *provisioners.ProvisionArgs) error {
 	var err error
-	var imageID *string
+	var image *ec2.Image
 	p.args = *args
 
 	uploadProgress := p.log.NewProgress("Uploading Image to AWS Bucket", "", 0)
 	defer uploadProgress.Finish(true)
 
 	// Handle Exisitng Image and Force Flag
-	imageID, err = p.getImageID(p.args.Name)
-	if imageID != nil {
-		if args.Force {
-			// deregister current live version as were force pushing
-			p.log.Infof("deregistering old ami: %v\n", imageID)
-			_, err = p.ec2Client.DeregisterImageWithContext(p.args.Context, &ec2.DeregisterImageInput{
-				ImageId: imageID,
-			})
-		} else {
-			err = errors.New("ami exists: try using the --force flag")
+	image, err = p.getImage(p.args.Context, p.args.Name)
+	if err != nil {
+		return err
+	}
+
+	if image != nil {
+		// an AMI left by an earlier run with the same token is either
+		// already what we want, or a failed attempt that can be replaced
+		sameImage := args.Token != "" && imageToken(image) == args.Token
+		if sameImage && aws.StringValue(image.State) != ec2.ImageStateFailed {
+			p.log.Printf("Provisioned AMI: %s (already up to date)", aws.StringValue(image.ImageId))
+			return nil
 		}
 
-	}
+		if !args.Force && !sameImage {
+			return errors.New("ami exists: try using the --force flag")
+		}
 
-	if err != nil {
-		return err
+		// deregister current live version as were force pushing
+		p.log.Infof("deregistering old ami: %v\n", aws.StringValue(image.ImageId))
+		err = provisioners.Retry(args, p.log, "Deregistering AMI", func() error {
+			_, err := p.ec2Client.DeregisterImageWithContext(p.args.Context, &ec2.DeregisterImageInput{
+				ImageId: image.ImageId,
+			})
+			return err
+		})
+		if err != nil {
+			return err
+		}
 	}
 
-	// Upload Image
-	keyName := aws.String(p.args.Name + "-" + uuid.New().String())
+	// Upload Image. Keys derived from the token are reused by later runs,
+	// rather than leaving orphaned objects in the bucket.
+	suffix := args.Token
+	if suffix == "" {
+		suffix = uuid.New().String()
+	}
+	keyName := aws.String(p.args.Name + "-" + suffix)
 	uploader := s3manager.NewUploader(p.awsSession)
-	_, err = uploader.Upload(&s3manager.UploadInput{
-		Bucket: aws.String(p.cfg.Bucket),
-		Key:    keyName,
-		Body:   args.Image,
+	err = provisioners.RetryUpload(args, p.log, "Uploading image", func(image vio.File) error {
+		_, err := uploader.UploadWithContext(p.args.Context, &s3manager.UploadInput{
+			Bucket: aws.String(p.cfg.Bucket),
+			Key:    keyName,
+			Body:   image,
+		})
+		return err
 	})
 
 	uploadProgress.Finish(true)
@@ -200,53 +253,86 @@ func (p *Provisioner) Provision(args *provisioners.ProvisionArgs) error {
 
 	defer func() {
 		p.log.Infof("Cleaning Image From Bucket %s", keyName)
-		// Delete object that was uploaded (mainly used to clean up when the function ends)
+		// Delete object that was uploaded (mainly used to clean up when the function ends),
+		// even if the provision was cancelled
 		_, _ = p.s3Client.DeleteObject(&s3.DeleteObjectInput{
 			Bucket: aws.String(p.cfg.Bucket),
 			Key:    keyName,
 		})
 	}()
 
-	snapshotID, err := p.importSnapshot(aws.StringValue(keyName))
+	var snapshotID string
+	err = provisioners.Retry(args, p.log, "Importing snapshot", func() error {
+		var err error
+		snapshotID, err = p.importSnapshot(aws.StringValue(keyName))
+		return err
+	})
 	if err != nil {
 		return fmt.Errorf("Failed to convert bucket Image to Snapshot, error: %s", err.Error())
 	}
 
 	registerImgProgress := p.log.NewProgress("Registering snapshot as AMI", "", 0)
 	defer registerImgProgress.Finish(true)
-	rio, err := p.ec2Client.RegisterImage(&ec2.RegisterImageInput{
-		Architecture:       aws.String("x86_64"),
-		Description:        aws.String(p.args.Description),
-		Name:               aws.String(p.args.Name),
-		EnaSupport:         aws.Bool(true),
-		VirtualizationType: aws.String("hvm"),
-		RootDeviceName:     aws.String("/dev/sda1"),
-		BlockDeviceMappings: []*ec2.BlockDeviceMapping{
-			&ec2.BlockDeviceMapping{
-				DeviceName: aws.String("/dev/sda1"),
-				Ebs: &ec2.EbsBlockDevice{
-					SnapshotId: aws.String(snapshotID),
+
+	var rio *ec2.RegisterImageOutput
+	err = provisioners.Retry(args, p.log, "Registering AMI", func() error {
+		var err error
+		rio, err = p.ec2Client.RegisterImageWithContext(p.args.Context, &ec2.RegisterImageInput{
+			Architecture:       aws.String("x86_64"),
+			Description:        aws.String(p.args.Description),
+			Name:               aws.String(p.args.Name),
+			EnaSupport:         aws.Bool(true),
+			VirtualizationType: aws.String("hvm"),
+			RootDeviceName:     aws.String("/dev/sda1"),
+			BlockDeviceMappings: []*ec2.BlockDeviceMapping{
+				&ec2.BlockDeviceMapping{
+					DeviceName: aws.String("/dev/sda1"),
+					Ebs: &ec2.EbsBlockDevice{
+						SnapshotId: aws.String(snapshotID),
+					},
 				},
 			},
-		},
+		})
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "InvalidAMIName.Duplicate" {
+			return provisioners.Permanent(err)
+		}
+		return err
 	})
 	if err != nil {
 		return err
 	}
+
+	if args.Token != "" {
+		err = provisioners.Retry(args, p.log, "Tagging AMI", func() error {
+			_, err := p.ec2Client.CreateTagsWithContext(p.args.Context, &ec2.CreateTagsInput{
+				Resources: []*string{rio.ImageId},
+				Tags: []*ec2.Tag{
+					&ec2.Tag{
+						Key:   aws.String(provisioners.TokenTag),
+						Value: aws.String(args.Token),
+					},
+				},
+			})
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
 	registerImgProgress.Finish(true)
 
 	p.log.Printf("Provisioned AMI: %s", *rio.ImageId)
 	return nil
 }
 
-// getImageID given a imageName, return the imageID of the first image found, or nil if not found
-func (p *Provisioner) getImageID(imageName string) (*string, error) {
+// getImage given a imageName, return the first image found, or nil if not found
+func (p *Provisioner) getImage(ctx context.Context, imageName string) (*ec2.Image, error) {
 	var err error
 	filterForce := &ec2.Filter{
 		Name:   aws.String("name"),
 		Values: []*string{aws.String(imageName)},
 	}
-	awsImages, err := p.ec2Client.DescribeImages(&ec2.DescribeImagesInput{
+	awsImages, err := p.ec2Client.DescribeImagesWithContext(ctx, &ec2.DescribeImagesInput{
 		Filters: []*ec2.Filter{filterForce},
 	})
 	if err != nil {
@@ -254,19 +340,29 @@ func (p *Provisioner) getImageID(imageName string) (*string, error) {
 	}
 
 	if len(awsImages.Images) > 0 {
-		return awsImages.Images[0].ImageId, nil
+		return awsImages.Images[0], nil
 	}
 
 	return nil, nil
 }
 
+// imageToken returns the idempotency token recorded on image, if any.
+func imageToken(image *ec2.Image) string {
+	for _, tag := range image.Tags {
+		if aws.StringValue(tag.Key) == provisioners.TokenTag {
+			return aws.StringValue(tag.Value)
+		}
+	}
+	return ""
+}
+
 func (p *Provisioner) importSnapshot(bucketImageKey string) (string, error) {
 	snapshotProgress := p.log.NewProgress("Converting Image to Snapshot ", "", 0)
 	defer snapshotProgress.Finish(false)
 	// Import Snapshot
 	var snapshotID *string
 	// o.updateStatus("Importing disk into EBS Snapshot")
-	iso, err := p.ec2Client.ImportSnapshot(&ec2.ImportSnapshotInput{
+	iso, err := p.ec2Client.ImportSnapshotWithContext(p.args.Context, &ec2.ImportSnapshotInput{
 		Description: aws.String(p.args.Description),
 		DiskContainer: &ec2.SnapshotDiskContainer{
 			UserBucket: &ec2.UserBucket{
@@ -282,7 +378,7 @@ func (p *Provisioner) importSnapshot(bucketImageKey string) (string, error) {
 
 	var disto *ec2.DescribeImportSnapshotTasksOutput
 	for {
-		disto, err = p.ec2Client.DescribeImportSnapshotTasks(&ec2.DescribeImportSnapshotTasksInput{
+		disto, err = p.ec2Client.DescribeImportSnapshotTasksWithContext(p.args.Context, &ec2.DescribeImportSnapshotTasksInput{
 			ImportTaskIds: []*string{iso.ImportTaskId},
 		})
 		if err != nil {
@@ -304,7 +400,12 @@ func (p *Provisioner) importSnapshot(bucketImageKey string) (string, error) {
 			err = errors.New("No import id tasks exists for the snapshot")
 			break
 		}
-		time.Sleep(pollrate)
+
+		select {
+		case <-p.args.Context.Done():
+			return "", p.args.Context.Err()
+		case <-time.After(pollrate):
+		}
 	}
 
 	return aws.StringValue(snapshotID), err
@@ -318,6 +419,7 @@ func (p *Provisioner) Marshal() ([]byte, error) {
 	m["secret"] = p.cfg.Secret
 	m["region"] = p.cfg.Region
 	m["bucket"] = p.cfg.Bucket
+	m["profile"] = p.cfg.Profile
 
 	out, err := json.Marshal(m)
 	if err != nil {
@@ -326,3 +428,145 @@ func (p *Provisioner) Marshal() ([]byte, error) {
 
 	return out, nil
 }
+
+// Launch starts an instance of the AMI called args.Name, in a security group
+// that opens args.Ports, and waits until it is running.
+func (p *Provisioner) Launch(args *provisioners.LaunchArgs) (*provisioners.Instance, error) {
+
+	image, err := p.getImage(args.Context, args.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	if image == nil {
+		return nil, fmt.Errorf("ami '%s' not found", args.Name)
+	}
+
+	progress := p.log.NewProgress("Launching instance", "", 0)
+	defer progress.Finish(false)
+
+	err = p.ec2Client.WaitUntilImageAvailableWithContext(args.Context, &ec2.DescribeImagesInput{
+		ImageIds: []*string{image.ImageId},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("ami '%s' did not become available: %v", args.Name, err)
+	}
+
+	groupID, err := p.securityGroup(args)
+	if err != nil {
+		return nil, err
+	}
+
+	reservation, err := p.ec2Client.RunInstancesWithContext(args.Context, &ec2.RunInstancesInput{
+		ImageId:          image.ImageId,
+		InstanceType:     aws.String(args.MachineType),
+		MinCount:         aws.Int64(1),
+		MaxCount:         aws.Int64(1),
+		SecurityGroupIds: []*string{groupID},
+		TagSpecifications: []*ec2.TagSpecification{
+			&ec2.TagSpecification{
+				ResourceType: aws.String(ec2.ResourceTypeInstance),
+				Tags: []*ec2.Tag{
+					&ec2.Tag{
+						Key:   aws.String("Name"),
+						Value: aws.String(args.Name),
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(reservation.Instances) == 0 {
+		return nil, errors.New("no instance was launched")
+	}
+
+	input := &ec2.DescribeInstancesInput{
+		InstanceIds: []*string{reservation.Instances[0].InstanceId},
+	}
+
+	err = p.ec2Client.WaitUntilInstanceRunningWithContext(args.Context, input)
+	if err != nil {
+		return nil, err
+	}
+
+	out, err := p.ec2Client.DescribeInstancesWithContext(args.Context, input)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(out.Reservations) == 0 || len(out.Reservations[0].Instances) == 0 {
+		return nil, errors.New("launched instance not found")
+	}
+
+	instance := out.Reservations[0].Instances[0]
+	progress.Finish(true)
+
+	return &provisioners.Instance{
+		ID: aws.StringValue(instance.InstanceId),
+		IP: aws.StringValue(instance.PublicIpAddress),
+	}, nil
+
+}
+
+// securityGroup returns the ID of the security group for instances of
+// args.Name, creating it if necessary, and makes sure it opens args.Ports.
+func (p *Provisioner) securityGroup(args *provisioners.LaunchArgs) (*string, error) {
+
+	name := aws.String("vorteil-" + args.Name)
+
+	groups, err := p.ec2Client.DescribeSecurityGroupsWithContext(args.Context, &ec2.DescribeSecurityGroupsInput{
+		Filters: []*ec2.Filter{
+			&ec2.Filter{
+				Name:   aws.String("group-name"),
+				Values: []*string{name},
+			},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var groupID *string
+	if len(groups.SecurityGroups) > 0 {
+		groupID = groups.SecurityGroups[0].GroupId
+	} else {
+		group, err := p.ec2Client.CreateSecurityGroupWithContext(args.Context, &ec2.CreateSecurityGroupInput{
+			GroupName:   name,
+			Description: aws.String(fmt.Sprintf("Ports exposed by vorteil image %s", args.Name)),
+		})
+		if err != nil {
+			return nil, err
+		}
+		groupID = group.GroupId
+	}
+
+	for _, port := range args.Ports {
+		_, err = p.ec2Client.AuthorizeSecurityGroupIngressWithContext(args.Context, &ec2.AuthorizeSecurityGroupIngressInput{
+			GroupId: groupID,
+			IpPermissions: []*ec2.IpPermission{
+				&ec2.IpPermission{
+					IpProtocol: aws.String(port.Protocol),
+					FromPort:   aws.Int64(int64(port.Port)),
+					ToPort:     aws.Int64(int64(port.Port)),
+					IpRanges: []*ec2.IpRange{
+						&ec2.IpRange{
+							CidrIp: aws.String("0.0.0.0/0"),
+						},
+					},
+				},
+			},
+		})
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "InvalidPermission.Duplicate" {
+			err = nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return groupID, nil
+
+}
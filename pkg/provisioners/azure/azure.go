@@ -9,6 +9,7 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"crypto/rand"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
@@ -16,11 +17,14 @@ import (
 	"io/ioutil"
 	"net/url"
 	"os"
+	"strconv"
 	"strings"
 
 	"github.com/Azure/azure-sdk-for-go/profiles/latest/compute/mgmt/compute"
+	"github.com/Azure/azure-sdk-for-go/profiles/latest/network/mgmt/network"
 	"github.com/Azure/azure-sdk-for-go/storage"
 	"github.com/Azure/azure-storage-blob-go/azblob"
+	"github.com/Azure/go-autorest/autorest"
 	"github.com/Azure/go-autorest/autorest/azure"
 	"github.com/Azure/go-autorest/autorest/azure/auth"
 	"github.com/vorteil/vorteil/pkg/elog"
@@ -33,6 +37,8 @@ const (
 	// ProvisionerType : Constant string value used to represent the provisioner type azure
 	ProvisionerType = "microsoft-azure"
 	blobSize        = 4194304
+
+	provisioningStateFailed = "Failed"
 )
 
 // Provisioner satisfies the provisioners.Provisioner interface
@@ -109,7 +115,7 @@ func (p *Provisioner) Type() string {
 
 // DiskFormat returns the provisioners required disk format
 func (p *Provisioner) DiskFormat() vdisk.Format {
-	return vdisk.VHDFormat
+	return vdisk.AzureFormat
 }
 
 func fetchVal(keyMap map[string]interface{}, name string) string {
@@ -149,7 +155,7 @@ func (p *Provisioner) SizeAlign() vcfg.Bytes {
 	return vcfg.Bytes(0)
 }
 
-func (p *Provisioner) getBlobRef(name string) (*storage.Blob, error) {
+func (p *Provisioner) getBlobRef(ctx context.Context, name string) (*storage.Blob, error) {
 
 	creds, err := azblob.NewSharedKeyCredential(p.cfg.StorageAccountName, p.cfg.StorageAccountKey)
 	if err != nil {
@@ -164,8 +170,6 @@ func (p *Provisioner) getBlobRef(name string) (*storage.Blob, error) {
 	}
 
 	containerURL := azblob.NewContainerURL(*url, pi)
-	ctx := context.Background()
-
 	containerURL.Create(ctx, azblob.Metadata{}, azblob.PublicAccessNone) // creates if not exists
 
 	storageClient, err := storage.NewBasicClient(p.cfg.StorageAccountName, p.cfg.StorageAccountKey)
@@ -181,12 +185,11 @@ func (p *Provisioner) getBlobRef(name string) (*storage.Blob, error) {
 
 }
 
-func (p *Provisioner) getImagesClient() (compute.ImagesClient, error) {
+func (p *Provisioner) getAuthorizer() (autorest.Authorizer, error) {
 
-	imagesClient := compute.NewImagesClient(p.subscriptionID)
 	settings, err := auth.GetSettingsFromEnvironment()
 	if err != nil {
-		return imagesClient, err
+		return nil, err
 	}
 
 	settings.Values[auth.SubscriptionID] = p.subscriptionID
@@ -196,7 +199,15 @@ func (p *Provisioner) getImagesClient() (compute.ImagesClient, error) {
 	settings.Values[auth.Resource] = p.resourceManagerEndpointURL
 	settings.Values[auth.TenantID] = p.tenantID
 
-	imagesClient.Authorizer, err = settings.GetAuthorizer()
+	return settings.GetAuthorizer()
+
+}
+
+func (p *Provisioner) getImagesClient() (compute.ImagesClient, error) {
+
+	var err error
+	imagesClient := compute.NewImagesClient(p.subscriptionID)
+	imagesClient.Authorizer, err = p.getAuthorizer()
 
 	return imagesClient, err
 
@@ -257,6 +268,13 @@ func (p *Provisioner) uploadBlob(f *os.File, args *provisioners.ProvisionArgs, b
 	f.Seek(0, 0)
 
 	for {
+		// the storage client can't be cancelled, so check between pages
+		err := args.Context.Err()
+		if err != nil {
+			progress.Finish(false)
+			return err
+		}
+
 		ps, _ = f.Seek(0, 1)
 		n, err := reader.Read(buf)
 
@@ -298,7 +316,25 @@ func (p *Provisioner) Provision(args *provisioners.ProvisionArgs) error {
 		f      *os.File
 	)
 
-	blob, err := p.getBlobRef(args.Name)
+	imagesClient, err := p.getImagesClient()
+	if err != nil {
+		return err
+	}
+
+	// an image left by an earlier run with the same token is either already
+	// what we want, or a failed attempt that can be replaced
+	var sameImage bool
+	result, err := imagesClient.Get(args.Context, p.cfg.ResourceGroup, args.Name, "")
+	if err == nil && result.ID != nil && args.Token != "" {
+		token, ok := result.Tags[provisioners.TokenTag]
+		sameImage = ok && token != nil && *token == args.Token
+		if sameImage && (result.ProvisioningState == nil || *result.ProvisioningState != provisioningStateFailed) {
+			p.log.Printf("Image '%s' is already up to date", args.Name)
+			return nil
+		}
+	}
+
+	blob, err := p.getBlobRef(args.Context, args.Name)
 	if err != nil {
 		return err
 	}
@@ -312,12 +348,21 @@ func (p *Provisioner) Provision(args *provisioners.ProvisionArgs) error {
 	blob.Properties.ContentType = "text/plain"
 	blob.Properties.ContentLength = length
 
-	err = p.uploadBlob(f, args, blob)
+	err = provisioners.Retry(args, p.log, "Uploading image", func() error {
+		return p.uploadBlob(f, args, blob)
+	})
 	if err != nil {
 		return err
 	}
 
-	err = p.createImage(length, args, blob)
+	err = p.deleteImageIfRequired(imagesClient, args, sameImage)
+	if err != nil {
+		return err
+	}
+
+	err = provisioners.Retry(args, p.log, "Creating image", func() error {
+		return p.createImage(imagesClient, length, args, blob)
+	})
 	if err != nil {
 		return err
 	}
@@ -325,13 +370,13 @@ func (p *Provisioner) Provision(args *provisioners.ProvisionArgs) error {
 	return nil
 }
 
-func (p *Provisioner) deleteImageIfRequired(imagesClient compute.ImagesClient, args *provisioners.ProvisionArgs) error {
+func (p *Provisioner) deleteImageIfRequired(imagesClient compute.ImagesClient, args *provisioners.ProvisionArgs, replace bool) error {
 
 	result, err := imagesClient.Get(args.Context, p.cfg.ResourceGroup, args.Name, "")
 	if err == nil || result.ID != nil {
 		// image already exists
-		if !args.Force {
-			return fmt.Errorf("Image already exists; aborting. To replace conflicting image, include the 'force' directive")
+		if !args.Force && !replace {
+			return provisioners.Permanent(fmt.Errorf("Image already exists; aborting. To replace conflicting image, include the 'force' directive"))
 		}
 
 		ciprogree := p.log.NewProgress("Deleting existing image", "", 0)
@@ -351,17 +396,7 @@ func (p *Provisioner) deleteImageIfRequired(imagesClient compute.ImagesClient, a
 	return nil
 }
 
-func (p *Provisioner) createImage(length int64, args *provisioners.ProvisionArgs, blob *storage.Blob) error {
-
-	imagesClient, err := p.getImagesClient()
-	if err != nil {
-		return err
-	}
-
-	err = p.deleteImageIfRequired(imagesClient, args)
-	if err != nil {
-		return err
-	}
+func (p *Provisioner) createImage(imagesClient compute.ImagesClient, length int64, args *provisioners.ProvisionArgs, blob *storage.Blob) error {
 
 	ciprogree := p.log.NewProgress("Creating Image from blob", "", 0)
 	defer ciprogree.Finish(false)
@@ -377,6 +412,9 @@ func (p *Provisioner) createImage(length int64, args *provisioners.ProvisionArgs
 	// set description as a tag
 	tags := make(map[string]*string)
 	tags["Description"] = &args.Description
+	if args.Token != "" {
+		tags[provisioners.TokenTag] = &args.Token
+	}
 	img.Tags = tags
 	u := blob.GetURL()
 	img.StorageProfile.OsDisk.BlobURI = &u
@@ -415,3 +453,278 @@ func (p *Provisioner) Marshal() ([]byte, error) {
 
 	return out, nil
 }
+
+// Launch starts a virtual machine from the image called args.Name, with a
+// public IP address and a network security group that opens args.Ports, and
+// waits until it is running. Supporting resources are named after the image
+// and reused if they already exist.
+func (p *Provisioner) Launch(args *provisioners.LaunchArgs) (*provisioners.Instance, error) {
+
+	authorizer, err := p.getAuthorizer()
+	if err != nil {
+		return nil, err
+	}
+
+	imagesClient, err := p.getImagesClient()
+	if err != nil {
+		return nil, err
+	}
+
+	image, err := imagesClient.Get(args.Context, p.cfg.ResourceGroup, args.Name, "")
+	if err != nil {
+		return nil, fmt.Errorf("image '%s' not found: %v", args.Name, err)
+	}
+
+	progress := p.log.NewProgress("Launching virtual machine", "", 0)
+	defer progress.Finish(false)
+
+	subnet, err := p.createSubnet(args, authorizer)
+	if err != nil {
+		return nil, err
+	}
+
+	ip, err := p.createPublicIP(args, authorizer)
+	if err != nil {
+		return nil, err
+	}
+
+	nsg, err := p.createSecurityGroup(args, authorizer)
+	if err != nil {
+		return nil, err
+	}
+
+	nic, err := p.createInterface(args, authorizer, subnet, ip, nsg)
+	if err != nil {
+		return nil, err
+	}
+
+	vm, err := p.createVM(args, authorizer, image, nic)
+	if err != nil {
+		return nil, err
+	}
+
+	// static addresses are assigned once the VM is running
+	ipClient := network.NewPublicIPAddressesClient(p.subscriptionID)
+	ipClient.Authorizer = authorizer
+	ip, err = ipClient.Get(args.Context, p.cfg.ResourceGroup, *ip.Name, "")
+	if err != nil {
+		return nil, err
+	}
+
+	var address string
+	if ip.PublicIPAddressPropertiesFormat != nil && ip.IPAddress != nil {
+		address = *ip.IPAddress
+	}
+	progress.Finish(true)
+
+	return &provisioners.Instance{
+		ID: *vm.ID,
+		IP: address,
+	}, nil
+
+}
+
+func (p *Provisioner) createSubnet(args *provisioners.LaunchArgs, authorizer autorest.Authorizer) (network.Subnet, error) {
+
+	client := network.NewVirtualNetworksClient(p.subscriptionID)
+	client.Authorizer = authorizer
+
+	future, err := client.CreateOrUpdate(args.Context, p.cfg.ResourceGroup, args.Name+"-vnet", network.VirtualNetwork{
+		Location: &p.cfg.Location,
+		VirtualNetworkPropertiesFormat: &network.VirtualNetworkPropertiesFormat{
+			AddressSpace: &network.AddressSpace{
+				AddressPrefixes: &[]string{"10.0.0.0/16"},
+			},
+			Subnets: &[]network.Subnet{
+				{
+					Name: str("default"),
+					SubnetPropertiesFormat: &network.SubnetPropertiesFormat{
+						AddressPrefix: str("10.0.0.0/24"),
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return network.Subnet{}, err
+	}
+
+	err = future.WaitForCompletionRef(args.Context, client.Client)
+	if err != nil {
+		return network.Subnet{}, err
+	}
+
+	vnet, err := future.Result(client)
+	if err != nil {
+		return network.Subnet{}, err
+	}
+
+	if vnet.Subnets == nil || len(*vnet.Subnets) == 0 {
+		return network.Subnet{}, fmt.Errorf("virtual network '%s' has no subnets", *vnet.Name)
+	}
+
+	return (*vnet.Subnets)[0], nil
+
+}
+
+func (p *Provisioner) createPublicIP(args *provisioners.LaunchArgs, authorizer autorest.Authorizer) (network.PublicIPAddress, error) {
+
+	client := network.NewPublicIPAddressesClient(p.subscriptionID)
+	client.Authorizer = authorizer
+
+	future, err := client.CreateOrUpdate(args.Context, p.cfg.ResourceGroup, args.Name+"-ip", network.PublicIPAddress{
+		Location: &p.cfg.Location,
+		PublicIPAddressPropertiesFormat: &network.PublicIPAddressPropertiesFormat{
+			PublicIPAllocationMethod: network.Static,
+		},
+	})
+	if err != nil {
+		return network.PublicIPAddress{}, err
+	}
+
+	err = future.WaitForCompletionRef(args.Context, client.Client)
+	if err != nil {
+		return network.PublicIPAddress{}, err
+	}
+
+	return future.Result(client)
+
+}
+
+func (p *Provisioner) createSecurityGroup(args *provisioners.LaunchArgs, authorizer autorest.Authorizer) (network.SecurityGroup, error) {
+
+	client := network.NewSecurityGroupsClient(p.subscriptionID)
+	client.Authorizer = authorizer
+
+	rules := make([]network.SecurityRule, 0)
+	for i, port := range args.Ports {
+		protocol := network.SecurityRuleProtocolTCP
+		if port.Protocol == "udp" {
+			protocol = network.SecurityRuleProtocolUDP
+		}
+
+		rules = append(rules, network.SecurityRule{
+			Name: str(fmt.Sprintf("%s-%d", port.Protocol, port.Port)),
+			SecurityRulePropertiesFormat: &network.SecurityRulePropertiesFormat{
+				Protocol:                 protocol,
+				SourceAddressPrefix:      str("*"),
+				SourcePortRange:          str("*"),
+				DestinationAddressPrefix: str("*"),
+				DestinationPortRange:     str(strconv.Itoa(port.Port)),
+				Access:                   network.SecurityRuleAccessAllow,
+				Direction:                network.SecurityRuleDirectionInbound,
+				Priority:                 i32(int32(100 + i)),
+			},
+		})
+	}
+
+	future, err := client.CreateOrUpdate(args.Context, p.cfg.ResourceGroup, args.Name+"-nsg", network.SecurityGroup{
+		Location: &p.cfg.Location,
+		SecurityGroupPropertiesFormat: &network.SecurityGroupPropertiesFormat{
+			SecurityRules: &rules,
+		},
+	})
+	if err != nil {
+		return network.SecurityGroup{}, err
+	}
+
+	err = future.WaitForCompletionRef(args.Context, client.Client)
+	if err != nil {
+		return network.SecurityGroup{}, err
+	}
+
+	return future.Result(client)
+
+}
+
+func (p *Provisioner) createInterface(args *provisioners.LaunchArgs, authorizer autorest.Authorizer, subnet network.Subnet, ip network.PublicIPAddress, nsg network.SecurityGroup) (network.Interface, error) {
+
+	client := network.NewInterfacesClient(p.subscriptionID)
+	client.Authorizer = authorizer
+
+	future, err := client.CreateOrUpdate(args.Context, p.cfg.ResourceGroup, args.Name+"-nic", network.Interface{
+		Location: &p.cfg.Location,
+		InterfacePropertiesFormat: &network.InterfacePropertiesFormat{
+			NetworkSecurityGroup: &nsg,
+			IPConfigurations: &[]network.InterfaceIPConfiguration{
+				{
+					Name: str("default"),
+					InterfaceIPConfigurationPropertiesFormat: &network.InterfaceIPConfigurationPropertiesFormat{
+						Subnet:                    &subnet,
+						PrivateIPAllocationMethod: network.Dynamic,
+						PublicIPAddress:           &ip,
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return network.Interface{}, err
+	}
+
+	err = future.WaitForCompletionRef(args.Context, client.Client)
+	if err != nil {
+		return network.Interface{}, err
+	}
+
+	return future.Result(client)
+
+}
+
+func (p *Provisioner) createVM(args *provisioners.LaunchArgs, authorizer autorest.Authorizer, image compute.Image, nic network.Interface) (compute.VirtualMachine, error) {
+
+	client := compute.NewVirtualMachinesClient(p.subscriptionID)
+	client.Authorizer = authorizer
+
+	// vorteil images don't use it, but Azure requires an admin password
+	password := make([]byte, 16)
+	_, err := rand.Read(password)
+	if err != nil {
+		return compute.VirtualMachine{}, err
+	}
+
+	future, err := client.CreateOrUpdate(args.Context, p.cfg.ResourceGroup, args.Name, compute.VirtualMachine{
+		Location: &p.cfg.Location,
+		VirtualMachineProperties: &compute.VirtualMachineProperties{
+			HardwareProfile: &compute.HardwareProfile{
+				VMSize: compute.VirtualMachineSizeTypes(args.MachineType),
+			},
+			StorageProfile: &compute.StorageProfile{
+				ImageReference: &compute.ImageReference{
+					ID: image.ID,
+				},
+			},
+			OsProfile: &compute.OSProfile{
+				ComputerName:  str(args.Name),
+				AdminUsername: str("vorteil"),
+				AdminPassword: str(fmt.Sprintf("Vt1!%x", password)),
+			},
+			NetworkProfile: &compute.NetworkProfile{
+				NetworkInterfaces: &[]compute.NetworkInterfaceReference{
+					{
+						ID: nic.ID,
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return compute.VirtualMachine{}, err
+	}
+
+	err = future.WaitForCompletionRef(args.Context, client.Client)
+	if err != nil {
+		return compute.VirtualMachine{}, err
+	}
+
+	return future.Result(client)
+
+}
+
+func str(s string) *string {
+	return &s
+}
+
+func i32(i int32) *int32 {
+	return &i
+}
@@ -12,6 +12,8 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
@@ -21,9 +23,11 @@ import (
 	"github.com/vorteil/vorteil/pkg/provisioners"
 	"github.com/vorteil/vorteil/pkg/vcfg"
 	"github.com/vorteil/vorteil/pkg/vdisk"
+	"github.com/vorteil/vorteil/pkg/vio"
 	"golang.org/x/oauth2/google"
 	"golang.org/x/oauth2/jwt"
 	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/googleapi"
 	"google.golang.org/api/option"
 )
 
@@ -47,8 +51,9 @@ type ProvisionerArgs struct {
 
 // Config contains configuration fields required by the Provisioner
 type Config struct {
-	Bucket string `json:"bucket"` // Name of the bucket
-	Key    string `json:"key"`    // base64 encoded contents of a (JSON) Google Cloud Platform service account key file
+	Bucket string `json:"bucket"`         // Name of the bucket
+	Key    string `json:"key"`            // base64 encoded contents of a (JSON) Google Cloud Platform service account key file
+	Zone   string `json:"zone,omitempty"` // Zone to launch instances in
 }
 
 // ProvisionArgs TODO:
@@ -63,6 +68,8 @@ const (
 	// ProvisionerType for GCP provisioner
 	ProvisionerType = "google-compute"
 	statusDone      = "DONE"
+	statusFailed    = "FAILED"
+	defaultZone     = "us-central1-a"
 	waitInSecs      = 1800 // 30 minutes
 )
 
@@ -166,6 +173,12 @@ func (p *Provisioner) DiskFormat() vdisk.Format {
 	return vdisk.GCPFArchiveFormat
 }
 
+// Streams returns true because images are uploaded as a single stream, so
+// they can be uploaded while they're still being built.
+func (p *Provisioner) Streams() bool {
+	return true
+}
+
 // SizeAlign returns vcfg GiB size in bytes
 func (p *Provisioner) SizeAlign() vcfg.Bytes {
 	return vcfg.GiB
@@ -175,46 +188,87 @@ func (p *Provisioner) SizeAlign() vcfg.Bytes {
 func (p *Provisioner) Provision(args *provisioners.ProvisionArgs) error {
 	projectID := p.keyMap["project_id"].(string)
 
-	img, err := p.computeClient.Images.Get(projectID, args.Name).Do()
-	if err == nil && !args.Force {
-		return fmt.Errorf("image '%s' already exists", args.Name)
+	var sameImage bool
+	img, err := p.computeClient.Images.Get(projectID, args.Name).Context(args.Context).Do()
+	if err == nil {
+		// an image left by an earlier run with the same token is either
+		// already what we want, or a failed attempt that can be replaced
+		sameImage = args.Token != "" && img.Labels[provisioners.TokenTag] == args.Token
+		if sameImage && img.Status != statusFailed {
+			p.log.Printf("Image '%s' is already up to date", args.Name)
+			return nil
+		}
+
+		if !args.Force && !sameImage {
+			return fmt.Errorf("image '%s' already exists", args.Name)
+		}
 	}
 
 	name := strings.Replace(fmt.Sprintf("%s.tar.gz", uuid.New().String()), "-", "", -1)
+	if args.Token != "" {
+		name = fmt.Sprintf("%s-%s.tar.gz", args.Name, args.Token)
+	}
 	obj := p.bucketHandle.Object(name)
 
-	_, err = obj.Attrs(args.Context)
+	attrs, err := obj.Attrs(args.Context)
 	if err == nil {
-		return fmt.Errorf("object '%s' already exists", name)
+		if args.Token == "" || attrs.Size != int64(args.Image.Size()) {
+			return fmt.Errorf("object '%s' already exists", name)
+		}
+
+		// uploaded by an earlier run that failed later on
+		p.log.Infof("Reusing previously uploaded object '%s'", name)
+	} else {
+		err = provisioners.RetryUpload(args, p.log, "Uploading image", func(image vio.File) error {
+			return p.uploadObject(obj, image, args)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	defer func() {
+		// clean up even if the provision was cancelled
+		obj.Delete(context.Background())
+	}()
+
+	if img != nil && (args.Force || sameImage) {
+		err := provisioners.Retry(args, p.log, "Deleting conflicting image", func() error {
+			return p.deleteConflictingImage(args.Context, projectID, args.Name)
+		})
+		if err != nil {
+			return err
+		}
 	}
 
+	return provisioners.Retry(args, p.log, "Creating image", func() error {
+		return p.uploadImage(projectID, name, args)
+	})
+}
+
+func (p *Provisioner) uploadObject(obj *storage.ObjectHandle, image vio.File, args *provisioners.ProvisionArgs) error {
+
 	w := obj.NewWriter(args.Context)
 
-	progress := p.log.NewProgress(fmt.Sprintf("Uploading %s:", args.Name), "KiB", int64(args.Image.Size()))
-	pr := progress.ProxyReader(args.Image)
+	progress := p.log.NewProgress(fmt.Sprintf("Uploading %s:", args.Name), "KiB", int64(image.Size()))
+	pr := progress.ProxyReader(image)
 	defer pr.Close()
 
-	_, err = io.Copy(w, pr)
+	_, err := io.Copy(w, pr)
 	if err != nil {
 		progress.Finish(false)
 		w.Close()
 		return err
 	}
-	w.Close()
-	progress.Finish(true)
 
-	defer func() {
-		obj.Delete(args.Context)
-	}()
-
-	if args.Force && img != nil {
-		err := p.deleteConflictingImage(projectID, args.Name)
-		if err != nil {
-			return err
-		}
+	err = w.Close()
+	if err != nil {
+		progress.Finish(false)
+		return err
 	}
+	progress.Finish(true)
 
-	return p.uploadImage(projectID, name, args)
+	return nil
 }
 
 // Marshal returns json provisioner as bytes
@@ -224,6 +278,7 @@ func (p *Provisioner) Marshal() ([]byte, error) {
 	m[provisioners.MapKey] = ProvisionerType
 	m["bucket"] = p.cfg.Bucket
 	m["key"] = p.cfg.Key
+	m["zone"] = p.cfg.Zone
 
 	out, err := json.Marshal(m)
 	if err != nil {
@@ -239,13 +294,19 @@ func (p *Provisioner) uploadImage(projectID, file string, args *provisioners.Pro
 	ciprogree := p.log.NewProgress("Creating Image", "", 0)
 	defer ciprogree.Finish(false)
 
+	var labels map[string]string
+	if args.Token != "" {
+		labels = map[string]string{provisioners.TokenTag: args.Token}
+	}
+
 	op, err := p.computeClient.Images.Insert(projectID, &compute.Image{
 		Name: args.Name,
 		RawDisk: &compute.ImageRawDisk{
 			Source: fmt.Sprintf("https://storage.googleapis.com/%s/%s", p.cfg.Bucket, file),
 		},
 		Description: args.Description,
-	}).Do()
+		Labels:      labels,
+	}).Context(args.Context).Do()
 
 	if err != nil {
 		return err
@@ -253,8 +314,12 @@ func (p *Provisioner) uploadImage(projectID, file string, args *provisioners.Pro
 
 	var pollTimeout int
 	for op.Status != statusDone && pollTimeout <= waitInSecs {
-		<-time.After(time.Second)
-		op, err = p.computeClient.GlobalOperations.Get(projectID, op.Name).Do()
+		select {
+		case <-args.Context.Done():
+			return args.Context.Err()
+		case <-time.After(time.Second):
+		}
+		op, err = p.computeClient.GlobalOperations.Get(projectID, op.Name).Context(args.Context).Do()
 		if err != nil {
 			return err
 		}
@@ -265,24 +330,28 @@ func (p *Provisioner) uploadImage(projectID, file string, args *provisioners.Pro
 		return fmt.Errorf("timed out waiting for image creation")
 	}
 
+	if op.Error != nil && len(op.Error.Errors) > 0 {
+		return fmt.Errorf("failed to create image: %s", op.Error.Errors[0].Message)
+	}
+
 	return nil
 }
 
-func (p *Provisioner) deleteImage(projectID, name string) error {
+func (p *Provisioner) deleteImage(ctx context.Context, projectID, name string) error {
 
 	var (
 		err   error
 		delOp *compute.Operation
 	)
 
-	delOp, err = p.computeClient.Images.Delete(projectID, name).Do()
+	delOp, err = p.computeClient.Images.Delete(projectID, name).Context(ctx).Do()
 	if err != nil {
 		return err
 	}
 
 	var pollTimeout int
 	for delOp.Status != statusDone && pollTimeout <= waitInSecs {
-		delOp, err = p.computeClient.GlobalOperations.Get(projectID, delOp.Name).Do()
+		delOp, err = p.computeClient.GlobalOperations.Get(projectID, delOp.Name).Context(ctx).Do()
 		if err != nil {
 			break
 		}
@@ -291,7 +360,11 @@ func (p *Provisioner) deleteImage(projectID, name string) error {
 			break
 		}
 
-		time.Sleep(time.Second)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Second):
+		}
 		pollTimeout++
 	}
 	if pollTimeout >= waitInSecs {
@@ -301,7 +374,7 @@ func (p *Provisioner) deleteImage(projectID, name string) error {
 	return nil
 }
 
-func (p *Provisioner) deleteConflictingImage(projectID, name string) error {
+func (p *Provisioner) deleteConflictingImage(ctx context.Context, projectID, name string) error {
 
 	var (
 		err  error
@@ -310,17 +383,168 @@ func (p *Provisioner) deleteConflictingImage(projectID, name string) error {
 
 	// args.Logger.Infof("Deleting conflicting image.")
 	imagesForce := p.computeClient.Images.List(projectID)
-	list, err = imagesForce.Do()
+	list, err = imagesForce.Context(ctx).Do()
 	if err != nil {
 		return err
 	}
 
 	for _, image := range list.Items {
 		if image.Name == name {
-			err = p.deleteImage(projectID, name)
+			err = p.deleteImage(ctx, projectID, name)
 			break
 		}
 	}
 
 	return err
 }
+
+// Launch starts an instance of the image called args.Name in the configured
+// zone, with a firewall rule that opens args.Ports, and waits until it is
+// running.
+func (p *Provisioner) Launch(args *provisioners.LaunchArgs) (*provisioners.Instance, error) {
+
+	projectID := p.keyMap["project_id"].(string)
+
+	zone := p.cfg.Zone
+	if zone == "" {
+		zone = defaultZone
+	}
+
+	progress := p.log.NewProgress("Launching instance", "", 0)
+	defer progress.Finish(false)
+
+	if len(args.Ports) > 0 {
+		err := p.createFirewall(projectID, args)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	op, err := p.computeClient.Instances.Insert(projectID, zone, &compute.Instance{
+		Name:        args.Name,
+		MachineType: fmt.Sprintf("zones/%s/machineTypes/%s", zone, args.MachineType),
+		Tags: &compute.Tags{
+			Items: []string{args.Name},
+		},
+		Disks: []*compute.AttachedDisk{
+			&compute.AttachedDisk{
+				Boot:       true,
+				AutoDelete: true,
+				InitializeParams: &compute.AttachedDiskInitializeParams{
+					SourceImage: fmt.Sprintf("global/images/%s", args.Name),
+				},
+			},
+		},
+		NetworkInterfaces: []*compute.NetworkInterface{
+			&compute.NetworkInterface{
+				Network: "global/networks/default",
+				AccessConfigs: []*compute.AccessConfig{
+					&compute.AccessConfig{
+						Name: "External NAT",
+						Type: "ONE_TO_ONE_NAT",
+					},
+				},
+			},
+		},
+	}).Context(args.Context).Do()
+	if err != nil {
+		return nil, err
+	}
+
+	err = p.waitForOperation(args.Context, op, func() (*compute.Operation, error) {
+		return p.computeClient.ZoneOperations.Get(projectID, zone, op.Name).Context(args.Context).Do()
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to launch instance: %v", err)
+	}
+
+	instance, err := p.computeClient.Instances.Get(projectID, zone, args.Name).Context(args.Context).Do()
+	if err != nil {
+		return nil, err
+	}
+
+	var ip string
+	if len(instance.NetworkInterfaces) > 0 && len(instance.NetworkInterfaces[0].AccessConfigs) > 0 {
+		ip = instance.NetworkInterfaces[0].AccessConfigs[0].NatIP
+	}
+	progress.Finish(true)
+
+	return &provisioners.Instance{
+		ID: fmt.Sprintf("%s/%s", zone, instance.Name),
+		IP: ip,
+	}, nil
+
+}
+
+// createFirewall creates or updates a firewall rule opening args.Ports to
+// instances tagged with args.Name.
+func (p *Provisioner) createFirewall(projectID string, args *provisioners.LaunchArgs) error {
+
+	allowed := make(map[string]*compute.FirewallAllowed)
+	for _, port := range args.Ports {
+		if allowed[port.Protocol] == nil {
+			allowed[port.Protocol] = &compute.FirewallAllowed{IPProtocol: port.Protocol}
+		}
+		allowed[port.Protocol].Ports = append(allowed[port.Protocol].Ports, strconv.Itoa(port.Port))
+	}
+
+	fw := &compute.Firewall{
+		Name:         "vorteil-" + args.Name,
+		Network:      "global/networks/default",
+		SourceRanges: []string{"0.0.0.0/0"},
+		TargetTags:   []string{args.Name},
+	}
+
+	for _, a := range allowed {
+		fw.Allowed = append(fw.Allowed, a)
+	}
+
+	op, err := p.computeClient.Firewalls.Insert(projectID, fw).Context(args.Context).Do()
+	if gerr, ok := err.(*googleapi.Error); ok && gerr.Code == http.StatusConflict {
+		op, err = p.computeClient.Firewalls.Update(projectID, fw.Name, fw).Context(args.Context).Do()
+	}
+	if err != nil {
+		return err
+	}
+
+	err = p.waitForOperation(args.Context, op, func() (*compute.Operation, error) {
+		return p.computeClient.GlobalOperations.Get(projectID, op.Name).Context(args.Context).Do()
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create firewall rule: %v", err)
+	}
+
+	return nil
+
+}
+
+// waitForOperation polls op using get until it is done, waitInSecs passes,
+// or ctx is done.
+func (p *Provisioner) waitForOperation(ctx context.Context, op *compute.Operation, get func() (*compute.Operation, error)) error {
+
+	var err error
+	var pollTimeout int
+	for op.Status != statusDone && pollTimeout <= waitInSecs {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Second):
+		}
+		op, err = get()
+		if err != nil {
+			return err
+		}
+		pollTimeout++
+	}
+
+	if op.Status != statusDone {
+		return fmt.Errorf("timed out waiting for operation")
+	}
+
+	if op.Error != nil && len(op.Error.Errors) > 0 {
+		return errors.New(op.Error.Errors[0].Message)
+	}
+
+	return nil
+
+}
@@ -0,0 +1,94 @@
+package ipxe
+
+import (
+	"bytes"
+	"io"
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/vorteil/vorteil/pkg/cli"
+	"github.com/vorteil/vorteil/pkg/elog"
+	"github.com/vorteil/vorteil/pkg/provisioners"
+)
+
+var (
+	provisionersNewPassphrase string
+
+	// iPXE
+	provisionersNewIPXEUploadURL string
+	provisionersNewIPXEPublicURL string
+	provisionersNewIPXEUsername  string
+	provisionersNewIPXEPassword  string
+
+	// Equinix Metal
+	provisionersNewIPXEToken   string
+	provisionersNewIPXEProject string
+	provisionersNewIPXEMetro   string
+)
+
+var log elog.View
+
+// ProvisionersNewIPXECmd is a cobra command that can be used to create a new
+// ipxe provisioner.
+var ProvisionersNewIPXECmd = &cobra.Command{
+	Use:   "ipxe <OUTPUT_FILE>",
+	Short: "Add a new iPXE (bare metal or Equinix Metal) Provisioner.",
+	Long: `Add a new iPXE Provisioner. Provisioned images are uploaded as RAW disks to an
+HTTP endpoint alongside an iPXE script that SAN boots them from it, so any
+server that can chain-load the script can run the app. The endpoint must
+accept PUT requests and support range requests.
+
+If an Equinix Metal API token, project and metro are given, 'provision
+--launch PLAN' deploys a server of that plan that boots from the script.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+
+		f, err := os.OpenFile(args[0], os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			cli.SetError(err, 1)
+			return
+		}
+		defer f.Close()
+
+		p, err := NewProvisioner(log, &Config{
+			UploadURL: provisionersNewIPXEUploadURL,
+			PublicURL: provisionersNewIPXEPublicURL,
+			Username:  provisionersNewIPXEUsername,
+			Password:  provisionersNewIPXEPassword,
+			Token:     provisionersNewIPXEToken,
+			Project:   provisionersNewIPXEProject,
+			Metro:     provisionersNewIPXEMetro,
+		})
+		if err != nil {
+			cli.SetError(err, 2)
+			return
+		}
+
+		data, err := p.Marshal()
+		if err != nil {
+			cli.SetError(err, 3)
+			return
+		}
+
+		out := provisioners.Encrypt(data, provisionersNewPassphrase)
+		_, err = io.Copy(f, bytes.NewReader(out))
+		if err != nil {
+			cli.SetError(err, 4)
+			return
+		}
+
+	},
+}
+
+func init() {
+	f := ProvisionersNewIPXECmd.Flags()
+	f.StringVar(&provisionersNewIPXEUploadURL, "upload-url", "", "URL to upload images and iPXE scripts under with PUT requests (required)")
+	ProvisionersNewIPXECmd.MarkFlagRequired("upload-url")
+	f.StringVar(&provisionersNewIPXEPublicURL, "public-url", "", "URL servers download images and iPXE scripts from, if it isn't the upload URL")
+	f.StringVarP(&provisionersNewIPXEUsername, "username", "u", "", "Username for uploads, if the endpoint needs basic authentication")
+	f.StringVar(&provisionersNewIPXEPassword, "password", "", "Password for uploads")
+	f.StringVar(&provisionersNewIPXEToken, "token", "", "Equinix Metal API token, to launch servers that boot provisioned images")
+	f.StringVar(&provisionersNewIPXEProject, "project", "", "Equinix Metal project ID to launch servers in")
+	f.StringVar(&provisionersNewIPXEMetro, "metro", "", "Equinix Metal metro to launch servers in (e.g. sv)")
+	f.StringVarP(&provisionersNewPassphrase, "passphrase", "p", "", "Passphrase for encrypting exported provisioner data.")
+}
@@ -0,0 +1,137 @@
+package ipxe
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/vorteil/vorteil/pkg/provisioners"
+)
+
+const (
+	equinixAPI            = "https://api.equinix.com/metal/v1/"
+	deviceWaitTimeout     = time.Minute * 30
+	devicePollInterval    = time.Second * 10
+	deviceStateActive     = "active"
+	deviceStateFailed     = "failed"
+	deviceOperatingSystem = "custom_ipxe"
+)
+
+// request sends a JSON encoded body to the Equinix Metal API and decodes the
+// response into out, if it isn't nil
+func (p *Provisioner) request(ctx context.Context, method, path string, body interface{}, status int, out interface{}) error {
+
+	var data []byte
+	if body != nil {
+		var err error
+		data, err = json.Marshal(body)
+		if err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, equinixAPI+path, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Auth-Token", p.cfg.Token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != status {
+		b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("%s %s response was not ok: %s: %s", method, path, resp.Status, b)
+	}
+
+	if out == nil {
+		return nil
+	}
+
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+type device struct {
+	ID          string `json:"id"`
+	State       string `json:"state"`
+	IPAddresses []struct {
+		Address       string `json:"address"`
+		AddressFamily int    `json:"address_family"`
+		Public        bool   `json:"public"`
+	} `json:"ip_addresses"`
+}
+
+// publicIPv4 returns the device's public IPv4 address, if it has one yet
+func (d *device) publicIPv4() string {
+	for _, ip := range d.IPAddresses {
+		if ip.Public && ip.AddressFamily == 4 {
+			return ip.Address
+		}
+	}
+	return ""
+}
+
+// Launch deploys an Equinix Metal server of the plan args.MachineType that
+// boots the image from its iPXE script on every boot, and waits for it to
+// become active. Equinix Metal servers have no firewall of their own, so
+// args.Ports are reachable without being opened.
+func (p *Provisioner) Launch(args *provisioners.LaunchArgs) (*provisioners.Instance, error) {
+
+	if p.cfg.Token == "" {
+		return nil, fmt.Errorf("the %s provisioner has no Equinix Metal token to launch servers with", ProvisionerType)
+	}
+
+	progress := p.log.NewProgress("Launching server", "", 0)
+	defer progress.Finish(false)
+
+	d := new(device)
+	err := p.request(args.Context, http.MethodPost, "projects/"+p.cfg.Project+"/devices", map[string]interface{}{
+		"hostname":         args.Name,
+		"plan":             args.MachineType,
+		"metro":            p.cfg.Metro,
+		"operating_system": deviceOperatingSystem,
+		"ipxe_script_url":  p.publicURL(args.Name + scriptSuffix),
+		"always_pxe":       true, // the disk is only ever on the endpoint
+		"tags":             []string{"vorteil"},
+	}, http.StatusCreated, d)
+	if err != nil {
+		return nil, fmt.Errorf("failed to launch server: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(args.Context, deviceWaitTimeout)
+	defer cancel()
+
+	for d.State != deviceStateActive {
+		if d.State == deviceStateFailed {
+			return nil, fmt.Errorf("failed to launch server: device '%s' failed to provision", d.ID)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("timed out waiting for device '%s' to become active: %v", d.ID, ctx.Err())
+		case <-time.After(devicePollInterval):
+		}
+
+		err = p.request(ctx, http.MethodGet, "devices/"+d.ID, nil, http.StatusOK, d)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	progress.Finish(true)
+
+	return &provisioners.Instance{
+		ID: d.ID,
+		IP: d.publicIPv4(),
+	}, nil
+
+}
@@ -0,0 +1,285 @@
+package ipxe
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/vorteil/vorteil/pkg/elog"
+	"github.com/vorteil/vorteil/pkg/provisioners"
+	"github.com/vorteil/vorteil/pkg/vcfg"
+	"github.com/vorteil/vorteil/pkg/vdisk"
+	"github.com/vorteil/vorteil/pkg/vio"
+)
+
+// ProvisionerType : Constant string value used to represent the provisioner type ipxe
+const ProvisionerType = "ipxe"
+
+const (
+	imageSuffix  = ".raw"
+	scriptSuffix = ".ipxe"
+)
+
+// Provisioner satisfies the provisioners.Provisioner interface
+type Provisioner struct {
+	cfg    *Config
+	log    elog.View
+	client http.Client
+}
+
+// Config contains configuration fields required by the Provisioner. Images
+// and their iPXE scripts are uploaded with PUT requests to UploadURL, using
+// basic authentication if a Username is set, and servers download them from
+// PublicURL, which defaults to UploadURL. The endpoint has to support range
+// requests, because iPXE reads the disk from it block by block as the app
+// boots.
+//
+// If Token, Project and Metro are set, instances can be launched as Equinix
+// Metal servers that boot from the iPXE script.
+type Config struct {
+	UploadURL string `json:"upload-url"`
+	PublicURL string `json:"public-url,omitempty"`
+	Username  string `json:"username,omitempty"`
+	Password  string `json:"password,omitempty"`
+	Token     string `json:"token,omitempty"`
+	Project   string `json:"project,omitempty"`
+	Metro     string `json:"metro,omitempty"`
+}
+
+// NewProvisioner creates a provisioner object that it returns
+func NewProvisioner(log elog.View, cfg *Config) (*Provisioner, error) {
+	p := new(Provisioner)
+	p.cfg = cfg
+	p.log = log
+	err := p.Validate()
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s provisioner: %v", ProvisionerType, err)
+	}
+
+	return p, p.init()
+}
+
+// Validate arguments for ipxe
+func (p *Provisioner) Validate() error {
+
+	for _, x := range []struct {
+		name, value string
+	}{
+		{"upload-url", p.cfg.UploadURL},
+		{"public-url", p.cfg.PublicURL},
+	} {
+		if x.value == "" {
+			continue
+		}
+		u, err := url.Parse(x.value)
+		if err != nil {
+			return fmt.Errorf("%s: %v", x.name, err)
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return fmt.Errorf("%s must be an http or https URL", x.name)
+		}
+	}
+
+	if p.cfg.UploadURL == "" {
+		return fmt.Errorf("upload-url field should not be empty")
+	}
+
+	if p.cfg.Token != "" && (p.cfg.Project == "" || p.cfg.Metro == "") {
+		return fmt.Errorf("project and metro fields are needed to launch Equinix Metal servers")
+	}
+
+	return nil
+}
+
+// init checks that the Equinix Metal token can access the project, if one is
+// configured
+func (p *Provisioner) init() error {
+
+	if p.cfg.Token == "" {
+		return nil
+	}
+
+	err := p.request(context.Background(), http.MethodGet, "projects/"+p.cfg.Project, nil, http.StatusOK, nil)
+	if err != nil {
+		return fmt.Errorf("unable to access Equinix Metal project '%s': %v", p.cfg.Project, err)
+	}
+
+	return nil
+}
+
+// Type returns 'ipxe'
+func (p *Provisioner) Type() string {
+	return ProvisionerType
+}
+
+// DiskFormat returns the provisioners required disk format
+func (p *Provisioner) DiskFormat() vdisk.Format {
+	return vdisk.RAWFormat
+}
+
+// SizeAlign returns VCFG MiB size in bytes
+func (p *Provisioner) SizeAlign() vcfg.Bytes {
+	return vcfg.MiB
+}
+
+// objectURL returns the URL of the object called name under base.
+func objectURL(base, name string) string {
+	u, _ := url.Parse(base) // validated already
+	u.Path = path.Join("/", u.Path, name)
+	return u.String()
+}
+
+func (p *Provisioner) publicURL(name string) string {
+	base := p.cfg.PublicURL
+	if base == "" {
+		base = p.cfg.UploadURL
+	}
+	return objectURL(base, name)
+}
+
+// Script returns the iPXE script that boots the image called name. The image
+// is attached as a SAN disk over HTTP, so that the app reads its disk from
+// the endpoint instead of needing a local disk written first.
+func (p *Provisioner) Script(name string) string {
+	return fmt.Sprintf(`#!ipxe
+isset ${ip} || dhcp
+echo Booting %s
+sanboot --no-describe %s
+`, name, p.publicURL(name+imageSuffix))
+}
+
+// Provision given a valid ProvisionArgs object will provision the passed vorteil project
+// to the configured provisioner
+func (p *Provisioner) Provision(args *provisioners.ProvisionArgs) error {
+
+	if args.Description != "" {
+		p.log.Warnf(`The 'description' field is ignored by iPXE provision operation`)
+	}
+
+	imageURL := objectURL(p.cfg.UploadURL, args.Name+imageSuffix)
+
+	exists, err := p.exists(args.Context, imageURL)
+	if err != nil {
+		return err
+	}
+
+	if exists && !args.Force {
+		return fmt.Errorf("image '%s' already exists at %s", args.Name, imageURL)
+	}
+
+	err = provisioners.RetryUpload(args, p.log, "Uploading image", func(image vio.File) error {
+		progress := p.log.NewProgress(fmt.Sprintf("Uploading %s:", args.Name), "KiB", int64(image.Size()))
+		defer progress.Finish(false)
+
+		pr := progress.ProxyReader(image)
+		defer pr.Close()
+
+		err := p.upload(args.Context, imageURL, pr, int64(image.Size()), "application/octet-stream")
+		if err != nil {
+			return err
+		}
+
+		progress.Finish(true)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	script := p.Script(args.Name)
+	err = provisioners.Retry(args, p.log, "Uploading iPXE script", func() error {
+		return p.upload(args.Context, objectURL(p.cfg.UploadURL, args.Name+scriptSuffix), strings.NewReader(script), int64(len(script)), "text/plain")
+	})
+	if err != nil {
+		return err
+	}
+
+	p.log.Printf("iPXE script: %s", p.publicURL(args.Name+scriptSuffix))
+	return nil
+}
+
+// exists checks whether there is already an object at u
+func (p *Provisioner) exists(ctx context.Context, u string) (bool, error) {
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, u, nil)
+	if err != nil {
+		return false, err
+	}
+	p.authorize(req)
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return false, nil
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return true, nil
+	default:
+		return false, fmt.Errorf("HEAD %s response was not ok: %s", u, resp.Status)
+	}
+}
+
+func (p *Provisioner) authorize(req *http.Request) {
+	if p.cfg.Username != "" {
+		req.SetBasicAuth(p.cfg.Username, p.cfg.Password)
+	}
+}
+
+// upload PUTs the contents of r to u
+func (p *Provisioner) upload(ctx context.Context, u string, r io.Reader, size int64, contentType string) error {
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, u, ioutil.NopCloser(r))
+	if err != nil {
+		return err
+	}
+	p.authorize(req)
+	req.Header.Set("Content-Type", contentType)
+	req.ContentLength = size
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		err = fmt.Errorf("PUT %s response was not ok: %s: %s", u, resp.Status, b)
+		if resp.StatusCode >= 400 && resp.StatusCode < 500 {
+			return provisioners.Permanent(err)
+		}
+		return err
+	}
+
+	return nil
+}
+
+// Marshal returns json provisioner as bytes
+func (p *Provisioner) Marshal() ([]byte, error) {
+	m := make(map[string]interface{})
+	m[provisioners.MapKey] = ProvisionerType
+	m["upload-url"] = p.cfg.UploadURL
+	m["public-url"] = p.cfg.PublicURL
+	m["username"] = p.cfg.Username
+	m["password"] = p.cfg.Password
+	m["token"] = p.cfg.Token
+	m["project"] = p.cfg.Project
+	m["metro"] = p.cfg.Metro
+
+	out, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+
+	return out, nil
+}
@@ -18,6 +18,11 @@ var (
 	provisionerNewNutanixUsername string
 	provisionerNewNutanixPassword string
 	provisionerNewNutanixHost     string
+
+	provisionerNewNutanixCluster          string
+	provisionerNewNutanixStorageContainer string
+	provisionerNewNutanixSubnet           string
+	provisionerNewNutanixProject          string
 )
 
 var log elog.View
@@ -36,9 +41,13 @@ var ProvisionersNewNutanixCmd = &cobra.Command{
 		defer f.Close()
 
 		p, err := NewProvisioner(log, &Config{
-			Username: provisionerNewNutanixUsername,
-			Password: provisionerNewNutanixPassword,
-			Host:     provisionerNewNutanixHost,
+			Username:         provisionerNewNutanixUsername,
+			Password:         provisionerNewNutanixPassword,
+			Host:             provisionerNewNutanixHost,
+			Cluster:          provisionerNewNutanixCluster,
+			StorageContainer: provisionerNewNutanixStorageContainer,
+			Subnet:           provisionerNewNutanixSubnet,
+			Project:          provisionerNewNutanixProject,
 		})
 		if err != nil {
 			cli.SetError(err, 2)
@@ -70,5 +79,9 @@ func init() {
 	ProvisionersNewNutanixCmd.MarkFlagRequired("password")
 	f.StringVarP(&provisionerNewNutanixHost, "host", "n", "", "Hostname (required)")
 	ProvisionersNewNutanixCmd.MarkFlagRequired("host")
+	f.StringVar(&provisionerNewNutanixCluster, "cluster", "", "Cluster to place the image and VM template on")
+	f.StringVar(&provisionerNewNutanixStorageContainer, "storage-container", "", "Storage container for the VM template's disk")
+	f.StringVar(&provisionerNewNutanixSubnet, "subnet", "", "Subnet for the VM template's network interface")
+	f.StringVar(&provisionerNewNutanixProject, "project", "", "Prism Central project to own the image and VM template")
 
 }
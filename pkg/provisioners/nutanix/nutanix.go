@@ -1,6 +1,8 @@
 package nutanix
 
 import (
+	"bytes"
+	"context"
 	"crypto/tls"
 	"encoding/base64"
 	"encoding/json"
@@ -19,18 +21,43 @@ import (
 // ProvisionerType : Constant string value used to represent the provisioner type nutanix
 const ProvisionerType = "nutanix"
 
+const (
+	templateSockets   = 1
+	templateVCPUs     = 1
+	templateMemoryMiB = 1024
+	imageWaitTimeout  = time.Minute * 30
+)
+
 // Provisioner satisfies the provisioners.Provisioner interface
 type Provisioner struct {
 	cfg    *Config
 	log    elog.View
 	client http.Client
+
+	cluster          *reference
+	storageContainer *reference
+	subnet           *reference
+	project          *reference
 }
 
-// Config contains configuration fields required by the Provisioner
+// Config contains configuration fields required by the Provisioner. The
+// optional Cluster, StorageContainer, Subnet and Project fields are names
+// that are resolved when the provisioner is created. If a StorageContainer
+// or Subnet is set, a powered off VM template is created from the uploaded
+// image, since neither can be applied to an image directly.
 type Config struct {
-	Username string `json:"username"`
-	Password string `json:"password"`
-	Host     string `json:"host"`
+	Username         string `json:"username"`
+	Password         string `json:"password"`
+	Host             string `json:"host"`
+	Cluster          string `json:"cluster,omitempty"`
+	StorageContainer string `json:"storage-container,omitempty"`
+	Subnet           string `json:"subnet,omitempty"`
+	Project          string `json:"project,omitempty"`
+}
+
+type reference struct {
+	Kind string `json:"kind"`
+	UUID string `json:"uuid"`
 }
 
 // NewProvisioner creates a provisioner object that it returns
@@ -78,11 +105,224 @@ func (p *Provisioner) Validate() error {
 	return nil
 }
 
-// init
+// init resolves the names of the cluster, storage container, subnet and
+// project to references
 func (p *Provisioner) init() error {
+
+	var err error
+	ctx := context.Background()
+
+	for _, x := range []struct {
+		kind, name string
+		ref        **reference
+	}{
+		{"cluster", p.cfg.Cluster, &p.cluster},
+		{"subnet", p.cfg.Subnet, &p.subnet},
+		{"project", p.cfg.Project, &p.project},
+	} {
+		if x.name == "" {
+			continue
+		}
+		*x.ref, err = p.lookup(ctx, x.kind, x.name)
+		if err != nil {
+			return err
+		}
+	}
+
+	if p.cfg.StorageContainer != "" {
+		p.storageContainer, err = p.lookupStorageContainer(ctx, p.cfg.StorageContainer)
+		if err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
+func (p *Provisioner) authHeader() string {
+	return fmt.Sprintf("Basic %s", base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%s:%s", p.cfg.Username, p.cfg.Password))))
+}
+
+// request sends a JSON encoded body to the v3 API and decodes the response
+// into out, if it isn't nil
+func (p *Provisioner) request(ctx context.Context, method, path string, body interface{}, status int, out interface{}) error {
+
+	var data []byte
+	if body != nil {
+		var err error
+		data, err = json.Marshal(body)
+		if err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, fmt.Sprintf("https://%s/api/nutanix/v3/%s", p.cfg.Host, path), bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", p.authHeader())
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != status {
+		b, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("%s %s response was not ok: %s: %s", method, path, resp.Status, b)
+	}
+
+	if out == nil {
+		return nil
+	}
+
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// lookup finds the uuid of the entity of the given kind with a name that
+// exactly matches name
+func (p *Provisioner) lookup(ctx context.Context, kind, name string) (*reference, error) {
+
+	list := new(listEntitiesResponse)
+	err := p.request(ctx, http.MethodPost, kind+"s/list", map[string]interface{}{
+		"kind":   kind,
+		"filter": fmt.Sprintf("name==%s", name),
+		"length": 1000,
+	}, http.StatusOK, list)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, e := range list.Entities {
+		if e.Spec.Name == name || e.Status.Name == name {
+			return &reference{Kind: kind, UUID: e.Metadata.UUID}, nil
+		}
+	}
+
+	return nil, fmt.Errorf("%s '%s' not found", kind, name)
+}
+
+// lookupStorageContainer finds the uuid of a storage container using the
+// groups API, since storage containers have no v3 list endpoint
+func (p *Provisioner) lookupStorageContainer(ctx context.Context, name string) (*reference, error) {
+
+	groups := new(groupsResponse)
+	err := p.request(ctx, http.MethodPost, "groups", map[string]interface{}{
+		"entity_type": "storage_container",
+		"group_member_attributes": []map[string]string{
+			{"attribute": "container_name"},
+		},
+		"filter_criteria": fmt.Sprintf("container_name==%s", name),
+	}, http.StatusOK, groups)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, g := range groups.GroupResults {
+		for _, e := range g.EntityResults {
+			for _, d := range e.Data {
+				for _, v := range d.Values {
+					if d.Name == "container_name" && len(v.Values) > 0 && v.Values[0] == name {
+						return &reference{Kind: "storage_container", UUID: e.EntityID}, nil
+					}
+				}
+			}
+		}
+	}
+
+	return nil, fmt.Errorf("storage container '%s' not found", name)
+}
+
+// waitForImage polls the image until it has finished processing
+func (p *Provisioner) waitForImage(ctx context.Context, uuid string) error {
+
+	deadline := time.Now().Add(imageWaitTimeout)
+
+	for {
+		image := new(imageCreateResponse)
+		err := p.request(ctx, http.MethodGet, "images/"+uuid, nil, http.StatusOK, image)
+		if err != nil {
+			return err
+		}
+
+		switch image.Status.State {
+		case "COMPLETE":
+			return nil
+		case "ERROR":
+			return fmt.Errorf("image '%s' failed to process", uuid)
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out waiting for image '%s' to finish processing", uuid)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Second * 5):
+		}
+	}
+}
+
+// createTemplate creates a powered off VM from the image to act as a
+// template, with its disk in the storage container and a NIC on the subnet
+func (p *Provisioner) createTemplate(ctx context.Context, name, imageUUID string) error {
+
+	disk := map[string]interface{}{
+		"device_properties": map[string]interface{}{
+			"device_type": "DISK",
+			"disk_address": map[string]interface{}{
+				"adapter_type": "SCSI",
+				"device_index": 0,
+			},
+		},
+		"data_source_reference": &reference{Kind: "image", UUID: imageUUID},
+	}
+	if p.storageContainer != nil {
+		disk["storage_config"] = map[string]interface{}{
+			"storage_container_reference": p.storageContainer,
+		}
+	}
+
+	resources := map[string]interface{}{
+		"power_state":          "OFF",
+		"num_sockets":          templateSockets,
+		"num_vcpus_per_socket": templateVCPUs,
+		"memory_size_mib":      templateMemoryMiB,
+		"disk_list":            []interface{}{disk},
+	}
+	if p.subnet != nil {
+		resources["nic_list"] = []interface{}{
+			map[string]interface{}{"subnet_reference": p.subnet},
+		}
+	}
+
+	spec := map[string]interface{}{
+		"name":      name,
+		"resources": resources,
+	}
+	if p.cluster != nil {
+		spec["cluster_reference"] = p.cluster
+	}
+
+	return p.request(ctx, http.MethodPost, "vms", map[string]interface{}{
+		"spec":     spec,
+		"metadata": p.metadata("vm"),
+	}, http.StatusAccepted, nil)
+}
+
+func (p *Provisioner) metadata(kind string) map[string]interface{} {
+	m := map[string]interface{}{
+		"kind": kind,
+	}
+	if p.project != nil {
+		m["project_reference"] = p.project
+	}
+	return m
+}
+
 // Type returns 'nutanix'
 func (p *Provisioner) Type() string {
 	return ProvisionerType
@@ -99,17 +339,18 @@ func (p *Provisioner) SizeAlign() vcfg.Bytes {
 }
 
 // Provision given a valid ProvisionArgs object will provision the passed vorteil project
+//
 //	to the configured provisioner
 func (p *Provisioner) Provision(args *provisioners.ProvisionArgs) error {
 
-	authHeader := fmt.Sprintf("Basic %s", base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%s:%s", p.cfg.Username, p.cfg.Password))))
+	authHeader := p.authHeader()
 	if args.Description != "" {
 		p.log.Warnf(`The 'description' field is ignored by Nutanix provision operation`)
 	}
 
 	p.log.Infof("Checking for image name conflicts...")
 
-	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("https://%s/api/nutanix/v3/images/list", p.cfg.Host), strings.NewReader(fmt.Sprintf("{\n\t\"kind\":\"image\",\n\t\"length\":1000\n}")))
+	req, err := http.NewRequestWithContext(args.Context, http.MethodPost, fmt.Sprintf("https://%s/api/nutanix/v3/images/list", p.cfg.Host), strings.NewReader(fmt.Sprintf("{\n\t\"kind\":\"image\",\n\t\"length\":1000\n}")))
 	if err != nil {
 		return err
 	}
@@ -149,8 +390,25 @@ func (p *Provisioner) Provision(args *provisioners.ProvisionArgs) error {
 
 	p.log.Infof("Sending 'create image' request")
 
-	reqBody := fmt.Sprintf("{\n\t\"spec\": {\n\t\t\"name\": \"%s\",\n\t\t\"resources\": {\n\t\t\t\"image_type\": \"DISK_IMAGE\"\n\t\t}\n\t},\n\t\"metadata\": {\n\t\t\"kind\": \"image\"\n\t}\n}", args.Name)
-	req, err = http.NewRequest(http.MethodPost, fmt.Sprintf("https://%s/api/nutanix/v3/images", p.cfg.Host), strings.NewReader(reqBody))
+	resources := map[string]interface{}{
+		"image_type": "DISK_IMAGE",
+	}
+	if p.cluster != nil {
+		resources["initial_placement_ref_list"] = []*reference{p.cluster}
+	}
+
+	reqBody, err := json.Marshal(map[string]interface{}{
+		"spec": map[string]interface{}{
+			"name":      args.Name,
+			"resources": resources,
+		},
+		"metadata": p.metadata("image"),
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err = http.NewRequestWithContext(args.Context, http.MethodPost, fmt.Sprintf("https://%s/api/nutanix/v3/images", p.cfg.Host), bytes.NewReader(reqBody))
 	if err != nil {
 		return err
 	}
@@ -181,12 +439,16 @@ func (p *Provisioner) Provision(args *provisioners.ProvisionArgs) error {
 	}
 
 	// Ends up 404ing without a delay
-	time.Sleep(time.Second * 1)
+	select {
+	case <-args.Context.Done():
+		return args.Context.Err()
+	case <-time.After(time.Second * 1):
+	}
 
 	p.log.Infof("Uploading disk to image (uuid: '%s')", uuid)
 	pe := p.log.NewProgress("Uploading", "KiB", int64(args.Image.Size()))
 
-	req, err = http.NewRequest(http.MethodPut, fmt.Sprintf("https://%s/api/nutanix/v3/images/%s/file", p.cfg.Host, uuid), pe.ProxyReader(args.Image))
+	req, err = http.NewRequestWithContext(args.Context, http.MethodPut, fmt.Sprintf("https://%s/api/nutanix/v3/images/%s/file", p.cfg.Host, uuid), pe.ProxyReader(args.Image))
 	if err != nil {
 		return err
 	}
@@ -210,6 +472,21 @@ func (p *Provisioner) Provision(args *provisioners.ProvisionArgs) error {
 		}
 		return fmt.Errorf("%s", b)
 	}
+
+	if p.storageContainer != nil || p.subnet != nil {
+		p.log.Infof("Waiting for image to finish processing...")
+		err = p.waitForImage(args.Context, uuid)
+		if err != nil {
+			return err
+		}
+
+		p.log.Infof("Creating VM template '%s'", args.Name)
+		err = p.createTemplate(args.Context, args.Name, uuid)
+		if err != nil {
+			return err
+		}
+	}
+
 	p.log.Infof("Done!")
 	return nil
 }
@@ -221,6 +498,10 @@ func (p *Provisioner) Marshal() ([]byte, error) {
 	m["username"] = p.cfg.Username
 	m["password"] = p.cfg.Password
 	m["host"] = p.cfg.Host
+	m["cluster"] = p.cfg.Cluster
+	m["storage-container"] = p.cfg.StorageContainer
+	m["subnet"] = p.cfg.Subnet
+	m["project"] = p.cfg.Project
 
 	out, err := json.Marshal(m)
 	if err != nil {
@@ -257,6 +538,34 @@ type imageCreateResponse struct {
 	} `json:"metadata"`
 }
 
+type listEntitiesResponse struct {
+	Entities []struct {
+		Status struct {
+			Name string `json:"name"`
+		} `json:"status"`
+		Spec struct {
+			Name string `json:"name"`
+		} `json:"spec"`
+		Metadata struct {
+			UUID string `json:"uuid"`
+		} `json:"metadata"`
+	} `json:"entities"`
+}
+
+type groupsResponse struct {
+	GroupResults []struct {
+		EntityResults []struct {
+			EntityID string `json:"entity_id"`
+			Data     []struct {
+				Name   string `json:"name"`
+				Values []struct {
+					Values []string `json:"values"`
+				} `json:"values"`
+			} `json:"data"`
+		} `json:"entity_results"`
+	} `json:"group_results"`
+}
+
 type listImagesResponse struct {
 	APIVersion string `json:"api_version"`
 	Metadata   struct {
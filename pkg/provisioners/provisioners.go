@@ -15,6 +15,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"strconv"
 
 	"github.com/vorteil/vorteil/pkg/vcfg"
 	"github.com/vorteil/vorteil/pkg/vdisk"
@@ -42,6 +43,92 @@ type ProvisionArgs struct {
 	ReadyWhenUsable bool
 	Context         context.Context
 	Image           vio.File
+
+	// OpenImage, if set, returns a new copy of Image so that failed uploads
+	// can be retried from the beginning.
+	OpenImage func() (vio.File, error)
+
+	// Token is an idempotency token derived from the image digest (see
+	// Token). Provisioners record it on the images they create so that
+	// re-running a failed provision can recognise finished work instead of
+	// creating duplicates or failing on a name collision.
+	Token string
+
+	// Retry controls how failed platform operations are retried. If nil,
+	// DefaultRetryPolicy is used.
+	Retry *RetryPolicy
+}
+
+// Streamer is implemented by provisioners that can upload an image while it
+// is still being built. Their Provision reads Image from start to finish
+// without relying on its Size, which is zero until the build has finished,
+// and copes with an empty Token, since the digest isn't known in advance.
+type Streamer interface {
+	Streams() bool
+}
+
+// Launcher is implemented by provisioners that can start an instance from an
+// image they have provisioned.
+type Launcher interface {
+	Launch(args *LaunchArgs) (*Instance, error)
+}
+
+// LaunchArgs ...
+type LaunchArgs struct {
+	Name        string // name of the provisioned image, also used for the instance
+	MachineType string // platform specific instance type, e.g. "t3.micro"
+	Ports       []Port // ports to open to the internet
+	Context     context.Context
+}
+
+// Port is a port that should be reachable on a launched instance.
+type Port struct {
+	Protocol string // "tcp" or "udp"
+	Port     int
+}
+
+// Instance describes a launched instance.
+type Instance struct {
+	ID string
+	IP string
+}
+
+// Ports returns the ports exposed by the network interfaces in cfg. HTTP and
+// HTTPS ports are returned as TCP ports.
+func Ports(cfg *vcfg.VCFG) ([]Port, error) {
+
+	var ports []Port
+	seen := make(map[Port]bool)
+
+	for _, nic := range cfg.Networks {
+		protocols := []struct {
+			name  string
+			ports []string
+		}{
+			{"tcp", nic.TCP},
+			{"tcp", nic.HTTP},
+			{"tcp", nic.HTTPS},
+			{"udp", nic.UDP},
+		}
+
+		for _, protocol := range protocols {
+			for _, s := range protocol.ports {
+				n, err := strconv.Atoi(s)
+				if err != nil || n <= 0 || n > 65535 {
+					return nil, fmt.Errorf("invalid %s port '%s'", protocol.name, s)
+				}
+
+				port := Port{Protocol: protocol.name, Port: n}
+				if !seen[port] {
+					seen[port] = true
+					ports = append(ports, port)
+				}
+			}
+		}
+	}
+
+	return ports, nil
+
 }
 
 type InvalidProvisionerError struct {
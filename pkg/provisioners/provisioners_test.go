@@ -0,0 +1,52 @@
+package provisioners
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/vorteil/vorteil/pkg/vcfg"
+)
+
+func TestPorts(t *testing.T) {
+
+	cfg := &vcfg.VCFG{
+		Networks: []vcfg.NetworkInterface{
+			{
+				HTTP:  []string{"80"},
+				HTTPS: []string{"443"},
+				TCP:   []string{"80", "22"},
+			},
+			{
+				UDP: []string{"53"},
+			},
+		},
+	}
+
+	ports, err := Ports(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []Port{
+		{Protocol: "tcp", Port: 80},
+		{Protocol: "tcp", Port: 22},
+		{Protocol: "tcp", Port: 443},
+		{Protocol: "udp", Port: 53},
+	}
+
+	if !reflect.DeepEqual(ports, expected) {
+		t.Errorf("expected %v, got %v", expected, ports)
+	}
+
+	cfg.Networks[1].UDP = []string{"dns"}
+	_, err = Ports(cfg)
+	if err == nil {
+		t.Errorf("expected an error for an invalid port")
+	}
+
+}
@@ -0,0 +1,172 @@
+package provisioners
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/vorteil/vorteil/pkg/elog"
+	"github.com/vorteil/vorteil/pkg/vio"
+)
+
+// TokenTag is the tag (or label) provisioners attach to the images they
+// create to record the idempotency token of the disk image they came from.
+const TokenTag = "vorteil-token"
+
+// RetryPolicy controls how provisioners retry platform operations that fail.
+type RetryPolicy struct {
+	Attempts int           // total number of attempts, including the first
+	Delay    time.Duration // delay before the first retry
+	MaxDelay time.Duration // upper limit for the doubling delay
+}
+
+// DefaultRetryPolicy is used when ProvisionArgs doesn't specify a policy.
+var DefaultRetryPolicy = RetryPolicy{
+	Attempts: 3,
+	Delay:    time.Second * 5,
+	MaxDelay: time.Minute,
+}
+
+// PermanentError wraps an error that retrying won't fix, such as a name
+// collision, so that Retry gives up immediately.
+type PermanentError struct {
+	Err error
+}
+
+func (e *PermanentError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *PermanentError) Unwrap() error {
+	return e.Err
+}
+
+// Permanent marks err as an error that shouldn't be retried.
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &PermanentError{Err: err}
+}
+
+// Token returns an idempotency token derived from the digest of the image
+// read from r. The token is short and lowercase enough to be used as a tag
+// or label value on all supported platforms.
+func Token(r io.Reader) (string, error) {
+
+	h := sha256.New()
+	_, err := io.Copy(h, r)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil))[:32], nil
+
+}
+
+// RetryPolicy returns the policy provisioners should use for args.
+func (args *ProvisionArgs) RetryPolicy() RetryPolicy {
+
+	policy := DefaultRetryPolicy
+	if args.Retry != nil {
+		policy = *args.Retry
+	}
+
+	if policy.Attempts < 1 {
+		policy.Attempts = 1
+	}
+
+	return policy
+
+}
+
+// Retry calls fn until it succeeds, returns a PermanentError, or the attempts
+// allowed by the policy in args are used up. The delay between attempts
+// doubles each time, and nothing is retried once args.Context is done.
+func Retry(args *ProvisionArgs, log elog.View, what string, fn func() error) error {
+
+	policy := args.RetryPolicy()
+	delay := policy.Delay
+
+	var err error
+	for attempt := 1; ; attempt++ {
+		err = fn()
+		if err == nil {
+			return nil
+		}
+
+		var perr *PermanentError
+		if errors.As(err, &perr) {
+			return perr.Err
+		}
+
+		if args.Context != nil && args.Context.Err() != nil {
+			return err
+		}
+
+		if attempt >= policy.Attempts {
+			break
+		}
+
+		log.Warnf("%s failed (attempt %d of %d), retrying in %v: %v", what, attempt, policy.Attempts, delay, err)
+
+		if args.Context != nil {
+			select {
+			case <-args.Context.Done():
+				return args.Context.Err()
+			case <-time.After(delay):
+			}
+		} else {
+			time.Sleep(delay)
+		}
+
+		delay *= 2
+		if policy.MaxDelay > 0 && delay > policy.MaxDelay {
+			delay = policy.MaxDelay
+		}
+	}
+
+	if policy.Attempts > 1 {
+		return fmt.Errorf("%s failed after %d attempts: %w", what, policy.Attempts, err)
+	}
+
+	return err
+
+}
+
+// RetryUpload is like Retry, but passes fn a fresh copy of the image on every
+// attempt so that uploads always start from the beginning. If args.OpenImage
+// is nil, args.Image can only be read once and the upload isn't retried.
+func RetryUpload(args *ProvisionArgs, log elog.View, what string, fn func(image vio.File) error) error {
+
+	if args.OpenImage == nil {
+		return fn(args.Image)
+	}
+
+	first := true
+	return Retry(args, log, what, func() error {
+
+		image := args.Image
+		if !first {
+			var err error
+			image, err = args.OpenImage()
+			if err != nil {
+				return Permanent(err)
+			}
+			defer image.Close()
+		}
+		first = false
+
+		return fn(image)
+
+	})
+
+}
@@ -0,0 +1,93 @@
+package provisioners
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vorteil/vorteil/pkg/elog"
+)
+
+func TestRetry(t *testing.T) {
+
+	log := &elog.CLI{}
+	args := &ProvisionArgs{
+		Context: context.Background(),
+		Retry:   &RetryPolicy{Attempts: 3, Delay: time.Millisecond},
+	}
+
+	var calls int
+	err := Retry(args, log, "test", func() error {
+		calls++
+		if calls < 3 {
+			return errors.New("transient")
+		}
+		return nil
+	})
+	if err != nil || calls != 3 {
+		t.Errorf("expected success on the third attempt, got %v after %d attempts", err, calls)
+	}
+
+	calls = 0
+	err = Retry(args, log, "test", func() error {
+		calls++
+		return errors.New("transient")
+	})
+	if err == nil || calls != 3 {
+		t.Errorf("expected failure after 3 attempts, got %v after %d attempts", err, calls)
+	}
+
+	calls = 0
+	permanent := errors.New("permanent")
+	err = Retry(args, log, "test", func() error {
+		calls++
+		return Permanent(permanent)
+	})
+	if err != permanent || calls != 1 {
+		t.Errorf("expected permanent error to stop retries, got %v after %d attempts", err, calls)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	args.Context = ctx
+
+	calls = 0
+	err = Retry(args, log, "test", func() error {
+		calls++
+		cancel()
+		return ctx.Err()
+	})
+	if err != context.Canceled || calls != 1 {
+		t.Errorf("expected cancellation to stop retries, got %v after %d attempts", err, calls)
+	}
+
+}
+
+func TestToken(t *testing.T) {
+
+	a, err := Token(strings.NewReader("disk image"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := Token(strings.NewReader("disk image"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := Token(strings.NewReader("other disk image"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if a != b || a == c || len(a) != 32 || strings.ToLower(a) != a {
+		t.Errorf("unexpected tokens: %s, %s, %s", a, b, c)
+	}
+
+}
@@ -22,6 +22,10 @@ var (
 	provisionersNewVCenterDatastore  string
 	provisionersNewVCenterCluster    string
 	provisionersNewVCenterNotes      string
+
+	provisionersNewVCenterFolder       string
+	provisionersNewVCenterResourcePool string
+	provisionersNewVCenterTemplate     bool
 )
 
 var log elog.View
@@ -41,13 +45,16 @@ var ProvisionersNewVCenterCmd = &cobra.Command{
 		}
 		defer f.Close()
 		p, err := NewProvisioner(log, &Config{
-			Username:   provisionersNewVCenterUsername,
-			Password:   provisionersNewVCenterPassword,
-			Address:    provisionersNewVCenterAddress,
-			Datacenter: provisionersNewVCenterDatacenter,
-			Datastore:  provisionersNewVCenterDatastore,
-			Cluster:    provisionersNewVCenterCluster,
-			Notes:      provisionersNewVCenterNotes,
+			Username:     provisionersNewVCenterUsername,
+			Password:     provisionersNewVCenterPassword,
+			Address:      provisionersNewVCenterAddress,
+			Datacenter:   provisionersNewVCenterDatacenter,
+			Datastore:    provisionersNewVCenterDatastore,
+			Cluster:      provisionersNewVCenterCluster,
+			Notes:        provisionersNewVCenterNotes,
+			Folder:       provisionersNewVCenterFolder,
+			ResourcePool: provisionersNewVCenterResourcePool,
+			Template:     &provisionersNewVCenterTemplate,
 		})
 		if err != nil {
 			cli.SetError(err, 4)
@@ -82,4 +89,7 @@ func init() {
 	ProvisionersNewVCenterCmd.MarkFlagRequired("username")
 	f.StringVarP(&provisionersNewVCenterPassword, "password", "p", "", "VMWare password (required)")
 	ProvisionersNewVCenterCmd.MarkFlagRequired("password")
+	f.StringVar(&provisionersNewVCenterFolder, "folder", "", "VM folder to place the virtual machine in, relative to the datacenter's VM folder")
+	f.StringVar(&provisionersNewVCenterResourcePool, "resource-pool", "", "Resource pool to place the virtual machine in, relative to the host cluster's root resource pool")
+	f.BoolVar(&provisionersNewVCenterTemplate, "template", true, "Convert the virtual machine to a template after upload")
 }
@@ -9,6 +9,7 @@ import (
 	"fmt"
 	"io"
 	"net/url"
+	"path"
 	"strings"
 
 	"github.com/vmware/govmomi"
@@ -43,15 +44,40 @@ type Provisioner struct {
 	args         provisioners.ProvisionArgs
 }
 
-// Config contains configuration fields required by the Provisioner
+// Config contains configuration fields required by the Provisioner. Folder
+// is an inventory path relative to the datacenter's VM folder, and
+// ResourcePool is a path relative to the cluster's root resource pool. Either
+// may be an absolute inventory path instead. If Template is unset the VM is
+// converted to a template after upload.
 type Config struct {
-	Username   string `json:"username"`
-	Password   string `json:"password"`
-	Address    string `json:"address"`
-	Datacenter string `json:"datacenter"`
-	Datastore  string `json:"datastore"`
-	Cluster    string `json:"cluster"`
-	Notes      string `json:"notes"`
+	Username     string `json:"username"`
+	Password     string `json:"password"`
+	Address      string `json:"address"`
+	Datacenter   string `json:"datacenter"`
+	Datastore    string `json:"datastore"`
+	Cluster      string `json:"cluster"`
+	Notes        string `json:"notes"`
+	Folder       string `json:"folder,omitempty"`
+	ResourcePool string `json:"resource-pool,omitempty"`
+	Template     *bool  `json:"template,omitempty"`
+}
+
+func (cfg *Config) folderPath() string {
+	if strings.HasPrefix(cfg.Folder, "/") {
+		return cfg.Folder
+	}
+	return path.Join("/", cfg.Datacenter, "vm", cfg.Folder)
+}
+
+func (cfg *Config) resourcePoolPath() string {
+	if strings.HasPrefix(cfg.ResourcePool, "/") {
+		return cfg.ResourcePool
+	}
+	return path.Join("/", cfg.Datacenter, "host", cfg.Cluster, "Resources", cfg.ResourcePool)
+}
+
+func (cfg *Config) markAsTemplate() bool {
+	return cfg.Template == nil || *cfg.Template
 }
 
 // NewProvisioner - Create a VCenter Provisioner object
@@ -94,14 +120,12 @@ func (p *Provisioner) Validate() error {
 		return err
 	}
 
-	path := "/" + p.cfg.Datacenter + "/host/" + p.cfg.Cluster + "/Resources"
-	_, err = finder.ResourcePoolOrDefault(ctx, path)
+	_, err = finder.ResourcePoolOrDefault(ctx, p.cfg.resourcePoolPath())
 	if err != nil {
 		return err
 	}
 
-	path = "/" + p.cfg.Datacenter + "/vm"
-	_, err = finder.FolderOrDefault(ctx, path)
+	_, err = finder.FolderOrDefault(ctx, p.cfg.folderPath())
 	return err
 }
 
@@ -133,14 +157,12 @@ func (p *Provisioner) init() error {
 		return err
 	}
 
-	path := "/" + p.cfg.Datacenter + "/host/" + p.cfg.Cluster + "/Resources"
-	p.resourcepool, err = p.finder.ResourcePoolOrDefault(ctx, path)
+	p.resourcepool, err = p.finder.ResourcePoolOrDefault(ctx, p.cfg.resourcePoolPath())
 	if err != nil {
 		return err
 	}
 
-	path = "/" + p.cfg.Datacenter + "/vm"
-	p.folder, err = p.finder.FolderOrDefault(ctx, path)
+	p.folder, err = p.finder.FolderOrDefault(ctx, p.cfg.folderPath())
 	return err
 }
 
@@ -172,7 +194,7 @@ func (p *Provisioner) Provision(args *provisioners.ProvisionArgs) error {
 
 	// check for conflicts
 	var vm *object.VirtualMachine
-	vm, err = p.finder.VirtualMachine(args.Context, args.Name)
+	vm, err = p.finder.VirtualMachine(args.Context, path.Join(p.folder.InventoryPath, args.Name))
 	if err == nil {
 		// no error returned means a vm with that name exists already
 		if args.Force {
@@ -259,7 +281,7 @@ func (p *Provisioner) Provision(args *provisioners.ProvisionArgs) error {
 	}
 
 	p.log.Infof("Waiting on lease...")
-	info, err := lease.Wait(context.Background(), importSpec.FileItem)
+	info, err := lease.Wait(args.Context, importSpec.FileItem)
 	if err != nil {
 		if err.Error() == fmt.Sprintf("The name '%s' already exists.", args.Name) {
 			return err
@@ -285,7 +307,7 @@ func (p *Provisioner) Provision(args *provisioners.ProvisionArgs) error {
 	}
 
 	p.log.Printf("Getting virtual machine reference...")
-	v, err := p.finder.VirtualMachine(args.Context, args.Name)
+	v, err := p.finder.VirtualMachine(args.Context, path.Join(p.folder.InventoryPath, args.Name))
 	if err != nil {
 		return err
 	}
@@ -295,8 +317,13 @@ func (p *Provisioner) Provision(args *provisioners.ProvisionArgs) error {
 		return err
 	}
 
-	p.log.Printf("Marking as virtual machine template...")
-	v.MarkAsTemplate(args.Context)
+	if p.cfg.markAsTemplate() {
+		p.log.Printf("Marking as virtual machine template...")
+		err = v.MarkAsTemplate(args.Context)
+		if err != nil {
+			return err
+		}
+	}
 
 	p.log.Printf("Provisioned: %s", args.Name)
 	return nil
@@ -313,6 +340,9 @@ func (p *Provisioner) Marshal() ([]byte, error) {
 	m["datastore"] = p.cfg.Datastore
 	m["cluster"] = p.cfg.Cluster
 	m["notes"] = p.cfg.Notes
+	m["folder"] = p.cfg.Folder
+	m["resource-pool"] = p.cfg.ResourcePool
+	m["template"] = p.cfg.markAsTemplate()
 
 	out, err := json.Marshal(m)
 	if err != nil {
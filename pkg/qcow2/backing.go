@@ -0,0 +1,329 @@
+package qcow2
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	magic = 0x514649FB
+
+	// header extension types
+	extensionEnd           = 0x00000000
+	extensionBackingFormat = 0xE2792ACA
+
+	// the longest backing file name qemu accepts
+	maxBackingFileName = 1023
+
+	flagZero = 1
+)
+
+// Backing is a disk image that a qcow2 image refers to for the contents of
+// clusters it doesn't contain itself. It can be a raw image or another qcow2
+// image, which may have a backing file of its own.
+type Backing struct {
+	f      *os.File
+	path   string
+	format string
+	size   int64
+
+	// qcow2 backing images only
+	hdr         *Header
+	clusterSize int64
+	l1          []uint64
+	backing     *Backing
+	buf         []byte
+}
+
+// OpenBacking opens the image at path to be used as a backing file. Images
+// that start with the qcow2 magic are read as qcow2 images, and everything
+// else is read as a raw image.
+func OpenBacking(path string) (*Backing, error) {
+
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(abs)
+	if err != nil {
+		return nil, err
+	}
+
+	b := &Backing{
+		f:      f,
+		path:   abs,
+		format: "raw",
+	}
+
+	err = b.load()
+	if err != nil {
+		b.Close()
+		return nil, fmt.Errorf("bad qcow2 backing file '%s': %v", path, err)
+	}
+
+	return b, nil
+
+}
+
+func (b *Backing) load() error {
+
+	info, err := b.f.Stat()
+	if err != nil {
+		return err
+	}
+	b.size = info.Size()
+
+	hdr := new(Header)
+	err = binary.Read(b.f, binary.BigEndian, hdr)
+	if err != nil || hdr.Magic != magic {
+		// anything that isn't qcow2 is a raw image
+		return nil
+	}
+
+	b.format = "qcow2"
+	b.hdr = hdr
+	b.size = int64(hdr.Size)
+
+	if hdr.Version > 3 || hdr.CryptMethod != 0 {
+		return errors.New("unsupported qcow2 version or encryption")
+	}
+
+	if hdr.Version < 3 {
+		hdr.IncompatibleFeatures = 0
+		hdr.CompressionType = 0
+	}
+
+	if hdr.IncompatibleFeatures&^incompatCompressionType != 0 {
+		return fmt.Errorf("unsupported qcow2 features (%#x)", hdr.IncompatibleFeatures)
+	}
+
+	if hdr.ClusterBits < 9 || hdr.ClusterBits > 21 {
+		return fmt.Errorf("invalid qcow2 cluster bits (%d)", hdr.ClusterBits)
+	}
+
+	b.clusterSize = int64(1) << hdr.ClusterBits
+	b.buf = make([]byte, b.clusterSize)
+	b.l1 = make([]uint64, hdr.L1Size)
+
+	err = binary.Read(io.NewSectionReader(b.f, int64(hdr.L1TableOffset), 8*int64(hdr.L1Size)), binary.BigEndian, b.l1)
+	if err != nil {
+		return err
+	}
+
+	if hdr.BackingFileOffset != 0 {
+		name := make([]byte, hdr.BackingFileSize)
+		_, err = b.f.ReadAt(name, int64(hdr.BackingFileOffset))
+		if err != nil {
+			return err
+		}
+
+		path := string(name)
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(filepath.Dir(b.path), path)
+		}
+
+		b.backing, err = OpenBacking(path)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+
+}
+
+// Format returns the backing image's format as qemu names it: "raw" or
+// "qcow2".
+func (b *Backing) Format() string {
+	return b.format
+}
+
+// Size returns the virtual size of the backing image.
+func (b *Backing) Size() int64 {
+	return b.size
+}
+
+// Close closes the backing image, and any backing images of its own.
+func (b *Backing) Close() error {
+
+	if b.backing != nil {
+		_ = b.backing.Close()
+	}
+
+	return b.f.Close()
+
+}
+
+// ReadAt implements io.ReaderAt, reading the backing image's virtual
+// contents. Anything beyond the end of the image reads as zeroes, the same
+// way qemu treats a backing file smaller than the image that refers to it.
+func (b *Backing) ReadAt(p []byte, off int64) (int, error) {
+
+	var n int
+
+	for len(p) > 0 {
+		if off >= b.size {
+			for i := range p {
+				p[i] = 0
+			}
+			return n + len(p), nil
+		}
+
+		k := int64(len(p))
+		if off+k > b.size {
+			k = b.size - off
+		}
+
+		var err error
+		if b.hdr == nil {
+			_, err = b.f.ReadAt(p[:k], off)
+		} else {
+			k, err = b.readCluster(p[:k], off)
+		}
+		if err != nil {
+			return n, err
+		}
+
+		n += int(k)
+		off += k
+		p = p[k:]
+	}
+
+	return n, nil
+
+}
+
+// readCluster reads as much of p as falls within the cluster containing off.
+func (b *Backing) readCluster(p []byte, off int64) (int64, error) {
+
+	cluster := off / b.clusterSize
+	delta := off % b.clusterSize
+	k := b.clusterSize - delta
+	if k > int64(len(p)) {
+		k = int64(len(p))
+	}
+	p = p[:k]
+
+	mask := uint64(1)<<62 - 1
+	entriesPerL2 := b.clusterSize / 8
+
+	var entry uint64
+	if l1 := cluster / entriesPerL2; l1 < int64(len(b.l1)) && b.l1[l1]&mask != 0 {
+		err := binary.Read(io.NewSectionReader(b.f, int64(b.l1[l1]&mask&^0x1FF)+8*(cluster%entriesPerL2), 8), binary.BigEndian, &entry)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	switch {
+	case entry&flagCompressed != 0:
+		err := b.readCompressed(entry)
+		if err != nil {
+			return 0, err
+		}
+		copy(p, b.buf[delta:])
+	case entry&flagZero != 0:
+		for i := range p {
+			p[i] = 0
+		}
+	case entry&mask&^0x1FF != 0:
+		_, err := b.f.ReadAt(p, int64(entry&mask&^0x1FF)+delta)
+		if err != nil {
+			return 0, err
+		}
+	case b.backing != nil:
+		_, err := b.backing.ReadAt(p, off)
+		if err != nil {
+			return 0, err
+		}
+	default:
+		for i := range p {
+			p[i] = 0
+		}
+	}
+
+	return k, nil
+
+}
+
+// readCompressed decompresses the cluster described by entry into b.buf.
+func (b *Backing) readCompressed(entry uint64) error {
+
+	shift := 62 - (b.hdr.ClusterBits - 8)
+	host := int64(entry & (1<<shift - 1))
+	sectors := int64(entry&(1<<62-1)) >> shift
+	length := (host/SectorSize+sectors+1)*SectorSize - host
+
+	var r io.Reader = io.NewSectionReader(b.f, host, length)
+	if b.hdr.CompressionType == compressionTypeZstd {
+		dec, err := zstd.NewReader(r)
+		if err != nil {
+			return err
+		}
+		defer dec.Close()
+		r = dec
+	} else {
+		r = flate.NewReader(r)
+	}
+
+	_, err := io.ReadFull(r, b.buf)
+	if err != nil {
+		return err
+	}
+
+	return nil
+
+}
+
+// matches returns true if the backing image has the same contents as p at
+// off, so that a cluster containing p can be left out of the image.
+func (b *Backing) matches(p []byte, off int64, scratch []byte) (bool, error) {
+
+	_, err := b.ReadAt(scratch[:len(p)], off)
+	if err != nil {
+		return false, err
+	}
+
+	return bytes.Equal(p, scratch[:len(p)]), nil
+
+}
+
+// backingFileHeader returns the header extensions and backing file name that
+// follow a header of length bytes, and the offset of the name.
+func backingFileHeader(length int64, name, format string) ([]byte, int64, error) {
+
+	if len(name) > maxBackingFileName {
+		return nil, 0, fmt.Errorf("qcow2 backing file name is too long (%d bytes)", len(name))
+	}
+
+	buf := new(bytes.Buffer)
+
+	data := make([]byte, (len(format)+7)/8*8)
+	copy(data, format)
+
+	err := binary.Write(buf, binary.BigEndian, []uint32{extensionBackingFormat, uint32(len(format))})
+	if err != nil {
+		return nil, 0, err
+	}
+	buf.Write(data)
+
+	err = binary.Write(buf, binary.BigEndian, []uint32{extensionEnd, 0})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	offset := length + int64(buf.Len())
+	buf.WriteString(name)
+
+	return buf.Bytes(), offset, nil
+
+}
@@ -0,0 +1,146 @@
+package qcow2
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression identifies the algorithm used to compress data clusters.
+type Compression int
+
+const (
+	CompressionNone Compression = iota
+	CompressionZlib
+	CompressionZstd
+)
+
+var compressionNames = map[Compression]string{
+	CompressionNone: "none",
+	CompressionZlib: "zlib",
+	CompressionZstd: "zstd",
+}
+
+func (c Compression) String() string {
+	return compressionNames[c]
+}
+
+// ParseCompression resolves a string into a Compression. An empty string is
+// treated as "none".
+func ParseCompression(s string) (Compression, error) {
+
+	s = strings.ToLower(strings.TrimSpace(s))
+	if s == "" {
+		return CompressionNone, nil
+	}
+
+	for c, name := range compressionNames {
+		if s == name {
+			return c, nil
+		}
+	}
+
+	return CompressionNone, fmt.Errorf("unrecognized qcow2 compression '%s' -- try one of these: none, zlib, zstd", s)
+}
+
+// zlibWindowSize is the largest window qemu will use to inflate a compressed
+// cluster. Go's deflate implementation always uses a 32 KiB window, so each
+// chunk of this size is deflated without any history and flushed, keeping
+// every back-reference within range.
+const zlibWindowSize = 0x1000
+
+type compressor interface {
+	compress(p []byte) ([]byte, error)
+}
+
+type zlibCompressor struct {
+	buf *bytes.Buffer
+	fw  *flate.Writer
+}
+
+func newZlibCompressor() (*zlibCompressor, error) {
+
+	buf := new(bytes.Buffer)
+	fw, err := flate.NewWriter(buf, flate.DefaultCompression)
+	if err != nil {
+		return nil, err
+	}
+
+	return &zlibCompressor{
+		buf: buf,
+		fw:  fw,
+	}, nil
+
+}
+
+func (c *zlibCompressor) compress(p []byte) ([]byte, error) {
+
+	c.buf.Reset()
+
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > zlibWindowSize {
+			chunk = chunk[:zlibWindowSize]
+		}
+
+		c.fw.Reset(c.buf)
+		_, err := c.fw.Write(chunk)
+		if err != nil {
+			return nil, err
+		}
+
+		err = c.fw.Flush()
+		if err != nil {
+			return nil, err
+		}
+
+		p = p[len(chunk):]
+	}
+
+	// terminate the stream with an empty final block
+	c.fw.Reset(c.buf)
+	err := c.fw.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return c.buf.Bytes(), nil
+
+}
+
+type zstdCompressor struct {
+	buf []byte
+	enc *zstd.Encoder
+}
+
+func newZstdCompressor() (*zstdCompressor, error) {
+
+	enc, err := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+	if err != nil {
+		return nil, err
+	}
+
+	return &zstdCompressor{
+		enc: enc,
+	}, nil
+
+}
+
+func (c *zstdCompressor) compress(p []byte) ([]byte, error) {
+	c.buf = c.enc.EncodeAll(p, c.buf[:0])
+	return c.buf, nil
+}
+
+func newCompressor(c Compression) (compressor, error) {
+	switch c {
+	case CompressionZlib:
+		return newZlibCompressor()
+	case CompressionZstd:
+		return newZstdCompressor()
+	default:
+		return nil, fmt.Errorf("unsupported qcow2 compression '%s'", c)
+	}
+}
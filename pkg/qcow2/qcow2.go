@@ -3,23 +3,65 @@ package qcow2
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"io"
+	"path/filepath"
+
+	"github.com/vorteil/vorteil/pkg/elog"
 )
 
 const (
 	SectorSize = 0x200
 )
 
+const (
+	flagCopied     = 1 << 63
+	flagCompressed = 1 << 62
+
+	incompatCompressionType = 1 << 3
+	compressionTypeZstd     = 1
+)
+
 type HolePredictor interface {
 	Size() int64
 	RegionIsHole(begin, size int64) bool
 }
 
+// Writer converts a raw disk image into a qcow2 image as it is written, without
+// the need for a temporary file. All metadata is calculated up front using the
+// HolePredictor, and clusters predicted to be holes are left out of the image
+// entirely.
+//
+// If compression is enabled clusters are compressed and packed one after the
+// other as they are written, and the L2 tables and refcounts are written when
+// the Writer is closed. A compressing Writer cannot revisit a cluster once it
+// has moved past it.
+//
+// If a backing file is given the image only contains the clusters that differ
+// from it, and the rest are read from the backing file. Clusters are compared
+// and packed as they are written, in the same way as compressed clusters, so
+// the same restriction applies.
 type Writer struct {
-	w io.WriteSeeker
-	h HolePredictor
-
-	cursor int64
+	w   io.WriteSeeker
+	h   HolePredictor
+	log elog.Logger
+
+	header      *Header
+	backing     *Backing
+	backingName string
+	scratch     []byte
+
+	cursor      int64
+	seekPending bool
+
+	compression   Compression
+	compressor    compressor
+	buffer        []byte
+	bufferCluster int64
+	nextCluster   int64
+	hostCursor    int64
+	l2            []uint64
+	refcounts     []uint16
 
 	totalDataSectors      int64
 	totalDataClusters     int64
@@ -36,15 +78,61 @@ type Writer struct {
 	refcountTableClusters int64
 }
 
+// Options contains optional settings for a Writer. Backing is the path of a
+// raw or qcow2 image to use as the image's backing file. It is recorded in the
+// image relative to the image if the Writer is writing to a file, since that's
+// how qemu resolves relative backing file names, or as an absolute path
+// otherwise.
+type Options struct {
+	Compression Compression
+	Backing     string
+}
+
 func NewWriter(w io.WriteSeeker, h HolePredictor) (*Writer, error) {
+	return NewWriterWithOptions(w, h, &Options{})
+}
+
+func NewWriterWithOptions(w io.WriteSeeker, h HolePredictor, opts *Options) (*Writer, error) {
 
 	x := &Writer{
-		w: w,
-		h: h,
+		w:             w,
+		h:             h,
+		compression:   opts.Compression,
+		bufferCluster: -1,
+	}
+
+	if x.compression != CompressionNone {
+		var err error
+		x.compressor, err = newCompressor(x.compression)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.Backing != "" {
+		var err error
+		x.backing, err = OpenBacking(opts.Backing)
+		if err != nil {
+			return nil, err
+		}
+
+		x.backingName = x.backing.path
+		if f, ok := w.(interface{ Name() string }); ok {
+			dir, err := filepath.Abs(filepath.Dir(f.Name()))
+			if err == nil {
+				rel, err := filepath.Rel(dir, x.backing.path)
+				if err == nil {
+					x.backingName = filepath.ToSlash(rel)
+				}
+			}
+		}
 	}
 
 	err := x.init()
 	if err != nil {
+		if x.backing != nil {
+			_ = x.backing.Close()
+		}
 		return nil, err
 	}
 
@@ -52,6 +140,12 @@ func NewWriter(w io.WriteSeeker, h HolePredictor) (*Writer, error) {
 
 }
 
+// dynamic returns true if clusters are allocated as they are written, rather
+// than up front using the HolePredictor.
+func (w *Writer) dynamic() bool {
+	return w.compression != CompressionNone || w.backing != nil
+}
+
 func divide(x, y int64) int64 {
 	return (x + y - 1) / y
 }
@@ -71,11 +165,18 @@ func (w *Writer) init() error {
 	w.refcountBlocks = divide(w.totalDataClusters, w.clusterSize/2)
 	w.refcountTableClusters = divide(w.refcountBlocks, w.clusterSize/8)
 
+	// NOTE: packed compressed clusters can straddle one more host cluster
+	// than the data would otherwise occupy.
+	var slack int64
+	if w.compression != CompressionNone {
+		slack = 1
+	}
+
 	// NOTE: I think refcounts refer to the host file including metadata, so this is an attempt to include that.
 	w.metadataClusters = 1 + w.l1Size + w.l2Blocks + w.refcountBlocks + w.refcountTableClusters
 	for {
 		before := w.metadataClusters
-		w.refcountBlocks = divide(w.totalDataClusters+w.metadataClusters, w.clusterSize/2)
+		w.refcountBlocks = divide(w.totalDataClusters+w.metadataClusters+slack, w.clusterSize/2)
 		w.refcountTableClusters = divide(w.refcountBlocks, w.clusterSize/8)
 		w.metadataClusters = 1 + w.l1Size + w.l2Blocks + w.refcountBlocks + w.refcountTableClusters
 		if w.metadataClusters == before {
@@ -132,12 +233,14 @@ type Header struct {
 	AutoclearFeatures     uint64 //   [88:95] for version >= 3: Bitmask of auto-clear feature
 	RefcountOrder         uint32 //   [96:99] for version >= 3: Describes the width of a reference count block entry
 	HeaderLength          uint32 // [100:103] for version >= 3: Length of the header structure in bytes
+	CompressionType       uint8  //     [104] for version >= 3: Compression method used for compressed clusters
+	_                     [7]byte
 }
 
 func (w *Writer) writeHeader() error {
 
 	hdr := &Header{
-		Magic:                 0x514649FB,
+		Magic:                 magic,
 		Version:               2,
 		ClusterBits:           16, // Number of trailing zeroes on the w.clusterSize in binary (sys.Ctz)
 		Size:                  uint64(w.h.Size()),
@@ -148,11 +251,56 @@ func (w *Writer) writeHeader() error {
 		// SnapshotsOffset:       uint64(w.snapshotsOffset),
 	}
 
+	// NOTE: zstd compressed clusters require a version 3 header with the
+	// compression type field.
+	if w.compression == CompressionZstd {
+		hdr.Version = 3
+		hdr.IncompatibleFeatures = incompatCompressionType
+		hdr.RefcountOrder = 4
+		hdr.HeaderLength = uint32(binary.Size(hdr))
+		hdr.CompressionType = compressionTypeZstd
+	}
+
+	// NOTE: header extensions start where the version's header ends, which
+	// overlaps the unused version 3 fields of a version 2 header.
+	var extensions []byte
+	var extensionsOffset int64
+	if w.backing != nil {
+		extensionsOffset = 72
+		if hdr.Version >= 3 {
+			extensionsOffset = int64(hdr.HeaderLength)
+		}
+
+		var err error
+		var nameOffset int64
+		extensions, nameOffset, err = backingFileHeader(extensionsOffset, w.backingName, w.backing.Format())
+		if err != nil {
+			return err
+		}
+
+		hdr.BackingFileOffset = uint64(nameOffset)
+		hdr.BackingFileSize = uint32(len(w.backingName))
+	}
+
+	w.header = hdr
+
 	err := binary.Write(w.w, binary.BigEndian, hdr)
 	if err != nil {
 		return err
 	}
 
+	if extensions != nil {
+		_, err = w.w.Seek(extensionsOffset, io.SeekStart)
+		if err != nil {
+			return err
+		}
+
+		_, err = w.w.Write(extensions)
+		if err != nil {
+			return err
+		}
+	}
+
 	_, err = w.w.Seek(w.clusterSize, io.SeekStart)
 	if err != nil {
 		return err
@@ -211,6 +359,17 @@ func (w *Writer) writeRefcountBlocks() error {
 		}
 	}
 
+	// NOTE: the refcounts of compressed images depend on how well each
+	// cluster compresses, and those of images with a backing file on which
+	// clusters differ from it, so they are written by Close instead.
+	if w.dynamic() {
+		w.refcounts = make([]uint16, w.refcountBlocks*w.clusterSize/2)
+		for cluster := int64(0); cluster < w.metadataClusters; cluster++ {
+			w.refcounts[cluster] = 1
+		}
+		totalHostClusters = 0
+	}
+
 	for cluster := int64(0); cluster < totalHostClusters; cluster++ {
 		err := binary.Write(buf, binary.BigEndian, uint16(1))
 		if err != nil {
@@ -242,19 +401,13 @@ func (w *Writer) writeL1Table() error {
 	var capacity int64
 	var required = w.h.Size()
 
+	// NOTE: every L2 table is written to the image, even if all of the
+	// clusters it refers to are holes, so every L1 entry points to one.
 	for capacity < required {
 		l2Offset := w.l2Offset + w.clusterSize*l2
-
-		if w.h.RegionIsHole(l2*w.clusterSize, w.clusterSize) {
-			err := binary.Write(buf, binary.BigEndian, uint64(0))
-			if err != nil {
-				return err
-			}
-		} else {
-			err := binary.Write(buf, binary.BigEndian, uint64(l2Offset)|(1<<63)) // OFLAG_COPIED
-			if err != nil {
-				return err
-			}
+		err := binary.Write(buf, binary.BigEndian, uint64(l2Offset)|(1<<63)) // OFLAG_COPIED
+		if err != nil {
+			return err
 		}
 		l2++
 		capacity += l2Capacity
@@ -276,11 +429,20 @@ func (w *Writer) writeL1Table() error {
 
 func (w *Writer) writeL2Tables() error {
 
+	if w.dynamic() {
+		w.l2 = make([]uint64, w.totalDataClusters)
+		w.buffer = make([]byte, w.clusterSize)
+		w.scratch = make([]byte, w.clusterSize)
+		w.hostCursor = w.l2Offset + w.l2Blocks*w.clusterSize
+		_, err := w.w.Seek(w.hostCursor, io.SeekStart)
+		return err
+	}
+
 	buf := new(bytes.Buffer)
 	for cluster := int64(0); cluster < w.totalDataClusters; cluster++ {
 		offset := uint64(0)
 		if w.clusterInUse[cluster] {
-			offset = uint64(w.clusterOffsets[cluster]) | (1 << 63) // OFLAG_COPIED
+			offset = uint64(w.clusterOffsets[cluster]) | flagCopied
 		}
 		err := binary.Write(buf, binary.BigEndian, offset)
 		if err != nil {
@@ -303,16 +465,359 @@ func (w *Writer) writeL2Tables() error {
 }
 
 func (w *Writer) Close() error {
+
+	if w.backing != nil {
+		defer w.backing.Close()
+	}
+
+	if !w.dynamic() {
+		return nil
+	}
+
+	err := w.flushCluster()
+	if err != nil {
+		return err
+	}
+
+	err = w.skipClusters(w.totalDataClusters)
+	if err != nil {
+		return err
+	}
+
+	// pad the final cluster so that reads of whole sectors never go past the
+	// end of the file
+	end := divide(w.hostCursor, w.clusterSize) * w.clusterSize
+	_, err = w.w.Write(make([]byte, end-w.hostCursor))
+	if err != nil {
+		return err
+	}
+
+	_, err = w.w.Seek((1+w.refcountTableClusters)*w.clusterSize, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	err = binary.Write(w.w, binary.BigEndian, w.refcounts)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.w.Seek(w.l2Offset, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	err = binary.Write(w.w, binary.BigEndian, w.l2)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.w.Seek(end, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	w.traceClusters(end)
+
 	return nil
+
 }
 
+// SetLogger sets the logger the Writer traces the metadata it writes to. The
+// header and the layout of the tables are written when the Writer is created,
+// so they're traced right away. The L2 tables of a compressing Writer, or one
+// with a backing file, are traced when it's closed, since that's when they're
+// written.
+func (w *Writer) SetLogger(log elog.Logger) {
+
+	w.log = log
+	if log == nil {
+		return
+	}
+
+	hdr := w.header
+	log.Tracef("qcow2 header: version %d, %d byte clusters, virtual size %d bytes, incompatible features %#x, compression type %d",
+		hdr.Version, int64(1)<<hdr.ClusterBits, hdr.Size, hdr.IncompatibleFeatures, hdr.CompressionType)
+	log.Tracef("qcow2 refcount table at %#x (%d clusters), pointing to %d refcount blocks at %#x",
+		hdr.RefcountTableOffset, hdr.RefcountTableClusters, w.refcountBlocks, w.clusterSize*(1+w.refcountTableClusters))
+	log.Tracef("qcow2 l1 table at %#x with %d entries, pointing to %d l2 tables at %#x",
+		hdr.L1TableOffset, hdr.L1Size, w.l2Blocks, w.l2Offset)
+
+	if w.backing != nil {
+		log.Tracef("qcow2 backing file: %s (%s), recorded as '%s' at %#x",
+			w.backing.path, w.backing.Format(), w.backingName, hdr.BackingFileOffset)
+	}
+
+	if w.dynamic() {
+		log.Tracef("qcow2 data clusters are allocated as they're written, starting at %#x", w.hostCursor)
+		return
+	}
+
+	var allocated int64
+	for _, inUse := range w.clusterInUse {
+		if inUse {
+			allocated++
+		}
+	}
+
+	log.Tracef("qcow2 l2 tables: %d of %d data clusters allocated, starting at %#x", allocated, w.totalDataClusters, w.clusterOffsets[0])
+
+}
+
+// traceClusters traces the L2 tables of a Writer that allocates clusters as
+// they are written, once they're complete.
+func (w *Writer) traceClusters(end int64) {
+
+	if w.log == nil {
+		return
+	}
+
+	var compressed, uncompressed int64
+	for _, entry := range w.l2 {
+		switch {
+		case entry&flagCompressed != 0:
+			compressed++
+		case entry != 0:
+			uncompressed++
+		}
+	}
+
+	w.log.Tracef("qcow2 l2 tables: %d of %d data clusters allocated (%d compressed, %d stored as is), image ends at %#x",
+		compressed+uncompressed, w.totalDataClusters, compressed, uncompressed, end)
+
+}
+
+// flushCluster compresses the buffered cluster and appends it to the image.
+// Clusters that don't shrink are stored uncompressed, and clusters of zeroes
+// are left unallocated. If there is a backing file it is clusters that match
+// the backing file that are left unallocated instead, even if they're zeroes.
+func (w *Writer) flushCluster() error {
+
+	if w.bufferCluster < 0 {
+		return nil
+	}
+
+	cluster := w.bufferCluster
+	w.bufferCluster = -1
+	w.nextCluster = cluster + 1
+
+	if w.backing != nil {
+		same, err := w.backing.matches(w.buffer, cluster*w.clusterSize, w.scratch)
+		if err != nil {
+			return err
+		}
+		if same {
+			return nil
+		}
+	} else if isZeroes(w.buffer) {
+		return nil
+	}
+
+	var err error
+	data := w.buffer
+	if w.compressor != nil {
+		data, err = w.compressor.compress(w.buffer)
+		if err != nil {
+			return err
+		}
+	}
+
+	offset := w.hostCursor
+	if int64(len(data)) >= w.clusterSize {
+		data = w.buffer
+		offset = divide(offset, w.clusterSize) * w.clusterSize
+		if offset != w.hostCursor {
+			_, err = w.w.Seek(offset, io.SeekStart)
+			if err != nil {
+				return err
+			}
+		}
+		w.l2[cluster] = uint64(offset) | flagCopied
+	} else {
+		// NOTE: the descriptor's size field is the number of 512 byte
+		// sectors used beyond the one containing the offset.
+		sizeShift := 62 - (w.clusterBits() - 8)
+		sectors := (offset+int64(len(data))-1)/SectorSize - offset/SectorSize
+		w.l2[cluster] = uint64(offset) | uint64(sectors)<<sizeShift | flagCompressed
+	}
+
+	_, err = w.w.Write(data)
+	if err != nil {
+		return err
+	}
+
+	end := offset + int64(len(data))
+	for c := offset / w.clusterSize; c <= (end-1)/w.clusterSize; c++ {
+		w.refcounts[c]++
+	}
+
+	w.hostCursor = end
+
+	return nil
+
+}
+
+func (w *Writer) clusterBits() uint {
+	var bits uint
+	for int64(1)<<bits < w.clusterSize {
+		bits++
+	}
+	return bits
+}
+
+// skipClusters flushes the clusters between the last one flushed and end,
+// which haven't been written to and so are zeroes, in case the backing file
+// has data there. Without a backing file they are left unallocated.
+func (w *Writer) skipClusters(end int64) error {
+
+	if w.backing == nil {
+		return nil
+	}
+
+	for cluster := w.nextCluster; cluster < end; cluster++ {
+		for i := range w.buffer {
+			w.buffer[i] = 0
+		}
+		w.bufferCluster = cluster
+
+		err := w.flushCluster()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+
+}
+
+// writeDynamic buffers p a cluster at a time, flushing each cluster once it
+// is full or the Writer moves on to another one.
+func (w *Writer) writeDynamic(p []byte) (int, error) {
+
+	var n int
+
+	for len(p) > 0 {
+
+		cluster := w.cursor / w.clusterSize
+		delta := w.cursor % w.clusterSize
+		if cluster >= w.totalDataClusters {
+			return n, errors.New("qcow2 writer received more raw image data than expected")
+		}
+
+		chunk := p
+		if int64(len(chunk)) > w.clusterSize-delta {
+			chunk = chunk[:w.clusterSize-delta]
+		}
+
+		if w.clusterInUse[cluster] || w.backing != nil {
+			if cluster != w.bufferCluster {
+				err := w.flushCluster()
+				if err != nil {
+					return n, err
+				}
+
+				if cluster < w.nextCluster {
+					return n, errors.New("compressed or backed qcow2 writer cannot seek backwards")
+				}
+
+				err = w.skipClusters(cluster)
+				if err != nil {
+					return n, err
+				}
+
+				for i := range w.buffer {
+					w.buffer[i] = 0
+				}
+				w.bufferCluster = cluster
+			}
+
+			copy(w.buffer[delta:], chunk)
+
+			if delta+int64(len(chunk)) == w.clusterSize {
+				err := w.flushCluster()
+				if err != nil {
+					return n, err
+				}
+			}
+		} else if !isZeroes(chunk) {
+			return n, errors.New("qcow2 writer received data for a region predicted to be empty")
+		}
+
+		n += len(chunk)
+		w.cursor += int64(len(chunk))
+		p = p[len(chunk):]
+
+	}
+
+	return n, nil
+
+}
+
+func isZeroes(p []byte) bool {
+	for _, b := range p {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Write splits p along cluster boundaries, writing data destined for
+// allocated clusters and discarding data destined for holes. Because holes
+// aren't stored in the image, writing anything other than zeroes into one is
+// an error.
 func (w *Writer) Write(p []byte) (int, error) {
 
-	k, err := w.w.Write(p)
-	w.cursor += int64(k)
-	return k, err
+	if w.dynamic() {
+		return w.writeDynamic(p)
+	}
+
+	var n int
+
+	for len(p) > 0 {
+
+		cluster := w.cursor / w.clusterSize
+		delta := w.cursor % w.clusterSize
+		if cluster >= w.totalDataClusters {
+			return n, errors.New("qcow2 writer received more raw image data than expected")
+		}
+
+		chunk := p
+		if int64(len(chunk)) > w.clusterSize-delta {
+			chunk = chunk[:w.clusterSize-delta]
+		}
+
+		if w.clusterInUse[cluster] {
+			if w.seekPending {
+				_, err := w.w.Seek(w.clusterOffsets[cluster]+delta, io.SeekStart)
+				if err != nil {
+					return n, err
+				}
+				w.seekPending = false
+			}
+
+			k, err := w.w.Write(chunk)
+			n += k
+			w.cursor += int64(k)
+			if err != nil {
+				return n, err
+			}
+		} else {
+			if !isZeroes(chunk) {
+				return n, errors.New("qcow2 writer received data for a region predicted to be empty")
+			}
+
+			n += len(chunk)
+			w.cursor += int64(len(chunk))
+			w.seekPending = true
+		}
+
+		p = p[len(chunk):]
+
+	}
+
+	return n, nil
 
-	// TODO: check not writing into a forbidden cluster
 }
 
 func (w *Writer) Seek(offset int64, whence int) (int64, error) {
@@ -328,13 +833,25 @@ func (w *Writer) Seek(offset int64, whence int) (int64, error) {
 		panic("bad seek whence")
 	}
 
+	w.cursor = abs
+
+	if w.dynamic() {
+		return abs, nil
+	}
+
 	cluster := abs / w.clusterSize
 	delta := abs % w.clusterSize
+	if cluster >= w.totalDataClusters || !w.clusterInUse[cluster] {
+		w.seekPending = true
+		return abs, nil
+	}
+
 	x := w.clusterOffsets[cluster] + delta
 	_, err := w.w.Seek(x, io.SeekStart)
-	w.cursor = abs
 	if err != nil {
 		return 0, err
 	}
+	w.seekPending = false
+
 	return abs, nil
 }
@@ -0,0 +1,395 @@
+package qcow2
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+type testImage struct {
+	data  []byte
+	holes map[int64]bool // keyed by cluster
+}
+
+func (img *testImage) Size() int64 {
+	return int64(len(img.data))
+}
+
+func (img *testImage) RegionIsHole(begin, size int64) bool {
+	for c := begin / 0x10000; c <= (begin+size-1)/0x10000; c++ {
+		if !img.holes[c] {
+			return false
+		}
+	}
+	return true
+}
+
+// readVirtual resolves the contents of a qcow2 image using its L1 and L2
+// tables.
+func readVirtual(t *testing.T, f io.ReaderAt, size int64) []byte {
+
+	hdr := new(Header)
+	err := binary.Read(io.NewSectionReader(f, 0, 0x10000), binary.BigEndian, hdr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if hdr.Magic != 0x514649FB || int64(hdr.Size) != size {
+		t.Fatalf("bad qcow2 header: %+v", hdr)
+	}
+
+	clusterSize := int64(1) << hdr.ClusterBits
+	entriesPerL2 := clusterSize / 8
+	mask := uint64(1)<<62 - 1
+
+	out := make([]byte, size)
+	for offset := int64(0); offset < size; offset += clusterSize {
+		cluster := offset / clusterSize
+
+		var l2 uint64
+		err = binary.Read(io.NewSectionReader(f, int64(hdr.L1TableOffset)+8*(cluster/entriesPerL2), 8), binary.BigEndian, &l2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if l2&mask == 0 {
+			continue
+		}
+
+		var x uint64
+		err = binary.Read(io.NewSectionReader(f, int64(l2&mask)+8*(cluster%entriesPerL2), 8), binary.BigEndian, &x)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if x&mask == 0 {
+			continue
+		}
+
+		if x&flagCompressed != 0 {
+			shift := 62 - (hdr.ClusterBits - 8)
+			host := int64(x & (1<<shift - 1))
+			sectors := int64(x&mask) >> shift
+			length := (host/SectorSize+sectors+1)*SectorSize - host
+
+			var r io.Reader = io.NewSectionReader(f, host, length)
+			if hdr.Version >= 3 && hdr.CompressionType == compressionTypeZstd {
+				dec, err := zstd.NewReader(r)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer dec.Close()
+				r = dec
+			} else {
+				r = flate.NewReader(r)
+			}
+
+			_, err = io.ReadFull(r, out[offset:offset+clusterSize])
+			if err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+
+		_, err = f.ReadAt(out[offset:offset+clusterSize], int64(x&mask))
+		if err != nil && err != io.EOF {
+			t.Fatal(err)
+		}
+	}
+
+	return out
+
+}
+
+func TestWriter(t *testing.T) {
+
+	img := &testImage{
+		data:  make([]byte, 0x10000*64),
+		holes: map[int64]bool{3: true, 4: true, 10: true, 63: true},
+	}
+
+	for c := int64(0); c < 64; c++ {
+		if !img.holes[c] {
+			copy(img.data[c*0x10000:], bytes.Repeat([]byte{byte(c + 1)}, int(0x10000-c)))
+		}
+	}
+
+	f, err := ioutil.TempFile("", "qcow2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	w, err := NewWriter(f, img)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// write across holes in odd-sized pieces, then seek over the rest
+	_, err = io.CopyBuffer(w, bytes.NewReader(img.data[:0x10000*20]), make([]byte, 12345))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = w.Seek(0x10000*20, io.SeekStart)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = w.Write(img.data[0x10000*20 : 0x10000*63])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = w.Seek(0, io.SeekEnd)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(readVirtual(t, f, img.Size()), img.data) {
+		t.Errorf("qcow2 image contents differ from the raw image")
+	}
+
+	_, err = w.Seek(0x10000*3, io.SeekStart)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = w.Write([]byte{1})
+	if err == nil {
+		t.Errorf("qcow2 writer accepted data for a hole")
+	}
+
+}
+
+func TestCompressedWriter(t *testing.T) {
+
+	img := &testImage{
+		data:  make([]byte, 0x10000*48),
+		holes: map[int64]bool{0: true, 7: true, 8: true, 47: true},
+	}
+
+	rng := rand.New(rand.NewSource(1))
+	for c := int64(0); c < 48; c++ {
+		switch {
+		case img.holes[c]:
+		case c%10 == 0:
+			// incompressible
+			rng.Read(img.data[c*0x10000 : (c+1)*0x10000])
+		case c%7 == 0:
+			// allocated but empty
+		default:
+			copy(img.data[c*0x10000:], bytes.Repeat([]byte{byte(c), 'q', 'c', 'o', 'w'}, 0x1000))
+		}
+	}
+
+	for _, compression := range []Compression{CompressionZlib, CompressionZstd} {
+
+		f, err := ioutil.TempFile("", "qcow2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(f.Name())
+		defer f.Close()
+
+		w, err := NewWriterWithOptions(f, img, &Options{Compression: compression})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// skip over part of an empty cluster and the end of the image
+		_, err = io.CopyBuffer(w, bytes.NewReader(img.data[:0x10000*28+100]), make([]byte, 12345))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = w.Seek(0x10000*28+5000, io.SeekStart)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = w.Write(img.data[0x10000*28+5000 : 0x10000*47])
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// revisiting a cluster that has already been compressed isn't possible
+		_, err = w.Seek(0x10000, io.SeekStart)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = w.Write([]byte{1})
+		if err == nil {
+			t.Errorf("%s compressed qcow2 writer accepted data for an earlier cluster", compression)
+		}
+
+		err = w.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(readVirtual(t, f, img.Size()), img.data) {
+			t.Errorf("%s compressed qcow2 image contents differ from the raw image", compression)
+		}
+
+		info, err := f.Stat()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// the uncompressed image would have 5 metadata and 44 data clusters
+		if info.Size() >= 0x10000*(5+44)/2 {
+			t.Errorf("%s compressed qcow2 image is larger than expected: %d bytes", compression, info.Size())
+		}
+
+	}
+
+}
+
+func TestBackedWriter(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "qcow2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	base := &testImage{
+		data:  make([]byte, 0x10000*16),
+		holes: map[int64]bool{5: true},
+	}
+
+	for c := int64(0); c < 16; c++ {
+		if !base.holes[c] {
+			copy(base.data[c*0x10000:], bytes.Repeat([]byte{byte(c + 1)}, 0x10000))
+		}
+	}
+
+	bf, err := os.Create(filepath.Join(dir, "base.qcow2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bf.Close()
+
+	w, err := NewWriterWithOptions(bf, base, &Options{Compression: CompressionZlib})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = w.Write(base.data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// cluster 2 changes, cluster 5 gains data, and clusters 9 and 12 to 15
+	// are emptied, the last few by never being written
+	img := &testImage{
+		data:  append([]byte{}, base.data...),
+		holes: map[int64]bool{9: true, 12: true, 13: true, 14: true, 15: true},
+	}
+	img.data[2*0x10000+100] = 0xFF
+	copy(img.data[5*0x10000:], []byte("vorteil"))
+	for _, c := range []int64{9, 12, 13, 14, 15} {
+		copy(img.data[c*0x10000:], make([]byte, 0x10000))
+	}
+
+	for _, compression := range []Compression{CompressionNone, CompressionZstd} {
+
+		f, err := os.Create(filepath.Join(dir, "child.qcow2"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+
+		w, err := NewWriterWithOptions(f, img, &Options{
+			Compression: compression,
+			Backing:     bf.Name(),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = io.CopyBuffer(w, bytes.NewReader(img.data[:0x10000*9]), make([]byte, 12345))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = w.Seek(0x10000*10, io.SeekStart)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = w.Write(img.data[0x10000*10 : 0x10000*12])
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = w.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		hdr := new(Header)
+		err = binary.Read(io.NewSectionReader(f, 0, 0x10000), binary.BigEndian, hdr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		name := make([]byte, hdr.BackingFileSize)
+		_, err = f.ReadAt(name, int64(hdr.BackingFileOffset))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(name) != "base.qcow2" {
+			t.Errorf("%s backed qcow2 image has the wrong backing file name: %s", compression, name)
+		}
+
+		b, err := OpenBacking(f.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		data := make([]byte, img.Size())
+		_, err = b.ReadAt(data, 0)
+		b.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(data, img.data) {
+			t.Errorf("%s backed qcow2 image contents differ from the raw image", compression)
+		}
+
+		// only the 7 clusters that differ are stored, along with 5 clusters of
+		// metadata
+		info, err := f.Stat()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if info.Size() > 0x10000*(5+7) {
+			t.Errorf("%s backed qcow2 image is larger than expected: %d bytes", compression, info.Size())
+		}
+
+	}
+
+}
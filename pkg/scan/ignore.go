@@ -0,0 +1,154 @@
+package scan
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// An ignore file lists the vulnerabilities a project has accepted, one per
+// line, optionally followed by the date the exception expires. Anything after
+// a '#' is a comment:
+//
+//	CVE-2020-1234             # not reachable from the app
+//	CVE-2021-0042 2021-06-30  # until the upstream fix is released
+//
+// An exception lasts until the end of its expiry date, in UTC. Exceptions
+// without one never expire.
+
+// IgnoreFileName is the name of the ignore file in a project's directory.
+const IgnoreFileName = ".vorteil-scan-ignore"
+
+const dateFormat = "2006-01-02"
+
+// IgnoreRule accepts a vulnerability until it expires.
+type IgnoreRule struct {
+	ID      string
+	Expires time.Time // the last day the rule applies, or zero if it never expires
+	Reason  string
+}
+
+// expired returns true if the rule no longer applies at t.
+func (r *IgnoreRule) expired(t time.Time) bool {
+	return !r.Expires.IsZero() && !t.Before(r.Expires.AddDate(0, 0, 1))
+}
+
+// Ignore is a list of accepted vulnerabilities.
+type Ignore struct {
+	Rules []IgnoreRule
+}
+
+// ParseIgnore parses an ignore file.
+func ParseIgnore(r io.Reader) (*Ignore, error) {
+
+	x := new(Ignore)
+	seen := make(map[string]int)
+
+	s := bufio.NewScanner(r)
+	for n := 1; s.Scan(); n++ {
+		line := s.Text()
+
+		var reason string
+		if k := strings.Index(line, "#"); k >= 0 {
+			line, reason = line[:k], strings.TrimSpace(line[k+1:])
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		if len(fields) > 2 {
+			return nil, fmt.Errorf("line %d: expected an id and an optional expiry date", n)
+		}
+
+		rule := IgnoreRule{
+			ID:     fields[0],
+			Reason: reason,
+		}
+
+		if len(fields) == 2 {
+			date, err := time.Parse(dateFormat, fields[1])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid expiry date '%s' (should be YYYY-MM-DD)", n, fields[1])
+			}
+			rule.Expires = date
+		}
+
+		if prev, ok := seen[rule.ID]; ok {
+			return nil, fmt.Errorf("line %d: %s is already ignored on line %d", n, rule.ID, prev)
+		}
+		seen[rule.ID] = n
+
+		x.Rules = append(x.Rules, rule)
+	}
+
+	err := s.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return x, nil
+
+}
+
+// LoadIgnoreFile loads the ignore file at path.
+func LoadIgnoreFile(path string) (*Ignore, error) {
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	x, err := ParseIgnore(f)
+	if err != nil {
+		return nil, fmt.Errorf("bad ignore file '%s': %v", path, err)
+	}
+
+	return x, nil
+
+}
+
+// Filter returns the findings that aren't ignored at t, and the rules that
+// would have ignored some of them if they hadn't expired. A nil Ignore
+// ignores nothing.
+func (x *Ignore) Filter(findings []Finding, t time.Time) (Findings, []IgnoreRule) {
+
+	var remaining Findings
+	var expired []IgnoreRule
+
+	rules := make(map[string]*IgnoreRule)
+	if x != nil {
+		for i := range x.Rules {
+			rules[x.Rules[i].ID] = &x.Rules[i]
+		}
+	}
+
+	reported := make(map[string]bool)
+
+	for _, f := range findings {
+		rule, ok := rules[f.ID]
+		if ok && !rule.expired(t) {
+			continue
+		}
+
+		if ok && !reported[rule.ID] {
+			reported[rule.ID] = true
+			expired = append(expired, *rule)
+		}
+
+		remaining = append(remaining, f)
+	}
+
+	return remaining, expired
+
+}
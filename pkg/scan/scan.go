@@ -0,0 +1,92 @@
+package scan
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/vorteil/vorteil/pkg/elog"
+	"github.com/vorteil/vorteil/pkg/vcfg"
+	"github.com/vorteil/vorteil/pkg/vio"
+)
+
+// A Scanner looks for known vulnerabilities in an app before it is built,
+// failing the build if it finds any that haven't been accepted in an Ignore
+// list. Vorteil doesn't scan anything itself: Scanners wrap whichever tool or
+// service an organisation already uses.
+
+// Scanner finds known vulnerabilities in an app's VCFG and file tree.
+type Scanner interface {
+	Scan(ctx context.Context, cfg *vcfg.VCFG, fs vio.FileTree) ([]Finding, error)
+}
+
+// Finding is a vulnerability found by a Scanner.
+type Finding struct {
+	ID       string // e.g. "CVE-2020-1234"
+	Package  string // the affected package or file, if known
+	Severity string // as reported by the scanner, if known
+}
+
+func (f Finding) String() string {
+
+	s := f.ID
+	if f.Package != "" {
+		s += " in " + f.Package
+	}
+	if f.Severity != "" {
+		s += " (" + f.Severity + ")"
+	}
+
+	return s
+
+}
+
+// Findings is the error returned when a scan finds vulnerabilities that
+// aren't ignored.
+type Findings []Finding
+
+// Error implements error.
+func (f Findings) Error() string {
+
+	lines := make([]string, len(f))
+	for i := range f {
+		lines[i] = f[i].String()
+	}
+
+	return fmt.Sprintf("app has known vulnerabilities:\n\t%s", strings.Join(lines, "\n\t"))
+
+}
+
+// Check scans cfg and fs with s, and returns Findings listing every
+// vulnerability that ignore doesn't accept, or nil if there are none. The
+// ignore list is optional. Findings that were accepted until an expiry that
+// has passed are reported again, with a warning logged for each.
+func Check(ctx context.Context, s Scanner, ignore *Ignore, cfg *vcfg.VCFG, fs vio.FileTree, log elog.View) error {
+
+	findings, err := s.Scan(ctx, cfg, fs)
+	if err != nil {
+		return fmt.Errorf("failed to scan app: %w", err)
+	}
+
+	remaining, expired := ignore.Filter(findings, time.Now())
+	for _, rule := range expired {
+		log.Warnf("Ignored vulnerability %s expired on %s", rule.ID, rule.Expires.Format(dateFormat))
+	}
+
+	if len(remaining) > 0 {
+		return remaining
+	}
+
+	if len(findings) > 0 {
+		log.Infof("Ignoring %d known vulnerabilities", len(findings))
+	}
+
+	return nil
+
+}
@@ -0,0 +1,114 @@
+package scan
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vorteil/vorteil/pkg/elog"
+	"github.com/vorteil/vorteil/pkg/vcfg"
+	"github.com/vorteil/vorteil/pkg/vio"
+)
+
+type testScanner []Finding
+
+func (s testScanner) Scan(ctx context.Context, cfg *vcfg.VCFG, fs vio.FileTree) ([]Finding, error) {
+	return s, nil
+}
+
+func TestParseIgnore(t *testing.T) {
+
+	x, err := ParseIgnore(strings.NewReader(`
+# accepted findings
+CVE-2020-0001
+CVE-2020-0002 2020-06-30 # until the fix is released
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(x.Rules) != 2 {
+		t.Fatalf("expected 2 rules, got %d", len(x.Rules))
+	}
+
+	if x.Rules[0].ID != "CVE-2020-0001" || !x.Rules[0].Expires.IsZero() {
+		t.Errorf("unexpected first rule: %+v", x.Rules[0])
+	}
+
+	if x.Rules[1].ID != "CVE-2020-0002" || x.Rules[1].Expires.Format(dateFormat) != "2020-06-30" || x.Rules[1].Reason != "until the fix is released" {
+		t.Errorf("unexpected second rule: %+v", x.Rules[1])
+	}
+
+	for _, bad := range []string{
+		"CVE-2020-0001 30/06/2020",
+		"CVE-2020-0001 2020-06-30 extra",
+		"CVE-2020-0001\nCVE-2020-0001",
+	} {
+		_, err = ParseIgnore(strings.NewReader(bad))
+		if err == nil {
+			t.Errorf("expected an error parsing %q", bad)
+		}
+	}
+
+}
+
+func TestFilter(t *testing.T) {
+
+	x, err := ParseIgnore(strings.NewReader("CVE-2020-0001\nCVE-2020-0002 2020-06-30\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	findings := []Finding{
+		{ID: "CVE-2020-0001"},
+		{ID: "CVE-2020-0002"},
+		{ID: "CVE-2020-0003"},
+	}
+
+	remaining, expired := x.Filter(findings, time.Date(2020, 6, 30, 23, 0, 0, 0, time.UTC))
+	if len(remaining) != 1 || remaining[0].ID != "CVE-2020-0003" || len(expired) != 0 {
+		t.Errorf("expected only the unlisted finding before the expiry, got %v, %v", remaining, expired)
+	}
+
+	remaining, expired = x.Filter(findings, time.Date(2020, 7, 1, 0, 0, 0, 0, time.UTC))
+	if len(remaining) != 2 || len(expired) != 1 || expired[0].ID != "CVE-2020-0002" {
+		t.Errorf("expected the expired rule to stop applying, got %v, %v", remaining, expired)
+	}
+
+	var none *Ignore
+	remaining, _ = none.Filter(findings, time.Now())
+	if len(remaining) != len(findings) {
+		t.Errorf("expected a nil ignore list to ignore nothing, got %v", remaining)
+	}
+
+}
+
+func TestCheck(t *testing.T) {
+
+	log := &elog.CLI{}
+	tree := vio.NewFileTree()
+	defer tree.Close()
+
+	x, err := ParseIgnore(strings.NewReader("CVE-2020-0001\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = Check(context.Background(), testScanner{{ID: "CVE-2020-0001"}}, x, &vcfg.VCFG{}, tree, log)
+	if err != nil {
+		t.Errorf("unexpected error for an ignored finding: %v", err)
+	}
+
+	err = Check(context.Background(), testScanner{{ID: "CVE-2020-0001"}, {ID: "CVE-2020-0002", Package: "openssl"}}, x, &vcfg.VCFG{}, tree, log)
+	findings, ok := err.(Findings)
+	if !ok || len(findings) != 1 || !strings.Contains(err.Error(), "CVE-2020-0002 in openssl") {
+		t.Errorf("expected the unignored finding to be reported, got %v", err)
+	}
+
+}
@@ -0,0 +1,130 @@
+package sdk
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"context"
+	"errors"
+	"io"
+
+	"github.com/vorteil/vorteil/pkg/elog"
+	"github.com/vorteil/vorteil/pkg/policy"
+	"github.com/vorteil/vorteil/pkg/scan"
+	"github.com/vorteil/vorteil/pkg/vcfg"
+	"github.com/vorteil/vorteil/pkg/vdisk"
+	"github.com/vorteil/vorteil/pkg/vimg"
+	"github.com/vorteil/vorteil/pkg/vio"
+	"github.com/vorteil/vorteil/pkg/vpkg"
+)
+
+var errNoLogger = errors.New("no logger provided")
+
+// BuildArgs describe a disk image to build. The app comes from Package if it
+// is set, or else from resolving Source the same way as the Package function
+// does, with each of VCFGs merged over its VCFG. Build takes ownership of
+// Package, and closes it once the image is built.
+//
+// Logger is required. The rest of the fields are passed on to vdisk.Build,
+// and described there.
+type BuildArgs struct {
+	Source          string
+	Package         vpkg.Builder
+	VCFGs           []*vcfg.VCFG
+	Format          vdisk.Format
+	SizeAlign       int64
+	KernelOptions   vdisk.KernelOptions
+	Logger          elog.View
+	DiskWriter      func(name string) (io.WriteSeeker, error)
+	OSFiles         vio.FileTree
+	FilesystemCache *vdisk.FilesystemCache
+	Checksums       *vdisk.Checksums
+	Manifest        *vdisk.Manifest
+	Policy          *policy.Policy
+	ZoneInfo        string
+	Reproducible    *vdisk.Reproducible
+	Signer          vimg.Signer
+	Scanner         scan.Scanner
+	ScanIgnore      *scan.Ignore
+	Measurements    *vimg.Measurements
+	GUIDs           *vimg.GUIDs
+}
+
+// Build builds the disk image described by args and writes it to w. The
+// build stops early with ctx's error if ctx is done first.
+func Build(ctx context.Context, w io.WriteSeeker, args BuildArgs) error {
+
+	pkg, err := openPackage(ctx, &args)
+	if err != nil {
+		return err
+	}
+	defer pkg.Close()
+
+	return vdisk.Build(ctx, w, args.vdisk(pkg))
+
+}
+
+// openPackage returns a reader for the app args describe, with the VCFG
+// overrides merged in.
+func openPackage(ctx context.Context, args *BuildArgs) (vpkg.Reader, error) {
+
+	if args.Logger == nil {
+		return nil, errNoLogger
+	}
+
+	b := args.Package
+	if b == nil {
+		if args.Source == "" {
+			return nil, errors.New("no package or source provided")
+		}
+
+		var err error
+		b, err = Package(ctx, args.Source)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, cfg := range args.VCFGs {
+		err := b.MergeVCFG(cfg)
+		if err != nil {
+			b.Close()
+			return nil, err
+		}
+	}
+
+	pkg, err := vpkg.ReaderFromBuilder(b)
+	if err != nil {
+		b.Close()
+		return nil, err
+	}
+
+	return pkg, nil
+
+}
+
+func (args *BuildArgs) vdisk(pkg vpkg.Reader) *vdisk.BuildArgs {
+	return &vdisk.BuildArgs{
+		PackageReader:    pkg,
+		Format:           args.Format,
+		SizeAlign:        args.SizeAlign,
+		KernelOptions:    args.KernelOptions,
+		Logger:           args.Logger,
+		WithVCFGDefaults: true,
+		DiskWriter:       args.DiskWriter,
+		OSFiles:          args.OSFiles,
+		FilesystemCache:  args.FilesystemCache,
+		Checksums:        args.Checksums,
+		Manifest:         args.Manifest,
+		Policy:           args.Policy,
+		ZoneInfo:         args.ZoneInfo,
+		Reproducible:     args.Reproducible,
+		Signer:           args.Signer,
+		Scanner:          args.Scanner,
+		ScanIgnore:       args.ScanIgnore,
+		Measurements:     args.Measurements,
+		GUIDs:            args.GUIDs,
+	}
+}
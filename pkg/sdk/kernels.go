@@ -0,0 +1,39 @@
+package sdk
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"path/filepath"
+
+	"github.com/vorteil/vorteil/pkg/elog"
+	"github.com/vorteil/vorteil/pkg/vimg"
+	"github.com/vorteil/vorteil/pkg/vkern"
+)
+
+// UseKernels sets up every build to load kernels from the directories and
+// remote repositories in args, caching assembled kernel layers beneath
+// args.Directory. It has to be called before anything is built, and returns
+// the manager the kernels come from.
+func UseKernels(args vkern.CLIArgs, log elog.View) (vkern.Manager, error) {
+
+	ksrc, err := vkern.CLI(args, log)
+	if err != nil {
+		return nil, err
+	}
+
+	layers, err := vkern.NewLayerCache(filepath.Join(args.Directory, "cache"))
+	if err != nil {
+		return nil, err
+	}
+
+	vkern.Global = ksrc
+	vimg.GetKernel = ksrc.Get
+	vimg.GetLatestKernel = vkern.ConstructGetLastestKernelsFunc(&ksrc)
+	vimg.GetKernelLayer = layers.Reader
+
+	return ksrc, nil
+
+}
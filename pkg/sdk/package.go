@@ -0,0 +1,105 @@
+package sdk
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+
+	"github.com/vorteil/vorteil/pkg/vpkg"
+	"github.com/vorteil/vorteil/pkg/vproj"
+)
+
+// Package resolves source into a package builder. The source can be a
+// project directory, optionally followed by ':' and the name of one of its
+// targets, a package file, or the http(s) URL of a package.
+func Package(ctx context.Context, source string) (vpkg.Builder, error) {
+
+	if u, err := url.Parse(source); err == nil && (u.Scheme == "http" || u.Scheme == "https") {
+		return packageFromURL(ctx, source)
+	}
+
+	path, target := vproj.Split(source)
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if fi.IsDir() {
+		proj, err := vproj.LoadProject(path)
+		if err != nil {
+			return nil, err
+		}
+
+		tgt, err := proj.Target(target)
+		if err != nil {
+			return nil, err
+		}
+
+		return tgt.NewBuilder()
+	}
+
+	if target != "" {
+		return nil, fmt.Errorf("package '%s' has no targets", path)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	rdr, err := vpkg.Load(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return builderFromReader(rdr)
+
+}
+
+func packageFromURL(ctx context.Context, source string) (vpkg.Builder, error) {
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, source, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("failed to download package '%s': %s", source, resp.Status)
+	}
+
+	rdr, err := vpkg.Load(resp.Body)
+	if err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+
+	return builderFromReader(rdr)
+
+}
+
+func builderFromReader(rdr vpkg.Reader) (vpkg.Builder, error) {
+
+	b, err := vpkg.NewBuilderFromReader(rdr)
+	if err != nil {
+		rdr.Close()
+		return nil, err
+	}
+
+	return b, nil
+
+}
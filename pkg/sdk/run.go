@@ -0,0 +1,222 @@
+package sdk
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/vorteil/vorteil/pkg/vcfg"
+	"github.com/vorteil/vorteil/pkg/vdisk"
+	"github.com/vorteil/vorteil/pkg/virtualizers"
+)
+
+// RunArgs describe an app to build and run. The disk is built from the
+// embedded BuildArgs in the Allocator's disk format, so their Format and
+// DiskWriter are ignored.
+//
+// Config is passed to the virtualizer's Initialize function, e.g. the output
+// of qemu.Config.Marshal. Anything the VM writes to its serial port is copied
+// to Serial, if it is set. KernelArgs are appended to the image's own kernel
+// arguments by virtualizers that boot the kernel directly.
+type RunArgs struct {
+	BuildArgs
+	Allocator  virtualizers.VirtualizerAllocator
+	Config     []byte
+	Name       string
+	Serial     io.Writer
+	KernelArgs string
+}
+
+// Run builds the app described by args into a temporary disk image and runs
+// it, returning once the VM has stopped. If ctx is done first the VM is
+// stopped and ctx's error is returned. The VM and its disks are deleted
+// before Run returns.
+func Run(ctx context.Context, args RunArgs) error {
+
+	if args.Allocator == nil {
+		return errors.New("no virtualizer provided")
+	}
+
+	if !args.Allocator.IsAvailable() {
+		return errors.New("virtualizer is not available on this host")
+	}
+
+	pkg, err := openPackage(ctx, &args.BuildArgs)
+	if err != nil {
+		return err
+	}
+	defer pkg.Close()
+
+	cfg, err := vcfg.LoadFile(pkg.VCFG())
+	if err != nil {
+		return err
+	}
+
+	dir, err := ioutil.TempDir("", "vorteil-run-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	disks := &diskFiles{main: filepath.Join(dir, "disk")}
+	defer disks.Close()
+
+	f, err := os.Create(disks.main)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	bargs := args.vdisk(pkg)
+	bargs.Format = args.Allocator.DiskFormat()
+	bargs.DiskWriter = disks.create
+
+	err = vdisk.Build(ctx, f, bargs)
+	if err != nil {
+		return err
+	}
+
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+
+	err = disks.Close()
+	if err != nil {
+		return err
+	}
+
+	err = vcfg.WithDefaults(cfg, args.Logger)
+	if err != nil {
+		return err
+	}
+
+	virt := args.Allocator.Alloc()
+
+	err = virt.Initialize(args.Config)
+	if err != nil {
+		return err
+	}
+	defer virt.Close(true)
+
+	name := args.Name
+	if name == "" {
+		name = cfg.Info.Name
+	}
+
+	op := virt.Prepare(&virtualizers.PrepareArgs{
+		Name:       name,
+		PName:      virt.Type(),
+		Context:    ctx,
+		Start:      true,
+		Config:     cfg,
+		ImagePath:  disks.main,
+		Disks:      disks.paths,
+		Logger:     args.Logger,
+		KernelArgs: args.KernelArgs,
+	})
+
+	return wait(ctx, virt, op, args.Serial)
+
+}
+
+// wait copies the VM's serial output to serial until the VM stops, the
+// operation that started it fails, or ctx is done.
+func wait(ctx context.Context, virt virtualizers.Virtualizer, op *virtualizers.VirtualizeOperation, serial io.Writer) error {
+
+	sub := virt.Serial().Subscribe()
+	defer sub.Close()
+	inbox := sub.Inbox()
+
+	errs := op.Error
+
+	ticker := time.NewTicker(time.Millisecond * 200)
+	defer ticker.Stop()
+
+	var hasBeenAlive bool
+
+	for {
+		select {
+		case err, more := <-errs:
+			if !more {
+				errs = nil
+				continue
+			}
+			if err != nil {
+				return err
+			}
+
+		case <-ticker.C:
+			switch virt.State() {
+			case virtualizers.Alive:
+				hasBeenAlive = true
+			case virtualizers.Ready:
+				if hasBeenAlive {
+					return nil
+				}
+			case virtualizers.Deleted:
+				return nil
+			}
+
+		case msg, more := <-inbox:
+			if !more {
+				return nil
+			}
+			if serial != nil {
+				_, _ = serial.Write(msg)
+			}
+
+		case <-ctx.Done():
+			_ = virt.Stop()
+			return ctx.Err()
+		}
+	}
+
+}
+
+// diskFiles creates the additional disks of a run alongside its main disk.
+type diskFiles struct {
+	main  string
+	paths []string
+	files []*os.File
+}
+
+func (d *diskFiles) create(name string) (io.WriteSeeker, error) {
+
+	f, err := os.Create(vdisk.DiskPath(d.main, name))
+	if err != nil {
+		return nil, err
+	}
+
+	d.paths = append(d.paths, f.Name())
+	d.files = append(d.files, f)
+
+	return f, nil
+
+}
+
+// Close closes every file, returning the first error encountered.
+func (d *diskFiles) Close() error {
+
+	var err error
+
+	for _, f := range d.files {
+		e := f.Close()
+		if e != nil && err == nil {
+			err = e
+		}
+	}
+	d.files = nil
+
+	return err
+
+}
@@ -0,0 +1,96 @@
+package sdk
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/vorteil/vorteil/pkg/elog"
+	"github.com/vorteil/vorteil/pkg/vcfg"
+	"github.com/vorteil/vorteil/pkg/vio"
+	"github.com/vorteil/vorteil/pkg/vproj"
+)
+
+func TestPackage(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "sdk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		vproj.FileName: "[[target]]\nname = \"default\"\nvcfgs = [\"default.vcfg\"]\n",
+		"default.vcfg": "[[program]]\nbinary = \"/app\"\n",
+		"app":          "#!/bin/app",
+	}
+
+	for name, data := range files {
+		err = ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx := context.Background()
+
+	_, err = Package(ctx, dir+":missing")
+	if err == nil {
+		t.Errorf("expected an error for a missing target")
+	}
+
+	b, err := Package(ctx, dir+":default")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	args := &BuildArgs{
+		Package: b,
+		VCFGs:   []*vcfg.VCFG{{System: vcfg.SystemSettings{Hostname: "sdk"}}},
+	}
+
+	_, err = openPackage(ctx, args)
+	if err != errNoLogger {
+		t.Errorf("expected an error without a logger, got %v", err)
+	}
+
+	args.Logger = &elog.CLI{}
+
+	pkg, err := openPackage(ctx, args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pkg.Close()
+
+	cfg, err := vcfg.LoadFile(pkg.VCFG())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.System.Hostname != "sdk" || len(cfg.Programs) != 1 {
+		t.Errorf("VCFG overrides weren't merged: %+v", cfg)
+	}
+
+	found := false
+	err = pkg.FS().Walk(func(path string, f vio.File) error {
+		if path == "./app" {
+			found = true
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !found {
+		t.Errorf("expected the app in the package's file-system")
+	}
+
+}
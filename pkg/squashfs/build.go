@@ -0,0 +1,434 @@
+package squashfs
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/vorteil/vorteil/pkg/vio"
+)
+
+type node struct {
+	tree     *vio.TreeNode
+	children []*node
+	number   uint32
+	ref      uint64
+
+	// regular files
+	start  uint64
+	blocks []uint32
+	sparse uint64
+
+	// symlinks
+	target string
+
+	// directories
+	listing     uint64
+	listingSize int
+}
+
+// basicType returns the type of inode n has, ignoring the extended types,
+// which is what directory entries record.
+func (n *node) basicType() uint16 {
+
+	f := n.tree.File
+
+	switch {
+	case f.IsDir():
+		return inodeDir
+	case f.IsSymlink():
+		return inodeSymlink
+	case f.Special() == os.ModeDevice:
+		return inodeBlockDevice
+	case f.Special() == os.ModeDevice|os.ModeCharDevice:
+		return inodeCharDevice
+	case f.Special() == os.ModeNamedPipe:
+		return inodeFIFO
+	default:
+		return inodeFile
+	}
+
+}
+
+type builder struct {
+	spool     *os.File
+	timestamp time.Time
+
+	compressor
+	block    []byte
+	dataSize uint64
+
+	root   *node
+	count  uint32
+	ids    []uint32
+	idIdx  map[uint32]uint16
+	inodes metadataWriter
+	dirs   metadataWriter
+}
+
+func newBuilder(spool *os.File, t time.Time) *builder {
+	return &builder{
+		spool:     spool,
+		timestamp: t,
+		block:     make([]byte, BlockSize),
+		idIdx:     make(map[uint32]uint16),
+	}
+}
+
+// build reads every file in the tree in order, compressing the contents of
+// regular files into the spool, then writes the inode and directory tables.
+func (b *builder) build(ctx context.Context, tree vio.FileTree) error {
+
+	nodes := make(map[*vio.TreeNode]*node)
+
+	err := tree.WalkNode(func(path string, n *vio.TreeNode) error {
+
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		x := &node{tree: n}
+		nodes[n] = x
+		if n.Parent == nil || n.Parent == n {
+			b.root = x
+		} else {
+			parent := nodes[n.Parent]
+			parent.children = append(parent.children, x)
+		}
+
+		switch x.basicType() {
+		case inodeFile:
+			err := b.writeData(x)
+			if err != nil {
+				return fmt.Errorf("failed to read '%s': %w", path, err)
+			}
+		case inodeSymlink:
+			x.target = n.File.Symlink()
+			if !n.File.SymlinkIsCached() {
+				data, err := ioutil.ReadAll(n.File)
+				if err != nil {
+					return fmt.Errorf("failed to read '%s': %w", path, err)
+				}
+				x.target = string(data)
+			}
+			_ = n.File.Close()
+		}
+
+		return nil
+
+	})
+	if err != nil {
+		return err
+	}
+
+	b.number(b.root)
+
+	return b.writeInodes(ctx, b.root, b.count+1)
+
+}
+
+// writeData compresses the contents of a regular file into the spool one
+// block at a time. Blocks full of zeroes are left out, and recorded as holes.
+func (b *builder) writeData(n *node) error {
+
+	defer n.tree.File.Close()
+
+	n.start = SuperblockSize + b.dataSize
+	size := int64(n.tree.File.Size())
+
+	for size > 0 {
+
+		k := int64(BlockSize)
+		if k > size {
+			k = size
+		}
+		size -= k
+
+		p := b.block[:k]
+		_, err := io.ReadFull(n.tree.File, p)
+		if err != nil {
+			return err
+		}
+
+		if isZeroes(p) {
+			n.blocks = append(n.blocks, 0)
+			n.sparse += uint64(k)
+			continue
+		}
+
+		data, compressed := b.compress(p)
+		_, err = b.spool.Write(data)
+		if err != nil {
+			return err
+		}
+
+		x := uint32(len(data))
+		if !compressed {
+			x |= dataUncompressed
+		}
+		n.blocks = append(n.blocks, x)
+		b.dataSize += uint64(len(data))
+
+	}
+
+	return nil
+
+}
+
+func isZeroes(p []byte) bool {
+
+	for _, x := range p {
+		if x != 0 {
+			return false
+		}
+	}
+
+	return true
+
+}
+
+// number sorts the children of every directory by name and numbers the
+// inodes in the order writeInodes writes them: each directory after
+// everything in it.
+func (b *builder) number(n *node) {
+
+	sort.Slice(n.children, func(i, j int) bool {
+		return n.children[i].tree.File.Name() < n.children[j].tree.File.Name()
+	})
+
+	for _, child := range n.children {
+		b.number(child)
+	}
+
+	b.count++
+	n.number = b.count
+
+}
+
+// id returns the index of a user or group ID in the ID table, adding it if it
+// isn't there yet.
+func (b *builder) id(x uint32) (uint16, error) {
+
+	if idx, ok := b.idIdx[x]; ok {
+		return idx, nil
+	}
+
+	if len(b.ids) == math.MaxUint16 {
+		return 0, fmt.Errorf("more than %d distinct user and group IDs", math.MaxUint16)
+	}
+
+	idx := uint16(len(b.ids))
+	b.ids = append(b.ids, x)
+	b.idIdx[x] = idx
+
+	return idx, nil
+
+}
+
+// writeInodes writes the inodes of everything in a directory, then its
+// listing in the directory table, then its own inode, because each of those
+// needs to know where the ones before it were written.
+func (b *builder) writeInodes(ctx context.Context, n *node, parent uint32) error {
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	for _, child := range n.children {
+		err := b.writeInodes(ctx, child, n.number)
+		if err != nil {
+			return err
+		}
+	}
+
+	if n.tree.File.IsDir() {
+		err := b.writeListing(n)
+		if err != nil {
+			return err
+		}
+	}
+
+	return b.writeInode(n, parent)
+
+}
+
+// writeListing writes a directory's entries to the directory table. Entries
+// are grouped under headers, and each group must be no bigger than
+// maxDirEntries and point to inodes in the same metadata block whose numbers
+// are within 16 bits of the header's.
+func (b *builder) writeListing(n *node) error {
+
+	n.listing = b.dirs.ref()
+	buf := new(bytes.Buffer)
+
+	for i := 0; i < len(n.children); {
+
+		first := n.children[i]
+		block := uint32(first.ref >> 16)
+
+		j := i + 1
+		for ; j < len(n.children) && j-i < maxDirEntries; j++ {
+			x := n.children[j]
+			delta := int64(x.number) - int64(first.number)
+			if uint32(x.ref>>16) != block || delta < math.MinInt16 || delta > math.MaxInt16 {
+				break
+			}
+		}
+
+		_ = binary.Write(buf, binary.LittleEndian, []uint32{uint32(j - i - 1), block, first.number})
+
+		for _, x := range n.children[i:j] {
+			name := x.tree.File.Name()
+			if len(name) == 0 || len(name) > 256 {
+				return fmt.Errorf("invalid file name '%s'", name)
+			}
+			_ = binary.Write(buf, binary.LittleEndian, struct {
+				Offset     uint16
+				InodeDelta int16
+				Type       uint16
+				NameSize   uint16
+			}{
+				Offset:     uint16(x.ref),
+				InodeDelta: int16(int64(x.number) - int64(first.number)),
+				Type:       x.basicType(),
+				NameSize:   uint16(len(name) - 1),
+			})
+			buf.WriteString(name)
+		}
+
+		i = j
+
+	}
+
+	// the size includes the '.' and '..' entries, which aren't stored
+	n.listingSize = buf.Len() + 3
+	_, _ = b.dirs.Write(buf.Bytes())
+
+	return nil
+
+}
+
+func (b *builder) writeInode(n *node, parent uint32) error {
+
+	own := n.tree.File.Ownership()
+	if own == nil {
+		own = &vio.DefaultOwnership
+	}
+
+	uid, err := b.id(own.UID)
+	if err != nil {
+		return err
+	}
+
+	gid, err := b.id(own.GID)
+	if err != nil {
+		return err
+	}
+
+	typ := n.basicType()
+	var body []interface{}
+	f := n.tree.File
+	links := uint32(n.tree.Links)
+
+	switch typ {
+	case inodeDir:
+		block, offset := uint32(n.listing>>16), uint16(n.listing)
+		if n.listingSize > math.MaxUint16 {
+			typ = inodeExtendedDir
+			body = []interface{}{links, uint32(n.listingSize), block, parent, uint16(0), offset, uint32(noIndex)}
+		} else {
+			body = []interface{}{block, links, uint16(n.listingSize), offset, parent}
+		}
+	case inodeFile:
+		size := uint64(f.Size())
+		if n.start > math.MaxUint32 || size > math.MaxUint32 {
+			typ = inodeExtendedFile
+			body = []interface{}{n.start, size, n.sparse, links, uint32(noIndex), uint32(0), uint32(noIndex)}
+		} else {
+			body = []interface{}{uint32(n.start), uint32(noIndex), uint32(0), uint32(size)}
+		}
+		body = append(body, n.blocks)
+	case inodeSymlink:
+		body = []interface{}{links, uint32(len(n.target)), []byte(n.target)}
+	case inodeBlockDevice, inodeCharDevice:
+		major, minor := f.Device()
+		dev := minor&0xff | major<<8 | (minor&^0xff)<<12
+		body = []interface{}{links, dev}
+	default:
+		body = []interface{}{links}
+	}
+
+	n.ref = b.inodes.ref()
+
+	buf := new(bytes.Buffer)
+	_ = binary.Write(buf, binary.LittleEndian, []uint16{typ, uint16(own.Mode & vio.ModeMask), uid, gid})
+	_ = binary.Write(buf, binary.LittleEndian, []uint32{uint32(b.timestamp.Unix()), n.number})
+	for _, x := range body {
+		_ = binary.Write(buf, binary.LittleEndian, x)
+	}
+
+	_, _ = b.inodes.Write(buf.Bytes())
+
+	return nil
+
+}
+
+// layout places the tables after the file contents and returns the
+// superblock along with the tables.
+func (b *builder) layout() (superblock, []byte) {
+
+	idTable := new(metadataWriter)
+	_ = binary.Write(idTable, binary.LittleEndian, b.ids)
+
+	inodes := b.inodes.bytes()
+	dirs := b.dirs.bytes()
+	ids := idTable.bytes()
+
+	inodeTableStart := uint64(SuperblockSize) + b.dataSize
+	dirTableStart := inodeTableStart + uint64(len(inodes))
+	idBlocksStart := dirTableStart + uint64(len(dirs))
+	idTableStart := idBlocksStart + uint64(len(ids))
+
+	tables := new(bytes.Buffer)
+	tables.Write(inodes)
+	tables.Write(dirs)
+	tables.Write(ids)
+	for _, start := range idTable.starts {
+		_ = binary.Write(tables, binary.LittleEndian, idBlocksStart+uint64(start))
+	}
+
+	super := superblock{
+		Magic:               Magic,
+		Inodes:              b.count,
+		ModificationTime:    uint32(b.timestamp.Unix()),
+		BlockSize:           BlockSize,
+		Compression:         compressionZlib,
+		BlockLog:            BlockLog,
+		Flags:               flagNoFragments | flagNoXattrs,
+		IDs:                 uint16(len(b.ids)),
+		VersionMajor:        4,
+		RootInode:           b.root.ref,
+		BytesUsed:           inodeTableStart + uint64(tables.Len()),
+		IDTableStart:        idTableStart,
+		XattrTableStart:     noTable,
+		InodeTableStart:     inodeTableStart,
+		DirectoryTableStart: dirTableStart,
+		FragmentTableStart:  noTable,
+		ExportTableStart:    noTable,
+	}
+
+	return super, tables.Bytes()
+
+}
@@ -0,0 +1,211 @@
+package squashfs
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/vorteil/vorteil/pkg/elog"
+	"github.com/vorteil/vorteil/pkg/vio"
+)
+
+// CompilerArgs organizes all inputs necessary to create a new Compiler.
+type CompilerArgs struct {
+	FileTree vio.FileTree
+	Logger   elog.Logger
+}
+
+// Compiler builds a read-only SquashFS file-system. Compilation happens in the
+// same stages as the other file-system compilers: NewCompiler, Commit,
+// Precompile, Compile. Because the file-system is compressed its size can't
+// be known until the contents have been compressed, so Commit does that,
+// spooling the compressed data into a temporary file until Compile copies it
+// out.
+type Compiler struct {
+	log  elog.Logger
+	tree vio.FileTree
+
+	// timestamp is written to the superblock and every inode instead of the
+	// current time, if it is set.
+	timestamp time.Time
+
+	spool  *os.File
+	super  superblock
+	tables []byte
+	size   int64
+}
+
+// NewCompiler returns an initialized Compiler object. Its contents can be
+// modified with Mkdir and AddFile before calling Commit.
+func NewCompiler(args *CompilerArgs) *Compiler {
+	return &Compiler{
+		log:  args.Logger,
+		tree: args.FileTree,
+	}
+}
+
+// Mkdir adds an empty directory to the file-system at 'path' if no file or
+// directory is already mapped there. It must be called before Commit.
+func (c *Compiler) Mkdir(path string) error {
+
+	_, base := filepath.Split(path)
+	err := c.tree.Map(path, vio.CustomFile(vio.CustomFileArgs{
+		Name:  base,
+		IsDir: true,
+	}))
+	if err != nil {
+		return err
+	}
+
+	return nil
+
+}
+
+// AddFile adds a file to the file-system at 'path'. It must be called before
+// Commit.
+func (c *Compiler) AddFile(path string, r io.ReadCloser, size int64, force bool) error {
+
+	_, base := filepath.Split(path)
+	err := c.tree.Map(path, vio.CustomFile(vio.CustomFileArgs{
+		Name:       base,
+		Size:       int(size),
+		ReadCloser: r,
+	}))
+	if err != nil {
+		return err
+	}
+
+	return nil
+
+}
+
+// IncreaseMinimumInodes does nothing, because a SquashFS file-system can't
+// be written to, so there's no point in reserving inodes for later.
+func (c *Compiler) IncreaseMinimumInodes(inodes int64) {
+}
+
+// SetMinimumInodes does nothing, for the same reason as IncreaseMinimumInodes.
+func (c *Compiler) SetMinimumInodes(inodes int64) {
+}
+
+// SetMinimumInodesPer64MiB does nothing, for the same reason as
+// IncreaseMinimumInodes.
+func (c *Compiler) SetMinimumInodesPer64MiB(inodes int64) {
+}
+
+// IncreaseMinimumFreeSpace does nothing, because a SquashFS file-system can't
+// be written to, so free space inside it would be wasted.
+func (c *Compiler) IncreaseMinimumFreeSpace(space int64) {
+}
+
+// Reproduce makes the Compiler write t to the superblock and every inode
+// instead of the current time. The seed is unused, because a SquashFS
+// file-system has no random identifiers.
+func (c *Compiler) Reproduce(seed int64, t time.Time) {
+	c.timestamp = t
+}
+
+// Commit compresses the contents of the file-system and lays out its tables,
+// after which MinimumSize returns the exact size of the file-system. Any
+// calls to functions that change the contents of the file-system must be
+// done before this function is called.
+func (c *Compiler) Commit(ctx context.Context) error {
+
+	if c.timestamp.IsZero() {
+		c.timestamp = time.Now()
+	}
+
+	spool, err := newSpool()
+	if err != nil {
+		return err
+	}
+
+	b := newBuilder(spool, c.timestamp)
+
+	err = b.build(ctx, c.tree)
+	if err != nil {
+		_ = closeSpool(spool)
+		return err
+	}
+
+	c.spool = spool
+	c.super, c.tables = b.layout()
+
+	return nil
+
+}
+
+// MinimumSize returns the number of bytes needed to contain the file-system,
+// rounded up to a multiple of 4 KiB. It can be called after a successful call
+// to Commit.
+func (c *Compiler) MinimumSize() int64 {
+	return align(int64(c.super.BytesUsed), PadSize)
+}
+
+// Precompile locks in the size of the space the file-system is written to.
+// Anything after the file-system itself is left as a hole.
+func (c *Compiler) Precompile(ctx context.Context, size int64) error {
+
+	if size < c.MinimumSize() {
+		return errors.New("insufficient size to contain the squashfs file-system")
+	}
+
+	c.size = size
+	return nil
+
+}
+
+// RegionIsHole reports whether a region of the space passed to Precompile is
+// entirely after the end of the file-system.
+func (c *Compiler) RegionIsHole(begin, size int64) bool {
+	return begin >= c.MinimumSize()
+}
+
+// Compile writes the file-system to w, and removes the temporary file its
+// contents were spooled into.
+func (c *Compiler) Compile(ctx context.Context, w io.WriteSeeker) error {
+
+	defer func() {
+		_ = closeSpool(c.spool)
+	}()
+
+	err := c.super.write(w)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.spool.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(w, c.spool)
+	if err != nil {
+		return err
+	}
+
+	if err = ctx.Err(); err != nil {
+		return err
+	}
+
+	_, err = w.Write(c.tables)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Seek(c.size, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	return nil
+
+}
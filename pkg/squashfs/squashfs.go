@@ -0,0 +1,218 @@
+// Package squashfs builds SquashFS 4.0 file-systems: compressed, read-only
+// file-systems that Linux can mount directly. They suit immutable root
+// file-systems, where the size of the image matters more than being able to
+// write to it.
+package squashfs
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+const (
+	// Magic identifies a SquashFS superblock.
+	Magic = 0x73717368
+
+	// BlockLog is the base 2 logarithm of BlockSize.
+	BlockLog = 17
+
+	// BlockSize is the size of the chunks file contents are compressed in.
+	BlockSize = 1 << BlockLog
+
+	// SuperblockSize is the size of the superblock at the start of the
+	// file-system. File contents follow it immediately.
+	SuperblockSize = 96
+
+	// PadSize is what the size of the file-system is rounded up to, so that
+	// it can be read in whole device blocks.
+	PadSize = 4096
+
+	// metadataBlockSize is the most uncompressed data a metadata block
+	// holds.
+	metadataBlockSize = 8192
+
+	// metadataUncompressed is set in a metadata block's header if its data
+	// is stored uncompressed.
+	metadataUncompressed = 0x8000
+
+	// dataUncompressed is set in a data block's size if its data is stored
+	// uncompressed.
+	dataUncompressed = 1 << 24
+
+	compressionZlib = 1
+
+	flagNoFragments = 0x10
+	flagNoXattrs    = 0x200
+
+	// noTable is the start of tables the file-system doesn't have.
+	noTable = 0xFFFFFFFFFFFFFFFF
+
+	// noIndex marks the absence of a fragment or extended attributes.
+	noIndex = 0xFFFFFFFF
+
+	// maxDirEntries is the most entries that can share a directory header.
+	maxDirEntries = 256
+)
+
+// inode types
+const (
+	inodeDir = iota + 1
+	inodeFile
+	inodeSymlink
+	inodeBlockDevice
+	inodeCharDevice
+	inodeFIFO
+	inodeSocket
+	inodeExtendedDir
+	inodeExtendedFile
+)
+
+type superblock struct {
+	Magic               uint32
+	Inodes              uint32
+	ModificationTime    uint32
+	BlockSize           uint32
+	Fragments           uint32
+	Compression         uint16
+	BlockLog            uint16
+	Flags               uint16
+	IDs                 uint16
+	VersionMajor        uint16
+	VersionMinor        uint16
+	RootInode           uint64
+	BytesUsed           uint64
+	IDTableStart        uint64
+	XattrTableStart     uint64
+	InodeTableStart     uint64
+	DirectoryTableStart uint64
+	FragmentTableStart  uint64
+	ExportTableStart    uint64
+}
+
+func (s *superblock) write(w io.Writer) error {
+	return binary.Write(w, binary.LittleEndian, s)
+}
+
+func align(x, y int64) int64 {
+	return (x + y - 1) / y * y
+}
+
+// compressor compresses blocks with zlib, which SquashFS calls gzip.
+type compressor struct {
+	buf bytes.Buffer
+	zw  *zlib.Writer
+}
+
+// compress returns the compressed form of p and true, or p itself and false
+// if compressing it doesn't make it any smaller. The returned slice is only
+// valid until the next call.
+func (c *compressor) compress(p []byte) ([]byte, bool) {
+
+	c.buf.Reset()
+	if c.zw == nil {
+		c.zw = zlib.NewWriter(&c.buf)
+	} else {
+		c.zw.Reset(&c.buf)
+	}
+
+	// writing to a bytes.Buffer never fails
+	_, _ = c.zw.Write(p)
+	_ = c.zw.Close()
+
+	if c.buf.Len() >= len(p) {
+		return p, false
+	}
+
+	return c.buf.Bytes(), true
+
+}
+
+// metadataWriter packs a table into metadata blocks, each of which holds up
+// to 8 KiB of data after a 16 bit header giving its stored size.
+type metadataWriter struct {
+	compressor
+	out    bytes.Buffer
+	block  []byte
+	starts []int64
+}
+
+// ref returns a reference to the next byte written: the offset of its
+// metadata block from the start of the table in the upper bits, and its
+// offset within the block's uncompressed data in the lower 16.
+func (m *metadataWriter) ref() uint64 {
+	return uint64(m.out.Len())<<16 | uint64(len(m.block))
+}
+
+func (m *metadataWriter) Write(p []byte) (int, error) {
+
+	n := len(p)
+
+	for len(p) > 0 {
+		k := metadataBlockSize - len(m.block)
+		if k > len(p) {
+			k = len(p)
+		}
+		m.block = append(m.block, p[:k]...)
+		p = p[k:]
+		if len(m.block) == metadataBlockSize {
+			m.flush()
+		}
+	}
+
+	return n, nil
+
+}
+
+// flush writes out the partially filled block, if there is one.
+func (m *metadataWriter) flush() {
+
+	if len(m.block) == 0 {
+		return
+	}
+
+	data, compressed := m.compress(m.block)
+	header := uint16(len(data))
+	if !compressed {
+		header |= metadataUncompressed
+	}
+
+	m.starts = append(m.starts, int64(m.out.Len()))
+	_ = binary.Write(&m.out, binary.LittleEndian, header)
+	m.out.Write(data)
+	m.block = m.block[:0]
+
+}
+
+// bytes flushes the table and returns all of its metadata blocks.
+func (m *metadataWriter) bytes() []byte {
+	m.flush()
+	return m.out.Bytes()
+}
+
+func newSpool() (*os.File, error) {
+	return ioutil.TempFile("", "vorteil-squashfs-")
+}
+
+func closeSpool(f *os.File) error {
+
+	if f == nil {
+		return nil
+	}
+
+	err := f.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Remove(f.Name())
+
+}
@@ -0,0 +1,252 @@
+package squashfs
+
+import (
+	"bytes"
+	"compress/zlib"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vorteil/vorteil/pkg/vio"
+)
+
+// readMetadata returns the uncompressed contents of a table's metadata
+// blocks.
+func readMetadata(t *testing.T, data []byte) []byte {
+
+	var out []byte
+
+	for len(data) > 0 {
+		header := binary.LittleEndian.Uint16(data)
+		size := int(header &^ metadataUncompressed)
+		block := data[2 : 2+size]
+		data = data[2+size:]
+
+		if header&metadataUncompressed != 0 {
+			out = append(out, block...)
+			continue
+		}
+
+		r, err := zlib.NewReader(bytes.NewReader(block))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		block, err = ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out = append(out, block...)
+	}
+
+	return out
+
+}
+
+func TestMetadataWriter(t *testing.T) {
+
+	m := new(metadataWriter)
+
+	if m.ref() != 0 {
+		t.Errorf("empty table should start at reference 0, got %#x", m.ref())
+	}
+
+	_, _ = m.Write(make([]byte, metadataBlockSize+10))
+
+	ref := m.ref()
+	if ref&0xffff != 10 {
+		t.Errorf("reference has the wrong offset in its block: %#x", ref)
+	}
+	if ref>>16 == 0 || ref>>16 != uint64(m.out.Len()) {
+		t.Errorf("reference should point to the second block: %#x", ref)
+	}
+
+	data := m.bytes()
+	if len(m.starts) != 2 {
+		t.Fatalf("expected two blocks, got %d", len(m.starts))
+	}
+
+	header := binary.LittleEndian.Uint16(data)
+	if header&metadataUncompressed != 0 {
+		t.Errorf("block of zeroes was stored uncompressed")
+	}
+	if int64(header)+2 != m.starts[1] {
+		t.Errorf("first block's header has the wrong size: %d", header)
+	}
+
+	// a few bytes can't be made smaller by compressing them
+	m = new(metadataWriter)
+	_, _ = m.Write([]byte{1, 2, 3})
+	data = m.bytes()
+	if !bytes.Equal(data, []byte{3, 0x80, 1, 2, 3}) {
+		t.Errorf("small block should be stored uncompressed: %x", data)
+	}
+
+}
+
+func TestListingHeaders(t *testing.T) {
+
+	tree := vio.NewFileTree()
+	for i := 0; i < maxDirEntries+10; i++ {
+		name := fmt.Sprintf("/dir/%04d", i)
+		err := tree.Map(name, vio.CustomFile(vio.CustomFileArgs{
+			Name:  name[5:],
+			IsDir: true,
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	spool, err := newSpool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeSpool(spool)
+
+	b := newBuilder(spool, time.Unix(0, 0))
+	err = b.build(context.Background(), tree)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := b.root.children[0]
+	if dir.number != uint32(len(dir.children)+1) || b.root.number != dir.number+1 {
+		t.Errorf("directories should be numbered after their contents: %d, %d", dir.number, b.root.number)
+	}
+
+	// two headers, and an entry of 12 bytes per child
+	expect := 2*12 + len(dir.children)*(8+4) + 3
+	if dir.listingSize != expect {
+		t.Errorf("listing should be %d bytes, got %d", expect, dir.listingSize)
+	}
+
+	listing := readMetadata(t, b.dirs.bytes())
+	if binary.LittleEndian.Uint32(listing) != maxDirEntries-1 {
+		t.Errorf("first header should have %d entries, got %d", maxDirEntries, binary.LittleEndian.Uint32(listing)+1)
+	}
+
+	second := listing[12+maxDirEntries*12:]
+	if binary.LittleEndian.Uint32(second) != 9 || binary.LittleEndian.Uint32(second[8:]) != maxDirEntries+1 {
+		t.Errorf("second header is wrong: %x", second[:12])
+	}
+
+}
+
+func TestCompile(t *testing.T) {
+
+	tree := vio.NewFileTree()
+	data := []byte(strings.Repeat("vorteil", BlockSize/4))
+
+	for path, args := range map[string]vio.CustomFileArgs{
+		"/a": {
+			Size:       len(data),
+			ReadCloser: ioutil.NopCloser(bytes.NewReader(data)),
+			Ownership:  &vio.Ownership{UID: 1, GID: 2, Mode: 0644},
+		},
+		"/b": {
+			Size:       BlockSize,
+			ReadCloser: ioutil.NopCloser(bytes.NewReader(make([]byte, BlockSize))),
+		},
+		"/c": {
+			IsSymlink: true,
+			Symlink:   "a",
+		},
+	} {
+		args.Name = path[1:]
+		err := tree.Map(path, vio.CustomFile(args))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c := NewCompiler(&CompilerArgs{FileTree: tree})
+	err := c.Mkdir("dev")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.Reproduce(0, time.Unix(1000, 0))
+
+	ctx := context.Background()
+	err = c.Commit(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	size := c.MinimumSize()
+	if size%PadSize != 0 || size < int64(c.super.BytesUsed) {
+		t.Errorf("minimum size %d doesn't fit %d bytes", size, c.super.BytesUsed)
+	}
+
+	err = c.Precompile(ctx, size-PadSize)
+	if err == nil {
+		t.Errorf("precompile accepted a size that's too small")
+	}
+
+	err = c.Precompile(ctx, size+PadSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.RegionIsHole(0, PadSize) || !c.RegionIsHole(size, PadSize) {
+		t.Errorf("holes are in the wrong place")
+	}
+
+	f, err := ioutil.TempFile("", "squashfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	err = c.Compile(ctx, f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	img, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if int64(len(img)) != int64(c.super.BytesUsed) {
+		t.Errorf("wrote %d bytes, but the superblock says %d", len(img), c.super.BytesUsed)
+	}
+
+	super := new(superblock)
+	err = binary.Read(bytes.NewReader(img), binary.LittleEndian, super)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if super.Magic != Magic || super.VersionMajor != 4 || super.BlockSize != BlockSize || super.BlockLog != BlockLog {
+		t.Errorf("superblock is wrong: %+v", super)
+	}
+
+	if super.Inodes != 5 || super.IDs != 3 || super.ModificationTime != 1000 {
+		t.Errorf("expected 5 inodes, 3 IDs and the reproducible time: %+v", super)
+	}
+
+	if !(super.InodeTableStart < super.DirectoryTableStart && super.DirectoryTableStart < super.IDTableStart) {
+		t.Errorf("tables are out of order: %+v", super)
+	}
+
+	// the ID table's index is the last thing in the file-system
+	idBlock := binary.LittleEndian.Uint64(img[super.IDTableStart:])
+	if super.IDTableStart+8 != super.BytesUsed || idBlock <= super.DirectoryTableStart {
+		t.Errorf("ID table index is wrong: %d", idBlock)
+	}
+
+	// the compressible file takes far less than its size, and the block of
+	// zeroes takes no space at all
+	if super.InodeTableStart-SuperblockSize > uint64(len(data))/10 {
+		t.Errorf("file contents weren't compressed: %d bytes", super.InodeTableStart-SuperblockSize)
+	}
+
+}
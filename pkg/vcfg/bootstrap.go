@@ -5,6 +5,15 @@ package vcfg
  * Copyright 2020 vorteil.io Pty Ltd
  */
 
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+)
+
 // Command ...
 type Command string
 
@@ -16,4 +25,131 @@ const (
 	BootstrapSleep                  = "SLEEP"
 	BootstrapFindAndReplace         = "FIND_AND_REPLACE"
 	BootstrapGetRequest             = "GET"
+
+	// BootstrapWaitTCP waits until a TCP connection to host:port succeeds,
+	// optionally giving up after a timeout: "WAIT_TCP db:5432 30s".
+	BootstrapWaitTCP = "WAIT_TCP"
+
+	// BootstrapFetch downloads a URL to an absolute path:
+	// "FETCH https://example.com/app.conf /etc/app.conf".
+	BootstrapFetch = "FETCH"
+
+	// BootstrapTemplate replaces the $VAR and ${VAR} references in a file
+	// with the values of the program's environment variables, leaving
+	// references to variables that aren't set alone:
+	// "TEMPLATE /etc/app.conf".
+	BootstrapTemplate = "TEMPLATE"
 )
+
+// bootstrapValidators check the arguments of each bootstrap command.
+var bootstrapValidators = map[string]func(args []string) error{
+	BootstrapWaitFile:       minBootstrapArgs(1),
+	BootstrapWaitPort:       minBootstrapArgs(1),
+	BootstrapSleep:          minBootstrapArgs(1),
+	BootstrapFindAndReplace: minBootstrapArgs(1),
+	BootstrapGetRequest:     minBootstrapArgs(1),
+	BootstrapWaitTCP:        validateBootstrapWaitTCP,
+	BootstrapFetch:          validateBootstrapFetch,
+	BootstrapTemplate:       validateBootstrapTemplate,
+}
+
+func minBootstrapArgs(n int) func(args []string) error {
+	return func(args []string) error {
+		if len(args) < n {
+			return fmt.Errorf("expected at least %d arguments", n)
+		}
+		return nil
+	}
+}
+
+func validateBootstrapWaitTCP(args []string) error {
+
+	if len(args) < 1 || len(args) > 2 {
+		return fmt.Errorf("expected host:port and an optional timeout")
+	}
+
+	host, port, err := net.SplitHostPort(args[0])
+	if err != nil || host == "" {
+		return fmt.Errorf("invalid address '%s': expected host:port", args[0])
+	}
+
+	n, err := strconv.Atoi(port)
+	if err != nil || n <= 0 || n > 65535 {
+		return fmt.Errorf("invalid port '%s'", port)
+	}
+
+	if len(args) == 2 {
+		d, err := DurationFromString(args[1])
+		if err != nil || d <= 0 {
+			return fmt.Errorf("invalid timeout '%s'", args[1])
+		}
+	}
+
+	return nil
+
+}
+
+func validateBootstrapFetch(args []string) error {
+
+	if len(args) != 2 {
+		return fmt.Errorf("expected a URL and a path")
+	}
+
+	u, err := url.Parse(args[0])
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid URL '%s': expected an http or https URL", args[0])
+	}
+
+	if !path.IsAbs(args[1]) {
+		return fmt.Errorf("invalid path '%s': must be an absolute path", args[1])
+	}
+
+	return nil
+
+}
+
+func validateBootstrapTemplate(args []string) error {
+
+	if len(args) != 1 {
+		return fmt.Errorf("expected a path")
+	}
+
+	if !path.IsAbs(args[0]) {
+		return fmt.Errorf("invalid path '%s': must be an absolute path", args[0])
+	}
+
+	return nil
+
+}
+
+// BootstrapCommands returns the names of every bootstrap command.
+func BootstrapCommands() []string {
+	return []string{
+		BootstrapWaitFile, BootstrapWaitPort, BootstrapWaitTCP, BootstrapSleep,
+		BootstrapFindAndReplace, BootstrapGetRequest, BootstrapFetch,
+		BootstrapTemplate,
+	}
+}
+
+// ValidateBootstrap checks a bootstrap step, which is a command followed by
+// its arguments separated by spaces.
+func ValidateBootstrap(step string) error {
+
+	fields := strings.Fields(step)
+	if len(fields) == 0 {
+		return fmt.Errorf("empty bootstrap step")
+	}
+
+	fn, ok := bootstrapValidators[fields[0]]
+	if !ok {
+		return fmt.Errorf("unknown bootstrap command '%s' (expected one of: %s)", fields[0], strings.Join(BootstrapCommands(), ", "))
+	}
+
+	err := fn(fields[1:])
+	if err != nil {
+		return fmt.Errorf("bootstrap step '%s': %v", step, err)
+	}
+
+	return nil
+
+}
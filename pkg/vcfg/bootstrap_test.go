@@ -0,0 +1,50 @@
+package vcfg
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateBootstrap(t *testing.T) {
+
+	good := []string{
+		"SLEEP 3000",
+		"WAIT_FILE /tmp/ready",
+		"WAIT_PORT 8080",
+		"WAIT_TCP db:5432",
+		"WAIT_TCP [fd00::1]:5432 1m",
+		"FETCH https://example.com/app.conf /etc/app.conf",
+		"TEMPLATE /etc/app.conf",
+	}
+
+	for _, step := range good {
+		assert.NoError(t, ValidateBootstrap(step), step)
+	}
+
+	bad := []string{
+		"",
+		"SLEEP",
+		"REBOOT now",
+		"WAIT_TCP db",
+		"WAIT_TCP :5432",
+		"WAIT_TCP db:99999",
+		"WAIT_TCP db:5432 soon",
+		"WAIT_TCP db:5432 30s extra",
+		"FETCH https://example.com/app.conf",
+		"FETCH ftp://example.com/app.conf /etc/app.conf",
+		"FETCH https://example.com/app.conf etc/app.conf",
+		"TEMPLATE",
+		"TEMPLATE app.conf",
+	}
+
+	for _, step := range bad {
+		assert.Error(t, ValidateBootstrap(step), step)
+	}
+
+}
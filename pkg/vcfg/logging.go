@@ -0,0 +1,213 @@
+package vcfg
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// DefaultLoggingType is the source of logs shipped by a logging driver if the
+// Logging doesn't specify one: the stdout and stderr of every program.
+const DefaultLoggingType = "programs"
+
+// LoggingDriver generates the log agent configuration for a kind of log sink
+// from the fields of a Logging.
+type LoggingDriver func(l *Logging) ([]string, error)
+
+var registeredLoggingDrivers = map[string]LoggingDriver{
+	"syslog":  syslogLoggingDriver,
+	"fluentd": fluentdLoggingDriver,
+	"file":    fileLoggingDriver,
+}
+
+// RegisterLoggingDriver registers a LoggingDriver with a given name.
+func RegisterLoggingDriver(name string, fn LoggingDriver) error {
+
+	if _, exists := registeredLoggingDrivers[name]; exists {
+		return fmt.Errorf("refusing to register logging driver '%s': already registered", name)
+	}
+
+	registeredLoggingDrivers[name] = fn
+	return nil
+
+}
+
+// LoggingDrivers returns an alphabetised list of all registered logging
+// drivers.
+func LoggingDrivers() []string {
+
+	var names = []string{}
+	for k := range registeredLoggingDrivers {
+		names = append(names, k)
+	}
+
+	sort.Strings(names)
+	return names
+
+}
+
+// Expand replaces the Logging's driver settings with the Config they
+// generate, which is put before any Config that was set explicitly so that it
+// can override the generated values. Expand does nothing if no Driver is set,
+// which means it is safe to call more than once.
+func (l *Logging) Expand() error {
+
+	if l.Driver == "" {
+		return nil
+	}
+
+	fn, ok := registeredLoggingDrivers[l.Driver]
+	if !ok {
+		return fmt.Errorf("unknown logging driver '%s' (expected one of: %s)", l.Driver, strings.Join(LoggingDrivers(), ", "))
+	}
+
+	cfg, err := fn(l)
+	if err != nil {
+		return fmt.Errorf("logging driver '%s': %w", l.Driver, err)
+	}
+
+	if l.Type == "" {
+		l.Type = DefaultLoggingType
+	}
+
+	l.Config = append(cfg, l.Config...)
+	l.Driver = ""
+	l.Address = ""
+	l.Path = ""
+	l.Tag = ""
+	l.MaxSize = 0
+	l.MaxFiles = 0
+
+	return nil
+
+}
+
+// parseLoggingAddress splits an address of the form [scheme://]host[:port],
+// filling in the defaults for anything missing.
+func parseLoggingAddress(address, scheme, port string) (string, string, string, error) {
+
+	if address == "" {
+		return "", "", "", fmt.Errorf("address required")
+	}
+
+	if !strings.Contains(address, "://") {
+		address = scheme + "://" + address
+	}
+
+	u, err := url.Parse(address)
+	if err != nil {
+		return "", "", "", fmt.Errorf("invalid address '%s': %w", address, err)
+	}
+
+	if u.Hostname() == "" || (u.Path != "" && u.Path != "/") {
+		return "", "", "", fmt.Errorf("invalid address '%s': expected [scheme://]host[:port]", address)
+	}
+
+	if u.Port() != "" {
+		port = u.Port()
+	}
+
+	n, err := strconv.Atoi(port)
+	if err != nil || n <= 0 || n > 65535 {
+		return "", "", "", fmt.Errorf("invalid port '%s'", port)
+	}
+
+	return u.Scheme, u.Hostname(), port, nil
+
+}
+
+func syslogLoggingDriver(l *Logging) ([]string, error) {
+
+	scheme, host, port, err := parseLoggingAddress(l.Address, "udp", "514")
+	if err != nil {
+		return nil, err
+	}
+
+	if scheme != "udp" && scheme != "tcp" {
+		return nil, fmt.Errorf("unsupported protocol '%s' (expected udp or tcp)", scheme)
+	}
+
+	cfg := []string{
+		"Name=syslog",
+		"Host=" + host,
+		"Port=" + port,
+		"Mode=" + scheme,
+		"Syslog_Format=rfc5424",
+		"Syslog_Message_Key=log",
+	}
+
+	if l.Tag != "" {
+		cfg = append(cfg, "Syslog_Appname_Preset="+l.Tag)
+	}
+
+	return cfg, nil
+
+}
+
+func fluentdLoggingDriver(l *Logging) ([]string, error) {
+
+	scheme, host, port, err := parseLoggingAddress(l.Address, "tcp", "24224")
+	if err != nil {
+		return nil, err
+	}
+
+	if scheme != "tcp" {
+		return nil, fmt.Errorf("unsupported protocol '%s' (expected tcp)", scheme)
+	}
+
+	cfg := []string{
+		"Name=forward",
+		"Host=" + host,
+		"Port=" + port,
+	}
+
+	if l.Tag != "" {
+		cfg = append(cfg, "Tag="+l.Tag)
+	}
+
+	return cfg, nil
+
+}
+
+func fileLoggingDriver(l *Logging) ([]string, error) {
+
+	if l.Path == "" {
+		return nil, fmt.Errorf("path required")
+	}
+
+	p := path.Clean(l.Path)
+	if !path.IsAbs(p) || p == "/" {
+		return nil, fmt.Errorf("invalid path '%s': must be an absolute path to a file", l.Path)
+	}
+
+	if l.MaxFiles > 0 && l.MaxSize == 0 {
+		return nil, fmt.Errorf("max-files requires max-size")
+	}
+
+	cfg := []string{
+		"Name=file",
+		"Path=" + path.Dir(p),
+		"File=" + path.Base(p),
+	}
+
+	if l.MaxSize > 0 {
+		cfg = append(cfg, "Max_Size="+strconv.Itoa(l.MaxSize.Units(Byte)))
+
+		files := l.MaxFiles
+		if files == 0 {
+			files = 1
+		}
+		cfg = append(cfg, "Max_Files="+strconv.FormatUint(uint64(files), 10))
+	}
+
+	return cfg, nil
+
+}
@@ -0,0 +1,72 @@
+package vcfg
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoggingExpand(t *testing.T) {
+
+	l := Logging{
+		Driver:  "syslog",
+		Address: "tcp://logs.example.com",
+		Tag:     "app",
+		Config:  []string{"Syslog_Format=rfc3164"},
+	}
+
+	err := l.Expand()
+	assert.NoError(t, err)
+	assert.Equal(t, DefaultLoggingType, l.Type)
+	assert.Equal(t, "", l.Driver)
+	assert.Equal(t, []string{
+		"Name=syslog",
+		"Host=logs.example.com",
+		"Port=514",
+		"Mode=tcp",
+		"Syslog_Format=rfc5424",
+		"Syslog_Message_Key=log",
+		"Syslog_Appname_Preset=app",
+		"Syslog_Format=rfc3164",
+	}, l.Config)
+
+	// expanding again changes nothing
+	x := l
+	assert.NoError(t, x.Expand())
+	assert.Equal(t, l, x)
+
+	l = Logging{
+		Type:    "system",
+		Driver:  "fluentd",
+		Address: "10.0.0.1:24225",
+	}
+	assert.NoError(t, l.Expand())
+	assert.Equal(t, "system", l.Type)
+	assert.Equal(t, []string{"Name=forward", "Host=10.0.0.1", "Port=24225"}, l.Config)
+
+	l = Logging{
+		Driver:   "file",
+		Path:     "/var/log/app.log",
+		MaxSize:  10 * MiB,
+		MaxFiles: 3,
+	}
+	assert.NoError(t, l.Expand())
+	assert.Equal(t, []string{"Name=file", "Path=/var/log", "File=app.log", "Max_Size=10485760", "Max_Files=3"}, l.Config)
+
+	for _, bad := range []Logging{
+		{Driver: "nope"},
+		{Driver: "syslog"},
+		{Driver: "syslog", Address: "http://logs.example.com"},
+		{Driver: "fluentd", Address: "logs.example.com:99999"},
+		{Driver: "file", Path: "app.log"},
+		{Driver: "file", Path: "/app.log", MaxFiles: 2},
+	} {
+		assert.Error(t, bad.Expand(), "%+v", bad)
+	}
+
+}
@@ -31,8 +31,47 @@ func Merge(a, b *VCFG) (*VCFG, error) {
 		return nil, err
 	}
 
-	// nfs, and routes
-	err = mergeNFSRoutes(a, b)
+	// nfs, smb, and routes
+	err = mergeNFSSMBRoutes(a, b)
+	if err != nil {
+		return nil, err
+	}
+
+	// disks
+	err = a.mergeDisks(b)
+	if err != nil {
+		return nil, err
+	}
+
+	// partitions
+	err = a.mergePartitions(b)
+	if err != nil {
+		return nil, err
+	}
+
+	// nodes
+	err = a.mergeNodes(b)
+	if err != nil {
+		return nil, err
+	}
+
+	// sync
+	err = a.mergeSync(b)
+	if err != nil {
+		return nil, err
+	}
+
+	// ownership
+	a.mergeOwnership(b)
+
+	// templates
+	err = a.mergeTemplates(b)
+	if err != nil {
+		return nil, err
+	}
+
+	// quotas
+	err = a.mergeQuotas(b)
 	if err != nil {
 		return nil, err
 	}
@@ -90,12 +129,17 @@ func mergeSystemInfoVM(a, b *VCFG) error {
 	return nil
 }
 
-func mergeNFSRoutes(a, b *VCFG) error {
+func mergeNFSSMBRoutes(a, b *VCFG) error {
 	// NFS
 	if err := a.mergeNFS(b); err != nil {
 		return err
 	}
 
+	// SMB
+	if err := a.mergeSMB(b); err != nil {
+		return err
+	}
+
 	// Routes
 	if err := a.mergeRoutes(b); err != nil {
 		return err
@@ -226,6 +270,56 @@ func (vcfg *VCFG) mergeNFS(b *VCFG) error {
 	return nil
 }
 
+func (vcfg *VCFG) mergeSMB(b *VCFG) error {
+	if vcfg.SMB == nil {
+		vcfg.SMB = b.SMB
+	} else if b.SMB != nil {
+
+		for k, s := range vcfg.SMB {
+			if len(b.SMB) > k {
+				err := mergo.Merge(&s, &b.SMB[k], mergo.WithOverride)
+				if err != nil {
+					return err
+				}
+
+				vcfg.SMB[k] = s
+			}
+		}
+
+		if len(b.SMB) > len(vcfg.SMB) {
+			vcfg.SMB = append(vcfg.SMB, b.SMB[len(vcfg.SMB):]...)
+		}
+
+	}
+
+	return nil
+}
+
+func (vcfg *VCFG) mergeSync(b *VCFG) error {
+	if vcfg.Sync == nil {
+		vcfg.Sync = b.Sync
+	} else if b.Sync != nil {
+
+		for k, s := range vcfg.Sync {
+			if len(b.Sync) > k {
+				err := mergo.Merge(&s, &b.Sync[k], mergo.WithOverride)
+				if err != nil {
+					return err
+				}
+
+				vcfg.Sync[k] = s
+			}
+		}
+
+		if len(b.Sync) > len(vcfg.Sync) {
+			vcfg.Sync = append(vcfg.Sync, b.Sync[len(vcfg.Sync):]...)
+		}
+
+	}
+
+	return nil
+}
+
 func (vcfg *VCFG) mergeLogging(b *VCFG) error {
 	if vcfg.Logging == nil {
 		vcfg.Logging = b.Logging
@@ -263,3 +357,182 @@ func (vcfg *VCFG) mergeLogging(b *VCFG) error {
 
 	return nil
 }
+
+// mergeDisks merges disks by name rather than by index, because unlike most
+// other sections the order of disks is rarely meaningful.
+func (vcfg *VCFG) mergeDisks(b *VCFG) error {
+
+	for _, x := range b.Disks {
+		var found bool
+		for k, d := range vcfg.Disks {
+			if d.Name != x.Name {
+				continue
+			}
+
+			err := mergo.Merge(&d, &x, mergo.WithOverride)
+			if err != nil {
+				return err
+			}
+
+			vcfg.Disks[k] = d
+			found = true
+			break
+		}
+
+		if !found {
+			vcfg.Disks = append(vcfg.Disks, x)
+		}
+	}
+
+	return nil
+}
+
+// mergePartitions merges partitions by name, like disks. Partitions that are
+// new to a are added after the ones it already has.
+func (vcfg *VCFG) mergePartitions(b *VCFG) error {
+
+	for _, x := range b.Partitions {
+		var found bool
+		for k, p := range vcfg.Partitions {
+			if p.Name != x.Name {
+				continue
+			}
+
+			err := mergo.Merge(&p, &x, mergo.WithOverride)
+			if err != nil {
+				return err
+			}
+
+			vcfg.Partitions[k] = p
+			found = true
+			break
+		}
+
+		if !found {
+			vcfg.Partitions = append(vcfg.Partitions, x)
+		}
+	}
+
+	return nil
+}
+
+// mergeNodes merges special files by path. Nodes that are new to a are added
+// after the ones it already has.
+func (vcfg *VCFG) mergeNodes(b *VCFG) error {
+
+	for _, x := range b.Nodes {
+		var found bool
+		for k, n := range vcfg.Nodes {
+			if n.Path != x.Path {
+				continue
+			}
+
+			err := mergo.Merge(&n, &x, mergo.WithOverride)
+			if err != nil {
+				return err
+			}
+
+			vcfg.Nodes[k] = n
+			found = true
+			break
+		}
+
+		if !found {
+			vcfg.Nodes = append(vcfg.Nodes, x)
+		}
+	}
+
+	return nil
+}
+
+// mergeOwnership merges ownership overrides by path, with each field set in b
+// replacing the same field in a.
+func (vcfg *VCFG) mergeOwnership(b *VCFG) {
+
+	if len(b.Ownership) == 0 {
+		return
+	}
+
+	if vcfg.Ownership == nil {
+		vcfg.Ownership = make(map[string]Ownership)
+	}
+
+	for path, x := range b.Ownership {
+
+		o := vcfg.Ownership[path]
+
+		if x.UID != nil {
+			o.UID = x.UID
+		}
+
+		if x.GID != nil {
+			o.GID = x.GID
+		}
+
+		if x.Mode != "" {
+			o.Mode = x.Mode
+		}
+
+		vcfg.Ownership[path] = o
+
+	}
+
+}
+
+// mergeTemplates merges templates by path. Templates that are new to a are
+// added after the ones it already has.
+func (vcfg *VCFG) mergeTemplates(b *VCFG) error {
+
+	for _, x := range b.Templates {
+		var found bool
+		for k, t := range vcfg.Templates {
+			if t.Path != x.Path {
+				continue
+			}
+
+			err := mergo.Merge(&t, &x, mergo.WithOverride)
+			if err != nil {
+				return err
+			}
+
+			vcfg.Templates[k] = t
+			found = true
+			break
+		}
+
+		if !found {
+			vcfg.Templates = append(vcfg.Templates, x)
+		}
+	}
+
+	return nil
+}
+
+// mergeQuotas merges quotas by type and ID. Quotas that are new to a are added
+// after the ones it already has.
+func (vcfg *VCFG) mergeQuotas(b *VCFG) error {
+
+	for _, x := range b.Quotas {
+		var found bool
+		for k, q := range vcfg.Quotas {
+			if q.Type != x.Type || q.ID != x.ID {
+				continue
+			}
+
+			err := mergo.Merge(&q, &x, mergo.WithOverride)
+			if err != nil {
+				return err
+			}
+
+			vcfg.Quotas[k] = q
+			found = true
+			break
+		}
+
+		if !found {
+			vcfg.Quotas = append(vcfg.Quotas, x)
+		}
+	}
+
+	return nil
+}
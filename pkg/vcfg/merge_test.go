@@ -139,6 +139,51 @@ func TestMergeNFS(t *testing.T) {
 
 }
 
+func TestMergeSMB(t *testing.T) {
+
+	a := new(VCFG)
+	b := new(VCFG)
+
+	a.SMB = []SMBSettings{
+		{MountPoint: "/share", Server: "//host/share", Username: "app"},
+		{MountPoint: "/other", Server: "//host/other"},
+	}
+	b.SMB = []SMBSettings{
+		{Password: "secret"},
+		{},
+		{MountPoint: "/third", Server: "//host/third"},
+	}
+
+	err := a.mergeSMB(b)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(a.SMB))
+	assert.Equal(t, SMBSettings{MountPoint: "/share", Server: "//host/share", Username: "app", Password: "secret"}, a.SMB[0])
+	assert.Equal(t, "/other", a.SMB[1].MountPoint)
+	assert.Equal(t, b.SMB[2], a.SMB[2])
+
+}
+
+func TestMergeSync(t *testing.T) {
+
+	a := new(VCFG)
+	b := new(VCFG)
+
+	a.Sync = []ObjectSync{
+		{Source: "s3://bucket/a", Path: "/a", Region: "us-east-1"},
+	}
+	b.Sync = []ObjectSync{
+		{Source: "s3://bucket/b", SyncBack: true},
+		{Source: "gs://bucket/c", Path: "/c"},
+	}
+
+	err := a.mergeSync(b)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(a.Sync))
+	assert.Equal(t, ObjectSync{Source: "s3://bucket/b", Path: "/a", Region: "us-east-1", SyncBack: true}, a.Sync[0])
+	assert.Equal(t, b.Sync[1], a.Sync[1])
+
+}
+
 func TestMergePrograms(t *testing.T) {
 
 	a := new(VCFG)
@@ -188,6 +233,121 @@ func TestMergeRoutes(t *testing.T) {
 
 }
 
+func TestMergeDisks(t *testing.T) {
+
+	a := new(VCFG)
+	b := new(VCFG)
+
+	a.Disks = []Disk{
+		{Name: "data", MountPoint: "/data", Size: 64 * MiB},
+		{Name: "logs", MountPoint: "/logs"},
+	}
+	b.Disks = []Disk{
+		{Name: "cache", MountPoint: "/cache"},
+		{Name: "data", Size: 128 * MiB},
+	}
+
+	err := a.mergeDisks(b)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(a.Disks))
+	assert.Equal(t, Disk{Name: "data", MountPoint: "/data", Size: 128 * MiB}, a.Disks[0])
+	assert.Equal(t, "logs", a.Disks[1].Name)
+	assert.Equal(t, b.Disks[0], a.Disks[2])
+
+}
+
+func TestMergePartitions(t *testing.T) {
+
+	a := new(VCFG)
+	b := new(VCFG)
+
+	a.Partitions = []Partition{
+		{Name: "config", MountPoint: "/config", Size: 8 * MiB},
+		{Name: "cache", MountPoint: "/cache", Flags: []string{"no-automount"}},
+	}
+	b.Partitions = []Partition{
+		{Name: "state", MountPoint: "/state"},
+		{Name: "config", Flags: []string{"read-only"}},
+	}
+
+	err := a.mergePartitions(b)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(a.Partitions))
+	assert.Equal(t, Partition{Name: "config", MountPoint: "/config", Size: 8 * MiB, Flags: []string{"read-only"}}, a.Partitions[0])
+	assert.Equal(t, "cache", a.Partitions[1].Name)
+	assert.Equal(t, b.Partitions[0], a.Partitions[2])
+
+}
+
+func TestMergeNodes(t *testing.T) {
+
+	a := new(VCFG)
+	b := new(VCFG)
+
+	a.Nodes = []Node{
+		{Path: "/dev/null", Type: CharDeviceNode, Major: 1, Minor: 3},
+		{Path: "/run/pipe", Type: FIFONode},
+	}
+	b.Nodes = []Node{
+		{Path: "/dev/sda", Type: BlockDeviceNode, Major: 8},
+		{Path: "/dev/null", Minor: 5},
+	}
+
+	err := a.mergeNodes(b)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(a.Nodes))
+	assert.Equal(t, Node{Path: "/dev/null", Type: CharDeviceNode, Major: 1, Minor: 5}, a.Nodes[0])
+	assert.Equal(t, "/run/pipe", a.Nodes[1].Path)
+	assert.Equal(t, b.Nodes[0], a.Nodes[2])
+
+}
+
+func TestMergeTemplates(t *testing.T) {
+
+	a := new(VCFG)
+	b := new(VCFG)
+
+	a.Templates = []Template{
+		{Source: "/etc/app.tmpl", Path: "/etc/app.conf", Values: map[string]string{"a": "1", "b": "2"}},
+	}
+	b.Templates = []Template{
+		{Path: "/etc/app.conf", Values: map[string]string{"b": "3"}},
+		{Source: "/etc/motd.tmpl", Path: "/etc/motd"},
+	}
+
+	err := a.mergeTemplates(b)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(a.Templates))
+	assert.Equal(t, "/etc/app.tmpl", a.Templates[0].Source)
+	assert.Equal(t, map[string]string{"a": "1", "b": "3"}, a.Templates[0].Values)
+	assert.Equal(t, b.Templates[1], a.Templates[1])
+
+}
+
+func TestMergeOwnership(t *testing.T) {
+
+	uid, gid := uint32(0), uint32(33)
+
+	a := new(VCFG)
+	b := new(VCFG)
+
+	a.Ownership = map[string]Ownership{
+		"/app":     {UID: &uid, Mode: "0755"},
+		"/app/run": {GID: &gid},
+	}
+	b.Ownership = map[string]Ownership{
+		"/app":      {GID: &gid},
+		"/app/data": {Mode: "0700"},
+	}
+
+	a.mergeOwnership(b)
+	assert.Equal(t, 3, len(a.Ownership))
+	assert.Equal(t, Ownership{UID: &uid, GID: &gid, Mode: "0755"}, a.Ownership["/app"])
+	assert.Equal(t, Ownership{GID: &gid}, a.Ownership["/app/run"])
+	assert.Equal(t, b.Ownership["/app/data"], a.Ownership["/app/data"])
+
+}
+
 func TestMerge(t *testing.T) {
 
 	a := new(VCFG)
@@ -219,3 +379,24 @@ func TestMerge(t *testing.T) {
 	assert.NoError(t, err)
 
 }
+
+func TestMergeQuotas(t *testing.T) {
+
+	a := new(VCFG)
+	b := new(VCFG)
+
+	a.Quotas = []Quota{
+		{Type: ProjectQuota, ID: 10, Path: "/data", Space: 64 * MiB},
+	}
+	b.Quotas = []Quota{
+		{Type: ProjectQuota, ID: 10, Inodes: 1000},
+		{Type: UserQuota, ID: 10, Space: MiB},
+	}
+
+	err := a.mergeQuotas(b)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(a.Quotas))
+	assert.Equal(t, Quota{Type: ProjectQuota, ID: 10, Path: "/data", Space: 64 * MiB, Inodes: 1000}, a.Quotas[0])
+	assert.Equal(t, b.Quotas[1], a.Quotas[1])
+
+}
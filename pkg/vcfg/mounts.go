@@ -0,0 +1,160 @@
+package vcfg
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"time"
+)
+
+// NFSVersions are the NFS protocol versions an NFSSettings may ask for.
+var NFSVersions = []string{"3", "4", "4.0", "4.1", "4.2"}
+
+// NFSTransports are the transports an NFSSettings may ask for.
+var NFSTransports = []string{"tcp", "udp", "rdma"}
+
+// SMBVersions are the SMB protocol versions an SMBSettings may ask for.
+var SMBVersions = []string{"1.0", "2.0", "2.1", "3", "3.0", "3.02", "3.1.1"}
+
+func oneOf(s string, list []string) bool {
+
+	for _, x := range list {
+		if s == x {
+			return true
+		}
+	}
+
+	return false
+
+}
+
+// joinMountOptions puts generated mount options in front of options,
+// so that anything set explicitly still overrides them.
+func joinMountOptions(generated []string, options string) string {
+
+	if options != "" {
+		generated = append(generated, options)
+	}
+
+	return strings.Join(generated, ",")
+
+}
+
+func validateMountPoint(mountPoint string) error {
+
+	if mountPoint == "" {
+		return fmt.Errorf("mount point required")
+	}
+
+	if !path.IsAbs(mountPoint) || path.Clean(mountPoint) == "/" {
+		return fmt.Errorf("invalid mount point '%s': must be an absolute path other than '/'", mountPoint)
+	}
+
+	return nil
+
+}
+
+// Expand checks the NFSSettings and replaces its Version, Transport and
+// Timeout with the mount options they stand for, which are put before any
+// options that were set explicitly. It is safe to call more than once.
+func (n *NFSSettings) Expand() error {
+
+	err := validateMountPoint(n.MountPoint)
+	if err != nil {
+		return err
+	}
+
+	if n.Server == "" {
+		return fmt.Errorf("server required")
+	}
+
+	var options []string
+
+	if n.Version != "" {
+		if !oneOf(n.Version, NFSVersions) {
+			return fmt.Errorf("unsupported version '%s' (expected one of: %s)", n.Version, strings.Join(NFSVersions, ", "))
+		}
+		options = append(options, "vers="+n.Version)
+	}
+
+	if n.Transport != "" {
+		if !oneOf(n.Transport, NFSTransports) {
+			return fmt.Errorf("unsupported transport '%s' (expected one of: %s)", n.Transport, strings.Join(NFSTransports, ", "))
+		}
+		if n.Transport == "udp" && strings.HasPrefix(n.Version, "4") {
+			return fmt.Errorf("NFS version %s doesn't support the udp transport", n.Version)
+		}
+		options = append(options, "proto="+n.Transport)
+	}
+
+	if n.Timeout != 0 {
+		// timeo is in tenths of a second
+		timeo := n.Timeout.Duration() / (time.Second / 10)
+		if timeo <= 0 {
+			return fmt.Errorf("invalid timeout '%s': must be at least 100ms", n.Timeout)
+		}
+		options = append(options, fmt.Sprintf("timeo=%d", timeo))
+	}
+
+	n.Arguments = joinMountOptions(options, n.Arguments)
+	n.Version = ""
+	n.Transport = ""
+	n.Timeout = 0
+
+	return nil
+
+}
+
+// Expand checks the SMBSettings and replaces its Username, Password, Domain
+// and Version with the mount options they stand for, which are put before
+// any options that were set explicitly. It is safe to call more than once.
+func (s *SMBSettings) Expand() error {
+
+	err := validateMountPoint(s.MountPoint)
+	if err != nil {
+		return err
+	}
+
+	share := strings.TrimPrefix(s.Server, "//")
+	if share == s.Server || !strings.Contains(strings.Trim(share, "/"), "/") {
+		return fmt.Errorf("invalid server '%s': expected //host/share", s.Server)
+	}
+
+	var options []string
+
+	for _, x := range []struct {
+		name, value string
+	}{
+		{"username", s.Username},
+		{"password", s.Password},
+		{"domain", s.Domain},
+	} {
+		if strings.Contains(x.value, ",") {
+			return fmt.Errorf("%s can't contain a comma", x.name)
+		}
+		if x.value != "" {
+			options = append(options, x.name+"="+x.value)
+		}
+	}
+
+	if s.Version != "" {
+		if !oneOf(s.Version, SMBVersions) {
+			return fmt.Errorf("unsupported version '%s' (expected one of: %s)", s.Version, strings.Join(SMBVersions, ", "))
+		}
+		options = append(options, "vers="+s.Version)
+	}
+
+	s.Arguments = joinMountOptions(options, s.Arguments)
+	s.Username = ""
+	s.Password = ""
+	s.Domain = ""
+	s.Version = ""
+
+	return nil
+
+}
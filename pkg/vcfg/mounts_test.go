@@ -0,0 +1,92 @@
+package vcfg
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNFSExpand(t *testing.T) {
+
+	n := NFSSettings{
+		MountPoint: "/data",
+		Server:     "10.0.0.1:/exports/data",
+		Arguments:  "nolock",
+		Version:    "4.1",
+		Transport:  "tcp",
+		Timeout:    Duration(60 * time.Second),
+	}
+
+	err := n.Expand()
+	assert.NoError(t, err)
+	assert.Equal(t, NFSSettings{
+		MountPoint: "/data",
+		Server:     "10.0.0.1:/exports/data",
+		Arguments:  "vers=4.1,proto=tcp,timeo=600,nolock",
+	}, n)
+
+	// expanding again changes nothing
+	x := n
+	assert.NoError(t, x.Expand())
+	assert.Equal(t, n, x)
+
+	bad := map[string]NFSSettings{
+		"no mount point": {Server: "host:/x"},
+		"root":           {MountPoint: "/", Server: "host:/x"},
+		"no server":      {MountPoint: "/data"},
+		"bad version":    {MountPoint: "/data", Server: "host:/x", Version: "5"},
+		"bad transport":  {MountPoint: "/data", Server: "host:/x", Transport: "sctp"},
+		"udp with v4":    {MountPoint: "/data", Server: "host:/x", Version: "4", Transport: "udp"},
+		"short timeout":  {MountPoint: "/data", Server: "host:/x", Timeout: Duration(time.Millisecond)},
+	}
+
+	for name, n := range bad {
+		assert.Error(t, n.Expand(), name)
+	}
+
+}
+
+func TestSMBExpand(t *testing.T) {
+
+	s := SMBSettings{
+		MountPoint: "/share",
+		Server:     "//files.example.com/share",
+		Arguments:  "uid=1000",
+		Username:   "app",
+		Password:   "secret",
+		Domain:     "EXAMPLE",
+		Version:    "3.0",
+	}
+
+	err := s.Expand()
+	assert.NoError(t, err)
+	assert.Equal(t, SMBSettings{
+		MountPoint: "/share",
+		Server:     "//files.example.com/share",
+		Arguments:  "username=app,password=secret,domain=EXAMPLE,vers=3.0,uid=1000",
+	}, s)
+
+	// expanding again changes nothing
+	x := s
+	assert.NoError(t, x.Expand())
+	assert.Equal(t, s, x)
+
+	bad := map[string]SMBSettings{
+		"no mount point": {Server: "//host/share"},
+		"no share":       {MountPoint: "/share", Server: "//host"},
+		"not unc":        {MountPoint: "/share", Server: "host/share"},
+		"bad version":    {MountPoint: "/share", Server: "//host/share", Version: "4"},
+		"comma":          {MountPoint: "/share", Server: "//host/share", Password: "a,b"},
+	}
+
+	for name, s := range bad {
+		assert.Error(t, s.Expand(), name)
+	}
+
+}
@@ -0,0 +1,86 @@
+package vcfg
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// ObjectStorageSchemes are the URL schemes an ObjectSync's Source may use:
+// Amazon S3 (or anything compatible with it) and Google Cloud Storage.
+var ObjectStorageSchemes = []string{"s3", "gs"}
+
+// ObjectSync copies everything under a prefix of an object storage bucket
+// into a directory when the VM boots, before any hooks or programs run. If
+// SyncBack is set the directory is copied back to the prefix once the
+// programs and on-shutdown hooks have exited, within the same terminate-wait.
+//
+// Source is a URL like "s3://bucket/prefix" or "gs://bucket/prefix". Endpoint
+// and Region only apply to S3, and Endpoint can point at any service that's
+// compatible with it. Credentials is the path of a file in the root
+// file-system holding AWS shared credentials or a Google service account key.
+// Without it, the credentials of the instance the VM runs on are used.
+type ObjectSync struct {
+	Source      string `toml:"source,omitempty" json:"source"`
+	Path        string `toml:"path,omitempty" json:"path"`
+	Endpoint    string `toml:"endpoint,omitempty" json:"endpoint,omitempty"`
+	Region      string `toml:"region,omitempty" json:"region,omitempty"`
+	Credentials string `toml:"credentials,omitempty" json:"credentials,omitempty"`
+	SyncBack    bool   `toml:"sync-back,omitempty" json:"sync-back,omitempty"`
+}
+
+// Validate checks the ObjectSync's settings.
+func (s *ObjectSync) Validate() error {
+
+	if s.Source == "" {
+		return fmt.Errorf("source required")
+	}
+
+	u, err := url.Parse(s.Source)
+	if err != nil || !oneOf(u.Scheme, ObjectStorageSchemes) || u.Host == "" {
+		return fmt.Errorf("invalid source '%s': expected s3://bucket[/prefix] or gs://bucket[/prefix]", s.Source)
+	}
+
+	if s.Path == "" {
+		return fmt.Errorf("path required")
+	}
+
+	if !path.IsAbs(s.Path) || path.Clean(s.Path) == "/" {
+		return fmt.Errorf("invalid path '%s': must be an absolute path other than '/'", s.Path)
+	}
+
+	if u.Scheme != "s3" && (s.Endpoint != "" || s.Region != "") {
+		return fmt.Errorf("endpoint and region only apply to s3 sources")
+	}
+
+	if s.Endpoint != "" {
+		e, err := url.Parse(s.Endpoint)
+		if err != nil || (e.Scheme != "http" && e.Scheme != "https") || e.Host == "" {
+			return fmt.Errorf("invalid endpoint '%s': expected an http or https URL", s.Endpoint)
+		}
+	}
+
+	if s.Credentials != "" && !path.IsAbs(s.Credentials) {
+		return fmt.Errorf("invalid credentials '%s': must be an absolute path", s.Credentials)
+	}
+
+	return nil
+
+}
+
+// Overlaps reports whether the paths of two ObjectSyncs are the same, or one
+// is inside the other.
+func (s *ObjectSync) Overlaps(x *ObjectSync) bool {
+
+	a := strings.TrimSuffix(path.Clean(s.Path), "/") + "/"
+	b := strings.TrimSuffix(path.Clean(x.Path), "/") + "/"
+
+	return strings.HasPrefix(a, b) || strings.HasPrefix(b, a)
+
+}
@@ -0,0 +1,54 @@
+package vcfg
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestObjectSyncValidate(t *testing.T) {
+
+	good := []ObjectSync{
+		{Source: "s3://bucket", Path: "/data"},
+		{Source: "s3://bucket/prefix/", Path: "/data", Region: "us-east-1", SyncBack: true},
+		{Source: "s3://bucket/prefix", Path: "/data", Endpoint: "https://minio.example.com:9000"},
+		{Source: "gs://bucket/prefix", Path: "/data", Credentials: "/etc/gcs.json"},
+	}
+
+	for _, s := range good {
+		assert.NoError(t, s.Validate(), s.Source)
+	}
+
+	bad := map[string]ObjectSync{
+		"no source":            {Path: "/data"},
+		"unknown scheme":       {Source: "ftp://bucket", Path: "/data"},
+		"no bucket":            {Source: "s3:///prefix", Path: "/data"},
+		"no path":              {Source: "s3://bucket"},
+		"relative path":        {Source: "s3://bucket", Path: "data"},
+		"root path":            {Source: "s3://bucket", Path: "/"},
+		"gcs region":           {Source: "gs://bucket", Path: "/data", Region: "us-east-1"},
+		"bad endpoint":         {Source: "s3://bucket", Path: "/data", Endpoint: "minio:9000"},
+		"relative credentials": {Source: "s3://bucket", Path: "/data", Credentials: "creds"},
+	}
+
+	for name, s := range bad {
+		assert.Error(t, s.Validate(), name)
+	}
+
+}
+
+func TestObjectSyncOverlaps(t *testing.T) {
+
+	a := &ObjectSync{Path: "/data"}
+
+	assert.True(t, a.Overlaps(&ObjectSync{Path: "/data/"}))
+	assert.True(t, a.Overlaps(&ObjectSync{Path: "/data/x"}))
+	assert.True(t, a.Overlaps(&ObjectSync{Path: "/"}))
+	assert.False(t, a.Overlaps(&ObjectSync{Path: "/database"}))
+
+}
@@ -374,6 +374,45 @@ var (
 	Ext2FS = Filesystem("ext2")
 	Ext4FS = Filesystem("ext4")
 	XFS    = Filesystem("xfs")
+
+	// SquashFS is compressed and can't be written to, so it suits root
+	// file-systems and disks whose contents never change.
+	SquashFS = Filesystem("squashfs")
+
+	// EROFS can't be written to either, but it isn't compressed, so any part
+	// of any file can be read straight from the disk. It suits read-only root
+	// file-systems for workloads that read files in no particular order.
+	EROFS = Filesystem("erofs")
+
+	// FAT32 has no owners, permissions or symlinks, but almost anything can
+	// read it, so it suits disks and partitions for exchanging files with
+	// other systems.
+	FAT32 = Filesystem("fat32")
+
+	// F2FS is log-structured, so it suits appliances that boot from SD cards
+	// and eMMC, which ext4 and XFS wear out unevenly.
+	F2FS = Filesystem("f2fs")
+)
+
+// ReadOnly reports whether a file-system can only be mounted read-only.
+func (fs Filesystem) ReadOnly() bool {
+	return fs == SquashFS || fs == EROFS
+}
+
+// DataOnly reports whether a file-system can only hold plain files and
+// directories, and so can't be a root file-system.
+func (fs Filesystem) DataOnly() bool {
+	return fs == FAT32
+}
+
+// BootMode instructs the compiler to make a disk bootable by specific firmware
+type BootMode string
+
+// Supported boot modes
+var (
+	BIOSBoot   = BootMode("bios")
+	UEFIBoot   = BootMode("uefi")
+	HybridBoot = BootMode("hybrid")
 )
 
 //
@@ -21,16 +21,24 @@ import (
 
 // VCFG ..
 type VCFG struct {
-	Programs []Program          `toml:"program,omitempty" json:"program,omitempty"`
-	Networks []NetworkInterface `toml:"network,omitempty" json:"network,omitempty"`
-	System   SystemSettings     `toml:"system,omitempty" json:"system,omitempty"`
-	Info     PackageInfo        `toml:"info,omitempty" json:"info,omitempty"`
-	VM       VMSettings         `toml:"vm,omitempty" json:"vm,omitempty"`
-	NFS      []NFSSettings      `toml:"nfs,omitempty" json:"nfs,omitempty"`
-	Routing  []Route            `toml:"route,omitempty" json:"route,omitempty"`
-	Logging  []Logging          `toml:"logging,omitempty" json:"logging,omitempty"`
-	Sysctl   map[string]string  `toml:"sysctl,omitempty" json:"sysctl,omitempty"`
-	modtime  time.Time
+	Programs   []Program            `toml:"program,omitempty" json:"program,omitempty"`
+	Networks   []NetworkInterface   `toml:"network,omitempty" json:"network,omitempty"`
+	System     SystemSettings       `toml:"system,omitempty" json:"system,omitempty"`
+	Info       PackageInfo          `toml:"info,omitempty" json:"info,omitempty"`
+	VM         VMSettings           `toml:"vm,omitempty" json:"vm,omitempty"`
+	NFS        []NFSSettings        `toml:"nfs,omitempty" json:"nfs,omitempty"`
+	SMB        []SMBSettings        `toml:"smb,omitempty" json:"smb,omitempty"`
+	Sync       []ObjectSync         `toml:"sync,omitempty" json:"sync,omitempty"`
+	Routing    []Route              `toml:"route,omitempty" json:"route,omitempty"`
+	Logging    []Logging            `toml:"logging,omitempty" json:"logging,omitempty"`
+	Sysctl     map[string]string    `toml:"sysctl,omitempty" json:"sysctl,omitempty"`
+	Disks      []Disk               `toml:"disk,omitempty" json:"disk,omitempty"`
+	Partitions []Partition          `toml:"partition,omitempty" json:"partition,omitempty"`
+	Nodes      []Node               `toml:"node,omitempty" json:"node,omitempty"`
+	Ownership  map[string]Ownership `toml:"ownership,omitempty" json:"ownership,omitempty"`
+	Templates  []Template           `toml:"templates,omitempty" json:"templates,omitempty"`
+	Quotas     []Quota              `toml:"quota,omitempty" json:"quota,omitempty"`
+	modtime    time.Time
 }
 
 //Privilege: The privilege level that the machine user will bet set with.
@@ -61,6 +69,17 @@ type Program struct {
 	Terminate TerminateSignal `toml:"terminate,omitempty" json:"terminate"`
 }
 
+// Hook is a program init runs to completion apart from the app's long-running
+// programs, for one-off tasks like migrations and cleanup. Fields left empty
+// have the same defaults as a Program's.
+type Hook struct {
+	Binary    string    `toml:"binary,omitempty" json:"binary"`
+	Args      string    `toml:"args,omitempty" json:"args"`
+	Env       []string  `toml:"env,omitempty" json:"env"`
+	Cwd       string    `toml:"cwd,omitempty" json:"cwd"`
+	Privilege Privilege `toml:"privilege,omitempty" json:"privilege"`
+}
+
 // NetworkInterface ..
 type NetworkInterface struct {
 	IP                               string   `toml:"ip,omitempty" json:"ip"`
@@ -75,11 +94,131 @@ type NetworkInterface struct {
 	TCPDUMP                          bool     `toml:"tcpdump,omitempty" json:"tcpdump"`
 }
 
-// NFSSettings ..
+// NFSSettings describes an NFS export mounted at MountPoint. Version,
+// Transport and Timeout are shorthand for the mount options of the same
+// names, and are folded into Arguments by Expand.
 type NFSSettings struct {
+	MountPoint string   `toml:"mount,omitempty" json:"mount"`
+	Server     string   `toml:"server,omitempty" json:"server"`
+	Arguments  string   `toml:"options,omitempty" json:"options"`
+	Version    string   `toml:"version,omitempty" json:"version,omitempty"`
+	Transport  string   `toml:"transport,omitempty" json:"transport,omitempty"`
+	Timeout    Duration `toml:"timeout,omitempty" json:"timeout,omitempty"`
+}
+
+// SMBSettings describes an SMB/CIFS share mounted at MountPoint. Server is
+// the UNC path of the share, e.g. "//fileserver/data". Username, Password,
+// Domain and Version are shorthand for the mount options of the same names,
+// and are folded into Arguments by Expand. Like the rest of the VCFG, the
+// password is stored on the disk unencrypted.
+type SMBSettings struct {
 	MountPoint string `toml:"mount,omitempty" json:"mount"`
 	Server     string `toml:"server,omitempty" json:"server"`
 	Arguments  string `toml:"options,omitempty" json:"options"`
+	Username   string `toml:"username,omitempty" json:"username,omitempty"`
+	Password   string `toml:"password,omitempty" json:"password,omitempty"`
+	Domain     string `toml:"domain,omitempty" json:"domain,omitempty"`
+	Version    string `toml:"version,omitempty" json:"version,omitempty"`
+}
+
+// Disk describes an additional disk attached to the VM alongside the boot
+// disk. Its file-system is seeded with the package's tree of the same name, if
+// it has one, and mounted at MountPoint. If Filesystem is empty the disk uses
+// the same file-system as the root partition.
+type Disk struct {
+	Name       string     `toml:"name,omitempty" json:"name"`
+	MountPoint string     `toml:"mount,omitempty" json:"mount"`
+	Size       Bytes      `toml:"size,omitzero" json:"size,omitempty"`
+	Filesystem Filesystem `toml:"filesystem,omitempty" json:"filesystem,omitempty"`
+}
+
+// Partition describes an extra partition on the boot disk, which is laid out
+// between the Vorteil OS partition and the root file-system, in the order they
+// are declared. Its file-system is seeded with the package's disk tree of the
+// same name, if it has one, and mounted at MountPoint. If Size is a delta it
+// is added to the file-system as free space, otherwise the partition is
+// exactly Size. If Filesystem is empty the partition uses the same
+// file-system as the root partition. Flags set GPT attributes on the
+// partition: "required", "read-only", "hidden", and "no-automount".
+type Partition struct {
+	Name       string     `toml:"name,omitempty" json:"name"`
+	MountPoint string     `toml:"mount,omitempty" json:"mount"`
+	Size       Bytes      `toml:"size,omitzero" json:"size,omitempty"`
+	Filesystem Filesystem `toml:"filesystem,omitempty" json:"filesystem,omitempty"`
+	Flags      []string   `toml:"flags,omitempty" json:"flags,omitempty"`
+}
+
+// NodeType is the type of a special file declared in the VCFG.
+type NodeType string
+
+var (
+	// CharDeviceNode is a character device node.
+	CharDeviceNode = NodeType("char")
+	// BlockDeviceNode is a block device node.
+	BlockDeviceNode = NodeType("block")
+	// FIFONode is a named pipe.
+	FIFONode = NodeType("fifo")
+)
+
+// Node describes a device node or named pipe to create in the root
+// file-system at Path. Major and Minor are ignored for named pipes.
+type Node struct {
+	Path  string   `toml:"path,omitempty" json:"path"`
+	Type  NodeType `toml:"type,omitempty" json:"type"`
+	Major uint32   `toml:"major,omitzero" json:"major,omitempty"`
+	Minor uint32   `toml:"minor,omitzero" json:"minor,omitempty"`
+}
+
+// Template renders the Go template at Source in the root file-system into a
+// file at Path when the disk is built, replacing anything already there. The
+// source is removed unless it's also the Path. Templates can use Values as
+// {{ .Values.name }}, which can be overridden when the disk is built, and the
+// environment the disk is built in as {{ .Env.NAME }}.
+type Template struct {
+	Source string            `toml:"source,omitempty" json:"source"`
+	Path   string            `toml:"path,omitempty" json:"path"`
+	Values map[string]string `toml:"values,omitempty" json:"values,omitempty"`
+}
+
+// QuotaType is what a quota declared in the VCFG limits.
+type QuotaType string
+
+var (
+	// UserQuota limits the files owned by a user.
+	UserQuota = QuotaType("user")
+	// GroupQuota limits the files owned by a group.
+	GroupQuota = QuotaType("group")
+	// ProjectQuota limits the files in a project, which is usually every file
+	// under a directory.
+	ProjectQuota = QuotaType("project")
+)
+
+// Quota limits the space and inodes the user, group or project with ID can
+// use in the root file-system. A project quota with a Path applies to that
+// directory and everything created under it, so it limits the size of the
+// directory tree. Limits left zero aren't enforced, and a user or group quota
+// with ID 0 sets the limits for every user or group without their own. Only
+// XFS root file-systems support quotas, and they can't have group and project
+// quotas at the same time. The guest only enforces quotas of the types
+// declared here.
+type Quota struct {
+	Type       QuotaType `toml:"type,omitempty" json:"type"`
+	ID         uint32    `toml:"id,omitzero" json:"id,omitempty"`
+	Path       string    `toml:"path,omitempty" json:"path,omitempty"`
+	Space      Bytes     `toml:"space,omitzero" json:"space,omitempty"`
+	SoftSpace  Bytes     `toml:"soft-space,omitzero" json:"soft-space,omitempty"`
+	Inodes     uint64    `toml:"inodes,omitzero" json:"inodes,omitempty"`
+	SoftInodes uint64    `toml:"soft-inodes,omitzero" json:"soft-inodes,omitempty"`
+}
+
+// Ownership overrides the owner and permissions of the file or directory at
+// its absolute path in the root file-system, which is its key in
+// VCFG.Ownership. Fields left unset keep the file's own values, or the
+// file-system's defaults. Mode is in octal, e.g. "0640" or "4755".
+type Ownership struct {
+	UID  *uint32 `toml:"uid,omitempty" json:"uid,omitempty"`
+	GID  *uint32 `toml:"gid,omitempty" json:"gid,omitempty"`
+	Mode string  `toml:"mode,omitempty" json:"mode,omitempty"`
 }
 
 // Route ..
@@ -100,6 +239,102 @@ type SystemSettings struct {
 	Filesystem    Filesystem `toml:"filesystem,omitempty" json:"filesystem,omitempty"`
 	User          string     `toml:"user,omitempty" json:"user,omitempty"` // Note: should we validate against regex ^[a-z]*$
 	TerminateWait uint       `toml:"terminate-wait,omitzero" json:"terminate-wait,omitzero"`
+
+	// ExpandFilesystem instructs the guest to grow the root partition and
+	// file-system to fill the disk at boot, if the disk has been made bigger
+	// than it was built.
+	ExpandFilesystem bool `toml:"expand-fs,omitempty" json:"expand-fs,omitempty"`
+
+	// The following fields override the randomly generated (or hardcoded)
+	// identifiers written to the disk. They are useful when downstream
+	// systems identify disks by UUID, or when replacing a disk in-place.
+	DiskGUID          string `toml:"disk-guid,omitempty" json:"disk-guid,omitempty"`
+	OSPartitionGUID   string `toml:"os-partition-guid,omitempty" json:"os-partition-guid,omitempty"`
+	RootPartitionGUID string `toml:"root-partition-guid,omitempty" json:"root-partition-guid,omitempty"`
+	FilesystemUUID    string `toml:"filesystem-uuid,omitempty" json:"filesystem-uuid,omitempty"`
+
+	// FilesystemLabel is the volume label of the root file-system, which
+	// allows it to be mounted by label.
+	FilesystemLabel string `toml:"fs-label,omitempty" json:"fs-label,omitempty"`
+
+	// XFS tunes the layout of the root file-system when it is XFS. Small
+	// blocks suit many small files, large blocks and directory blocks suit
+	// few huge files and huge directories.
+	XFS XFSSettings `toml:"xfs,omitempty" json:"xfs,omitempty"`
+
+	// Encryption encrypts the root file-system partition with LUKS2 if
+	// either of its fields are set. The key is never written to the disk,
+	// so it has to be supplied to the VM when it boots.
+	Encryption EncryptionSettings `toml:"encryption,omitempty" json:"encryption,omitempty"`
+
+	// Verity adds a dm-verity hash tree partition for the root file-system
+	// and passes its root hash to the kernel, which then refuses to read any
+	// block that has been tampered with. The root file-system is mounted
+	// read-only.
+	Verity bool `toml:"verity,omitempty" json:"verity,omitempty"`
+
+	// OverlaySize mounts the root file-system read-only and adds a writable
+	// partition of this size, which the guest overlays on top of it with
+	// overlayfs. Changes are kept on the overlay partition, so the root
+	// file-system is left exactly as it was built. If it is a delta it is
+	// added to the overlay file-system as free space.
+	OverlaySize Bytes `toml:"overlay-size,omitzero" json:"overlay-size,omitempty"`
+
+	// OverlayFilesystem is the file-system of the overlay partition. If it
+	// is empty the overlay uses the same file-system as the root partition.
+	OverlayFilesystem Filesystem `toml:"overlay-filesystem,omitempty" json:"overlay-filesystem,omitempty"`
+
+	// BootMode is the firmware the disk boots under: "bios" (the default),
+	// "uefi", or "hybrid" for both. UEFI disks get an EFI system partition
+	// holding the kernel bundle's EFI loader, and hybrid disks have the BIOS
+	// bootloader in their protective MBR as well.
+	BootMode BootMode `toml:"boot-mode,omitempty" json:"boot-mode,omitempty"`
+
+	// Timezone is the IANA name of the system's local time zone, e.g.
+	// "Australia/Sydney". It is only honoured if the time-zone database is
+	// added to the disk when it is built, and defaults to "UTC".
+	Timezone string `toml:"timezone,omitempty" json:"timezone,omitempty"`
+
+	// TagOutput has the guest prefix every line a program writes to the
+	// serial port with the program's index, e.g. "[program 1] ", so that the
+	// output of each program can be told apart and filtered on the host.
+	TagOutput bool `toml:"tag-output,omitempty" json:"tag-output,omitempty"`
+
+	// FirstBoot hooks are run in order by init before any program is
+	// started, the first time the disk boots. Init records that they've all
+	// succeeded on the root file-system, so they're never run again unless
+	// one of them fails, in which case the programs aren't started either.
+	FirstBoot []Hook `toml:"first-boot,omitempty" json:"first-boot,omitempty"`
+
+	// OnShutdown hooks are run in order by init whenever the VM shuts down,
+	// after the programs have exited. They share the programs' terminate-wait,
+	// so any still running when it runs out are killed.
+	OnShutdown []Hook `toml:"on-shutdown,omitempty" json:"on-shutdown,omitempty"`
+
+	// PreserveOwnership keeps the owners and permissions files have on the
+	// host when the disk is built. Otherwise every file is owned by the
+	// default user (1000) and only accessible to it, apart from files
+	// listed in VCFG.Ownership.
+	PreserveOwnership bool `toml:"preserve-ownership,omitempty" json:"preserve-ownership,omitempty"`
+}
+
+// EncryptionSettings ..
+type EncryptionSettings struct {
+	Passphrase string `toml:"passphrase,omitempty" json:"passphrase,omitempty"`
+	KeyFile    string `toml:"key-file,omitempty" json:"key-file,omitempty"`
+}
+
+// Enabled returns true if the settings call for encryption.
+func (x *EncryptionSettings) Enabled() bool {
+	return x.Passphrase != "" || x.KeyFile != ""
+}
+
+// XFSSettings are the block sizes of an XFS file-system. Any left zero use
+// the compiler's defaults.
+type XFSSettings struct {
+	BlockSize          Bytes `toml:"block-size,omitzero" json:"block-size,omitempty"`
+	InodeSize          Bytes `toml:"inode-size,omitzero" json:"inode-size,omitempty"`
+	DirectoryBlockSize Bytes `toml:"dir-block-size,omitzero" json:"dir-block-size,omitempty"`
 }
 
 // PackageInfo ..
@@ -120,12 +355,24 @@ type VMSettings struct {
 	Inodes   InodesQuota `toml:"inodes,omitzero" json:"inodes,omitempty"`
 	Kernel   string      `toml:"kernel,omitempty" json:"kernel,omitempty"`
 	DiskSize Bytes       `toml:"disk-size,omitzero" json:"disk-size,omitempty"`
+	SwapSize Bytes       `toml:"swap-size,omitzero" json:"swap-size,omitempty"`
 }
 
 // Logging ..
+//
+// Config is passed as-is to the log agent on the VM. Alternatively, Driver
+// names one of the registered LoggingDrivers, which generates the Config for a
+// common sink at build time from the remaining fields. See Expand.
 type Logging struct {
 	Config []string `toml:"config,omitempty" json:"config,omitempty"`
 	Type   string   `toml:"type,omitempty" json:"type,omitempty"`
+
+	Driver   string `toml:"driver,omitempty" json:"driver,omitempty"`
+	Address  string `toml:"address,omitempty" json:"address,omitempty"`
+	Path     string `toml:"path,omitempty" json:"path,omitempty"`
+	Tag      string `toml:"tag,omitempty" json:"tag,omitempty"`
+	MaxSize  Bytes  `toml:"max-size,omitzero" json:"max-size,omitempty"`
+	MaxFiles uint   `toml:"max-files,omitzero" json:"max-files,omitempty"`
 }
 
 // Format ..
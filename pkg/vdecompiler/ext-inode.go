@@ -100,19 +100,19 @@ func (r *inodeReader) Read(p []byte) (n int, err error) {
 // InodeIsRegularFile returns true if the permission bits in the inode represent
 // a regular file.
 func InodeIsRegularFile(inode *ext.Inode) bool {
-	return inode.Permissions&ext.InodeTypeRegularFile == ext.InodeTypeRegularFile
+	return inode.Permissions&ext.InodeTypeMask == ext.InodeTypeRegularFile
 }
 
 // InodeIsDirectory returns true if the permission bits in the inode represent
 // a directory.
 func InodeIsDirectory(inode *ext.Inode) bool {
-	return inode.Permissions&ext.InodeTypeDirectory == ext.InodeTypeDirectory
+	return inode.Permissions&ext.InodeTypeMask == ext.InodeTypeDirectory
 }
 
 // InodeIsSymlink returns true if the permission bits in the inode represent
 // a symlink.
 func InodeIsSymlink(inode *ext.Inode) bool {
-	return inode.Permissions&ext.InodeTypeSymlink == ext.InodeTypeSymlink
+	return inode.Permissions&ext.InodeTypeMask == ext.InodeTypeSymlink
 }
 
 // InodeSize returns the size of the file respresented by the inode. It is
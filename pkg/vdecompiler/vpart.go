@@ -7,6 +7,8 @@ package vdecompiler
 
 import (
 	"archive/tar"
+	"encoding/binary"
+	"encoding/json"
 	"fmt"
 	"io"
 
@@ -126,3 +128,54 @@ func (iio *IO) KernelFile(name string) (io.Reader, error) {
 	return r, nil
 
 }
+
+// VCFG returns the config stored on the image's OS partition, which is the
+// one the image was built with, less any encryption secrets.
+func (iio *IO) VCFG() (*vcfg.VCFG, error) {
+
+	if iio.vpart.vcfg != nil {
+		return iio.vpart.vcfg, nil
+	}
+
+	partitions, err := iio.GPTEntries()
+	if err != nil {
+		return nil, err
+	}
+
+	offset := int64(partitions[0].FirstLBA) * vimg.SectorSize
+	_, err = iio.img.Seek(offset, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+
+	conf := new(vimg.BootloaderConfig)
+	err = binary.Read(iio.img, binary.LittleEndian, conf)
+	if err != nil {
+		return nil, err
+	}
+
+	if conf.ConfigLen > conf.ConfigCapacity {
+		return nil, fmt.Errorf("image has a malformed bootloader config")
+	}
+
+	_, err = iio.img.Seek(offset+int64(conf.ConfigOffset), io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+
+	data := make([]byte, conf.ConfigLen)
+	_, err = io.ReadFull(iio.img, data)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := new(vcfg.VCFG)
+	err = json.Unmarshal(data, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("image has a malformed config: %w", err)
+	}
+
+	iio.vpart.vcfg = cfg
+	return cfg, nil
+
+}
@@ -0,0 +1,256 @@
+package vdisk
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/vorteil/vorteil/pkg/vcfg"
+)
+
+// Baseline is a record of an image's contents: what each file in its root
+// file-system holds, and each setting of the config it was built with. Later
+// builds of the same app can be checked against it to catch content that
+// changed by accident.
+//
+// Files maps each path to "dir" for directories, "symlink:" followed by the
+// target for symlinks, "special" for device nodes and named pipes, or the
+// algorithm and digest of a regular file's contents, like a ManifestOutput.
+// VCFG maps each setting, like "program.0.args", to its value as JSON.
+//
+// Allow lists the files and settings that are expected to change between
+// builds, as patterns in the form path.Match takes. Patterns for files start
+// with '/'. A pattern also allows everything under what it matches, so
+// "/var/cache" allows any change inside that directory and "info" allows any
+// change to the info section.
+type Baseline struct {
+	Files map[string]string `json:"files"`
+	VCFG  map[string]string `json:"vcfg"`
+	Allow []string          `json:"allow,omitempty"`
+}
+
+// Kinds of BaselineDifference.
+const (
+	BaselineFile = "file"
+	BaselineVCFG = "vcfg"
+)
+
+// BaselineDifference is something in an image that doesn't match its
+// baseline. Expected is empty if it was added since the baseline was made,
+// and Actual is empty if it was removed.
+type BaselineDifference struct {
+	Kind     string
+	Key      string
+	Expected string
+	Actual   string
+	Allowed  bool
+}
+
+func (d *BaselineDifference) String() string {
+
+	switch {
+	case d.Expected == "":
+		return fmt.Sprintf("%s '%s' was added", d.Kind, d.Key)
+	case d.Actual == "":
+		return fmt.Sprintf("%s '%s' was removed", d.Kind, d.Key)
+	case d.Kind == BaselineVCFG:
+		return fmt.Sprintf("%s '%s' changed from %s to %s", d.Kind, d.Key, d.Expected, d.Actual)
+	default:
+		return fmt.Sprintf("%s '%s' changed", d.Kind, d.Key)
+	}
+
+}
+
+// LoadBaseline reads a baseline from r.
+func LoadBaseline(r io.Reader) (*Baseline, error) {
+
+	b := new(Baseline)
+	err := json.NewDecoder(r).Decode(b)
+	if err != nil {
+		return nil, err
+	}
+
+	err = ValidateBaselinePatterns(b.Allow)
+	if err != nil {
+		return nil, err
+	}
+
+	return b, nil
+
+}
+
+// Write writes the baseline to w as JSON.
+func (b *Baseline) Write(w io.Writer) error {
+
+	data, err := json.MarshalIndent(b, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(append(data, '\n'))
+	return err
+
+}
+
+// ValidateBaselinePatterns checks that each pattern can be used in a
+// Baseline's Allow list.
+func ValidateBaselinePatterns(patterns []string) error {
+
+	for _, p := range patterns {
+		_, err := path.Match(p, "")
+		if err != nil {
+			return fmt.Errorf("invalid allow pattern '%s': %v", p, err)
+		}
+	}
+
+	return nil
+
+}
+
+// FlattenVCFG returns every setting in cfg, keyed the way a Baseline's VCFG
+// is.
+func FlattenVCFG(cfg *vcfg.VCFG) (map[string]string, error) {
+
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	var x interface{}
+	err = json.Unmarshal(data, &x)
+	if err != nil {
+		return nil, err
+	}
+
+	m := make(map[string]string)
+	flatten(m, "", x)
+
+	return m, nil
+
+}
+
+func flatten(m map[string]string, key string, x interface{}) {
+
+	join := func(k string) string {
+		if key == "" {
+			return k
+		}
+		return key + "." + k
+	}
+
+	switch v := x.(type) {
+	case map[string]interface{}:
+		for k, child := range v {
+			flatten(m, join(k), child)
+		}
+	case []interface{}:
+		for i, child := range v {
+			flatten(m, join(strconv.Itoa(i)), child)
+		}
+	case nil:
+	default:
+		data, _ := json.Marshal(v)
+		m[key] = string(data)
+	}
+
+}
+
+// parentKey returns what contains key, or an empty string if nothing does.
+func parentKey(kind, key string) string {
+
+	if kind == BaselineFile {
+		if key == "/" {
+			return ""
+		}
+		return path.Dir(key)
+	}
+
+	idx := strings.LastIndex(key, ".")
+	if idx < 0 {
+		return ""
+	}
+
+	return key[:idx]
+
+}
+
+func allowed(kind, key string, patterns []string) bool {
+
+	for _, p := range patterns {
+
+		if strings.HasPrefix(p, "/") != (kind == BaselineFile) {
+			continue
+		}
+
+		for k := key; k != ""; k = parentKey(kind, k) {
+			if ok, _ := path.Match(p, k); ok {
+				return true
+			}
+		}
+
+	}
+
+	return false
+
+}
+
+func compareBaselineMaps(kind string, expected, actual map[string]string, patterns []string) []BaselineDifference {
+
+	var diffs []BaselineDifference
+
+	keys := make(map[string]bool)
+	for k := range expected {
+		keys[k] = true
+	}
+	for k := range actual {
+		keys[k] = true
+	}
+
+	for k := range keys {
+		if expected[k] == actual[k] {
+			continue
+		}
+		diffs = append(diffs, BaselineDifference{
+			Kind:     kind,
+			Key:      k,
+			Expected: expected[k],
+			Actual:   actual[k],
+			Allowed:  allowed(kind, k, patterns),
+		})
+	}
+
+	sort.Slice(diffs, func(i, j int) bool {
+		return diffs[i].Key < diffs[j].Key
+	})
+
+	return diffs
+
+}
+
+// Compare returns everything in actual that doesn't match the baseline,
+// files first, marking the differences allowed by the baseline's Allow
+// patterns or the extra patterns in allow.
+func (b *Baseline) Compare(actual *Baseline, allow []string) ([]BaselineDifference, error) {
+
+	err := ValidateBaselinePatterns(allow)
+	if err != nil {
+		return nil, err
+	}
+
+	patterns := append(append([]string{}, b.Allow...), allow...)
+
+	diffs := compareBaselineMaps(BaselineFile, b.Files, actual.Files, patterns)
+	diffs = append(diffs, compareBaselineMaps(BaselineVCFG, b.VCFG, actual.VCFG, patterns)...)
+
+	return diffs, nil
+
+}
@@ -0,0 +1,144 @@
+package vdisk
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/vorteil/vorteil/pkg/vcfg"
+)
+
+func TestFlattenVCFG(t *testing.T) {
+
+	cfg := new(vcfg.VCFG)
+	cfg.Info.Version = "1.0"
+	cfg.Programs = []vcfg.Program{{Args: "app --flag"}}
+
+	m, err := FlattenVCFG(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if m["info.version"] != `"1.0"` {
+		t.Errorf("info.version flattened incorrectly: %v", m)
+	}
+
+	if m["program.0.args"] != `"app --flag"` {
+		t.Errorf("program.0.args flattened incorrectly: %v", m)
+	}
+
+}
+
+func TestBaselineCompare(t *testing.T) {
+
+	expected := &Baseline{
+		Files: map[string]string{
+			"/":          "dir",
+			"/app":       "sha256:aa",
+			"/etc":       "dir",
+			"/etc/build": "sha256:bb",
+			"/lib":       "symlink:/usr/lib",
+		},
+		VCFG: map[string]string{
+			"info.version":   `"1.0"`,
+			"program.0.args": `"app"`,
+		},
+		Allow: []string{"/etc/*", "info"},
+	}
+
+	actual := &Baseline{
+		Files: map[string]string{
+			"/":          "dir",
+			"/app":       "sha256:cc",
+			"/etc":       "dir",
+			"/etc/build": "sha256:dd",
+			"/new":       "sha256:ee",
+		},
+		VCFG: map[string]string{
+			"info.version":   `"1.1"`,
+			"program.0.args": `"app --debug"`,
+		},
+	}
+
+	diffs, err := expected.Compare(actual, []string{"/ne?"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := []struct {
+		kind, key string
+		allowed   bool
+	}{
+		{BaselineFile, "/app", false},
+		{BaselineFile, "/etc/build", true},
+		{BaselineFile, "/lib", false},
+		{BaselineFile, "/new", true},
+		{BaselineVCFG, "info.version", true},
+		{BaselineVCFG, "program.0.args", false},
+	}
+
+	if len(diffs) != len(expect) {
+		t.Fatalf("expected %d differences, got %d: %v", len(expect), len(diffs), diffs)
+	}
+
+	for i, x := range expect {
+		d := diffs[i]
+		if d.Kind != x.kind || d.Key != x.key || d.Allowed != x.allowed {
+			t.Errorf("difference %d should be %s '%s' (allowed: %v), got %s '%s' (allowed: %v)", i, x.kind, x.key, x.allowed, d.Kind, d.Key, d.Allowed)
+		}
+	}
+
+	if s := diffs[2].String(); !strings.Contains(s, "removed") {
+		t.Errorf("removed file described wrongly: %s", s)
+	}
+
+	if s := diffs[3].String(); !strings.Contains(s, "added") {
+		t.Errorf("added file described wrongly: %s", s)
+	}
+
+	_, err = expected.Compare(actual, []string{"/["})
+	if err == nil {
+		t.Errorf("malformed allow pattern was accepted")
+	}
+
+}
+
+func TestLoadBaseline(t *testing.T) {
+
+	b := &Baseline{
+		Files: map[string]string{"/": "dir"},
+		VCFG:  map[string]string{"info.name": `"app"`},
+		Allow: []string{"/tmp"},
+	}
+
+	buf := new(bytes.Buffer)
+	err := b.Write(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := LoadBaseline(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	diffs, err := b.Compare(loaded, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(diffs) != 0 || len(loaded.Allow) != 1 {
+		t.Errorf("baseline changed when written and loaded: %v", diffs)
+	}
+
+	_, err = LoadBaseline(strings.NewReader(`{"allow": ["["]}`))
+	if err == nil {
+		t.Errorf("baseline with a malformed allow pattern was accepted")
+	}
+
+}
@@ -7,14 +7,20 @@ package vdisk
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 
+	"github.com/vorteil/vorteil/pkg/ebs"
 	"github.com/vorteil/vorteil/pkg/elog"
 	"github.com/vorteil/vorteil/pkg/gcparchive"
+	"github.com/vorteil/vorteil/pkg/iso"
+	"github.com/vorteil/vorteil/pkg/policy"
 	"github.com/vorteil/vorteil/pkg/qcow2"
+	"github.com/vorteil/vorteil/pkg/scan"
 	"github.com/vorteil/vorteil/pkg/vcfg"
 	"github.com/vorteil/vorteil/pkg/vhd"
+	"github.com/vorteil/vorteil/pkg/vhdx"
 	"github.com/vorteil/vorteil/pkg/vimg"
 	"github.com/vorteil/vorteil/pkg/vio"
 	"github.com/vorteil/vorteil/pkg/vmdk"
@@ -29,26 +35,97 @@ type KernelOptions struct {
 }
 
 // BuildArgs contains all arguments a caller can use to customize the behaviour
-// of the Build function.
+// of the Build function. If Image is set the disk is built from it instead of
+// from PackageReader, skipping package and file-system compilation entirely.
+//
+// DiskWriter is called once for each additional disk declared in the VCFG,
+// after the main disk has been written, to get somewhere to write it in the
+// same format. If it is nil additional disks aren't built.
+//
+// OSFiles are added to the Vorteil OS partition of the disk, rather than the
+// app's file-system.
+//
+// If FilesystemCache is set the app's file-system is reused from it when the
+// package hasn't changed since it was cached.
+//
+// If Checksums is set it is filled in with the checksums of the image written
+// to w, split into regions of Checksums.RegionSize bytes (or
+// DefaultChecksumRegionSize if that is zero). Additional disks aren't
+// checksummed.
+//
+// If Manifest is set the inputs Build knows about are recorded in it: the
+// VCFG, kernel and file count. Its outputs are left to the caller.
+//
+// If ZoneInfo is set the time-zone database in that host directory is added
+// to the app's file-system at DefaultZoneInfo, with /etc/localtime pointing
+// at the VCFG's system.timezone. The host's C.UTF-8 locale is added as well,
+// if it has one.
+//
+// The templates declared in the VCFG are rendered into the app's file-system
+// with TemplateData, which may be nil.
+//
+// If Reproducible is set everything that would otherwise be random or taken
+// from the clock is derived from it instead, so the same package always
+// builds the same image. Only some formats can be built reproducibly, and the
+// FilesystemCache isn't used.
+//
+// If Policy is set the VCFG and the app's file-system are checked against it
+// before anything is built, and the build fails if any of its rules are
+// broken. Disks built from an Image can't be checked.
+//
+// If Scanner is set the app is scanned for known vulnerabilities after the
+// Policy is checked, and the build fails if any are found that ScanIgnore
+// doesn't accept. Disks built from an Image can't be scanned.
+//
+// If Signer is set the EFI binaries on the disk are signed with it for Secure
+// Boot. The VCFG's system.boot-mode has to be "uefi" or "hybrid", and disks
+// built from an Image can't be signed.
+//
+// If Measurements is set it is filled in with the TPM measurements the main
+// disk is expected to produce when it boots. Disks built from an Image can't
+// be measured.
+//
+// If GUIDs is set it fixes or derives the GUIDs of the main disk and its
+// partitions, as described by vimg.GUIDs.
 type BuildArgs struct {
 	PackageReader    vpkg.Reader
+	Image            Image
 	Format           Format
+	FormatOptions    FormatOptions
 	SizeAlign        int64
 	KernelOptions    KernelOptions
 	Logger           elog.View
 	WithVCFGDefaults bool
+	DiskWriter       func(name string) (io.WriteSeeker, error)
+	OSFiles          vio.FileTree
+	FilesystemCache  *FilesystemCache
+	Checksums        *Checksums
+	Manifest         *Manifest
+	Policy           *policy.Policy
+	ZoneInfo         string
+	TemplateData     *TemplateData
+	Reproducible     *Reproducible
+	Signer           vimg.Signer
+	Scanner          scan.Scanner
+	ScanIgnore       *scan.Ignore
+	Measurements     *vimg.Measurements
+	GUIDs            *vimg.GUIDs
 }
 
 // NegotiateSize prebuilds the minimum amount for a disk.
 func NegotiateSize(ctx context.Context, vimgBuilder *vimg.Builder, cfg *vcfg.VCFG, args *BuildArgs) error {
+	return negotiateSize(ctx, vimgBuilder, cfg.VM.DiskSize, args)
+}
+
+func negotiateSize(ctx context.Context, vimgBuilder *vimg.Builder, diskSize vcfg.Bytes, args *BuildArgs) error {
 	size := vimgBuilder.MinimumSize()
-	if !cfg.VM.DiskSize.IsDelta() {
-		if size > int64(cfg.VM.DiskSize.Units(vcfg.Byte)) {
-			delta := vcfg.Bytes(size) - cfg.VM.DiskSize
+	if !diskSize.IsDelta() {
+		if size > int64(diskSize.Units(vcfg.Byte)) {
+			delta := vcfg.Bytes(size) - diskSize
 			delta.Align(vcfg.MiB)
 			return fmt.Errorf("specified disk size %s insufficient to contain disk contents", delta)
 		}
-		size = int64(cfg.VM.DiskSize.Units(vcfg.Byte))
+		size = int64(diskSize.Units(vcfg.Byte))
 	}
 
 	alignment := args.SizeAlign
@@ -80,12 +157,27 @@ func build(ctx context.Context, w io.WriteSeeker, cfg *vcfg.VCFG, args *BuildArg
 
 	log := args.Logger
 
-	fsCompiler, err := NewFilesystemCompiler(string(cfg.System.Filesystem), log, args.PackageReader.FS(), nil)
+	fsCompiler, err := NewFilesystemCompiler(string(cfg.System.Filesystem), log, args.PackageReader.FS(), cfg)
+	if err != nil {
+		return err
+	}
+	args.reproduce(fsCompiler, "")
+
+	// a cached file-system may have been built at another time
+	if args.FilesystemCache != nil && args.Reproducible == nil {
+		fsCompiler, err = args.FilesystemCache.Compiler(log, fsCompiler, string(cfg.System.Filesystem), args.PackageReader.FS(), cfg)
+		if err != nil {
+			return err
+		}
+	}
+
+	partitions, err := ExtraPartitions(cfg, args)
 	if err != nil {
 		return err
 	}
 
 	vimgBuilder, err := CreateBuilder(ctx, &vimg.BuilderArgs{
+		Seed: args.seed(""),
 		Kernel: vimg.KernelOptions{
 			Record: args.KernelOptions.Record,
 			Shell:  args.KernelOptions.Shell,
@@ -93,12 +185,20 @@ func build(ctx context.Context, w io.WriteSeeker, cfg *vcfg.VCFG, args *BuildArg
 		FSCompiler: fsCompiler,
 		VCFG:       cfg,
 		Logger:     log,
+		OSFiles:    args.OSFiles,
+		Partitions: partitions,
+		Signer:     args.Signer,
+		GUIDs:      args.GUIDs,
 	})
 	if err != nil {
 		return err
 	}
 	defer vimgBuilder.Close()
 
+	if args.Manifest != nil {
+		args.Manifest.Inputs.Kernel = string(vimgBuilder.KernelUsed())
+	}
+
 	vimgBuilder.SetDefaultMTU(args.Format.DefaultMTU())
 
 	err = NegotiateSize(ctx, vimgBuilder, cfg, args)
@@ -106,7 +206,17 @@ func build(ctx context.Context, w io.WriteSeeker, cfg *vcfg.VCFG, args *BuildArg
 		return err
 	}
 
-	err = args.Format.Build(ctx, log, w, vimgBuilder, cfg)
+	err = args.Format.BuildWithOptions(ctx, log, w, vimgBuilder, cfg, args.FormatOptions)
+	if err != nil {
+		return err
+	}
+
+	err = recordMeasurements(vimgBuilder, args)
+	if err != nil {
+		return err
+	}
+
+	err = BuildDisks(ctx, cfg, args)
 	if err != nil {
 		return err
 	}
@@ -118,6 +228,53 @@ func build(ctx context.Context, w io.WriteSeeker, cfg *vcfg.VCFG, args *BuildArg
 // Build writes a virtual disk image to w using the provided args.
 func Build(ctx context.Context, w io.WriteSeeker, args *BuildArgs) error {
 
+	if args.Checksums == nil {
+		return buildImage(ctx, w, args)
+	}
+
+	cw := NewChecksumWriter(w, args.Checksums.RegionSize)
+
+	err := buildImage(ctx, cw, args)
+	if err != nil {
+		return err
+	}
+
+	r, _ := w.(io.ReaderAt)
+	sums, err := cw.Checksums(r)
+	if err != nil {
+		return err
+	}
+
+	*args.Checksums = *sums
+
+	return nil
+
+}
+
+func buildImage(ctx context.Context, w io.WriteSeeker, args *BuildArgs) error {
+
+	if args.Image != nil {
+		if args.OSFiles != nil {
+			return errors.New("os files can't be added to a disk built from an image")
+		}
+		if args.Policy != nil {
+			return errors.New("policies can't be checked against a disk built from an image")
+		}
+		if args.Scanner != nil {
+			return errors.New("a disk built from an image can't be scanned")
+		}
+		if args.Signer != nil {
+			return errors.New("a disk built from an image can't be signed for secure boot")
+		}
+		if args.Measurements != nil {
+			return errors.New("a disk built from an image can't be measured")
+		}
+		if args.GUIDs != nil {
+			return errors.New("the GUIDs of a disk built from an image can't be changed")
+		}
+		return buildFromImage(ctx, w, args)
+	}
+
 	vf := args.PackageReader.VCFG()
 	defer vf.Close()
 	cfg, err := vcfg.LoadFile(vf)
@@ -134,6 +291,79 @@ func Build(ctx context.Context, w io.WriteSeeker, args *BuildArgs) error {
 		}
 	}
 
+	err = validateReproducible(cfg, args)
+	if err != nil {
+		return err
+	}
+
+	err = ValidateDisks(cfg, args.PackageReader)
+	if err != nil {
+		return err
+	}
+
+	err = ValidateNodes(cfg)
+	if err != nil {
+		return err
+	}
+
+	err = mapNodes(cfg, args.PackageReader.FS())
+	if err != nil {
+		return err
+	}
+
+	if args.ZoneInfo != "" {
+		err = MapTimezoneData(cfg, args.ZoneInfo, args.PackageReader.FS())
+		if err != nil {
+			return err
+		}
+	}
+
+	err = ValidateTemplates(cfg)
+	if err != nil {
+		return err
+	}
+
+	err = RenderTemplates(cfg, args.TemplateData, args.PackageReader.FS())
+	if err != nil {
+		return err
+	}
+
+	err = ValidateOwnership(cfg)
+	if err != nil {
+		return err
+	}
+
+	err = ValidateQuotas(cfg)
+	if err != nil {
+		return err
+	}
+
+	err = applyOwnership(cfg, args.PackageReader.FS())
+	if err != nil {
+		return err
+	}
+
+	if args.Policy != nil {
+		err = args.Policy.Check(cfg, args.PackageReader.FS())
+		if err != nil {
+			return err
+		}
+	}
+
+	if args.Scanner != nil {
+		err = scan.Check(ctx, args.Scanner, args.ScanIgnore, cfg, args.PackageReader.FS(), args.Logger)
+		if err != nil {
+			return err
+		}
+	}
+
+	if args.Manifest != nil {
+		err = args.Manifest.recordInputs(cfg, args.PackageReader.FS())
+		if err != nil {
+			return err
+		}
+	}
+
 	err = build(ctx, w, cfg, args)
 	if err != nil {
 		return err
@@ -165,7 +395,7 @@ func lcm(a, b int64, integers ...int64) int64 {
 }
 
 func buildRAW(w io.WriteSeeker, b *vimg.Builder, cfg *vcfg.VCFG) (io.WriteSeeker, error) {
-	return vio.WriteSeeker(w)
+	return newRawWriter(w, b.Size())
 }
 
 func buildStreamOptimizedVMDK(w io.WriteSeeker, b *vimg.Builder, cfg *vcfg.VCFG) (io.WriteSeeker, error) {
@@ -180,6 +410,14 @@ func buildGCPArchive(w io.WriteSeeker, b *vimg.Builder, cfg *vcfg.VCFG) (io.Writ
 	return gcparchive.NewWriter(w, b)
 }
 
+func buildEBS(w io.WriteSeeker, b *vimg.Builder, cfg *vcfg.VCFG) (io.WriteSeeker, error) {
+	return ebs.NewWriter(w, b)
+}
+
+func buildISO(w io.WriteSeeker, b *vimg.Builder, cfg *vcfg.VCFG) (io.WriteSeeker, error) {
+	return iso.NewWriter(w, b)
+}
+
 func buildXVA(w io.WriteSeeker, b *vimg.Builder, cfg *vcfg.VCFG) (io.WriteSeeker, error) {
 	return xva.NewWriter(w, b, cfg)
 }
@@ -188,10 +426,50 @@ func buildFixedVHD(w io.WriteSeeker, b *vimg.Builder, cfg *vcfg.VCFG) (io.WriteS
 	return vhd.NewFixedWriter(w, b)
 }
 
+func buildAzureVHD(w io.WriteSeeker, b *vimg.Builder, cfg *vcfg.VCFG) (io.WriteSeeker, error) {
+	return vhd.NewAzureWriter(w, b)
+}
+
 func buildDynamicVHD(w io.WriteSeeker, b *vimg.Builder, cfg *vcfg.VCFG) (io.WriteSeeker, error) {
 	return vhd.NewDynamicWriter(w, b)
 }
 
+func buildDynamicVHDWithOptions(w io.WriteSeeker, b *vimg.Builder, cfg *vcfg.VCFG, opts FormatOptions) (io.WriteSeeker, error) {
+
+	err := opts.checkKeys(VHDDynamicFormat, "parent")
+	if err != nil {
+		return nil, err
+	}
+
+	if opts["parent"] == "" {
+		return vhd.NewDynamicWriter(w, b)
+	}
+
+	return vhd.NewDifferencingWriter(w, b, opts["parent"])
+}
+
+func buildVHDX(w io.WriteSeeker, b *vimg.Builder, cfg *vcfg.VCFG) (io.WriteSeeker, error) {
+	return vhdx.NewDynamicWriter(w, b, nil)
+}
+
 func buildQCOW2(w io.WriteSeeker, b *vimg.Builder, cfg *vcfg.VCFG) (io.WriteSeeker, error) {
 	return qcow2.NewWriter(w, b)
 }
+
+func buildQCOW2WithOptions(w io.WriteSeeker, b *vimg.Builder, cfg *vcfg.VCFG, opts FormatOptions) (io.WriteSeeker, error) {
+
+	err := opts.checkKeys(QCOW2Format, "compress", "backing")
+	if err != nil {
+		return nil, err
+	}
+
+	compression, err := qcow2.ParseCompression(opts["compress"])
+	if err != nil {
+		return nil, err
+	}
+
+	return qcow2.NewWriterWithOptions(w, b, &qcow2.Options{
+		Compression: compression,
+		Backing:     opts["backing"],
+	})
+}
@@ -0,0 +1,398 @@
+package vdisk
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/vorteil/vorteil/pkg/elog"
+	"github.com/vorteil/vorteil/pkg/vcfg"
+	"github.com/vorteil/vorteil/pkg/vimg"
+	"github.com/vorteil/vorteil/pkg/vio"
+)
+
+// DefaultFilesystemCacheEntries is the number of file-systems a
+// FilesystemCache keeps before it starts evicting the least recently used.
+const DefaultFilesystemCacheEntries = 4
+
+const (
+	cacheHoleChunk  = 0x100000
+	cacheBlockChunk = 0x1000
+)
+
+// FilesystemCache keeps compiled file-systems on disk so that repeated builds
+// of an unchanged package only have to regenerate the OS partition and the
+// disk format wrapper. File-systems are keyed by a digest of the package's
+// file tree (paths, sizes, modification times and symlink targets, but not
+// file contents), the file-system compiler and its options, and the size of
+// the partition.
+type FilesystemCache struct {
+	dir  string
+	max  int
+	lock sync.Mutex
+}
+
+// NewFilesystemCache returns a FilesystemCache that stores its file-systems in
+// dir.
+func NewFilesystemCache(dir string) (*FilesystemCache, error) {
+
+	err := os.MkdirAll(dir, 0777)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FilesystemCache{
+		dir: dir,
+		max: DefaultFilesystemCacheEntries,
+	}, nil
+
+}
+
+// Compiler wraps fs, which must have been created from tree by the named
+// file-system compiler with cfg as its args, so that it writes a cached
+// file-system if one exists and caches what it compiles if not. Encrypted
+// disks are never cached, because the cache is not encrypted at rest.
+func (c *FilesystemCache) Compiler(log elog.View, fs vimg.FSCompiler, name string, tree vio.FileTree, cfg *vcfg.VCFG) (vimg.FSCompiler, error) {
+
+	if cfg.System.Encryption.Enabled() {
+		return fs, nil
+	}
+
+	hasher := sha256.New()
+	fmt.Fprintf(hasher, "compiler %s\n", name)
+
+	system, err := json.Marshal(cfg.System)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(hasher, "system %s\n", system)
+
+	quotas, err := json.Marshal(cfg.Quotas)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(hasher, "quotas %s\n", quotas)
+
+	err = tree.Walk(func(path string, f vio.File) error {
+		var symlink string
+		if f.IsSymlink() && f.SymlinkIsCached() {
+			symlink = f.Symlink()
+		}
+		fmt.Fprintf(hasher, "file %q %v %v %d %d %q\n", path, f.IsDir(), f.IsSymlink(), f.Size(), f.ModTime().UnixNano(), symlink)
+		if f.Special() != 0 {
+			major, minor := f.Device()
+			fmt.Fprintf(hasher, "special %v %d %d\n", f.Special(), major, minor)
+		}
+		if o := f.Ownership(); o != nil {
+			fmt.Fprintf(hasher, "owner %d %d %o\n", o.UID, o.GID, o.Mode)
+		}
+		xattrs := f.Xattrs()
+		names := make([]string, 0, len(xattrs))
+		for name := range xattrs {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintf(hasher, "xattr %q %x\n", name, xattrs[name])
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &cachingCompiler{
+		FSCompiler: fs,
+		cache:      c,
+		log:        log,
+		hasher:     hasher,
+		cacheable:  true,
+	}, nil
+
+}
+
+// write copies the cached file-system at path to w if it exists, skipping the
+// regions that fs reports as holes.
+func (c *FilesystemCache) write(ctx context.Context, path string, w io.WriteSeeker, fs vimg.FSCompiler) (bool, error) {
+
+	c.lock.Lock()
+	f, err := os.Open(path)
+	if err == nil {
+		now := time.Now()
+		_ = os.Chtimes(path, now, now)
+	}
+	c.lock.Unlock()
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+	size := fi.Size()
+
+	buf := make([]byte, cacheBlockChunk)
+
+	for k := int64(0); k < size; k += cacheHoleChunk {
+
+		err = ctx.Err()
+		if err != nil {
+			return false, err
+		}
+
+		n := size - k
+		if n > cacheHoleChunk {
+			n = cacheHoleChunk
+		}
+
+		if fs.RegionIsHole(k, n) {
+			continue
+		}
+
+		for j := k; j < k+n; j += cacheBlockChunk {
+
+			m := k + n - j
+			if m > cacheBlockChunk {
+				m = cacheBlockChunk
+			}
+
+			if fs.RegionIsHole(j, m) {
+				continue
+			}
+
+			_, err = f.ReadAt(buf[:m], j)
+			if err != nil {
+				return false, err
+			}
+
+			_, err = w.Seek(j, io.SeekStart)
+			if err != nil {
+				return false, err
+			}
+
+			_, err = w.Write(buf[:m])
+			if err != nil {
+				return false, err
+			}
+
+		}
+
+	}
+
+	_, err = w.Seek(size, io.SeekStart)
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+
+}
+
+// store moves a newly compiled file-system into the cache, evicting the least
+// recently used file-systems if there are too many.
+func (c *FilesystemCache) store(tmp, path string) error {
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	err := os.Rename(tmp, path)
+	if err != nil {
+		return err
+	}
+
+	matches, err := filepath.Glob(filepath.Join(c.dir, "*.fs"))
+	if err != nil {
+		return err
+	}
+
+	if len(matches) <= c.max {
+		return nil
+	}
+
+	var infos []os.FileInfo
+	for _, match := range matches {
+		fi, err := os.Stat(match)
+		if err == nil {
+			infos = append(infos, fi)
+		}
+	}
+
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ModTime().After(infos[j].ModTime())
+	})
+
+	for i := c.max; i < len(infos); i++ {
+		_ = os.Remove(filepath.Join(c.dir, infos[i].Name()))
+	}
+
+	return nil
+
+}
+
+// cachingCompiler records everything that affects the output of the
+// vimg.FSCompiler it wraps, so that it can find its file-system in a
+// FilesystemCache.
+type cachingCompiler struct {
+	vimg.FSCompiler
+	cache     *FilesystemCache
+	log       elog.View
+	hasher    hash.Hash
+	cacheable bool
+	path      string
+}
+
+func (c *cachingCompiler) Mkdir(path string) error {
+	fmt.Fprintf(c.hasher, "mkdir %q\n", path)
+	return c.FSCompiler.Mkdir(path)
+}
+
+func (c *cachingCompiler) AddFile(path string, r io.ReadCloser, size int64, force bool) error {
+	// there's no way to know what's in the file without reading it
+	c.cacheable = false
+	return c.FSCompiler.AddFile(path, r, size, force)
+}
+
+func (c *cachingCompiler) IncreaseMinimumFreeSpace(space int64) {
+	fmt.Fprintf(c.hasher, "free %d\n", space)
+	c.FSCompiler.IncreaseMinimumFreeSpace(space)
+}
+
+func (c *cachingCompiler) SetMinimumInodes(inodes int64) {
+	fmt.Fprintf(c.hasher, "inodes %d\n", inodes)
+	c.FSCompiler.SetMinimumInodes(inodes)
+}
+
+func (c *cachingCompiler) SetMinimumInodesPer64MiB(inodes int64) {
+	fmt.Fprintf(c.hasher, "inodes-per-64mib %d\n", inodes)
+	c.FSCompiler.SetMinimumInodesPer64MiB(inodes)
+}
+
+func (c *cachingCompiler) IncreaseMinimumInodes(inodes int64) {
+	fmt.Fprintf(c.hasher, "more-inodes %d\n", inodes)
+	c.FSCompiler.IncreaseMinimumInodes(inodes)
+}
+
+func (c *cachingCompiler) Precompile(ctx context.Context, size int64) error {
+
+	err := c.FSCompiler.Precompile(ctx, size)
+	if err != nil {
+		return err
+	}
+
+	if c.cacheable {
+		fmt.Fprintf(c.hasher, "size %d\n", size)
+		c.path = filepath.Join(c.cache.dir, hex.EncodeToString(c.hasher.Sum(nil))+".fs")
+	}
+
+	return nil
+
+}
+
+func (c *cachingCompiler) Compile(ctx context.Context, w io.WriteSeeker) error {
+
+	if c.path == "" {
+		return c.FSCompiler.Compile(ctx, w)
+	}
+
+	ok, err := c.cache.write(ctx, c.path, w, c.FSCompiler)
+	if err != nil {
+		return err
+	}
+	if ok {
+		c.log.Debugf("Using cached file-system: %s", c.path)
+		return nil
+	}
+
+	f, err := ioutil.TempFile(c.cache.dir, "fs-")
+	if err != nil {
+		c.log.Warnf("Failed to cache file-system: %v", err)
+		return c.FSCompiler.Compile(ctx, w)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	cw := &cacheWriter{w: w, f: f}
+
+	err = c.FSCompiler.Compile(ctx, cw)
+	if err != nil {
+		return err
+	}
+
+	end, err := w.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+
+	if cw.err == nil {
+		cw.err = f.Truncate(end)
+	}
+
+	if cw.err == nil {
+		cw.err = f.Close()
+	}
+
+	if cw.err == nil {
+		cw.err = c.cache.store(f.Name(), c.path)
+	}
+
+	if cw.err != nil {
+		c.log.Warnf("Failed to cache file-system: %v", cw.err)
+	}
+
+	return nil
+
+}
+
+// cacheWriter copies everything written to w into f at the same offsets. If
+// writing to f fails it gives up on f, but keeps writing to w.
+type cacheWriter struct {
+	w   io.WriteSeeker
+	f   *os.File
+	err error
+}
+
+func (cw *cacheWriter) Write(p []byte) (int, error) {
+
+	n, err := cw.w.Write(p)
+	if cw.err == nil {
+		_, cw.err = cw.f.Write(p[:n])
+	}
+
+	return n, err
+
+}
+
+func (cw *cacheWriter) Seek(offset int64, whence int) (int64, error) {
+
+	k, err := cw.w.Seek(offset, whence)
+	if err != nil {
+		return k, err
+	}
+
+	if cw.err == nil {
+		_, cw.err = cw.f.Seek(k, io.SeekStart)
+	}
+
+	return k, nil
+
+}
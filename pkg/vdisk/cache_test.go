@@ -0,0 +1,166 @@
+package vdisk
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vorteil/vorteil/pkg/elog"
+	"github.com/vorteil/vorteil/pkg/vcfg"
+	"github.com/vorteil/vorteil/pkg/vio"
+)
+
+// cacheTestCompiler writes a recognizable file-system with a hole in the
+// middle and counts how many times it is compiled.
+type cacheTestCompiler struct {
+	compiles int
+}
+
+func (c *cacheTestCompiler) Mkdir(path string) error {
+	return nil
+}
+
+func (c *cacheTestCompiler) AddFile(path string, r io.ReadCloser, size int64, force bool) error {
+	return r.Close()
+}
+
+func (c *cacheTestCompiler) IncreaseMinimumFreeSpace(space int64)  {}
+func (c *cacheTestCompiler) SetMinimumInodes(inodes int64)         {}
+func (c *cacheTestCompiler) SetMinimumInodesPer64MiB(inodes int64) {}
+func (c *cacheTestCompiler) IncreaseMinimumInodes(inodes int64)    {}
+
+func (c *cacheTestCompiler) Commit(ctx context.Context) error {
+	return nil
+}
+
+func (c *cacheTestCompiler) MinimumSize() int64 {
+	return cacheHoleChunk * 3
+}
+
+func (c *cacheTestCompiler) Precompile(ctx context.Context, size int64) error {
+	return nil
+}
+
+func (c *cacheTestCompiler) Compile(ctx context.Context, w io.WriteSeeker) error {
+
+	c.compiles++
+
+	_, err := w.Write(bytes.Repeat([]byte{1}, cacheHoleChunk+100))
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Seek(cacheHoleChunk*2, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write([]byte("vorteil"))
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Seek(cacheHoleChunk*3, io.SeekStart)
+	return err
+
+}
+
+func (c *cacheTestCompiler) RegionIsHole(begin, size int64) bool {
+	return begin >= cacheHoleChunk+cacheBlockChunk && begin+size <= cacheHoleChunk*2
+}
+
+func compileWithCache(t *testing.T, cache *FilesystemCache, tree vio.FileTree, cfg *vcfg.VCFG) ([]byte, int) {
+
+	fs := new(cacheTestCompiler)
+	c, err := cache.Compiler(&elog.CLI{}, fs, "test", tree, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.IncreaseMinimumFreeSpace(0x100000)
+
+	err = c.Precompile(context.Background(), c.MinimumSize())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := new(bytes.Buffer)
+	w, err := vio.WriteSeeker(struct{ io.Writer }{buf})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = c.Compile(context.Background(), w)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes(), fs.compiles
+
+}
+
+func TestFilesystemCache(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "fscache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cache, err := NewFilesystemCache(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tree := vio.NewFileTree()
+	defer tree.Close()
+
+	err = tree.Map("app", vio.CustomFile(vio.CustomFileArgs{
+		Name:       "app",
+		Size:       4,
+		ModTime:    time.Unix(1600000000, 0),
+		ReadCloser: ioutil.NopCloser(strings.NewReader("data")),
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := new(vcfg.VCFG)
+
+	compiled, n := compileWithCache(t, cache, tree, cfg)
+	if n != 1 {
+		t.Fatalf("file-system wasn't compiled on a cache miss")
+	}
+
+	cached, n := compileWithCache(t, cache, tree, cfg)
+	if n != 0 {
+		t.Errorf("file-system was compiled despite being cached")
+	}
+
+	if !bytes.Equal(compiled, cached) {
+		t.Errorf("cached file-system differs from the compiled one")
+	}
+
+	cfg.System.FilesystemLabel = "changed"
+	_, n = compileWithCache(t, cache, tree, cfg)
+	if n != 1 {
+		t.Errorf("cached file-system was used after the compiler options changed")
+	}
+
+	cfg.System.Encryption.Passphrase = "secret"
+	_, n = compileWithCache(t, cache, tree, cfg)
+	if n != 1 {
+		t.Errorf("encrypted file-system was taken from the cache")
+	}
+
+}
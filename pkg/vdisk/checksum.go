@@ -0,0 +1,325 @@
+package vdisk
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+)
+
+// DefaultChecksumRegionSize is the size of the regions an image is split into
+// for checksumming, unless another size is requested.
+const DefaultChecksumRegionSize = 0x4000000 // 64 MiB
+
+// ChecksumsSuffix is appended to an image's path to get the path of its
+// checksums manifest.
+const ChecksumsSuffix = ".sha256.json"
+
+// ChecksumAlgorithm is the only algorithm checksums manifests currently use.
+const ChecksumAlgorithm = "sha256"
+
+// Checksums is a manifest of the SHA256 checksums of each region of an image
+// file, so that a copy of the image can be checked for corruption and the
+// damaged parts located. The last region may be shorter than RegionSize.
+type Checksums struct {
+	Algorithm  string   `json:"algorithm"`
+	Size       int64    `json:"size"`
+	RegionSize int64    `json:"region-size"`
+	Regions    []string `json:"regions"`
+}
+
+// ChecksumMismatch describes a region of an image that doesn't match its
+// checksum.
+type ChecksumMismatch struct {
+	Region int
+	Offset int64
+	Size   int64
+}
+
+// LoadChecksums reads a checksums manifest from r.
+func LoadChecksums(r io.Reader) (*Checksums, error) {
+
+	sums := new(Checksums)
+	err := json.NewDecoder(r).Decode(sums)
+	if err != nil {
+		return nil, err
+	}
+
+	if sums.Algorithm != ChecksumAlgorithm {
+		return nil, fmt.Errorf("unsupported checksum algorithm '%s'", sums.Algorithm)
+	}
+
+	if sums.RegionSize <= 0 || int64(len(sums.Regions)) != regionCount(sums.Size, sums.RegionSize) {
+		return nil, errors.New("malformed checksums manifest")
+	}
+
+	return sums, nil
+
+}
+
+// Write writes the checksums manifest to w as JSON.
+func (sums *Checksums) Write(w io.Writer) error {
+
+	data, err := json.MarshalIndent(sums, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(append(data, '\n'))
+	return err
+
+}
+
+func regionCount(size, regionSize int64) int64 {
+	return (size + regionSize - 1) / regionSize
+}
+
+// ComputeChecksums reads the first size bytes of r and returns their
+// checksums, split into regions of regionSize bytes.
+func ComputeChecksums(r io.ReaderAt, size, regionSize int64) (*Checksums, error) {
+
+	if regionSize <= 0 {
+		regionSize = DefaultChecksumRegionSize
+	}
+
+	sums := &Checksums{
+		Algorithm:  ChecksumAlgorithm,
+		Size:       size,
+		RegionSize: regionSize,
+	}
+
+	for off := int64(0); off < size; off += regionSize {
+
+		n := size - off
+		if n > regionSize {
+			n = regionSize
+		}
+
+		hasher := sha256.New()
+		_, err := io.Copy(hasher, io.NewSectionReader(r, off, n))
+		if err != nil {
+			return nil, err
+		}
+
+		sums.Regions = append(sums.Regions, hex.EncodeToString(hasher.Sum(nil)))
+
+	}
+
+	return sums, nil
+
+}
+
+// Verify checks the first sums.Size bytes of r against the checksums and
+// returns the regions that don't match. An error is returned if r isn't the
+// right size.
+func (sums *Checksums) Verify(r io.ReaderAt, size int64) ([]ChecksumMismatch, error) {
+
+	if size != sums.Size {
+		return nil, fmt.Errorf("image is %d bytes but should be %d bytes", size, sums.Size)
+	}
+
+	actual, err := ComputeChecksums(r, sums.Size, sums.RegionSize)
+	if err != nil {
+		return nil, err
+	}
+
+	var mismatches []ChecksumMismatch
+
+	for i := range sums.Regions {
+		if actual.Regions[i] == sums.Regions[i] {
+			continue
+		}
+
+		off := int64(i) * sums.RegionSize
+		n := sums.Size - off
+		if n > sums.RegionSize {
+			n = sums.RegionSize
+		}
+
+		mismatches = append(mismatches, ChecksumMismatch{
+			Region: i,
+			Offset: off,
+			Size:   n,
+		})
+	}
+
+	return mismatches, nil
+
+}
+
+// ChecksumWriter checksums everything written through it to an image. Data
+// written in order (including skipped over space, which is treated as zeroes)
+// is hashed as it goes. If anything is written out of order the image has to
+// be read back to be checksummed.
+//
+// It passes Stat and Truncate through to the destination if it supports them,
+// so that raw images can still be written as sparse files.
+type ChecksumWriter struct {
+	w          io.WriteSeeker
+	regionSize int64
+	pos        int64
+	size       int64
+	hashed     int64
+	hasher     hash.Hash
+	regions    []string
+	reread     bool
+}
+
+// NewChecksumWriter returns a ChecksumWriter that writes to w, which must be
+// at the start of the image.
+func NewChecksumWriter(w io.WriteSeeker, regionSize int64) *ChecksumWriter {
+
+	if regionSize <= 0 {
+		regionSize = DefaultChecksumRegionSize
+	}
+
+	return &ChecksumWriter{
+		w:          w,
+		regionSize: regionSize,
+		hasher:     sha256.New(),
+	}
+
+}
+
+// hash adds p to the checksums, at the offset already hashed up to.
+func (cw *ChecksumWriter) hash(p []byte) {
+
+	for len(p) > 0 {
+
+		n := cw.regionSize - cw.hashed%cw.regionSize
+		if n > int64(len(p)) {
+			n = int64(len(p))
+		}
+
+		_, _ = cw.hasher.Write(p[:n])
+		cw.hashed += n
+		p = p[n:]
+
+		if cw.hashed%cw.regionSize == 0 {
+			cw.regions = append(cw.regions, hex.EncodeToString(cw.hasher.Sum(nil)))
+			cw.hasher.Reset()
+		}
+
+	}
+
+}
+
+// hashZeroes adds zeroes to the checksums up to offset end.
+func (cw *ChecksumWriter) hashZeroes(end int64) {
+
+	zeroes := make([]byte, 0x10000)
+	for cw.hashed < end {
+		n := end - cw.hashed
+		if n > int64(len(zeroes)) {
+			n = int64(len(zeroes))
+		}
+		cw.hash(zeroes[:n])
+	}
+
+}
+
+// Write implements io.Writer.
+func (cw *ChecksumWriter) Write(p []byte) (int, error) {
+
+	n, err := cw.w.Write(p)
+
+	if !cw.reread {
+		if cw.pos < cw.hashed {
+			cw.reread = true
+		} else {
+			cw.hashZeroes(cw.pos)
+			cw.hash(p[:n])
+		}
+	}
+
+	cw.pos += int64(n)
+	if cw.pos > cw.size {
+		cw.size = cw.pos
+	}
+
+	return n, err
+
+}
+
+// Seek implements io.Seeker.
+func (cw *ChecksumWriter) Seek(offset int64, whence int) (int64, error) {
+
+	k, err := cw.w.Seek(offset, whence)
+	if err != nil {
+		return k, err
+	}
+
+	cw.pos = k
+	return k, nil
+
+}
+
+// Stat returns the destination's os.FileInfo, if it has one.
+func (cw *ChecksumWriter) Stat() (os.FileInfo, error) {
+
+	f, ok := cw.w.(interface{ Stat() (os.FileInfo, error) })
+	if !ok {
+		return nil, errors.New("destination can't be stat'd")
+	}
+
+	return f.Stat()
+
+}
+
+// Truncate changes the size of the destination, if it supports it.
+func (cw *ChecksumWriter) Truncate(size int64) error {
+
+	f, ok := cw.w.(interface{ Truncate(int64) error })
+	if !ok {
+		return errors.New("destination can't be truncated")
+	}
+
+	err := f.Truncate(size)
+	if err != nil {
+		return err
+	}
+
+	if size < cw.hashed {
+		cw.reread = true
+	}
+
+	cw.size = size
+	return nil
+
+}
+
+// Checksums returns the checksums of the image. If it was written out of
+// order it is read back from r, and an error is returned if r is nil.
+func (cw *ChecksumWriter) Checksums(r io.ReaderAt) (*Checksums, error) {
+
+	if cw.reread {
+		if r == nil {
+			return nil, errors.New("image was written out of order and can't be read back to checksum it")
+		}
+		return ComputeChecksums(r, cw.size, cw.regionSize)
+	}
+
+	cw.hashZeroes(cw.size)
+
+	regions := cw.regions
+	if cw.hashed%cw.regionSize != 0 {
+		regions = append(regions, hex.EncodeToString(cw.hasher.Sum(nil)))
+	}
+
+	return &Checksums{
+		Algorithm:  ChecksumAlgorithm,
+		Size:       cw.size,
+		RegionSize: cw.regionSize,
+		Regions:    append([]string(nil), regions...),
+	}, nil
+
+}
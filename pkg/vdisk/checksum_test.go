@@ -0,0 +1,122 @@
+package vdisk
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestChecksumWriter(t *testing.T) {
+
+	f, err := ioutil.TempFile("", "checksums")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	cw := NewChecksumWriter(f, 0x1000)
+
+	// data, a hole spanning a whole region, then data again
+	_, err = cw.Write(bytes.Repeat([]byte{1}, 0x1800))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = cw.Seek(0x3000, io.SeekStart)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = cw.Write([]byte("vorteil"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = cw.Truncate(0x4800)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sums, err := cw.Checksums(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect, err := ComputeChecksums(f, 0x4800, 0x1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(sums, expect) {
+		t.Errorf("checksums of an image written in order don't match its contents")
+	}
+
+	// writing before the end of what's been hashed forces a re-read
+	_, err = cw.Seek(0x10, io.SeekStart)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = cw.Write([]byte("rewritten"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = cw.Checksums(nil)
+	if err == nil {
+		t.Errorf("checksums of an image written out of order were calculated without reading it")
+	}
+
+	sums, err = cw.Checksums(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mismatches, err := sums.Verify(f, 0x4800)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(mismatches) != 0 {
+		t.Errorf("image doesn't match its own checksums")
+	}
+
+	_, err = f.WriteAt([]byte{0xFF}, 0x2100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mismatches, err = sums.Verify(f, 0x4800)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(mismatches) != 1 || mismatches[0].Region != 2 {
+		t.Errorf("expected region 2 to be corrupt, got %v", mismatches)
+	}
+
+	buf := new(bytes.Buffer)
+	err = sums.Write(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := LoadChecksums(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(loaded, sums) {
+		t.Errorf("checksums changed when written and loaded")
+	}
+
+}
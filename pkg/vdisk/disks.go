@@ -0,0 +1,311 @@
+package vdisk
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/vorteil/vorteil/pkg/elog"
+	"github.com/vorteil/vorteil/pkg/vcfg"
+	"github.com/vorteil/vorteil/pkg/vimg"
+	"github.com/vorteil/vorteil/pkg/vio"
+	"github.com/vorteil/vorteil/pkg/vpkg"
+)
+
+// DiskPath returns the path an additional disk should be written to given the
+// path of the main disk, by inserting the disk's name before the extension.
+// For example, the "data" disk of "app.vmdk" is "app-data.vmdk".
+func DiskPath(main, name string) string {
+	ext := filepath.Ext(main)
+	return strings.TrimSuffix(main, ext) + "-" + name + ext
+}
+
+// ValidateDisks checks the additional disks and extra partitions declared in
+// cfg, that the root and overlay file-systems can hold more than plain files,
+// and that every additional disk in the package is one of them. Disks and
+// partitions share names, because they are both seeded from the package's
+// disk trees.
+func ValidateDisks(cfg *vcfg.VCFG, pkg vpkg.Reader) error {
+
+	names := make(map[string]bool)
+	mounts := make(map[string]bool)
+
+	validate := func(what, name, mountPoint string, fs vcfg.Filesystem) error {
+
+		err := vpkg.ValidDiskName(name)
+		if err != nil {
+			return err
+		}
+
+		if names[name] {
+			return fmt.Errorf("disk or partition '%s' declared more than once", name)
+		}
+		names[name] = true
+
+		mount := path.Clean(mountPoint)
+		if !path.IsAbs(mount) || mount == "/" {
+			return fmt.Errorf("%s '%s' has invalid mount point '%s': must be an absolute path other than the root", what, name, mountPoint)
+		}
+
+		if mounts[mount] {
+			return fmt.Errorf("more than one disk or partition mounted at '%s'", mount)
+		}
+		mounts[mount] = true
+
+		if fs != "" {
+			if _, ok := registeredFSCompilers[string(fs)]; !ok {
+				return fmt.Errorf("%s '%s' has unsupported file-system '%s'", what, name, fs)
+			}
+		}
+
+		return nil
+
+	}
+
+	for _, disk := range cfg.Disks {
+		err := validate("disk", disk.Name, disk.MountPoint, disk.Filesystem)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, p := range cfg.Partitions {
+		if p.Name == vimg.OverlayLabel && cfg.System.OverlaySize != 0 {
+			return fmt.Errorf("partition name '%s' is reserved for the overlay partition", p.Name)
+		}
+
+		err := validate("partition", p.Name, p.MountPoint, p.Filesystem)
+		if err != nil {
+			return err
+		}
+
+		_, err = vimg.PartitionAttributes(p.Flags)
+		if err != nil {
+			return fmt.Errorf("partition '%s': %v", p.Name, err)
+		}
+	}
+
+	if fs := cfg.System.OverlayFilesystem; fs != "" {
+		if cfg.System.OverlaySize == 0 {
+			return errors.New("system.overlay-filesystem needs system.overlay-size to be set")
+		}
+		if _, ok := registeredFSCompilers[string(fs)]; !ok {
+			return fmt.Errorf("overlay partition has unsupported file-system '%s'", fs)
+		}
+		if fs.ReadOnly() {
+			return fmt.Errorf("overlay partition can't use the read-only file-system '%s'", fs)
+		}
+		if fs.DataOnly() {
+			return fmt.Errorf("overlay partition can't use the '%s' file-system", fs)
+		}
+	}
+
+	if fs := cfg.System.Filesystem; fs.DataOnly() {
+		return fmt.Errorf("the '%s' file-system can only be used for additional disks and partitions", fs)
+	}
+
+	if pkg == nil {
+		return nil
+	}
+
+	for _, name := range vpkg.DiskNames(pkg.Disks()) {
+		if !names[name] {
+			return fmt.Errorf("package contains disk '%s' which is not declared in the vcfg", name)
+		}
+	}
+
+	return nil
+
+}
+
+// dataFilesystemCompiler returns a compiler for the file-system of an
+// additional disk or extra partition, which is the same as the root
+// file-system unless fs is set. If the root file-system is read-only, ext2 is
+// used instead.
+func dataFilesystemCompiler(cfg *vcfg.VCFG, fs vcfg.Filesystem, tree vio.FileTree, log elog.View) (vimg.FSCompiler, error) {
+
+	if fs == "" {
+		fs = cfg.System.Filesystem
+		if fs.ReadOnly() {
+			fs = vcfg.Ext2FS
+		}
+	}
+
+	// the root file-system's identifiers don't carry over
+	fsCfg := new(vcfg.VCFG)
+	fsCfg.System.Filesystem = fs
+
+	return NewFilesystemCompiler(string(fs), log, tree, fsCfg)
+
+}
+
+// ExtraPartitions returns the extra partitions declared in cfg, with their
+// file-systems seeded from the package, followed by the overlay partition if
+// system.overlay-size is set.
+func ExtraPartitions(cfg *vcfg.VCFG, args *BuildArgs) ([]vimg.ExtraPartition, error) {
+
+	var partitions []vimg.ExtraPartition
+
+	trees := args.PackageReader.Disks()
+
+	for _, p := range cfg.Partitions {
+
+		tree, ok := trees[p.Name]
+		if !ok {
+			tree = vio.NewFileTree()
+		}
+
+		attrs, err := vimg.PartitionAttributes(p.Flags)
+		if err != nil {
+			return nil, err
+		}
+
+		fsCompiler, err := dataFilesystemCompiler(cfg, p.Filesystem, tree, args.Logger)
+		if err != nil {
+			return nil, fmt.Errorf("partition '%s': %w", p.Name, err)
+		}
+		args.reproduce(fsCompiler, p.Name)
+
+		partitions = append(partitions, vimg.ExtraPartition{
+			Name:       p.Name,
+			Size:       p.Size,
+			Attributes: attrs,
+			FSCompiler: fsCompiler,
+		})
+
+	}
+
+	if cfg.System.OverlaySize != 0 {
+		p, err := overlayPartition(cfg, args.Logger)
+		if err != nil {
+			return nil, err
+		}
+		args.reproduce(p.FSCompiler, p.Name)
+		partitions = append(partitions, *p)
+	}
+
+	return partitions, nil
+
+}
+
+// overlayPartition returns the writable partition overlaid on the root
+// file-system, with empty directories for overlayfs to use.
+func overlayPartition(cfg *vcfg.VCFG, log elog.View) (*vimg.ExtraPartition, error) {
+
+	tree := vio.NewFileTree()
+
+	for _, dir := range []string{vimg.OverlayUpperDir, vimg.OverlayWorkDir} {
+		err := tree.Map(dir, vio.CustomFile(vio.CustomFileArgs{
+			Name:    dir,
+			IsDir:   true,
+			ModTime: time.Unix(0, 0),
+		}))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	fsCompiler, err := dataFilesystemCompiler(cfg, cfg.System.OverlayFilesystem, tree, log)
+	if err != nil {
+		return nil, fmt.Errorf("overlay partition: %w", err)
+	}
+
+	return &vimg.ExtraPartition{
+		Name:       vimg.OverlayLabel,
+		Size:       cfg.System.OverlaySize,
+		FSCompiler: fsCompiler,
+	}, nil
+
+}
+
+// BuildDisks builds each of the additional disks declared in cfg, seeding
+// their file-systems from the package, and writes them to the destinations
+// returned by args.DiskWriter. It should be called after the main disk has
+// been written, because that's the order the package is read in.
+func BuildDisks(ctx context.Context, cfg *vcfg.VCFG, args *BuildArgs) error {
+
+	if len(cfg.Disks) == 0 {
+		return nil
+	}
+
+	if args.DiskWriter == nil {
+		args.Logger.Warnf("Skipping %d additional disk(s) declared in the vcfg", len(cfg.Disks))
+		return nil
+	}
+
+	var trees map[string]vio.FileTree
+	if args.PackageReader != nil {
+		trees = args.PackageReader.Disks()
+	}
+
+	for _, disk := range cfg.Disks {
+
+		tree, ok := trees[disk.Name]
+		if !ok {
+			tree = vio.NewFileTree()
+		}
+
+		err := buildDisk(ctx, cfg, disk, tree, args)
+		if err != nil {
+			return fmt.Errorf("failed to build disk '%s': %w", disk.Name, err)
+		}
+
+	}
+
+	return nil
+
+}
+
+func buildDisk(ctx context.Context, cfg *vcfg.VCFG, disk vcfg.Disk, tree vio.FileTree, args *BuildArgs) error {
+
+	log := args.Logger
+
+	fsCompiler, err := dataFilesystemCompiler(cfg, disk.Filesystem, tree, log)
+	if err != nil {
+		return err
+	}
+	args.reproduce(fsCompiler, disk.Name)
+
+	vimgBuilder, err := vimg.NewDataDiskBuilder(ctx, &vimg.DataDiskBuilderArgs{
+		Seed:       args.seed(disk.Name),
+		Name:       disk.Name,
+		Size:       disk.Size,
+		FSCompiler: fsCompiler,
+		Logger:     log,
+	})
+	if err != nil {
+		return err
+	}
+	defer vimgBuilder.Close()
+
+	err = negotiateSize(ctx, vimgBuilder, disk.Size, args)
+	if err != nil {
+		return err
+	}
+
+	w, err := args.DiskWriter(disk.Name)
+	if err != nil {
+		return err
+	}
+
+	// parent and backing images are only for the main disk, so additional
+	// disks stand alone
+	opts := args.FormatOptions.without("parent", "backing")
+
+	err = args.Format.BuildWithOptions(ctx, log, w, vimgBuilder, cfg, opts)
+	if err != nil {
+		return err
+	}
+
+	return nil
+
+}
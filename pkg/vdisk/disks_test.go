@@ -0,0 +1,138 @@
+package vdisk
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"testing"
+
+	"github.com/vorteil/vorteil/pkg/elog"
+	"github.com/vorteil/vorteil/pkg/erofs"
+	"github.com/vorteil/vorteil/pkg/squashfs"
+	"github.com/vorteil/vorteil/pkg/vcfg"
+	"github.com/vorteil/vorteil/pkg/vimg"
+)
+
+func TestValidateDisks(t *testing.T) {
+
+	cfg := &vcfg.VCFG{
+		Disks: []vcfg.Disk{
+			{Name: "data", MountPoint: "/data"},
+		},
+		Partitions: []vcfg.Partition{
+			{Name: "config", MountPoint: "/config", Flags: []string{"read-only"}},
+			{Name: "cache", MountPoint: "/cache", Filesystem: vcfg.Ext2FS},
+		},
+	}
+
+	err := ValidateDisks(cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bad := map[string]vcfg.Partition{
+		"shared name":  {Name: "data", MountPoint: "/other"},
+		"shared mount": {Name: "other", MountPoint: "/data"},
+		"root mount":   {Name: "other", MountPoint: "/"},
+		"bad flag":     {Name: "other", MountPoint: "/other", Flags: []string{"bootable"}},
+		"bad fs":       {Name: "other", MountPoint: "/other", Filesystem: "ntfs"},
+	}
+
+	for name, p := range bad {
+		x := *cfg
+		x.Partitions = append([]vcfg.Partition{p}, cfg.Partitions...)
+		if ValidateDisks(&x, nil) == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+
+}
+
+func TestOverlayPartition(t *testing.T) {
+
+	cfg := &vcfg.VCFG{
+		Partitions: []vcfg.Partition{
+			{Name: vimg.OverlayLabel, MountPoint: "/overlay"},
+		},
+	}
+
+	err := ValidateDisks(cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg.System.OverlaySize = 32 * vcfg.MiB
+
+	if ValidateDisks(cfg, nil) == nil {
+		t.Errorf("expected an error for a partition using the overlay's name")
+	}
+
+	p, err := overlayPartition(cfg, &elog.CLI{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if p.Name != vimg.OverlayLabel || p.Size != cfg.System.OverlaySize {
+		t.Errorf("wrong overlay partition: %s (%s)", p.Name, p.Size)
+	}
+
+	cfg.Partitions = nil
+	cfg.System.OverlayFilesystem = "ntfs"
+
+	if ValidateDisks(cfg, nil) == nil {
+		t.Errorf("expected an error for an unsupported overlay file-system")
+	}
+
+	cfg.System.OverlayFilesystem = vcfg.Ext2FS
+
+	err = ValidateDisks(cfg, nil)
+	if err != nil {
+		t.Errorf("unexpected error for an ext2 overlay: %v", err)
+	}
+
+	cfg.System.OverlayFilesystem = vcfg.SquashFS
+
+	if ValidateDisks(cfg, nil) == nil {
+		t.Errorf("expected an error for a read-only overlay file-system")
+	}
+
+	cfg.System.OverlayFilesystem = vcfg.FAT32
+
+	if ValidateDisks(cfg, nil) == nil {
+		t.Errorf("expected an error for a fat32 overlay file-system")
+	}
+
+	cfg.System.OverlayFilesystem = ""
+	cfg.System.Filesystem = vcfg.FAT32
+
+	if ValidateDisks(cfg, nil) == nil {
+		t.Errorf("expected an error for a fat32 root file-system")
+	}
+
+	// a read-only root file-system gets a writable overlay
+	cfg.System.OverlayFilesystem = ""
+	cfg.System.Filesystem = vcfg.SquashFS
+
+	p, err = overlayPartition(cfg, &elog.CLI{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := p.FSCompiler.(*squashfs.Compiler); ok {
+		t.Errorf("overlay partition uses the read-only root file-system")
+	}
+
+	cfg.System.Filesystem = vcfg.EROFS
+
+	p, err = overlayPartition(cfg, &elog.CLI{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := p.FSCompiler.(*erofs.Compiler); ok {
+		t.Errorf("overlay partition uses the read-only root file-system")
+	}
+
+}
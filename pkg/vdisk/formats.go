@@ -16,6 +16,7 @@ import (
 	"github.com/vorteil/vorteil/pkg/elog"
 	"github.com/vorteil/vorteil/pkg/vcfg"
 	"github.com/vorteil/vorteil/pkg/vimg"
+	"github.com/vorteil/vorteil/pkg/vio"
 )
 
 // Format is a string representing a supported disk image format.
@@ -43,6 +44,14 @@ const (
 	VHDDynamicFormat Format = "vhd-dynamic"
 	// QCOW2Format is a disk type that returns "qcow2"
 	QCOW2Format Format = "qcow2"
+	// AzureFormat is a disk type that returns "azure"
+	AzureFormat Format = "azure"
+	// ISOFormat is a disk type that returns "iso"
+	ISOFormat Format = "iso"
+	// VHDXFormat is a disk type that returns "vhdx"
+	VHDXFormat Format = "vhdx"
+	// EBSFormat is a disk type that returns "ebs"
+	EBSFormat Format = "ebs"
 )
 
 // AllFormatStrings returns a list of all supported disk image formats.
@@ -69,6 +78,10 @@ var (
 		VHDFixedFormat:            ".vhd",
 		VHDDynamicFormat:          ".vhd",
 		QCOW2Format:               ".qcow2",
+		AzureFormat:               ".vhd",
+		ISOFormat:                 ".iso",
+		VHDXFormat:                ".vhdx",
+		EBSFormat:                 ".ebs",
 	}
 
 	alignments = map[Format]int64{
@@ -82,6 +95,10 @@ var (
 		VHDFixedFormat:            0x200000,
 		VHDDynamicFormat:          0x200000,
 		QCOW2Format:               0x200000,
+		AzureFormat:               0x100000,
+		ISOFormat:                 0x200000,
+		VHDXFormat:                0x200000,
+		EBSFormat:                 0x40000000,
 	}
 
 	defaultMTUs = map[Format]uint{
@@ -95,6 +112,10 @@ var (
 		VHDFixedFormat:            1500,
 		VHDDynamicFormat:          1500,
 		QCOW2Format:               1500,
+		AzureFormat:               1500,
+		ISOFormat:                 1500,
+		VHDXFormat:                1500,
+		EBSFormat:                 1500,
 	}
 
 	buildFuncs = map[Format]BuildWriterInstantiator{
@@ -108,6 +129,24 @@ var (
 		VHDFixedFormat:            buildFixedVHD,
 		VHDDynamicFormat:          buildDynamicVHD,
 		QCOW2Format:               buildQCOW2,
+		AzureFormat:               buildAzureVHD,
+		ISOFormat:                 buildISO,
+		VHDXFormat:                buildVHDX,
+		EBSFormat:                 buildEBS,
+	}
+
+	optionBuildFuncs = map[Format]BuildWriterOptionsInstantiator{
+		QCOW2Format:      buildQCOW2WithOptions,
+		VHDDynamicFormat: buildDynamicVHDWithOptions,
+	}
+
+	// streamableFormats are the formats whose writers never seek backwards,
+	// and so can be written to a pipe with a StreamWriter.
+	streamableFormats = map[Format]bool{
+		RAWFormat:                 true,
+		VMDKStreamOptimizedFormat: true,
+		GCPFArchiveFormat:         true,
+		EBSFormat:                 true,
 	}
 )
 
@@ -115,6 +154,65 @@ var (
 // can be used to handle the writing of a raw image.
 type BuildWriterInstantiator func(io.WriteSeeker, *vimg.Builder, *vcfg.VCFG) (io.WriteSeeker, error)
 
+// BuildWriterOptionsInstantiator is a BuildWriterInstantiator for formats that
+// accept FormatOptions.
+type BuildWriterOptionsInstantiator func(io.WriteSeeker, *vimg.Builder, *vcfg.VCFG, FormatOptions) (io.WriteSeeker, error)
+
+// FormatOptions contains format specific settings, such as the compression
+// algorithm used by a qcow2 image.
+type FormatOptions map[string]string
+
+// ParseFormatOptions resolves a list of "key=value" strings into
+// FormatOptions.
+func ParseFormatOptions(opts []string) (FormatOptions, error) {
+
+	m := make(FormatOptions)
+
+	for _, opt := range opts {
+		kv := strings.SplitN(opt, "=", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+			return nil, fmt.Errorf("invalid format option '%s': must be of the form 'key=value'", opt)
+		}
+		m[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+	}
+
+	return m, nil
+}
+
+// checkKeys returns an error if the options contain any key not in keys.
+func (opts FormatOptions) checkKeys(format Format, keys ...string) error {
+
+	for k := range opts {
+		var ok bool
+		for _, key := range keys {
+			if k == key {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return fmt.Errorf("unrecognized %s format option '%s'", format, k)
+		}
+	}
+
+	return nil
+}
+
+// without returns a copy of the options with keys removed.
+func (opts FormatOptions) without(keys ...string) FormatOptions {
+
+	m := make(FormatOptions)
+	for k, v := range opts {
+		m[k] = v
+	}
+
+	for _, k := range keys {
+		delete(m, k)
+	}
+
+	return m
+}
+
 // RegisterNewDiskFormat registers a new disk format that can be used with the vdisk package.
 // Example: RegisterNewDiskFormat(Format("vmdk-custom"), ".vmdk", 0x200000, 1500, customVMDKBuilder)
 func RegisterNewDiskFormat(format Format, extention string, alignment int64, mtu uint, builderFunc BuildWriterInstantiator) error {
@@ -202,24 +300,68 @@ func (x *Format) DefaultMTU() uint {
 	return defaultMTUs[*x]
 }
 
+// Streamable returns true if the format can be written sequentially to a
+// destination that can't seek, such as a pipe.
+func (x *Format) Streamable() bool {
+	return streamableFormats[*x]
+}
+
+// StreamWriter wraps w for building a Streamable format to it. Even if w is an
+// io.Seeker, such as os.Stdout, it is never used as one: seeking forward
+// writes zeroes instead, and seeking backward fails.
+func StreamWriter(w io.Writer) (io.WriteSeeker, error) {
+	return vio.WriteSeeker(struct{ io.Writer }{w})
+}
+
+// loggingWriter is implemented by format writers that can trace the metadata
+// they write into an image, such as grain tables and BATs, which is most of
+// what goes wrong when a hypervisor won't boot an image.
+type loggingWriter interface {
+	SetLogger(log elog.Logger)
+}
+
 // Build creates the disk for the correct format ...
 func (x *Format) Build(ctx context.Context, log elog.View, w io.WriteSeeker, b *vimg.Builder, cfg *vcfg.VCFG) error {
+	return x.BuildWithOptions(ctx, log, w, b, cfg, nil)
+}
+
+// BuildWithOptions creates the disk for the correct format, passing opts to
+// the format's writer. It returns an error if the format doesn't accept
+// options but some were provided.
+func (x *Format) BuildWithOptions(ctx context.Context, log elog.View, w io.WriteSeeker, b *vimg.Builder, cfg *vcfg.VCFG, opts FormatOptions) error {
 
 	p := log.NewProgress(fmt.Sprintf("Initializing %s image file", x), "", 0)
 	defer p.Finish(false)
 
-	w, err := buildFuncs[*x](w, b, cfg)
+	var err error
+	if fn, ok := optionBuildFuncs[*x]; ok {
+		w, err = fn(w, b, cfg, opts)
+	} else if len(opts) > 0 {
+		err = fmt.Errorf("the %s format does not accept any format options", x)
+	} else {
+		w, err = buildFuncs[*x](w, b, cfg)
+	}
 	if err != nil {
 		return err
 	}
-	closer, ok := w.(io.Closer)
-	if ok {
-		defer closer.Close()
-	}
 
 	p.Finish(true)
 
+	if lw, ok := w.(loggingWriter); ok {
+		lw.SetLogger(log)
+	}
+
 	err = b.Build(ctx, w)
+
+	// NOTE: some writers finish the image when closed, so errors here
+	// matter.
+	closer, ok := w.(io.Closer)
+	if ok {
+		cerr := closer.Close()
+		if err == nil {
+			err = cerr
+		}
+	}
 	if err != nil {
 		return err
 	}
@@ -9,8 +9,14 @@ import (
 	"fmt"
 	"sort"
 
+	"github.com/google/uuid"
 	"github.com/vorteil/vorteil/pkg/elog"
+	"github.com/vorteil/vorteil/pkg/erofs"
 	"github.com/vorteil/vorteil/pkg/ext"
+	"github.com/vorteil/vorteil/pkg/f2fs"
+	"github.com/vorteil/vorteil/pkg/fat32"
+	"github.com/vorteil/vorteil/pkg/squashfs"
+	"github.com/vorteil/vorteil/pkg/vcfg"
 	"github.com/vorteil/vorteil/pkg/vimg"
 	"github.com/vorteil/vorteil/pkg/vio"
 )
@@ -22,6 +28,16 @@ func init() {
 	}
 
 	fn := func(log elog.Logger, tree vio.FileTree, args interface{}) (vimg.FSCompiler, error) {
+		id, err := FilesystemUUID(args)
+		if err != nil {
+			return nil, err
+		}
+		if id != ([16]byte{}) {
+			return nil, fmt.Errorf("the ext2 file-system does not support setting a UUID")
+		}
+		if cfg, ok := args.(*vcfg.VCFG); ok && cfg != nil && cfg.System.FilesystemLabel != "" {
+			return nil, fmt.Errorf("the ext2 file-system does not support volume labels")
+		}
 		return ext.NewCompiler(&ext.CompilerArgs{
 			Logger:   log,
 			FileTree: tree,
@@ -43,13 +59,138 @@ func init() {
 		panic(err)
 	}
 
+	err = RegisterFilesystemCompiler(string(vcfg.SquashFS), func(log elog.Logger, tree vio.FileTree, args interface{}) (vimg.FSCompiler, error) {
+		id, err := FilesystemUUID(args)
+		if err != nil {
+			return nil, err
+		}
+		if id != ([16]byte{}) {
+			return nil, fmt.Errorf("the squashfs file-system does not support setting a UUID")
+		}
+		if cfg, ok := args.(*vcfg.VCFG); ok && cfg != nil && cfg.System.FilesystemLabel != "" {
+			return nil, fmt.Errorf("the squashfs file-system does not support volume labels")
+		}
+		return squashfs.NewCompiler(&squashfs.CompilerArgs{
+			Logger:   log,
+			FileTree: tree,
+		}), nil
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	err = RegisterFilesystemCompiler(string(vcfg.EROFS), func(log elog.Logger, tree vio.FileTree, args interface{}) (vimg.FSCompiler, error) {
+		id, err := FilesystemUUID(args)
+		if err != nil {
+			return nil, err
+		}
+		label, err := FilesystemLabel(args, erofs.MaxLabelLength)
+		if err != nil {
+			return nil, err
+		}
+		return erofs.NewCompiler(&erofs.CompilerArgs{
+			Logger:   log,
+			FileTree: tree,
+			UUID:     id,
+			Label:    label,
+		}), nil
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	err = RegisterFilesystemCompiler(string(vcfg.F2FS), func(log elog.Logger, tree vio.FileTree, args interface{}) (vimg.FSCompiler, error) {
+		id, err := FilesystemUUID(args)
+		if err != nil {
+			return nil, err
+		}
+		label, err := FilesystemLabel(args, f2fs.MaxLabelLength)
+		if err != nil {
+			return nil, err
+		}
+		return f2fs.NewCompiler(&f2fs.CompilerArgs{
+			Logger:   log,
+			FileTree: tree,
+			UUID:     id,
+			Label:    label,
+		}), nil
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	err = RegisterFilesystemCompiler(string(vcfg.FAT32), func(log elog.Logger, tree vio.FileTree, args interface{}) (vimg.FSCompiler, error) {
+		id, err := FilesystemUUID(args)
+		if err != nil {
+			return nil, err
+		}
+		if id != ([16]byte{}) {
+			return nil, fmt.Errorf("the fat32 file-system does not support setting a UUID")
+		}
+		label, err := FilesystemLabel(args, 11)
+		if err != nil {
+			return nil, err
+		}
+		_, err = fat32.VolumeLabel(label)
+		if err != nil {
+			return nil, err
+		}
+		return fat32.NewCompiler(&fat32.CompilerArgs{
+			Logger:   log,
+			FileTree: tree,
+			Label:    label,
+		}), nil
+	})
+	if err != nil {
+		panic(err)
+	}
+
 }
 
 // FSCompilerInstantiator is a function that returns a new file-system compiler
 // when provided with common arguments (any uncommon arguments can be passed
-// through 'args').
+// through 'args'). When called by Build, args is the *vcfg.VCFG for the disk.
 type FSCompilerInstantiator func(log elog.Logger, tree vio.FileTree, args interface{}) (vimg.FSCompiler, error)
 
+// FilesystemUUID returns the file-system UUID requested by the VCFG passed to
+// an FSCompilerInstantiator as args. The zero UUID is returned if none was
+// requested.
+func FilesystemUUID(args interface{}) ([16]byte, error) {
+
+	cfg, ok := args.(*vcfg.VCFG)
+	if !ok || cfg == nil || cfg.System.FilesystemUUID == "" {
+		return [16]byte{}, nil
+	}
+
+	id, err := uuid.Parse(cfg.System.FilesystemUUID)
+	if err != nil {
+		return [16]byte{}, fmt.Errorf("invalid system.filesystem-uuid '%s': %v", cfg.System.FilesystemUUID, err)
+	}
+
+	return id, nil
+
+}
+
+// FilesystemLabel returns the file-system volume label requested by the VCFG
+// passed to an FSCompilerInstantiator as args, returning an error if it is
+// longer than max bytes. An empty string is returned if no label was
+// requested.
+func FilesystemLabel(args interface{}, max int) (string, error) {
+
+	cfg, ok := args.(*vcfg.VCFG)
+	if !ok || cfg == nil || cfg.System.FilesystemLabel == "" {
+		return "", nil
+	}
+
+	label := cfg.System.FilesystemLabel
+	if len(label) > max {
+		return "", fmt.Errorf("invalid system.fs-label '%s': must be no more than %d bytes long", label, max)
+	}
+
+	return label, nil
+
+}
+
 var registeredFSCompilers map[string]FSCompilerInstantiator
 
 // RegisterFilesystemCompiler registers a FSCompilerInstantiator with a given
@@ -0,0 +1,141 @@
+package vdisk
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+
+	"github.com/vorteil/vorteil/pkg/vcfg"
+	"github.com/vorteil/vorteil/pkg/vimg"
+)
+
+// ErrNotRawImage is returned by OpenRawImage if the file isn't a raw disk
+// image.
+var ErrNotRawImage = errors.New("not a raw disk image")
+
+// bootSignature is the value found in the last two bytes of the first sector
+// of every MBR or GPT (protective MBR) partitioned disk.
+const bootSignature = 0xAA55
+
+// Image is a pre-existing raw disk image that can be used in place of a
+// package as the source of a build.
+type Image interface {
+	io.ReaderAt
+	Size() int64
+}
+
+// RawImage is an Image backed by a raw disk image file.
+type RawImage struct {
+	f    *os.File
+	size int64
+}
+
+// OpenRawImage opens the file at path as an Image. It returns ErrNotRawImage
+// if the file isn't a whole number of sectors or doesn't begin with a
+// partition table, so that callers can fall back to treating the file as
+// something else, like a package.
+func OpenRawImage(path string) (*RawImage, error) {
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	size := fi.Size()
+	if size == 0 || size%vimg.SectorSize != 0 {
+		f.Close()
+		return nil, ErrNotRawImage
+	}
+
+	mbr := make([]byte, vimg.SectorSize)
+	_, err = f.ReadAt(mbr, 0)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	if binary.LittleEndian.Uint16(mbr[510:]) != bootSignature {
+		f.Close()
+		return nil, ErrNotRawImage
+	}
+
+	return &RawImage{
+		f:    f,
+		size: size,
+	}, nil
+
+}
+
+// ReadAt implements io.ReaderAt.
+func (img *RawImage) ReadAt(p []byte, off int64) (int, error) {
+	return img.f.ReadAt(p, off)
+}
+
+// Size returns the size of the image in bytes.
+func (img *RawImage) Size() int64 {
+	return img.size
+}
+
+// Name returns the path the image was opened from.
+func (img *RawImage) Name() string {
+	return img.f.Name()
+}
+
+// Close closes the underlying file.
+func (img *RawImage) Close() error {
+	return img.f.Close()
+}
+
+func buildFromImage(ctx context.Context, w io.WriteSeeker, args *BuildArgs) error {
+
+	// there's no package to load a VCFG from, but some formats (like xva)
+	// still want one for their metadata
+	cfg := new(vcfg.VCFG)
+	if args.WithVCFGDefaults {
+		err := vcfg.WithDefaults(cfg, args.Logger)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := validateReproducible(cfg, args)
+	if err != nil {
+		return err
+	}
+
+	vimgBuilder, err := vimg.NewImageBuilder(ctx, &vimg.ImageBuilderArgs{
+		Image:  args.Image,
+		Size:   args.Image.Size(),
+		Logger: args.Logger,
+	})
+	if err != nil {
+		return err
+	}
+	defer vimgBuilder.Close()
+
+	err = NegotiateSize(ctx, vimgBuilder, cfg, args)
+	if err != nil {
+		return err
+	}
+
+	err = args.Format.BuildWithOptions(ctx, args.Logger, w, vimgBuilder, cfg, args.FormatOptions)
+	if err != nil {
+		return err
+	}
+
+	return nil
+
+}
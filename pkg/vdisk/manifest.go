@@ -0,0 +1,129 @@
+package vdisk
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"time"
+
+	"github.com/vorteil/vorteil/pkg/vcfg"
+	"github.com/vorteil/vorteil/pkg/vio"
+)
+
+// ManifestSuffix is appended to an image's path to get the path of its build
+// manifest.
+const ManifestSuffix = ".manifest.json"
+
+// Manifest describes what went into building an image and what came out of
+// it, so that an image can be traced back to the app and tooling that made
+// it. Build fills in the parts of Inputs it knows about; the rest is up to
+// the caller.
+type Manifest struct {
+	Tool    ManifestTool     `json:"tool"`
+	Built   time.Time        `json:"built"`
+	Inputs  ManifestInputs   `json:"inputs"`
+	Outputs []ManifestOutput `json:"outputs"`
+}
+
+// ManifestTool identifies the tool that built an image.
+type ManifestTool struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	Ref     string `json:"ref,omitempty"`
+}
+
+// ManifestInputs describes what an image was built from. Images rewrapped
+// from an existing disk image have no VCFG, kernel or files.
+type ManifestInputs struct {
+	Source        string `json:"source"`
+	ProjectDigest string `json:"project-digest,omitempty"`
+	VCFGDigest    string `json:"vcfg-digest,omitempty"`
+	Kernel        string `json:"kernel,omitempty"`
+	Files         int    `json:"files"`
+}
+
+// ManifestOutput describes an image file written by a build. Disk is empty
+// for the main disk, and is the name of the disk in the VCFG otherwise.
+type ManifestOutput struct {
+	Path   string `json:"path"`
+	Disk   string `json:"disk,omitempty"`
+	Format string `json:"format"`
+	Size   int64  `json:"size"`
+	Digest string `json:"digest"`
+}
+
+// Write writes the manifest to w as JSON.
+func (m *Manifest) Write(w io.Writer) error {
+
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(append(data, '\n'))
+	return err
+
+}
+
+// AddOutput records the image file at path in the manifest, hashing its
+// contents.
+func (m *Manifest) AddOutput(path, disk string, format Format) error {
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	hasher := sha256.New()
+	size, err := io.Copy(hasher, f)
+	if err != nil {
+		return err
+	}
+
+	m.Outputs = append(m.Outputs, ManifestOutput{
+		Path:   path,
+		Disk:   disk,
+		Format: format.String(),
+		Size:   size,
+		Digest: ChecksumAlgorithm + ":" + hex.EncodeToString(hasher.Sum(nil)),
+	})
+
+	return nil
+
+}
+
+// recordInputs fills in the parts of the manifest's inputs that come from the
+// package: a digest of the final VCFG and the number of files in the app's
+// file-system.
+func (m *Manifest) recordInputs(cfg *vcfg.VCFG, tree vio.FileTree) error {
+
+	// secrets are left out, so that the digest can't be used to check a
+	// guessed passphrase
+	c := *cfg
+	c.System.Encryption = vcfg.EncryptionSettings{}
+
+	data, err := json.Marshal(&c)
+	if err != nil {
+		return err
+	}
+
+	digest := sha256.Sum256(data)
+	m.Inputs.VCFGDigest = ChecksumAlgorithm + ":" + hex.EncodeToString(digest[:])
+
+	m.Inputs.Files = 0
+	return tree.Walk(func(path string, f vio.File) error {
+		if !f.IsDir() {
+			m.Inputs.Files++
+		}
+		return nil
+	})
+
+}
@@ -0,0 +1,113 @@
+package vdisk
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vorteil/vorteil/pkg/vcfg"
+	"github.com/vorteil/vorteil/pkg/vio"
+)
+
+func TestManifest(t *testing.T) {
+
+	tree := vio.NewFileTree()
+	defer tree.Close()
+
+	for _, path := range []string{"app", "etc/config"} {
+		err := tree.Map(path, vio.CustomFile(vio.CustomFileArgs{
+			Name:       path,
+			Size:       4,
+			ModTime:    time.Unix(1600000000, 0),
+			ReadCloser: ioutil.NopCloser(strings.NewReader("data")),
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	m := new(Manifest)
+
+	cfg := new(vcfg.VCFG)
+	err := m.recordInputs(cfg, tree)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if m.Inputs.Files != 2 {
+		t.Errorf("expected 2 files, got %d", m.Inputs.Files)
+	}
+
+	digest := m.Inputs.VCFGDigest
+
+	// secrets don't change the digest
+	cfg.System.Encryption.Passphrase = "secret"
+	err = m.recordInputs(cfg, tree)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if m.Inputs.VCFGDigest != digest {
+		t.Errorf("vcfg digest depends on the encryption passphrase")
+	}
+
+	cfg.System.Hostname = "vorteil"
+	err = m.recordInputs(cfg, tree)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if m.Inputs.VCFGDigest == digest {
+		t.Errorf("vcfg digest didn't change with the vcfg")
+	}
+
+	f, err := ioutil.TempFile("", "manifest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	_, err = f.Write([]byte("vorteil"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = m.AddOutput(f.Name(), "", RAWFormat)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := new(bytes.Buffer)
+	err = m.Write(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := new(Manifest)
+	err = json.Unmarshal(buf.Bytes(), loaded)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := ManifestOutput{
+		Path:   f.Name(),
+		Format: "raw",
+		Size:   7,
+		Digest: "sha256:e84807d3c9a1d16f4aacf5bc8effd482ce4e86e9701d5c77b22e097c5e1ea4d2",
+	}
+
+	if len(loaded.Outputs) != 1 || loaded.Outputs[0] != expect {
+		t.Errorf("bad manifest outputs: %+v", loaded.Outputs)
+	}
+
+}
@@ -0,0 +1,33 @@
+package vdisk
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"github.com/vorteil/vorteil/pkg/vimg"
+)
+
+// MeasurementsSuffix is appended to an image's path to get the path of its
+// expected TPM measurements.
+const MeasurementsSuffix = ".pcr.json"
+
+// recordMeasurements fills in args.Measurements, if it's set, from a builder
+// that has finished building the main disk.
+func recordMeasurements(vimgBuilder *vimg.Builder, args *BuildArgs) error {
+
+	if args.Measurements == nil {
+		return nil
+	}
+
+	m, err := vimgBuilder.Measurements()
+	if err != nil {
+		return err
+	}
+
+	*args.Measurements = *m
+
+	return nil
+
+}
@@ -0,0 +1,82 @@
+package vdisk
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/vorteil/vorteil/pkg/vcfg"
+	"github.com/vorteil/vorteil/pkg/vio"
+)
+
+var nodeTypes = map[vcfg.NodeType]os.FileMode{
+	vcfg.CharDeviceNode:  os.ModeDevice | os.ModeCharDevice,
+	vcfg.BlockDeviceNode: os.ModeDevice,
+	vcfg.FIFONode:        os.ModeNamedPipe,
+}
+
+// ValidateNodes checks the device nodes and named pipes declared in cfg.
+func ValidateNodes(cfg *vcfg.VCFG) error {
+
+	paths := make(map[string]bool)
+
+	for _, n := range cfg.Nodes {
+
+		p := path.Clean(n.Path)
+		if !path.IsAbs(n.Path) || p == "/" {
+			return fmt.Errorf("node has invalid path '%s': must be an absolute path other than the root", n.Path)
+		}
+
+		if paths[p] {
+			return fmt.Errorf("node '%s' declared more than once", p)
+		}
+		paths[p] = true
+
+		if _, ok := nodeTypes[n.Type]; !ok {
+			return fmt.Errorf("node '%s' has invalid type '%s' (should be '%s', '%s', or '%s')", p, n.Type, vcfg.CharDeviceNode, vcfg.BlockDeviceNode, vcfg.FIFONode)
+		}
+
+	}
+
+	return nil
+
+}
+
+// mapNodes adds the device nodes and named pipes declared in cfg to tree,
+// replacing anything already at their paths.
+func mapNodes(cfg *vcfg.VCFG, tree vio.FileTree) error {
+
+	for _, n := range cfg.Nodes {
+
+		special := nodeTypes[n.Type]
+		major, minor := n.Major, n.Minor
+		if special == os.ModeNamedPipe {
+			major, minor = 0, 0
+		}
+
+		p := strings.TrimPrefix(path.Clean(n.Path), "/")
+		err := tree.Map(p, vio.CustomFile(vio.CustomFileArgs{
+			Name:       path.Base(p),
+			ModTime:    time.Unix(0, 0),
+			Special:    special,
+			Major:      major,
+			Minor:      minor,
+			ReadCloser: ioutil.NopCloser(strings.NewReader("")),
+		}))
+		if err != nil {
+			return err
+		}
+
+	}
+
+	return nil
+
+}
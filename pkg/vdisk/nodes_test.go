@@ -0,0 +1,83 @@
+package vdisk
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"os"
+	"testing"
+
+	"github.com/vorteil/vorteil/pkg/vcfg"
+	"github.com/vorteil/vorteil/pkg/vio"
+)
+
+func TestNodes(t *testing.T) {
+
+	cfg := &vcfg.VCFG{
+		Nodes: []vcfg.Node{
+			{Path: "/dev/null", Type: vcfg.CharDeviceNode, Major: 1, Minor: 3},
+			{Path: "/dev/vda", Type: vcfg.BlockDeviceNode, Major: 254},
+			{Path: "/run/pipe", Type: vcfg.FIFONode, Major: 7},
+		},
+	}
+
+	err := ValidateNodes(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tree := vio.NewFileTree()
+	defer tree.Close()
+
+	err = mapNodes(cfg, tree)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type node struct {
+		special      os.FileMode
+		major, minor uint32
+	}
+
+	found := make(map[string]node)
+	err = tree.Walk(func(path string, f vio.File) error {
+		if f.Special() != 0 {
+			major, minor := f.Device()
+			found[path] = node{f.Special(), major, minor}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]node{
+		"./dev/null": {os.ModeDevice | os.ModeCharDevice, 1, 3},
+		"./dev/vda":  {os.ModeDevice, 254, 0},
+		"./run/pipe": {os.ModeNamedPipe, 0, 0},
+	}
+
+	for path, n := range expected {
+		if found[path] != n {
+			t.Errorf("%s: expected %v, got %v", path, n, found[path])
+		}
+	}
+
+	bad := map[string]vcfg.Node{
+		"relative path": {Path: "dev/zero", Type: vcfg.CharDeviceNode},
+		"root path":     {Path: "/", Type: vcfg.FIFONode},
+		"duplicate":     {Path: "/dev/null/", Type: vcfg.CharDeviceNode},
+		"bad type":      {Path: "/dev/sock", Type: "socket"},
+	}
+
+	for name, n := range bad {
+		x := *cfg
+		x.Nodes = append([]vcfg.Node{n}, cfg.Nodes...)
+		if ValidateNodes(&x) == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+
+}
@@ -0,0 +1,129 @@
+package vdisk
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+
+	"github.com/vorteil/vorteil/pkg/vcfg"
+	"github.com/vorteil/vorteil/pkg/vio"
+)
+
+// parseMode parses the octal permissions of an ownership override.
+func parseMode(s string) (uint32, error) {
+
+	x, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || x&^vio.ModeMask != 0 {
+		return 0, fmt.Errorf("invalid mode '%s': should be octal permissions like '0644'", s)
+	}
+
+	return uint32(x), nil
+
+}
+
+// ValidateOwnership checks the ownership overrides in cfg.
+func ValidateOwnership(cfg *vcfg.VCFG) error {
+
+	paths := make(map[string]string)
+
+	for p, o := range cfg.Ownership {
+
+		if !path.IsAbs(p) {
+			return fmt.Errorf("ownership override has invalid path '%s': must be an absolute path", p)
+		}
+
+		if prev, ok := paths[path.Clean(p)]; ok {
+			return fmt.Errorf("ownership overrides '%s' and '%s' are for the same path", prev, p)
+		}
+		paths[path.Clean(p)] = p
+
+		if o.Mode != "" {
+			_, err := parseMode(o.Mode)
+			if err != nil {
+				return fmt.Errorf("ownership override for '%s' has an %v", p, err)
+			}
+		}
+
+	}
+
+	return nil
+
+}
+
+// override applies x on top of o, which may be nil.
+func override(o *vio.Ownership, x vcfg.Ownership) *vio.Ownership {
+
+	own := vio.DefaultOwnership
+	if o != nil {
+		own = *o
+	}
+
+	if x.UID != nil {
+		own.UID = *x.UID
+	}
+
+	if x.GID != nil {
+		own.GID = *x.GID
+	}
+
+	if x.Mode != "" {
+		own.Mode, _ = parseMode(x.Mode)
+	}
+
+	return &own
+
+}
+
+// applyOwnership sets the owners and permissions of the files in tree. Files
+// keep the ones they had on the host only if cfg.System.PreserveOwnership is
+// set, and the overrides in cfg.Ownership are applied on top either way.
+func applyOwnership(cfg *vcfg.VCFG, tree vio.FileTree) error {
+
+	overrides := make(map[string]vcfg.Ownership)
+	for p, o := range cfg.Ownership {
+		overrides[path.Clean(p)] = o
+	}
+
+	err := tree.WalkNode(func(p string, n *vio.TreeNode) error {
+
+		p = path.Clean("/" + p)
+
+		own := n.File.Ownership()
+		if !cfg.System.PreserveOwnership {
+			own = nil
+		}
+
+		if x, ok := overrides[p]; ok {
+			own = override(own, x)
+			delete(overrides, p)
+		}
+
+		if own != n.File.Ownership() {
+			n.File = vio.WithOwnership(n.File, own)
+		}
+
+		return nil
+
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(overrides) > 0 {
+		var missing []string
+		for p := range overrides {
+			missing = append(missing, p)
+		}
+		sort.Strings(missing)
+		return fmt.Errorf("ownership override for '%s' doesn't match any file", missing[0])
+	}
+
+	return nil
+
+}
@@ -0,0 +1,127 @@
+package vdisk
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/vorteil/vorteil/pkg/vcfg"
+	"github.com/vorteil/vorteil/pkg/vio"
+)
+
+func ownershipTestTree(t *testing.T) vio.FileTree {
+
+	tree := vio.NewFileTree()
+
+	for _, p := range []string{"/app", "/app/data"} {
+		err := tree.Map(p, vio.CustomFile(vio.CustomFileArgs{
+			Name:       p[strings.LastIndex(p, "/")+1:],
+			IsDir:      p == "/app",
+			ReadCloser: ioutil.NopCloser(strings.NewReader("")),
+			Ownership:  &vio.Ownership{UID: 501, GID: 20, Mode: 0644},
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return tree
+
+}
+
+func TestOwnership(t *testing.T) {
+
+	uid := uint32(0)
+
+	cfg := &vcfg.VCFG{
+		Ownership: map[string]vcfg.Ownership{
+			"/app/data/": {UID: &uid, Mode: "4755"},
+		},
+	}
+
+	err := ValidateOwnership(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, preserve := range []bool{false, true} {
+
+		cfg.System.PreserveOwnership = preserve
+
+		tree := ownershipTestTree(t)
+		defer tree.Close()
+
+		err = applyOwnership(cfg, tree)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		found := make(map[string]vio.Ownership)
+		err = tree.Walk(func(path string, f vio.File) error {
+			if o := f.Ownership(); o != nil {
+				found[path] = *o
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expected := map[string]vio.Ownership{
+			"./app/data": {UID: 0, GID: vio.DefaultOwnership.GID, Mode: 04755},
+		}
+		if preserve {
+			expected["./app"] = vio.Ownership{UID: 501, GID: 20, Mode: 0644}
+			expected["./app/data"] = vio.Ownership{UID: 0, GID: 20, Mode: 04755}
+		}
+
+		for path, o := range expected {
+			if found[path] != o {
+				t.Errorf("preserve %v: %s: expected %v, got %v", preserve, path, o, found[path])
+			}
+		}
+
+		if len(found) != len(expected) {
+			t.Errorf("preserve %v: expected %d files with owners, got %d", preserve, len(expected), len(found))
+		}
+
+	}
+
+	missing := &vcfg.VCFG{
+		Ownership: map[string]vcfg.Ownership{
+			"/app/missing": {UID: &uid},
+		},
+	}
+
+	tree := ownershipTestTree(t)
+	defer tree.Close()
+
+	if applyOwnership(missing, tree) == nil {
+		t.Errorf("override for a missing file was accepted")
+	}
+
+	bad := map[string]vcfg.Ownership{
+		"app":       {UID: &uid},
+		"/app//":    {UID: &uid},
+		"/app/data": {Mode: "0999"},
+		"/app/run":  {Mode: "17777"},
+	}
+
+	for p, o := range bad {
+		x := &vcfg.VCFG{
+			Ownership: map[string]vcfg.Ownership{
+				p:      o,
+				"/app": {Mode: "0755"},
+			},
+		}
+		if ValidateOwnership(x) == nil {
+			t.Errorf("%s: expected an error", p)
+		}
+	}
+
+}
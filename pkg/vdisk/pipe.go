@@ -0,0 +1,152 @@
+package vdisk
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/vorteil/vorteil/pkg/vio"
+)
+
+// ImagePipe hands an image to readers while it is still being built, so that
+// uploading it can overlap with compiling it. Everything written to it is
+// kept in a file, so any number of readers can read the image from the
+// beginning, each one blocking until more of the image has been written or
+// the build has finished.
+//
+// Only Streamable formats can be built to an ImagePipe, through a
+// StreamWriter.
+type ImagePipe struct {
+	f    *os.File
+	mu   sync.Mutex
+	cond *sync.Cond
+	size int64
+	done bool
+	err  error
+}
+
+// NewImagePipe returns an ImagePipe that keeps the image in f, which should be
+// empty.
+func NewImagePipe(f *os.File) *ImagePipe {
+
+	p := &ImagePipe{f: f}
+	p.cond = sync.NewCond(&p.mu)
+	return p
+
+}
+
+// Write appends data to the image.
+func (p *ImagePipe) Write(data []byte) (int, error) {
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.done {
+		return 0, errors.New("image pipe is closed")
+	}
+
+	n, err := p.f.WriteAt(data, p.size)
+	p.size += int64(n)
+	p.cond.Broadcast()
+
+	return n, err
+
+}
+
+// CloseWithError marks the image as finished. Readers that reach the end of
+// it get err, or io.EOF if err is nil.
+func (p *ImagePipe) CloseWithError(err error) {
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.done {
+		return
+	}
+
+	p.done = true
+	p.err = err
+	p.cond.Broadcast()
+
+}
+
+// Open returns a new reader for the image, starting at the beginning. Its
+// Size is zero because the size of the image isn't known until it has been
+// built. If the build has already failed its error is returned instead.
+func (p *ImagePipe) Open() (vio.File, error) {
+
+	p.mu.Lock()
+	err := p.err
+	p.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	return vio.CustomFile(vio.CustomFileArgs{
+		Name:       filepath.Base(p.f.Name()),
+		ModTime:    time.Now(),
+		ReadCloser: &imagePipeReader{p: p},
+	}), nil
+
+}
+
+type imagePipeReader struct {
+	p      *ImagePipe
+	pos    int64
+	closed bool
+}
+
+func (r *imagePipeReader) Read(data []byte) (int, error) {
+
+	p := r.p
+	p.mu.Lock()
+
+	for !r.closed && r.pos >= p.size && !p.done {
+		p.cond.Wait()
+	}
+
+	switch {
+	case r.closed:
+		p.mu.Unlock()
+		return 0, os.ErrClosed
+	case r.pos >= p.size && p.err != nil:
+		p.mu.Unlock()
+		return 0, p.err
+	case r.pos >= p.size:
+		p.mu.Unlock()
+		return 0, io.EOF
+	}
+
+	if int64(len(data)) > p.size-r.pos {
+		data = data[:p.size-r.pos]
+	}
+	p.mu.Unlock()
+
+	n, err := p.f.ReadAt(data, r.pos)
+	r.pos += int64(n)
+	if err == io.EOF && n == len(data) {
+		err = nil
+	}
+
+	return n, err
+
+}
+
+func (r *imagePipeReader) Close() error {
+
+	r.p.mu.Lock()
+	defer r.p.mu.Unlock()
+
+	r.closed = true
+	r.p.cond.Broadcast()
+	return nil
+
+}
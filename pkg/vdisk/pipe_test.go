@@ -0,0 +1,127 @@
+package vdisk
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestImagePipe(t *testing.T) {
+
+	f, err := ioutil.TempFile("", "pipe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	pipe := NewImagePipe(f)
+
+	image, err := pipe.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer image.Close()
+
+	data := bytes.Repeat([]byte("vorteil"), 0x1000)
+	read := make(chan []byte)
+
+	go func() {
+		buf, _ := ioutil.ReadAll(image)
+		read <- buf
+	}()
+
+	w, err := StreamWriter(pipe)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = w.Write(data[:0x10])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = w.Seek(0x100, io.SeekStart)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	copy(data[0x10:0x100], make([]byte, 0xF0))
+	_, err = w.Write(data[0x100:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pipe.CloseWithError(nil)
+
+	if !bytes.Equal(<-read, data) {
+		t.Errorf("image read while it was being written is wrong")
+	}
+
+	// readers opened later get the whole image
+	again, err := pipe.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer again.Close()
+
+	buf, err := ioutil.ReadAll(again)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(buf, data) {
+		t.Errorf("image read after it was written is wrong")
+	}
+
+	_, err = w.Write(data)
+	if err == nil {
+		t.Errorf("wrote to a closed image pipe")
+	}
+
+}
+
+func TestImagePipeError(t *testing.T) {
+
+	f, err := ioutil.TempFile("", "pipe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	pipe := NewImagePipe(f)
+
+	image, err := pipe.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer image.Close()
+
+	_, err = pipe.Write([]byte("partial"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	failed := errors.New("build failed")
+	pipe.CloseWithError(failed)
+
+	_, err = ioutil.ReadAll(image)
+	if err != failed {
+		t.Errorf("expected the build error, got %v", err)
+	}
+
+	_, err = pipe.Open()
+	if err != failed {
+		t.Errorf("opened the image of a failed build")
+	}
+
+}
@@ -0,0 +1,81 @@
+package vdisk
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"fmt"
+	"path"
+
+	"github.com/vorteil/vorteil/pkg/vcfg"
+)
+
+// ValidateQuotas checks the quotas declared in cfg.
+func ValidateQuotas(cfg *vcfg.VCFG) error {
+
+	if len(cfg.Quotas) == 0 {
+		return nil
+	}
+
+	if fs := cfg.System.Filesystem; fs != vcfg.XFS {
+		if fs == "" {
+			fs = vcfg.Ext2FS
+		}
+		return fmt.Errorf("quotas are only supported on xfs root file-systems, not %s", fs)
+	}
+
+	types := make(map[vcfg.QuotaType]bool)
+	ids := make(map[vcfg.Quota]bool)
+	paths := make(map[string]bool)
+
+	for _, q := range cfg.Quotas {
+
+		switch q.Type {
+		case vcfg.UserQuota, vcfg.GroupQuota, vcfg.ProjectQuota:
+		default:
+			return fmt.Errorf("quota has invalid type '%s' (should be '%s', '%s', or '%s')", q.Type, vcfg.UserQuota, vcfg.GroupQuota, vcfg.ProjectQuota)
+		}
+		types[q.Type] = true
+
+		key := vcfg.Quota{Type: q.Type, ID: q.ID}
+		if ids[key] {
+			return fmt.Errorf("%s quota %d declared more than once", q.Type, q.ID)
+		}
+		ids[key] = true
+
+		if q.Path != "" {
+			p := path.Clean(q.Path)
+			if q.Type != vcfg.ProjectQuota {
+				return fmt.Errorf("%s quota %d has a path, but only project quotas apply to paths", q.Type, q.ID)
+			}
+			if q.ID == 0 {
+				return fmt.Errorf("project quota for '%s' needs an id other than 0", p)
+			}
+			if !path.IsAbs(q.Path) {
+				return fmt.Errorf("project quota %d has invalid path '%s': must be an absolute path", q.ID, q.Path)
+			}
+			if paths[p] {
+				return fmt.Errorf("project quota path '%s' declared more than once", p)
+			}
+			paths[p] = true
+		}
+
+		if q.Space != 0 && q.SoftSpace > q.Space {
+			return fmt.Errorf("%s quota %d has a soft space limit greater than its space limit", q.Type, q.ID)
+		}
+
+		if q.Inodes != 0 && q.SoftInodes > q.Inodes {
+			return fmt.Errorf("%s quota %d has a soft inodes limit greater than its inodes limit", q.Type, q.ID)
+		}
+
+	}
+
+	if types[vcfg.GroupQuota] && types[vcfg.ProjectQuota] {
+		return fmt.Errorf("xfs can't have group and project quotas at the same time")
+	}
+
+	return nil
+
+}
@@ -0,0 +1,54 @@
+package vdisk
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"testing"
+
+	"github.com/vorteil/vorteil/pkg/vcfg"
+)
+
+func TestValidateQuotas(t *testing.T) {
+
+	cfg := &vcfg.VCFG{
+		Quotas: []vcfg.Quota{
+			{Type: vcfg.UserQuota, Space: 64 * vcfg.MiB},
+			{Type: vcfg.UserQuota, ID: 1000, Space: 32 * vcfg.MiB, SoftSpace: 16 * vcfg.MiB},
+			{Type: vcfg.ProjectQuota, ID: 1, Path: "/data", Inodes: 100},
+		},
+	}
+	cfg.System.Filesystem = vcfg.XFS
+
+	err := ValidateQuotas(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, x := range [][]vcfg.Quota{
+		{{Type: "disk"}},
+		{{Type: vcfg.UserQuota, ID: 1}, {Type: vcfg.UserQuota, ID: 1}},
+		{{Type: vcfg.UserQuota, Path: "/data"}},
+		{{Type: vcfg.ProjectQuota, Path: "/data"}},
+		{{Type: vcfg.ProjectQuota, ID: 1, Path: "data"}},
+		{{Type: vcfg.ProjectQuota, ID: 1, Path: "/data"}, {Type: vcfg.ProjectQuota, ID: 2, Path: "/data/"}},
+		{{Type: vcfg.UserQuota, Space: vcfg.MiB, SoftSpace: 2 * vcfg.MiB}},
+		{{Type: vcfg.GroupQuota}, {Type: vcfg.ProjectQuota}},
+	} {
+		cfg.Quotas = x
+		err = ValidateQuotas(cfg)
+		if err == nil {
+			t.Errorf("expected an error for %v", x)
+		}
+	}
+
+	cfg.Quotas = []vcfg.Quota{{Type: vcfg.UserQuota}}
+	cfg.System.Filesystem = vcfg.Ext4FS
+	err = ValidateQuotas(cfg)
+	if err == nil {
+		t.Errorf("expected an error for ext4")
+	}
+
+}
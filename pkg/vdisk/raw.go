@@ -0,0 +1,216 @@
+package vdisk
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"errors"
+	"io"
+	"os"
+
+	"github.com/vorteil/vorteil/pkg/vio"
+)
+
+// rawBlockSize is the granularity at which the raw writer looks for empty
+// space. It matches the block size of most host file-systems, which is the
+// smallest hole they can represent.
+const rawBlockSize = 0x1000
+
+// sparseFile is satisfied by destinations that can have holes left in them,
+// which in practice means regular files.
+type sparseFile interface {
+	io.WriteSeeker
+	io.WriterAt
+	Stat() (os.FileInfo, error)
+	Truncate(size int64) error
+}
+
+// rawWriter writes a raw image to a regular file, seeking over every empty
+// block rather than writing zeroes so that the host file-system can leave a
+// hole there. Because it never writes the empty blocks it relies on the file
+// being empty from its starting offset onwards, so anything already there is
+// discarded when the writer is created.
+type rawWriter struct {
+	f      sparseFile
+	base   int64
+	size   int64
+	cursor int64
+	pos    int64
+}
+
+func newRawWriter(w io.WriteSeeker, size int64) (io.WriteSeeker, error) {
+
+	f, ok := w.(sparseFile)
+	if !ok {
+		return vio.WriteSeeker(w)
+	}
+
+	fi, err := f.Stat()
+	if err != nil || !fi.Mode().IsRegular() {
+		return vio.WriteSeeker(w)
+	}
+
+	base, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+
+	err = f.Truncate(base)
+	if err != nil {
+		return nil, err
+	}
+
+	return &rawWriter{
+		f:    f,
+		base: base,
+		size: size,
+	}, nil
+
+}
+
+func isZeroes(p []byte) bool {
+	for _, x := range p {
+		if x != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// sync moves the file's real offset to the cursor, which is allowed to drift
+// while skipping over empty blocks.
+func (w *rawWriter) sync() error {
+
+	if w.pos == w.cursor {
+		return nil
+	}
+
+	_, err := w.f.Seek(w.base+w.cursor, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	w.pos = w.cursor
+	return nil
+
+}
+
+// Write implements io.Writer. Runs of empty blocks are skipped, and runs of
+// blocks containing data are written in a single call.
+func (w *rawWriter) Write(p []byte) (n int, err error) {
+
+	for len(p) > 0 {
+
+		// the first run ends at the next block boundary
+		l := int(rawBlockSize - w.cursor%rawBlockSize)
+		if l > len(p) {
+			l = len(p)
+		}
+
+		empty := isZeroes(p[:l])
+		for l < len(p) {
+			k := rawBlockSize
+			if l+k > len(p) {
+				k = len(p) - l
+			}
+			if isZeroes(p[l:l+k]) != empty {
+				break
+			}
+			l += k
+		}
+
+		if empty {
+			w.cursor += int64(l)
+		} else {
+			err = w.sync()
+			if err != nil {
+				return
+			}
+
+			var k int
+			k, err = w.f.Write(p[:l])
+			w.cursor += int64(k)
+			w.pos = w.cursor
+			n += k
+			if err != nil {
+				return
+			}
+			p = p[k:]
+			continue
+		}
+
+		n += l
+		p = p[l:]
+
+	}
+
+	return
+
+}
+
+// ReadFrom implements io.ReaderFrom, passing the data straight through to the
+// file so that zero-copy optimizations still apply to file contents.
+func (w *rawWriter) ReadFrom(r io.Reader) (int64, error) {
+
+	err := w.sync()
+	if err != nil {
+		return 0, err
+	}
+
+	var n int64
+	if rf, ok := w.f.(io.ReaderFrom); ok {
+		n, err = rf.ReadFrom(r)
+	} else {
+		n, err = io.Copy(struct{ io.Writer }{w.f}, r)
+	}
+
+	w.cursor += n
+	w.pos = w.cursor
+
+	return n, err
+
+}
+
+// WriteAt implements io.WriterAt, skipping writes that are entirely empty.
+// It doesn't move the cursor, so it can be used while other data is being
+// written in order.
+func (w *rawWriter) WriteAt(p []byte, off int64) (int, error) {
+
+	if isZeroes(p) {
+		return len(p), nil
+	}
+
+	return w.f.WriteAt(p, w.base+off)
+
+}
+
+// Seek implements io.Seeker. It never touches the file, so seeking over empty
+// space costs nothing.
+func (w *rawWriter) Seek(offset int64, whence int) (int64, error) {
+
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += w.cursor
+	case io.SeekEnd:
+		offset += w.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+
+	if offset < 0 {
+		return 0, errors.New("cannot seek to a negative offset")
+	}
+
+	w.cursor = offset
+	return w.cursor, nil
+
+}
+
+// Close sets the file to the full size of the image in case it ends with empty
+// space that was skipped. It does not close the file.
+func (w *rawWriter) Close() error {
+	return w.f.Truncate(w.base + w.size)
+}
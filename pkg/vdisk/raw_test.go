@@ -0,0 +1,82 @@
+package vdisk
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestRawWriter(t *testing.T) {
+
+	size := int64(rawBlockSize * 64)
+	data := make([]byte, size)
+	copy(data[100:], bytes.Repeat([]byte{1}, rawBlockSize*3))
+	copy(data[rawBlockSize*20+7:], []byte("vorteil"))
+	copy(data[rawBlockSize*40:], bytes.Repeat([]byte{2}, rawBlockSize))
+
+	f, err := ioutil.TempFile("", "raw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	// leftovers from an earlier image must not leak into the holes
+	_, err = f.Write(bytes.Repeat([]byte{0xFF}, int(size)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = f.Seek(0, io.SeekStart)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ws, err := newRawWriter(f, size)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w, ok := ws.(*rawWriter)
+	if !ok {
+		t.Fatalf("raw writer didn't recognize a regular file as sparse")
+	}
+
+	// write across holes in odd-sized pieces, then seek over the rest
+	_, err = io.CopyBuffer(struct{ io.Writer }{w}, bytes.NewReader(data[:rawBlockSize*30+5]), make([]byte, 12345))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = w.Seek(rawBlockSize*40, io.SeekStart)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = w.ReadFrom(bytes.NewReader(data[rawBlockSize*40 : rawBlockSize*41]))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(out, data) {
+		t.Errorf("raw image contents differ from what was written")
+	}
+
+}
@@ -0,0 +1,99 @@
+package vdisk
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"time"
+
+	"github.com/vorteil/vorteil/pkg/vcfg"
+	"github.com/vorteil/vorteil/pkg/vimg"
+)
+
+// Reproducible pins everything a build would otherwise take from the clock
+// or a random number generator, so that building the same package twice with
+// the same Reproducible settings gives bit-identical images.
+type Reproducible struct {
+	// Seed derives the GUIDs of the disks and partitions, and the UUIDs of
+	// file-systems that aren't set in the VCFG.
+	Seed int64
+
+	// Time is written wherever the build would otherwise write the current
+	// time.
+	Time time.Time
+}
+
+// reproducibleFormats are the formats that add nothing random or
+// time-dependent around the disk image.
+var reproducibleFormats = map[Format]bool{
+	RAWFormat:         true,
+	QCOW2Format:       true,
+	GCPFArchiveFormat: true,
+	EBSFormat:         true,
+}
+
+// Reproducible returns true if images in the format can be built
+// reproducibly.
+func (x Format) Reproducible() bool {
+	return reproducibleFormats[x]
+}
+
+// validateReproducible checks that a reproducible build of cfg is possible.
+func validateReproducible(cfg *vcfg.VCFG, args *BuildArgs) error {
+
+	if args.Reproducible == nil {
+		return nil
+	}
+
+	if !args.Format.Reproducible() {
+		return fmt.Errorf("the %s format can't be built reproducibly", args.Format)
+	}
+
+	if cfg.System.Encryption.Enabled() {
+		return errors.New("encrypted disks can't be built reproducibly")
+	}
+
+	return nil
+
+}
+
+// seed returns the seed for the GUIDs of the named disk, or the main disk if
+// name is empty. Builds that don't have to be reproducible always use zero.
+func (args *BuildArgs) seed(name string) int64 {
+
+	if args.Reproducible == nil {
+		return 0
+	}
+
+	if name == "" {
+		return args.Reproducible.Seed
+	}
+
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(name))
+
+	return args.Reproducible.Seed ^ int64(h.Sum64())
+
+}
+
+// reproduce configures fs to build reproducibly, if it has to and it
+// supports it. The name distinguishes the file-systems of a build from one
+// another, and is empty for the root file-system.
+func (args *BuildArgs) reproduce(fs vimg.FSCompiler, name string) {
+
+	if args.Reproducible == nil {
+		return
+	}
+
+	if r, ok := fs.(vimg.ReproducibleFSCompiler); ok {
+		// file-systems get their own seeds, so their UUIDs don't match the
+		// GUIDs of the disk they're on
+		r.Reproduce(args.seed("fs/"+name), args.Reproducible.Time)
+	}
+
+}
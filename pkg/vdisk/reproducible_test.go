@@ -0,0 +1,69 @@
+package vdisk
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"testing"
+	"time"
+
+	"github.com/vorteil/vorteil/pkg/vcfg"
+)
+
+func TestValidateReproducible(t *testing.T) {
+
+	cfg := &vcfg.VCFG{}
+	args := &BuildArgs{Format: VMDKSparseFormat}
+
+	err := validateReproducible(cfg, args)
+	if err != nil {
+		t.Errorf("unexpected error for a non-reproducible build: %v", err)
+	}
+
+	args.Reproducible = &Reproducible{Seed: 1, Time: time.Unix(0, 0)}
+
+	err = validateReproducible(cfg, args)
+	if err == nil {
+		t.Errorf("expected an error for the %s format", args.Format)
+	}
+
+	args.Format = RAWFormat
+
+	err = validateReproducible(cfg, args)
+	if err != nil {
+		t.Errorf("unexpected error for the %s format: %v", args.Format, err)
+	}
+
+	cfg.System.Encryption.Passphrase = "secret"
+
+	err = validateReproducible(cfg, args)
+	if err == nil {
+		t.Errorf("expected an error for an encrypted disk")
+	}
+
+}
+
+func TestReproducibleSeed(t *testing.T) {
+
+	args := &BuildArgs{}
+	if args.seed("") != 0 || args.seed("data") != 0 {
+		t.Errorf("expected zero seeds for a non-reproducible build")
+	}
+
+	args.Reproducible = &Reproducible{Seed: 42}
+
+	if args.seed("") != 42 {
+		t.Errorf("expected the main disk to use the seed, got %d", args.seed(""))
+	}
+
+	if args.seed("data") == args.seed("") || args.seed("data") == args.seed("logs") {
+		t.Errorf("expected every disk to have its own seed")
+	}
+
+	if args.seed("data") != args.seed("data") {
+		t.Errorf("expected seeds to be stable")
+	}
+
+}
@@ -0,0 +1,247 @@
+package vdisk
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/vorteil/vorteil/pkg/vcfg"
+	"github.com/vorteil/vorteil/pkg/vimg"
+)
+
+// FSGrower grows a file-system in place so that it fills size bytes. The
+// file-system starts at offset zero of rw, and the new space already exists.
+type FSGrower func(rw io.ReadWriteSeeker, size int64) error
+
+var registeredFSGrowers map[string]FSGrower
+
+// RegisterFilesystemGrower registers a FSGrower for the named file-system.
+func RegisterFilesystemGrower(name string, fn FSGrower) error {
+
+	if registeredFSGrowers == nil {
+		registeredFSGrowers = make(map[string]FSGrower)
+	}
+
+	if _, exists := registeredFSGrowers[name]; exists {
+		return fmt.Errorf("refusing to register file-system grower '%s': already registered", name)
+	}
+
+	registeredFSGrowers[name] = fn
+	return nil
+
+}
+
+// FilesystemGrowers returns an alphabetised list of all file-systems that
+// have a registered grower.
+func FilesystemGrowers() []string {
+
+	var names = []string{}
+
+	for k := range registeredFSGrowers {
+		names = append(names, k)
+	}
+
+	sort.Strings(names)
+	return names
+
+}
+
+// DeregisterFilesystemGrower deregisters the FSGrower for the named
+// file-system.
+func DeregisterFilesystemGrower(name string) error {
+
+	if registeredFSGrowers != nil {
+		if _, exists := registeredFSGrowers[name]; exists {
+			delete(registeredFSGrowers, name)
+			return nil
+		}
+	}
+
+	return fmt.Errorf("file-system grower '%s' not found", name)
+
+}
+
+const (
+	extSignatureOffset = 1024 + 56
+	extIncompatOffset  = 1024 + 96
+	extSignature       = 0xEF53
+	extIncompatExtents = 0x40
+)
+
+var (
+	xfsMagic  = []byte("XFSB")
+	luksMagic = []byte{'L', 'U', 'K', 'S', 0xBA, 0xBE}
+)
+
+// detectFilesystem identifies the file-system at the start of r, returning
+// the name it is built with.
+func detectFilesystem(r io.ReaderAt) (vcfg.Filesystem, error) {
+
+	buf := make([]byte, 2048)
+	_, err := r.ReadAt(buf, 0)
+	if err != nil {
+		return "", err
+	}
+
+	switch {
+	case bytes.HasPrefix(buf, luksMagic):
+		return "", errors.New("encrypted file-systems can't be resized")
+	case bytes.HasPrefix(buf, xfsMagic):
+		return vcfg.XFS, nil
+	case binary.LittleEndian.Uint16(buf[extSignatureOffset:]) == extSignature:
+		if binary.LittleEndian.Uint32(buf[extIncompatOffset:])&extIncompatExtents != 0 {
+			return vcfg.Ext4FS, nil
+		}
+		return vcfg.Ext2FS, nil
+	}
+
+	return "", errors.New("unrecognized file-system")
+
+}
+
+// section is an io.ReadWriteSeeker over part of a file.
+type section struct {
+	f      *os.File
+	offset int64
+	size   int64
+	pos    int64
+}
+
+func (s *section) Read(p []byte) (int, error) {
+
+	if s.pos >= s.size {
+		return 0, io.EOF
+	}
+
+	if int64(len(p)) > s.size-s.pos {
+		p = p[:s.size-s.pos]
+	}
+
+	n, err := s.f.ReadAt(p, s.offset+s.pos)
+	s.pos += int64(n)
+	return n, err
+
+}
+
+func (s *section) Write(p []byte) (int, error) {
+
+	if s.pos+int64(len(p)) > s.size {
+		return 0, io.ErrShortWrite
+	}
+
+	n, err := s.f.WriteAt(p, s.offset+s.pos)
+	s.pos += int64(n)
+	return n, err
+
+}
+
+func (s *section) Seek(offset int64, whence int) (int64, error) {
+
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += s.pos
+	case io.SeekEnd:
+		offset += s.size
+	default:
+		return s.pos, errors.New("invalid whence")
+	}
+
+	if offset < 0 {
+		return s.pos, errors.New("negative seek")
+	}
+
+	s.pos = offset
+	return s.pos, nil
+
+}
+
+// ResizeRawImage grows the raw disk image at path to size bytes, rounded down
+// to a whole number of sectors. It moves the secondary GPT to the new end of
+// the disk, grows the root partition to fill the new space, and grows the
+// root file-system using the grower registered for it.
+//
+// The file-system is checked before the image is changed, but if growing it
+// fails after the partition table has been expanded the image is left valid
+// with the file-system at its original size.
+func ResizeRawImage(path string, size int64) error {
+
+	size -= size % vimg.SectorSize
+
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	if fi.Size()%vimg.SectorSize != 0 {
+		return ErrNotRawImage
+	}
+
+	if size < fi.Size() {
+		return fmt.Errorf("image can't be shrunk from %s to %s", vcfg.Bytes(fi.Size()), vcfg.Bytes(size))
+	}
+
+	if size == fi.Size() {
+		return nil
+	}
+
+	first, _, err := vimg.LastPartition(f)
+	if err != nil {
+		return err
+	}
+
+	fs, err := detectFilesystem(io.NewSectionReader(f, first*vimg.SectorSize, fi.Size()-first*vimg.SectorSize))
+	if err != nil {
+		return err
+	}
+
+	fn, ok := registeredFSGrowers[string(fs)]
+	if !ok {
+		return fmt.Errorf("resizing '%s' file-systems is not supported", fs)
+	}
+
+	err = f.Truncate(size)
+	if err != nil {
+		return err
+	}
+
+	err = vimg.ExpandPartitionTable(f, size)
+	if err != nil {
+		_ = f.Truncate(fi.Size())
+		return err
+	}
+
+	first, last, err := vimg.LastPartition(f)
+	if err != nil {
+		return err
+	}
+
+	partSize := (last - first + 1) * vimg.SectorSize
+
+	err = fn(&section{
+		f:      f,
+		offset: first * vimg.SectorSize,
+		size:   partSize,
+	}, partSize)
+	if err != nil {
+		return err
+	}
+
+	return f.Close()
+
+}
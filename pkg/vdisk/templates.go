@@ -0,0 +1,168 @@
+package vdisk
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strings"
+	"text/template"
+
+	"github.com/vorteil/vorteil/pkg/vcfg"
+	"github.com/vorteil/vorteil/pkg/vio"
+)
+
+// TemplateData is what the templates declared in a VCFG are rendered with.
+// Values override the values each template declares, and Env is the
+// environment the disk is built in.
+type TemplateData struct {
+	Values map[string]string
+	Env    map[string]string
+}
+
+// ValidateTemplates checks the templates declared in cfg.
+func ValidateTemplates(cfg *vcfg.VCFG) error {
+
+	paths := make(map[string]bool)
+
+	for _, t := range cfg.Templates {
+
+		if !path.IsAbs(t.Source) {
+			return fmt.Errorf("template has invalid source '%s': must be an absolute path", t.Source)
+		}
+
+		p := path.Clean(t.Path)
+		if !path.IsAbs(t.Path) || p == "/" {
+			return fmt.Errorf("template has invalid path '%s': must be an absolute path other than the root", t.Path)
+		}
+
+		if paths[p] {
+			return fmt.Errorf("template path '%s' declared more than once", p)
+		}
+		paths[p] = true
+
+	}
+
+	return nil
+
+}
+
+// RenderTemplates renders the templates declared in cfg into tree with data,
+// which may be nil. Templates fail to render if they use a value that isn't
+// set, rather than leaving a gap in the file.
+func RenderTemplates(cfg *vcfg.VCFG, data *TemplateData, tree vio.FileTree) error {
+
+	if len(cfg.Templates) == 0 {
+		return nil
+	}
+
+	if data == nil {
+		data = new(TemplateData)
+	}
+
+	sources := make(map[string]vio.File)
+	for _, t := range cfg.Templates {
+		sources[path.Clean(t.Source)] = nil
+	}
+
+	err := tree.Walk(func(p string, f vio.File) error {
+		p = path.Clean("/" + p)
+		if _, ok := sources[p]; ok {
+			sources[p] = f
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// every source is read before anything is mapped, so that one template's
+	// output can't replace another's source
+	contents := make(map[string][]byte)
+	for p, f := range sources {
+		if f == nil {
+			return fmt.Errorf("template source '%s' doesn't match any file", p)
+		}
+		if f.IsDir() || f.IsSymlink() || f.Special() != 0 {
+			return fmt.Errorf("template source '%s' isn't a regular file", p)
+		}
+		contents[p], err = ioutil.ReadAll(f)
+		if err != nil {
+			return err
+		}
+	}
+
+	rendered := make(map[string]bool)
+
+	for _, t := range cfg.Templates {
+
+		src := path.Clean(t.Source)
+		tmpl, err := template.New(path.Base(src)).Option("missingkey=error").Parse(string(contents[src]))
+		if err != nil {
+			return fmt.Errorf("failed to parse template '%s': %v", src, err)
+		}
+
+		values := make(map[string]string)
+		for k, v := range t.Values {
+			values[k] = v
+		}
+		for k, v := range data.Values {
+			values[k] = v
+		}
+
+		env := data.Env
+		if env == nil {
+			env = make(map[string]string)
+		}
+
+		buf := new(bytes.Buffer)
+		err = tmpl.Execute(buf, map[string]interface{}{
+			"Values": values,
+			"Env":    env,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to render template '%s': %v", src, err)
+		}
+
+		p := path.Clean(t.Path)
+		err = mapBytes(tree, p, buf.Bytes(), sources[src])
+		if err != nil {
+			return err
+		}
+		rendered[p] = true
+
+	}
+
+	for src := range sources {
+		if rendered[src] {
+			continue
+		}
+		err = tree.Unmap(strings.TrimPrefix(src, "/"))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+
+}
+
+// mapBytes maps data into tree at the absolute path p, with the ownership and
+// modification time of f.
+func mapBytes(tree vio.FileTree, p string, data []byte, f vio.File) error {
+
+	p = strings.TrimPrefix(p, "/")
+	return tree.Map(p, vio.CustomFile(vio.CustomFileArgs{
+		Name:       path.Base(p),
+		Size:       len(data),
+		ModTime:    f.ModTime(),
+		Ownership:  f.Ownership(),
+		ReadCloser: ioutil.NopCloser(bytes.NewReader(data)),
+	}))
+
+}
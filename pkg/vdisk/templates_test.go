@@ -0,0 +1,138 @@
+package vdisk
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/vorteil/vorteil/pkg/vcfg"
+	"github.com/vorteil/vorteil/pkg/vio"
+)
+
+func TestTemplates(t *testing.T) {
+
+	tree := vio.NewFileTree()
+	defer tree.Close()
+
+	for name, content := range map[string]string{
+		"etc/app.conf.tmpl": "level={{ .Values.level }} region={{ .Values.region }} home={{ .Env.HOME }}",
+		"etc/motd":          "{{ .Values.greeting }}",
+	} {
+		err := tree.Map(name, vio.CustomFile(vio.CustomFileArgs{
+			Name:       name,
+			Size:       len(content),
+			ReadCloser: ioutil.NopCloser(strings.NewReader(content)),
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cfg := &vcfg.VCFG{
+		Templates: []vcfg.Template{
+			{Source: "/etc/app.conf.tmpl", Path: "/etc/app.conf", Values: map[string]string{"level": "info", "region": "eu"}},
+			{Source: "/etc/motd", Path: "/etc/motd", Values: map[string]string{"greeting": "hello"}},
+		},
+	}
+
+	err := ValidateTemplates(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = RenderTemplates(cfg, &TemplateData{
+		Values: map[string]string{"level": "debug"},
+		Env:    map[string]string{"HOME": "/root"},
+	}, tree)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	found := make(map[string]string)
+	err = tree.Walk(func(path string, f vio.File) error {
+		if f.IsDir() {
+			return nil
+		}
+		data, err := ioutil.ReadAll(f)
+		if err != nil {
+			return err
+		}
+		if int64(len(data)) != int64(f.Size()) {
+			t.Errorf("'%s' has the wrong size", path)
+		}
+		found[path] = string(data)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{
+		"./etc/app.conf": "level=debug region=eu home=/root",
+		"./etc/motd":     "hello",
+	}
+
+	if len(found) != len(expected) {
+		t.Errorf("expected %d files, found %v", len(expected), found)
+	}
+
+	for k, v := range expected {
+		if found[k] != v {
+			t.Errorf("'%s' rendered as '%s', expected '%s'", k, found[k], v)
+		}
+	}
+
+}
+
+func TestTemplatesMissingValue(t *testing.T) {
+
+	tree := vio.NewFileTree()
+	defer tree.Close()
+
+	content := []byte("{{ .Values.missing }}")
+	err := tree.Map("app.tmpl", vio.CustomFile(vio.CustomFileArgs{
+		Name:       "app.tmpl",
+		Size:       len(content),
+		ReadCloser: ioutil.NopCloser(bytes.NewReader(content)),
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &vcfg.VCFG{
+		Templates: []vcfg.Template{{Source: "/app.tmpl", Path: "/app"}},
+	}
+
+	err = RenderTemplates(cfg, nil, tree)
+	if err == nil {
+		t.Errorf("expected an error for a missing value")
+	}
+
+	cfg.Templates[0].Source = "/missing"
+	err = RenderTemplates(cfg, nil, tree)
+	if err == nil {
+		t.Errorf("expected an error for a missing source")
+	}
+
+}
+
+func TestValidateTemplates(t *testing.T) {
+
+	for _, x := range [][]vcfg.Template{
+		{{Source: "app.tmpl", Path: "/app"}},
+		{{Source: "/app.tmpl", Path: "/"}},
+		{{Source: "/a.tmpl", Path: "/app"}, {Source: "/b.tmpl", Path: "/app/"}},
+	} {
+		err := ValidateTemplates(&vcfg.VCFG{Templates: x})
+		if err == nil {
+			t.Errorf("expected an error for %v", x)
+		}
+	}
+
+}
@@ -0,0 +1,162 @@
+package vdisk
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/vorteil/vorteil/pkg/vcfg"
+	"github.com/vorteil/vorteil/pkg/vio"
+)
+
+// DefaultZoneInfo is where the time-zone database is found on most Linux
+// hosts, and where it is put on the disk.
+const DefaultZoneInfo = "/usr/share/zoneinfo"
+
+// DefaultTimezone is the time zone used if the VCFG doesn't set one.
+const DefaultTimezone = "UTC"
+
+// localeDirs are the places a host might keep its compiled C.UTF-8 locale.
+var localeDirs = []string{"/usr/lib/locale/C.utf8", "/usr/lib/locale/C.UTF-8"}
+
+// zoneInfoSkip are subdirectories of the time-zone database that duplicate
+// the rest of it, and that nothing needs.
+var zoneInfoSkip = map[string]bool{
+	"posix": true,
+	"right": true,
+}
+
+// timezone returns the time zone cfg asks for.
+func timezone(cfg *vcfg.VCFG) string {
+
+	if cfg.System.Timezone == "" {
+		return DefaultTimezone
+	}
+
+	return cfg.System.Timezone
+
+}
+
+// ValidateTimezone checks that the time zone set in cfg exists in the
+// time-zone database at dir.
+func ValidateTimezone(cfg *vcfg.VCFG, dir string) error {
+
+	tz := timezone(cfg)
+	if path.IsAbs(tz) || path.Clean(tz) != tz || strings.HasPrefix(tz, "..") {
+		return fmt.Errorf("invalid time zone '%s'", tz)
+	}
+
+	fi, err := os.Stat(filepath.Join(dir, filepath.FromSlash(tz)))
+	if err != nil || fi.IsDir() {
+		return fmt.Errorf("time zone '%s' not found in '%s'", tz, dir)
+	}
+
+	return nil
+
+}
+
+// MapTimezoneData adds the time-zone database at dir to tree, along with
+// /etc/localtime and /etc/timezone for the time zone set in cfg. If the host
+// has a C.UTF-8 locale it's added too, and made the default in
+// /etc/locale.conf.
+func MapTimezoneData(cfg *vcfg.VCFG, dir string, tree vio.FileTree) error {
+
+	err := ValidateTimezone(cfg, dir)
+	if err != nil {
+		return err
+	}
+
+	err = mapHostDirectory(dir, strings.TrimPrefix(DefaultZoneInfo, "/"), tree, zoneInfoSkip)
+	if err != nil {
+		return err
+	}
+
+	tz := timezone(cfg)
+	link := path.Join(DefaultZoneInfo, tz)
+
+	err = tree.Map("etc/localtime", vio.CustomFile(vio.CustomFileArgs{
+		Name:       "localtime",
+		Size:       len(link),
+		ModTime:    time.Unix(0, 0),
+		IsSymlink:  true,
+		ReadCloser: ioutil.NopCloser(strings.NewReader(link)),
+	}))
+	if err != nil {
+		return err
+	}
+
+	err = mapText(tree, "etc/timezone", tz+"\n")
+	if err != nil {
+		return err
+	}
+
+	for _, locale := range localeDirs {
+
+		fi, err := os.Stat(locale)
+		if err != nil || !fi.IsDir() {
+			continue
+		}
+
+		err = mapHostDirectory(locale, "usr/lib/locale/C.UTF-8", tree, nil)
+		if err != nil {
+			return err
+		}
+
+		return mapText(tree, "etc/locale.conf", "LANG=C.UTF-8\n")
+
+	}
+
+	return nil
+
+}
+
+// mapHostDirectory maps everything beneath the host directory dir into tree
+// at prefix, leaving out any subdirectories of dir named in skip.
+func mapHostDirectory(dir, prefix string, tree vio.FileTree, skip map[string]bool) error {
+
+	return filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+
+		if fi.IsDir() && skip[rel] {
+			return filepath.SkipDir
+		}
+
+		f, err := vio.LazyOpen(p)
+		if err != nil {
+			return err
+		}
+
+		return tree.Map(path.Join(prefix, rel), f)
+
+	})
+
+}
+
+func mapText(tree vio.FileTree, p, s string) error {
+
+	return tree.Map(p, vio.CustomFile(vio.CustomFileArgs{
+		Name:       path.Base(p),
+		Size:       len(s),
+		ModTime:    time.Unix(0, 0),
+		ReadCloser: ioutil.NopCloser(strings.NewReader(s)),
+	}))
+
+}
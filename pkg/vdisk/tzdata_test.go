@@ -0,0 +1,90 @@
+package vdisk
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/vorteil/vorteil/pkg/vcfg"
+	"github.com/vorteil/vorteil/pkg/vio"
+)
+
+func TestMapTimezoneData(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "zoneinfo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"UTC", "Europe/Berlin", "posix/UTC", "right/UTC"} {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		err = os.MkdirAll(filepath.Dir(p), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ioutil.WriteFile(p, []byte("TZif"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cfg := &vcfg.VCFG{}
+	cfg.System.Timezone = "Europe/Berlin"
+
+	tree := vio.NewFileTree()
+	defer tree.Close()
+
+	err = MapTimezoneData(cfg, dir, tree)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	found := make(map[string]vio.File)
+	err = tree.Walk(func(path string, f vio.File) error {
+		found[path] = f
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{"./usr/share/zoneinfo/UTC", "./usr/share/zoneinfo/Europe/Berlin", "./etc/timezone"} {
+		if _, ok := found[path]; !ok {
+			t.Errorf("expected %s in the tree", path)
+		}
+	}
+
+	for _, path := range []string{"./usr/share/zoneinfo/posix", "./usr/share/zoneinfo/right"} {
+		if _, ok := found[path]; ok {
+			t.Errorf("didn't expect %s in the tree", path)
+		}
+	}
+
+	localtime, ok := found["./etc/localtime"]
+	if !ok || !localtime.IsSymlink() {
+		t.Fatal("expected /etc/localtime to be a symlink")
+	}
+
+	data, err := ioutil.ReadAll(localtime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "/usr/share/zoneinfo/Europe/Berlin" {
+		t.Errorf("wrong /etc/localtime target: %s", data)
+	}
+
+	for _, tz := range []string{"Mars/Olympus_Mons", "../UTC", "/UTC", "Europe"} {
+		cfg.System.Timezone = tz
+		if ValidateTimezone(cfg, dir) == nil {
+			t.Errorf("%s: expected an error", tz)
+		}
+	}
+
+}
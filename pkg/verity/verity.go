@@ -0,0 +1,253 @@
+package verity
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// BlockSize is the size of both the data blocks and the hash blocks of the
+// hash trees built by this package.
+const BlockSize = 4096
+
+// Algorithm is the hash algorithm used to build hash trees.
+const Algorithm = "sha256"
+
+const (
+	digestSize     = sha256.Size
+	hashesPerBlock = BlockSize / digestSize
+	superblockSize = 512
+	maxSaltSize    = 256
+)
+
+// superblock is the on-disk superblock veritysetup writes at the start of a
+// hash device, which lets the device be checked with 'veritysetup verify'.
+type superblock struct {
+	Signature     [8]byte
+	Version       uint32
+	HashType      uint32
+	UUID          [16]byte
+	Algorithm     [32]byte
+	DataBlockSize uint32
+	HashBlockSize uint32
+	DataBlocks    uint64
+	SaltSize      uint16
+	_             [6]byte
+	Salt          [maxSaltSize]byte
+	_             [168]byte
+}
+
+// levelBlocks returns the number of hash blocks in each level of the hash
+// tree for dataBlocks blocks of data, starting with the level that hashes the
+// data itself.
+func levelBlocks(dataBlocks int64) []int64 {
+
+	var levels []int64
+
+	n := dataBlocks
+	for n > 1 {
+		n = (n + hashesPerBlock - 1) / hashesPerBlock
+		levels = append(levels, n)
+	}
+
+	return levels
+
+}
+
+// HashDeviceSize returns the size of the hash device needed for dataSize
+// bytes of data, including its superblock.
+func HashDeviceSize(dataSize int64) int64 {
+
+	blocks := int64(1) // superblock
+	for _, n := range levelBlocks(dataSize / BlockSize) {
+		blocks += n
+	}
+
+	return blocks * BlockSize
+
+}
+
+// DataSize returns the largest amount of data, in whole blocks, that fits in
+// size bytes along with its hash device.
+func DataSize(size int64) int64 {
+
+	// start from an underestimate, since the hash device for size bytes is
+	// at least as big as the one for the data
+	data := size - HashDeviceSize(size)
+	if data < 0 {
+		data = 0
+	}
+	data -= data % BlockSize
+
+	for next := data + BlockSize; next+HashDeviceSize(next) <= size; next += BlockSize {
+		data = next
+	}
+
+	return data
+
+}
+
+// Tree is a dm-verity hash tree (hash format version 1) for a block of data.
+type Tree struct {
+	salt       []byte
+	uuid       [16]byte
+	dataBlocks int64
+	levels     [][]byte
+	root       []byte
+}
+
+// hash returns the digest of a block, with the salt prepended.
+func (t *Tree) hash(block []byte) []byte {
+
+	h := sha256.New()
+	_, _ = h.Write(t.salt)
+	_, _ = h.Write(block)
+	return h.Sum(nil)
+
+}
+
+// hashLevel returns the level of the tree that hashes the blocks in data,
+// padded out to a whole number of blocks.
+func (t *Tree) hashLevel(data []byte) []byte {
+
+	n := (int64(len(data))/BlockSize + hashesPerBlock - 1) / hashesPerBlock
+	level := make([]byte, n*BlockSize)
+
+	for i := 0; i*BlockSize < len(data); i++ {
+		copy(level[i*digestSize:], t.hash(data[i*BlockSize:(i+1)*BlockSize]))
+	}
+
+	return level
+
+}
+
+// Build reads dataSize bytes from r, which must be a whole number of blocks,
+// and returns the hash tree for them. The salt is at most 256 bytes, and the
+// uuid is only recorded in the superblock.
+func Build(r io.Reader, dataSize int64, salt []byte, uuid [16]byte) (*Tree, error) {
+
+	if dataSize <= 0 || dataSize%BlockSize != 0 {
+		return nil, fmt.Errorf("verity data size must be a non-zero multiple of %d bytes", BlockSize)
+	}
+
+	if len(salt) > maxSaltSize {
+		return nil, errors.New("verity salt is too long")
+	}
+
+	t := &Tree{
+		salt:       salt,
+		uuid:       uuid,
+		dataBlocks: dataSize / BlockSize,
+	}
+
+	// the first level is built as the data is read, so that the data never
+	// has to be held in memory
+	counts := levelBlocks(t.dataBlocks)
+	var level []byte
+	if len(counts) > 0 {
+		level = make([]byte, counts[0]*BlockSize)
+	}
+
+	block := make([]byte, BlockSize)
+	for i := int64(0); i < t.dataBlocks; i++ {
+		_, err := io.ReadFull(r, block)
+		if err != nil {
+			return nil, err
+		}
+
+		digest := t.hash(block)
+		if level == nil {
+			t.root = digest
+			return t, nil
+		}
+
+		copy(level[i*digestSize:], digest)
+	}
+
+	t.levels = append(t.levels, level)
+	for len(level) > BlockSize {
+		level = t.hashLevel(level)
+		t.levels = append(t.levels, level)
+	}
+
+	t.root = t.hash(level)
+
+	return t, nil
+
+}
+
+// RootHash returns the digest at the top of the hash tree, which is what the
+// data is verified against.
+func (t *Tree) RootHash() []byte {
+	return t.root
+}
+
+// Size returns the size of the hash device, including its superblock.
+func (t *Tree) Size() int64 {
+	return HashDeviceSize(t.dataBlocks * BlockSize)
+}
+
+// WriteTo writes the hash device to w: a superblock in the first block,
+// followed by the levels of the tree from the top down, which is the order
+// the kernel expects to find them in.
+func (t *Tree) WriteTo(w io.Writer) (int64, error) {
+
+	sb := superblock{
+		Version:       1,
+		HashType:      1,
+		UUID:          t.uuid,
+		DataBlockSize: BlockSize,
+		HashBlockSize: BlockSize,
+		DataBlocks:    uint64(t.dataBlocks),
+		SaltSize:      uint16(len(t.salt)),
+	}
+
+	copy(sb.Signature[:], "verity")
+	copy(sb.Algorithm[:], Algorithm)
+	copy(sb.Salt[:], t.salt)
+
+	buf := new(bytes.Buffer)
+	_ = binary.Write(buf, binary.LittleEndian, &sb)
+	buf.Write(make([]byte, BlockSize-superblockSize))
+
+	k, err := io.Copy(w, buf)
+	if err != nil {
+		return k, err
+	}
+
+	for i := len(t.levels) - 1; i >= 0; i-- {
+		n, err := w.Write(t.levels[i])
+		k += int64(n)
+		if err != nil {
+			return k, err
+		}
+	}
+
+	return k, nil
+
+}
+
+// Table returns the device-mapper table line for a verity target that
+// verifies dataDev against the hash tree on hashDev. The hash tree starts in
+// the block after the superblock.
+func (t *Tree) Table(dataDev, hashDev string) string {
+
+	salt := "-"
+	if len(t.salt) > 0 {
+		salt = hex.EncodeToString(t.salt)
+	}
+
+	return fmt.Sprintf("0 %d verity 1 %s %s %d %d %d 1 %s %s %s",
+		t.dataBlocks*BlockSize/512, dataDev, hashDev, BlockSize, BlockSize,
+		t.dataBlocks, Algorithm, hex.EncodeToString(t.root), salt)
+
+}
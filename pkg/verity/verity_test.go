@@ -0,0 +1,142 @@
+package verity
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func saltedHash(salt, data []byte) []byte {
+	h := sha256.New()
+	h.Write(salt)
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+// verify walks the hash device the way the kernel would, checking every data
+// block against it, and returns the root hash it finds.
+func verify(t *testing.T, dev, data, salt []byte) []byte {
+
+	sb := new(superblock)
+	err := binary.Read(bytes.NewReader(dev), binary.LittleEndian, sb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(sb.Signature[:6]) != "verity" || sb.Version != 1 || sb.HashType != 1 {
+		t.Fatalf("bad verity superblock: %+v", sb)
+	}
+
+	if int(sb.DataBlocks)*BlockSize != len(data) || !bytes.Equal(sb.Salt[:sb.SaltSize], salt) {
+		t.Fatalf("verity superblock doesn't match the data")
+	}
+
+	// levels are stored top-first after the superblock
+	counts := levelBlocks(int64(sb.DataBlocks))
+	offsets := make([]int64, len(counts))
+	offset := int64(BlockSize)
+	for i := len(counts) - 1; i >= 0; i-- {
+		offsets[i] = offset
+		offset += counts[i] * BlockSize
+	}
+
+	if offset != int64(len(dev)) {
+		t.Fatalf("hash device is %d bytes, expected %d", len(dev), offset)
+	}
+
+	blocks := data
+	for i := range counts {
+		for j := 0; j*BlockSize < len(blocks); j++ {
+			digest := saltedHash(salt, blocks[j*BlockSize:(j+1)*BlockSize])
+			at := offsets[i] + int64(j*digestSize)
+			if !bytes.Equal(dev[at:at+digestSize], digest) {
+				t.Fatalf("bad digest for block %d of level %d", j, i)
+			}
+		}
+		blocks = dev[offsets[i] : offsets[i]+counts[i]*BlockSize]
+	}
+
+	return saltedHash(salt, blocks)
+
+}
+
+func TestTree(t *testing.T) {
+
+	salt := []byte("vorteil")
+
+	// enough data for two levels, with a partial block of hashes
+	data := make([]byte, 300*BlockSize)
+	rand.New(rand.NewSource(1)).Read(data[:200*BlockSize])
+
+	tree, err := Build(bytes.NewReader(data), int64(len(data)), salt, [16]byte{1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dev := new(bytes.Buffer)
+	n, err := tree.WriteTo(dev)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n != tree.Size() || n != HashDeviceSize(int64(len(data))) {
+		t.Fatalf("wrote %d bytes, expected %d", n, tree.Size())
+	}
+
+	root := verify(t, dev.Bytes(), data, salt)
+	if !bytes.Equal(root, tree.RootHash()) {
+		t.Fatalf("root hash doesn't match the hash device")
+	}
+
+	table := tree.Table("/dev/sda2", "/dev/sda3")
+	expect := "0 2400 verity 1 /dev/sda2 /dev/sda3 4096 4096 300 1 sha256 " +
+		hex.EncodeToString(root) + " " + hex.EncodeToString(salt)
+	if table != expect {
+		t.Errorf("bad table: %s", table)
+	}
+
+	// a single block of data has no hash blocks at all
+	tree, err = Build(bytes.NewReader(data), BlockSize, nil, [16]byte{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(tree.RootHash(), saltedHash(nil, data[:BlockSize])) || tree.Size() != BlockSize {
+		t.Errorf("bad tree for a single block")
+	}
+
+	if !strings.HasSuffix(tree.Table("a", "b"), " -") {
+		t.Errorf("unsalted table doesn't use '-' for the salt")
+	}
+
+	_, err = Build(bytes.NewReader(data), BlockSize+1, nil, [16]byte{})
+	if err == nil {
+		t.Errorf("built a tree for a partial block")
+	}
+
+}
+
+func TestDataSize(t *testing.T) {
+
+	for _, size := range []int64{0, BlockSize, 2 * BlockSize, 1 << 20, 1<<30 + 512} {
+		data := DataSize(size)
+		if data%BlockSize != 0 || (data > 0 && data+HashDeviceSize(data) > size) {
+			t.Errorf("bad data size %d for %d bytes", data, size)
+		}
+
+		// one more block wouldn't fit
+		if next := data + BlockSize; next+HashDeviceSize(next) <= size {
+			t.Errorf("data size %d for %d bytes is too small", data, size)
+		}
+	}
+
+}
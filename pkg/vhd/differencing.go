@@ -0,0 +1,686 @@
+package vhd
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"github.com/vorteil/vorteil/pkg/elog"
+)
+
+// A differencing VHD only contains the blocks of an image that differ from a
+// parent VHD, so that a fleet sharing a common base image only needs to be
+// sent the deltas. Its layout is the same as a dynamic VHD, except that the
+// header identifies the parent and points at "parent locators" holding its
+// path, and that each block's sector bitmap marks which sectors are in the
+// child. Blocks missing from the BAT, and sectors missing from a block's
+// bitmap, are read from the parent instead.
+//
+// Readers match the child to its parent by the parent's unique ID, so the
+// parent must not be modified or rebuilt once children have been made from
+// it.
+
+const (
+	diskTypeFixed        = 2
+	diskTypeDynamic      = 3
+	diskTypeDifferencing = 4
+
+	conectixCookie = 0x636F6E6563746978
+	cxsparseCookie = 0x6378737061727365
+
+	// platform codes of the parent locators
+	platformW2ru = 0x57327275 // relative Windows path, UTF-16LE
+	platformW2ku = 0x57326B75 // absolute Windows path, UTF-16LE
+
+	unusedBATEntry = 0xFFFFFFFF
+)
+
+type parentLocator struct { // 24 bytes
+	PlatformCode       uint32
+	PlatformDataSpace  uint32
+	PlatformDataLength uint32
+	Reserved           uint32
+	PlatformDataOffset uint64
+}
+
+// Parent is a fixed or dynamic VHD that a differencing VHD is built against.
+type Parent struct {
+	f         *os.File
+	path      string
+	footer    footer
+	blockSize int64
+	bitmap    int64
+	bat       []uint32
+}
+
+// OpenParent opens the VHD at path to be used as the parent of a differencing
+// VHD. Chains of differencing VHDs aren't supported, so the parent must be a
+// fixed or dynamic VHD.
+func OpenParent(path string) (*Parent, error) {
+
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(abs)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Parent{
+		f:    f,
+		path: abs,
+	}
+
+	err = p.load()
+	if err != nil {
+		_ = f.Close()
+		return nil, fmt.Errorf("bad parent vhd '%s': %v", path, err)
+	}
+
+	return p, nil
+
+}
+
+func (p *Parent) load() error {
+
+	info, err := p.f.Stat()
+	if err != nil {
+		return err
+	}
+
+	if info.Size() < 512 {
+		return errors.New("file too small to be a vhd")
+	}
+
+	err = binary.Read(io.NewSectionReader(p.f, info.Size()-512, 512), binary.BigEndian, &p.footer)
+	if err != nil {
+		return err
+	}
+
+	if p.footer.Cookie != conectixCookie {
+		return errors.New("missing vhd footer")
+	}
+
+	switch p.footer.DiskType {
+	case diskTypeFixed:
+		return nil
+	case diskTypeDynamic:
+	case diskTypeDifferencing:
+		return errors.New("differencing vhds can't be used as parents")
+	default:
+		return fmt.Errorf("unsupported vhd disk type %d", p.footer.DiskType)
+	}
+
+	hdr := new(header)
+	err = binary.Read(io.NewSectionReader(p.f, int64(p.footer.DataOffset), 1024), binary.BigEndian, hdr)
+	if err != nil {
+		return err
+	}
+
+	if hdr.Cookie != cxsparseCookie {
+		return errors.New("missing dynamic disk header")
+	}
+
+	if hdr.BlockSize == 0 || hdr.BlockSize%512 != 0 {
+		return fmt.Errorf("invalid block size %d", hdr.BlockSize)
+	}
+
+	p.blockSize = int64(hdr.BlockSize)
+	p.bitmap = (p.blockSize/512/8 + 511) / 512 * 512
+	p.bat = make([]uint32, hdr.MaxTableEntries)
+
+	err = binary.Read(io.NewSectionReader(p.f, int64(hdr.TableOffset), 4*int64(len(p.bat))), binary.BigEndian, p.bat)
+	if err != nil {
+		return err
+	}
+
+	return nil
+
+}
+
+// Size returns the virtual size of the parent disk.
+func (p *Parent) Size() int64 {
+	return int64(p.footer.CurrentSize)
+}
+
+// ReadAt implements io.ReaderAt, reading the parent disk's virtual contents.
+// Unallocated blocks of a dynamic parent read as zeroes.
+func (p *Parent) ReadAt(b []byte, off int64) (int, error) {
+
+	if off+int64(len(b)) > p.Size() {
+		return 0, io.ErrUnexpectedEOF
+	}
+
+	if p.footer.DiskType == diskTypeFixed {
+		return p.f.ReadAt(b, off)
+	}
+
+	var n int
+	for len(b) > 0 {
+		block := off / p.blockSize
+		delta := off % p.blockSize
+		k := p.blockSize - delta
+		if k > int64(len(b)) {
+			k = int64(len(b))
+		}
+
+		if block >= int64(len(p.bat)) || p.bat[block] == unusedBATEntry {
+			for i := int64(0); i < k; i++ {
+				b[i] = 0
+			}
+		} else {
+			_, err := p.f.ReadAt(b[:k], int64(p.bat[block])*512+p.bitmap+delta)
+			if err != nil {
+				return n, err
+			}
+		}
+
+		n += int(k)
+		off += k
+		b = b[k:]
+	}
+
+	return n, nil
+
+}
+
+// Close closes the parent's file.
+func (p *Parent) Close() error {
+	return p.f.Close()
+}
+
+// DifferencingWriter writes a differencing VHD against a parent VHD. Like the
+// streaming formats it never seeks backwards through the raw image, and the
+// space it is told to skip over is treated as zeroes, but it seeks backwards
+// through its own output to fill in the BAT once it knows which blocks
+// differ.
+type DifferencingWriter struct {
+	w      io.WriteSeeker
+	parent *Parent
+	size   int64
+	footer []byte
+	header *header
+	bat    []byte
+	batAt  int64
+	next   int64
+	cursor int64
+	buf    []byte
+	pbuf   []byte
+	closed bool
+	log    elog.Logger
+}
+
+// NewDifferencingWriter returns a writer that writes a differencing VHD to w
+// containing only the parts of the raw image that differ from the parent VHD
+// at parentPath. The parent must be the same size as the image. If w is a
+// file the parent's path is recorded relative to it, otherwise the parent is
+// expected to sit alongside the child.
+func NewDifferencingWriter(w io.WriteSeeker, h HolePredictor, parentPath string) (*DifferencingWriter, error) {
+
+	parent, err := OpenParent(parentPath)
+	if err != nil {
+		return nil, err
+	}
+
+	dw, err := newDifferencingWriter(w, h.Size(), parent)
+	if err != nil {
+		_ = parent.Close()
+		return nil, err
+	}
+
+	return dw, nil
+
+}
+
+func newDifferencingWriter(w io.WriteSeeker, size int64, parent *Parent) (*DifferencingWriter, error) {
+
+	if parent.Size() != size {
+		return nil, fmt.Errorf("parent vhd is %d bytes but the image is %d bytes: set the vm's disk size to match the parent", parent.Size(), size)
+	}
+
+	dw := &DifferencingWriter{
+		w:      w,
+		parent: parent,
+		size:   size,
+		buf:    make([]byte, chunkSize),
+		pbuf:   make([]byte, chunkSize),
+	}
+
+	entries := (size + chunkSize - 1) / chunkSize
+	dw.bat = bytes.Repeat([]byte{0xFF}, int((4*entries+511)/512*512))
+	dw.batAt = 1536
+
+	var err error
+	dw.footer, err = dw.marshalFooter()
+	if err != nil {
+		return nil, err
+	}
+
+	relative := ".\\" + filepath.Base(parent.path)
+	if f, ok := w.(interface{ Name() string }); ok {
+		var dir string
+		dir, err = filepath.Abs(filepath.Dir(f.Name()))
+		if err == nil {
+			var rel string
+			rel, err = filepath.Rel(dir, parent.path)
+			if err == nil {
+				relative = windowsPath(rel)
+				if !strings.HasPrefix(relative, "..") {
+					relative = ".\\" + relative
+				}
+			}
+		}
+	}
+
+	locators := [][]byte{
+		utf16LE(relative),
+		utf16LE(windowsPath(parent.path)),
+	}
+
+	// the locators' data goes between the BAT and the first block
+	hdr := &header{
+		Cookie:          cxsparseCookie,
+		DataOffset:      0xFFFFFFFFFFFFFFFF,
+		TableOffset:     uint64(dw.batAt),
+		HeaderVersion:   0x00010000,
+		MaxTableEntries: uint32(entries),
+		BlockSize:       chunkSize,
+		ParentUniqueID:  parent.footer.UniqueID,
+		ParentTimeStamp: parent.footer.TimeStamp,
+	}
+
+	name := utf16BE(filepath.Base(parent.path))
+	if len(name) > len(hdr.ParentUnicodeName) {
+		return nil, errors.New("parent vhd file name is too long")
+	}
+	copy(hdr.ParentUnicodeName[:], name)
+
+	offset := dw.batAt + int64(len(dw.bat))
+	entryFields := []*[24]byte{&hdr.ParentLocatorEntry1, &hdr.ParentLocatorEntry2}
+	for i, data := range locators {
+		space := (int64(len(data)) + 511) / 512 * 512
+		loc := parentLocator{
+			PlatformCode:       []uint32{platformW2ru, platformW2ku}[i],
+			PlatformDataSpace:  uint32(space),
+			PlatformDataLength: uint32(len(data)),
+			PlatformDataOffset: uint64(offset),
+		}
+
+		lbuf := new(bytes.Buffer)
+		err = binary.Write(lbuf, binary.BigEndian, &loc)
+		if err != nil {
+			return nil, err
+		}
+		copy(entryFields[i][:], lbuf.Bytes())
+
+		offset += space
+	}
+	dw.next = offset
+
+	hbuf := new(bytes.Buffer)
+	err = binary.Write(hbuf, binary.BigEndian, hdr)
+	if err != nil {
+		return nil, err
+	}
+	hdr.Checksum = checksum(hbuf.Bytes())
+
+	hbuf.Reset()
+	err = binary.Write(hbuf, binary.BigEndian, hdr)
+	if err != nil {
+		return nil, err
+	}
+
+	dw.header = hdr
+
+	_, err = w.Write(dw.footer)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = w.Write(hbuf.Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	// the real BAT is written once every block has been compared
+	_, err = w.Write(dw.bat)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, data := range locators {
+		space := (len(data) + 511) / 512 * 512
+		_, err = w.Write(append(data, make([]byte, space-len(data))...))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return dw, nil
+
+}
+
+func (w *DifferencingWriter) marshalFooter() ([]byte, error) {
+
+	ftr := &footer{
+		Cookie:             conectixCookie,
+		Features:           0x00000002,
+		FileFormatVersion:  0x00010000,
+		DataOffset:         512,
+		TimeStamp:          uint32(time.Now().Unix() - 946684800), // 2000 offset
+		CreatorApplication: 0x76636C69,
+		CreatorVersion:     0x00010000,
+		CreatorHostOS:      0x5769326B,
+		OriginalSize:       uint64(w.size),
+		CurrentSize:        uint64(w.size),
+		DiskGeometry:       geometry(w.size),
+		DiskType:           diskTypeDifferencing,
+	}
+
+	_, err := rand.Read(ftr.UniqueID[:])
+	if err != nil {
+		return nil, err
+	}
+
+	buf := new(bytes.Buffer)
+	err = binary.Write(buf, binary.BigEndian, ftr)
+	if err != nil {
+		return nil, err
+	}
+	ftr.Checksum = checksum(buf.Bytes())
+
+	buf.Reset()
+	err = binary.Write(buf, binary.BigEndian, ftr)
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+
+}
+
+// flush compares the block that has just been finished with the parent, and
+// writes it out if any of its sectors differ, marking only those sectors in
+// its bitmap.
+func (w *DifferencingWriter) flush() error {
+
+	block := (w.cursor - 1) / chunkSize
+	start := block * chunkSize
+	length := w.cursor - start
+
+	data := w.buf[:length]
+	pdata := w.pbuf[:length]
+
+	_, err := w.parent.ReadAt(pdata, start)
+	if err != nil {
+		return err
+	}
+
+	if !bytes.Equal(data, pdata) {
+		bitmap := make([]byte, 512)
+		for s := int64(0); s*512 < length; s++ {
+			if !bytes.Equal(data[s*512:(s+1)*512], pdata[s*512:(s+1)*512]) {
+				bitmap[s/8] |= 0x80 >> uint(s%8)
+			}
+		}
+
+		_, err = w.w.Seek(w.next, io.SeekStart)
+		if err != nil {
+			return err
+		}
+
+		_, err = w.w.Write(bitmap)
+		if err != nil {
+			return err
+		}
+
+		_, err = w.w.Write(w.buf)
+		if err != nil {
+			return err
+		}
+
+		binary.BigEndian.PutUint32(w.bat[4*block:], uint32(w.next/512))
+		w.next += 512 + chunkSize
+	}
+
+	for i := range w.buf {
+		w.buf[i] = 0
+	}
+
+	return nil
+
+}
+
+// SetLogger sets the logger the DifferencingWriter traces the metadata it
+// writes to. The footer and header are traced right away, and the BAT once it
+// has been written, when the DifferencingWriter is closed.
+func (w *DifferencingWriter) SetLogger(log elog.Logger) {
+
+	w.log = log
+	if log == nil {
+		return
+	}
+
+	traceFooter(log, w.footer)
+	traceHeader(log, w.header)
+	log.Tracef("vhd: parent is %s, blocks start at %#x", w.parent.path, w.next)
+
+}
+
+// Write implements io.Writer.
+func (w *DifferencingWriter) Write(p []byte) (int, error) {
+
+	if w.cursor+int64(len(p)) > w.size {
+		return 0, errors.New("vhd differencing writer received more raw image data than was expected")
+	}
+
+	var n int
+	for len(p) > 0 {
+		k := copy(w.buf[w.cursor%chunkSize:], p)
+		w.cursor += int64(k)
+		n += k
+		p = p[k:]
+
+		if w.cursor%chunkSize == 0 || w.cursor == w.size {
+			err := w.flush()
+			if err != nil {
+				return n, err
+			}
+		}
+	}
+
+	return n, nil
+
+}
+
+// Seek implements io.Seeker. It can only seek forwards. Every block skipped
+// over is still compared with the parent, since the parent may have data
+// where the image has none.
+func (w *DifferencingWriter) Seek(offset int64, whence int) (int64, error) {
+
+	var abs int64
+	switch whence {
+	case io.SeekStart:
+		abs = offset
+	case io.SeekCurrent:
+		abs = w.cursor + offset
+	case io.SeekEnd:
+		abs = w.size + offset
+	default:
+		panic("bad seek whence")
+	}
+
+	if abs < w.cursor {
+		return w.cursor, errors.New("vhd differencing writer cannot seek backwards")
+	}
+
+	if abs > w.size {
+		return w.cursor, errors.New("vhd differencing writer cannot seek beyond the end of the disk")
+	}
+
+	err := w.skipTo(abs)
+	if err != nil {
+		return w.cursor, err
+	}
+
+	return w.cursor, nil
+
+}
+
+func (w *DifferencingWriter) skipTo(abs int64) error {
+
+	for w.cursor < abs {
+		end := (w.cursor/chunkSize + 1) * chunkSize
+		if end > w.size {
+			end = w.size
+		}
+
+		if abs < end {
+			w.cursor = abs
+			break
+		}
+
+		w.cursor = end
+		err := w.flush()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+
+}
+
+// Close compares the rest of the image with the parent, then writes the
+// footer and the BAT, and closes the parent.
+func (w *DifferencingWriter) Close() error {
+
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	defer w.parent.Close()
+
+	err := w.skipTo(w.size)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.w.Seek(w.next, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.w.Write(w.footer)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.w.Seek(w.batAt, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.w.Write(w.bat)
+	if err != nil {
+		return err
+	}
+
+	if w.log != nil {
+		traceBAT(w.log, w.bat, int64(w.header.MaxTableEntries))
+	}
+
+	_, err = w.w.Seek(w.next+512, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	return nil
+
+}
+
+// geometry returns the CHS geometry the VHD spec derives from the disk size.
+func geometry(size int64) uint32 {
+
+	var cylinders, heads, sectorsPerTrack int64
+	var cylinderTimesHeads int64
+
+	totalSectors := size / 512
+	if totalSectors > 65535*16*255 {
+		totalSectors = 65535 * 16 * 255
+	}
+
+	if totalSectors >= 65525*16*63 {
+		sectorsPerTrack = 255
+		heads = 16
+		cylinderTimesHeads = totalSectors / sectorsPerTrack
+	} else {
+		sectorsPerTrack = 17
+		cylinderTimesHeads = totalSectors / sectorsPerTrack
+		heads = (cylinderTimesHeads + 1023) / 1024
+		if heads < 4 {
+			heads = 4
+		}
+		if cylinderTimesHeads >= (heads*1024) || heads > 16 {
+			sectorsPerTrack = 31
+			heads = 16
+			cylinderTimesHeads = totalSectors / sectorsPerTrack
+		}
+		if cylinderTimesHeads >= heads*1024 {
+			sectorsPerTrack = 63
+			heads = 16
+			cylinderTimesHeads = totalSectors / sectorsPerTrack
+		}
+	}
+	cylinders = cylinderTimesHeads / heads
+
+	return uint32(cylinders<<16 | heads<<8 | sectorsPerTrack)
+
+}
+
+// checksum returns the one's complement of the sum of the bytes of a header
+// or footer marshalled with a zero checksum.
+func checksum(data []byte) uint32 {
+	var sum uint32
+	for _, x := range data {
+		sum += uint32(x)
+	}
+	return ^sum
+}
+
+func windowsPath(path string) string {
+	return strings.Replace(path, "/", "\\", -1)
+}
+
+func utf16LE(s string) []byte {
+	u := utf16.Encode([]rune(s))
+	b := make([]byte, 2*len(u))
+	for i, x := range u {
+		binary.LittleEndian.PutUint16(b[2*i:], x)
+	}
+	return b
+}
+
+func utf16BE(s string) []byte {
+	u := utf16.Encode([]rune(s))
+	b := make([]byte, 2*len(u))
+	for i, x := range u {
+		binary.BigEndian.PutUint16(b[2*i:], x)
+	}
+	return b
+}
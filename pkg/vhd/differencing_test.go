@@ -0,0 +1,196 @@
+package vhd
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDifferencingWriter(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "vhd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	length := int64(3 * chunkSize)
+	base := bytes.Repeat([]byte{0xAB}, int(length))
+
+	pf, err := os.Create(filepath.Join(dir, "base.vhd"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pf.Close()
+
+	pw, err := NewDynamicWriter(pf, testImage(length))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = pw.Write(base)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = pw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// block 0 is unchanged, one sector of block 1 changes, and block 2 is
+	// skipped so it becomes zeroes
+	child := make([]byte, length)
+	copy(child, base[:2*chunkSize])
+	child[chunkSize+1024] = 0xCD
+
+	f, err := os.Create(filepath.Join(dir, "child.vhd"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	w, err := NewDifferencingWriter(f, testImage(length), pf.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = w.Write(child[:2*chunkSize])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = w.Seek(0, io.SeekEnd)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = w.Seek(0, io.SeekStart)
+	if err == nil {
+		t.Errorf("vhd differencing writer seeked backwards")
+	}
+
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parent, err := OpenParent(pf.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer parent.Close()
+
+	data := make([]byte, length)
+	_, err = parent.ReadAt(data, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(data, base) {
+		t.Errorf("parent vhd contents differ from the raw image")
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ftr := new(footer)
+	err = binary.Read(io.NewSectionReader(f, info.Size()-512, 512), binary.BigEndian, ftr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ftr.DiskType != diskTypeDifferencing || ftr.CurrentSize != uint64(length) || ftr.UniqueID == [16]byte{} {
+		t.Errorf("bad differencing vhd footer: %+v", ftr)
+	}
+
+	hdr := new(header)
+	err = binary.Read(io.NewSectionReader(f, 512, 1024), binary.BigEndian, hdr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if hdr.ParentUniqueID != parent.footer.UniqueID || hdr.ParentUniqueID == [16]byte{} {
+		t.Errorf("differencing vhd doesn't identify its parent")
+	}
+
+	if !bytes.HasPrefix(hdr.ParentUnicodeName[:], utf16BE("base.vhd")) {
+		t.Errorf("bad parent name in differencing vhd header")
+	}
+
+	loc := new(parentLocator)
+	err = binary.Read(bytes.NewReader(hdr.ParentLocatorEntry1[:]), binary.BigEndian, loc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	relative := make([]byte, loc.PlatformDataLength)
+	_, err = f.ReadAt(relative, int64(loc.PlatformDataOffset))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if loc.PlatformCode != platformW2ru || !bytes.Equal(relative, utf16LE(".\\base.vhd")) {
+		t.Errorf("bad relative parent locator")
+	}
+
+	bat := make([]uint32, hdr.MaxTableEntries)
+	err = binary.Read(io.NewSectionReader(f, int64(hdr.TableOffset), 4*int64(len(bat))), binary.BigEndian, bat)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(bat) != 3 || bat[0] != unusedBATEntry || bat[1] == unusedBATEntry || bat[2] == unusedBATEntry {
+		t.Fatalf("wrong blocks in differencing vhd: %x", bat)
+	}
+
+	for i := 1; i < 3; i++ {
+		block := make([]byte, 512+chunkSize)
+		_, err = f.ReadAt(block, int64(bat[i])*512)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		bitmap := make([]byte, 512)
+		if i == 1 {
+			bitmap[0] = 0x20 // only the third sector differs
+		} else {
+			for j := 0; j < chunkSize/512/8; j++ {
+				bitmap[j] = 0xFF
+			}
+		}
+
+		if !bytes.Equal(block[:512], bitmap) {
+			t.Errorf("bad sector bitmap for block %d", i)
+		}
+
+		if !bytes.Equal(block[512:], child[i*chunkSize:(i+1)*chunkSize]) {
+			t.Errorf("block %d has the wrong data", i)
+		}
+	}
+
+	_, err = NewDifferencingWriter(new(seekBuffer), testImage(chunkSize), pf.Name())
+	if err == nil {
+		t.Errorf("differencing vhd accepted a parent of a different size")
+	}
+
+}
+
+type seekBuffer struct {
+	bytes.Buffer
+}
+
+func (b *seekBuffer) Seek(offset int64, whence int) (int64, error) {
+	return 0, nil
+}
@@ -7,10 +7,13 @@ package vhd
 
 import (
 	"bytes"
+	"crypto/rand"
 	"encoding/binary"
 	"errors"
 	"io"
 	"time"
+
+	"github.com/vorteil/vorteil/pkg/elog"
 )
 
 const chunkSize = 0x200000
@@ -23,6 +26,8 @@ type DynamicWriter struct {
 	cursor        int64
 	chunkOffsets  []int64
 	flushedChunks int64
+	bat           []byte
+	log           elog.Logger
 }
 
 func NewDynamicWriter(w io.WriteSeeker, h HolePredictor) (*DynamicWriter, error) {
@@ -102,11 +107,16 @@ func (w *DynamicWriter) writeRedundantFooter() error {
 		CurrentSize:        uint64(w.h.Size()),
 		DiskGeometry:       uint32(cylinders<<16 | heads<<8 | sectorsPerTrack),
 		DiskType:           3,
-		// TODO: UniqueID
+	}
+
+	// differencing disks identify their parent by its unique ID
+	_, err := rand.Read(footer.UniqueID[:])
+	if err != nil {
+		return err
 	}
 
 	buf := new(bytes.Buffer)
-	err := binary.Write(buf, binary.BigEndian, footer)
+	err = binary.Write(buf, binary.BigEndian, footer)
 	if err != nil {
 		return err
 	}
@@ -210,9 +220,27 @@ func (w *DynamicWriter) writeBAT() error {
 		return err
 	}
 
+	w.bat = bat
+
 	return nil
 }
 
+// SetLogger sets the logger the DynamicWriter traces the metadata it writes
+// to. Everything but the blocks themselves is written when the DynamicWriter
+// is created, so it's traced right away.
+func (w *DynamicWriter) SetLogger(log elog.Logger) {
+
+	w.log = log
+	if log == nil {
+		return
+	}
+
+	traceFooter(log, w.footer.Bytes())
+	traceHeader(log, w.header)
+	traceBAT(log, w.bat, int64(w.header.MaxTableEntries))
+
+}
+
 func (w *DynamicWriter) Write(p []byte) (n int, err error) {
 
 	chunk := w.cursor / chunkSize
@@ -7,11 +7,13 @@ package vhd
 
 import (
 	"bytes"
+	"crypto/rand"
 	"encoding/binary"
 	"errors"
 	"io"
 	"time"
 
+	"github.com/vorteil/vorteil/pkg/elog"
 	"github.com/vorteil/vorteil/pkg/vio"
 )
 
@@ -20,19 +22,51 @@ type HolePredictor interface {
 	RegionIsHole(begin, size int64) bool
 }
 
+// AzureAlignment is the multiple Azure requires the virtual size of a VHD to
+// be.
+const AzureAlignment = 0x100000
+
 type FixedWriter struct {
-	w      io.WriteSeeker
-	cursor int64
-	length int64
+	w        io.WriteSeeker
+	cursor   int64
+	length   int64
+	size     int64
+	uniqueID [16]byte
+	log      elog.Logger
 }
 
 func NewFixedWriter(w io.WriteSeeker, h HolePredictor) (*FixedWriter, error) {
 	return &FixedWriter{
 		w:      w,
 		length: h.Size(),
+		size:   h.Size(),
 	}, nil
 }
 
+// NewAzureWriter returns a fixed VHD writer for images destined for Azure.
+// Azure rejects disks that aren't a whole number of MiB, so the raw image is
+// padded with zeros up to the next MiB boundary before the footer is written.
+// Azure also expects every disk to carry a unique ID.
+func NewAzureWriter(w io.WriteSeeker, h HolePredictor) (*FixedWriter, error) {
+
+	length := h.Size()
+	size := (length + AzureAlignment - 1) / AzureAlignment * AzureAlignment
+
+	fw := &FixedWriter{
+		w:      w,
+		length: length,
+		size:   size,
+	}
+
+	_, err := rand.Read(fw.uniqueID[:])
+	if err != nil {
+		return nil, err
+	}
+
+	return fw, nil
+
+}
+
 func (w *FixedWriter) Write(p []byte) (n int, err error) {
 	n, err = w.w.Write(p)
 	w.cursor += int64(n)
@@ -57,6 +91,14 @@ func (w *FixedWriter) writeFooter() error {
 		return errors.New("vhd fixed image writer expected more raw image data than was received")
 	}
 
+	if w.cursor < w.size {
+		_, err = io.CopyN(w.w, vio.Zeroes, w.size-w.cursor)
+		if err != nil {
+			return err
+		}
+		w.cursor = w.size
+	}
+
 	conectix := uint64(0x636F6E6563746978)
 	timestamp := time.Now().Unix() - 946684800 // 2000 offset
 
@@ -64,7 +106,7 @@ func (w *FixedWriter) writeFooter() error {
 	var cylinders, heads, sectorsPerTrack int64
 	var cylinderTimesHeads int64
 
-	totalSectors := w.length / 512
+	totalSectors := w.size / 512
 	if totalSectors > 65535*16*255 {
 		totalSectors = 65535 * 16 * 255
 	}
@@ -103,11 +145,11 @@ func (w *FixedWriter) writeFooter() error {
 		CreatorApplication: 0x76636C69,
 		CreatorVersion:     0x00010000, // TODO: does this matter?
 		CreatorHostOS:      0x5769326B, // TODO: does this matter?
-		OriginalSize:       uint64(w.length),
-		CurrentSize:        uint64(w.length),
+		OriginalSize:       uint64(w.size),
+		CurrentSize:        uint64(w.size),
 		DiskGeometry:       uint32(cylinders<<16 | heads<<8 | sectorsPerTrack),
 		DiskType:           2, // fixed vhd
-		// TODO: UniqueID
+		UniqueID:           w.uniqueID,
 	}
 
 	buf := new(bytes.Buffer)
@@ -135,6 +177,13 @@ func (w *FixedWriter) writeFooter() error {
 		return err
 	}
 
+	if w.log != nil {
+		if w.size != w.length {
+			w.log.Tracef("vhd: padded %d byte image to %d bytes", w.length, w.size)
+		}
+		traceFooter(w.log, fbuf.Bytes())
+	}
+
 	_, err = io.Copy(w.w, bytes.NewReader(fbuf.Bytes()))
 	if err != nil {
 		return err
@@ -143,6 +192,12 @@ func (w *FixedWriter) writeFooter() error {
 	return nil
 }
 
+// SetLogger sets the logger the FixedWriter traces the footer it writes to
+// when it's closed.
+func (w *FixedWriter) SetLogger(log elog.Logger) {
+	w.log = log
+}
+
 func (w *FixedWriter) Close() error {
 
 	err := w.writeFooter()
@@ -0,0 +1,100 @@
+package vhd
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+type testImage int64
+
+func (img testImage) Size() int64 {
+	return int64(img)
+}
+
+func (img testImage) RegionIsHole(begin, size int64) bool {
+	return false
+}
+
+func TestAzureWriter(t *testing.T) {
+
+	length := int64(AzureAlignment + 0x1000)
+	data := bytes.Repeat([]byte{0xAB}, int(length))
+
+	f, err := ioutil.TempFile("", "vhd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	w, err := NewAzureWriter(f, testImage(length))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = w.Write(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if info.Size() != 2*AzureAlignment+512 {
+		t.Fatalf("unexpected azure vhd size: %d", info.Size())
+	}
+
+	raw := make([]byte, 2*AzureAlignment)
+	_, err = f.ReadAt(raw, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(raw[:length], data) || bytes.Count(raw[length:], []byte{0}) != len(raw)-int(length) {
+		t.Errorf("azure vhd contents differ from the padded raw image")
+	}
+
+	buf := make([]byte, 512)
+	_, err = f.ReadAt(buf, 2*AzureAlignment)
+	if err != nil && err != io.EOF {
+		t.Fatal(err)
+	}
+
+	ftr := new(footer)
+	err = binary.Read(bytes.NewReader(buf), binary.BigEndian, ftr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ftr.Cookie != 0x636F6E6563746978 || ftr.DiskType != 2 || ftr.CurrentSize != 2*AzureAlignment || ftr.UniqueID == [16]byte{} {
+		t.Errorf("bad azure vhd footer: %+v", ftr)
+	}
+
+	var checksum uint32
+	for i, x := range buf {
+		if i < 64 || i >= 68 {
+			checksum += uint32(x)
+		}
+	}
+
+	if ^checksum != ftr.Checksum {
+		t.Errorf("bad azure vhd footer checksum")
+	}
+
+}
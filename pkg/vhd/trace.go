@@ -0,0 +1,98 @@
+package vhd
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/vorteil/vorteil/pkg/elog"
+)
+
+// Hypervisors are fussy about VHDs in ways that are hard to see without
+// taking the image apart: Hyper-V and Azure check the geometry and checksums
+// in the footer, and disagreements about the BAT show up as blocks that read
+// back as zeroes. The writers trace what they put in each of those
+// structures, so that a misbehaving image can be diagnosed from the build
+// output instead of a hexdump.
+
+var diskTypes = map[uint32]string{
+	diskTypeFixed:        "fixed",
+	diskTypeDynamic:      "dynamic",
+	diskTypeDifferencing: "differencing",
+}
+
+// traceFooter logs the fields of a marshalled footer.
+func traceFooter(log elog.Logger, data []byte) {
+
+	ftr := new(footer)
+	err := binary.Read(bytes.NewReader(data), binary.BigEndian, ftr)
+	if err != nil {
+		log.Tracef("vhd footer: %v", err)
+		return
+	}
+
+	diskType, ok := diskTypes[ftr.DiskType]
+	if !ok {
+		diskType = fmt.Sprintf("%d", ftr.DiskType)
+	}
+
+	log.Tracef("vhd footer: %s disk of %d bytes, geometry %d/%d/%d (c/h/s), data offset %#x, checksum %#08x, unique ID %x",
+		diskType, ftr.CurrentSize, ftr.DiskGeometry>>16, ftr.DiskGeometry>>8&0xFF, ftr.DiskGeometry&0xFF,
+		ftr.DataOffset, ftr.Checksum, ftr.UniqueID)
+
+}
+
+// traceHeader logs the fields of a dynamic or differencing disk's header.
+func traceHeader(log elog.Logger, hdr *header) {
+
+	log.Tracef("vhd header: bat at %#x with %d entries, blocks of %d bytes, checksum %#08x",
+		hdr.TableOffset, hdr.MaxTableEntries, hdr.BlockSize, hdr.Checksum)
+
+	if hdr.ParentUniqueID != [16]byte{} {
+		log.Tracef("vhd header: parent unique ID %x", hdr.ParentUniqueID)
+	}
+
+}
+
+// traceBAT logs which blocks a BAT allocates, as runs of consecutive blocks,
+// followed by how much of the disk is allocated.
+func traceBAT(log elog.Logger, bat []byte, entries int64) {
+
+	var allocated int64
+	start := int64(-1)
+
+	run := func(end int64) {
+		if start < 0 {
+			return
+		}
+		first := binary.BigEndian.Uint32(bat[4*start:])
+		last := binary.BigEndian.Uint32(bat[4*(end-1):])
+		log.Tracef("vhd bat: blocks %d to %d at sectors %d to %d", start, end-1, first, last)
+		start = -1
+	}
+
+	for i := int64(0); i < entries; i++ {
+		if binary.BigEndian.Uint32(bat[4*i:]) == 0xFFFFFFFF {
+			run(i)
+			continue
+		}
+		if start < 0 {
+			start = i
+		}
+		allocated++
+	}
+	run(entries)
+
+	var percent float64
+	if entries > 0 {
+		percent = 100 * float64(allocated) / float64(entries)
+	}
+
+	log.Tracef("vhd bat: %d of %d blocks allocated (%.1f%%)", allocated, entries, percent)
+
+}
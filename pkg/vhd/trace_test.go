@@ -0,0 +1,77 @@
+package vhd
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/vorteil/vorteil/pkg/elog"
+)
+
+// traceLogger records trace output. Only Tracef is implemented.
+type traceLogger struct {
+	elog.Logger
+	lines []string
+}
+
+func (log *traceLogger) Tracef(format string, x ...interface{}) {
+	log.lines = append(log.lines, fmt.Sprintf(format, x...))
+}
+
+func TestDynamicWriterTrace(t *testing.T) {
+
+	f, err := ioutil.TempFile("", "vhd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	// blocks 1 and 2 are holes, so the BAT has two runs
+	img := &holeyImage{
+		size:  4 * chunkSize,
+		holes: map[int64]bool{1: true, 2: true},
+	}
+
+	w, err := NewDynamicWriter(f, img)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	log := new(traceLogger)
+	w.SetLogger(log)
+
+	out := strings.Join(log.lines, "\n")
+	for _, s := range []string{
+		"vhd footer: dynamic disk of 8388608 bytes",
+		"vhd header: bat at 0x600 with 4 entries",
+		"vhd bat: blocks 0 to 0 at sectors 4 to 4",
+		"vhd bat: blocks 3 to 3 at sectors 4101 to 4101",
+		"vhd bat: 2 of 4 blocks allocated (50.0%)",
+	} {
+		if !strings.Contains(out, s) {
+			t.Errorf("trace output is missing %q:\n%s", s, out)
+		}
+	}
+
+}
+
+type holeyImage struct {
+	size  int64
+	holes map[int64]bool
+}
+
+func (img *holeyImage) Size() int64 {
+	return img.size
+}
+
+func (img *holeyImage) RegionIsHole(begin, size int64) bool {
+	return img.holes[begin/chunkSize]
+}
@@ -0,0 +1,123 @@
+package vhdx
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"crypto/rand"
+
+	"github.com/google/uuid"
+)
+
+const (
+	KiB = 0x400
+	MiB = 0x100000
+
+	fileIdentifierSignature = 0x656C696678646876 // "vhdxfile"
+	headerSignature         = 0x64616568         // "head"
+	regionTableSignature    = 0x69676572         // "regi"
+	metadataSignature       = 0x617461646174656D // "metadata"
+
+	headerOffset1      = 64 * KiB
+	headerOffset2      = 128 * KiB
+	regionTableOffset1 = 192 * KiB
+	regionTableOffset2 = 256 * KiB
+	headerSize         = 4 * KiB
+	regionTableSize    = 64 * KiB
+	metadataTableSize  = 64 * KiB
+
+	payloadBlockNotPresent   = 0
+	payloadBlockFullyPresent = 6
+
+	metadataIsVirtualDisk = 1 << 1
+	metadataIsRequired    = 1 << 2
+)
+
+var (
+	batRegionGUID      = guid("2DC27766-F623-4200-9D64-115E9BFD4A08")
+	metadataRegionGUID = guid("8B7CA206-4790-4B9A-B8FE-575F050F886E")
+
+	fileParametersGUID     = guid("CAA16737-FA36-4D43-B3B6-33F0AA44E76B")
+	virtualDiskSizeGUID    = guid("2FA54224-CD1B-4876-B211-5DBED83BF4B8")
+	virtualDiskIDGUID      = guid("BECA12AB-B2E6-4523-93EF-C309E000C746")
+	logicalSectorSizeGUID  = guid("8141BF1D-A96F-4709-BA47-F233A8FAAB5F")
+	physicalSectorSizeGUID = guid("CDA348C7-445D-4471-9CC9-E9885251C556")
+)
+
+// guid converts a GUID string into the mixed-endian form used on disk.
+func guid(s string) [16]byte {
+	u := uuid.MustParse(s)
+	var g [16]byte
+	copy(g[:], u[:])
+	g[0], g[1], g[2], g[3] = u[3], u[2], u[1], u[0]
+	g[4], g[5] = u[5], u[4]
+	g[6], g[7] = u[7], u[6]
+	return g
+}
+
+func generateGUID() ([16]byte, error) {
+	var g [16]byte
+	_, err := rand.Read(g[:])
+	if err != nil {
+		return g, err
+	}
+	g[7] = (g[7] & 0x0f) | 0x40 // version 4
+	g[8] = (g[8] & 0x3f) | 0x80 // variant
+	return g, nil
+}
+
+type fileIdentifier struct { // 64 KiB
+	Signature uint64
+	Creator   [256]uint16
+	Reserved  [65016]byte
+}
+
+type header struct { // 4 KiB
+	Signature      uint32
+	Checksum       uint32
+	SequenceNumber uint64
+	FileWriteGUID  [16]byte
+	DataWriteGUID  [16]byte
+	LogGUID        [16]byte
+	LogVersion     uint16
+	Version        uint16
+	LogLength      uint32
+	LogOffset      uint64
+	Reserved       [4016]byte
+}
+
+type regionTableHeader struct { // 16 bytes
+	Signature  uint32
+	Checksum   uint32
+	EntryCount uint32
+	Reserved   uint32
+}
+
+type regionTableEntry struct { // 32 bytes
+	GUID       [16]byte
+	FileOffset uint64
+	Length     uint32
+	Required   uint32
+}
+
+type metadataTableHeader struct { // 32 bytes
+	Signature  uint64
+	Reserved   uint16
+	EntryCount uint16
+	Reserved2  [20]byte
+}
+
+type metadataTableEntry struct { // 32 bytes
+	ItemID   [16]byte
+	Offset   uint32
+	Length   uint32
+	Flags    uint32
+	Reserved uint32
+}
+
+type fileParameters struct {
+	BlockSize uint32
+	Flags     uint32
+}
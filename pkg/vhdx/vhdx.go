@@ -0,0 +1,532 @@
+package vhdx
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"unicode/utf16"
+
+	"github.com/vorteil/vorteil/pkg/elog"
+	"github.com/vorteil/vorteil/pkg/vio"
+)
+
+type HolePredictor interface {
+	Size() int64
+	RegionIsHole(begin, size int64) bool
+}
+
+// Options contains optional settings for a DynamicWriter. Zero values are
+// replaced by defaults.
+type Options struct {
+	// BlockSize is the size of each payload block. It must be a power of two
+	// between 1 MiB and 256 MiB. Defaults to 2 MiB.
+	BlockSize int64
+
+	// LogicalSectorSize is the sector size reported to the guest, either 512
+	// or 4096 bytes. It must match the sector size the raw image was laid out
+	// for. Defaults to 512.
+	LogicalSectorSize int64
+
+	// PhysicalSectorSize is either 512 or 4096 bytes. Defaults to 4096.
+	PhysicalSectorSize int64
+}
+
+// DynamicWriter converts a raw disk image into a dynamically allocated VHDX
+// image as it is written. All metadata is calculated up front using the
+// HolePredictor, and payload blocks predicted to be holes are left out of the
+// image entirely.
+type DynamicWriter struct {
+	w    io.WriteSeeker
+	h    HolePredictor
+	opts Options
+
+	cursor      int64
+	seekPending bool
+	hostEnd     int64
+
+	chunkRatio    int64
+	payloadBlocks int64
+	blockOffsets  []int64
+	fileSize      int64
+
+	bat            []uint64
+	batOffset      int64
+	metadataOffset int64
+	logOffset      int64
+	log            elog.Logger
+}
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+// NewDynamicWriter returns a DynamicWriter to which a RAW image can be copied
+// in order to create a VHDX image.
+func NewDynamicWriter(w io.WriteSeeker, h HolePredictor, opts *Options) (*DynamicWriter, error) {
+
+	dw := &DynamicWriter{
+		w: w,
+		h: h,
+	}
+
+	if opts != nil {
+		dw.opts = *opts
+	}
+
+	err := dw.init()
+	if err != nil {
+		return nil, err
+	}
+
+	return dw, nil
+
+}
+
+func divide(x, y int64) int64 {
+	return (x + y - 1) / y
+}
+
+func align(x, y int64) int64 {
+	return divide(x, y) * y
+}
+
+func (w *DynamicWriter) init() error {
+
+	if w.opts.BlockSize == 0 {
+		w.opts.BlockSize = 2 * MiB
+	}
+	if w.opts.LogicalSectorSize == 0 {
+		w.opts.LogicalSectorSize = 512
+	}
+	if w.opts.PhysicalSectorSize == 0 {
+		w.opts.PhysicalSectorSize = 4096
+	}
+
+	bs := w.opts.BlockSize
+	if bs < MiB || bs > 256*MiB || bs&(bs-1) != 0 {
+		return fmt.Errorf("invalid vhdx block size %d: must be a power of two between 1 MiB and 256 MiB", bs)
+	}
+
+	for _, x := range []int64{w.opts.LogicalSectorSize, w.opts.PhysicalSectorSize} {
+		if x != 512 && x != 4096 {
+			return fmt.Errorf("invalid vhdx sector size %d: must be 512 or 4096", x)
+		}
+	}
+
+	if w.h.Size()%w.opts.LogicalSectorSize != 0 {
+		return fmt.Errorf("vhdx disk size must be a multiple of the logical sector size (%d)", w.opts.LogicalSectorSize)
+	}
+
+	// NOTE: each sector bitmap block describes 2^23 sectors, so the number of
+	// payload blocks between sector bitmap entries in the BAT depends on the
+	// logical sector size.
+	w.chunkRatio = (1 << 23) * w.opts.LogicalSectorSize / bs
+	w.payloadBlocks = divide(w.h.Size(), bs)
+
+	batEntries := w.payloadBlocks
+	if w.payloadBlocks > 0 {
+		batEntries += (w.payloadBlocks - 1) / w.chunkRatio
+	}
+
+	logOffset := int64(1 * MiB)
+	logLength := int64(1 * MiB)
+	metadataOffset := logOffset + logLength
+	metadataLength := int64(1 * MiB)
+	batOffset := metadataOffset + metadataLength
+	batLength := align(batEntries*8, MiB)
+	dataOffset := batOffset + batLength
+
+	bat := make([]uint64, batEntries)
+	w.blockOffsets = make([]int64, w.payloadBlocks)
+	offset := dataOffset
+	for block := int64(0); block < w.payloadBlocks; block++ {
+		if w.h.RegionIsHole(block*bs, bs) {
+			continue
+		}
+		w.blockOffsets[block] = offset
+		bat[block+block/w.chunkRatio] = uint64(offset/MiB)<<20 | payloadBlockFullyPresent
+		offset += bs
+	}
+	w.fileSize = offset
+
+	err := w.writeFileIdentifier()
+	if err != nil {
+		return err
+	}
+
+	err = w.writeHeaders(logOffset, logLength)
+	if err != nil {
+		return err
+	}
+
+	err = w.writeRegionTables(batOffset, batLength, metadataOffset, metadataLength)
+	if err != nil {
+		return err
+	}
+
+	err = w.writeMetadata(metadataOffset)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.w.Seek(batOffset, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	err = binary.Write(w.w, binary.LittleEndian, bat)
+	if err != nil {
+		return err
+	}
+
+	w.hostEnd = batOffset + int64(len(bat))*8
+	w.seekPending = true
+
+	w.bat = bat
+	w.batOffset = batOffset
+	w.metadataOffset = metadataOffset
+	w.logOffset = logOffset
+
+	return nil
+
+}
+
+func (w *DynamicWriter) writeAt(offset int64, data interface{}) error {
+
+	_, err := w.w.Seek(offset, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	return binary.Write(w.w, binary.LittleEndian, data)
+
+}
+
+// checksum writes x to a buffer of the given size, calculates the CRC-32C of
+// the buffer and stores it at offset 4, where every checksummed VHDX
+// structure keeps it.
+func checksum(size int, x ...interface{}) ([]byte, error) {
+
+	buf := new(bytes.Buffer)
+	for _, v := range x {
+		err := binary.Write(buf, binary.LittleEndian, v)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if buf.Len() > size {
+		return nil, errors.New("vhdx structure is too large")
+	}
+
+	data := make([]byte, size)
+	copy(data, buf.Bytes())
+	binary.LittleEndian.PutUint32(data[4:], crc32.Checksum(data, crc32c))
+
+	return data, nil
+
+}
+
+func (w *DynamicWriter) writeFileIdentifier() error {
+
+	fid := &fileIdentifier{
+		Signature: fileIdentifierSignature,
+	}
+	copy(fid.Creator[:], utf16.Encode([]rune("vorteil")))
+
+	return w.writeAt(0, fid)
+
+}
+
+func (w *DynamicWriter) writeHeaders(logOffset, logLength int64) error {
+
+	fileWriteGUID, err := generateGUID()
+	if err != nil {
+		return err
+	}
+
+	dataWriteGUID, err := generateGUID()
+	if err != nil {
+		return err
+	}
+
+	// NOTE: the header with the greater sequence number is current, but both
+	// are written identically so that either is valid.
+	for i, offset := range []int64{headerOffset1, headerOffset2} {
+		hdr := &header{
+			Signature:      headerSignature,
+			SequenceNumber: uint64(i),
+			FileWriteGUID:  fileWriteGUID,
+			DataWriteGUID:  dataWriteGUID,
+			Version:        1,
+			LogLength:      uint32(logLength),
+			LogOffset:      uint64(logOffset),
+		}
+
+		data, err := checksum(headerSize, hdr)
+		if err != nil {
+			return err
+		}
+
+		err = w.writeAt(offset, data)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+
+}
+
+func (w *DynamicWriter) writeRegionTables(batOffset, batLength, metadataOffset, metadataLength int64) error {
+
+	hdr := &regionTableHeader{
+		Signature:  regionTableSignature,
+		EntryCount: 2,
+	}
+
+	entries := []regionTableEntry{
+		{
+			GUID:       batRegionGUID,
+			FileOffset: uint64(batOffset),
+			Length:     uint32(batLength),
+			Required:   1,
+		},
+		{
+			GUID:       metadataRegionGUID,
+			FileOffset: uint64(metadataOffset),
+			Length:     uint32(metadataLength),
+			Required:   1,
+		},
+	}
+
+	data, err := checksum(regionTableSize, hdr, entries)
+	if err != nil {
+		return err
+	}
+
+	for _, offset := range []int64{regionTableOffset1, regionTableOffset2} {
+		err = w.writeAt(offset, data)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+
+}
+
+func (w *DynamicWriter) writeMetadata(metadataOffset int64) error {
+
+	diskID, err := generateGUID()
+	if err != nil {
+		return err
+	}
+
+	items := []struct {
+		id    [16]byte
+		flags uint32
+		value interface{}
+	}{
+		{fileParametersGUID, metadataIsRequired, &fileParameters{BlockSize: uint32(w.opts.BlockSize)}},
+		{virtualDiskSizeGUID, metadataIsVirtualDisk | metadataIsRequired, uint64(w.h.Size())},
+		{virtualDiskIDGUID, metadataIsVirtualDisk | metadataIsRequired, diskID},
+		{logicalSectorSizeGUID, metadataIsVirtualDisk | metadataIsRequired, uint32(w.opts.LogicalSectorSize)},
+		{physicalSectorSizeGUID, metadataIsVirtualDisk | metadataIsRequired, uint32(w.opts.PhysicalSectorSize)},
+	}
+
+	table := new(bytes.Buffer)
+	values := new(bytes.Buffer)
+
+	err = binary.Write(table, binary.LittleEndian, &metadataTableHeader{
+		Signature:  metadataSignature,
+		EntryCount: uint16(len(items)),
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, item := range items {
+		offset := metadataTableSize + values.Len()
+		err = binary.Write(values, binary.LittleEndian, item.value)
+		if err != nil {
+			return err
+		}
+
+		err = binary.Write(table, binary.LittleEndian, &metadataTableEntry{
+			ItemID: item.id,
+			Offset: uint32(offset),
+			Length: uint32(metadataTableSize + values.Len() - offset),
+			Flags:  item.flags,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	err = w.writeAt(metadataOffset, table.Bytes())
+	if err != nil {
+		return err
+	}
+
+	return w.writeAt(metadataOffset+metadataTableSize, values.Bytes())
+
+}
+
+func isZeroes(p []byte) bool {
+	for _, b := range p {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// SetLogger sets the logger the DynamicWriter traces the metadata it writes
+// to. Everything but the payload blocks themselves is written when the
+// DynamicWriter is created, so it's traced right away.
+func (w *DynamicWriter) SetLogger(log elog.Logger) {
+
+	w.log = log
+	if log == nil {
+		return
+	}
+
+	log.Tracef("vhdx: virtual size %d bytes, %d byte blocks, %d byte logical sectors, %d byte physical sectors, chunk ratio %d",
+		w.h.Size(), w.opts.BlockSize, w.opts.LogicalSectorSize, w.opts.PhysicalSectorSize, w.chunkRatio)
+	log.Tracef("vhdx regions: log at %#x, metadata at %#x, bat at %#x with %d entries",
+		w.logOffset, w.metadataOffset, w.batOffset, len(w.bat))
+
+	var allocated int64
+	start := int64(-1)
+
+	run := func(end int64) {
+		if start < 0 {
+			return
+		}
+		log.Tracef("vhdx bat: payload blocks %d to %d at %#x to %#x", start, end-1, w.blockOffsets[start], w.blockOffsets[end-1])
+		start = -1
+	}
+
+	for block := int64(0); block < w.payloadBlocks; block++ {
+		if w.blockOffsets[block] == 0 {
+			run(block)
+			continue
+		}
+		if start < 0 {
+			start = block
+		}
+		allocated++
+	}
+	run(w.payloadBlocks)
+
+	log.Tracef("vhdx bat: %d of %d payload blocks allocated, file ends at %#x", allocated, w.payloadBlocks, w.fileSize)
+
+}
+
+// Write splits p along block boundaries, writing data destined for allocated
+// blocks and discarding data destined for holes. Because holes aren't stored
+// in the image, writing anything other than zeroes into one is an error.
+func (w *DynamicWriter) Write(p []byte) (int, error) {
+
+	var n int
+	bs := w.opts.BlockSize
+
+	for len(p) > 0 {
+
+		block := w.cursor / bs
+		delta := w.cursor % bs
+		if w.cursor >= w.h.Size() {
+			return n, errors.New("vhdx writer received more raw image data than expected")
+		}
+
+		chunk := p
+		if int64(len(chunk)) > bs-delta {
+			chunk = chunk[:bs-delta]
+		}
+
+		if w.blockOffsets[block] != 0 {
+			if w.seekPending {
+				_, err := w.w.Seek(w.blockOffsets[block]+delta, io.SeekStart)
+				if err != nil {
+					return n, err
+				}
+				w.seekPending = false
+			}
+
+			k, err := w.w.Write(chunk)
+			n += k
+			w.cursor += int64(k)
+			if end := w.blockOffsets[block] + delta + int64(k); end > w.hostEnd {
+				w.hostEnd = end
+			}
+			if err != nil {
+				return n, err
+			}
+		} else {
+			if !isZeroes(chunk) {
+				return n, errors.New("vhdx writer received data for a region predicted to be empty")
+			}
+
+			n += len(chunk)
+			w.cursor += int64(len(chunk))
+			w.seekPending = true
+		}
+
+		p = p[len(chunk):]
+
+	}
+
+	return n, nil
+
+}
+
+// Seek implements io.Seeker.
+func (w *DynamicWriter) Seek(offset int64, whence int) (int64, error) {
+
+	var abs int64
+	switch whence {
+	case io.SeekStart:
+		abs = offset
+	case io.SeekCurrent:
+		abs = w.cursor + offset
+	case io.SeekEnd:
+		abs = w.h.Size() + offset
+	default:
+		panic("bad seek whence")
+	}
+
+	w.cursor = abs
+	w.seekPending = true
+
+	return abs, nil
+
+}
+
+// Close pads the final payload block so that the file contains every
+// allocated block in full.
+func (w *DynamicWriter) Close() error {
+
+	if w.hostEnd >= w.fileSize {
+		return nil
+	}
+
+	_, err := w.w.Seek(w.hostEnd, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.CopyN(w.w, vio.Zeroes, w.fileSize-w.hostEnd)
+	if err != nil {
+		return err
+	}
+
+	return nil
+
+}
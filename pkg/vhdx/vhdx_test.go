@@ -0,0 +1,224 @@
+package vhdx
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+type testImage struct {
+	data  []byte
+	holes map[int64]bool // keyed by block
+}
+
+func (img *testImage) Size() int64 {
+	return int64(len(img.data))
+}
+
+func (img *testImage) RegionIsHole(begin, size int64) bool {
+	for b := begin / MiB; b <= (begin+size-1)/MiB; b++ {
+		if !img.holes[b] {
+			return false
+		}
+	}
+	return true
+}
+
+func readStruct(t *testing.T, f io.ReaderAt, offset int64, x interface{}) {
+	err := binary.Read(io.NewSectionReader(f, offset, int64(binary.Size(x))), binary.LittleEndian, x)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func checkCRC(t *testing.T, f io.ReaderAt, offset, size int64) {
+	data := make([]byte, size)
+	_, err := f.ReadAt(data, offset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := binary.LittleEndian.Uint32(data[4:])
+	binary.LittleEndian.PutUint32(data[4:], 0)
+	if crc32.Checksum(data, crc32c) != expect {
+		t.Errorf("bad checksum for structure at offset %#x", offset)
+	}
+}
+
+// readVirtual resolves the contents of a VHDX image using its region table,
+// metadata and BAT.
+func readVirtual(t *testing.T, f io.ReaderAt) []byte {
+
+	fid := new(fileIdentifier)
+	readStruct(t, f, 0, fid)
+	if fid.Signature != fileIdentifierSignature {
+		t.Fatalf("bad file identifier")
+	}
+
+	for _, offset := range []int64{headerOffset1, headerOffset2} {
+		hdr := new(header)
+		readStruct(t, f, offset, hdr)
+		if hdr.Signature != headerSignature || hdr.Version != 1 {
+			t.Fatalf("bad header: %+v", hdr)
+		}
+		checkCRC(t, f, offset, headerSize)
+	}
+
+	checkCRC(t, f, regionTableOffset1, regionTableSize)
+	rt := new(regionTableHeader)
+	readStruct(t, f, regionTableOffset1, rt)
+	entries := make([]regionTableEntry, rt.EntryCount)
+	readStruct(t, f, regionTableOffset1+16, entries)
+
+	var batOffset, metadataOffset int64
+	for _, e := range entries {
+		switch e.GUID {
+		case batRegionGUID:
+			batOffset = int64(e.FileOffset)
+		case metadataRegionGUID:
+			metadataOffset = int64(e.FileOffset)
+		}
+	}
+
+	mt := new(metadataTableHeader)
+	readStruct(t, f, metadataOffset, mt)
+	if mt.Signature != metadataSignature {
+		t.Fatalf("bad metadata table")
+	}
+	items := make([]metadataTableEntry, mt.EntryCount)
+	readStruct(t, f, metadataOffset+32, items)
+
+	var size uint64
+	var sectorSize uint32
+	params := new(fileParameters)
+	for _, item := range items {
+		switch item.ItemID {
+		case fileParametersGUID:
+			readStruct(t, f, metadataOffset+int64(item.Offset), params)
+		case virtualDiskSizeGUID:
+			readStruct(t, f, metadataOffset+int64(item.Offset), &size)
+		case logicalSectorSizeGUID:
+			readStruct(t, f, metadataOffset+int64(item.Offset), &sectorSize)
+		}
+	}
+
+	bs := int64(params.BlockSize)
+	chunkRatio := (1 << 23) * int64(sectorSize) / bs
+
+	out := make([]byte, size)
+	for block := int64(0); block*bs < int64(size); block++ {
+		var entry uint64
+		readStruct(t, f, batOffset+8*(block+block/chunkRatio), &entry)
+		if entry&7 != payloadBlockFullyPresent {
+			continue
+		}
+
+		end := (block + 1) * bs
+		if end > int64(size) {
+			end = int64(size)
+		}
+
+		_, err := f.ReadAt(out[block*bs:end], int64(entry>>20)*MiB)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return out
+
+}
+
+func TestDynamicWriter(t *testing.T) {
+
+	img := &testImage{
+		data:  make([]byte, MiB*24),
+		holes: map[int64]bool{0: true, 4: true, 5: true, 6: true, 11: true, 23: true},
+	}
+
+	for b := int64(0); b < 24; b++ {
+		if !img.holes[b] {
+			copy(img.data[b*MiB:], bytes.Repeat([]byte{byte(b + 1)}, int(MiB-b)))
+		}
+	}
+
+	f, err := ioutil.TempFile("", "vhdx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	w, err := NewDynamicWriter(f, img, &Options{BlockSize: MiB})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// write across holes in odd-sized pieces, then seek over the rest
+	_, err = io.CopyBuffer(w, bytes.NewReader(img.data[:MiB*11+100]), make([]byte, 12345))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = w.Seek(MiB*11+5000, io.SeekStart)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = w.Write(img.data[MiB*11+5000 : MiB*23])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = w.Seek(0, io.SeekEnd)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(readVirtual(t, f), img.data) {
+		t.Errorf("vhdx image contents differ from the raw image")
+	}
+
+	_, err = w.Seek(MiB*5, io.SeekStart)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = w.Write([]byte{1})
+	if err == nil {
+		t.Errorf("vhdx writer accepted data for a hole")
+	}
+
+}
+
+func TestDynamicWriterOptions(t *testing.T) {
+
+	img := &testImage{
+		data: make([]byte, MiB*3),
+	}
+
+	for _, opts := range []*Options{
+		{BlockSize: 3 * MiB},
+		{BlockSize: 512 * KiB},
+		{LogicalSectorSize: 1024},
+		{PhysicalSectorSize: 520},
+	} {
+		_, err := NewDynamicWriter(nil, img, opts)
+		if err == nil {
+			t.Errorf("vhdx writer accepted invalid options: %+v", opts)
+		}
+	}
+
+}
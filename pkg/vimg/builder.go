@@ -10,9 +10,14 @@ import (
 	"errors"
 	"io"
 	"math/rand"
+	"os"
+	"time"
 
 	"github.com/vorteil/vorteil/pkg/elog"
+	"github.com/vorteil/vorteil/pkg/fat32"
 	"github.com/vorteil/vorteil/pkg/vcfg"
+	"github.com/vorteil/vorteil/pkg/verity"
+	"github.com/vorteil/vorteil/pkg/vio"
 	"github.com/vorteil/vorteil/pkg/vkern"
 )
 
@@ -32,6 +37,16 @@ type FSCompiler interface {
 	RegionIsHole(begin, size int64) bool
 }
 
+// ReproducibleFSCompiler is implemented by FSCompilers that would otherwise
+// write the current time or random identifiers to the file-system. Reproduce
+// is called before Commit when a build has to be reproducible: the compiler
+// should use t for every timestamp it writes, and derive anything random from
+// seed.
+type ReproducibleFSCompiler interface {
+	FSCompiler
+	Reproduce(seed int64, t time.Time)
+}
+
 // KernelOptions for settings that change kernel behaviour.
 type KernelOptions struct {
 	Record bool
@@ -45,6 +60,21 @@ type BuilderArgs struct {
 	FSCompiler FSCompiler
 	VCFG       *vcfg.VCFG
 	Logger     elog.View
+
+	// OSFiles are extra files added to the Vorteil OS partition alongside
+	// the kernel bundle, such as monitoring agents or certificates.
+	OSFiles vio.FileTree
+
+	// Partitions are extra partitions laid out before the root file-system,
+	// in order.
+	Partitions []ExtraPartition
+
+	// Signer, if set, signs the EFI binaries in the EFI system partition for
+	// Secure Boot. It can only be used for disks that boot under UEFI.
+	Signer Signer
+
+	// GUIDs, if set, fixes or derives the disk and partition GUIDs.
+	GUIDs *GUIDs
 }
 
 // Builder is used for building a raw Vorteil image. Building happens in several
@@ -63,6 +93,15 @@ type Builder struct {
 	kernelTags    []string
 	linuxArgs     string
 	defaultMTU    uint
+	osFiles       vio.FileTree
+	osFilesSize   int64
+	extras        []*extraPartition
+	swapSize      int64
+	signer        Signer
+	fixedGUIDs    map[string][]byte
+	deriveGUIDs   bool
+	guidSeed      int64
+	guidArgs      *GUIDs
 
 	// The following variables need to be calculated in the prebuild step.
 	size                      int64
@@ -79,9 +118,38 @@ type Builder struct {
 	gptEntries                []byte
 	gptEntriesCRC             uint32
 	diskUID                   []byte
-
-	kernelBundle *vkern.ManagedBundle
-	configData   []byte
+	usedGUIDs                 map[string][]byte
+	rootPartitionGUID         []byte
+	verityFirstLBA            int64
+	verityLastLBA             int64
+	verityPartitionUID        []byte
+	espFirstLBA               int64
+	espLastLBA                int64
+	espPartitionUID           []byte
+	swapFirstLBA              int64
+	swapLastLBA               int64
+	swapPartitionUID          []byte
+
+	kernelBundle  *vkern.ManagedBundle
+	configData    []byte
+	encryptionKey []byte
+	espFiles      []*espFile
+	espFS         *fat32.Compiler
+
+	// The following variable is only set once Build has written the kernel.
+	kernelDigest []byte
+
+	// The following variables are only set when system.verity is set, and
+	// only once Build has been called.
+	verityRoot *os.File
+	verityTree *verity.Tree
+
+	// The following variables are only set by NewImageBuilder.
+	image     io.ReaderAt
+	imageSize int64
+
+	// The following variables are only set by NewDataDiskBuilder.
+	dataDisk string
 }
 
 // NewBuilder returns a new Builder object configured according to the provided
@@ -102,6 +170,13 @@ func NewBuilder(ctx context.Context, args *BuilderArgs) (*Builder, error) {
 	b.kernelOptions = args.Kernel
 	b.defaultMTU = 1500
 	b.log = args.Logger
+	b.osFiles = args.OSFiles
+	b.signer = args.Signer
+	b.guidArgs = args.GUIDs
+
+	for _, p := range args.Partitions {
+		b.extras = append(b.extras, &extraPartition{ExtraPartition: p})
+	}
 
 	err = b.validateArgs(ctx)
 	if err != nil {
@@ -125,7 +200,27 @@ func (b *Builder) SetDefaultMTU(mtu uint) {
 
 func (b *Builder) validateArgs(ctx context.Context) error {
 
-	err := b.validateOSArgs(ctx)
+	err := b.validateGUIDArgs()
+	if err != nil {
+		return err
+	}
+
+	err = b.validateBootModeArgs()
+	if err != nil {
+		return err
+	}
+
+	err = b.validateSecureBootArgs()
+	if err != nil {
+		return err
+	}
+
+	err = b.validateSwapArgs()
+	if err != nil {
+		return err
+	}
+
+	err = b.validateOSArgs(ctx)
 	if err != nil {
 		return err
 	}
@@ -135,6 +230,11 @@ func (b *Builder) validateArgs(ctx context.Context) error {
 		return err
 	}
 
+	err = b.validateExpansionArgs()
+	if err != nil {
+		return err
+	}
+
 	return nil
 }
 
@@ -147,6 +247,18 @@ func (b *Builder) calculateMinimumSize(ctx context.Context) error {
 		return err
 	}
 
+	err = b.calculateMinimumESPSize(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = b.calculateMinimumExtraPartitionsSize(ctx)
+	if err != nil {
+		return err
+	}
+
+	b.calculateMinimumSwapSize()
+
 	err = b.calculateMinimumRootSize(ctx)
 	if err != nil {
 		return err
@@ -158,6 +270,11 @@ func (b *Builder) calculateMinimumSize(ctx context.Context) error {
 // Close frees up any resources kept open by the Builder.
 func (b *Builder) Close() error {
 
+	err := b.closeVerityRoot()
+	if err != nil {
+		return err
+	}
+
 	if b.kernelBundle != nil {
 		err := b.kernelBundle.Close()
 		if err != nil {
@@ -193,6 +310,10 @@ func (b *Builder) Prebuild(ctx context.Context, size int64) error {
 		panic(errors.New("image size must be a multiple of the sector size"))
 	}
 
+	if b.image != nil {
+		return b.prebuildImage(ctx)
+	}
+
 	sectors := size / SectorSize
 	b.secondaryGPTHeaderLBA = sectors - 1
 	b.secondaryGPTHeaderOffset = b.secondaryGPTHeaderLBA * SectorSize
@@ -200,11 +321,17 @@ func (b *Builder) Prebuild(ctx context.Context, size int64) error {
 	b.secondaryGPTEntriesOffset = b.secondaryGPTEntriesLBA * SectorSize
 	b.lastUsableLBA = b.secondaryGPTEntriesLBA - 1
 
+	if b.dataDisk != "" {
+		return b.prebuildData(ctx)
+	}
+
 	err := b.prebuildOS(ctx)
 	if err != nil {
 		return err
 	}
 
+	b.prebuildESP()
+
 	err = b.prebuildRoot(ctx)
 	if err != nil {
 		return err
@@ -218,6 +345,11 @@ func (b *Builder) Prebuild(ctx context.Context, size int64) error {
 		return err
 	}
 
+	err = b.generateExpansionInfo()
+	if err != nil {
+		return err
+	}
+
 	return nil
 }
 
@@ -232,7 +364,12 @@ func (b *Builder) Build(ctx context.Context, w io.WriteSeeker) error {
 	progress := b.log.NewProgress("Writing image", "KiB", b.size)
 	defer progress.Finish(false)
 
-	err := b.writePartitions(ctx, elog.MultiWriteSeeker(w, progress))
+	var err error
+	if b.image != nil {
+		err = b.writeImage(ctx, elog.MultiWriteSeeker(w, progress))
+	} else {
+		err = b.writePartitions(ctx, elog.MultiWriteSeeker(w, progress))
+	}
 	if err != nil {
 		return err
 	}
@@ -268,9 +405,17 @@ func (b *Builder) isGPTHole(first, last int64) bool {
 // continuing for the full size is zeroed.
 func (b *Builder) RegionIsHole(begin, size int64) bool {
 
+	if b.image != nil {
+		return b.imageRegionIsHole(begin, size)
+	}
+
 	first := begin / SectorSize
 	last := (begin + size - 1) / SectorSize
 
+	if b.dataDisk != "" {
+		return b.dataRegionIsHole(first, last)
+	}
+
 	if first >= b.rootFirstLBA && last <= b.rootLastLBA {
 		// file-system holes
 		pBegin := (first - b.rootFirstLBA) * SectorSize
@@ -278,6 +423,18 @@ func (b *Builder) RegionIsHole(begin, size int64) bool {
 		return b.rootRegionIsHole(pBegin, pSize)
 	}
 
+	if b.uefi() && first >= b.espFirstLBA && last <= b.espLastLBA {
+		return b.espRegionIsHole(first-b.espFirstLBA, last-b.espFirstLBA)
+	}
+
+	if hole, ok := b.extraPartitionRegionIsHole(first, last); ok {
+		return hole
+	}
+
+	if hole, ok := b.swapRegionIsHole(first, last); ok {
+		return hole
+	}
+
 	if first >= b.osFirstLBA && last <= b.osLastLBA {
 		// OS partition holes
 		pBegin := (first - b.osLastLBA) * SectorSize
@@ -0,0 +1,141 @@
+package vimg
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"math/rand"
+	"unicode/utf16"
+
+	"github.com/vorteil/vorteil/pkg/elog"
+	"github.com/vorteil/vorteil/pkg/vcfg"
+)
+
+// DataPartitionTypeGUID is the GPT partition type of the file-system partition
+// on an additional data disk ("Linux filesystem data").
+var DataPartitionTypeGUID = [16]byte{0xAF, 0x3D, 0xC6, 0x0F, 0x83, 0x84,
+	0x72, 0x47, 0x8E, 0x79, 0x3D, 0x69, 0xD8, 0x47, 0x7D, 0xE4}
+
+// DataDiskBuilderArgs collects all of the arguments needed to call
+// NewDataDiskBuilder into one place.
+type DataDiskBuilderArgs struct {
+	Seed       int64
+	Name       string
+	Size       vcfg.Bytes
+	FSCompiler FSCompiler
+	Logger     elog.View
+	GUIDs      *GUIDs
+}
+
+// NewDataDiskBuilder returns a new Builder object for an additional disk that
+// only holds data. The disk has a GPT with a single partition named after the
+// disk, which contains the file-system. If Size is a delta it is added to the
+// file-system as free space, otherwise it is the caller's responsibility to
+// Prebuild the disk at the right size.
+func NewDataDiskBuilder(ctx context.Context, args *DataDiskBuilderArgs) (*Builder, error) {
+
+	err := ctx.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	if args.Name == "" {
+		return nil, errors.New("data disk requires a name")
+	}
+
+	b := new(Builder)
+	b.rng = rand.New(rand.NewSource(args.Seed))
+	b.fs = args.FSCompiler
+	b.log = args.Logger
+	b.dataDisk = args.Name
+
+	err = b.setGUIDs(args.GUIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	b.minSize = (3 + 2*GPTEntriesSectors) * SectorSize
+
+	b.fs.IncreaseMinimumFreeSpace(int64(vcfg.MiB))
+	if args.Size.IsDelta() {
+		delta := vcfg.Bytes(0)
+		delta.ApplyDelta(args.Size)
+		b.fs.IncreaseMinimumFreeSpace(int64(delta.Units(vcfg.Byte)))
+	}
+
+	err = b.fs.Commit(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	b.minSize += b.fs.MinimumSize()
+
+	return b, nil
+}
+
+func (b *Builder) prebuildData(ctx context.Context) error {
+
+	err := ctx.Err()
+	if err != nil {
+		return err
+	}
+
+	b.rootFirstLBA = P0FirstLBA
+	b.rootLastLBA = b.lastUsableLBA
+
+	err = b.fs.Precompile(ctx, (b.rootLastLBA-b.rootFirstLBA+1)*SectorSize)
+	if err != nil {
+		return err
+	}
+
+	b.diskUID, err = b.partitionGUID(diskGUIDKey)
+	if err != nil {
+		return err
+	}
+
+	b.rootPartitionGUID, err = b.partitionGUID(b.dataDisk)
+	if err != nil {
+		return err
+	}
+
+	p := GPTEntry{
+		TypeGUID: DataPartitionTypeGUID,
+		FirstLBA: uint64(b.rootFirstLBA),
+		LastLBA:  uint64(b.rootLastLBA),
+	}
+
+	copy(p.PartitionGUID[:], b.rootPartitionGUID)
+	copy(p.Name[:], partitionName(b.dataDisk))
+
+	buf := new(bytes.Buffer)
+	_ = binary.Write(buf, binary.LittleEndian, p)
+	b.setGPTEntries(buf.Bytes())
+
+	return nil
+}
+
+// partitionName encodes name as the utf16 used for GPT partition names.
+func partitionName(name string) []byte {
+
+	buf := new(bytes.Buffer)
+	_ = binary.Write(buf, binary.LittleEndian, utf16.Encode([]rune(name)))
+
+	return buf.Bytes()
+}
+
+func (b *Builder) dataRegionIsHole(first, last int64) bool {
+
+	if first >= b.rootFirstLBA && last <= b.rootLastLBA {
+		pBegin := (first - b.rootFirstLBA) * SectorSize
+		pSize := (last - first + 1) * SectorSize
+		return b.fs.RegionIsHole(pBegin, pSize)
+	}
+
+	return b.isGPTHole(first, last)
+}
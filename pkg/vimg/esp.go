@@ -0,0 +1,294 @@
+package vimg
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/vorteil/vorteil/pkg/fat32"
+	"github.com/vorteil/vorteil/pkg/vcfg"
+	"github.com/vorteil/vorteil/pkg/vio"
+)
+
+// Disks built with system.boot-mode set to "uefi" or "hybrid" have an EFI
+// system partition between the OS partition and the root file-system. It is a
+// FAT32 file-system containing every file in the kernel bundle tagged "uefi",
+// all of them in \EFI\BOOT. Firmware boots \EFI\BOOT\BOOTX64.EFI, which is
+// expected to be a signed first-stage loader (like shim) that loads its
+// neighbours, and those find the kernel on the "vorteil-os" partition. The ESP
+// gets its own entry at the end of the GPT so that the other partitions keep
+// their indices.
+//
+// If the Builder has a Signer every EFI binary is signed as it's loaded, before
+// the ESP is laid out, since signing makes them bigger.
+//
+// Hybrid disks also keep the BIOS bootloader in the protective MBR, and mark
+// the OS partition as legacy BIOS bootable, so that the same disk boots under
+// either firmware. The BIOS bootloader never looks at the ESP, and UEFI
+// firmware ignores the MBR's boot code.
+
+// Various ESP constants.
+const (
+	ESPSectors   = 69632 // 34 MiB, just big enough for FAT32 with 512 byte clusters
+	ESPKernelTag = "uefi"
+	ESPLoader    = "BOOTX64.EFI"
+	ESPLabel     = "VORTEIL ESP"
+
+	// GPTAttributeRequired marks a partition the platform needs to function.
+	GPTAttributeRequired = 1 << 0
+
+	// GPTAttributeLegacyBIOSBootable marks the partition a BIOS bootloader
+	// boots from on a GPT disk.
+	GPTAttributeLegacyBIOSBootable = 1 << 2
+)
+
+var (
+	// ESPPartitionName is the hardcoded name for the EFI system partition in the GPT.
+	ESPPartitionName = []byte{0x76, 0x0, 0x6f, 0x0, 0x72, 0x0, 0x74, 0x0, 0x65, 0x0, 0x69, 0x0,
+		0x6c, 0x0, 0x2d, 0x0, 0x65, 0x0, 0x73, 0x0, 0x70, 0x0} // "vorteil-esp" in utf16
+
+	// ESPPartitionTypeGUID is the GPT partition type of the EFI system partition.
+	ESPPartitionTypeGUID = [16]byte{0x28, 0x73, 0x2A, 0xC1, 0x1F, 0xF8,
+		0xD2, 0x11, 0xBA, 0x4B, 0x00, 0xA0, 0xC9, 0x3E, 0xC9, 0x3B}
+)
+
+// espTime is the time written to every directory entry in the ESP, so that
+// builds are reproducible.
+var espTime = time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// espFile is a file in \EFI\BOOT. Names are upper-case, because firmware
+// looks them up without regard to case, and that way any that fit are stored
+// as plain 8.3 names.
+type espFile struct {
+	name string
+	data []byte
+}
+
+// uefi returns true if the disk boots under UEFI, and so needs an ESP.
+func (b *Builder) uefi() bool {
+	mode := b.vcfg.System.BootMode
+	return mode == vcfg.UEFIBoot || mode == vcfg.HybridBoot
+}
+
+// bios returns true if the disk boots under BIOS, and so needs the bootloader
+// in its MBR.
+func (b *Builder) bios() bool {
+	return b.vcfg.System.BootMode != vcfg.UEFIBoot
+}
+
+func (b *Builder) validateBootModeArgs() error {
+
+	switch b.vcfg.System.BootMode {
+	case "", vcfg.BIOSBoot, vcfg.UEFIBoot, vcfg.HybridBoot:
+	default:
+		return fmt.Errorf("invalid system.boot-mode '%s' (should be 'bios', 'uefi', or 'hybrid')", b.vcfg.System.BootMode)
+	}
+
+	return nil
+
+}
+
+func (b *Builder) calculateMinimumESPSize(ctx context.Context) error {
+
+	if !b.uefi() {
+		return nil
+	}
+
+	err := b.loadESPFiles(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = b.compileESP(ctx)
+	if err != nil {
+		return err
+	}
+
+	b.minSize += ESPSectors * SectorSize
+
+	return nil
+
+}
+
+// loadESPFiles reads the files tagged for the ESP out of the kernel bundle. It
+// must be called after the kernel has been loaded.
+func (b *Builder) loadESPFiles(ctx context.Context) error {
+
+	names := make(map[string]bool)
+	for _, f := range b.kernelBundle.Bundle().Files() {
+		for _, tag := range f.Tags {
+			if tag == ESPKernelTag {
+				names[f.Name] = true
+			}
+		}
+	}
+
+	rdr := b.kernelBundle.Bundle().Reader(ESPKernelTag)
+	defer rdr.Close()
+
+	var loader bool
+	b.espFiles = nil
+
+	tr := tar.NewReader(rdr)
+	for {
+		err := ctx.Err()
+		if err != nil {
+			return err
+		}
+
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		if !names[hdr.Name] {
+			continue
+		}
+
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return err
+		}
+
+		data, err = b.signESPFile(ctx, hdr.Name, data)
+		if err != nil {
+			return err
+		}
+
+		if strings.EqualFold(hdr.Name, ESPLoader) {
+			loader = true
+		}
+
+		b.espFiles = append(b.espFiles, &espFile{
+			name: strings.ToUpper(hdr.Name),
+			data: data,
+		})
+	}
+
+	if !loader {
+		return fmt.Errorf("kernel %s doesn't support uefi boot (it has no %s)", b.kernel, ESPLoader)
+	}
+
+	return nil
+
+}
+
+// compileESP lays out the FAT32 file-system of the ESP, which always fills
+// the whole partition.
+func (b *Builder) compileESP(ctx context.Context) error {
+
+	tree := vio.NewFileTree()
+	for _, f := range b.espFiles {
+		err := tree.Map("/EFI/BOOT/"+f.name, vio.CustomFile(vio.CustomFileArgs{
+			Name:       f.name,
+			Size:       len(f.data),
+			ReadCloser: ioutil.NopCloser(bytes.NewReader(f.data)),
+		}))
+		if err != nil {
+			return fmt.Errorf("bad uefi file in kernel %s: %v", b.kernel, err)
+		}
+	}
+
+	b.espFS = fat32.NewCompiler(&fat32.CompilerArgs{
+		FileTree: tree,
+		Logger:   b.log,
+		Label:    ESPLabel,
+	})
+
+	// the volume ID is the partition's GUID, which isn't known yet
+	b.espFS.Reproduce(0, espTime)
+
+	err := b.espFS.Commit(ctx)
+	if err != nil {
+		return fmt.Errorf("bad uefi file in kernel %s: %v", b.kernel, err)
+	}
+
+	err = b.espFS.Precompile(ctx, ESPSectors*SectorSize)
+	if err != nil {
+		return fmt.Errorf("uefi files in kernel %s don't fit in the EFI system partition", b.kernel)
+	}
+
+	return nil
+
+}
+
+func (b *Builder) prebuildESP() {
+
+	if !b.uefi() {
+		return
+	}
+
+	b.espFirstLBA = b.osLastLBA + 1
+	b.espLastLBA = b.espFirstLBA + ESPSectors - 1
+	b.espFS.SetHiddenSectors(uint32(b.espFirstLBA))
+
+}
+
+func (b *Builder) generateESPEntry() (*GPTEntry, error) {
+
+	var err error
+	b.espPartitionUID, err = b.partitionGUID(ESPPartitionLabel)
+	if err != nil {
+		return nil, err
+	}
+
+	b.espFS.SetVolumeID(binary.LittleEndian.Uint32(b.espPartitionUID))
+
+	p := &GPTEntry{
+		TypeGUID:   ESPPartitionTypeGUID,
+		FirstLBA:   uint64(b.espFirstLBA),
+		LastLBA:    uint64(b.espLastLBA),
+		Attributes: GPTAttributeRequired,
+	}
+
+	copy(p.PartitionGUID[:], b.espPartitionUID)
+	copy(p.Name[:], ESPPartitionName)
+
+	return p, nil
+
+}
+
+func (b *Builder) writeESP(ctx context.Context, w io.WriteSeeker) error {
+
+	if !b.uefi() {
+		return nil
+	}
+
+	_, err := w.Seek(b.espFirstLBA*SectorSize, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	ws, err := vio.WriteSeeker(w)
+	if err != nil {
+		return err
+	}
+
+	err = b.espFS.Compile(ctx, ws)
+	if err != nil {
+		return err
+	}
+
+	return nil
+
+}
+
+// espRegionIsHole reports whether the sectors from first to last, relative to
+// the start of the ESP, are all left empty.
+func (b *Builder) espRegionIsHole(first, last int64) bool {
+	return b.espFS.RegionIsHole(first*SectorSize, (last-first+1)*SectorSize)
+}
@@ -0,0 +1,345 @@
+package vimg
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+
+	"github.com/vorteil/vorteil/pkg/vcfg"
+)
+
+// ExpansionInfo describes the layout of a disk as it was built, so that the
+// guest's init can tell at boot whether the disk has been grown since, and
+// grow the root partition and file-system to fill it. It is only included in
+// the kernel config if system.expand-fs is set.
+type ExpansionInfo struct {
+	DiskSize               int64  `json:"disk-size"`
+	RootPartition          int    `json:"root-partition"`
+	RootFirstLBA           int64  `json:"root-first-lba"`
+	RootLastLBA            int64  `json:"root-last-lba"`
+	SecondaryGPTHeaderLBA  int64  `json:"secondary-gpt-header-lba"`
+	SecondaryGPTEntriesLBA int64  `json:"secondary-gpt-entries-lba"`
+	Filesystem             string `json:"filesystem"`
+	Encrypted              bool   `json:"encrypted,omitempty"`
+}
+
+// kernelConfig is the structure of the config the guest reads at boot.
+type kernelConfig struct {
+	vcfg.VCFG
+	Expand *ExpansionInfo `json:"expand,omitempty"`
+	Swap   *SwapInfo      `json:"swap,omitempty"`
+}
+
+// rootPartitionIndex is the index of the root partition in the GPT entries.
+const rootPartitionIndex = 1
+
+func (b *Builder) validateExpansionArgs() error {
+
+	if !b.vcfg.System.ExpandFilesystem {
+		return nil
+	}
+
+	// growing a file-system past the number of block group descriptors it
+	// was built with relies on reserved GDT blocks, which only the ext4
+	// compiler leaves room for
+	switch b.vcfg.System.Filesystem {
+	case vcfg.Ext4FS, vcfg.XFS:
+	default:
+		fs := b.vcfg.System.Filesystem
+		if fs == "" {
+			fs = vcfg.Ext2FS
+		}
+		return fmt.Errorf("system.expand-fs is not supported by the '%s' file-system", fs)
+	}
+
+	return nil
+
+}
+
+// expansionPlaceholder returns an ExpansionInfo that encodes to at least as
+// many bytes as any real one, so that the config can be sized before the
+// disk's layout is known.
+func (b *Builder) expansionPlaceholder() *ExpansionInfo {
+	return &ExpansionInfo{
+		DiskSize:               math.MaxInt64,
+		RootPartition:          rootPartitionIndex,
+		RootFirstLBA:           math.MaxInt64,
+		RootLastLBA:            math.MaxInt64,
+		SecondaryGPTHeaderLBA:  math.MaxInt64,
+		SecondaryGPTEntriesLBA: math.MaxInt64,
+		Filesystem:             string(b.vcfg.System.Filesystem),
+		Encrypted:              true,
+	}
+}
+
+func (b *Builder) marshalConfig(cfg *vcfg.VCFG, expand *ExpansionInfo) error {
+
+	data, err := json.Marshal(&kernelConfig{
+		VCFG:   *cfg,
+		Expand: expand,
+		Swap:   b.swapInfo(),
+	})
+	if err != nil {
+		return err
+	}
+
+	b.configData = data
+
+	return nil
+
+}
+
+// generateExpansionInfo replaces the placeholder expansion info in the config
+// now that the disk's layout is known.
+func (b *Builder) generateExpansionInfo() error {
+
+	if !b.vcfg.System.ExpandFilesystem {
+		return nil
+	}
+
+	capacity := len(b.configData)
+
+	var cfg kernelConfig
+	err := json.Unmarshal(b.configData, &cfg)
+	if err != nil {
+		return err
+	}
+
+	err = b.marshalConfig(&cfg.VCFG, &ExpansionInfo{
+		DiskSize:               b.size,
+		RootPartition:          rootPartitionIndex,
+		RootFirstLBA:           b.rootFirstLBA,
+		RootLastLBA:            b.rootLastLBA,
+		SecondaryGPTHeaderLBA:  b.secondaryGPTHeaderLBA,
+		SecondaryGPTEntriesLBA: b.secondaryGPTEntriesLBA,
+		Filesystem:             string(b.vcfg.System.Filesystem),
+		Encrypted:              b.encryptionKey != nil,
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(b.configData) > capacity {
+		return errors.New("expansion info outgrew the space reserved for it")
+	}
+
+	return nil
+
+}
+
+// ErrNotExpandable is returned by ExpandPartitionTable if the disk's last
+// partition doesn't run up to the end of the usable space, which means it
+// can't safely be grown.
+var ErrNotExpandable = errors.New("last partition does not end at the end of the disk")
+
+// ExpandPartitionTable updates the GPT of a disk that has been grown to size
+// bytes: it moves the secondary GPT to the new end of the disk, and grows the
+// last partition (the root partition, on disks built by this package) to fill
+// the new space. The file-system within the partition must be grown
+// separately, which the guest does at boot if system.expand-fs was set.
+//
+// The primary GPT is rewritten last, so an interrupted expansion leaves a disk
+// that is still valid at its original size.
+func ExpandPartitionTable(rw io.ReadWriteSeeker, size int64) error {
+
+	hdr, entries, err := readPrimaryGPT(rw)
+	if err != nil {
+		return err
+	}
+
+	sectors := size / SectorSize
+	if sectors-1 < int64(hdr.BackupLBA) {
+		return fmt.Errorf("disk can't be shrunk from %d to %d sectors", hdr.BackupLBA+1, sectors)
+	}
+
+	if sectors-1 == int64(hdr.BackupLBA) {
+		return nil
+	}
+
+	last, lastLBA := lastPartitionEntry(entries)
+	if last < 0 || lastLBA != hdr.LastUsableLBA {
+		return ErrNotExpandable
+	}
+
+	secondaryHeaderLBA := sectors - 1
+	secondaryEntriesLBA := secondaryHeaderLBA - GPTEntriesSectors
+	lastUsableLBA := secondaryEntriesLBA - 1
+
+	binary.LittleEndian.PutUint64(entries[last*GPTEntrySize+40:], uint64(lastUsableLBA))
+	hdr.CRCParts = crc32.ChecksumIEEE(entries)
+	hdr.LastUsableLBA = uint64(lastUsableLBA)
+
+	secondary := hdr
+	secondary.CurrentLBA = uint64(secondaryHeaderLBA)
+	secondary.BackupLBA = PrimaryGPTHeaderLBA
+	secondary.StartLBAParts = uint64(secondaryEntriesLBA)
+
+	err = writeGPTCopy(rw, &secondary, entries)
+	if err != nil {
+		return err
+	}
+
+	hdr.BackupLBA = uint64(secondaryHeaderLBA)
+
+	err = writeGPTCopy(rw, &hdr, entries)
+	if err != nil {
+		return err
+	}
+
+	return growProtectiveMBR(rw, sectors)
+
+}
+
+// LastPartition returns the first and last LBAs of the partition that ends
+// furthest into the disk, which on disks built by this package is the root
+// partition.
+func LastPartition(r io.ReadSeeker) (firstLBA, lastLBA int64, err error) {
+
+	_, entries, err := readPrimaryGPT(r)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	last, x := lastPartitionEntry(entries)
+	if last < 0 {
+		return 0, 0, errors.New("disk has no partitions")
+	}
+
+	firstLBA = int64(binary.LittleEndian.Uint64(entries[last*GPTEntrySize+32:]))
+	lastLBA = int64(x)
+
+	return firstLBA, lastLBA, nil
+
+}
+
+// lastPartitionEntry returns the index and last LBA of the partition entry
+// that ends furthest into the disk, or -1 if there are no partitions.
+func lastPartitionEntry(entries []byte) (int, uint64) {
+
+	last := -1
+	var lastLBA uint64
+	for i := 0; i < len(entries)/GPTEntrySize; i++ {
+		x := binary.LittleEndian.Uint64(entries[i*GPTEntrySize+40:])
+		if x > lastLBA {
+			last, lastLBA = i, x
+		}
+	}
+
+	return last, lastLBA
+
+}
+
+// growProtectiveMBR updates the size of the protective MBR's partition, which
+// covers the whole disk (or as much of it as can be addressed).
+func growProtectiveMBR(w io.WriteSeeker, sectors int64) error {
+
+	total := uint32(math.MaxUint32)
+	if sectors-1 < math.MaxUint32 {
+		total = uint32(sectors - 1)
+	}
+
+	// offset of the first partition record's TotalSectors field
+	_, err := w.Seek(458, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	return binary.Write(w, binary.LittleEndian, total)
+
+}
+
+func readPrimaryGPT(r io.ReadSeeker) (GPTHeader, []byte, error) {
+
+	var hdr GPTHeader
+
+	_, err := r.Seek(PrimaryGPTHeaderOffset, io.SeekStart)
+	if err != nil {
+		return hdr, nil, err
+	}
+
+	err = binary.Read(r, binary.LittleEndian, &hdr)
+	if err != nil {
+		return hdr, nil, err
+	}
+
+	if hdr.Signature != GPTSignature {
+		return hdr, nil, errors.New("disk has no GPT")
+	}
+
+	if hdr.CRC != gptHeaderCRC(hdr) {
+		return hdr, nil, errors.New("primary GPT header checksum mismatch")
+	}
+
+	if hdr.SizePartEntry != GPTEntrySize || hdr.NoOfParts != MaximumGPTEntries {
+		return hdr, nil, errors.New("unsupported GPT entries")
+	}
+
+	_, err = r.Seek(int64(hdr.StartLBAParts)*SectorSize, io.SeekStart)
+	if err != nil {
+		return hdr, nil, err
+	}
+
+	entries := make([]byte, MaximumGPTEntries*GPTEntrySize)
+	_, err = io.ReadFull(r, entries)
+	if err != nil {
+		return hdr, nil, err
+	}
+
+	if crc32.ChecksumIEEE(entries) != hdr.CRCParts {
+		return hdr, nil, errors.New("primary GPT entries checksum mismatch")
+	}
+
+	return hdr, entries, nil
+
+}
+
+func gptHeaderCRC(hdr GPTHeader) uint32 {
+
+	hdr.CRC = 0
+
+	buf := new(bytes.Buffer)
+	_ = binary.Write(buf, binary.LittleEndian, hdr)
+
+	return crc32.ChecksumIEEE(buf.Bytes()[:GPTHeaderSize])
+
+}
+
+// writeGPTCopy writes a GPT header and its entries to the locations the header
+// gives for them.
+func writeGPTCopy(w io.WriteSeeker, hdr *GPTHeader, entries []byte) error {
+
+	hdr.CRC = gptHeaderCRC(*hdr)
+
+	_, err := w.Seek(int64(hdr.StartLBAParts)*SectorSize, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(w, bytes.NewReader(entries))
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Seek(int64(hdr.CurrentLBA)*SectorSize, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	err = binary.Write(w, binary.LittleEndian, hdr)
+	if err != nil {
+		return err
+	}
+
+	return nil
+
+}
@@ -0,0 +1,192 @@
+package vimg
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/vorteil/vorteil/pkg/vcfg"
+	"github.com/vorteil/vorteil/pkg/vio"
+)
+
+// GPT partition attributes that can be set on extra partitions by name.
+const (
+	GPTAttributeReadOnly    = 1 << 60
+	GPTAttributeHidden      = 1 << 62
+	GPTAttributeNoAutomount = 1 << 63
+)
+
+var partitionAttributes = map[string]uint64{
+	"required":     GPTAttributeRequired,
+	"read-only":    GPTAttributeReadOnly,
+	"hidden":       GPTAttributeHidden,
+	"no-automount": GPTAttributeNoAutomount,
+}
+
+// PartitionAttributes converts the flags of a vcfg partition into GPT
+// partition attributes.
+func PartitionAttributes(flags []string) (uint64, error) {
+
+	var attrs uint64
+
+	for _, flag := range flags {
+		x, ok := partitionAttributes[flag]
+		if !ok {
+			return 0, fmt.Errorf("invalid partition flag '%s' (should be 'required', 'read-only', 'hidden', or 'no-automount')", flag)
+		}
+		attrs |= x
+	}
+
+	return attrs, nil
+
+}
+
+// ExtraPartition describes a partition added to the disk between the Vorteil
+// OS partition (or the ESP) and the root file-system. If Size is a delta it is
+// added to the file-system as free space, otherwise the partition is exactly
+// Size.
+type ExtraPartition struct {
+	Name       string
+	Size       vcfg.Bytes
+	Attributes uint64
+	FSCompiler FSCompiler
+}
+
+type extraPartition struct {
+	ExtraPartition
+	size     int64
+	firstLBA int64
+	lastLBA  int64
+}
+
+func (b *Builder) calculateMinimumExtraPartitionsSize(ctx context.Context) error {
+
+	for _, p := range b.extras {
+
+		fs := p.FSCompiler
+		fs.IncreaseMinimumFreeSpace(int64(vcfg.MiB))
+
+		if p.Size.IsDelta() {
+			delta := vcfg.Bytes(0)
+			delta.ApplyDelta(p.Size)
+			fs.IncreaseMinimumFreeSpace(int64(delta.Units(vcfg.Byte)))
+		}
+
+		err := fs.Commit(ctx)
+		if err != nil {
+			return fmt.Errorf("partition '%s': %w", p.Name, err)
+		}
+
+		p.size = fs.MinimumSize()
+		if !p.Size.IsDelta() {
+			if int64(p.Size) < p.size {
+				return fmt.Errorf("partition '%s' needs at least %s, more than its size of %s", p.Name, vcfg.Bytes(p.size), p.Size)
+			}
+			p.size = int64(p.Size)
+		}
+		p.size = (p.size + SectorSize - 1) / SectorSize * SectorSize
+
+		b.minSize += p.size
+
+	}
+
+	return nil
+
+}
+
+// prebuildExtraPartitions lays out the extra partitions one after another,
+// starting at lba, and returns the first lba after them.
+func (b *Builder) prebuildExtraPartitions(ctx context.Context, lba int64) (int64, error) {
+
+	for _, p := range b.extras {
+
+		p.firstLBA = lba
+		p.lastLBA = lba + p.size/SectorSize - 1
+		lba = p.lastLBA + 1
+
+		err := p.FSCompiler.Precompile(ctx, p.size)
+		if err != nil {
+			return 0, fmt.Errorf("partition '%s': %w", p.Name, err)
+		}
+
+	}
+
+	return lba, nil
+
+}
+
+func (b *Builder) generateExtraPartitionEntries() ([]GPTEntry, error) {
+
+	var entries []GPTEntry
+
+	for _, p := range b.extras {
+
+		uid, err := b.partitionGUID(p.Name)
+		if err != nil {
+			return nil, err
+		}
+
+		e := GPTEntry{
+			TypeGUID:   DataPartitionTypeGUID,
+			FirstLBA:   uint64(p.firstLBA),
+			LastLBA:    uint64(p.lastLBA),
+			Attributes: p.Attributes,
+		}
+
+		copy(e.PartitionGUID[:], uid)
+		copy(e.Name[:], partitionName(p.Name))
+
+		entries = append(entries, e)
+
+	}
+
+	return entries, nil
+
+}
+
+func (b *Builder) writeExtraPartitions(ctx context.Context, w io.WriteSeeker) error {
+
+	for _, p := range b.extras {
+
+		_, err := w.Seek(p.firstLBA*SectorSize, io.SeekStart)
+		if err != nil {
+			return err
+		}
+
+		ws, err := vio.WriteSeeker(w)
+		if err != nil {
+			return err
+		}
+
+		err = p.FSCompiler.Compile(ctx, ws)
+		if err != nil {
+			return fmt.Errorf("partition '%s': %w", p.Name, err)
+		}
+
+	}
+
+	return nil
+
+}
+
+// extraPartitionRegionIsHole returns true if the sectors from first to last
+// are empty space within one of the extra partitions. The second value is
+// false if they aren't all within one.
+func (b *Builder) extraPartitionRegionIsHole(first, last int64) (bool, bool) {
+
+	for _, p := range b.extras {
+		if first >= p.firstLBA && last <= p.lastLBA {
+			pBegin := (first - p.firstLBA) * SectorSize
+			pSize := (last - first + 1) * SectorSize
+			return p.FSCompiler.RegionIsHole(pBegin, pSize), true
+		}
+	}
+
+	return false, false
+
+}
@@ -0,0 +1,155 @@
+package vimg
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// The GPT names of the partitions every disk may have, which are used to look
+// up their GUIDs in GUIDs. Extra partitions use their own names, and the swap
+// and overlay partitions use SwapLabel and OverlayLabel.
+const (
+	OSPartitionLabel     = "vorteil-os"
+	RootPartitionLabel   = "vorteil-root"
+	VerityPartitionLabel = "vorteil-verity"
+	ESPPartitionLabel    = "vorteil-esp"
+)
+
+// GUIDs controls the disk and partition GUIDs a Builder writes to the GPT, so
+// that tooling which tracks images by GUID keeps working when they're rebuilt.
+//
+// Disk and Partitions fix GUIDs outright, with Partitions keyed by GPT
+// partition name. If Derive is set every other GUID is derived from Seed and
+// the name of its partition, so it doesn't change when other partitions are
+// added or removed. Otherwise they're generated by the Builder's random number
+// generator, as usual.
+//
+// The VCFG's system.disk-guid and system.os-partition-guid take precedence
+// over GUIDs. The root partition's GUID is part of the kernel's command line,
+// so it can only be set with system.root-partition-guid.
+type GUIDs struct {
+	Disk       string
+	Partitions map[string]string
+	Derive     bool
+	Seed       int64
+}
+
+// diskGUIDKey is the key of the disk's own GUID among a Builder's GUIDs,
+// which can't clash with a partition name.
+const diskGUIDKey = ""
+
+// setGUIDs records the GUIDs fixed by x, which may be nil.
+func (b *Builder) setGUIDs(x *GUIDs) error {
+
+	b.fixedGUIDs = make(map[string][]byte)
+	b.usedGUIDs = make(map[string][]byte)
+
+	if x == nil {
+		return nil
+	}
+
+	b.deriveGUIDs = x.Derive
+	b.guidSeed = x.Seed
+
+	if x.Disk != "" {
+		guid, err := parseGUID(x.Disk)
+		if err != nil {
+			return fmt.Errorf("invalid disk GUID '%s': %v", x.Disk, err)
+		}
+		b.fixedGUIDs[diskGUIDKey] = guid
+	}
+
+	for name, value := range x.Partitions {
+		if name == diskGUIDKey {
+			return errors.New("invalid GUID for a partition without a name")
+		}
+
+		guid, err := parseGUID(value)
+		if err != nil {
+			return fmt.Errorf("invalid GUID for partition '%s': %v", name, err)
+		}
+
+		if name == RootPartitionLabel && b.dataDisk == "" {
+			if formatGUID(guid) != RootPartitionUUID(b.vcfg) {
+				return errors.New("the root partition's GUID can only be set with system.root-partition-guid")
+			}
+			continue
+		}
+
+		b.fixedGUIDs[name] = guid
+	}
+
+	return nil
+
+}
+
+// deriveGUID returns a random-looking GUID that only depends on seed and name.
+func deriveGUID(seed int64, name string) []byte {
+
+	buf := make([]byte, 8+len(name))
+	binary.LittleEndian.PutUint64(buf, uint64(seed))
+	copy(buf[8:], name)
+
+	sum := sha256.Sum256(buf)
+	guid := sum[:16]
+
+	// mark it as a version 4 UUID, like generateUID does
+	guid[6] = guid[6]&^0xf0 | 0x40
+	guid[8] = guid[8]&^0xc0 | 0x80
+
+	return guid
+
+}
+
+// partitionGUID returns the GUID of the named partition, or of the disk
+// itself if name is diskGUIDKey: the fixed GUID if there is one, otherwise a
+// derived GUID if the Builder derives them, or else a newly generated UID. A
+// UID is generated either way so that the output of the Builder's random
+// number generator is unaffected.
+func (b *Builder) partitionGUID(name string) ([]byte, error) {
+
+	uid, err := b.generateUID()
+	if err != nil {
+		return nil, err
+	}
+
+	guid, ok := b.fixedGUIDs[name]
+	if !ok && b.deriveGUIDs {
+		guid = deriveGUID(b.guidSeed, name)
+	} else if !ok {
+		guid = uid
+	}
+
+	b.usedGUIDs[name] = guid
+
+	return guid, nil
+
+}
+
+// GUIDs returns the GUIDs of the disk and each of its partitions, which can be
+// passed back to a later Builder to fix them. It can only be called after a
+// successful call to Prebuild.
+func (b *Builder) GUIDs() *GUIDs {
+
+	x := &GUIDs{
+		Partitions: make(map[string]string),
+	}
+
+	for name, guid := range b.usedGUIDs {
+		if name == diskGUIDKey {
+			x.Disk = formatGUID(guid)
+			continue
+		}
+		x.Partitions[name] = formatGUID(guid)
+	}
+
+	return x
+
+}
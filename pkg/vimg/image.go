@@ -0,0 +1,187 @@
+package vimg
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/vorteil/vorteil/pkg/elog"
+)
+
+// ImageBuilderArgs collects all of the arguments needed to call
+// NewImageBuilder into one place.
+type ImageBuilderArgs struct {
+	Image  io.ReaderAt
+	Size   int64
+	Logger elog.View
+}
+
+// NewImageBuilder returns a new Builder object that reproduces an existing raw
+// disk image instead of compiling one from a package. Nothing about the image
+// is changed, so the Builder can be used to rewrap third-party or decompiled
+// disks in any virtual disk image format. The image can be padded with zeroes
+// by calling Prebuild with a size larger than the image, but it can never be
+// shrunk.
+func NewImageBuilder(ctx context.Context, args *ImageBuilderArgs) (*Builder, error) {
+
+	err := ctx.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	if args.Size <= 0 || args.Size%SectorSize != 0 {
+		return nil, fmt.Errorf("raw disk image size must be a non-zero multiple of %d bytes", SectorSize)
+	}
+
+	b := new(Builder)
+	b.log = args.Logger
+	b.image = args.Image
+	b.imageSize = args.Size
+	b.minSize = args.Size
+
+	return b, nil
+}
+
+func (b *Builder) prebuildImage(ctx context.Context) error {
+
+	err := ctx.Err()
+	if err != nil {
+		return err
+	}
+
+	if b.size < b.imageSize {
+		return fmt.Errorf("cannot shrink the %d byte raw disk image to %d bytes", b.imageSize, b.size)
+	}
+
+	if b.size > b.imageSize {
+		b.log.Debugf("Padding raw disk image with %d bytes of empty space", b.size-b.imageSize)
+	}
+
+	return nil
+
+}
+
+// writeImage copies the source image to w, seeking over every empty sector so
+// that sparse formats never see data written into a region they were told is
+// a hole.
+func (b *Builder) writeImage(ctx context.Context, w io.WriteSeeker) error {
+
+	_, err := w.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	zeroes := make([]byte, SectorSize)
+	buf := make([]byte, 0x100000)
+
+	for offset := int64(0); offset < b.size; {
+
+		err = ctx.Err()
+		if err != nil {
+			return err
+		}
+
+		n := int64(len(buf))
+		if offset+n > b.size {
+			n = b.size - offset
+		}
+
+		chunk := buf[:n]
+		err = b.readImage(chunk, offset)
+		if err != nil {
+			return err
+		}
+
+		for k := int64(0); k < n; k += SectorSize {
+			sector := chunk[k : k+SectorSize]
+			if offset+k < b.size-SectorSize && bytes.Equal(sector, zeroes) {
+				_, err = w.Seek(SectorSize, io.SeekCurrent)
+			} else {
+				_, err = w.Write(sector)
+			}
+			if err != nil {
+				return err
+			}
+		}
+
+		offset += n
+
+	}
+
+	return nil
+
+}
+
+// readImage fills p with data from the source image starting at offset,
+// treating anything beyond the end of the image as zeroes.
+func (b *Builder) readImage(p []byte, offset int64) error {
+
+	for i := range p {
+		p[i] = 0
+	}
+
+	if offset >= b.imageSize {
+		return nil
+	}
+
+	if offset+int64(len(p)) > b.imageSize {
+		p = p[:b.imageSize-offset]
+	}
+
+	_, err := b.image.ReadAt(p, offset)
+	if err == io.EOF {
+		err = nil
+	}
+
+	return err
+
+}
+
+func (b *Builder) imageRegionIsHole(begin, size int64) bool {
+
+	// the final sector is always written so that formats which simply pass
+	// through to a file still end up with a file of the right size
+	if begin+size > b.size-SectorSize {
+		return false
+	}
+
+	if begin >= b.imageSize {
+		return true
+	}
+
+	if begin+size > b.imageSize {
+		size = b.imageSize - begin
+	}
+
+	n := size
+	if n > 0x100000 {
+		n = 0x100000
+	}
+	buf := make([]byte, n)
+
+	for end := begin + size; begin < end; begin += n {
+		if begin+n > end {
+			n = end - begin
+		}
+
+		err := b.readImage(buf[:n], begin)
+		if err != nil {
+			return false
+		}
+
+		for _, x := range buf[:n] {
+			if x != 0 {
+				return false
+			}
+		}
+	}
+
+	return true
+
+}
@@ -0,0 +1,302 @@
+package vimg
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"debug/pe"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// Measurements are the TPM measurements a disk is expected to produce when it
+// boots, so that operators running Vorteil VMs with a virtual TPM (like
+// swtpm) can write attestation policies without booting the image first.
+//
+// Every digest is a SHA-256. The firmware's own events are the ones SeaBIOS
+// and OVMF log when booting from disk: other firmware may log different
+// actions into PCR 4, in which case the individual events should be replayed
+// against the VM's event log instead of comparing PCR values directly. The
+// kernel layer and its command line are measured into PCRs 9 and 8, as Linux
+// loaders do, but only by loaders that support measured boot.
+//
+// Hybrid disks have a Boot for each firmware.
+type Measurements struct {
+	Algorithm string         `json:"algorithm"`
+	Boots     []MeasuredBoot `json:"boots"`
+}
+
+// MeasuredBoot is the sequence of measurements made booting under one kind of
+// firmware, and the PCR values they produce, starting from zero.
+type MeasuredBoot struct {
+	Firmware string            `json:"firmware"`
+	Events   []MeasuredEvent   `json:"events"`
+	PCRs     map[string]string `json:"pcrs"`
+}
+
+// MeasuredEvent is a single measurement, named after the TCG event type that
+// logs it.
+type MeasuredEvent struct {
+	PCR         int    `json:"pcr"`
+	Type        string `json:"type"`
+	Description string `json:"description"`
+	Digest      string `json:"digest"`
+}
+
+// Write writes the measurements to w as JSON.
+func (m *Measurements) Write(w io.Writer) error {
+
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(append(data, '\n'))
+	return err
+
+}
+
+func (mb *MeasuredBoot) measure(pcr int, typ, desc string, digest []byte) {
+	mb.Events = append(mb.Events, MeasuredEvent{
+		PCR:         pcr,
+		Type:        typ,
+		Description: desc,
+		Digest:      hex.EncodeToString(digest),
+	})
+}
+
+func (mb *MeasuredBoot) measureData(pcr int, typ, desc string, data []byte) {
+	digest := sha256.Sum256(data)
+	mb.measure(pcr, typ, desc, digest[:])
+}
+
+func (mb *MeasuredBoot) action(pcr int, typ, action string) {
+	mb.measureData(pcr, typ, action, []byte(action))
+}
+
+func (mb *MeasuredBoot) separator(pcr int) {
+	mb.measureData(pcr, "EV_SEPARATOR", "separator", []byte{0, 0, 0, 0})
+}
+
+// replay extends every event into a zeroed PCR bank, in order.
+func (mb *MeasuredBoot) replay() error {
+
+	pcrs := make(map[int][]byte)
+	for _, ev := range mb.Events {
+		digest, err := hex.DecodeString(ev.Digest)
+		if err != nil {
+			return err
+		}
+
+		pcr, ok := pcrs[ev.PCR]
+		if !ok {
+			pcr = make([]byte, sha256.Size)
+		}
+
+		x := sha256.Sum256(append(pcr, digest...))
+		pcrs[ev.PCR] = x[:]
+	}
+
+	mb.PCRs = make(map[string]string)
+	for k, v := range pcrs {
+		mb.PCRs[fmt.Sprintf("%d", k)] = hex.EncodeToString(v)
+	}
+
+	return nil
+
+}
+
+// Measurements returns the measurements the disk is expected to produce when
+// it boots. It can only be called after a successful call to Build.
+func (b *Builder) Measurements() (*Measurements, error) {
+
+	if b.image != nil || b.dataDisk != "" {
+		return nil, errors.New("only bootable disks built from a package can be measured")
+	}
+
+	if b.kernelDigest == nil {
+		return nil, errors.New("the disk hasn't been built yet")
+	}
+
+	m := &Measurements{
+		Algorithm: "sha256",
+	}
+
+	var boots []*MeasuredBoot
+
+	if b.bios() {
+		mb, err := b.measureBIOSBoot()
+		if err != nil {
+			return nil, err
+		}
+		boots = append(boots, mb)
+	}
+
+	if b.uefi() {
+		mb, err := b.measureUEFIBoot()
+		if err != nil {
+			return nil, err
+		}
+		boots = append(boots, mb)
+	}
+
+	for _, mb := range boots {
+		mb.measureData(8, "EV_IPL", "kernel command line", []byte(b.linuxArgs))
+		mb.measure(9, "EV_IPL", fmt.Sprintf("kernel %s", b.kernel), b.kernelDigest)
+
+		err := mb.replay()
+		if err != nil {
+			return nil, err
+		}
+
+		m.Boots = append(m.Boots, *mb)
+	}
+
+	return m, nil
+
+}
+
+func (b *Builder) measureBIOSBoot() (*MeasuredBoot, error) {
+
+	buf := new(bytes.Buffer)
+	mbr := b.protectiveMBR()
+
+	err := binary.Write(buf, binary.LittleEndian, &mbr)
+	if err != nil {
+		return nil, err
+	}
+	data := buf.Bytes()
+
+	mb := &MeasuredBoot{Firmware: "bios"}
+	mb.action(4, "EV_ACTION", "Calling INT 19h")
+	for pcr := 0; pcr < 8; pcr++ {
+		mb.separator(pcr)
+	}
+	mb.action(4, "EV_ACTION", "Booting BCV device 80h (HDD)")
+	mb.measureData(4, "EV_IPL", "MBR", data[:440])
+	mb.measureData(5, "EV_IPL_PARTITION_DATA", "MBR PARTITION_TABLE", data[440:])
+
+	return mb, nil
+
+}
+
+func (b *Builder) measureUEFIBoot() (*MeasuredBoot, error) {
+
+	// firmware boots the loader, and the loader boots its neighbours
+	files := make([]*espFile, len(b.espFiles))
+	copy(files, b.espFiles)
+	sort.SliceStable(files, func(i, j int) bool {
+		return files[i].name == ESPLoader && files[j].name != ESPLoader
+	})
+
+	mb := &MeasuredBoot{Firmware: "uefi"}
+	mb.action(4, "EV_EFI_ACTION", "Calling EFI Application from Boot Option")
+	for pcr := 0; pcr < 8; pcr++ {
+		mb.separator(pcr)
+	}
+
+	for _, f := range files {
+		name := f.name
+		if !isEFIBinary(name) {
+			continue
+		}
+
+		digest, err := authenticodeDigest(f.data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to measure %s: %v", name, err)
+		}
+
+		mb.measure(4, "EV_EFI_BOOT_SERVICES_APPLICATION", `\EFI\BOOT\`+name, digest)
+	}
+
+	return mb, nil
+
+}
+
+// authenticodeDigest returns the Authenticode hash of a PE image, which is
+// what UEFI firmware measures when it loads one. Unlike a plain hash it
+// doesn't change when the image is signed.
+func authenticodeDigest(data []byte) ([]byte, error) {
+
+	f, err := pe.NewFile(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) < 0x40 {
+		return nil, errors.New("truncated pe header")
+	}
+
+	// the checksum and certificate table directory entry are skipped, and
+	// their offsets depend on the optional header's format
+	optOffset := int64(binary.LittleEndian.Uint32(data[0x3C:])) + 4 + 20
+
+	var headersSize, dirOffset int64
+	var certs pe.DataDirectory
+	switch oh := f.OptionalHeader.(type) {
+	case *pe.OptionalHeader32:
+		headersSize = int64(oh.SizeOfHeaders)
+		dirOffset = optOffset + 96
+		if oh.NumberOfRvaAndSizes > pe.IMAGE_DIRECTORY_ENTRY_SECURITY {
+			certs = oh.DataDirectory[pe.IMAGE_DIRECTORY_ENTRY_SECURITY]
+		}
+	case *pe.OptionalHeader64:
+		headersSize = int64(oh.SizeOfHeaders)
+		dirOffset = optOffset + 112
+		if oh.NumberOfRvaAndSizes > pe.IMAGE_DIRECTORY_ENTRY_SECURITY {
+			certs = oh.DataDirectory[pe.IMAGE_DIRECTORY_ENTRY_SECURITY]
+		}
+	default:
+		return nil, errors.New("missing pe optional header")
+	}
+
+	checksumOffset := optOffset + 64
+	certsEntryOffset := dirOffset + pe.IMAGE_DIRECTORY_ENTRY_SECURITY*8
+
+	if headersSize > int64(len(data)) || certsEntryOffset+8 > headersSize {
+		return nil, errors.New("truncated pe header")
+	}
+
+	h := sha256.New()
+	h.Write(data[:checksumOffset])
+	h.Write(data[checksumOffset+4 : certsEntryOffset])
+	h.Write(data[certsEntryOffset+8 : headersSize])
+
+	sections := make([]*pe.Section, 0, len(f.Sections))
+	for _, s := range f.Sections {
+		if s.Size > 0 {
+			sections = append(sections, s)
+		}
+	}
+	sort.Slice(sections, func(i, j int) bool {
+		return sections[i].Offset < sections[j].Offset
+	})
+
+	hashed := headersSize
+	for _, s := range sections {
+		end := int64(s.Offset) + int64(s.Size)
+		if end > int64(len(data)) {
+			return nil, fmt.Errorf("truncated pe section %s", s.Name)
+		}
+		h.Write(data[s.Offset:end])
+		hashed += int64(s.Size)
+	}
+
+	// anything after the sections is hashed too, except the signatures
+	end := int64(len(data)) - int64(certs.Size)
+	if hashed < end {
+		h.Write(data[hashed:end])
+	}
+
+	return h.Sum(nil), nil
+
+}
@@ -8,8 +8,8 @@ package vimg
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
 	"encoding/binary"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -35,6 +35,9 @@ var GetKernel func(ctx context.Context, version vkern.CalVer) (*vkern.ManagedBun
 // GetLatestKernel is the function a Builder will use to determine what kernel to use if none is specified. It must be set externally.
 var GetLatestKernel func(ctx context.Context) (vkern.CalVer, error)
 
+// GetKernelLayer is the function a Builder will use to load the kernel layer for a bundle and a set of tags. It is optional, and can be set externally to reuse previously assembled layers between builds.
+var GetKernelLayer func(bundle *vkern.ManagedBundle, tags ...string) (io.ReadCloser, error)
+
 func (b *Builder) prebuildOS(ctx context.Context) error {
 
 	err := b.calculateOSPartitionSize()
@@ -73,6 +76,11 @@ func (b *Builder) calculateMinimumOSPartitionSize(ctx context.Context) error {
 		return err
 	}
 
+	err = b.validateOSFiles()
+	if err != nil {
+		return err
+	}
+
 	err = b.generateConfig()
 	if err != nil {
 		return err
@@ -81,7 +89,7 @@ func (b *Builder) calculateMinimumOSPartitionSize(ctx context.Context) error {
 	sectors := int64(KernelConfigSpaceSectors) // bootloader config
 
 	// kernel size
-	s := b.kernelBundle.Bundle().Size(b.kernelTags...)
+	s := b.kernelBundle.Bundle().Size(b.kernelTags...) + b.osFilesSize
 	s = (s + SectorSize - 1) / SectorSize
 	sectors += s
 
@@ -149,6 +157,9 @@ func (b *Builder) setConfigDefaults() error {
 
 	}
 
+	setHookDefaults(b.vcfg.System.FirstBoot)
+	setHookDefaults(b.vcfg.System.OnShutdown)
+
 	for i := range b.vcfg.Networks {
 
 		n := &b.vcfg.Networks[i]
@@ -178,6 +189,56 @@ func (b *Builder) setConfigDefaults() error {
 	return nil
 }
 
+// setHookDefaults gives hooks the same defaults as programs, other than the
+// output they write to, which always goes to the serial port.
+func setHookDefaults(hooks []vcfg.Hook) {
+
+	for i := range hooks {
+
+		h := &hooks[i]
+
+		if h.Cwd == "" {
+			h.Cwd = "/"
+		}
+
+		if string(h.Privilege) == "" {
+			h.Privilege = vcfg.RootPrivilege
+		}
+
+	}
+
+}
+
+func validPrivilege(p vcfg.Privilege) bool {
+
+	switch p {
+	case vcfg.RootPrivilege, vcfg.SuperuserPrivilege, vcfg.UserPrivilege:
+		return true
+	default:
+		return false
+	}
+
+}
+
+// validateHooks checks the hooks in the VCFG's system.<key>.
+func validateHooks(key string, hooks []vcfg.Hook) error {
+
+	for i, h := range hooks {
+
+		if h.Binary == "" && h.Args == "" {
+			return fmt.Errorf("missing binary and arguments for system.%s hook %d", key, i)
+		}
+
+		if !validPrivilege(h.Privilege) {
+			return fmt.Errorf("invalid privilege setting for system.%s hook %d: %s (should be 'root', 'superuser', or 'user')", key, i, h.Privilege)
+		}
+
+	}
+
+	return nil
+
+}
+
 func (b *Builder) validateConfig() error {
 
 	for i, p := range b.vcfg.Programs {
@@ -186,15 +247,16 @@ func (b *Builder) validateConfig() error {
 			return fmt.Errorf("missing binary and arguments for program %d", i)
 		}
 
-		switch p.Privilege {
-		case vcfg.RootPrivilege:
-		case vcfg.SuperuserPrivilege:
-		case vcfg.UserPrivilege:
-		default:
+		if !validPrivilege(p.Privilege) {
 			return fmt.Errorf("invalid privilege setting for program %d: %s (should be 'root', 'superuser', or 'user')", i, p.Privilege)
 		}
 
-		// TODO: validate bootstrap?
+		for _, step := range p.Bootstrap {
+			err := vcfg.ValidateBootstrap(step)
+			if err != nil {
+				return fmt.Errorf("invalid bootstrap for program %d: %v", i, err)
+			}
+		}
 
 		// Validate Terminate Signal
 		if err := p.Terminate.Validate(); err != nil {
@@ -202,6 +264,33 @@ func (b *Builder) validateConfig() error {
 		}
 	}
 
+	err := validateHooks("first-boot", b.vcfg.System.FirstBoot)
+	if err != nil {
+		return err
+	}
+
+	err = validateHooks("on-shutdown", b.vcfg.System.OnShutdown)
+	if err != nil {
+		return err
+	}
+
+	for i := range b.vcfg.Sync {
+
+		s := &b.vcfg.Sync[i]
+
+		err = s.Validate()
+		if err != nil {
+			return fmt.Errorf("invalid sync %d: %w", i, err)
+		}
+
+		for j := 0; j < i; j++ {
+			if s.Overlaps(&b.vcfg.Sync[j]) {
+				return fmt.Errorf("sync %d and sync %d have overlapping paths", j, i)
+			}
+		}
+
+	}
+
 	for i, n := range b.vcfg.Networks {
 
 		if n.IP == "dhcp" {
@@ -241,19 +330,45 @@ func (b *Builder) generateConfig() error {
 		return err
 	}
 
-	err = b.validateConfig()
-	if err != nil {
-		return err
+	for i := range b.vcfg.Logging {
+		err = b.vcfg.Logging[i].Expand()
+		if err != nil {
+			return fmt.Errorf("invalid logging %d: %w", i, err)
+		}
+	}
+
+	for i := range b.vcfg.NFS {
+		err = b.vcfg.NFS[i].Expand()
+		if err != nil {
+			return fmt.Errorf("invalid nfs %d: %w", i, err)
+		}
+	}
+
+	for i := range b.vcfg.SMB {
+		err = b.vcfg.SMB[i].Expand()
+		if err != nil {
+			return fmt.Errorf("invalid smb %d: %w", i, err)
+		}
 	}
 
-	data, err := json.Marshal(b.vcfg)
+	err = b.validateConfig()
 	if err != nil {
 		return err
 	}
 
-	b.configData = data
+	// the config is stored unencrypted on the OS partition, so the secrets
+	// protecting the root partition must never end up in it
+	cfg := *b.vcfg
+	cfg.System.Encryption = vcfg.EncryptionSettings{}
 
-	return nil
+	// the real expansion info can't be known until the disk's layout is,
+	// but space for it has to be reserved now
+	var expand *ExpansionInfo
+	if cfg.System.ExpandFilesystem {
+		expand = b.expansionPlaceholder()
+	}
+
+	return b.marshalConfig(&cfg, expand)
 }
 
 // BootloaderConfig is the structure of the bootloader config as it appears on the disk.
@@ -319,11 +434,23 @@ func (b *Builder) writeKernel(ctx context.Context, w io.WriteSeeker) error {
 
 	b.log.Debugf("Using kernel from filepath: %s", kern.Location())
 
-	rdr := kern.Bundle().Reader(b.kernelTags...)
-	_, err = io.Copy(w, rdr)
+	var rdr io.ReadCloser
+	if GetKernelLayer != nil {
+		rdr, err = GetKernelLayer(kern, b.kernelTags...)
+		if err != nil {
+			return err
+		}
+	} else {
+		rdr = kern.Bundle().Reader(b.kernelTags...)
+	}
+	defer rdr.Close()
+
+	h := sha256.New()
+	err = b.writeKernelLayer(ctx, io.MultiWriter(w, h), rdr)
 	if err != nil {
 		return err
 	}
+	b.kernelDigest = h.Sum(nil)
 
 	return nil
 
@@ -489,7 +616,11 @@ func (b *Builder) processLinuxArgs() error {
 	_, ok1 := m["ro"]
 	_, ok2 := m["rw"]
 	if !ok1 && !ok2 {
-		args = append(args, "rw")
+		if b.vcfg.System.Verity || b.vcfg.System.OverlaySize != 0 || b.vcfg.System.Filesystem.ReadOnly() {
+			args = append(args, "ro")
+		} else {
+			args = append(args, "rw")
+		}
 	}
 
 	// if the fs is not set here we assume it is ext2
@@ -500,6 +631,10 @@ func (b *Builder) processLinuxArgs() error {
 
 	args = append(args, fmt.Sprintf("rootfstype=%s", fs))
 
+	if _, ok := m["overlay"]; !ok {
+		args = append(args, b.overlayArgs(fs)...)
+	}
+
 	if _, ok := m["loglevel"]; !ok {
 		args = append(args, "loglevel=4")
 	}
@@ -516,7 +651,13 @@ func (b *Builder) processLinuxArgs() error {
 	}
 
 	if _, ok := m["root"]; !ok {
-		args = append(args, fmt.Sprintf("root=PARTUUID=%s", Part2UUIDString))
+		if b.vcfg.System.Verity {
+			// the dm-mod.create argument for this device is added once the
+			// root hash is known
+			args = append(args, fmt.Sprintf("root=%s", verityDevice))
+		} else {
+			args = append(args, fmt.Sprintf("root=PARTUUID=%s", RootPartitionUUID(b.vcfg)))
+		}
 	}
 
 	args = append(args, "i8042.noaux i8042.nomux i8042.nopnp i8042.dumbkbd vt.color=0x00")
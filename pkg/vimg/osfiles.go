@@ -0,0 +1,155 @@
+package vimg
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/vorteil/vorteil/pkg/vio"
+)
+
+// maxOSFileName is the longest name an extra OS partition file can have,
+// which is the longest that fits in a single ustar header.
+const maxOSFileName = 100
+
+// validateOSFiles checks the extra files that were requested for the OS
+// partition, which are appended to the kernel layer as tar entries, and
+// calculates the space they need. It must be called after the kernel has been
+// loaded.
+func (b *Builder) validateOSFiles() error {
+
+	b.osFilesSize = 0
+
+	if b.osFiles == nil {
+		return nil
+	}
+
+	reserved := make(map[string]bool)
+	for _, name := range b.kernelBundle.Bundle().FilesList(b.kernelTags...) {
+		reserved[name] = true
+	}
+
+	return b.osFiles.Walk(func(path string, f vio.File) error {
+
+		name := osFileName(path, f)
+		if name == "" {
+			return nil
+		}
+
+		if len(name) > maxOSFileName {
+			return fmt.Errorf("os file '%s' has a name longer than %d bytes", path, maxOSFileName)
+		}
+
+		if reserved[strings.TrimSuffix(name, "/")] {
+			return fmt.Errorf("os file '%s' conflicts with a file in the kernel bundle", path)
+		}
+
+		if f.IsSymlink() {
+			return fmt.Errorf("os file '%s' is a symlink, which isn't supported", path)
+		}
+
+		b.osFilesSize += SectorSize
+		if !f.IsDir() {
+			b.osFilesSize += int64(f.Size()+SectorSize-1) / SectorSize * SectorSize
+		}
+
+		return nil
+
+	})
+
+}
+
+// osFileName returns the name of a file in the OS partition tar archive,
+// which is relative and has a trailing slash if it's a directory. The root
+// directory has no name.
+func osFileName(path string, f vio.File) string {
+
+	name := strings.TrimPrefix(strings.TrimPrefix(path, "."), "/")
+	if name == "" {
+		return ""
+	}
+
+	if f.IsDir() {
+		name += "/"
+	}
+
+	return name
+
+}
+
+// writeKernelLayer writes the kernel layer followed by the extra OS files, as
+// a single tar archive.
+func (b *Builder) writeKernelLayer(ctx context.Context, w io.Writer, layer io.Reader) error {
+
+	if b.osFilesSize == 0 {
+		_, err := io.Copy(w, layer)
+		return err
+	}
+
+	// copy everything but the two empty blocks that end the archive, so that
+	// the extra files are part of it
+	size := b.kernelBundle.Bundle().Size(b.kernelTags...) - 2*SectorSize
+	_, err := io.CopyN(w, layer, size)
+	if err != nil {
+		return err
+	}
+
+	tw := tar.NewWriter(w)
+
+	err = b.osFiles.Walk(func(path string, f vio.File) error {
+
+		err := ctx.Err()
+		if err != nil {
+			return err
+		}
+
+		name := osFileName(path, f)
+		if name == "" {
+			return nil
+		}
+
+		hdr := &tar.Header{
+			Name:    name,
+			Mode:    0644,
+			ModTime: f.ModTime().Truncate(time.Second),
+			Format:  tar.FormatUSTAR,
+		}
+
+		if f.IsDir() {
+			hdr.Typeflag = tar.TypeDir
+			hdr.Mode = 0755
+		} else {
+			hdr.Typeflag = tar.TypeReg
+			hdr.Size = int64(f.Size())
+		}
+
+		err = tw.WriteHeader(hdr)
+		if err != nil {
+			return err
+		}
+
+		if !f.IsDir() {
+			_, err = io.Copy(tw, f)
+			if err != nil {
+				return err
+			}
+		}
+
+		return f.Close()
+
+	})
+	if err != nil {
+		return err
+	}
+
+	return tw.Close()
+
+}
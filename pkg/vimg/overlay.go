@@ -0,0 +1,53 @@
+package vimg
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"fmt"
+
+	"github.com/vorteil/vorteil/pkg/vcfg"
+)
+
+// OverlayLabel is the GPT name of the writable partition overlaid on the
+// root file-system when system.overlay-size is set. The guest finds it by
+// this label.
+const OverlayLabel = "vorteil-overlay"
+
+// The directories on the overlay partition used for overlayfs's upper and
+// work directories.
+const (
+	OverlayUpperDir = "upper"
+	OverlayWorkDir  = "work"
+)
+
+// overlayArgs returns the kernel arguments that tell the guest's init to
+// overlay the writable partition on the read-only root file-system, in the
+// same form as the root and rootfstype arguments.
+func (b *Builder) overlayArgs(fs vcfg.Filesystem) []string {
+
+	if b.vcfg.System.OverlaySize == 0 {
+		return nil
+	}
+
+	// the overlay uses the root file-system's type unless it has its own,
+	// or the root file-system can't be written to
+	switch b.vcfg.System.OverlayFilesystem {
+	case "":
+		if fs.ReadOnly() {
+			fs = vcfg.Ext2FS
+		}
+	case "ext":
+		fs = "ext2"
+	default:
+		fs = b.vcfg.System.OverlayFilesystem
+	}
+
+	return []string{
+		fmt.Sprintf("overlay=PARTLABEL=%s", OverlayLabel),
+		fmt.Sprintf("overlayfstype=%s", fs),
+	}
+
+}
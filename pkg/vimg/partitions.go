@@ -9,9 +9,13 @@ import (
 	"bytes"
 	"context"
 	"encoding/binary"
+	"fmt"
 	"hash/crc32"
 	"io"
+	"strings"
 
+	"github.com/google/uuid"
+	"github.com/vorteil/vorteil/pkg/vcfg"
 	"github.com/vorteil/vorteil/pkg/vio"
 )
 
@@ -52,6 +56,80 @@ var (
 	Part2UUIDString = "4048447D-C09D-D111-B245-5FFDCE74FAD2"
 )
 
+// RootPartitionUUID returns the PARTUUID of the root file-system partition of
+// disks built using cfg, as it should appear in the kernel's "root" argument.
+func RootPartitionUUID(cfg *vcfg.VCFG) string {
+
+	if cfg != nil && cfg.System.RootPartitionGUID != "" {
+		u, err := uuid.Parse(cfg.System.RootPartitionGUID)
+		if err == nil {
+			return strings.ToUpper(u.String())
+		}
+	}
+
+	return Part2UUIDString
+
+}
+
+// parseGUID converts a GUID string into the mixed-endian form used by the GPT.
+func parseGUID(s string) ([]byte, error) {
+
+	u, err := uuid.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 16)
+	copy(buf, u[:])
+
+	// the first three fields are stored little-endian
+	buf[0], buf[1], buf[2], buf[3] = u[3], u[2], u[1], u[0]
+	buf[4], buf[5] = u[5], u[4]
+	buf[6], buf[7] = u[7], u[6]
+
+	return buf, nil
+
+}
+
+func (b *Builder) validateGUIDArgs() error {
+
+	err := b.setGUIDs(b.guidArgs)
+	if err != nil {
+		return err
+	}
+
+	guids := []struct {
+		field string
+		value string
+		key   string
+	}{
+		{"system.disk-guid", b.vcfg.System.DiskGUID, diskGUIDKey},
+		{"system.os-partition-guid", b.vcfg.System.OSPartitionGUID, OSPartitionLabel},
+		{"system.root-partition-guid", b.vcfg.System.RootPartitionGUID, RootPartitionLabel},
+	}
+
+	for _, x := range guids {
+		if x.value == "" {
+			continue
+		}
+
+		guid, err := parseGUID(x.value)
+		if err != nil {
+			return fmt.Errorf("invalid %s '%s': %v", x.field, x.value, err)
+		}
+
+		b.fixedGUIDs[x.key] = guid
+	}
+
+	b.rootPartitionGUID = b.fixedGUIDs[RootPartitionLabel]
+	if b.rootPartitionGUID == nil {
+		b.rootPartitionGUID = Part2UUID
+	}
+
+	return nil
+
+}
+
 func (b *Builder) writeGPT(ctx context.Context, w io.WriteSeeker) error {
 
 	err := b.writeMBR(ctx, w)
@@ -91,11 +169,37 @@ func (b *Builder) writeSecondaryGPT(ctx context.Context, w io.WriteSeeker) error
 
 func (b *Builder) writePartitionsContents(ctx context.Context, w io.WriteSeeker) error {
 
+	if b.dataDisk != "" {
+		return b.writeRoot(ctx, w)
+	}
+
+	if b.vcfg.System.Verity {
+		err := b.compileVerityRoot(ctx)
+		if err != nil {
+			return err
+		}
+	}
+
 	err := b.writeOS(ctx, w)
 	if err != nil {
 		return err
 	}
 
+	err = b.writeESP(ctx, w)
+	if err != nil {
+		return err
+	}
+
+	err = b.writeExtraPartitions(ctx, w)
+	if err != nil {
+		return err
+	}
+
+	err = b.writeSwap(ctx, w)
+	if err != nil {
+		return err
+	}
+
 	err = b.writeRoot(ctx, w)
 	if err != nil {
 		return err
@@ -154,6 +258,21 @@ func (b *Builder) writeMBR(ctx context.Context, w io.WriteSeeker) error {
 		return err
 	}
 
+	mbr := b.protectiveMBR()
+
+	err = binary.Write(w, binary.LittleEndian, &mbr)
+	if err != nil {
+		return err
+	}
+
+	return nil
+
+}
+
+// protectiveMBR returns the disk's protective MBR, with the BIOS bootloader in
+// it if the disk boots under BIOS.
+func (b *Builder) protectiveMBR() ProtectiveMBR {
+
 	mbr := ProtectiveMBR{
 		Status:        0x7F,
 		PartitionType: 0xEE,
@@ -162,14 +281,12 @@ func (b *Builder) writeMBR(ctx context.Context, w io.WriteSeeker) error {
 		TotalSectors:  uint32(b.size/SectorSize) - 1,
 	}
 
-	copy(mbr.Bootloader[:], Bootloader)
-
-	err = binary.Write(w, binary.LittleEndian, &mbr)
-	if err != nil {
-		return err
+	// data disks aren't bootable, and uefi disks aren't booted by the mbr
+	if b.dataDisk == "" && b.bios() {
+		copy(mbr.Bootloader[:], Bootloader)
 	}
 
-	return nil
+	return mbr
 
 }
 
@@ -198,7 +315,7 @@ type GPTEntry struct {
 	PartitionGUID [16]byte
 	FirstLBA      uint64
 	LastLBA       uint64
-	_             uint64 // attributes
+	Attributes    uint64
 	Name          [72]byte
 }
 
@@ -350,12 +467,12 @@ func (b *Builder) generateUID() ([]byte, error) {
 func (b *Builder) generateGPTEntries() error {
 
 	var err error
-	b.diskUID, err = b.generateUID()
+	b.diskUID, err = b.partitionGUID(diskGUIDKey)
 	if err != nil {
 		return err
 	}
 
-	uid0, err := b.generateUID()
+	uid0, err := b.partitionGUID(OSPartitionLabel)
 	if err != nil {
 		return err
 	}
@@ -368,6 +485,10 @@ func (b *Builder) generateGPTEntries() error {
 	copy(p0.PartitionGUID[:], uid0)
 	copy(p0.Name[:], OSPartitionName)
 
+	if b.uefi() && b.bios() {
+		p0.Attributes = GPTAttributeLegacyBIOSBootable
+	}
+
 	p1 := GPTEntry{
 		TypeGUID: [16]byte{0xE3, 0xBC, 0x68, 0x4F, 0xCD, 0xE8,
 			0xB1, 0x4D, 0x96, 0xE7, 0xFB, 0xCA, 0xF9, 0x84, 0xB7, 0x09}, // Linux x86-64 root filesystem partition
@@ -375,19 +496,75 @@ func (b *Builder) generateGPTEntries() error {
 		LastLBA:  uint64(b.rootLastLBA),
 	}
 
-	copy(p1.PartitionGUID[:], Part2UUID)
+	copy(p1.PartitionGUID[:], b.rootPartitionGUID)
+	b.usedGUIDs[RootPartitionLabel] = b.rootPartitionGUID
 	copy(p1.Name[:], RootPartitionName)
 
 	entriesBuffer := new(bytes.Buffer)
 	_ = binary.Write(entriesBuffer, binary.LittleEndian, p0)
 	_ = binary.Write(entriesBuffer, binary.LittleEndian, p1)
 
-	b.gptEntries = entriesBuffer.Bytes()
+	if b.vcfg.System.Verity {
+		b.verityPartitionUID, err = b.partitionGUID(VerityPartitionLabel)
+		if err != nil {
+			return err
+		}
+
+		typeGUID, _ := parseGUID(VerityPartitionType)
+
+		p2 := GPTEntry{
+			FirstLBA: uint64(b.verityFirstLBA),
+			LastLBA:  uint64(b.verityLastLBA),
+		}
+
+		copy(p2.TypeGUID[:], typeGUID)
+		copy(p2.PartitionGUID[:], b.verityPartitionUID)
+		copy(p2.Name[:], VerityPartitionName)
+
+		_ = binary.Write(entriesBuffer, binary.LittleEndian, p2)
+	}
+
+	if b.uefi() {
+		p3, err := b.generateESPEntry()
+		if err != nil {
+			return err
+		}
+
+		_ = binary.Write(entriesBuffer, binary.LittleEndian, p3)
+	}
+
+	extras, err := b.generateExtraPartitionEntries()
+	if err != nil {
+		return err
+	}
+
+	for _, p := range extras {
+		_ = binary.Write(entriesBuffer, binary.LittleEndian, p)
+	}
+
+	if b.swapSize > 0 {
+		p, err := b.generateSwapEntry()
+		if err != nil {
+			return err
+		}
+
+		_ = binary.Write(entriesBuffer, binary.LittleEndian, p)
+	}
+
+	b.setGPTEntries(entriesBuffer.Bytes())
+
+	return nil
+}
+
+// setGPTEntries records the encoded GPT entries and their checksum, which
+// covers the empty entries that follow them as well.
+func (b *Builder) setGPTEntries(entries []byte) {
+
+	b.gptEntries = entries
 
 	crc := crc32.NewIEEE()
 	_, _ = io.Copy(crc, bytes.NewReader(b.gptEntries))
 	_, _ = io.CopyN(crc, vio.Zeroes, MaximumGPTEntries*GPTEntrySize-int64(len(b.gptEntries)))
 	b.gptEntriesCRC = crc.Sum32()
 
-	return nil
 }
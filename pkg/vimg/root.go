@@ -7,9 +7,14 @@ package vimg
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
 
+	"github.com/vorteil/vorteil/pkg/luks"
 	"github.com/vorteil/vorteil/pkg/vcfg"
+	"github.com/vorteil/vorteil/pkg/verity"
 	"github.com/vorteil/vorteil/pkg/vio"
 )
 
@@ -20,10 +25,27 @@ func (b *Builder) prebuildRoot(ctx context.Context) error {
 		return err
 	}
 
-	b.rootFirstLBA = b.osLastLBA + 1
+	lba := b.osLastLBA + 1
+	if b.uefi() {
+		lba = b.espLastLBA + 1
+	}
+
+	lba, err = b.prebuildExtraPartitions(ctx, lba)
+	if err != nil {
+		return err
+	}
+
+	b.rootFirstLBA = b.prebuildSwap(lba)
 	b.rootLastLBA = b.lastUsableLBA
 
 	size := (b.rootLastLBA - b.rootFirstLBA + 1) * SectorSize
+	if b.encryptionKey != nil {
+		size -= luks.PayloadOffset
+	}
+
+	if b.vcfg.System.Verity {
+		size = b.prebuildVerity()
+	}
 
 	err = b.fs.Precompile(ctx, size)
 	if err != nil {
@@ -45,6 +67,14 @@ func (b *Builder) writeRoot(ctx context.Context, w io.WriteSeeker) error {
 		return err
 	}
 
+	if b.encryptionKey != nil {
+		return b.writeEncryptedRoot(ctx, ws)
+	}
+
+	if b.verityTree != nil {
+		return b.writeVerityRoot(ctx, ws)
+	}
+
 	err = b.fs.Compile(ctx, ws)
 	if err != nil {
 		return err
@@ -54,12 +84,86 @@ func (b *Builder) writeRoot(ctx context.Context, w io.WriteSeeker) error {
 
 }
 
+func (b *Builder) writeEncryptedRoot(ctx context.Context, w io.WriteSeeker) error {
+
+	lw, err := luks.NewWriter(w, (b.rootLastLBA-b.rootFirstLBA+1)*SectorSize, &luks.Options{
+		Key:   b.encryptionKey,
+		Label: b.vcfg.System.FilesystemLabel,
+	})
+	if err != nil {
+		return err
+	}
+
+	ws, err := vio.WriteSeeker(lw)
+	if err != nil {
+		return err
+	}
+
+	err = b.fs.Compile(ctx, ws)
+	if err != nil {
+		return err
+	}
+
+	return lw.Close()
+
+}
+
 func (b *Builder) rootRegionIsHole(begin, size int64) bool {
+
+	// encrypted empty space isn't empty
+	if b.encryptionKey != nil {
+		return false
+	}
+
 	return b.fs.RegionIsHole(begin, size)
 }
 
+func (b *Builder) validateEncryptionArgs() error {
+
+	cfg := &b.vcfg.System.Encryption
+	if !cfg.Enabled() {
+		return nil
+	}
+
+	if cfg.Passphrase != "" && cfg.KeyFile != "" {
+		return errors.New("system.encryption accepts either a passphrase or a key-file, not both")
+	}
+
+	if cfg.Passphrase != "" {
+		b.encryptionKey = []byte(cfg.Passphrase)
+		return nil
+	}
+
+	key, err := ioutil.ReadFile(cfg.KeyFile)
+	if err != nil {
+		return fmt.Errorf("failed to read system.encryption key-file: %w", err)
+	}
+
+	if len(key) == 0 {
+		return fmt.Errorf("system.encryption key-file '%s' is empty", cfg.KeyFile)
+	}
+
+	b.encryptionKey = key
+	return nil
+
+}
+
 func (b *Builder) validateRootArgs() error {
 
+	err := b.validateEncryptionArgs()
+	if err != nil {
+		return err
+	}
+
+	err = b.validateVerityArgs()
+	if err != nil {
+		return err
+	}
+
+	if fs := b.vcfg.System.Filesystem; fs.ReadOnly() && len(b.vcfg.System.FirstBoot) > 0 && b.vcfg.System.OverlaySize == 0 {
+		return fmt.Errorf("system.first-boot needs a writable root file-system to record that it has run, so the '%s' file-system needs system.overlay-size", fs)
+	}
+
 	// inject files/directories here
 	for _, dir := range []string{"dev", "vorteil", "tmp", "proc", "sys"} {
 		err := b.fs.Mkdir(dir)
@@ -102,6 +206,12 @@ func (b *Builder) calculateMinimumRootSize(ctx context.Context) error {
 	}
 
 	b.minSize += b.fs.MinimumSize()
+	if b.encryptionKey != nil {
+		b.minSize += luks.PayloadOffset
+	}
+	if b.vcfg.System.Verity {
+		b.minSize += verity.HashDeviceSize(b.fs.MinimumSize()) + verity.BlockSize
+	}
 	progress.Finish(true)
 
 	return nil
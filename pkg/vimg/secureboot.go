@@ -0,0 +1,104 @@
+package vimg
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Signer signs the EFI binaries that are written to the EFI system partition
+// of a disk, so that it passes Secure Boot validation on hosts that trust the
+// signer's certificate. Sign is given the name of a binary and its contents,
+// and returns the signed contents.
+type Signer interface {
+	Sign(ctx context.Context, name string, data []byte) ([]byte, error)
+}
+
+// SBSign is a Signer that signs binaries with the sbsign tool, using the
+// private key and certificate in the files named by Key and Cert. Path is
+// the sbsign executable, which is looked up on the PATH if it is empty.
+type SBSign struct {
+	Key  string
+	Cert string
+	Path string
+}
+
+// Sign signs data with sbsign.
+func (s *SBSign) Sign(ctx context.Context, name string, data []byte) ([]byte, error) {
+
+	path := s.Path
+	if path == "" {
+		path = "sbsign"
+	}
+
+	dir, err := ioutil.TempDir("", "vorteil-sbsign-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	in := filepath.Join(dir, "unsigned")
+	out := filepath.Join(dir, "signed")
+
+	err = ioutil.WriteFile(in, data, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	stderr := new(bytes.Buffer)
+	cmd := exec.CommandContext(ctx, path, "--key", s.Key, "--cert", s.Cert, "--output", out, in)
+	cmd.Stderr = stderr
+
+	err = cmd.Run()
+	if err != nil {
+		msg := strings.TrimSpace(stderr.String())
+		if msg != "" {
+			return nil, fmt.Errorf("failed to sign %s: %v: %s", name, err, msg)
+		}
+		return nil, fmt.Errorf("failed to sign %s: %v", name, err)
+	}
+
+	return ioutil.ReadFile(out)
+
+}
+
+// isEFIBinary returns true if the ESP file with the given name is an EFI
+// application that firmware or the loader will verify.
+func isEFIBinary(name string) bool {
+	return strings.EqualFold(filepath.Ext(name), ".efi")
+}
+
+func (b *Builder) validateSecureBootArgs() error {
+
+	if b.signer != nil && !b.uefi() {
+		return errors.New("signing for secure boot needs system.boot-mode to be 'uefi' or 'hybrid'")
+	}
+
+	return nil
+
+}
+
+// signESPFile returns the contents of the named ESP file, signed if it's an
+// EFI binary and the Builder has a Signer.
+func (b *Builder) signESPFile(ctx context.Context, name string, data []byte) ([]byte, error) {
+
+	if b.signer == nil || !isEFIBinary(name) {
+		return data, nil
+	}
+
+	b.log.Debugf("Signing %s for secure boot", name)
+
+	return b.signer.Sign(ctx, name, data)
+
+}
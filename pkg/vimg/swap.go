@@ -0,0 +1,203 @@
+package vimg
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/vorteil/vorteil/pkg/vcfg"
+)
+
+// Linux swap area constants.
+const (
+	SwapPageSize = 4096
+	SwapMinPages = 10
+	SwapMagic    = "SWAPSPACE2"
+	SwapLabel    = "vorteil-swap"
+)
+
+var (
+	// SwapPartitionName is the hardcoded name for the swap partition in the GPT.
+	SwapPartitionName = partitionName(SwapLabel)
+
+	// SwapPartitionType is the GPT partition type of the swap partition.
+	SwapPartitionType = "0657FD6D-A4AB-43C4-84E5-0933C84B4F4F" // Linux swap
+)
+
+// SwapInfo tells the guest's init which partition to enable as swap space. It
+// is only included in the kernel config if vm.swap-size is set.
+type SwapInfo struct {
+	Partition int    `json:"partition"`
+	Size      int64  `json:"size"`
+	Label     string `json:"label"`
+}
+
+// swapHeader is the structure of the header in the first page of a Linux swap
+// area, after the 1024 bytes reserved for boot code.
+type swapHeader struct {
+	Version    uint32
+	LastPage   uint32
+	NrBadPages uint32
+	UUID       [16]byte
+	VolumeName [16]byte
+}
+
+func (b *Builder) validateSwapArgs() error {
+
+	size := b.vcfg.VM.SwapSize
+	if size == 0 {
+		return nil
+	}
+
+	if size.IsDelta() {
+		return errors.New("vm.swap-size cannot be a delta")
+	}
+
+	if int64(size) < SwapMinPages*SwapPageSize {
+		return fmt.Errorf("vm.swap-size must be at least %s", vcfg.Bytes(SwapMinPages*SwapPageSize))
+	}
+
+	b.swapSize = (int64(size) + SwapPageSize - 1) / SwapPageSize * SwapPageSize
+
+	return nil
+
+}
+
+func (b *Builder) calculateMinimumSwapSize() {
+	b.minSize += b.swapSize
+}
+
+// swapPartitionIndex returns the index of the swap partition in the GPT
+// entries, which follows every other optional partition.
+func (b *Builder) swapPartitionIndex() int {
+
+	idx := rootPartitionIndex + 1 + len(b.extras)
+
+	if b.vcfg.System.Verity {
+		idx++
+	}
+
+	if b.uefi() {
+		idx++
+	}
+
+	return idx
+
+}
+
+func (b *Builder) swapInfo() *SwapInfo {
+
+	if b.swapSize == 0 {
+		return nil
+	}
+
+	return &SwapInfo{
+		Partition: b.swapPartitionIndex(),
+		Size:      b.swapSize,
+		Label:     SwapLabel,
+	}
+
+}
+
+// prebuildSwap lays out the swap partition starting at lba, and returns the
+// first lba after it.
+func (b *Builder) prebuildSwap(lba int64) int64 {
+
+	if b.swapSize == 0 {
+		return lba
+	}
+
+	b.swapFirstLBA = lba
+	b.swapLastLBA = lba + b.swapSize/SectorSize - 1
+
+	return b.swapLastLBA + 1
+
+}
+
+func (b *Builder) generateSwapEntry() (*GPTEntry, error) {
+
+	var err error
+	b.swapPartitionUID, err = b.partitionGUID(SwapLabel)
+	if err != nil {
+		return nil, err
+	}
+
+	typeGUID, _ := parseGUID(SwapPartitionType)
+
+	e := &GPTEntry{
+		FirstLBA: uint64(b.swapFirstLBA),
+		LastLBA:  uint64(b.swapLastLBA),
+	}
+
+	copy(e.TypeGUID[:], typeGUID)
+	copy(e.PartitionGUID[:], b.swapPartitionUID)
+	copy(e.Name[:], SwapPartitionName)
+
+	return e, nil
+
+}
+
+// writeSwap writes the header of the swap area. The rest of the partition is
+// left empty.
+func (b *Builder) writeSwap(ctx context.Context, w io.WriteSeeker) error {
+
+	if b.swapSize == 0 {
+		return nil
+	}
+
+	err := ctx.Err()
+	if err != nil {
+		return err
+	}
+
+	hdr := &swapHeader{
+		Version:  1,
+		LastPage: uint32(b.swapSize/SwapPageSize - 1),
+	}
+
+	copy(hdr.UUID[:], b.swapPartitionUID)
+	copy(hdr.VolumeName[:], SwapLabel)
+
+	page := make([]byte, SwapPageSize)
+	buf := new(bytes.Buffer)
+	err = binary.Write(buf, binary.LittleEndian, hdr)
+	if err != nil {
+		return err
+	}
+	copy(page[1024:], buf.Bytes())
+	copy(page[SwapPageSize-len(SwapMagic):], SwapMagic)
+
+	_, err = w.Seek(b.swapFirstLBA*SectorSize, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(page)
+	if err != nil {
+		return err
+	}
+
+	return nil
+
+}
+
+// swapRegionIsHole returns true if the sectors from first to last are empty
+// space within the swap partition. The second value is false if they aren't
+// within it.
+func (b *Builder) swapRegionIsHole(first, last int64) (bool, bool) {
+
+	if b.swapSize == 0 || first < b.swapFirstLBA || last > b.swapLastLBA {
+		return false, false
+	}
+
+	return first >= b.swapFirstLBA+SwapPageSize/SectorSize, true
+
+}
@@ -0,0 +1,200 @@
+package vimg
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/vorteil/vorteil/pkg/verity"
+	"github.com/vorteil/vorteil/pkg/vio"
+)
+
+var (
+	// VerityPartitionName is the hardcoded name for the dm-verity hash tree partition in the GPT.
+	VerityPartitionName = []byte{0x76, 0x0, 0x6f, 0x0, 0x72, 0x0, 0x74, 0x0, 0x65, 0x0, 0x69, 0x0,
+		0x6c, 0x0, 0x2d, 0x0, 0x76, 0x0, 0x65, 0x0, 0x72, 0x0, 0x69, 0x0, 0x74, 0x0, 0x79, 0x0} // "vorteil-verity" in utf16
+
+	// VerityPartitionType is the GPT partition type of the dm-verity hash tree partition.
+	VerityPartitionType = "2C7357ED-EBD2-46D9-AEC1-23D437EC2BF5" // Linux x86-64 root verity partition
+)
+
+// verityDevice is the device-mapper device the root file-system is mounted
+// from when system.verity is set.
+const verityDevice = "/dev/dm-0"
+
+// formatGUID converts a GUID in the mixed-endian form used by the GPT into a
+// string, as it would appear in a PARTUUID.
+func formatGUID(guid []byte) string {
+
+	var u uuid.UUID
+	copy(u[:], guid)
+
+	u[0], u[1], u[2], u[3] = guid[3], guid[2], guid[1], guid[0]
+	u[4], u[5] = guid[5], guid[4]
+	u[6], u[7] = guid[7], guid[6]
+
+	return strings.ToUpper(u.String())
+
+}
+
+func (b *Builder) validateVerityArgs() error {
+
+	if !b.vcfg.System.Verity {
+		return nil
+	}
+
+	if b.vcfg.System.Encryption.Enabled() {
+		return errors.New("system.verity cannot be combined with system.encryption")
+	}
+
+	if b.vcfg.System.ExpandFilesystem {
+		return errors.New("system.verity cannot be combined with system.expand-fs")
+	}
+
+	if len(b.vcfg.System.FirstBoot) > 0 && b.vcfg.System.OverlaySize == 0 {
+		return errors.New("system.first-boot needs a writable root file-system to record that it has run, so system.verity needs system.overlay-size")
+	}
+
+	return nil
+
+}
+
+// prebuildVerity splits the space after the OS partition between the root
+// file-system and the hash tree that verifies it, and returns the size left
+// for the file-system.
+func (b *Builder) prebuildVerity() int64 {
+
+	size := (b.lastUsableLBA - b.rootFirstLBA + 1) * SectorSize
+	size = verity.DataSize(size)
+
+	b.rootLastLBA = b.rootFirstLBA + size/SectorSize - 1
+	b.verityFirstLBA = b.rootLastLBA + 1
+	b.verityLastLBA = b.lastUsableLBA
+
+	return size
+
+}
+
+// compileVerityRoot compiles the root file-system into a temporary file and
+// builds its hash tree. This has to happen before anything is written,
+// because the root hash is part of the kernel args in the bootloader config.
+func (b *Builder) compileVerityRoot(ctx context.Context) error {
+
+	f, err := ioutil.TempFile("", "vorteil-verity-")
+	if err != nil {
+		return err
+	}
+	b.verityRoot = f
+
+	err = b.fs.Compile(ctx, f)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	salt := make([]byte, 32)
+	_, err = io.ReadFull(b.rng, salt)
+	if err != nil {
+		return err
+	}
+
+	var id [16]byte
+	copy(id[:], b.verityPartitionUID)
+
+	size := (b.rootLastLBA - b.rootFirstLBA + 1) * SectorSize
+	b.verityTree, err = verity.Build(io.MultiReader(f, vio.Zeroes), size, salt, id)
+	if err != nil {
+		return err
+	}
+
+	table := b.verityTree.Table("PARTUUID="+RootPartitionUUID(b.vcfg), "PARTUUID="+formatGUID(b.verityPartitionUID))
+	b.linuxArgs += " " + strconv.Quote(fmt.Sprintf("dm-mod.create=vroot,,,ro,%s", table))
+
+	b.log.Debugf("kernel args: %v", b.linuxArgs)
+
+	return nil
+
+}
+
+// writeVerityRoot copies the compiled root file-system out of its temporary
+// file, skipping over empty blocks, and then writes the hash tree partition.
+func (b *Builder) writeVerityRoot(ctx context.Context, w io.WriteSeeker) error {
+
+	_, err := b.verityRoot.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, verity.BlockSize)
+	zeroes := make([]byte, verity.BlockSize)
+
+	var n int
+	var k int64
+	for {
+		err = ctx.Err()
+		if err != nil {
+			return err
+		}
+
+		n, err = io.ReadFull(b.verityRoot, buf)
+		if err == io.EOF {
+			break
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return err
+		}
+
+		if bytes.Equal(buf[:n], zeroes[:n]) {
+			_, err = w.Seek(int64(n), io.SeekCurrent)
+		} else {
+			_, err = w.Write(buf[:n])
+		}
+		if err != nil {
+			return err
+		}
+		k += int64(n)
+	}
+
+	_, err = w.Seek((b.verityFirstLBA-b.rootFirstLBA)*SectorSize-k, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+
+	_, err = b.verityTree.WriteTo(w)
+	if err != nil {
+		return err
+	}
+
+	return nil
+
+}
+
+func (b *Builder) closeVerityRoot() error {
+
+	if b.verityRoot == nil {
+		return nil
+	}
+
+	b.verityRoot.Close()
+	err := os.Remove(b.verityRoot.Name())
+	b.verityRoot = nil
+
+	return err
+
+}
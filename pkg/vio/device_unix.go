@@ -0,0 +1,32 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package vio
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+func deviceNumbers(fi os.FileInfo) (uint32, uint32) {
+
+	if fi.Mode()&os.ModeDevice == 0 {
+		return 0, 0
+	}
+
+	stat, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0
+	}
+
+	rdev := uint64(stat.Rdev)
+	return unix.Major(rdev), unix.Minor(rdev)
+
+}
@@ -0,0 +1,15 @@
+//go:build windows
+// +build windows
+
+package vio
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import "os"
+
+func deviceNumbers(fi os.FileInfo) (uint32, uint32) {
+	return 0, 0
+}
@@ -50,6 +50,96 @@ type File interface {
 
 	// Symlink returns a non-empty string if the symlink is cached, or an empty string otherwise.
 	Symlink() string
+
+	// Special returns the type of a device node or named pipe
+	// (os.ModeDevice, os.ModeDevice|os.ModeCharDevice, or
+	// os.ModeNamedPipe), or zero if the File is anything else.
+	Special() os.FileMode
+
+	// Device returns the major and minor numbers of a device node.
+	Device() (major, minor uint32)
+
+	// Xattrs returns the file's extended attributes keyed by their full
+	// names, like "security.capability", or nil if it has none.
+	Xattrs() map[string][]byte
+
+	// Ownership returns the file's owner and permissions, or nil if it has
+	// none of its own and should get the file-system's defaults.
+	Ownership() *Ownership
+}
+
+// Ownership is the owner and permissions of a File.
+type Ownership struct {
+	UID uint32
+	GID uint32
+
+	// Mode holds the permission bits the way chmod takes them, including
+	// the setuid, setgid and sticky bits, e.g. 0755 or 04755.
+	Mode uint32
+}
+
+// ModeMask covers the bits of an Ownership's Mode.
+const ModeMask = 07777
+
+// DefaultOwnership is what file-systems give files without an Ownership of
+// their own: they belong to the default user, and nobody else can use them.
+var DefaultOwnership = Ownership{
+	UID:  1000,
+	GID:  1000,
+	Mode: 0700,
+}
+
+// WithOwnership returns a File that is the same as f apart from its
+// ownership, which is replaced with o.
+func WithOwnership(f File, o *Ownership) File {
+
+	major, minor := f.Device()
+
+	return CustomFile(CustomFileArgs{
+		Name:               f.Name(),
+		Size:               f.Size(),
+		ModTime:            f.ModTime(),
+		IsDir:              f.IsDir(),
+		IsSymlink:          f.IsSymlink(),
+		IsSymlinkNotCached: !f.SymlinkIsCached(),
+		Symlink:            f.Symlink(),
+		Special:            f.Special(),
+		Major:              major,
+		Minor:              minor,
+		Xattrs:             f.Xattrs(),
+		Ownership:          o,
+		ReadCloser:         f,
+	})
+
+}
+
+// SpecialTypes are the bits of an os.FileMode that identify device nodes and
+// named pipes.
+const SpecialTypes = os.ModeDevice | os.ModeCharDevice | os.ModeNamedPipe
+
+// openSpecial returns a File for a device node or named pipe, which has no
+// contents to read. Opening a named pipe would block until something writes
+// to it, so it is never opened.
+func openSpecial(path string, fi os.FileInfo) (File, error) {
+
+	major, minor := deviceNumbers(fi)
+
+	xattrs, err := hostXattrs(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return CustomFile(CustomFileArgs{
+		Name:       fi.Name(),
+		ModTime:    fi.ModTime(),
+		Special:    fi.Mode() & SpecialTypes,
+		Major:      major,
+		Minor:      minor,
+		Xattrs:     xattrs,
+		Ownership:  hostOwnership(fi),
+		ReadCloser: ioutil.NopCloser(strings.NewReader("")),
+	}), nil
+
 }
 
 // Open mimics the os.Open function but returns an
@@ -60,6 +150,15 @@ func Open(path string) (File, error) {
 		return nil, err
 	}
 
+	if fi.Mode()&SpecialTypes != 0 {
+		return openSpecial(path, fi)
+	}
+
+	xattrs, err := hostXattrs(path)
+	if err != nil {
+		return nil, err
+	}
+
 	if fi.Mode()&os.ModeSymlink == os.ModeSymlink {
 
 		lpath, err := os.Readlink(path)
@@ -77,6 +176,8 @@ func Open(path string) (File, error) {
 			ModTime:    fi.ModTime(),
 			IsDir:      fi.IsDir(),
 			IsSymlink:  true,
+			Xattrs:     xattrs,
+			Ownership:  hostOwnership(fi),
 			ReadCloser: rc,
 		}), nil
 	}
@@ -92,6 +193,8 @@ func Open(path string) (File, error) {
 		ModTime:    fi.ModTime(),
 		IsDir:      fi.IsDir(),
 		IsSymlink:  false,
+		Xattrs:     xattrs,
+		Ownership:  hostOwnership(fi),
 		ReadCloser: f,
 	}), nil
 }
@@ -106,6 +209,11 @@ type CustomFileArgs struct {
 	IsSymlink          bool
 	IsSymlinkNotCached bool
 	Symlink            string
+	Special            os.FileMode
+	Major              uint32
+	Minor              uint32
+	Xattrs             map[string][]byte
+	Ownership          *Ownership
 	ReadCloser         io.ReadCloser
 }
 
@@ -121,6 +229,11 @@ func CustomFile(args CustomFileArgs) File {
 		isSymlink:       args.IsSymlink,
 		isSymlinkCached: !args.IsSymlinkNotCached,
 		symlink:         args.Symlink,
+		special:         args.Special & SpecialTypes,
+		major:           args.Major,
+		minor:           args.Minor,
+		xattrs:          args.Xattrs,
+		ownership:       args.Ownership,
 		rc:              args.ReadCloser,
 	}
 }
@@ -133,6 +246,11 @@ type customFile struct {
 	isSymlink       bool
 	isSymlinkCached bool
 	symlink         string
+	special         os.FileMode
+	major           uint32
+	minor           uint32
+	xattrs          map[string][]byte
+	ownership       *Ownership
 	rc              io.ReadCloser
 }
 
@@ -164,6 +282,22 @@ func (f *customFile) Symlink() string {
 	return f.symlink
 }
 
+func (f *customFile) Special() os.FileMode {
+	return f.special
+}
+
+func (f *customFile) Device() (major, minor uint32) {
+	return f.major, f.minor
+}
+
+func (f *customFile) Xattrs() map[string][]byte {
+	return f.xattrs
+}
+
+func (f *customFile) Ownership() *Ownership {
+	return f.ownership
+}
+
 func (f *customFile) Read(p []byte) (n int, err error) {
 	return f.rc.Read(p)
 }
@@ -218,6 +352,7 @@ func Info(f File) os.FileInfo {
 	if f.IsSymlink() {
 		mode |= os.ModeSymlink
 	}
+	mode |= f.Special()
 	return &finfo{
 		name:    f.Name(),
 		size:    int64(f.Size()),
@@ -240,6 +375,7 @@ func LazyReadCloser(openFunc func() (io.Reader, error),
 type lazyReadCloser struct {
 	opened    bool
 	closed    bool
+	local     bool
 	r         io.Reader
 	openFunc  func() (io.Reader, error)
 	closeFunc func() error
@@ -280,6 +416,15 @@ func LazyOpen(path string) (File, error) {
 		return nil, err
 	}
 
+	if fi.Mode()&SpecialTypes != 0 {
+		return openSpecial(path, fi)
+	}
+
+	xattrs, err := hostXattrs(path)
+	if err != nil {
+		return nil, err
+	}
+
 	var f *os.File
 	var lpath string
 	var lrdr io.Reader
@@ -336,6 +481,76 @@ func LazyOpen(path string) (File, error) {
 		IsSymlink:          islink,
 		IsSymlinkNotCached: false,
 		Symlink:            lpath,
-		ReadCloser:         LazyReadCloser(openFunc, closeFunc),
+		Xattrs:             xattrs,
+		Ownership:          hostOwnership(fi),
+		ReadCloser: &lazyReadCloser{
+			local:     fi.Mode().IsRegular(),
+			openFunc:  openFunc,
+			closeFunc: closeFunc,
+		},
 	}), nil
 }
+
+// localSource unwraps nested custom files to find the io.ReadCloser that
+// backs a regular file, or returns nil if f isn't a regular file.
+func localSource(f File) io.ReadCloser {
+
+	cf, ok := f.(*customFile)
+	if !ok || cf.isDir || cf.isSymlink || cf.special != 0 {
+		return nil
+	}
+
+	if inner, ok := cf.rc.(File); ok {
+		return localSource(inner)
+	}
+
+	return cf.rc
+
+}
+
+// IsLocalFile returns true if f is a regular file backed by a file on the
+// local file-system, as returned by Open or LazyOpen. It does not open the
+// file.
+func IsLocalFile(f File) bool {
+
+	switch rc := localSource(f).(type) {
+	case *os.File:
+		return true
+	case *lazyReadCloser:
+		return rc.local
+	default:
+		return false
+	}
+
+}
+
+// LocalFile returns the *os.File backing f if IsLocalFile is true, opening
+// it first if necessary. This makes it possible to copy the contents of f
+// with an io.ReaderFrom, which can avoid copying the data through userspace
+// entirely (e.g. using copy_file_range on Linux). The returned file must not
+// be closed directly; close f instead. If f has already been read from,
+// reads from the returned file continue from the same offset.
+func LocalFile(f File) (*os.File, bool) {
+
+	switch rc := localSource(f).(type) {
+	case *os.File:
+		return rc, true
+	case *lazyReadCloser:
+		if !rc.local || rc.closed {
+			return nil, false
+		}
+		if rc.r == nil {
+			r, err := rc.openFunc()
+			if err != nil {
+				return nil, false
+			}
+			rc.r = r
+			rc.opened = true
+		}
+		osf, ok := rc.r.(*os.File)
+		return osf, ok
+	default:
+		return nil, false
+	}
+
+}
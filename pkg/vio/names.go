@@ -0,0 +1,158 @@
+package vio
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"fmt"
+	unixpath "path"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"unicode"
+)
+
+// Windows hosts treat file names differently to the Linux guest: paths use
+// backslashes, names are case-insensitive, some names are reserved for devices
+// and trailing dots and spaces are silently dropped. A tree that looks fine on
+// a Windows host can therefore end up with files the app can't find once it
+// boots, so trees built from directories on Windows are checked with
+// CheckNames before they're used.
+
+// windowsReservedNames are device names Windows won't use for files, with or
+// without an extension.
+var windowsReservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true,
+	"COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true,
+	"LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// NameError describes a path in a FileTree that won't behave the same way on
+// a Windows host as it does in the guest.
+type NameError struct {
+	Path    string
+	Problem string
+}
+
+func (e NameError) String() string {
+	return fmt.Sprintf("%s: %s", e.Path, e.Problem)
+}
+
+// NameErrors is the error returned by CheckNames.
+type NameErrors []NameError
+
+// Error implements error.
+func (e NameErrors) Error() string {
+
+	lines := make([]string, len(e))
+	for i := range e {
+		lines[i] = e[i].String()
+	}
+
+	return fmt.Sprintf("file names that aren't portable between Windows and the guest:\n\t%s", strings.Join(lines, "\n\t"))
+
+}
+
+// normalizePath turns a path using the host's separators into a path
+// relative to the root of a FileTree.
+func normalizePath(path string) string {
+
+	path = filepath.ToSlash(path)
+	path = strings.TrimPrefix(unixpath.Join("/", path), "/")
+
+	return path
+
+}
+
+// CheckNames returns NameErrors listing every name in t that differs only by
+// case from another in the same directory, is reserved on Windows, or ends
+// with a dot or space, or nil if there are none.
+func CheckNames(t FileTree) error {
+
+	var errs NameErrors
+
+	err := t.WalkNode(func(path string, n *TreeNode) error {
+
+		if !n.File.IsDir() {
+			return nil
+		}
+
+		seen := make(map[string]string)
+		for _, child := range n.Children {
+			name := child.File.Name()
+			p := strings.TrimPrefix(path+"/"+name, "./")
+
+			if prev, ok := seen[strings.ToLower(name)]; ok {
+				errs = append(errs, NameError{
+					Path:    p,
+					Problem: fmt.Sprintf("differs from '%s' only by case", prev),
+				})
+			} else {
+				seen[strings.ToLower(name)] = name
+			}
+
+			problem := windowsNameProblem(name)
+			if problem != "" {
+				errs = append(errs, NameError{
+					Path:    p,
+					Problem: problem,
+				})
+			}
+		}
+
+		return nil
+
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+
+	return nil
+
+}
+
+// windowsNameProblem returns the reason Windows can't hold a file with the
+// given name, or an empty string if it can.
+func windowsNameProblem(name string) string {
+
+	base := strings.ToUpper(name)
+	if k := strings.Index(base, "."); k >= 0 {
+		base = base[:k]
+	}
+
+	if windowsReservedNames[base] {
+		return "is a reserved device name on windows"
+	}
+
+	if strings.HasSuffix(name, ".") || strings.HasSuffix(name, " ") {
+		return "ends with a dot or space, which windows drops"
+	}
+
+	for _, r := range name {
+		if strings.ContainsRune(`<>:"\|?*`, r) || unicode.IsControl(r) {
+			return fmt.Sprintf("contains %q, which windows doesn't allow in file names", r)
+		}
+	}
+
+	return ""
+
+}
+
+// checkHostNames runs CheckNames on trees built on Windows hosts.
+func checkHostNames(t FileTree) error {
+
+	if runtime.GOOS != "windows" {
+		return nil
+	}
+
+	return CheckNames(t)
+
+}
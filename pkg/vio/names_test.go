@@ -0,0 +1,95 @@
+package vio
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheckNames(t *testing.T) {
+
+	tree := NewFileTree()
+	defer tree.Close()
+
+	for _, path := range []string{"etc/hosts", "Etc/localtime", "app/aux.c", "app/notes.", "app/a:b", "app/main"} {
+		err := tree.Map(path, CustomFile(CustomFileArgs{
+			Name:       filepath.Base(path),
+			ReadCloser: ioutil.NopCloser(strings.NewReader("")),
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := CheckNames(tree)
+	errs, ok := err.(NameErrors)
+	if !ok {
+		t.Fatalf("expected NameErrors, got %v", err)
+	}
+
+	problems := make(map[string]bool)
+	for _, e := range errs {
+		problems[e.Path] = true
+	}
+
+	for _, path := range []string{"etc", "app/aux.c", "app/notes.", "app/a:b"} {
+		if !problems[path] {
+			t.Errorf("expected a problem with '%s', got %v", path, err)
+		}
+	}
+
+	if len(errs) != 4 {
+		t.Errorf("expected 4 problems, got %v", err)
+	}
+
+}
+
+func TestFileTreeFromDirectory(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "vio-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	err = os.MkdirAll(filepath.Join(dir, "bin"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{".vorteilproject", filepath.Join("bin", "app")} {
+		err = ioutil.WriteFile(filepath.Join(dir, name), []byte("x"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tree, err := FileTreeFromDirectory(dir + string(filepath.Separator))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	var paths []string
+	err = tree.Walk(func(path string, f File) error {
+		paths = append(paths, path)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := "[. ./.vorteilproject ./bin ./bin/app]"
+	if got := fmt.Sprintf("%v", paths); got != expect {
+		t.Errorf("expected %s, got %s", expect, got)
+	}
+
+}
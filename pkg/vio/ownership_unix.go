@@ -0,0 +1,30 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package vio
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"os"
+	"syscall"
+)
+
+// hostOwnership returns the owner and permissions of a file on the host.
+func hostOwnership(fi os.FileInfo) *Ownership {
+
+	stat, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil
+	}
+
+	return &Ownership{
+		UID:  stat.Uid,
+		GID:  stat.Gid,
+		Mode: uint32(stat.Mode) & ModeMask,
+	}
+
+}
@@ -0,0 +1,17 @@
+//go:build windows
+// +build windows
+
+package vio
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import "os"
+
+// hostOwnership returns nil, because files on Windows hosts have no owner or
+// permissions that mean anything in the guest.
+func hostOwnership(fi os.FileInfo) *Ownership {
+	return nil
+}
@@ -8,6 +8,7 @@ package vio
 import (
 	"archive/tar"
 	"bytes"
+	"crypto/sha256"
 	"encoding/binary"
 	"encoding/json"
 	"errors"
@@ -91,6 +92,50 @@ func readArchiveMetadata(r io.Reader) (map[string]interface{}, error) {
 
 type archiveLoader struct {
 	tr *tar.Reader
+
+	// sizes counts the regular files of each size found in the manifest.
+	// Only files that share their size with another file can be the target
+	// of a deduplicated hard link, so only those get cached as they stream
+	// past.
+	sizes map[int]int
+	cache map[string][]byte
+}
+
+func (a *archiveLoader) countSizes(x map[string]interface{}) {
+
+	if fi, ok := x["fi"].(map[string]interface{}); ok {
+		isDir, _ := fi["IsDir"].(bool)
+		isSymlink, _ := fi["IsSymlink"].(bool)
+		size, _ := fi["Size"].(float64)
+		if !isDir && !isSymlink && size > 0 {
+			a.sizes[int(size)]++
+		}
+	}
+
+	if children, ok := x["children"].([]interface{}); ok {
+		for _, child := range children {
+			if y, ok := child.(map[string]interface{}); ok {
+				a.countSizes(y)
+			}
+		}
+	}
+
+}
+
+func (a *archiveLoader) isLinkCandidate(h *tar.Header) bool {
+	return h.Typeflag == tar.TypeReg && h.Size > 0 && a.sizes[int(h.Size)] > 1
+}
+
+func (a *archiveLoader) cacheEntry(h *tar.Header) ([]byte, error) {
+
+	data, err := ioutil.ReadAll(a.tr)
+	if err != nil {
+		return nil, err
+	}
+
+	a.cache[h.Name] = data
+	return data, nil
+
 }
 
 func (a *archiveLoader) loadChildren(n *TreeNode, x map[string]interface{}) error {
@@ -171,12 +216,37 @@ func (a *archiveLoader) openFn(parentPath string, fi *fi) func() (io.Reader, err
 				return nil, err
 			}
 
-			if h.Name == path {
-				if h.Linkname != "" {
-					return strings.NewReader(h.Linkname), nil
+			if h.Name != path {
+				if a.isLinkCandidate(h) {
+					_, err = a.cacheEntry(h)
+					if err != nil {
+						return nil, err
+					}
+				}
+				continue
+			}
+
+			if h.Typeflag == tar.TypeLink {
+				data, ok := a.cache[h.Linkname]
+				if !ok {
+					return nil, fmt.Errorf("object '%s' links to missing object '%s': %w", path, h.Linkname, errCorruptArchive)
 				}
-				return a.tr, nil
+				return bytes.NewReader(data), nil
 			}
+
+			if h.Linkname != "" {
+				return strings.NewReader(h.Linkname), nil
+			}
+
+			if a.isLinkCandidate(h) {
+				data, err := a.cacheEntry(h)
+				if err != nil {
+					return nil, err
+				}
+				return bytes.NewReader(data), nil
+			}
+
+			return a.tr, nil
 		}
 	}
 
@@ -201,6 +271,8 @@ func (a *archiveLoader) reconstructArchiveNode(parent *TreeNode, x map[string]in
 	var rc io.ReadCloser
 	if fi.IsSymlink && fi.Symlink != "" {
 		rc = ioutil.NopCloser(strings.NewReader(fi.Symlink))
+	} else if fi.Special != 0 {
+		rc = ioutil.NopCloser(strings.NewReader(""))
 	} else {
 		rc = LazyReadCloser(a.openFn(parentPath, fi), a.nilClose)
 	}
@@ -213,6 +285,11 @@ func (a *archiveLoader) reconstructArchiveNode(parent *TreeNode, x map[string]in
 		IsSymlink:          fi.IsSymlink,
 		IsSymlinkNotCached: fi.Symlink == "",
 		Symlink:            fi.Symlink,
+		Special:            fi.Special,
+		Major:              fi.Major,
+		Minor:              fi.Minor,
+		Xattrs:             fi.Xattrs,
+		Ownership:          fi.Ownership,
 		ReadCloser:         rc,
 	})
 
@@ -263,7 +340,9 @@ func archiveCloser(r io.Reader) func() error {
 //
 // LoadArchive loads the FileTree using lazy loading, and
 // does not need to cache the entire contents of r within
-// memory.
+// memory. Files that were deduplicated by the archiver are
+// reconstructed transparently, which requires caching the
+// contents of any file that could be the target of one.
 func LoadArchive(r io.Reader) (FileTree, error) {
 
 	m, err := readArchiveMetadata(r)
@@ -274,9 +353,13 @@ func LoadArchive(r io.Reader) (FileTree, error) {
 	tr := tar.NewReader(r)
 
 	a := &archiveLoader{
-		tr: tr,
+		tr:    tr,
+		sizes: make(map[int]int),
+		cache: make(map[string][]byte),
 	}
 
+	a.countSizes(m)
+
 	root, err := a.reconstructArchiveNode(nil, m)
 	if err != nil {
 		return nil, fmt.Errorf("failed to reconstruct vtree node: %w -- archive corrupt or version incompatible", err)
@@ -292,9 +375,19 @@ func LoadArchive(r io.Reader) (FileTree, error) {
 
 }
 
+type archivedContent struct {
+	path string
+	hash [sha256.Size]byte
+}
+
 type archiver struct {
 	tarw *tar.Writer
 	fn   ArchiveFunc
+
+	// written records the content hash of every regular file already in
+	// the archive, grouped by size, so that identical files can be stored
+	// once and referenced with a hard link from then on.
+	written map[int64][]archivedContent
 }
 
 func (a *archiver) writeSymlink(path string, f File) error {
@@ -341,8 +434,98 @@ func (a *archiver) writeDir(path string, f File) error {
 
 }
 
+func (a *archiver) writeSpecial(path string, f File) error {
+
+	hdr, err := tar.FileInfoHeader(Info(f), "")
+	if err != nil {
+		return err
+	}
+
+	major, minor := f.Device()
+	hdr.Name = path
+	hdr.Devmajor = int64(major)
+	hdr.Devminor = int64(minor)
+
+	err = a.tarw.WriteHeader(hdr)
+	if err != nil {
+		return err
+	}
+
+	return f.Close()
+
+}
+
+func (a *archiver) writeLink(path, target string, f File) error {
+
+	hdr, err := tar.FileInfoHeader(Info(f), "")
+	if err != nil {
+		return err
+	}
+
+	hdr.Name = path
+	hdr.Typeflag = tar.TypeLink
+	hdr.Linkname = target
+	hdr.Size = 0
+
+	err = a.tarw.WriteHeader(hdr)
+	if err != nil {
+		return err
+	}
+
+	return f.Close()
+
+}
+
 func (a *archiver) writeFile(path string, f File) error {
 
+	size := int64(f.Size())
+	if size == 0 {
+		return a.writeFileContent(path, f, f)
+	}
+
+	candidates := a.written[size]
+	if len(candidates) == 0 {
+		hasher := sha256.New()
+		err := a.writeFileContent(path, f, io.TeeReader(f, hasher))
+		if err != nil {
+			return err
+		}
+		a.record(path, size, hasher.Sum(nil))
+		return nil
+	}
+
+	// another file of the same size has already been written, so buffer
+	// this one to find out if it can be stored as a reference instead
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return err
+	}
+
+	hash := sha256.Sum256(data)
+	for _, c := range candidates {
+		if c.hash == hash {
+			return a.writeLink(path, c.path, f)
+		}
+	}
+
+	err = a.writeFileContent(path, f, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	a.record(path, size, hash[:])
+
+	return nil
+
+}
+
+func (a *archiver) record(path string, size int64, hash []byte) {
+	c := archivedContent{path: path}
+	copy(c.hash[:], hash)
+	a.written[size] = append(a.written[size], c)
+}
+
+func (a *archiver) writeFileContent(path string, f File, r io.Reader) error {
+
 	hdr, err := tar.FileInfoHeader(Info(f), "")
 	if err != nil {
 		return err
@@ -355,7 +538,7 @@ func (a *archiver) writeFile(path string, f File) error {
 		return err
 	}
 
-	_, err = io.Copy(a.tarw, f)
+	_, err = io.Copy(a.tarw, r)
 	if err != nil {
 		return err
 	}
@@ -383,6 +566,10 @@ func (a *archiver) walker(path string, f File) error {
 		return a.writeDir(path, f)
 	}
 
+	if f.Special() != 0 {
+		return a.writeSpecial(path, f)
+	}
+
 	return a.writeFile(path, f)
 
 }
@@ -434,8 +621,9 @@ func (t *tree) Archive(w io.Writer, fn ArchiveFunc) error {
 	defer tarw.Close()
 
 	a := &archiver{
-		tarw: tarw,
-		fn:   fn,
+		tarw:    tarw,
+		fn:      fn,
+		written: make(map[int64][]archivedContent),
 	}
 	err = t.Walk(a.walker)
 	if err != nil {
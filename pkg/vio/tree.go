@@ -51,7 +51,8 @@ type FileTree interface {
 
 	// Archive encodes the data within the FileTree into
 	// a stream that it writes to w. This stream can be
-	// decoded by calling LoadArchive.
+	// decoded by calling LoadArchive. Files with
+	// identical contents are only stored once.
 	//
 	// The fn argument is optional, and can be used to
 	// track progress or perform logging during the
@@ -137,6 +138,11 @@ type fi struct {
 	IsSymlink bool
 	Symlink   string
 	ModTime   time.Time
+	Special   os.FileMode       `json:",omitempty"`
+	Major     uint32            `json:",omitempty"`
+	Minor     uint32            `json:",omitempty"`
+	Xattrs    map[string][]byte `json:",omitempty"`
+	Ownership *Ownership        `json:",omitempty"`
 }
 
 // MarshalJSON implements json.Marshaler.
@@ -164,6 +170,14 @@ func (n *TreeNode) MarshalJSON() ([]byte, error) {
 		info.Symlink = n.File.Symlink()
 	}
 
+	if n.File.Special() != 0 {
+		info.Special = n.File.Special()
+		info.Major, info.Minor = n.File.Device()
+	}
+
+	info.Xattrs = n.File.Xattrs()
+	info.Ownership = n.File.Ownership()
+
 	m["fi"] = info
 
 	m["children"] = n.Children
@@ -441,20 +455,26 @@ type loadFromDirectory struct {
 
 func (v *loadFromDirectory) walker(path string, fi os.FileInfo, err error) error {
 
-	path = filepath.ToSlash(path)
-	abs := path
-	path = strings.TrimPrefix(path, v.dir)
-	path = strings.TrimPrefix(path, "/")
-	if path == "" {
+	if err != nil {
+		return err
+	}
+
+	rel, err := filepath.Rel(v.dir, path)
+	if err != nil {
+		return err
+	}
+
+	rel = normalizePath(rel)
+	if rel == "" {
 		return nil
 	}
 
-	f, err := LazyOpen(abs)
+	f, err := LazyOpen(path)
 	if err != nil {
 		return err
 	}
 
-	err = v.tree.Map(path, f)
+	err = v.tree.Map(rel, f)
 	if err != nil {
 		return err
 	}
@@ -465,7 +485,9 @@ func (v *loadFromDirectory) walker(path string, fi os.FileInfo, err error) error
 
 // FileTreeFromDirectory creates a new FileTree based on a directory. The
 // files in the tree will be loaded in lazily, so the function should be safe
-// for use on very large directory trees.
+// for use on very large directory trees. On Windows hosts the tree is checked
+// with CheckNames, and a NameErrors is returned if any of its names won't
+// work in the guest.
 func FileTreeFromDirectory(dir string) (FileTree, error) {
 
 	v := &loadFromDirectory{
@@ -478,6 +500,12 @@ func FileTreeFromDirectory(dir string) (FileTree, error) {
 		return nil, err
 	}
 
+	err = checkHostNames(v.tree)
+	if err != nil {
+		v.tree.Close()
+		return nil, err
+	}
+
 	return v.tree, nil
 
 }
@@ -545,15 +573,12 @@ func (t *tree) Map(path string, f File) error {
 		return errors.New("cannot map object with negative size")
 	}
 
-	path = filepath.ToSlash(path)
-	path = unixpath.Clean(path)
-	path = filepath.ToSlash(path)
-	path = unixpath.Join("/", path)
-	path = strings.TrimPrefix(path, "/")
+	path = normalizePath(path)
 	if path == "" {
 		return errors.New("cannot map over the root node")
 	}
 
+	major, minor := f.Device()
 	f = CustomFile(CustomFileArgs{
 		Name:               unixpath.Base(path),
 		Size:               f.Size(),
@@ -561,6 +586,11 @@ func (t *tree) Map(path string, f File) error {
 		IsSymlink:          f.IsSymlink(),
 		IsSymlinkNotCached: !f.SymlinkIsCached(),
 		Symlink:            f.Symlink(),
+		Special:            f.Special(),
+		Major:              major,
+		Minor:              minor,
+		Xattrs:             f.Xattrs(),
+		Ownership:          f.Ownership(),
 		ModTime:            f.ModTime(),
 		ReadCloser:         f,
 	})
@@ -577,6 +607,7 @@ func (t *tree) MapSubTree(path string, sub FileTree) error {
 
 	st := sub.(*tree)
 	f := st.root.File
+	major, minor := f.Device()
 	st.root.File = CustomFile(CustomFileArgs{
 		Name:               unixpath.Base(path),
 		Size:               f.Size(),
@@ -584,6 +615,11 @@ func (t *tree) MapSubTree(path string, sub FileTree) error {
 		IsSymlink:          f.IsSymlink(),
 		IsSymlinkNotCached: !f.SymlinkIsCached(),
 		Symlink:            f.Symlink(),
+		Special:            f.Special(),
+		Major:              major,
+		Minor:              minor,
+		Xattrs:             f.Xattrs(),
+		Ownership:          f.Ownership(),
 		ModTime:            f.ModTime(),
 		ReadCloser:         f,
 	})
@@ -620,8 +656,7 @@ func (t *tree) Walk(fn WalkFunc) error {
 
 func (t *tree) SubTree(path string) (FileTree, error) {
 
-	path = unixpath.Clean(path)
-	path = filepath.ToSlash(path)
+	path = normalizePath(path)
 
 	node := t.root
 	for {
@@ -649,8 +684,7 @@ func (t *tree) SubTree(path string) (FileTree, error) {
 
 func (t *tree) Unmap(path string) error {
 
-	path = unixpath.Clean(path)
-	path = filepath.ToSlash(path)
+	path = normalizePath(path)
 	return t.root.unmap(path)
 
 }
@@ -11,6 +11,7 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"os"
 	"path/filepath"
 	"sort"
 	"strings"
@@ -21,7 +22,6 @@ import (
 // TODO: test FileTree.SubTree
 // TODO: Check that overwrites clean up the things they replace
 // TODO: test FileTree.MapSubTree
-// TODO: FileTreeFromDirectory
 
 func TestFileTreeArchive(t *testing.T) {
 
@@ -105,6 +105,216 @@ func TestFileTreeArchive(t *testing.T) {
 
 }
 
+func TestFileTreeArchiveDeduplication(t *testing.T) {
+
+	var err error
+
+	tree := NewFileTree()
+
+	contents := map[string]string{
+		"lib/libc.so":       "shared library",
+		"app/lib/libc.so":   "shared library",
+		"app/lib/libd.so":   "shared libraru",
+		"other/lib/libc.so": "shared library",
+	}
+
+	for id, data := range contents {
+		err = tree.Map(id, CustomFile(CustomFileArgs{
+			Name:       filepath.Base(id),
+			Size:       len(data),
+			ReadCloser: ioutil.NopCloser(strings.NewReader(data)),
+		}))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	buf := new(bytes.Buffer)
+	err = tree.Archive(buf, nil)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if n := bytes.Count(buf.Bytes(), []byte("shared library")); n != 1 {
+		t.Errorf("expected duplicate file contents to be archived once, but found them %d times", n)
+		return
+	}
+
+	tree, err = LoadArchive(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer tree.Close()
+
+	var got int
+	err = tree.Walk(func(path string, f File) error {
+
+		if f.IsDir() {
+			return nil
+		}
+
+		// skip reading one of the files to ensure entries
+		// that are passed over are still available
+		path = strings.TrimPrefix(path, "./")
+		if path == "app/lib/libc.so" {
+			return nil
+		}
+
+		data, err := ioutil.ReadAll(f)
+		if err != nil {
+			return err
+		}
+
+		if string(data) != contents[path] {
+			return fmt.Errorf("bad file data for %s: expected %s, but got %s", path, contents[path], data)
+		}
+
+		got++
+		return nil
+
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if got != len(contents)-1 {
+		t.Errorf("expected %d files, but got %d", len(contents)-1, got)
+	}
+
+}
+
+func TestFileTreeArchiveSpecialFiles(t *testing.T) {
+
+	var err error
+
+	tree := NewFileTree()
+
+	type node struct {
+		special      os.FileMode
+		major, minor uint32
+	}
+
+	nodes := map[string]node{
+		"dev/null":  {os.ModeDevice | os.ModeCharDevice, 1, 3},
+		"dev/vda":   {os.ModeDevice, 254, 0},
+		"run/pipe":  {os.ModeNamedPipe, 0, 0},
+		"etc/hosts": {},
+	}
+
+	for id, n := range nodes {
+		err = tree.Map(id, CustomFile(CustomFileArgs{
+			Name:       filepath.Base(id),
+			Special:    n.special,
+			Major:      n.major,
+			Minor:      n.minor,
+			ReadCloser: ioutil.NopCloser(strings.NewReader("")),
+		}))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	buf := new(bytes.Buffer)
+	err = tree.Archive(buf, nil)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	tree, err = LoadArchive(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer tree.Close()
+
+	err = tree.Walk(func(path string, f File) error {
+
+		if f.IsDir() {
+			return nil
+		}
+
+		path = strings.TrimPrefix(path, "./")
+		major, minor := f.Device()
+		got := node{f.Special(), major, minor}
+		if got != nodes[path] {
+			return fmt.Errorf("bad special file %s: expected %v, but got %v", path, nodes[path], got)
+		}
+
+		return nil
+
+	})
+	if err != nil {
+		t.Error(err)
+	}
+
+}
+
+func TestFileTreeArchiveXattrs(t *testing.T) {
+
+	tree := NewFileTree()
+
+	xattrs := map[string][]byte{
+		XattrCapability: {0, 0, 0, 2, 0, 4, 0, 0, 0, 0, 0, 0},
+		"user.empty":    {},
+	}
+
+	err := tree.Map("bin/app", CustomFile(CustomFileArgs{
+		Name:       "app",
+		Size:       5,
+		Xattrs:     xattrs,
+		ReadCloser: ioutil.NopCloser(strings.NewReader("hello")),
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := new(bytes.Buffer)
+	err = tree.Archive(buf, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tree, err = LoadArchive(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	err = tree.Walk(func(path string, f File) error {
+
+		if f.IsDir() {
+			if len(f.Xattrs()) > 0 {
+				return fmt.Errorf("directory %s has extended attributes", path)
+			}
+			return nil
+		}
+
+		got := f.Xattrs()
+		if len(got) != len(xattrs) {
+			return fmt.Errorf("expected %d extended attributes, but got %d", len(xattrs), len(got))
+		}
+
+		for name, value := range xattrs {
+			if !bytes.Equal(got[name], value) {
+				return fmt.Errorf("bad extended attribute %s: expected %x, but got %x", name, value, got[name])
+			}
+		}
+
+		return nil
+
+	})
+	if err != nil {
+		t.Error(err)
+	}
+
+}
+
 func TestFileTreeCloseOrder(t *testing.T) {
 
 	var err error
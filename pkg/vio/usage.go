@@ -0,0 +1,94 @@
+package vio
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	unixpath "path"
+	"sort"
+)
+
+// Usage is the space taken up by the contents of a file or directory.
+type Usage struct {
+	Path  string
+	Size  int64
+	IsDir bool
+}
+
+// UsageReport summarizes where the space in a FileTree goes.
+type UsageReport struct {
+	// Total is the combined size of every file in the tree.
+	Total int64
+
+	// Files are the largest files in the tree, largest first.
+	Files []Usage
+
+	// Dirs are the largest directories in the tree, other than the root,
+	// largest first. A directory's size includes everything beneath it.
+	Dirs []Usage
+}
+
+// DiskUsage walks t to find its total size and its n largest files and
+// directories. Paths are absolute, e.g. "/usr/lib".
+func DiskUsage(t FileTree, n int) (*UsageReport, error) {
+
+	report := new(UsageReport)
+	dirs := make(map[string]int64)
+
+	var files []Usage
+
+	err := t.Walk(func(path string, f File) error {
+
+		path = unixpath.Clean("/" + path)
+
+		if f.IsDir() {
+			if path != "/" {
+				dirs[path] += 0
+			}
+			return nil
+		}
+
+		size := int64(f.Size())
+		report.Total += size
+		files = append(files, Usage{Path: path, Size: size})
+
+		for dir := unixpath.Dir(path); dir != "/"; dir = unixpath.Dir(dir) {
+			dirs[dir] += size
+		}
+
+		return nil
+
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for path, size := range dirs {
+		report.Dirs = append(report.Dirs, Usage{Path: path, Size: size, IsDir: true})
+	}
+
+	report.Files = largest(files, n)
+	report.Dirs = largest(report.Dirs, n)
+
+	return report, nil
+
+}
+
+func largest(usage []Usage, n int) []Usage {
+
+	sort.Slice(usage, func(i, j int) bool {
+		if usage[i].Size != usage[j].Size {
+			return usage[i].Size > usage[j].Size
+		}
+		return usage[i].Path < usage[j].Path
+	})
+
+	if len(usage) > n {
+		usage = usage[:n]
+	}
+
+	return usage
+
+}
@@ -0,0 +1,65 @@
+package vio
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDiskUsage(t *testing.T) {
+
+	tree := NewFileTree()
+	defer tree.Close()
+
+	sizes := map[string]int{
+		"app":              50,
+		"lib/libc.so":      30,
+		"lib/x/libfoo.so":  40,
+		"etc/hosts":        5,
+		"usr/share/readme": 1,
+	}
+
+	for path, size := range sizes {
+		err := tree.Map(path, CustomFile(CustomFileArgs{
+			Name:       filepath.Base(path),
+			Size:       size,
+			ReadCloser: ioutil.NopCloser(strings.NewReader(strings.Repeat("x", size))),
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	report, err := DiskUsage(tree, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if report.Total != 126 {
+		t.Errorf("expected a total of 126 bytes, got %d", report.Total)
+	}
+
+	files := []Usage{
+		{Path: "/app", Size: 50},
+		{Path: "/lib/x/libfoo.so", Size: 40},
+	}
+	if !reflect.DeepEqual(report.Files, files) {
+		t.Errorf("wrong largest files: %v", report.Files)
+	}
+
+	dirs := []Usage{
+		{Path: "/lib", Size: 70, IsDir: true},
+		{Path: "/lib/x", Size: 40, IsDir: true},
+	}
+	if !reflect.DeepEqual(report.Dirs, dirs) {
+		t.Errorf("wrong largest directories: %v", report.Dirs)
+	}
+
+}
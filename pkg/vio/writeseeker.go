@@ -72,6 +72,28 @@ func (ws *writeSeeker) Seek(offset int64, whence int) (int64, error) {
 	}
 }
 
+type writerOnly struct {
+	io.Writer
+}
+
+// ReadFrom implements io.ReaderFrom, passing the data straight through to
+// the underlying writer if it also implements io.ReaderFrom.
+func (ws *writeSeeker) ReadFrom(r io.Reader) (int64, error) {
+
+	rf, ok := ws.w.(io.ReaderFrom)
+	if !ok {
+		return io.Copy(writerOnly{ws}, r)
+	}
+
+	n, err := rf.ReadFrom(r)
+	if ws.s == nil {
+		ws.k += n
+	}
+
+	return n, err
+
+}
+
 func WriteSeeker(w io.Writer) (io.WriteSeeker, error) {
 
 	ws := new(writeSeeker)
@@ -89,3 +111,84 @@ func WriteSeeker(w io.Writer) (io.WriteSeeker, error) {
 	return ws, nil
 
 }
+
+// writerAtWrapper is implemented by writers that wrap another and can pass
+// writes at arbitrary offsets through to it, but only if it supports them.
+type writerAtWrapper interface {
+	WriterAt() (io.WriterAt, bool)
+}
+
+// WriterAt returns w as an io.WriterAt if it can write at arbitrary offsets,
+// which lets different parts of an image be written concurrently. Writers
+// returned by WriteSeeker can if the writer they wrap can, with offsets
+// relative to where it was when they were created.
+func WriterAt(w io.Writer) (io.WriterAt, bool) {
+
+	if x, ok := w.(writerAtWrapper); ok {
+		return x.WriterAt()
+	}
+
+	ws, ok := w.(*writeSeeker)
+	if !ok {
+		wa, ok := w.(io.WriterAt)
+		return wa, ok
+	}
+
+	if ws.s == nil {
+		return nil, false
+	}
+
+	wa, ok := WriterAt(ws.w)
+	if !ok {
+		return nil, false
+	}
+
+	return NewOffsetWriter(wa, ws.k), true
+
+}
+
+// OffsetWriter writes to an io.WriterAt as though it were a file starting at
+// a fixed offset.
+type OffsetWriter struct {
+	w    io.WriterAt
+	base int64
+	pos  int64
+}
+
+// NewOffsetWriter returns an OffsetWriter that writes to w starting at offset
+// base. It has a position of its own, so any number of them can write to the
+// same io.WriterAt at once.
+func NewOffsetWriter(w io.WriterAt, base int64) *OffsetWriter {
+	return &OffsetWriter{
+		w:    w,
+		base: base,
+	}
+}
+
+func (ow *OffsetWriter) Write(p []byte) (int, error) {
+	n, err := ow.w.WriteAt(p, ow.base+ow.pos)
+	ow.pos += int64(n)
+	return n, err
+}
+
+func (ow *OffsetWriter) WriteAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	return ow.w.WriteAt(p, ow.base+off)
+}
+
+func (ow *OffsetWriter) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += ow.pos
+	default:
+		return ow.pos, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return ow.pos, errors.New("negative seek")
+	}
+	ow.pos = offset
+	return ow.pos, nil
+}
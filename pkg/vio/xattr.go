@@ -0,0 +1,30 @@
+package vio
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import "strings"
+
+// Extended attribute names that have a meaning of their own in the guest.
+const (
+	XattrCapability      = "security.capability"
+	XattrPOSIXACLAccess  = "system.posix_acl_access"
+	XattrPOSIXACLDefault = "system.posix_acl_default"
+)
+
+// carryXattr reports whether an extended attribute of a file on the host
+// belongs in a tree built from it. Security labels like security.selinux
+// describe the host's policy rather than the app, so file capabilities are
+// the only attributes taken from the security namespace.
+func carryXattr(name string) bool {
+
+	switch name {
+	case XattrCapability, XattrPOSIXACLAccess, XattrPOSIXACLDefault:
+		return true
+	}
+
+	return strings.HasPrefix(name, "user.") || strings.HasPrefix(name, "trusted.")
+
+}
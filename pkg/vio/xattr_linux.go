@@ -0,0 +1,104 @@
+//go:build linux
+// +build linux
+
+package vio
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"bytes"
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// hostXattrs returns the extended attributes of the file at path that
+// carryXattr accepts, without following symlinks, or nil if it has none or
+// the file-system it's on doesn't support them.
+func hostXattrs(path string) (map[string][]byte, error) {
+
+	names, err := listXattrs(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var xattrs map[string][]byte
+
+	for _, name := range names {
+		if !carryXattr(name) {
+			continue
+		}
+
+		value, err := getXattr(path, name)
+		if err == unix.ENODATA {
+			continue // removed since it was listed
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to read extended attribute '%s' of '%s': %v", name, path, err)
+		}
+
+		if xattrs == nil {
+			xattrs = make(map[string][]byte)
+		}
+		xattrs[name] = value
+	}
+
+	return xattrs, nil
+
+}
+
+func listXattrs(path string) ([]string, error) {
+
+	for {
+		size, err := unix.Llistxattr(path, nil)
+		if err == unix.ENOTSUP {
+			return nil, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to list extended attributes of '%s': %v", path, err)
+		}
+		if size == 0 {
+			return nil, nil
+		}
+
+		buf := make([]byte, size)
+		size, err = unix.Llistxattr(path, buf)
+		if err == unix.ERANGE {
+			continue // the list grew since its size was checked
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to list extended attributes of '%s': %v", path, err)
+		}
+
+		var names []string
+		for _, name := range bytes.Split(buf[:size], []byte{0}) {
+			if len(name) > 0 {
+				names = append(names, string(name))
+			}
+		}
+
+		return names, nil
+	}
+
+}
+
+func getXattr(path, name string) ([]byte, error) {
+
+	for {
+		size, err := unix.Lgetxattr(path, name, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		buf := make([]byte, size)
+		size, err = unix.Lgetxattr(path, name, buf)
+		if err == unix.ERANGE {
+			continue // the value grew since its size was checked
+		} else if err != nil {
+			return nil, err
+		}
+
+		return buf[:size], nil
+	}
+
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+package vio
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+// hostXattrs returns nil, because only Linux hosts have extended attributes
+// that mean the same thing in the guest.
+func hostXattrs(path string) (map[string][]byte, error) {
+	return nil, nil
+}
@@ -0,0 +1,58 @@
+package virtualizers
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"context"
+	"time"
+)
+
+// PrepareContext returns the context of args, or context.Background if it
+// has none, so that virtualizers can always check it.
+func PrepareContext(args *PrepareArgs) context.Context {
+
+	if args.Context == nil {
+		return context.Background()
+	}
+
+	return args.Context
+
+}
+
+// Start starts v unless ctx is already done. If ctx is done later on, v is
+// stopped as soon as it has finished starting, so that cancelling the context
+// passed to Prepare reliably aborts the VM.
+func Start(ctx context.Context, v Virtualizer) error {
+
+	err := ctx.Err()
+	if err != nil {
+		return err
+	}
+
+	err = v.Start()
+	if err != nil {
+		return err
+	}
+
+	if ctx.Done() == nil {
+		return nil
+	}
+
+	go func() {
+		<-ctx.Done()
+
+		for v.State() == Changing {
+			time.Sleep(time.Millisecond * 200)
+		}
+
+		if v.State() == Alive {
+			_ = v.Stop()
+		}
+	}()
+
+	return nil
+
+}
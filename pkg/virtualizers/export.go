@@ -0,0 +1,83 @@
+package virtualizers
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Exporter is implemented by virtualizers that can write a prepared VM out as
+// the files its hypervisor needs to run it with its own tooling: the VM's
+// definition, its disks and anything else it boots from. The VM has to be
+// prepared without being started, and should still be closed afterwards,
+// which leaves the exported files alone.
+type Exporter interface {
+	Export(dir string) ([]string, error) // Write the VM's files to dir, returning their paths
+}
+
+// ExportFiles copies each of the files into dir, keeping their names, and
+// returns the paths of the copies.
+func ExportFiles(dir string, files ...string) ([]string, error) {
+
+	var paths []string
+	for _, file := range files {
+		path := filepath.Join(dir, filepath.Base(file))
+		err := copyFile(file, path)
+		if err != nil {
+			return nil, err
+		}
+		paths = append(paths, path)
+	}
+
+	return paths, nil
+
+}
+
+// ExportText writes the file called name to dir, with every mention of the
+// folder a VM was prepared in replaced by dir, so that the paths in it point
+// at the exported copies of its files.
+func ExportText(dir, name, folder, text string, perm os.FileMode) (string, error) {
+
+	for _, from := range []string{folder, filepath.ToSlash(folder)} {
+		text = strings.ReplaceAll(text, from, dir)
+	}
+
+	path := filepath.Join(dir, name)
+	err := ioutil.WriteFile(path, []byte(text), perm)
+	if err != nil {
+		return "", err
+	}
+
+	return path, nil
+
+}
+
+func copyFile(src, dst string) error {
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	_, err = io.Copy(out, in)
+	if err != nil {
+		return err
+	}
+
+	return out.Close()
+
+}
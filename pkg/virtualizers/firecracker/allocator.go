@@ -18,8 +18,11 @@ var VirtualizerID = "firecracker"
 
 type allocator struct{}
 
-// Config to run the virtualizer
-type Config struct{}
+// Config to run the virtualizer. If Rootless is set the VM is networked with
+// slirp4netns instead of vorteil-bridge, so it can be run without root.
+type Config struct {
+	Rootless bool
+}
 
 // Marshal the config into a byte[]
 func (c *Config) Marshal() []byte {
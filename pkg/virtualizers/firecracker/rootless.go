@@ -0,0 +1,125 @@
+package firecracker
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/vorteil/vorteil/pkg/vcfg"
+)
+
+// Rootless networking runs firecracker inside its own user and network
+// namespace, where an unprivileged user is allowed to create tap devices.
+// slirp4netns connects the namespace to the host's network in user-mode, the
+// same way qemu's user networking does, so no bridge or NAT rules have to be
+// set up on the host. The VM's tap devices are bridged to slirp4netns's tap
+// device inside the namespace, which puts the VM directly on slirp's network,
+// and ports are forwarded to the host through slirp4netns's API socket.
+
+const (
+	slirpNetwork    = "10.0.2."
+	slirpGateway    = slirpNetwork + "2"
+	slirpMask       = "255.255.255.0"
+	slirpFirstGuest = 15
+	slirpTap        = "tap0"
+	rootlessBridge  = "br0"
+)
+
+// AssignRootlessAddresses gives each network interface in cfg a static
+// address on slirp4netns's network, so that ports can be forwarded to it
+// before the VM boots. Every rootless VM has a network to itself, so the
+// addresses are always the same. It must be applied to the VCFG the disk is
+// built from.
+func AssignRootlessAddresses(cfg *vcfg.VCFG) {
+	for i := range cfg.Networks {
+		cfg.Networks[i].IP = rootlessAddress(i)
+		cfg.Networks[i].Gateway = slirpGateway
+		cfg.Networks[i].Mask = slirpMask
+	}
+}
+
+func rootlessAddress(i int) string {
+	return slirpNetwork + strconv.Itoa(slirpFirstGuest+i)
+}
+
+func rootlessTap(i int) string {
+	return fmt.Sprintf("fc%d", i)
+}
+
+// rootlessSetupScript returns the shell script run inside the namespace to
+// create a tap device for each of the VM's n network interfaces, and bridge
+// them to slirp4netns's tap device.
+func rootlessSetupScript(n int) string {
+
+	cmds := []string{
+		fmt.Sprintf("ip link add %s type bridge", rootlessBridge),
+		fmt.Sprintf("ip link set %s master %s", slirpTap, rootlessBridge),
+		fmt.Sprintf("ip link set %s up", slirpTap),
+	}
+
+	for i := 0; i < n; i++ {
+		tap := rootlessTap(i)
+		cmds = append(cmds,
+			fmt.Sprintf("ip tuntap add dev %s mode tap", tap),
+			fmt.Sprintf("ip link set %s master %s", tap, rootlessBridge),
+			fmt.Sprintf("ip link set %s up", tap),
+		)
+	}
+
+	cmds = append(cmds, fmt.Sprintf("ip link set %s up", rootlessBridge))
+
+	return strings.Join(cmds, " && ")
+
+}
+
+type slirpRequest struct {
+	Execute   string      `json:"execute"`
+	Arguments interface{} `json:"arguments,omitempty"`
+}
+
+type slirpHostFwd struct {
+	Proto     string `json:"proto"`
+	HostAddr  string `json:"host_addr"`
+	HostPort  int    `json:"host_port"`
+	GuestAddr string `json:"guest_addr"`
+	GuestPort int    `json:"guest_port"`
+}
+
+type slirpResponse struct {
+	Error *struct {
+		Desc string `json:"desc"`
+	} `json:"error"`
+}
+
+// hostFwdRequest returns the slirp4netns API request that forwards hostPort
+// on every host address to guestPort on the VM's guestAddr.
+func hostFwdRequest(protocol, hostPort, guestAddr, guestPort string) ([]byte, error) {
+
+	hp, err := strconv.Atoi(hostPort)
+	if err != nil {
+		return nil, fmt.Errorf("bad host port '%s'", hostPort)
+	}
+
+	gp, err := strconv.Atoi(guestPort)
+	if err != nil {
+		return nil, fmt.Errorf("bad port '%s'", guestPort)
+	}
+
+	return json.Marshal(&slirpRequest{
+		Execute: "add_hostfwd",
+		Arguments: &slirpHostFwd{
+			Proto:     protocol,
+			HostAddr:  "0.0.0.0",
+			HostPort:  hp,
+			GuestAddr: guestAddr,
+			GuestPort: gp,
+		},
+	})
+
+}
@@ -0,0 +1,261 @@
+// +build linux
+
+package firecracker
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/vorteil/vorteil/pkg/virtualizers"
+)
+
+// rootlessNetwork is the user and network namespace a rootless VM runs in,
+// and the slirp4netns process connecting it to the host.
+type rootlessNetwork struct {
+	holder    *exec.Cmd
+	holderIn  io.WriteCloser
+	slirp     *exec.Cmd
+	apiSocket string
+}
+
+// pid returns the pid of the process holding the namespace open, which is
+// what nsenter and slirp4netns identify the namespace by.
+func (r *rootlessNetwork) pid() string {
+	return strconv.Itoa(r.holder.Process.Pid)
+}
+
+// nsenter returns the arguments that run a command inside the namespace as
+// its root user.
+func (r *rootlessNetwork) nsenter() []string {
+	return []string{"nsenter", "--target", r.pid(), "--user", "--net", "--preserve-credentials"}
+}
+
+// wrap changes cmd so that it runs inside the namespace.
+func (r *rootlessNetwork) wrap(cmd *exec.Cmd) error {
+
+	nsenter, err := exec.LookPath("nsenter")
+	if err != nil {
+		return err
+	}
+
+	cmd.Path = nsenter
+	cmd.Args = append(r.nsenter(), cmd.Args...)
+	cmd.Args[0] = nsenter
+
+	return nil
+
+}
+
+// startRootlessNetwork creates a namespace with a tap device for each of the
+// VM's n network interfaces, connected to the host by slirp4netns.
+func startRootlessNetwork(folder string, n int) (*rootlessNetwork, error) {
+
+	for _, bin := range []string{"unshare", "nsenter", "slirp4netns"} {
+		_, err := exec.LookPath(bin)
+		if err != nil {
+			return nil, fmt.Errorf("rootless networking requires %s: %v", bin, err)
+		}
+	}
+
+	r := &rootlessNetwork{
+		apiSocket: filepath.Join(folder, "slirp4netns.sock"),
+	}
+
+	// the namespace lasts until the holder's stdin is closed
+	r.holder = exec.Command("unshare", "--user", "--map-root-user", "--net", "sh", "-c", "echo && exec cat")
+	var err error
+	r.holderIn, err = r.holder.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	out, err := r.holder.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	err = r.holder.Start()
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = bufio.NewReader(out).ReadString('\n')
+	if err != nil {
+		r.close()
+		return nil, errors.New("unable to create a network namespace for rootless networking")
+	}
+
+	err = r.startSlirp()
+	if err != nil {
+		r.close()
+		return nil, err
+	}
+
+	setup := exec.Command(r.nsenter()[0], append(r.nsenter()[1:], "sh", "-c", rootlessSetupScript(n))...)
+	output, err := setup.CombinedOutput()
+	if err != nil {
+		r.close()
+		return nil, fmt.Errorf("unable to create tap devices in the network namespace: %v: %s", err, output)
+	}
+
+	return r, nil
+
+}
+
+// startSlirp starts slirp4netns and waits for it to create its tap device in
+// the namespace.
+func (r *rootlessNetwork) startSlirp() error {
+
+	ready, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer ready.Close()
+
+	r.slirp = exec.Command("slirp4netns", "--ready-fd", "3", "--api-socket", r.apiSocket,
+		"--disable-host-loopback", r.pid(), slirpTap)
+	r.slirp.ExtraFiles = []*os.File{w}
+
+	err = r.slirp.Start()
+	w.Close()
+	if err != nil {
+		return err
+	}
+
+	// slirp4netns writes to the ready fd once the tap device exists, and
+	// closes it without writing anything if it fails
+	data, _ := ioutil.ReadAll(io.LimitReader(ready, 1))
+	if len(data) == 0 {
+		return errors.New("slirp4netns failed to start")
+	}
+
+	return nil
+
+}
+
+// forward forwards hostPort on the host to guestPort on the VM.
+func (r *rootlessNetwork) forward(protocol, hostPort, guestAddr, guestPort string) error {
+
+	req, err := hostFwdRequest(protocol, hostPort, guestAddr, guestPort)
+	if err != nil {
+		return err
+	}
+
+	conn, err := net.DialTimeout("unix", r.apiSocket, time.Second*5)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write(req)
+	if err != nil {
+		return err
+	}
+
+	if uc, ok := conn.(*net.UnixConn); ok {
+		_ = uc.CloseWrite()
+	}
+
+	resp := new(slirpResponse)
+	err = json.NewDecoder(conn).Decode(resp)
+	if err != nil {
+		return err
+	}
+
+	if resp.Error != nil {
+		return fmt.Errorf("unable to forward port %s: %s", guestPort, resp.Error.Desc)
+	}
+
+	return nil
+
+}
+
+// close stops slirp4netns and lets the namespace, and everything in it, go
+// away.
+func (r *rootlessNetwork) close() {
+	if r.slirp != nil && r.slirp.Process != nil {
+		_ = r.slirp.Process.Kill()
+		_ = r.slirp.Wait()
+	}
+	if r.holder != nil && r.holder.Process != nil {
+		r.holderIn.Close()
+		_ = r.holder.Process.Kill()
+		_ = r.holder.Wait()
+	}
+	os.Remove(r.apiSocket)
+}
+
+// rootlessDeviceCreation sets up rootless networking for the VM and forwards
+// its ports to the host, trying the same port numbers first.
+func (o *operation) rootlessDeviceCreation() error {
+
+	var err error
+	o.netns, err = startRootlessNetwork(o.folder, len(o.config.Networks))
+	if err != nil {
+		return err
+	}
+
+	hasDefinedPorts := false
+
+	for i := range o.config.Networks {
+		o.tapDevicesName = append(o.tapDevicesName, rootlessTap(i))
+
+		guest := o.config.Networks[i].IP
+		if guest != rootlessAddress(i) {
+			return fmt.Errorf("network interface %d must have the address %s for rootless networking", i, rootlessAddress(i))
+		}
+
+		if i >= len(o.routes) {
+			continue
+		}
+
+		lists := []struct {
+			protocol string
+			ports    []virtualizers.RouteMap
+		}{
+			{"tcp", o.routes[i].HTTP},
+			{"tcp", o.routes[i].HTTPS},
+			{"tcp", o.routes[i].TCP},
+			{"udp", o.routes[i].UDP},
+		}
+
+		for _, list := range lists {
+			for j, port := range list.ports {
+				bind, nr, err := virtualizers.BindPort("nat", list.protocol, port.Port, o.strictPorts)
+				if err != nil {
+					return err
+				}
+
+				err = o.netns.forward(list.protocol, bind, guest, port.Port)
+				if err != nil {
+					return err
+				}
+
+				list.ports[j].Address = nr
+				hasDefinedPorts = true
+			}
+		}
+	}
+
+	if len(o.routes) > 0 && !hasDefinedPorts {
+		o.logger.Warnf("VM has network cards but no defined ports")
+	}
+
+	return nil
+
+}
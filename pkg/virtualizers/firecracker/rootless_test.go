@@ -0,0 +1,58 @@
+package firecracker
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/vorteil/vorteil/pkg/vcfg"
+)
+
+func TestAssignRootlessAddresses(t *testing.T) {
+	cfg := &vcfg.VCFG{
+		Networks: []vcfg.NetworkInterface{{HTTP: []string{"8888"}}, {IP: "dhcp"}},
+	}
+
+	AssignRootlessAddresses(cfg)
+
+	for i, expect := range []string{"10.0.2.15", "10.0.2.16"} {
+		nic := cfg.Networks[i]
+		if nic.IP != expect || nic.Gateway != "10.0.2.2" || nic.Mask != "255.255.255.0" {
+			t.Errorf("network interface %d has bad addresses: %s, %s, %s", i, nic.IP, nic.Gateway, nic.Mask)
+		}
+	}
+}
+
+func TestRootlessSetupScript(t *testing.T) {
+	script := rootlessSetupScript(2)
+
+	for _, cmd := range []string{
+		"ip link set tap0 master br0",
+		"ip tuntap add dev fc0 mode tap",
+		"ip link set fc1 master br0",
+	} {
+		if !strings.Contains(script, cmd) {
+			t.Errorf("setup script is missing '%s': %s", cmd, script)
+		}
+	}
+
+	if !strings.HasSuffix(script, "ip link set br0 up") {
+		t.Errorf("setup script doesn't bring the bridge up last: %s", script)
+	}
+}
+
+func TestHostFwdRequest(t *testing.T) {
+	req, err := hostFwdRequest("tcp", "8080", "10.0.2.15", "80")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := `{"execute":"add_hostfwd","arguments":{"proto":"tcp","host_addr":"0.0.0.0","host_port":8080,"guest_addr":"10.0.2.15","guest_port":80}}`
+	if string(req) != expect {
+		t.Errorf("expected request %s but got %s", expect, req)
+	}
+
+	_, err = hostFwdRequest("tcp", "8080", "10.0.2.15", "http")
+	if err == nil {
+		t.Errorf("accepted a bad port")
+	}
+}
@@ -9,11 +9,13 @@ package firecracker
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"net"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"syscall"
@@ -61,8 +63,10 @@ type Virtualizer struct {
 	logger       elog.View      // logger
 	serialLogger *logger.Logger // logs for the serial of the vm
 
-	routes []virtualizers.NetworkInterface // api network interface that displays ports
-	config *vcfg.VCFG                      // config for the vm
+	routes      []virtualizers.NetworkInterface // api network interface that displays ports
+	config      *vcfg.VCFG                      // config for the vm
+	kernelArgs  string                          // extra kernel arguments given at run time
+	strictPorts bool                            // fail instead of remapping ports that are in use
 
 	firecrackerPath string // path to vmlinux files
 	// firecracker related objects
@@ -79,6 +83,9 @@ type Virtualizer struct {
 	tapDevicesName []string         //array of tap device names
 	// tapDevice    Devices       // tap device for the machine
 
+	rootless bool             // use slirp4netns instead of vorteil-bridge
+	netns    *rootlessNetwork // namespace the vm runs in when rootless
+
 	vmdrive string // store disks in this directory
 }
 
@@ -87,8 +94,14 @@ func (v *Virtualizer) Type() string {
 	return VirtualizerID
 }
 
-// Initialize passes the arguments from creation to create a virtualizer. No arguments apart from name so no need to do anything
+// Initialize passes the arguments from creation to create a virtualizer
 func (v *Virtualizer) Initialize(data []byte) error {
+	c := new(Config)
+	err := c.Unmarshal(data)
+	if err != nil {
+		return err
+	}
+	v.rootless = c.Rootless
 	return nil
 }
 
@@ -150,10 +163,15 @@ func (v *Virtualizer) Download() (vio.File, error) {
 
 // Close shuts down the virtual machine and cleans up the disk and folders
 func (v *Virtualizer) Close(force bool) error {
-	// Error might've happened before in the prepare so machine would be nil
-	if v.machine != nil {
-		v.logger.Debugf("Deleting VM")
+	// Error might've happened before in the prepare so machine would be nil,
+	// but a VM that was prepared without being started still has devices
+	if v.machine == nil && v.state != virtualizers.Ready {
+		return nil
+	}
 
+	v.logger.Debugf("Deleting VM")
+
+	if v.machine != nil {
 		if !force {
 			// if state not ready stop it so it is
 			if !(v.state == virtualizers.Ready) {
@@ -170,24 +188,93 @@ func (v *Virtualizer) Close(force bool) error {
 		if err != nil {
 			return err
 		}
+	}
 
-		// Cleanup tap devices
+	// Cleanup tap devices, which go away with the namespace if rootless
+	if v.netns != nil {
+		v.netns.close()
+	} else {
 		for _, ifname := range v.tapDevicesName {
-			err = tenus.DeleteLink(ifname)
+			err := tenus.DeleteLink(ifname)
 			if err != nil {
 				return err
 			}
 		}
+	}
 
-		v.state = virtualizers.Deleted
+	v.state = virtualizers.Deleted
 
-		// remove virtualizer from active vms
-		virtualizers.ActiveVMs.Delete(v.name)
-	}
+	// remove virtualizer from active vms
+	virtualizers.ActiveVMs.Delete(v.name)
 
 	return nil
 }
 
+// exportConfig is the format of the configuration file firecracker is given
+// with --config-file.
+type exportConfig struct {
+	BootSource        models.BootSource           `json:"boot-source"`
+	Drives            []models.Drive              `json:"drives"`
+	MachineConfig     models.MachineConfiguration `json:"machine-config"`
+	NetworkInterfaces []models.NetworkInterface   `json:"network-interfaces"`
+}
+
+// Export writes the disks and vmlinux binary of a VM that has been prepared
+// but not started to dir, along with a configuration file that firecracker can
+// boot it from with '--config-file'. The tap devices the configuration names
+// are deleted when the VM is closed, so they have to be created again before
+// it is booted.
+func (v *Virtualizer) Export(dir string) ([]string, error) {
+
+	if v.state != virtualizers.Ready || v.machine != nil {
+		return nil, errors.New("virtual machine must be prepared but not started to export it")
+	}
+
+	files := []string{v.fconfig.KernelImagePath}
+	for _, d := range v.fconfig.Drives {
+		files = append(files, *d.PathOnHost)
+	}
+
+	paths, err := virtualizers.ExportFiles(dir, files...)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := exportConfig{
+		BootSource: models.BootSource{
+			KernelImagePath: &paths[0],
+			BootArgs:        v.fconfig.KernelArgs,
+		},
+		Drives:            v.fconfig.Drives,
+		MachineConfig:     v.fconfig.MachineCfg,
+		NetworkInterfaces: []models.NetworkInterface{},
+	}
+
+	for i, ni := range v.fconfig.NetworkInterfaces {
+		cfg.NetworkInterfaces = append(cfg.NetworkInterfaces, models.NetworkInterface{
+			IfaceID:     firecracker.String(strconv.Itoa(i + 1)),
+			HostDevName: firecracker.String(ni.StaticConfiguration.HostDevName),
+		})
+	}
+
+	data, err := json.MarshalIndent(cfg, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	path, err := virtualizers.ExportText(dir, "firecracker.json", v.folder, string(data), 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(v.tapDevicesName) > 0 {
+		v.logger.Warnf("Create the tap devices %s before booting the exported virtual machine", strings.Join(v.tapDevicesName, ", "))
+	}
+
+	return append(paths, path), nil
+
+}
+
 // Prepare prepares the virtualizer with the appropriate fields to run the virtualizer
 func (v *Virtualizer) Prepare(args *virtualizers.PrepareArgs) *virtualizers.VirtualizeOperation {
 
@@ -200,6 +287,8 @@ func (v *Virtualizer) Prepare(args *virtualizers.PrepareArgs) *virtualizers.Virt
 
 	v.created = time.Now()
 	v.config = args.Config
+	v.kernelArgs = args.KernelArgs
+	v.strictPorts = args.StrictPorts
 	v.source = args.Source
 	v.logger = args.Logger
 	v.serialLogger = logger.NewLogger(2048 * 10)
@@ -208,7 +297,7 @@ func (v *Virtualizer) Prepare(args *virtualizers.PrepareArgs) *virtualizers.Virt
 	op.Logs = make(chan string, 128)
 	op.Error = make(chan error, 1)
 	op.Status = make(chan string, 10)
-	op.ctx = args.Context
+	op.ctx = virtualizers.PrepareContext(args)
 
 	o := new(virtualizers.VirtualizeOperation)
 	o.Logs = op.Logs
@@ -249,14 +338,16 @@ func (o *operation) initializeVM(args *virtualizers.PrepareArgs) error {
 	o.folder = filepath.Dir(args.ImagePath)
 	o.id = strings.Split(filepath.Base(o.folder), "-")[1]
 	// get bridge device
-	o.bridgeDevice, err = tenus.BridgeFromName(vorteilBridge)
-	if err != nil {
-		return err
+	if !o.rootless {
+		o.bridgeDevice, err = tenus.BridgeFromName(vorteilBridge)
+		if err != nil {
+			return err
+		}
 	}
 	o.gctx = context.Background()
 	o.vmmCtx, o.vmmCancel = context.WithCancel(o.gctx)
 
-	o.kip, err = o.fetchVMLinux(fmt.Sprintf("firecracker-%s", o.config.VM.Kernel))
+	o.kip, err = o.fetchVMLinux(o.config.VM.Kernel)
 	if err != nil {
 		return err
 	}
@@ -268,6 +359,9 @@ func (o *operation) initializeVM(args *virtualizers.PrepareArgs) error {
 func (o *operation) prepare(args *virtualizers.PrepareArgs) {
 	var returnErr error
 	defer func() {
+		if returnErr != nil && o.netns != nil {
+			o.netns.close()
+		}
 		o.finished(returnErr)
 	}()
 
@@ -278,13 +372,24 @@ func (o *operation) prepare(args *virtualizers.PrepareArgs) {
 		returnErr = err
 		return
 	}
-	err = o.deviceCreation()
+
+	// fetching the kernel can take a while
+	err = o.ctx.Err()
+	if err != nil {
+		returnErr = err
+		return
+	}
+	if o.rootless {
+		err = o.rootlessDeviceCreation()
+	} else {
+		err = o.deviceCreation()
+	}
 	if err != nil {
 		returnErr = err
 		return
 	}
 
-	fcCfg, machineOpts := o.generateFirecrackerConfig(diskpath)
+	fcCfg, machineOpts := o.generateFirecrackerConfig(diskpath, args.Disks)
 	// append new fields to overarching struct
 	o.machineOpts = machineOpts
 	o.fconfig = fcCfg
@@ -298,7 +403,7 @@ func (o *operation) prepare(args *virtualizers.PrepareArgs) {
 	}
 
 	if args.Start {
-		err = o.Start()
+		err = virtualizers.Start(o.ctx, o.Virtualizer)
 		if err != nil {
 			returnErr = err
 			return
@@ -306,7 +411,7 @@ func (o *operation) prepare(args *virtualizers.PrepareArgs) {
 	}
 }
 
-func (o *operation) generateFirecrackerConfig(diskpath string) (firecracker.Config, []firecracker.Opt) {
+func (o *operation) generateFirecrackerConfig(diskpath string, disks []string) (firecracker.Config, []firecracker.Opt) {
 	logger := log.New()
 	logger.SetFormatter(&firecrackerFormatter{log.TextFormatter{
 		DisableColors: false,
@@ -320,13 +425,23 @@ func (o *operation) generateFirecrackerConfig(diskpath string) (firecracker.Conf
 		PathOnHost:   &diskpath,
 		IsRootDevice: firecracker.Bool(true),
 		IsReadOnly:   firecracker.Bool(false),
-		Partuuid:     vimg.Part2UUIDString,
+		Partuuid:     vimg.RootPartitionUUID(o.config),
 	}
 
 	devices = append(devices, rootDrive)
+
+	for i := range disks {
+		disk := filepath.ToSlash(disks[i])
+		devices = append(devices, models.Drive{
+			DriveID:      firecracker.String(strconv.Itoa(i + 2)),
+			PathOnHost:   &disk,
+			IsRootDevice: firecracker.Bool(false),
+			IsReadOnly:   firecracker.Bool(false),
+		})
+	}
 	var interfaces []firecracker.NetworkInterface
 
-	for i := 0; i < len(o.tapDevices); i++ {
+	for i := 0; i < len(o.tapDevicesName); i++ {
 		interfaces = append(interfaces,
 			firecracker.NetworkInterface{
 				StaticConfiguration: &firecracker.StaticNetworkConfiguration{
@@ -339,7 +454,7 @@ func (o *operation) generateFirecrackerConfig(diskpath string) (firecracker.Conf
 	return firecracker.Config{
 			SocketPath:      filepath.Join(o.folder, fmt.Sprintf("%s.%s", o.name, "socket")),
 			KernelImagePath: o.kip,
-			KernelArgs:      fmt.Sprintf("init=/vorteil/vinitd console=ttyS0 loglevel=2 reboot=k panic=1 pci=off i8042.noaux i8042.nomux i8042.nopnp i8042.dumbkbd vt.color=0x00 root=PARTUUID=%s", vimg.Part2UUIDString),
+			KernelArgs:      o.bootArgs(),
 			Drives:          devices,
 			MachineCfg: models.MachineConfiguration{
 				VcpuCount:  firecracker.Int64(int64(o.config.VM.CPUs)),
@@ -353,6 +468,25 @@ func (o *operation) generateFirecrackerConfig(diskpath string) (firecracker.Conf
 		}
 }
 
+// bootArgs returns the kernel command line to boot the vm with. Firecracker
+// skips the bootloader, so the image's configured kernel arguments are added
+// here, followed by any given at run time so that they take precedence.
+func (o *operation) bootArgs() string {
+
+	args := []string{
+		fmt.Sprintf("init=/vorteil/vinitd console=ttyS0 loglevel=2 reboot=k panic=1 pci=off i8042.noaux i8042.nomux i8042.nopnp i8042.dumbkbd vt.color=0x00 root=PARTUUID=%s", vimg.RootPartitionUUID(o.config)),
+	}
+
+	for _, s := range []string{o.config.System.KernelArgs, o.kernelArgs} {
+		if s = strings.TrimSpace(s); s != "" {
+			args = append(args, s)
+		}
+	}
+
+	return strings.Join(args, " ")
+
+}
+
 func (o *operation) deviceCreation() error {
 
 	for i := range o.config.Networks {
@@ -402,6 +536,13 @@ func (v *Virtualizer) Start() error {
 				Pgid:    0,
 			}
 
+			if v.netns != nil {
+				err = v.netns.wrap(cmd)
+				if err != nil {
+					v.logger.Errorf("Error entering network namespace: %s", err.Error())
+				}
+			}
+
 			v.machineOpts = append(v.machineOpts, firecracker.WithProcessRunner(cmd))
 
 			v.machine, err = firecracker.NewMachine(v.vmmCtx, v.fconfig, v.machineOpts...)
@@ -414,9 +555,12 @@ func (v *Virtualizer) Start() error {
 			}
 			v.state = virtualizers.Alive
 
-			go func() {
-				v.routes = util.LookForIP(v.serialLogger, v.routes)
-			}()
+			// rootless routes were forwarded to localhost in prepare
+			if !v.rootless {
+				go func() {
+					v.routes = util.LookForIP(v.serialLogger, v.routes)
+				}()
+			}
 
 			if err := v.machine.Wait(v.vmmCtx); err != nil {
 				// Should end when we ctrl-c no need to print this.
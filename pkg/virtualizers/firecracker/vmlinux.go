@@ -0,0 +1,278 @@
+package firecracker
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/vorteil/vorteil/pkg/elog"
+	"github.com/vorteil/vorteil/pkg/vkern"
+)
+
+const (
+	vmlinuxPrefix         = "firecracker-"
+	vmlinuxPartialSuffix  = ".part"
+	vmlinuxChecksumSuffix = ".sha256"
+)
+
+// VMLinux is a vmlinux binary stored in the directory firecracker boots
+// kernels from.
+type VMLinux struct {
+	Name    string       `json:"name"`
+	Kernel  vkern.CalVer `json:"kernel"`
+	Path    string       `json:"path"`
+	Size    int64        `json:"size"`
+	ModTime time.Time    `json:"modified"`
+}
+
+// VMLinuxName returns the file name of the vmlinux binary for kernel.
+func VMLinuxName(kernel string) string {
+	return vmlinuxPrefix + kernel
+}
+
+// ListVMLinux returns the vmlinux binaries in dir, oldest kernel first.
+// Downloads that were interrupted aren't included.
+func ListVMLinux(dir string) ([]VMLinux, error) {
+
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var list []VMLinux
+	for _, fi := range fis {
+		name := fi.Name()
+		if fi.IsDir() || !strings.HasPrefix(name, vmlinuxPrefix) || strings.HasSuffix(name, vmlinuxPartialSuffix) {
+			continue
+		}
+
+		// kernels that don't parse are kept, but sort as the oldest
+		kernel, _ := vkern.Parse(strings.TrimPrefix(name, vmlinuxPrefix))
+		list = append(list, VMLinux{
+			Name:    name,
+			Kernel:  kernel,
+			Path:    filepath.Join(dir, name),
+			Size:    fi.Size(),
+			ModTime: fi.ModTime(),
+		})
+	}
+
+	sort.SliceStable(list, func(i, j int) bool {
+		a, b := list[i].Kernel, list[j].Kernel
+		if a == "" || b == "" {
+			return a == "" && b != ""
+		}
+		return a.Less(b)
+	})
+
+	return list, nil
+
+}
+
+// FetchVMLinux returns the path to the vmlinux binary for kernel in dir,
+// downloading it first if it isn't there. Downloads are checked against the
+// SHA256 sum published alongside them, if there is one, and only moved into
+// place once they are complete, so an interrupted download is never booted.
+func FetchVMLinux(ctx context.Context, dir, kernel string, log elog.View) (string, error) {
+
+	name := VMLinuxName(kernel)
+	path := filepath.Join(dir, name)
+
+	_, err := os.Stat(path)
+	if err == nil {
+		return path, nil
+	}
+	if !os.IsNotExist(err) {
+		return "", err
+	}
+
+	err = os.MkdirAll(dir, os.ModePerm)
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequest(http.MethodGet, DownloadPath+name, nil)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return "", fmt.Errorf("'%s' VMLinux, does not exist", name)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("error downloading %s: %v -- %s", req.URL, resp.StatusCode, http.StatusText(resp.StatusCode))
+	}
+
+	f, err := os.Create(path + vmlinuxPartialSuffix)
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	p := log.NewProgress("Downloading VMLinux", "Bytes", resp.ContentLength)
+	defer p.Finish(false)
+
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(f, h), p.ProxyReader(resp.Body))
+	if err != nil {
+		return "", err
+	}
+
+	err = f.Close()
+	if err != nil {
+		return "", err
+	}
+
+	expected, err := fetchVMLinuxChecksum(ctx, name)
+	if err != nil {
+		return "", err
+	}
+
+	if sum := hex.EncodeToString(h.Sum(nil)); expected != "" && sum != expected {
+		return "", fmt.Errorf("'%s' failed checksum verification (expected %s, got %s): the download was probably interrupted or corrupted, run the command again to retry", name, expected, sum)
+	}
+
+	err = os.Rename(f.Name(), path)
+	if err != nil {
+		return "", err
+	}
+
+	return path, nil
+
+}
+
+// VerifyVMLinux compares the SHA256 sum of v to the one published for it. It
+// returns false without an error if no sum is published.
+func VerifyVMLinux(ctx context.Context, v VMLinux) (bool, error) {
+
+	expected, err := fetchVMLinuxChecksum(ctx, v.Name)
+	if err != nil {
+		return false, err
+	}
+
+	if expected == "" {
+		return false, nil
+	}
+
+	f, err := os.Open(v.Path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return false, err
+	}
+
+	if sum := hex.EncodeToString(h.Sum(nil)); sum != expected {
+		return false, fmt.Errorf("'%s' failed checksum verification (expected %s, got %s): delete it or prune it and it will be downloaded again when it's next needed", v.Name, expected, sum)
+	}
+
+	return true, nil
+
+}
+
+// PruneVMLinux deletes all but the newest keep vmlinux binaries in dir, as well
+// as any downloads that were interrupted, and returns the binaries it deleted.
+func PruneVMLinux(dir string, keep int) ([]VMLinux, error) {
+
+	list, err := ListVMLinux(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	for _, fi := range fis {
+		if strings.HasPrefix(fi.Name(), vmlinuxPrefix) && strings.HasSuffix(fi.Name(), vmlinuxPartialSuffix) {
+			err = os.Remove(filepath.Join(dir, fi.Name()))
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	var pruned []VMLinux
+	for i := 0; i < len(list)-keep; i++ {
+		err = os.Remove(list[i].Path)
+		if err != nil {
+			return pruned, err
+		}
+		pruned = append(pruned, list[i])
+	}
+
+	return pruned, nil
+
+}
+
+// fetchVMLinuxChecksum downloads the SHA256 sum published for the vmlinux
+// binary called name. It returns an empty string if none is published.
+func fetchVMLinuxChecksum(ctx context.Context, name string) (string, error) {
+
+	req, err := http.NewRequest(http.MethodGet, DownloadPath+name+vmlinuxChecksumSuffix, nil)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", fmt.Errorf("error in request for file at url '%s': %w", req.URL, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return "", nil
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("error downloading %s: %v -- %s", req.URL, resp.StatusCode, http.StatusText(resp.StatusCode))
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+	if err != nil {
+		return "", err
+	}
+
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return "", fmt.Errorf("published checksum for '%s' is empty", name)
+	}
+
+	sum := strings.ToLower(fields[0])
+	if x, err := hex.DecodeString(sum); err != nil || len(x) != sha256.Size {
+		return "", fmt.Errorf("published checksum '%s' for '%s' isn't a SHA256 sum", fields[0], name)
+	}
+
+	return sum, nil
+
+}
@@ -0,0 +1,75 @@
+package firecracker
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestListAndPruneVMLinux(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "vmlinux")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{
+		"firecracker-20.9.1",
+		"firecracker-20.10.2",
+		"firecracker-20.1.0",
+		"firecracker-20.11.0.part",
+		"firecracker-custom",
+		"unrelated",
+	} {
+		err = ioutil.WriteFile(filepath.Join(dir, name), []byte(name), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	list, err := ListVMLinux(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"firecracker-custom", "firecracker-20.1.0", "firecracker-20.9.1", "firecracker-20.10.2"}
+	if len(list) != len(expected) {
+		t.Fatalf("expected %d vmlinux binaries, got %v", len(expected), list)
+	}
+	for i := range expected {
+		if list[i].Name != expected[i] {
+			t.Errorf("expected %s at %d, got %s", expected[i], i, list[i].Name)
+		}
+	}
+
+	pruned, err := PruneVMLinux(dir, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(pruned) != 2 || pruned[0].Name != "firecracker-custom" || pruned[1].Name != "firecracker-20.1.0" {
+		t.Errorf("pruned the wrong binaries: %v", pruned)
+	}
+
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var left []string
+	for _, fi := range fis {
+		left = append(left, fi.Name())
+	}
+
+	if len(left) != 3 || left[0] != "firecracker-20.10.2" || left[1] != "firecracker-20.9.1" || left[2] != "unrelated" {
+		t.Errorf("wrong files left after pruning: %v", left)
+	}
+
+	list, err = ListVMLinux(filepath.Join(dir, "missing"))
+	if err != nil || len(list) != 0 {
+		t.Errorf("expected nothing in a missing directory, got %v, %v", list, err)
+	}
+
+}
@@ -17,10 +17,13 @@ import (
 // VirtualizerID is a unique identifier for Hyperv
 var VirtualizerID = "hyperv"
 
-// Config required for creating a Hyper-V VM
+// Config required for creating a Hyper-V VM. If NAT is set the VM is attached
+// to NATSwitchName rather than SwitchName, and its ports are forwarded to the
+// host.
 type Config struct {
 	Headless   bool
 	SwitchName string
+	NAT        bool
 }
 
 // Marshal the config into a byte[]
@@ -83,6 +86,11 @@ func (a *allocator) ValidateArgs(data []byte) error {
 		return err
 	}
 
+	// the nat switch is created when it is first needed
+	if c.NAT {
+		return nil
+	}
+
 	switches, err := virtualizers.VSwitches()
 	if err != nil {
 		return err
@@ -0,0 +1,225 @@
+package hyperv
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/vorteil/vorteil/pkg/vcfg"
+	"github.com/vorteil/vorteil/pkg/virtualizers"
+)
+
+// NAT networking attaches the VM to an internal switch shared by every Vorteil
+// VM, and uses WinNAT to give that switch's network access to the outside
+// world. There is no DHCP server on an internal switch, so the VM's network
+// interfaces are given static addresses on the NAT network, and each port the
+// VM exposes is mapped to a port on the host with a static NAT mapping, the
+// same way the qemu and virtualbox backends forward ports to localhost.
+
+const (
+	// NATSwitchName is the internal switch VMs are attached to when NAT
+	// networking is used. It is created the first time it is needed.
+	NATSwitchName = "vorteil-nat"
+
+	natName         = "vorteil-nat"
+	natGateway      = "192.168.77.1"
+	natPrefix       = "192.168.77.0/24"
+	natPrefixLength = "24"
+	natMask         = "255.255.255.0"
+
+	// addresses below natFirstHost are left for the host
+	natFirstHost = 10
+	natLastHost  = 254
+)
+
+// AssignNATAddresses gives each network interface in cfg a static address on
+// the NAT network. It must be applied to the VCFG the disk is built from,
+// since the addresses are baked into the disk. Addresses are picked at random
+// so that VMs running at the same time are unlikely to collide.
+func AssignNATAddresses(cfg *vcfg.VCFG) error {
+
+	n := len(cfg.Networks)
+	if n == 0 {
+		return nil
+	}
+
+	hosts := natLastHost - natFirstHost + 1
+	if n > hosts {
+		return fmt.Errorf("too many network interfaces for the NAT network (%d)", n)
+	}
+
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	first := natFirstHost + rng.Intn(hosts-n+1)
+
+	gateway := net.ParseIP(natGateway).To4()
+	for i := range cfg.Networks {
+		ip := make(net.IP, len(gateway))
+		copy(ip, gateway)
+		ip[3] = byte(first + i)
+
+		cfg.Networks[i].IP = ip.String()
+		cfg.Networks[i].Gateway = natGateway
+		cfg.Networks[i].Mask = natMask
+	}
+
+	return nil
+
+}
+
+// natMappingArgs returns the powershell arguments that forward external on
+// the host to port on the VM's internal address ip.
+func natMappingArgs(protocol, external, ip, port string) []string {
+	return []string{"Add-NetNatStaticMapping", "-NatName", natName,
+		"-Protocol", strings.ToUpper(protocol), "-ExternalIPAddress", "0.0.0.0",
+		"-ExternalPort", external, "-InternalIPAddress", ip, "-InternalPort", port}
+}
+
+// natUnmappingArgs returns the powershell arguments that remove every static
+// NAT mapping to the internal address ip.
+func natUnmappingArgs(ip string) []string {
+	return []string{"Get-NetNatStaticMapping", "-NatName", natName, "|",
+		"Where-Object", "{$_.InternalIPAddress", "-eq", fmt.Sprintf("'%s'}", ip), "|",
+		"Remove-NetNatStaticMapping", "-Confirm:$false"}
+}
+
+// setupNAT creates the internal switch, the host's address on it, and the
+// WinNAT network if they don't exist yet.
+func (o *operation) setupNAT() error {
+
+	switches, err := virtualizers.VSwitches()
+	if err != nil {
+		return err
+	}
+
+	found := false
+	for _, name := range switches {
+		if strings.TrimSpace(name) == NATSwitchName {
+			found = true
+		}
+	}
+
+	if !found {
+		cmd := exec.Command(virtualizers.Powershell, "New-VMSwitch", "-Name", NATSwitchName, "-SwitchType", "Internal")
+		output, err := o.execute(cmd)
+		if err != nil {
+			o.logger.Errorf("Error New-VMSwitch: %v", err)
+			return err
+		}
+		if len(output) != 0 {
+			o.logger.Infof("%s", output)
+		}
+	}
+
+	cmd := exec.Command(virtualizers.Powershell, "Get-NetIPAddress", "-IPAddress", natGateway, "-ErrorAction", "SilentlyContinue")
+	output, err := o.execute(cmd)
+	if err != nil {
+		return err
+	}
+
+	if strings.TrimSpace(output) == "" {
+		cmd = exec.Command(virtualizers.Powershell, "New-NetIPAddress", "-IPAddress", natGateway,
+			"-PrefixLength", natPrefixLength, "-InterfaceAlias", fmt.Sprintf("\"vEthernet (%s)\"", NATSwitchName))
+		_, err = o.execute(cmd)
+		if err != nil {
+			o.logger.Errorf("Error New-NetIPAddress: %v", err)
+			return err
+		}
+	}
+
+	cmd = exec.Command(virtualizers.Powershell, "Get-NetNat", "-Name", natName, "-ErrorAction", "SilentlyContinue")
+	output, err = o.execute(cmd)
+	if err != nil {
+		return err
+	}
+
+	if strings.TrimSpace(output) == "" {
+		cmd = exec.Command(virtualizers.Powershell, "New-NetNat", "-Name", natName, "-InternalIPInterfaceAddressPrefix", natPrefix)
+		output, err = o.execute(cmd)
+		if err != nil {
+			o.logger.Errorf("Error New-NetNat: %v", err)
+			return err
+		}
+		if strings.Contains(output, "New-NetNat :") {
+			return fmt.Errorf("unable to create the hyper-v nat network: %s", strings.TrimSpace(output))
+		}
+	}
+
+	return nil
+
+}
+
+// forwardPorts maps a port on the host to each port the VM exposes, trying
+// the same port number first, and records the addresses in the routes.
+func (o *operation) forwardPorts() error {
+
+	hasDefinedPorts := false
+
+	for i := range o.routes {
+		if i >= len(o.config.Networks) || net.ParseIP(o.config.Networks[i].IP) == nil {
+			return fmt.Errorf("network interface %d has no static address on the nat network", i)
+		}
+		ip := o.config.Networks[i].IP
+
+		lists := []struct {
+			protocol string
+			ports    []virtualizers.RouteMap
+		}{
+			{"tcp", o.routes[i].HTTP},
+			{"tcp", o.routes[i].HTTPS},
+			{"tcp", o.routes[i].TCP},
+			{"udp", o.routes[i].UDP},
+		}
+
+		for _, list := range lists {
+			for j, port := range list.ports {
+				bind, nr, err := virtualizers.BindPort("nat", list.protocol, port.Port, o.strictPorts)
+				if err != nil {
+					return err
+				}
+
+				cmd := exec.Command(virtualizers.Powershell, natMappingArgs(list.protocol, bind, ip, port.Port)...)
+				output, err := o.execute(cmd)
+				if err != nil {
+					o.logger.Errorf("Error Add-NetNatStaticMapping: %v", err)
+					return err
+				}
+				if strings.Contains(output, "Add-NetNatStaticMapping :") {
+					return fmt.Errorf("unable to forward port %s: %s", port.Port, strings.TrimSpace(output))
+				}
+
+				list.ports[j].Address = nr
+				hasDefinedPorts = true
+			}
+		}
+	}
+
+	if len(o.routes) > 0 && !hasDefinedPorts {
+		o.logger.Warnf("VM has network cards but no defined ports")
+	}
+
+	return nil
+
+}
+
+// removePortMappings removes the static NAT mappings made by forwardPorts.
+func (v *Virtualizer) removePortMappings() {
+	for i := range v.routes {
+		if v.config == nil || i >= len(v.config.Networks) || net.ParseIP(v.config.Networks[i].IP) == nil {
+			continue
+		}
+
+		cmd := exec.Command(virtualizers.Powershell, natUnmappingArgs(v.config.Networks[i].IP)...)
+		_, err := v.execute(cmd)
+		if err != nil {
+			v.logger.Errorf("Error Remove-NetNatStaticMapping: %v", err)
+		}
+	}
+}
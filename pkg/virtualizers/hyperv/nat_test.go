@@ -0,0 +1,61 @@
+package hyperv
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/vorteil/vorteil/pkg/vcfg"
+)
+
+func TestAssignNATAddresses(t *testing.T) {
+	cfg := &vcfg.VCFG{
+		Networks: []vcfg.NetworkInterface{{HTTP: []string{"8888"}}, {UDP: []string{"53"}}},
+	}
+
+	err := AssignNATAddresses(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, network, _ := net.ParseCIDR(natPrefix)
+	for i, nic := range cfg.Networks {
+		ip := net.ParseIP(nic.IP)
+		if ip == nil || !network.Contains(ip) || nic.IP == natGateway {
+			t.Errorf("network interface %d has a bad address %s", i, nic.IP)
+		}
+		if nic.Gateway != natGateway || nic.Mask != natMask {
+			t.Errorf("network interface %d has a bad gateway or mask", i)
+		}
+	}
+
+	if cfg.Networks[0].IP == cfg.Networks[1].IP {
+		t.Errorf("network interfaces were given the same address")
+	}
+}
+
+func TestNATMappingArgs(t *testing.T) {
+	args := natMappingArgs("udp", "5353", "192.168.77.20", "53")
+	expect := []string{"Add-NetNatStaticMapping", "-NatName", "vorteil-nat", "-Protocol", "UDP",
+		"-ExternalIPAddress", "0.0.0.0", "-ExternalPort", "5353", "-InternalIPAddress", "192.168.77.20", "-InternalPort", "53"}
+	if !reflect.DeepEqual(args, expect) {
+		t.Errorf("bad static mapping arguments, expected %v but got %v", expect, args)
+	}
+}
+
+func TestInitializeNAT(t *testing.T) {
+	c := &Config{
+		SwitchName: "Default Switch",
+		NAT:        true,
+	}
+
+	v := &Virtualizer{}
+	err := v.Initialize(c.Marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !v.nat || v.switchName != NATSwitchName {
+		t.Errorf("initialize failed, expected the nat switch but got %s", v.switchName)
+	}
+}
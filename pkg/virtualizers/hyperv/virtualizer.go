@@ -36,11 +36,13 @@ type Virtualizer struct {
 	headless     bool        // whether to show a gui when spawning a vm
 	created      time.Time   // time the vm was created
 	switchName   string      // The virtual switch hyper-v will use
+	nat          bool        // forward ports to the host through WinNAT instead of using switchName
 	folder       string      // The folder to store vm details and objects
 	disk         *os.File    // disk of the machine
 	logger       elog.View
 	serialLogger *logger.Logger                  // logs for the serial of the vm
 	routes       []virtualizers.NetworkInterface // api network interface that displays ports and network types
+	strictPorts  bool                            // fail instead of remapping ports that are in use
 
 	config  *vcfg.VCFG // config for the vm
 	sock    net.Conn   // net connection to listen for serial on
@@ -165,9 +167,11 @@ func (v *Virtualizer) Start() error {
 		v.state = virtualizers.Alive
 
 		go v.checkState()
-		go func() {
-			v.routes = util.LookForIP(v.serialLogger, v.routes)
-		}()
+		if !v.nat {
+			go func() {
+				v.routes = util.LookForIP(v.serialLogger, v.routes)
+			}()
+		}
 
 		err = v.headlessCheck()
 		if err != nil {
@@ -216,6 +220,9 @@ func (v *Virtualizer) Close(force bool) error {
 	if err != nil {
 		v.logger.Errorf("Error Remove-VM: %v", err)
 	}
+	if v.nat {
+		v.removePortMappings()
+	}
 	v.state = virtualizers.Deleted
 
 	v.disk.Close()
@@ -240,6 +247,10 @@ func (v *Virtualizer) Initialize(data []byte) error {
 	}
 	v.headless = c.Headless
 	v.switchName = c.SwitchName
+	v.nat = c.NAT
+	if v.nat {
+		v.switchName = NATSwitchName
+	}
 	return nil
 }
 
@@ -439,6 +450,7 @@ func (v *Virtualizer) Prepare(args *virtualizers.PrepareArgs) *virtualizers.Virt
 	v.pname = args.PName
 	// v.source = args.Source
 	v.routes = util.Routes(args.Config.Networks)
+	v.strictPorts = args.StrictPorts
 	v.state = virtualizers.Changing
 	v.vmdrive = args.VMDrive
 	v.created = time.Now()
@@ -449,7 +461,7 @@ func (v *Virtualizer) Prepare(args *virtualizers.PrepareArgs) *virtualizers.Virt
 	op.Logs = make(chan string, 128)
 	op.Error = make(chan error, 1)
 	op.Status = make(chan string, 10)
-	op.ctx = args.Context
+	op.ctx = virtualizers.PrepareContext(args)
 
 	o := new(virtualizers.VirtualizeOperation)
 	o.Logs = op.Logs
@@ -536,6 +548,14 @@ func (o *operation) prepare(args *virtualizers.PrepareArgs) {
 		return
 	}
 
+	if o.nat {
+		err := o.setupNAT()
+		if err != nil {
+			returnErr = err
+			return
+		}
+	}
+
 	o.config.VM.RAM.Align(vcfg.MiB * 2)
 
 	size := fmt.Sprintf("%v%s", o.config.VM.RAM.Units(vcfg.MiB), "MB")
@@ -563,15 +583,29 @@ func (o *operation) prepare(args *virtualizers.PrepareArgs) {
 		return
 	}
 
+	err = o.attachDisks(args.Disks)
+	if err != nil {
+		returnErr = err
+		return
+	}
+
 	err = o.setEnableServices()
 	if err != nil {
 		returnErr = err
 		return
 	}
+
+	if o.nat {
+		err = o.forwardPorts()
+		if err != nil {
+			returnErr = err
+			return
+		}
+	}
 	o.state = "ready"
 
 	if args.Start {
-		err = o.Start()
+		err = virtualizers.Start(o.ctx, o.Virtualizer)
 		if err != nil {
 			returnErr = err
 			return
@@ -580,6 +614,21 @@ func (o *operation) prepare(args *virtualizers.PrepareArgs) {
 
 }
 
+// attachDisks adds each additional disk to the VM after the boot disk.
+func (o *operation) attachDisks(disks []string) error {
+	for _, disk := range disks {
+		cmd := exec.Command(virtualizers.Powershell, "Add-VMHardDiskDrive", "-VMName", o.name, "-Path", filepath.ToSlash(disk))
+		output, err := o.execute(cmd)
+		if err != nil {
+			return err
+		}
+		if len(output) != 0 {
+			o.logger.Infof("%s", output)
+		}
+	}
+	return nil
+}
+
 func (o *operation) setEnableServices() error {
 	cmd := exec.Command(virtualizers.Powershell, "Enable-VMIntegrationService", "-VMName", o.name, "-Name", "Shutdown,Vss")
 	output, err := o.execute(cmd)
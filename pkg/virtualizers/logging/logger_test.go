@@ -1,6 +1,8 @@
 package logger
 
 import (
+	"bytes"
+	"strings"
 	"testing"
 )
 
@@ -29,3 +31,39 @@ func TestLogging(t *testing.T) {
 		t.Errorf("logging \"hello\" failed, expected \"%v\" but got \"%v\"", "hello", string(logs))
 	}
 }
+
+// TestProgramFilter writes tagged serial output in pieces and checks that only
+// the chosen program's lines come out, without their tags
+func TestProgramFilter(t *testing.T) {
+	input := "booting\n" + ProgramTag(0) + "first\n" + ProgramTag(1) + "sec" + "ond\n" + ProgramTag(0) + "third\n" + ProgramTag(1) + "partial"
+
+	for _, x := range []struct {
+		program  int
+		expected string
+	}{
+		{0, "first\nthird\n"},
+		{1, "second\npartial"},
+		{SystemOutput, "booting\n"},
+	} {
+		out := new(bytes.Buffer)
+		f := NewProgramFilter(out, x.program)
+		for _, chunk := range strings.SplitAfter(input, "e") {
+			f.Write([]byte(chunk))
+		}
+		f.Flush()
+
+		if out.String() != x.expected {
+			t.Errorf("filtering program %d failed, expected %q but got %q", x.program, x.expected, out.String())
+		}
+	}
+}
+
+// TestParseLine checks that malformed tags are treated as system output
+func TestParseLine(t *testing.T) {
+	for _, line := range []string{"[program] x\n", "[program -1] x\n", "[program 1]x\n", "[    0.000000] Linux\n"} {
+		index, text := ParseLine([]byte(line))
+		if index != SystemOutput || string(text) != line {
+			t.Errorf("expected %q to be system output, got program %d", line, index)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package logger
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// When system.tag-output is set in an app's VCFG, the guest's init prefixes
+// every line a program writes to the serial port with a tag holding the
+// program's index in the VCFG, like "[program 1] ". Lines without a tag come
+// from the kernel or from init itself.
+
+// SystemOutput is the program ParseLine reports for untagged lines.
+const SystemOutput = -1
+
+const programTagPrefix = "[program "
+
+// ProgramTag returns the tag the guest puts in front of lines written by the
+// program at index in the VCFG.
+func ProgramTag(index int) string {
+	return fmt.Sprintf("%s%d] ", programTagPrefix, index)
+}
+
+// ParseLine returns the index of the program that wrote line and the line
+// without its tag, or SystemOutput and the unchanged line if it isn't tagged.
+func ParseLine(line []byte) (int, []byte) {
+
+	if !bytes.HasPrefix(line, []byte(programTagPrefix)) {
+		return SystemOutput, line
+	}
+
+	rest := line[len(programTagPrefix):]
+	k := bytes.Index(rest, []byte("] "))
+	if k < 0 {
+		return SystemOutput, line
+	}
+
+	index, err := strconv.Atoi(string(rest[:k]))
+	if err != nil || index < 0 {
+		return SystemOutput, line
+	}
+
+	return index, rest[k+2:]
+
+}
+
+// ProgramFilter is a writer that only passes on the serial output of a single
+// program, with its tags removed. Output is filtered a line at a time, so an
+// incomplete line is held back until it's finished or the filter is flushed.
+type ProgramFilter struct {
+	w       io.Writer
+	program int
+	buf     []byte
+}
+
+// NewProgramFilter returns a ProgramFilter that writes the lines of the
+// program at index in the VCFG to w, or only the untagged lines if index is
+// SystemOutput.
+func NewProgramFilter(w io.Writer, index int) *ProgramFilter {
+	return &ProgramFilter{
+		w:       w,
+		program: index,
+	}
+}
+
+// Write implements io.Writer.
+func (f *ProgramFilter) Write(p []byte) (int, error) {
+
+	f.buf = append(f.buf, p...)
+
+	for {
+		k := bytes.IndexByte(f.buf, '\n')
+		if k < 0 {
+			break
+		}
+
+		line := f.buf[:k+1]
+		f.buf = f.buf[k+1:]
+
+		err := f.writeLine(line)
+		if err != nil {
+			return len(p), err
+		}
+	}
+
+	return len(p), nil
+
+}
+
+// Flush writes out an incomplete last line, if it belongs to the program.
+func (f *ProgramFilter) Flush() error {
+
+	if len(f.buf) == 0 {
+		return nil
+	}
+
+	line := f.buf
+	f.buf = nil
+
+	return f.writeLine(line)
+
+}
+
+func (f *ProgramFilter) writeLine(line []byte) error {
+
+	index, text := ParseLine(line)
+	if index != f.program {
+		return nil
+	}
+
+	_, err := f.w.Write(text)
+	return err
+
+}
@@ -576,6 +576,12 @@ func (mgr *Manager) Prepare(name string, args *PrepareArgs) (*VirtualizeOperatio
 	if !ok {
 		return nil, fmt.Errorf("virtualizer '%s' has unrecognized virtualizer type: %s", name, ptype)
 	}
+
+	err = PrepareContext(args).Err()
+	if err != nil {
+		return nil, err
+	}
+
 	p := palloc.Alloc()
 	err = p.Initialize(data)
 	if err != nil {
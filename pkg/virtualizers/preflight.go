@@ -0,0 +1,57 @@
+package virtualizers
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/vorteil/vorteil/pkg/vcfg"
+)
+
+// minFreeSpace is how much free space the directory a VM's files are stored
+// in needs beyond its disks, for the hypervisor's configuration, logs and
+// sockets.
+const minFreeSpace = 64 * vcfg.MiB
+
+// Preflight checks that the host can run the VM described by args on the
+// virtualizer vtype before it is prepared, so that missing resources or
+// hypervisor support are reported with a way to fix them, instead of as a
+// failure somewhere in the hypervisor's output. Conflicts that only
+// sometimes stop a VM from running are logged as warnings.
+func Preflight(vtype string, args *PrepareArgs) error {
+
+	err := hostAcceleration(vtype)
+	if err != nil {
+		return err
+	}
+
+	if msg := hostConflict(vtype); msg != "" && args.Logger != nil {
+		args.Logger.Warnf("%s", msg)
+	}
+
+	if args.Config != nil {
+		if free, ok := hostFreeMemory(); ok && int64(args.Config.VM.RAM) > free {
+			return fmt.Errorf("not enough free memory to run the virtual machine: it needs %s but the host only has %s available; close other applications or virtual machines, or lower vm.ram (e.g. --vm.ram)",
+				args.Config.VM.RAM, vcfg.Bytes(free))
+		}
+	}
+
+	dir := args.VMDrive
+	if dir == "" && args.ImagePath != "" {
+		dir = filepath.Dir(args.ImagePath)
+	}
+
+	if dir != "" {
+		if free, ok := hostFreeSpace(dir); ok && free < int64(minFreeSpace) {
+			return fmt.Errorf("not enough free disk space in '%s' to run the virtual machine: it needs at least %s but only %s is free; free up space or point TMPDIR (TEMP on windows) at a larger disk",
+				dir, minFreeSpace, vcfg.Bytes(free))
+		}
+	}
+
+	return nil
+
+}
@@ -0,0 +1,44 @@
+//go:build darwin
+// +build darwin
+
+package virtualizers
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"errors"
+
+	"golang.org/x/sys/unix"
+)
+
+// hostAcceleration returns an error if QEMU can't use Hypervisor.framework,
+// which it runs VMs with on macOS.
+func hostAcceleration(vtype string) error {
+
+	if vtype != "qemu" {
+		return nil
+	}
+
+	support, err := unix.SysctlUint32("kern.hv_support")
+	if err != nil || support == 0 {
+		return errors.New("Hypervisor.framework isn't available (kern.hv_support is 0): this Mac's CPU doesn't support it, or if this host is itself a virtual machine enable nested virtualization for it")
+	}
+
+	return nil
+
+}
+
+// hostConflict returns no warnings, because the hypervisors supported on
+// macOS can run alongside each other.
+func hostConflict(vtype string) string {
+	return ""
+}
+
+// hostFreeMemory doesn't report the free memory on macOS, which compresses
+// and swaps memory too readily for a free page count to be meaningful.
+func hostFreeMemory() (int64, bool) {
+	return 0, false
+}
@@ -0,0 +1,89 @@
+//go:build linux
+// +build linux
+
+package virtualizers
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const kvmDevice = "/dev/kvm"
+
+// hostAcceleration returns an error if the virtualizers that run VMs with KVM
+// can't use it.
+func hostAcceleration(vtype string) error {
+
+	if vtype != "qemu" && vtype != "firecracker" {
+		return nil
+	}
+
+	f, err := os.OpenFile(kvmDevice, os.O_RDWR, 0)
+	if err == nil {
+		f.Close()
+		return nil
+	}
+
+	switch {
+	case os.IsNotExist(err):
+		return errors.New("KVM isn't available (/dev/kvm doesn't exist): enable virtualization (VT-x or AMD-V) in the BIOS and load the kvm_intel or kvm_amd module, or enable nested virtualization if this host is itself a virtual machine")
+	case os.IsPermission(err):
+		return errors.New("no permission to use KVM (/dev/kvm): add your user to the kvm group with 'sudo usermod -aG kvm $USER' and log in again")
+	default:
+		return err
+	}
+
+}
+
+// hostConflict returns a warning if VirtualBox may be stopped from running
+// VMs by KVM, which can't share the CPU's virtualization extensions with it.
+func hostConflict(vtype string) string {
+
+	if vtype != "virtualbox" {
+		return ""
+	}
+
+	for _, module := range []string{"kvm_intel", "kvm_amd"} {
+		if _, err := os.Stat("/sys/module/" + module); err == nil {
+			return "The " + module + " module is loaded, so VirtualBox can't start virtual machines while KVM ones are running: stop them, or unload it with 'sudo modprobe -r " + module + "'"
+		}
+	}
+
+	return ""
+
+}
+
+// hostFreeMemory returns the memory available to start new applications
+// without swapping, as estimated by the kernel.
+func hostFreeMemory() (int64, bool) {
+
+	f, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0, false
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) < 2 || fields[0] != "MemAvailable:" {
+			continue
+		}
+		kb, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return 0, false
+		}
+		return kb * 1024, true
+	}
+
+	return 0, false
+
+}
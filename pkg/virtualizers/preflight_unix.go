@@ -0,0 +1,25 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package virtualizers
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import "golang.org/x/sys/unix"
+
+// hostFreeSpace returns the free space available to unprivileged users on the
+// file-system dir is on.
+func hostFreeSpace(dir string) (int64, bool) {
+
+	var st unix.Statfs_t
+	err := unix.Statfs(dir, &st)
+	if err != nil {
+		return 0, false
+	}
+
+	return int64(st.Bavail) * int64(st.Bsize), true
+
+}
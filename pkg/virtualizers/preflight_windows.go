@@ -0,0 +1,128 @@
+//go:build windows
+// +build windows
+
+package virtualizers
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"errors"
+	"os/exec"
+	"strings"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+var procGlobalMemoryStatusEx = windows.NewLazySystemDLL("kernel32.dll").NewProc("GlobalMemoryStatusEx")
+
+// memoryStatusEx is the MEMORYSTATUSEX structure GlobalMemoryStatusEx fills.
+type memoryStatusEx struct {
+	Length               uint32
+	MemoryLoad           uint32
+	TotalPhys            uint64
+	AvailPhys            uint64
+	TotalPageFile        uint64
+	AvailPageFile        uint64
+	TotalVirtual         uint64
+	AvailVirtual         uint64
+	AvailExtendedVirtual uint64
+}
+
+// hypervisorPresent reports whether the Windows hypervisor is running, which
+// is the case whenever Hyper-V or the Windows Hypervisor Platform is enabled.
+// The second value is false if it couldn't be determined.
+func hypervisorPresent() (bool, bool) {
+
+	if Powershell == "" {
+		return false, false
+	}
+
+	out, err := exec.Command(Powershell, "-NoProfile", "-Command", "(Get-CimInstance Win32_ComputerSystem).HypervisorPresent").Output()
+	if err != nil {
+		return false, false
+	}
+
+	switch strings.TrimSpace(string(out)) {
+	case "True":
+		return true, true
+	case "False":
+		return false, true
+	default:
+		return false, false
+	}
+
+}
+
+// hostAcceleration returns an error if the Windows hypervisor that QEMU and
+// Hyper-V run VMs with isn't running.
+func hostAcceleration(vtype string) error {
+
+	if vtype != "qemu" && vtype != "hyperv" {
+		return nil
+	}
+
+	present, ok := hypervisorPresent()
+	if !ok || present {
+		return nil
+	}
+
+	if vtype == "qemu" {
+		return errors.New("the Windows Hypervisor Platform isn't running, which QEMU needs for acceleration: enable it with 'Enable-WindowsOptionalFeature -Online -FeatureName HypervisorPlatform' in an administrator PowerShell, then reboot")
+	}
+
+	return errors.New("Hyper-V isn't running: enable it with 'Enable-WindowsOptionalFeature -Online -FeatureName Microsoft-Hyper-V -All' in an administrator PowerShell, then reboot")
+
+}
+
+// hostConflict returns a warning if VirtualBox or VMware has to run VMs on
+// top of the Windows hypervisor, which older versions of both can't do.
+func hostConflict(vtype string) string {
+
+	if vtype != "virtualbox" && vtype != "vmware" {
+		return ""
+	}
+
+	present, ok := hypervisorPresent()
+	if !ok || !present {
+		return ""
+	}
+
+	return "Hyper-V is enabled, so " + vtype + " has to run virtual machines through the Windows hypervisor, which is slow and fails on older versions: use --platform=hyperv instead, or disable it with 'bcdedit /set hypervisorlaunchtype off' in an administrator prompt and reboot"
+
+}
+
+// hostFreeMemory returns the physical memory available on the host.
+func hostFreeMemory() (int64, bool) {
+
+	status := memoryStatusEx{Length: uint32(unsafe.Sizeof(memoryStatusEx{}))}
+	r, _, _ := procGlobalMemoryStatusEx.Call(uintptr(unsafe.Pointer(&status)))
+	if r == 0 {
+		return 0, false
+	}
+
+	return int64(status.AvailPhys), true
+
+}
+
+// hostFreeSpace returns the free space available to the user on the volume
+// dir is on.
+func hostFreeSpace(dir string) (int64, bool) {
+
+	p, err := windows.UTF16PtrFromString(dir)
+	if err != nil {
+		return 0, false
+	}
+
+	var free, total, totalFree uint64
+	err = windows.GetDiskFreeSpaceEx(p, &free, &total, &totalFree)
+	if err != nil {
+		return 0, false
+	}
+
+	return int64(free), true
+
+}
@@ -53,6 +53,7 @@ type Virtualizer struct {
 	networkType string      // type of network to spawn on
 	folder      string      // folder to store vm details
 	disk        *os.File    // disk of the machine
+	disks       []string    // paths of the boot disk and any additional disks
 	source      interface{} // details about how the vm was made
 	// loggers
 	logger elog.View
@@ -65,8 +66,9 @@ type Virtualizer struct {
 	sock    net.Conn      // net connection
 
 	// VCFG Stuff
-	routes []virtualizers.NetworkInterface // api network interface that displays ports and network types
-	config *vcfg.VCFG                      // config for the vm
+	routes      []virtualizers.NetworkInterface // api network interface that displays ports and network types
+	strictPorts bool                            // fail instead of remapping ports that are in use
+	config      *vcfg.VCFG                      // config for the vm
 
 	vmdrive string // store disks in this directory
 
@@ -91,6 +93,16 @@ func createArgs(cpus uint, memory int, headless bool, diskpath string, diskforma
 	return argsCommand
 }
 
+// createDiskArgs attaches each additional disk to the same controller as the
+// boot disk, in order.
+func createDiskArgs(disks []string, diskformat string) string {
+	var argsCommand string
+	for i, disk := range disks {
+		argsCommand += fmt.Sprintf(" -device scsi-hd,drive=hd%[1]d -drive if=none,file=\"%[2]s\",format=%[3]s,id=hd%[1]d", i+1, filepath.ToSlash(disk), diskformat)
+	}
+	return argsCommand
+}
+
 // Type returns the type of virtualizer
 func (v *Virtualizer) Type() string {
 	return VirtualizerID
@@ -234,7 +246,7 @@ func (v *Virtualizer) initLogging() error {
 
 func (v *Virtualizer) Bind(args string, i int, j int, protocol string, port virtualizers.RouteMap, networkType string) (string, string, bool, error) {
 	var hasDefinedPorts bool
-	bind, nr, err := virtualizers.BindPort(v.networkType, protocol, port.Port)
+	bind, nr, err := virtualizers.BindPort(v.networkType, protocol, port.Port, v.strictPorts)
 	if err != nil {
 		return "", "", false, err
 	}
@@ -337,6 +349,84 @@ func (v *Virtualizer) Detach(source string) error {
 	return nil
 }
 
+// Export writes the disks of a VM that has been prepared but not started to
+// dir, along with a script that launches qemu with the arguments it would have
+// been started with. The monitor that vorteil controls the VM through is left
+// out.
+func (v *Virtualizer) Export(dir string) ([]string, error) {
+
+	if v.state != virtualizers.Ready || v.command == nil || v.command.Process != nil {
+		return nil, errors.New("virtual machine must be prepared but not started to export it")
+	}
+
+	paths, err := virtualizers.ExportFiles(dir, v.disks...)
+	if err != nil {
+		return nil, err
+	}
+
+	// paths are moved to dir before quoting, in case it needs quoting when
+	// the folder didn't
+	args := make([]string, len(v.command.Args))
+	r := strings.NewReplacer(v.folder, dir, filepath.ToSlash(v.folder), filepath.ToSlash(dir))
+	for i, arg := range v.command.Args {
+		args[i] = r.Replace(arg)
+	}
+
+	name, script := launchScript(args, runtime.GOOS == "windows")
+	path, err := virtualizers.ExportText(dir, name, v.folder, script, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(paths, path), nil
+
+}
+
+// launchScript returns the name and contents of a shell script, or a batch
+// file on windows, that runs the qemu command args without its monitor.
+func launchScript(args []string, windows bool) (string, string) {
+
+	var quoted []string
+	for i := 0; i < len(args); i++ {
+		if args[i] == "-monitor" {
+			i++
+			continue
+		}
+		quoted = append(quoted, quoteArg(args[i], windows))
+	}
+
+	if windows {
+		return "qemu.bat", fmt.Sprintf("@echo off\r\n%s %%*\r\n", strings.Join(quoted, " "))
+	}
+
+	return "qemu.sh", fmt.Sprintf("#!/bin/sh\nexec %s \"$@\"\n", strings.Join(quoted, " "))
+
+}
+
+// quoteArg quotes arg for a shell script, or a batch file on windows, if it
+// has anything in it that the shell would otherwise interpret.
+func quoteArg(arg string, windows bool) string {
+
+	if windows {
+		arg = strings.ReplaceAll(arg, "%", "%%")
+	}
+
+	safe := func(r rune) bool {
+		return (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || strings.ContainsRune("-_./,:=@+%", r)
+	}
+
+	if arg != "" && strings.IndexFunc(arg, func(r rune) bool { return !safe(r) }) == -1 {
+		return arg
+	}
+
+	if windows {
+		return `"` + strings.ReplaceAll(arg, `"`, `""`) + `"`
+	}
+
+	return "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+
+}
+
 // Close shuts down the virtual machine and cleans up the disk and folders
 func (v *Virtualizer) Close(force bool) error {
 	v.logger.Debugf("Deleting VM")
@@ -391,10 +481,11 @@ func (v *Virtualizer) Prepare(args *virtualizers.PrepareArgs) *virtualizers.Virt
 	v.serialLogger = logger.NewLogger(2048 * 10)
 	v.logger.Debugf("Preparing VM")
 	v.routes = util.Routes(args.Config.Networks)
+	v.strictPorts = args.StrictPorts
 	op.Logs = make(chan string, 128)
 	op.Error = make(chan error, 1)
 	op.Status = make(chan string, 10)
-	op.ctx = args.Context
+	op.ctx = virtualizers.PrepareContext(args)
 
 	o := new(virtualizers.VirtualizeOperation)
 	o.Logs = op.Logs
@@ -117,12 +117,14 @@ func (o *operation) prepare(args *virtualizers.PrepareArgs) {
 	o.state = "initializing"
 	o.name = args.Name
 	o.folder = filepath.Dir(args.ImagePath)
+	o.disks = append([]string{args.ImagePath}, args.Disks...)
 	o.id = strings.Split(filepath.Base(o.folder), "-")[1]
 
 	diskpath := filepath.ToSlash(args.ImagePath)
 	diskformat := "raw"
 
 	argsCommand := createArgs(o.config.VM.CPUs, o.config.VM.RAM.Units(vcfg.MiB), o.headless, diskpath, diskformat)
+	argsCommand += createDiskArgs(args.Disks, diskformat)
 	argsCommand += fmt.Sprintf(" -monitor unix:%s,server,nowait", filepath.ToSlash(filepath.Join(o.folder, "monitor.sock")))
 
 	params, err := shellwords.Parse(argsCommand)
@@ -145,7 +147,7 @@ func (o *operation) prepare(args *virtualizers.PrepareArgs) {
 	o.state = "ready"
 
 	if args.Start {
-		err = o.Start()
+		err = virtualizers.Start(o.ctx, o.Virtualizer)
 		if err != nil {
 			returnErr = err
 		}
@@ -131,3 +131,25 @@ func TestRoutes(t *testing.T) {
 		}
 	}
 }
+
+func TestLaunchScript(t *testing.T) {
+	args := []string{"qemu-system-x86_64", "-m", "256", "-drive", "if=none,file=/tmp/my disk,format=raw,id=hd0", "-monitor", "unix:/tmp/monitor.sock,server,nowait", "-name", "it's"}
+
+	name, script := launchScript(args, false)
+	if name != "qemu.sh" {
+		t.Errorf("expected script name %v but got %v", "qemu.sh", name)
+	}
+	expected := "#!/bin/sh\nexec qemu-system-x86_64 -m 256 -drive 'if=none,file=/tmp/my disk,format=raw,id=hd0' -name 'it'\\''s' \"$@\"\n"
+	if script != expected {
+		t.Errorf("expected script %q but got %q", expected, script)
+	}
+
+	name, script = launchScript(args, true)
+	if name != "qemu.bat" {
+		t.Errorf("expected script name %v but got %v", "qemu.bat", name)
+	}
+	expected = "@echo off\r\nqemu-system-x86_64 -m 256 -drive \"if=none,file=/tmp/my disk,format=raw,id=hd0\" -name \"it's\" %*\r\n"
+	if script != expected {
+		t.Errorf("expected script %q but got %q", expected, script)
+	}
+}
@@ -131,21 +131,38 @@ func BridgedDevices() ([]string, error) {
 // has already been created
 func CheckNameExistsVirtualBox(name string) (bool, error) {
 
-	command := exec.Command("VBoxManage", "showvminfo", name)
+	command := exec.Command("VBoxManage", "list", "vms")
 	var outB, errB bytes.Buffer
 	command.Stdout = &outB
 	command.Stderr = &errB
 
 	err := command.Run()
 	if err != nil {
-		errMsg := strings.Split(fmt.Sprintf("%s", command.Stderr), "\n")[0]
-		if errMsg == fmt.Sprintf("VBoxManage: error: Could not find a registered machine named '%s'", name) {
-			return false, nil
+		return false, fmt.Errorf("%v: %s", err, strings.TrimSpace(errB.String()))
+	}
+
+	for _, vm := range VirtualBoxVMs(outB.String()) {
+		if vm == name {
+			return true, nil
 		}
-		return false, err
 	}
 
-	return true, nil
+	return false, nil
+}
+
+// VirtualBoxVMs parses the names of the vms from the output of 'VBoxManage list vms',
+// which has a line for each vm in the form: "name" {uuid}
+func VirtualBoxVMs(list string) []string {
+	var names []string
+	for _, line := range strings.Split(list, "\n") {
+		line = strings.TrimSpace(line)
+		k := strings.LastIndex(line, "\" {")
+		if !strings.HasPrefix(line, "\"") || k < 1 {
+			continue
+		}
+		names = append(names, line[1:k])
+	}
+	return names
 }
 
 // CheckNameExistsHyperV checks the hyperv driver to see if a vm with the same name already exists
@@ -171,8 +188,21 @@ func CheckNameExistsHyperV(name string) (bool, error) {
 	return false, nil
 }
 
-// BindPort attempts to bind ports and if not available will assign a different port.
-func BindPort(netType, protocol, port string) (string, string, error) {
+// PortInUseError is returned by BindPort when a port is already in use on the
+// host and remapping it isn't allowed.
+type PortInUseError struct {
+	Protocol string
+	Port     string
+}
+
+// Error implements error.
+func (e *PortInUseError) Error() string {
+	return fmt.Sprintf("%s port %s is already in use on the host", e.Protocol, e.Port)
+}
+
+// BindPort attempts to bind ports and if not available will assign a different
+// port, unless strict is set, in which case it returns a PortInUseError.
+func BindPort(netType, protocol, port string, strict bool) (string, string, error) {
 	var (
 		bind     string
 		netRoute string
@@ -204,6 +234,9 @@ func BindPort(netType, protocol, port string) (string, string, error) {
 				listener.Close()
 			}
 		}
+		if !isBound && strict {
+			return "", netRoute, &PortInUseError{Protocol: protocol, Port: port}
+		}
 		if !isBound {
 			// log that it failed to bind netRoute
 			netRoute = "localhost:0"
@@ -241,6 +274,55 @@ func BindPort(netType, protocol, port string) (string, string, error) {
 	return bind, netRoute, nil
 }
 
+// PortRemap is a port that was forwarded from a different host port than the
+// one requested, because the requested port was in use.
+type PortRemap struct {
+	NIC       int
+	Protocol  string
+	Requested string
+	Actual    string
+}
+
+// RemappedPorts returns every port forwarded to networks from a different host
+// port than the one requested, in the order of the NICs and their ports.
+func RemappedPorts(networks []NetworkInterface) []PortRemap {
+
+	var remaps []PortRemap
+
+	for i, nic := range networks {
+		lists := []struct {
+			protocol string
+			ports    []RouteMap
+		}{
+			{"http", nic.HTTP},
+			{"https", nic.HTTPS},
+			{"tcp", nic.TCP},
+			{"udp", nic.UDP},
+		}
+
+		for _, list := range lists {
+			for _, port := range list.ports {
+				if port.Address == "" {
+					continue
+				}
+				actual := port.Address[strings.LastIndex(port.Address, ":")+1:]
+				if actual == port.Port {
+					continue
+				}
+				remaps = append(remaps, PortRemap{
+					NIC:       i,
+					Protocol:  list.protocol,
+					Requested: port.Port,
+					Actual:    actual,
+				})
+			}
+		}
+	}
+
+	return remaps
+
+}
+
 // GetExecutable returns the name of the executable for the virtualizer.
 func GetExecutable(virtualizer string) (string, error) {
 	switch virtualizer {
@@ -10,6 +10,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"net"
 	"os"
 	"os/exec"
@@ -42,12 +43,15 @@ type Virtualizer struct {
 	networkDevice string         // type of network device to use
 	folder        string         // folder to store vm details
 	disk          *os.File       // disk of the machine
+	diskpath      string         // path of the boot disk
+	disks         []string       // additional disks attached after the boot disk
 	serialLogger  *logger.Logger // serial logger for serial output of app
 	logger        elog.View      // logger for the CLI
 	// subServer *graph.Graph
-	routes []virtualizers.NetworkInterface // api network interface that displays ports
-	config *vcfg.VCFG                      // config for the vm
-	sock   net.Conn                        // Connection to listen to for serial output
+	routes      []virtualizers.NetworkInterface // api network interface that displays ports
+	strictPorts bool                            // fail instead of remapping ports that are in use
+	config      *vcfg.VCFG                      // config for the vm
+	sock        net.Conn                        // Connection to listen to for serial output
 
 	vmdrive string // store disks in this directory
 
@@ -63,35 +67,18 @@ func (v *Virtualizer) State() string {
 	return v.state
 }
 
-// getState fetches the state to maintain a polling request incase it gets cleaned up from a different gui
+// getState fetches the state to maintain a polling request incase it gets cleaned up from a different gui.
+// An empty state means the vm is no longer registered.
 func (v *Virtualizer) getState() (string, error) {
-	cmd := exec.Command("VBoxManage", "showvminfo", v.name)
-
-	stdout := new(bytes.Buffer)
-	cmd.Stdout = stdout
-
-	err := v.execute(cmd)
+	info, err := v.vmInfo()
 	if err != nil {
-		if strings.Contains(err.Error(), "Could not find a registered machine named") || strings.Contains(err.Error(), "The object is not ready") {
+		if strings.Contains(err.Error(), "The object is not ready") {
 			return "", nil
 		}
 		return "", err
 	}
 
-	stdoutStr := stdout.String()
-	if len(stdoutStr) == 0 {
-		return "", fmt.Errorf("failed to get stdout from state check")
-	}
-
-	var parsedState string
-	lines := strings.Split(stdoutStr, "\n")
-	for _, l := range lines {
-		if strings.HasPrefix(l, "State:") {
-			parsedState = strings.TrimSpace(strings.Split(strings.TrimPrefix(l, "State:"), "(")[0])
-			break
-		}
-	}
-	return parsedState, nil
+	return info["VMState"], nil
 }
 
 // Stop stops the virtual machine
@@ -112,7 +99,7 @@ func (v *Virtualizer) Stop() error {
 			if err != nil {
 				return err
 			}
-			if state == "powered off" {
+			if state == "" || isStopped(state) {
 				break
 			}
 			if count > 10 {
@@ -338,11 +325,12 @@ func (v *Virtualizer) Prepare(args *virtualizers.PrepareArgs) *virtualizers.Virt
 	v.serialLogger = logger.NewLogger(2048 * 10)
 	v.logger.Debugf("Preparing VM")
 	v.routes = util.Routes(args.Config.Networks)
+	v.strictPorts = args.StrictPorts
 
 	op.Logs = make(chan string, 128)
 	op.Error = make(chan error, 1)
 	op.Status = make(chan string, 10)
-	op.ctx = args.Context
+	op.ctx = virtualizers.PrepareContext(args)
 
 	o := new(virtualizers.VirtualizeOperation)
 	o.Logs = op.Logs
@@ -354,6 +342,36 @@ func (v *Virtualizer) Prepare(args *virtualizers.PrepareArgs) *virtualizers.Virt
 	return o
 }
 
+// Export writes the .vbox file and disks of a VM that has been prepared but
+// isn't running to dir, with the .vbox file's paths pointing at the copies, so
+// that it can be added to VirtualBox with 'VBoxManage registervm'.
+func (v *Virtualizer) Export(dir string) ([]string, error) {
+
+	if v.state != virtualizers.Ready {
+		return nil, errors.New("virtual machine must be prepared but not running to export it")
+	}
+
+	paths, err := virtualizers.ExportFiles(dir, append([]string{v.diskpath}, v.disks...)...)
+	if err != nil {
+		return nil, err
+	}
+
+	// createvm puts the machine's settings in a folder of its own under the
+	// base folder
+	vbox, err := ioutil.ReadFile(filepath.Join(v.folder, v.name, v.name+".vbox"))
+	if err != nil {
+		return nil, err
+	}
+
+	path, err := virtualizers.ExportText(dir, v.name+".vbox", v.folder, string(vbox), 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(paths, path), nil
+
+}
+
 // Detach ... removes vm from active vms list and moves content to source directory
 // func (v *Virtualizer) Detach(source string) error {
 // 	if v.state != virtualizers.Ready {
@@ -430,17 +448,17 @@ func (v *Virtualizer) checkState() {
 		state, err := v.getState()
 		if err != nil {
 			// Supressing errors that don't affect getting the state of the machine / errors that may error out because the virtual machine is gone.
-			if !strings.Contains(err.Error(), "signal: interrupt") && !strings.Contains(err.Error(), "Could not find a registered machine") && !strings.Contains(err.Error(), "exit status 3221225786") && !strings.Contains(err.Error(), "The object is not ready") {
+			if !strings.Contains(err.Error(), "signal: interrupt") && !strings.Contains(err.Error(), "exit status 3221225786") {
 				v.logger.Errorf("Getting VM State: %s", err.Error())
 			}
 		}
 		if state == "" {
 			break
 		}
-		if state == "running" {
+		if state == vmStateRunning {
 			v.state = virtualizers.Alive
 		}
-		if state == "powered off" {
+		if isStopped(state) {
 			v.state = virtualizers.Ready
 		}
 		time.Sleep(time.Second * 1)
@@ -510,12 +528,22 @@ func (v *Virtualizer) prepareVM(diskpath string) error {
 		return err
 	}
 
+	for i, disk := range v.disks {
+		cmd = exec.Command("VBoxManage", "storageattach", v.name,
+			"--storagectl", fmt.Sprintf("SCSI-%s", filepath.Base(diskpath)), "--port", strconv.Itoa(i+1), "--device", "0",
+			"--type", "hdd", "--medium", disk)
+		err = v.execute(cmd)
+		if err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
 func (v *Virtualizer) Bind(args []string, i int, j int, protocol string, port virtualizers.RouteMap, networkType string) ([]string, string, bool, error) {
 	var hasDefinedPorts bool
-	bind, nr, err := virtualizers.BindPort(v.networkType, protocol, port.Port)
+	bind, nr, err := virtualizers.BindPort(v.networkType, protocol, port.Port, v.strictPorts)
 	if err != nil {
 		return nil, "", false, err
 	}
@@ -697,6 +725,8 @@ func (o *operation) prepare(args *virtualizers.PrepareArgs) {
 	o.name = args.Name
 	o.id = randstr.Hex(5)
 	o.folder = filepath.Dir(args.ImagePath)
+	o.diskpath = args.ImagePath
+	o.disks = args.Disks
 
 	_, err = o.checkIfBridged()
 	if err != nil {
@@ -734,7 +764,7 @@ func (o *operation) startupVM(path string, start bool) error {
 	go o.checkState()
 
 	if start {
-		err = o.Start()
+		err = virtualizers.Start(o.ctx, o.Virtualizer)
 		if err != nil {
 			return fmt.Errorf("Error starting vm: %s", err.Error())
 		}
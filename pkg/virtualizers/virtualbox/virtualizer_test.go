@@ -138,3 +138,34 @@ func TestRoutes(t *testing.T) {
 		}
 	}
 }
+
+var machineReadable = `name="vorteil-vm"
+memory=1024
+VMState="poweroff"
+VMStateChangeTime="2020-06-01T03:12:45.000000000"
+"SATA Controller-0-0"="C:\\Users\\vorteil\\disk.vmdk"
+description="says \"hello\""
+`
+
+func TestParseMachineReadable(t *testing.T) {
+	fields := parseMachineReadable(strings.ReplaceAll(machineReadable, "\n", "\r\n"))
+
+	expect := map[string]string{
+		"name":                "vorteil-vm",
+		"memory":              "1024",
+		"VMState":             "poweroff",
+		"VMStateChangeTime":   "2020-06-01T03:12:45.000000000",
+		"SATA Controller-0-0": "C:\\Users\\vorteil\\disk.vmdk",
+		"description":         "says \"hello\"",
+	}
+
+	for k, v := range expect {
+		if fields[k] != v {
+			t.Errorf("parsing machine-readable output failed, expected %s to be '%s' but got '%s'", k, v, fields[k])
+		}
+	}
+
+	if !isStopped(fields["VMState"]) || isStopped(vmStateRunning) {
+		t.Errorf("vm states weren't interpreted properly")
+	}
+}
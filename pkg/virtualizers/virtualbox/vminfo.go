@@ -0,0 +1,106 @@
+package virtualbox
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"bufio"
+	"bytes"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/vorteil/vorteil/pkg/virtualizers"
+)
+
+// VM states reported in the VMState field of VBoxManage's machine-readable
+// output. Unlike the human-readable output these aren't translated.
+const (
+	vmStateRunning  = "running"
+	vmStatePoweroff = "poweroff"
+	vmStateAborted  = "aborted"
+	vmStateSaved    = "saved"
+)
+
+// isStopped returns true if the VM isn't running and can be started, whether
+// it was shut down or crashed.
+func isStopped(vmState string) bool {
+	switch vmState {
+	case vmStatePoweroff, vmStateAborted, vmStateSaved:
+		return true
+	default:
+		return false
+	}
+}
+
+// parseMachineReadable parses the key="value" lines VBoxManage prints when
+// given --machinereadable. Keys with special characters in them are quoted
+// too, and numbers aren't quoted at all.
+func parseMachineReadable(data string) map[string]string {
+
+	fields := make(map[string]string)
+
+	s := bufio.NewScanner(strings.NewReader(data))
+	for s.Scan() {
+		line := strings.TrimRight(s.Text(), "\r")
+
+		var key, value string
+		if strings.HasPrefix(line, "\"") {
+			end := strings.Index(line[1:], "\"=")
+			if end < 0 {
+				continue
+			}
+			key = line[1 : end+1]
+			value = line[end+3:]
+		} else {
+			k := strings.Index(line, "=")
+			if k < 0 {
+				continue
+			}
+			key = line[:k]
+			value = line[k+1:]
+		}
+
+		fields[key] = unquote(value)
+	}
+
+	return fields
+
+}
+
+func unquote(s string) string {
+	if len(s) >= 2 && strings.HasPrefix(s, "\"") && strings.HasSuffix(s, "\"") {
+		u, err := strconv.Unquote(s)
+		if err != nil {
+			return s[1 : len(s)-1]
+		}
+		return u
+	}
+	return s
+}
+
+// vmInfo returns the machine-readable details of the VM, or nil if it isn't
+// registered with VirtualBox anymore.
+func (v *Virtualizer) vmInfo() (map[string]string, error) {
+
+	cmd := exec.Command("VBoxManage", "showvminfo", v.name, "--machinereadable")
+
+	stdout := new(bytes.Buffer)
+	cmd.Stdout = stdout
+
+	err := v.execute(cmd)
+	if err != nil {
+		// the error message is translated, so check the list of vms
+		// rather than the message to see if it's because the vm is gone
+		exists, xerr := virtualizers.CheckNameExistsVirtualBox(v.name)
+		if xerr == nil && !exists {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return parseMachineReadable(stdout.String()), nil
+
+}
@@ -66,13 +66,24 @@ type PrepareArgs struct {
 	Name      string // name of the vm
 	PName     string // name of virtualizer spawned from
 	Logger    elog.View
-	FCPath    string // used for firecracker to find vmlinux binaries
-	Context   context.Context
-	Start     bool       // to control whether its to start automatically
-	Config    *vcfg.VCFG // the vcfg attached to the VM
+	FCPath    string          // used for firecracker to find vmlinux binaries
+	Context   context.Context // if done, aborts preparing the VM and stops it once started
+	Start     bool            // to control whether its to start automatically
+	Config    *vcfg.VCFG      // the vcfg attached to the VM
 	Source    interface{}
 	ImagePath string
-	VMDrive   string // path to store disks for vms
+	Disks     []string // paths to additional disks to attach after the boot disk, in the same format
+	VMDrive   string   // path to store disks for vms
+
+	// KernelArgs are extra kernel arguments appended to the image's own, for
+	// virtualizers that boot the kernel directly instead of through the
+	// image's bootloader.
+	KernelArgs string
+
+	// StrictPorts makes preparing the VM fail with a PortInUseError if a
+	// port it forwards is already in use on the host, instead of forwarding
+	// a random free port in its place.
+	StrictPorts bool
 }
 
 // VirtualizeOperation is a struct that contains ways to log for the operation
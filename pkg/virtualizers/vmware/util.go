@@ -6,6 +6,7 @@ package vmware
  */
 
 import (
+	"fmt"
 	"runtime"
 	"strings"
 
@@ -190,3 +191,20 @@ func GenerateVMX(cores, memory, disk, name, dir string, numberOfNetworkCards int
 
 	return vmx
 }
+
+// GenerateVMXDisks returns vmx entries attaching each additional disk to the
+// same controller as the boot disk, skipping unit 7 which is reserved for the
+// controller itself.
+func GenerateVMXDisks(disks []string) string {
+
+	var vmx string
+	for i, disk := range disks {
+		unit := i + 1
+		if unit >= 7 {
+			unit++
+		}
+		vmx += fmt.Sprintf("scsi0:%[1]d.present = \"TRUE\"\nscsi0:%[1]d.fileName = \"%[2]s\"\n", unit, disk)
+	}
+
+	return vmx
+}
@@ -50,6 +50,7 @@ type Virtualizer struct {
 	folder       string         // path to the folder containing vmx, disk for vm
 	disk         *os.File       // the disk the vm is running
 	vmxPath      string         // the vmx file workstation will use
+	disks        []string       // paths of the boot disk and any additional disks
 	networkType  string         // the type of network the vm spawns on
 	source       interface{}    //details about how the source was created using api.source struct
 	serialLogger *logger.Logger // serial output logger for app that gets run
@@ -205,6 +206,33 @@ func (v *Virtualizer) Close(force bool) error {
 	return nil
 }
 
+// Export writes the vmx file and disks of a VM that has been prepared but not
+// started to dir, with the vmx file's paths pointing at the copies.
+func (v *Virtualizer) Export(dir string) ([]string, error) {
+
+	if v.state != virtualizers.Ready || v.startCommand == nil || v.startCommand.Process != nil {
+		return nil, errors.New("virtual machine must be prepared but not started to export it")
+	}
+
+	paths, err := virtualizers.ExportFiles(dir, v.disks...)
+	if err != nil {
+		return nil, err
+	}
+
+	vmx, err := ioutil.ReadFile(v.vmxPath)
+	if err != nil {
+		return nil, err
+	}
+
+	path, err := virtualizers.ExportText(dir, filepath.Base(v.vmxPath), v.folder, string(vmx), 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(paths, path), nil
+
+}
+
 // Detach removes vm from active vm list
 // func (v *Virtualizer) Detach(source string) error {
 // 	if v.state != virtualizers.Ready {
@@ -428,7 +456,7 @@ func (v *Virtualizer) Prepare(args *virtualizers.PrepareArgs) *virtualizers.Virt
 	op.Logs = make(chan string, 128)
 	op.Error = make(chan error, 1)
 	op.Status = make(chan string, 10)
-	op.ctx = args.Context
+	op.ctx = virtualizers.PrepareContext(args)
 
 	op.Virtualizer = v
 
@@ -480,10 +508,12 @@ func (o *operation) prepare(args *virtualizers.PrepareArgs) {
 	o.state = "initializing"
 	o.id = randstr.Hex(5)
 	o.folder = filepath.Dir(args.ImagePath)
+	o.disks = append([]string{args.ImagePath}, args.Disks...)
 
 	o.config.VM.RAM.Align(vcfg.MiB * 4)
 
 	vmxString := GenerateVMX(strconv.Itoa(int(o.config.VM.CPUs)), strconv.Itoa(o.config.VM.RAM.Units(vcfg.MiB)), args.ImagePath, o.name, o.folder, len(o.routes), o.networkType, o.id)
+	vmxString += GenerateVMXDisks(args.Disks)
 
 	vmxPath := filepath.Join(o.folder, o.name+".vmx")
 	o.vmxPath = vmxPath
@@ -509,7 +539,7 @@ func (o *operation) prepare(args *virtualizers.PrepareArgs) {
 	o.state = "ready"
 
 	if args.Start {
-		err = o.Start()
+		err = virtualizers.Start(o.ctx, o.Virtualizer)
 		if err != nil {
 			returnErr = fmt.Errorf("Error starting vm: %v", err)
 			return
@@ -0,0 +1,164 @@
+package vkern
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// LayerCache keeps kernel layers assembled from a Bundle on disk so that
+// repeated builds using the same kernel and tags (e.g. the busybox shell) can
+// skip decompressing and re-assembling them. Layers are keyed by the kernel
+// version, a hash of the bundle file, and the requested tags.
+type LayerCache struct {
+	dir     string
+	lock    sync.Mutex
+	digests map[string]string
+}
+
+// NewLayerCache returns a LayerCache that stores its layers in dir.
+func NewLayerCache(dir string) (*LayerCache, error) {
+
+	err := os.MkdirAll(dir, 0777)
+	if err != nil {
+		return nil, err
+	}
+
+	return &LayerCache{
+		dir:     dir,
+		digests: make(map[string]string),
+	}, nil
+
+}
+
+func (c *LayerCache) bundleDigest(location string) (string, error) {
+
+	fi, err := os.Stat(location)
+	if err != nil {
+		return "", err
+	}
+
+	memo := fmt.Sprintf("%s:%d:%d", location, fi.Size(), fi.ModTime().UnixNano())
+	if digest, ok := c.digests[memo]; ok {
+		return digest, nil
+	}
+
+	f, err := os.Open(location)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	hasher := sha256.New()
+	_, err = io.Copy(hasher, f)
+	if err != nil {
+		return "", err
+	}
+
+	digest := hex.EncodeToString(hasher.Sum(nil))
+	c.digests[memo] = digest
+
+	return digest, nil
+
+}
+
+func tagsDigest(tags []string) string {
+
+	var trimmed []string
+	for _, tag := range tags {
+		trimmed = append(trimmed, strings.TrimPrefix(tag, "+"))
+	}
+	sort.Strings(trimmed)
+
+	sum := sha256.Sum256([]byte(strings.Join(trimmed, ",")))
+	return hex.EncodeToString(sum[:])[:16]
+
+}
+
+// prune removes layers cached for an older bundle of the same version.
+func (c *LayerCache) prune(version CalVer, digest string) {
+
+	matches, err := filepath.Glob(filepath.Join(c.dir, version.String()+"-*.tar"))
+	if err != nil {
+		return
+	}
+
+	for _, match := range matches {
+		if !strings.HasPrefix(filepath.Base(match), version.String()+"-"+digest+"-") {
+			_ = os.Remove(match)
+		}
+	}
+
+}
+
+func (c *LayerCache) store(path string, bundle *Bundle, tags []string) error {
+
+	f, err := ioutil.TempFile(c.dir, "layer-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	rdr := bundle.Reader(tags...)
+	defer rdr.Close()
+
+	_, err = io.Copy(f, rdr)
+	if err != nil {
+		return err
+	}
+
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), path)
+
+}
+
+// Reader returns the same data as calling Reader on the bundle with the
+// provided tags, assembling and caching it first if necessary.
+func (c *LayerCache) Reader(bundle *ManagedBundle, tags ...string) (io.ReadCloser, error) {
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	digest, err := c.bundleDigest(bundle.Location())
+	if err != nil {
+		return nil, err
+	}
+
+	version := bundle.Bundle().Version()
+	path := filepath.Join(c.dir, fmt.Sprintf("%s-%s-%s.tar", version.String(), digest[:16], tagsDigest(tags)))
+
+	f, err := os.Open(path)
+	if err == nil {
+		return f, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	c.prune(version, digest[:16])
+
+	err = c.store(path, bundle.Bundle(), tags)
+	if err != nil {
+		return nil, fmt.Errorf("failed to cache kernel layer: %w", err)
+	}
+
+	return os.Open(path)
+
+}
@@ -0,0 +1,108 @@
+package vkern
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// checksumSuffix is appended to a kernel bundle's URL to find its published
+// SHA256 sum, which is in the format written by sha256sum.
+const checksumSuffix = ".sha256"
+
+// fetchChecksum downloads and parses the SHA256 sum published for the kernel
+// bundle at url. It returns an empty string if the source doesn't publish
+// sums, since older sources only sign their bundles.
+func fetchChecksum(ctx context.Context, url string) (string, error) {
+
+	req, err := http.NewRequest(http.MethodGet, url+checksumSuffix, nil)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", fmt.Errorf("error in request for file at url '%s': %w", req.URL, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return "", nil
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("error downloading %s: %v -- %s", req.URL, resp.StatusCode, http.StatusText(resp.StatusCode))
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+	if err != nil {
+		return "", err
+	}
+
+	return parseChecksum(data)
+
+}
+
+// parseChecksum returns the SHA256 sum in data, which is either just the hex
+// encoded sum or a line of sha256sum output.
+func parseChecksum(data []byte) (string, error) {
+
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return "", fmt.Errorf("published checksum is empty")
+	}
+
+	sum := strings.ToLower(fields[0])
+	if x, err := hex.DecodeString(sum); err != nil || len(x) != sha256.Size {
+		return "", fmt.Errorf("published checksum '%s' isn't a SHA256 sum", fields[0])
+	}
+
+	return sum, nil
+
+}
+
+// verifyChecksum compares the SHA256 sum of a downloaded kernel bundle to the
+// published one, if there is one.
+func verifyChecksum(version CalVer, expected string, actual []byte) error {
+
+	if expected == "" {
+		return nil
+	}
+
+	if sum := hex.EncodeToString(actual); sum != expected {
+		return fmt.Errorf("kernel %s failed checksum verification (expected %s, got %s): the download was probably interrupted or corrupted, run the command again to retry", version, expected, sum)
+	}
+
+	return nil
+
+}
+
+// fileChecksum returns the SHA256 sum of the file at path.
+func fileChecksum(path string) ([]byte, error) {
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return nil, err
+	}
+
+	return h.Sum(nil), nil
+
+}
@@ -8,6 +8,7 @@ package vkern
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -171,9 +172,6 @@ func (mgr *CLIRemoteManager) forceUpdate(ctx context.Context) error {
 
 func (mgr *CLIRemoteManager) get(version CalVer) error {
 
-	prog := mgr.log.NewProgress(fmt.Sprintf("Fetching kernel: %s", version.String()), "", 0)
-	defer prog.Finish(false)
-
 	mgr.log.Infof("Downloading kernel version: %s", version.String())
 
 	kernelName := filenameFromVersion(version)
@@ -203,6 +201,14 @@ func (mgr *CLIRemoteManager) get(version CalVer) error {
 		_ = os.Remove(signatureFile)
 	}()
 
+	checksum, err := fetchChecksum(context.Background(), kernelURL)
+	if err != nil {
+		return err
+	}
+	if checksum == "" {
+		mgr.log.Warnf("remote kernels source '%s' doesn't publish checksums, relying on the kernel's signature alone", mgr.url)
+	}
+
 	var wg sync.WaitGroup
 	wg.Add(2)
 
@@ -217,7 +223,9 @@ func (mgr *CLIRemoteManager) get(version CalVer) error {
 		}
 	}
 
-	download := func(src, dest string) {
+	// download saves src to dest, also writing it to w. If label isn't empty
+	// the download is shown as a progress bar.
+	download := func(src, dest, label string, w io.Writer) {
 		defer wg.Done()
 
 		f, err := os.Create(dest)
@@ -232,35 +240,50 @@ func (mgr *CLIRemoteManager) get(version CalVer) error {
 			setFirstError(fmt.Errorf("error in request for file at url '%s': %w", src, err))
 			return
 		}
+		defer resp.Body.Close()
 
-		if resp.Body != nil {
-			defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			setFirstError(fmt.Errorf("error downloading %s: %v -- %s", src, resp.StatusCode, http.StatusText(resp.StatusCode)))
+			return
 		}
 
-		p := mgr.log.NewProgress(fmt.Sprintf("Downloading file from url: %s", src), "KiB", resp.ContentLength)
-		defer p.Finish(false)
-
-		r := p.ProxyReader(resp.Body)
-		defer r.Close()
+		var r io.Reader = resp.Body
+		if label != "" {
+			p := mgr.log.NewProgress(label, "KiB", resp.ContentLength)
+			defer p.Finish(false)
+			pr := p.ProxyReader(resp.Body)
+			defer pr.Close()
+			defer func() {
+				if err == nil {
+					p.Finish(true)
+				}
+			}()
+			r = pr
+		}
 
-		_, err = io.Copy(f, r)
+		n, err := io.Copy(io.MultiWriter(f, w), r)
 		if err != nil {
 			setFirstError(fmt.Errorf("error downloading kernel file '%s': %w", dest, err))
 			return
 		}
 
+		if resp.ContentLength >= 0 && n != resp.ContentLength {
+			err = fmt.Errorf("error downloading kernel file '%s': received %d of %d bytes, run the command again to retry", dest, n, resp.ContentLength)
+			setFirstError(err)
+			return
+		}
+
 		err = f.Close()
 		if err != nil {
 			setFirstError(fmt.Errorf("error saving kernel file '%s': %w", dest, err))
 			return
 		}
-
-		p.Finish(true)
-		return
 	}
 
-	go download(kernelURL, kernelFile)
-	go download(signatureURL, signatureFile)
+	hasher := sha256.New()
+
+	go download(kernelURL, kernelFile, fmt.Sprintf("Downloading kernel %s", version.String()), hasher)
+	go download(signatureURL, signatureFile, "", ioutil.Discard)
 
 	wg.Wait()
 
@@ -268,6 +291,11 @@ func (mgr *CLIRemoteManager) get(version CalVer) error {
 		return firstError
 	}
 
+	err = verifyChecksum(version, checksum, hasher.Sum(nil))
+	if err != nil {
+		return err
+	}
+
 	krrData := mustGetAsset("vorteil.gpg")
 	krr := bytes.NewReader(krrData)
 
@@ -317,8 +345,6 @@ func (mgr *CLIRemoteManager) get(version CalVer) error {
 		return err
 	}
 
-	prog.Finish(true)
-
 	return nil
 }
 
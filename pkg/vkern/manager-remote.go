@@ -75,6 +75,7 @@ func (mgr *RemoteManager) pollOnce(ctx context.Context) error {
 
 	mgr.lock.Lock()
 	for i, tuple := range list {
+		tuple := tuple
 		fi, err := os.Stat(filepath.Join(mgr.dir, filenameFromVersion(tuple.Version)))
 		if err == nil {
 			if tuple.ModTime.Before(fi.ModTime()) {
@@ -289,6 +290,24 @@ func (mgr *RemoteManager) get(version CalVer) error {
 		return firstError
 	}
 
+	checksum, err := fetchChecksum(context.Background(), kernelURL)
+	if err != nil {
+		return err
+	}
+
+	if checksum != "" {
+		sum, err := fileChecksum(kernelFile)
+		if err != nil {
+			return err
+		}
+
+		err = verifyChecksum(version, checksum, sum)
+		if err != nil {
+			Logger("Remote manager for '%s' downloaded a corrupt kernel: %v", mgr.url, err)
+			return err
+		}
+	}
+
 	err = validateKernelSignature(kernelFile, signatureFile)
 	if err != nil {
 		// update to cached
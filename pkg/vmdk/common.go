@@ -11,6 +11,8 @@ import (
 	"math/rand"
 	"strings"
 	"time"
+
+	"github.com/vorteil/vorteil/pkg/elog"
 )
 
 const (
@@ -50,3 +52,12 @@ func generateDiskUID() string {
 	binary.LittleEndian.PutUint32(b[:], uint32(rand.Int31()))
 	return strings.ToUpper(fmt.Sprintf("%X", b))
 }
+
+// traceHeader logs the fields of a VMDK header that hypervisors look at when
+// deciding whether they can open an image.
+func traceHeader(log elog.Logger, hdr *Header) {
+	log.Tracef("vmdk header: version %d, flags %#x, capacity %d sectors, grains of %d sectors, %d entries per grain table, compression %d",
+		hdr.Version, hdr.Flags, hdr.Capacity, hdr.GrainSize, hdr.NumGTEsPerGT, hdr.CompressAlgorithm)
+	log.Tracef("vmdk header: descriptor at sector %d (%d sectors), redundant grain directory at sector %d, grain directory at sector %d, overhead %d",
+		hdr.DescriptorOffset, hdr.DescriptorSize, hdr.RGDOffset, hdr.GDOffset, hdr.OverHead)
+}
@@ -10,6 +10,8 @@ import (
 	"fmt"
 	"io"
 	"strings"
+
+	"github.com/vorteil/vorteil/pkg/elog"
 )
 
 type HolePredictor interface {
@@ -30,6 +32,8 @@ type SparseWriter struct {
 	hdr          *Header
 	cursor       int64
 	grainOffsets []int64
+
+	log elog.Logger
 }
 
 func sparseDescriptor(name string, totalDataGrains int64) string {
@@ -99,6 +103,19 @@ func (w *SparseWriter) writeSparseHeader() error {
 
 }
 
+// grainSector returns the sector grain i is stored at, or zero if it's a hole
+// and isn't stored at all.
+func (w *SparseWriter) grainSector(i int64) int64 {
+
+	grainSector := w.grainOffsets[i]
+	if i+1 < int64(len(w.grainOffsets)) && grainSector == w.grainOffsets[i+1] {
+		return 0
+	}
+
+	return grainSector / SectorSize
+
+}
+
 func (w *SparseWriter) writeGrainData() error {
 	var err error
 
@@ -133,11 +150,7 @@ func (w *SparseWriter) writeGrainData() error {
 
 	for i := int64(0); i < w.totalDataGrains; i++ {
 
-		grainSector := int64(w.grainOffsets[i])
-		if i+1 < int64(len(w.grainOffsets)) && grainSector == int64(w.grainOffsets[i+1]) {
-			grainSector = 0
-		}
-		grainSector /= SectorSize
+		grainSector := w.grainSector(i)
 
 		if i%TableMaxRows == 0 {
 			table := i / TableMaxRows
@@ -179,11 +192,7 @@ func (w *SparseWriter) writeGrainData() error {
 
 	for i := int64(0); i < w.totalDataGrains; i++ {
 
-		grainSector := int64(w.grainOffsets[i])
-		if i+1 < int64(len(w.grainOffsets)) && grainSector == int64(w.grainOffsets[i+1]) {
-			grainSector = 0
-		}
-		grainSector /= SectorSize
+		grainSector := w.grainSector(i)
 
 		if i%TableMaxRows == 0 {
 			table := i / TableMaxRows
@@ -244,6 +253,50 @@ func (w *SparseWriter) init() error {
 	return nil
 }
 
+// SetLogger sets the logger the SparseWriter traces the metadata it writes to.
+// Everything but the grains themselves is written when the SparseWriter is
+// created, so it's traced right away.
+func (w *SparseWriter) SetLogger(log elog.Logger) {
+
+	w.log = log
+	if log == nil {
+		return
+	}
+
+	traceHeader(log, w.hdr)
+
+	log.Tracef("vmdk grain directories: %d grain tables, directories of %d sectors followed by tables of %d sectors", w.totalTables, w.totalGDSectors, w.totalGTSectors)
+
+	var total int64
+	for table := int64(0); table < w.totalTables; table++ {
+
+		var allocated, first, last int64
+		for i := table * TableMaxRows; i < (table+1)*TableMaxRows && i < w.totalDataGrains; i++ {
+			sector := w.grainSector(i)
+			if sector == 0 {
+				continue
+			}
+			if allocated == 0 {
+				first = sector
+			}
+			last = sector
+			allocated++
+		}
+
+		total += allocated
+		if allocated == 0 {
+			log.Tracef("vmdk grain table %d: every grain is a hole", table)
+			continue
+		}
+
+		log.Tracef("vmdk grain table %d: %d grains allocated, stored from sector %d to %d", table, allocated, first, last+SectorsPerGrain-1)
+
+	}
+
+	log.Tracef("vmdk grains: %d of %d allocated, data starts at sector %d", total, w.totalDataGrains, int64(w.hdr.OverHead)*SectorsPerGrain)
+
+}
+
 func (w *SparseWriter) Write(p []byte) (int, error) {
 
 	k, err := w.w.Write(p)
@@ -14,6 +14,7 @@ import (
 	"io"
 	"strings"
 
+	"github.com/vorteil/vorteil/pkg/elog"
 	"github.com/vorteil/vorteil/pkg/vio"
 )
 
@@ -49,6 +50,8 @@ type StreamOptimizedWriter struct {
 	totalGTSectors     int64
 	grainNo            int64
 	grainCounter       int64
+
+	log elog.Logger
 }
 
 func streamDescriptor(name string, totalDataGrains int64) string {
@@ -178,6 +181,26 @@ type grainMarker struct {
 	Size uint32
 }
 
+// tableGrains returns the number of allocated grains in a grain table.
+func tableGrains(table []uint32) int {
+
+	var n int
+	for _, x := range table {
+		if x != 0 {
+			n++
+		}
+	}
+
+	return n
+
+}
+
+func (w *StreamOptimizedWriter) tracef(format string, x ...interface{}) {
+	if w.log != nil {
+		w.log.Tracef(format, x...)
+	}
+}
+
 func (w *StreamOptimizedWriter) flushGrain() error {
 	var err error
 	defer func() {
@@ -189,15 +212,10 @@ func (w *StreamOptimizedWriter) flushGrain() error {
 
 	// flush table if necessary
 	if w.grainNo/TableMaxRows != w.streamCurrentTable {
-		var writeTable bool
-		for _, x := range w.streamTable {
-			if x != 0 {
-				writeTable = true
-				break
-			}
-		}
+		grains := tableGrains(w.streamTable)
 
-		if !writeTable {
+		if grains == 0 {
+			w.tracef("vmdk grain table %d: every grain is a hole, so it's left out", w.streamCurrentTable)
 			w.streamDirectory = append(w.streamDirectory, 0)
 			w.streamCurrentTable++
 		} else {
@@ -220,6 +238,7 @@ func (w *StreamOptimizedWriter) flushGrain() error {
 			// add table location to directory
 			offset := uint32(pos / SectorSize)
 			w.streamDirectory = append(w.streamDirectory, offset+1)
+			w.tracef("vmdk grain table %d at sector %d: %d grains allocated", w.streamCurrentTable, offset+1, grains)
 			_, err = w.w.Seek(pos+512+2048, io.SeekStart)
 			if err != nil {
 				return err
@@ -299,6 +318,21 @@ func (w *StreamOptimizedWriter) flushGrain() error {
 	return nil
 }
 
+// SetLogger sets the logger the StreamOptimizedWriter traces the metadata it
+// writes to. The header is written when the StreamOptimizedWriter is created,
+// so it's traced right away, but the grain tables and directory are traced as
+// they are written.
+func (w *StreamOptimizedWriter) SetLogger(log elog.Logger) {
+
+	w.log = log
+	if log == nil {
+		return
+	}
+
+	traceHeader(log, w.hdr)
+
+}
+
 // Write implements io.Writer.
 func (w *StreamOptimizedWriter) Write(p []byte) (int, error) {
 
@@ -387,6 +421,7 @@ func (w *StreamOptimizedWriter) writeFooter() error {
 	}
 	offset := pos / SectorSize
 	w.streamDirectory = append(w.streamDirectory, uint32(offset+1))
+	w.tracef("vmdk grain table %d at sector %d: %d grains allocated", w.streamCurrentTable, offset+1, tableGrains(w.streamTable))
 
 	// write table to disk
 	err = binary.Write(w.w, binary.LittleEndian, append(marker, w.streamTable...))
@@ -426,6 +461,7 @@ func (w *StreamOptimizedWriter) writeFooter() error {
 	// add table location to directory
 	gdOffset := (pos + 512) / 512
 	offset = pos + 512 + 4*int64(len(w.streamDirectory))
+	w.tracef("vmdk grain directory at sector %d: %d tables, %d of %d grains allocated", gdOffset, w.streamCurrentTable, w.grainCounter, w.totalDataGrains)
 
 	_, err = w.w.Seek(offset, io.SeekStart)
 	if err != nil {
@@ -443,6 +479,10 @@ func (w *StreamOptimizedWriter) writeFooter() error {
 
 	// write footer
 	w.hdr.GDOffset = uint64(gdOffset)
+	if w.log != nil {
+		w.log.Tracef("vmdk footer at sector %d", (offset+512)/SectorSize)
+		traceHeader(w.log, w.hdr)
+	}
 	err = binary.Write(w.w, binary.LittleEndian, w.hdr)
 	if err != nil {
 		return err
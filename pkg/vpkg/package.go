@@ -9,6 +9,7 @@ import (
 	"bytes"
 	"compress/flate"
 	"compress/gzip"
+	"crypto/sha256"
 	"encoding/binary"
 	"encoding/hex"
 	"errors"
@@ -19,9 +20,11 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"time"
 
+	"github.com/cespare/xxhash/v2"
 	"github.com/djherbis/buffer"
 	"github.com/djherbis/nio"
 	"github.com/vorteil/vorteil/pkg/vcfg"
@@ -45,11 +48,12 @@ needed to produce a Vorteil disk image.
 const magic = 0x004c494554524f56 // "VORTEIL "
 
 type header struct {
-	Magic        uint64
-	VersionMajor uint8
-	VersionMinor uint8
-	VersionPatch uint8
-	Pad          [501]byte
+	Magic         uint64
+	VersionMajor  uint8
+	VersionMinor  uint8
+	VersionPatch  uint8
+	HashAlgorithm HashAlgorithm
+	Pad           [500]byte
 }
 
 const headerLength = 512
@@ -60,28 +64,100 @@ const headerLength = 512
 // them alphabetically, and we prefer the components to be
 // extracted in this order for performance reasons.
 const (
-	vcfgPath = "./1.vcfg"
-	iconPath = "./2.icon"
-	fsPath   = "./4.fs"
+	vcfgPath  = "./1.vcfg"
+	iconPath  = "./2.icon"
+	fsPath    = "./4.fs"
+	disksPath = "./5.disks"
 )
 
 // ..
 const (
 	SemverMajor    = 3
-	SemverMinor    = 0
+	SemverMinor    = 2
 	SemverRevision = 0
 )
 
+// HashAlgorithm identifies the digest used to compute the
+// hash of a package. The algorithm is recorded in the package
+// header so that anything comparing package hashes (e.g.
+// repository deduplication and caching) knows how they were
+// produced. Packages created before the algorithm was recorded
+// read as HashAdler32.
+type HashAlgorithm uint8
+
+// Supported package hash algorithms. Adler-32 is the default
+// for backwards compatibility, but it collides far too easily
+// to be relied upon to identify package contents. Prefer
+// HashXXH64 for speed or HashSHA256 where a cryptographic
+// digest is required.
+const (
+	HashAdler32 HashAlgorithm = iota
+	HashXXH64
+	HashSHA256
+)
+
+var hashAlgorithmNames = map[HashAlgorithm]string{
+	HashAdler32: "adler32",
+	HashXXH64:   "xxh64",
+	HashSHA256:  "sha256",
+}
+
+// String returns the canonical name of the algorithm.
+func (alg HashAlgorithm) String() string {
+	if name, ok := hashAlgorithmNames[alg]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown(%d)", uint8(alg))
+}
+
+// ParseHashAlgorithm resolves the name of a supported hash
+// algorithm, case-insensitively.
+func ParseHashAlgorithm(s string) (HashAlgorithm, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	for alg, name := range hashAlgorithmNames {
+		if s == name {
+			return alg, nil
+		}
+	}
+	return 0, fmt.Errorf("unsupported hash algorithm '%s'", s)
+}
+
 // Hasher ..
 type Hasher struct {
-	hash.Hash32
+	hash.Hash
+	Algorithm HashAlgorithm
 }
 
-// NewHasher ..
+// NewHasher returns a Hasher using the default (Adler-32)
+// algorithm.
 func NewHasher() *Hasher {
 	return &Hasher{
-		Hash32: adler32.New(),
+		Hash:      adler32.New(),
+		Algorithm: HashAdler32,
+	}
+}
+
+// NewHasherWithAlgorithm returns a Hasher using the provided
+// algorithm.
+func NewHasherWithAlgorithm(alg HashAlgorithm) (*Hasher, error) {
+
+	var h hash.Hash
+
+	switch alg {
+	case HashAdler32:
+		h = adler32.New()
+	case HashXXH64:
+		h = xxhash.New()
+	case HashSHA256:
+		h = sha256.New()
+	default:
+		return nil, fmt.Errorf("unsupported hash algorithm '%s'", alg)
 	}
+
+	return &Hasher{
+		Hash:      h,
+		Algorithm: alg,
+	}, nil
 }
 
 // String ..
@@ -89,6 +165,12 @@ func (h *Hasher) String() string {
 	return fmt.Sprintf(hex.EncodeToString(h.Sum(nil)))
 }
 
+// Digest returns the hash prefixed by the name of its
+// algorithm, e.g. "sha256:e3b0c442...".
+func (h *Hasher) Digest() string {
+	return h.Algorithm.String() + ":" + h.String()
+}
+
 // Compression constants are defined here and copied from
 // the standard library flate package so that code importing
 // vpkg does not need to also import flate.
@@ -121,6 +203,12 @@ type Builder interface {
 	// package. The default is DefaultCompression.
 	SetCompressionLevel(level int)
 
+	// SetHashAlgorithm sets the algorithm recorded in the
+	// package header as the one that should be used to
+	// compute the package's hash. The default is
+	// HashAdler32.
+	SetHashAlgorithm(alg HashAlgorithm)
+
 	// SetMonitoringOptions is an advanced function that
 	// can be used to add logging and progress reporting
 	// to packaging operations, in addition to other
@@ -177,12 +265,25 @@ type Builder interface {
 	//	/dir/file
 	//	./dir/file
 	AddSubTreeToFS(path string, sub vio.FileTree) error
+
+	// AddToDisk is equivalent to AddToFS, except that it
+	// maps the vio.File into the filesystem of the named
+	// additional disk, creating the disk if it doesn't
+	// exist yet.
+	AddToDisk(disk, path string, f vio.File) error
+
+	// AddSubTreeToDisk is equivalent to AddSubTreeToFS,
+	// except that it maps the vio.FileTree into the
+	// filesystem of the named additional disk, creating the
+	// disk if it doesn't exist yet.
+	AddSubTreeToDisk(disk, path string, sub vio.FileTree) error
 }
 
 type builder struct {
 	tree             vio.FileTree
 	vcfg             vio.File
 	compressionLevel int
+	hashAlgorithm    HashAlgorithm
 	monitoring       MonitoringOptions
 	closeFunc        func() error
 }
@@ -226,6 +327,7 @@ func NewBuilderFromReader(rdr Reader) (Builder, error) {
 	var err error
 	b := NewBuilder()
 	b.(*builder).closeFunc = rdr.Close
+	b.SetHashAlgorithm(rdr.HashAlgorithm())
 
 	err = b.SetVCFG(rdr.VCFG())
 	if err != nil {
@@ -244,6 +346,14 @@ func NewBuilderFromReader(rdr Reader) (Builder, error) {
 		return nil, err
 	}
 
+	disks := rdr.Disks()
+	for _, name := range DiskNames(disks) {
+		err = b.AddSubTreeToDisk(name, "", disks[name])
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	return b, nil
 
 }
@@ -293,6 +403,10 @@ func (b *builder) SetCompressionLevel(level int) {
 	b.compressionLevel = level
 }
 
+func (b *builder) SetHashAlgorithm(alg HashAlgorithm) {
+	b.hashAlgorithm = alg
+}
+
 func (b *builder) SetMonitoringOptions(opts MonitoringOptions) {
 	b.monitoring = opts
 }
@@ -323,6 +437,64 @@ func (b *builder) AddSubTreeToFS(path string, sub vio.FileTree) error {
 	// return b.tree.MapSubTree(fsPath+"/"+path, sub)
 }
 
+// ValidDiskName returns an error if name can't be used to identify an
+// additional disk in a package. Names end up in file names and device labels,
+// so they are limited to lowercase letters, digits, and hyphens.
+func ValidDiskName(name string) error {
+
+	if name == "" {
+		return errors.New("disk name cannot be empty")
+	}
+
+	for _, c := range name {
+		if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '-' {
+			return fmt.Errorf("invalid disk name '%s': must contain only lowercase letters, digits, and hyphens", name)
+		}
+	}
+
+	return nil
+
+}
+
+func (b *builder) AddToDisk(disk, path string, f vio.File) error {
+
+	err := ValidDiskName(disk)
+	if err != nil {
+		return err
+	}
+
+	path = strings.TrimPrefix(path, "/")
+	if path == "" || path == "." {
+		return b.tree.Map(disksPath+"/"+disk, f)
+	}
+
+	return b.tree.Map(disksPath+"/"+disk+"/"+path, f)
+}
+
+func (b *builder) AddSubTreeToDisk(disk, path string, sub vio.FileTree) error {
+	path = strings.TrimPrefix(path, "/")
+	err := sub.Walk(func(p string, f vio.File) error {
+		p = filepath.ToSlash(filepath.Clean(filepath.Join(path, p)))
+		return b.AddToDisk(disk, p, f)
+	})
+	return err
+}
+
+// DiskNames returns the names of the disks in the map in
+// alphabetical order, which is the order they appear in the
+// package.
+func DiskNames(disks map[string]vio.FileTree) []string {
+
+	names := make([]string, 0, len(disks))
+	for name := range disks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+
+}
+
 type multireader struct {
 	io.Reader
 	io.Closer
@@ -344,6 +516,7 @@ func (b *builder) Pack(w io.Writer) error {
 	hdr.VersionMajor = SemverMajor
 	hdr.VersionMinor = SemverMinor
 	hdr.VersionPatch = SemverRevision
+	hdr.HashAlgorithm = b.hashAlgorithm
 
 	err = binary.Write(mw, binary.LittleEndian, hdr)
 	if err != nil {
@@ -526,14 +699,28 @@ type Reader interface {
 	// app's virtual disk.
 	FS() vio.FileTree
 
+	// HashAlgorithm returns the algorithm the package
+	// header says should be used to compute its hash.
+	HashAlgorithm() HashAlgorithm
+
+	// Disks returns a vio.FileTree for each additional
+	// disk in the package, keyed by the disk's name. The
+	// map is empty if the package only has the main
+	// filesystem. Because packages are loaded lazily the
+	// trees must be read after FS, and in the order given
+	// by DiskNames.
+	Disks() map[string]vio.FileTree
+
 	Close() error
 }
 
 type reader struct {
-	closeFunc func() error
-	vcfg      vio.File
-	icon      vio.File
-	fs        vio.FileTree
+	closeFunc     func() error
+	vcfg          vio.File
+	icon          vio.File
+	fs            vio.FileTree
+	disks         map[string]vio.FileTree
+	hashAlgorithm HashAlgorithm
 }
 
 func (r *reader) Close() error {
@@ -545,6 +732,9 @@ func (r *reader) Close() error {
 		r.icon.Close()
 	}
 	r.fs.Close()
+	for _, disk := range r.disks {
+		disk.Close()
+	}
 	return nil
 }
 
@@ -572,6 +762,7 @@ func ReaderFromBuilder(b Builder) (Reader, error) {
 	}
 
 	tree := bx.tree
+	rdr.hashAlgorithm = bx.hashAlgorithm
 
 	err := tree.Walk(func(path string, f vio.File) error {
 		switch path {
@@ -579,7 +770,7 @@ func ReaderFromBuilder(b Builder) (Reader, error) {
 			rdr.vcfg = f
 		case iconPath:
 			rdr.icon = f
-		case fsPath:
+		case fsPath, disksPath:
 			return vio.ErrSkip
 		case ".":
 			return nil
@@ -597,6 +788,11 @@ func ReaderFromBuilder(b Builder) (Reader, error) {
 		return nil, err
 	}
 
+	rdr.disks, err = loadDisks(tree)
+	if err != nil {
+		return nil, err
+	}
+
 	return rdr, nil
 
 }
@@ -650,6 +846,7 @@ func Load(r io.Reader) (Reader, error) {
 	}
 
 	rdr := new(reader)
+	rdr.hashAlgorithm = hdr.HashAlgorithm
 
 	if closer, ok := r.(io.ReadCloser); ok {
 		rdr.closeFunc = closer.Close
@@ -661,7 +858,7 @@ func Load(r io.Reader) (Reader, error) {
 			rdr.vcfg = f
 		case iconPath:
 			rdr.icon = f
-		case fsPath:
+		case fsPath, disksPath:
 			return vio.ErrSkip
 		case ".":
 			return nil
@@ -679,10 +876,61 @@ func Load(r io.Reader) (Reader, error) {
 		return nil, err
 	}
 
+	rdr.disks, err = loadDisks(tree)
+	if err != nil {
+		return nil, err
+	}
+
 	return rdr, nil
 
 }
 
+// loadDisks finds the filesystem of every additional disk
+// in the package tree.
+func loadDisks(tree vio.FileTree) (map[string]vio.FileTree, error) {
+
+	disks := make(map[string]vio.FileTree)
+
+	sub, err := tree.SubTree(disksPath)
+	if err == vio.ErrNodeNotFound {
+		return disks, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	err = sub.Walk(func(path string, f vio.File) error {
+		if path == "." {
+			return nil
+		}
+
+		if !f.IsDir() {
+			return fmt.Errorf("unexpected archive element: %v", path)
+		}
+
+		names = append(names, strings.TrimPrefix(path, "./"))
+		return vio.ErrSkip
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range names {
+		err = ValidDiskName(name)
+		if err != nil {
+			return nil, err
+		}
+
+		disks[name], err = sub.SubTree(name)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return disks, nil
+
+}
+
 // VCFG ..
 func (r *reader) VCFG() vio.File {
 	return r.vcfg
@@ -705,16 +953,48 @@ func (r *reader) FS() vio.FileTree {
 	return r.fs
 }
 
-// ComputeHash ..
+// HashAlgorithm ..
+func (r *reader) HashAlgorithm() HashAlgorithm {
+	return r.hashAlgorithm
+}
+
+// Disks ..
+func (r *reader) Disks() map[string]vio.FileTree {
+	return r.disks
+}
+
+// ComputeHash computes the hash of a package using the
+// algorithm recorded in its header.
 func ComputeHash(r io.Reader) (string, error) {
 
-	hasher := NewHasher()
+	rdr, err := Load(r)
+	if err != nil {
+		return "", err
+	}
+
+	return computeHash(rdr, rdr.HashAlgorithm())
+}
+
+// ComputeHashWithAlgorithm computes the hash of a package
+// using the provided algorithm, regardless of the algorithm
+// recorded in its header.
+func ComputeHashWithAlgorithm(r io.Reader, alg HashAlgorithm) (string, error) {
 
 	rdr, err := Load(r)
 	if err != nil {
 		return "", err
 	}
 
+	return computeHash(rdr, alg)
+}
+
+func computeHash(rdr Reader, alg HashAlgorithm) (string, error) {
+
+	hasher, err := NewHasherWithAlgorithm(alg)
+	if err != nil {
+		return "", err
+	}
+
 	bldr, err := NewBuilderFromReader(rdr)
 	if err != nil {
 		return "", err
@@ -754,6 +1034,12 @@ func ReplaceVCFG(r Reader, f vio.File) (Reader, error) {
 
 	x := rdr.(*peekVCFGReader)
 	x.vcfgdata = data
+	x.vcfg = vio.CustomFile(vio.CustomFileArgs{
+		Name:       x.vcfg.Name(),
+		Size:       len(data),
+		ModTime:    x.vcfg.ModTime(),
+		ReadCloser: ioutil.NopCloser(bytes.NewReader(data)),
+	})
 
 	return x, nil
 }
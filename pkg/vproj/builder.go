@@ -42,9 +42,66 @@ func (t *Target) NewBuilder() (vpkg.Builder, error) {
 		}
 	}
 
+	err = t.addDisks(b)
+	if err != nil {
+		return nil, err
+	}
+
 	return b, nil
 }
 
+// diskSource returns the absolute path of the directory used to seed a disk.
+func (t *Target) diskSource(d DiskData) string {
+
+	abs := d.Source
+	if !filepath.IsAbs(abs) {
+		abs = filepath.Join(t.Dir, abs)
+	}
+
+	return filepath.ToSlash(filepath.Clean(abs))
+}
+
+func (t *Target) addDisks(b vpkg.Builder) error {
+
+	for _, d := range t.Disks {
+		abs := t.diskSource(d)
+
+		fi, err := os.Stat(abs)
+		if err != nil {
+			return fmt.Errorf("bad source for disk '%s': %w", d.Name, err)
+		}
+
+		if !fi.IsDir() {
+			return fmt.Errorf("source for disk '%s' is not a directory: %s", d.Name, d.Source)
+		}
+
+		tree, err := vio.FileTreeFromDirectory(abs)
+		if err != nil {
+			return err
+		}
+
+		err = b.AddSubTreeToDisk(d.Name, "", tree)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// isDiskSource returns true if abs is the source directory of one of the
+// target's disks, which shouldn't also end up in the main file-system.
+func (t *Target) isDiskSource(abs string) bool {
+
+	for _, d := range t.Disks {
+		if t.diskSource(d) == abs {
+			return true
+		}
+	}
+
+	return false
+}
+
 func (t *Target) utilNewBuilderHandleVCFGAndIcon(b vpkg.Builder) error {
 
 	err := t.handleVCFG(b)
@@ -165,6 +222,10 @@ func (t *Target) walkFiles(b vpkg.Builder, ignore []glob.Glob) error {
 			return err
 		}
 
+		if info.IsDir() && t.isDiskSource(abs) {
+			return filepath.SkipDir
+		}
+
 		for _, ip := range ignore {
 			if ip.Match(path) {
 				if info.IsDir() {
@@ -15,6 +15,8 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"text/template"
+	"time"
 
 	"github.com/djherbis/buffer"
 	"github.com/djherbis/nio"
@@ -32,11 +34,30 @@ const (
 )
 
 // TargetData ..
+//
+// Provisioner optionally names a provisioner file (relative to the
+// project directory) that the target should be deployed to, and
+// ImageName is a text/template used to name the provisioned image. See
+// ImageNameData for the fields available to the template.
+//
+// Disks seed the file-systems of additional disks declared in the vcfg with
+// the contents of project directories, which are left out of the main
+// file-system.
 type TargetData struct {
-	Name  string   `toml:"name" json:"name"`
-	VCFGs []string `toml:"vcfgs,omitempty" json:"vcfgs"`
-	Icon  string   `toml:"icon,omitempty" json:"icon"`
-	Files []string `toml:"files,omitempty" json:"files"`
+	Name        string     `toml:"name" json:"name"`
+	VCFGs       []string   `toml:"vcfgs,omitempty" json:"vcfgs"`
+	Icon        string     `toml:"icon,omitempty" json:"icon"`
+	Files       []string   `toml:"files,omitempty" json:"files"`
+	Provisioner string     `toml:"provisioner,omitempty" json:"provisioner,omitempty"`
+	ImageName   string     `toml:"image-name,omitempty" json:"image-name,omitempty"`
+	Disks       []DiskData `toml:"disk,omitempty" json:"disk,omitempty"`
+}
+
+// DiskData maps a directory (relative to the project directory) to the
+// file-system of the named additional disk.
+type DiskData struct {
+	Name   string `toml:"name" json:"name"`
+	Source string `toml:"source" json:"source"`
 }
 
 // ProjectData ..
@@ -153,6 +174,9 @@ func (p *Project) Target(name string) (*Target, error) {
 			t.Icon = targets[i].Icon
 			t.Files = targets[i].Files
 			t.VCFGs = targets[i].VCFGs
+			t.Provisioner = targets[i].Provisioner
+			t.ImageName = targets[i].ImageName
+			t.Disks = targets[i].Disks
 			found = true
 			break
 		}
@@ -168,12 +192,78 @@ func (p *Project) Target(name string) (*Target, error) {
 
 // Target ..
 type Target struct {
-	Name   string
-	Dir    string
-	Ignore []string
-	Icon   string
-	VCFGs  []string
-	Files  []string
+	Name        string
+	Dir         string
+	Ignore      []string
+	Icon        string
+	VCFGs       []string
+	Files       []string
+	Provisioner string
+	ImageName   string
+	Disks       []DiskData
+}
+
+// ProvisionerPath returns the path to the target's provisioner file, or an
+// error if the target doesn't declare one.
+func (t *Target) ProvisionerPath() (string, error) {
+
+	if t.Provisioner == "" {
+		return "", fmt.Errorf("project target '%s' has no provisioner", t.Name)
+	}
+
+	path := t.Provisioner
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(t.Dir, path)
+	}
+
+	return path, nil
+}
+
+// ImageNameData contains the fields available to a target's image naming
+// template.
+type ImageNameData struct {
+	Project   string // base name of the project directory
+	Target    string // name of the project target
+	Name      string // info.name from the target's vcfg
+	Version   string // info.version from the target's vcfg
+	Timestamp int64  // unix time of the deployment
+	Date      string // time of the deployment, formatted as YYYYMMDDhhmmss
+}
+
+// RenderImageName evaluates the target's image naming template using
+// information from cfg. It returns an empty string if the target has no
+// template.
+func (t *Target) RenderImageName(cfg *vcfg.VCFG) (string, error) {
+
+	if t.ImageName == "" {
+		return "", nil
+	}
+
+	tmpl, err := template.New("image-name").Option("missingkey=error").Parse(t.ImageName)
+	if err != nil {
+		return "", fmt.Errorf("bad image-name template for project target '%s': %w", t.Name, err)
+	}
+
+	now := time.Now().UTC()
+	data := ImageNameData{
+		Project:   filepath.Base(filepath.Clean(t.Dir)),
+		Target:    t.Name,
+		Timestamp: now.Unix(),
+		Date:      now.Format("20060102150405"),
+	}
+
+	if cfg != nil {
+		data.Name = cfg.Info.Name
+		data.Version = cfg.Info.Version
+	}
+
+	buf := new(bytes.Buffer)
+	err = tmpl.Execute(buf, data)
+	if err != nil {
+		return "", fmt.Errorf("bad image-name template for project target '%s': %w", t.Name, err)
+	}
+
+	return strings.TrimSpace(buf.String()), nil
 }
 
 // VCFG ..
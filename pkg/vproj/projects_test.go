@@ -0,0 +1,48 @@
+package vproj
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vorteil/vorteil/pkg/vcfg"
+)
+
+func TestTargetDeployment(t *testing.T) {
+
+	dir := filepath.Join("projects", "example")
+
+	tgt := &Target{
+		Name:        "prod",
+		Dir:         dir,
+		Provisioner: "aws.provisioner",
+		ImageName:   "{{.Project}}-{{.Target}}-{{.Name}}-{{.Version}}",
+	}
+
+	path, err := tgt.ProvisionerPath()
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join(dir, "aws.provisioner"), path)
+
+	cfg := new(vcfg.VCFG)
+	cfg.Info.Name = "app"
+	cfg.Info.Version = "1.2.0"
+
+	name, err := tgt.RenderImageName(cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, "example-prod-app-1.2.0", name)
+
+	tgt.ImageName = "{{.Missing}}"
+	_, err = tgt.RenderImageName(cfg)
+	assert.Error(t, err)
+
+	// targets without deployment settings
+	tgt = &Target{Name: "default", Dir: dir}
+
+	_, err = tgt.ProvisionerPath()
+	assert.Error(t, err)
+
+	name, err = tgt.RenderImageName(cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, "", name)
+
+}
@@ -14,6 +14,17 @@ func align(x, y int64) int64 {
 	return divide(x, y) * y
 }
 
+// log2 returns the base two logarithm of x, and whether x is a power of two.
+func log2(x int64) (uint8, bool) {
+
+	var n uint8
+	for ; x > 1 && x%2 == 0; x /= 2 {
+		n++
+	}
+
+	return n, x == 1
+}
+
 type rngReader struct {
 }
 
@@ -27,8 +38,11 @@ func (rng *rngReader) Read(b []byte) (n int, err error) {
 	non-deterministically as required.
 */
 func generateUID() ([16]byte, error) {
+	return generateUIDFrom(new(rngReader))
+}
 
-	rng := new(rngReader)
+// generateUIDFrom returns a UID read from rng.
+func generateUIDFrom(rng io.Reader) ([16]byte, error) {
 
 	var uid [16]byte
 	buf := make([]byte, 16)
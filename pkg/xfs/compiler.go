@@ -3,7 +3,9 @@ package xfs
 import (
 	"context"
 	"io"
+	"math/rand"
 	"path/filepath"
+	"time"
 
 	"github.com/vorteil/vorteil/pkg/elog"
 	"github.com/vorteil/vorteil/pkg/vio"
@@ -12,13 +14,69 @@ import (
 type CompilerArgs struct {
 	FileTree vio.FileTree
 	Logger   elog.Logger
+
+	// UUID is written to the superblocks to identify the file-system. If
+	// left zero, a random UUID is generated.
+	UUID [16]byte
+
+	// Label is written to the superblocks as the file-system name. If left
+	// empty, the name "xfs" is used.
+	Label string
+
+	// FileTypes enables the ftype feature, which stores the type of each
+	// file in its directory entries so that readdir doesn't need to read
+	// the inode to report it. It needs Linux 3.10 or newer to mount.
+	FileTypes bool
+
+	// BlockSize is the size of the file-system's blocks in bytes. Smaller
+	// blocks waste less space on many small files, larger blocks suit a few
+	// huge ones. Linux can't mount blocks larger than its page size. If left
+	// zero, 4 KiB blocks are used.
+	BlockSize int64
+
+	// InodeSize is the size of each inode in bytes, from 256 up to 2048 or
+	// half the block size. Larger inodes fit bigger directories and more
+	// extents inline. If left zero, 512 byte inodes are used.
+	InodeSize int64
+
+	// DirectoryBlockSize is the size of directory blocks in bytes, from the
+	// block size up to 64 KiB. Larger directory blocks make lookups in huge
+	// directories cheaper. If left zero, it matches the block size.
+	DirectoryBlockSize int64
+
+	// Quotas are the limits of the user, group and project quotas to set up.
+	// Usage is accounted for each type of quota that appears, and the guest
+	// has to mount the file-system with matching quota options to enforce
+	// them. Group and project quotas can't be used at the same time.
+	Quotas []Quota
+
+	// Workers is the number of goroutines writing the headers, b+ trees
+	// and free inodes of alloc groups while the file tree is being written,
+	// if the image can be written at arbitrary offsets. If zero,
+	// DefaultWorkers is used. If one, everything is written in order.
+	Workers int
+
+	// MaxMemory is the most memory, in bytes, that a directory is generated
+	// in. Larger directories are generated a block at a time as they are
+	// written instead. If zero, DefaultMaxMemory is used.
+	MaxMemory int64
 }
 
+// MaxLabelLength is the longest label an XFS file-system can have.
+const MaxLabelLength = 12
+
 type Compiler struct {
 	log                                      elog.Logger
 	tree                                     vio.FileTree
 	minFreeInodes, minInodes, minInodesPer64 int64
 	minFreeSpace                             int64
+	uuid                                     [16]byte
+	label                                    string
+	fileTypes                                bool
+	blockSize, inodeSize, dirBlockSize       int64
+	quotas                                   []Quota
+	workers                                  int
+	maxMemory                                int64
 
 	actualSize  int64
 	precompiler *precompiler
@@ -27,8 +85,17 @@ type Compiler struct {
 
 func NewCompiler(args *CompilerArgs) *Compiler {
 	return &Compiler{
-		log:  args.Logger,
-		tree: args.FileTree,
+		log:          args.Logger,
+		tree:         args.FileTree,
+		uuid:         args.UUID,
+		label:        args.Label,
+		fileTypes:    args.FileTypes,
+		blockSize:    args.BlockSize,
+		inodeSize:    args.InodeSize,
+		dirBlockSize: args.DirectoryBlockSize,
+		quotas:       args.Quotas,
+		workers:      args.Workers,
+		maxMemory:    args.MaxMemory,
 	}
 }
 
@@ -79,6 +146,19 @@ func (c *Compiler) IncreaseMinimumFreeSpace(space int64) {
 	c.minFreeSpace += space
 }
 
+// Reproduce derives the file-system's UUID from seed, unless one was given
+// to NewCompiler. The XFS compiler writes no timestamps, so t is unused.
+func (c *Compiler) Reproduce(seed int64, t time.Time) {
+
+	if c.uuid != ([16]byte{}) {
+		return
+	}
+
+	// reading from a math/rand source never fails
+	c.uuid, _ = generateUIDFrom(rand.New(rand.NewSource(seed)))
+
+}
+
 func (c *Compiler) Commit(ctx context.Context) error {
 
 	args := &precompilerArgs{
@@ -87,6 +167,23 @@ func (c *Compiler) Commit(ctx context.Context) error {
 	}
 	// TODO args.Options.MinimumFreeInodes NOTE: XFS can create new inodes as needed, so these args aren't usually necessary
 	args.Options.MinimumFreeSpace = c.minFreeSpace
+	args.Options.UUID = c.uuid
+	args.Options.Label = c.label
+	args.Options.FileTypes = c.fileTypes
+	args.Options.BlockSize = c.blockSize
+	args.Options.InodeSize = c.inodeSize
+	args.Options.DirectoryBlockSize = c.dirBlockSize
+	args.Options.Quotas = c.quotas
+	args.Options.Workers = c.workers
+	args.Options.MaxMemory = c.maxMemory
+
+	if args.Options.UUID == ([16]byte{}) {
+		var err error
+		args.Options.UUID, err = generateUID()
+		if err != nil {
+			return err
+		}
+	}
 
 	p, err := newBuild(ctx, args)
 	if err != nil {
@@ -4,12 +4,37 @@ import (
 	"bytes"
 	"encoding/binary"
 	"io"
+	"os"
 	"sort"
 	"strings"
 
 	"github.com/vorteil/vorteil/pkg/vio"
 )
 
+// DefaultMaxMemory is the largest directory, in bytes, generated all at once
+// if CompilerArgs.MaxMemory is zero.
+const DefaultMaxMemory = 0x10000000 // 256 MiB
+
+// lazyReader reads data as next writes it, calling next for more only once
+// everything it wrote before has been read. next returns false once there is
+// nothing left to write.
+type lazyReader struct {
+	buf  bytes.Buffer
+	next func(w io.Writer) bool
+}
+
+func (r *lazyReader) Read(p []byte) (int, error) {
+
+	for r.buf.Len() == 0 {
+		if !r.next(&r.buf) {
+			return 0, io.EOF
+		}
+	}
+
+	return r.buf.Read(p)
+
+}
+
 type inodeTranslator interface {
 	inodeNumberFromNode(n *vio.TreeNode) uint64
 }
@@ -20,7 +45,7 @@ type shortDirHeader struct {
 	ParentIno    uint32
 }
 
-func generateShortFormDentry(name string, ino, offset int64) (data []byte, delta int64) {
+func generateShortFormDentry(name string, ftype uint8, ino, offset int64, fileTypes bool) (data []byte, delta int64) {
 
 	buf := new(bytes.Buffer)
 	l := len(name)
@@ -40,6 +65,10 @@ func generateShortFormDentry(name string, ino, offset int64) (data []byte, delta
 		panic(err)
 	}
 
+	if fileTypes {
+		buf.WriteByte(ftype)
+	}
+
 	err = binary.Write(buf, binary.BigEndian, uint32(ino)) // TODO: what if the translated number > 32 bit?
 	if err != nil {
 		panic(err)
@@ -49,7 +78,7 @@ func generateShortFormDentry(name string, ino, offset int64) (data []byte, delta
 
 }
 
-func generateShortFormDirectoryData(t inodeTranslator, n *vio.TreeNode) []byte {
+func generateShortFormDirectoryData(t inodeTranslator, n *vio.TreeNode, fileTypes bool) []byte {
 
 	buf := new(bytes.Buffer)
 	hdr := &shortDirHeader{
@@ -72,7 +101,7 @@ func generateShortFormDirectoryData(t inodeTranslator, n *vio.TreeNode) []byte {
 			panic("superlarge inode in shortform directory")
 		}
 
-		dentry, delta := generateShortFormDentry(child.File.Name(), int64(ino), offset)
+		dentry, delta := generateShortFormDentry(child.File.Name(), fileType(child.File), int64(ino), offset, fileTypes)
 
 		_, err = io.Copy(buf, bytes.NewReader(dentry))
 		if err != nil {
@@ -165,15 +194,37 @@ func (ht dir2HashTable) Swap(i, j int) {
 	ht[j] = x
 }
 
+func fileType(f vio.File) uint8 {
+
+	switch {
+	case f.IsDir():
+		return FTypeDirectory
+	case f.IsSymlink():
+		return FTypeSymlink
+	case f.Special() == os.ModeNamedPipe:
+		return FTypeFIFO
+	case f.Special()&os.ModeCharDevice != 0:
+		return FTypeCharSpecial
+	case f.Special() != 0:
+		return FTypeBlockSpecial
+	default:
+		return FTypeRegularFile
+	}
+
+}
+
 type dentry struct {
 	Inode uint64
 	Name  string
 	FType uint8
 }
 
-func addDentry(w io.Writer, offset int64, dentry *dentry) int64 {
+func addDentry(w io.Writer, offset int64, dentry *dentry, fileTypes bool) int64 {
 
 	l := 11 + int64(len(dentry.Name))
+	if fileTypes {
+		l++
+	}
 	pad := align(l, 8) - l
 
 	err := binary.Write(w, binary.BigEndian, dentry.Inode)
@@ -191,7 +242,12 @@ func addDentry(w io.Writer, offset int64, dentry *dentry) int64 {
 		panic(err)
 	}
 
-	// _ = binary.Write(w, binary.BigEndian, dentry.FType) NOTE: this is for later versions of directories
+	if fileTypes {
+		err = binary.Write(w, binary.BigEndian, dentry.FType)
+		if err != nil {
+			panic(err)
+		}
+	}
 
 	_, err = io.CopyN(w, vio.Zeroes, pad)
 	if err != nil {
@@ -207,7 +263,7 @@ func addDentry(w io.Writer, offset int64, dentry *dentry) int64 {
 
 }
 
-func writeDir2Dentries(w io.Writer, header *Dir2Header, dentries []*dentry, offset, space, blockSize int64) (dir2HashTable, uint16) {
+func writeDir2Dentries(w io.Writer, header *Dir2Header, dentries []*dentry, offset, space, blockSize int64, fileTypes bool) (dir2HashTable, uint16) {
 
 	hashTable := make(dir2HashTable, 0, len(dentries))
 
@@ -218,7 +274,7 @@ func writeDir2Dentries(w io.Writer, header *Dir2Header, dentries []*dentry, offs
 			Address: uint32(offset / 8),
 		})
 
-		delta := addDentry(w, offset%blockSize, dentry)
+		delta := addDentry(w, offset%blockSize, dentry, fileTypes)
 		offset += delta
 		space -= delta
 	}
@@ -235,7 +291,7 @@ type blockDirBuilder struct {
 	hashTable dir2HashTable
 }
 
-func writeDir2Data(w io.Writer, magic uint32, dentries []*dentry, offset, space, blockSize int64) (dir2HashTable, uint16) {
+func writeDir2Data(w io.Writer, magic uint32, dentries []*dentry, offset, space, blockSize int64, fileTypes bool) (dir2HashTable, uint16) {
 
 	var best uint16
 	var hashTable dir2HashTable
@@ -243,7 +299,7 @@ func writeDir2Data(w io.Writer, magic uint32, dentries []*dentry, offset, space,
 	header := Dir2Header{
 		Magic: magic,
 	}
-	hashTable, best = writeDir2Dentries(buf, &header, dentries, offset, space, blockSize)
+	hashTable, best = writeDir2Dentries(buf, &header, dentries, offset, space, blockSize, fileTypes)
 
 	err := binary.Write(w, binary.BigEndian, &header)
 	if err != nil {
@@ -283,12 +339,7 @@ func (b *blockDirBuilder) writeData(w io.Writer) {
 
 	for _, child := range b.n.Children {
 
-		ftype := uint8(FTypeRegularFile)
-		if child.File.IsDir() {
-			ftype = FTypeDirectory
-		} else if child.File.IsSymlink() {
-			ftype = FTypeSymlink
-		}
+		ftype := fileType(child.File)
 
 		dentries = append(dentries, &dentry{
 			Inode: b.c.inodeNumberFromNode(child),
@@ -299,12 +350,12 @@ func (b *blockDirBuilder) writeData(w io.Writer) {
 	}
 
 	offset := int64(16)
-	space := b.c.blockSize()
+	space := b.c.directoryBlockSize()
 	space -= offset
 	space -= 8 * b.entries // hashtable
 	space -= 8             // tail
 
-	b.hashTable, _ = writeDir2Data(w, Dir2BlockMagic, dentries, offset, space, b.c.blockSize())
+	b.hashTable, _ = writeDir2Data(w, Dir2BlockMagic, dentries, offset, space, b.c.directoryBlockSize(), b.c.fileTypes)
 
 }
 
@@ -360,7 +411,7 @@ func (c *compiler) calculateLengthOfBlockFormDirectoryData(n *vio.TreeNode) int6
 
 func (c *compiler) generateBlockFormDirectoryData(n *vio.TreeNode) io.Reader {
 
-	_ = c.computeNodeExtents(n.NodeSequenceNumber, &dataRange{blocks: 1}) // called here to ensure things are computed in order
+	_ = c.computeNodeExtents(n.NodeSequenceNumber, &dataRange{blocks: c.directoryBlocks(1)}) // called here to ensure things are computed in order
 
 	b := &blockDirBuilder{
 		n: n,
@@ -400,17 +451,18 @@ func (b *leafDirBuilder) process() {
 	for i := int64(0); i < b.dataExtents; i++ {
 		b.dataBlocks += b.extents[i].length
 	}
+	b.dataBlocks /= b.c.directoryBlocks(1)
 
 	b.bests = make([]uint16, b.dataBlocks)
 	b.blockEntries = make([][]*dentry, b.dataBlocks)
 	block := 0
-	space := b.c.blockSize() - 16
+	space := b.c.directoryBlockSize() - 16
 
 	addEntry := func(inode uint64, name string, ftype uint8) {
 
-		l := align(int64(11+len(name)), 8)
+		l := b.c.dataEntrySize(name)
 		if space-l < 16 { // TODO: Really? Why 16? Why not zero?
-			space = b.c.blockSize() - 16
+			space = b.c.directoryBlockSize() - 16
 			block++
 		}
 		space -= l
@@ -427,12 +479,7 @@ func (b *leafDirBuilder) process() {
 	addEntry(b.c.inodeNumberFromNode(b.n.Parent), "..", FTypeDirectory)
 
 	for _, child := range b.n.Children {
-		ftype := uint8(FTypeRegularFile)
-		if child.File.IsDir() {
-			ftype = FTypeDirectory
-		} else if child.File.IsSymlink() {
-			ftype = FTypeSymlink
-		}
+		ftype := fileType(child.File)
 		addEntry(b.c.inodeNumberFromNode(child), child.File.Name(), ftype)
 	}
 
@@ -440,10 +487,10 @@ func (b *leafDirBuilder) process() {
 
 func (b *leafDirBuilder) writeDataBlock(w io.Writer, n int64, dentries []*dentry) {
 
-	space := b.c.blockSize() - 16
-	offset := 16 + n*b.c.blockSize()
+	space := b.c.directoryBlockSize() - 16
+	offset := 16 + n*b.c.directoryBlockSize()
 
-	hashes, best := writeDir2Data(w, Dir2BlockData, dentries, offset, space, b.c.blockSize())
+	hashes, best := writeDir2Data(w, Dir2BlockData, dentries, offset, space, b.c.directoryBlockSize(), b.c.fileTypes)
 	b.hashTable = append(b.hashTable, hashes...)
 	b.bests[n] = best
 
@@ -482,7 +529,7 @@ func (b *leafDirBuilder) writeLeafBlock(w io.Writer) {
 		panic(err)
 	}
 
-	padSize := b.c.blockSize()
+	padSize := b.c.directoryBlockSize()
 	padSize -= 16                      // leaf header
 	padSize -= int64(b.entries * 8)    // hash table
 	padSize -= int64(2 * b.dataBlocks) // bests
@@ -523,7 +570,7 @@ func (c *compiler) calculateLengthOfLeafFormDirectoryData(n *vio.TreeNode) int64
 	var size int64
 
 	nblocks := int64(c.nodeBlocks[n.NodeSequenceNumber])
-	nblocks--
+	nblocks -= c.directoryBlocks(1)
 	size = c.blockSize() * nblocks
 
 	return size
@@ -575,19 +622,21 @@ func (b *nodeDirBuilder) process() {
 	for i := int64(0); i < b.dataExtents; i++ {
 		b.dataBlocks += b.extents[i].length
 	}
+	b.dataBlocks /= b.c.directoryBlocks(1)
 
+	b.leafBlocks /= b.c.directoryBlocks(1)
 	b.leafBlocks -= 1
 
 	b.bests = make([]uint16, b.dataBlocks)
 	b.blockEntries = make([][]*dentry, b.dataBlocks)
 	block := 0
-	space := b.c.blockSize() - 16
+	space := b.c.directoryBlockSize() - 16
 
 	addEntry := func(inode uint64, name string, ftype uint8) {
 
-		l := align(int64(11+len(name)), 8)
+		l := b.c.dataEntrySize(name)
 		if space-l < 16 { // TODO: Really? Why 16? Why not zero?
-			space = b.c.blockSize() - 16
+			space = b.c.directoryBlockSize() - 16
 			block++
 		}
 		space -= l
@@ -604,12 +653,7 @@ func (b *nodeDirBuilder) process() {
 	addEntry(b.c.inodeNumberFromNode(b.n.Parent), "..", FTypeDirectory)
 
 	for _, child := range b.n.Children {
-		ftype := uint8(FTypeRegularFile)
-		if child.File.IsDir() {
-			ftype = FTypeDirectory
-		} else if child.File.IsSymlink() {
-			ftype = FTypeSymlink
-		}
+		ftype := fileType(child.File)
 		addEntry(b.c.inodeNumberFromNode(child), child.File.Name(), ftype)
 	}
 
@@ -617,10 +661,10 @@ func (b *nodeDirBuilder) process() {
 
 func (b *nodeDirBuilder) writeDataBlock(w io.Writer, n int64, dentries []*dentry) {
 
-	space := b.c.blockSize() - 16
-	offset := 16 + n*b.c.blockSize()
+	space := b.c.directoryBlockSize() - 16
+	offset := 16 + n*b.c.directoryBlockSize()
 
-	hashes, best := writeDir2Data(w, Dir2BlockData, dentries, offset, space, b.c.blockSize())
+	hashes, best := writeDir2Data(w, Dir2BlockData, dentries, offset, space, b.c.directoryBlockSize(), b.c.fileTypes)
 	b.hashTable = append(b.hashTable, hashes...)
 	b.bests[n] = best
 
@@ -652,7 +696,7 @@ func (b *nodeDirBuilder) writeNodeBlock(w io.Writer) {
 	epb := int64((b.c.directoryBlockSize() - 16) / 8) // entries per block
 	for i := int64(0); i < b.leafBlocks; i++ {
 		blockNo := 0x800000000 / b.c.blockSize()
-		blockNo += 1
+		blockNo += b.c.directoryBlocks(1 + i)
 		hv := uint32(0)
 		if epb*(i+1) < int64(len(b.hashTable)) {
 			hv = b.hashTable[epb*(i+1)-1].HashVal
@@ -665,7 +709,7 @@ func (b *nodeDirBuilder) writeNodeBlock(w io.Writer) {
 			panic(err)
 		}
 
-		err = binary.Write(w, binary.BigEndian, uint32(blockNo+i)) // before
+		err = binary.Write(w, binary.BigEndian, uint32(blockNo)) // before
 		if err != nil {
 			panic(err)
 		}
@@ -688,15 +732,15 @@ func (b *nodeDirBuilder) writeLeafBlock(w io.Writer, i int64) {
 	}
 
 	blockNo := int64(0x800000000 / b.c.blockSize())
-	blockNo += 1 + i
+	blockNo += b.c.directoryBlocks(1 + i)
 
 	if i > 0 {
-		nodeHeader.Info.Back = uint32(blockNo - 1)
+		nodeHeader.Info.Back = uint32(blockNo - b.c.directoryBlocks(1))
 	}
 	entriesPerBlock := (b.c.directoryBlockSize() - 16) / 8
 	nodeHeader.Count = uint16(entriesPerBlock)
 	if i < b.leafBlocks-1 {
-		nodeHeader.Info.Forw = uint32(blockNo + 1)
+		nodeHeader.Info.Forw = uint32(blockNo + b.c.directoryBlocks(1))
 	} else {
 		if int64(len(b.hashTable))%entriesPerBlock != 0 {
 			nodeHeader.Count = uint16(int64(len(b.hashTable)) % entriesPerBlock)
@@ -732,14 +776,20 @@ func (b *nodeDirBuilder) writeLeafBlocks(w io.Writer) {
 
 }
 
-func (b *nodeDirBuilder) writeFreeIndexBlock(w io.Writer) {
+func (b *nodeDirBuilder) writeFreeIndexBlock(w io.Writer, i int64) {
+
+	bestsPerBlock := b.c.bestsPerFreeIndexBlock()
+	bests := b.bests[i*bestsPerBlock:]
+	if int64(len(bests)) > bestsPerBlock {
+		bests = bests[:bestsPerBlock]
+	}
 
 	// free index
 	freeIndexHeader := &Dir2FreeIndexHeader{
 		Magic:   Dir2FreeMagic,
-		FirstDB: 0,
-		NUsed:   int32(len(b.bests)),
-		NValid:  int32(len(b.bests)),
+		FirstDB: int32(i * bestsPerBlock),
+		NUsed:   int32(len(bests)),
+		NValid:  int32(len(bests)),
 	}
 
 	err := binary.Write(w, binary.BigEndian, freeIndexHeader)
@@ -747,20 +797,26 @@ func (b *nodeDirBuilder) writeFreeIndexBlock(w io.Writer) {
 		panic(err)
 	}
 
-	// _, _ = io.CopyN(buf, zeroes, c.directoryBlockSize()-16-2*int64(len(bests)))
-
-	err = binary.Write(w, binary.BigEndian, b.bests)
+	err = binary.Write(w, binary.BigEndian, bests)
 	if err != nil {
 		panic(err)
 	}
 
-	_, err = io.CopyN(w, vio.Zeroes, b.c.directoryBlockSize()-16-2*int64(len(b.bests)))
+	_, err = io.CopyN(w, vio.Zeroes, b.c.directoryBlockSize()-16-2*int64(len(bests)))
 	if err != nil {
 		panic(err)
 	}
 
 }
 
+func (b *nodeDirBuilder) writeFreeIndexBlocks(w io.Writer) {
+
+	for i := int64(0); i < divide(b.dataBlocks, b.c.bestsPerFreeIndexBlock()); i++ {
+		b.writeFreeIndexBlock(w, i)
+	}
+
+}
+
 func (b *nodeDirBuilder) generate() []byte {
 
 	b.process()
@@ -770,12 +826,43 @@ func (b *nodeDirBuilder) generate() []byte {
 	b.writeDataBlocks(buf)
 	b.writeNodeBlock(buf)
 	b.writeLeafBlocks(buf)
-	b.writeFreeIndexBlock(buf)
+	b.writeFreeIndexBlocks(buf)
 
 	return buf.Bytes()
 
 }
 
+// stream returns a reader that generates the directory a block at a time as
+// it is read, so that only the hash table, rather than the whole directory,
+// is held in memory. It reads the same as generate.
+func (b *nodeDirBuilder) stream() io.Reader {
+
+	b.process()
+
+	freeIndexBlocks := divide(b.dataBlocks, b.c.bestsPerFreeIndexBlock())
+
+	var i int64
+	return &lazyReader{next: func(w io.Writer) bool {
+		switch {
+		case i < b.dataBlocks:
+			b.writeDataBlock(w, i, b.blockEntries[i])
+			b.blockEntries[i] = nil
+		case i == b.dataBlocks:
+			b.writeNodeBlock(w)
+			sort.Sort(b.hashTable)
+		case i <= b.dataBlocks+b.leafBlocks:
+			b.writeLeafBlock(w, i-b.dataBlocks-1)
+		case i <= b.dataBlocks+b.leafBlocks+freeIndexBlocks:
+			b.writeFreeIndexBlock(w, i-b.dataBlocks-b.leafBlocks-1)
+		default:
+			return false
+		}
+		i++
+		return true
+	}}
+
+}
+
 func (c *compiler) generateNodeFormDirectoryData(n *vio.TreeNode, blocks int64, extents []*extent) io.Reader {
 
 	b := &nodeDirBuilder{
@@ -785,6 +872,15 @@ func (c *compiler) generateNodeFormDirectoryData(n *vio.TreeNode, blocks int64,
 		extents: extents,
 	}
 
+	max := c.args.Options.MaxMemory
+	if max == 0 {
+		max = DefaultMaxMemory
+	}
+
+	if blocks*c.directoryBlockSize() > max {
+		return b.stream()
+	}
+
 	data := b.generate()
 
 	return bytes.NewReader(data)
@@ -794,17 +890,17 @@ func (c *compiler) generateNodeFormDirectoryData(n *vio.TreeNode, blocks int64,
 func (c *compiler) generateDirectory(n *vio.TreeNode) (size int64, data []byte, extents []*extent) {
 
 	extents = make([]*extent, 0)
-	nblocks := int64(c.nodeBlocks[n.NodeSequenceNumber])
+	nblocks := int64(c.nodeBlocks[n.NodeSequenceNumber]) / c.directoryBlocks(1)
 
 	if nblocks == 0 {
 		// short form
-		data = generateShortFormDirectoryData(c, n)
+		data = generateShortFormDirectoryData(c, n, c.fileTypes)
 		size = int64(len(data))
 		return
 	} else if nblocks == 1 {
 		// block form
 		size = c.calculateLengthOfBlockFormDirectoryData(n)
-		extents = c.computeNodeExtents(n.NodeSequenceNumber, &dataRange{blocks: nblocks})
+		extents = c.computeNodeExtents(n.NodeSequenceNumber, &dataRange{blocks: c.directoryBlocks(nblocks)})
 		return
 	}
 
@@ -815,7 +911,7 @@ func (c *compiler) generateDirectory(n *vio.TreeNode) (size int64, data []byte,
 	if lfll <= c.directoryBlockSize() {
 		// leaf format
 		size = c.calculateLengthOfLeafFormDirectoryData(n)
-		extents = c.computeNodeExtents(n.NodeSequenceNumber, &dataRange{blocks: nblocks - 1, offset: 0}, &dataRange{blocks: 1, offset: 0x800000000 / c.blockSize()})
+		extents = c.computeNodeExtents(n.NodeSequenceNumber, &dataRange{blocks: c.directoryBlocks(nblocks - 1), offset: 0}, &dataRange{blocks: c.directoryBlocks(1), offset: 0x800000000 / c.blockSize()})
 		return
 	}
 
@@ -823,13 +919,11 @@ func (c *compiler) generateDirectory(n *vio.TreeNode) (size int64, data []byte,
 	ll := int64(16)
 
 	grow := func(child string) {
-		l := int64(len(child))
-		l = 11 + l
-		l = align(l, 8) // round up to nearest 8
+		l := c.dataEntrySize(child)
 
 		// TODO: shuffle entries to optimize used space
 
-		delta := align(ll, c.blockSize()) - ll
+		delta := align(ll, c.directoryBlockSize()) - ll
 		if delta < l || delta-l < 16 {
 			ll += delta + 16
 		}
@@ -852,15 +946,15 @@ func (c *compiler) generateDirectory(n *vio.TreeNode) (size int64, data []byte,
 	leafBlocks := divide(leafBlocksBytes, c.directoryBlockSize()-headerSize)
 	leafBlocks += 1
 
-	freeIndexBytes := 16 + 2*next
-	freeIndexBlocks := divide(freeIndexBytes, c.directoryBlockSize())
+	freeIndexBlocks := divide(ddb, c.bestsPerFreeIndexBlock())
 
-	size = ddb * c.blockSize()
-	extents = c.computeNodeExtents(n.NodeSequenceNumber, &dataRange{blocks: ddb, offset: 0}, &dataRange{blocks: leafBlocks, offset: 0x800000000 / c.blockSize()}, &dataRange{blocks: freeIndexBlocks, offset: 2 * 0x800000000 / c.blockSize()})
+	size = ddb * c.directoryBlockSize()
+	extents = c.computeNodeExtents(n.NodeSequenceNumber, &dataRange{blocks: c.directoryBlocks(ddb), offset: 0}, &dataRange{blocks: c.directoryBlocks(leafBlocks), offset: 0x800000000 / c.blockSize()}, &dataRange{blocks: c.directoryBlocks(freeIndexBlocks), offset: 2 * 0x800000000 / c.blockSize()})
 	return
 }
 
 func (c *compiler) generateDirectoryBlockData(n *vio.TreeNode, blocks int64) io.Reader {
+	blocks /= c.directoryBlocks(1) // file-system blocks to directory blocks
 	if blocks == 1 {
 		return c.generateBlockFormDirectoryData(n)
 	}
@@ -870,7 +964,7 @@ func (c *compiler) generateDirectoryBlockData(n *vio.TreeNode, blocks int64) io.
 	lfll := 16 + 4 + 2*next + (8 * entries)
 	if lfll <= c.directoryBlockSize() {
 		// leaf format
-		extents := c.computeNodeExtents(n.NodeSequenceNumber, &dataRange{blocks: blocks - 1, offset: 0}, &dataRange{blocks: 1, offset: 0x800000000 / c.blockSize()}) // called here to ensure things are computed in order
+		extents := c.computeNodeExtents(n.NodeSequenceNumber, &dataRange{blocks: c.directoryBlocks(blocks - 1), offset: 0}, &dataRange{blocks: c.directoryBlocks(1), offset: 0x800000000 / c.blockSize()}) // called here to ensure things are computed in order
 		return c.generateLeafFormDirectoryData(n, blocks, extents)
 	}
 
@@ -878,13 +972,11 @@ func (c *compiler) generateDirectoryBlockData(n *vio.TreeNode, blocks int64) io.
 	ll := int64(16)
 
 	grow := func(child string) {
-		l := int64(len(child))
-		l = 11 + l
-		l = align(l, 8) // round up to nearest 8
+		l := c.dataEntrySize(child)
 
 		// TODO: shuffle entries to optimize used space
 
-		delta := align(ll, c.blockSize()) - ll
+		delta := align(ll, c.directoryBlockSize()) - ll
 		if delta < l || delta-l < 16 {
 			ll += delta + 16
 		}
@@ -907,9 +999,8 @@ func (c *compiler) generateDirectoryBlockData(n *vio.TreeNode, blocks int64) io.
 	leafBlocks := divide(leafBlocksBytes, c.directoryBlockSize()-headerSize)
 	leafBlocks += 1
 
-	freeIndexBytes := 16 + 2*next
-	freeIndexBlocks := divide(freeIndexBytes, c.directoryBlockSize())
+	freeIndexBlocks := divide(ddb, c.bestsPerFreeIndexBlock())
 
-	extents := c.computeNodeExtents(n.NodeSequenceNumber, &dataRange{blocks: ddb, offset: 0}, &dataRange{blocks: leafBlocks, offset: 0x800000000 / c.blockSize()}, &dataRange{blocks: freeIndexBlocks, offset: 2 * 0x800000000 / c.blockSize()})
+	extents := c.computeNodeExtents(n.NodeSequenceNumber, &dataRange{blocks: c.directoryBlocks(ddb), offset: 0}, &dataRange{blocks: c.directoryBlocks(leafBlocks), offset: 0x800000000 / c.blockSize()}, &dataRange{blocks: c.directoryBlocks(freeIndexBlocks), offset: 2 * 0x800000000 / c.blockSize()})
 	return c.generateNodeFormDirectoryData(n, blocks, extents)
 }
@@ -0,0 +1,488 @@
+package xfs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// superblock field offsets patched in place by Grow
+const (
+	sbDataBlocksOffset = 8
+	sbAGCountOffset    = 88
+	sbDataFreeOffset   = 144
+)
+
+// minAllocGroupBlocks is the smallest alloc group the kernel accepts
+// (XFS_MIN_AG_BLOCKS).
+const minAllocGroupBlocks = 64
+
+// agflBlocks is the number of free list blocks reserved in each alloc group.
+const agflBlocks = 4
+
+type grower struct {
+	rw         io.ReadWriteSeeker
+	sb         SuperBlock
+	raw        []byte
+	blockSize  int64
+	agBlocks   int64
+	metaBlocks int64
+	oldBlocks  int64
+	newBlocks  int64
+	oldAGs     int64
+	newAGs     int64
+}
+
+// Grow grows an XFS file-system built by this package in place, so that it
+// fills size bytes. The new space must already exist and be readable and
+// writable through rw, which must treat the start of the file-system as
+// offset zero. The last alloc group is extended to its full size and new
+// alloc groups are added after it. New alloc groups have no inodes until the
+// kernel allocates some.
+func Grow(rw io.ReadWriteSeeker, size int64) error {
+
+	g := &grower{rw: rw}
+
+	err := g.readSuperblock()
+	if err != nil {
+		return err
+	}
+
+	err = g.plan(size)
+	if err != nil {
+		return err
+	}
+
+	if g.newBlocks == g.oldBlocks {
+		return nil
+	}
+
+	freeBlocks, err := g.extendLastAllocGroup()
+	if err != nil {
+		return err
+	}
+
+	for ag := g.oldAGs; ag < g.newAGs; ag++ {
+		var free int64
+		free, err = g.addAllocGroup(ag)
+		if err != nil {
+			return err
+		}
+		freeBlocks += free
+	}
+
+	return g.writeSuperblocks(freeBlocks)
+
+}
+
+func (g *grower) readAt(p []byte, off int64) error {
+
+	_, err := g.rw.Seek(off, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.ReadFull(g.rw, p)
+	return err
+
+}
+
+func (g *grower) writeAt(p []byte, off int64) error {
+
+	_, err := g.rw.Seek(off, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(g.rw, bytes.NewReader(p))
+	return err
+
+}
+
+func (g *grower) readSuperblock() error {
+
+	g.raw = make([]byte, SectorSize)
+	err := g.readAt(g.raw, 0)
+	if err != nil {
+		return err
+	}
+
+	err = binary.Read(bytes.NewReader(g.raw), binary.BigEndian, &g.sb)
+	if err != nil {
+		return err
+	}
+
+	sb := &g.sb
+
+	if sb.MagicNumber != SBMagicNumber {
+		return errors.New("not an xfs file-system")
+	}
+
+	if sb.VersionNum&0xF != VersionNumber || sb.MoreFeatures&Version2CRCBit != 0 {
+		return errors.New("unsupported xfs version")
+	}
+
+	if sb.SectorSize != SectorSize || sb.BlockSize == 0 || sb.AGBlocks == 0 || sb.AGCount == 0 {
+		return errors.New("unsupported xfs geometry")
+	}
+
+	if sb.InProgress != 0 {
+		return errors.New("xfs file-system is still being created")
+	}
+
+	g.blockSize = int64(sb.BlockSize)
+	g.agBlocks = int64(sb.AGBlocks)
+	g.metaBlocks = divide(4*SectorSize, g.blockSize)
+
+	return nil
+
+}
+
+func (g *grower) plan(size int64) error {
+
+	g.oldBlocks = int64(g.sb.DataBlocks)
+	g.oldAGs = int64(g.sb.AGCount)
+
+	g.newBlocks = size / g.blockSize
+	if g.newBlocks < g.oldBlocks {
+		return fmt.Errorf("xfs file-system can't be shrunk from %d to %d blocks", g.oldBlocks, g.newBlocks)
+	}
+
+	g.newAGs = divide(g.newBlocks, g.agBlocks)
+
+	// leave out a trailing alloc group that's too small to be valid
+	if g.newAGs > g.oldAGs && g.newBlocks-(g.newAGs-1)*g.agBlocks < minAllocGroupBlocks {
+		g.newAGs--
+		g.newBlocks = g.newAGs * g.agBlocks
+	}
+
+	if g.newBlocks < g.oldBlocks {
+		g.newBlocks = g.oldBlocks
+		g.newAGs = g.oldAGs
+	}
+
+	return nil
+
+}
+
+func (g *grower) allocGroupLength(ag, blocks int64) int64 {
+
+	length := blocks - ag*g.agBlocks
+	if length > g.agBlocks {
+		length = g.agBlocks
+	}
+
+	return length
+
+}
+
+func (g *grower) allocGroupOffset(ag int64) int64 {
+	return ag * g.agBlocks * g.blockSize
+}
+
+func (g *grower) readFreeSpaceRecords(ag int64, agf *AGF) ([]AllocRecord, error) {
+
+	if agf.Levels != [2]uint32{1, 1} {
+		return nil, errors.New("unsupported xfs free space b+ tree depth")
+	}
+
+	block := make([]byte, g.blockSize)
+	err := g.readAt(block, g.allocGroupOffset(ag)+int64(agf.Roots[0])*g.blockSize)
+	if err != nil {
+		return nil, err
+	}
+
+	hdr := new(BTreeSBlock)
+	r := bytes.NewReader(block)
+	err = binary.Read(r, binary.BigEndian, hdr)
+	if err != nil {
+		return nil, err
+	}
+
+	if hdr.Magic != ABTBMagicNumber || hdr.Level != 0 {
+		return nil, errors.New("bad xfs free space b+ tree")
+	}
+
+	recs := make([]AllocRecord, hdr.NumRecs)
+	err = binary.Read(r, binary.BigEndian, recs)
+	if err != nil {
+		return nil, err
+	}
+
+	return recs, nil
+
+}
+
+// writeFreeSpaceTrees rewrites both single-leaf free space b+ trees of an
+// alloc group from recs.
+func (g *grower) writeFreeSpaceTrees(ag int64, agf *AGF, recs []AllocRecord) error {
+
+	if int64(len(recs)) > (g.blockSize-16)/8 {
+		return errors.New("too many free space extents to grow xfs file-system")
+	}
+
+	byBlock := append([]AllocRecord(nil), recs...)
+	sort.Slice(byBlock, func(i, j int) bool {
+		return byBlock[i].StartBlock < byBlock[j].StartBlock
+	})
+
+	byCount := append([]AllocRecord(nil), recs...)
+	sort.Slice(byCount, func(i, j int) bool {
+		if byCount[i].BlockCount != byCount[j].BlockCount {
+			return byCount[i].BlockCount < byCount[j].BlockCount
+		}
+		return byCount[i].StartBlock < byCount[j].StartBlock
+	})
+
+	trees := []struct {
+		magic uint32
+		root  uint32
+		recs  []AllocRecord
+	}{
+		{ABTBMagicNumber, agf.Roots[0], byBlock},
+		{ABTCMagicNumber, agf.Roots[1], byCount},
+	}
+
+	for _, tree := range trees {
+
+		buf := new(bytes.Buffer)
+		err := binary.Write(buf, binary.BigEndian, &BTreeSBlock{
+			Magic:    tree.magic,
+			NumRecs:  uint16(len(tree.recs)),
+			LeftSIB:  0xFFFFFFFF,
+			RightSIB: 0xFFFFFFFF,
+		})
+		if err != nil {
+			return err
+		}
+
+		err = binary.Write(buf, binary.BigEndian, tree.recs)
+		if err != nil {
+			return err
+		}
+
+		block := make([]byte, g.blockSize)
+		copy(block, buf.Bytes())
+
+		err = g.writeAt(block, g.allocGroupOffset(ag)+int64(tree.root)*g.blockSize)
+		if err != nil {
+			return err
+		}
+
+	}
+
+	agf.FreeBlocks = 0
+	agf.Longest = 0
+	for _, rec := range recs {
+		agf.FreeBlocks += rec.BlockCount
+		if rec.BlockCount > agf.Longest {
+			agf.Longest = rec.BlockCount
+		}
+	}
+
+	return nil
+
+}
+
+// extendLastAllocGroup adds the new space at the end of the existing last
+// alloc group to its free space, if it wasn't full.
+func (g *grower) extendLastAllocGroup() (int64, error) {
+
+	ag := g.oldAGs - 1
+	oldLength := g.allocGroupLength(ag, g.oldBlocks)
+	newLength := g.allocGroupLength(ag, g.newBlocks)
+	if newLength == oldLength {
+		return 0, nil
+	}
+
+	offset := g.allocGroupOffset(ag)
+
+	agf := new(AGF)
+	buf := make([]byte, binary.Size(agf))
+	err := g.readAt(buf, offset+SectorSize)
+	if err != nil {
+		return 0, err
+	}
+
+	err = binary.Read(bytes.NewReader(buf), binary.BigEndian, agf)
+	if err != nil {
+		return 0, err
+	}
+
+	if agf.Magic != AGFMagicNumber || int64(agf.Length) != oldLength {
+		return 0, errors.New("bad xfs alloc group header")
+	}
+
+	recs, err := g.readFreeSpaceRecords(ag, agf)
+	if err != nil {
+		return 0, err
+	}
+
+	added := uint32(newLength - oldLength)
+	extended := false
+	for i := range recs {
+		if int64(recs[i].StartBlock+recs[i].BlockCount) == oldLength {
+			recs[i].BlockCount += added
+			extended = true
+		}
+	}
+
+	if !extended {
+		recs = append(recs, AllocRecord{
+			StartBlock: uint32(oldLength),
+			BlockCount: added,
+		})
+	}
+
+	err = g.writeFreeSpaceTrees(ag, agf, recs)
+	if err != nil {
+		return 0, err
+	}
+
+	agf.Length = uint32(newLength)
+
+	out := new(bytes.Buffer)
+	err = binary.Write(out, binary.BigEndian, agf)
+	if err != nil {
+		return 0, err
+	}
+
+	err = g.writeAt(out.Bytes(), offset+SectorSize)
+	if err != nil {
+		return 0, err
+	}
+
+	// AGI length
+	buf = make([]byte, 4)
+	binary.BigEndian.PutUint32(buf, uint32(newLength))
+	err = g.writeAt(buf, offset+2*SectorSize+12)
+	if err != nil {
+		return 0, err
+	}
+
+	return int64(added), nil
+
+}
+
+// addAllocGroup writes the headers and empty b+ trees for a new alloc group,
+// and returns the number of free blocks in it, counting its free list.
+func (g *grower) addAllocGroup(ag int64) (int64, error) {
+
+	offset := g.allocGroupOffset(ag)
+	length := g.allocGroupLength(ag, g.newBlocks)
+
+	inobtAddr := uint32(g.metaBlocks)
+	abtbAddr := inobtAddr + 1
+	abtcAddr := abtbAddr + 1
+	firstFree := abtcAddr + 1 + agflBlocks
+
+	agf := &AGF{
+		Magic:   AGFMagicNumber,
+		Version: AGFVersion,
+		SeqNo:   uint32(ag),
+		Length:  uint32(length),
+		Roots:   [2]uint32{abtbAddr, abtcAddr},
+		Levels:  [2]uint32{1, 1},
+		FLFirst: 0,
+		FLLast:  agflBlocks - 1,
+		FLCount: agflBlocks,
+	}
+
+	err := g.writeFreeSpaceTrees(ag, agf, []AllocRecord{{
+		StartBlock: firstFree,
+		BlockCount: uint32(length) - firstFree,
+	}})
+	if err != nil {
+		return 0, err
+	}
+
+	// an empty inode b+ tree, because inodes are allocated on demand
+	buf := new(bytes.Buffer)
+	err = binary.Write(buf, binary.BigEndian, &BTreeSBlock{
+		Magic:    IBTMagicNumber,
+		LeftSIB:  0xFFFFFFFF,
+		RightSIB: 0xFFFFFFFF,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	block := make([]byte, g.blockSize)
+	copy(block, buf.Bytes())
+
+	err = g.writeAt(block, offset+int64(inobtAddr)*g.blockSize)
+	if err != nil {
+		return 0, err
+	}
+
+	// headers, except for the superblock, which is written with the others
+	headers := make([]byte, 4*SectorSize)
+
+	buf.Reset()
+	err = binary.Write(buf, binary.BigEndian, agf)
+	if err != nil {
+		return 0, err
+	}
+	copy(headers[SectorSize:], buf.Bytes())
+
+	agi := &AGI{
+		Magic:   AGIMagicNumber,
+		Version: AGIVersion,
+		SeqNo:   uint32(ag),
+		Length:  uint32(length),
+		Root:    inobtAddr,
+		Level:   1,
+		NewIno:  0xFFFFFFFF, // NOTE: according to the spec this is NULL (-1)
+		DirIno:  0xFFFFFFFF,
+	}
+
+	for i := range agi.Unlinked {
+		agi.Unlinked[i] = 0xFFFFFFFF
+	}
+
+	buf.Reset()
+	err = binary.Write(buf, binary.BigEndian, agi)
+	if err != nil {
+		return 0, err
+	}
+	copy(headers[2*SectorSize:], buf.Bytes())
+
+	agfl := headers[3*SectorSize:]
+	for i := range agfl {
+		agfl[i] = 0xFF
+	}
+
+	for i := uint32(0); i < agflBlocks; i++ {
+		binary.BigEndian.PutUint32(agfl[i*4:], abtcAddr+1+i)
+	}
+
+	err = g.writeAt(headers[SectorSize:], offset+SectorSize)
+	if err != nil {
+		return 0, err
+	}
+
+	return int64(agf.FreeBlocks) + agflBlocks, nil
+
+}
+
+// writeSuperblocks writes the updated superblock to every alloc group,
+// including the secondary copies in the existing ones.
+func (g *grower) writeSuperblocks(freeBlocks int64) error {
+
+	binary.BigEndian.PutUint64(g.raw[sbDataBlocksOffset:], uint64(g.newBlocks))
+	binary.BigEndian.PutUint32(g.raw[sbAGCountOffset:], uint32(g.newAGs))
+	binary.BigEndian.PutUint64(g.raw[sbDataFreeOffset:], g.sb.DataFree+uint64(freeBlocks))
+
+	for ag := int64(0); ag < g.newAGs; ag++ {
+		err := g.writeAt(g.raw, g.allocGroupOffset(ag))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+
+}
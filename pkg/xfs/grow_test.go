@@ -0,0 +1,152 @@
+package xfs
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vorteil/vorteil/pkg/elog"
+	"github.com/vorteil/vorteil/pkg/vio"
+)
+
+func compileGrowTestFilesystem(t *testing.T, f *os.File) int64 {
+
+	tree := vio.NewFileTree()
+
+	err := tree.Map("app", vio.CustomFile(vio.CustomFileArgs{
+		Name:       "app",
+		Size:       4,
+		ModTime:    time.Unix(1600000000, 0),
+		ReadCloser: ioutil.NopCloser(strings.NewReader("data")),
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := NewCompiler(&CompilerArgs{
+		FileTree: tree,
+		Logger:   &elog.CLI{},
+	})
+
+	c.IncreaseMinimumFreeSpace(0x1000000)
+
+	ctx := context.Background()
+	err = c.Commit(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	size := c.MinimumSize()
+	err = c.Precompile(ctx, size)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = c.Compile(ctx, f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return size
+
+}
+
+func TestGrow(t *testing.T) {
+
+	f, err := ioutil.TempFile("", "xfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	size := compileGrowTestFilesystem(t, f)
+
+	sb := new(SuperBlock)
+	err = binary.Read(io.NewSectionReader(f, 0, SectorSize), binary.BigEndian, sb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	oldAGs := int64(sb.AGCount)
+	agSize := int64(sb.AGBlocks) * int64(sb.BlockSize)
+	size = oldAGs*agSize + 3*agSize + agSize/2
+
+	err = f.Truncate(size)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = Grow(f, size)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var blocks, free int64
+
+	for ag := int64(0); ag < oldAGs+4; ag++ {
+
+		offset := ag * agSize
+
+		secondary := new(SuperBlock)
+		err = binary.Read(io.NewSectionReader(f, offset, SectorSize), binary.BigEndian, secondary)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if secondary.DataBlocks != uint64(size)/uint64(sb.BlockSize) || secondary.AGCount != uint32(oldAGs+4) {
+			t.Fatalf("alloc group %d superblock wasn't updated", ag)
+		}
+
+		agf := new(AGF)
+		err = binary.Read(io.NewSectionReader(f, offset+SectorSize, SectorSize), binary.BigEndian, agf)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if agf.Magic != AGFMagicNumber || agf.SeqNo != uint32(ag) {
+			t.Fatalf("alloc group %d has a bad AGF", ag)
+		}
+
+		block := make([]byte, sb.BlockSize)
+		_, err = f.ReadAt(block, offset+int64(agf.Roots[0])*int64(sb.BlockSize))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		hdr := new(BTreeSBlock)
+		rec := new(AllocRecord)
+		r := bytes.NewReader(block)
+		_ = binary.Read(r, binary.BigEndian, hdr)
+		_ = binary.Read(r, binary.BigEndian, rec)
+
+		if hdr.Magic != ABTBMagicNumber || hdr.NumRecs != 1 || rec.StartBlock+rec.BlockCount != agf.Length || rec.BlockCount != agf.FreeBlocks {
+			t.Fatalf("alloc group %d free space doesn't match its length", ag)
+		}
+
+		blocks += int64(agf.Length)
+		free += int64(agf.FreeBlocks + agf.FLCount)
+
+	}
+
+	if blocks != size/int64(sb.BlockSize) {
+		t.Errorf("alloc groups add up to %d blocks, expected %d", blocks, size/int64(sb.BlockSize))
+	}
+
+	grown := new(SuperBlock)
+	err = binary.Read(io.NewSectionReader(f, 0, SectorSize), binary.BigEndian, grown)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if int64(grown.DataFree) != free {
+		t.Errorf("superblock has %d free blocks, alloc groups have %d", grown.DataFree, free)
+	}
+
+}
@@ -0,0 +1,95 @@
+package xfs
+
+import (
+	"context"
+	"io"
+	"runtime"
+	"sync"
+
+	"github.com/vorteil/vorteil/pkg/elog"
+	"github.com/vorteil/vorteil/pkg/vio"
+)
+
+// DefaultWorkers is the number of goroutines used to write the metadata of
+// alloc groups if CompilerArgs.Workers is zero.
+var DefaultWorkers = runtime.NumCPU()
+
+// writeAllocGroupsConcurrently writes the headers, b+ trees and free inodes
+// of every alloc group from a pool of workers, each straight into place at
+// its own offset of wa, while the inodes and data of the file tree, which
+// have to be read in order, are written to w.
+func (c *compiler) writeAllocGroupsConcurrently(ctx context.Context, w io.WriteSeeker, wa io.WriterAt, workers int, inodeProgress, dataProgress elog.Progress) error {
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	groups := make(chan int64)
+	errs := make(chan error, workers)
+	wg := new(sync.WaitGroup)
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ag := range groups {
+				ow := vio.NewOffsetWriter(wa, 0)
+				err := c.writeAllocGroupMetaData(ow, ag)
+				if err == nil {
+					// free inodes aren't counted by the progress, so none
+					// is needed
+					err = c.writeInodes(ow, ag, c.usedInodesInAllocGroup(ag), c.inodesPerAllocGroup(), nil)
+				}
+				if err != nil {
+					errs <- err
+					cancel()
+					return
+				}
+			}
+		}()
+	}
+
+	go func() {
+		defer close(groups)
+		for ag := int64(0); ag < c.allocGroups; ag++ {
+			select {
+			case groups <- ag:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	var err error
+	for ag := int64(0); ag < c.allocGroups; ag++ {
+
+		err = c.writeInodes(w, ag, 0, c.usedInodesInAllocGroup(ag), inodeProgress)
+		if err != nil {
+			break
+		}
+
+		if err = ctx.Err(); err != nil {
+			break
+		}
+
+		err = c.writeAllocGroupData(ctx, w, ag, dataProgress)
+		if err != nil {
+			break
+		}
+
+	}
+
+	if err != nil {
+		cancel()
+	}
+	wg.Wait()
+
+	// a worker's error is what cancelled everything else, if there is one
+	select {
+	case werr := <-errs:
+		return werr
+	default:
+	}
+
+	return err
+
+}
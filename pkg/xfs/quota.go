@@ -0,0 +1,368 @@
+package xfs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+
+	"github.com/vorteil/vorteil/pkg/vio"
+)
+
+// QuotaType is what a Quota limits.
+type QuotaType int
+
+const (
+	UserQuota QuotaType = iota
+	GroupQuota
+	ProjectQuota
+)
+
+func (t QuotaType) String() string {
+	switch t {
+	case UserQuota:
+		return "user"
+	case GroupQuota:
+		return "group"
+	default:
+		return "project"
+	}
+}
+
+// Quota sets the limits on the space in bytes and the inodes that the user,
+// group or project with ID can use. Limits left zero aren't enforced, and the
+// limits of ID 0 are the defaults for every other ID without its own. A
+// project quota with a Path gives the directory at that path and everything
+// under it the project's ID, and marks the directory so that files created in
+// it later inherit it.
+type Quota struct {
+	Type       QuotaType
+	ID         uint32
+	Path       string
+	Space      int64
+	SoftSpace  int64
+	Inodes     int64
+	SoftInodes int64
+}
+
+// firstQuotaInode is the sequence number of the first quota inode, which
+// follow the root directory and the realtime inodes.
+const firstQuotaInode = 3
+
+// quotaFile is the contents of a quota inode: a sparse file with a block of
+// dquots for each range of IDs that has limits or uses any inodes.
+type quotaFile struct {
+	dtype  uint8
+	dquots map[uint32]*Dquot
+	chunks []int64 // file blocks holding dquots, in order
+}
+
+func (q *quotaFile) dquot(id uint32) *Dquot {
+
+	d, ok := q.dquots[id]
+	if !ok {
+		d = &Dquot{
+			Magic:   DquotMagicNumber,
+			Version: DquotVersion,
+			Type:    q.dtype,
+			ID:      id,
+		}
+		q.dquots[id] = d
+	}
+
+	return d
+
+}
+
+func (q *quotaFile) account(id uint32, blocks int64) {
+	d := q.dquot(id)
+	d.BlockCount += uint64(blocks)
+	d.InodeCount++
+}
+
+// ranges returns the fragments of the file that hold dquots.
+func (q *quotaFile) ranges() []*dataRange {
+
+	var ranges []*dataRange
+	for _, chunk := range q.chunks {
+		if l := len(ranges); l > 0 && ranges[l-1].offset+ranges[l-1].blocks == chunk {
+			ranges[l-1].blocks++
+			continue
+		}
+		ranges = append(ranges, &dataRange{blocks: 1, offset: chunk})
+	}
+
+	return ranges
+
+}
+
+// reader returns the blocks of the file that hold dquots, in order. Every
+// dquot in a block is written, because the kernel checks them all when it
+// reads the block.
+func (q *quotaFile) reader(blockSize int64) io.Reader {
+
+	perBlock := blockSize / DquotBlockSize
+	buf := new(bytes.Buffer)
+
+	for _, chunk := range q.chunks {
+		for i := int64(0); i < perBlock; i++ {
+			id := uint32(chunk*perBlock + i)
+			d, ok := q.dquots[id]
+			if !ok {
+				d = &Dquot{
+					Magic:   DquotMagicNumber,
+					Version: DquotVersion,
+					Type:    q.dtype,
+					ID:      id,
+				}
+			}
+			_ = binary.Write(buf, binary.BigEndian, d)
+			buf.Write(make([]byte, DquotBlockSize-binary.Size(d)))
+		}
+		buf.Write(make([]byte, blockSize-perBlock*DquotBlockSize))
+	}
+
+	return buf
+
+}
+
+// quotas are the quota files of a file-system and the projects of its inodes.
+type quotas struct {
+	userQuotas   *quotaFile
+	otherQuotas  *quotaFile // group or project quotas
+	quotaFiles   []*quotaFile
+	projectPaths map[string]uint32 // paths given projects that haven't been found yet
+	nodeProjects []uint32          // nil unless there are project quotas
+}
+
+// quotaFile returns the quota file of the inode with sequence number ino, or
+// nil if it isn't a quota inode.
+func (q *quotas) quotaFile(ino int64) *quotaFile {
+
+	x := ino - firstQuotaInode
+	if x < 0 || x >= int64(len(q.quotaFiles)) {
+		return nil
+	}
+
+	return q.quotaFiles[x]
+
+}
+
+// project returns the project ID of the inode with sequence number ino.
+func (q *quotas) project(ino int64) uint32 {
+
+	if q.nodeProjects == nil {
+		return 0
+	}
+
+	return q.nodeProjects[ino]
+
+}
+
+// initQuotas creates a quota file for user quotas and one for either group or
+// project quotas, if any of them are set. XFS file-systems without the v5
+// format can't have both group and project quotas.
+func (p *precompiler) initQuotas() error {
+
+	p.quotas = quotas{projectPaths: make(map[string]uint32)}
+
+	for _, q := range p.args.Options.Quotas {
+		switch q.Type {
+		case UserQuota:
+			if p.userQuotas == nil {
+				p.userQuotas = &quotaFile{dtype: DquotTypeUser, dquots: make(map[uint32]*Dquot)}
+			}
+		case GroupQuota, ProjectQuota:
+			dtype := uint8(DquotTypeGroup)
+			if q.Type == ProjectQuota {
+				dtype = DquotTypeProject
+			}
+			if p.otherQuotas == nil {
+				p.otherQuotas = &quotaFile{dtype: dtype, dquots: make(map[uint32]*Dquot)}
+			}
+			if p.otherQuotas.dtype != dtype {
+				return fmt.Errorf("can't have group and project quotas at the same time")
+			}
+		default:
+			return fmt.Errorf("invalid quota type %d", q.Type)
+		}
+
+		if q.Path != "" {
+			if q.Type != ProjectQuota {
+				return fmt.Errorf("%s quota %d has a path, but only project quotas apply to paths", q.Type, q.ID)
+			}
+			p.projectPaths[path.Clean("/"+q.Path)] = q.ID
+		}
+	}
+
+	for _, q := range []*quotaFile{p.userQuotas, p.otherQuotas} {
+		if q != nil {
+			q.dquot(0) // holds the default limits
+			p.quotaFiles = append(p.quotaFiles, q)
+		}
+	}
+
+	return nil
+
+}
+
+// accountQuotas adds the inode with sequence number k at path to the usage of
+// the quotas it counts towards. Inodes are accounted in order, so that
+// directories are given a project before anything in them.
+func (p *precompiler) accountQuotas(k int64, path string, node *vio.TreeNode, blocks int64) {
+
+	if p.quotaFiles == nil {
+		return
+	}
+
+	uid, gid := fileOwner(node.File)
+
+	if p.userQuotas != nil {
+		p.userQuotas.account(uid, blocks)
+	}
+
+	if p.otherQuotas == nil {
+		return
+	}
+
+	if p.nodeProjects == nil {
+		p.otherQuotas.account(gid, blocks)
+		return
+	}
+
+	var project uint32
+	if id, ok := p.projectPaths[path]; ok {
+		project = id
+		delete(p.projectPaths, path)
+	} else if node.Parent != nil && node.Parent != node {
+		project = p.nodeProjects[node.Parent.NodeSequenceNumber]
+	}
+
+	p.nodeProjects[k] = project
+	p.otherQuotas.account(project, blocks)
+
+}
+
+// finishQuotas sets the limits of the quotas, works out which blocks of each
+// quota file hold dquots, and returns the number of blocks in all of them.
+func (p *precompiler) finishQuotas() (int64, error) {
+
+	if p.quotaFiles == nil {
+		return 0, nil
+	}
+
+	for path := range p.projectPaths {
+		return 0, fmt.Errorf("project quota path '%s' doesn't exist", path)
+	}
+
+	// the realtime inodes aren't in the tree, but they still count towards
+	// the quotas of the default owner
+	for ino := int64(1); ino < firstQuotaInode; ino++ {
+		p.accountQuotas(ino, "", &vio.TreeNode{File: vio.CustomFile(vio.CustomFileArgs{})}, 0)
+	}
+
+	for _, q := range p.args.Options.Quotas {
+		f := p.userQuotas
+		if q.Type != UserQuota {
+			f = p.otherQuotas
+		}
+		d := f.dquot(q.ID)
+		d.BlockHardLimit = uint64(divide(q.Space, p.blockSize()))
+		d.BlockSoftLimit = uint64(divide(q.SoftSpace, p.blockSize()))
+		d.InodeHardLimit = uint64(q.Inodes)
+		d.InodeSoftLimit = uint64(q.SoftInodes)
+	}
+
+	var blocks int64
+	perBlock := p.blockSize() / DquotBlockSize
+
+	for i, f := range p.quotaFiles {
+
+		defaults := f.dquot(0)
+		chunks := make(map[int64]bool)
+
+		for id, d := range f.dquots {
+			chunks[int64(id)/perBlock] = true
+			if id == 0 {
+				continue
+			}
+
+			// the kernel refuses dquots over their soft limits without a
+			// grace period timer, so quotas can't start out exceeded
+			limits := []struct {
+				name             string
+				used, hard, soft uint64
+				defHard, defSoft uint64
+			}{
+				{"space", d.BlockCount, d.BlockHardLimit, d.BlockSoftLimit, defaults.BlockHardLimit, defaults.BlockSoftLimit},
+				{"inodes", d.InodeCount, d.InodeHardLimit, d.InodeSoftLimit, defaults.InodeHardLimit, defaults.InodeSoftLimit},
+			}
+			for _, l := range limits {
+				if l.hard == 0 {
+					l.hard = l.defHard
+				}
+				if l.soft == 0 {
+					l.soft = l.defSoft
+				}
+				if (l.hard != 0 && l.used > l.hard) || (l.soft != 0 && l.used > l.soft) {
+					return 0, fmt.Errorf("%s quota %d is already exceeded by the files in the file-system (%s)", dquotTypeName(f.dtype), id, l.name)
+				}
+			}
+		}
+
+		f.chunks = make([]int64, 0, len(chunks))
+		for chunk := range chunks {
+			f.chunks = append(f.chunks, chunk)
+		}
+		sort.Slice(f.chunks, func(i, j int) bool { return f.chunks[i] < f.chunks[j] })
+
+		if int64(len(f.ranges())+1) > p.inodeDataCapacity/16 {
+			return 0, fmt.Errorf("%s quota ids are too spread out to fit in the quota file", dquotTypeName(f.dtype))
+		}
+
+		x := int64(len(f.chunks))
+		p.nodeBlocks[firstQuotaInode+i] = uint32(x)
+		blocks += x
+
+	}
+
+	return blocks, nil
+
+}
+
+func dquotTypeName(dtype uint8) string {
+	switch dtype {
+	case DquotTypeUser:
+		return UserQuota.String()
+	case DquotTypeGroup:
+		return GroupQuota.String()
+	default:
+		return ProjectQuota.String()
+	}
+}
+
+// quotaFlags returns the superblock's quota flags. The usage in every dquot
+// is worked out when the file-system is built, so quotas are marked as
+// checked and the kernel doesn't have to scan every inode when it mounts it.
+func (q *quotas) quotaFlags() uint16 {
+
+	var flags uint16
+
+	if q.userQuotas != nil {
+		flags |= QuotaUserAccounting | QuotaUserEnforced | QuotaUserChecked
+	}
+
+	if q.otherQuotas != nil {
+		flags |= QuotaOtherEnforced | QuotaOtherChecked
+		if q.otherQuotas.dtype == DquotTypeGroup {
+			flags |= QuotaGroupAccounting
+		} else {
+			flags |= QuotaProjectAccounting
+		}
+	}
+
+	return flags
+
+}
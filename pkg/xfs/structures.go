@@ -6,7 +6,12 @@ const (
 	SectorSize       = 0x1 << sectorSizeLog
 	inodesPercentage = 25
 
-	dirBlockAllocLog = 0 // 1 block
+	inodeClusterSize = 0x2000 // XFS_INODE_BIG_CLUSTER_SIZE
+	minInodeSize     = 0x100  // XFS_DINODE_MIN_SIZE
+	maxInodeSize     = 0x800  // XFS_DINODE_MAX_SIZE
+	minJournalBlocks = 512    // XFS_MIN_LOG_BLOCKS
+
+	maxDirectoryBlockSize = 0x10000 // XFS_MAX_BLOCKSIZE
 
 	VersionNumber      = 4      // XFS_SB_VERSION_4
 	VersionAttrBit     = 0x0010 // XFS_SB_VERSION_ATTRBIT
@@ -65,6 +70,24 @@ const (
 	InodeFormatLocal   = 1
 	InodeFormatExtents = 2
 	InodeFormatBTree   = 3
+
+	InodeFlagProjInherit = 0x0200 // XFS_DIFLAG_PROJINHERIT
+
+	DquotMagicNumber = 0x4451 // XFS_DQUOT_MAGIC "DQ"
+	DquotVersion     = 1      // XFS_DQUOT_VERSION
+	DquotBlockSize   = 136    // sizeof(xfs_dqblk_t)
+
+	DquotTypeUser    = 0x01 // XFS_DQTYPE_USER
+	DquotTypeProject = 0x02 // XFS_DQTYPE_PROJ
+	DquotTypeGroup   = 0x04 // XFS_DQTYPE_GROUP
+
+	QuotaUserAccounting    = 0x0001 // XFS_UQUOTA_ACCT
+	QuotaUserEnforced      = 0x0002 // XFS_UQUOTA_ENFD
+	QuotaUserChecked       = 0x0004 // XFS_UQUOTA_CHKD
+	QuotaProjectAccounting = 0x0008 // XFS_PQUOTA_ACCT
+	QuotaOtherEnforced     = 0x0010 // XFS_OQUOTA_ENFD
+	QuotaOtherChecked      = 0x0020 // XFS_OQUOTA_CHKD
+	QuotaGroupAccounting   = 0x0040 // XFS_GQUOTA_ACCT
 )
 
 type SuperBlock struct {
@@ -262,8 +285,9 @@ type InodeCore struct {
 	UID          uint32    // 8
 	GID          uint32    // 12
 	Nlink        uint32    // 16
-	ProjID       uint16    // 20
-	Pad          [8]byte   // 22
+	ProjIDLow    uint16    // 20
+	ProjIDHigh   uint16    // 22
+	Pad          [6]byte   // 24
 	FlushIter    uint16    // 30
 	ATime        Timestamp // 32
 	MTime        Timestamp // 40
@@ -294,3 +318,27 @@ type Dir2NodeBlockHeader struct {
 	Count uint16
 	Level uint16
 }
+
+type Dquot struct {
+	Magic            uint16 // 0
+	Version          uint8  // 2
+	Type             uint8  // 3
+	ID               uint32 // 4
+	BlockHardLimit   uint64 // 8
+	BlockSoftLimit   uint64 // 16
+	InodeHardLimit   uint64 // 24
+	InodeSoftLimit   uint64 // 32
+	BlockCount       uint64 // 40
+	InodeCount       uint64 // 48
+	InodeTimer       uint32 // 56
+	BlockTimer       uint32 // 60
+	InodeWarnings    uint16 // 64
+	BlockWarnings    uint16 // 66
+	Pad0             uint32 // 68
+	RTBlockHardLimit uint64 // 72
+	RTBlockSoftLimit uint64 // 80
+	RTBlockCount     uint64 // 88
+	RTBlockTimer     uint32 // 96
+	RTBlockWarnings  uint16 // 100
+	Pad              uint16 // 102
+} // 104
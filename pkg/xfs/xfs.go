@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	pathpkg "path"
 	"strings"
 
 	"github.com/davidminor/uint128"
@@ -22,6 +23,25 @@ type precompilerArgs struct {
 	Options  struct {
 		MinimumFreeInodes int64
 		MinimumFreeSpace  int64
+		UUID              [16]byte
+		Label             string
+		FileTypes         bool
+
+		// BlockSize, InodeSize and DirectoryBlockSize are in bytes. Zero
+		// means the default for each.
+		BlockSize          int64
+		InodeSize          int64
+		DirectoryBlockSize int64
+
+		Quotas []Quota
+
+		// Workers is the number of goroutines writing the metadata of
+		// alloc groups. Zero means DefaultWorkers.
+		Workers int
+
+		// MaxMemory is the largest directory, in bytes, generated all at
+		// once. Zero means DefaultMaxMemory.
+		MaxMemory int64
 	}
 }
 
@@ -39,6 +59,7 @@ type constants struct {
 	allocGroups           int64
 	journalBlocks         int64
 	treeBlocks            int64
+	fileTypes             bool
 
 	usedInodes  int64
 	freeInodes  int64
@@ -53,7 +74,7 @@ type constants struct {
 func (c *constants) translateRelativeInodeNumber(x int64) uint64 {
 	ag := x / c.inodesPerAllocGroup()
 	rel := x % c.inodesPerAllocGroup()
-	rel += c.inodesPerBlock() * (c.superMetaBlocks() + 7)
+	rel += c.inodesPerBlock() * c.headerBlocks()
 	if ag == 0 {
 		rel += c.journalBlocks * c.inodesPerBlock()
 	}
@@ -70,7 +91,7 @@ func (c *constants) translateAbsoluteInodeNumber(x int64) uint64 {
 
 	ag := x / c.inodesPerAllocGroup()
 	rel := x % c.inodesPerAllocGroup()
-	rel += c.inodesPerBlock() * (c.superMetaBlocks() + 7)
+	rel += c.inodesPerBlock() * c.headerBlocks()
 	if ag == 0 {
 		rel += c.journalBlocks * c.inodesPerBlock()
 	}
@@ -131,6 +152,60 @@ func (c *constants) directoryBlockSize() int64 {
 	return c.blockSize() * (1 << c.exponents.directoryBlockSize)
 }
 
+// bestsPerFreeIndexBlock returns the number of directory data blocks a free
+// index block records the best free space of.
+func (c *constants) bestsPerFreeIndexBlock() int64 {
+	return (c.directoryBlockSize() - 16) / 2
+}
+
+// directoryBlocks converts a number of directory blocks into a number of
+// file-system blocks.
+func (c *constants) directoryBlocks(x int64) int64 {
+	return x << c.exponents.directoryBlockSize
+}
+
+// inodeAlignment returns the number of blocks inode chunks are aligned to, or
+// zero if the layout can't keep them aligned. Chunks start straight after the
+// alloc group headers, which only land on a cluster boundary for block sizes
+// of 2 KiB and up.
+func (c *constants) inodeAlignment() int64 {
+
+	x := divide(inodeClusterSize, c.blockSize())
+	if (c.superMetaBlocks()+7)%x != 0 { // NOTE: headerBlocks pads the inode b+ tree to keep this alignment
+		return 0
+	}
+
+	return x
+
+}
+
+// dataEntrySize returns the length of the entry for name in a directory data
+// block, which has a byte for the file type if the ftype feature is enabled.
+func (c *constants) dataEntrySize(name string) int64 {
+
+	l := 11 + int64(len(name))
+	if c.fileTypes {
+		l++
+	}
+
+	return align(l, 8)
+
+}
+
+// shortFormEntrySize returns the length of the entry for name in a short form
+// directory, which has a byte for the file type if the ftype feature is
+// enabled.
+func (c *constants) shortFormEntrySize(name string) int64 {
+
+	l := 7 + int64(len(name))
+	if c.fileTypes {
+		l++
+	}
+
+	return l
+
+}
+
 func (c *constants) calculateInodes(used, minimumFree int64) {
 	c.usedInodes = used
 	c.freeInodes = minimumFree
@@ -143,8 +218,68 @@ func (c *constants) superMetaBlocks() int64 {
 	return divide(4*c.sectorSize(), c.blockSize()) // 4 sectors
 }
 
+// headerBlocks returns the number of blocks at the start of every alloc group
+// before the journal and inodes: the superblock sectors, a root block for
+// each b+ tree, the free list, and any other inode b+ tree blocks.
+func (c *constants) headerBlocks() int64 {
+
+	x := c.superMetaBlocks() + 7 // + 7 blocks for b+ tree roots and the free list
+
+	extra := c.inodeBTreeBlocks() - 1
+	if a := c.inodeAlignment(); a > 0 {
+		extra = align(extra, a)
+	}
+
+	return x + extra
+
+}
+
 func (c *constants) metadataBlocksPerAllocGroup() int64 {
-	return c.superMetaBlocks() + 7 + c.inodeBlocksPerAllocGroup() // + 7 blocks for b+ trees and the free list
+	return c.headerBlocks() + c.inodeBlocksPerAllocGroup()
+}
+
+// inodeBTreeRecordsPerLeaf returns the number of inode chunk records that fit
+// in a leaf of the inode b+ tree.
+func (c *constants) inodeBTreeRecordsPerLeaf() int64 {
+	return (c.blockSize() - 16) / 16 // -16 for header, /16 for record size
+}
+
+// inodeBTreePointersPerNode returns the number of key and pointer pairs that
+// fit in an interior node of the inode b+ tree.
+func (c *constants) inodeBTreePointersPerNode() int64 {
+	return (c.blockSize() - 16) / 8 // -16 for header, /8 for key/pointer pairs
+}
+
+// inodeBTree returns the number of blocks on each level of an alloc group's
+// inode b+ tree, from the leaves up to the root.
+func (c *constants) inodeBTree() []int64 {
+
+	leaves := divide(c.inodesPerAllocGroup()/64, c.inodeBTreeRecordsPerLeaf())
+	if leaves == 0 {
+		leaves = 1
+	}
+
+	levels := []int64{leaves}
+	for x := leaves; x > 1; {
+		x = divide(x, c.inodeBTreePointersPerNode())
+		levels = append(levels, x)
+	}
+
+	return levels
+
+}
+
+// inodeBTreeBlocks returns the total number of blocks in an alloc group's
+// inode b+ tree.
+func (c *constants) inodeBTreeBlocks() int64 {
+
+	var x int64
+	for _, blocks := range c.inodeBTree() {
+		x += blocks
+	}
+
+	return x
+
 }
 
 func (c *constants) partialCalculateSpace() {
@@ -159,6 +294,7 @@ type precompiler struct {
 	args       precompilerArgs
 	tree       vio.FileTree
 	nodeBlocks []uint32 // uint32 gives us a file-size limit of 16 TiB with 4 KiB blocks
+	quotas
 }
 
 func (p *precompiler) setBlockSize(size int64) error {
@@ -190,23 +326,96 @@ func (p *precompiler) setBlockSize(size int64) error {
 	return nil
 }
 
+func (p *precompiler) setInodeSize(size int64) error {
+
+	// an inode can take up at most half a block
+	max := p.blockSize() / 2
+	if max > maxInodeSize {
+		max = maxInodeSize
+	}
+
+	if size == 0 {
+		size = 0x200 // 512 bytes
+		if size > max {
+			size = max
+		}
+	}
+
+	if size < minInodeSize {
+		return fmt.Errorf("minimum inode size is %d", minInodeSize)
+	}
+
+	if size > max {
+		return fmt.Errorf("maximum inode size is %d with %d byte blocks", max, p.blockSize())
+	}
+
+	x, ok := log2(size)
+	if !ok {
+		return errors.New("inode size must be a power of two")
+	}
+
+	p.exponents.inodeSize = x
+	p.inodeDataCapacity = p.inodeSize() - 100
+
+	return nil
+}
+
+func (p *precompiler) setDirectoryBlockSize(size int64) error {
+
+	if size == 0 {
+		p.exponents.directoryBlockSize = 0
+		return nil
+	}
+
+	if size < p.blockSize() {
+		return fmt.Errorf("minimum directory block size is the block size (%d)", p.blockSize())
+	}
+
+	if size > maxDirectoryBlockSize {
+		return fmt.Errorf("maximum directory block size is %d", maxDirectoryBlockSize)
+	}
+
+	x, ok := log2(size)
+	if !ok {
+		return errors.New("directory block size must be a power of two")
+	}
+
+	p.exponents.directoryBlockSize = x - p.exponents.blockSize
+
+	return nil
+}
+
 func (p *precompiler) calculateMinimumSize(ctx context.Context) error {
 
 	var err error
 
 	p.allocGroups = 1
-	p.exponents.blocksPerAllocGroup = 12 // This makes for 16 MiB groups when using 4 KiB blocks. Big enough for a small journal log.
+	p.exponents.blocksPerAllocGroup = 24 - p.exponents.blockSize // 16 MiB groups, the smallest XFS allows. Big enough for a small journal log.
 
 	// scan file tree to calculate space & inode requirements
-	var blocks int64
+	var blocks, quotaBlocks int64
 	var k int
+	var progress elog.Progress
 	treeNodes := p.tree.NodeCount()
 
 	// realtime stuff
 	var root *vio.TreeNode
 	// blocks += 1
 	treeNodes += 2
+
+	err = p.initQuotas()
+	if err != nil {
+		goto fail
+	}
+	treeNodes += len(p.quotaFiles)
+
+	progress = elog.NewProgress(p.log, "Scanning file-system", "", int64(p.tree.NodeCount()))
+	defer progress.Finish(false)
+
 	p.nodeBlocks = make([]uint32, treeNodes)
+	if p.otherQuotas != nil && p.otherQuotas.dtype == DquotTypeProject {
+		p.nodeProjects = make([]uint32, treeNodes)
+	}
 	// p.nodeBlocks[2] = 1
 
 	err = p.tree.WalkNode(func(path string, node *vio.TreeNode) error {
@@ -219,7 +428,7 @@ func (p *precompiler) calculateMinimumSize(ctx context.Context) error {
 			root = node
 			root.Parent = root
 		} else {
-			node.NodeSequenceNumber += 2 // offset for realtime devices
+			node.NodeSequenceNumber += int64(firstQuotaInode-1) + int64(len(p.quotaFiles)) // offset for realtime devices and quota files
 			k = int(node.NodeSequenceNumber)
 		}
 
@@ -233,20 +442,19 @@ func (p *precompiler) calculateMinimumSize(ctx context.Context) error {
 			var ll int64 // length (leaf form)
 			// TODO: var ln int64 // length (node form)
 
-			ls = 6 - 17 // Header + negative for . & .. NOTE: the 6 could be 10 if we ever expect to have a huge number of inodes
-			lb = 24     // Magic number, best free array, and block tail.
-			ll = 16     // Magic number and best free array.
+			// Header + negative for . & .. NOTE: the 6 could be 10 if we ever expect to have a huge number of inodes
+			ls = 6 - p.shortFormEntrySize(".") - p.shortFormEntrySize("..")
+			lb = 24 // Magic number, best free array, and block tail.
+			ll = 16 // Magic number and best free array.
 
 			grow := func(child string) {
-				l := int64(len(child))
-				ls += l + 7 // NOTE: this could be +11 if we ever expect to have a huge number of inodes
-				l = 11 + l
-				l = align(l, 8) // round up to nearest 8
-				lb += l + 8     // +8: leaf entry
+				ls += p.shortFormEntrySize(child) // NOTE: this could be 4 bytes more if we ever expect to have a huge number of inodes
+				l := p.dataEntrySize(child)
+				lb += l + 8 // +8: leaf entry
 
 				// TODO: shuffle entries to optimize used space
 
-				delta := align(ll, p.blockSize()) - ll
+				delta := align(ll, p.directoryBlockSize()) - ll
 				if delta < l || delta-l < 16 {
 					ll += delta + 16
 				}
@@ -271,7 +479,7 @@ func (p *precompiler) calculateMinimumSize(ctx context.Context) error {
 				x = 1
 			} else {
 				// determine how many extents are necessary to store the data
-				next := divide(ll, p.blockSize()) // number of extents for the directory data
+				next := divide(ll, p.directoryBlockSize()) // number of extents for the directory data
 				for {
 					lfll := 16 + 4 + 2*next + (8 * entries) // leaf-form leaf length
 					ddl := ll                               // directory data length
@@ -296,8 +504,11 @@ func (p *precompiler) calculateMinimumSize(ctx context.Context) error {
 						// leafBlocksBytes += leafBlocks * headerSize
 						x += leafBlocks // leaf blocks
 
-						freeIndexBytes := 16 + 2*next
-						freeIndexBlocks := divide(freeIndexBytes, p.directoryBlockSize())
+						if leafBlocks > (p.directoryBlockSize()-16)/8 {
+							return fmt.Errorf("directory '%s' has too many entries for %d byte directory blocks", path, p.directoryBlockSize())
+						}
+
+						freeIndexBlocks := divide(ddb, p.bestsPerFreeIndexBlock())
 						x += freeIndexBlocks // freeindex blocks
 						break
 					}
@@ -305,6 +516,8 @@ func (p *precompiler) calculateMinimumSize(ctx context.Context) error {
 					break
 				}
 			}
+
+			x = p.directoryBlocks(x)
 		} else if f.IsSymlink() {
 			x = int64(f.Size())
 			if f.SymlinkIsCached() && x < p.inodeDataCapacity {
@@ -323,14 +536,35 @@ func (p *precompiler) calculateMinimumSize(ctx context.Context) error {
 		p.nodeBlocks[k] = uint32(x)
 		blocks += x
 
+		p.accountQuotas(int64(k), pathpkg.Clean("/"+path), node, x)
+		progress.Increment(1)
+
 		return nil
 	})
 	if err != nil {
 		goto fail
 	}
+	progress.Finish(true)
+
+	quotaBlocks, err = p.finishQuotas()
+	if err != nil {
+		goto fail
+	}
+	blocks += quotaBlocks
 
 	p.treeBlocks = blocks
-	p.journalBlocks = 1368 // no idea why, but this seems to be the smallest number the reference implementation uses
+	p.journalBlocks = 1368 // no idea why, but this seems to be the smallest number the reference implementation uses with 4 KiB blocks
+
+	// Directory operations reserve journal space for whole directory blocks,
+	// so the journal keeps its size in bytes and grows with directory blocks.
+	p.journalBlocks = p.directoryBlocks(divide(p.journalBlocks*0x1000, p.blockSize()))
+	if p.journalBlocks < minJournalBlocks {
+		p.journalBlocks = minJournalBlocks
+	}
+
+	for p.blocksPerAllocGroup() < 2*p.journalBlocks {
+		p.exponents.blocksPerAllocGroup++
+	}
 
 	k = -1
 
@@ -389,6 +623,9 @@ func (p *precompiler) calculateMinimumSize(ctx context.Context) error {
 			if x := p.freeBlocks - minFreeBlocks; x < growth {
 				growth = x
 			}
+			if x := p.inodeAlignment(); x > 0 {
+				growth -= growth % x
+			}
 			if growth > 0 {
 				p.journalBlocks += growth
 				continue
@@ -426,11 +663,19 @@ func newBuild(ctx context.Context, args *precompilerArgs) (*precompiler, error)
 		tree: args.Contents,
 	}
 	p.exponents.sectorSize = 9 // 512 bytes
-	p.exponents.inodeSize = 9  // 512 bytes
-	p.inodeDataCapacity = p.inodeSize() - 100
-	p.exponents.directoryBlockSize = 0
+	p.fileTypes = args.Options.FileTypes
 
-	err = p.setBlockSize(0x1000) // 4 KiB
+	err = p.setBlockSize(args.Options.BlockSize)
+	if err != nil {
+		goto fail
+	}
+
+	err = p.setInodeSize(args.Options.InodeSize)
+	if err != nil {
+		goto fail
+	}
+
+	err = p.setDirectoryBlockSize(args.Options.DirectoryBlockSize)
 	if err != nil {
 		goto fail
 	}
@@ -481,6 +726,8 @@ type compiler struct {
 	allocGroupFreeInodes []int64
 
 	countedNodeBlocks int64
+
+	quotas
 }
 
 func (p *precompiler) Precompile(ctx context.Context, fsSize int64) (*compiler, error) {
@@ -495,6 +742,7 @@ func (p *precompiler) Precompile(ctx context.Context, fsSize int64) (*compiler,
 		nodeBlocks:         p.nodeBlocks,
 		nodeExtents:        make([][]*extent, len(p.nodeBlocks)),
 		lastCalculatedNode: -1,
+		quotas:             p.quotas,
 	}
 
 	if fsSize%p.blockSize() != 0 {
@@ -565,8 +813,8 @@ func (c *compiler) precompile(ctx context.Context) error {
 			}
 
 			// NOTE: this prevents the inodes section from becoming misaligned
-			if growth%2 > 0 {
-				growth--
+			if x := c.inodeAlignment(); x > 0 {
+				growth -= growth % x
 			}
 
 			if growth > 0 {
@@ -721,37 +969,109 @@ cancel:
 
 func (c *compiler) writeAllocGroups(ctx context.Context, w io.WriteSeeker) error {
 	var err error
+
+	var inodes, blocks int64
 	for ag := int64(0); ag < c.allocGroups; ag++ {
-		err = c.writeAllocGroup(ctx, w, ag)
+		inodes += c.usedInodesInAllocGroup(ag)
+	}
+	for _, x := range c.nodeBlocks {
+		blocks += int64(x)
+	}
+
+	inodeProgress := elog.NewProgress(c.log, "Writing inodes", "", inodes)
+	defer inodeProgress.Finish(false)
+	dataProgress := elog.NewProgress(c.log, "Writing file data", "KiB", blocks*c.blockSize())
+	defer dataProgress.Finish(false)
+
+	workers := c.args.Options.Workers
+	if workers == 0 {
+		workers = DefaultWorkers
+	}
+
+	wa, ok := vio.WriterAt(w)
+	if ok && workers > 1 && c.allocGroups > 1 {
+		err = c.writeAllocGroupsConcurrently(ctx, w, wa, workers, inodeProgress, dataProgress)
 		if err != nil {
 			return err
 		}
+	} else {
+		for ag := int64(0); ag < c.allocGroups; ag++ {
+			err = c.writeAllocGroup(ctx, w, ag, inodeProgress, dataProgress)
+			if err != nil {
+				return err
+			}
+		}
 	}
+
+	inodeProgress.Finish(true)
+	dataProgress.Finish(true)
 	return nil
 }
 
-func (c *compiler) writeAllocGroup(ctx context.Context, w io.WriteSeeker, ag int64) error {
-	var err error
+// writeAllocGroup writes everything in an alloc group, in order.
+func (c *compiler) writeAllocGroup(ctx context.Context, w io.WriteSeeker, ag int64, inodeProgress, dataProgress elog.Progress) error {
 
-	allocGroupOffset := ag * c.blocksPerAllocGroup() * c.blockSize()
-	_, err = w.Seek(allocGroupOffset, io.SeekStart)
+	err := c.writeAllocGroupMetaData(w, ag)
 	if err != nil {
 		return err
 	}
 
-	uuid, err := generateUID()
+	err = c.writeInodes(w, ag, 0, c.inodesPerAllocGroup(), inodeProgress)
+	if err != nil {
+		return err
+	}
+
+	if err = ctx.Err(); err != nil {
+		return err
+	}
+
+	return c.writeAllocGroupData(ctx, w, ag, dataProgress)
+}
+
+// allocGroupLength returns the number of blocks in an alloc group, which is
+// only fewer than the rest for the last.
+func (c *compiler) allocGroupLength(ag int64) int64 {
+	if ag == c.allocGroups-1 && c.totalBlocks%c.blocksPerAllocGroup() != 0 {
+		return c.totalBlocks % c.blocksPerAllocGroup()
+	}
+	return c.blocksPerAllocGroup()
+}
+
+// usedInodesInAllocGroup returns the number of inodes in an alloc group that
+// are taken by the file tree, which come before its free inodes.
+func (c *compiler) usedInodesInAllocGroup(ag int64) int64 {
+	return c.inodesPerAllocGroup() - c.allocGroupFreeInodes[ag]
+}
+
+// writeAllocGroupMetaData writes the headers and b+ trees of an alloc group,
+// and the journal if it is the first. None of it depends on the contents of
+// the file tree.
+func (c *compiler) writeAllocGroupMetaData(w io.WriteSeeker, ag int64) error {
+	var err error
+
+	allocGroupOffset := ag * c.blocksPerAllocGroup() * c.blockSize()
+	_, err = w.Seek(allocGroupOffset, io.SeekStart)
 	if err != nil {
 		return err
 	}
 
 	// superblock
+	moreFeatures := uint32(Version2LazySBCountBit)
+	if c.fileTypes {
+		moreFeatures |= Version2Ftype
+	}
+	for _, q := range c.args.Options.Quotas {
+		if q.Type == ProjectQuota && q.ID > 0xFFFF {
+			moreFeatures |= Version2ProjID32Bit
+		}
+	}
+
 	sb := &SuperBlock{
 		MagicNumber: SBMagicNumber,
 		BlockSize:   uint32(c.blockSize()),
 		DataBlocks:  uint64(c.totalBlocks),
-		// UUID:                       [16]byte{0x65, 0x7b, 0x9b, 0x73, 0xfe, 0xa4, 0x44, 0x3e, 0x98, 0x51, 0x6b, 0x01, 0x55, 0x7f, 0xea, 0xab}, // should this be generated?
-		UUID:                       uuid,
-		LogStart:                   uint64(c.superMetaBlocks() + 7), // first non-metadata thing on the first alloc group
+		UUID:                       c.args.Options.UUID,
+		LogStart:                   uint64(c.headerBlocks()), // first non-metadata thing on the first alloc group
 		RootInode:                  c.translateAbsoluteInodeNumber(0),
 		RealtimeBitmapInode:        c.translateAbsoluteInodeNumber(1),
 		RealtimeSummaryInode:       c.translateAbsoluteInodeNumber(2),
@@ -759,11 +1079,10 @@ func (c *compiler) writeAllocGroup(ctx context.Context, w io.WriteSeeker, ag int
 		AGBlocks:                   uint32(c.blocksPerAllocGroup()),
 		AGCount:                    uint32(c.allocGroups),
 		LogBlocks:                  uint32(c.journalBlocks),
-		VersionNum:                 VersionNumber | VersionAlignBit | VersionNlinkBit | VersionLogV2Bit | VersionExtFlgBit | VersionDirV2Bit | VersionMoreBitsBit,
+		VersionNum:                 VersionNumber | VersionNlinkBit | VersionLogV2Bit | VersionExtFlgBit | VersionDirV2Bit | VersionMoreBitsBit,
 		SectorSize:                 SectorSize,
 		InodeSize:                  uint16(c.inodeSize()),
 		InodesPerBlock:             uint16(c.inodesPerBlock()),
-		FSName:                     [12]byte{'x', 'f', 's', 0, 0, 0, 0, 0, 0, 0, 0, 0}, // should this be configurable?
 		BlockSizeLogarithmic:       uint8(c.exponents.blockSize),
 		SectorSizeLogarithmic:      sectorSizeLog,
 		InodeSizeLogarithmic:       c.exponents.inodeSize,
@@ -773,17 +1092,40 @@ func (c *compiler) writeAllocGroup(ctx context.Context, w io.WriteSeeker, ag int
 		InodesAllocated:            uint64(c.allocGroups * c.inodesPerAllocGroup()),
 		InodesFree:                 uint64(c.freeInodes),
 		DataFree:                   uint64(c.freeBlocks + 4*c.allocGroups), // NOTE: +4/ag is for the reserved free-list blocks, I think.
-		DirectoryBlocksLogarithmic: dirBlockAllocLog,
+		DirectoryBlocksLogarithmic: c.exponents.directoryBlockSize,
 		LogSectorSizeLogarithmic:   0,
 		LogSectorSize:              0,
-		MoreFeatures:               Version2LazySBCountBit,
-		BadFeatures:                Version2LazySBCountBit,
+		MoreFeatures:               moreFeatures,
+		BadFeatures:                moreFeatures,
 		// UserQuotasInode:            0xffffffff,
 		// GroupQuotasInode:           0xffffffff,
-		InodeChunkAlignment: 2,
+		InodeChunkAlignment: uint32(c.inodeAlignment()),
 		LogStripeUnit:       1,
 	}
 
+	if sb.InodeChunkAlignment != 0 {
+		sb.VersionNum |= VersionAlignBit
+	}
+
+	if c.quotaFiles != nil {
+		sb.VersionNum |= VersionQuotaBit
+		sb.QuotaFlags = c.quotaFlags()
+		ino := int64(firstQuotaInode)
+		if c.userQuotas != nil {
+			sb.UserQuotasInode = c.translateAbsoluteInodeNumber(ino)
+			ino++
+		}
+		if c.otherQuotas != nil {
+			sb.GroupQuotasInode = c.translateAbsoluteInodeNumber(ino)
+		}
+	}
+
+	label := c.args.Options.Label
+	if label == "" {
+		label = "xfs"
+	}
+	copy(sb.FSName[:], label)
+
 	err = binary.Write(w, binary.BigEndian, sb)
 	if err != nil {
 		return err
@@ -829,18 +1171,7 @@ func (c *compiler) writeAllocGroup(ctx context.Context, w io.WriteSeeker, ag int
 		return err
 	}
 
-	inodeChunks := c.inodesPerAllocGroup() / 64
-	chunksPerLeaf := (c.blockSize() - 16) / 16 // -16 for header, /16 for record size
-	leavesPerNode := (c.blockSize() - 16) / 8  // -16 for header, /8 for key/pointer pairs
-	leavesNeeded := inodeChunks / chunksPerLeaf
-	level := uint32(1)
-	if leavesNeeded > 1 {
-		level++
-		if leavesNeeded > leavesPerNode {
-			return errors.New("deep b+ trees unimplemented") // this will trigger if we try to have more than 8323200 inodes per alloc group
-		}
-		return errors.New("deep b+ trees unimplemented") // this will trigger if we try to have more than 16320 inodes per alloc group
-	}
+	levels := c.inodeBTree()
 
 	agi := &AGI{
 		Magic:     AGIMagicNumber,
@@ -849,7 +1180,7 @@ func (c *compiler) writeAllocGroup(ctx context.Context, w io.WriteSeeker, ag int
 		Length:    uint32(c.blocksPerAllocGroup()),
 		Count:     uint32(c.inodesPerAllocGroup()), // TODO: - c.allocGroupFreeInodes[ag]), -- is it meant to be this way?
 		Root:      uint32(c.superMetaBlocks()),
-		Level:     level,
+		Level:     uint32(len(levels)),
 		FreeCount: uint32(c.allocGroupFreeInodes[ag]),
 		NewIno:    uint32(c.translateRelativeInodeNumber(ag * c.inodesPerAllocGroup())),
 		DirIno:    uint32(0xFFFFFFFF), // NOTE: according to the spec this is NULL (-1)
@@ -884,43 +1215,11 @@ func (c *compiler) writeAllocGroup(ctx context.Context, w io.WriteSeeker, ag int
 	err = binary.Write(w, binary.BigEndian, bytes.Repeat([]byte{0xFF}, int(c.sectorSize()-16)))
 
 	// write inode b+ tree
-	ibt := &BTreeSBlock{
-		Magic:    IBTMagicNumber,
-		Level:    0,
-		NumRecs:  uint16(inodeChunks),
-		LeftSIB:  0xFFFFFFFF,
-		RightSIB: 0xFFFFFFFF,
-	}
-
-	_, err = w.Seek(allocGroupOffset+int64(agi.Root)*c.blockSize(), io.SeekStart)
-	if err != nil {
-		return err
-	}
-
-	err = binary.Write(w, binary.BigEndian, ibt)
+	err = c.writeInodeBTree(w, ag, allocGroupOffset, agi.Root)
 	if err != nil {
 		return err
 	}
 
-	for i := int64(0); i < inodeChunks; i++ {
-		var used int64
-		used = c.usedInodes - (ag*c.inodesPerAllocGroup() + i*64)
-		if used < 0 {
-			used = 0
-		} else if used > 64 {
-			used = 64
-		}
-		rec := &InodeBTRecord{
-			StartIno:  uint32(c.translateRelativeInodeNumber(i*64 + ag*c.inodesPerAllocGroup())),
-			FreeCount: uint32(64 - used),
-			Free:      0xFFFFFFFFFFFFFFFF << used,
-		}
-		err = binary.Write(w, binary.BigEndian, rec)
-		if err != nil {
-			return err
-		}
-	}
-
 	// write free space b+ trees
 	abtb := &BTreeSBlock{
 		Magic:    ABTBMagicNumber,
@@ -988,7 +1287,6 @@ func (c *compiler) writeAllocGroup(ctx context.Context, w io.WriteSeeker, ag int
 	// NOTE: free list should be completely empty for us so we can ignore it
 
 	// journal
-	remainder := int64(agf.Length) - c.metadataBlocksPerAllocGroup() // this is how many blocks we have left for copying data
 	if ag == 0 {
 		_, err = w.Seek(int64(sb.LogStart)*c.blockSize(), io.SeekStart)
 		if err != nil {
@@ -1028,12 +1326,20 @@ func (c *compiler) writeAllocGroup(ctx context.Context, w io.WriteSeeker, ag int
 		if err != nil {
 			return err
 		}
-
-		remainder -= c.journalBlocks
 	}
 
-	// inodes
-	for ino := int64(0); ino < c.inodesPerAllocGroup(); ino++ {
+	return nil
+}
+
+// writeInodes writes the inodes of an alloc group from first up to last. The
+// inodes of the file tree have to be written in order, before any of the file
+// data, but the free inodes after them can be written at any time.
+func (c *compiler) writeInodes(w io.WriteSeeker, ag, first, last int64, progress elog.Progress) error {
+	var err error
+
+	allocGroupOffset := ag * c.blocksPerAllocGroup() * c.blockSize()
+
+	for ino := first; ino < last; ino++ {
 
 		inodeNumber := c.translateRelativeInodeNumber(ino + c.inodesPerAllocGroup()*ag)
 
@@ -1042,7 +1348,7 @@ func (c *compiler) writeAllocGroup(ctx context.Context, w io.WriteSeeker, ag int
 			return err
 		}
 
-		if ino < c.inodesPerAllocGroup()-c.allocGroupFreeInodes[ag] {
+		if ino < c.usedInodesInAllocGroup(ag) {
 			rdr := c.popInode()
 			if rdr == nil {
 				return c.nodesError
@@ -1052,6 +1358,7 @@ func (c *compiler) writeAllocGroup(ctx context.Context, w io.WriteSeeker, ag int
 			if err != nil && err != io.EOF {
 				return err
 			}
+			progress.Increment(1)
 		} else {
 			err = binary.Write(w, binary.BigEndian, &InodeCore{
 				Magic:        InodeMagicNumber,
@@ -1065,11 +1372,24 @@ func (c *compiler) writeAllocGroup(ctx context.Context, w io.WriteSeeker, ag int
 		}
 	}
 
-	if err = ctx.Err(); err != nil {
-		return err
+	return nil
+}
+
+// writeAllocGroupData writes the data & metadata blocks of the file tree that
+// belong in an alloc group, which have to be written in order.
+func (c *compiler) writeAllocGroupData(ctx context.Context, w io.WriteSeeker, ag int64, progress elog.Progress) error {
+	var err error
+
+	allocGroupOffset := ag * c.blocksPerAllocGroup() * c.blockSize()
+	length := c.allocGroupLength(ag)
+	freeBlocks := c.allocGroupFreeBlocks[ag]
+
+	remainder := length - c.metadataBlocksPerAllocGroup() // this is how many blocks we have left for copying data
+	if ag == 0 {
+		remainder -= c.journalBlocks
 	}
 
-	_, err = w.Seek(allocGroupOffset+(int64(agf.Length)-remainder)*c.blockSize(), io.SeekStart)
+	_, err = w.Seek(allocGroupOffset+(length-remainder)*c.blockSize(), io.SeekStart)
 	if err != nil {
 		return err
 	}
@@ -1085,11 +1405,12 @@ func (c *compiler) writeAllocGroup(ctx context.Context, w io.WriteSeeker, ag int
 		if err != nil && err != io.EOF {
 			return err
 		}
+		progress.Increment(c.blockSize())
 		remainder--
 	}
 
 	if remainder != 0 { // force a write to the end of the alloc group just in case that matters
-		_, err = w.Seek(allocGroupOffset+int64(agf.Length)*c.blockSize()-1, io.SeekStart)
+		_, err = w.Seek(allocGroupOffset+length*c.blockSize()-1, io.SeekStart)
 		if err != nil {
 			return err
 		}
@@ -1102,6 +1423,140 @@ func (c *compiler) writeAllocGroup(ctx context.Context, w io.WriteSeeker, ag int
 	return nil
 }
 
+// writeInodeBTree writes the inode b+ tree of an alloc group. The root is at
+// block root and any other blocks follow the free list, level by level from
+// the leaves up. Records are spread evenly across each level.
+func (c *compiler) writeInodeBTree(w io.WriteSeeker, ag, allocGroupOffset int64, root uint32) error {
+
+	levels := c.inodeBTree()
+	chunks := c.inodesPerAllocGroup() / 64
+
+	// first[l][i] is the first chunk under the i-th block on level l, with an
+	// extra entry at the end of each level for the chunk after the last one
+	first := make([][]int64, len(levels))
+	first[0] = make([]int64, levels[0]+1)
+	for i := int64(0); i <= levels[0]; i++ {
+		first[0][i] = i * chunks / levels[0]
+	}
+
+	for l := 1; l < len(levels); l++ {
+		first[l] = make([]int64, levels[l]+1)
+		for i := int64(0); i <= levels[l]; i++ {
+			first[l][i] = first[l-1][i*levels[l-1]/levels[l]]
+		}
+	}
+
+	// children[l][i] is the index of the first block on level l-1 under the
+	// i-th block on level l
+	children := func(l int, i int64) int64 {
+		return i * levels[l-1] / levels[l]
+	}
+
+	base := c.superMetaBlocks() + 7
+	addrs := make([]int64, len(levels))
+	for l := range levels {
+		addrs[l] = base
+		base += levels[l]
+	}
+
+	addr := func(l int, i int64) uint32 {
+		if l == len(levels)-1 {
+			return root
+		}
+		return uint32(addrs[l] + i)
+	}
+
+	startIno := func(chunk int64) uint32 {
+		return uint32(c.translateRelativeInodeNumber(chunk*64 + ag*c.inodesPerAllocGroup()))
+	}
+
+	for l := range levels {
+		for i := int64(0); i < levels[l]; i++ {
+
+			buf := new(bytes.Buffer)
+
+			hdr := &BTreeSBlock{
+				Magic:    IBTMagicNumber,
+				Level:    uint16(l),
+				LeftSIB:  0xFFFFFFFF,
+				RightSIB: 0xFFFFFFFF,
+			}
+
+			if i > 0 {
+				hdr.LeftSIB = addr(l, i-1)
+			}
+
+			if i < levels[l]-1 {
+				hdr.RightSIB = addr(l, i+1)
+			}
+
+			if l == 0 {
+				hdr.NumRecs = uint16(first[0][i+1] - first[0][i])
+			} else {
+				hdr.NumRecs = uint16(children(l, i+1) - children(l, i))
+			}
+
+			err := binary.Write(buf, binary.BigEndian, hdr)
+			if err != nil {
+				return err
+			}
+
+			if l == 0 {
+				for chunk := first[0][i]; chunk < first[0][i+1]; chunk++ {
+					var used int64
+					used = c.usedInodes - (ag*c.inodesPerAllocGroup() + chunk*64)
+					if used < 0 {
+						used = 0
+					} else if used > 64 {
+						used = 64
+					}
+					rec := &InodeBTRecord{
+						StartIno:  startIno(chunk),
+						FreeCount: uint32(64 - used),
+						Free:      0xFFFFFFFFFFFFFFFF << used,
+					}
+					err = binary.Write(buf, binary.BigEndian, rec)
+					if err != nil {
+						return err
+					}
+				}
+			} else {
+				// keys and pointers are each packed into their own half of
+				// the block, so the pointers begin after the last possible key
+				keys := make([]uint32, c.inodeBTreePointersPerNode())
+				ptrs := make([]uint32, c.inodeBTreePointersPerNode())
+				for j := children(l, i); j < children(l, i+1); j++ {
+					k := j - children(l, i)
+					keys[k] = startIno(first[l-1][j])
+					ptrs[k] = addr(l-1, j)
+				}
+				err = binary.Write(buf, binary.BigEndian, keys)
+				if err != nil {
+					return err
+				}
+				err = binary.Write(buf, binary.BigEndian, ptrs)
+				if err != nil {
+					return err
+				}
+			}
+
+			_, err = w.Seek(allocGroupOffset+int64(addr(l, i))*c.blockSize(), io.SeekStart)
+			if err != nil {
+				return err
+			}
+
+			_, err = io.Copy(w, buf)
+			if err != nil {
+				return err
+			}
+
+		}
+	}
+
+	return nil
+
+}
+
 func (c *compiler) inodeNumberFromNode(n *vio.TreeNode) uint64 {
 	return c.translateAbsoluteInodeNumber(n.NodeSequenceNumber)
 }
@@ -1127,7 +1582,10 @@ func (c *compiler) popDataBlock() io.Reader {
 			continue
 		}
 
-		if n.File.IsDir() {
+		if q := c.quotaFile(n.NodeSequenceNumber); q != nil {
+			_ = c.computeNodeExtents(n.NodeSequenceNumber, q.ranges()...) // called here to ensure things are computed in order
+			c.dataReader = q.reader(c.blockSize())
+		} else if n.File.IsDir() {
 			c.dataReader = c.generateDirectoryBlockData(n, c.dataReaderBlocksRemaining)
 		} else if n.File.IsSymlink() {
 			// TODO: does this work?
@@ -1256,6 +1714,32 @@ func (c *compiler) computeNodeExtentsDryrun(ino int64, fragments ...int64) []*ex
 	return e
 }
 
+// specialInodeMode returns the inode type of a device node or named pipe.
+func specialInodeMode(f vio.File) uint16 {
+
+	switch fileType(f) {
+	case FTypeFIFO:
+		return 0x1000
+	case FTypeCharSpecial:
+		return 0x2000
+	default:
+		return 0x6000
+	}
+
+}
+
+// fileOwner returns the owner of f, which is user and group 1000 unless it
+// has its own.
+func fileOwner(f vio.File) (uint32, uint32) {
+
+	if o := f.Ownership(); o != nil {
+		return o.UID, o.GID
+	}
+
+	return 1000, 1000
+
+}
+
 func (c *compiler) popInode() io.Reader {
 
 	n, more := <-c.nodes
@@ -1273,7 +1757,11 @@ func (c *compiler) popInode() io.Reader {
 	nblocks = uint64(c.nodeBlocks[n.NodeSequenceNumber])
 	var data []byte
 
-	if n.File.IsDir() {
+	if q := c.quotaFile(n.NodeSequenceNumber); q != nil {
+		mode = 0x8000
+		format = InodeFormatExtents
+		extents = c.computeNodeExtents(n.NodeSequenceNumber, q.ranges()...)
+	} else if n.File.IsDir() {
 		mode = 0x4000 | 0700
 		format = InodeFormatLocal
 		if nblocks > 0 {
@@ -1288,6 +1776,9 @@ func (c *compiler) popInode() io.Reader {
 			format = InodeFormatExtents
 		}
 		size = int64(n.File.Size())
+	} else if n.File.Special() != 0 {
+		mode = specialInodeMode(n.File) | 0700
+		format = InodeFormatDev
 	} else { // regular file
 		mode = 0x8000 | 0700
 		format = InodeFormatExtents
@@ -1299,21 +1790,35 @@ func (c *compiler) popInode() io.Reader {
 
 	nextents = int32(len(extents))
 
+	uid, gid := fileOwner(n.File)
+	if o := n.File.Ownership(); o != nil {
+		mode = mode&0xF000 | uint16(o.Mode&vio.ModeMask)
+	}
+
+	var flags uint16
+	project := c.project(n.NodeSequenceNumber)
+	if project != 0 && n.File.IsDir() {
+		flags |= InodeFlagProjInherit
+	}
+
 	core := &InodeCore{
 		Magic:   InodeMagicNumber,
 		Mode:    mode,
 		Version: 2,
 		Format:  format,
 		// Onlink:  uint16(n.Links),
-		UID:     1000,
-		GID:     1000,
+		UID:     uid,
+		GID:     gid,
 		Nlink:   uint32(n.Links),
 		Size:    size,
 		NBlocks: nblocks,
 		// ExtSize TODO: is this necessary?
 		NExtents:     nextents,
 		AFormat:      InodeFormatExtents,
+		Flags:        flags,
 		NextUnlinked: 0xFFFFFFFF,
+		ProjIDLow:    uint16(project),
+		ProjIDHigh:   uint16(project >> 16),
 	}
 
 	buf := new(bytes.Buffer)
@@ -1378,6 +1883,12 @@ func (c *compiler) popInode() io.Reader {
 		} else {
 			panic(errors.New("attempted to write local-format inode for an unsupported file-type"))
 		}
+	} else if format == InodeFormatDev {
+		major, minor := n.File.Device()
+		err = binary.Write(buf, binary.BigEndian, major<<18|minor&0x3FFFF)
+		if err != nil {
+			panic(err)
+		}
 	} else {
 		panic(errors.New("attempted to write an unsupported inode format"))
 	}
@@ -1408,6 +1919,20 @@ func (c *compiler) treeWalkers() {
 		Links:              1,
 	}
 
+	// quota files
+	var quotaNodes []*vio.TreeNode
+	for i := range c.quotaFiles {
+		quotaNodes = append(quotaNodes, &vio.TreeNode{
+			File: vio.CustomFile(vio.CustomFileArgs{
+				Size:       0,
+				Ownership:  &vio.Ownership{}, // root
+				ReadCloser: ioutil.NopCloser(bytes.NewReader([]byte{})),
+			}),
+			NodeSequenceNumber: int64(firstQuotaInode + i),
+			Links:              1,
+		})
+	}
+
 	// one walker for data blocks
 	go func() {
 		var previous *vio.TreeNode
@@ -1421,10 +1946,13 @@ func (c *compiler) treeWalkers() {
 			}
 			previous = n
 
-			// insert realtime nodes
+			// insert realtime and quota nodes
 			if path == "." {
 				c.data <- rtbmap
 				c.data <- rtsummary
+				for _, q := range quotaNodes {
+					c.data <- q
+				}
 			}
 
 			return nil
@@ -1437,10 +1965,13 @@ func (c *compiler) treeWalkers() {
 		c.nodesError = c.tree.WalkNode(func(path string, n *vio.TreeNode) error {
 			c.nodes <- n
 
-			// insert realtime inodes
+			// insert realtime and quota inodes
 			if path == "." {
 				c.nodes <- rtbmap
 				c.nodes <- rtsummary
+				for _, q := range quotaNodes {
+					c.nodes <- q
+				}
 			}
 
 			return nil
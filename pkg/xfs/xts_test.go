@@ -2,10 +2,17 @@ package xfs
 
 import (
 	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"os"
+	"path"
+	"strings"
 	"testing"
 
+	"github.com/vorteil/vorteil/pkg/elog"
 	"github.com/vorteil/vorteil/pkg/vio"
 )
 
@@ -48,7 +55,7 @@ func TestEmptyShortformDirectoryData(t *testing.T) {
 	}
 
 	// empty directory
-	got := generateShortFormDirectoryData(c, n)
+	got := generateShortFormDirectoryData(c, n, false)
 
 	if !bytes.Equal(expect, got) {
 		t.Errorf("expected %v, got %v", expect, got)
@@ -112,7 +119,7 @@ func TestBasicShortformDirectoryData(t *testing.T) {
 	}
 
 	// empty directory
-	got := generateShortFormDirectoryData(c, n)
+	got := generateShortFormDirectoryData(c, n, false)
 
 	if !bytes.Equal(expect, got) {
 		t.Errorf("expected %v, got %v", expect, got)
@@ -122,6 +129,66 @@ func TestBasicShortformDirectoryData(t *testing.T) {
 // TODO: short-form directory data that overflows
 // TODO: short-form directory data using high address range inodes (64 bit)
 
+func TestShortformDentryFileType(t *testing.T) {
+
+	got, delta := generateShortFormDentry("ab", FTypeSymlink, 99, 48, false)
+	expect := []byte{2, 0, 48, 'a', 'b', 0, 0, 0, 99}
+	if !bytes.Equal(expect, got) {
+		t.Errorf("expected %v, got %v", expect, got)
+	}
+
+	if delta != 16 {
+		t.Errorf("expected delta 16, got %d", delta)
+	}
+
+	got, _ = generateShortFormDentry("ab", FTypeSymlink, 99, 48, true)
+	expect = []byte{2, 0, 48, 'a', 'b', FTypeSymlink, 0, 0, 0, 99}
+	if !bytes.Equal(expect, got) {
+		t.Errorf("expected %v, got %v", expect, got)
+	}
+
+}
+
+func TestDentryFileType(t *testing.T) {
+
+	d := &dentry{
+		Inode: 99,
+		Name:  "abcde",
+		FType: FTypeDirectory,
+	}
+
+	for _, fileTypes := range []bool{false, true} {
+
+		c := &constants{fileTypes: fileTypes}
+		buf := new(bytes.Buffer)
+
+		l := addDentry(buf, 64, d, fileTypes)
+		if l != c.dataEntrySize(d.Name) || int64(buf.Len()) != l {
+			t.Errorf("ftype %v: dentry size %d and %d bytes written, but expected %d", fileTypes, l, buf.Len(), c.dataEntrySize(d.Name))
+		}
+
+		data := buf.Bytes()
+		if data[8] != 5 || string(data[9:14]) != "abcde" {
+			t.Errorf("ftype %v: dentry has the wrong name: %v", fileTypes, data)
+		}
+
+		if fileTypes && data[14] != FTypeDirectory {
+			t.Errorf("ftype %v: dentry has the wrong file type: %d", fileTypes, data[14])
+		}
+
+		if data[len(data)-1] != 64 {
+			t.Errorf("ftype %v: dentry has the wrong tag: %v", fileTypes, data)
+		}
+
+	}
+
+	// the file type pushes a 5 byte name into another 8 bytes
+	if (&constants{}).dataEntrySize("abcde") != 16 || (&constants{fileTypes: true}).dataEntrySize("abcde") != 24 {
+		t.Errorf("dataEntrySize doesn't account for the file type")
+	}
+
+}
+
 func TestHashName(t *testing.T) {
 
 	expect := uint32(0)
@@ -359,3 +426,694 @@ func TestConstants(t *testing.T) {
 	}
 
 }
+
+func TestSetInodeSize(t *testing.T) {
+	p := new(precompiler)
+	p.exponents.sectorSize = 9
+	p.pageSize = 0x10000
+
+	err := p.setBlockSize(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = p.setInodeSize(0)
+	if err != nil {
+		t.Error(err)
+	}
+
+	expect := int64(512)
+	got := p.inodeSize()
+	if expect != got {
+		t.Errorf("expected default inode size to be %v, got %v", expect, got)
+	}
+
+	err = p.setInodeSize(2048)
+	if err != nil {
+		t.Error(err)
+	}
+
+	expect = 2048 - 100
+	got = p.inodeDataCapacity
+	if expect != got {
+		t.Errorf("expected inode data capacity to be %v, got %v", expect, got)
+	}
+
+	for _, size := range []int64{128, 384, 4096} {
+		err = p.setInodeSize(size)
+		if err == nil {
+			t.Errorf("expected to get a failure for allowing inode size %v", size)
+		}
+	}
+
+	p.exponents.blockSize = 0
+	err = p.setBlockSize(512)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = p.setInodeSize(0)
+	if err != nil {
+		t.Error(err)
+	}
+
+	expect = 256
+	got = p.inodeSize()
+	if expect != got {
+		t.Errorf("expected default inode size with small blocks to be %v, got %v", expect, got)
+	}
+
+	err = p.setInodeSize(512)
+	if err == nil {
+		t.Errorf("expected to get a failure for allowing inode size larger than half a block")
+	}
+}
+
+func TestSetDirectoryBlockSize(t *testing.T) {
+	p := new(precompiler)
+	p.exponents.sectorSize = 9
+	p.pageSize = 0x10000
+
+	err := p.setBlockSize(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = p.setDirectoryBlockSize(0)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if p.directoryBlockSize() != p.blockSize() {
+		t.Errorf("expected default directory block size to be %v, got %v", p.blockSize(), p.directoryBlockSize())
+	}
+
+	err = p.setDirectoryBlockSize(0x4000)
+	if err != nil {
+		t.Error(err)
+	}
+
+	expect := int64(0x4000)
+	got := p.directoryBlockSize()
+	if expect != got {
+		t.Errorf("expected %v, got %v", expect, got)
+	}
+
+	expect = 8
+	got = p.directoryBlocks(2)
+	if expect != got {
+		t.Errorf("expected %v, got %v", expect, got)
+	}
+
+	for _, size := range []int64{0x800, 0x3000, 0x20000} {
+		err = p.setDirectoryBlockSize(size)
+		if err == nil {
+			t.Errorf("expected to get a failure for allowing directory block size %v", size)
+		}
+	}
+}
+
+func TestCompileBlockSizes(t *testing.T) {
+
+	for _, args := range []CompilerArgs{
+		{},
+		{BlockSize: 0x200},
+		{BlockSize: 0x400, InodeSize: 0x100},
+		{BlockSize: 0x800, DirectoryBlockSize: 0x2000},
+		{InodeSize: 0x800, DirectoryBlockSize: 0x10000},
+	} {
+
+		tree := vio.NewFileTree()
+
+		// enough entries for a node form directory with any of these sizes
+		for i := 0; i < 2000; i++ {
+			name := fmt.Sprintf("dir/a-long-file-name-to-fill-directory-blocks-%04d", i)
+			err := tree.Map(name, vio.CustomFile(vio.CustomFileArgs{
+				Name:       path.Base(name),
+				Size:       4,
+				ReadCloser: ioutil.NopCloser(strings.NewReader("data")),
+			}))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		args.FileTree = tree
+		args.Logger = &elog.CLI{}
+		c := NewCompiler(&args)
+
+		ctx := context.Background()
+		err := c.Commit(ctx)
+		if err != nil {
+			t.Fatalf("%+v: %v", args, err)
+		}
+
+		size := c.MinimumSize()
+		err = c.Precompile(ctx, size)
+		if err != nil {
+			t.Fatalf("%+v: %v", args, err)
+		}
+
+		f, err := ioutil.TempFile("", "xfs")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(f.Name())
+		defer f.Close()
+
+		err = c.Compile(ctx, f)
+		if err != nil {
+			t.Fatalf("%+v: %v", args, err)
+		}
+
+		_, err = f.Seek(0, io.SeekStart)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sb := new(SuperBlock)
+		err = binary.Read(f, binary.BigEndian, sb)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		p := c.precompiler
+		if int64(sb.BlockSize) != p.blockSize() || int64(sb.InodeSize) != p.inodeSize() {
+			t.Errorf("%+v: superblock has %d byte blocks and %d byte inodes", args, sb.BlockSize, sb.InodeSize)
+		}
+
+		if args.BlockSize != 0 && int64(sb.BlockSize) != args.BlockSize {
+			t.Errorf("%+v: expected %d byte blocks, got %d", args, args.BlockSize, sb.BlockSize)
+		}
+
+		if args.InodeSize != 0 && int64(sb.InodeSize) != args.InodeSize {
+			t.Errorf("%+v: expected %d byte inodes, got %d", args, args.InodeSize, sb.InodeSize)
+		}
+
+		if x := int64(sb.BlockSize) << sb.DirectoryBlocksLogarithmic; x != p.directoryBlockSize() {
+			t.Errorf("%+v: superblock has %d byte directory blocks", args, x)
+		}
+
+		if x := int64(sb.AGBlocks) * int64(sb.BlockSize); x < 0x1000000 {
+			t.Errorf("%+v: alloc groups are %d bytes, smaller than XFS allows", args, x)
+		}
+
+		if sb.VersionNum&VersionAlignBit != 0 && int64(sb.InodeChunkAlignment)*int64(sb.BlockSize) != inodeClusterSize {
+			t.Errorf("%+v: inode chunks are aligned to %d blocks", args, sb.InodeChunkAlignment)
+		}
+
+		if sb.InodeChunkAlignment != 0 && sb.LogBlocks%sb.InodeChunkAlignment != 0 {
+			t.Errorf("%+v: journal of %d blocks misaligns the inodes", args, sb.LogBlocks)
+		}
+
+	}
+
+}
+
+func TestParallelCompile(t *testing.T) {
+
+	// if direct, the file-system is compiled into a file that the workers
+	// write metadata to directly
+	compile := func(workers int, direct bool) []byte {
+
+		tree := vio.NewFileTree()
+		for i := 0; i < 300; i++ {
+			name := fmt.Sprintf("dir%d/file%d", i%7, i)
+			data := strings.Repeat(fmt.Sprintf("%d", i), i*50)
+			err := tree.Map(name, vio.CustomFile(vio.CustomFileArgs{
+				Name:       path.Base(name),
+				Size:       len(data),
+				ReadCloser: ioutil.NopCloser(strings.NewReader(data)),
+			}))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		c := NewCompiler(&CompilerArgs{
+			FileTree: tree,
+			Logger:   &elog.CLI{},
+			UUID:     [16]byte{1},
+			Workers:  workers,
+		})
+
+		ctx := context.Background()
+		err := c.Commit(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// big enough for several alloc groups
+		err = c.Precompile(ctx, 0x4000000)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if c.compiler.allocGroups < 2 {
+			t.Fatalf("expected more than one alloc group, got %d", c.compiler.allocGroups)
+		}
+
+		if !direct {
+			buf := new(bytes.Buffer)
+			w, err := vio.WriteSeeker(struct{ io.Writer }{buf})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = c.Compile(ctx, w)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			return buf.Bytes()
+		}
+
+		f, err := ioutil.TempFile("", "xfs")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(f.Name())
+		defer f.Close()
+
+		err = c.Compile(ctx, f)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = f.Truncate(0x4000000)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		data, err := ioutil.ReadAll(io.NewSectionReader(f, 0, 0x4000000))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return data
+
+	}
+
+	serial := compile(1, false)
+
+	if !bytes.Equal(serial, compile(4, false)) {
+		t.Errorf("file-system compiled with workers but in order differs from the serial build")
+	}
+
+	if !bytes.Equal(serial, compile(4, true)) {
+		t.Errorf("file-system written in parallel differs from the serial build")
+	}
+
+}
+
+func TestStreamedDirectory(t *testing.T) {
+
+	compile := func(maxMemory int64) []byte {
+
+		tree := vio.NewFileTree()
+		for i := 0; i < 3000; i++ {
+			name := fmt.Sprintf("dir/a-rather-long-file-name-%d", i)
+			err := tree.Map(name, vio.CustomFile(vio.CustomFileArgs{
+				Name:       path.Base(name),
+				ReadCloser: ioutil.NopCloser(strings.NewReader("")),
+			}))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		c := NewCompiler(&CompilerArgs{
+			FileTree:  tree,
+			Logger:    &elog.CLI{},
+			UUID:      [16]byte{1},
+			MaxMemory: maxMemory,
+		})
+
+		ctx := context.Background()
+		err := c.Commit(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = c.Precompile(ctx, 0x4000000)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		buf := new(bytes.Buffer)
+		w, err := vio.WriteSeeker(struct{ io.Writer }{buf})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = c.Compile(ctx, w)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return buf.Bytes()
+
+	}
+
+	// a directory this big has to be in node format, and the smallest
+	// memory cap streams it
+	if !bytes.Equal(compile(0), compile(1)) {
+		t.Errorf("file-system with a streamed directory differs from one generated all at once")
+	}
+
+}
+
+func TestInodeBTree(t *testing.T) {
+
+	for _, args := range []CompilerArgs{
+		{BlockSize: 0x200, InodeSize: 0x100},
+		{},
+	} {
+
+		tree := vio.NewFileTree()
+
+		for i := 0; i < 20000; i++ {
+			name := fmt.Sprintf("dir%d/file%d", i/1000, i)
+			err := tree.Map(name, vio.CustomFile(vio.CustomFileArgs{
+				Name:       path.Base(name),
+				ReadCloser: ioutil.NopCloser(strings.NewReader("")),
+			}))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		args.FileTree = tree
+		args.Logger = &elog.CLI{}
+		c := NewCompiler(&args)
+
+		ctx := context.Background()
+		err := c.Commit(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = c.Precompile(ctx, c.MinimumSize())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		f, err := ioutil.TempFile("", "xfs")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(f.Name())
+		defer f.Close()
+
+		err = c.Compile(ctx, f)
+		if err != nil {
+			t.Fatalf("%+v: %v", args, err)
+		}
+
+		sb := new(SuperBlock)
+		err = binary.Read(io.NewSectionReader(f, 0, 0x200), binary.BigEndian, sb)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		bs := int64(sb.BlockSize)
+		pc := c.compiler
+		deep := false
+
+		for ag := int64(0); ag < int64(sb.AGCount); ag++ {
+
+			offset := ag * int64(sb.AGBlocks) * bs
+
+			agi := new(AGI)
+			err = binary.Read(io.NewSectionReader(f, offset+2*int64(sb.SectorSize), 0x200), binary.BigEndian, agi)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if agi.Level > 1 {
+				deep = true
+			}
+
+			var recs []InodeBTRecord
+			var walk func(addr uint32, level uint16, key uint32)
+			walk = func(addr uint32, level uint16, key uint32) {
+
+				r := io.NewSectionReader(f, offset+int64(addr)*bs, bs)
+				hdr := new(BTreeSBlock)
+				err := binary.Read(r, binary.BigEndian, hdr)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if hdr.Magic != IBTMagicNumber || hdr.Level != level || hdr.NumRecs == 0 {
+					t.Fatalf("ag %d: bad inode b+ tree block %d: %+v", ag, addr, hdr)
+				}
+
+				if level == 0 {
+					x := make([]InodeBTRecord, hdr.NumRecs)
+					err = binary.Read(r, binary.BigEndian, x)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if x[0].StartIno != key {
+						t.Errorf("ag %d: block %d starts at inode %d, keyed as %d", ag, addr, x[0].StartIno, key)
+					}
+					recs = append(recs, x...)
+					return
+				}
+
+				max := (bs - 16) / 8
+				keys := make([]uint32, max)
+				ptrs := make([]uint32, max)
+				err = binary.Read(r, binary.BigEndian, keys)
+				if err != nil {
+					t.Fatal(err)
+				}
+				err = binary.Read(r, binary.BigEndian, ptrs)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				for i := 0; i < int(hdr.NumRecs); i++ {
+					walk(ptrs[i], level-1, keys[i])
+				}
+
+			}
+
+			walk(agi.Root, uint16(agi.Level-1), uint32(pc.translateRelativeInodeNumber(ag*pc.inodesPerAllocGroup())))
+
+			if int64(len(recs))*64 != pc.inodesPerAllocGroup() {
+				t.Fatalf("ag %d: inode b+ tree has %d records for %d inodes", ag, len(recs), pc.inodesPerAllocGroup())
+			}
+
+			var free uint32
+			for i, rec := range recs {
+				expect := uint32(pc.translateRelativeInodeNumber(int64(i)*64 + ag*pc.inodesPerAllocGroup()))
+				if rec.StartIno != expect {
+					t.Errorf("ag %d: record %d starts at inode %d, expected %d", ag, i, rec.StartIno, expect)
+				}
+				free += rec.FreeCount
+			}
+
+			if free != agi.FreeCount {
+				t.Errorf("ag %d: inode b+ tree has %d free inodes, expected %d", ag, free, agi.FreeCount)
+			}
+
+			if agi.Root != uint32(pc.superMetaBlocks()) || int64(sb.LogStart) != pc.headerBlocks() {
+				t.Errorf("ag %d: unexpected layout", ag)
+			}
+
+		}
+
+		if !deep {
+			t.Errorf("%+v: no alloc group needed a deep inode b+ tree", args)
+		}
+
+	}
+
+}
+
+func TestQuotas(t *testing.T) {
+
+	tree := vio.NewFileTree()
+	defer tree.Close()
+
+	for name, size := range map[string]int{
+		"data/a":     5000,
+		"data/sub/b": 10,
+		"other/c":    10,
+	} {
+		args := vio.CustomFileArgs{
+			Name:       path.Base(name),
+			Size:       size,
+			ReadCloser: ioutil.NopCloser(bytes.NewReader(make([]byte, size))),
+		}
+		if name == "other/c" {
+			args.Ownership = &vio.Ownership{UID: 2000, GID: 2000, Mode: 0644}
+		}
+		err := tree.Map(name, vio.CustomFile(args))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c := NewCompiler(&CompilerArgs{
+		FileTree: tree,
+		Logger:   &elog.CLI{},
+		Quotas: []Quota{
+			{Type: UserQuota, Space: 0x100000},
+			{Type: UserQuota, ID: 2000, Inodes: 10},
+			{Type: ProjectQuota, ID: 70000, Path: "/data", Space: 0x100000},
+		},
+	})
+
+	ctx := context.Background()
+	err := c.Commit(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seqs := make(map[string]int64)
+	err = tree.WalkNode(func(name string, n *vio.TreeNode) error {
+		seqs[path.Clean(name)] = n.NodeSequenceNumber
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = c.Precompile(ctx, c.MinimumSize())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := ioutil.TempFile("", "xfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	err = c.Compile(ctx, f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sb := new(SuperBlock)
+	err = binary.Read(io.NewSectionReader(f, 0, 0x200), binary.BigEndian, sb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if sb.VersionNum&VersionQuotaBit == 0 || sb.MoreFeatures&Version2ProjID32Bit == 0 {
+		t.Errorf("missing quota or 32-bit project id features")
+	}
+
+	flags := uint16(QuotaUserAccounting | QuotaUserEnforced | QuotaUserChecked | QuotaProjectAccounting | QuotaOtherEnforced | QuotaOtherChecked)
+	if sb.QuotaFlags != flags {
+		t.Errorf("expected quota flags %#x, got %#x", flags, sb.QuotaFlags)
+	}
+
+	pc := c.compiler
+	bs := pc.blockSize()
+
+	inode := func(seq int64) *InodeCore {
+		core := new(InodeCore)
+		err := binary.Read(io.NewSectionReader(f, int64(pc.translateRelativeInodeNumber(seq))*pc.inodeSize(), pc.inodeSize()), binary.BigEndian, core)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return core
+	}
+
+	// dquots reads every dquot in a quota inode, by id
+	dquots := func(ino uint64) map[uint32]*Dquot {
+
+		seq := int64(ino)
+		core := inode(seq)
+		if core.Mode != 0x8000 || core.Format != InodeFormatExtents || core.UID != 0 {
+			t.Fatalf("quota inode %d isn't a regular file owned by root: %+v", ino, core)
+		}
+
+		r := io.NewSectionReader(f, int64(pc.translateRelativeInodeNumber(seq))*pc.inodeSize()+100, int64(core.NExtents)*16)
+		extents := make([][2]uint64, core.NExtents)
+		err := binary.Read(r, binary.BigEndian, extents)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		perBlock := bs / DquotBlockSize
+		found := make(map[uint32]*Dquot)
+		for _, e := range extents {
+			offset := (e[0] & 0x7FFFFFFFFFFFFFFF) >> 9
+			first := (e[0]&0x1FF)<<43 | e[1]>>21
+			length := e[1] & 0x1FFFFF
+			ag := first >> pc.exponents.blocksPerAllocGroup
+			block := int64(ag)*pc.blocksPerAllocGroup() + int64(first&(1<<pc.exponents.blocksPerAllocGroup-1))
+			for i := int64(0); i < int64(length); i++ {
+				for j := int64(0); j < perBlock; j++ {
+					d := new(Dquot)
+					err = binary.Read(io.NewSectionReader(f, (block+i)*bs+j*DquotBlockSize, DquotBlockSize), binary.BigEndian, d)
+					if err != nil {
+						t.Fatal(err)
+					}
+					id := uint32((int64(offset)+i)*perBlock + j)
+					if d.Magic != DquotMagicNumber || d.Version != DquotVersion || d.ID != id {
+						t.Fatalf("quota inode %d: bad dquot for id %d: %+v", ino, id, d)
+					}
+					found[id] = d
+				}
+			}
+		}
+
+		return found
+	}
+
+	users := dquots(sb.UserQuotasInode)
+	if d := users[0]; d.Type != DquotTypeUser || d.BlockHardLimit != uint64(0x100000/bs) {
+		t.Errorf("bad default user dquot: %+v", d)
+	}
+	if d := users[2000]; d.InodeHardLimit != 10 || d.InodeCount != 1 || d.BlockCount != 1 {
+		t.Errorf("bad user 2000 dquot: %+v", d)
+	}
+
+	projects := dquots(sb.GroupQuotasInode)
+	if d := projects[70000]; d.Type != DquotTypeProject || d.InodeCount != 4 || d.BlockCount != 3 || d.BlockHardLimit != uint64(0x100000/bs) {
+		t.Errorf("bad project 70000 dquot: %+v", d)
+	}
+
+	for name, project := range map[string]uint32{
+		".":          0,
+		"data":       70000,
+		"data/sub":   70000,
+		"data/sub/b": 70000,
+		"other":      0,
+	} {
+		core := inode(seqs[name])
+		if x := uint32(core.ProjIDHigh)<<16 | uint32(core.ProjIDLow); x != project {
+			t.Errorf("'%s' has project %d, expected %d", name, x, project)
+		}
+		inherit := core.Flags&InodeFlagProjInherit != 0
+		if inherit != (project != 0 && core.Mode&0xF000 == 0x4000) {
+			t.Errorf("'%s' has the wrong project inherit flag", name)
+		}
+	}
+
+	// quotas can't start out exceeded
+	tree2 := vio.NewFileTree()
+	defer tree2.Close()
+	c = NewCompiler(&CompilerArgs{
+		FileTree: tree2,
+		Logger:   &elog.CLI{},
+		Quotas:   []Quota{{Type: UserQuota, ID: 1000, Inodes: 1}},
+	})
+	err = tree2.Map("a", vio.CustomFile(vio.CustomFileArgs{Name: "a", ReadCloser: ioutil.NopCloser(strings.NewReader(""))}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Commit(ctx)
+	if err == nil {
+		t.Errorf("expected an error for an exceeded quota")
+	}
+
+}